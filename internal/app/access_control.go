@@ -0,0 +1,138 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+)
+
+// AccessConfig restricts the addresses clients may connect from. The ranges of
+// the listeners are checked as connections are accepted, those of the users
+// once clients send their startup message.
+type AccessConfig struct {
+	// Allow and Deny are the CIDR ranges the clients of the default listener may
+	// and may not connect from, see domain.AccessList; the other listeners have
+	// their own in ListenerConfig
+	Allow []string
+	Deny  []string
+
+	// Users restricts the addresses some users may log in from, whatever the listener
+	Users []UserAccessConfig
+}
+
+// UserAccessConfig restricts the addresses a user may log in from
+type UserAccessConfig struct {
+	User  string
+	Allow []string
+	Deny  []string
+}
+
+// Enabled reports whether access is restricted, by config or by one of listeners
+func (c AccessConfig) Enabled(listeners []ListenerConfig) bool {
+	if len(c.Allow) > 0 || len(c.Deny) > 0 || len(c.Users) > 0 {
+		return true
+	}
+	for _, listener := range listeners {
+		if len(listener.Allow) > 0 || len(listener.Deny) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the address lists, global and per user, and that every user
+// is named once
+func (c AccessConfig) Validate() error {
+	if _, err := domain.ParseAccessList(c.Allow, c.Deny); err != nil {
+		return fmt.Errorf("access: %w", err)
+	}
+	users := make(map[string]bool, len(c.Users))
+	for _, user := range c.Users {
+		if user.User == "" {
+			return fmt.Errorf("access: user name is required")
+		}
+		if users[user.User] {
+			return fmt.Errorf("access: user %q is listed twice", user.User)
+		}
+		users[user.User] = true
+		if _, err := domain.ParseAccessList(user.Allow, user.Deny); err != nil {
+			return fmt.Errorf("access of user %s: %w", user.User, err)
+		}
+	}
+	return nil
+}
+
+// AccessControl implements domain.AccessController with the access lists of
+// the listeners and users, emitting a connection_rejected event for each
+// connection it rejects
+type AccessControl struct {
+	listeners map[string]domain.AccessList // by listener name, empty for the default one
+	users     map[string]domain.AccessList
+	events    domain.EventSink
+	clock     domain.Clock
+}
+
+// NewAccessControl creates an AccessControl from the access lists of config
+// and of listeners
+func NewAccessControl(config AccessConfig, listeners []ListenerConfig, events domain.EventSink, clock domain.Clock) (*AccessControl, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	control := &AccessControl{
+		listeners: make(map[string]domain.AccessList),
+		users:     make(map[string]domain.AccessList),
+		events:    events,
+		clock:     clock,
+	}
+	control.listeners[""], _ = domain.ParseAccessList(config.Allow, config.Deny)
+	for _, listener := range listeners {
+		list, err := domain.ParseAccessList(listener.Allow, listener.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("access of listener %s: %w", listener.Name, err)
+		}
+		control.listeners[listener.Name] = list
+	}
+	for _, user := range config.Users {
+		control.users[user.User], _ = domain.ParseAccessList(user.Allow, user.Deny)
+	}
+	return control, nil
+}
+
+// AdmitAddress reports whether the access list of the listener admits addr
+func (c *AccessControl) AdmitAddress(listener string, addr net.Addr) bool {
+	if c.listeners[listener].Admits(addr) {
+		return true
+	}
+	c.reject(listener, "", addr, "listener")
+	return false
+}
+
+// AdmitUser reports whether the access list of the user, if any, admits addr
+func (c *AccessControl) AdmitUser(listener, user string, addr net.Addr) bool {
+	list, ok := c.users[user]
+	if !ok || list.Admits(addr) {
+		return true
+	}
+	c.reject(listener, user, addr, "user")
+	return false
+}
+
+// reject reports a connection rejected by the access list of scope, listener or user
+func (c *AccessControl) reject(listener, user string, addr net.Addr, scope string) {
+	if c.events == nil {
+		return
+	}
+	fields := map[string]interface{}{
+		"listener":    listener,
+		"client_addr": addr.String(),
+		"access_list": scope,
+	}
+	if user != "" {
+		fields["user"] = user
+	}
+	c.events.Emit(domain.Event{
+		Type:      domain.EventConnectionRejected,
+		Timestamp: c.clock.Now(),
+		Fields:    fields,
+	})
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessControl(t *testing.T) {
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	events := &mocks.RecordingEventSink{}
+	access, err := NewAccessControl(AccessConfig{
+		Deny:  []string{"203.0.113.0/24"},
+		Users: []UserAccessConfig{{User: "etl", Allow: []string{"10.30.0.0/16", "192.0.2.7"}}},
+	}, []ListenerConfig{{Name: "analytics", Allow: []string{"10.20.0.0/16"}, Deny: []string{"10.20.9.0/24"}}}, events, clock)
+	require.NoError(t, err)
+
+	addr := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000} }
+	assert.True(t, access.AdmitAddress("", addr("10.1.2.3")))
+	assert.False(t, access.AdmitAddress("", addr("203.0.113.9")))
+	assert.True(t, access.AdmitAddress("analytics", addr("10.20.1.1")))
+	assert.False(t, access.AdmitAddress("analytics", addr("10.20.9.1")), "Deny ranges should win over allow ranges")
+	assert.False(t, access.AdmitAddress("analytics", addr("10.1.2.3")), "Addresses outside the allow ranges should be rejected")
+	assert.True(t, access.AdmitAddress("analytics", addr("::ffff:10.20.1.1")), "IPv4-mapped addresses should match IPv4 ranges")
+	assert.True(t, access.AdmitAddress("analytics", &net.UnixAddr{Name: "/tmp/.s.PGSQL.5432", Net: "unix"}))
+
+	assert.True(t, access.AdmitUser("", "etl", addr("10.30.0.1")))
+	assert.True(t, access.AdmitUser("", "etl", addr("192.0.2.7")))
+	assert.False(t, access.AdmitUser("", "etl", addr("192.0.2.8")))
+	assert.True(t, access.AdmitUser("", "alice", addr("192.0.2.8")), "Users without an access list should be admitted")
+
+	rejected := events.EventsOfType(domain.EventConnectionRejected)
+	require.Len(t, rejected, 4)
+	assert.Equal(t, map[string]interface{}{"listener": "", "client_addr": "203.0.113.9:40000", "access_list": "listener"}, rejected[0].Fields)
+	assert.Equal(t, clock.Now(), rejected[0].Timestamp)
+	assert.Equal(t, map[string]interface{}{"listener": "", "client_addr": "192.0.2.8:40000", "access_list": "user", "user": "etl"}, rejected[3].Fields)
+
+	for _, config := range []AccessConfig{
+		{Allow: []string{"10.0.0.0/33"}},
+		{Deny: []string{"pgbouncer.internal"}},
+		{Users: []UserAccessConfig{{Allow: []string{"10.0.0.0/8"}}}},
+		{Users: []UserAccessConfig{{User: "etl"}, {User: "etl"}}},
+	} {
+		assert.Error(t, config.Validate(), "%+v", config)
+	}
+	_, err = NewAccessControl(AccessConfig{}, []ListenerConfig{{Name: "analytics", Deny: []string{"10.0.0.300"}}}, events, clock)
+	assert.Error(t, err)
+}
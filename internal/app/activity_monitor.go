@@ -0,0 +1,211 @@
+package app
+
+import (
+	"context"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultActivityWindow is how far back query rates are averaged
+	DefaultActivityWindow = 10 * time.Second
+
+	// DefaultRecentDenials is how many denials an ActivityMonitor remembers
+	DefaultRecentDenials = 50
+)
+
+// PrincipalActivity is the recent traffic of a user and database
+type PrincipalActivity struct {
+	User             string
+	Database         string
+	Queries          int64 // evaluated within the window
+	Denied           int64 // denied within the window
+	QueriesPerSecond float64
+}
+
+// Denial is a query the policy engines denied
+type Denial struct {
+	Time         time.Time
+	ConnectionID string
+	User         string
+	Database     string
+	Policy       string
+	Reason       string
+}
+
+// Activity is a snapshot of recent traffic
+type Activity struct {
+	Window     time.Duration
+	Principals []PrincipalActivity // busiest first
+	Denials    []Denial            // most recent first
+}
+
+// activityCounter counts queries and denials in one-second buckets
+type activityCounter struct {
+	queries []int64
+	denied  []int64
+	last    int64 // Unix second of the newest bucket
+}
+
+// advance moves the counter to the second now, clearing the buckets it skips
+func (c *activityCounter) advance(now int64) {
+	size := int64(len(c.queries))
+	if now <= c.last {
+		return
+	}
+	for second := max(c.last+1, now-size+1); second <= now; second++ {
+		c.queries[second%size] = 0
+		c.denied[second%size] = 0
+	}
+	c.last = now
+}
+
+// sum returns the queries and denials of the buckets
+func (c *activityCounter) sum() (queries, denied int64) {
+	for i := range c.queries {
+		queries += c.queries[i]
+		denied += c.denied[i]
+	}
+	return queries, denied
+}
+
+// ActivityMonitor is a domain.PolicyEngine decorator that measures the query rate of
+// each principal and keeps the latest denials, so operators can watch a running
+// server. It never changes decisions.
+type ActivityMonitor struct {
+	next   domain.PolicyEngine
+	clock  domain.Clock
+	window time.Duration
+
+	mu         sync.Mutex
+	principals map[principalKey]*activityCounter
+	denials    []Denial // ring buffer
+	nextDenial int
+	lastSweep  int64
+}
+
+// NewActivityMonitor creates an ActivityMonitor observing the decisions of next
+func NewActivityMonitor(next domain.PolicyEngine, clock domain.Clock) *ActivityMonitor {
+	return &ActivityMonitor{
+		next:       next,
+		clock:      clock,
+		window:     DefaultActivityWindow,
+		principals: make(map[principalKey]*activityCounter),
+		denials:    make([]Denial, 0, DefaultRecentDenials),
+	}
+}
+
+// Evaluate returns the decision of the wrapped engine and records it
+func (m *ActivityMonitor) Evaluate(ctx context.Context, query *domain.Query) (domain.Decision, error) {
+	decision, err := m.next.Evaluate(ctx, query)
+	if err != nil {
+		return decision, err
+	}
+
+	m.observe(query, decision)
+	return decision, nil
+}
+
+// RecordUsage forwards statement usage to the wrapped engine when it has metered quotas
+func (m *ActivityMonitor) RecordUsage(ctx context.Context, query *domain.Query, usage domain.StatementUsage) error {
+	if recorder, ok := m.next.(domain.UsageRecorder); ok {
+		return recorder.RecordUsage(ctx, query, usage)
+	}
+	return nil
+}
+
+// observe counts the decision and remembers it when it is a denial
+func (m *ActivityMonitor) observe(query *domain.Query, decision domain.Decision) {
+	now := m.clock.Now()
+	second := now.Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep(second)
+
+	key := principalKey{user: query.UserID, database: query.Database}
+	counter, ok := m.principals[key]
+	if !ok {
+		buckets := int(m.window / time.Second)
+		counter = &activityCounter{queries: make([]int64, buckets), denied: make([]int64, buckets), last: second}
+		m.principals[key] = counter
+	}
+	counter.advance(second)
+	bucket := second % int64(len(counter.queries))
+	counter.queries[bucket]++
+	if decision.Allowed() {
+		return
+	}
+	counter.denied[bucket]++
+
+	denial := Denial{
+		Time:         now,
+		ConnectionID: query.ConnectionID,
+		User:         query.UserID,
+		Database:     query.Database,
+		Policy:       decision.Policy,
+		Reason:       decision.Reason,
+	}
+	if len(m.denials) < cap(m.denials) {
+		m.denials = append(m.denials, denial)
+	} else {
+		m.denials[m.nextDenial] = denial
+	}
+	m.nextDenial = (m.nextDenial + 1) % cap(m.denials)
+}
+
+// sweep drops principals without queries in the window, at most once per window
+func (m *ActivityMonitor) sweep(now int64) {
+	size := int64(m.window / time.Second)
+	if now-m.lastSweep < size {
+		return
+	}
+	m.lastSweep = now
+
+	for key, counter := range m.principals {
+		if now-counter.last >= size {
+			delete(m.principals, key)
+		}
+	}
+}
+
+// Activity returns the query rates of the principals active within the window
+// and the latest denials
+func (m *ActivityMonitor) Activity() Activity {
+	second := m.clock.Now().Unix()
+
+	m.mu.Lock()
+	activity := Activity{Window: m.window}
+	for key, counter := range m.principals {
+		counter.advance(second)
+		queries, denied := counter.sum()
+		if queries == 0 {
+			continue
+		}
+		activity.Principals = append(activity.Principals, PrincipalActivity{
+			User:             key.user,
+			Database:         key.database,
+			Queries:          queries,
+			Denied:           denied,
+			QueriesPerSecond: float64(queries) / m.window.Seconds(),
+		})
+	}
+	for i := 1; i <= len(m.denials); i++ {
+		activity.Denials = append(activity.Denials, m.denials[(m.nextDenial-i+len(m.denials))%len(m.denials)])
+	}
+	m.mu.Unlock()
+
+	sort.Slice(activity.Principals, func(i, j int) bool {
+		a, b := activity.Principals[i], activity.Principals[j]
+		if a.Queries != b.Queries {
+			return a.Queries > b.Queries
+		}
+		if a.User != b.User {
+			return a.User < b.User
+		}
+		return a.Database < b.Database
+	})
+	return activity
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActivityMonitor(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	monitor := NewActivityMonitor(userDenyingPolicyEngine{user: "bob"}, clock)
+
+	for i := 0; i < 20; i++ {
+		decision, err := monitor.Evaluate(ctx, newPrincipalQuery("alice"))
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed())
+	}
+	clock.Advance(5 * time.Second)
+	for i := 0; i < 5; i++ {
+		decision, err := monitor.Evaluate(ctx, newPrincipalQuery("bob"))
+		require.NoError(t, err)
+		assert.False(t, decision.Allowed(), "Decisions should pass through unchanged")
+	}
+
+	activity := monitor.Activity()
+	require.Len(t, activity.Principals, 2)
+	assert.Equal(t, PrincipalActivity{User: "alice", Database: "app", Queries: 20, QueriesPerSecond: 2}, activity.Principals[0])
+	assert.Equal(t, PrincipalActivity{User: "bob", Database: "app", Queries: 5, Denied: 5, QueriesPerSecond: 0.5}, activity.Principals[1])
+	require.Len(t, activity.Denials, 5)
+	assert.Equal(t, "tight", activity.Denials[0].Policy)
+	assert.Equal(t, "conn_bob", activity.Denials[0].ConnectionID)
+
+	clock.Advance(6 * time.Second)
+	activity = monitor.Activity()
+	require.Len(t, activity.Principals, 1, "Queries older than the window should no longer count")
+	assert.Equal(t, "bob", activity.Principals[0].User)
+	assert.Len(t, activity.Denials, 5, "Denials are kept beyond the window")
+}
+
+func TestActivityMonitor_KeepsLatestDenials(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	monitor := NewActivityMonitor(userDenyingPolicyEngine{user: "bob"}, clock)
+
+	for i := 0; i < DefaultRecentDenials+5; i++ {
+		clock.Advance(time.Millisecond)
+		_, err := monitor.Evaluate(ctx, newPrincipalQuery("bob"))
+		require.NoError(t, err)
+	}
+
+	denials := monitor.Activity().Denials
+	require.Len(t, denials, DefaultRecentDenials)
+	assert.Equal(t, clock.Now(), denials[0].Time, "The latest denial should come first")
+	assert.True(t, denials[0].Time.After(denials[len(denials)-1].Time))
+}
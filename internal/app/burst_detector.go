@@ -0,0 +1,177 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sync"
+	"time"
+)
+
+// BurstPolicyName is the decision policy reported when the burst limit denies a query
+const BurstPolicyName = "query_burst"
+
+// BurstDetectorConfig configures detection of repeated identical queries (N+1 patterns)
+type BurstDetectorConfig struct {
+	// Threshold is the number of identical queries from one connection within
+	// Interval that counts as a burst; zero disables detection
+	Threshold int
+
+	// Interval is the length of the detection window
+	Interval time.Duration
+
+	// Limit, when positive, denies identical queries beyond this many per Interval
+	// on a connection
+	Limit int
+}
+
+// Enabled reports whether burst detection is configured
+func (c BurstDetectorConfig) Enabled() bool {
+	return c.Threshold > 0 || c.Limit > 0
+}
+
+// Validate checks that the threshold and limit are not negative and that an
+// enabled detector has an interval
+func (c BurstDetectorConfig) Validate() error {
+	if c.Threshold < 0 || c.Limit < 0 {
+		return fmt.Errorf("burst threshold and limit must not be negative")
+	}
+	if c.Enabled() && c.Interval <= 0 {
+		return fmt.Errorf("burst interval must be positive")
+	}
+	return nil
+}
+
+// burstKey identifies a fingerprint on a connection
+type burstKey struct {
+	connectionID string
+	hash         string
+}
+
+// burstWindow counts identical queries within one detection window
+type burstWindow struct {
+	start    time.Time
+	count    int
+	reported bool
+}
+
+// BurstDetector is a domain.PolicyEngine decorator that detects bursts of identical
+// fingerprints from a single connection, emits a query_burst event once per window,
+// and optionally rate limits them before the wrapped engine is consulted.
+type BurstDetector struct {
+	config BurstDetectorConfig
+	next   domain.PolicyEngine
+	events domain.EventSink
+	clock  domain.Clock
+
+	mu        sync.Mutex
+	windows   map[burstKey]*burstWindow
+	lastSweep time.Time
+}
+
+// NewBurstDetector creates a BurstDetector in front of next, which may be nil
+func NewBurstDetector(config BurstDetectorConfig, next domain.PolicyEngine, events domain.EventSink, clock domain.Clock) (*BurstDetector, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &BurstDetector{
+		config:  config,
+		next:    next,
+		events:  events,
+		clock:   clock,
+		windows: make(map[burstKey]*burstWindow),
+	}, nil
+}
+
+// Evaluate records the query's fingerprint and denies it when the burst limit is exceeded;
+// otherwise the decision of the wrapped engine is returned
+func (d *BurstDetector) Evaluate(ctx context.Context, query *domain.Query) (domain.Decision, error) {
+	if hash := query.Hash.Value(); hash != "" {
+		if decision, limited := d.observe(query, hash); limited {
+			return decision, nil
+		}
+	}
+
+	if d.next == nil {
+		return domain.AllowDecision(), nil
+	}
+	return d.next.Evaluate(ctx, query)
+}
+
+// RecordUsage forwards statement usage to the wrapped engine when it has metered quotas
+func (d *BurstDetector) RecordUsage(ctx context.Context, query *domain.Query, usage domain.StatementUsage) error {
+	if recorder, ok := d.next.(domain.UsageRecorder); ok {
+		return recorder.RecordUsage(ctx, query, usage)
+	}
+	return nil
+}
+
+// observe counts the query and reports a deny decision when it exceeds the limit
+func (d *BurstDetector) observe(query *domain.Query, hash string) (domain.Decision, bool) {
+	now := d.clock.Now()
+
+	d.mu.Lock()
+	d.sweep(now)
+
+	key := burstKey{connectionID: query.ConnectionID, hash: hash}
+	window, ok := d.windows[key]
+	if !ok || now.Sub(window.start) >= d.config.Interval {
+		window = &burstWindow{start: now}
+		d.windows[key] = window
+	}
+	window.count++
+	count := window.count
+	start := window.start
+
+	report := d.config.Threshold > 0 && count >= d.config.Threshold && !window.reported
+	if report {
+		window.reported = true
+	}
+	d.mu.Unlock()
+
+	limited := d.config.Limit > 0 && count > d.config.Limit
+
+	if report && d.events != nil {
+		d.events.Emit(domain.Event{
+			Type:         domain.EventQueryBurst,
+			Timestamp:    now,
+			ConnectionID: query.ConnectionID,
+			Fields: map[string]interface{}{
+				"fingerprint": hash,
+				"normalized":  query.Normalized,
+				"count":       count,
+				"interval":    d.config.Interval.String(),
+				"user":        query.UserID,
+				"database":    query.Database,
+				"limited":     limited,
+			},
+		})
+	}
+
+	if !limited {
+		return domain.Decision{}, false
+	}
+
+	return domain.Decision{
+		Action:  domain.DecisionDeny,
+		Policy:  BurstPolicyName,
+		Reason:  fmt.Sprintf("query repeated %d times within %s (limit %d); batch it instead of issuing one query per row", count, d.config.Interval, d.config.Limit),
+		Limit:   int64(d.config.Limit),
+		Used:    int64(count - 1),
+		ResetAt: start.Add(d.config.Interval),
+	}, true
+}
+
+// sweep drops expired windows at most once per interval so closed connections do not leak
+func (d *BurstDetector) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < d.config.Interval {
+		return
+	}
+	d.lastSweep = now
+
+	for key, window := range d.windows {
+		if now.Sub(window.start) >= d.config.Interval {
+			delete(d.windows, key)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFingerprintedQuery(connectionID, hash string) *domain.Query {
+	query := domain.NewQuery("SELECT * FROM users WHERE id = 1", connectionID)
+	query.Normalized = "SELECT * FROM users WHERE id = $1"
+	query.Hash = domain.NewQueryHash(hash)
+	return query
+}
+
+func TestBurstDetector_ReportsOncePerWindow(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	events := &mocks.RecordingEventSink{}
+
+	detector, err := NewBurstDetector(BurstDetectorConfig{Threshold: 3, Interval: time.Second}, nil, events, clock)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		decision, err := detector.Evaluate(ctx, newFingerprintedQuery("conn_1", "abc"))
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed(), "Detection alone never denies")
+	}
+
+	// Other connections and fingerprints are counted separately
+	_, err = detector.Evaluate(ctx, newFingerprintedQuery("conn_2", "abc"))
+	require.NoError(t, err)
+	_, err = detector.Evaluate(ctx, newFingerprintedQuery("conn_1", "def"))
+	require.NoError(t, err)
+
+	bursts := events.EventsOfType(domain.EventQueryBurst)
+	require.Len(t, bursts, 1)
+	assert.Equal(t, "conn_1", bursts[0].ConnectionID)
+	assert.Equal(t, "abc", bursts[0].Fields["fingerprint"])
+	assert.Equal(t, 3, bursts[0].Fields["count"])
+
+	clock.Advance(time.Second)
+	for i := 0; i < 3; i++ {
+		_, err := detector.Evaluate(ctx, newFingerprintedQuery("conn_1", "abc"))
+		require.NoError(t, err)
+	}
+	assert.Len(t, events.EventsOfType(domain.EventQueryBurst), 2, "A new window should report again")
+}
+
+func TestBurstDetector_Limit(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	next := &mocks.StaticPolicyEngine{}
+
+	detector, err := NewBurstDetector(BurstDetectorConfig{Interval: time.Second, Limit: 2}, next, nil, clock)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		decision, err := detector.Evaluate(ctx, newFingerprintedQuery("conn_1", "abc"))
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed())
+	}
+
+	decision, err := detector.Evaluate(ctx, newFingerprintedQuery("conn_1", "abc"))
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed())
+	assert.Equal(t, BurstPolicyName, decision.Policy)
+	assert.Equal(t, clock.Now().Add(time.Second), decision.ResetAt)
+	assert.Len(t, next.Queries(), 2, "Limited queries should not reach the wrapped engine")
+
+	// Queries without a fingerprint are never limited
+	unfingerprinted := domain.NewQuery("SELEC broken", "conn_1")
+	decision, err = detector.Evaluate(ctx, unfingerprinted)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed())
+
+	clock.Advance(time.Second)
+	decision, err = detector.Evaluate(ctx, newFingerprintedQuery("conn_1", "abc"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed(), "The limit should reset with the window")
+}
+
+func TestBurstDetectorConfig_Validate(t *testing.T) {
+	assert.NoError(t, BurstDetectorConfig{}.Validate())
+	assert.NoError(t, BurstDetectorConfig{Threshold: 10, Interval: time.Second}.Validate())
+	assert.Error(t, BurstDetectorConfig{Threshold: 10}.Validate())
+	assert.Error(t, BurstDetectorConfig{Limit: -1, Interval: time.Second}.Validate())
+}
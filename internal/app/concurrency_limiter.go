@@ -0,0 +1,185 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sync"
+)
+
+// concurrencySlots are the statements a principal runs under a policy with a
+// concurrency cap, and those queued for a slot
+type concurrencySlots struct {
+	limit   int64
+	running map[string]int       // statements in flight, by connection
+	waiting []*concurrencyWaiter // in arrival order
+}
+
+// concurrencyWaiter is a statement queued for a slot
+type concurrencyWaiter struct {
+	connectionID string
+	granted      chan struct{} // closed once a slot is handed over
+}
+
+// ConcurrencyLimiter caps the statements principals run at once under the
+// policies with MaxConcurrentQueries. A connection holds a single slot while
+// it has statements in flight, however many it pipelined, since the upstream
+// runs them one at a time. Statements beyond the cap queue in arrival order
+// for up to the policy's QueueTimeout, and are denied after that.
+type ConcurrencyLimiter struct {
+	clock domain.Clock
+
+	mu    sync.Mutex
+	slots map[domain.UsageKey]*concurrencySlots
+}
+
+// NewConcurrencyLimiter creates a ConcurrencyLimiter timing queued statements with clock
+func NewConcurrencyLimiter(clock domain.Clock) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		clock: clock,
+		slots: make(map[domain.UsageKey]*concurrencySlots),
+	}
+}
+
+// Acquire takes a slot for the query's connection under each capped policy,
+// waiting for those that are full. It returns the function freeing the slots,
+// nil when no policy is capped, or a deny decision when a slot could not be
+// had in time, in which case none is held. It returns the context's error when
+// it is done first.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, policies []domain.QuotaPolicy, query *domain.Query) (func(), domain.Decision, error) {
+	var held []domain.UsageKey
+	for _, policy := range policies {
+		if policy.MaxConcurrentQueries <= 0 {
+			continue
+		}
+		key := domain.UsageKey{Policy: policy.Name, User: query.UserID, Database: query.Database}
+		running, err := l.acquire(ctx, policy, key, query.ConnectionID)
+		if err != nil || running > 0 {
+			l.release(held, query.ConnectionID)
+			if err != nil {
+				return nil, domain.Decision{}, err
+			}
+			return nil, concurrencyLimitDecision(policy, running), nil
+		}
+		held = append(held, key)
+	}
+	if len(held) == 0 {
+		return nil, domain.AllowDecision(), nil
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.release(held, query.ConnectionID)
+		})
+	}, domain.AllowDecision(), nil
+}
+
+// acquire takes a slot of key for the connection, and returns zero once it
+// holds one, or the statements running when it gave up waiting
+func (l *ConcurrencyLimiter) acquire(ctx context.Context, policy domain.QuotaPolicy, key domain.UsageKey, connectionID string) (int64, error) {
+	l.mu.Lock()
+	slots, ok := l.slots[key]
+	if !ok {
+		slots = &concurrencySlots{running: make(map[string]int)}
+		l.slots[key] = slots
+	}
+	// The policy may have been replaced since the slots were created
+	slots.limit = policy.MaxConcurrentQueries
+	if slots.running[connectionID] > 0 || (len(slots.waiting) == 0 && int64(len(slots.running)) < slots.limit) {
+		slots.running[connectionID]++
+		l.mu.Unlock()
+		return 0, nil
+	}
+	if policy.QueueTimeout <= 0 {
+		running := int64(len(slots.running))
+		l.mu.Unlock()
+		return running, nil
+	}
+	waiter := &concurrencyWaiter{connectionID: connectionID, granted: make(chan struct{})}
+	slots.waiting = append(slots.waiting, waiter)
+	l.mu.Unlock()
+
+	timer := l.clock.NewTimer(policy.QueueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-waiter.granted:
+		return 0, nil
+	case <-timer.C():
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-waiter.granted:
+		// The slot was handed over as the wait ended
+		if err == nil {
+			return 0, nil
+		}
+		l.releaseLocked(key, connectionID)
+	default:
+		for i, queued := range slots.waiting {
+			if queued == waiter {
+				slots.waiting = append(slots.waiting[:i], slots.waiting[i+1:]...)
+				break
+			}
+		}
+		l.grant(key, slots)
+	}
+	return max(1, int64(len(slots.running))), err
+}
+
+// release frees the slots of keys held by the connection
+func (l *ConcurrencyLimiter) release(keys []domain.UsageKey, connectionID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		l.releaseLocked(key, connectionID)
+	}
+}
+
+// releaseLocked frees a slot of key held by the connection; l.mu must be held
+func (l *ConcurrencyLimiter) releaseLocked(key domain.UsageKey, connectionID string) {
+	slots, ok := l.slots[key]
+	if !ok {
+		return
+	}
+	if slots.running[connectionID]--; slots.running[connectionID] <= 0 {
+		delete(slots.running, connectionID)
+	}
+	l.grant(key, slots)
+}
+
+// grant hands the free slots of key over to the statements queued first, and
+// forgets the slots once none is running or queued; l.mu must be held
+func (l *ConcurrencyLimiter) grant(key domain.UsageKey, slots *concurrencySlots) {
+	for len(slots.waiting) > 0 && int64(len(slots.running)) < slots.limit {
+		waiter := slots.waiting[0]
+		slots.waiting = slots.waiting[1:]
+		slots.running[waiter.connectionID]++
+		close(waiter.granted)
+	}
+	if len(slots.running) == 0 && len(slots.waiting) == 0 {
+		delete(l.slots, key)
+	}
+}
+
+// concurrencyLimitDecision denies a statement beyond the concurrency cap of
+// policy, with running statements in flight
+func concurrencyLimitDecision(policy domain.QuotaPolicy, running int64) domain.Decision {
+	reason := fmt.Sprintf("quota %q exceeded: %d of %d concurrent queries running", policy.Name, running, policy.MaxConcurrentQueries)
+	if policy.QueueTimeout > 0 {
+		reason += fmt.Sprintf(", none ended within %s", policy.QueueTimeout)
+	}
+	return domain.Decision{
+		Action: domain.DecisionDeny,
+		Policy: policy.Name,
+		Reason: reason,
+		Limit:  policy.MaxConcurrentQueries,
+		Used:   running,
+		Hint:   policy.Hint,
+	}
+}
@@ -0,0 +1,83 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	limiter := NewConcurrencyLimiter(clock)
+	policies := []domain.QuotaPolicy{{Name: "tenant", MaxConcurrentQueries: 2}}
+
+	acquire := func(connectionID string) func() {
+		t.Helper()
+		release, decision, err := limiter.Acquire(ctx, policies, newConnectionQuery("alice", connectionID))
+		require.NoError(t, err)
+		require.True(t, decision.Allowed(), decision.Reason)
+		require.NotNil(t, release)
+		return release
+	}
+	first, second := acquire("conn_1"), acquire("conn_2")
+	pipelined := acquire("conn_1")
+
+	_, decision, err := limiter.Acquire(ctx, policies, newConnectionQuery("alice", "conn_3"))
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed())
+	assert.Equal(t, `quota "tenant" exceeded: 2 of 2 concurrent queries running`, decision.Reason)
+	assert.Equal(t, int64(2), decision.Used)
+
+	release, decision, err := limiter.Acquire(ctx, policies, newConnectionQuery("bob", "conn_4"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed(), "Principals have slots of their own")
+	release()
+
+	// A connection holds its slot until its last statement ends
+	first()
+	first()
+	_, decision, _ = limiter.Acquire(ctx, policies, newConnectionQuery("alice", "conn_3"))
+	assert.False(t, decision.Allowed(), "Releases should only count once")
+	pipelined()
+	third := acquire("conn_3")
+
+	// Queued statements get the slots freed in arrival order
+	policies[0].QueueTimeout = 5 * time.Second
+	results := make(chan domain.Decision, 2)
+	for i, connectionID := range []string{"conn_5", "conn_6"} {
+		go func() {
+			_, decision, err := limiter.Acquire(ctx, policies, newConnectionQuery("alice", connectionID))
+			assert.NoError(t, err)
+			results <- decision
+		}()
+		require.True(t, clock.WaitForTimers(i+1, time.Second))
+	}
+	second()
+	assert.True(t, (<-results).Allowed())
+	clock.Advance(5 * time.Second)
+	decision = <-results
+	assert.False(t, decision.Allowed())
+	assert.Equal(t, `quota "tenant" exceeded: 2 of 2 concurrent queries running, none ended within 5s`, decision.Reason)
+	third()
+
+	cancelled, cancel := context.WithCancel(ctx)
+	go func() {
+		require.True(t, clock.WaitForTimers(1, time.Second))
+		cancel()
+	}()
+	acquire("conn_7")
+	_, _, err = limiter.Acquire(cancelled, policies, newConnectionQuery("alice", "conn_8"))
+	assert.ErrorIs(t, err, context.Canceled)
+
+	release, decision, err = limiter.Acquire(ctx, []domain.QuotaPolicy{{Name: "uncapped", Rate: 10}}, newConnectionQuery("alice", "conn_1"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed())
+	assert.Nil(t, release, "Queries under no cap should hold nothing")
+}
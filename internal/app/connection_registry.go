@@ -0,0 +1,179 @@
+package app
+
+import (
+	"maps"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnectionInfo describes an open client connection
+type ConnectionInfo struct {
+	ID          string
+	User        string
+	Database    string
+	ClientAddr  string // empty until the session is registered
+	ConnectedAt time.Time
+	Idle        bool // waiting for the client's next message outside a transaction
+
+	// Query is the most recent query of the connection, still running unless the
+	// connection is idle, and QueryStart when it was sent
+	Query      string
+	QueryStart time.Time
+
+	// Transaction and Parameters are the session state reported for proxied
+	// connections; other connections are always idle with no parameters
+	Transaction domain.TransactionStatus
+	Parameters  map[string]string
+}
+
+// ConnectionRegistry is a domain.ConnectionTracker decorator that keeps the open
+// connections of known principals so they can be listed, forwarding every call
+// to the wrapped tracker, which may be nil
+type ConnectionRegistry struct {
+	next  domain.ConnectionTracker
+	clock domain.Clock
+
+	mu           sync.Mutex
+	connections  map[string]*ConnectionInfo
+	terminations map[string]func() // of registered connections, by connection ID
+}
+
+// NewConnectionRegistry creates a registry in front of next
+func NewConnectionRegistry(next domain.ConnectionTracker, clock domain.Clock) *ConnectionRegistry {
+	return &ConnectionRegistry{
+		next:         next,
+		clock:        clock,
+		connections:  make(map[string]*ConnectionInfo),
+		terminations: make(map[string]func()),
+	}
+}
+
+// Track registers the connection
+func (r *ConnectionRegistry) Track(connectionID, user, database string, evict func()) {
+	r.mu.Lock()
+	r.connections[connectionID] = &ConnectionInfo{
+		ID:          connectionID,
+		User:        user,
+		Database:    database,
+		ConnectedAt: r.clock.Now(),
+		Transaction: domain.TransactionIdle,
+	}
+	r.mu.Unlock()
+
+	if r.next != nil {
+		r.next.Track(connectionID, user, database, evict)
+	}
+}
+
+// Busy marks the connection as processing a message
+func (r *ConnectionRegistry) Busy(connectionID string) bool {
+	r.setIdle(connectionID, false)
+	if r.next != nil {
+		return r.next.Busy(connectionID)
+	}
+	return true
+}
+
+// Idle marks the connection as waiting for its next message
+func (r *ConnectionRegistry) Idle(connectionID string) {
+	r.setIdle(connectionID, true)
+	if r.next != nil {
+		r.next.Idle(connectionID)
+	}
+}
+
+// Register records the client address of the connection and how to terminate it
+func (r *ConnectionRegistry) Register(session domain.Session, terminate func()) {
+	r.mu.Lock()
+	if connection, ok := r.connections[session.ConnectionID]; ok {
+		connection.ClientAddr = session.ClientAddr
+		r.terminations[session.ConnectionID] = sync.OnceFunc(terminate)
+	}
+	r.mu.Unlock()
+
+	if sessions, ok := r.next.(domain.SessionRegistry); ok {
+		sessions.Register(session, terminate)
+	}
+}
+
+// QueryStarted records the query the connection runs
+func (r *ConnectionRegistry) QueryStarted(connectionID, query string) {
+	r.mu.Lock()
+	if connection, ok := r.connections[connectionID]; ok {
+		connection.Query = query
+		connection.QueryStart = r.clock.Now()
+	}
+	r.mu.Unlock()
+
+	if sessions, ok := r.next.(domain.SessionRegistry); ok {
+		sessions.QueryStarted(connectionID, query)
+	}
+}
+
+// Terminate closes a registered connection, reporting whether it is open. The
+// connection is listed until its handler has closed it.
+func (r *ConnectionRegistry) Terminate(connectionID string) bool {
+	r.mu.Lock()
+	terminate, ok := r.terminations[connectionID]
+	r.mu.Unlock()
+
+	if ok {
+		terminate()
+	}
+	return ok
+}
+
+// UpdateSession records the session state of the connection
+func (r *ConnectionRegistry) UpdateSession(connectionID string, state domain.SessionState) {
+	r.mu.Lock()
+	if connection, ok := r.connections[connectionID]; ok {
+		connection.Transaction = state.Transaction
+		connection.Parameters = maps.Clone(state.Parameters)
+	}
+	r.mu.Unlock()
+
+	if sessions, ok := r.next.(domain.SessionStateTracker); ok {
+		sessions.UpdateSession(connectionID, state)
+	}
+}
+
+// Untrack forgets the connection
+func (r *ConnectionRegistry) Untrack(connectionID string) {
+	r.mu.Lock()
+	delete(r.connections, connectionID)
+	delete(r.terminations, connectionID)
+	r.mu.Unlock()
+
+	if r.next != nil {
+		r.next.Untrack(connectionID)
+	}
+}
+
+// Connections returns the open connections, oldest first
+func (r *ConnectionRegistry) Connections() []ConnectionInfo {
+	r.mu.Lock()
+	connections := make([]ConnectionInfo, 0, len(r.connections))
+	for _, connection := range r.connections {
+		connections = append(connections, *connection)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(connections, func(i, j int) bool {
+		if !connections[i].ConnectedAt.Equal(connections[j].ConnectedAt) {
+			return connections[i].ConnectedAt.Before(connections[j].ConnectedAt)
+		}
+		return connections[i].ID < connections[j].ID
+	})
+	return connections
+}
+
+// setIdle records whether the connection is idle
+func (r *ConnectionRegistry) setIdle(connectionID string, idle bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if connection, ok := r.connections[connectionID]; ok {
+		connection.Idle = idle
+	}
+}
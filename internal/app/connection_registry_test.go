@@ -0,0 +1,84 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionRegistry(t *testing.T) {
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	tracker := NewIdleConnectionTracker(1)
+	registry := NewConnectionRegistry(tracker, clock)
+
+	var evicted []string
+	registry.Track("conn_2", "alice", "app", func() { evicted = append(evicted, "conn_2") })
+	clock.Advance(time.Second)
+	registry.Track("conn_1", "alice", "app", func() { evicted = append(evicted, "conn_1") })
+
+	registry.Idle("conn_2")
+	registry.Idle("conn_1")
+	assert.Equal(t, []string{"conn_2"}, evicted, "Calls should reach the wrapped tracker")
+	assert.False(t, registry.Busy("conn_2"))
+
+	connections := registry.Connections()
+	require.Len(t, connections, 2)
+	assert.Equal(t, "conn_2", connections[0].ID, "Connections should be listed oldest first")
+	assert.Equal(t, "alice", connections[0].User)
+	assert.Equal(t, "app", connections[0].Database)
+	assert.False(t, connections[0].Idle)
+	assert.True(t, connections[1].Idle)
+	assert.Equal(t, domain.TransactionIdle, connections[1].Transaction)
+
+	registry.UpdateSession("conn_1", domain.SessionState{
+		Transaction: domain.TransactionActive,
+		Parameters:  map[string]string{"search_path": "billing"},
+	})
+	connections = registry.Connections()
+	assert.Equal(t, domain.TransactionActive, connections[1].Transaction)
+	assert.Equal(t, map[string]string{"search_path": "billing"}, connections[1].Parameters)
+
+	registry.Untrack("conn_2")
+	assert.Len(t, registry.Connections(), 1)
+	assert.Equal(t, 1, tracker.IdleCount("alice", "app"))
+}
+
+func TestConnectionRegistry_WithoutTracker(t *testing.T) {
+	registry := NewConnectionRegistry(nil, testkit.NewFakeClock(time.Now()))
+
+	registry.Track("conn_1", "alice", "app", func() {})
+	registry.Idle("conn_1")
+	assert.True(t, registry.Busy("conn_1"))
+	registry.Untrack("conn_1")
+	assert.Empty(t, registry.Connections())
+}
+
+func TestConnectionRegistry_Terminate(t *testing.T) {
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	registry := NewConnectionRegistry(nil, clock)
+
+	terminated := 0
+	registry.Track("conn_1", "alice", "app", func() {})
+	registry.Register(domain.Session{ConnectionID: "conn_1", ClientAddr: "10.0.0.7:51234"}, func() { terminated++ })
+	clock.Advance(time.Second)
+	registry.QueryStarted("conn_1", "SELECT pg_sleep(60)")
+
+	connections := registry.Connections()
+	require.Len(t, connections, 1)
+	assert.Equal(t, "10.0.0.7:51234", connections[0].ClientAddr)
+	assert.Equal(t, "SELECT pg_sleep(60)", connections[0].Query)
+	assert.Equal(t, clock.Now(), connections[0].QueryStart)
+
+	assert.True(t, registry.Terminate("conn_1"))
+	assert.True(t, registry.Terminate("conn_1"), "Connections should be listed until their handler closes them")
+	assert.Equal(t, 1, terminated, "Connections should only be terminated once")
+	assert.False(t, registry.Terminate("conn_2"))
+
+	registry.Untrack("conn_1")
+	assert.False(t, registry.Terminate("conn_1"))
+}
@@ -0,0 +1,175 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sync"
+	"time"
+)
+
+// DenialAnomalyConfig configures alerts for principals that are denied unusually often
+type DenialAnomalyConfig struct {
+	// Percent is the share of denied queries, from 0 to 100, above which a principal
+	// raises an alert; zero disables detection
+	Percent float64
+
+	// Window is the length of the observation window
+	Window time.Duration
+
+	// MinQueries is the number of queries a principal must issue within Window
+	// before its denial rate is considered, so a single early denial does not alert
+	MinQueries int
+}
+
+// Enabled reports whether denial anomaly detection is configured
+func (c DenialAnomalyConfig) Enabled() bool {
+	return c.Percent > 0
+}
+
+// Validate checks that the percent is between 0 and 100, the minimum queries
+// not negative, and that enabled alerts have a window
+func (c DenialAnomalyConfig) Validate() error {
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("denial alert percent must be between 0 and 100")
+	}
+	if c.MinQueries < 0 {
+		return fmt.Errorf("denial alert minimum queries must not be negative")
+	}
+	if c.Enabled() && c.Window <= 0 {
+		return fmt.Errorf("denial alert window must be positive")
+	}
+	return nil
+}
+
+// principalKey identifies the user and database a query is attributed to
+type principalKey struct {
+	user     string
+	database string
+}
+
+// denialWindow counts evaluated and denied queries within one observation window
+type denialWindow struct {
+	start    time.Time
+	queries  int
+	denied   int
+	policies map[string]int
+	reported bool
+}
+
+// DenialAnomalyDetector is a domain.PolicyEngine decorator that tracks the denial rate
+// of each principal and emits a denial_anomaly event once per window when it exceeds
+// the configured percentage. It never changes decisions.
+type DenialAnomalyDetector struct {
+	config DenialAnomalyConfig
+	next   domain.PolicyEngine
+	events domain.EventSink
+	clock  domain.Clock
+
+	mu        sync.Mutex
+	windows   map[principalKey]*denialWindow
+	lastSweep time.Time
+}
+
+// NewDenialAnomalyDetector creates a DenialAnomalyDetector observing the decisions of next
+func NewDenialAnomalyDetector(config DenialAnomalyConfig, next domain.PolicyEngine, events domain.EventSink, clock domain.Clock) (*DenialAnomalyDetector, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if next == nil {
+		return nil, fmt.Errorf("denial anomaly detection requires a policy engine")
+	}
+	return &DenialAnomalyDetector{
+		config:  config,
+		next:    next,
+		events:  events,
+		clock:   clock,
+		windows: make(map[principalKey]*denialWindow),
+	}, nil
+}
+
+// Evaluate returns the decision of the wrapped engine and records it for the query's principal
+func (d *DenialAnomalyDetector) Evaluate(ctx context.Context, query *domain.Query) (domain.Decision, error) {
+	decision, err := d.next.Evaluate(ctx, query)
+	if err != nil {
+		return decision, err
+	}
+
+	d.observe(query, decision)
+	return decision, nil
+}
+
+// RecordUsage forwards statement usage to the wrapped engine when it has metered quotas
+func (d *DenialAnomalyDetector) RecordUsage(ctx context.Context, query *domain.Query, usage domain.StatementUsage) error {
+	if recorder, ok := d.next.(domain.UsageRecorder); ok {
+		return recorder.RecordUsage(ctx, query, usage)
+	}
+	return nil
+}
+
+// observe counts the decision and emits an event when the principal crosses the threshold
+func (d *DenialAnomalyDetector) observe(query *domain.Query, decision domain.Decision) {
+	now := d.clock.Now()
+
+	d.mu.Lock()
+	d.sweep(now)
+
+	key := principalKey{user: query.UserID, database: query.Database}
+	window, ok := d.windows[key]
+	if !ok || now.Sub(window.start) >= d.config.Window {
+		window = &denialWindow{start: now, policies: make(map[string]int)}
+		d.windows[key] = window
+	}
+	window.queries++
+	if !decision.Allowed() {
+		window.denied++
+		window.policies[decision.Policy]++
+	}
+
+	percent := float64(window.denied) * 100 / float64(window.queries)
+	report := !window.reported && window.queries >= d.config.MinQueries && percent > d.config.Percent
+	if !report {
+		d.mu.Unlock()
+		return
+	}
+	window.reported = true
+
+	policies := make(map[string]int, len(window.policies))
+	for name, count := range window.policies {
+		policies[name] = count
+	}
+	fields := map[string]interface{}{
+		"user":           query.UserID,
+		"database":       query.Database,
+		"queries":        window.queries,
+		"denied":         window.denied,
+		"denied_percent": percent,
+		"threshold":      d.config.Percent,
+		"window":         d.config.Window.String(),
+		"policies":       policies,
+	}
+	d.mu.Unlock()
+
+	if d.events != nil {
+		d.events.Emit(domain.Event{
+			Type:         domain.EventDenialAnomaly,
+			Timestamp:    now,
+			ConnectionID: query.ConnectionID,
+			Fields:       fields,
+		})
+	}
+}
+
+// sweep drops expired windows at most once per window length so idle principals do not leak
+func (d *DenialAnomalyDetector) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < d.config.Window {
+		return
+	}
+	d.lastSweep = now
+
+	for key, window := range d.windows {
+		if now.Sub(window.start) >= d.config.Window {
+			delete(d.windows, key)
+		}
+	}
+}
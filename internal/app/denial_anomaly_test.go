@@ -0,0 +1,100 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// userDenyingPolicyEngine denies every query for the given user
+type userDenyingPolicyEngine struct {
+	user string
+}
+
+func (e userDenyingPolicyEngine) Evaluate(ctx context.Context, query *domain.Query) (domain.Decision, error) {
+	if query.UserID == e.user {
+		return domain.Decision{Action: domain.DecisionDeny, Policy: "tight"}, nil
+	}
+	return domain.AllowDecision(), nil
+}
+
+func newPrincipalQuery(user string) *domain.Query {
+	query := domain.NewQuery("SELECT 1", "conn_"+user)
+	query.UserID = user
+	query.Database = "app"
+	return query
+}
+
+func TestDenialAnomalyDetector_ReportsOncePerWindow(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	events := &mocks.RecordingEventSink{}
+
+	detector, err := NewDenialAnomalyDetector(DenialAnomalyConfig{Percent: 50, Window: time.Minute, MinQueries: 4}, userDenyingPolicyEngine{user: "bob"}, events, clock)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		decision, err := detector.Evaluate(ctx, newPrincipalQuery("bob"))
+		require.NoError(t, err)
+		assert.False(t, decision.Allowed(), "Decisions should pass through unchanged")
+	}
+	assert.Empty(t, events.Events(), "No alert before the minimum number of queries")
+
+	for i := 0; i < 10; i++ {
+		_, err := detector.Evaluate(ctx, newPrincipalQuery("alice"))
+		require.NoError(t, err)
+		_, err = detector.Evaluate(ctx, newPrincipalQuery("bob"))
+		require.NoError(t, err)
+	}
+
+	alerts := events.EventsOfType(domain.EventDenialAnomaly)
+	require.Len(t, alerts, 1, "Only the denied principal should alert, once per window")
+	assert.Equal(t, "bob", alerts[0].Fields["user"])
+	assert.Equal(t, "app", alerts[0].Fields["database"])
+	assert.Equal(t, 4, alerts[0].Fields["queries"])
+	assert.Equal(t, 4, alerts[0].Fields["denied"])
+	assert.Equal(t, map[string]int{"tight": 4}, alerts[0].Fields["policies"])
+
+	clock.Advance(time.Minute)
+	for i := 0; i < 4; i++ {
+		_, err := detector.Evaluate(ctx, newPrincipalQuery("bob"))
+		require.NoError(t, err)
+	}
+	assert.Len(t, events.EventsOfType(domain.EventDenialAnomaly), 2, "A new window should alert again")
+}
+
+func TestDenialAnomalyDetector_BelowThreshold(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	events := &mocks.RecordingEventSink{}
+	next := &mocks.PolicyEngine{}
+	next.On("Evaluate", ctx, mock.Anything).Return(domain.Decision{Action: domain.DecisionDeny, Policy: "tight"}, nil).Once()
+	next.On("Evaluate", ctx, mock.Anything).Return(domain.AllowDecision(), nil).Once()
+
+	detector, err := NewDenialAnomalyDetector(DenialAnomalyConfig{Percent: 50, Window: time.Minute, MinQueries: 2}, next, events, clock)
+	require.NoError(t, err)
+
+	// Exactly half of bob's queries are denied, which does not exceed the threshold
+	for i := 0; i < 2; i++ {
+		_, err := detector.Evaluate(ctx, newPrincipalQuery("bob"))
+		require.NoError(t, err)
+	}
+	assert.Empty(t, events.Events())
+	next.AssertExpectations(t)
+}
+
+func TestDenialAnomalyConfig_Validate(t *testing.T) {
+	assert.NoError(t, DenialAnomalyConfig{}.Validate())
+	assert.NoError(t, DenialAnomalyConfig{Percent: 50, Window: time.Minute}.Validate())
+	assert.Error(t, DenialAnomalyConfig{Percent: 50}.Validate())
+	assert.Error(t, DenialAnomalyConfig{Percent: 150, Window: time.Minute}.Validate())
+	assert.Error(t, DenialAnomalyConfig{Percent: 50, Window: time.Minute, MinQueries: -1}.Validate())
+}
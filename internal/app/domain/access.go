@@ -0,0 +1,105 @@
+package domain
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// AccessList admits or rejects clients by the address they connect from. An
+// address in one of the Deny ranges is rejected; otherwise it is admitted when
+// Allow is empty or one of its ranges contains it.
+type AccessList struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// ParseAccessList parses lists of CIDR ranges, e.g. 10.0.0.0/8; a bare address
+// is a range of its own
+func ParseAccessList(allow, deny []string) (AccessList, error) {
+	var list AccessList
+	var err error
+	if list.Allow, err = parsePrefixes(allow); err != nil {
+		return AccessList{}, err
+	}
+	if list.Deny, err = parsePrefixes(deny); err != nil {
+		return AccessList{}, err
+	}
+	return list, nil
+}
+
+// parsePrefixes parses CIDR ranges and bare addresses
+func parsePrefixes(ranges []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range ranges {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address range %q: use a CIDR range such as 10.0.0.0/8 or an address", value)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address range %q: use a CIDR range such as 10.0.0.0/8 or an address", value)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Empty reports whether the list admits every address
+func (l AccessList) Empty() bool {
+	return len(l.Allow) == 0 && len(l.Deny) == 0
+}
+
+// Admits reports whether a client connecting from addr is admitted. Addresses
+// without an IP, such as those of Unix sockets, are local and always admitted.
+func (l AccessList) Admits(addr net.Addr) bool {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return true
+	}
+	for _, prefix := range l.Deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(l.Allow) == 0 {
+		return true
+	}
+	for _, prefix := range l.Allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP of a network address, IPv4-mapped addresses as IPv4
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, ok := netip.AddrFromSlice(a.IP)
+		return ip.Unmap(), ok
+	case *net.UDPAddr:
+		ip, ok := netip.AddrFromSlice(a.IP)
+		return ip.Unmap(), ok
+	default:
+		return netip.Addr{}, false
+	}
+}
+
+// AccessController decides which client addresses may connect
+type AccessController interface {
+	// AdmitAddress reports whether the named listener may accept a connection
+	// from addr; it is consulted before anything is read from the connection
+	AdmitAddress(listener string, addr net.Addr) bool
+
+	// AdmitUser reports whether user may log in from addr through the named
+	// listener; it is consulted once the client sent its startup message
+	AdmitUser(listener, user string, addr net.Addr) bool
+}
@@ -0,0 +1,46 @@
+package domain
+
+import (
+	"time"
+)
+
+// CaptureFormatVersion is the current version of the query capture format
+const CaptureFormatVersion = 1
+
+// CaptureRecordKind identifies what a capture record describes
+type CaptureRecordKind string
+
+const (
+	CaptureRecordQuery      CaptureRecordKind = "query"
+	CaptureRecordNormalized CaptureRecordKind = "normalized"
+	CaptureRecordProtocol   CaptureRecordKind = "protocol"
+)
+
+// CaptureHeader is the first entry of a capture file and describes its format
+type CaptureHeader struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Source    string    `json:"source,omitempty"`
+	Instance  string    `json:"instance,omitempty"`
+}
+
+// CaptureRecord is a single captured event of a client connection
+type CaptureRecord struct {
+	Timestamp    time.Time              `json:"ts"`
+	ConnectionID string                 `json:"conn"`
+	Kind         CaptureRecordKind      `json:"kind"`
+	MessageType  string                 `json:"type,omitempty"`
+	Query        string                 `json:"query,omitempty"`
+	Normalized   string                 `json:"normalized,omitempty"`
+	QueryHash    string                 `json:"hash,omitempty"`
+	Details      map[string]interface{} `json:"details,omitempty"`
+}
+
+// CaptureSource provides capture records in the order they were recorded
+type CaptureSource interface {
+	// Header returns the capture header
+	Header() CaptureHeader
+
+	// Next returns the next record, or io.EOF when the capture is exhausted
+	Next() (*CaptureRecord, error)
+}
@@ -0,0 +1,24 @@
+package domain
+
+import (
+	"time"
+)
+
+// Clock abstracts the passage of time for quota windows and timeouts,
+// so time-based behavior can be driven deterministically in tests
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+
+	// NewTimer creates a timer that fires once d has elapsed
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single-shot timer created by a Clock
+type Timer interface {
+	// C returns the channel receiving the fire time
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing and reports whether it was still pending
+	Stop() bool
+}
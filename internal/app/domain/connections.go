@@ -0,0 +1,49 @@
+package domain
+
+// ConnectionTracker follows client connections once their principal is known,
+// so connections can be reclaimed when a principal holds too many of them
+type ConnectionTracker interface {
+	// Track registers a connection; evict is called, at most once, when the
+	// connection must be closed
+	Track(connectionID, user, database string, evict func())
+
+	// Busy marks the connection as processing a message. It reports false when the
+	// connection has already been evicted and must not process anything more.
+	Busy(connectionID string) bool
+
+	// Idle marks the connection as waiting for its next message. Connections
+	// waiting inside a transaction, or for the upstream to answer, stay busy, so
+	// they are never evicted mid-transaction.
+	Idle(connectionID string)
+
+	// Untrack forgets a closed connection
+	Untrack(connectionID string)
+}
+
+// SessionStateTracker is implemented by connection trackers that follow the
+// state of sessions. Proxied connections report their state whenever a
+// transaction starts or ends, or the client changes its parameters.
+type SessionStateTracker interface {
+	// UpdateSession records the state of a tracked connection's session
+	UpdateSession(connectionID string, state SessionState)
+}
+
+// SessionRegistry is implemented by connection trackers that list the sessions
+// of tracked connections and let administrators terminate them
+type SessionRegistry interface {
+	// Register records the session of a tracked connection; terminate is called,
+	// at most once, when an administrator terminates the connection
+	Register(session Session, terminate func())
+
+	// QueryStarted records the query a tracked connection runs
+	QueryStarted(connectionID, query string)
+}
+
+// ConnectionLimiter caps the concurrent client connections of principals
+type ConnectionLimiter interface {
+	// AcquireConnection claims a connection for the session's principal, or
+	// returns a deny decision when one of its caps is reached. The release
+	// function of an admitted connection must be called once it closes; its
+	// decision carries the startup parameters to send upstream.
+	AcquireConnection(session Session) (release func(), decision Decision)
+}
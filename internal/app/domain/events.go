@@ -0,0 +1,99 @@
+package domain
+
+import (
+	"time"
+)
+
+// EventType identifies the kind of an Event
+type EventType string
+
+const (
+	// EventQueryBurst reports identical queries repeated by one connection in a short interval (N+1)
+	EventQueryBurst EventType = "query_burst"
+
+	// EventDenialAnomaly reports a principal denied more often than expected, which usually
+	// points at a misconfigured client or an undersized quota
+	EventDenialAnomaly EventType = "denial_anomaly"
+
+	// EventRateAnomaly reports a principal, or a query fingerprint of one, whose
+	// query rate strayed from its learned baseline by more than the configured factor
+	EventRateAnomaly EventType = "rate_anomaly"
+
+	// EventQuotaThreshold reports a principal whose usage crossed an alert threshold,
+	// a percentage of a quota's limit, within the quota's window
+	EventQuotaThreshold EventType = "quota_threshold"
+
+	// EventQuotaBlocked reports a principal denied by a quota it had been allowed by
+	EventQuotaBlocked EventType = "quota_blocked"
+
+	// EventUpstreamFailover reports new connections routed to the secondary
+	// upstream after the primary failed its health checks
+	EventUpstreamFailover EventType = "upstream_failover"
+
+	// EventUpstreamFailback reports new connections routed to the primary
+	// upstream again once it stayed healthy for the cooldown
+	EventUpstreamFailback EventType = "upstream_failback"
+
+	// EventUsageReport reports the usage of a quota over the windows that ended
+	// since the last report, emitted by the leader of a cluster
+	EventUsageReport EventType = "usage_report"
+
+	// EventQueryDecision reports the decision taken on a query, for query log
+	// destinations that forward decisions to the event sinks
+	EventQueryDecision EventType = "query_decision"
+
+	// EventConnectionRejected reports a connection rejected by an access list,
+	// by the address of its client or the user it logs in as
+	EventConnectionRejected EventType = "connection_rejected"
+
+	// EventFirewallViolation reports a query whose fingerprint is not among those
+	// the SQL firewall learned for its user, once per user and fingerprint
+	EventFirewallViolation EventType = "firewall_violation"
+)
+
+// EventTypes lists the types of the events the enforcer emits
+var EventTypes = []EventType{EventQueryBurst, EventDenialAnomaly, EventRateAnomaly, EventQuotaThreshold,
+	EventQuotaBlocked, EventUpstreamFailover, EventUpstreamFailback, EventUsageReport, EventQueryDecision,
+	EventConnectionRejected, EventFirewallViolation}
+
+// Event is a notable occurrence worth surfacing to operators, such as a detected query pattern
+type Event struct {
+	Type         EventType
+	Timestamp    time.Time
+	InstanceID   string // Enforcer replica that emitted the event
+	ConnectionID string
+	Fields       map[string]interface{}
+}
+
+// EventSink receives events emitted by the enforcer
+type EventSink interface {
+	// Emit publishes the event; implementations must not block the query path
+	Emit(event Event)
+}
+
+// QueryEvent is the outcome of an evaluated query, published so analytics pipelines
+// can follow usage as it happens. Allowed queries are published once they complete,
+// with what they consumed.
+type QueryEvent struct {
+	Timestamp       time.Time // When the query was received
+	InstanceID      string    // Enforcer replica that evaluated the query
+	ConnectionID    string
+	User            string
+	Database        string
+	ApplicationName string
+	Kind            QueryKind
+	QueryHash       string
+	Normalized      string // Empty when the query could not be normalized
+	Decision        DecisionAction
+	Policy          string // Policy that denied the query
+	Reason          string
+	Duration        time.Duration
+	Rows            int64
+	Bytes           int64
+}
+
+// QueryEventPublisher publishes query events to downstream consumers
+type QueryEventPublisher interface {
+	// Publish queues the event; implementations must not block the query path
+	Publish(event QueryEvent)
+}
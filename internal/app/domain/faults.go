@@ -0,0 +1,31 @@
+package domain
+
+import (
+	"context"
+	"errors"
+)
+
+// FaultPoint identifies a place in the request path where faults can be injected
+type FaultPoint string
+
+const (
+	FaultPointClientRead    FaultPoint = "client_read"
+	FaultPointUpstreamRead  FaultPoint = "upstream_read"
+	FaultPointUpstreamWrite FaultPoint = "upstream_write"
+	FaultPointStore         FaultPoint = "store"
+)
+
+var (
+	// ErrInjectedFault is returned by a FaultInjector for an artificial error
+	ErrInjectedFault = errors.New("injected fault")
+
+	// ErrInjectedReset is returned by a FaultInjector to simulate a connection reset
+	ErrInjectedReset = errors.New("injected connection reset")
+)
+
+// FaultInjector introduces artificial latency and failures for resilience testing
+type FaultInjector interface {
+	// Inject applies the faults configured for the point; a non-nil error must
+	// be handled by the caller as if the underlying operation had failed
+	Inject(ctx context.Context, point FaultPoint) error
+}
@@ -0,0 +1,26 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+// FirewallProfile is the set of query fingerprints the SQL firewall learned
+// for a user: the queries it is known to run
+type FirewallProfile struct {
+	User         string
+	LearnedSince time.Time         // when the first query of the user was learned
+	Enforced     bool              // learning ended, so that unseen fingerprints are blocked or alerted
+	Fingerprints map[string]string // normalized query by fingerprint; an empty fingerprint stands for queries that could not be normalized
+}
+
+// FirewallProfileStore persists the profiles learned by the SQL firewall, so
+// that they outlive restarts
+type FirewallProfileStore interface {
+	// LoadFirewallProfiles returns the profiles saved last, none when nothing
+	// was saved yet
+	LoadFirewallProfiles(ctx context.Context) ([]FirewallProfile, error)
+
+	// SaveFirewallProfiles replaces the saved profiles with profiles
+	SaveFirewallProfiles(ctx context.Context, profiles []FirewallProfile) error
+}
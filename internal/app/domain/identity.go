@@ -0,0 +1,11 @@
+package domain
+
+import "context"
+
+// IdentityResolver looks up the directory groups users belong to. Quota
+// policies target a group through their Role, so its members are quota-bound
+// without being listed in the configuration.
+type IdentityResolver interface {
+	// Groups returns the names of the groups user belongs to
+	Groups(ctx context.Context, user string) ([]string, error)
+}
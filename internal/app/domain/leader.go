@@ -0,0 +1,37 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+// LeaderElector elects a single replica of a cluster to run the housekeeping
+// jobs that must not run on every replica, such as usage compaction
+type LeaderElector interface {
+	// Lead acquires the leadership, or renews it when the instance holds it, and
+	// returns until when the instance leads; zero when another replica does
+	Lead(ctx context.Context) (time.Time, error)
+
+	// Resign releases the leadership if the instance holds it, so that another
+	// replica takes over without waiting for it to expire
+	Resign(ctx context.Context) error
+}
+
+// WindowUsage is the usage of a principal within one window of a quota
+type WindowUsage struct {
+	Key   UsageKey
+	Start time.Time
+	End   time.Time
+	Used  int64
+}
+
+// UsageHistory is implemented by usage stores keeping the counters of elapsed
+// windows, which the leader of a cluster reports and compacts
+type UsageHistory interface {
+	// Ended returns the counters of the windows that ended after from and no later than to
+	Ended(ctx context.Context, from, to time.Time) ([]WindowUsage, error)
+
+	// Compact deletes the counters of the windows that ended before before, and
+	// returns how many were deleted
+	Compact(ctx context.Context, before time.Time) (int64, error)
+}
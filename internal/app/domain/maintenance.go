@@ -0,0 +1,32 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultMaintenanceMessage is returned to rejected clients when a window has no message
+const DefaultMaintenanceMessage = "the database is undergoing maintenance, please retry later"
+
+// MaintenanceWindow puts a database, or every database behind the listener, into maintenance mode
+type MaintenanceWindow struct {
+	// Database limits the window to one database; empty applies to every connection
+	Database string
+
+	// Message is sent to clients whose connection is rejected
+	Message string
+
+	// QueueTimeout holds new connections for up to this long, waiting for
+	// the window to end, before rejecting them. Zero rejects immediately.
+	QueueTimeout time.Duration
+
+	StartedAt time.Time
+}
+
+// MaintenanceGate decides whether new client connections may proceed
+type MaintenanceGate interface {
+	// Admit waits while the database is under maintenance, up to the window's
+	// queue timeout, and returns the window still blocking the connection,
+	// or nil when it may proceed
+	Admit(ctx context.Context, database string) (*MaintenanceWindow, error)
+}
@@ -0,0 +1,35 @@
+package domain
+
+import "context"
+
+// PolicyResource is a quota policy declared as a Kubernetes custom resource
+type PolicyResource struct {
+	Name       string
+	Generation int64 // of the resource spec, incremented by the API server on every change
+	Policy     QuotaPolicy
+	Err        error // why the spec is not a valid policy, nil when it is
+}
+
+// PolicyResources lists and watches the quota policies declared as resources
+// for the operator, which reports back how each was synced
+type PolicyResources interface {
+	// List returns every declared policy, valid or not
+	List(ctx context.Context) ([]PolicyResource, error)
+
+	// Watch calls changed whenever a resource is created, updated or deleted,
+	// until ctx is cancelled
+	Watch(ctx context.Context, changed func())
+
+	// SetStatus records in the status of resource whether it was synced: err
+	// is nil once its policy is in the policy store
+	SetStatus(ctx context.Context, resource PolicyResource, err error) error
+}
+
+// PolicySink is a policy store the operator keeps in sync with the declared
+// policies, leaving the policies written by other means alone
+type PolicySink interface {
+	// SyncPolicies writes policies, and deletes those it wrote before that are
+	// no longer declared. It returns, by name, the policies that could not be
+	// written, such as those clashing with policies written by other means.
+	SyncPolicies(ctx context.Context, policies []QuotaPolicy) (map[string]error, error)
+}
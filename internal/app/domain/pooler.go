@@ -0,0 +1,71 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+// PoolStats is a pool of the connection pooler the upstream runs, such as
+// PgBouncer, as reported by its admin console
+type PoolStats struct {
+	Database string
+	User     string
+	Mode     string // session, transaction or statement
+	Size     int64  // server connections the pool may open; zero when unknown
+
+	ClientsActive  int64         // clients linked to a server connection, or idle
+	ClientsWaiting int64         // clients waiting for a server connection
+	ServersActive  int64         // server connections linked to a client
+	ServersIdle    int64         // server connections ready for a client
+	ServersUsed    int64         // server connections idle for longer than the pooler checks them
+	MaxWait        time.Duration // how long the oldest waiting client has waited
+	Clients        int64         // client connections of the pool, including those of other hosts
+
+	// Averages of the pool's database over the pooler's last stats period
+	QueriesPerSecond      float64
+	TransactionsPerSecond float64
+	AverageQueryTime      time.Duration
+	AverageWait           time.Duration
+
+	// Totals of the pool's database since the pooler started
+	TotalQueries   int64
+	TotalBytes     int64 // received from clients and sent to them
+	TotalQueryTime time.Duration
+}
+
+// Saturation returns the percentage of the pool's server connections linked to
+// clients. A pool with waiting clients is saturated whatever its size.
+func (p PoolStats) Saturation() int {
+	switch {
+	case p.ClientsWaiting > 0:
+		return 100
+	case p.Size <= 0:
+		return 0
+	default:
+		return int(min(p.ServersActive*100/p.Size, 100))
+	}
+}
+
+// PoolerConsole reads the pools of a connection pooler
+type PoolerConsole interface {
+	Pools(ctx context.Context) ([]PoolStats, error)
+}
+
+// PoolerAdmin runs the admin commands of a connection pooler
+type PoolerAdmin interface {
+	// KillClients closes the client connections of the user to the database and
+	// returns how many were closed
+	KillClients(ctx context.Context, user, database string) (int, error)
+
+	// Disable rejects new client connections to the database, and Enable accepts
+	// them again
+	Disable(ctx context.Context, database string) error
+	Enable(ctx context.Context, database string) error
+}
+
+// PoolSaturation reports how saturated the upstream pools of principals are
+type PoolSaturation interface {
+	// Saturation returns the saturation percentage of the pool the user and
+	// database are proxied to, and false when it is not known
+	Saturation(user, database string) (int, bool)
+}
@@ -24,16 +24,31 @@ func (q QueryHash) Value() string {
 	return q.value
 }
 
+// QueryKind tells which protocol message a query was observed in
+type QueryKind string
+
+const (
+	QueryKindSimple  QueryKind = "simple"  // Query message of the simple protocol
+	QueryKindParse   QueryKind = "parse"   // Parse message preparing a statement
+	QueryKindExecute QueryKind = "execute" // Execute of a previously prepared statement
+)
+
 // Query represents a SQL query with metadata
 type Query struct {
-	Raw          string
-	Normalized   string
-	Hash         QueryHash
-	ConnectionID string
-	UserID       string
-	Database     string
-	Timestamp    time.Time
-	Parameters   []interface{}
+	Kind            QueryKind // Empty for queries observed outside the protocol, treated as simple
+	Raw             string
+	Normalized      string
+	Hash            QueryHash
+	ConnectionID    string
+	UserID          string
+	Database        string
+	ApplicationName string
+	Labels          map[string]string // Connection labels supplied by the client at startup
+	Listener        string            // Name of the listener that accepted the connection; empty for the default one
+	Timestamp       time.Time
+	Parameters      []interface{} // Values bound for an Execute, when parameter capture is enabled
+	Duration        time.Duration // Wall-clock time until the upstream completed it; zero until then
+	Evaluation      time.Duration // Time the policy engine took to decide on it
 }
 
 // NewQuery creates a new Query
@@ -51,6 +66,14 @@ type QueryNormalizer interface {
 	Normalize(rawQuery string) (NormalizedQuery, error)
 }
 
+// StatementNormalizer is implemented by query normalizers that also look prepared
+// statements up by name. Connection handlers normalize Parse messages through it
+// when available.
+type StatementNormalizer interface {
+	// NormalizeStatement normalizes the query of the prepared statement name
+	NormalizeStatement(name, rawQuery string) (NormalizedQuery, error)
+}
+
 // NormalizedQuery represents a normalized query result for quota tracking
 type NormalizedQuery struct {
 	Original   string
@@ -74,9 +97,10 @@ type QueryAnalyzer interface {
 // QueryAnalysis represents the analysis result of a query
 type QueryAnalysis struct {
 	Query         *Query
-	EstimatedCost int64
+	EstimatedCost int64 // Heuristic score, at least 1; higher for queries likely to be expensive
 	QueryType     QueryType
 	Tables        []string
+	Joins         int // Explicit joins and additional relations of FROM lists
 	Operations    []QueryOperation
 }
 
@@ -0,0 +1,38 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+// QueryStats is what the statements of a query fingerprint consumed, like a row
+// of pg_stat_statements
+type QueryStats struct {
+	Hash          QueryHash
+	Query         string // normalized text of the first statement seen
+	Calls         int64
+	TotalDuration time.Duration
+	P95Duration   time.Duration // of the latest calls
+	Rows          int64
+	Bytes         int64
+	LastSeen      time.Time
+}
+
+// MeanDuration returns the average duration of a call
+func (s QueryStats) MeanDuration() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.TotalDuration / time.Duration(s.Calls)
+}
+
+// QueryStatsStore is implemented by usage stores that persist query statistics.
+// Enforcers sharing a store add their calls, durations, rows and bytes to the
+// same fingerprints.
+type QueryStatsStore interface {
+	// SaveQueryStats adds the calls, total duration, rows and bytes of each
+	// entry of stats to those stored for its fingerprint, and replaces its 95th
+	// percentile duration and, when later, its last seen time. The first query
+	// saved is kept as the example.
+	SaveQueryStats(ctx context.Context, stats []QueryStats) error
+}
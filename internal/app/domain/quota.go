@@ -0,0 +1,916 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuotaDimension is what a quota policy limits
+type QuotaDimension string
+
+const (
+	QuotaDimensionQueries QuotaDimension = "queries" // Queries run, weighted by UsageWeights
+	QuotaDimensionBytes   QuotaDimension = "bytes"   // Bytes of result rows and COPY data
+	QuotaDimensionRows    QuotaDimension = "rows"    // Rows returned or transferred by COPY
+	QuotaDimensionSeconds QuotaDimension = "seconds" // Execution time of statements
+	QuotaDimensionCost    QuotaDimension = "cost"    // Estimated cost of queries, weighted by UsageWeights
+)
+
+// Unit returns the name of what the dimension counts; the empty dimension counts queries
+func (d QuotaDimension) Unit() string {
+	switch d {
+	case "":
+		return string(QuotaDimensionQueries)
+	case QuotaDimensionCost:
+		return "cost units"
+	default:
+		return string(d)
+	}
+}
+
+// Scale returns how many usage units one unit of the limit is: execution time
+// is limited in seconds but counted in milliseconds so short statements add up
+func (d QuotaDimension) Scale() int64 {
+	if d == QuotaDimensionSeconds {
+		return 1000
+	}
+	return 1
+}
+
+// RateScope selects which queries share the token bucket of a rate-limited policy
+type RateScope string
+
+const (
+	RateScopeUser       RateScope = "user"       // The queries of a principal across its connections
+	RateScopeConnection RateScope = "connection" // The queries of each connection
+)
+
+// StatementClass selects the statements a scoped policy applies to
+type StatementClass string
+
+const (
+	StatementClassRead   StatementClass = "read"   // SELECT, and COPY to the client
+	StatementClassWrite  StatementClass = "write"  // INSERT, UPDATE, DELETE and DDL
+	StatementClassSelect StatementClass = "select" // SELECT, and COPY to the client
+	StatementClassInsert StatementClass = "insert" // INSERT, and COPY from the client
+	StatementClassUpdate StatementClass = "update" // UPDATE and MERGE
+	StatementClassDelete StatementClass = "delete" // DELETE and TRUNCATE
+	StatementClassDDL    StatementClass = "ddl"    // CREATE, ALTER and DROP
+)
+
+// statementClassTypes lists the query types of each statement class
+var statementClassTypes = map[StatementClass][]QueryType{
+	StatementClassRead:   {QueryTypeSelect},
+	StatementClassWrite:  {QueryTypeInsert, QueryTypeUpdate, QueryTypeDelete, QueryTypeCreate, QueryTypeDrop, QueryTypeAlter},
+	StatementClassSelect: {QueryTypeSelect},
+	StatementClassInsert: {QueryTypeInsert},
+	StatementClassUpdate: {QueryTypeUpdate},
+	StatementClassDelete: {QueryTypeDelete},
+	StatementClassDDL:    {QueryTypeCreate, QueryTypeDrop, QueryTypeAlter},
+}
+
+// Valid reports whether the class is known
+func (c StatementClass) Valid() bool {
+	_, ok := statementClassTypes[c]
+	return ok
+}
+
+// Includes reports whether statements of the query type belong to the class
+func (c StatementClass) Includes(queryType QueryType) bool {
+	for _, included := range statementClassTypes[c] {
+		if included == queryType {
+			return true
+		}
+	}
+	return false
+}
+
+// QuotaPolicy limits how much a principal may consume within a time window: the
+// number of queries it runs or, for metered dimensions, the data its statements
+// transfer or the time they take. Empty User or Database fields match any value;
+// every entry of Labels must be present with the same value on the connection.
+// A policy with a Listener only applies to the connections accepted by the
+// listener of that name. A windowed policy with PerLabel counts the usage of
+// each value of that connection label apart, so that the tenants sharing a
+// user and database each get the whole limit; connections without the label
+// share the counter of the empty value.
+//
+// A policy may also smooth the rate of queries with a token bucket: queries
+// beyond Rate per second, after a burst of Burst queries, are delayed rather
+// than denied. Principals below Rate once their burst is available again earn
+// credits, CreditRate per second up to Credits, which let later queries beyond
+// the burst run without delay until they are spent. MaxConnections caps the
+// concurrent connections of each principal the policy matches, and
+// MaxConcurrentQueries the statements they run at once: statements beyond it
+// wait up to QueueTimeout for another to end, and are denied after that.
+// StatementTimeout cancels the queries the policy applies to that run longer,
+// whatever the upstream's own statement_timeout, and MaxResultRows and
+// MaxResultBytes those returning larger results, cut off once they reach the
+// cap. MaxTransactionDuration and MaxTransactionStatements bound the
+// transactions of the principals: a connection whose transaction stays open
+// longer, or runs more statements, is closed and its transaction rolled back.
+// A policy with a rate, a connection or concurrency cap, a statement timeout,
+// a result cap or a transaction limit may leave Limit and Window unset.
+//
+// StartupParameters are added to the startup message of the upstream
+// connections of the principals the policy matches, replacing those the client
+// sent: application_name to tell the enforcer's connections apart upstream, or
+// options to set server settings. Values may refer to the connection with the
+// placeholders of ExpandStartupParameters. Where several policies set the same
+// parameter, the most specific one wins. A policy may set startup parameters
+// only, without any limit.
+//
+// Queries allowed once a principal has used WarnAt percent of a windowed limit
+// carry a warning notice. A Soft limit never denies: queries beyond it are
+// allowed with a warning. A hard limit may grant a Grace period instead: once
+// exceeded within a window, queries are allowed with a warning for that long
+// before they are denied.
+//
+// While the upstream pool of a principal is at least TightenAt percent
+// saturated, its limit and rate are tightened to TightenTo percent of their
+// value, so that busy principals leave room to the others. See Tightened.
+//
+// Tables and Statements scope a policy to the queries reading or writing some
+// tables: the policy only applies to a query with a statement of one of the
+// classes on one of the tables. Fingerprints and Patterns scope a policy to
+// some queries: those with one of the fingerprints, or whose normalized text
+// matches one of the patterns. A Deny policy has no limit; it rejects every
+// query it applies to, except during the recurring windows of AllowDuring. An
+// Allow policy has no limit either; it exempts the queries it applies to from
+// every other policy, deny policies included.
+//
+// A policy with ActiveDuring windows only applies during them, in their time
+// zone: stricter limits during business hours, or an allow policy exempting
+// batch jobs at night. Outside its windows the policy matches no principal.
+//
+// A policy with a Role applies to the members of that role, and to those of
+// the directory group of that name found by an IdentityResolver. Every matching
+// policy applies, unless an Override policy replaces it: an override takes the
+// place of the less specific policies it matches along with, for each limit it
+// sets, whether a windowed limit of the same dimension, a rate, a connection or
+// concurrency cap, a statement timeout, or a result cap or a transaction limit
+// of the same dimension. See Specificity. Scoped, fingerprinted, deny and allow policies are never
+// replaced.
+type QuotaPolicy struct {
+	Name      string
+	User      string
+	Role      string // Empty matches users of any role
+	Database  string
+	Labels    map[string]string
+	Listener  string         // Empty matches connections of every listener
+	Dimension QuotaDimension // Empty limits queries
+	Limit     int64
+	Window    time.Duration
+	PerLabel  string    // Connection label whose values are counted apart; empty counts the principal as a whole
+	Rate      float64   // Queries per second, weighted by UsageWeights; zero disables rate limiting
+	Burst     int64     // Zero allows a burst of one second's worth of queries
+	RatePer   RateScope // Empty shares the rate across the principal's connections
+
+	Credits    int64   // Most credits a principal accrues while below Rate; zero disables credits
+	CreditRate float64 // Credits earned per second once the burst is available; zero earns at Rate
+
+	WarnAt int           // Percentage of Limit from which queries carry a warning; zero never warns
+	Soft   bool          // Queries beyond Limit are allowed with a warning
+	Grace  time.Duration // How long queries beyond Limit are allowed with a warning before they are denied
+
+	TightenAt int // Upstream pool saturation percentage from which Limit and Rate are tightened; zero never tightens
+	TightenTo int // Percentage of Limit and Rate left while tightened
+
+	MaxConnections       int64         // Zero leaves connections unlimited
+	MaxConcurrentQueries int64         // Statements running at once; zero leaves them unlimited
+	QueueTimeout         time.Duration // How long statements beyond MaxConcurrentQueries wait; zero denies them at once
+	StatementTimeout     time.Duration // Zero leaves statements unbounded
+	MaxResultRows        int64         // Rows a statement may return; zero leaves results unbounded
+	MaxResultBytes       int64         // Bytes of result rows a statement may return; zero leaves results unbounded
+
+	MaxTransactionDuration   time.Duration // How long a transaction may stay open; zero leaves it unbounded
+	MaxTransactionStatements int64         // Statements a transaction may run; zero leaves them unlimited
+
+	StartupParameters map[string]string // Sent upstream in the startup message, see ExpandStartupParameters
+
+	Tables      []string         // Table patterns: name, schema.name or schema.*; empty matches any table
+	Statements  []StatementClass // Empty matches any statement
+	Deny        bool
+	AllowDuring []string // Recurring windows lifting a deny policy, see ParseRecurringWindow
+
+	ActiveDuring []string // Recurring windows the policy applies in, see ParseRecurringWindow; empty always applies
+
+	Fingerprints []string // Query hashes, as logged in query_hash; empty matches any query
+	Patterns     []string // Regular expressions matched against the normalized query
+	Allow        bool
+	Hint         string // Sent to clients along with the denials of the policy
+
+	Override bool
+}
+
+// Specificity ranks how narrowly the policy selects principals, so that
+// overrides replace broader policies deterministically: a user is more specific
+// than a role, which is more specific than a database, which is more specific
+// than every principal. A policy selecting a user and a database ranks above
+// one selecting the user only, and a scheduled policy above an unscheduled one
+// selecting the same principals, so that it replaces it while active.
+func (p QuotaPolicy) Specificity() int {
+	specificity := 0
+	if p.User != "" {
+		specificity += 8
+	}
+	if p.Role != "" {
+		specificity += 4
+	}
+	if p.Database != "" {
+		specificity += 2
+	}
+	if p.Scheduled() {
+		specificity++
+	}
+	return specificity
+}
+
+// Scheduled reports whether the policy only applies during some windows
+func (p QuotaPolicy) Scheduled() bool {
+	return len(p.ActiveDuring) > 0
+}
+
+// Replaceable reports whether an override may replace the limits of the policy:
+// those of scoped, fingerprinted, deny and allow policies stay in force
+func (p QuotaPolicy) Replaceable() bool {
+	return !p.Scoped() && !p.Fingerprinted() && !p.Deny && !p.Allow
+}
+
+// Overridden returns the policy less the limits that override replaces, and
+// whether it replaces any. It is only meaningful for a less specific policy
+// matching the same principals.
+func (p QuotaPolicy) Overridden(override QuotaPolicy) (QuotaPolicy, bool) {
+	replaced := false
+	if override.Windowed() && p.Windowed() && override.Dimension.Unit() == p.Dimension.Unit() {
+		p.Limit, p.Window, p.WarnAt, p.Soft, p.Grace = 0, 0, 0, false, 0
+		replaced = true
+	}
+	if override.RateLimited() && p.RateLimited() {
+		p.Rate, p.Burst, p.RatePer, p.Credits, p.CreditRate = 0, 0, "", 0, 0
+		replaced = true
+	}
+	if override.MaxConnections > 0 && p.MaxConnections > 0 {
+		p.MaxConnections = 0
+		replaced = true
+	}
+	if override.MaxConcurrentQueries > 0 && p.MaxConcurrentQueries > 0 {
+		p.MaxConcurrentQueries, p.QueueTimeout = 0, 0
+		replaced = true
+	}
+	if override.StatementTimeout > 0 && p.StatementTimeout > 0 {
+		p.StatementTimeout = 0
+		replaced = true
+	}
+	if override.MaxResultRows > 0 && p.MaxResultRows > 0 {
+		p.MaxResultRows = 0
+		replaced = true
+	}
+	if override.MaxResultBytes > 0 && p.MaxResultBytes > 0 {
+		p.MaxResultBytes = 0
+		replaced = true
+	}
+	if override.MaxTransactionDuration > 0 && p.MaxTransactionDuration > 0 {
+		p.MaxTransactionDuration = 0
+		replaced = true
+	}
+	if override.MaxTransactionStatements > 0 && p.MaxTransactionStatements > 0 {
+		p.MaxTransactionStatements = 0
+		replaced = true
+	}
+	return p, replaced
+}
+
+// Limited reports whether the policy has a windowed limit, a rate, a connection
+// or concurrency cap, a statement timeout, a result cap or a transaction limit
+func (p QuotaPolicy) Limited() bool {
+	return p.Windowed() || p.RateLimited() || p.MaxConnections > 0 || p.MaxConcurrentQueries > 0 || p.StatementTimeout > 0 || p.ResultCapped() ||
+		p.TransactionLimited()
+}
+
+// ResultCapped reports whether the policy caps the rows or bytes of results
+func (p QuotaPolicy) ResultCapped() bool {
+	return p.MaxResultRows > 0 || p.MaxResultBytes > 0
+}
+
+// TransactionLimited reports whether the policy bounds the duration or the
+// statements of transactions
+func (p QuotaPolicy) TransactionLimited() bool {
+	return p.MaxTransactionDuration > 0 || p.MaxTransactionStatements > 0
+}
+
+// Matches reports whether the policy applies to connections of the given listener,
+// user, database and labels
+func (p QuotaPolicy) Matches(listener, user, database string, labels map[string]string) bool {
+	if (p.User != "" && p.User != user) || (p.Database != "" && p.Database != database) {
+		return false
+	}
+	if p.Listener != "" && p.Listener != listener {
+		return false
+	}
+	for name, value := range p.Labels {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Scoped reports whether the policy only applies to some tables or statements,
+// which requires analyzing queries
+func (p QuotaPolicy) Scoped() bool {
+	return len(p.Tables) > 0 || len(p.Statements) > 0
+}
+
+// Fingerprinted reports whether the policy only applies to some queries, matched
+// by fingerprint or pattern
+func (p QuotaPolicy) Fingerprinted() bool {
+	return len(p.Fingerprints) > 0 || len(p.Patterns) > 0
+}
+
+// MatchesAccess reports whether a scoped policy applies to a statement of the
+// query type on table, which is empty for statements without tables
+func (p QuotaPolicy) MatchesAccess(queryType QueryType, table string) bool {
+	if len(p.Statements) > 0 {
+		included := false
+		for _, class := range p.Statements {
+			included = included || class.Includes(queryType)
+		}
+		if !included {
+			return false
+		}
+	}
+	if len(p.Tables) == 0 {
+		return true
+	}
+	for _, pattern := range p.Tables {
+		if table != "" && MatchesTable(pattern, table) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesTable reports whether a table pattern matches a table as referenced by a
+// query. Unqualified references are taken to be in the public schema, while
+// unqualified patterns match the table in any schema.
+func MatchesTable(pattern, table string) bool {
+	schema, name, qualified := strings.Cut(table, ".")
+	if !qualified {
+		schema, name = "public", table
+	}
+
+	patternSchema, patternName, patternQualified := strings.Cut(pattern, ".")
+	if !patternQualified {
+		return pattern == name
+	}
+	return patternSchema == schema && (patternName == "*" || patternName == name)
+}
+
+// ValidTablePattern reports whether pattern is a table name, a schema-qualified
+// table name or a schema followed by .*
+func ValidTablePattern(pattern string) bool {
+	schema, name, qualified := strings.Cut(pattern, ".")
+	if !qualified {
+		return pattern != "" && !strings.Contains(pattern, "*")
+	}
+	return schema != "" && !strings.Contains(schema, "*") && name != "" && !strings.Contains(name, ".") &&
+		(name == "*" || !strings.Contains(name, "*"))
+}
+
+// ValidFingerprint reports whether hash looks like a query fingerprint: a
+// non-empty string of hexadecimal digits
+func ValidFingerprint(hash string) bool {
+	if hash == "" {
+		return false
+	}
+	for _, r := range hash {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// startupPlaceholder matches the placeholders of startup parameter values
+var startupPlaceholder = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// reservedStartupParameters are the startup parameters policies cannot set:
+// they select the upstream login, and labels never reach the upstream
+var reservedStartupParameters = map[string]bool{"user": true, "database": true, "replication": true}
+
+// ExpandStartupParameters returns the startup parameters of the policy for the
+// connection of session, with the placeholders {connection_id},
+// {application_name}, {user}, {database}, {listener} and {client_addr} in their
+// values replaced with those of the connection
+func (p QuotaPolicy) ExpandStartupParameters(session Session) map[string]string {
+	if len(p.StartupParameters) == 0 {
+		return nil
+	}
+	replacer := strings.NewReplacer(
+		"{connection_id}", session.ConnectionID,
+		"{application_name}", session.ApplicationName,
+		"{user}", session.User,
+		"{database}", session.Database,
+		"{listener}", session.Listener,
+		"{client_addr}", session.ClientAddr,
+	)
+	expanded := make(map[string]string, len(p.StartupParameters))
+	for name, value := range p.StartupParameters {
+		expanded[name] = replacer.Replace(value)
+	}
+	return expanded
+}
+
+// validateStartupParameters checks the names and placeholders of the startup
+// parameters of the policy, which only apply to whole connections
+func (p QuotaPolicy) validateStartupParameters() error {
+	if len(p.StartupParameters) == 0 {
+		return nil
+	}
+	if p.Deny || p.Allow || p.Scoped() || p.Fingerprinted() {
+		return fmt.Errorf("quota policy %q: startup parameters cannot be scoped to tables, statements or queries, nor set by deny or allow policies", p.Name)
+	}
+	for name, value := range p.StartupParameters {
+		if name == "" || reservedStartupParameters[name] || strings.HasPrefix(name, "label.") {
+			return fmt.Errorf("quota policy %q: startup parameter %q cannot be set", p.Name, name)
+		}
+		for _, match := range startupPlaceholder.FindAllStringSubmatch(value, -1) {
+			switch match[1] {
+			case "connection_id", "application_name", "user", "database", "listener", "client_addr":
+			default:
+				return fmt.Errorf("quota policy %q: unknown placeholder %s in startup parameter %s: use {connection_id}, {application_name}, {user}, {database}, {listener} or {client_addr}", p.Name, match[0], name)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks that the policy is well formed
+func (p QuotaPolicy) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("quota policy name is required")
+	}
+	for _, pattern := range p.Tables {
+		if !ValidTablePattern(pattern) {
+			return fmt.Errorf("quota policy %q: invalid table pattern %q: use name, schema.name or schema.*", p.Name, pattern)
+		}
+	}
+	for _, class := range p.Statements {
+		if !class.Valid() {
+			return fmt.Errorf("quota policy %q: unknown statement class %q: use read, write, select, insert, update, delete or ddl", p.Name, class)
+		}
+	}
+	for _, hash := range p.Fingerprints {
+		if !ValidFingerprint(hash) {
+			return fmt.Errorf("quota policy %q: invalid fingerprint %q: use a query hash as logged in query_hash", p.Name, hash)
+		}
+	}
+	for _, pattern := range p.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("quota policy %q: invalid pattern %q: %v", p.Name, pattern, err)
+		}
+	}
+	for _, window := range p.AllowDuring {
+		if _, err := ParseRecurringWindow(window); err != nil {
+			return fmt.Errorf("quota policy %q: %w", p.Name, err)
+		}
+	}
+	for _, window := range p.ActiveDuring {
+		if _, err := ParseRecurringWindow(window); err != nil {
+			return fmt.Errorf("quota policy %q: %w", p.Name, err)
+		}
+	}
+	if len(p.AllowDuring) > 0 && !p.Deny {
+		return fmt.Errorf("quota policy %q: allowed windows require a deny policy", p.Name)
+	}
+	if p.PerLabel != "" && !p.Windowed() {
+		return fmt.Errorf("quota policy %q: per label requires a limit and a window", p.Name)
+	}
+	if p.Override && !p.Replaceable() {
+		return fmt.Errorf("quota policy %q: an override cannot be scoped to tables, statements or queries, nor deny or allow them", p.Name)
+	}
+	if err := p.validateStartupParameters(); err != nil {
+		return err
+	}
+	if p.Allow {
+		if p.Deny || p.Windowed() || p.Dimension != "" || p.Rate != 0 || p.Burst != 0 || p.RatePer != "" || p.Credits != 0 || p.CreditRate != 0 || p.MaxConnections != 0 || p.MaxConcurrentQueries != 0 || p.QueueTimeout != 0 || p.StatementTimeout != 0 || p.MaxResultRows != 0 || p.MaxResultBytes != 0 ||
+			p.MaxTransactionDuration != 0 || p.MaxTransactionStatements != 0 {
+			return fmt.Errorf("quota policy %q: an allow policy cannot deny queries or have a limit, a rate, a connection or concurrency cap, a statement timeout, a result cap or a transaction limit", p.Name)
+		}
+		return nil
+	}
+	if p.Deny {
+		if p.Windowed() || p.Dimension != "" || p.Rate != 0 || p.Burst != 0 || p.RatePer != "" || p.Credits != 0 || p.CreditRate != 0 || p.MaxConnections != 0 || p.MaxConcurrentQueries != 0 || p.QueueTimeout != 0 || p.StatementTimeout != 0 || p.MaxResultRows != 0 || p.MaxResultBytes != 0 ||
+			p.MaxTransactionDuration != 0 || p.MaxTransactionStatements != 0 {
+			return fmt.Errorf("quota policy %q: a deny policy cannot have a limit, a rate, a connection or concurrency cap, a statement timeout, a result cap or a transaction limit", p.Name)
+		}
+		return nil
+	}
+	if p.MaxConnections > 0 && (p.Scoped() || p.Fingerprinted()) {
+		return fmt.Errorf("quota policy %q: connection caps cannot be scoped to tables, statements or queries", p.Name)
+	}
+	if p.Rate < 0 || p.Burst < 0 {
+		return fmt.Errorf("quota policy %q: rate and burst must not be negative", p.Name)
+	}
+	if p.MaxConnections < 0 {
+		return fmt.Errorf("quota policy %q: max connections must not be negative", p.Name)
+	}
+	if p.MaxConcurrentQueries < 0 || p.QueueTimeout < 0 {
+		return fmt.Errorf("quota policy %q: max concurrent queries and queue timeout must not be negative", p.Name)
+	}
+	if p.QueueTimeout > 0 && p.MaxConcurrentQueries == 0 {
+		return fmt.Errorf("quota policy %q: queue timeout requires max concurrent queries", p.Name)
+	}
+	if p.StatementTimeout < 0 {
+		return fmt.Errorf("quota policy %q: statement timeout must not be negative", p.Name)
+	}
+	if p.MaxResultRows < 0 || p.MaxResultBytes < 0 {
+		return fmt.Errorf("quota policy %q: max result rows and bytes must not be negative", p.Name)
+	}
+	if p.MaxTransactionDuration < 0 || p.MaxTransactionStatements < 0 {
+		return fmt.Errorf("quota policy %q: max transaction duration and statements must not be negative", p.Name)
+	}
+	if p.Burst > 0 && p.Rate == 0 {
+		return fmt.Errorf("quota policy %q: burst requires a rate", p.Name)
+	}
+	if p.Credits < 0 || p.CreditRate < 0 {
+		return fmt.Errorf("quota policy %q: credits and credit rate must not be negative", p.Name)
+	}
+	if p.Credits > 0 && (p.Rate == 0 || p.RatePer == RateScopeConnection) {
+		return fmt.Errorf("quota policy %q: credits require a rate shared by the principal's connections", p.Name)
+	}
+	if p.CreditRate > 0 && p.Credits == 0 {
+		return fmt.Errorf("quota policy %q: credit rate requires credits", p.Name)
+	}
+	switch p.RatePer {
+	case "", RateScopeUser, RateScopeConnection:
+	default:
+		return fmt.Errorf("quota policy %q: unknown rate scope %q: use user or connection", p.Name, p.RatePer)
+	}
+	if p.Windowed() || (!p.RateLimited() && p.MaxConnections == 0 && p.MaxConcurrentQueries == 0 && p.StatementTimeout == 0 && !p.ResultCapped() && !p.TransactionLimited() && len(p.StartupParameters) == 0) {
+		if p.Limit <= 0 {
+			return fmt.Errorf("quota policy %q: limit must be positive", p.Name)
+		}
+		if p.Window <= 0 {
+			return fmt.Errorf("quota policy %q: window must be positive", p.Name)
+		}
+	}
+	switch p.Dimension {
+	case "", QuotaDimensionQueries, QuotaDimensionBytes, QuotaDimensionRows, QuotaDimensionSeconds, QuotaDimensionCost:
+	default:
+		return fmt.Errorf("quota policy %q: unknown dimension %q: use queries, cost, bytes, rows or seconds", p.Name, p.Dimension)
+	}
+	if (p.WarnAt != 0 || p.Soft || p.Grace != 0) && !p.Windowed() {
+		return fmt.Errorf("quota policy %q: warnings, soft limits and grace periods require a limit and a window", p.Name)
+	}
+	if p.WarnAt < 0 || p.WarnAt > 100 {
+		return fmt.Errorf("quota policy %q: warn at must be a percentage between 1 and 100", p.Name)
+	}
+	if p.Grace < 0 {
+		return fmt.Errorf("quota policy %q: grace period must not be negative", p.Name)
+	}
+	if p.Soft && p.Grace > 0 {
+		return fmt.Errorf("quota policy %q: a soft limit never denies queries, so it has no grace period", p.Name)
+	}
+	if (p.TightenAt != 0 || p.TightenTo != 0) && !p.Windowed() && !p.RateLimited() {
+		return fmt.Errorf("quota policy %q: tightening requires a limit or a rate", p.Name)
+	}
+	if p.TightenAt < 0 || p.TightenAt > 100 {
+		return fmt.Errorf("quota policy %q: tighten at must be a percentage between 1 and 100", p.Name)
+	}
+	if (p.TightenAt == 0) != (p.TightenTo == 0) {
+		return fmt.Errorf("quota policy %q: tighten at and tighten to go together", p.Name)
+	}
+	if p.TightenTo < 0 || p.TightenTo >= 100 {
+		return fmt.Errorf("quota policy %q: tighten to must be a percentage between 1 and 99", p.Name)
+	}
+	return nil
+}
+
+// Tightened returns the policy with its limit, rate and burst cut to TightenTo
+// percent, keeping at least one of each, when saturation reaches TightenAt, and
+// whether it was tightened
+func (p QuotaPolicy) Tightened(saturation int) (QuotaPolicy, bool) {
+	if p.TightenAt == 0 || saturation < p.TightenAt {
+		return p, false
+	}
+	if p.Windowed() {
+		p.Limit = max(1, p.Limit*int64(p.TightenTo)/100)
+	}
+	if p.RateLimited() {
+		p.Rate = p.Rate * float64(p.TightenTo) / 100
+		if p.Burst > 0 {
+			p.Burst = max(1, p.Burst*int64(p.TightenTo)/100)
+		}
+	}
+	return p, true
+}
+
+// Windowed reports whether the policy limits consumption within a window, as
+// opposed to only smoothing the query rate
+func (p QuotaPolicy) Windowed() bool {
+	return p.Limit != 0 || p.Window != 0
+}
+
+// UsageKey returns the key of the principal's counter under the policy, split
+// by the value of the PerLabel label among the labels of its connection
+func (p QuotaPolicy) UsageKey(user, database string, labels map[string]string) UsageKey {
+	key := UsageKey{Policy: p.Name, User: user, Database: database}
+	if p.PerLabel != "" {
+		key.Label = labels[p.PerLabel]
+	}
+	return key
+}
+
+// RateLimited reports whether the policy delays queries beyond a rate
+func (p QuotaPolicy) RateLimited() bool {
+	return p.Rate > 0
+}
+
+// RateBurst returns how many queries may run back to back before the rate
+// applies: Burst when set, otherwise one second's worth of queries and at least one
+func (p QuotaPolicy) RateBurst() int64 {
+	if p.Burst > 0 {
+		return p.Burst
+	}
+	return max(1, int64(math.Ceil(p.Rate)))
+}
+
+// CreditAccrual returns how many credits the policy earns per second once the
+// burst is available: CreditRate when set, otherwise Rate
+func (p QuotaPolicy) CreditAccrual() float64 {
+	if p.CreditRate > 0 {
+		return p.CreditRate
+	}
+	return p.Rate
+}
+
+// Metered reports whether the policy limits what statements consume, measured as
+// they complete, rather than queries charged as they arrive
+func (p QuotaPolicy) Metered() bool {
+	return p.Dimension != "" && p.Dimension != QuotaDimensionQueries && p.Dimension != QuotaDimensionCost
+}
+
+// UsageWeights sets how much quota each kind of query consumes. A prepared statement
+// is charged its Parse weight once and its Execute weight on every execution.
+type UsageWeights struct {
+	Simple  int64
+	Parse   int64
+	Execute int64
+}
+
+// DefaultUsageWeights charges one unit per Query, Parse and Execute message
+func DefaultUsageWeights() UsageWeights {
+	return UsageWeights{Simple: 1, Parse: 1, Execute: 1}
+}
+
+// For returns the weight of the query kind
+func (w UsageWeights) For(kind QueryKind) int64 {
+	switch kind {
+	case QueryKindParse:
+		return w.Parse
+	case QueryKindExecute:
+		return w.Execute
+	default:
+		return w.Simple
+	}
+}
+
+// Validate checks that no weight is negative
+func (w UsageWeights) Validate() error {
+	if w.Simple < 0 || w.Parse < 0 || w.Execute < 0 {
+		return fmt.Errorf("usage weights must not be negative")
+	}
+	return nil
+}
+
+// UsageKey identifies the usage counter of a principal under a policy
+type UsageKey struct {
+	Policy   string
+	User     string
+	Database string
+	Label    string // Value of the policy's PerLabel label; empty for policies counting principals as a whole
+}
+
+// String returns a stable representation of the key
+func (k UsageKey) String() string {
+	if k.Label != "" {
+		return k.Policy + "/" + k.User + "/" + k.Database + "/" + k.Label
+	}
+	return k.Policy + "/" + k.User + "/" + k.Database
+}
+
+// Usage is the consumption recorded for a UsageKey within a window
+type Usage struct {
+	Used    int64
+	ResetAt time.Time
+}
+
+// UsageStore persists usage counters for quota windows
+type UsageStore interface {
+	// Increment adds amount to the counter and returns the usage after the increment
+	Increment(ctx context.Context, key UsageKey, window time.Duration, amount int64) (Usage, error)
+
+	// Get returns the current usage without modifying it
+	Get(ctx context.Context, key UsageKey, window time.Duration) (Usage, error)
+
+	// Reset clears the counter
+	Reset(ctx context.Context, key UsageKey) error
+}
+
+// QuotaStatus is the usage of a windowed quota by the principal of a connection
+type QuotaStatus struct {
+	Policy    string
+	Dimension QuotaDimension
+	Limit     int64
+	Used      int64 // in the units of Limit
+	Window    time.Duration
+	ResetAt   time.Time
+}
+
+// Remaining returns what is left of the limit, never below zero
+func (s QuotaStatus) Remaining() int64 {
+	return max(s.Limit-s.Used, 0)
+}
+
+// QuotaReporter reports the quotas of connections, so that clients can query
+// theirs over SQL
+type QuotaReporter interface {
+	// QuotaStatus returns the usage of every windowed quota applying to the
+	// connection of the session
+	QuotaStatus(ctx context.Context, session Session) ([]QuotaStatus, error)
+}
+
+// Pinger is implemented by components that depend on an external service, such
+// as usage stores kept in a database, so health probes can check it is reachable
+type Pinger interface {
+	// Ping returns an error when the service cannot be reached
+	Ping(ctx context.Context) error
+}
+
+// DecisionAction is the outcome of a policy evaluation
+type DecisionAction string
+
+const (
+	DecisionAllow DecisionAction = "allow"
+	DecisionDeny  DecisionAction = "deny"
+)
+
+// Decision is the result of evaluating quota policies for a query
+type Decision struct {
+	Action  DecisionAction
+	Policy  string
+	Reason  string
+	Code    string // SQLSTATE reported for a denial; empty reports configuration_limit_exceeded
+	Hint    string
+	Limit   int64
+	Used    int64
+	ResetAt time.Time
+
+	Warnings []string // Sent to the client as notices along with an allowed query
+
+	StatementTimeout time.Duration // The query is cancelled once it runs longer; zero leaves it unbounded
+	TimeoutPolicy    string        // Policy the statement timeout comes from
+
+	MaxResultRows     int64  // The query is cut off once it returned more rows; zero leaves its result unbounded
+	MaxResultBytes    int64  // The query is cut off once it returned more bytes of rows; zero leaves its result unbounded
+	ResultRowsPolicy  string // Policy the result row cap comes from
+	ResultBytesPolicy string // Policy the result byte cap comes from
+
+	MaxTransactionDuration      time.Duration // The connection is closed once its transaction stays open longer; zero leaves it unbounded
+	MaxTransactionStatements    int64         // The connection is closed once its transaction runs more statements; zero leaves them unlimited
+	TransactionDurationPolicy   string        // Policy the transaction duration limit comes from
+	TransactionStatementsPolicy string        // Policy the transaction statement limit comes from
+
+	// Release frees the concurrency slots an allowed query holds; it must be
+	// called once the query ends, or at once when it is not run. Nil when the
+	// query holds none.
+	Release func()
+
+	StartupParameters map[string]string // Sent upstream in the startup message of an admitted connection
+
+	Rewrite string // Text forwarded upstream in place of an allowed Query or Parse message; empty forwards it as sent
+
+	// Statements are the decisions of each statement of a simple query holding
+	// several, whose statement timeouts and result caps apply to that statement
+	// only; nil for other queries
+	Statements []Decision
+}
+
+// Allowed reports whether the query may proceed
+func (d Decision) Allowed() bool {
+	return d.Action != DecisionDeny
+}
+
+// Finish releases what the decision holds, once its query ended or when it is
+// not run
+func (d Decision) Finish() {
+	if d.Release != nil {
+		d.Release()
+	}
+}
+
+// AllowDecision returns a decision permitting the query
+func AllowDecision() Decision {
+	return Decision{Action: DecisionAllow}
+}
+
+// PolicyEngine decides whether a query may proceed
+type PolicyEngine interface {
+	// Evaluate returns the quota decision for the query and records its usage when allowed
+	Evaluate(ctx context.Context, query *Query) (Decision, error)
+}
+
+// ChargeBatch holds back the charges of the queries evaluated with its context,
+// so that the statements of a batch are charged only once all of them are
+// allowed. Policy engines still count the charges held back when checking the
+// next queries of the batch against their limits.
+type ChargeBatch struct {
+	mu      sync.Mutex
+	pending map[UsageKey]int64
+	charges []func(ctx context.Context) error
+}
+
+// chargeBatchKey is the context key of the charge batch of a query
+type chargeBatchKey struct{}
+
+// WithChargeBatch returns a copy of ctx holding back the charges of the queries
+// evaluated with it in the returned batch
+func WithChargeBatch(ctx context.Context) (context.Context, *ChargeBatch) {
+	batch := &ChargeBatch{pending: make(map[UsageKey]int64)}
+	return context.WithValue(ctx, chargeBatchKey{}, batch), batch
+}
+
+// ChargeBatchOf returns the batch holding back the charges of the queries
+// evaluated with ctx, nil when they are charged at once
+func ChargeBatchOf(ctx context.Context) *ChargeBatch {
+	batch, _ := ctx.Value(chargeBatchKey{}).(*ChargeBatch)
+	return batch
+}
+
+// Defer holds back charge, which adds amount to the usage of key, until Commit
+func (b *ChargeBatch) Defer(key UsageKey, amount int64, charge func(ctx context.Context) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if amount != 0 {
+		b.pending[key] += amount
+	}
+	b.charges = append(b.charges, charge)
+}
+
+// Pending returns the usage of key held back so far
+func (b *ChargeBatch) Pending(key UsageKey) int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pending[key]
+}
+
+// Commit makes the charges held back, in order, stopping at the first that fails
+func (b *ChargeBatch) Commit(ctx context.Context) error {
+	b.mu.Lock()
+	charges := b.charges
+	b.charges, b.pending = nil, make(map[UsageKey]int64)
+	b.mu.Unlock()
+
+	for _, charge := range charges {
+		if err := charge(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueryHandler decides whether a query may proceed: the rest of a middleware
+// chain, down to the policy engine
+type QueryHandler func(ctx context.Context, query *Query) (Decision, error)
+
+// QueryMiddleware intercepts queries around the policy engine. It may change the
+// query before calling next, such as its attribution, decide on it without
+// calling next, or change the decision next returned; one replacing an allowed
+// decision must Finish it.
+type QueryMiddleware func(ctx context.Context, query *Query, next QueryHandler) (Decision, error)
+
+// StatementUsage is what a statement consumed
+type StatementUsage struct {
+	Bytes    int64         // Values of result rows and CopyData payload in either direction
+	Rows     int64         // Result rows, or the count of a COPY command tag; zero when unknown
+	Duration time.Duration // Until the upstream completed the statement; zero without an upstream
+	Queued   time.Duration // Sent before the upstream completed the statements ahead of it, not part of Duration
+}
+
+// UsageRecorder is implemented by policy engines with metered quotas. What a
+// statement consumes is only known once it completes, so it is charged
+// afterwards and an exhausted quota denies the principal's next queries.
+type UsageRecorder interface {
+	// RecordUsage charges what query consumed to the matching metered policies
+	RecordUsage(ctx context.Context, query *Query, usage StatementUsage) error
+}
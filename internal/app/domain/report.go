@@ -0,0 +1,30 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+// TenantUsage is what a tenant, a user of a database, consumed over a period
+type TenantUsage struct {
+	User     string
+	Database string
+	Queries  int64
+	Rows     int64
+	Bytes    int64
+	Seconds  float64 // of statement execution
+	Cost     int64   // estimated cost units, weighted by UsageWeights
+}
+
+// UsageReport sums, by tenant, the usage of the windows that ended after From
+// and no later than To, for chargeback or showback billing
+type UsageReport struct {
+	From    time.Time
+	To      time.Time
+	Tenants []TenantUsage
+}
+
+// UsageExporter publishes usage reports outside the enforcer
+type UsageExporter interface {
+	ExportUsage(ctx context.Context, report UsageReport) error
+}
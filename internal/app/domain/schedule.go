@@ -0,0 +1,138 @@
+package domain
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weekdays are the day names accepted in recurring windows
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// RecurringWindow is a time range repeated on some days of the week, such as a
+// weekly maintenance window. A range ending before it starts runs past midnight
+// and belongs to the day it starts on.
+type RecurringWindow struct {
+	Days     []time.Weekday // empty repeats the window every day
+	Start    time.Duration  // since midnight
+	End      time.Duration  // since midnight
+	Location *time.Location // nil is UTC
+}
+
+// ParseRecurringWindow parses a window written as optional days, a time range
+// and an optional time zone, e.g. "02:00-04:00", "Sat Sun 01:00-05:00" or
+// "Mon-Fri 22:00-06:00 Europe/Paris"
+func ParseRecurringWindow(value string) (RecurringWindow, error) {
+	var window RecurringWindow
+	fields := strings.Fields(value)
+
+	timeField := -1
+	for i, field := range fields {
+		if strings.Contains(field, ":") {
+			timeField = i
+			break
+		}
+	}
+	if timeField < 0 || len(fields) > timeField+2 {
+		return window, fmt.Errorf("invalid window %q: use [days] HH:MM-HH:MM [time zone], e.g. Sat 02:00-04:00", value)
+	}
+
+	for _, field := range fields[:timeField] {
+		days, err := parseWeekdays(field)
+		if err != nil {
+			return window, fmt.Errorf("invalid window %q: %w", value, err)
+		}
+		window.Days = append(window.Days, days...)
+	}
+
+	start, end, ok := strings.Cut(fields[timeField], "-")
+	if !ok {
+		return window, fmt.Errorf("invalid window %q: the time range must be HH:MM-HH:MM", value)
+	}
+	var err error
+	if window.Start, err = parseTimeOfDay(start); err != nil {
+		return window, fmt.Errorf("invalid window %q: %w", value, err)
+	}
+	if window.End, err = parseTimeOfDay(end); err != nil {
+		return window, fmt.Errorf("invalid window %q: %w", value, err)
+	}
+	if window.Start == window.End {
+		return window, fmt.Errorf("invalid window %q: the time range is empty", value)
+	}
+
+	if len(fields) > timeField+1 {
+		if window.Location, err = time.LoadLocation(fields[timeField+1]); err != nil {
+			return window, fmt.Errorf("invalid window %q: unknown time zone %q", value, fields[timeField+1])
+		}
+	}
+	return window, nil
+}
+
+// parseWeekdays parses a day name or a range of days such as Mon-Fri
+func parseWeekdays(value string) ([]time.Weekday, error) {
+	first, last, isRange := strings.Cut(value, "-")
+	from, ok := weekdays[strings.ToLower(first)]
+	if !ok {
+		return nil, fmt.Errorf("unknown day %q: use Mon, Tue, Wed, Thu, Fri, Sat or Sun", first)
+	}
+	if !isRange {
+		return []time.Weekday{from}, nil
+	}
+	to, ok := weekdays[strings.ToLower(last)]
+	if !ok {
+		return nil, fmt.Errorf("unknown day %q: use Mon, Tue, Wed, Thu, Fri, Sat or Sun", last)
+	}
+
+	days := []time.Weekday{from}
+	for day := from; day != to; {
+		day = (day + 1) % 7
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+// parseTimeOfDay parses HH:MM into the time since midnight; 24:00 is the end of the day
+func parseTimeOfDay(value string) (time.Duration, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(value, "%d:%d", &hours, &minutes); err != nil || len(value) != 5 ||
+		hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes > 0) {
+		return 0, fmt.Errorf("invalid time %q: use HH:MM", value)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// Contains reports whether t falls within an occurrence of the window
+func (w RecurringWindow) Contains(t time.Time) bool {
+	location := w.Location
+	if location == nil {
+		location = time.UTC
+	}
+	local := t.In(location)
+	offset := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute +
+		time.Duration(local.Second())*time.Second
+
+	if w.Start < w.End {
+		return offset >= w.Start && offset < w.End && w.onDay(local.Weekday())
+	}
+	// The window runs past midnight: it either started today or the day before
+	if offset >= w.Start {
+		return w.onDay(local.Weekday())
+	}
+	return offset < w.End && w.onDay((local.Weekday()+6)%7)
+}
+
+// onDay reports whether the window starts on day
+func (w RecurringWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, candidate := range w.Days {
+		if candidate == day {
+			return true
+		}
+	}
+	return false
+}
@@ -7,14 +7,59 @@ import (
 
 // TCPServer defines the interface for a TCP server
 type TCPServer interface {
-	// Start begins listening for TCP connections on the specified address
+	// Start begins listening for TCP connections on the specified address.
+	// The address may use port 0, in which case the resolved address is
+	// available through Address as soon as Start returns.
 	Start(ctx context.Context, address string) error
 
+	// Serve begins accepting TCP connections on already open listeners, such as
+	// sockets passed by systemd. Connections are handled with a context telling
+	// the name of the listener that accepted them, see ListenerName.
+	Serve(ctx context.Context, listeners []Listener) error
+
+	// Started returns a channel that is closed once the server accepts connections
+	Started() <-chan struct{}
+
 	// Stop gracefully shuts down the server
 	Stop(ctx context.Context) error
 
-	// Address returns the address the server is listening on
+	// Drain stops accepting connections, asks the handler to close its
+	// connections when it is a ConnectionDrainer, and waits until they are
+	// closed or ctx is done. The server still has to be stopped afterwards.
+	Drain(ctx context.Context) error
+
+	// OpenConnections returns how many client connections are open
+	OpenConnections() int
+
+	// Address returns the address the server is listening on, that of its
+	// first listener when it has several
 	Address() string
+
+	// Addresses returns the address of every listener of the server by name
+	Addresses() map[string]string
+}
+
+// Listener is a socket accepting client connections under a name, which
+// policies and upstreams may be scoped to. The default listener has no name.
+type Listener struct {
+	Name     string
+	Listener net.Listener
+}
+
+// listenerNameKey is the context key of the name of the listener of a connection
+type listenerNameKey struct{}
+
+// WithListenerName returns a copy of ctx telling the connection was accepted by
+// the named listener
+func WithListenerName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, listenerNameKey{}, name)
+}
+
+// ListenerName returns the name of the listener that accepted the connection
+// handled with ctx, empty for the default listener
+func ListenerName(ctx context.Context) string {
+	name, _ := ctx.Value(listenerNameKey{}).(string)
+	return name
 }
 
 // ConnectionHandler defines the interface for handling TCP connections
@@ -23,6 +68,14 @@ type ConnectionHandler interface {
 	HandleConnection(ctx context.Context, conn net.Conn) error
 }
 
+// ConnectionDrainer is implemented by connection handlers that can close their
+// connections without interrupting the work of their clients
+type ConnectionDrainer interface {
+	// Drain rejects new connections and closes each open one as soon as its
+	// client is outside a transaction with no query in flight
+	Drain()
+}
+
 // QueryLogger defines the interface for logging SQL queries and protocol messages
 type QueryLogger interface {
 	// LogQuery logs a SQL query with connection information
@@ -34,3 +87,12 @@ type QueryLogger interface {
 	// LogNormalizedQuery logs a normalized SQL query
 	LogNormalizedQuery(connectionID string, normalizedQuery NormalizedQuery) error
 }
+
+// DecisionLogger is implemented by query loggers that record the outcome of every
+// evaluated query. The connection handler logs denied queries when they are denied,
+// and allowed ones once their results complete, along with what they consumed,
+// or right away when no result follows, such as for a Parse or without an upstream.
+type DecisionLogger interface {
+	// LogDecision records the decision taken on query and what the query consumed
+	LogDecision(query *Query, decision Decision, usage StatementUsage) error
+}
@@ -0,0 +1,70 @@
+package domain
+
+// Session is what a client declared in the StartupMessage of its connection.
+// Connections that skip the startup phase, such as replayed message streams,
+// have a Session carrying only their ConnectionID.
+type Session struct {
+	ConnectionID    string
+	User            string
+	Database        string // Defaults to User, as in PostgreSQL
+	ApplicationName string
+	Labels          map[string]string // Connection labels supplied through label.* parameters
+	Parameters      map[string]string // Every startup parameter, labels included
+	TLS             bool              // Whether the client negotiated TLS with an SSLRequest
+	Listener        string            // Name of the listener that accepted the connection; empty for the default one
+	ClientAddr      string            // Remote address of the client connection
+
+	UpstreamParameters map[string]string // Startup parameters policies set on the upstream connection, over the client's
+}
+
+// SessionLogger is implemented by query loggers that attribute what they log to
+// the user and database of the connection. The connection handler calls
+// StartSession once the client has been admitted and EndSession when the
+// connection closes.
+type SessionLogger interface {
+	// StartSession records the session of a new connection
+	StartSession(session Session) error
+
+	// EndSession forgets the session of a closed connection
+	EndSession(connectionID string)
+}
+
+// TransactionStatus is the transaction status a backend reports in ReadyForQuery
+type TransactionStatus byte
+
+const (
+	TransactionIdle   TransactionStatus = 'I' // Outside a transaction block
+	TransactionActive TransactionStatus = 'T' // Inside a transaction block
+	TransactionFailed TransactionStatus = 'E' // Inside a failed transaction block, until it is rolled back
+)
+
+// String returns the name of the status
+func (s TransactionStatus) String() string {
+	switch s {
+	case TransactionActive:
+		return "active"
+	case TransactionFailed:
+		return "failed"
+	default:
+		return "idle"
+	}
+}
+
+// SessionState is what a client changed in its session since it connected,
+// as observed on the upstream connection: whether it is inside a transaction,
+// and the run-time parameters it set with SET and did not reset since
+type SessionState struct {
+	Transaction TransactionStatus
+	Parameters  map[string]string // Values as written in the SET statement, by lower-case parameter name
+}
+
+// InTransaction reports whether the client is inside a transaction block,
+// failed or not
+func (s SessionState) InTransaction() bool {
+	return s.Transaction == TransactionActive || s.Transaction == TransactionFailed
+}
+
+// SearchPath returns the search_path the client set, or "" when it kept the default
+func (s SessionState) SearchPath() string {
+	return s.Parameters["search_path"]
+}
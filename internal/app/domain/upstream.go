@@ -0,0 +1,34 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+// UpstreamTarget is a PostgreSQL or PgBouncer backend that client connections can be forwarded to
+type UpstreamTarget struct {
+	Address string // host:port
+
+	// ServerName replaces the server name of the upstream TLS configuration, for
+	// targets standing in for an upstream under another host name; empty keeps it
+	ServerName string
+}
+
+// UpstreamResolver discovers the current set of upstream targets
+type UpstreamResolver interface {
+	// Resolve returns the current targets and how long they may be cached before
+	// resolving again. A zero TTL leaves the refresh interval to the caller.
+	Resolve(ctx context.Context) ([]UpstreamTarget, time.Duration, error)
+}
+
+// UpstreamSelector picks the upstream target for a new client connection
+type UpstreamSelector interface {
+	// Next returns the target to connect to, or false when none is available
+	Next() (UpstreamTarget, bool)
+}
+
+// UpstreamChecker checks the health of an upstream target
+type UpstreamChecker interface {
+	// Check returns nil when the target at address is healthy
+	Check(ctx context.Context, address string) error
+}
@@ -0,0 +1,150 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthCheckTimeout bounds each check of a health probe
+const healthCheckTimeout = 2 * time.Second
+
+// Names of the checks reported by Health
+const (
+	HealthCheckListener   = "listener"
+	HealthCheckUpstream   = "upstream"
+	HealthCheckUsageStore = "usage_store"
+)
+
+// HealthCheck is the outcome of one check of a health probe
+type HealthCheck struct {
+	Name    string
+	Healthy bool
+	Detail  string
+}
+
+// Health is the outcome of a liveness or readiness probe
+type Health struct {
+	Healthy bool
+	Checks  []HealthCheck
+}
+
+// Liveness checks the listener only, so that an unreachable upstream does not get
+// the enforcer restarted: it is live once listening, including while it drains
+func (s *ServerService) Liveness() Health {
+	listener := s.checkListener()
+	live := listener.Healthy || s.DrainStatus().Draining
+	return Health{Healthy: live, Checks: []HealthCheck{listener}}
+}
+
+// Readiness checks that the listener accepts connections, that at least one
+// upstream target accepts a connection and that the usage store is reachable,
+// when an upstream and a usage store are configured. Upstream targets are probed
+// concurrently; while failed over, the secondary upstream is checked instead of
+// the primary. The upstreams of listeners having their own are checked as
+// upstream.<listener>, and those of databases as upstream.database.<database>.
+func (s *ServerService) Readiness(ctx context.Context) Health {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	checks := []HealthCheck{s.checkListener()}
+	switch {
+	case s.failover != nil && s.failover.Status().FailedOver:
+		check := s.checkUpstreams(ctx, HealthCheckUpstream, s.secondary)
+		check.Detail = "failed over to the secondary, " + check.Detail
+		checks = append(checks, check)
+	case s.upstreams != nil:
+		checks = append(checks, s.checkUpstreams(ctx, HealthCheckUpstream, s.upstreams))
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.listenerUpstreams)) {
+		checks = append(checks, s.checkUpstreams(ctx, HealthCheckUpstream+"."+name, s.listenerUpstreams[name]))
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.databaseUpstreams)) {
+		checks = append(checks, s.checkUpstreams(ctx, HealthCheckUpstream+".database."+name, s.databaseUpstreams[name]))
+	}
+	if s.usageStore != nil {
+		check := HealthCheck{Name: HealthCheckUsageStore, Healthy: true, Detail: "reachable"}
+		if err := s.usageStore.Ping(ctx); err != nil {
+			check.Healthy = false
+			check.Detail = err.Error()
+		}
+		checks = append(checks, check)
+	}
+
+	health := Health{Healthy: true, Checks: checks}
+	for _, check := range checks {
+		health.Healthy = health.Healthy && check.Healthy
+	}
+	return health
+}
+
+// checkListener reports whether the listener accepts connections
+func (s *ServerService) checkListener() HealthCheck {
+	check := HealthCheck{Name: HealthCheckListener}
+	select {
+	case <-s.tcpServer.Started():
+	default:
+		check.Detail = "not listening"
+		return check
+	}
+
+	if s.DrainStatus().Draining {
+		check.Detail = fmt.Sprintf("draining, %d connections open", s.tcpServer.OpenConnections())
+		return check
+	}
+	addresses := s.tcpServer.Addresses()
+	var listening []string
+	for _, name := range slices.Sorted(maps.Keys(addresses)) {
+		if name == "" {
+			listening = append(listening, addresses[name])
+		} else {
+			listening = append(listening, name+"="+addresses[name])
+		}
+	}
+	check.Healthy = true
+	check.Detail = "accepting connections on " + strings.Join(listening, ", ")
+	return check
+}
+
+// checkUpstreams opens a connection to every target of upstreams
+func (s *ServerService) checkUpstreams(ctx context.Context, name string, upstreams *UpstreamBalancer) HealthCheck {
+	check := HealthCheck{Name: name}
+	targets := upstreams.Targets()
+	if len(targets) == 0 {
+		check.Detail = "no upstream target resolved"
+		return check
+	}
+
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target domain.UpstreamTarget) {
+			defer wg.Done()
+			errs[i] = adapters.ProbeUpstream(ctx, target.Address, healthCheckTimeout)
+		}(i, target)
+	}
+	wg.Wait()
+
+	reachable := 0
+	var failure error
+	for _, err := range errs {
+		if err == nil {
+			reachable++
+		} else if failure == nil {
+			failure = err
+		}
+	}
+	check.Healthy = reachable > 0
+	check.Detail = fmt.Sprintf("%d of %d targets reachable", reachable, len(targets))
+	if failure != nil {
+		check.Detail += ": " + failure.Error()
+	}
+	return check
+}
@@ -0,0 +1,293 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLeaderRenewInterval is how often the leadership of the housekeeping
+	// jobs is acquired or renewed
+	DefaultLeaderRenewInterval = 5 * time.Second
+
+	// DefaultUsageReportInterval is how often the leader reports the usage of the
+	// windows that ended
+	DefaultUsageReportInterval = time.Hour
+
+	// DefaultUsageRetention is how long the counters of elapsed windows are kept
+	// for reporting before the leader compacts them
+	DefaultUsageRetention = 7 * 24 * time.Hour
+
+	// usageCompactionInterval is how often the leader compacts usage counters
+	usageCompactionInterval = time.Hour
+
+	// resignTimeout bounds the release of the leadership on shutdown
+	resignTimeout = 5 * time.Second
+)
+
+// HousekeepingConfig configures the jobs run by the replica elected leader of a cluster
+type HousekeepingConfig struct {
+	// RenewInterval is how often the leadership is acquired or renewed; it must
+	// be well below how long the elector grants it for
+	RenewInterval  time.Duration
+	ReportInterval time.Duration
+	Retention      time.Duration // of the counters of elapsed windows
+
+	// ExportDir receives a file every report interval, summing the usage of
+	// each tenant, in ExportFormat (csv when empty); empty disables the export
+	ExportDir    string
+	ExportFormat string
+}
+
+// Validate checks that counters are kept until they are reported
+func (c HousekeepingConfig) Validate() error {
+	if c.RenewInterval < 0 || c.ReportInterval < 0 || c.Retention < 0 {
+		return fmt.Errorf("housekeeping intervals and retention must not be negative")
+	}
+	if c.Retention > 0 && c.Retention < c.reportInterval() {
+		return fmt.Errorf("usage retention %s is shorter than the report interval %s", c.Retention, c.reportInterval())
+	}
+	if c.ExportFormat != "" {
+		if err := adapters.UsageExportFormat(c.ExportFormat).Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportFormat returns ExportFormat, or csv when empty
+func (c HousekeepingConfig) exportFormat() adapters.UsageExportFormat {
+	if c.ExportFormat != "" {
+		return adapters.UsageExportFormat(c.ExportFormat)
+	}
+	return adapters.UsageExportCSV
+}
+
+// reportInterval returns ReportInterval, or its default when zero
+func (c HousekeepingConfig) reportInterval() time.Duration {
+	if c.ReportInterval > 0 {
+		return c.ReportInterval
+	}
+	return DefaultUsageReportInterval
+}
+
+// HousekeepingJob is a periodic job run by the leader only
+type HousekeepingJob struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context, now time.Time) error
+}
+
+// Housekeeper runs housekeeping jobs on the replica elected leader. Every renew
+// interval it acquires or renews the leadership, then runs the jobs that are due
+// with a context ending with the leadership. A replica taking over runs every
+// job at once, so a job may run early after a change of leader but never on
+// two replicas at the same time.
+type Housekeeper struct {
+	elector domain.LeaderElector
+	jobs    []HousekeepingJob
+	renew   time.Duration
+	clock   domain.Clock
+	logger  logger.Logger
+	due     []time.Time // of each job while leading
+
+	mu    sync.Mutex
+	until time.Time // end of the leadership, zero while not leading
+}
+
+// NewHousekeeper creates a Housekeeper electing the leader with elector every
+// renew interval; zero uses DefaultLeaderRenewInterval
+func NewHousekeeper(elector domain.LeaderElector, renew time.Duration, clock domain.Clock, log logger.Logger, jobs ...HousekeepingJob) *Housekeeper {
+	if renew <= 0 {
+		renew = DefaultLeaderRenewInterval
+	}
+	return &Housekeeper{
+		elector: elector,
+		jobs:    jobs,
+		renew:   renew,
+		clock:   clock,
+		logger:  log,
+		due:     make([]time.Time, len(jobs)),
+	}
+}
+
+// Leader reports whether the instance leads the housekeeping jobs
+func (h *Housekeeper) Leader() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.until.After(h.clock.Now())
+}
+
+// Tick acquires or renews the leadership and, while the instance leads, runs
+// the jobs that are due. A failed renewal keeps the leadership until it expires.
+func (h *Housekeeper) Tick(ctx context.Context) {
+	h.mu.Lock()
+	until := h.until
+	h.mu.Unlock()
+
+	now := h.clock.Now()
+	leading := until.After(now)
+	if renewed, err := h.elector.Lead(ctx); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		h.logger.Error("Failed to renew the leadership of the housekeeping jobs: %v", err)
+	} else {
+		until = renewed
+	}
+
+	elected := until.After(now)
+	switch {
+	case elected && !leading:
+		h.logger.Info("Elected leader of the housekeeping jobs")
+		clear(h.due)
+	case !elected && leading:
+		h.logger.Info("Lost the leadership of the housekeeping jobs")
+	}
+	h.mu.Lock()
+	h.until = until
+	h.mu.Unlock()
+	if !elected {
+		return
+	}
+
+	jobCtx, cancel := context.WithDeadline(ctx, until)
+	defer cancel()
+	for i, job := range h.jobs {
+		if now.Before(h.due[i]) {
+			continue
+		}
+		h.due[i] = now.Add(job.Interval)
+		if err := job.Run(jobCtx, now); err != nil && ctx.Err() == nil {
+			h.logger.Error("Housekeeping job %s failed: %v", job.Name, err)
+		}
+	}
+}
+
+// Run elects the leader and runs the jobs every renew interval until ctx is
+// cancelled, then releases the leadership
+func (h *Housekeeper) Run(ctx context.Context) {
+	for {
+		h.Tick(ctx)
+		timer := h.clock.NewTimer(h.renew)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			h.resign()
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// resign releases the leadership if the instance holds it
+func (h *Housekeeper) resign() {
+	if !h.Leader() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resignTimeout)
+	defer cancel()
+	if err := h.elector.Resign(ctx); err != nil {
+		h.logger.Error("Failed to resign the leadership of the housekeeping jobs: %v", err)
+	}
+
+	h.mu.Lock()
+	h.until = time.Time{}
+	h.mu.Unlock()
+}
+
+// UsageReportJob emits, every interval, a usage report per quota policy over the
+// windows that rolled over since the previous report. A new leader reports the
+// windows that ended within the last interval.
+func UsageReportJob(history domain.UsageHistory, events domain.EventSink, interval time.Duration) HousekeepingJob {
+	var reported time.Time
+	return HousekeepingJob{
+		Name:     "usage report",
+		Interval: interval,
+		Run: func(ctx context.Context, now time.Time) error {
+			from := reported
+			if from.IsZero() {
+				from = now.Add(-interval)
+			}
+			windows, err := history.Ended(ctx, from, now)
+			if err != nil {
+				return err
+			}
+			reported = now
+
+			for _, report := range usageReports(windows) {
+				report["from"] = from.UTC().Format(time.RFC3339)
+				report["to"] = now.UTC().Format(time.RFC3339)
+				events.Emit(domain.Event{Type: domain.EventUsageReport, Timestamp: now, Fields: report})
+			}
+			return nil
+		},
+	}
+}
+
+// usageReports sums windows by policy, in the order of the policy names
+func usageReports(windows []domain.WindowUsage) []map[string]interface{} {
+	type summary struct {
+		windows    int
+		principals map[[2]string]bool
+		used       int64
+		maxUsed    int64
+	}
+	summaries := make(map[string]*summary)
+	for _, window := range windows {
+		s, ok := summaries[window.Key.Policy]
+		if !ok {
+			s = &summary{principals: make(map[[2]string]bool)}
+			summaries[window.Key.Policy] = s
+		}
+		s.windows++
+		s.principals[[2]string{window.Key.User, window.Key.Database}] = true
+		s.used += window.Used
+		s.maxUsed = max(s.maxUsed, window.Used)
+	}
+
+	policies := make([]string, 0, len(summaries))
+	for policy := range summaries {
+		policies = append(policies, policy)
+	}
+	sort.Strings(policies)
+
+	reports := make([]map[string]interface{}, 0, len(policies))
+	for _, policy := range policies {
+		s := summaries[policy]
+		reports = append(reports, map[string]interface{}{
+			"policy":     policy,
+			"windows":    s.windows,
+			"principals": len(s.principals),
+			"used":       s.used,
+			"max_used":   s.maxUsed,
+		})
+	}
+	return reports
+}
+
+// UsageCompactionJob deletes, every hour, the counters of the windows that
+// ended longer than retention ago
+func UsageCompactionJob(history domain.UsageHistory, retention time.Duration, log logger.Logger) HousekeepingJob {
+	return HousekeepingJob{
+		Name:     "usage compaction",
+		Interval: usageCompactionInterval,
+		Run: func(ctx context.Context, now time.Time) error {
+			before := now.Add(-retention)
+			deleted, err := history.Compact(ctx, before)
+			if err != nil {
+				return err
+			}
+			if deleted > 0 {
+				log.Info("Compacted %d usage counters of windows ended before %s", deleted, before.UTC().Format(time.RFC3339))
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// usageHistory implements domain.UsageHistory with windows kept in memory
+type usageHistory struct {
+	mu      sync.Mutex
+	windows []domain.WindowUsage
+}
+
+func (h *usageHistory) Ended(ctx context.Context, from, to time.Time) ([]domain.WindowUsage, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var ended []domain.WindowUsage
+	for _, window := range h.windows {
+		if window.End.After(from) && !window.End.After(to) {
+			ended = append(ended, window)
+		}
+	}
+	return ended, nil
+}
+
+func (h *usageHistory) Compact(ctx context.Context, before time.Time) (int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	kept := h.windows[:0]
+	for _, window := range h.windows {
+		if !window.End.Before(before) {
+			kept = append(kept, window)
+		}
+	}
+	deleted := int64(len(h.windows) - len(kept))
+	h.windows = kept
+	return deleted, nil
+}
+
+func TestHousekeeper_RunsJobsWhileLeading(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	start := clock.Now()
+	history := &usageHistory{windows: []domain.WindowUsage{
+		{Key: domain.UsageKey{Policy: "hourly", User: "alice", Database: "app"}, Start: start.Add(-2 * time.Hour), End: start.Add(-time.Hour), Used: 5},
+		{Key: domain.UsageKey{Policy: "hourly", User: "alice", Database: "app"}, Start: start.Add(-time.Hour), End: start, Used: 7},
+		{Key: domain.UsageKey{Policy: "hourly", User: "bob", Database: "app"}, Start: start.Add(-time.Hour), End: start, Used: 3},
+		{Key: domain.UsageKey{Policy: "daily", User: "bob", Database: "app"}, Start: start.Add(-24 * time.Hour), End: start.Add(-30 * time.Minute), Used: 40},
+		{Key: domain.UsageKey{Policy: "daily", User: "bob", Database: "app"}, Start: start.Add(-72 * time.Hour), End: start.Add(-48 * time.Hour), Used: 90},
+	}}
+	events := &mocks.RecordingEventSink{}
+	elector := &mocks.LeaderElector{}
+	log := logger.NewSimpleLogger()
+	housekeeper := NewHousekeeper(elector, 5*time.Second, clock, log,
+		UsageReportJob(history, events, time.Hour),
+		UsageCompactionJob(history, 24*time.Hour, log))
+
+	elector.On("Lead", ctx).Return(time.Time{}, nil).Once()
+	housekeeper.Tick(ctx)
+	assert.False(t, housekeeper.Leader())
+	assert.Empty(t, events.Events(), "Followers should not run the jobs")
+	assert.Len(t, history.windows, 5)
+
+	elector.On("Lead", ctx).Return(clock.Now().Add(15*time.Second), nil).Once()
+	housekeeper.Tick(ctx)
+	assert.True(t, housekeeper.Leader())
+	reports := events.EventsOfType(domain.EventUsageReport)
+	require.Len(t, reports, 2)
+	assert.Equal(t, map[string]interface{}{
+		"policy": "daily", "windows": 1, "principals": 1, "used": int64(40), "max_used": int64(40),
+		"from": "2025-06-01T11:00:00Z", "to": "2025-06-01T12:00:00Z",
+	}, reports[0].Fields)
+	assert.Equal(t, map[string]interface{}{
+		"policy": "hourly", "windows": 2, "principals": 2, "used": int64(10), "max_used": int64(7),
+		"from": "2025-06-01T11:00:00Z", "to": "2025-06-01T12:00:00Z",
+	}, reports[1].Fields, "Windows ended before the last interval should not be reported")
+	assert.Len(t, history.windows, 4, "Windows ended before the retention should be compacted")
+
+	// A failed renewal keeps the leadership until it expires
+	clock.Advance(5 * time.Second)
+	elector.On("Lead", ctx).Return(time.Time{}, errors.New("connection refused")).Once()
+	housekeeper.Tick(ctx)
+	assert.True(t, housekeeper.Leader())
+	assert.Len(t, events.Events(), 2, "Jobs should wait for their interval")
+
+	clock.Advance(10 * time.Second)
+	elector.On("Lead", ctx).Return(time.Time{}, errors.New("connection refused")).Once()
+	housekeeper.Tick(ctx)
+	assert.False(t, housekeeper.Leader())
+
+	elector.AssertExpectations(t)
+}
+
+func TestHousekeeper_ResignsOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	elector := &mocks.LeaderElector{}
+	elector.On("Lead", mock.Anything).Return(clock.Now().Add(15*time.Second), nil)
+	elector.On("Resign", mock.Anything).Return(nil).Once()
+	housekeeper := NewHousekeeper(elector, 5*time.Second, clock, logger.NewSimpleLogger())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		housekeeper.Run(ctx)
+	}()
+	require.Eventually(t, housekeeper.Leader, time.Second, time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run should return once cancelled")
+	}
+	assert.False(t, housekeeper.Leader())
+	elector.AssertExpectations(t)
+}
+
+func TestHousekeepingConfig_Validate(t *testing.T) {
+	assert.NoError(t, HousekeepingConfig{}.Validate())
+	assert.NoError(t, HousekeepingConfig{ReportInterval: 24 * time.Hour, Retention: 48 * time.Hour}.Validate())
+	assert.ErrorContains(t, HousekeepingConfig{Retention: 30 * time.Minute}.Validate(), "shorter than the report interval")
+	assert.Error(t, HousekeepingConfig{RenewInterval: -time.Second}.Validate())
+}
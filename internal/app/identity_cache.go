@@ -0,0 +1,209 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultIdentityCacheTTL is how long the groups of a user are cached
+	DefaultIdentityCacheTTL = 5 * time.Minute
+
+	// DefaultIdentityRetry is how long a failed lookup is not retried
+	DefaultIdentityRetry = 10 * time.Second
+)
+
+// IdentityConfig configures the lookup of the directory groups of users, which
+// quota policies target through their role
+type IdentityConfig struct {
+	LDAP LDAPConfig
+
+	// CacheTTL is how long the groups of a user are cached; zero uses
+	// DefaultIdentityCacheTTL
+	CacheTTL time.Duration
+}
+
+// LDAPConfig configures the LDAP directory groups are searched in
+type LDAPConfig struct {
+	// URL of the server, ldap://host[:port] or ldaps://host[:port]; empty disables the lookup
+	URL string
+
+	// BindDN and BindPassword are the credentials searches bind with; empty
+	// searches anonymously
+	BindDN       string
+	BindPassword string
+
+	// BaseDN is the subtree groups are searched in
+	BaseDN string
+
+	// GroupFilter finds the groups of a user, {user} standing for the user name,
+	// and GroupAttribute holds the name of the groups; empty uses the adapter
+	// defaults, posixGroup entries listing the user as a memberUid and cn
+	GroupFilter    string
+	GroupAttribute string
+
+	// CAFile holds the CAs trusted to sign the certificate of ldaps and
+	// StartTLS servers; empty uses the system roots
+	CAFile string
+
+	// StartTLS upgrades ldap:// connections to TLS before binding
+	StartTLS bool
+
+	// FollowReferrals follows the search references of the server, one hop deep
+	FollowReferrals bool
+
+	// Timeout bounds each lookup; zero uses the adapter default
+	Timeout time.Duration
+}
+
+// Enabled reports whether a directory is configured
+func (c IdentityConfig) Enabled() bool {
+	return c.LDAP.URL != ""
+}
+
+// Validate checks that an enabled directory has a base DN, no negative TTL or
+// timeout, and no StartTLS on an ldaps URL
+func (c IdentityConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.LDAP.BaseDN == "" {
+		return fmt.Errorf("identity: ldap base DN is required")
+	}
+	if c.CacheTTL < 0 || c.LDAP.Timeout < 0 {
+		return fmt.Errorf("identity: cache TTL and ldap timeout must not be negative")
+	}
+	if c.LDAP.StartTLS && strings.HasPrefix(c.LDAP.URL, "ldaps:") {
+		return fmt.Errorf("identity: ldap StartTLS requires an ldap URL")
+	}
+	return nil
+}
+
+// newIdentityResolver creates the LDAP resolver of config
+func newIdentityResolver(config IdentityConfig) (*adapters.LDAPIdentityResolver, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	ldap := config.LDAP
+	var opts []adapters.LDAPIdentityResolverOption
+	if ldap.BindDN != "" {
+		opts = append(opts, adapters.WithLDAPBind(ldap.BindDN, ldap.BindPassword))
+	}
+	if ldap.GroupFilter != "" {
+		opts = append(opts, adapters.WithLDAPGroupFilter(ldap.GroupFilter))
+	}
+	if ldap.GroupAttribute != "" {
+		opts = append(opts, adapters.WithLDAPGroupAttribute(ldap.GroupAttribute))
+	}
+	if ldap.CAFile != "" {
+		opts = append(opts, adapters.WithLDAPRootCAs(ldap.CAFile))
+	}
+	if ldap.StartTLS {
+		opts = append(opts, adapters.WithLDAPStartTLS())
+	}
+	if ldap.FollowReferrals {
+		opts = append(opts, adapters.WithLDAPReferrals())
+	}
+	if ldap.Timeout > 0 {
+		opts = append(opts, adapters.WithLDAPTimeout(ldap.Timeout))
+	}
+	resolver, err := adapters.NewLDAPIdentityResolver(ldap.URL, ldap.BaseDN, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("identity: %w", err)
+	}
+	return resolver, nil
+}
+
+// IdentityCache implements domain.IdentityResolver by caching the groups
+// another resolver finds. Expired groups keep being returned while they are
+// looked up again in the background, so only the first lookup of a user waits
+// for the directory. Lookups that fail are logged and retried after
+// DefaultIdentityRetry; until then the user keeps the groups last found, none
+// if it was never resolved.
+type IdentityCache struct {
+	resolver domain.IdentityResolver
+	ttl      time.Duration
+	clock    domain.Clock
+	logger   logger.Logger
+
+	mu       sync.Mutex
+	entries  map[string]identityEntry
+	inflight map[string]chan struct{} // lookups in progress, closed once done
+}
+
+// identityEntry holds the groups of a user until they expire
+type identityEntry struct {
+	groups  []string
+	expires time.Time
+}
+
+// NewIdentityCache creates an IdentityCache over resolver; a zero ttl uses DefaultIdentityCacheTTL
+func NewIdentityCache(resolver domain.IdentityResolver, ttl time.Duration, clock domain.Clock, log logger.Logger) *IdentityCache {
+	if ttl <= 0 {
+		ttl = DefaultIdentityCacheTTL
+	}
+	return &IdentityCache{
+		resolver: resolver,
+		ttl:      ttl,
+		clock:    clock,
+		logger:   log,
+		entries:  make(map[string]identityEntry),
+		inflight: make(map[string]chan struct{}),
+	}
+}
+
+// Groups returns the cached groups of user. The first lookup of a user is
+// waited for, concurrent callers included, unless ctx is done first.
+func (c *IdentityCache) Groups(ctx context.Context, user string) ([]string, error) {
+	c.mu.Lock()
+	entry, cached := c.entries[user]
+	if cached && c.clock.Now().Before(entry.expires) {
+		c.mu.Unlock()
+		return entry.groups, nil
+	}
+	done, busy := c.inflight[user]
+	if !busy {
+		done = make(chan struct{})
+		c.inflight[user] = done
+		// The lookup outlives the caller: the resolver bounds it on its own
+		go c.lookup(context.WithoutCancel(ctx), user, done)
+	}
+	c.mu.Unlock()
+	if cached {
+		return entry.groups, nil
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[user].groups, nil
+}
+
+// lookup resolves the groups of user and caches them, then closes done
+func (c *IdentityCache) lookup(ctx context.Context, user string, done chan struct{}) {
+	groups, err := c.resolver.Groups(ctx, user)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer close(done)
+	delete(c.inflight, user)
+	now := c.clock.Now()
+	if err != nil {
+		c.logger.Error("Failed to look up the groups of %s: %v", user, err)
+		entry := c.entries[user]
+		entry.expires = now.Add(DefaultIdentityRetry)
+		c.entries[user] = entry
+		return
+	}
+	c.entries[user] = identityEntry{groups: groups, expires: now.Add(c.ttl)}
+}
@@ -0,0 +1,64 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentityCache(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	resolver := &mocks.IdentityResolver{}
+	resolver.On("Groups", mock.Anything, "alice").Return([]string{"analysts"}, nil).Once()
+	cache := NewIdentityCache(resolver, time.Minute, clock, logger.NewSimpleLogger())
+	settled := func() bool {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		return len(cache.inflight) == 0
+	}
+
+	groups, err := cache.Groups(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"analysts"}, groups, "The first lookup should be waited for")
+	groups, _ = cache.Groups(ctx, "alice")
+	assert.Equal(t, []string{"analysts"}, groups)
+	resolver.AssertNumberOfCalls(t, "Groups", 1)
+
+	// Expired groups are served while they are looked up again
+	resolver.On("Groups", mock.Anything, "alice").Return([]string{"analysts", "oncall"}, nil).Once()
+	clock.Advance(2 * time.Minute)
+	groups, _ = cache.Groups(ctx, "alice")
+	assert.Equal(t, []string{"analysts"}, groups)
+	require.Eventually(t, func() bool {
+		groups, _ := cache.Groups(ctx, "alice")
+		return len(groups) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Failures keep the groups last found and are retried later
+	resolver.On("Groups", mock.Anything, "alice").Return(nil, errors.New("directory unavailable"))
+	clock.Advance(2 * time.Minute)
+	_, _ = cache.Groups(ctx, "alice")
+	require.Eventually(t, settled, 2*time.Second, 10*time.Millisecond)
+	groups, _ = cache.Groups(ctx, "alice")
+	assert.Equal(t, []string{"analysts", "oncall"}, groups)
+	resolver.AssertNumberOfCalls(t, "Groups", 3)
+	clock.Advance(DefaultIdentityRetry)
+	_, _ = cache.Groups(ctx, "alice")
+	require.Eventually(t, settled, 2*time.Second, 10*time.Millisecond)
+	resolver.AssertNumberOfCalls(t, "Groups", 4)
+
+	resolver.On("Groups", mock.Anything, "bob").Return(nil, errors.New("directory unavailable"))
+	groups, err = cache.Groups(ctx, "bob")
+	require.NoError(t, err)
+	assert.Empty(t, groups, "Users never resolved should have no group")
+}
@@ -0,0 +1,139 @@
+package app
+
+import (
+	"sort"
+	"sync"
+)
+
+// trackedConnection is the state of one client connection in an IdleConnectionTracker
+type trackedConnection struct {
+	principal principalKey
+	idle      bool
+	idleOrder uint64 // order in which connections went idle
+	evicted   bool
+	evict     func()
+}
+
+// IdleConnectionTracker is a domain.ConnectionTracker that caps the number of idle
+// connections each principal (user and database) may hold. When a connection going
+// idle puts its principal over the cap, the principal's longest idle connections are
+// evicted, reclaiming capacity hogged by clients that leak connections.
+type IdleConnectionTracker struct {
+	maxIdle int
+
+	mu          sync.Mutex
+	idleSeq     uint64
+	connections map[string]*trackedConnection
+	principals  map[principalKey]map[string]*trackedConnection
+}
+
+// NewIdleConnectionTracker creates a tracker allowing maxIdle idle connections per principal
+func NewIdleConnectionTracker(maxIdle int) *IdleConnectionTracker {
+	return &IdleConnectionTracker{
+		maxIdle:     maxIdle,
+		connections: make(map[string]*trackedConnection),
+		principals:  make(map[principalKey]map[string]*trackedConnection),
+	}
+}
+
+// Track registers a busy connection for the principal
+func (t *IdleConnectionTracker) Track(connectionID, user, database string, evict func()) {
+	key := principalKey{user: user, database: database}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	connection := &trackedConnection{principal: key, evict: evict}
+	t.connections[connectionID] = connection
+	if t.principals[key] == nil {
+		t.principals[key] = make(map[string]*trackedConnection)
+	}
+	t.principals[key][connectionID] = connection
+}
+
+// Busy marks the connection as processing a message
+func (t *IdleConnectionTracker) Busy(connectionID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	connection, ok := t.connections[connectionID]
+	if !ok {
+		return true
+	}
+	if connection.evicted {
+		return false
+	}
+	connection.idle = false
+	return true
+}
+
+// Idle marks the connection as idle and evicts the principal's longest idle
+// connections beyond the cap
+func (t *IdleConnectionTracker) Idle(connectionID string) {
+	t.mu.Lock()
+
+	connection, ok := t.connections[connectionID]
+	if !ok || connection.idle || connection.evicted {
+		t.mu.Unlock()
+		return
+	}
+	t.idleSeq++
+	connection.idle = true
+	connection.idleOrder = t.idleSeq
+
+	var idle []*trackedConnection
+	for _, candidate := range t.principals[connection.principal] {
+		if candidate.idle {
+			idle = append(idle, candidate)
+		}
+	}
+
+	var evictions []func()
+	if excess := len(idle) - t.maxIdle; excess > 0 {
+		sort.Slice(idle, func(i, j int) bool {
+			return idle[i].idleOrder < idle[j].idleOrder
+		})
+		for _, victim := range idle[:excess] {
+			victim.idle = false
+			victim.evicted = true
+			evictions = append(evictions, victim.evict)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, evict := range evictions {
+		evict()
+	}
+}
+
+// Untrack forgets the connection
+func (t *IdleConnectionTracker) Untrack(connectionID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	connection, ok := t.connections[connectionID]
+	if !ok {
+		return
+	}
+	delete(t.connections, connectionID)
+
+	principal := t.principals[connection.principal]
+	delete(principal, connectionID)
+	if len(principal) == 0 {
+		delete(t.principals, connection.principal)
+	}
+}
+
+// IdleCount returns the number of idle connections held by the principal
+func (t *IdleConnectionTracker) IdleCount(user, database string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	count := 0
+	for _, connection := range t.principals[principalKey{user: user, database: database}] {
+		if connection.idle {
+			count++
+		}
+	}
+	return count
+}
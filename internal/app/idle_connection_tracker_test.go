@@ -0,0 +1,40 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdleConnectionTracker_EvictsLongestIdle(t *testing.T) {
+	tracker := NewIdleConnectionTracker(2)
+
+	var evicted []string
+	track := func(id, user string) {
+		tracker.Track(id, user, "app", func() { evicted = append(evicted, id) })
+	}
+	track("conn_1", "alice")
+	track("conn_2", "alice")
+	track("conn_3", "alice")
+	track("conn_4", "bob")
+
+	tracker.Idle("conn_2")
+	tracker.Idle("conn_1")
+	tracker.Idle("conn_4")
+	assert.Empty(t, evicted, "Principals within the cap keep their connections")
+
+	tracker.Idle("conn_3")
+	assert.Equal(t, []string{"conn_2"}, evicted, "The longest idle connection should be evicted")
+	assert.Equal(t, 2, tracker.IdleCount("alice", "app"))
+	assert.False(t, tracker.Busy("conn_2"), "Evicted connections must not process messages")
+
+	assert.True(t, tracker.Busy("conn_1"))
+	tracker.Idle("conn_1")
+	tracker.Idle("conn_1")
+	assert.Len(t, evicted, 1, "Going idle again within the cap evicts nothing")
+
+	tracker.Untrack("conn_2")
+	tracker.Untrack("conn_1")
+	assert.Equal(t, 1, tracker.IdleCount("alice", "app"))
+	assert.True(t, tracker.Busy("conn_unknown"), "Untracked connections are never held back")
+}
@@ -0,0 +1,35 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+)
+
+// GenerateInstanceID builds an identifier for this enforcer replica from the
+// hostname and a random suffix, so restarts on the same host stay distinguishable
+func GenerateInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "enforcer"
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return host
+	}
+	return host + "-" + hex.EncodeToString(suffix)
+}
+
+// instanceEventSink stamps the instance ID on every event before forwarding it
+type instanceEventSink struct {
+	instanceID string
+	next       domain.EventSink
+}
+
+// Emit sets the event's instance ID and forwards it
+func (s instanceEventSink) Emit(event domain.Event) {
+	event.InstanceID = s.instanceID
+	s.next.Emit(event)
+}
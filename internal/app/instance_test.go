@@ -0,0 +1,43 @@
+package app
+
+import (
+	"strings"
+	"testing"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateInstanceID(t *testing.T) {
+	first := GenerateInstanceID()
+	second := GenerateInstanceID()
+
+	assert.NotEmpty(t, first)
+	assert.NotEqual(t, first, second, "Restarts on the same host should get distinct IDs")
+	assert.Equal(t, first[:strings.LastIndex(first, "-")], second[:strings.LastIndex(second, "-")])
+}
+
+func TestInstanceEventSink(t *testing.T) {
+	events := &mocks.RecordingEventSink{}
+	sink := instanceEventSink{instanceID: "enforcer-1", next: events}
+
+	sink.Emit(domain.Event{Type: domain.EventQueryBurst, ConnectionID: "conn_1"})
+
+	recorded := events.Events()
+	require.Len(t, recorded, 1)
+	assert.Equal(t, "enforcer-1", recorded[0].InstanceID)
+	assert.Equal(t, "conn_1", recorded[0].ConnectionID)
+}
+
+func TestNewServerService_InstanceID(t *testing.T) {
+	service, err := NewServerService(ServerConfig{Address: "127.0.0.1:0", InstanceID: "enforcer-1"})
+	require.NoError(t, err)
+	assert.Equal(t, "enforcer-1", service.InstanceID())
+
+	service, err = NewServerService(ServerConfig{Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	assert.NotEmpty(t, service.InstanceID(), "An instance ID should be generated when none is configured")
+}
@@ -0,0 +1,1049 @@
+package interfaces
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminPolicy is a quota policy as exchanged with the admin API
+type adminPolicy struct {
+	Name      string            `json:"name"`
+	User      string            `json:"user,omitempty"`
+	Role      string            `json:"role,omitempty"`
+	Database  string            `json:"database,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Listener  string            `json:"listener,omitempty"`
+	Dimension string            `json:"dimension,omitempty"`
+	Limit     int64             `json:"limit,omitempty"`
+	PerLabel  string            `json:"per_label,omitempty"`
+	Window    string            `json:"window,omitempty"` // Go duration, e.g. 1h
+	Rate      float64           `json:"rate,omitempty"`   // queries per second
+	Burst     int64             `json:"burst,omitempty"`
+	RatePer   string            `json:"rate_per,omitempty"`
+
+	Credits    int64   `json:"credits,omitempty"`     // most credits accrued while below the rate
+	CreditRate float64 `json:"credit_rate,omitempty"` // credits earned per second while idle
+
+	WarnAt int    `json:"warn_at,omitempty"` // percentage of the limit
+	Soft   bool   `json:"soft,omitempty"`
+	Grace  string `json:"grace,omitempty"` // Go duration, e.g. 15m
+
+	TightenAt int `json:"tighten_at,omitempty"` // pool saturation percentage
+	TightenTo int `json:"tighten_to,omitempty"` // percentage of the limits and rate
+
+	MaxConnections       int64  `json:"max_connections,omitempty"`
+	MaxConcurrentQueries int64  `json:"max_concurrent_queries,omitempty"`
+	QueueTimeout         string `json:"queue_timeout,omitempty"`     // Go duration, e.g. 5s
+	StatementTimeout     string `json:"statement_timeout,omitempty"` // Go duration, e.g. 30s
+	MaxResultRows        int64  `json:"max_result_rows,omitempty"`
+	MaxResultBytes       int64  `json:"max_result_bytes,omitempty"`
+
+	MaxTransactionDuration   string `json:"max_transaction_duration,omitempty"` // Go duration, e.g. 5m
+	MaxTransactionStatements int64  `json:"max_transaction_statements,omitempty"`
+
+	StartupParameters map[string]string `json:"startup_parameters,omitempty"`
+
+	Tables      []string                `json:"tables,omitempty"`
+	Statements  []domain.StatementClass `json:"statements,omitempty"`
+	Deny        bool                    `json:"deny,omitempty"`
+	AllowDuring []string                `json:"allow_during,omitempty"` // e.g. Sat 02:00-04:00
+
+	ActiveDuring []string `json:"active_during,omitempty"` // e.g. Mon-Fri 09:00-18:00 Europe/Paris
+
+	Fingerprints []string `json:"fingerprints,omitempty"` // query hashes, as logged in query_hash
+	Patterns     []string `json:"patterns,omitempty"`     // regular expressions
+	Allow        bool     `json:"allow,omitempty"`
+	Hint         string   `json:"hint,omitempty"`
+
+	Override bool `json:"override,omitempty"`
+}
+
+// adminExplainRequest describes a query to explain the policies of
+type adminExplainRequest struct {
+	User     string            `json:"user"`
+	Database string            `json:"database,omitempty"` // defaults to the user
+	Listener string            `json:"listener,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Query    string            `json:"query"`
+}
+
+// adminExplanation tells whether a policy applies to the query explained, and why
+type adminExplanation struct {
+	Policy     adminPolicy `json:"policy"` // less the limits overrides replaced
+	Applies    bool        `json:"applies"`
+	Reason     string      `json:"reason"`
+	ReplacedBy string      `json:"replaced_by,omitempty"`
+}
+
+// adminUsage is the usage of a principal under a policy
+type adminUsage struct {
+	Policy    string    `json:"policy"`
+	User      string    `json:"user"`
+	Database  string    `json:"database"`
+	Label     string    `json:"label,omitempty"`
+	Dimension string    `json:"dimension"`
+	Used      int64     `json:"used"`
+	Limit     int64     `json:"limit"`
+	Window    string    `json:"window"`
+	ResetAt   time.Time `json:"reset_at"`
+}
+
+// adminCredits is the credit balance of a principal under a policy with credits
+type adminCredits struct {
+	Policy     string    `json:"policy"`
+	User       string    `json:"user"`
+	Database   string    `json:"database"`
+	Credits    float64   `json:"credits"`
+	Cap        int64     `json:"cap"`
+	CreditRate float64   `json:"credit_rate"` // credits earned per second while idle
+	FullAt     time.Time `json:"full_at"`
+}
+
+// adminConnection is an open client connection
+type adminConnection struct {
+	ID          string    `json:"id"`
+	User        string    `json:"user"`
+	Database    string    `json:"database"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Idle        bool      `json:"idle"`
+	Age         string    `json:"age"`
+
+	ClientAddr  string            `json:"client_addr,omitempty"`
+	Query       string            `json:"query,omitempty"`
+	QueryStart  *time.Time        `json:"query_start,omitempty"`
+	Transaction string            `json:"transaction"`
+	Parameters  map[string]string `json:"parameters,omitempty"`
+}
+
+// adminActivity is the recent traffic of a server
+type adminActivity struct {
+	InstanceID string                   `json:"instance_id"`
+	Window     string                   `json:"window"`
+	Principals []adminPrincipalActivity `json:"principals"`
+	Denials    []adminDenial            `json:"recent_denials"`
+}
+
+// adminPrincipalActivity is the recent traffic of a user and database
+type adminPrincipalActivity struct {
+	User             string  `json:"user"`
+	Database         string  `json:"database"`
+	Queries          int64   `json:"queries"`
+	Denied           int64   `json:"denied"`
+	QueriesPerSecond float64 `json:"queries_per_second"`
+}
+
+// adminDenial is a denied query
+type adminDenial struct {
+	Time         time.Time `json:"time"`
+	ConnectionID string    `json:"connection_id"`
+	User         string    `json:"user"`
+	Database     string    `json:"database"`
+	Policy       string    `json:"policy"`
+	Reason       string    `json:"reason"`
+}
+
+// adminQueryStats is the statistics of a query fingerprint
+type adminQueryStats struct {
+	Hash        string    `json:"query_hash"`
+	Query       string    `json:"query"`
+	Calls       int64     `json:"calls"`
+	TotalTimeMs float64   `json:"total_time_ms"`
+	MeanTimeMs  float64   `json:"mean_time_ms"`
+	P95TimeMs   float64   `json:"p95_time_ms"`
+	Rows        int64     `json:"rows"`
+	Bytes       int64     `json:"bytes"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// queryStatsOrders are the orders ?sort= may list query statistics in, each
+// largest first
+var queryStatsOrders = map[string]func(a, b domain.QueryStats) bool{
+	"total": func(a, b domain.QueryStats) bool { return a.TotalDuration > b.TotalDuration },
+	"mean":  func(a, b domain.QueryStats) bool { return a.MeanDuration() > b.MeanDuration() },
+	"p95":   func(a, b domain.QueryStats) bool { return a.P95Duration > b.P95Duration },
+	"calls": func(a, b domain.QueryStats) bool { return a.Calls > b.Calls },
+	"rows":  func(a, b domain.QueryStats) bool { return a.Rows > b.Rows },
+	"bytes": func(a, b domain.QueryStats) bool { return a.Bytes > b.Bytes },
+}
+
+// adminQueryCache reports the lookups of the normalized query cache
+type adminQueryCache struct {
+	Enabled    bool            `json:"enabled"`
+	Queries    adminCacheStats `json:"queries"`    // by query text
+	Statements adminCacheStats `json:"statements"` // by prepared statement name
+}
+
+// adminCacheStats counts the lookups of a cache
+type adminCacheStats struct {
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	HitRatio  float64 `json:"hit_ratio"`
+	Evictions int64   `json:"evictions"`
+	Entries   int     `json:"entries"`
+	Capacity  int     `json:"capacity"`
+}
+
+// adminPooler reports the pools of the upstream's pooler as last polled
+type adminPooler struct {
+	PolledAt time.Time         `json:"polled_at"` // zero until a poll succeeds
+	Pools    []adminPoolerPool `json:"pools"`
+}
+
+// adminPoolerPool is a pool of the upstream's pooler, merged with the
+// enforcer's counters of the principal of the same user and database
+type adminPoolerPool struct {
+	Database   string `json:"database"`
+	User       string `json:"user"`
+	Mode       string `json:"mode,omitempty"`
+	Size       int64  `json:"size"`
+	Saturation int    `json:"saturation"` // percentage of the pool's servers in use
+
+	ClientsActive  int64  `json:"clients_active"`
+	ClientsWaiting int64  `json:"clients_waiting"`
+	ServersActive  int64  `json:"servers_active"`
+	ServersIdle    int64  `json:"servers_idle"`
+	ServersUsed    int64  `json:"servers_used"`
+	MaxWait        string `json:"max_wait"`
+	Clients        int64  `json:"clients"`
+
+	QueriesPerSecond      float64 `json:"queries_per_second"`
+	TransactionsPerSecond float64 `json:"transactions_per_second"`
+	AverageQueryTime      string  `json:"average_query_time"`
+	AverageWait           string  `json:"average_wait"`
+
+	EnforcerConnections      int     `json:"enforcer_connections"`
+	EnforcerQueriesPerSecond float64 `json:"enforcer_queries_per_second"`
+}
+
+// adminFirewallProfile is the set of queries the SQL firewall learned for a user
+type adminFirewallProfile struct {
+	User         string            `json:"user"`
+	LearnedSince time.Time         `json:"learned_since"`
+	Enforced     bool              `json:"enforced"`
+	Fingerprints map[string]string `json:"fingerprints"` // normalized query by fingerprint
+}
+
+// adminFailover is the state of the failover to the secondary upstream
+type adminFailover struct {
+	FailedOver          bool      `json:"failed_over"`
+	Since               time.Time `json:"since"` // of the last failover or failback, zero if none
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	HealthySince        time.Time `json:"healthy_since"` // zero while the primary is failing
+	Checks              int64     `json:"checks"`
+	FailedChecks        int64     `json:"failed_checks"`
+	Failovers           int64     `json:"failovers"`
+	Failbacks           int64     `json:"failbacks"`
+	LastError           string    `json:"last_error,omitempty"`
+}
+
+// defaultDrainTimeout bounds a drain requested without a timeout
+const defaultDrainTimeout = 5 * time.Minute
+
+// adminDrainRequest starts a drain
+type adminDrainRequest struct {
+	Timeout string `json:"timeout,omitempty"` // Go duration, e.g. 5m
+}
+
+// adminDrain is the progress of a drain
+type adminDrain struct {
+	Draining        bool      `json:"draining"`
+	StartedAt       time.Time `json:"started_at"`
+	Deadline        time.Time `json:"deadline"`
+	OpenConnections int       `json:"open_connections"`
+	Done            bool      `json:"done"`
+}
+
+// adminFaults are the rules of the faults injected, as PQE_FAULTS takes them
+type adminFaults struct {
+	Rules string `json:"rules"` // e.g. upstream_read:reset@0.05;store:latency:200ms
+}
+
+// adminAPI serves the admin HTTP API of a running server
+type adminAPI struct {
+	server *app.ServerService
+	token  string
+}
+
+// NewAdminAPI returns the admin HTTP API of server. Every request must carry
+// token as a bearer token.
+//
+//	GET    /api/v1/quotas              list the quota policies
+//	POST   /api/v1/quotas              add a policy
+//	PUT    /api/v1/quotas/{name}       add or replace a policy
+//	DELETE /api/v1/quotas/{name}       remove a policy
+//	GET    /api/v1/usage               usage of the connected principals, or of ?user=&database=
+//	DELETE /api/v1/usage?user=&database=[&policy=]  reset a principal's usage
+//	GET    /api/v1/credits             credit balances of the connected principals, or of ?user=&database=
+//	GET    /api/v1/connections         list the open connections
+//	DELETE /api/v1/connections/{id}    terminate a connection
+//	GET    /api/v1/activity            recent query rates per principal and the latest denials
+//	GET    /api/v1/queries[?sort=&limit=]  statistics per query fingerprint, the most time-consuming first
+//	GET    /api/v1/query-cache         hits and misses of the normalized query cache
+//	GET    /api/v1/pgbouncer           pools of the upstream's PgBouncer, merged with the enforcer's counters
+//	GET    /api/v1/upstream/failover   whether new connections failed over to the secondary upstream, and check counters
+//	GET    /api/v1/firewall            queries the SQL firewall learned for each user
+//	DELETE /api/v1/firewall/{user}     learn the queries of a user again
+//	POST   /api/v1/explain             which policies apply to a query of a principal, and why
+//	POST   /api/v1/drain               stop accepting connections and close the open ones between transactions
+//	GET    /api/v1/drain               progress of the drain
+//	GET    /api/v1/faults              rules of the faults injected, in binaries built with the chaos tag
+//	PUT    /api/v1/faults              replace the rules of the faults injected
+//
+// Policy changes last until the policies are reloaded from the configuration.
+func NewAdminAPI(server *app.ServerService, token string) http.Handler {
+	api := &adminAPI{server: server, token: token}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/quotas", api.listPolicies)
+	mux.HandleFunc("POST /api/v1/quotas", api.createPolicy)
+	mux.HandleFunc("PUT /api/v1/quotas/{name}", api.putPolicy)
+	mux.HandleFunc("DELETE /api/v1/quotas/{name}", api.deletePolicy)
+	mux.HandleFunc("GET /api/v1/usage", api.usage)
+	mux.HandleFunc("DELETE /api/v1/usage", api.resetUsage)
+	mux.HandleFunc("GET /api/v1/credits", api.credits)
+	mux.HandleFunc("GET /api/v1/connections", api.connections)
+	mux.HandleFunc("DELETE /api/v1/connections/{id}", api.terminateConnection)
+	mux.HandleFunc("GET /api/v1/activity", api.activity)
+	mux.HandleFunc("GET /api/v1/queries", api.queries)
+	mux.HandleFunc("GET /api/v1/query-cache", api.queryCache)
+	mux.HandleFunc("GET /api/v1/pgbouncer", api.pooler)
+	mux.HandleFunc("GET /api/v1/upstream/failover", api.failover)
+	mux.HandleFunc("GET /api/v1/firewall", api.firewallProfiles)
+	mux.HandleFunc("DELETE /api/v1/firewall/{user}", api.relearnFirewall)
+	mux.HandleFunc("POST /api/v1/explain", api.explain)
+	mux.HandleFunc("POST /api/v1/drain", api.startDrain)
+	mux.HandleFunc("GET /api/v1/drain", api.drainStatus)
+	mux.HandleFunc("GET /api/v1/faults", api.faultRules)
+	mux.HandleFunc("PUT /api/v1/faults", api.setFaultRules)
+	return api.authenticate(mux)
+}
+
+// authenticate rejects requests without the bearer token
+func (a *adminAPI) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pgbouncer-quota-enforcer"`)
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid bearer token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listPolicies returns the quota policies
+func (a *adminAPI) listPolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := a.server.Policies()
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	entries := make([]adminPolicy, 0, len(policies))
+	for _, policy := range policies {
+		entries = append(entries, toAdminPolicy(policy))
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// createPolicy adds a policy whose name is not taken
+func (a *adminAPI) createPolicy(w http.ResponseWriter, r *http.Request) {
+	policy, err := decodePolicy(r, "")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	policies, err := a.server.Policies()
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	for _, existing := range policies {
+		if existing.Name == policy.Name {
+			writeError(w, http.StatusConflict, fmt.Errorf("quota policy %q already exists", policy.Name))
+			return
+		}
+	}
+
+	if _, err := a.server.PutPolicy(policy); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, toAdminPolicy(policy))
+}
+
+// putPolicy adds or replaces the policy named in the path
+func (a *adminAPI) putPolicy(w http.ResponseWriter, r *http.Request) {
+	policy, err := decodePolicy(r, r.PathValue("name"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	added, err := a.server.PutPolicy(policy)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if added {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, toAdminPolicy(policy))
+}
+
+// deletePolicy removes the policy named in the path
+func (a *adminAPI) deletePolicy(w http.ResponseWriter, r *http.Request) {
+	if err := a.server.DeletePolicy(r.PathValue("name")); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// principals returns the user and database pair in the query string, or those
+// of every open connection
+func (a *adminAPI) principals(r *http.Request) [][2]string {
+	if user := r.URL.Query().Get("user"); user != "" {
+		return [][2]string{{user, queryDatabase(r, user)}}
+	}
+	var principals [][2]string
+	seen := make(map[[2]string]bool)
+	for _, connection := range a.server.Connections() {
+		principal := [2]string{connection.User, connection.Database}
+		if !seen[principal] {
+			seen[principal] = true
+			principals = append(principals, principal)
+		}
+	}
+	return principals
+}
+
+// usage returns the usage of the principal in the query string, or of every
+// principal with an open connection. Policies counted per label report the
+// usage of the label value in the query string.
+func (a *adminAPI) usage(w http.ResponseWriter, r *http.Request) {
+	entries := []adminUsage{}
+	label := r.URL.Query().Get("label")
+	for _, principal := range a.principals(r) {
+		usages, err := a.server.Usage(r.Context(), principal[0], principal[1], label)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		for _, usage := range usages {
+			entry := adminUsage{
+				Policy:    usage.Policy.Name,
+				User:      principal[0],
+				Database:  principal[1],
+				Dimension: usage.Policy.Dimension.Unit(),
+				Used:      usage.Used,
+				Limit:     usage.Policy.Limit,
+				Window:    usage.Policy.Window.String(),
+				ResetAt:   usage.ResetAt,
+			}
+			if usage.Policy.PerLabel != "" {
+				entry.Label = label
+			}
+			entries = append(entries, entry)
+		}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// credits returns the credit balances of the principal in the query string, or
+// of every principal with an open connection
+func (a *adminAPI) credits(w http.ResponseWriter, r *http.Request) {
+	entries := []adminCredits{}
+	for _, principal := range a.principals(r) {
+		credits, err := a.server.Credits(r.Context(), principal[0], principal[1])
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		for _, balance := range credits {
+			entries = append(entries, adminCredits{
+				Policy:     balance.Policy.Name,
+				User:       principal[0],
+				Database:   principal[1],
+				Credits:    balance.Balance,
+				Cap:        balance.Policy.Credits,
+				CreditRate: balance.Policy.CreditAccrual(),
+				FullAt:     balance.FullAt,
+			})
+		}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// resetUsage clears the usage of the principal, and label value, in the query string
+func (a *adminAPI) resetUsage(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("user is required"))
+		return
+	}
+
+	if err := a.server.ResetUsage(r.Context(), user, queryDatabase(r, user), r.URL.Query().Get("label"), r.URL.Query().Get("policy")); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// connections returns the open client connections
+func (a *adminAPI) connections(w http.ResponseWriter, r *http.Request) {
+	connections := a.server.Connections()
+	now := time.Now()
+	entries := make([]adminConnection, 0, len(connections))
+	for _, connection := range connections {
+		entry := adminConnection{
+			ID:          connection.ID,
+			User:        connection.User,
+			Database:    connection.Database,
+			ConnectedAt: connection.ConnectedAt,
+			Idle:        connection.Idle,
+			Age:         now.Sub(connection.ConnectedAt).Round(time.Second).String(),
+			ClientAddr:  connection.ClientAddr,
+			Query:       connection.Query,
+			Transaction: connection.Transaction.String(),
+			Parameters:  connection.Parameters,
+		}
+		if !connection.QueryStart.IsZero() {
+			entry.QueryStart = &connection.QueryStart
+		}
+		entries = append(entries, entry)
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// terminateConnection closes a client connection
+func (a *adminAPI) terminateConnection(w http.ResponseWriter, r *http.Request) {
+	if err := a.server.TerminateConnection(r.PathValue("id")); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// activity returns the recent query rates and denials
+func (a *adminAPI) activity(w http.ResponseWriter, r *http.Request) {
+	activity := a.server.Activity()
+	entry := adminActivity{
+		InstanceID: a.server.InstanceID(),
+		Window:     activity.Window.String(),
+		Principals: make([]adminPrincipalActivity, 0, len(activity.Principals)),
+		Denials:    make([]adminDenial, 0, len(activity.Denials)),
+	}
+	for _, principal := range activity.Principals {
+		entry.Principals = append(entry.Principals, adminPrincipalActivity{
+			User:             principal.User,
+			Database:         principal.Database,
+			Queries:          principal.Queries,
+			Denied:           principal.Denied,
+			QueriesPerSecond: principal.QueriesPerSecond,
+		})
+	}
+	for _, denial := range activity.Denials {
+		entry.Denials = append(entry.Denials, adminDenial{
+			Time:         denial.Time,
+			ConnectionID: denial.ConnectionID,
+			User:         denial.User,
+			Database:     denial.Database,
+			Policy:       denial.Policy,
+			Reason:       denial.Reason,
+		})
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// queries returns the statistics of the query fingerprints, sorted by ?sort=
+// and cut to the first ?limit=
+func (a *adminAPI) queries(w http.ResponseWriter, r *http.Request) {
+	order := "total"
+	if value := r.URL.Query().Get("sort"); value != "" {
+		order = value
+	}
+	larger, ok := queryStatsOrders[order]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown sort %q: use total, mean, p95, calls, rows or bytes", order))
+		return
+	}
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", value))
+			return
+		}
+	}
+
+	stats := a.server.QueryStats()
+	sort.SliceStable(stats, func(i, j int) bool { return larger(stats[i], stats[j]) })
+	if limit > 0 && len(stats) > limit {
+		stats = stats[:limit]
+	}
+	entries := make([]adminQueryStats, 0, len(stats))
+	for _, entry := range stats {
+		entries = append(entries, adminQueryStats{
+			Hash:        entry.Hash.String(),
+			Query:       entry.Query,
+			Calls:       entry.Calls,
+			TotalTimeMs: durationMilliseconds(entry.TotalDuration),
+			MeanTimeMs:  durationMilliseconds(entry.MeanDuration()),
+			P95TimeMs:   durationMilliseconds(entry.P95Duration),
+			Rows:        entry.Rows,
+			Bytes:       entry.Bytes,
+			LastSeen:    entry.LastSeen,
+		})
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// durationMilliseconds converts d to fractional milliseconds
+func durationMilliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// queryCache returns the lookup counters of the normalized query cache
+func (a *adminAPI) queryCache(w http.ResponseWriter, r *http.Request) {
+	stats, enabled := a.server.QueryCacheStats()
+	writeJSON(w, http.StatusOK, adminQueryCache{
+		Enabled:    enabled,
+		Queries:    toAdminCacheStats(stats.Queries),
+		Statements: toAdminCacheStats(stats.Statements),
+	})
+}
+
+// pooler returns the pools of the upstream's pooler as last polled
+func (a *adminAPI) pooler(w http.ResponseWriter, r *http.Request) {
+	pools, polledAt, err := a.server.PoolerPools()
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	entry := adminPooler{PolledAt: polledAt, Pools: make([]adminPoolerPool, 0, len(pools))}
+	for _, pool := range pools {
+		entry.Pools = append(entry.Pools, adminPoolerPool{
+			Database:   pool.Database,
+			User:       pool.User,
+			Mode:       pool.Mode,
+			Size:       pool.Size,
+			Saturation: pool.Saturation,
+
+			ClientsActive:  pool.ClientsActive,
+			ClientsWaiting: pool.ClientsWaiting,
+			ServersActive:  pool.ServersActive,
+			ServersIdle:    pool.ServersIdle,
+			ServersUsed:    pool.ServersUsed,
+			MaxWait:        pool.MaxWait.String(),
+			Clients:        pool.Clients,
+
+			QueriesPerSecond:      pool.QueriesPerSecond,
+			TransactionsPerSecond: pool.TransactionsPerSecond,
+			AverageQueryTime:      pool.AverageQueryTime.String(),
+			AverageWait:           pool.AverageWait.String(),
+
+			EnforcerConnections:      pool.EnforcerConnections,
+			EnforcerQueriesPerSecond: pool.EnforcerQueriesPerSecond,
+		})
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// failover returns the state of the failover to the secondary upstream
+func (a *adminAPI) failover(w http.ResponseWriter, r *http.Request) {
+	status, err := a.server.UpstreamFailover()
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, adminFailover{
+		FailedOver:          status.FailedOver,
+		Since:               status.Since,
+		ConsecutiveFailures: status.ConsecutiveFailures,
+		HealthySince:        status.HealthySince,
+		Checks:              status.Checks,
+		FailedChecks:        status.FailedChecks,
+		Failovers:           status.Failovers,
+		Failbacks:           status.Failbacks,
+		LastError:           status.LastError,
+	})
+}
+
+// firewallProfiles returns the queries the SQL firewall learned for each user
+func (a *adminAPI) firewallProfiles(w http.ResponseWriter, r *http.Request) {
+	profiles, err := a.server.FirewallProfiles()
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	entries := make([]adminFirewallProfile, 0, len(profiles))
+	for _, profile := range profiles {
+		entries = append(entries, adminFirewallProfile(profile))
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// relearnFirewall forgets the queries the SQL firewall learned for a user
+func (a *adminAPI) relearnFirewall(w http.ResponseWriter, r *http.Request) {
+	if err := a.server.RelearnFirewall(r.PathValue("user")); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// explain returns the policies matching the principal of the query in the
+// request body, from the most specific, and whether each applies to the query
+func (a *adminAPI) explain(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	var request adminExplainRequest
+	if err := decoder.Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to decode explain request: %w", err))
+		return
+	}
+	if request.User == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("user is required"))
+		return
+	}
+
+	query := domain.NewQuery(request.Query, "")
+	query.UserID = request.User
+	query.Database = request.Database
+	if query.Database == "" {
+		query.Database = request.User
+	}
+	query.Listener = request.Listener
+	query.Labels = request.Labels
+
+	explanations, err := a.server.ExplainQuery(query)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	entries := make([]adminExplanation, 0, len(explanations))
+	for _, explanation := range explanations {
+		entries = append(entries, adminExplanation{
+			Policy:     toAdminPolicy(explanation.Policy),
+			Applies:    explanation.Applies,
+			Reason:     explanation.Reason,
+			ReplacedBy: explanation.ReplacedBy,
+		})
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// toAdminCacheStats converts the counters of a cache, with the share of hits
+func toAdminCacheStats(stats adapters.CacheStats) adminCacheStats {
+	entry := adminCacheStats{
+		Hits:      stats.Hits,
+		Misses:    stats.Misses,
+		Evictions: stats.Evictions,
+		Entries:   stats.Entries,
+		Capacity:  stats.Capacity,
+	}
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		entry.HitRatio = float64(stats.Hits) / float64(lookups)
+	}
+	return entry
+}
+
+// startDrain starts draining the server, within the timeout of the request body
+// or defaultDrainTimeout; a drain already in progress keeps its deadline
+func (a *adminAPI) startDrain(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	var request adminDrainRequest
+	if err := decoder.Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to decode drain request: %w", err))
+		return
+	}
+	timeout := defaultDrainTimeout
+	if request.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(request.Timeout); err != nil || timeout <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout %q: use a positive duration such as 5m", request.Timeout))
+			return
+		}
+	}
+
+	status, started := a.server.Drain(timeout)
+	code := http.StatusOK
+	if started {
+		code = http.StatusAccepted
+	}
+	writeJSON(w, code, toAdminDrain(status))
+}
+
+// drainStatus returns the progress of the drain
+func (a *adminAPI) drainStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, toAdminDrain(a.server.DrainStatus()))
+}
+
+// faultRules returns the rules of the faults injected
+func (a *adminAPI) faultRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := a.server.FaultRules()
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, adminFaults{Rules: adapters.FormatFaultRules(rules)})
+}
+
+// setFaultRules replaces the rules of the faults injected with those of the
+// request body; empty rules stop injecting faults
+func (a *adminAPI) setFaultRules(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	var request adminFaults
+	if err := decoder.Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to decode fault rules: %w", err))
+		return
+	}
+	rules, err := adapters.ParseFaultRules(request.Rules)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := a.server.SetFaultRules(rules); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, adminFaults{Rules: adapters.FormatFaultRules(rules)})
+}
+
+// toAdminDrain converts the progress of a drain to its API representation
+func toAdminDrain(status app.DrainStatus) adminDrain {
+	return adminDrain{
+		Draining:        status.Draining,
+		StartedAt:       status.StartedAt,
+		Deadline:        status.Deadline,
+		OpenConnections: status.OpenConnections,
+		Done:            status.Done,
+	}
+}
+
+// queryDatabase returns the database in the query string, which defaults to the
+// user as in PostgreSQL
+func queryDatabase(r *http.Request, user string) string {
+	if database := r.URL.Query().Get("database"); database != "" {
+		return database
+	}
+	return user
+}
+
+// decodePolicy reads a policy from the request body. A name taken from the path
+// fills in a missing name and must match a given one.
+func decodePolicy(r *http.Request, name string) (domain.QuotaPolicy, error) {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	var entry adminPolicy
+	if err := decoder.Decode(&entry); err != nil {
+		return domain.QuotaPolicy{}, fmt.Errorf("failed to decode policy: %w", err)
+	}
+	if name != "" {
+		if entry.Name != "" && entry.Name != name {
+			return domain.QuotaPolicy{}, fmt.Errorf("policy name %q does not match %q", entry.Name, name)
+		}
+		entry.Name = name
+	}
+
+	var window, grace, queueTimeout, statementTimeout, transactionDuration time.Duration
+	if entry.Window != "" {
+		var err error
+		if window, err = time.ParseDuration(entry.Window); err != nil {
+			return domain.QuotaPolicy{}, fmt.Errorf("invalid window: %w", err)
+		}
+	}
+	if entry.Grace != "" {
+		var err error
+		if grace, err = time.ParseDuration(entry.Grace); err != nil {
+			return domain.QuotaPolicy{}, fmt.Errorf("invalid grace period: %w", err)
+		}
+	}
+	if entry.QueueTimeout != "" {
+		var err error
+		if queueTimeout, err = time.ParseDuration(entry.QueueTimeout); err != nil {
+			return domain.QuotaPolicy{}, fmt.Errorf("invalid queue timeout: %w", err)
+		}
+	}
+	if entry.StatementTimeout != "" {
+		var err error
+		if statementTimeout, err = time.ParseDuration(entry.StatementTimeout); err != nil {
+			return domain.QuotaPolicy{}, fmt.Errorf("invalid statement timeout: %w", err)
+		}
+	}
+	if entry.MaxTransactionDuration != "" {
+		var err error
+		if transactionDuration, err = time.ParseDuration(entry.MaxTransactionDuration); err != nil {
+			return domain.QuotaPolicy{}, fmt.Errorf("invalid max transaction duration: %w", err)
+		}
+	}
+
+	policy := domain.QuotaPolicy{
+		Name:      entry.Name,
+		User:      entry.User,
+		Role:      entry.Role,
+		Database:  entry.Database,
+		Labels:    entry.Labels,
+		Listener:  entry.Listener,
+		Dimension: domain.QuotaDimension(entry.Dimension),
+		Limit:     entry.Limit,
+		Window:    window,
+		PerLabel:  entry.PerLabel,
+		Rate:      entry.Rate,
+		Burst:     entry.Burst,
+		RatePer:   domain.RateScope(entry.RatePer),
+
+		Credits:    entry.Credits,
+		CreditRate: entry.CreditRate,
+
+		WarnAt: entry.WarnAt,
+		Soft:   entry.Soft,
+		Grace:  grace,
+
+		TightenAt: entry.TightenAt,
+		TightenTo: entry.TightenTo,
+
+		MaxConnections:       entry.MaxConnections,
+		MaxConcurrentQueries: entry.MaxConcurrentQueries,
+		QueueTimeout:         queueTimeout,
+		StatementTimeout:     statementTimeout,
+		MaxResultRows:        entry.MaxResultRows,
+		MaxResultBytes:       entry.MaxResultBytes,
+
+		MaxTransactionDuration:   transactionDuration,
+		MaxTransactionStatements: entry.MaxTransactionStatements,
+
+		StartupParameters: entry.StartupParameters,
+
+		Tables:      entry.Tables,
+		Statements:  entry.Statements,
+		Deny:        entry.Deny,
+		AllowDuring: entry.AllowDuring,
+
+		ActiveDuring: entry.ActiveDuring,
+
+		Fingerprints: entry.Fingerprints,
+		Patterns:     entry.Patterns,
+		Allow:        entry.Allow,
+		Hint:         entry.Hint,
+
+		Override: entry.Override,
+	}
+	return policy, policy.Validate()
+}
+
+// toAdminPolicy converts a policy to its API representation
+func toAdminPolicy(policy domain.QuotaPolicy) adminPolicy {
+	entry := adminPolicy{
+		Name:      policy.Name,
+		User:      policy.User,
+		Role:      policy.Role,
+		Database:  policy.Database,
+		Labels:    policy.Labels,
+		Listener:  policy.Listener,
+		Dimension: string(policy.Dimension),
+		Limit:     policy.Limit,
+		PerLabel:  policy.PerLabel,
+		Rate:      policy.Rate,
+		Burst:     policy.Burst,
+		RatePer:   string(policy.RatePer),
+
+		Credits:    policy.Credits,
+		CreditRate: policy.CreditRate,
+
+		WarnAt: policy.WarnAt,
+		Soft:   policy.Soft,
+
+		TightenAt: policy.TightenAt,
+		TightenTo: policy.TightenTo,
+
+		MaxConnections:       policy.MaxConnections,
+		MaxConcurrentQueries: policy.MaxConcurrentQueries,
+		MaxResultRows:        policy.MaxResultRows,
+		MaxResultBytes:       policy.MaxResultBytes,
+
+		MaxTransactionStatements: policy.MaxTransactionStatements,
+
+		StartupParameters: policy.StartupParameters,
+
+		Tables:      policy.Tables,
+		Statements:  policy.Statements,
+		Deny:        policy.Deny,
+		AllowDuring: policy.AllowDuring,
+
+		ActiveDuring: policy.ActiveDuring,
+
+		Fingerprints: policy.Fingerprints,
+		Patterns:     policy.Patterns,
+		Allow:        policy.Allow,
+		Hint:         policy.Hint,
+
+		Override: policy.Override,
+	}
+	if policy.Windowed() {
+		entry.Window = policy.Window.String()
+	}
+	if policy.Grace > 0 {
+		entry.Grace = policy.Grace.String()
+	}
+	if policy.QueueTimeout > 0 {
+		entry.QueueTimeout = policy.QueueTimeout.String()
+	}
+	if policy.StatementTimeout > 0 {
+		entry.StatementTimeout = policy.StatementTimeout.String()
+	}
+	if policy.MaxTransactionDuration > 0 {
+		entry.MaxTransactionDuration = policy.MaxTransactionDuration.String()
+	}
+	return entry
+}
+
+// writeServiceError maps an error of the server service to a status code
+func writeServiceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, app.ErrPoliciesUnmanaged), errors.Is(err, app.ErrPoolerUnmonitored),
+		errors.Is(err, app.ErrFailoverDisabled), errors.Is(err, app.ErrFirewallDisabled),
+		errors.Is(err, app.ErrFaultInjectionDisabled):
+		writeError(w, http.StatusNotImplemented, err)
+	case errors.Is(err, app.ErrPolicyNotFound), errors.Is(err, app.ErrConnectionNotFound),
+		errors.Is(err, app.ErrFirewallProfileNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, app.ErrInvalidPolicies):
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// writeError writes err as a JSON error body
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeJSON writes value as the JSON body of the response
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
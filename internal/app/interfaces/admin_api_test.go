@@ -0,0 +1,342 @@
+package interfaces
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// adminRequest sends a request to the admin API with the test token
+func adminRequest(t *testing.T, api http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestAdminAPI_Authentication(t *testing.T) {
+	server, err := app.NewServerService(app.ServerConfig{Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	api := NewAdminAPI(server, "secret")
+
+	for _, header := range []string{"", "Bearer wrong", "secret"} {
+		request := httptest.NewRequest(http.MethodGet, "/api/v1/quotas", nil)
+		if header != "" {
+			request.Header.Set("Authorization", header)
+		}
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, request)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code, "Authorization %q should be rejected", header)
+	}
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, api, http.MethodGet, "/api/v1/quotas", "").Code)
+}
+
+func TestAdminAPI_Policies(t *testing.T) {
+	server, err := app.NewServerService(app.ServerConfig{
+		Address:  "127.0.0.1:0",
+		Policies: []domain.QuotaPolicy{{Name: "default", Limit: 10, Window: time.Hour}},
+	})
+	require.NoError(t, err)
+	api := NewAdminAPI(server, "secret")
+
+	recorder := adminRequest(t, api, http.MethodPost, "/api/v1/quotas", `{"name":"alice","user":"alice","limit":5,"window":"1m"}`)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	recorder = adminRequest(t, api, http.MethodPost, "/api/v1/quotas", `{"name":"alice","limit":5,"window":"1m"}`)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	recorder = adminRequest(t, api, http.MethodPost, "/api/v1/quotas", `{"name":"broken","window":"1m"}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = adminRequest(t, api, http.MethodPut, "/api/v1/quotas/alice", `{"user":"alice","limit":1,"window":"1h"}`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	recorder = adminRequest(t, api, http.MethodPut, "/api/v1/quotas/alice", `{"name":"bob","limit":1,"window":"1h"}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	policies, err := server.Policies()
+	require.NoError(t, err)
+	assert.Equal(t, []domain.QuotaPolicy{
+		{Name: "default", Limit: 10, Window: time.Hour},
+		{Name: "alice", User: "alice", Limit: 1, Window: time.Hour},
+	}, policies)
+
+	assert.Equal(t, http.StatusNoContent, adminRequest(t, api, http.MethodDelete, "/api/v1/quotas/default", "").Code)
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, api, http.MethodDelete, "/api/v1/quotas/default", "").Code)
+
+	var listed []adminPolicy
+	recorder = adminRequest(t, api, http.MethodGet, "/api/v1/quotas", "")
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &listed))
+	assert.Equal(t, []adminPolicy{{Name: "alice", User: "alice", Limit: 1, Window: "1h0m0s"}}, listed)
+}
+
+func TestAdminAPI_QueryRules(t *testing.T) {
+	server, err := app.NewServerService(app.ServerConfig{Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	api := NewAdminAPI(server, "secret")
+
+	recorder := adminRequest(t, api, http.MethodPost, "/api/v1/quotas",
+		`{"name":"no-full-scans","patterns":["(?i)^select \\* from huge_table$"],"deny":true,"hint":"filter by created_at"}`)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	recorder = adminRequest(t, api, http.MethodPost, "/api/v1/quotas", `{"name":"health-checks","fingerprints":["50fde20626009aba"],"allow":true}`)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	recorder = adminRequest(t, api, http.MethodPost, "/api/v1/quotas", `{"name":"broken","patterns":["(unclosed"],"deny":true}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	recorder = adminRequest(t, api, http.MethodPost, "/api/v1/quotas", `{"name":"reporting","database":"reporting","statement_timeout":"30s"}`)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	recorder = adminRequest(t, api, http.MethodPost, "/api/v1/quotas", `{"name":"broken","statement_timeout":"soon"}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	var listed []adminPolicy
+	recorder = adminRequest(t, api, http.MethodGet, "/api/v1/quotas", "")
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &listed))
+	assert.Equal(t, []adminPolicy{
+		{Name: "no-full-scans", Patterns: []string{`(?i)^select \* from huge_table$`}, Deny: true, Hint: "filter by created_at"},
+		{Name: "health-checks", Fingerprints: []string{"50fde20626009aba"}, Allow: true},
+		{Name: "reporting", Database: "reporting", StatementTimeout: "30s"},
+	}, listed)
+}
+
+func TestAdminAPI_Usage(t *testing.T) {
+	server, err := app.NewServerService(app.ServerConfig{
+		Address:  "127.0.0.1:0",
+		Policies: []domain.QuotaPolicy{{Name: "alice", User: "alice", Limit: 10, Window: time.Hour}},
+	})
+	require.NoError(t, err)
+	api := NewAdminAPI(server, "secret")
+
+	var usages []adminUsage
+	recorder := adminRequest(t, api, http.MethodGet, "/api/v1/usage?user=alice", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &usages))
+	require.Len(t, usages, 1)
+	assert.Equal(t, "alice", usages[0].Policy)
+	assert.Equal(t, "alice", usages[0].Database, "The database should default to the user")
+	assert.Equal(t, int64(10), usages[0].Limit)
+
+	recorder = adminRequest(t, api, http.MethodGet, "/api/v1/usage", "")
+	assert.JSONEq(t, "[]", recorder.Body.String(), "Without connections there is no usage to show")
+
+	assert.Equal(t, http.StatusNoContent, adminRequest(t, api, http.MethodDelete, "/api/v1/usage?user=alice", "").Code)
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, api, http.MethodDelete, "/api/v1/usage?user=alice&policy=other", "").Code)
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, api, http.MethodDelete, "/api/v1/usage", "").Code)
+
+	recorder = adminRequest(t, api, http.MethodGet, "/api/v1/connections", "")
+	assert.JSONEq(t, "[]", recorder.Body.String())
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, api, http.MethodDelete, "/api/v1/connections/conn_1", "").Code)
+}
+
+func TestAdminAPI_Drain(t *testing.T) {
+	server, err := app.NewServerService(app.ServerConfig{Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	require.NoError(t, server.Start(context.Background(), "127.0.0.1:0"))
+	defer func() {
+		require.NoError(t, server.Stop(context.Background()))
+	}()
+	api := NewAdminAPI(server, "secret")
+
+	var status adminDrain
+	recorder := adminRequest(t, api, http.MethodGet, "/api/v1/drain", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+	assert.False(t, status.Draining)
+
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, api, http.MethodPost, "/api/v1/drain", `{"timeout": "soon"}`).Code)
+
+	recorder = adminRequest(t, api, http.MethodPost, "/api/v1/drain", `{"timeout": "1m"}`)
+	require.Equal(t, http.StatusAccepted, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+	assert.True(t, status.Draining)
+	assert.Equal(t, time.Minute, status.Deadline.Sub(status.StartedAt))
+
+	// Draining again keeps the deadline of the drain in progress
+	recorder = adminRequest(t, api, http.MethodPost, "/api/v1/drain", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var again adminDrain
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &again))
+	assert.True(t, again.Deadline.Equal(status.Deadline))
+
+	<-server.Drained()
+	recorder = adminRequest(t, api, http.MethodGet, "/api/v1/drain", "")
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+	assert.True(t, status.Done, "A server without connections drains at once")
+	assert.Zero(t, status.OpenConnections)
+}
+
+func TestAdminAPI_QueryCache(t *testing.T) {
+	server, err := app.NewServerService(app.ServerConfig{Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	var cache adminQueryCache
+	recorder := adminRequest(t, NewAdminAPI(server, "secret"), http.MethodGet, "/api/v1/query-cache", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &cache))
+	assert.False(t, cache.Enabled)
+
+	server, err = app.NewServerService(app.ServerConfig{Address: "127.0.0.1:0", QueryCacheSize: 100, StatementCacheSize: 10})
+	require.NoError(t, err)
+	recorder = adminRequest(t, NewAdminAPI(server, "secret"), http.MethodGet, "/api/v1/query-cache", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &cache))
+	assert.True(t, cache.Enabled)
+	assert.Equal(t, 100, cache.Queries.Capacity)
+	assert.Equal(t, 10, cache.Statements.Capacity)
+}
+
+func TestAdminAPI_PgBouncer(t *testing.T) {
+	server, err := app.NewServerService(app.ServerConfig{Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	recorder := adminRequest(t, NewAdminAPI(server, "secret"), http.MethodGet, "/api/v1/pgbouncer", "")
+	assert.Equal(t, http.StatusNotImplemented, recorder.Code)
+
+	server, err = app.NewServerService(app.ServerConfig{
+		Address:   "127.0.0.1:0",
+		PgBouncer: app.PgBouncerConfig{AdminURL: "postgres://stats@127.0.0.1:1/pgbouncer"},
+	})
+	require.NoError(t, err)
+	var pooler adminPooler
+	recorder = adminRequest(t, NewAdminAPI(server, "secret"), http.MethodGet, "/api/v1/pgbouncer", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &pooler))
+	assert.Empty(t, pooler.Pools, "Nothing is polled before the server starts")
+}
+
+func TestAdminAPI_Faults(t *testing.T) {
+	server, err := app.NewServerService(app.ServerConfig{Address: "127.0.0.1:0", Faults: "store:latency:10ms"})
+	require.NoError(t, err)
+	api := NewAdminAPI(server, "secret")
+
+	recorder := adminRequest(t, api, http.MethodGet, "/api/v1/faults", "")
+	if !adapters.FaultInjectionEnabled {
+		assert.Equal(t, http.StatusNotImplemented, recorder.Code)
+		return
+	}
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"rules": "store:latency:10ms"}`, recorder.Body.String())
+
+	recorder = adminRequest(t, api, http.MethodPut, "/api/v1/faults", `{"rules": "disk:error"}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = adminRequest(t, api, http.MethodPut, "/api/v1/faults", `{"rules": "upstream_read:reset@0.05"}`)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	recorder = adminRequest(t, api, http.MethodGet, "/api/v1/faults", "")
+	assert.JSONEq(t, `{"rules": "upstream_read:reset@0.05"}`, recorder.Body.String())
+}
+
+func TestAdminAPI_Firewall(t *testing.T) {
+	server, err := app.NewServerService(app.ServerConfig{Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	recorder := adminRequest(t, NewAdminAPI(server, "secret"), http.MethodGet, "/api/v1/firewall", "")
+	assert.Equal(t, http.StatusNotImplemented, recorder.Code)
+
+	backend := testkit.StartFakeBackend(t)
+	profileFile := filepath.Join(t.TempDir(), "firewall.json")
+	server, err = app.NewServerService(app.ServerConfig{
+		Address:  "127.0.0.1:0",
+		Upstream: backend.Addr(),
+		Firewall: app.FirewallConfig{Mode: app.FirewallLearn, ProfileFile: profileFile},
+		LogLevel: logger.LevelError,
+	})
+	require.NoError(t, err)
+	require.NoError(t, server.Start(context.Background(), "127.0.0.1:0"))
+	api := NewAdminAPI(server, "secret")
+
+	client := testkit.MustDial(t, server.Address(), testkit.ClientConfig{User: "alice", Database: "app"})
+	_, err = client.Query("SELECT 1")
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+
+	var profiles []adminFirewallProfile
+	recorder = adminRequest(t, api, http.MethodGet, "/api/v1/firewall", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &profiles))
+	require.Len(t, profiles, 1)
+	assert.Equal(t, "alice", profiles[0].User)
+	assert.False(t, profiles[0].Enforced)
+	assert.Len(t, profiles[0].Fingerprints, 1)
+
+	require.NoError(t, server.Stop(context.Background()))
+	saved, err := os.ReadFile(profileFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(saved), `"user": "alice"`, "The profiles should be saved on shutdown")
+
+	assert.Equal(t, http.StatusNoContent, adminRequest(t, api, http.MethodDelete, "/api/v1/firewall/alice", "").Code)
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, api, http.MethodDelete, "/api/v1/firewall/alice", "").Code)
+}
+
+func TestAdminAPI_UpstreamFailover(t *testing.T) {
+	server, err := app.NewServerService(app.ServerConfig{Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	recorder := adminRequest(t, NewAdminAPI(server, "secret"), http.MethodGet, "/api/v1/upstream/failover", "")
+	assert.Equal(t, http.StatusNotImplemented, recorder.Code)
+
+	// The primary refuses connections, so new ones fail over to the backend
+	backend := testkit.StartFakeBackend(t)
+	server, err = app.NewServerService(app.ServerConfig{
+		Address:  "127.0.0.1:0",
+		Upstream: "127.0.0.1:1",
+		Failover: app.UpstreamFailoverConfig{Upstream: backend.Addr(), Interval: 10 * time.Millisecond, Threshold: 2},
+		LogLevel: logger.LevelError,
+	})
+	require.NoError(t, err)
+	require.NoError(t, server.Start(context.Background(), "127.0.0.1:0"))
+	defer func() {
+		require.NoError(t, server.Stop(context.Background()))
+	}()
+
+	var failover adminFailover
+	require.Eventually(t, func() bool {
+		recorder := adminRequest(t, NewAdminAPI(server, "secret"), http.MethodGet, "/api/v1/upstream/failover", "")
+		return recorder.Code == http.StatusOK && json.Unmarshal(recorder.Body.Bytes(), &failover) == nil && failover.FailedOver
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(1), failover.Failovers)
+	assert.GreaterOrEqual(t, failover.FailedChecks, int64(2))
+	assert.Contains(t, failover.LastError, "127.0.0.1:1")
+
+	client := testkit.MustDial(t, server.Address(), testkit.ClientConfig{User: "alice", Database: "app"})
+	_, err = client.Query("SELECT 1")
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+	assert.True(t, server.Readiness(context.Background()).Healthy, "Readiness should follow the secondary while failed over")
+}
+
+func TestAdminAPI_Explain(t *testing.T) {
+	server, err := app.NewServerService(app.ServerConfig{
+		Address: "127.0.0.1:0",
+		Policies: []domain.QuotaPolicy{
+			{Name: "global", Limit: 10, Window: time.Hour},
+			{Name: "analysts", Role: "analysts", Limit: 100, Window: time.Hour, Override: true},
+		},
+		Roles: map[string][]string{"analysts": {"alice"}},
+	})
+	require.NoError(t, err)
+	api := NewAdminAPI(server, "secret")
+
+	recorder := adminRequest(t, api, http.MethodPost, "/api/v1/explain", `{"user":"alice","query":"SELECT 1"}`)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var explanations []adminExplanation
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &explanations))
+	require.Len(t, explanations, 2)
+	assert.Equal(t, "analysts", explanations[0].Policy.Name)
+	assert.True(t, explanations[0].Applies)
+	assert.Equal(t, "global", explanations[1].Policy.Name)
+	assert.False(t, explanations[1].Applies)
+	assert.Equal(t, "analysts", explanations[1].ReplacedBy)
+
+	recorder = adminRequest(t, api, http.MethodPost, "/api/v1/explain", `{"query":"SELECT 1"}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
@@ -0,0 +1,151 @@
+package interfaces
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"pgbouncer-quota-enforcer/internal/config"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// adminTokenEnv names the environment variable holding the admin API token, so
+// that it does not have to appear on the command line
+const adminTokenEnv = "ENFORCER_ADMIN_TOKEN"
+
+// adminError is an error response of the admin API
+type adminError struct {
+	status  string
+	code    int
+	message string
+}
+
+// Error returns the status and the message of the response
+func (e *adminError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("admin API returned %s", e.status)
+	}
+	return fmt.Sprintf("admin API returned %s: %s", e.status, e.message)
+}
+
+// adminClient calls the admin HTTP API of a running server
+type adminClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// addAdminFlags adds the flags locating the admin API to a command
+func addAdminFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String("admin-url", "", "Base URL of the admin API (default: taken from the admin section of --config, else http://127.0.0.1:8080)")
+	cmd.PersistentFlags().String("admin-token", "", "Bearer token of the admin API (default: $"+adminTokenEnv+", else the admin token of --config)")
+}
+
+// newAdminClient returns a client of the admin API located by the command's flags,
+// falling back to the environment and then to the configuration file
+func newAdminClient(cmd *cobra.Command) (*adminClient, error) {
+	baseURL, err := cmd.Flags().GetString("admin-url")
+	if err != nil {
+		return nil, err
+	}
+	token, err := cmd.Flags().GetString("admin-token")
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		token = os.Getenv(adminTokenEnv)
+	}
+
+	configFile, _ := cmd.Flags().GetString("config")
+	if configFile != "" && (baseURL == "" || token == "") {
+		cfg, err := config.Load(configFile, cmd.Flags())
+		if err != nil {
+			return nil, err
+		}
+		if baseURL == "" && cfg.Admin.Address != "" {
+			baseURL = adminURL(cfg.Admin.Address)
+		}
+		if token == "" {
+			token = cfg.Admin.Token
+		}
+	}
+	if baseURL == "" {
+		baseURL = "http://127.0.0.1:8080"
+	}
+	if token == "" {
+		return nil, fmt.Errorf("an admin token is required: use --admin-token or $%s", adminTokenEnv)
+	}
+
+	return &adminClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// adminURL returns the URL of an admin API listening on address; listeners on
+// every interface are reached through the loopback interface
+func adminURL(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "http://" + address
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// do sends a request to the admin API and decodes the JSON response into out,
+// unless out is nil. Error responses are returned as errors.
+func (c *adminClient) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, target, &payload)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to reach the admin API: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= http.StatusBadRequest {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(response.Body).Decode(&failure)
+		return &adminError{status: response.Status, code: response.StatusCode, message: failure.Error}
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode admin API response: %w", err)
+	}
+	return nil
+}
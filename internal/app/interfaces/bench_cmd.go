@@ -0,0 +1,137 @@
+package interfaces
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// NewBenchCommand creates the bench command
+func NewBenchCommand() *cobra.Command {
+	var config adapters.LoadConfig
+	var queries []string
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "bench",
+		Short: "Load a server with a query mix and report latencies and quota denials",
+		Long: `Open --connections concurrent connections to --target and send them the
+queries given with --query over the simple query protocol, at --rate queries
+per second over all connections, for --duration. A query may be prefixed with
+its weight in the mix and a colon: "3:SELECT 1" is sent three times as often
+as a query of weight 1.
+
+The report gives the latency percentiles of the queries answered and the share
+of them denied by a quota (SQLSTATE 53400), per query and overall. Run it
+against the enforcer, then against its upstream directly, to size the
+enforcer before production.`,
+		Example: `  pgbouncer-quota-enforcer bench --target postgres://alice@127.0.0.1:5432/app --connections 50 --rate 2000 --duration 1m
+  pgbouncer-quota-enforcer bench --target postgres://alice@127.0.0.1:5432/app --query "9:SELECT 1" --query "1:SELECT count(*) FROM orders"`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			mix, err := parseQueryMix(queries)
+			if err != nil {
+				return err
+			}
+			config.Mix = mix
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return runBench(ctx, cmd.OutOrStdout(), config, jsonOutput)
+		},
+	}
+
+	cmd.Flags().StringVar(&config.Target, "target", "", "Connection string of the server to load, such as postgres://user@host:5432/database")
+	cmd.Flags().IntVar(&config.Connections, "connections", 10, "Concurrent connections")
+	cmd.Flags().Float64Var(&config.Rate, "rate", 0, "Queries per second over all connections (default: as fast as possible)")
+	cmd.Flags().DurationVar(&config.Duration, "duration", 10*time.Second, "How long to send queries for")
+	cmd.Flags().StringArrayVar(&queries, "query", []string{"SELECT 1"}, "Query of the mix, optionally prefixed with its weight and a colon; repeatable")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+	_ = cmd.MarkFlagRequired("target")
+
+	return cmd
+}
+
+// parseQueryMix parses queries given as SQL or as weight:SQL
+func parseQueryMix(queries []string) ([]adapters.LoadQuery, error) {
+	mix := make([]adapters.LoadQuery, 0, len(queries))
+	for _, query := range queries {
+		weight := 1
+		if prefix, sql, found := strings.Cut(query, ":"); found {
+			if n, err := strconv.Atoi(strings.TrimSpace(prefix)); err == nil {
+				if n <= 0 {
+					return nil, fmt.Errorf("query %q: weight must be positive", query)
+				}
+				weight, query = n, sql
+			}
+		}
+		query = strings.TrimSpace(query)
+		if query == "" {
+			return nil, fmt.Errorf("queries must not be empty")
+		}
+		mix = append(mix, adapters.LoadQuery{SQL: query, Weight: weight})
+	}
+	return mix, nil
+}
+
+// runBench loads the target and prints the report
+func runBench(ctx context.Context, out io.Writer, config adapters.LoadConfig, jsonOutput bool) error {
+	log := logger.NewSimpleLogger()
+	log.SetLevel(logger.LevelError)
+	generator, err := adapters.NewLoadGenerator(config, log)
+	if err != nil {
+		return err
+	}
+
+	// An interrupted run still reports what it measured
+	report, _ := generator.Run(ctx)
+
+	if jsonOutput {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	fmt.Fprintf(out, "%d queries sent over %d connections in %s (%.1f queries/s)\n",
+		report.Sent, report.Connections, report.Elapsed.Round(time.Millisecond), report.Throughput)
+	fmt.Fprintf(out, "%d denied by a quota (%s), %d failed, %d connection attempts failed\n",
+		report.Denied, formatPercent(report.DenialRate), report.Errors, report.ConnectionErrors)
+	fmt.Fprintf(out, "Latency: p50 %s, p90 %s, p99 %s, max %s\n\n",
+		formatLatency(report.Latency.P50), formatLatency(report.Latency.P90),
+		formatLatency(report.Latency.P99), formatLatency(report.Latency.Max))
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "QUERY\tSENT\tDENIED\tERRORS\tP50\tP90\tP99\tMAX")
+	for _, query := range report.Queries {
+		fmt.Fprintf(w, "%s\t%d\t%d (%s)\t%d\t%s\t%s\t%s\t%s\n",
+			listedQuery(query.Query), query.Sent, query.Denied, formatPercent(query.DenialRate), query.Errors,
+			formatLatency(query.Latency.P50), formatLatency(query.Latency.P90),
+			formatLatency(query.Latency.P99), formatLatency(query.Latency.Max))
+	}
+	return w.Flush()
+}
+
+// formatPercent formats a ratio as a percentage
+func formatPercent(ratio float64) string {
+	return fmt.Sprintf("%.1f%%", ratio*100)
+}
+
+// formatLatency rounds a latency to a readable precision
+func formatLatency(d time.Duration) string {
+	if d >= time.Millisecond {
+		return d.Round(10 * time.Microsecond).String()
+	}
+	return d.Round(time.Microsecond).String()
+}
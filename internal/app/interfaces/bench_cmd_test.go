@@ -0,0 +1,52 @@
+package interfaces
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBenchCommand(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	server, err := app.NewServerService(app.ServerConfig{
+		Address:  "127.0.0.1:0",
+		Upstream: backend.Addr(),
+		Policies: []domain.QuotaPolicy{{Name: "app", Database: "app", Limit: 5, Window: time.Hour}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, server.Start(context.Background(), "127.0.0.1:0"))
+	defer func() {
+		require.NoError(t, server.Stop(context.Background()))
+	}()
+
+	out, err := runCommand(t, "bench", "--target", "postgres://alice@"+server.Address()+"/app?sslmode=disable",
+		"--connections", "2", "--rate", "100", "--duration", "200ms", "--query", "3:SELECT 1", "--query", "SELECT 2")
+	require.NoError(t, err)
+	assert.Contains(t, out, "20 queries sent over 2 connections")
+	assert.Contains(t, out, "15 denied by a quota (75.0%)", "Queries beyond the quota should be reported as denied")
+	assert.Regexp(t, `QUERY\s+SENT\s+DENIED\s+ERRORS\s+P50\s+P90\s+P99\s+MAX`, out)
+	assert.Regexp(t, `SELECT 2\s+\d+\s+\d+ \(`, out)
+}
+
+func TestParseQueryMix(t *testing.T) {
+	mix, err := parseQueryMix([]string{"3:SELECT 1", "SELECT '10:00'::time", " 1 : SELECT 2 "})
+	require.NoError(t, err)
+	assert.Equal(t, []adapters.LoadQuery{
+		{SQL: "SELECT 1", Weight: 3},
+		{SQL: "SELECT '10:00'::time", Weight: 1},
+		{SQL: "SELECT 2", Weight: 1},
+	}, mix)
+
+	_, err = parseQueryMix([]string{"0:SELECT 1"})
+	assert.Error(t, err)
+	_, err = parseQueryMix([]string{"2:"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,139 @@
+package interfaces
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// NewRecordCommand creates the record command
+func NewRecordCommand() *cobra.Command {
+	var config app.ServerConfig
+	var duration time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "record",
+		Short: "Record the queries clients send to an upstream into a capture file",
+		Long: `Proxy the connections accepted on --address to --upstream without enforcing
+any quota, and record every message clients send, with its timing, to the
+capture file given with --output. Recording stops on Ctrl+C or after
+--duration.
+
+Captures can be replayed against a server with replay, or evaluated against
+proposed policies with simulate.`,
+		Example: `  pgbouncer-quota-enforcer record --address :6433 --upstream pgbouncer.internal:6432 --output capture.jsonl --duration 10m`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			if duration > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, duration)
+				defer cancel()
+			}
+			return runRecord(ctx, cmd.OutOrStdout(), config)
+		},
+	}
+
+	cmd.Flags().StringVar(&config.Address, "address", "127.0.0.1:6433", "Address clients connect to while recording")
+	cmd.Flags().StringVar(&config.Upstream, "upstream", "", "PostgreSQL or PgBouncer the connections are proxied to, as host:port")
+	cmd.Flags().StringVar(&config.CaptureFile, "output", "", "Capture file to write")
+	cmd.Flags().BoolVar(&config.CaptureParameters, "capture-parameters", false, "Record the values bound to prepared statements; they may contain personal data")
+	cmd.Flags().DurationVar(&duration, "duration", 0, "Stop recording after this long (default: until interrupted)")
+	_ = cmd.MarkFlagRequired("upstream")
+	_ = cmd.MarkFlagRequired("output")
+
+	return cmd
+}
+
+// runRecord proxies and records connections until ctx is done
+func runRecord(ctx context.Context, out io.Writer, config app.ServerConfig) error {
+	config.LogLevel = logger.LevelError
+	server, err := app.NewServerService(config)
+	if err != nil {
+		return fmt.Errorf("failed to create recorder: %w", err)
+	}
+	if err := server.Start(ctx, config.Address); err != nil {
+		return fmt.Errorf("failed to start recorder: %w", err)
+	}
+	fmt.Fprintf(out, "Recording connections to %s into %s\n", server.Address(), config.CaptureFile)
+
+	<-ctx.Done()
+	stopCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Stop(stopCtx); err != nil {
+		return fmt.Errorf("failed to stop recorder: %w", err)
+	}
+	fmt.Fprintf(out, "Capture written to %s\n", config.CaptureFile)
+	return nil
+}
+
+// NewReplayCommand creates the replay command
+func NewReplayCommand() *cobra.Command {
+	var captureFile string
+	var target string
+	var speed float64
+
+	cmd := &cobra.Command{
+		Use:   "replay",
+		Short: "Replay a capture file against a server",
+		Long: `Open a connection to --target for every connection of the capture and send
+it the recorded startup parameters and simple queries, at the recorded pace
+divided by --speed. Responses are read and discarded, and clients do not
+authenticate, so the target must trust the recorded users.
+
+Replay a capture against an enforcer to regression-test quota policies, or
+at a higher speed to load-test it.`,
+		Example: `  pgbouncer-quota-enforcer replay --capture capture.jsonl --target 127.0.0.1:5432
+  pgbouncer-quota-enforcer replay --capture capture.jsonl --target 127.0.0.1:5432 --speed 10
+  pgbouncer-quota-enforcer replay --capture capture.jsonl --target 127.0.0.1:5432 --speed 0`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if speed < 0 {
+				return fmt.Errorf("speed must not be negative")
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return runReplay(ctx, cmd.OutOrStdout(), captureFile, target, speed)
+		},
+	}
+
+	cmd.Flags().StringVar(&captureFile, "capture", "", "Capture file recorded with record or --capture-file")
+	cmd.Flags().StringVar(&target, "target", "", "Server to replay the capture against, as host:port")
+	cmd.Flags().Float64Var(&speed, "speed", 1, "Speed-up of the recorded pace: 2 replays twice as fast, 0 as fast as possible")
+	_ = cmd.MarkFlagRequired("capture")
+	_ = cmd.MarkFlagRequired("target")
+
+	return cmd
+}
+
+// runReplay replays the capture against target and prints what was sent
+func runReplay(ctx context.Context, out io.Writer, captureFile, target string, speed float64) error {
+	f, err := os.Open(captureFile)
+	if err != nil {
+		return fmt.Errorf("failed to open capture file: %w", err)
+	}
+	defer f.Close()
+
+	source, err := adapters.NewCaptureReader(f)
+	if err != nil {
+		return err
+	}
+
+	log := logger.NewSimpleLogger()
+	log.SetLevel(logger.LevelError)
+	started := time.Now()
+	stats, err := adapters.NewCaptureReplayer(target, speed, log).Replay(ctx, source)
+	fmt.Fprintf(out, "%d queries replayed over %d connections in %s, %d records skipped\n",
+		stats.Queries, stats.Connections, time.Since(started).Round(time.Millisecond), stats.Skipped)
+	return err
+}
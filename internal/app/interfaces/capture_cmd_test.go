@@ -0,0 +1,55 @@
+package interfaces
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordAndReplayCommands(t *testing.T) {
+	captureFile := filepath.Join(t.TempDir(), "capture.jsonl")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	recorded := testkit.StartFakeBackend(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- runRecord(ctx, io.Discard, app.ServerConfig{Address: address, Upstream: recorded.Addr(), CaptureFile: captureFile})
+	}()
+
+	var client *testkit.Client
+	require.Eventually(t, func() bool {
+		client, err = testkit.Dial(address, testkit.ClientConfig{User: "alice", Database: "app"})
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = client.Query("SELECT 1")
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+	cancel()
+	require.NoError(t, <-done)
+
+	replayed := testkit.StartFakeBackend(t)
+	out, err := runCommand(t, "replay", "--capture", captureFile, "--target", replayed.Addr(), "--speed", "0")
+	require.NoError(t, err)
+	assert.Contains(t, out, "1 queries replayed over 1 connections")
+	require.Eventually(t, func() bool {
+		return slices.Contains(replayed.Queries(), "SELECT 1")
+	}, 5*time.Second, 10*time.Millisecond, "The recorded query should be sent to the target")
+	assert.Equal(t, "alice", replayed.StartupParameters()[0]["user"])
+
+	_, err = runCommand(t, "replay", "--capture", captureFile, "--target", replayed.Addr(), "--speed", "-1")
+	assert.Error(t, err)
+}
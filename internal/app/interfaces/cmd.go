@@ -2,11 +2,23 @@ package interfaces
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/internal/config"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"sort"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -14,55 +26,323 @@ import (
 
 // NewServerCommand creates the server command
 func NewServerCommand() *cobra.Command {
-	var address string
-
 	cmd := &cobra.Command{
 		Use:   "server",
 		Short: "Start the TCP server that logs received bytes",
 		Long: `Start a TCP server that accepts connections and logs all received bytes.
 This server is designed to be the first step in building a PostgreSQL
-protocol-aware quota enforcement service.`,
+protocol-aware quota enforcement service.
+
+Settings may also come from the file given with --config; flags set on the
+command line override it. Quota policies are reloaded without dropping
+connections when the file changes or on SIGHUP.
+
+With --usage-store-dsn, usage counters are shared through a PostgreSQL
+database and the policies of its quota_enforcer.quota_policies table are
+enforced alongside the configured ones. --usage-store-file keeps them in a
+SQLite database file instead, for a single enforcer, and --usage-store-redis
+in Redis, for replicas enforcing quotas on the sum of their usage.
+
+With --etcd-endpoints, the quota policies and roles kept in etcd are enforced
+as well, and reloaded as soon as they change there.
+
+With --leader-election, the replicas elect one of them, through a Redis lock
+or a Kubernetes Lease, to report the usage of elapsed windows and to compact
+the counters of the usage store older than --usage-retention. With
+--usage-export-dir, the leader also writes the usage of each tenant to a file
+of that directory every report interval, for chargeback.
+
+Send SIGUSR1 to put the listener into maintenance mode, rejecting new
+connections, and SIGUSR2 to leave it.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runServer(address)
+			configFile, err := cmd.Flags().GetString("config")
+			if err != nil {
+				return err
+			}
+
+			load := func() (*config.Config, error) {
+				return config.Load(configFile, cmd.Flags())
+			}
+			cfg, err := load()
+			if err != nil {
+				return err
+			}
+			return runServer(cfg, configFile, load)
 		},
 	}
 
-	cmd.Flags().StringVarP(&address, "address", "a", ":5432", "Address to listen on (default: :5432)")
+	cmd.Flags().StringP("address", "a", config.DefaultAddress, "Address to listen on (default: :5432)")
+	cmd.Flags().String("instance-id", "", "Identifier of this replica in logs, events and captures (default: hostname with a random suffix)")
+	cmd.Flags().String("upstream", "", "Upstream PostgreSQL or PgBouncer: host:port (re-resolved as DNS records expire), srv://<record> or consul://<service>?tag=<tag>&dc=<dc>")
+	cmd.Flags().Duration("upstream-min-refresh", app.DefaultUpstreamMinRefresh, "Shortest delay between two upstream resolutions")
+	cmd.Flags().Duration("upstream-max-refresh", app.DefaultUpstreamMaxRefresh, "Longest delay between two upstream resolutions, used when records carry no TTL")
+	cmd.Flags().String("failover-upstream", "", "Secondary upstream new connections fail over to while the upstream fails its health checks, in any form --upstream accepts")
+	cmd.Flags().Duration("failover-cooldown", app.DefaultFailoverCooldown, "How long the upstream must stay healthy before new connections fail back to it")
+	cmd.Flags().Bool("upstream-reconnect", false, "Reconnect clients whose upstream connection is lost outside a transaction, sending an interrupted read-only query again, instead of disconnecting them")
+	cmd.Flags().String("pool-mode", "", "Share upstream connections between clients: session or transaction; needs --auth-file (default: one upstream connection per client)")
+	cmd.Flags().Int("pool-size", adapters.DefaultPoolSize, "Upstream connections each user and database pair may open when pooling")
+	cmd.Flags().Duration("pool-wait-timeout", adapters.DefaultPoolWaitTimeout, "How long a client waits for a pooled upstream connection before it is disconnected")
+	cmd.Flags().Duration("upstream-timeout", 10*time.Second, "How long connecting to the upstream and completing its startup may take")
+	cmd.Flags().Duration("read-timeout", 30*time.Second, "How long a client read blocks before shutdown and eviction are checked again")
+	cmd.Flags().Duration("idle-timeout", 0, "Close client connections idle outside a transaction for longer than this (0 disables)")
+	cmd.Flags().Duration("idle-transaction-timeout", 0, "Close client connections idle inside a transaction for longer than this, ending the transaction (0 disables)")
+	cmd.Flags().Duration("shutdown-timeout", 10*time.Second, "How long to wait for connections to finish on shutdown; on SIGTERM, clients first get as long to finish their transactions")
+	cmd.Flags().String("log-level", "debug", "Minimum severity logged: debug, info or error")
+	cmd.Flags().StringSlice("log-parameters", nil, "Query hashes whose literals and bound parameters may be logged, * for every query (default: queries are logged normalized)")
+	cmd.Flags().String("capture-file", "", "Record query events to a capture file for later replay")
+	cmd.Flags().String("normalizer", string(adapters.DefaultNormalizer), "How queries are fingerprinted: pg_query, fast-regex, which needs no CGO call but does not check their syntax, or none, which leaves their literals in logs and fingerprints")
+	cmd.Flags().Int("query-cache-size", adapters.DefaultQueryCacheSize, "Normalized queries cached by text so repeated queries are parsed once (0 disables the cache)")
+	cmd.Flags().Int("statement-cache-size", adapters.DefaultStatementCacheSize, "Prepared statements cached by name in addition to the query cache (0 caches them by text only)")
+	cmd.Flags().Bool("capture-parameters", false, "Record the values bound to prepared statements; they may contain personal data")
+	cmd.Flags().Bool("gss-encryption-tunnel", false, "Relay the connections of clients requesting GSSAPI encryption to the upstream unread, without enforcing them (default: GSSENCRequests are declined)")
+	cmd.Flags().Bool("quota-functions", false, "Answer SELECT quota_remaining() and SELECT * FROM pgqe.usage with the quotas of the client's connection")
+	cmd.Flags().String("maintenance-message", domain.DefaultMaintenanceMessage, "Error message sent to clients rejected during maintenance")
+	cmd.Flags().Duration("maintenance-queue", 0, "How long new connections wait for maintenance to end before being rejected")
+	cmd.Flags().Int("burst-threshold", 0, "Report N+1 patterns when a connection repeats a query this many times within --burst-interval (0 disables)")
+	cmd.Flags().Duration("burst-interval", time.Second, "Window used to detect repeated queries")
+	cmd.Flags().Int("burst-limit", 0, "Deny identical queries beyond this many per --burst-interval on a connection (0 disables)")
+	cmd.Flags().Float64("denial-alert-percent", 0, "Alert when a user is denied more than this percentage of queries within --denial-alert-window (0 disables)")
+	cmd.Flags().Duration("denial-alert-window", 5*time.Minute, "Window used to compute denial rates")
+	cmd.Flags().Int("max-idle-connections", 0, "Close the longest idle connections of a user and database pair beyond this many (0 disables)")
+	cmd.Flags().Int("max-message-size-mb", 0, "Close connections sending a message larger than this many megabytes (0 disables)")
+	cmd.Flags().Int("max-connection-buffer-mb", 0, "Close connections whose prepared statements and portals hold more than this many megabytes (0 disables)")
+	cmd.Flags().Bool("socket-activation", false, "Serve the sockets passed by systemd; those named after a listener serve it, the others replace --address")
+	cmd.Flags().Int("denial-alert-min-queries", 20, "Queries a user must issue within the window before denial alerts apply")
+	cmd.Flags().Float64("rate-alert-factor", 0, "Alert when the query rate of a user is this many times above or below its learned baseline (0 disables)")
+	cmd.Flags().Duration("rate-alert-interval", app.DefaultRateAnomalyInterval, "Interval query rates are measured over")
+	cmd.Flags().Int("rate-alert-warmup", app.DefaultRateAnomalyWarmup, "Intervals a baseline is learned over before it alerts")
+	cmd.Flags().Float64("rate-alert-min-rate", app.DefaultRateAnomalyMinRate, "Queries per second below which rate deviations are not reported")
+	cmd.Flags().Bool("rate-alert-fingerprints", false, "Learn a baseline for each query fingerprint of a user as well")
+	cmd.Flags().Bool("rate-alert-notices", false, "Warn clients of a user whose query rate strayed with a notice")
+	cmd.Flags().String("firewall-mode", "", "SQL firewall mode: learn the query fingerprints of each user, then enforce them, or enforce those of --firewall-profile-file (default: disabled)")
+	cmd.Flags().Duration("firewall-learning-period", 0, "How long the queries of a user are learned, from its first, before the firewall enforces them (0 learns until --firewall-mode enforce)")
+	cmd.Flags().String("firewall-action", string(app.FirewallBlock), "What the firewall does with unseen queries: block, or alert and let them through")
+	cmd.Flags().StringSlice("firewall-users", nil, "Users the firewall applies to, typically service accounts (default: every user)")
+	cmd.Flags().String("firewall-profile-file", "", "JSON file the learned query fingerprints are saved to and loaded from (default: kept in memory)")
+	cmd.Flags().String("tls-cert", "", "PEM certificate presented to clients that request TLS (default: SSLRequests are declined)")
+	cmd.Flags().String("tls-key", "", "PEM private key of --tls-cert")
+	cmd.Flags().String("tls-ca", "", "PEM CA bundle that must have signed the certificates clients present")
+	cmd.Flags().StringSlice("tls-require-users", nil, "Users whose plaintext connections are rejected; * for every user")
+	cmd.Flags().StringSlice("access-allow", nil, "CIDR ranges clients of the default listener may connect from (default: any)")
+	cmd.Flags().StringSlice("access-deny", nil, "CIDR ranges clients of the default listener may not connect from")
+	cmd.Flags().String("auth-file", "", "PgBouncer auth_file (userlist.txt) used to authenticate clients at the enforcer")
+	cmd.Flags().String("auth-upstream-user", "", "User locally authenticated clients are logged into the upstream as (default: the client's user)")
+	cmd.Flags().String("usage-store-dsn", "", "PostgreSQL connection string of a database keeping usage counters and quota policies (default: usage is kept in memory)")
+	cmd.Flags().String("usage-store-file", "", "SQLite database file keeping usage counters and quota policies, for a single enforcer")
+	cmd.Flags().String("usage-store-redis", "", "Redis URL of a server keeping usage counters, summed across enforcers")
+	cmd.Flags().String("usage-consistency", "eventual", "How enforcers sharing a usage store see each other's usage: strict writes every query through, eventual buffers it")
+	cmd.Flags().Int64("usage-max-overshoot", 0, "Usage of a counter an enforcer holds back at most with eventual consistency (0 only bounds it by the flush interval)")
+	cmd.Flags().Duration("usage-store-flush-interval", adapters.DefaultUsageFlushInterval, "How often buffered usage is written to the usage store")
+	cmd.Flags().StringSlice("etcd-endpoints", nil, "etcd endpoints, as host:port, to read and watch quota policies and roles from (default: etcd is not used)")
+	cmd.Flags().String("etcd-prefix", adapters.DefaultEtcdPrefix, "etcd key prefix of the quota policies, roles and instances")
+	cmd.Flags().String("leader-election", "", "How replicas elect the one running housekeeping jobs: redis or kubernetes (default: no housekeeping)")
+	cmd.Flags().String("leader-election-redis", "", "Redis URL of the leader election lock (default: that of --usage-store-redis)")
+	cmd.Flags().String("leader-election-namespace", "", "Namespace of the leader election Lease (default: that of the pod)")
+	cmd.Flags().Duration("usage-report-interval", app.DefaultUsageReportInterval, "How often the leader reports the usage of the windows that ended")
+	cmd.Flags().Duration("usage-retention", app.DefaultUsageRetention, "How long the leader keeps the usage counters of elapsed windows")
+	cmd.Flags().String("usage-export-dir", "", "Directory the leader writes the usage of each tenant to every report interval (default: usage is not exported)")
+	cmd.Flags().String("usage-export-format", string(adapters.UsageExportCSV), "Format of the exported usage: csv, json or parquet")
+	cmd.Flags().Bool("async-usage", false, "Record usage in the background so a slow usage store does not delay queries")
+	cmd.Flags().Duration("usage-staleness", adapters.DefaultUsageStaleness, "How long usage read from the usage store is trusted with --async-usage (0 reads it on every check)")
+	cmd.Flags().Int("usage-workers", adapters.DefaultAsyncUsageWorkers, "Goroutines writing usage to the usage store with --async-usage")
+	cmd.Flags().Int("usage-queue-size", adapters.DefaultAsyncUsageQueueSize, "Increments each usage worker buffers with --async-usage before queries wait for it")
+	cmd.Flags().String("admin-address", "", "Address the admin HTTP API listens on (default: the API is disabled)")
+	cmd.Flags().String("admin-token", "", "Bearer token required by the admin HTTP API")
+	cmd.Flags().String("health-address", "", "Address serving the /healthz and /readyz probes (default: the probes are disabled)")
+	cmd.Flags().String("audit-file", "", "Append a JSON Lines record of every evaluated query to this file (default: no audit log)")
+	cmd.Flags().Int64("audit-max-size-mb", 100, "Rotate the audit log before it grows beyond this many megabytes (0 disables)")
+	cmd.Flags().Duration("audit-max-age", 24*time.Hour, "Rotate the audit log once it has been written to for this long (0 disables)")
+	cmd.Flags().Int("audit-max-backups", 0, "Rotated audit logs to keep (0 keeps them all)")
+	cmd.Flags().Bool("audit-compress", true, "Compress rotated audit logs with gzip")
+	cmd.Flags().String("slow-query-log", "", "Append a JSON Lines record of every query slower than --slow-query-threshold to this file, or - for stderr (default: no slow query log)")
+	cmd.Flags().Duration("slow-query-threshold", app.DefaultSlowQueryThreshold, "Duration beyond which queries are logged as slow, from when they are received until the upstream completes them")
+	cmd.Flags().Float64("slow-query-sample-rate", 1, "Share of slow queries logged, between 0 and 1")
+	cmd.Flags().Int("slow-query-max-per-second", 0, "Slow queries logged per second at most (0 disables the cap)")
+	cmd.Flags().Bool("slow-query-redact", false, "Log the format and size of bound parameters instead of their values")
+	cmd.Flags().StringSlice("script", nil, "Lua scripts defining an evaluate(query) function run in order on every query, which may deny or rewrite it (default: no script)")
+	cmd.Flags().Duration("script-timeout", adapters.DefaultScriptTimeout, "How long a script may run on a query before it is ignored")
+	cmd.Flags().Int64("rewrite-row-limit", 0, "LIMIT appended to the SELECTs reading relations without one (default: none)")
+	cmd.Flags().Bool("rewrite-trace-comments", false, "Prepend a W3C traceparent comment to every query")
+	cmd.Flags().String("rewrite-tenant-column", "", "Column holding the tenant of the rows of the filtered tables (default: no tenant filter)")
+	cmd.Flags().String("rewrite-tenant-value", "user", "Tenant of a connection: user, database, application_name or label.<name>")
+	cmd.Flags().StringSlice("rewrite-tenant-tables", nil, "Tables filtered by tenant: name, schema.name or schema.*")
+	cmd.Flags().StringSlice("kafka-brokers", nil, "Kafka brokers, as host:port, to publish query events to (default: events are not published)")
+	cmd.Flags().String("kafka-topic", "", "Kafka topic receiving query events")
+	cmd.Flags().String("kafka-key", string(adapters.KafkaKeyUser), "Event field keying Kafka messages: user or query_hash")
+	cmd.Flags().Int("kafka-batch-size", adapters.DefaultKafkaBatchSize, "Query events sent to Kafka per request at most")
+	cmd.Flags().Duration("kafka-linger", adapters.DefaultKafkaLinger, "How long query events wait for their Kafka batch to fill")
+	cmd.Flags().Bool("kafka-tls", false, "Connect to the Kafka brokers over TLS")
+	cmd.Flags().String("kafka-tls-ca", "", "PEM CAs trusted to sign Kafka broker certificates (default: the system roots)")
+	cmd.Flags().String("kafka-sasl-mechanism", "", "SASL mechanism authenticating to the Kafka brokers: PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512 (default: no SASL)")
+	cmd.Flags().String("kafka-sasl-username", "", "SASL user authenticating to the Kafka brokers; its password is set by kafka.sasl.password or "+config.EnvVar("kafka.sasl.password"))
+	cmd.Flags().IntSlice("quota-alert-thresholds", nil, "Raise an event when a user's usage crosses these percentages of a quota, e.g. 80,100 (default: no quota alerts)")
+	cmd.Flags().String("pgbouncer-admin-url", "", "URL of the upstream PgBouncer's admin console, polled so that policies can tighten quotas of saturated pools (default: not polled)")
+	cmd.Flags().Duration("pgbouncer-poll-interval", app.DefaultPoolerPollInterval, "How often the PgBouncer admin console is polled")
+	cmd.Flags().Int("query-stats-max", app.DefaultMaxQueryStats, "Query fingerprints whose statistics are kept; the least recently seen are dropped beyond it")
+	cmd.Flags().Duration("query-stats-flush-interval", app.DefaultQueryStatsFlushInterval, "How often query statistics are added to a PostgreSQL or SQLite usage store")
+	cmd.Flags().String("faults", "", "Faults to inject, as point:kind[:duration][@probability] rules separated by ';'; only binaries built with the chaos tag inject them")
 
 	return cmd
 }
 
-// runServer starts the TCP server and handles graceful shutdown
-func runServer(address string) error {
+// runServer starts the TCP server and handles graceful shutdown.
+// The configured maintenance window is applied on SIGUSR1 and lifted on SIGUSR2.
+// Quota policies are reloaded through load on SIGHUP and when configFile changes.
+// The usage store, when configured, is closed after the server so buffered usage is written.
+// The admin HTTP API and the health probes, when configured, are served until shutdown.
+func runServer(cfg *config.Config, configFile string, load func() (*config.Config, error)) error {
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Keep usage counters in PostgreSQL or SQLite when a usage store is configured
+	var serviceOpts []app.ServiceOption
+	serverConfig := cfg.ServerConfig()
+	usageStore, err := openUsageStore(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if usageStore != nil {
+		defer closeUsageStore(usageStore)
+		serviceOpts = append(serviceOpts, app.WithUsageStore(usageStore))
+	}
+
+	// Elect the replica running the housekeeping jobs when leader election is configured
+	if cfg.Housekeeping.Election != "" {
+		if serverConfig.InstanceID == "" {
+			serverConfig.InstanceID = app.GenerateInstanceID()
+		}
+		elector, err := openLeaderElector(ctx, cfg, serverConfig.InstanceID)
+		if err != nil {
+			return err
+		}
+		if closer, ok := elector.(io.Closer); ok {
+			defer closer.Close()
+		}
+		serviceOpts = append(serviceOpts, app.WithLeaderElector(elector))
+	}
+
+	// Read and watch quota policies in etcd when it is configured
+	policyStore, err := openPolicyStore(cfg)
+	if err != nil {
+		return err
+	}
+	if policyStore != nil {
+		defer closePolicyStore(policyStore)
+	}
+	sources := policySources(usageStore, policyStore)
+
+	policies, err := quotaPolicies(ctx, cfg, sources)
+	if err != nil {
+		return err
+	}
+	serverConfig.Policies = policies
+	roles, err := quotaRoles(ctx, cfg, sources)
+	if err != nil {
+		return err
+	}
+	serverConfig.Roles = roles
+
 	// Create server service
-	serverService := app.NewServerService(app.ServerConfig{
-		Address: address,
-	})
+	serverService, err := app.NewServerService(serverConfig, serviceOpts...)
+	if err != nil {
+		return fmt.Errorf("failed to create server: %w", err)
+	}
 
 	// Start server
-	if err := serverService.Start(ctx, address); err != nil {
+	if err := serverService.Start(ctx, serverConfig.Address); err != nil {
 		return fmt.Errorf("failed to start server: %w", err)
 	}
 
-	fmt.Printf("TCP server started on %s\n", serverService.Address())
+	fmt.Printf("TCP server started on %s (instance %s)\n", serverService.Address(), serverService.InstanceID())
+	for _, listener := range serverConfig.Listeners {
+		fmt.Printf("Listener %s started on %s\n", listener.Name, serverService.Addresses()[listener.Name])
+	}
+	// Serve the admin API and the health probes alongside the proxy
+	endpoints := []*httpEndpoint{
+		{name: "admin API", address: cfg.Admin.Address, handler: NewAdminAPI(serverService, cfg.Admin.Token)},
+		{name: "health probes", address: cfg.Health.Address, handler: NewHealthAPI(serverService)},
+	}
+	for _, endpoint := range endpoints {
+		if err := endpoint.serve(); err != nil {
+			for _, started := range endpoints {
+				started.close()
+			}
+			_ = serverService.Stop(context.Background())
+			return err
+		}
+	}
+
 	fmt.Println("Press Ctrl+C to stop the server")
 
+	// Reload quota policies when the configuration file or etcd changes
+	changes := make(chan struct{}, 1)
+	changed := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+	if configFile != "" {
+		if err := config.Watch(ctx, configFile, changed); err != nil {
+			fmt.Printf("Configuration changes will only be applied on SIGHUP: %v\n", err)
+		}
+	}
+	if policyStore != nil {
+		policyStore.Register(ctx, serverService.InstanceID())
+		policyStore.Applied(ctx)
+		policyStore.Watch(ctx, changed)
+	}
+
 	// Wait for interrupt signal
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+
+	// Block until we receive a shutdown signal, toggling maintenance and reloading on the way
+	maintenance := cfg.MaintenanceWindow()
+	var stopSignal os.Signal
+wait:
+	for {
+		select {
+		case <-changes:
+			reloadPolicies(ctx, serverService, load, sources)
+		case sig := <-sigChan:
+			switch sig {
+			case syscall.SIGUSR1:
+				serverService.Maintenance().Enable(maintenance)
+				fmt.Println("Maintenance mode enabled")
+			case syscall.SIGUSR2:
+				serverService.Maintenance().Disable(maintenance.Database)
+				fmt.Println("Maintenance mode disabled")
+			case syscall.SIGHUP:
+				reloadPolicies(ctx, serverService, load, sources)
+			default:
+				stopSignal = sig
+				break wait
+			}
+		}
+	}
 
-	// Block until we receive a signal
-	<-sigChan
+	// Orchestrators stop replicas with SIGTERM: let clients finish their
+	// transactions first, within the shutdown timeout
+	if stopSignal == syscall.SIGTERM {
+		fmt.Println("\nDraining connections...")
+		serverService.Drain(cfg.Timeouts.Shutdown)
+		<-serverService.Drained()
+	}
 	fmt.Println("\nShutting down server...")
 
 	// Create context with timeout for graceful shutdown
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
 	defer shutdownCancel()
 
+	// Stop the admin API and the probes first so they do not observe a stopping server
+	for _, endpoint := range endpoints {
+		if err := endpoint.shutdown(shutdownCtx); err != nil {
+			fmt.Printf("Failed to stop the %s: %v\n", endpoint.name, err)
+		}
+	}
+
 	// Stop server
 	if err := serverService.Stop(shutdownCtx); err != nil {
 		return fmt.Errorf("error during server shutdown: %w", err)
@@ -72,6 +352,357 @@ func runServer(address string) error {
 	return nil
 }
 
+// policyStore defines quota policies and roles alongside the configuration
+type policyStore interface {
+	LoadPolicies(ctx context.Context) ([]domain.QuotaPolicy, error)
+	LoadRoles(ctx context.Context) (map[string][]string, error)
+}
+
+// usageStore keeps usage counters and defines quota policies and roles of its own
+type usageStore interface {
+	domain.UsageStore
+	policyStore
+	Close() error
+}
+
+// policySource is a policy store named for errors, with what to do once the
+// policies read from it are in force
+type policySource struct {
+	name    string
+	store   policyStore
+	applied func(ctx context.Context) // may be nil
+}
+
+// policySources returns the sources of the stores configured, which may be nil
+func policySources(usageStore usageStore, etcdStore *adapters.EtcdPolicyStore) []policySource {
+	var sources []policySource
+	if usageStore != nil {
+		sources = append(sources, policySource{name: "the usage store", store: usageStore})
+	}
+	if etcdStore != nil {
+		sources = append(sources, policySource{name: "etcd", store: etcdStore, applied: etcdStore.Applied})
+	}
+	return sources
+}
+
+// openPolicyStore connects to the configured etcd cluster, and returns nil when
+// there is none
+func openPolicyStore(cfg *config.Config) (*adapters.EtcdPolicyStore, error) {
+	if len(cfg.Etcd.Endpoints) == 0 {
+		return nil, nil
+	}
+	storeLogger := logger.NewSimpleLogger()
+	storeLogger.SetLevel(cfg.ServerConfig().LogLevel)
+
+	var storeOpts []adapters.EtcdPolicyStoreOption
+	if cfg.Etcd.Prefix != "" {
+		storeOpts = append(storeOpts, adapters.WithEtcdPrefix(cfg.Etcd.Prefix))
+	}
+	if cfg.Etcd.LeaseTTL > 0 {
+		storeOpts = append(storeOpts, adapters.WithEtcdLeaseTTL(cfg.Etcd.LeaseTTL))
+	}
+	return adapters.NewEtcdPolicyStore(cfg.Etcd.Endpoints, storeLogger, storeOpts...)
+}
+
+// openLeaderElector connects to the lock or the Lease of the configured leader
+// election, to elect identity
+func openLeaderElector(ctx context.Context, cfg *config.Config, identity string) (domain.LeaderElector, error) {
+	var electorOpts []adapters.LeaderElectorOption
+	if cfg.Housekeeping.Lock != "" {
+		electorOpts = append(electorOpts, adapters.WithLeaderLock(cfg.Housekeeping.Lock))
+	}
+	if cfg.Housekeeping.TTL > 0 {
+		electorOpts = append(electorOpts, adapters.WithLeaderTTL(cfg.Housekeeping.TTL))
+	}
+
+	if cfg.Housekeeping.Election == "kubernetes" {
+		return adapters.NewKubernetesLeaderElector(cfg.Housekeeping.Namespace, identity, electorOpts...)
+	}
+	url := cfg.Housekeeping.Redis
+	if url == "" {
+		url = cfg.UsageStore.Redis
+	}
+	return adapters.NewRedisLeaderElector(ctx, url, identity, electorOpts...)
+}
+
+// closePolicyStore unregisters the instance from etcd and closes the connection
+func closePolicyStore(policyStore *adapters.EtcdPolicyStore) {
+	if err := policyStore.Close(); err != nil {
+		fmt.Printf("Failed to unregister from etcd: %v\n", err)
+	}
+}
+
+// openUsageStore connects to the configured PostgreSQL or Redis usage store or
+// opens the configured SQLite one, and returns nil when there is none
+func openUsageStore(ctx context.Context, cfg *config.Config) (usageStore, error) {
+	if cfg.UsageStore.DSN == "" && cfg.UsageStore.File == "" && cfg.UsageStore.Redis == "" {
+		return nil, nil
+	}
+	storeLogger := logger.NewSimpleLogger()
+	storeLogger.SetLevel(cfg.ServerConfig().LogLevel)
+
+	var usageOpts []adapters.BufferedUsageStoreOption
+	if cfg.UsageStore.FlushInterval > 0 {
+		usageOpts = append(usageOpts, adapters.WithUsageFlushInterval(cfg.UsageStore.FlushInterval))
+	}
+	if cfg.UsageStore.Consistency == "strict" {
+		usageOpts = append(usageOpts, adapters.WithStrictUsage())
+	}
+	if cfg.UsageStore.MaxOvershoot > 0 {
+		usageOpts = append(usageOpts, adapters.WithUsageMaxPending(cfg.UsageStore.MaxOvershoot))
+	}
+
+	switch {
+	case cfg.UsageStore.File != "":
+		storeOpts := []adapters.SQLiteUsageStoreOption{adapters.WithSQLiteUsageOptions(usageOpts...)}
+		if cfg.UsageStore.CheckpointInterval > 0 {
+			storeOpts = append(storeOpts, adapters.WithSQLiteCheckpointInterval(cfg.UsageStore.CheckpointInterval))
+		}
+		store, err := adapters.NewSQLiteUsageStore(ctx, cfg.UsageStore.File, storeLogger, storeOpts...)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case cfg.UsageStore.Redis != "":
+		store, err := adapters.NewRedisUsageStore(ctx, cfg.UsageStore.Redis, storeLogger, usageOpts...)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+
+	store, err := adapters.NewPostgresUsageStore(ctx, cfg.UsageStore.DSN, storeLogger, usageOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// closeUsageStore writes the usage buffered by the usage store and closes it
+func closeUsageStore(usageStore usageStore) {
+	if err := usageStore.Close(); err != nil {
+		fmt.Printf("Failed to write quota usage: %v\n", err)
+	}
+}
+
+// httpEndpoint is an HTTP server running alongside the proxy; an empty address disables it
+type httpEndpoint struct {
+	name    string
+	address string
+	handler http.Handler
+	server  *http.Server // nil until served
+}
+
+// serve starts serving the endpoint in the background
+func (e *httpEndpoint) serve() error {
+	if e.address == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", e.address)
+	if err != nil {
+		return fmt.Errorf("failed to listen for the %s: %w", e.name, err)
+	}
+	e.server = &http.Server{
+		Handler:           e.handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("Stopped serving the %s: %v\n", e.name, err)
+		}
+	}(e.server)
+	fmt.Printf("Serving the %s on %s\n", e.name, listener.Addr())
+	return nil
+}
+
+// shutdown stops the endpoint once its requests are answered or ctx is done
+func (e *httpEndpoint) shutdown(ctx context.Context) error {
+	if e.server == nil {
+		return nil
+	}
+	return e.server.Shutdown(ctx)
+}
+
+// close stops the endpoint right away
+func (e *httpEndpoint) close() {
+	if e.server != nil {
+		_ = e.server.Close()
+	}
+}
+
+// policyTarget enforces the quota policies and roles that are reloaded
+type policyTarget interface {
+	ReloadPolicies(policies []domain.QuotaPolicy) error
+	SetRoles(roles map[string][]string) error
+}
+
+// reloadPolicies reloads the configuration and applies its quota policies and roles,
+// along with those of the policy sources. Other settings need a restart. An invalid
+// configuration leaves the current policies active.
+func reloadPolicies(ctx context.Context, target policyTarget, load func() (*config.Config, error), sources []policySource) {
+	cfg, err := load()
+	if err != nil {
+		fmt.Printf("Keeping current quota policies: %v\n", err)
+		return
+	}
+	policies, err := quotaPolicies(ctx, cfg, sources)
+	if err != nil {
+		fmt.Printf("Keeping current quota policies: %v\n", err)
+		return
+	}
+	roles, err := quotaRoles(ctx, cfg, sources)
+	if err != nil {
+		fmt.Printf("Keeping current quota policies: %v\n", err)
+		return
+	}
+	if err := target.ReloadPolicies(policies); err != nil {
+		fmt.Printf("Keeping current quota policies: %v\n", err)
+		return
+	}
+	if err := target.SetRoles(roles); err != nil {
+		fmt.Printf("Keeping current roles: %v\n", err)
+		return
+	}
+	for _, source := range sources {
+		if source.applied != nil {
+			source.applied(ctx)
+		}
+	}
+	fmt.Println("Quota policies reloaded")
+}
+
+// quotaRoles returns the users of the configured roles along with the members the
+// policy sources define for them
+func quotaRoles(ctx context.Context, cfg *config.Config, sources []policySource) (map[string][]string, error) {
+	roles := cfg.QuotaRoles()
+	for _, source := range sources {
+		stored, err := source.store.LoadRoles(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for role, users := range stored {
+			roles[role] = append(roles[role], users...)
+		}
+	}
+	return roles, nil
+}
+
+// quotaPolicies returns the configured quota policies followed by those defined in
+// the policy sources. A name may only be used once across all of them.
+func quotaPolicies(ctx context.Context, cfg *config.Config, sources []policySource) ([]domain.QuotaPolicy, error) {
+	policies := cfg.QuotaPolicies()
+	definedIn := make(map[string]string, len(policies))
+	for _, policy := range policies {
+		definedIn[policy.Name] = "the configuration"
+	}
+
+	for _, source := range sources {
+		stored, err := source.store.LoadPolicies(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, policy := range stored {
+			if first, ok := definedIn[policy.Name]; ok {
+				return nil, fmt.Errorf("quota policy %q is defined in both %s and %s", policy.Name, first, source.name)
+			}
+			definedIn[policy.Name] = source.name
+		}
+		policies = append(policies, stored...)
+	}
+	return policies, nil
+}
+
+// NewSimulateCommand creates the simulate command
+func NewSimulateCommand() *cobra.Command {
+	var policyFile string
+	var captureFile string
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "simulate",
+		Short: "Evaluate proposed quota policies against a recorded capture",
+		Long: `Replay a query capture through the quota engine without enforcing anything
+and report, per user and database, which queries the proposed policies
+would have denied. Use it to tune limits before turning enforcement on.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runSimulate(cmd.OutOrStdout(), policyFile, captureFile, jsonOutput)
+		},
+	}
+
+	cmd.Flags().StringVar(&policyFile, "policies", "", "Policy file to evaluate")
+	cmd.Flags().StringVar(&captureFile, "capture", "", "Capture file recorded with --capture-file")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+	_ = cmd.MarkFlagRequired("policies")
+	_ = cmd.MarkFlagRequired("capture")
+
+	return cmd
+}
+
+// runSimulate evaluates the policy file against the capture and prints the report
+func runSimulate(out io.Writer, policyFile, captureFile string, jsonOutput bool) error {
+	policies, err := adapters.LoadPolicyFile(policyFile)
+	if err != nil {
+		return err
+	}
+
+	simulation, err := app.NewSimulationService(policies)
+	if err != nil {
+		return fmt.Errorf("invalid policies: %w", err)
+	}
+
+	f, err := os.Open(captureFile)
+	if err != nil {
+		return fmt.Errorf("failed to open capture file: %w", err)
+	}
+	defer f.Close()
+
+	source, err := adapters.NewCaptureReader(f)
+	if err != nil {
+		return err
+	}
+
+	report, err := simulation.Run(context.Background(), source)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	fmt.Fprintf(out, "%d queries evaluated, %d would have been denied\n\n", report.Queries, report.Denied)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tDATABASE\tQUERIES\tDENIED\tFIRST DENIED\tPOLICIES")
+	for _, tenant := range report.Tenants {
+		firstDenied := "-"
+		if tenant.FirstDeniedAt != nil {
+			firstDenied = tenant.FirstDeniedAt.Format(time.RFC3339)
+		}
+
+		policyNames := make([]string, 0, len(tenant.DeniedByPolicy))
+		for name, count := range tenant.DeniedByPolicy {
+			policyNames = append(policyNames, fmt.Sprintf("%s=%d", name, count))
+		}
+		sort.Strings(policyNames)
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n",
+			orDash(tenant.User), orDash(tenant.Database), tenant.Queries, tenant.Denied,
+			firstDenied, orDash(strings.Join(policyNames, ",")))
+	}
+	return w.Flush()
+}
+
+// orDash renders empty values as "-" in tables
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
 // NewRootCommand creates the root command
 func NewRootCommand() *cobra.Command {
 	cmd := &cobra.Command{
@@ -81,8 +712,24 @@ func NewRootCommand() *cobra.Command {
 query events to track and enforce database usage quotas.`,
 	}
 
+	cmd.PersistentFlags().String("config", "", "Configuration file (.yaml, .yml or .toml); flags set on the command line override it")
+
 	// Add subcommands
 	cmd.AddCommand(NewServerCommand())
+	cmd.AddCommand(NewSidecarCommand())
+	cmd.AddCommand(NewSimulateCommand())
+	cmd.AddCommand(NewRecordCommand())
+	cmd.AddCommand(NewReplayCommand())
+	cmd.AddCommand(NewBenchCommand())
+	cmd.AddCommand(NewQuotaCommand())
+	cmd.AddCommand(NewConfigCommand())
+	cmd.AddCommand(NewStatusCommand())
+	cmd.AddCommand(NewDrainCommand())
+	cmd.AddCommand(NewConnectionsCommand())
+	cmd.AddCommand(NewQueriesCommand())
+	cmd.AddCommand(NewFirewallCommand())
+	cmd.AddCommand(NewOperatorCommand())
+	cmd.AddCommand(NewReportCommand())
 
 	return cmd
 }
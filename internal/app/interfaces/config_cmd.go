@@ -0,0 +1,118 @@
+package interfaces
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"pgbouncer-quota-enforcer/internal/config"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// NewConfigCommand creates the config command and its subcommands
+func NewConfigCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Work with configuration files",
+	}
+
+	cmd.AddCommand(newConfigValidateCommand())
+	return cmd
+}
+
+// newConfigValidateCommand creates the config validate command
+func newConfigValidateCommand() *cobra.Command {
+	var resolve bool
+	var resolveTimeout time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "validate [file]",
+		Short: "Check a configuration file before deploying it",
+		Long: `Check a configuration file the way the server would load it: syntax, unknown
+and duplicate keys, durations and other value types, quota policies and the
+settings that depend on each other. The upstream address is resolved too,
+unless --resolve=false.
+
+Every problem is printed as file:line:column: key: message and the command
+exits with a non-zero status when there is any, so it can gate deploys in CI.`,
+		Example: `  pgbouncer-quota-enforcer config validate enforcer.yaml
+  pgbouncer-quota-enforcer --config enforcer.toml config validate --resolve=false`,
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configFile, err := cmd.Flags().GetString("config")
+			if err != nil {
+				return err
+			}
+			if len(args) > 0 {
+				configFile = args[0]
+			}
+			if configFile == "" {
+				return fmt.Errorf("no configuration file: pass one as an argument or with --config")
+			}
+			return runConfigValidate(cmd.Context(), cmd.OutOrStdout(), configFile, resolve, resolveTimeout)
+		},
+	}
+
+	cmd.Flags().BoolVar(&resolve, "resolve", true, "Resolve the upstream address")
+	cmd.Flags().DurationVar(&resolveTimeout, "resolve-timeout", 5*time.Second, "How long resolving the upstream address may take")
+
+	return cmd
+}
+
+// runConfigValidate checks the configuration file and prints its issues
+func runConfigValidate(ctx context.Context, out io.Writer, configFile string, resolve bool, resolveTimeout time.Duration) error {
+	// Settings missing from the file take the defaults of the server flags
+	issues, err := config.Check(configFile, NewServerCommand().Flags())
+	if err != nil {
+		return err
+	}
+
+	if len(issues) == 0 {
+		cfg, err := config.Load(configFile, NewServerCommand().Flags())
+		if err != nil {
+			return err
+		}
+		if cfg.Upstream.Address != "" {
+			if err := checkUpstream(ctx, cfg.Upstream.Address, resolve, resolveTimeout); err != nil {
+				issues = append(issues, config.Issue{Key: "upstream.address", Message: err.Error()})
+			}
+		}
+	}
+
+	for _, issue := range issues {
+		separator := " "
+		if issue.Line > 0 {
+			separator = ""
+		}
+		fmt.Fprintf(out, "%s:%s%s\n", configFile, separator, issue)
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("%s: %d problem(s) found", configFile, len(issues))
+	}
+	fmt.Fprintf(out, "%s: OK\n", configFile)
+	return nil
+}
+
+// checkUpstream checks that the upstream address is well formed and, when resolve
+// is set, that it resolves to at least one target
+func checkUpstream(ctx context.Context, address string, resolve bool, timeout time.Duration) error {
+	resolver, err := adapters.NewUpstreamResolver(address)
+	if err != nil || !resolve {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	targets, _, err := resolver.Resolve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", address, err)
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("%s resolves to no upstream", address)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package interfaces
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidateCommand(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.yaml")
+	require.NoError(t, os.WriteFile(valid, []byte("upstream:\n  address: 127.0.0.1:6432\npolicies:\n  - {name: default, limit: 10, window: 1h}\n"), 0o600))
+	invalid := filepath.Join(dir, "invalid.yaml")
+	require.NoError(t, os.WriteFile(invalid, []byte("policies:\n  - {name: default, limit: 10, window: 1h}\n  - {name: default, limit: 5, window: 1h}\n"), 0o600))
+	badUpstream := filepath.Join(dir, "upstream.yaml")
+	require.NoError(t, os.WriteFile(badUpstream, []byte("upstream:\n  address: ftp://db\n"), 0o600))
+
+	out, err := runCommand(t, "config", "validate", valid)
+	require.NoError(t, err)
+	assert.Equal(t, valid+": OK\n", out)
+
+	out, err = runCommand(t, "--config", invalid, "config", "validate")
+	assert.Error(t, err)
+	assert.Contains(t, out, invalid+`:3:6: policies[1].name: quota policy "default" is already defined on line 2`)
+
+	out, err = runCommand(t, "config", "validate", "--resolve=false", badUpstream)
+	assert.Error(t, err)
+	assert.Contains(t, out, badUpstream+`: upstream.address: unsupported upstream scheme "ftp"`)
+}
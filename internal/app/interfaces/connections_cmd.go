@@ -0,0 +1,114 @@
+package interfaces
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// maxListedQueryLength truncates the queries listed by connections list and bench
+const maxListedQueryLength = 60
+
+// NewConnectionsCommand creates the connections command and its subcommands
+func NewConnectionsCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "connections",
+		Short: "List and terminate the client connections of a running server",
+		Long: `List the client connections of a running server, with the query each ran
+last, and terminate a connection through the admin API.
+
+A terminated client is sent a FATAL error, as with pg_terminate_backend: the
+query it runs is cancelled and its upstream connection is closed.`,
+	}
+	addAdminFlags(cmd)
+
+	cmd.AddCommand(newConnectionsListCommand())
+	cmd.AddCommand(newConnectionsTerminateCommand())
+	return cmd
+}
+
+// newConnectionsListCommand creates the connections list command
+func newConnectionsListCommand() *cobra.Command {
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the open client connections",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newAdminClient(cmd)
+			if err != nil {
+				return err
+			}
+			var connections []adminConnection
+			if err := client.do(cmd.Context(), http.MethodGet, "/api/v1/connections", nil, nil, &connections); err != nil {
+				return err
+			}
+			return printConnections(cmd.OutOrStdout(), connections, jsonOutput)
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the connections as JSON")
+	return cmd
+}
+
+// newConnectionsTerminateCommand creates the connections terminate command
+func newConnectionsTerminateCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "terminate <id>",
+		Aliases: []string{"kill"},
+		Short:   "Terminate a client connection",
+		Example: `  pgbouncer-quota-enforcer connections terminate conn_42`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newAdminClient(cmd)
+			if err != nil {
+				return err
+			}
+			if err := client.do(cmd.Context(), http.MethodDelete, "/api/v1/connections/"+url.PathEscape(args[0]), nil, nil, nil); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Connection %s terminated\n", args[0])
+			return nil
+		},
+	}
+}
+
+// printConnections writes connections as a table, or as JSON
+func printConnections(out io.Writer, connections []adminConnection, jsonOutput bool) error {
+	if jsonOutput {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(connections)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSER\tDATABASE\tCLIENT\tAGE\tSTATE\tTRANSACTION\tQUERY")
+	for _, connection := range connections {
+		state := "active"
+		if connection.Idle {
+			state = "idle"
+		}
+		query := listedQuery(connection.Query)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			connection.ID, orDash(connection.User), orDash(connection.Database), orDash(connection.ClientAddr),
+			connection.Age, state, connection.Transaction, orDash(query))
+	}
+	return w.Flush()
+}
+
+// listedQuery collapses the whitespace of query and truncates it to
+// maxListedQueryLength for tables
+func listedQuery(query string) string {
+	query = strings.Join(strings.Fields(query), " ")
+	if len(query) > maxListedQueryLength {
+		query = query[:maxListedQueryLength-3] + "..."
+	}
+	return query
+}
@@ -0,0 +1,52 @@
+package interfaces
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionsCommand(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	server, err := app.NewServerService(app.ServerConfig{Address: "127.0.0.1:0", Upstream: backend.Addr()})
+	require.NoError(t, err)
+	require.NoError(t, server.Start(context.Background(), "127.0.0.1:0"))
+	defer func() {
+		require.NoError(t, server.Stop(context.Background()))
+	}()
+	admin := httptest.NewServer(NewAdminAPI(server, "secret"))
+	defer admin.Close()
+
+	flags := []string{"--admin-url", admin.URL, "--admin-token", "secret"}
+	connections := func(args ...string) (string, error) {
+		return runCommand(t, append(append([]string{"connections"}, args...), flags...)...)
+	}
+
+	client := testkit.MustDial(t, server.Address(), testkit.ClientConfig{User: "alice", Database: "app"})
+	_, err = client.Query("SELECT 1")
+	require.NoError(t, err)
+
+	out, err := connections("list")
+	require.NoError(t, err)
+	assert.Regexp(t, `ID\s+USER\s+DATABASE\s+CLIENT\s+AGE\s+STATE\s+TRANSACTION\s+QUERY`, out)
+	assert.Regexp(t, `conn_\d+\s+alice\s+app\s+127\.0\.0\.1:\d+\s+\S+\s+idle\s+idle\s+SELECT 1`, out)
+
+	connectionID := server.Connections()[0].ID
+	out, err = connections("terminate", connectionID)
+	require.NoError(t, err)
+	assert.Contains(t, out, "Connection "+connectionID+" terminated")
+
+	var serverErr *testkit.ServerError
+	require.ErrorAs(t, client.WaitClosed(time.Second), &serverErr)
+	assert.Equal(t, "57P01", serverErr.Code)
+
+	_, err = connections("terminate", "conn_missing")
+	assert.ErrorContains(t, err, "connection not found")
+}
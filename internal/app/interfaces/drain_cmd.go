@@ -0,0 +1,102 @@
+package interfaces
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// NewDrainCommand creates the drain command
+func NewDrainCommand() *cobra.Command {
+	var timeout time.Duration
+	var interval time.Duration
+	var noWait bool
+
+	cmd := &cobra.Command{
+		Use:   "drain",
+		Short: "Stop a running server from accepting connections and wait for its clients to leave",
+		Long: `Drain a running server before it is restarted: it stops accepting connections
+and closes each open one as soon as its client is outside a transaction, so
+no transaction is cut short. Connections still open after --timeout are
+closed anyway. Take the server out of its load balancer first, as new
+connections are refused while it drains.
+
+The command reports the open connections every --interval until the server
+is drained; use --no-wait to return as soon as the drain started. Draining
+again reports the progress of the drain in progress, which keeps its
+deadline. The server keeps running once drained and exits on SIGTERM.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newAdminClient(cmd)
+			if err != nil {
+				return err
+			}
+			if interval <= 0 {
+				return fmt.Errorf("the refresh interval must be positive")
+			}
+
+			var status adminDrain
+			request := adminDrainRequest{Timeout: timeout.String()}
+			if err := client.do(cmd.Context(), http.MethodPost, "/api/v1/drain", nil, request, &status); err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			fmt.Fprintf(out, "Draining %s until %s\n", client.baseURL, status.Deadline.Local().Format(time.TimeOnly))
+			if noWait {
+				fmt.Fprintf(out, "%d connections open\n", status.OpenConnections)
+				return nil
+			}
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return watchDrain(ctx, out, client, status, interval)
+		},
+	}
+
+	addAdminFlags(cmd)
+	cmd.Flags().DurationVar(&timeout, "timeout", defaultDrainTimeout, "How long clients may keep their connections before they are closed")
+	cmd.Flags().DurationVar(&interval, "interval", time.Second, "How often the progress is reported")
+	cmd.Flags().BoolVar(&noWait, "no-wait", false, "Return as soon as the drain started")
+
+	return cmd
+}
+
+// watchDrain reports the open connections whenever their number changes until the
+// server is drained or ctx is cancelled
+func watchDrain(ctx context.Context, out io.Writer, client *adminClient, status adminDrain, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	reported := -1
+	for {
+		if status.OpenConnections != reported {
+			fmt.Fprintf(out, "%s  %d connections open\n", time.Now().Format(time.TimeOnly), status.OpenConnections)
+			reported = status.OpenConnections
+		}
+		if status.Done {
+			fmt.Fprintln(out, "Server drained")
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if err := client.do(ctx, http.MethodGet, "/api/v1/drain", nil, nil, &status); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
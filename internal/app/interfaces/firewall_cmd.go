@@ -0,0 +1,100 @@
+package interfaces
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// NewFirewallCommand creates the firewall command and its subcommands
+func NewFirewallCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "firewall",
+		Short: "Review and reset the queries the SQL firewall learned",
+		Long: `List the query fingerprints the SQL firewall of a running server learned for
+each user, and make it learn the queries of a user again, through the admin API.
+
+A user is learning until its --firewall-learning-period is over, then enforced:
+the queries whose fingerprint it never ran are blocked, or alerted on with
+--firewall-action alert. Relearning a user forgets its fingerprints; in learn
+mode its queries are learned again from the next one.`,
+	}
+	addAdminFlags(cmd)
+
+	cmd.AddCommand(newFirewallListCommand())
+	cmd.AddCommand(newFirewallRelearnCommand())
+	return cmd
+}
+
+// newFirewallListCommand creates the firewall list command
+func newFirewallListCommand() *cobra.Command {
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the users the SQL firewall learned queries for",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newAdminClient(cmd)
+			if err != nil {
+				return err
+			}
+			var profiles []adminFirewallProfile
+			if err := client.do(cmd.Context(), http.MethodGet, "/api/v1/firewall", nil, nil, &profiles); err != nil {
+				return err
+			}
+			return printFirewallProfiles(cmd.OutOrStdout(), profiles, jsonOutput)
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the profiles, with their queries, as JSON")
+	return cmd
+}
+
+// newFirewallRelearnCommand creates the firewall relearn command
+func newFirewallRelearnCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "relearn <user>",
+		Short:   "Forget the queries learned for a user, to learn them again",
+		Example: `  pgbouncer-quota-enforcer firewall relearn billing`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newAdminClient(cmd)
+			if err != nil {
+				return err
+			}
+			if err := client.do(cmd.Context(), http.MethodDelete, "/api/v1/firewall/"+url.PathEscape(args[0]), nil, nil, nil); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Queries learned for %s forgotten\n", args[0])
+			return nil
+		},
+	}
+}
+
+// printFirewallProfiles writes profiles as a table, or as JSON
+func printFirewallProfiles(out io.Writer, profiles []adminFirewallProfile, jsonOutput bool) error {
+	if jsonOutput {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(profiles)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tSTATE\tLEARNED SINCE\tQUERIES")
+	for _, profile := range profiles {
+		state := "learning"
+		if profile.Enforced {
+			state = "enforced"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n",
+			profile.User, state, profile.LearnedSince.UTC().Format(time.RFC3339), len(profile.Fingerprints))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,52 @@
+package interfaces
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewallCommand(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	server, err := app.NewServerService(app.ServerConfig{
+		Address:  "127.0.0.1:0",
+		Upstream: backend.Addr(),
+		Firewall: app.FirewallConfig{Mode: app.FirewallLearn},
+	})
+	require.NoError(t, err)
+	require.NoError(t, server.Start(context.Background(), "127.0.0.1:0"))
+	defer func() {
+		require.NoError(t, server.Stop(context.Background()))
+	}()
+	admin := httptest.NewServer(NewAdminAPI(server, "secret"))
+	defer admin.Close()
+
+	flags := []string{"--admin-url", admin.URL, "--admin-token", "secret"}
+	firewall := func(args ...string) (string, error) {
+		return runCommand(t, append(append([]string{"firewall"}, args...), flags...)...)
+	}
+
+	client := testkit.MustDial(t, server.Address(), testkit.ClientConfig{User: "billing", Database: "app"})
+	for _, query := range []string{"SELECT 1", "SELECT 2", "SELECT now()"} {
+		_, err = client.Query(query)
+		require.NoError(t, err)
+	}
+	require.NoError(t, client.Close())
+
+	out, err := firewall("list")
+	require.NoError(t, err)
+	assert.Regexp(t, `USER\s+STATE\s+LEARNED SINCE\s+QUERIES`, out)
+	assert.Regexp(t, `billing\s+learning\s+\d{4}-\d\d-\d\dT\S+Z\s+2\n`, out, "Queries differing by constants should share a fingerprint")
+
+	out, err = firewall("relearn", "billing")
+	require.NoError(t, err)
+	assert.Contains(t, out, "Queries learned for billing forgotten")
+	_, err = firewall("relearn", "billing")
+	assert.ErrorContains(t, err, "firewall profile not found")
+}
@@ -0,0 +1,59 @@
+package interfaces
+
+import (
+	"net/http"
+	"pgbouncer-quota-enforcer/internal/app"
+)
+
+// healthResponse is the body of a health probe
+type healthResponse struct {
+	Status     string        `json:"status"` // ok or unavailable
+	InstanceID string        `json:"instance_id"`
+	Checks     []healthCheck `json:"checks"`
+}
+
+// healthCheck is the outcome of one check of a health probe
+type healthCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // ok or failing
+	Detail string `json:"detail,omitempty"`
+}
+
+// NewHealthAPI returns the health probes of server, meant for orchestrators such
+// as Kubernetes. They need no token since they expose no configuration.
+//
+//	GET /healthz  200 while the listener is up or draining, else 503
+//	GET /readyz   200 while the listener accepts connections and the upstream and
+//	              usage store are reachable, else 503
+func NewHealthAPI(server *app.ServerService) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, server.InstanceID(), server.Liveness())
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, server.InstanceID(), server.Readiness(r.Context()))
+	})
+	return mux
+}
+
+// writeHealth writes the outcome of a probe, with 503 when it failed
+func writeHealth(w http.ResponseWriter, instanceID string, health app.Health) {
+	response := healthResponse{
+		Status:     "ok",
+		InstanceID: instanceID,
+		Checks:     make([]healthCheck, 0, len(health.Checks)),
+	}
+	status := http.StatusOK
+	if !health.Healthy {
+		response.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+	for _, check := range health.Checks {
+		entry := healthCheck{Name: check.Name, Status: "ok", Detail: check.Detail}
+		if !check.Healthy {
+			entry.Status = "failing"
+		}
+		response.Checks = append(response.Checks, entry)
+	}
+	writeJSON(w, status, response)
+}
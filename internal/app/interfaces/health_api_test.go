@@ -0,0 +1,105 @@
+package interfaces
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// pingingUsageStore is a usage store whose connectivity is set by the test
+type pingingUsageStore struct {
+	*mocks.UsageStore
+	err error
+}
+
+func (s *pingingUsageStore) Ping(ctx context.Context) error {
+	return s.err
+}
+
+// probe sends an unauthenticated request to a health probe and decodes its body
+func probe(t *testing.T, api http.Handler, target string) (int, healthResponse) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+
+	var response healthResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	return recorder.Code, response
+}
+
+// checkStatuses maps the checks of a probe to their status
+func checkStatuses(response healthResponse) map[string]string {
+	statuses := make(map[string]string, len(response.Checks))
+	for _, check := range response.Checks {
+		statuses[check.Name] = check.Status
+	}
+	return statuses
+}
+
+func TestHealthAPI_Probes(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer upstream.Close()
+	unreachable, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, unreachable.Close())
+
+	resolver := &mocks.UpstreamResolver{}
+	resolver.On("Resolve", mock.Anything).Return([]domain.UpstreamTarget{
+		{Address: upstream.Addr().String()},
+		{Address: unreachable.Addr().String()},
+	}, time.Hour, nil)
+	store := &pingingUsageStore{UsageStore: &mocks.UsageStore{}}
+
+	server, err := app.NewServerService(app.ServerConfig{Address: "127.0.0.1:0"},
+		app.WithUpstreamResolver(resolver), app.WithUsageStore(store))
+	require.NoError(t, err)
+	api := NewHealthAPI(server)
+
+	code, response := probe(t, api, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code, "The server is not listening yet")
+	assert.Equal(t, "unavailable", response.Status)
+
+	require.NoError(t, server.Start(context.Background(), "127.0.0.1:0"))
+	<-server.Started()
+	defer func() {
+		require.NoError(t, server.Stop(context.Background()))
+	}()
+
+	code, response = probe(t, api, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, server.InstanceID(), response.InstanceID)
+	assert.Equal(t, map[string]string{"listener": "ok"}, checkStatuses(response), "Liveness does not depend on the upstream")
+
+	code, response = probe(t, api, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]string{"listener": "ok", "upstream": "ok", "usage_store": "ok"}, checkStatuses(response))
+	assert.Contains(t, response.Checks[1].Detail, "1 of 2 targets reachable", "One reachable target is enough")
+
+	store.err = errors.New("connection refused")
+	code, response = probe(t, api, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "failing", checkStatuses(response)["usage_store"])
+	store.err = nil
+
+	// A draining server is still live but takes no traffic
+	server.Drain(time.Minute)
+	code, _ = probe(t, api, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	code, response = probe(t, api, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "failing", checkStatuses(response)["listener"])
+}
@@ -0,0 +1,92 @@
+package interfaces
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/internal/config"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// NewOperatorCommand creates the operator command
+func NewOperatorCommand() *cobra.Command {
+	var kubeconfig string
+	var resync time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "operator",
+		Short: "Sync QuotaPolicy resources of a Kubernetes cluster into etcd",
+		Long: `Manage quota policies through GitOps: the QuotaPolicy custom resources of the
+cluster, defined by deploy/kubernetes/quotapolicies.yaml, are written to the
+etcd cluster the enforcers read and watch their quota policies from. The spec
+of a resource is the policy file format in camel case, and the policy is
+named after the resource.
+
+Policies are synced whenever a resource changes and every --resync-interval.
+The operator only overwrites and deletes the policies it wrote: a resource
+named after a policy written to etcd by other means is not synced. The status
+of each resource tells whether its policy is in force, and why not.
+
+The operator runs in the cluster with the service account of its pod, which
+must be allowed to list and watch QuotaPolicies and update their status; use
+--kubeconfig to run it elsewhere. Run a single replica.`,
+		Example:      `  pgbouncer-quota-enforcer operator --etcd-endpoints etcd-0.internal:2379,etcd-1.internal:2379`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configFile, err := cmd.Flags().GetString("config")
+			if err != nil {
+				return err
+			}
+			cfg, err := config.Load(configFile, cmd.Flags())
+			if err != nil {
+				return err
+			}
+			return runOperator(cfg, kubeconfig, resync)
+		},
+	}
+
+	cmd.Flags().StringSlice("etcd-endpoints", nil, "etcd endpoints, as host:port, to write quota policies to")
+	cmd.Flags().String("etcd-prefix", adapters.DefaultEtcdPrefix, "etcd key prefix of the quota policies, as read by the enforcers")
+	cmd.Flags().StringVar(&kubeconfig, "kubeconfig", "", "kubeconfig file of the cluster (default: the service account of the pod)")
+	cmd.Flags().DurationVar(&resync, "resync-interval", app.DefaultOperatorResyncInterval, "How often every resource is synced again")
+	cmd.Flags().String("log-level", "info", "Minimum severity logged: debug, info or error")
+
+	return cmd
+}
+
+// runOperator syncs the QuotaPolicy resources into the configured etcd cluster
+// until interrupted
+func runOperator(cfg *config.Config, kubeconfig string, resync time.Duration) error {
+	if len(cfg.Etcd.Endpoints) == 0 {
+		return fmt.Errorf("the operator needs the etcd endpoints of the enforcers")
+	}
+
+	log := logger.NewSimpleLogger()
+	log.SetLevel(cfg.ServerConfig().LogLevel)
+	resources, err := adapters.NewKubernetesQuotaPolicies(kubeconfig, log)
+	if err != nil {
+		return err
+	}
+	policyStore, err := openPolicyStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer closePolicyStore(policyStore)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Printf("Syncing QuotaPolicy resources into etcd at %v\n", cfg.Etcd.Endpoints)
+	fmt.Println("Press Ctrl+C to stop the operator")
+	app.NewPolicyOperator(resources, policyStore, resync, adapters.SystemClock{}, log).Run(ctx)
+	fmt.Println("\nOperator stopped")
+	return nil
+}
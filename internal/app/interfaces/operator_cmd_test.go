@@ -0,0 +1,19 @@
+package interfaces
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOperatorCommand(t *testing.T) {
+	_, err := runCommand(t, "operator")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "etcd endpoints")
+
+	_, err = runCommand(t, "operator", "--etcd-endpoints", "127.0.0.1:2379",
+		"--kubeconfig", filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err, "A missing kubeconfig should be rejected before syncing")
+}
@@ -0,0 +1,76 @@
+package interfaces
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// NewQueriesCommand creates the queries command
+func NewQueriesCommand() *cobra.Command {
+	var order string
+	var limit int
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "queries",
+		Short: "Show the top queries of a running server, like pg_stat_statements",
+		Long: `Show what the statements of each query fingerprint consumed since a running
+server started: how many ran, their total, mean and 95th percentile duration
+upstream, the rows they returned and an example of their normalized text. This
+is the proxy's own pg_stat_statements, read through the admin API.
+
+Durations are in milliseconds. The 95th percentile is that of the latest calls
+of the fingerprint. Servers with a PostgreSQL or SQLite usage store also add
+the statistics to its query_stats table every --query-stats-flush-interval.`,
+		Example: `  pgbouncer-quota-enforcer queries
+  pgbouncer-quota-enforcer queries --sort p95 --limit 5`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newAdminClient(cmd)
+			if err != nil {
+				return err
+			}
+			query := url.Values{"sort": {order}}
+			if limit > 0 {
+				query.Set("limit", strconv.Itoa(limit))
+			}
+			var stats []adminQueryStats
+			if err := client.do(cmd.Context(), http.MethodGet, "/api/v1/queries", query, nil, &stats); err != nil {
+				return err
+			}
+			return printQueryStats(cmd.OutOrStdout(), stats, jsonOutput)
+		},
+	}
+
+	addAdminFlags(cmd)
+	cmd.Flags().StringVar(&order, "sort", "total", "Order of the queries, largest first: total, mean, p95, calls, rows or bytes")
+	cmd.Flags().IntVar(&limit, "limit", 20, "Queries shown at most (0 shows them all)")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the statistics as JSON")
+	return cmd
+}
+
+// printQueryStats writes stats as a table, or as JSON
+func printQueryStats(out io.Writer, stats []adminQueryStats, jsonOutput bool) error {
+	if jsonOutput {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CALLS\tTOTAL MS\tMEAN MS\tP95 MS\tROWS\tHASH\tQUERY")
+	for _, entry := range stats {
+		fmt.Fprintf(w, "%d\t%.2f\t%.2f\t%.2f\t%d\t%s\t%s\n",
+			entry.Calls, entry.TotalTimeMs, entry.MeanTimeMs, entry.P95TimeMs, entry.Rows,
+			entry.Hash, orDash(listedQuery(entry.Query)))
+	}
+	return w.Flush()
+}
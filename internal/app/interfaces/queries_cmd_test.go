@@ -0,0 +1,53 @@
+package interfaces
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueriesCommand(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	server, err := app.NewServerService(app.ServerConfig{Address: "127.0.0.1:0", Upstream: backend.Addr()})
+	require.NoError(t, err)
+	require.NoError(t, server.Start(context.Background(), "127.0.0.1:0"))
+	defer func() {
+		require.NoError(t, server.Stop(context.Background()))
+	}()
+	api := NewAdminAPI(server, "secret")
+	admin := httptest.NewServer(api)
+	defer admin.Close()
+
+	client := testkit.MustDial(t, server.Address(), testkit.ClientConfig{User: "alice", Database: "app"})
+	defer client.Close()
+	for _, query := range []string{"SELECT 1", "SELECT 2", "SELECT now()"} {
+		_, err = client.Query(query)
+		require.NoError(t, err)
+	}
+
+	out, err := runCommand(t, "queries", "--admin-url", admin.URL, "--admin-token", "secret", "--sort", "calls")
+	require.NoError(t, err)
+	assert.Regexp(t, `CALLS\s+TOTAL MS\s+MEAN MS\s+P95 MS\s+ROWS\s+HASH\s+QUERY`, out)
+	assert.Regexp(t, `(?m)^2\s+[\d.]+\s+[\d.]+\s+[\d.]+\s+\d+\s+\S+\s+SELECT \$1$`, out, "Queries differing by constants should share a fingerprint")
+	assert.Regexp(t, `(?m)^1\s+.*SELECT now\(\)$`, out)
+
+	var stats []adminQueryStats
+	recorder := adminRequest(t, api, http.MethodGet, "/api/v1/queries?sort=calls&limit=1", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &stats))
+	require.Len(t, stats, 1)
+	assert.Equal(t, int64(2), stats[0].Calls)
+	assert.Positive(t, stats[0].TotalTimeMs)
+	assert.False(t, stats[0].LastSeen.IsZero())
+
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, api, http.MethodGet, "/api/v1/queries?sort=name", "").Code)
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, api, http.MethodGet, "/api/v1/queries?limit=-1", "").Code)
+}
@@ -0,0 +1,576 @@
+package interfaces
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// limitPeriods are the named windows accepted in a limit such as 1000/hour
+var limitPeriods = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+}
+
+// NewQuotaCommand creates the quota command and its subcommands
+func NewQuotaCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "quota",
+		Short: "Manage the quota policies of a running server",
+		Long: `Add, list and remove the quota policies of a running server, explain which
+apply to a query and reset the usage of its principals through the admin API.
+
+Changes take effect immediately and last until the policies are reloaded
+from the configuration file, so persist them there as well.`,
+	}
+	addAdminFlags(cmd)
+
+	cmd.AddCommand(newQuotaAddCommand())
+	cmd.AddCommand(newQuotaListCommand())
+	cmd.AddCommand(newQuotaRemoveCommand())
+	cmd.AddCommand(newQuotaResetCommand())
+	cmd.AddCommand(newQuotaExplainCommand())
+	return cmd
+}
+
+// newQuotaAddCommand creates the quota add command
+func newQuotaAddCommand() *cobra.Command {
+	var policy adminPolicy
+	var limit string
+	var labels []string
+	var statements []string
+	var replace bool
+
+	cmd := &cobra.Command{
+		Use:   "add",
+		Short: "Add a quota policy",
+		Example: `  pgbouncer-quota-enforcer quota add --user alice --limit 1000/hour
+  pgbouncer-quota-enforcer quota add --user alice --limit 1000/day --warn-at 90 --grace 15m
+  pgbouncer-quota-enforcer quota add --database app --limit 100000/day --soft
+  pgbouncer-quota-enforcer quota add --name tenant-hourly --user app --limit 1000/hour --per-label tenant_id
+  pgbouncer-quota-enforcer quota add --name reporting --database reporting --dimension rows --limit 1000000/day
+  pgbouncer-quota-enforcer quota add --user batch --rate 20 --burst 50 --rate-per connection
+  pgbouncer-quota-enforcer quota add --database app --rate 200 --tighten-at 80 --tighten-to 50
+  pgbouncer-quota-enforcer quota add --database reporting --max-connections 20
+  pgbouncer-quota-enforcer quota add --user tenant --max-concurrent-queries 4 --queue-timeout 5s
+  pgbouncer-quota-enforcer quota add --user analyst --statement-timeout 30s
+  pgbouncer-quota-enforcer quota add --user tenant --max-result-rows 100000 --max-result-bytes 67108864
+  pgbouncer-quota-enforcer quota add --user app --max-transaction-duration 5m --max-transaction-statements 1000
+  pgbouncer-quota-enforcer quota add --name events-reads --table analytics.events --statements read --limit 100/hour
+  pgbouncer-quota-enforcer quota add --name audit-readonly --table 'audit.*' --statements write --deny
+  pgbouncer-quota-enforcer quota add --name writes --user tenant --statements write --limit 10000/day
+  pgbouncer-quota-enforcer quota add --name ddl --statements ddl --deny --allow-during 'Sat 02:00-04:00'
+  pgbouncer-quota-enforcer quota add --name no-full-scans --pattern '(?i)^select \* from huge_table$' --deny --hint 'filter by created_at'
+  pgbouncer-quota-enforcer quota add --name health-checks --fingerprint 50fde20626009aba --allow
+  pgbouncer-quota-enforcer quota add --name analytics --listener analytics --limit 100/hour
+  pgbouncer-quota-enforcer quota add --name analysts --role analysts --limit 5000/hour --override
+  pgbouncer-quota-enforcer quota add --user alice --limit 2000/hour --replace`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			if limit == "" && policy.Rate == 0 && policy.MaxConnections == 0 && policy.MaxConcurrentQueries == 0 && policy.StatementTimeout == "" &&
+				policy.MaxResultRows == 0 && policy.MaxResultBytes == 0 && policy.MaxTransactionDuration == "" && policy.MaxTransactionStatements == 0 &&
+				!policy.Deny && !policy.Allow {
+				return fmt.Errorf("--limit, --rate, --max-connections, --max-concurrent-queries, --statement-timeout, --max-result-rows, --max-result-bytes, " +
+					"--max-transaction-duration, --max-transaction-statements, --deny or --allow is required")
+			}
+			if limit != "" {
+				if policy.Limit, policy.Window, err = parseLimit(limit); err != nil {
+					return err
+				}
+			}
+			if policy.Labels, err = parseLabels(labels); err != nil {
+				return err
+			}
+			for _, class := range statements {
+				policy.Statements = append(policy.Statements, domain.StatementClass(class))
+			}
+			if policy.Name == "" {
+				policy.Name = defaultPolicyName(policy.User, policy.Database)
+				if policy.Name == "" {
+					return fmt.Errorf("--name is required when neither --user nor --database is given")
+				}
+			}
+
+			client, err := newAdminClient(cmd)
+			if err != nil {
+				return err
+			}
+			method, path := http.MethodPost, "/api/v1/quotas"
+			if replace {
+				method, path = http.MethodPut, "/api/v1/quotas/"+url.PathEscape(policy.Name)
+			}
+			var added adminPolicy
+			if err := client.do(cmd.Context(), method, path, nil, policy, &added); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Quota policy %s set to %s\n", added.Name, describePolicyLimits(added))
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&policy.Name, "name", "", "Policy name (default: the user and database joined by -)")
+	cmd.Flags().StringVar(&policy.User, "user", "", "User the policy applies to (default: every user)")
+	cmd.Flags().StringVar(&policy.Role, "role", "", "Role whose members the policy applies to (default: every user)")
+	cmd.Flags().StringVar(&policy.Database, "database", "", "Database the policy applies to (default: every database)")
+	cmd.Flags().StringSliceVar(&labels, "label", nil, "Connection label the policy requires, as key=value; may be repeated")
+	cmd.Flags().StringVar(&policy.Listener, "listener", "", "Listener whose connections the policy applies to (default: every listener)")
+	cmd.Flags().StringVar(&policy.Dimension, "dimension", "", "What the policy limits: queries, cost, bytes, rows or seconds (default: queries)")
+	cmd.Flags().StringVar(&limit, "limit", "", "Limit and window, e.g. 1000/hour, 50/minute or 500/15m")
+	cmd.Flags().StringVar(&policy.PerLabel, "per-label", "", "Connection label whose values each get the whole limit, e.g. tenant_id")
+	cmd.Flags().IntVar(&policy.WarnAt, "warn-at", 0, "Percentage of the limit from which queries carry a warning notice")
+	cmd.Flags().BoolVar(&policy.Soft, "soft", false, "Allow queries beyond the limit with a warning notice instead of denying them")
+	cmd.Flags().StringVar(&policy.Grace, "grace", "", "How long queries beyond the limit are allowed with a warning notice before they are denied, e.g. 15m")
+	cmd.Flags().Float64Var(&policy.Rate, "rate", 0, "Queries per second beyond which queries are delayed")
+	cmd.Flags().Int64Var(&policy.Burst, "burst", 0, "Queries that may run back to back before the rate applies (default: one second's worth)")
+	cmd.Flags().Int64Var(&policy.Credits, "credits", 0, "Most credits a user accrues while below the rate, spent on queries beyond the burst")
+	cmd.Flags().Float64Var(&policy.CreditRate, "credit-rate", 0, "Credits earned per second while below the rate (default: the rate)")
+	cmd.Flags().StringVar(&policy.RatePer, "rate-per", "", "Whose queries share the rate: user or connection (default: user)")
+	cmd.Flags().IntVar(&policy.TightenAt, "tighten-at", 0, "Saturation percentage of the upstream PgBouncer pool from which the limit and rate are tightened")
+	cmd.Flags().IntVar(&policy.TightenTo, "tighten-to", 0, "Percentage of the limit and rate left while the pool is saturated beyond --tighten-at")
+	cmd.Flags().Int64Var(&policy.MaxConnections, "max-connections", 0, "Concurrent connections each user and database pair may open")
+	cmd.Flags().Int64Var(&policy.MaxConcurrentQueries, "max-concurrent-queries", 0, "Statements each user and database pair may run at once")
+	cmd.Flags().StringVar(&policy.QueueTimeout, "queue-timeout", "", "How long statements beyond --max-concurrent-queries wait for another to end before they are denied, e.g. 5s (default: deny them at once)")
+	cmd.Flags().StringVar(&policy.StatementTimeout, "statement-timeout", "", "How long the queries the policy applies to may run before they are cancelled, e.g. 30s")
+	cmd.Flags().Int64Var(&policy.MaxResultRows, "max-result-rows", 0, "Rows the queries the policy applies to may return before they are cut off")
+	cmd.Flags().Int64Var(&policy.MaxResultBytes, "max-result-bytes", 0, "Bytes of rows the queries the policy applies to may return before they are cut off")
+	cmd.Flags().StringVar(&policy.MaxTransactionDuration, "max-transaction-duration", "", "How long a transaction may stay open before its connection is closed, e.g. 5m")
+	cmd.Flags().Int64Var(&policy.MaxTransactionStatements, "max-transaction-statements", 0, "Statements a transaction may run before its connection is closed")
+	cmd.Flags().StringSliceVar(&policy.Tables, "table", nil, "Table the policy applies to, as name, schema.name or schema.*; may be repeated")
+	cmd.Flags().StringSliceVar(&statements, "statements", nil, "Statements the policy applies to: read, write, select, insert, update, delete or ddl (default: every statement)")
+	cmd.Flags().BoolVar(&policy.Deny, "deny", false, "Reject the queries the policy applies to")
+	cmd.Flags().StringArrayVar(&policy.AllowDuring, "allow-during", nil, "Recurring window lifting --deny, e.g. 'Sat 02:00-04:00' or 'Mon-Fri 22:00-06:00 Europe/Paris'; may be repeated")
+	cmd.Flags().StringArrayVar(&policy.ActiveDuring, "active-during", nil, "Recurring window outside which the policy does not apply, e.g. 'Mon-Fri 09:00-18:00 Europe/Paris'; may be repeated")
+	cmd.Flags().StringSliceVar(&policy.Fingerprints, "fingerprint", nil, "Query hash the policy applies to, as logged in query_hash; may be repeated")
+	cmd.Flags().StringArrayVar(&policy.Patterns, "pattern", nil, "Regular expression matching the normalized queries the policy applies to; may be repeated")
+	cmd.Flags().BoolVar(&policy.Allow, "allow", false, "Exempt the queries the policy applies to from every other policy")
+	cmd.Flags().StringVar(&policy.Hint, "hint", "", "Hint sent to clients along with the denials of the policy")
+	cmd.Flags().BoolVar(&policy.Override, "override", false, "Replace the same kind of limits of the less specific policies matching along with this one")
+	cmd.Flags().BoolVar(&replace, "replace", false, "Replace a policy of the same name instead of failing")
+
+	return cmd
+}
+
+// newQuotaListCommand creates the quota list command
+func newQuotaListCommand() *cobra.Command {
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the quota policies",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newAdminClient(cmd)
+			if err != nil {
+				return err
+			}
+			var policies []adminPolicy
+			if err := client.do(cmd.Context(), http.MethodGet, "/api/v1/quotas", nil, nil, &policies); err != nil {
+				return err
+			}
+			return printPolicies(cmd.OutOrStdout(), policies, jsonOutput)
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the policies as JSON")
+	return cmd
+}
+
+// newQuotaRemoveCommand creates the quota remove command
+func newQuotaRemoveCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "remove <name>",
+		Aliases: []string{"rm"},
+		Short:   "Remove a quota policy",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newAdminClient(cmd)
+			if err != nil {
+				return err
+			}
+			if err := client.do(cmd.Context(), http.MethodDelete, "/api/v1/quotas/"+url.PathEscape(args[0]), nil, nil, nil); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Quota policy %s removed\n", args[0])
+			return nil
+		},
+	}
+}
+
+// newQuotaResetCommand creates the quota reset command
+func newQuotaResetCommand() *cobra.Command {
+	var user, database, label, policy string
+
+	cmd := &cobra.Command{
+		Use:   "reset",
+		Short: "Reset the usage of a user and database",
+		Example: `  pgbouncer-quota-enforcer quota reset --user alice --database app
+  pgbouncer-quota-enforcer quota reset --user alice --database app --policy alice-hourly
+  pgbouncer-quota-enforcer quota reset --user app --label tenant-42 --policy tenant-hourly`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newAdminClient(cmd)
+			if err != nil {
+				return err
+			}
+
+			query := url.Values{"user": {user}}
+			if database != "" {
+				query.Set("database", database)
+			}
+			if label != "" {
+				query.Set("label", label)
+			}
+			if policy != "" {
+				query.Set("policy", policy)
+			}
+			if err := client.do(cmd.Context(), http.MethodDelete, "/api/v1/usage", query, nil, nil); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Quota usage of %s reset\n", user)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&user, "user", "", "User whose usage is reset")
+	cmd.Flags().StringVar(&database, "database", "", "Database whose usage is reset (default: the user's name)")
+	cmd.Flags().StringVar(&label, "label", "", "Label value whose usage is reset under the policies counted per label")
+	cmd.Flags().StringVar(&policy, "policy", "", "Only reset the usage counted under this policy")
+	_ = cmd.MarkFlagRequired("user")
+
+	return cmd
+}
+
+// newQuotaExplainCommand creates the quota explain command
+func newQuotaExplainCommand() *cobra.Command {
+	var request adminExplainRequest
+	var labels []string
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "explain",
+		Short: "Explain which quota policies apply to a query",
+		Long: `List the quota policies matching a user and database, from the most specific,
+and tell whether each applies to the query and why.`,
+		Example: `  pgbouncer-quota-enforcer quota explain --user alice --database app --query 'SELECT * FROM orders'
+  pgbouncer-quota-enforcer quota explain --user alice --label team=billing --query 'DELETE FROM audit.events'`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			if request.Labels, err = parseLabels(labels); err != nil {
+				return err
+			}
+			client, err := newAdminClient(cmd)
+			if err != nil {
+				return err
+			}
+			var explanations []adminExplanation
+			if err := client.do(cmd.Context(), http.MethodPost, "/api/v1/explain", nil, request, &explanations); err != nil {
+				return err
+			}
+			return printExplanations(cmd.OutOrStdout(), explanations, jsonOutput)
+		},
+	}
+
+	cmd.Flags().StringVar(&request.User, "user", "", "User running the query")
+	cmd.Flags().StringVar(&request.Database, "database", "", "Database of the query (default: the user's name)")
+	cmd.Flags().StringVar(&request.Listener, "listener", "", "Listener accepting the connection (default: the main listener)")
+	cmd.Flags().StringSliceVar(&labels, "label", nil, "Connection label, as key=value; may be repeated")
+	cmd.Flags().StringVar(&request.Query, "query", "", "Query to explain")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the explanations as JSON")
+	_ = cmd.MarkFlagRequired("user")
+
+	return cmd
+}
+
+// printExplanations prints which policies apply to a query as a table or as JSON
+func printExplanations(out io.Writer, explanations []adminExplanation, jsonOutput bool) error {
+	if jsonOutput {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(explanations)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "POLICY\tAPPLIES\tLIMITS\tREASON")
+	for _, explanation := range explanations {
+		applies := "no"
+		if explanation.Applies {
+			applies = "yes"
+		}
+		reason := explanation.Reason
+		if explanation.Applies && explanation.ReplacedBy != "" {
+			reason += fmt.Sprintf(" (partly replaced by override %q)", explanation.ReplacedBy)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", explanation.Policy.Name, applies, orDash(describePolicyLimits(explanation.Policy)), reason)
+	}
+	return w.Flush()
+}
+
+// printPolicies prints the policies as a table or as JSON
+func printPolicies(out io.Writer, policies []adminPolicy, jsonOutput bool) error {
+	if jsonOutput {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(policies)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tUSER\tDATABASE\tLABELS\tSCOPE\tLIMIT\tWINDOW\tRATE\tCONNECTIONS\tCONCURRENT\tTIMEOUT\tRESULT")
+	for _, policy := range policies {
+		labels := make([]string, 0, len(policy.Labels))
+		for key, value := range policy.Labels {
+			labels = append(labels, key+"="+value)
+		}
+		sort.Strings(labels)
+
+		limit := "-"
+		if policy.Allow {
+			limit = "allow"
+		} else if policy.Deny {
+			limit = "deny"
+		} else if policy.Limit > 0 {
+			limit = fmt.Sprintf("%d %s", policy.Limit, domain.QuotaDimension(policy.Dimension).Unit())
+		}
+		rate := "-"
+		if policy.Rate > 0 {
+			rate = describeRate(policy)
+		}
+		connections := "-"
+		if policy.MaxConnections > 0 {
+			connections = strconv.FormatInt(policy.MaxConnections, 10)
+		}
+		concurrent := "-"
+		if policy.MaxConcurrentQueries > 0 {
+			concurrent = strconv.FormatInt(policy.MaxConcurrentQueries, 10)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			policy.Name, orDash(policy.User), orDash(policy.Database), orDash(strings.Join(labels, ",")),
+			orDash(describePolicyScope(policy)), limit, orDash(policy.Window), rate, connections, concurrent, orDash(policy.StatementTimeout),
+			orDash(describeResultCap(policy)))
+	}
+	return w.Flush()
+}
+
+// describeResultCap describes the result caps of a policy, e.g. 10000 rows or
+// 1048576 bytes, or nothing when it has none
+func describeResultCap(policy adminPolicy) string {
+	var caps []string
+	if policy.MaxResultRows > 0 {
+		caps = append(caps, fmt.Sprintf("%d rows", policy.MaxResultRows))
+	}
+	if policy.MaxResultBytes > 0 {
+		caps = append(caps, fmt.Sprintf("%d bytes", policy.MaxResultBytes))
+	}
+	return strings.Join(caps, " or ")
+}
+
+// describePolicyLimits describes the limit and the rate of a policy, and the
+// statements it applies to when it is scoped
+func describePolicyLimits(policy adminPolicy) string {
+	var limits []string
+	if policy.Allow {
+		limits = append(limits, "allow")
+	}
+	if policy.Deny {
+		limits = append(limits, "deny")
+	}
+	if policy.Limit > 0 {
+		limit := fmt.Sprintf("%d %s per %s", policy.Limit, domain.QuotaDimension(policy.Dimension).Unit(), policy.Window)
+		if policy.Soft {
+			limit = "soft " + limit
+		} else if policy.Grace != "" {
+			limit += fmt.Sprintf(" with %s of grace", policy.Grace)
+		}
+		if policy.WarnAt > 0 {
+			limit += fmt.Sprintf(" warning at %d%%", policy.WarnAt)
+		}
+		if policy.PerLabel != "" {
+			limit += fmt.Sprintf(" per %s", policy.PerLabel)
+		}
+		limits = append(limits, limit)
+	}
+	if policy.Rate > 0 {
+		limits = append(limits, describeRate(policy))
+	}
+	if policy.MaxConnections > 0 {
+		limits = append(limits, fmt.Sprintf("%d connections", policy.MaxConnections))
+	}
+	if policy.MaxConcurrentQueries > 0 {
+		concurrent := fmt.Sprintf("%d concurrent queries", policy.MaxConcurrentQueries)
+		if policy.QueueTimeout != "" {
+			concurrent += fmt.Sprintf(" queued for up to %s", policy.QueueTimeout)
+		}
+		limits = append(limits, concurrent)
+	}
+	if policy.StatementTimeout != "" {
+		limits = append(limits, fmt.Sprintf("statements of up to %s", policy.StatementTimeout))
+	}
+	if result := describeResultCap(policy); result != "" {
+		limits = append(limits, "results of up to "+result)
+	}
+	if policy.MaxTransactionDuration != "" {
+		limits = append(limits, fmt.Sprintf("transactions of up to %s", policy.MaxTransactionDuration))
+	}
+	if policy.MaxTransactionStatements > 0 {
+		limits = append(limits, fmt.Sprintf("transactions of up to %d statements", policy.MaxTransactionStatements))
+	}
+	description := strings.Join(limits, " and ")
+	if policy.TightenAt > 0 {
+		description += fmt.Sprintf(", tightened to %d%% from %d%% pool saturation", policy.TightenTo, policy.TightenAt)
+	}
+	if scope := describePolicyScope(policy); scope != "" {
+		description += " for " + scope
+	}
+	if len(policy.AllowDuring) > 0 {
+		description += " outside " + strings.Join(policy.AllowDuring, ", ")
+	}
+	if len(policy.ActiveDuring) > 0 {
+		description += " during " + strings.Join(policy.ActiveDuring, ", ")
+	}
+	if policy.Override {
+		description += ", overriding less specific policies"
+	}
+	return description
+}
+
+// describePolicyScope describes the role, queries, statements, tables and
+// listener a scoped policy applies to, e.g. write statements on audit.* via
+// listener analytics, or returns an empty string
+func describePolicyScope(policy adminPolicy) string {
+	scope := describeAccessScope(policy)
+	if policy.Role != "" {
+		if scope == "" {
+			scope = "role " + policy.Role
+		} else {
+			scope = "role " + policy.Role + " " + scope
+		}
+	}
+	if policy.Listener == "" {
+		return scope
+	}
+	if scope == "" {
+		return "listener " + policy.Listener
+	}
+	return scope + " via listener " + policy.Listener
+}
+
+// describeAccessScope describes the queries, statements and tables a scoped
+// policy applies to, e.g. write statements on audit.*, or returns an empty string
+func describeAccessScope(policy adminPolicy) string {
+	queries := describeQueryScope(policy)
+	if len(policy.Tables) == 0 && len(policy.Statements) == 0 {
+		return queries
+	}
+
+	scope := "statements"
+	if len(policy.Statements) > 0 {
+		classes := make([]string, 0, len(policy.Statements))
+		for _, class := range policy.Statements {
+			classes = append(classes, string(class))
+		}
+		scope = strings.Join(classes, "/") + " statements"
+	}
+	if len(policy.Tables) > 0 {
+		scope += " on " + strings.Join(policy.Tables, ",")
+	}
+	if queries != "" {
+		return queries + " with " + scope
+	}
+	return scope
+}
+
+// describeQueryScope describes the queries a fingerprinted policy applies to,
+// e.g. queries 50fde20626009aba or matching "^VACUUM", or returns an empty string
+func describeQueryScope(policy adminPolicy) string {
+	if len(policy.Fingerprints) == 0 && len(policy.Patterns) == 0 {
+		return ""
+	}
+
+	matches := append([]string(nil), policy.Fingerprints...)
+	for _, pattern := range policy.Patterns {
+		matches = append(matches, fmt.Sprintf("matching %q", pattern))
+	}
+	return "queries " + strings.Join(matches, " or ")
+}
+
+// describeRate describes the rate of a policy, e.g. 20/s per connection
+func describeRate(policy adminPolicy) string {
+	scope := policy.RatePer
+	if scope == "" {
+		scope = string(domain.RateScopeUser)
+	}
+	rate := strconv.FormatFloat(policy.Rate, 'f', -1, 64) + "/s"
+	if policy.Burst > 0 {
+		rate += fmt.Sprintf(" burst %d", policy.Burst)
+	}
+	rate += " per " + scope
+	if policy.Credits > 0 {
+		rate += fmt.Sprintf(" with up to %d credits", policy.Credits)
+	}
+	return rate
+}
+
+// parseLimit splits a limit such as 1000/hour into its count and window. The
+// window is a period name or a Go duration.
+func parseLimit(value string) (int64, string, error) {
+	count, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return 0, "", fmt.Errorf("invalid limit %q: use <count>/<window>, e.g. 1000/hour", value)
+	}
+
+	limit, err := strconv.ParseInt(count, 10, 64)
+	if err != nil || limit <= 0 {
+		return 0, "", fmt.Errorf("invalid limit %q: the count must be a positive integer", value)
+	}
+
+	window, ok := limitPeriods[strings.TrimSuffix(period, "s")]
+	if !ok {
+		if window, err = time.ParseDuration(period); err != nil || window <= 0 {
+			return 0, "", fmt.Errorf("invalid limit %q: the window must be second, minute, hour, day, week or a duration such as 15m", value)
+		}
+	}
+	return limit, window.String(), nil
+}
+
+// parseLabels parses key=value label selectors
+func parseLabels(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	labels := make(map[string]string, len(values))
+	for _, value := range values {
+		key, label, ok := strings.Cut(value, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid label %q: use key=value", value)
+		}
+		labels[key] = label
+	}
+	return labels, nil
+}
+
+// defaultPolicyName names a policy after the principal it applies to
+func defaultPolicyName(user, database string) string {
+	switch {
+	case user != "" && database != "":
+		return user + "-" + database
+	case user != "":
+		return user
+	default:
+		return database
+	}
+}
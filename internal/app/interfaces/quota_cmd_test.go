@@ -0,0 +1,139 @@
+package interfaces
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runCommand runs the root command with args and returns its output
+func runCommand(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	cmd := NewRootCommand()
+	cmd.SetOut(&out)
+	cmd.SetErr(&out)
+	cmd.SetArgs(args)
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+func TestQuotaCommand(t *testing.T) {
+	server, err := app.NewServerService(app.ServerConfig{
+		Address:  "127.0.0.1:0",
+		Policies: []domain.QuotaPolicy{{Name: "default", Limit: 10, Window: time.Hour}},
+	})
+	require.NoError(t, err)
+	admin := httptest.NewServer(NewAdminAPI(server, "secret"))
+	defer admin.Close()
+
+	flags := []string{"--admin-url", admin.URL, "--admin-token", "secret"}
+	quota := func(args ...string) (string, error) {
+		return runCommand(t, append(append([]string{"quota"}, args...), flags...)...)
+	}
+
+	out, err := quota("add", "--user", "alice", "--database", "app", "--label", "team=billing", "--limit", "1000/hour")
+	require.NoError(t, err)
+	assert.Contains(t, out, "Quota policy alice-app set to 1000 queries per 1h0m0s")
+
+	_, err = quota("add", "--user", "alice", "--database", "app", "--limit", "5/minute")
+	assert.ErrorContains(t, err, "already exists")
+	_, err = quota("add", "--user", "alice", "--database", "app", "--dimension", "rows", "--limit", "5/15m", "--replace")
+	require.NoError(t, err)
+	_, err = quota("add", "--user", "batch")
+	assert.ErrorContains(t, err, "--limit, --rate, --max-connections, --max-concurrent-queries, --statement-timeout, --max-result-rows, --max-result-bytes, "+
+		"--max-transaction-duration, --max-transaction-statements, --deny or --allow is required")
+	out, err = quota("add", "--user", "batch", "--rate", "2.5", "--rate-per", "connection", "--max-connections", "3")
+	require.NoError(t, err)
+	assert.Contains(t, out, "Quota policy batch set to 2.5/s per connection and 3 connections")
+	out, err = quota("add", "--user", "reporting", "--statement-timeout", "30s")
+	require.NoError(t, err)
+	assert.Contains(t, out, "Quota policy reporting set to statements of up to 30s")
+	out, err = quota("add", "--name", "audit", "--table", "audit.*", "--table", "secrets", "--statements", "write", "--deny")
+	require.NoError(t, err)
+	assert.Contains(t, out, "Quota policy audit set to deny for write statements on audit.*,secrets")
+	_, err = quota("add", "--name", "events", "--table", "analytics.*.events", "--limit", "100/hour")
+	assert.ErrorContains(t, err, "invalid table pattern")
+	out, err = quota("add", "--name", "health", "--fingerprint", "50fde20626009aba", "--pattern", "^VACUUM, ANALYZE", "--allow")
+	require.NoError(t, err)
+	assert.Contains(t, out, `Quota policy health set to allow for queries 50fde20626009aba or matching "^VACUUM, ANALYZE"`)
+	out, err = quota("add", "--name", "analytics", "--listener", "analytics", "--statements", "read", "--limit", "100/hour")
+	require.NoError(t, err)
+	assert.Contains(t, out, "Quota policy analytics set to 100 queries per 1h0m0s for read statements via listener analytics")
+	out, err = quota("add", "--name", "analysts", "--role", "analysts", "--limit", "50/hour", "--override")
+	require.NoError(t, err)
+	assert.Contains(t, out, "Quota policy analysts set to 50 queries per 1h0m0s for role analysts, overriding less specific policies")
+	require.NoError(t, server.SetRoles(map[string][]string{"analysts": {"bob"}}))
+
+	out, err = quota("explain", "--user", "bob", "--query", "SELECT * FROM orders")
+	require.NoError(t, err)
+	assert.Regexp(t, `analysts\s+yes\s+50 queries per 1h0m0s for role analysts.*matches member bob of role analysts`, out)
+	assert.Regexp(t, `default\s+no\s+10 queries per 1h0m0s\s+limits replaced by override "analysts"`, out)
+
+	out, err = quota("list")
+	require.NoError(t, err)
+	assert.Contains(t, out, "default")
+	assert.Regexp(t, `alice-app\s+alice\s+app\s+-\s+-\s+5 rows\s+15m0s\s+-\s+-`, out)
+	assert.Regexp(t, `batch\s+batch\s+-\s+-\s+-\s+-\s+-\s+2.5/s per connection\s+3`, out)
+	assert.Regexp(t, `reporting\s+reporting\s+-\s+-\s+-\s+-\s+-\s+-\s+-\s+-\s+30s`, out)
+	assert.Regexp(t, `audit\s+-\s+-\s+-\s+write statements on audit.\*,secrets\s+deny\s+-\s+-\s+-`, out)
+	assert.Regexp(t, `health\s+-\s+-\s+-\s+queries 50fde20626009aba or matching "\^VACUUM, ANALYZE"\s+allow\s+-\s+-\s+-`, out)
+	assert.Regexp(t, `analytics\s+-\s+-\s+-\s+read statements via listener analytics\s+100 queries`, out)
+
+	_, err = quota("reset", "--user", "alice", "--database", "app")
+	require.NoError(t, err)
+	_, err = quota("reset", "--user", "alice", "--policy", "missing")
+	assert.ErrorContains(t, err, "not found")
+
+	_, err = quota("remove", "default")
+	require.NoError(t, err)
+	_, err = quota("remove", "batch")
+	require.NoError(t, err)
+	_, err = quota("remove", "reporting")
+	require.NoError(t, err)
+	_, err = quota("remove", "audit")
+	require.NoError(t, err)
+	_, err = quota("remove", "health")
+	require.NoError(t, err)
+	_, err = quota("remove", "analytics")
+	require.NoError(t, err)
+	_, err = quota("remove", "analysts")
+	require.NoError(t, err)
+	policies, err := server.Policies()
+	require.NoError(t, err)
+	assert.Equal(t, []domain.QuotaPolicy{{Name: "alice-app", User: "alice", Database: "app", Dimension: domain.QuotaDimensionRows, Limit: 5, Window: 15 * time.Minute}}, policies)
+
+	_, err = runCommand(t, "quota", "list", "--admin-url", admin.URL, "--admin-token", "wrong")
+	assert.ErrorContains(t, err, "401")
+}
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		value  string
+		limit  int64
+		window string
+	}{
+		{value: "1000/hour", limit: 1000, window: "1h0m0s"},
+		{value: "50/minutes", limit: 50, window: "1m0s"},
+		{value: "7/day", limit: 7, window: "24h0m0s"},
+		{value: "500/15m", limit: 500, window: "15m0s"},
+	}
+	for _, tt := range tests {
+		limit, window, err := parseLimit(tt.value)
+		require.NoError(t, err, tt.value)
+		assert.Equal(t, tt.limit, limit, tt.value)
+		assert.Equal(t, tt.window, window, tt.value)
+	}
+
+	for _, value := range []string{"1000", "0/hour", "-1/hour", "ten/hour", "10/fortnight", "10/-1m"} {
+		_, _, err := parseLimit(value)
+		assert.Error(t, err, value)
+	}
+}
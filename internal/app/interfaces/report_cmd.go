@@ -0,0 +1,137 @@
+package interfaces
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/internal/config"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// NewReportCommand creates the report command
+func NewReportCommand() *cobra.Command {
+	var from, to, format, output string
+
+	cmd := &cobra.Command{
+		Use:   "report",
+		Short: "Export the usage of each tenant over a period, for chargeback or showback",
+		Long: `Sum the usage kept in the usage store by tenant, a user of a database: the
+queries, rows, bytes, execution seconds and cost units charged to it over the
+period from --from to --to, and export them as CSV, JSON or Parquet.
+
+A window is counted whole in the period it ended in, so reports of adjacent
+periods never count a window twice. What a window counted is told by the
+dimension of its quota policy: the windows of policies that no longer exist
+are left out. Policies counting the same dimension overlap, such as an hourly
+and a daily limit on queries, so a tenant is charged the largest of their sums.
+
+Only the PostgreSQL and SQLite usage stores keep the windows that ended, for
+--usage-retention when replicas compact them. Replicas elected with
+--leader-election can export each report interval themselves with
+--usage-export-dir.`,
+		Example: `  pgbouncer-quota-enforcer report --config enforcer.yaml --from 2025-06-01 --to 2025-07-01
+  pgbouncer-quota-enforcer report --usage-store-file quota.db --from 2025-06-01T00:00:00Z --format parquet --output june.parquet`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			start, err := parseReportTime(from)
+			if err != nil {
+				return fmt.Errorf("invalid --from: %w", err)
+			}
+			end := time.Now()
+			if to != "" {
+				if end, err = parseReportTime(to); err != nil {
+					return fmt.Errorf("invalid --to: %w", err)
+				}
+			}
+			if err := adapters.UsageExportFormat(format).Validate(); err != nil {
+				return err
+			}
+
+			configFile, err := cmd.Flags().GetString("config")
+			if err != nil {
+				return err
+			}
+			cfg, err := config.Load(configFile, cmd.Flags())
+			if err != nil {
+				return err
+			}
+			report, err := buildReport(cmd.Context(), cfg, start, end)
+			if err != nil {
+				return err
+			}
+
+			if output == "-" {
+				return adapters.WriteUsageReport(cmd.OutOrStdout(), report, adapters.UsageExportFormat(format))
+			}
+			file, err := os.Create(output)
+			if err != nil {
+				return fmt.Errorf("failed to create the report: %w", err)
+			}
+			if err := adapters.WriteUsageReport(file, report, adapters.UsageExportFormat(format)); err != nil {
+				file.Close()
+				return err
+			}
+			if err := file.Close(); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "Wrote the usage of %d tenants to %s\n", len(report.Tenants), output)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&from, "from", "", "Start of the period, as a date (2025-06-01) or an RFC 3339 time")
+	cmd.Flags().StringVar(&to, "to", "", "End of the period, as a date or an RFC 3339 time (default: now)")
+	cmd.Flags().StringVar(&format, "format", string(adapters.UsageExportCSV), "Format of the report: csv, json or parquet")
+	cmd.Flags().StringVarP(&output, "output", "o", "-", "File the report is written to, - for the standard output")
+	cmd.Flags().String("usage-store-dsn", "", "PostgreSQL connection string of the usage store")
+	cmd.Flags().String("usage-store-file", "", "SQLite database file of the usage store")
+	cmd.Flags().StringSlice("etcd-endpoints", nil, "etcd endpoints, as host:port, to read quota policies from as well")
+	cmd.Flags().String("etcd-prefix", adapters.DefaultEtcdPrefix, "etcd key prefix of the quota policies")
+	_ = cmd.MarkFlagRequired("from")
+
+	return cmd
+}
+
+// parseReportTime parses a date, midnight UTC, or an RFC 3339 time
+func parseReportTime(value string) (time.Time, error) {
+	if date, err := time.Parse(time.DateOnly, value); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// buildReport sums the usage of the configured usage store from start to end,
+// by the dimensions of the configured quota policies
+func buildReport(ctx context.Context, cfg *config.Config, start, end time.Time) (domain.UsageReport, error) {
+	store, err := openUsageStore(ctx, cfg)
+	if err != nil {
+		return domain.UsageReport{}, err
+	}
+	if store == nil {
+		return domain.UsageReport{}, fmt.Errorf("no usage store: pass one with --usage-store-dsn or --usage-store-file")
+	}
+	defer closeUsageStore(store)
+	history, ok := store.(domain.UsageHistory)
+	if !ok {
+		return domain.UsageReport{}, fmt.Errorf("the usage store keeps no elapsed windows to report")
+	}
+
+	policyStore, err := openPolicyStore(cfg)
+	if err != nil {
+		return domain.UsageReport{}, err
+	}
+	if policyStore != nil {
+		defer closePolicyStore(policyStore)
+	}
+	policies, err := quotaPolicies(ctx, cfg, policySources(store, policyStore))
+	if err != nil {
+		return domain.UsageReport{}, err
+	}
+	return app.BuildUsageReport(ctx, history, policies, start, end)
+}
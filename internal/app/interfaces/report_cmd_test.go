@@ -0,0 +1,58 @@
+package interfaces
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportCommand(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "quota.db")
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	store, err := adapters.NewSQLiteUsageStore(ctx, file, logger.NewSimpleLogger(), adapters.WithSQLiteUsageStoreClock(clock))
+	require.NoError(t, err)
+	for _, key := range []domain.UsageKey{
+		{Policy: "hourly", User: "alice", Database: "app"},
+		{Policy: "hourly", User: "bob", Database: "app"},
+	} {
+		_, err := store.Increment(ctx, key, time.Hour, 42)
+		require.NoError(t, err)
+	}
+	require.NoError(t, store.Close())
+
+	configFile := filepath.Join(dir, "enforcer.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte("policies:\n  - name: hourly\n    limit: 1000\n    window: 1h\n"), 0o600))
+
+	out, err := runCommand(t, "report", "--config", configFile, "--usage-store-file", file, "--from", "2025-06-01", "--to", "2025-06-02")
+	require.NoError(t, err)
+	assert.Equal(t, "from,to,user,database,queries,rows,bytes,seconds,cost\n"+
+		"2025-06-01T00:00:00Z,2025-06-02T00:00:00Z,alice,app,42,0,0,0,0\n"+
+		"2025-06-01T00:00:00Z,2025-06-02T00:00:00Z,bob,app,42,0,0,0,0\n", out)
+
+	output := filepath.Join(dir, "june.parquet")
+	_, err = runCommand(t, "report", "--config", configFile, "--usage-store-file", file, "--from", "2025-06-01", "--to", "2025-07-01",
+		"--format", "parquet", "--output", output)
+	require.NoError(t, err)
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "PAR1", string(content[:4]))
+
+	_, err = runCommand(t, "report", "--from", "2025-06-01")
+	assert.ErrorContains(t, err, "no usage store")
+	_, err = runCommand(t, "report", "--from", "June")
+	assert.ErrorContains(t, err, "invalid --from")
+	_, err = runCommand(t, "report", "--from", "2025-06-01", "--format", "xlsx")
+	assert.ErrorContains(t, err, "unknown usage export format")
+}
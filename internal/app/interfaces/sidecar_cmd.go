@@ -0,0 +1,165 @@
+package interfaces
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/internal/config"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// NewSidecarCommand creates the sidecar command
+func NewSidecarCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sidecar",
+		Short: "Enforce quotas through PgBouncer's admin console, without proxying connections",
+		Long: `Enforce quotas without sitting between clients and PgBouncer. The admin
+console given with --pgbouncer-admin-url is polled for the queries, bytes and
+query time of each database, which are charged to the users of its pools in
+proportion to their client connections, since PgBouncer only counts them per
+database.
+
+The clients of a principal beyond a quota are killed with KILL_CLIENT as long
+as it stays over quota, and a database is disabled with DISABLE while all of its
+users are, then enabled again once one of them is back under quota. The console
+user must be one of PgBouncer's admin_users, and KILL_CLIENT needs PgBouncer
+1.23 or later.
+
+Only windowed limits on queries, bytes and seconds are enforced: rates, costs,
+connection caps and the policies scoped to tables, statements or queries need
+the proxy. Settings come from the same configuration file as the server's;
+quota policies are reloaded when the file changes or on SIGHUP.`,
+		Example: `  pgbouncer-quota-enforcer sidecar --config enforcer.yaml \
+    --pgbouncer-admin-url postgres://enforcer@pgbouncer.internal:6432/pgbouncer`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configFile, err := cmd.Flags().GetString("config")
+			if err != nil {
+				return err
+			}
+
+			load := func() (*config.Config, error) {
+				return config.Load(configFile, cmd.Flags())
+			}
+			cfg, err := load()
+			if err != nil {
+				return err
+			}
+			return runSidecar(cfg, configFile, load)
+		},
+	}
+
+	cmd.Flags().String("pgbouncer-admin-url", "", "URL of PgBouncer's admin console, as one of its admin_users")
+	cmd.Flags().Duration("pgbouncer-poll-interval", app.DefaultPoolerPollInterval, "How often usage is read from the admin console and quotas enforced")
+	cmd.Flags().String("log-level", "info", "Minimum severity logged: debug, info or error")
+	cmd.Flags().String("usage-store-dsn", "", "PostgreSQL connection string of a database keeping usage counters and quota policies (default: usage is kept in memory)")
+	cmd.Flags().String("usage-store-file", "", "SQLite database file keeping usage counters and quota policies, for a single enforcer")
+	cmd.Flags().String("usage-store-redis", "", "Redis URL of a server keeping usage counters, summed across enforcers")
+	cmd.Flags().String("usage-consistency", "eventual", "How enforcers sharing a usage store see each other's usage: strict writes every query through, eventual buffers it")
+	cmd.Flags().Int64("usage-max-overshoot", 0, "Usage of a counter an enforcer holds back at most with eventual consistency (0 only bounds it by the flush interval)")
+	cmd.Flags().Duration("usage-store-flush-interval", adapters.DefaultUsageFlushInterval, "How often buffered usage is written to the usage store")
+	cmd.Flags().StringSlice("etcd-endpoints", nil, "etcd endpoints, as host:port, to read and watch quota policies and roles from (default: etcd is not used)")
+	cmd.Flags().String("etcd-prefix", adapters.DefaultEtcdPrefix, "etcd key prefix of the quota policies, roles and instances")
+
+	return cmd
+}
+
+// runSidecar enforces the configured quota policies through PgBouncer's admin
+// console until interrupted. Quota policies are reloaded through load on SIGHUP
+// and when configFile changes.
+func runSidecar(cfg *config.Config, configFile string, load func() (*config.Config, error)) error {
+	if cfg.PgBouncer.AdminURL == "" {
+		return fmt.Errorf("the sidecar needs the URL of PgBouncer's admin console")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	usageStore, err := openUsageStore(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	var quotaStore domain.UsageStore = adapters.NewMemoryUsageStore()
+	if usageStore != nil {
+		defer closeUsageStore(usageStore)
+		quotaStore = usageStore
+	}
+	policyStore, err := openPolicyStore(cfg)
+	if err != nil {
+		return err
+	}
+	if policyStore != nil {
+		defer closePolicyStore(policyStore)
+	}
+	sources := policySources(usageStore, policyStore)
+
+	policies, err := quotaPolicies(ctx, cfg, sources)
+	if err != nil {
+		return err
+	}
+	roles, err := quotaRoles(ctx, cfg, sources)
+	if err != nil {
+		return err
+	}
+
+	console, err := adapters.NewPgBouncerConsole(cfg.PgBouncer.AdminURL)
+	if err != nil {
+		return err
+	}
+	defer console.Close()
+
+	log := logger.NewSimpleLogger()
+	log.SetLevel(cfg.ServerConfig().LogLevel)
+	clock := adapters.SystemClock{}
+	monitor := app.NewPoolerMonitor(console, cfg.PgBouncer.PollInterval, clock, log.WithField("pooler", "pgbouncer"))
+	quotas, err := app.NewQuotaService(quotaStore, policies, app.WithPoolSaturation(monitor))
+	if err != nil {
+		return err
+	}
+	quotas.SetRoles(roles)
+	sidecar := app.NewSidecarService(monitor, console, quotas, clock, log)
+
+	go sidecar.Run(ctx)
+	fmt.Printf("Enforcing %d quota policies through PgBouncer's admin console\n", len(policies))
+	fmt.Println("Press Ctrl+C to stop the sidecar")
+
+	// Reload quota policies when the configuration file or etcd changes
+	changes := make(chan struct{}, 1)
+	changed := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+	if configFile != "" {
+		if err := config.Watch(ctx, configFile, changed); err != nil {
+			fmt.Printf("Configuration changes will only be applied on SIGHUP: %v\n", err)
+		}
+	}
+	if policyStore != nil {
+		policyStore.Watch(ctx, changed)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case <-changes:
+			reloadPolicies(ctx, sidecar, load, sources)
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				reloadPolicies(ctx, sidecar, load, sources)
+				continue
+			}
+			fmt.Println("\nSidecar stopped")
+			return nil
+		}
+	}
+}
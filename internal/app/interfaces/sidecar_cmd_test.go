@@ -0,0 +1,17 @@
+package interfaces
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSidecarCommand(t *testing.T) {
+	_, err := runCommand(t, "sidecar")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "admin console")
+
+	_, err = runCommand(t, "sidecar", "--pgbouncer-admin-url", "postgres://%zz")
+	assert.Error(t, err, "An invalid admin console URL should be rejected before polling")
+}
@@ -0,0 +1,255 @@
+package interfaces
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// clearScreen moves the cursor home and clears the terminal
+const clearScreen = "\033[H\033[2J"
+
+// utilizationBarWidth is the number of cells of a quota utilization bar
+const utilizationBarWidth = 20
+
+// statusSnapshot is what the status command shows at one refresh
+type statusSnapshot struct {
+	Time        time.Time
+	Connections []adminConnection
+	Usage       []adminUsage // nil when a custom policy engine manages the quotas
+	Activity    adminActivity
+}
+
+// NewStatusCommand creates the status command
+func NewStatusCommand() *cobra.Command {
+	var interval time.Duration
+	var denials int
+	var once bool
+
+	cmd := &cobra.Command{
+		Use:     "status",
+		Aliases: []string{"top"},
+		Short:   "Watch the connections, query rates and quotas of a running server",
+		Long: `Show a live view of a running server, refreshed every --interval: the open
+connections and query rate of each user and database, how much of each quota
+they used and the latest denied queries. Query rates are averaged over the
+server's activity window.
+
+The server is reached through its admin API. Use --once to print a single
+view without clearing the terminal, e.g. from scripts.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newAdminClient(cmd)
+			if err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			if once {
+				snapshot, err := fetchStatus(cmd.Context(), client)
+				if err != nil {
+					return err
+				}
+				return renderStatus(out, client.baseURL, snapshot, denials)
+			}
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return watchStatus(ctx, out, client, interval, denials)
+		},
+	}
+
+	addAdminFlags(cmd)
+	cmd.Flags().DurationVar(&interval, "interval", time.Second, "How often the view is refreshed")
+	cmd.Flags().IntVar(&denials, "denials", 10, "How many recent denials to show")
+	cmd.Flags().BoolVar(&once, "once", false, "Print the view once and exit")
+
+	return cmd
+}
+
+// watchStatus redraws the status view every interval until ctx is cancelled.
+// Errors are shown in place of the view so that it recovers once the server is back.
+func watchStatus(ctx context.Context, out io.Writer, client *adminClient, interval time.Duration, denials int) error {
+	if interval <= 0 {
+		return fmt.Errorf("the refresh interval must be positive")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var view bytes.Buffer
+		view.WriteString(clearScreen)
+		snapshot, err := fetchStatus(ctx, client)
+		if err == nil {
+			err = renderStatus(&view, client.baseURL, snapshot, denials)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			fmt.Fprintf(&view, "%s  %s\n\n%v\n", client.baseURL, time.Now().Format(time.TimeOnly), err)
+		}
+		if _, err := out.Write(view.Bytes()); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetchStatus reads the connections, usage and activity of the server
+func fetchStatus(ctx context.Context, client *adminClient) (statusSnapshot, error) {
+	snapshot := statusSnapshot{Time: time.Now()}
+	if err := client.do(ctx, http.MethodGet, "/api/v1/connections", nil, nil, &snapshot.Connections); err != nil {
+		return snapshot, err
+	}
+	if err := client.do(ctx, http.MethodGet, "/api/v1/activity", nil, nil, &snapshot.Activity); err != nil {
+		return snapshot, err
+	}
+
+	err := client.do(ctx, http.MethodGet, "/api/v1/usage", nil, nil, &snapshot.Usage)
+	var apiErr *adminError
+	if errors.As(err, &apiErr) && apiErr.code == http.StatusNotImplemented {
+		snapshot.Usage = nil
+		err = nil
+	}
+	return snapshot, err
+}
+
+// principalStatus is a row of the principal table
+type principalStatus struct {
+	user, database string
+	connections    int
+	idle           int
+	activity       adminPrincipalActivity
+}
+
+// renderStatus writes the status view of snapshot
+func renderStatus(out io.Writer, server string, snapshot statusSnapshot, denials int) error {
+	idle := 0
+	for _, connection := range snapshot.Connections {
+		if connection.Idle {
+			idle++
+		}
+	}
+	fmt.Fprintf(out, "%s  instance %s  %s\n", server, orDash(snapshot.Activity.InstanceID), snapshot.Time.Format(time.TimeOnly))
+	fmt.Fprintf(out, "Connections: %d (%d idle)  Rates over %s\n\n", len(snapshot.Connections), idle, snapshot.Activity.Window)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tDATABASE\tCONNS\tIDLE\tQPS\tDENIED")
+	for _, principal := range principalStatuses(snapshot) {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.1f\t%d\n",
+			orDash(principal.user), orDash(principal.database), principal.connections, principal.idle,
+			principal.activity.QueriesPerSecond, principal.activity.Denied)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if snapshot.Usage != nil {
+		usage := append([]adminUsage(nil), snapshot.Usage...)
+		sort.SliceStable(usage, func(i, j int) bool {
+			return utilization(usage[i]) > utilization(usage[j])
+		})
+
+		fmt.Fprintln(out)
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "QUOTA\tUSER\tDATABASE\tUSED\tUTILIZATION\tRESETS IN")
+		for _, entry := range usage {
+			resetsIn := "-"
+			if !entry.ResetAt.IsZero() && entry.ResetAt.After(snapshot.Time) {
+				resetsIn = entry.ResetAt.Sub(snapshot.Time).Round(time.Second).String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d/%d %s\t%s\t%s\n",
+				entry.Policy, orDash(entry.User), orDash(entry.Database), entry.Used, entry.Limit, entry.Dimension,
+				utilizationBar(utilization(entry)), resetsIn)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DENIED AT\tUSER\tDATABASE\tPOLICY\tREASON")
+	for i, denial := range snapshot.Activity.Denials {
+		if i == denials {
+			break
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			denial.Time.Local().Format(time.TimeOnly), orDash(denial.User), orDash(denial.Database),
+			orDash(denial.Policy), orDash(denial.Reason))
+	}
+	return w.Flush()
+}
+
+// principalStatuses merges the connections and activity of each user and
+// database, busiest first
+func principalStatuses(snapshot statusSnapshot) []*principalStatus {
+	byPrincipal := make(map[[2]string]*principalStatus)
+	principal := func(user, database string) *principalStatus {
+		key := [2]string{user, database}
+		if _, ok := byPrincipal[key]; !ok {
+			byPrincipal[key] = &principalStatus{user: user, database: database}
+		}
+		return byPrincipal[key]
+	}
+	for _, connection := range snapshot.Connections {
+		entry := principal(connection.User, connection.Database)
+		entry.connections++
+		if connection.Idle {
+			entry.idle++
+		}
+	}
+	for _, activity := range snapshot.Activity.Principals {
+		principal(activity.User, activity.Database).activity = activity
+	}
+
+	principals := make([]*principalStatus, 0, len(byPrincipal))
+	for _, entry := range byPrincipal {
+		principals = append(principals, entry)
+	}
+	sort.Slice(principals, func(i, j int) bool {
+		a, b := principals[i], principals[j]
+		if a.activity.Queries != b.activity.Queries {
+			return a.activity.Queries > b.activity.Queries
+		}
+		if a.connections != b.connections {
+			return a.connections > b.connections
+		}
+		return a.user+"\x00"+a.database < b.user+"\x00"+b.database
+	})
+	return principals
+}
+
+// utilization returns the share of the limit used, from 0 to 1
+func utilization(usage adminUsage) float64 {
+	if usage.Limit <= 0 {
+		return 0
+	}
+	return min(float64(usage.Used)/float64(usage.Limit), 1)
+}
+
+// utilizationBar draws a utilization as a bar followed by its percentage
+func utilizationBar(share float64) string {
+	filled := int(share*utilizationBarWidth + 0.5)
+	return fmt.Sprintf("[%s%s] %3.0f%%", strings.Repeat("#", filled), strings.Repeat(".", utilizationBarWidth-filled), share*100)
+}
@@ -0,0 +1,69 @@
+package interfaces
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderStatus(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	snapshot := statusSnapshot{
+		Time: now,
+		Connections: []adminConnection{
+			{ID: "conn_1", User: "alice", Database: "app"},
+			{ID: "conn_2", User: "alice", Database: "app", Idle: true},
+			{ID: "conn_3", User: "carol", Database: "app", Idle: true},
+		},
+		Usage: []adminUsage{
+			{Policy: "default", User: "carol", Database: "app", Dimension: "queries", Used: 1, Limit: 100},
+			{Policy: "alice-hourly", User: "alice", Database: "app", Dimension: "queries", Used: 75, Limit: 100, ResetAt: now.Add(90 * time.Second)},
+		},
+		Activity: adminActivity{
+			InstanceID: "enforcer-1",
+			Window:     "10s",
+			Principals: []adminPrincipalActivity{
+				{User: "bob", Database: "app", Queries: 5, Denied: 5, QueriesPerSecond: 0.5},
+				{User: "alice", Database: "app", Queries: 120, QueriesPerSecond: 12},
+			},
+			Denials: []adminDenial{
+				{Time: now, User: "bob", Database: "app", Policy: "bob-hourly", Reason: "quota exceeded"},
+				{Time: now, User: "bob", Database: "app", Policy: "older"},
+			},
+		},
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, renderStatus(&out, "http://127.0.0.1:8080", snapshot, 1))
+	view := out.String()
+
+	assert.Contains(t, view, "instance enforcer-1")
+	assert.Contains(t, view, "Connections: 3 (2 idle)")
+	assert.Regexp(t, `alice\s+app\s+2\s+1\s+12.0\s+0\n\s*bob\s+app\s+0\s+0\s+0.5\s+5\n\s*carol\s+app\s+1\s+1\s+0.0\s+0`, view, "Principals should be listed busiest first")
+	assert.Regexp(t, `alice-hourly\s+alice\s+app\s+75/100 queries\s+\[###############\.\.\.\.\.\]\s+75%\s+1m30s\n\s*default`, view)
+	assert.Contains(t, view, "bob-hourly")
+	assert.NotContains(t, view, "older", "Only the requested number of denials should be shown")
+}
+
+func TestStatusCommand_Once(t *testing.T) {
+	server, err := app.NewServerService(app.ServerConfig{
+		Address:  "127.0.0.1:0",
+		Policies: []domain.QuotaPolicy{{Name: "default", Limit: 10, Window: time.Hour}},
+	})
+	require.NoError(t, err)
+	admin := httptest.NewServer(NewAdminAPI(server, "secret"))
+	defer admin.Close()
+
+	out, err := runCommand(t, "status", "--once", "--admin-url", admin.URL, "--admin-token", "secret")
+	require.NoError(t, err)
+	assert.Contains(t, out, "instance "+server.InstanceID())
+	assert.Contains(t, out, "Connections: 0 (0 idle)  Rates over 10s")
+	assert.NotContains(t, out, clearScreen)
+}
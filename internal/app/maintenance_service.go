@@ -0,0 +1,112 @@
+package app
+
+import (
+	"context"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaintenanceService implements domain.MaintenanceGate with windows toggled at runtime
+type MaintenanceService struct {
+	clock   domain.Clock
+	mu      sync.Mutex
+	windows map[string]domain.MaintenanceWindow
+	changed chan struct{} // closed and replaced whenever a window ends
+}
+
+// NewMaintenanceService creates a MaintenanceService with no active window
+func NewMaintenanceService(clock domain.Clock) *MaintenanceService {
+	return &MaintenanceService{
+		clock:   clock,
+		windows: make(map[string]domain.MaintenanceWindow),
+		changed: make(chan struct{}),
+	}
+}
+
+// Enable starts, or replaces, the maintenance window for window.Database
+func (s *MaintenanceService) Enable(window domain.MaintenanceWindow) {
+	if window.Message == "" {
+		window.Message = domain.DefaultMaintenanceMessage
+	}
+	if window.StartedAt.IsZero() {
+		window.StartedAt = s.clock.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.windows[window.Database] = window
+}
+
+// Disable ends the maintenance window for database and releases queued connections.
+// An empty database ends the listener-wide window.
+func (s *MaintenanceService) Disable(database string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.windows[database]; !ok {
+		return
+	}
+	delete(s.windows, database)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Windows returns the active maintenance windows ordered by database
+func (s *MaintenanceService) Windows() []domain.MaintenanceWindow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	windows := make([]domain.MaintenanceWindow, 0, len(s.windows))
+	for _, window := range s.windows {
+		windows = append(windows, window)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Database < windows[j].Database })
+	return windows
+}
+
+// Admit returns nil when no window covers the database. Otherwise the connection is
+// held for up to the covering window's queue timeout, waiting for the window to end.
+func (s *MaintenanceService) Admit(ctx context.Context, database string) (*domain.MaintenanceWindow, error) {
+	var deadline time.Time
+
+	for {
+		window, changed, ok := s.active(database)
+		if !ok {
+			return nil, nil
+		}
+
+		now := s.clock.Now()
+		if deadline.IsZero() {
+			deadline = now.Add(window.QueueTimeout)
+		}
+		remaining := deadline.Sub(now)
+		if remaining <= 0 {
+			return &window, nil
+		}
+
+		timer := s.clock.NewTimer(remaining)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-changed:
+			timer.Stop()
+		case <-timer.C():
+		}
+	}
+}
+
+// active returns the window covering database, preferring the database-specific one,
+// together with the channel signalling the next change
+func (s *MaintenanceService) active(database string) (domain.MaintenanceWindow, <-chan struct{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if window, ok := s.windows[database]; ok && database != "" {
+		return window, s.changed, true
+	}
+	window, ok := s.windows[""]
+	return window, s.changed, ok
+}
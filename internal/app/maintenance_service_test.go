@@ -0,0 +1,86 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenanceService_Admit(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	service := NewMaintenanceService(clock)
+
+	window, err := service.Admit(ctx, "app")
+	require.NoError(t, err)
+	assert.Nil(t, window, "No window should admit every connection")
+
+	service.Enable(domain.MaintenanceWindow{Database: "reporting", Message: "reporting is being upgraded"})
+
+	window, err = service.Admit(ctx, "app")
+	require.NoError(t, err)
+	assert.Nil(t, window, "Windows only cover their own database")
+
+	window, err = service.Admit(ctx, "reporting")
+	require.NoError(t, err)
+	require.NotNil(t, window)
+	assert.Equal(t, "reporting is being upgraded", window.Message)
+
+	service.Enable(domain.MaintenanceWindow{})
+
+	window, err = service.Admit(ctx, "app")
+	require.NoError(t, err)
+	require.NotNil(t, window, "Listener-wide windows cover every database")
+	assert.Equal(t, domain.DefaultMaintenanceMessage, window.Message)
+	assert.Equal(t, clock.Now(), window.StartedAt)
+	assert.Len(t, service.Windows(), 2)
+
+	service.Disable("")
+	service.Disable("reporting")
+
+	window, err = service.Admit(ctx, "reporting")
+	require.NoError(t, err)
+	assert.Nil(t, window)
+	assert.Empty(t, service.Windows())
+}
+
+func TestMaintenanceService_Queue(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	service := NewMaintenanceService(clock)
+
+	admit := func() (chan *domain.MaintenanceWindow, chan error) {
+		windows := make(chan *domain.MaintenanceWindow, 1)
+		errs := make(chan error, 1)
+		go func() {
+			window, err := service.Admit(ctx, "app")
+			windows <- window
+			errs <- err
+		}()
+		require.True(t, clock.WaitForTimers(1, time.Second), "Admit should queue the connection")
+		return windows, errs
+	}
+
+	service.Enable(domain.MaintenanceWindow{QueueTimeout: 10 * time.Second})
+	windows, errs := admit()
+	service.Disable("")
+	assert.Nil(t, <-windows, "Queued connections should be admitted once maintenance ends")
+	assert.NoError(t, <-errs)
+
+	service.Enable(domain.MaintenanceWindow{QueueTimeout: 10 * time.Second})
+	windows, errs = admit()
+	clock.Advance(10 * time.Second)
+	assert.NotNil(t, <-windows, "Connections should be rejected once the queue timeout expires")
+	assert.NoError(t, <-errs)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err := service.Admit(cancelled, "app")
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,39 @@
+package app
+
+import (
+	"context"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+)
+
+// MiddlewareChain is a domain.PolicyEngine decorator running queries through
+// middlewares before the wrapped engine. The first middleware is the outermost:
+// it sees the query first and the decision last.
+type MiddlewareChain struct {
+	next    domain.PolicyEngine
+	handler domain.QueryHandler
+}
+
+// NewMiddlewareChain creates a MiddlewareChain running middlewares, in order, around next
+func NewMiddlewareChain(next domain.PolicyEngine, middlewares ...domain.QueryMiddleware) *MiddlewareChain {
+	handler := next.Evaluate
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		middleware, inner := middlewares[i], handler
+		handler = func(ctx context.Context, query *domain.Query) (domain.Decision, error) {
+			return middleware(ctx, query, inner)
+		}
+	}
+	return &MiddlewareChain{next: next, handler: handler}
+}
+
+// Evaluate returns the decision of the chain on query
+func (c *MiddlewareChain) Evaluate(ctx context.Context, query *domain.Query) (domain.Decision, error) {
+	return c.handler(ctx, query)
+}
+
+// RecordUsage forwards statement usage to the wrapped engine when it has metered quotas
+func (c *MiddlewareChain) RecordUsage(ctx context.Context, query *domain.Query, usage domain.StatementUsage) error {
+	if recorder, ok := c.next.(domain.UsageRecorder); ok {
+		return recorder.RecordUsage(ctx, query, usage)
+	}
+	return nil
+}
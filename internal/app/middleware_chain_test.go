@@ -0,0 +1,66 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddlewareChain_RunsInOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) domain.QueryMiddleware {
+		return func(ctx context.Context, query *domain.Query, next domain.QueryHandler) (domain.Decision, error) {
+			calls = append(calls, name+" before")
+			decision, err := next(ctx, query)
+			calls = append(calls, name+" after")
+			return decision, err
+		}
+	}
+	// Attribute queries of a shared legacy account to the application using it
+	attribute := func(ctx context.Context, query *domain.Query, next domain.QueryHandler) (domain.Decision, error) {
+		if query.UserID == "legacy" {
+			query.UserID = query.ApplicationName
+		}
+		return next(ctx, query)
+	}
+	engine := &mocks.StaticPolicyEngine{}
+	chain := NewMiddlewareChain(engine, trace("outer"), attribute, trace("inner"))
+
+	query := newPrincipalQuery("legacy")
+	query.ApplicationName = "billing"
+	decision, err := chain.Evaluate(context.Background(), query)
+	require.NoError(t, err)
+
+	assert.True(t, decision.Allowed())
+	assert.Equal(t, []string{"outer before", "inner before", "inner after", "outer after"}, calls)
+	require.Len(t, engine.Queries(), 1)
+	assert.Equal(t, "billing", engine.Queries()[0].UserID, "The engine should see the query as changed by the middlewares")
+
+	require.NoError(t, chain.RecordUsage(context.Background(), query, domain.StatementUsage{Rows: 3}))
+	assert.Equal(t, []domain.StatementUsage{{Rows: 3}}, engine.Usage())
+}
+
+func TestMiddlewareChain_ShortCircuits(t *testing.T) {
+	deny := func(ctx context.Context, query *domain.Query, next domain.QueryHandler) (domain.Decision, error) {
+		if query.UserID == "intern" {
+			return domain.Decision{Action: domain.DecisionDeny, Reason: "interns are read-only today"}, nil
+		}
+		return next(ctx, query)
+	}
+	engine := &mocks.StaticPolicyEngine{}
+	chain := NewMiddlewareChain(engine, deny)
+
+	decision, err := chain.Evaluate(context.Background(), newPrincipalQuery("intern"))
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed())
+	assert.Empty(t, engine.Queries(), "A middleware deciding should not reach the engine")
+
+	decision, err = chain.Evaluate(context.Background(), newPrincipalQuery("alice"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed())
+}
@@ -0,0 +1,285 @@
+package app
+
+import (
+	"fmt"
+	"maps"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// diffPolicies describes, one line per policy, how the policy set changed.
+// Policies are matched by name; lines are sorted by policy name.
+func diffPolicies(previous, next []domain.QuotaPolicy) []string {
+	before := make(map[string]domain.QuotaPolicy, len(previous))
+	for _, policy := range previous {
+		before[policy.Name] = policy
+	}
+	after := make(map[string]domain.QuotaPolicy, len(next))
+	for _, policy := range next {
+		after[policy.Name] = policy
+	}
+
+	var changes []string
+	for name, policy := range after {
+		old, existed := before[name]
+		if !existed {
+			changes = append(changes, fmt.Sprintf("%q added: %s", name, describeLimits(policy)))
+			continue
+		}
+
+		var fields []string
+		if old.Limit != policy.Limit {
+			fields = append(fields, fmt.Sprintf("limit %d -> %d", old.Limit, policy.Limit))
+		}
+		if old.Dimension.Unit() != policy.Dimension.Unit() {
+			fields = append(fields, fmt.Sprintf("dimension %s -> %s", old.Dimension.Unit(), policy.Dimension.Unit()))
+		}
+		if old.Window != policy.Window {
+			fields = append(fields, fmt.Sprintf("window %s -> %s", old.Window, policy.Window))
+		}
+		if old.PerLabel != policy.PerLabel {
+			fields = append(fields, fmt.Sprintf("per label %s -> %s", describePerLabel(old), describePerLabel(policy)))
+		}
+		if old.WarnAt != policy.WarnAt || old.Soft != policy.Soft || old.Grace != policy.Grace {
+			fields = append(fields, fmt.Sprintf("enforcement %s -> %s", describeEnforcement(old), describeEnforcement(policy)))
+		}
+		if old.Rate != policy.Rate || old.RateBurst() != policy.RateBurst() || old.RatePer != policy.RatePer ||
+			old.Credits != policy.Credits || old.CreditRate != policy.CreditRate {
+			fields = append(fields, fmt.Sprintf("rate %s -> %s", describeRate(old), describeRate(policy)))
+		}
+		if old.TightenAt != policy.TightenAt || old.TightenTo != policy.TightenTo {
+			fields = append(fields, fmt.Sprintf("tightening %s -> %s", describeTightening(old), describeTightening(policy)))
+		}
+		if old.MaxConnections != policy.MaxConnections {
+			fields = append(fields, fmt.Sprintf("max connections %s -> %s", describeMaxConnections(old), describeMaxConnections(policy)))
+		}
+		if old.MaxConcurrentQueries != policy.MaxConcurrentQueries || old.QueueTimeout != policy.QueueTimeout {
+			fields = append(fields, fmt.Sprintf("max concurrent queries %s -> %s", describeConcurrency(old), describeConcurrency(policy)))
+		}
+		if old.StatementTimeout != policy.StatementTimeout {
+			fields = append(fields, fmt.Sprintf("statement timeout %s -> %s", describeStatementTimeout(old), describeStatementTimeout(policy)))
+		}
+		if old.MaxResultRows != policy.MaxResultRows || old.MaxResultBytes != policy.MaxResultBytes {
+			fields = append(fields, fmt.Sprintf("result cap %s -> %s", describeResultCap(old), describeResultCap(policy)))
+		}
+		if old.MaxTransactionDuration != policy.MaxTransactionDuration || old.MaxTransactionStatements != policy.MaxTransactionStatements {
+			fields = append(fields, fmt.Sprintf("transaction limit %s -> %s", describeTransactionLimit(old), describeTransactionLimit(policy)))
+		}
+		if !maps.Equal(old.StartupParameters, policy.StartupParameters) {
+			fields = append(fields, fmt.Sprintf("startup parameters %s -> %s", describeStartupParameters(old), describeStartupParameters(policy)))
+		}
+		if old.Deny != policy.Deny {
+			fields = append(fields, fmt.Sprintf("deny %t -> %t", old.Deny, policy.Deny))
+		}
+		if old.Allow != policy.Allow {
+			fields = append(fields, fmt.Sprintf("allow %t -> %t", old.Allow, policy.Allow))
+		}
+		if old.Override != policy.Override {
+			fields = append(fields, fmt.Sprintf("override %t -> %t", old.Override, policy.Override))
+		}
+		if !slices.Equal(old.AllowDuring, policy.AllowDuring) {
+			fields = append(fields, fmt.Sprintf("allowed windows %s -> %s", describeAllowDuring(old), describeAllowDuring(policy)))
+		}
+		if !slices.Equal(old.ActiveDuring, policy.ActiveDuring) {
+			fields = append(fields, fmt.Sprintf("active windows %s -> %s", describeActiveDuring(old), describeActiveDuring(policy)))
+		}
+		if old.User != policy.User || old.Role != policy.Role || old.Database != policy.Database || !maps.Equal(old.Labels, policy.Labels) || old.Listener != policy.Listener ||
+			!slices.Equal(old.Tables, policy.Tables) || !slices.Equal(old.Statements, policy.Statements) ||
+			!slices.Equal(old.Fingerprints, policy.Fingerprints) || !slices.Equal(old.Patterns, policy.Patterns) {
+			fields = append(fields, "scope changed")
+		}
+		if old.Hint != policy.Hint {
+			fields = append(fields, "hint changed")
+		}
+		if len(fields) > 0 {
+			changes = append(changes, fmt.Sprintf("%q changed: %s", name, strings.Join(fields, ", ")))
+		}
+	}
+	for name := range before {
+		if _, kept := after[name]; !kept {
+			changes = append(changes, fmt.Sprintf("%q removed", name))
+		}
+	}
+
+	sort.Strings(changes)
+	return changes
+}
+
+// describeLimits describes the windowed limit and the rate of a policy
+func describeLimits(policy domain.QuotaPolicy) string {
+	var limits []string
+	if policy.Allow {
+		limits = append(limits, "allow")
+	}
+	if policy.Deny {
+		limits = append(limits, "deny")
+	}
+	if policy.Windowed() {
+		limits = append(limits, fmt.Sprintf("limit %d per %s", policy.Limit, policy.Window))
+	}
+	if policy.RateLimited() {
+		limits = append(limits, "rate "+describeRate(policy))
+	}
+	if policy.MaxConnections > 0 {
+		limits = append(limits, fmt.Sprintf("max connections %d", policy.MaxConnections))
+	}
+	if policy.MaxConcurrentQueries > 0 {
+		limits = append(limits, "max concurrent queries "+describeConcurrency(policy))
+	}
+	if policy.StatementTimeout > 0 {
+		limits = append(limits, fmt.Sprintf("statement timeout %s", policy.StatementTimeout))
+	}
+	if policy.ResultCapped() {
+		limits = append(limits, "result cap "+describeResultCap(policy))
+	}
+	if policy.TransactionLimited() {
+		limits = append(limits, "transaction limit "+describeTransactionLimit(policy))
+	}
+	if len(policy.StartupParameters) > 0 {
+		limits = append(limits, "startup parameters "+describeStartupParameters(policy))
+	}
+	return strings.Join(limits, ", ")
+}
+
+// describeEnforcement describes how the windowed limit of a policy is enforced,
+// e.g. hard with a 15m0s grace period, warning at 90%
+func describeEnforcement(policy domain.QuotaPolicy) string {
+	description := "hard"
+	if policy.Soft {
+		description = "soft"
+	} else if policy.Grace > 0 {
+		description = fmt.Sprintf("hard with a %s grace period", policy.Grace)
+	}
+	if policy.WarnAt > 0 {
+		description += fmt.Sprintf(", warning at %d%%", policy.WarnAt)
+	}
+	return description
+}
+
+// describeTightening describes how a policy tightens while its upstream pool
+// is saturated, e.g. to 50% from 80% saturation
+func describeTightening(policy domain.QuotaPolicy) string {
+	if policy.TightenAt == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("to %d%% from %d%% saturation", policy.TightenTo, policy.TightenAt)
+}
+
+// describeAllowDuring describes the windows lifting a deny policy
+func describeAllowDuring(policy domain.QuotaPolicy) string {
+	if len(policy.AllowDuring) == 0 {
+		return "none"
+	}
+	return strings.Join(policy.AllowDuring, ", ")
+}
+
+// describeActiveDuring describes the windows a scheduled policy applies in
+func describeActiveDuring(policy domain.QuotaPolicy) string {
+	if len(policy.ActiveDuring) == 0 {
+		return "always"
+	}
+	return strings.Join(policy.ActiveDuring, ", ")
+}
+
+// describeMaxConnections describes the connection cap of a policy
+func describeMaxConnections(policy domain.QuotaPolicy) string {
+	if policy.MaxConnections == 0 {
+		return "unlimited"
+	}
+	return strconv.FormatInt(policy.MaxConnections, 10)
+}
+
+// describeConcurrency describes the concurrency cap of a policy, e.g. 4
+// queued for up to 5s
+func describeConcurrency(policy domain.QuotaPolicy) string {
+	if policy.MaxConcurrentQueries == 0 {
+		return "unlimited"
+	}
+	description := strconv.FormatInt(policy.MaxConcurrentQueries, 10)
+	if policy.QueueTimeout > 0 {
+		description += fmt.Sprintf(" queued for up to %s", policy.QueueTimeout)
+	}
+	return description
+}
+
+// describeStatementTimeout describes the statement timeout of a policy
+func describeStatementTimeout(policy domain.QuotaPolicy) string {
+	if policy.StatementTimeout == 0 {
+		return "none"
+	}
+	return policy.StatementTimeout.String()
+}
+
+// describeResultCap describes the result caps of a policy, e.g. 10000 rows or
+// 1048576 bytes
+func describeResultCap(policy domain.QuotaPolicy) string {
+	var caps []string
+	if policy.MaxResultRows > 0 {
+		caps = append(caps, fmt.Sprintf("%d rows", policy.MaxResultRows))
+	}
+	if policy.MaxResultBytes > 0 {
+		caps = append(caps, fmt.Sprintf("%d bytes", policy.MaxResultBytes))
+	}
+	if len(caps) == 0 {
+		return "none"
+	}
+	return strings.Join(caps, " or ")
+}
+
+// describeTransactionLimit describes the transaction limits of a policy, e.g.
+// 5m0s or 1000 statements
+func describeTransactionLimit(policy domain.QuotaPolicy) string {
+	var limits []string
+	if policy.MaxTransactionDuration > 0 {
+		limits = append(limits, policy.MaxTransactionDuration.String())
+	}
+	if policy.MaxTransactionStatements > 0 {
+		limits = append(limits, fmt.Sprintf("%d statements", policy.MaxTransactionStatements))
+	}
+	if len(limits) == 0 {
+		return "none"
+	}
+	return strings.Join(limits, " or ")
+}
+
+// describePerLabel describes the label whose values a policy counts apart, e.g.
+// tenant_id
+func describePerLabel(policy domain.QuotaPolicy) string {
+	if policy.PerLabel == "" {
+		return "none"
+	}
+	return policy.PerLabel
+}
+
+// describeStartupParameters describes the startup parameters a policy sends
+// upstream, e.g. application_name=etl options=-c work_mem=64MB
+func describeStartupParameters(policy domain.QuotaPolicy) string {
+	if len(policy.StartupParameters) == 0 {
+		return "none"
+	}
+	parameters := make([]string, 0, len(policy.StartupParameters))
+	for _, name := range slices.Sorted(maps.Keys(policy.StartupParameters)) {
+		parameters = append(parameters, name+"="+policy.StartupParameters[name])
+	}
+	return strings.Join(parameters, " ")
+}
+
+// describeRate describes the rate of a policy, e.g. 20/s burst 50 per
+// connection, or 10/s burst 10 per user with 3000 credits earned at 2/s
+func describeRate(policy domain.QuotaPolicy) string {
+	if !policy.RateLimited() {
+		return "none"
+	}
+	scope := policy.RatePer
+	if scope == "" {
+		scope = domain.RateScopeUser
+	}
+	rate := fmt.Sprintf("%s/s burst %d per %s", strconv.FormatFloat(policy.Rate, 'f', -1, 64), policy.RateBurst(), scope)
+	if policy.Credits > 0 {
+		rate += fmt.Sprintf(" with %d credits earned at %s/s", policy.Credits, strconv.FormatFloat(policy.CreditAccrual(), 'f', -1, 64))
+	}
+	return rate
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffPolicies(t *testing.T) {
+	previous := []domain.QuotaPolicy{
+		{Name: "alice", User: "alice", Limit: 100, Window: time.Hour},
+		{Name: "audit", Tables: []string{"audit.*"}, Statements: []domain.StatementClass{domain.StatementClassWrite}, Limit: 10, Window: time.Hour},
+		{Name: "billing", Labels: map[string]string{"team": "billing"}, Limit: 10, Window: time.Minute},
+		{Name: "exports", Dimension: domain.QuotaDimensionBytes, Limit: 1 << 20, Window: time.Hour},
+		{Name: "full-scans", Patterns: []string{"^SELECT \\* FROM huge_table$"}, Deny: true},
+		{Name: "legacy", Limit: 5, Window: time.Minute},
+		{Name: "pool", Database: "app", MaxConnections: 10},
+		{Name: "reporting", Database: "reporting", Limit: 50, Window: time.Hour},
+		{Name: "secrets", Tables: []string{"secrets"}, Deny: true},
+	}
+	next := []domain.QuotaPolicy{
+		{Name: "alice", User: "alice", Limit: 200, Window: 30 * time.Minute},
+		{Name: "audit", Tables: []string{"audit.*"}, Statements: []domain.StatementClass{domain.StatementClassWrite}, Deny: true},
+		{Name: "billing", Labels: map[string]string{"team": "payments"}, Limit: 10, Window: time.Minute},
+		{Name: "etl", Database: "warehouse", Limit: 1000, Window: time.Hour},
+		{Name: "exports", Dimension: domain.QuotaDimensionRows, Limit: 1 << 20, Window: time.Hour},
+		{Name: "full-scans", Patterns: []string{"(?i)^select \\* from huge_table$"}, Deny: true, Hint: "filter by created_at"},
+		{Name: "health", Fingerprints: []string{"50fde20626009aba"}, Allow: true},
+		{Name: "pool", Database: "app", MaxConnections: 20, StatementTimeout: 30 * time.Second},
+		{Name: "reporting", Database: "reporting", Limit: 50, Window: time.Hour, Rate: 2.5},
+		{Name: "secrets", Tables: []string{"secrets"}, Deny: true, AllowDuring: []string{"Sat 02:00-04:00"}},
+		{Name: "smoothing", User: "etl", Rate: 20, Burst: 50, RatePer: domain.RateScopeConnection, MaxConnections: 4},
+	}
+
+	assert.Equal(t, []string{
+		`"alice" changed: limit 100 -> 200, window 1h0m0s -> 30m0s`,
+		`"audit" changed: limit 10 -> 0, window 1h0m0s -> 0s, deny false -> true`,
+		`"billing" changed: scope changed`,
+		`"etl" added: limit 1000 per 1h0m0s`,
+		`"exports" changed: dimension bytes -> rows`,
+		`"full-scans" changed: scope changed, hint changed`,
+		`"health" added: allow`,
+		`"legacy" removed`,
+		`"pool" changed: max connections 10 -> 20, statement timeout none -> 30s`,
+		`"reporting" changed: rate none -> 2.5/s burst 3 per user`,
+		`"secrets" changed: allowed windows none -> Sat 02:00-04:00`,
+		`"smoothing" added: rate 20/s burst 50 per connection, max connections 4`,
+	}, diffPolicies(previous, next))
+
+	assert.Empty(t, diffPolicies(previous, previous))
+}
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"context"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"sync"
+	"time"
+)
+
+// DefaultOperatorResyncInterval is how often the operator syncs every declared
+// policy again, should a change have been missed
+const DefaultOperatorResyncInterval = 5 * time.Minute
+
+// PolicyOperator keeps a policy store in sync with the quota policies declared
+// as Kubernetes resources, so that quotas can be managed through GitOps. Policies
+// are synced whenever a resource changes and every resync interval; the status
+// of each resource tells whether its policy is in force.
+type PolicyOperator struct {
+	resources domain.PolicyResources
+	sink      domain.PolicySink
+	resync    time.Duration
+	clock     domain.Clock
+	logger    logger.Logger
+
+	mu       sync.Mutex
+	statuses map[string]operatorStatus // last status set, by resource name
+}
+
+// operatorStatus is the status last set on a resource
+type operatorStatus struct {
+	generation int64
+	message    string // empty once synced
+}
+
+// NewPolicyOperator creates a PolicyOperator syncing resources into sink every
+// resync interval; zero uses DefaultOperatorResyncInterval
+func NewPolicyOperator(resources domain.PolicyResources, sink domain.PolicySink, resync time.Duration, clock domain.Clock, log logger.Logger) *PolicyOperator {
+	if resync <= 0 {
+		resync = DefaultOperatorResyncInterval
+	}
+	return &PolicyOperator{
+		resources: resources,
+		sink:      sink,
+		resync:    resync,
+		clock:     clock,
+		logger:    log,
+		statuses:  make(map[string]operatorStatus),
+	}
+}
+
+// Reconcile syncs the valid declared policies into the store, then sets the
+// status of the resources whose outcome changed
+func (o *PolicyOperator) Reconcile(ctx context.Context) error {
+	resources, err := o.resources.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	policies := make([]domain.QuotaPolicy, 0, len(resources))
+	for _, resource := range resources {
+		if resource.Err == nil {
+			policies = append(policies, resource.Policy)
+		}
+	}
+	failures, err := o.sink.SyncPolicies(ctx, policies)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	declared := make(map[string]bool, len(resources))
+	for _, resource := range resources {
+		declared[resource.Name] = true
+		syncErr := resource.Err
+		if syncErr == nil {
+			syncErr = failures[resource.Policy.Name]
+		}
+
+		status := operatorStatus{generation: resource.Generation}
+		if syncErr != nil {
+			status.message = syncErr.Error()
+		}
+		if previous, ok := o.statuses[resource.Name]; ok && previous == status {
+			continue
+		}
+		if err := o.resources.SetStatus(ctx, resource, syncErr); err != nil {
+			o.logger.Error("Failed to set the status of quota policy resource %s: %v", resource.Name, err)
+			continue
+		}
+		if syncErr != nil {
+			o.logger.Error("Quota policy resource %s is not in force: %v", resource.Name, syncErr)
+		} else {
+			o.logger.Info("Quota policy resource %s is in force (generation %d)", resource.Name, resource.Generation)
+		}
+		o.statuses[resource.Name] = status
+	}
+	for name := range o.statuses {
+		if !declared[name] {
+			delete(o.statuses, name)
+		}
+	}
+	return nil
+}
+
+// Run reconciles on every change of the resources and every resync interval
+// until ctx is cancelled
+func (o *PolicyOperator) Run(ctx context.Context) {
+	changes := make(chan struct{}, 1)
+	o.resources.Watch(ctx, func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+
+	for {
+		if err := o.Reconcile(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			o.logger.Error("Failed to sync quota policy resources: %v", err)
+		}
+
+		timer := o.clock.NewTimer(o.resync)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-changes:
+			timer.Stop()
+		case <-timer.C():
+		}
+	}
+}
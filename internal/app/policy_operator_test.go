@@ -0,0 +1,95 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyOperator_Reconcile(t *testing.T) {
+	ctx := context.Background()
+	daily := domain.QuotaPolicy{Name: "alice-daily", User: "alice", Limit: 1000, Window: 24 * time.Hour}
+	manual := domain.QuotaPolicy{Name: "manual", User: "carol", Limit: 10, Window: time.Hour}
+	invalid := errors.New(`quota policy "windowless": window must be positive`)
+	clash := errors.New(`quota policy "manual" was written by other means`)
+	resources := []domain.PolicyResource{
+		{Name: "alice-daily", Generation: 1, Policy: daily},
+		{Name: "manual", Generation: 3, Policy: manual},
+		{Name: "windowless", Generation: 1, Err: invalid},
+	}
+
+	source := &mocks.PolicyResources{}
+	sink := &mocks.PolicySink{}
+	operator := NewPolicyOperator(source, sink, 0, testkit.NewFakeClock(time.Now()), logger.NewSimpleLogger())
+
+	source.On("List", ctx).Return(resources, nil).Twice()
+	sink.On("SyncPolicies", ctx, []domain.QuotaPolicy{daily, manual}).Return(map[string]error{"manual": clash}, nil).Twice()
+	source.On("SetStatus", ctx, resources[0], nil).Return(nil).Once()
+	source.On("SetStatus", ctx, resources[1], clash).Return(nil).Once()
+	source.On("SetStatus", ctx, resources[2], invalid).Return(nil).Once()
+	require.NoError(t, operator.Reconcile(ctx))
+	require.NoError(t, operator.Reconcile(ctx), "Unchanged outcomes should not set the status again")
+	source.AssertExpectations(t)
+	sink.AssertExpectations(t)
+
+	// A new generation sets the status again
+	resources[0].Generation = 2
+	source.On("List", ctx).Return(resources, nil).Once()
+	sink.On("SyncPolicies", ctx, []domain.QuotaPolicy{daily, manual}).Return(map[string]error{"manual": clash}, nil).Once()
+	source.On("SetStatus", ctx, resources[0], nil).Return(nil).Once()
+	require.NoError(t, operator.Reconcile(ctx))
+	source.AssertExpectations(t)
+
+	source.On("List", ctx).Return(nil, errors.New("connection refused")).Once()
+	assert.Error(t, operator.Reconcile(ctx))
+}
+
+func TestPolicyOperator_RunReconcilesOnChanges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := &mocks.PolicyResources{}
+	sink := &mocks.PolicySink{}
+	operator := NewPolicyOperator(source, sink, time.Hour, testkit.NewFakeClock(time.Now()), logger.NewSimpleLogger())
+
+	watched := make(chan func(), 1)
+	source.On("Watch", ctx, mock.Anything).Run(func(args mock.Arguments) {
+		watched <- args.Get(1).(func())
+	}).Once()
+	source.On("List", ctx).Return([]domain.PolicyResource{}, nil)
+	synced := make(chan struct{}, 1)
+	sink.On("SyncPolicies", ctx, []domain.QuotaPolicy{}).Run(func(mock.Arguments) {
+		synced <- struct{}{}
+	}).Return(nil, nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		operator.Run(ctx)
+	}()
+	changed := <-watched
+	<-synced
+
+	changed()
+	select {
+	case <-synced:
+	case <-time.After(time.Second):
+		t.Fatal("A change of the resources should reconcile before the resync interval")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run should return once cancelled")
+	}
+}
@@ -0,0 +1,111 @@
+package app
+
+import (
+	"context"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPoolerPollInterval is how often the pooler's admin console is polled
+	DefaultPoolerPollInterval = 10 * time.Second
+
+	// poolerStaleIntervals is how many poll intervals the last pools polled are
+	// trusted for, so that an unreachable console does not tighten quotas forever
+	poolerStaleIntervals = 3
+)
+
+// PoolerMonitor periodically polls the pools of the connection pooler the
+// upstream runs, and reports the saturation of the pool of each principal
+type PoolerMonitor struct {
+	console  domain.PoolerConsole
+	interval time.Duration
+	clock    domain.Clock
+	logger   logger.Logger
+
+	mu       sync.RWMutex
+	pools    []domain.PoolStats
+	polledAt time.Time // zero until a poll succeeds
+}
+
+// NewPoolerMonitor creates a PoolerMonitor polling console every interval; zero
+// uses DefaultPoolerPollInterval
+func NewPoolerMonitor(console domain.PoolerConsole, interval time.Duration, clock domain.Clock, log logger.Logger) *PoolerMonitor {
+	if interval <= 0 {
+		interval = DefaultPoolerPollInterval
+	}
+	return &PoolerMonitor{
+		console:  console,
+		interval: interval,
+		clock:    clock,
+		logger:   log,
+	}
+}
+
+// Refresh polls the pools once. On failure the last pools polled are kept until
+// they go stale.
+func (m *PoolerMonitor) Refresh(ctx context.Context) error {
+	pools, err := m.console.Pools(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pools = pools
+	m.polledAt = m.clock.Now()
+	return nil
+}
+
+// Run polls the pools every interval until ctx is cancelled
+func (m *PoolerMonitor) Run(ctx context.Context) {
+	for {
+		timer := m.clock.NewTimer(m.interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+
+		if err := m.Refresh(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			m.logger.Error("Failed to poll the pooler's pools: %v", err)
+		}
+	}
+}
+
+// Pools returns the pools last polled and when they were, zero if never
+func (m *PoolerMonitor) Pools() ([]domain.PoolStats, time.Time) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]domain.PoolStats(nil), m.pools...), m.polledAt
+}
+
+// Saturation implements domain.PoolSaturation. Principals are proxied to the
+// pool of their user and database; when the pooler logs every client in as the
+// same user, the most saturated pool of the database counts. It is unknown
+// while the last pools polled are stale.
+func (m *PoolerMonitor) Saturation(user, database string) (int, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.polledAt.IsZero() || m.clock.Now().Sub(m.polledAt) > poolerStaleIntervals*m.interval {
+		return 0, false
+	}
+
+	saturation, found := 0, false
+	for _, pool := range m.pools {
+		if pool.Database != database {
+			continue
+		}
+		if pool.User == user {
+			return pool.Saturation(), true
+		}
+		saturation, found = max(saturation, pool.Saturation()), true
+	}
+	return saturation, found
+}
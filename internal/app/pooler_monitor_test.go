@@ -0,0 +1,57 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolerMonitor(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	console := &mocks.PoolerConsole{}
+	monitor := NewPoolerMonitor(console, 10*time.Second, clock, logger.NewSimpleLogger())
+
+	_, ok := monitor.Saturation("alice", "app")
+	assert.False(t, ok, "Saturation should be unknown before the first poll")
+
+	pools := []domain.PoolStats{
+		{Database: "app", User: "alice", Size: 10, ServersActive: 9},
+		{Database: "app", User: "bob", Size: 10, ServersActive: 2},
+		{Database: "reporting", User: "etl", Size: 5, ServersActive: 5, ClientsWaiting: 4},
+	}
+	console.On("Pools", ctx).Return(pools, nil).Once()
+	require.NoError(t, monitor.Refresh(ctx))
+
+	saturation, ok := monitor.Saturation("alice", "app")
+	assert.True(t, ok)
+	assert.Equal(t, 90, saturation)
+	saturation, _ = monitor.Saturation("bob", "app")
+	assert.Equal(t, 20, saturation)
+	saturation, ok = monitor.Saturation("carol", "reporting")
+	assert.True(t, ok)
+	assert.Equal(t, 100, saturation, "Principals without a pool of their own should get the busiest pool of their database")
+	_, ok = monitor.Saturation("alice", "other")
+	assert.False(t, ok)
+
+	console.On("Pools", ctx).Return(nil, errors.New("connection refused")).Once()
+	assert.Error(t, monitor.Refresh(ctx))
+	polled, polledAt := monitor.Pools()
+	assert.Equal(t, pools, polled, "Failures should keep the last pools polled")
+	assert.Equal(t, clock.Now(), polledAt)
+
+	clock.Advance(31 * time.Second)
+	_, ok = monitor.Saturation("alice", "app")
+	assert.False(t, ok, "Stale pools should not tighten quotas")
+
+	console.AssertExpectations(t)
+}
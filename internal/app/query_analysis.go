@@ -0,0 +1,83 @@
+package app
+
+import (
+	"pgbouncer-quota-enforcer/internal/app/domain"
+)
+
+// pgerrInsufficientPrivilege is the SQLSTATE reported for queries denied by a deny policy
+const pgerrInsufficientPrivilege = "42501"
+
+// queryAnalysis analyzes a query the first time a policy needs it, so queries no
+// cost or scoped policy applies to are never parsed
+type queryAnalysis struct {
+	analyzer   domain.QueryAnalyzer
+	normalizer domain.QueryNormalizer
+	query      *domain.Query
+
+	done   bool
+	result *domain.QueryAnalysis // nil when the query cannot be analyzed
+
+	normalizedDone bool
+	normalized     domain.NormalizedQuery
+}
+
+// get returns the analysis of the query, or nil when it cannot be analyzed
+func (a *queryAnalysis) get() *domain.QueryAnalysis {
+	if !a.done {
+		a.done = true
+		if a.analyzer != nil {
+			if result, err := a.analyzer.AnalyzeQuery(a.query); err == nil {
+				a.result = result
+			}
+		}
+	}
+	return a.result
+}
+
+// cost returns the estimated cost of the query, or 1 when it cannot be estimated
+func (a *queryAnalysis) cost() int64 {
+	if result := a.get(); result != nil && result.EstimatedCost > 1 {
+		return result.EstimatedCost
+	}
+	return 1
+}
+
+// access returns the first table access of the query a policy's scope matches.
+// Statements without tables are matched with an empty table. Queries that cannot
+// be analyzed match no scoped policy.
+func (a *queryAnalysis) access(policy domain.QuotaPolicy) (domain.QueryOperation, bool) {
+	result := a.get()
+	if result == nil {
+		return domain.QueryOperation{}, false
+	}
+
+	operations := result.Operations
+	if len(operations) == 0 {
+		operations = []domain.QueryOperation{{Type: string(result.QueryType)}}
+	}
+	for _, operation := range operations {
+		if policy.MatchesAccess(domain.QueryType(operation.Type), operation.Table) {
+			return operation, true
+		}
+	}
+	return domain.QueryOperation{}, false
+}
+
+// fingerprint returns the hash and normalized text of the query, normalizing it
+// when the connection did not. Queries that cannot be normalized have no hash
+// and keep their raw text.
+func (a *queryAnalysis) fingerprint() (string, string) {
+	if !a.normalizedDone {
+		a.normalizedDone = true
+		a.normalized = domain.NormalizedQuery{Original: a.query.Raw, Normalized: a.query.Normalized, Hash: a.query.Hash}
+		if a.query.Hash.Value() == "" && a.normalizer != nil {
+			if normalized, err := a.normalizer.Normalize(a.query.Raw); err == nil {
+				a.normalized = normalized
+			}
+		}
+		if a.normalized.Normalized == "" {
+			a.normalized.Normalized = a.query.Raw
+		}
+	}
+	return a.normalized.Hash.Value(), a.normalized.Normalized
+}
@@ -0,0 +1,261 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxQueryStats is how many query fingerprints are tracked, as
+	// pg_stat_statements.max
+	DefaultMaxQueryStats = 5000
+
+	// DefaultQueryStatsFlushInterval is how often query statistics are added to
+	// the usage store
+	DefaultQueryStatsFlushInterval = time.Minute
+
+	// queryStatsSamples is how many of the latest durations of a fingerprint its
+	// 95th percentile is computed over
+	queryStatsSamples = 128
+)
+
+// QueryStatsConfig configures the statistics kept per query fingerprint
+type QueryStatsConfig struct {
+	// Max caps the fingerprints tracked; the least recently seen are dropped
+	// beyond it. Zero uses DefaultMaxQueryStats.
+	Max int
+
+	// FlushInterval is how often the statistics are added to the usage store,
+	// when it keeps them; zero uses DefaultQueryStatsFlushInterval
+	FlushInterval time.Duration
+}
+
+// Validate checks that no setting is negative
+func (c QueryStatsConfig) Validate() error {
+	if c.Max < 0 || c.FlushInterval < 0 {
+		return fmt.Errorf("query statistics settings must not be negative")
+	}
+	return nil
+}
+
+// queryStatsEntry is the statistics of a fingerprint
+type queryStatsEntry struct {
+	stats   domain.QueryStats // since the collector started
+	flushed domain.QueryStats // the part of stats already saved
+	samples []time.Duration   // ring buffer of the latest durations
+	next    int
+}
+
+// p95 returns the 95th percentile of the sampled durations
+func (e *queryStatsEntry) p95() time.Duration {
+	if len(e.samples) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(e.samples)
+	slices.Sort(sorted)
+	return sorted[(len(sorted)*95+99)/100-1]
+}
+
+// QueryStatsCollector is a domain.PolicyEngine decorator that aggregates what
+// the statements of each query fingerprint consumed once they complete: calls,
+// durations, rows and bytes, like pg_stat_statements for the proxy layer. When
+// the usage store keeps query statistics they are added to it every flush
+// interval. It never changes decisions.
+type QueryStatsCollector struct {
+	next     domain.PolicyEngine
+	store    domain.QueryStatsStore // nil when statistics are kept in memory only
+	clock    domain.Clock
+	logger   logger.Logger
+	max      int
+	interval time.Duration
+
+	mu      sync.Mutex
+	entries map[domain.QueryHash]*queryStatsEntry
+
+	flushMu sync.Mutex // orders flushes so a fingerprint is never saved twice
+}
+
+// NewQueryStatsCollector creates a QueryStatsCollector observing the statements
+// charged through next. store may be nil.
+func NewQueryStatsCollector(next domain.PolicyEngine, store domain.QueryStatsStore, config QueryStatsConfig, clock domain.Clock, log logger.Logger) *QueryStatsCollector {
+	limit := config.Max
+	if limit == 0 {
+		limit = DefaultMaxQueryStats
+	}
+	interval := config.FlushInterval
+	if interval == 0 {
+		interval = DefaultQueryStatsFlushInterval
+	}
+	return &QueryStatsCollector{
+		next:     next,
+		store:    store,
+		clock:    clock,
+		logger:   log,
+		max:      limit,
+		interval: interval,
+		entries:  make(map[domain.QueryHash]*queryStatsEntry),
+	}
+}
+
+// Evaluate returns the decision of the wrapped engine
+func (c *QueryStatsCollector) Evaluate(ctx context.Context, query *domain.Query) (domain.Decision, error) {
+	return c.next.Evaluate(ctx, query)
+}
+
+// RecordUsage aggregates the usage of the query's fingerprint and forwards it to
+// the wrapped engine when it has metered quotas
+func (c *QueryStatsCollector) RecordUsage(ctx context.Context, query *domain.Query, usage domain.StatementUsage) error {
+	c.record(query, usage)
+	if recorder, ok := c.next.(domain.UsageRecorder); ok {
+		return recorder.RecordUsage(ctx, query, usage)
+	}
+	return nil
+}
+
+// record adds a completed statement to the statistics of its fingerprint.
+// Statements that could not be attributed to a query have none.
+func (c *QueryStatsCollector) record(query *domain.Query, usage domain.StatementUsage) {
+	if query.Hash.String() == "" {
+		return
+	}
+	now := c.clock.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[query.Hash]
+	if !ok {
+		if len(c.entries) >= c.max {
+			c.evict()
+		}
+		entry = &queryStatsEntry{
+			stats:   domain.QueryStats{Hash: query.Hash, Query: query.Normalized},
+			samples: make([]time.Duration, 0, queryStatsSamples),
+		}
+		c.entries[query.Hash] = entry
+	}
+
+	entry.stats.Calls++
+	entry.stats.TotalDuration += usage.Duration
+	entry.stats.Rows += usage.Rows
+	entry.stats.Bytes += usage.Bytes
+	entry.stats.LastSeen = now
+	if len(entry.samples) < cap(entry.samples) {
+		entry.samples = append(entry.samples, usage.Duration)
+	} else {
+		entry.samples[entry.next] = usage.Duration
+	}
+	entry.next = (entry.next + 1) % cap(entry.samples)
+}
+
+// evict drops the least recently seen 5% of the fingerprints, at least one, so
+// that a stream of one-off queries does not evict on every statement. What they
+// consumed since the last flush is not saved.
+func (c *QueryStatsCollector) evict() {
+	entries := make([]*queryStatsEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].stats.LastSeen.Before(entries[j].stats.LastSeen)
+	})
+	for _, entry := range entries[:max(len(entries)/20, 1)] {
+		delete(c.entries, entry.stats.Hash)
+	}
+}
+
+// QueryStats returns the statistics of the tracked fingerprints since the
+// collector started, the most time-consuming first
+func (c *QueryStatsCollector) QueryStats() []domain.QueryStats {
+	c.mu.Lock()
+	stats := make([]domain.QueryStats, 0, len(c.entries))
+	for _, entry := range c.entries {
+		snapshot := entry.stats
+		snapshot.P95Duration = entry.p95()
+		stats = append(stats, snapshot)
+	}
+	c.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].TotalDuration != stats[j].TotalDuration {
+			return stats[i].TotalDuration > stats[j].TotalDuration
+		}
+		return stats[i].Hash.String() < stats[j].Hash.String()
+	})
+	return stats
+}
+
+// Flush adds to the store what each fingerprint consumed since the last flush.
+// On failure it is added by the next one.
+func (c *QueryStatsCollector) Flush(ctx context.Context) error {
+	if c.store == nil {
+		return nil
+	}
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	type flushed struct {
+		entry *queryStatsEntry
+		stats domain.QueryStats
+	}
+	var pending []flushed
+	var deltas []domain.QueryStats
+	c.mu.Lock()
+	for _, entry := range c.entries {
+		if entry.stats.Calls == entry.flushed.Calls {
+			continue
+		}
+		stats := entry.stats
+		pending = append(pending, flushed{entry, stats})
+		deltas = append(deltas, domain.QueryStats{
+			Hash:          stats.Hash,
+			Query:         stats.Query,
+			Calls:         stats.Calls - entry.flushed.Calls,
+			TotalDuration: stats.TotalDuration - entry.flushed.TotalDuration,
+			P95Duration:   entry.p95(),
+			Rows:          stats.Rows - entry.flushed.Rows,
+			Bytes:         stats.Bytes - entry.flushed.Bytes,
+			LastSeen:      stats.LastSeen,
+		})
+	}
+	c.mu.Unlock()
+	if len(deltas) == 0 {
+		return nil
+	}
+
+	if err := c.store.SaveQueryStats(ctx, deltas); err != nil {
+		return fmt.Errorf("failed to save query statistics: %w", err)
+	}
+
+	c.mu.Lock()
+	for _, saved := range pending {
+		saved.entry.flushed = saved.stats
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// Run flushes the statistics every flush interval until ctx is cancelled
+func (c *QueryStatsCollector) Run(ctx context.Context) {
+	for {
+		timer := c.clock.NewTimer(c.interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+
+		if err := c.Flush(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			c.logger.Error("%v", err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// queryStatsStore records the statistics saved, failing while err is set
+type queryStatsStore struct {
+	saved [][]domain.QueryStats
+	err   error
+}
+
+func (s *queryStatsStore) SaveQueryStats(ctx context.Context, stats []domain.QueryStats) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.saved = append(s.saved, stats)
+	return nil
+}
+
+// newFingerprintQuery returns a query of alice with the given hash
+func newFingerprintQuery(hash, normalized string) *domain.Query {
+	query := newPrincipalQuery("alice")
+	query.Hash = domain.NewQueryHash(hash)
+	query.Normalized = normalized
+	return query
+}
+
+func TestQueryStatsCollector(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	collector := NewQueryStatsCollector(userDenyingPolicyEngine{}, nil, QueryStatsConfig{}, clock, logger.NewSimpleLogger())
+
+	for i := 1; i <= 100; i++ {
+		usage := domain.StatementUsage{Rows: 1, Bytes: 100, Duration: time.Duration(i) * time.Millisecond}
+		require.NoError(t, collector.RecordUsage(ctx, newFingerprintQuery("orders", "SELECT * FROM orders WHERE id = $1"), usage))
+	}
+	clock.Advance(time.Second)
+	usage := domain.StatementUsage{Rows: 1000, Duration: time.Second}
+	require.NoError(t, collector.RecordUsage(ctx, newFingerprintQuery("report", "SELECT * FROM sales"), usage))
+	require.NoError(t, collector.RecordUsage(ctx, newPrincipalQuery("alice"), usage), "Unattributed statements should be ignored")
+
+	stats := collector.QueryStats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, domain.QueryStats{
+		Hash:          domain.NewQueryHash("orders"),
+		Query:         "SELECT * FROM orders WHERE id = $1",
+		Calls:         100,
+		TotalDuration: 5050 * time.Millisecond,
+		P95Duration:   95 * time.Millisecond,
+		Rows:          100,
+		Bytes:         10000,
+		LastSeen:      time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC),
+	}, stats[0], "The most time-consuming fingerprint should come first")
+	assert.Equal(t, 50500*time.Microsecond, stats[0].MeanDuration())
+	assert.Equal(t, "report", stats[1].Hash.String())
+	assert.Equal(t, time.Second, stats[1].P95Duration)
+}
+
+func TestQueryStatsCollector_EvictsLeastRecentlySeen(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	collector := NewQueryStatsCollector(userDenyingPolicyEngine{}, nil, QueryStatsConfig{Max: 2}, clock, logger.NewSimpleLogger())
+
+	for _, hash := range []string{"a", "b", "a", "c"} {
+		clock.Advance(time.Second)
+		require.NoError(t, collector.RecordUsage(ctx, newFingerprintQuery(hash, ""), domain.StatementUsage{Duration: time.Millisecond}))
+	}
+
+	stats := collector.QueryStats()
+	require.Len(t, stats, 2)
+	assert.ElementsMatch(t, []string{"a", "c"}, []string{stats[0].Hash.String(), stats[1].Hash.String()})
+}
+
+func TestQueryStatsCollector_FlushesDeltas(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	store := &queryStatsStore{err: errors.New("database is locked")}
+	collector := NewQueryStatsCollector(userDenyingPolicyEngine{}, store, QueryStatsConfig{}, clock, logger.NewSimpleLogger())
+	record := func(calls int) {
+		for i := 0; i < calls; i++ {
+			require.NoError(t, collector.RecordUsage(ctx, newFingerprintQuery("orders", ""), domain.StatementUsage{Rows: 2, Duration: time.Millisecond}))
+		}
+	}
+
+	record(3)
+	assert.Error(t, collector.Flush(ctx))
+	store.err = nil
+	record(1)
+	require.NoError(t, collector.Flush(ctx))
+	require.Len(t, store.saved, 1)
+	assert.Equal(t, int64(4), store.saved[0][0].Calls, "A failed flush should be covered by the next one")
+	assert.Equal(t, int64(8), store.saved[0][0].Rows)
+
+	require.NoError(t, collector.Flush(ctx))
+	assert.Len(t, store.saved, 1, "Fingerprints without new calls should not be saved")
+
+	record(2)
+	require.NoError(t, collector.Flush(ctx))
+	require.Len(t, store.saved, 2)
+	assert.Equal(t, int64(2), store.saved[1][0].Calls)
+	assert.Equal(t, 2*time.Millisecond, store.saved[1][0].TotalDuration)
+	assert.Equal(t, int64(6), collector.QueryStats()[0].Calls, "Statistics should keep counting since the start")
+}
+
+func TestQueryStatsConfig_Validate(t *testing.T) {
+	assert.NoError(t, QueryStatsConfig{}.Validate())
+	assert.Error(t, QueryStatsConfig{Max: -1}.Validate())
+	assert.Error(t, QueryStatsConfig{FlushInterval: -time.Second}.Validate())
+}
@@ -0,0 +1,1191 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuotaService implements domain.PolicyEngine with windowed query-count policies,
+// rate limits and concurrency caps, domain.UsageRecorder with windowed metered policies and
+// domain.ConnectionLimiter with the connection caps of its policies
+type QuotaService struct {
+	store      domain.UsageStore
+	weights    domain.UsageWeights
+	analyzer   domain.QueryAnalyzer
+	normalizer domain.QueryNormalizer
+	clock      domain.Clock
+	limiter    *RateLimiter
+	running    *ConcurrencyLimiter
+	mu         sync.RWMutex
+	policies   []domain.QuotaPolicy
+	allowed    map[string][]domain.RecurringWindow // windows lifting each deny policy
+	active     map[string][]domain.RecurringWindow // windows scheduled policies apply in
+	patterns   map[string][]*regexp.Regexp         // compiled patterns of each policy
+	members    map[string]map[string]bool          // users of each role
+	identities domain.IdentityResolver             // groups users are members of as of roles; nil for none
+
+	connectionsMu sync.Mutex
+	connections   map[domain.UsageKey]int64 // open connections of principals under capped policies
+
+	// Quota alerts, raised when events is set
+	events     domain.EventSink
+	thresholds []int
+	blockedMu  sync.Mutex
+	blocked    map[domain.UsageKey]bool // principals denied by a policy since it last allowed them
+
+	graceMu  sync.Mutex
+	exceeded map[domain.UsageKey]time.Time // when principals went over the limit of a policy with a grace period
+
+	saturation domain.PoolSaturation // nil when policies are never tightened
+}
+
+// QuotaServiceOption configures optional behavior of a QuotaService
+type QuotaServiceOption func(*QuotaService)
+
+// WithUsageWeights sets how much quota each kind of query consumes
+func WithUsageWeights(weights domain.UsageWeights) QuotaServiceOption {
+	return func(s *QuotaService) {
+		s.weights = weights
+	}
+}
+
+// WithQueryAnalyzer analyzes queries with analyzer instead of pg_query, to
+// estimate the cost charged to cost policies and find the tables and statements
+// scoped policies apply to
+func WithQueryAnalyzer(analyzer domain.QueryAnalyzer) QuotaServiceOption {
+	return func(s *QuotaService) {
+		s.analyzer = analyzer
+	}
+}
+
+// WithQueryNormalizer fingerprints the queries the connection did not with
+// normalizer instead of pg_query
+func WithQueryNormalizer(normalizer domain.QueryNormalizer) QuotaServiceOption {
+	return func(s *QuotaService) {
+		s.normalizer = normalizer
+	}
+}
+
+// WithQuotaClock sets the clock timing rate limits and alerts
+func WithQuotaClock(clock domain.Clock) QuotaServiceOption {
+	return func(s *QuotaService) {
+		s.clock = clock
+	}
+}
+
+// WithQuotaAlerts emits a quota_threshold event when a principal's usage crosses
+// one of thresholds, percentages of a policy's limit, and a quota_blocked event
+// when a policy starts denying a principal
+func WithQuotaAlerts(thresholds []int, events domain.EventSink) QuotaServiceOption {
+	return func(s *QuotaService) {
+		s.thresholds = append([]int(nil), thresholds...)
+		sort.Ints(s.thresholds)
+		s.events = events
+		s.blocked = make(map[domain.UsageKey]bool)
+	}
+}
+
+// WithPoolSaturation tightens the policies with a TightenAt percentage while
+// the upstream pool of a principal is that saturated
+func WithPoolSaturation(saturation domain.PoolSaturation) QuotaServiceOption {
+	return func(s *QuotaService) {
+		s.saturation = saturation
+	}
+}
+
+// WithIdentityResolver makes the users identities finds in a group members of
+// the role of that name, in addition to the configured members
+func WithIdentityResolver(identities domain.IdentityResolver) QuotaServiceOption {
+	return func(s *QuotaService) {
+		s.identities = identities
+	}
+}
+
+// NewQuotaService creates a QuotaService evaluating the given policies against the store
+func NewQuotaService(store domain.UsageStore, policies []domain.QuotaPolicy, opts ...QuotaServiceOption) (*QuotaService, error) {
+	service := &QuotaService{
+		store:       store,
+		weights:     domain.DefaultUsageWeights(),
+		analyzer:    adapters.NewPgQueryAnalyzer(),
+		normalizer:  adapters.NewQueryNormalizer(adapters.DefaultNormalizer),
+		clock:       adapters.SystemClock{},
+		connections: make(map[domain.UsageKey]int64),
+		exceeded:    make(map[domain.UsageKey]time.Time),
+	}
+	for _, opt := range opts {
+		opt(service)
+	}
+	service.limiter = NewRateLimiter(service.clock)
+	service.running = NewConcurrencyLimiter(service.clock)
+	if err := service.weights.Validate(); err != nil {
+		return nil, err
+	}
+	for _, threshold := range service.thresholds {
+		if threshold <= 0 {
+			return nil, fmt.Errorf("quota alert thresholds must be positive")
+		}
+	}
+	if err := service.SetPolicies(policies); err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// SetPolicies validates and replaces the active policies
+func (s *QuotaService) SetPolicies(policies []domain.QuotaPolicy) error {
+	seen := make(map[string]struct{}, len(policies))
+	allowed := make(map[string][]domain.RecurringWindow)
+	active := make(map[string][]domain.RecurringWindow)
+	patterns := make(map[string][]*regexp.Regexp)
+	for _, policy := range policies {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+		if (policy.Scoped() || policy.Dimension == domain.QuotaDimensionCost) && !adapters.PgQueryAvailable {
+			return fmt.Errorf("quota policy %q analyzes queries with pg_query, which needs a binary built with cgo", policy.Name)
+		}
+		if _, dup := seen[policy.Name]; dup {
+			return fmt.Errorf("duplicate quota policy %q", policy.Name)
+		}
+		seen[policy.Name] = struct{}{}
+		for _, value := range policy.AllowDuring {
+			// Validate has parsed the window already
+			window, _ := domain.ParseRecurringWindow(value)
+			allowed[policy.Name] = append(allowed[policy.Name], window)
+		}
+		for _, value := range policy.ActiveDuring {
+			window, _ := domain.ParseRecurringWindow(value)
+			active[policy.Name] = append(active[policy.Name], window)
+		}
+		for _, pattern := range policy.Patterns {
+			// Validate has compiled the pattern already
+			patterns[policy.Name] = append(patterns[policy.Name], regexp.MustCompile(pattern))
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies = append([]domain.QuotaPolicy(nil), policies...)
+	s.allowed = allowed
+	s.active = active
+	s.patterns = patterns
+	return nil
+}
+
+// SetRoles replaces the members of the roles policies may apply to, as user
+// names by role name
+func (s *QuotaService) SetRoles(roles map[string][]string) {
+	members := make(map[string]map[string]bool, len(roles))
+	for role, users := range roles {
+		members[role] = make(map[string]bool, len(users))
+		for _, user := range users {
+			members[role][user] = true
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.members = members
+}
+
+// Policies returns a copy of the active policies
+func (s *QuotaService) Policies() []domain.QuotaPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]domain.QuotaPolicy(nil), s.policies...)
+}
+
+// Evaluate checks every matching policy and records usage when all of them allow the query.
+// Allow policies exempt the queries they apply to from every other policy, and deny
+// policies reject them outright, outside their allowed windows. The query consumes
+// the weight of its kind on query-count policies, and that weight times its
+// estimated cost on cost policies; zero-weight queries are always allowed by those.
+// Metered policies deny queries once their window is used up. An allowed query
+// carries the shortest statement timeout and the smallest result caps and
+// transaction limits of the matching policies. Checks and increments are not
+// atomic across policies, so concurrent queries may overshoot a limit by at
+// most the number of in-flight queries.
+//
+// Soft limits, and hard limits within their grace period, allow the queries
+// beyond them with a warning, as do limits used beyond their WarnAt percentage.
+//
+// An allowed query is then delayed until the rates of the matching rate-limited
+// policies allow it, also by the weight of its kind, and until it gets a slot
+// under their concurrency caps, before its usage is recorded. Slots are taken
+// by simple queries and executions, not Parse messages, and held until the
+// decision is released.
+//
+// Limits and rates are tightened while the upstream pool of the principal is
+// saturated, as reported by WithPoolSaturation.
+//
+// Queries evaluated with a domain.ChargeBatch are checked against their limits
+// counting the usage the batch holds back, and only wait for the rate limiters
+// and record their usage once the batch is committed.
+func (s *QuotaService) Evaluate(ctx context.Context, query *domain.Query) (domain.Decision, error) {
+	weight := s.weights.For(query.Kind)
+
+	analysis := s.analyze(query)
+	matching := s.queryPolicies(query, s.groups(ctx, query.UserID), analysis)
+	if len(matching) == 0 || exempt(matching) {
+		return domain.AllowDecision(), nil
+	}
+	saturation, tightened := s.tighten(matching, query)
+
+	now := s.clock.Now()
+	batch := domain.ChargeBatchOf(ctx)
+	for _, policy := range matching {
+		if policy.Deny && !s.allowedAt(policy, now) {
+			return s.accessDeniedDecision(policy, analysis), nil
+		}
+	}
+
+	var charged []chargedPolicy
+	var warnings []string
+	for _, policy := range matching {
+		if !policy.Windowed() {
+			continue
+		}
+
+		amount := weight
+		switch {
+		case policy.Metered():
+			// The query only needs some quota left; what it consumes is recorded later
+			amount = 1
+		case weight == 0:
+			continue
+		case policy.Dimension == domain.QuotaDimensionCost:
+			amount = weight * analysis.cost()
+		}
+
+		key := usageKey(policy, query)
+		usage, err := s.store.Get(ctx, key, policy.Window)
+		if err != nil {
+			return domain.Decision{}, fmt.Errorf("failed to read usage for %s: %w", key, err)
+		}
+		usage.Used += batch.Pending(key)
+
+		scale := policy.Dimension.Scale()
+		if usage.Used+amount > policy.Limit*scale {
+			used := usage.Used / scale
+			reason := fmt.Sprintf("quota %q exceeded: %d of %d %s per %s", policy.Name, used, policy.Limit, policy.Dimension.Unit(), policy.Window)
+			if tightened[policy.Name] {
+				reason += fmt.Sprintf(", tightened to %d%% while the upstream pool is %d%% saturated", policy.TightenTo, saturation)
+			}
+			if warning, ok := s.overLimitWarning(policy, key, reason, now); ok {
+				warnings = append(warnings, warning)
+			} else {
+				decision := domain.Decision{
+					Action:  domain.DecisionDeny,
+					Policy:  policy.Name,
+					Reason:  reason,
+					Limit:   policy.Limit,
+					Used:    used,
+					ResetAt: usage.ResetAt,
+					Hint:    policy.Hint,
+				}
+				s.alertBlocked(policy, query, key, decision)
+				return decision, nil
+			}
+		} else {
+			s.endGrace(policy, key)
+			if warning, ok := usageWarning(policy, usage, amount); ok {
+				warnings = append(warnings, warning)
+			}
+		}
+		s.unblock(key)
+		if !policy.Metered() {
+			charged = append(charged, chargedPolicy{policy: policy, amount: amount})
+		}
+	}
+
+	wait := func(ctx context.Context) error {
+		if _, err := s.limiter.Wait(ctx, matching, query, weight); err != nil {
+			return fmt.Errorf("rate-limited query abandoned: %w", err)
+		}
+		return nil
+	}
+	if batch == nil {
+		if err := wait(ctx); err != nil {
+			return domain.Decision{}, err
+		}
+	}
+
+	var release func()
+	if query.Kind != domain.QueryKindParse {
+		var denied domain.Decision
+		var err error
+		release, denied, err = s.running.Acquire(ctx, matching, query)
+		if err != nil || !denied.Allowed() {
+			// A batch only takes its tokens once all of its queries are allowed
+			if batch == nil {
+				s.limiter.Refund(matching, query, weight)
+			}
+			if err != nil {
+				return domain.Decision{}, fmt.Errorf("queued query abandoned: %w", err)
+			}
+			return denied, nil
+		}
+	}
+
+	if batch != nil {
+		// The batch waits for the rate limiters and charges its queries once
+		// all of them are allowed
+		batch.Defer(domain.UsageKey{}, 0, wait)
+		for _, charge := range charged {
+			batch.Defer(usageKey(charge.policy, query), charge.amount, func(ctx context.Context) error {
+				return s.charge(ctx, charge, query)
+			})
+		}
+	} else {
+		for _, charge := range charged {
+			if err := s.charge(ctx, charge, query); err != nil {
+				if release != nil {
+					release()
+				}
+				return domain.Decision{}, err
+			}
+		}
+	}
+
+	decision := domain.AllowDecision()
+	decision.Release = release
+	decision.Warnings = warnings
+	decision.StatementTimeout, decision.TimeoutPolicy = statementTimeout(matching)
+	decision.MaxResultRows, decision.ResultRowsPolicy = smallestLimit(matching, func(policy domain.QuotaPolicy) int64 { return policy.MaxResultRows })
+	decision.MaxResultBytes, decision.ResultBytesPolicy = smallestLimit(matching, func(policy domain.QuotaPolicy) int64 { return policy.MaxResultBytes })
+	decision.MaxTransactionDuration, decision.TransactionDurationPolicy = smallestLimit(matching, func(policy domain.QuotaPolicy) time.Duration { return policy.MaxTransactionDuration })
+	decision.MaxTransactionStatements, decision.TransactionStatementsPolicy = smallestLimit(matching, func(policy domain.QuotaPolicy) int64 { return policy.MaxTransactionStatements })
+	return decision, nil
+}
+
+// charge adds the amount a query is charged under a policy to its usage
+func (s *QuotaService) charge(ctx context.Context, charge chargedPolicy, query *domain.Query) error {
+	key := usageKey(charge.policy, query)
+	usage, err := s.store.Increment(ctx, key, charge.policy.Window, charge.amount)
+	if err != nil {
+		return fmt.Errorf("failed to record usage for %s: %w", key, err)
+	}
+	s.alertThresholds(charge.policy, query, usage, charge.amount)
+	return nil
+}
+
+// statementTimeout returns the shortest statement timeout of the policies and
+// the policy it comes from, or zero when none has one
+func statementTimeout(policies []domain.QuotaPolicy) (time.Duration, string) {
+	var timeout time.Duration
+	var name string
+	for _, policy := range policies {
+		if policy.StatementTimeout > 0 && (timeout == 0 || policy.StatementTimeout < timeout) {
+			timeout, name = policy.StatementTimeout, policy.Name
+		}
+	}
+	return timeout, name
+}
+
+// smallestLimit returns the smallest limit of the policies, as read by value,
+// and the policy it comes from, or zero when none has one
+func smallestLimit[T int64 | time.Duration](policies []domain.QuotaPolicy, value func(domain.QuotaPolicy) T) (T, string) {
+	var limit T
+	var name string
+	for _, policy := range policies {
+		if capped := value(policy); capped > 0 && (limit == 0 || capped < limit) {
+			limit, name = capped, policy.Name
+		}
+	}
+	return limit, name
+}
+
+// tighten replaces the policies that the saturation of the principal's upstream
+// pool tightens, and returns the saturation and the names of those policies
+func (s *QuotaService) tighten(policies []domain.QuotaPolicy, query *domain.Query) (int, map[string]bool) {
+	if s.saturation == nil || !slices.ContainsFunc(policies, func(policy domain.QuotaPolicy) bool { return policy.TightenAt > 0 }) {
+		return 0, nil
+	}
+	saturation, ok := s.saturation.Saturation(query.UserID, query.Database)
+	if !ok {
+		return 0, nil
+	}
+
+	var tightened map[string]bool
+	for i, policy := range policies {
+		if policy, ok := policy.Tightened(saturation); ok {
+			policies[i] = policy
+			if tightened == nil {
+				tightened = make(map[string]bool)
+			}
+			tightened[policy.Name] = true
+		}
+	}
+	return saturation, tightened
+}
+
+// usageWarning warns that the principal used WarnAt percent of the limit of the
+// policy or more, counting the amount the query consumes
+func usageWarning(policy domain.QuotaPolicy, usage domain.Usage, amount int64) (string, bool) {
+	if policy.WarnAt == 0 {
+		return "", false
+	}
+	used := usage.Used
+	if !policy.Metered() {
+		used += amount
+	}
+	limit := policy.Limit * policy.Dimension.Scale()
+	if used*100 < limit*int64(policy.WarnAt) {
+		return "", false
+	}
+	return fmt.Sprintf("you have used %d%% of quota %q: %d of %d %s per %s; resets at %s",
+		used*100/limit, policy.Name, used/policy.Dimension.Scale(), policy.Limit, policy.Dimension.Unit(), policy.Window,
+		usage.ResetAt.UTC().Format(time.RFC3339)), true
+}
+
+// overLimitWarning returns the warning allowing a query beyond the limit of a
+// soft policy, or of a hard policy within the grace period that started when its
+// principal first went over the limit, and false when the query is denied
+func (s *QuotaService) overLimitWarning(policy domain.QuotaPolicy, key domain.UsageKey, reason string, now time.Time) (string, bool) {
+	if policy.Soft {
+		return reason + "; the limit is soft, so queries are still allowed", true
+	}
+	if policy.Grace <= 0 {
+		return "", false
+	}
+
+	s.graceMu.Lock()
+	since, ok := s.exceeded[key]
+	if !ok {
+		since = now
+		s.exceeded[key] = since
+	}
+	s.graceMu.Unlock()
+
+	deadline := since.Add(policy.Grace)
+	if !now.Before(deadline) {
+		return "", false
+	}
+	return fmt.Sprintf("%s; queries will be denied from %s", reason, deadline.UTC().Format(time.RFC3339)), true
+}
+
+// endGrace forgets when the principal of key went over the limit of a policy
+// with a grace period, once its usage is back under the limit
+func (s *QuotaService) endGrace(policy domain.QuotaPolicy, key domain.UsageKey) {
+	if policy.Grace <= 0 {
+		return
+	}
+	s.graceMu.Lock()
+	delete(s.exceeded, key)
+	s.graceMu.Unlock()
+}
+
+// chargedPolicy is a policy that allowed a query and the amount it charges for it
+type chargedPolicy struct {
+	policy domain.QuotaPolicy
+	amount int64
+}
+
+// allowedAt reports whether one of the allowed windows of a deny policy covers t
+func (s *QuotaService) allowedAt(policy domain.QuotaPolicy, t time.Time) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, window := range s.allowed[policy.Name] {
+		if window.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// activeAt reports whether one of the windows of a scheduled policy covers t;
+// s.mu must be held
+func (s *QuotaService) activeAt(policy domain.QuotaPolicy, t time.Time) bool {
+	for _, window := range s.active[policy.Name] {
+		if window.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// exempt reports whether an allow policy is among those matching a query
+func exempt(policies []domain.QuotaPolicy) bool {
+	return slices.ContainsFunc(policies, func(policy domain.QuotaPolicy) bool { return policy.Allow })
+}
+
+// accessDeniedDecision denies a query a deny policy applies to, naming the
+// fingerprint or pattern, or else the statement and table, it matched
+func (s *QuotaService) accessDeniedDecision(policy domain.QuotaPolicy, analysis *queryAnalysis) domain.Decision {
+	reason := fmt.Sprintf("queries denied by policy %q", policy.Name)
+	if match, ok := s.queryMatch(policy, analysis); ok && policy.Fingerprinted() {
+		reason = fmt.Sprintf("%s denied by policy %q", match, policy.Name)
+	} else if policy.Scoped() {
+		// Scoped policies only apply to queries with a matching access
+		access, _ := analysis.access(policy)
+		reason = fmt.Sprintf("%s denied by policy %q", access.Type, policy.Name)
+		if access.Table != "" {
+			reason = fmt.Sprintf("%s on %s denied by policy %q", access.Type, access.Table, policy.Name)
+		}
+	}
+	if len(policy.AllowDuring) > 0 {
+		reason = fmt.Sprintf("%s outside %s", reason, strings.Join(policy.AllowDuring, ", "))
+	}
+	return domain.Decision{
+		Action: domain.DecisionDeny,
+		Policy: policy.Name,
+		Reason: reason,
+		Code:   pgerrInsufficientPrivilege,
+		Hint:   policy.Hint,
+	}
+}
+
+// RecordUsage charges the bytes, rows and execution time of a statement to the
+// matching metered policies, unless an allow policy exempts it. The statement is
+// never denied since it already ran.
+func (s *QuotaService) RecordUsage(ctx context.Context, query *domain.Query, usage domain.StatementUsage) error {
+	matching := s.queryPolicies(query, s.groups(ctx, query.UserID), s.analyze(query))
+	if exempt(matching) {
+		return nil
+	}
+	for _, policy := range matching {
+		if !policy.Windowed() {
+			continue
+		}
+
+		var amount int64
+		switch policy.Dimension {
+		case domain.QuotaDimensionBytes:
+			amount = usage.Bytes
+		case domain.QuotaDimensionRows:
+			amount = usage.Rows
+		case domain.QuotaDimensionSeconds:
+			amount = usage.Duration.Milliseconds()
+		}
+		if amount <= 0 {
+			continue
+		}
+
+		key := usageKey(policy, query)
+		counted, err := s.store.Increment(ctx, key, policy.Window, amount)
+		if err != nil {
+			return fmt.Errorf("failed to record usage for %s: %w", key, err)
+		}
+		s.alertThresholds(policy, query, counted, amount)
+	}
+	return nil
+}
+
+// ChargeUsage charges what a principal consumed without its queries being
+// evaluated, such as the queries a pooler reports it ran, to the windowed
+// policies matching the principal's connections, and returns whether it may go
+// on running queries. Weights do not apply and cost, scoped and fingerprinted
+// policies are left out, since the queries themselves are not known. A
+// principal is denied once its usage reaches a hard limit, after the grace
+// period if there is one.
+func (s *QuotaService) ChargeUsage(ctx context.Context, user, database string, queries int64, usage domain.StatementUsage) (domain.Decision, error) {
+	query := &domain.Query{UserID: user, Database: database}
+	matching := s.sessionPolicies(domain.Session{User: user, Database: database}, s.groups(ctx, user))
+	saturation, tightened := s.tighten(matching, query)
+
+	now := s.clock.Now()
+	decision := domain.AllowDecision()
+	for _, policy := range matching {
+		if !policy.Windowed() || policy.Dimension == domain.QuotaDimensionCost || policy.Scoped() || policy.Fingerprinted() {
+			continue
+		}
+
+		var amount int64
+		switch policy.Dimension {
+		case "", domain.QuotaDimensionQueries:
+			amount = queries
+		case domain.QuotaDimensionBytes:
+			amount = usage.Bytes
+		case domain.QuotaDimensionRows:
+			amount = usage.Rows
+		case domain.QuotaDimensionSeconds:
+			amount = usage.Duration.Milliseconds()
+		}
+
+		key := usageKey(policy, query)
+		var counted domain.Usage
+		var err error
+		if amount > 0 {
+			counted, err = s.store.Increment(ctx, key, policy.Window, amount)
+		} else {
+			counted, err = s.store.Get(ctx, key, policy.Window)
+		}
+		if err != nil {
+			return domain.Decision{}, fmt.Errorf("failed to record usage for %s: %w", key, err)
+		}
+		if amount > 0 {
+			s.alertThresholds(policy, query, counted, amount)
+		}
+
+		scale := policy.Dimension.Scale()
+		if counted.Used < policy.Limit*scale {
+			s.endGrace(policy, key)
+			s.unblock(key)
+			continue
+		}
+		used := counted.Used / scale
+		reason := fmt.Sprintf("quota %q exceeded: %d of %d %s per %s", policy.Name, used, policy.Limit, policy.Dimension.Unit(), policy.Window)
+		if tightened[policy.Name] {
+			reason += fmt.Sprintf(", tightened to %d%% while the upstream pool is %d%% saturated", policy.TightenTo, saturation)
+		}
+		if _, ok := s.overLimitWarning(policy, key, reason, now); ok || decision.Action == domain.DecisionDeny {
+			// Usage is still charged to the remaining policies
+			continue
+		}
+		decision = domain.Decision{
+			Action:  domain.DecisionDeny,
+			Policy:  policy.Name,
+			Reason:  reason,
+			Limit:   policy.Limit,
+			Used:    used,
+			ResetAt: counted.ResetAt,
+			Hint:    policy.Hint,
+		}
+		s.alertBlocked(policy, query, key, decision)
+	}
+	return decision, nil
+}
+
+// alertThresholds emits a quota_threshold event for every threshold the usage
+// crossed when amount was added to it
+func (s *QuotaService) alertThresholds(policy domain.QuotaPolicy, query *domain.Query, usage domain.Usage, amount int64) {
+	if s.events == nil {
+		return
+	}
+
+	limit := policy.Limit * policy.Dimension.Scale()
+	before := usage.Used - amount
+	for _, threshold := range s.thresholds {
+		// Compare in hundredths to stay exact
+		boundary := limit * int64(threshold)
+		if before*100 >= boundary || usage.Used*100 < boundary {
+			continue
+		}
+		s.events.Emit(domain.Event{
+			Type:         domain.EventQuotaThreshold,
+			Timestamp:    s.clock.Now(),
+			ConnectionID: query.ConnectionID,
+			Fields: map[string]interface{}{
+				"user":      query.UserID,
+				"database":  query.Database,
+				"policy":    policy.Name,
+				"threshold": threshold,
+				"used":      usage.Used / policy.Dimension.Scale(),
+				"limit":     policy.Limit,
+				"unit":      policy.Dimension.Unit(),
+				"window":    policy.Window.String(),
+				"reset_at":  usage.ResetAt,
+			},
+		})
+	}
+}
+
+// alertBlocked emits a quota_blocked event when the policy denies the principal
+// for the first time since it last allowed it
+func (s *QuotaService) alertBlocked(policy domain.QuotaPolicy, query *domain.Query, key domain.UsageKey, decision domain.Decision) {
+	if s.events == nil {
+		return
+	}
+
+	s.blockedMu.Lock()
+	reported := s.blocked[key]
+	s.blocked[key] = true
+	s.blockedMu.Unlock()
+	if reported {
+		return
+	}
+
+	s.events.Emit(domain.Event{
+		Type:         domain.EventQuotaBlocked,
+		Timestamp:    s.clock.Now(),
+		ConnectionID: query.ConnectionID,
+		Fields: map[string]interface{}{
+			"user":     query.UserID,
+			"database": query.Database,
+			"policy":   policy.Name,
+			"used":     decision.Used,
+			"limit":    decision.Limit,
+			"unit":     policy.Dimension.Unit(),
+			"window":   policy.Window.String(),
+			"reset_at": decision.ResetAt,
+			"reason":   decision.Reason,
+		},
+	})
+}
+
+// unblock forgets that the policy of key denied its principal, so that the next
+// denial is reported again
+func (s *QuotaService) unblock(key domain.UsageKey) {
+	if s.events == nil {
+		return
+	}
+
+	s.blockedMu.Lock()
+	delete(s.blocked, key)
+	s.blockedMu.Unlock()
+}
+
+// AcquireConnection counts the session's connection against the connection cap of
+// every matching policy. The connection is denied, and counted nowhere, when one
+// of them is reached. An admitted connection's decision carries the startup
+// parameters of the matching policies.
+func (s *QuotaService) AcquireConnection(session domain.Session) (func(), domain.Decision) {
+	policies := s.sessionPolicies(session, s.groups(context.Background(), session.User))
+	var capped []domain.QuotaPolicy
+	for _, policy := range policies {
+		if policy.MaxConnections > 0 {
+			capped = append(capped, policy)
+		}
+	}
+	allowed := domain.AllowDecision()
+	allowed.StartupParameters = startupParameters(policies, session)
+	if len(capped) == 0 {
+		return func() {}, allowed
+	}
+
+	keys := make([]domain.UsageKey, len(capped))
+	s.connectionsMu.Lock()
+	defer s.connectionsMu.Unlock()
+	for i, policy := range capped {
+		keys[i] = domain.UsageKey{Policy: policy.Name, User: session.User, Database: session.Database}
+		if open := s.connections[keys[i]]; open >= policy.MaxConnections {
+			return func() {}, connectionLimitDecision(policy, session, open)
+		}
+	}
+	for _, key := range keys {
+		s.connections[key]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.connectionsMu.Lock()
+			defer s.connectionsMu.Unlock()
+			for _, key := range keys {
+				if s.connections[key]--; s.connections[key] <= 0 {
+					delete(s.connections, key)
+				}
+			}
+		})
+	}, allowed
+}
+
+// startupParameters merges the startup parameters of policies for the session's
+// connection. Those of more specific policies win, then those of the policy
+// whose name sorts last, so the outcome does not depend on the order of the
+// policies.
+func startupParameters(policies []domain.QuotaPolicy, session domain.Session) map[string]string {
+	var setting []domain.QuotaPolicy
+	for _, policy := range policies {
+		if len(policy.StartupParameters) > 0 {
+			setting = append(setting, policy)
+		}
+	}
+	if len(setting) == 0 {
+		return nil
+	}
+	sort.Slice(setting, func(i, j int) bool {
+		if setting[i].Specificity() != setting[j].Specificity() {
+			return setting[i].Specificity() < setting[j].Specificity()
+		}
+		return setting[i].Name < setting[j].Name
+	})
+
+	params := make(map[string]string)
+	for _, policy := range setting {
+		for name, value := range policy.ExpandStartupParameters(session) {
+			params[name] = value
+		}
+	}
+	return params
+}
+
+// connectionLimitDecision denies a connection beyond the cap of policy, naming
+// the database when the policy only restricts databases, as PostgreSQL does
+func connectionLimitDecision(policy domain.QuotaPolicy, session domain.Session, open int64) domain.Decision {
+	reason := fmt.Sprintf("too many connections for role %q", session.User)
+	if policy.User == "" && policy.Database != "" {
+		reason = fmt.Sprintf("too many connections for database %q", session.Database)
+	}
+	return domain.Decision{
+		Action: domain.DecisionDeny,
+		Policy: policy.Name,
+		Reason: reason,
+		Limit:  policy.MaxConnections,
+		Used:   open,
+		Hint:   policy.Hint,
+	}
+}
+
+// PolicyUsage is what a principal consumed under a policy in its current window
+type PolicyUsage struct {
+	Policy  domain.QuotaPolicy
+	Used    int64 // in the units of the policy's limit
+	ResetAt time.Time
+}
+
+// Usage returns the usage of the principal under every policy that may apply to
+// it. Policies restricted to connection labels are included since the labels of
+// the principal's connections are not known here; label is the value whose
+// usage is returned under the policies counting label values apart.
+func (s *QuotaService) Usage(ctx context.Context, user, database, label string) ([]PolicyUsage, error) {
+	var usages []PolicyUsage
+	for _, policy := range s.principalPolicies(user, s.groups(ctx, user), database) {
+		if !policy.Windowed() {
+			continue
+		}
+
+		key := labelUsageKey(policy, user, database, label)
+		usage, err := s.store.Get(ctx, key, policy.Window)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read usage for %s: %w", key, err)
+		}
+		usages = append(usages, PolicyUsage{
+			Policy:  policy,
+			Used:    usage.Used / policy.Dimension.Scale(),
+			ResetAt: usage.ResetAt,
+		})
+	}
+	return usages, nil
+}
+
+// PolicyCredits is the credit balance of a principal under a policy with credits
+type PolicyCredits struct {
+	Policy  domain.QuotaPolicy
+	Balance float64
+	FullAt  time.Time // when the balance will be full again if the principal stays idle
+}
+
+// Credits returns the credit balances of the principal under every policy with
+// credits that may apply to it
+func (s *QuotaService) Credits(ctx context.Context, user, database string) []PolicyCredits {
+	var credits []PolicyCredits
+	for _, policy := range s.principalPolicies(user, s.groups(ctx, user), database) {
+		if policy.Credits == 0 {
+			continue
+		}
+		balance, fullAt := s.limiter.Credits(policy, user, database)
+		credits = append(credits, PolicyCredits{Policy: policy, Balance: balance, FullAt: fullAt})
+	}
+	return credits
+}
+
+// QuotaStatus returns the usage of the windowed policies applying to the
+// session's connection, given its listener and labels
+func (s *QuotaService) QuotaStatus(ctx context.Context, session domain.Session) ([]domain.QuotaStatus, error) {
+	var statuses []domain.QuotaStatus
+	for _, policy := range s.sessionPolicies(session, s.groups(ctx, session.User)) {
+		if !policy.Windowed() {
+			continue
+		}
+
+		key := policy.UsageKey(session.User, session.Database, session.Labels)
+		usage, err := s.store.Get(ctx, key, policy.Window)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read usage for %s: %w", key, err)
+		}
+		statuses = append(statuses, domain.QuotaStatus{
+			Policy:    policy.Name,
+			Dimension: policy.Dimension,
+			Limit:     policy.Limit,
+			Used:      usage.Used / policy.Dimension.Scale(),
+			Window:    policy.Window,
+			ResetAt:   usage.ResetAt,
+		})
+	}
+	return statuses, nil
+}
+
+// ResetUsage clears the counters of the principal under the named policy, or under
+// every policy that may apply to it when name is empty, those of label under the
+// policies counting label values apart. It reports whether a policy was found.
+func (s *QuotaService) ResetUsage(ctx context.Context, user, database, label, name string) (bool, error) {
+	found := false
+	for _, policy := range s.principalPolicies(user, s.groups(ctx, user), database) {
+		if name != "" && policy.Name != name {
+			continue
+		}
+		found = true
+
+		key := labelUsageKey(policy, user, database, label)
+		if err := s.store.Reset(ctx, key); err != nil {
+			return found, fmt.Errorf("failed to reset usage for %s: %w", key, err)
+		}
+	}
+	return found, nil
+}
+
+// labelUsageKey builds the counter key for a policy, principal and value of the
+// policy's PerLabel label
+func labelUsageKey(policy domain.QuotaPolicy, user, database, label string) domain.UsageKey {
+	return policy.UsageKey(user, database, map[string]string{policy.PerLabel: label})
+}
+
+// PolicyExplanation tells whether a policy applies to a query, and why
+type PolicyExplanation struct {
+	Policy     domain.QuotaPolicy // less the limits overrides replaced
+	Applies    bool
+	Reason     string
+	ReplacedBy string // the override that replaced limits of the policy, if any
+}
+
+// Explain tells which of the policies matching the query's principal apply to
+// the query and why, from the most specific. Policies whose limits overrides all
+// replaced, fingerprinted and scoped policies the query does not match, and the
+// policies an allow policy exempts the query from do not apply.
+func (s *QuotaService) Explain(query *domain.Query) []PolicyExplanation {
+	matching := s.principalMatches(query, s.groups(context.Background(), query.UserID))
+	applied, replacedBy := applyOverrides(matching)
+	trimmed := make(map[string]domain.QuotaPolicy, len(applied))
+	for _, policy := range applied {
+		trimmed[policy.Name] = policy
+	}
+
+	analysis := s.analyze(query)
+	explanations := make([]PolicyExplanation, 0, len(matching))
+	exemptedBy := ""
+	for _, policy := range matching {
+		explanation := PolicyExplanation{Policy: policy, ReplacedBy: replacedBy[policy.Name]}
+		if policy, ok := trimmed[policy.Name]; !ok {
+			explanation.Reason = fmt.Sprintf("limits replaced by override %q", explanation.ReplacedBy)
+		} else if _, ok := s.queryMatch(policy, analysis); policy.Fingerprinted() && !ok {
+			explanation.Reason = "query matches none of its fingerprints and patterns"
+		} else if _, ok := analysis.access(policy); policy.Scoped() && !ok {
+			explanation.Reason = "no statement of the query matches its scope"
+		} else {
+			explanation.Policy = policy
+			explanation.Applies = true
+			explanation.Reason = principalReason(policy, query)
+			if policy.Allow && exemptedBy == "" {
+				exemptedBy = policy.Name
+			}
+		}
+		explanations = append(explanations, explanation)
+	}
+
+	if exemptedBy != "" {
+		for i, explanation := range explanations {
+			if explanation.Applies && !explanation.Policy.Allow {
+				explanations[i].Applies = false
+				explanations[i].Reason = fmt.Sprintf("query exempted by allow policy %q", exemptedBy)
+			}
+		}
+	}
+	sort.SliceStable(explanations, func(i, j int) bool {
+		return explanations[i].Policy.Specificity() > explanations[j].Policy.Specificity()
+	})
+	return explanations
+}
+
+// principalReason describes how the query's connection matches the policy
+func principalReason(policy domain.QuotaPolicy, query *domain.Query) string {
+	var parts []string
+	if policy.User != "" {
+		parts = append(parts, "user "+query.UserID)
+	}
+	if policy.Role != "" {
+		parts = append(parts, fmt.Sprintf("member %s of role %s", query.UserID, policy.Role))
+	}
+	if policy.Database != "" {
+		parts = append(parts, "database "+query.Database)
+	}
+	if policy.Listener != "" {
+		parts = append(parts, "listener "+query.Listener)
+	}
+	if len(policy.Labels) > 0 {
+		parts = append(parts, "connection labels")
+	}
+	if policy.Scheduled() {
+		parts = append(parts, "window "+strings.Join(policy.ActiveDuring, ", "))
+	}
+	if len(parts) == 0 {
+		return "applies to every connection"
+	}
+	return "matches " + strings.Join(parts, ", ")
+}
+
+// principalPolicies returns the policies applying to the user, member of groups,
+// and database, whatever their labels and listener
+func (s *QuotaService) principalPolicies(user string, groups []string, database string) []domain.QuotaPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matching []domain.QuotaPolicy
+	for _, policy := range s.policies {
+		if s.matches(policy, policy.Listener, user, groups, database, policy.Labels) {
+			matching = append(matching, policy)
+		}
+	}
+	applied, _ := applyOverrides(matching)
+	return applied
+}
+
+// sessionPolicies returns the policies applying to the session's connection,
+// its user being a member of groups
+func (s *QuotaService) sessionPolicies(session domain.Session, groups []string) []domain.QuotaPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matching []domain.QuotaPolicy
+	for _, policy := range s.policies {
+		if s.matches(policy, session.Listener, session.User, groups, session.Database, session.Labels) {
+			matching = append(matching, policy)
+		}
+	}
+	applied, _ := applyOverrides(matching)
+	return applied
+}
+
+// matchingPolicies returns the policies applying to the query's principal, its
+// user being a member of groups
+func (s *QuotaService) matchingPolicies(query *domain.Query, groups []string) []domain.QuotaPolicy {
+	applied, _ := applyOverrides(s.principalMatches(query, groups))
+	return applied
+}
+
+// principalMatches returns the policies matching the query's principal, before
+// overrides replace any
+func (s *QuotaService) principalMatches(query *domain.Query, groups []string) []domain.QuotaPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matching []domain.QuotaPolicy
+	for _, policy := range s.policies {
+		if s.matches(policy, query.Listener, query.UserID, groups, query.Database, query.Labels) {
+			matching = append(matching, policy)
+		}
+	}
+	return matching
+}
+
+// matches reports whether the policy applies to connections of the listener,
+// user, database and labels, the user being a member of its role if it has
+// one, as configured or through one of groups, and one of its windows being
+// open if it is scheduled; s.mu must be held
+func (s *QuotaService) matches(policy domain.QuotaPolicy, listener, user string, groups []string, database string, labels map[string]string) bool {
+	if policy.Scheduled() && !s.activeAt(policy, s.clock.Now()) {
+		return false
+	}
+	if policy.Role != "" && !s.members[policy.Role][user] && !slices.Contains(groups, policy.Role) {
+		return false
+	}
+	return policy.Matches(listener, user, database, labels)
+}
+
+// groups returns the groups of user found by the identity resolver, none when
+// there is no resolver or it fails
+func (s *QuotaService) groups(ctx context.Context, user string) []string {
+	if s.identities == nil || user == "" {
+		return nil
+	}
+	groups, err := s.identities.Groups(ctx, user)
+	if err != nil {
+		return nil
+	}
+	return groups
+}
+
+// applyOverrides returns the matching policies less the limits that more
+// specific overrides among them replace, dropping those left without any, and
+// the override that replaced limits of each policy. Overrides are applied from
+// the most specific, by name among equally specific ones, so the outcome does
+// not depend on the order of the policies.
+func applyOverrides(matching []domain.QuotaPolicy) ([]domain.QuotaPolicy, map[string]string) {
+	var overrides []domain.QuotaPolicy
+	for _, policy := range matching {
+		if policy.Override {
+			overrides = append(overrides, policy)
+		}
+	}
+	if len(overrides) == 0 {
+		return matching, nil
+	}
+	sort.Slice(overrides, func(i, j int) bool {
+		if overrides[i].Specificity() != overrides[j].Specificity() {
+			return overrides[i].Specificity() > overrides[j].Specificity()
+		}
+		return overrides[i].Name < overrides[j].Name
+	})
+
+	applied := make([]domain.QuotaPolicy, 0, len(matching))
+	replacedBy := make(map[string]string)
+	for _, policy := range matching {
+		if policy.Replaceable() {
+			for _, override := range overrides {
+				if override.Specificity() <= policy.Specificity() {
+					continue
+				}
+				trimmed, replaced := policy.Overridden(override)
+				if replaced && replacedBy[policy.Name] == "" {
+					replacedBy[policy.Name] = override.Name
+				}
+				policy = trimmed
+			}
+			if !policy.Limited() && len(policy.StartupParameters) == 0 {
+				continue
+			}
+		}
+		applied = append(applied, policy)
+	}
+	return applied, replacedBy
+}
+
+// queryPolicies returns the policies applying to the query: those matching its
+// principal, less the fingerprinted policies the query does not match and the
+// scoped policies none of its statements match
+func (s *QuotaService) queryPolicies(query *domain.Query, groups []string, analysis *queryAnalysis) []domain.QuotaPolicy {
+	var policies []domain.QuotaPolicy
+	for _, policy := range s.matchingPolicies(query, groups) {
+		if policy.Fingerprinted() {
+			if _, ok := s.queryMatch(policy, analysis); !ok {
+				continue
+			}
+		}
+		if policy.Scoped() {
+			if _, ok := analysis.access(policy); !ok {
+				continue
+			}
+		}
+		policies = append(policies, policy)
+	}
+	return policies
+}
+
+// queryMatch reports whether the query has one of the fingerprints of a policy or
+// matches one of its patterns, and describes the match
+func (s *QuotaService) queryMatch(policy domain.QuotaPolicy, analysis *queryAnalysis) (string, bool) {
+	hash, text := analysis.fingerprint()
+	for _, fingerprint := range policy.Fingerprints {
+		if hash != "" && strings.EqualFold(fingerprint, hash) {
+			return "query " + hash, true
+		}
+	}
+
+	s.mu.RLock()
+	patterns := s.patterns[policy.Name]
+	s.mu.RUnlock()
+	for _, pattern := range patterns {
+		if pattern.MatchString(text) {
+			return fmt.Sprintf("query matching %q", pattern.String()), true
+		}
+	}
+	return "", false
+}
+
+// analyze prepares the lazy analysis of a query
+func (s *QuotaService) analyze(query *domain.Query) *queryAnalysis {
+	return &queryAnalysis{analyzer: s.analyzer, normalizer: s.normalizer, query: query}
+}
+
+// usageKey builds the counter key for a policy and query principal
+func usageKey(policy domain.QuotaPolicy, query *domain.Query) domain.UsageKey {
+	return policy.UsageKey(query.UserID, query.Database, query.Labels)
+}
@@ -0,0 +1,1243 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestQuery(user, database string) *domain.Query {
+	query := domain.NewQuery("SELECT 1", "conn_1")
+	query.UserID = user
+	query.Database = database
+	return query
+}
+
+func TestQuotaService_Evaluate(t *testing.T) {
+	ctx := context.Background()
+
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "alice-hourly", User: "alice", Limit: 2, Window: time.Hour},
+		{Name: "reporting", Database: "reporting", Limit: 1, Window: time.Hour},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		decision, err := service.Evaluate(ctx, newTestQuery("alice", "app"))
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed(), "Query %d should be allowed", i+1)
+	}
+
+	decision, err := service.Evaluate(ctx, newTestQuery("alice", "app"))
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed())
+	assert.Equal(t, "alice-hourly", decision.Policy)
+	assert.Equal(t, int64(2), decision.Used)
+	assert.Equal(t, int64(2), decision.Limit)
+	assert.False(t, decision.ResetAt.IsZero())
+
+	decision, err = service.Evaluate(ctx, newTestQuery("bob", "app"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed(), "Unmatched principals are not limited")
+
+	decision, err = service.Evaluate(ctx, newTestQuery("bob", "reporting"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed())
+
+	decision, err = service.Evaluate(ctx, newTestQuery("bob", "reporting"))
+	require.NoError(t, err)
+	assert.Equal(t, "reporting", decision.Policy)
+	assert.False(t, decision.Allowed())
+}
+
+func TestQuotaService_DeniedQueriesDoNotConsumeOtherPolicies(t *testing.T) {
+	ctx := context.Background()
+	store := adapters.NewMemoryUsageStore()
+
+	service, err := NewQuotaService(store, []domain.QuotaPolicy{
+		{Name: "strict", User: "alice", Limit: 1, Window: time.Hour},
+		{Name: "loose", User: "alice", Limit: 100, Window: time.Hour},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := service.Evaluate(ctx, newTestQuery("alice", "app"))
+		require.NoError(t, err)
+	}
+
+	usage, err := store.Get(ctx, domain.UsageKey{Policy: "loose", User: "alice", Database: "app"}, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), usage.Used)
+}
+
+func TestQuotaService_ChargeBatch(t *testing.T) {
+	store := adapters.NewMemoryUsageStore()
+	service, err := NewQuotaService(store, []domain.QuotaPolicy{
+		{Name: "alice", User: "alice", Limit: 2, Window: time.Hour},
+	})
+	require.NoError(t, err)
+	key := domain.UsageKey{Policy: "alice", User: "alice", Database: "app"}
+	used := func() int64 {
+		usage, err := store.Get(context.Background(), key, time.Hour)
+		require.NoError(t, err)
+		return usage.Used
+	}
+
+	// The third statement of a batch goes over the limit counting the two
+	// before it, and the batch is never committed
+	ctx, batch := domain.WithChargeBatch(context.Background())
+	for i, allowed := range []bool{true, true, false} {
+		decision, err := service.Evaluate(ctx, newTestQuery("alice", "app"))
+		require.NoError(t, err)
+		assert.Equal(t, allowed, decision.Allowed(), "statement %d", i)
+	}
+	assert.Equal(t, int64(2), batch.Pending(key))
+	assert.Zero(t, used(), "The statements of a batch should not be charged before it is committed")
+
+	ctx, batch = domain.WithChargeBatch(context.Background())
+	for i := 0; i < 2; i++ {
+		decision, err := service.Evaluate(ctx, newTestQuery("alice", "app"))
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed())
+	}
+	require.NoError(t, batch.Commit(ctx))
+	assert.Equal(t, int64(2), used())
+}
+
+func TestQuotaService_LabelSelectors(t *testing.T) {
+	ctx := context.Background()
+
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "etl", Labels: map[string]string{"workload": "etl"}, Limit: 1, Window: time.Hour},
+	})
+	require.NoError(t, err)
+
+	etl := newTestQuery("alice", "app")
+	etl.Labels = map[string]string{"workload": "etl", "team": "billing"}
+
+	decision, err := service.Evaluate(ctx, etl)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed())
+
+	decision, err = service.Evaluate(ctx, etl)
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed(), "Labelled connections should be limited")
+
+	decision, err = service.Evaluate(ctx, newTestQuery("alice", "app"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed(), "Connections without the label are not selected")
+}
+
+func TestQuotaService_PerLabelUsage(t *testing.T) {
+	ctx := context.Background()
+
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "tenant-hourly", User: "app", Limit: 2, Window: time.Hour, PerLabel: "tenant_id"},
+	})
+	require.NoError(t, err)
+
+	tenant := func(id string) *domain.Query {
+		query := newTestQuery("app", "app")
+		query.Labels = map[string]string{"tenant_id": id}
+		return query
+	}
+	for i := 0; i < 2; i++ {
+		decision, err := service.Evaluate(ctx, tenant("42"))
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed())
+	}
+	decision, err := service.Evaluate(ctx, tenant("42"))
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed(), "Tenant 42 should have used its whole limit")
+
+	decision, err = service.Evaluate(ctx, tenant("43"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed(), "Tenant 43 should be counted apart")
+
+	usages, err := service.Usage(ctx, "app", "app", "43")
+	require.NoError(t, err)
+	require.Len(t, usages, 1)
+	assert.Equal(t, int64(1), usages[0].Used)
+
+	found, err := service.ResetUsage(ctx, "app", "app", "42", "")
+	require.NoError(t, err)
+	assert.True(t, found)
+	decision, err = service.Evaluate(ctx, tenant("42"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed(), "Tenant 42 should have been reset")
+
+	usages, err = service.Usage(ctx, "app", "app", "43")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), usages[0].Used, "Resetting tenant 42 should leave tenant 43")
+
+	_, err = NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "tenant-rate", User: "app", Rate: 10, PerLabel: "tenant_id"},
+	})
+	assert.Error(t, err, "Per label requires a windowed limit")
+}
+
+func TestQuotaService_UsageWeights(t *testing.T) {
+	ctx := context.Background()
+	store := adapters.NewMemoryUsageStore()
+	policy := domain.QuotaPolicy{Name: "default", Limit: 9, Window: time.Hour}
+
+	service, err := NewQuotaService(store, []domain.QuotaPolicy{policy},
+		WithUsageWeights(domain.UsageWeights{Simple: 1, Parse: 0, Execute: 3}))
+	require.NoError(t, err)
+
+	evaluate := func(kind domain.QueryKind) domain.Decision {
+		query := newTestQuery("alice", "app")
+		query.Kind = kind
+		decision, err := service.Evaluate(ctx, query)
+		require.NoError(t, err)
+		return decision
+	}
+
+	assert.True(t, evaluate(domain.QueryKindParse).Allowed())
+	assert.True(t, evaluate(domain.QueryKindExecute).Allowed())
+	assert.True(t, evaluate(domain.QueryKindExecute).Allowed())
+	assert.True(t, evaluate("").Allowed(), "Queries without a kind are charged as simple queries")
+
+	usage, err := store.Get(ctx, domain.UsageKey{Policy: "default", User: "alice", Database: "app"}, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), usage.Used, "Parse is free, each Execute costs 3 and the simple query 1")
+
+	decision := evaluate(domain.QueryKindExecute)
+	assert.False(t, decision.Allowed(), "An execution that does not fit the remaining quota is denied")
+	assert.True(t, evaluate(domain.QueryKindParse).Allowed(), "Zero-weight queries are never denied")
+
+	_, err = NewQuotaService(store, nil, WithUsageWeights(domain.UsageWeights{Execute: -1}))
+	assert.Error(t, err)
+}
+
+func TestQuotaService_QueryCost(t *testing.T) {
+	ctx := context.Background()
+	store := adapters.NewMemoryUsageStore()
+	policies := []domain.QuotaPolicy{
+		{Name: "cost", Dimension: domain.QuotaDimensionCost, Limit: 10, Window: time.Hour},
+		{Name: "queries", Limit: 100, Window: time.Hour},
+	}
+
+	expensive := newTestQuery("alice", "app")
+	expensive.Raw = "SELECT * FROM orders"
+	unparsable := newTestQuery("alice", "app")
+	unparsable.Raw = "SELECT * FROM WHERE"
+
+	analyzer := &mocks.QueryAnalyzer{}
+	analyzer.On("AnalyzeQuery", expensive).Return(&domain.QueryAnalysis{EstimatedCost: 6}, nil).Once()
+	analyzer.On("AnalyzeQuery", unparsable).Return(nil, assert.AnError).Once()
+
+	service, err := NewQuotaService(store, policies, WithQueryAnalyzer(analyzer))
+	require.NoError(t, err)
+
+	for _, query := range []*domain.Query{expensive, unparsable} {
+		decision, err := service.Evaluate(ctx, query)
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed())
+	}
+
+	usage, err := store.Get(ctx, domain.UsageKey{Policy: "cost", User: "alice", Database: "app"}, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), usage.Used, "Queries that cannot be analyzed cost 1")
+	usage, err = store.Get(ctx, domain.UsageKey{Policy: "queries", User: "alice", Database: "app"}, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), usage.Used, "Query-count policies are not weighted by cost")
+
+	analyzer.On("AnalyzeQuery", expensive).Return(&domain.QueryAnalysis{EstimatedCost: 6}, nil).Once()
+	decision, err := service.Evaluate(ctx, expensive)
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed(), "A query whose cost does not fit the remaining quota is denied")
+	assert.Equal(t, "cost", decision.Policy)
+	assert.Contains(t, decision.Reason, "7 of 10 cost units")
+	analyzer.AssertExpectations(t)
+}
+
+func TestQuotaService_StatementUsage(t *testing.T) {
+	ctx := context.Background()
+	store := adapters.NewMemoryUsageStore()
+
+	service, err := NewQuotaService(store, []domain.QuotaPolicy{
+		{Name: "export-bytes", User: "alice", Dimension: domain.QuotaDimensionBytes, Limit: 1000, Window: time.Hour},
+		{Name: "export-rows", User: "alice", Dimension: domain.QuotaDimensionRows, Limit: 100, Window: time.Hour},
+		{Name: "queries", User: "alice", Limit: 10, Window: time.Hour},
+	})
+	require.NoError(t, err)
+
+	decision, err := service.Evaluate(ctx, newTestQuery("alice", "app"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed())
+
+	bytesKey := domain.UsageKey{Policy: "export-bytes", User: "alice", Database: "app"}
+	usage, err := store.Get(ctx, bytesKey, time.Hour)
+	require.NoError(t, err)
+	assert.Zero(t, usage.Used, "Queries should not consume data volume")
+
+	require.NoError(t, service.RecordUsage(ctx, newTestQuery("alice", "app"), domain.StatementUsage{Bytes: 600, Rows: 20}))
+	decision, err = service.Evaluate(ctx, newTestQuery("alice", "app"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed(), "Volume left in the window should allow queries")
+
+	// The COPY that exhausts the quota completes; the next query is denied
+	require.NoError(t, service.RecordUsage(ctx, newTestQuery("alice", "app"), domain.StatementUsage{Bytes: 500, Rows: 20}))
+	decision, err = service.Evaluate(ctx, newTestQuery("alice", "app"))
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed())
+	assert.Equal(t, "export-bytes", decision.Policy)
+	assert.Equal(t, int64(1100), decision.Used)
+	assert.Contains(t, decision.Reason, "1100 of 1000 bytes per 1h0m0s")
+
+	rows, err := store.Get(ctx, domain.UsageKey{Policy: "export-rows", User: "alice", Database: "app"}, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(40), rows.Used)
+
+	queries, err := store.Get(ctx, domain.UsageKey{Policy: "queries", User: "alice", Database: "app"}, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), queries.Used, "Denied queries should not be charged")
+
+	_, err = NewQuotaService(store, []domain.QuotaPolicy{
+		{Name: "invalid", Dimension: "megabytes", Limit: 1, Window: time.Hour},
+	})
+	assert.Error(t, err)
+}
+
+func TestQuotaService_ExecutionTime(t *testing.T) {
+	ctx := context.Background()
+
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "reporting-time", Database: "reporting", Dimension: domain.QuotaDimensionSeconds, Limit: 2, Window: time.Hour},
+	})
+	require.NoError(t, err)
+
+	query := newTestQuery("alice", "reporting")
+	for i := 0; i < 19; i++ {
+		require.NoError(t, service.RecordUsage(ctx, query, domain.StatementUsage{Duration: 100 * time.Millisecond}))
+	}
+	decision, err := service.Evaluate(ctx, query)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed(), "Short statements should add up in milliseconds")
+
+	require.NoError(t, service.RecordUsage(ctx, query, domain.StatementUsage{Duration: 150 * time.Millisecond}))
+	decision, err = service.Evaluate(ctx, query)
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed())
+	assert.Equal(t, int64(2), decision.Used)
+	assert.Equal(t, int64(2), decision.Limit)
+	assert.Contains(t, decision.Reason, "2 of 2 seconds per 1h0m0s")
+}
+
+func TestQuotaService_SetPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies []domain.QuotaPolicy
+	}{
+		{name: "Missing name", policies: []domain.QuotaPolicy{{Limit: 1, Window: time.Minute}}},
+		{name: "Zero limit", policies: []domain.QuotaPolicy{{Name: "a", Window: time.Minute}}},
+		{name: "Zero window", policies: []domain.QuotaPolicy{{Name: "a", Limit: 1}}},
+		{name: "Duplicate names", policies: []domain.QuotaPolicy{
+			{Name: "a", Limit: 1, Window: time.Minute},
+			{Name: "a", Limit: 2, Window: time.Minute},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewQuotaService(adapters.NewMemoryUsageStore(), tt.policies)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestQuotaService_UsageAndReset(t *testing.T) {
+	ctx := context.Background()
+
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "alice-hourly", User: "alice", Limit: 5, Window: time.Hour},
+		{Name: "billing", Labels: map[string]string{"team": "billing"}, Limit: 5, Window: time.Hour},
+		{Name: "bob", User: "bob", Limit: 5, Window: time.Hour},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err := service.Evaluate(ctx, newTestQuery("alice", "app"))
+		require.NoError(t, err)
+	}
+
+	usages, err := service.Usage(ctx, "alice", "app", "")
+	require.NoError(t, err)
+	require.Len(t, usages, 2, "Labelled policies may apply to the principal")
+	assert.Equal(t, "alice-hourly", usages[0].Policy.Name)
+	assert.Equal(t, int64(2), usages[0].Used)
+	assert.Equal(t, "billing", usages[1].Policy.Name)
+	assert.Equal(t, int64(0), usages[1].Used)
+
+	found, err := service.ResetUsage(ctx, "alice", "app", "", "bob")
+	require.NoError(t, err)
+	assert.False(t, found, "Policies of other principals should not be reset")
+
+	found, err = service.ResetUsage(ctx, "alice", "app", "", "")
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	usages, err = service.Usage(ctx, "alice", "app", "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), usages[0].Used)
+}
+
+func TestQuotaService_QuotaStatus(t *testing.T) {
+	ctx := context.Background()
+
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "alice-hourly", User: "alice", Limit: 5, Window: time.Hour},
+		{Name: "billing", Labels: map[string]string{"team": "billing"}, Limit: 5, Window: time.Hour},
+		{Name: "alice-rate", User: "alice", Rate: 10},
+	})
+	require.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		_, err := service.Evaluate(ctx, newTestQuery("alice", "app"))
+		require.NoError(t, err)
+	}
+
+	statuses, err := service.QuotaStatus(ctx, domain.Session{User: "alice", Database: "app"})
+	require.NoError(t, err)
+	require.Len(t, statuses, 1, "Only the windowed quotas of the connection should be reported")
+	assert.Equal(t, "alice-hourly", statuses[0].Policy)
+	assert.Equal(t, int64(5), statuses[0].Used)
+	assert.Equal(t, int64(0), statuses[0].Remaining())
+
+	statuses, err = service.QuotaStatus(ctx, domain.Session{User: "alice", Database: "app", Labels: map[string]string{"team": "billing"}})
+	require.NoError(t, err)
+	assert.Len(t, statuses, 2, "Labelled quotas should be reported to the connections with the labels")
+}
+
+func TestQuotaService_Alerts(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	events := &mocks.RecordingEventSink{}
+
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "alice-hourly", User: "alice", Limit: 5, Window: time.Hour},
+	}, WithQuotaAlerts([]int{100, 80}, events), WithQuotaClock(clock))
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := service.Evaluate(ctx, newTestQuery("alice", "app"))
+		require.NoError(t, err)
+	}
+	assert.Empty(t, events.Events())
+
+	for i := 0; i < 2; i++ {
+		_, err := service.Evaluate(ctx, newTestQuery("alice", "app"))
+		require.NoError(t, err)
+	}
+	alerts := events.EventsOfType(domain.EventQuotaThreshold)
+	require.Len(t, alerts, 2)
+	assert.Equal(t, 80, alerts[0].Fields["threshold"])
+	assert.Equal(t, int64(4), alerts[0].Fields["used"])
+	assert.Equal(t, 100, alerts[1].Fields["threshold"])
+	assert.Equal(t, "alice-hourly", alerts[1].Fields["policy"])
+	assert.Equal(t, "alice", alerts[1].Fields["user"])
+	assert.Equal(t, clock.Now(), alerts[1].Timestamp)
+
+	for i := 0; i < 2; i++ {
+		decision, err := service.Evaluate(ctx, newTestQuery("alice", "app"))
+		require.NoError(t, err)
+		assert.False(t, decision.Allowed())
+	}
+	blocked := events.EventsOfType(domain.EventQuotaBlocked)
+	require.Len(t, blocked, 1, "A principal is reported blocked once")
+	assert.Equal(t, int64(5), blocked[0].Fields["used"])
+	assert.Contains(t, blocked[0].Fields["reason"], "alice-hourly")
+
+	_, err = NewQuotaService(adapters.NewMemoryUsageStore(), nil, WithQuotaAlerts([]int{0}, events))
+	assert.Error(t, err)
+}
+
+func TestQuotaService_RateLimits(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	store := adapters.NewMemoryUsageStore()
+
+	service, err := NewQuotaService(store, []domain.QuotaPolicy{
+		{Name: "smoothing", User: "alice", Rate: 1},
+		{Name: "alice-hourly", User: "alice", Limit: 2, Window: time.Hour},
+	}, WithQuotaClock(clock))
+	require.NoError(t, err)
+
+	decision, err := service.Evaluate(ctx, newTestQuery("alice", "app"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed())
+
+	decisions := make(chan domain.Decision)
+	go func() {
+		decision, err := service.Evaluate(ctx, newTestQuery("alice", "app"))
+		assert.NoError(t, err)
+		decisions <- decision
+	}()
+	require.True(t, clock.WaitForTimers(1, time.Second), "The query beyond the rate should wait")
+	usage, err := service.Usage(ctx, "alice", "app", "")
+	require.NoError(t, err)
+	require.Len(t, usage, 1, "Rate-only policies have no usage")
+	assert.Equal(t, int64(1), usage[0].Used, "A delayed query is charged once it runs")
+
+	clock.Advance(time.Second)
+	assert.True(t, (<-decisions).Allowed(), "Delayed queries are not denied")
+
+	// Windowed limits still deny, without waiting for the rate
+	clock.Advance(time.Second)
+	decision, err = service.Evaluate(ctx, newTestQuery("alice", "app"))
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed())
+	assert.Equal(t, "alice-hourly", decision.Policy)
+	assert.Zero(t, clock.PendingTimers())
+
+	_, err = NewQuotaService(store, []domain.QuotaPolicy{{Name: "broken", Burst: 5}})
+	assert.Error(t, err, "A burst needs a rate")
+	_, err = NewQuotaService(store, []domain.QuotaPolicy{{Name: "broken", Rate: 1, RatePer: "database"}})
+	assert.Error(t, err)
+	_, err = NewQuotaService(store, []domain.QuotaPolicy{{Name: "broken", Rate: 1, Limit: 5}})
+	assert.Error(t, err, "A limit needs a window even with a rate")
+}
+
+func TestQuotaService_ConnectionLimits(t *testing.T) {
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "alice", User: "alice", MaxConnections: 2},
+		{Name: "reporting", Database: "reporting", MaxConnections: 1},
+		{Name: "hourly", Limit: 100, Window: time.Hour},
+	})
+	require.NoError(t, err)
+	session := func(user, database string) domain.Session {
+		return domain.Session{ConnectionID: "conn", User: user, Database: database}
+	}
+
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, decision := service.AcquireConnection(session("alice", "app"))
+		require.True(t, decision.Allowed(), "Connection %d should be admitted", i+1)
+		releases = append(releases, release)
+	}
+	_, decision := service.AcquireConnection(session("alice", "app"))
+	assert.False(t, decision.Allowed())
+	assert.Equal(t, "alice", decision.Policy)
+	assert.Equal(t, `too many connections for role "alice"`, decision.Reason)
+	assert.Equal(t, int64(2), decision.Limit)
+	assert.Equal(t, int64(2), decision.Used)
+
+	_, decision = service.AcquireConnection(session("alice", "other"))
+	assert.True(t, decision.Allowed(), "Each database of a user is counted separately")
+
+	// Releasing twice frees a single connection
+	releases[0]()
+	releases[0]()
+	release, decision := service.AcquireConnection(session("alice", "app"))
+	assert.True(t, decision.Allowed())
+	_, decision = service.AcquireConnection(session("alice", "app"))
+	assert.False(t, decision.Allowed())
+	release()
+
+	// A connection denied by one cap counts against none
+	_, decision = service.AcquireConnection(session("alice", "reporting"))
+	require.True(t, decision.Allowed())
+	_, decision = service.AcquireConnection(session("alice", "reporting"))
+	assert.Equal(t, `too many connections for database "reporting"`, decision.Reason)
+	_, decision = service.AcquireConnection(session("bob", "reporting"))
+	assert.True(t, decision.Allowed())
+
+	_, err = NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{{Name: "broken", MaxConnections: -1}})
+	assert.Error(t, err)
+}
+
+func TestQuotaService_StatementTimeouts(t *testing.T) {
+	ctx := context.Background()
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "default", StatementTimeout: time.Minute},
+		{Name: "reporting", Database: "reporting", StatementTimeout: 10 * time.Second, Limit: 100, Window: time.Hour},
+		{Name: "etl", User: "etl", StatementTimeout: time.Hour, Override: true},
+	})
+	require.NoError(t, err)
+
+	decision, err := service.Evaluate(ctx, newTestQuery("alice", "app"))
+	require.NoError(t, err)
+	require.True(t, decision.Allowed(), "A statement timeout alone should not deny queries")
+	assert.Equal(t, time.Minute, decision.StatementTimeout)
+	assert.Equal(t, "default", decision.TimeoutPolicy)
+
+	decision, err = service.Evaluate(ctx, newTestQuery("alice", "reporting"))
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, decision.StatementTimeout, "The shortest timeout should apply")
+	assert.Equal(t, "reporting", decision.TimeoutPolicy)
+
+	decision, err = service.Evaluate(ctx, newTestQuery("etl", "app"))
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, decision.StatementTimeout, "An override should replace a less specific timeout")
+	assert.Equal(t, "etl", decision.TimeoutPolicy)
+
+	_, err = NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{{Name: "broken", StatementTimeout: -time.Second}})
+	assert.Error(t, err)
+	_, err = NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{{Name: "broken", Tables: []string{"secrets"}, Deny: true, StatementTimeout: time.Second}})
+	assert.Error(t, err, "A deny policy cannot have a statement timeout")
+}
+
+func TestQuotaService_ResultCaps(t *testing.T) {
+	ctx := context.Background()
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "default", MaxResultRows: 100000},
+		{Name: "reporting", Database: "reporting", MaxResultRows: 1000, MaxResultBytes: 1 << 20},
+		{Name: "etl", User: "etl", MaxResultRows: 1000000, Override: true},
+	})
+	require.NoError(t, err)
+
+	decision, err := service.Evaluate(ctx, newTestQuery("alice", "reporting"))
+	require.NoError(t, err)
+	require.True(t, decision.Allowed(), "A result cap alone should not deny queries")
+	assert.Equal(t, int64(1000), decision.MaxResultRows, "The smallest cap should apply")
+	assert.Equal(t, "reporting", decision.ResultRowsPolicy)
+	assert.Equal(t, int64(1<<20), decision.MaxResultBytes)
+	assert.Equal(t, "reporting", decision.ResultBytesPolicy)
+
+	decision, err = service.Evaluate(ctx, newTestQuery("etl", "app"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000000), decision.MaxResultRows, "An override should replace a less specific cap")
+	assert.Zero(t, decision.MaxResultBytes)
+
+	_, err = NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{{Name: "broken", MaxResultBytes: -1}})
+	assert.Error(t, err)
+	_, err = NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{{Name: "broken", Allow: true, MaxResultRows: 10}})
+	assert.Error(t, err, "An allow policy cannot cap results")
+}
+
+func TestQuotaService_TransactionLimits(t *testing.T) {
+	ctx := context.Background()
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "default", MaxTransactionDuration: 10 * time.Minute},
+		{Name: "oltp", Database: "app", MaxTransactionDuration: 30 * time.Second, MaxTransactionStatements: 500},
+		{Name: "batch", User: "batch", MaxTransactionDuration: time.Hour, Override: true},
+	})
+	require.NoError(t, err)
+
+	decision, err := service.Evaluate(ctx, newTestQuery("alice", "app"))
+	require.NoError(t, err)
+	require.True(t, decision.Allowed(), "A transaction limit alone should not deny queries")
+	assert.Equal(t, 30*time.Second, decision.MaxTransactionDuration, "The shortest limit should apply")
+	assert.Equal(t, "oltp", decision.TransactionDurationPolicy)
+	assert.Equal(t, int64(500), decision.MaxTransactionStatements)
+	assert.Equal(t, "oltp", decision.TransactionStatementsPolicy)
+
+	decision, err = service.Evaluate(ctx, newTestQuery("batch", "app"))
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, decision.MaxTransactionDuration, "An override should replace a less specific limit")
+	assert.Equal(t, int64(500), decision.MaxTransactionStatements)
+
+	_, err = NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{{Name: "broken", MaxTransactionStatements: -1}})
+	assert.Error(t, err)
+	_, err = NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{{Name: "broken", Deny: true, MaxTransactionDuration: time.Minute}})
+	assert.Error(t, err, "A deny policy cannot limit transactions")
+}
+
+func TestQuotaService_ConcurrencyCaps(t *testing.T) {
+	ctx := context.Background()
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "tenant", User: "alice", MaxConcurrentQueries: 1, Hint: "wait for your other queries"},
+		{Name: "daily", Limit: 100, Window: 24 * time.Hour},
+	})
+	require.NoError(t, err)
+
+	running, err := service.Evaluate(ctx, newTestQuery("alice", "app"))
+	require.NoError(t, err)
+	require.True(t, running.Allowed())
+	require.NotNil(t, running.Release)
+
+	parse := newTestQuery("alice", "app")
+	parse.ConnectionID = "conn_2"
+	parse.Kind = domain.QueryKindParse
+	decision, err := service.Evaluate(ctx, parse)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed(), "Preparing a statement should not take a slot")
+	assert.Nil(t, decision.Release)
+
+	other := newTestQuery("alice", "app")
+	other.ConnectionID = "conn_2"
+	decision, err = service.Evaluate(ctx, other)
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed())
+	assert.Equal(t, "tenant", decision.Policy)
+	assert.Equal(t, "wait for your other queries", decision.Hint)
+
+	decision, err = service.Evaluate(ctx, newTestQuery("bob", "app"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed())
+	assert.Nil(t, decision.Release, "Uncapped principals should hold nothing")
+
+	running.Finish()
+	decision, err = service.Evaluate(ctx, other)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed(), "The slot should be free once the statement ended")
+	decision.Finish()
+
+	usage, err := service.Usage(ctx, "alice", "app", "")
+	require.NoError(t, err)
+	require.Len(t, usage, 1)
+	assert.Equal(t, int64(3), usage[0].Used, "Queries denied by a concurrency cap should not be charged")
+
+	// A query denied a slot gives back the rate tokens it took
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	service, err = NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "rate", User: "alice", Rate: 1, Burst: 2},
+		{Name: "tenant", User: "alice", MaxConcurrentQueries: 1},
+	}, WithQuotaClock(clock))
+	require.NoError(t, err)
+	bounded, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	running, err = service.Evaluate(bounded, newTestQuery("alice", "app"))
+	require.NoError(t, err)
+	require.True(t, running.Allowed())
+	decision, err = service.Evaluate(bounded, other)
+	require.NoError(t, err)
+	require.False(t, decision.Allowed())
+	running.Finish()
+	decision, err = service.Evaluate(bounded, other)
+	require.NoError(t, err, "The denied query should not have left the bucket empty")
+	assert.True(t, decision.Allowed())
+	decision.Finish()
+
+	for _, policy := range []domain.QuotaPolicy{
+		{Name: "broken", MaxConcurrentQueries: -1},
+		{Name: "broken", QueueTimeout: time.Second, Limit: 10, Window: time.Hour},
+		{Name: "broken", Deny: true, MaxConcurrentQueries: 1},
+	} {
+		_, err = NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{policy})
+		assert.Error(t, err)
+	}
+}
+
+func TestQuotaService_StartupParameters(t *testing.T) {
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "tagged", StartupParameters: map[string]string{"application_name": "{application_name} (pgqe {connection_id})"}},
+		{Name: "etl", User: "etl", MaxConnections: 1, StartupParameters: map[string]string{
+			"application_name": "etl via {listener}",
+			"options":          "-c statement_timeout=5min",
+		}},
+	})
+	require.NoError(t, err)
+
+	decision, err := service.Evaluate(context.Background(), newTestQuery("alice", "app"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed(), "Startup parameters alone should not deny queries")
+
+	release, decision := service.AcquireConnection(domain.Session{ConnectionID: "c1", User: "alice", Database: "app", ApplicationName: "psql"})
+	require.True(t, decision.Allowed())
+	release()
+	assert.Equal(t, map[string]string{"application_name": "psql (pgqe c1)"}, decision.StartupParameters)
+
+	release, decision = service.AcquireConnection(domain.Session{ConnectionID: "c2", User: "etl", Database: "app", Listener: "batch"})
+	require.True(t, decision.Allowed())
+	release()
+	assert.Equal(t, map[string]string{"application_name": "etl via batch", "options": "-c statement_timeout=5min"}, decision.StartupParameters,
+		"The parameters of the more specific policy should win")
+
+	for _, params := range []map[string]string{{"user": "admin"}, {"label.team": "a"}, {"application_name": "{secret}"}} {
+		_, err = NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{{Name: "broken", StartupParameters: params}})
+		assert.Error(t, err, "%v", params)
+	}
+	_, err = NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "broken", Tables: []string{"events"}, StartupParameters: map[string]string{"application_name": "x"}},
+	})
+	assert.Error(t, err, "Startup parameters should not be scoped to tables")
+}
+
+func TestQuotaService_TableScopes(t *testing.T) {
+	ctx := context.Background()
+	store := adapters.NewMemoryUsageStore()
+	service, err := NewQuotaService(store, []domain.QuotaPolicy{
+		{Name: "events-reads", Tables: []string{"analytics.events"}, Statements: []domain.StatementClass{domain.StatementClassRead}, Limit: 2, Window: time.Hour},
+		{Name: "audit-readonly", Tables: []string{"audit.*"}, Statements: []domain.StatementClass{domain.StatementClassWrite}, Deny: true},
+		{Name: "users-readonly", User: "app", Statements: []domain.StatementClass{domain.StatementClassWrite}, Tables: []string{"users"}, Deny: true},
+	})
+	require.NoError(t, err)
+
+	evaluate := func(user, sql string) domain.Decision {
+		query := newTestQuery(user, "app")
+		query.Raw = sql
+		decision, err := service.Evaluate(ctx, query)
+		require.NoError(t, err)
+		return decision
+	}
+
+	assert.True(t, evaluate("alice", "SELECT * FROM analytics.events WHERE id = 1").Allowed())
+	assert.True(t, evaluate("alice", "INSERT INTO analytics.events (name) VALUES ('x')").Allowed(), "Writes are not counted as reads")
+	assert.True(t, evaluate("alice", "SELECT * FROM events").Allowed(), "Unqualified tables are in the public schema")
+	assert.True(t, evaluate("alice", "SELECT e.id FROM analytics.events e JOIN users u ON u.id = e.user_id").Allowed())
+	decision := evaluate("alice", "SELECT count(*) FROM analytics.events")
+	assert.False(t, decision.Allowed())
+	assert.Equal(t, "events-reads", decision.Policy)
+	assert.True(t, evaluate("bob", "SELECT count(*) FROM analytics.events").Allowed(), "Each principal has its own usage")
+
+	assert.True(t, evaluate("alice", "SELECT * FROM audit.log WHERE id = 1").Allowed())
+	for _, sql := range []string{
+		"DELETE FROM audit.log WHERE id = 1",
+		"WITH moved AS (SELECT * FROM staging) INSERT INTO audit.log SELECT * FROM moved",
+		"SELECT 1; TRUNCATE audit.log",
+		"DROP TABLE audit.log",
+	} {
+		decision := evaluate("alice", sql)
+		assert.False(t, decision.Allowed(), sql)
+		assert.Equal(t, "audit-readonly", decision.Policy, sql)
+		assert.Equal(t, "42501", decision.Code, sql)
+	}
+	assert.Equal(t, `DELETE on audit.log denied by policy "audit-readonly"`, evaluate("alice", "DELETE FROM audit.log").Reason)
+
+	assert.Equal(t, `ALTER on users denied by policy "users-readonly"`, evaluate("app", "ALTER TABLE users ADD COLUMN age int").Reason)
+	assert.True(t, evaluate("alice", "ALTER TABLE users ADD COLUMN age int").Allowed())
+	assert.True(t, evaluate("app", "SELECT * FROM WHERE").Allowed(), "Queries that cannot be analyzed match no scoped policy")
+
+	for _, policy := range []domain.QuotaPolicy{
+		{Name: "broken", Tables: []string{"a.b.c"}, Deny: true},
+		{Name: "broken", Tables: []string{"*"}, Deny: true},
+		{Name: "broken", Statements: []domain.StatementClass{"truncate"}, Deny: true},
+		{Name: "broken", Tables: []string{"audit.*"}, Deny: true, Limit: 5, Window: time.Hour},
+		{Name: "broken", Tables: []string{"audit.*"}, MaxConnections: 5},
+	} {
+		_, err := NewQuotaService(store, []domain.QuotaPolicy{policy})
+		assert.Error(t, err, "%+v", policy)
+	}
+}
+
+func TestQuotaService_StatementTypes(t *testing.T) {
+	ctx := context.Background()
+	// A Saturday
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 7, 1, 30, 0, 0, time.UTC))
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "writes", User: "tenant", Statements: []domain.StatementClass{domain.StatementClassWrite}, Limit: 2, Window: 24 * time.Hour},
+		{Name: "deletes", User: "tenant", Statements: []domain.StatementClass{domain.StatementClassDelete}, Limit: 1, Window: 24 * time.Hour},
+		{Name: "ddl", Statements: []domain.StatementClass{domain.StatementClassDDL}, Deny: true,
+			AllowDuring: []string{"Sat 02:00-04:00", "Sun-Mon 23:00-01:00 Europe/Paris"}},
+	}, WithQuotaClock(clock))
+	require.NoError(t, err)
+
+	evaluate := func(user, sql string) domain.Decision {
+		query := newTestQuery(user, "app")
+		query.Raw = sql
+		decision, err := service.Evaluate(ctx, query)
+		require.NoError(t, err)
+		return decision
+	}
+
+	for i := 0; i < 5; i++ {
+		assert.True(t, evaluate("tenant", "SELECT * FROM orders WHERE id = 1").Allowed(), "Reads are unlimited")
+	}
+	assert.True(t, evaluate("tenant", "DELETE FROM orders WHERE id = 1").Allowed())
+	decision := evaluate("tenant", "TRUNCATE orders")
+	assert.Equal(t, "deletes", decision.Policy, "TRUNCATE counts as a delete")
+	assert.True(t, evaluate("tenant", "INSERT INTO orders (id) VALUES (2)").Allowed())
+	assert.Equal(t, "writes", evaluate("tenant", "UPDATE orders SET total = 0 WHERE id = 2").Policy)
+
+	decision = evaluate("alice", "CREATE INDEX orders_total_idx ON orders (total)")
+	assert.False(t, decision.Allowed())
+	assert.Equal(t, `CREATE on orders denied by policy "ddl" outside Sat 02:00-04:00, Sun-Mon 23:00-01:00 Europe/Paris`, decision.Reason)
+
+	clock.Advance(30 * time.Minute)
+	assert.True(t, evaluate("alice", "ALTER TABLE orders ADD COLUMN note text").Allowed(), "DDL is allowed in the maintenance window")
+	clock.Advance(2 * time.Hour)
+	assert.False(t, evaluate("alice", "ALTER TABLE orders DROP COLUMN note").Allowed(), "The window ended at 04:00")
+
+	// Monday 00:30 in Paris is Sunday 22:30 UTC: within the window that started Sunday 23:00
+	clock.Advance(time.Date(2025, 6, 8, 22, 30, 0, 0, time.UTC).Sub(clock.Now()))
+	assert.True(t, evaluate("alice", "DROP TABLE orders_archive").Allowed())
+	clock.Advance(24 * time.Hour)
+	assert.True(t, evaluate("alice", "DROP TABLE orders_archive").Allowed(), "Windows past midnight belong to the day they start on")
+	clock.Advance(24 * time.Hour)
+	assert.False(t, evaluate("alice", "DROP TABLE orders_archive").Allowed(), "Tuesday's window starts on a day without one")
+
+	for _, policy := range []domain.QuotaPolicy{
+		{Name: "broken", Statements: []domain.StatementClass{"ddl"}, Limit: 1, Window: time.Hour, AllowDuring: []string{"02:00-04:00"}},
+		{Name: "broken", Deny: true, AllowDuring: []string{"Someday 02:00-04:00"}},
+		{Name: "broken", Deny: true, AllowDuring: []string{"02:00-02:00"}},
+		{Name: "broken", Deny: true, AllowDuring: []string{"02:00-04:00 Mars/Olympus"}},
+	} {
+		_, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{policy})
+		assert.Error(t, err, "%+v", policy)
+	}
+}
+
+func TestQuotaService_Schedules(t *testing.T) {
+	ctx := context.Background()
+	// Monday 08:30 in Paris
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 9, 6, 30, 0, 0, time.UTC))
+	batch := map[string]string{"workload": "batch"}
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "tenant", User: "tenant", Limit: 3, Window: 24 * time.Hour},
+		{Name: "tenant-peak", User: "tenant", Limit: 1, Window: 24 * time.Hour, Override: true,
+			ActiveDuring: []string{"Mon-Fri 09:00-18:00 Europe/Paris"}},
+		{Name: "nightly-batch", Labels: batch, Allow: true, ActiveDuring: []string{"01:00-05:00"}},
+	}, WithQuotaClock(clock))
+	require.NoError(t, err)
+
+	evaluate := func(labels map[string]string) domain.Decision {
+		query := newTestQuery("tenant", "app")
+		query.Labels = labels
+		decision, err := service.Evaluate(ctx, query)
+		require.NoError(t, err)
+		return decision
+	}
+
+	assert.True(t, evaluate(nil).Allowed())
+	clock.Advance(time.Hour)
+	assert.True(t, evaluate(nil).Allowed(), "The peak policy replaces the daily one while active")
+	decision := evaluate(nil)
+	assert.False(t, decision.Allowed())
+	assert.Equal(t, "tenant-peak", decision.Policy)
+
+	// Queries the peak policy counted do not count against the daily one
+	clock.Advance(9 * time.Hour)
+	assert.True(t, evaluate(nil).Allowed(), "The daily policy applies again after business hours")
+	assert.True(t, evaluate(nil).Allowed())
+	decision = evaluate(nil)
+	assert.False(t, decision.Allowed())
+	assert.Equal(t, "tenant", decision.Policy)
+
+	assert.False(t, evaluate(batch).Allowed(), "Batch jobs are only exempt at night")
+	clock.Advance(9 * time.Hour)
+	assert.True(t, evaluate(batch).Allowed(), "Batch jobs are exempt between 01:00 and 05:00")
+
+	_, err = NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "broken", Limit: 1, Window: time.Hour, ActiveDuring: []string{"9-17"}},
+	})
+	assert.Error(t, err)
+}
+
+func TestQuotaService_QueryNormalizer(t *testing.T) {
+	ctx := context.Background()
+	normalizer := adapters.NewRegexNormalizer()
+	orders, err := normalizer.Normalize("SELECT * FROM orders WHERE id = $1")
+	require.NoError(t, err)
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "orders-lookup", Fingerprints: []string{orders.Hash.String()}, Deny: true},
+	}, WithQueryNormalizer(normalizer))
+	require.NoError(t, err)
+
+	for _, sql := range []string{"select * from orders where id = 42", "SELECT * FROM orders WHERE id = '7' -- by id"} {
+		query := newTestQuery("bob", "app")
+		query.Raw = sql
+		decision, err := service.Evaluate(ctx, query)
+		require.NoError(t, err)
+		assert.Equal(t, "orders-lookup", decision.Policy, "Queries should be fingerprinted by the given normalizer")
+	}
+}
+
+func TestQuotaService_QueryRules(t *testing.T) {
+	ctx := context.Background()
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "alice", User: "alice", Limit: 1, Window: time.Hour},
+		{Name: "no-full-scans", Patterns: []string{`(?i)^select \* from huge_table$`}, Deny: true, Hint: "filter huge_table by created_at"},
+		{Name: "orders-lookup", Fingerprints: []string{"0b4ec38d9ea2dda6"}, Deny: true},
+		{Name: "health-checks", Fingerprints: []string{"50FDE20626009ABA"}, Allow: true},
+		{Name: "ops-scans", User: "ops", Patterns: []string{`huge_table`}, Allow: true},
+	})
+	require.NoError(t, err)
+
+	evaluate := func(user, sql string) domain.Decision {
+		query := newTestQuery(user, "app")
+		query.Raw = sql
+		decision, err := service.Evaluate(ctx, query)
+		require.NoError(t, err)
+		return decision
+	}
+
+	decision := evaluate("bob", "select * from huge_table")
+	assert.False(t, decision.Allowed())
+	assert.Equal(t, `query matching "(?i)^select \\* from huge_table$" denied by policy "no-full-scans"`, decision.Reason)
+	assert.Equal(t, pgerrInsufficientPrivilege, decision.Code)
+	assert.Equal(t, "filter huge_table by created_at", decision.Hint)
+	assert.True(t, evaluate("bob", "SELECT * FROM huge_table WHERE created_at > '2025-01-01'").Allowed())
+
+	// Queries differing only in their constants share a fingerprint
+	for _, sql := range []string{"SELECT * FROM orders WHERE id = 42", "SELECT * FROM orders WHERE id = 7"} {
+		decision = evaluate("bob", sql)
+		assert.Equal(t, `query 0b4ec38d9ea2dda6 denied by policy "orders-lookup"`, decision.Reason)
+	}
+
+	// Allow policies exempt queries from every other policy
+	for i := 0; i < 3; i++ {
+		assert.True(t, evaluate("alice", "SELECT 1").Allowed(), "Health checks are not charged")
+	}
+	assert.True(t, evaluate("alice", "SELECT now()").Allowed())
+	assert.Equal(t, "alice", evaluate("alice", "SELECT now()").Policy)
+	assert.True(t, evaluate("ops", "SELECT * FROM huge_table").Allowed(), "Allow policies override deny policies")
+
+	// Hashes computed by the connection are used as they are
+	query := newTestQuery("bob", "app")
+	query.Hash = domain.NewQueryHash("0B4EC38D9EA2DDA6")
+	decision, err = service.Evaluate(ctx, query)
+	require.NoError(t, err)
+	assert.Equal(t, "orders-lookup", decision.Policy)
+
+	for _, policy := range []domain.QuotaPolicy{
+		{Name: "broken", Patterns: []string{"(unclosed"}, Deny: true},
+		{Name: "broken", Fingerprints: []string{"SELECT 1"}, Deny: true},
+		{Name: "broken", Fingerprints: []string{"50fde20626009aba"}, Allow: true, Limit: 1, Window: time.Hour},
+		{Name: "broken", Patterns: []string{"^SELECT"}, Allow: true, Deny: true},
+		{Name: "broken", Patterns: []string{"^SELECT"}, MaxConnections: 5},
+	} {
+		_, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{policy})
+		assert.Error(t, err, "%+v", policy)
+	}
+}
+
+func TestQuotaService_PolicyHierarchy(t *testing.T) {
+	ctx := context.Background()
+
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "global", Limit: 1, Window: time.Hour, MaxConnections: 5},
+		{Name: "app", Database: "app", Limit: 2, Window: time.Hour, Override: true},
+		{Name: "analysts", Role: "analysts", Limit: 3, Window: time.Hour, Override: true},
+		{Name: "alice", User: "alice", Limit: 4, Window: time.Hour, Override: true},
+		{Name: "bytes", Dimension: domain.QuotaDimensionBytes, Limit: 1 << 20, Window: time.Hour},
+	})
+	require.NoError(t, err)
+	service.SetRoles(map[string][]string{"analysts": {"alice", "bob"}})
+
+	allowed := func(user, database string) int {
+		t.Helper()
+		for i := 0; ; i++ {
+			decision, err := service.Evaluate(ctx, newTestQuery(user, database))
+			require.NoError(t, err)
+			if !decision.Allowed() {
+				return i
+			}
+		}
+	}
+	assert.Equal(t, 1, allowed("carol", "other"), "The global default should apply without overrides")
+	assert.Equal(t, 2, allowed("carol", "app"), "The database override should replace the global limit")
+	assert.Equal(t, 3, allowed("bob", "app"), "The role override should replace the database override")
+	assert.Equal(t, 4, allowed("alice", "app"), "The user override should replace the role override")
+
+	explanations := service.Explain(newTestQuery("bob", "app"))
+	require.Len(t, explanations, 4)
+	assert.Equal(t, "analysts", explanations[0].Policy.Name, "Explanations should start with the most specific policy")
+	assert.True(t, explanations[0].Applies)
+	assert.Equal(t, "matches member bob of role analysts", explanations[0].Reason)
+	assert.Equal(t, "app", explanations[1].Policy.Name)
+	assert.False(t, explanations[1].Applies)
+	assert.Equal(t, `limits replaced by override "analysts"`, explanations[1].Reason)
+
+	// The global policy keeps its connection cap, and the byte limit another dimension
+	assert.True(t, explanations[2].Applies)
+	assert.Equal(t, "analysts", explanations[2].ReplacedBy)
+	assert.False(t, explanations[2].Policy.Windowed())
+	assert.Equal(t, int64(5), explanations[2].Policy.MaxConnections)
+	assert.Equal(t, "bytes", explanations[3].Policy.Name)
+	assert.True(t, explanations[3].Applies)
+	assert.Equal(t, "applies to every connection", explanations[3].Reason)
+
+	// Once bob leaves the role, its policy no longer applies to him
+	service.SetRoles(nil)
+	explanations = service.Explain(newTestQuery("bob", "app"))
+	assert.Equal(t, "app", explanations[0].Policy.Name)
+	assert.Equal(t, "matches database app", explanations[0].Reason)
+}
+
+func TestQuotaService_DirectoryGroups(t *testing.T) {
+	ctx := context.Background()
+	identities := &mocks.IdentityResolver{}
+	identities.On("Groups", mock.Anything, "dana").Return([]string{"analysts", "staff"}, nil)
+	identities.On("Groups", mock.Anything, "erin").Return(nil, errors.New("directory unavailable"))
+	identities.On("Groups", mock.Anything, mock.Anything).Return([]string(nil), nil)
+
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "global", Limit: 1, Window: time.Hour},
+		{Name: "analysts", Role: "analysts", Limit: 3, Window: time.Hour, Override: true, MaxConnections: 1},
+	}, WithIdentityResolver(identities))
+	require.NoError(t, err)
+	service.SetRoles(map[string][]string{"analysts": {"bob"}})
+
+	applied := func(user string) string {
+		t.Helper()
+		decision, err := service.Evaluate(ctx, newTestQuery(user, "app"))
+		require.NoError(t, err)
+		return decision.Policy
+	}
+	_, err = service.Evaluate(ctx, newTestQuery("dana", "app"))
+	require.NoError(t, err)
+	usages, err := service.Usage(ctx, "dana", "app", "")
+	require.NoError(t, err)
+	require.Len(t, usages, 1)
+	assert.Equal(t, "analysts", usages[0].Policy.Name, "Members of a directory group should be members of its role")
+	assert.Equal(t, int64(1), usages[0].Used)
+
+	release, decision := service.AcquireConnection(domain.Session{User: "dana", Database: "app"})
+	defer release()
+	assert.True(t, decision.Allowed())
+	_, decision = service.AcquireConnection(domain.Session{User: "dana", Database: "app"})
+	assert.Equal(t, "analysts", decision.Policy, "Connection caps of group policies should apply")
+
+	usages, err = service.Usage(ctx, "bob", "app", "")
+	require.NoError(t, err)
+	assert.Equal(t, "analysts", usages[0].Policy.Name, "Configured members should be kept")
+	assert.Empty(t, applied("carol"))
+	assert.Equal(t, "global", applied("carol"), "Users outside the group should get the default policy")
+	assert.Empty(t, applied("erin"))
+	assert.Equal(t, "global", applied("erin"), "Users whose groups cannot be resolved should get the policies of their own")
+}
+
+func TestQuotaService_ExplainQueryRules(t *testing.T) {
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(), []domain.QuotaPolicy{
+		{Name: "global", Limit: 10, Window: time.Hour},
+		{Name: "audit", Tables: []string{"audit.*"}, Statements: []domain.StatementClass{domain.StatementClassWrite}, Deny: true},
+		{Name: "health", Patterns: []string{`^SELECT \$1$`}, Allow: true},
+	})
+	require.NoError(t, err)
+
+	reasons := func(raw string) map[string]string {
+		query := newTestQuery("alice", "app")
+		query.Raw = raw
+		reasons := make(map[string]string)
+		for _, explanation := range service.Explain(query) {
+			reasons[explanation.Policy.Name] = explanation.Reason
+		}
+		return reasons
+	}
+	assert.Equal(t, map[string]string{
+		"global": "applies to every connection",
+		"audit":  "no statement of the query matches its scope",
+		"health": "query matches none of its fingerprints and patterns",
+	}, reasons("SELECT * FROM orders"))
+	assert.Equal(t, map[string]string{
+		"global": `query exempted by allow policy "health"`,
+		"audit":  "no statement of the query matches its scope",
+		"health": "applies to every connection",
+	}, reasons("SELECT 1"))
+	assert.Equal(t, "applies to every connection", reasons("DELETE FROM audit.events")["audit"])
+}
+
+func TestQuotaService_SoftLimits(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	events := &mocks.RecordingEventSink{}
+
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(adapters.WithUsageStoreClock(clock)), []domain.QuotaPolicy{
+		{Name: "daily", User: "alice", Limit: 10, Window: 24 * time.Hour, WarnAt: 80},
+		{Name: "soft", User: "bob", Limit: 2, Window: time.Hour, Soft: true},
+		{Name: "grace", User: "carol", Limit: 1, Window: time.Hour, Grace: 10 * time.Minute},
+	}, WithQuotaClock(clock), WithQuotaAlerts([]int{100}, events))
+	require.NoError(t, err)
+
+	evaluate := func(user string) domain.Decision {
+		t.Helper()
+		decision, err := service.Evaluate(ctx, newTestQuery(user, "app"))
+		require.NoError(t, err)
+		return decision
+	}
+
+	for i := 0; i < 7; i++ {
+		assert.Empty(t, evaluate("alice").Warnings, "Query %d should not warn", i+1)
+	}
+	decision := evaluate("alice")
+	assert.True(t, decision.Allowed())
+	assert.Equal(t, []string{`you have used 80% of quota "daily": 8 of 10 queries per 24h0m0s; resets at 2025-06-02T00:00:00Z`}, decision.Warnings)
+
+	// Soft limits warn instead of denying, and keep counting
+	for i := 0; i < 2; i++ {
+		assert.Empty(t, evaluate("bob").Warnings)
+	}
+	decision = evaluate("bob")
+	assert.True(t, decision.Allowed(), "Soft limits should not deny queries")
+	assert.Equal(t, []string{`quota "soft" exceeded: 2 of 2 queries per 1h0m0s; the limit is soft, so queries are still allowed`}, decision.Warnings)
+	assert.Contains(t, evaluate("bob").Warnings[0], "3 of 2 queries")
+	assert.Empty(t, events.EventsOfType(domain.EventQuotaBlocked), "Soft limits never block principals")
+
+	// Hard limits allow queries for their grace period once exceeded
+	assert.True(t, evaluate("carol").Allowed())
+	decision = evaluate("carol")
+	assert.True(t, decision.Allowed())
+	assert.Equal(t, []string{`quota "grace" exceeded: 1 of 1 queries per 1h0m0s; queries will be denied from 2025-06-01T12:10:00Z`}, decision.Warnings)
+	clock.Advance(9 * time.Minute)
+	assert.True(t, evaluate("carol").Allowed(), "The grace period should start when the limit is first exceeded")
+	clock.Advance(time.Minute)
+	decision = evaluate("carol")
+	assert.False(t, decision.Allowed())
+	assert.Equal(t, "grace", decision.Policy)
+
+	// A new window starts a new grace period
+	clock.Advance(time.Hour)
+	assert.Empty(t, evaluate("carol").Warnings)
+	assert.True(t, evaluate("carol").Allowed())
+
+	for _, policy := range []domain.QuotaPolicy{
+		{Name: "rate", Rate: 10, Soft: true},
+		{Name: "percent", Limit: 1, Window: time.Hour, WarnAt: 101},
+		{Name: "both", Limit: 1, Window: time.Hour, Soft: true, Grace: time.Minute},
+	} {
+		assert.Error(t, policy.Validate(), policy.Name)
+	}
+}
+
+// poolSaturation reports a fixed saturation per database
+type poolSaturation map[string]int
+
+func (s poolSaturation) Saturation(user, database string) (int, bool) {
+	saturation, ok := s[database]
+	return saturation, ok
+}
+
+func TestQuotaService_PoolSaturation(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	saturation := poolSaturation{"app": 85, "reporting": 50}
+
+	service, err := NewQuotaService(adapters.NewMemoryUsageStore(adapters.WithUsageStoreClock(clock)), []domain.QuotaPolicy{
+		{Name: "tightened", Limit: 10, Window: time.Hour, TightenAt: 80, TightenTo: 50},
+		{Name: "batch", User: "etl", Rate: 10, Burst: 10, TightenAt: 80, TightenTo: 10},
+	}, WithQuotaClock(clock), WithPoolSaturation(saturation))
+	require.NoError(t, err)
+
+	evaluate := func(user, database string) domain.Decision {
+		t.Helper()
+		decision, err := service.Evaluate(ctx, newTestQuery(user, database))
+		require.NoError(t, err)
+		return decision
+	}
+
+	for i := 0; i < 5; i++ {
+		require.True(t, evaluate("alice", "app").Allowed(), "Query %d should be allowed", i+1)
+	}
+	decision := evaluate("alice", "app")
+	assert.False(t, decision.Allowed(), "The limit should be halved while the pool is saturated")
+	assert.Equal(t, int64(5), decision.Limit)
+	assert.Equal(t, `quota "tightened" exceeded: 5 of 5 queries per 1h0m0s, tightened to 50% while the upstream pool is 85% saturated`, decision.Reason)
+
+	for i := 0; i < 10; i++ {
+		require.True(t, evaluate("alice", "reporting").Allowed(), "Pools below the threshold should keep the full limit")
+	}
+	saturation["app"] = 79
+	assert.True(t, evaluate("alice", "app").Allowed(), "The full limit should apply again once the pool is less saturated")
+	assert.True(t, evaluate("bob", "unknown").Allowed(), "Unknown saturation should not tighten")
+
+	// Rates and bursts are tightened as well
+	saturation["app"] = 100
+	assert.True(t, evaluate("etl", "app").Allowed())
+	delayed := make(chan struct{})
+	go func() {
+		defer close(delayed)
+		evaluate("etl", "app")
+	}()
+	require.True(t, clock.WaitForTimers(1, time.Second), "The second query should wait for the tightened burst of one")
+	clock.Advance(time.Second)
+	<-delayed
+
+	for _, policy := range []domain.QuotaPolicy{
+		{Name: "unlimited", MaxConnections: 5, TightenAt: 80, TightenTo: 50},
+		{Name: "alone", Limit: 1, Window: time.Hour, TightenAt: 80},
+		{Name: "loosened", Limit: 1, Window: time.Hour, TightenAt: 80, TightenTo: 150},
+	} {
+		assert.Error(t, policy.Validate(), policy.Name)
+	}
+}
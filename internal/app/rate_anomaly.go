@@ -0,0 +1,263 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRateAnomalyInterval is how long query rates are measured over
+	// before they are compared with their baseline
+	DefaultRateAnomalyInterval = time.Minute
+
+	// DefaultRateAnomalyWarmup is how many intervals a baseline is learned over
+	// before it raises alerts
+	DefaultRateAnomalyWarmup = 10
+
+	// DefaultRateAnomalyMinRate is the query rate, per second, below which
+	// deviations are not reported
+	DefaultRateAnomalyMinRate = 1.0
+)
+
+// RateAnomalyConfig configures alerts for principals whose query rate strays
+// from what they usually issue
+type RateAnomalyConfig struct {
+	// Factor is how many times above its baseline, or below it, the query rate
+	// of an interval must be to raise an alert; zero disables detection
+	Factor float64
+
+	// Interval is how long query rates are measured over; zero uses
+	// DefaultRateAnomalyInterval
+	Interval time.Duration
+
+	// Warmup is how many intervals a baseline is learned over before it alerts.
+	// The baseline is a moving average of the rates of the intervals, in which
+	// each interval weighs 2/(Warmup+1). Zero uses DefaultRateAnomalyWarmup.
+	Warmup int
+
+	// MinRate is the query rate, per second, below which a spike is not
+	// reported, nor a drop from a baseline, so that quiet principals do not
+	// alert on a handful of queries; zero uses DefaultRateAnomalyMinRate
+	MinRate float64
+
+	// Fingerprints learns a baseline for each query fingerprint of a principal
+	// as well, to tell which query changed
+	Fingerprints bool
+
+	// Notices warns the clients of a principal whose rate strayed with a notice
+	// along with its next allowed query
+	Notices bool
+}
+
+// Enabled reports whether rate anomaly detection is configured
+func (c RateAnomalyConfig) Enabled() bool {
+	return c.Factor > 0
+}
+
+// Validate checks that no setting is negative and that enabled alerts have a
+// factor above 1
+func (c RateAnomalyConfig) Validate() error {
+	if c.Enabled() && c.Factor <= 1 {
+		return fmt.Errorf("rate alert factor must be greater than 1")
+	}
+	if c.Factor < 0 || c.Interval < 0 || c.Warmup < 0 || c.MinRate < 0 {
+		return fmt.Errorf("rate alert settings must not be negative")
+	}
+	return nil
+}
+
+// baselineKey identifies the queries a baseline is learned for: those of a
+// principal, or those of one of its query fingerprints
+type baselineKey struct {
+	principalKey
+	hash domain.QueryHash // empty for every query of the principal
+}
+
+// rateBaseline counts the queries of the current interval and learns the usual
+// rate of a key
+type rateBaseline struct {
+	queries   int64   // within the current interval
+	baseline  float64 // queries per second
+	intervals int     // learned so far
+	anomalous bool    // the last interval strayed, so the alert is not repeated
+}
+
+// RateAnomalyDetector is a domain.PolicyEngine decorator that learns the usual
+// query rate of each principal and emits a rate_anomaly event when the rate of
+// an interval is more than a factor above or below it: an early warning before
+// quotas are blown, or that a client stopped working. Baselines adapt to lasting
+// changes, so an alert is raised once per episode. It never changes decisions,
+// but may warn clients with a notice.
+type RateAnomalyDetector struct {
+	config RateAnomalyConfig
+	next   domain.PolicyEngine
+	events domain.EventSink
+	clock  domain.Clock
+	alpha  float64 // weight of the latest interval in a baseline
+
+	mu      sync.Mutex
+	rates   map[baselineKey]*rateBaseline
+	notices map[principalKey]string // warnings for the next query of a principal
+}
+
+// NewRateAnomalyDetector creates a RateAnomalyDetector observing the queries evaluated by next
+func NewRateAnomalyDetector(config RateAnomalyConfig, next domain.PolicyEngine, events domain.EventSink, clock domain.Clock) (*RateAnomalyDetector, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if next == nil {
+		return nil, fmt.Errorf("rate anomaly detection requires a policy engine")
+	}
+	if config.Interval == 0 {
+		config.Interval = DefaultRateAnomalyInterval
+	}
+	if config.Warmup == 0 {
+		config.Warmup = DefaultRateAnomalyWarmup
+	}
+	if config.MinRate == 0 {
+		config.MinRate = DefaultRateAnomalyMinRate
+	}
+	return &RateAnomalyDetector{
+		config:  config,
+		next:    next,
+		events:  events,
+		clock:   clock,
+		alpha:   2 / float64(config.Warmup+1),
+		rates:   make(map[baselineKey]*rateBaseline),
+		notices: make(map[principalKey]string),
+	}, nil
+}
+
+// Evaluate returns the decision of the wrapped engine and counts the query,
+// adding the pending notice of its principal to an allowed decision
+func (d *RateAnomalyDetector) Evaluate(ctx context.Context, query *domain.Query) (domain.Decision, error) {
+	decision, err := d.next.Evaluate(ctx, query)
+	if err != nil {
+		return decision, err
+	}
+
+	principal := principalKey{user: query.UserID, database: query.Database}
+	d.mu.Lock()
+	d.count(baselineKey{principalKey: principal})
+	if d.config.Fingerprints && query.Hash.String() != "" {
+		d.count(baselineKey{principalKey: principal, hash: query.Hash})
+	}
+	notice, ok := d.notices[principal]
+	if ok && decision.Allowed() {
+		delete(d.notices, principal)
+	}
+	d.mu.Unlock()
+
+	if ok && decision.Allowed() {
+		decision.Warnings = append(slices.Clip(decision.Warnings), notice)
+	}
+	return decision, nil
+}
+
+// RecordUsage forwards statement usage to the wrapped engine when it has metered quotas
+func (d *RateAnomalyDetector) RecordUsage(ctx context.Context, query *domain.Query, usage domain.StatementUsage) error {
+	if recorder, ok := d.next.(domain.UsageRecorder); ok {
+		return recorder.RecordUsage(ctx, query, usage)
+	}
+	return nil
+}
+
+// count adds a query to the current interval of key
+func (d *RateAnomalyDetector) count(key baselineKey) {
+	rate, ok := d.rates[key]
+	if !ok {
+		rate = &rateBaseline{}
+		d.rates[key] = rate
+	}
+	rate.queries++
+}
+
+// Check ends the current interval: the rate of each key is compared with its
+// baseline, which then learns it. Keys idle long enough to expect less than a
+// query per interval are forgotten and learn their baseline again.
+func (d *RateAnomalyDetector) Check() {
+	now := d.clock.Now()
+	seconds := d.config.Interval.Seconds()
+
+	var events []domain.Event
+	d.mu.Lock()
+	for key, rate := range d.rates {
+		current := float64(rate.queries) / seconds
+		rate.queries = 0
+
+		if rate.intervals >= d.config.Warmup {
+			direction := ""
+			switch {
+			case current >= d.config.MinRate && current > rate.baseline*d.config.Factor:
+				direction = "spike"
+			case rate.baseline >= d.config.MinRate && current < rate.baseline/d.config.Factor:
+				direction = "drop"
+			}
+			if direction != "" && !rate.anomalous {
+				events = append(events, d.anomaly(key, now, current, rate.baseline, direction))
+			}
+			rate.anomalous = direction != ""
+		}
+
+		if rate.intervals == 0 {
+			rate.baseline = current
+		} else {
+			rate.baseline += d.alpha * (current - rate.baseline)
+		}
+		rate.intervals++
+		if current == 0 && rate.baseline*seconds < 1 {
+			delete(d.rates, key)
+			if key.hash.String() == "" {
+				delete(d.notices, key.principalKey)
+			}
+		}
+	}
+	d.mu.Unlock()
+
+	if d.events != nil {
+		for _, event := range events {
+			d.events.Emit(event)
+		}
+	}
+}
+
+// anomaly returns the event reporting that the rate of key strayed from its
+// baseline, and queues a notice for its principal when notices are enabled
+func (d *RateAnomalyDetector) anomaly(key baselineKey, now time.Time, current, baseline float64, direction string) domain.Event {
+	fields := map[string]interface{}{
+		"user":                key.user,
+		"database":            key.database,
+		"direction":           direction,
+		"queries_per_second":  current,
+		"baseline_per_second": baseline,
+		"factor":              d.config.Factor,
+		"interval":            d.config.Interval.String(),
+	}
+	subject := fmt.Sprintf("the query rate of user %s on database %s", key.user, key.database)
+	if hash := key.hash.String(); hash != "" {
+		fields["query_hash"] = hash
+		subject = fmt.Sprintf("the rate of query %s of user %s on database %s", hash, key.user, key.database)
+	}
+	if d.config.Notices {
+		d.notices[key.principalKey] = fmt.Sprintf("%s is %.1f/s, against %.1f/s usually", subject, current, baseline)
+	}
+	return domain.Event{Type: domain.EventRateAnomaly, Timestamp: now, Fields: fields}
+}
+
+// Run checks the rates every interval until ctx is cancelled
+func (d *RateAnomalyDetector) Run(ctx context.Context) {
+	for {
+		timer := d.clock.NewTimer(d.config.Interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+		d.Check()
+	}
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// issue evaluates the given number of queries of each user through detector,
+// then ends the interval
+func issue(t *testing.T, detector *RateAnomalyDetector, counts map[string]int) {
+	t.Helper()
+	for user, count := range counts {
+		for i := 0; i < count; i++ {
+			query := newPrincipalQuery(user)
+			query.Hash = domain.NewQueryHash("orders")
+			_, err := detector.Evaluate(context.Background(), query)
+			require.NoError(t, err)
+		}
+	}
+	detector.Check()
+}
+
+func TestRateAnomalyDetector_ReportsSpikesAndDrops(t *testing.T) {
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	events := &mocks.RecordingEventSink{}
+	detector, err := NewRateAnomalyDetector(RateAnomalyConfig{Factor: 3, Interval: 10 * time.Second, Warmup: 3, MinRate: 1},
+		userDenyingPolicyEngine{}, events, clock)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		issue(t, detector, map[string]int{"alice": 20, "bob": 5}) // bob is below the minimum rate
+	}
+	assert.Empty(t, events.Events(), "A steady rate should not alert")
+
+	issue(t, detector, map[string]int{"alice": 100, "bob": 50})
+	alerts := events.EventsOfType(domain.EventRateAnomaly)
+	require.Len(t, alerts, 2)
+	for _, alert := range alerts {
+		assert.Equal(t, "spike", alert.Fields["direction"])
+		assert.NotContains(t, alert.Fields, "query_hash", "Fingerprints should only be tracked when enabled")
+	}
+
+	issue(t, detector, map[string]int{"alice": 100})
+	assert.Len(t, events.EventsOfType(domain.EventRateAnomaly), 2, "A lasting spike should alert once")
+
+	issue(t, detector, map[string]int{"alice": 20})
+	for i := 0; i < 4; i++ {
+		issue(t, detector, nil)
+	}
+	alerts = events.EventsOfType(domain.EventRateAnomaly)
+	require.Len(t, alerts, 3, "Falling back then stopping should alert once")
+	assert.Equal(t, "alice", alerts[2].Fields["user"])
+	assert.Equal(t, "drop", alerts[2].Fields["direction"])
+	assert.Equal(t, 2.0, alerts[2].Fields["queries_per_second"])
+}
+
+func TestRateAnomalyDetector_FingerprintsAndNotices(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	events := &mocks.RecordingEventSink{}
+	detector, err := NewRateAnomalyDetector(RateAnomalyConfig{Factor: 2, Interval: time.Second, Warmup: 1, Fingerprints: true, Notices: true},
+		userDenyingPolicyEngine{}, events, clock)
+	require.NoError(t, err)
+
+	issue(t, detector, map[string]int{"alice": 5})
+	issue(t, detector, map[string]int{"alice": 20})
+	alerts := events.EventsOfType(domain.EventRateAnomaly)
+	require.Len(t, alerts, 2, "Both the principal and its fingerprint should alert")
+
+	decision, err := detector.Evaluate(ctx, newPrincipalQuery("alice"))
+	require.NoError(t, err)
+	require.Len(t, decision.Warnings, 1, "The next query should carry a notice")
+	assert.Contains(t, decision.Warnings[0], "20.0/s")
+
+	decision, err = detector.Evaluate(ctx, newPrincipalQuery("alice"))
+	require.NoError(t, err)
+	assert.Empty(t, decision.Warnings, "The notice should be sent once")
+}
+
+func TestRateAnomalyConfig_Validate(t *testing.T) {
+	assert.NoError(t, RateAnomalyConfig{}.Validate())
+	assert.NoError(t, RateAnomalyConfig{Factor: 3}.Validate())
+	assert.Error(t, RateAnomalyConfig{Factor: 1}.Validate())
+	assert.Error(t, RateAnomalyConfig{Factor: 3, Interval: -time.Second}.Validate())
+	assert.Error(t, RateAnomalyConfig{Factor: 3, MinRate: -1}.Validate())
+}
@@ -0,0 +1,220 @@
+package app
+
+import (
+	"context"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sync"
+	"time"
+)
+
+// rateSweepInterval is how often buckets that refilled completely are dropped
+const rateSweepInterval = time.Minute
+
+// rateKey identifies the token bucket of a policy shared by a principal, or by a
+// single connection of it
+type rateKey struct {
+	policy       string
+	user         string
+	database     string
+	connectionID string // empty when the principal's connections share the bucket
+}
+
+// tokenBucket holds the tokens available to a rateKey as of updated. Tokens go
+// negative when queries reserve more than is available; they wait for the debt
+// to be refilled. Credits accrue once the bucket is full, up to their cap, and
+// are spent before queries go into debt.
+type tokenBucket struct {
+	tokens    float64
+	burst     float64
+	rate      float64
+	credits   float64
+	creditCap float64
+	accrual   float64 // credits earned per second while the bucket is full
+	updated   time.Time
+}
+
+// refill adds the tokens accumulated since the last update, up to the burst,
+// and the credits earned for the time the bucket spent full
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	b.updated = now
+	if b.tokens+elapsed*b.rate <= b.burst {
+		b.tokens += elapsed * b.rate
+		return
+	}
+	full := elapsed - max(0, b.burst-b.tokens)/b.rate
+	b.tokens = b.burst
+	b.credits = min(b.creditCap, b.credits+full*b.accrual)
+}
+
+// put gives back tokens, those beyond the burst as credits
+func (b *tokenBucket) put(tokens float64) {
+	b.tokens += tokens
+	if b.tokens > b.burst {
+		b.credits = min(b.creditCap, b.credits+b.tokens-b.burst)
+		b.tokens = b.burst
+	}
+}
+
+// RateLimiter smooths the query rate of the rate-limited quota policies with token
+// buckets. Queries reserve their tokens as they arrive and wait until the bucket
+// has refilled the tokens they borrowed, so delayed queries run in arrival order
+// at the policy's rate instead of being denied. Principals of policies with
+// credits start with a full balance, as if they had been idle, and keep it
+// across policy reloads but not restarts.
+type RateLimiter struct {
+	clock domain.Clock
+
+	mu        sync.Mutex
+	buckets   map[rateKey]*tokenBucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates a RateLimiter measuring time with clock
+func NewRateLimiter(clock domain.Clock) *RateLimiter {
+	return &RateLimiter{
+		clock:   clock,
+		buckets: make(map[rateKey]*tokenBucket),
+	}
+}
+
+// Wait takes cost tokens from the bucket of the query under each rate-limited
+// policy and blocks until all of them are available. It returns how long the
+// query was delayed, or the context's error when it is done first, in which case
+// the tokens are given back.
+func (l *RateLimiter) Wait(ctx context.Context, policies []domain.QuotaPolicy, query *domain.Query, cost int64) (time.Duration, error) {
+	if cost <= 0 {
+		return 0, nil
+	}
+
+	var delay time.Duration
+	var reserved []rateKey
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	l.sweep(now)
+	for _, policy := range policies {
+		if !policy.RateLimited() {
+			continue
+		}
+		key := rateKeyOf(policy, query)
+		reserved = append(reserved, key)
+		delay = max(delay, l.reserve(key, policy, cost, now))
+	}
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return 0, nil
+	}
+
+	timer := l.clock.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return delay, nil
+	case <-ctx.Done():
+		l.release(reserved, cost)
+		return 0, ctx.Err()
+	}
+}
+
+// reserve takes cost tokens from the bucket of key and returns how long the
+// bucket needs to refill its debt; l.mu must be held
+func (l *RateLimiter) reserve(key rateKey, policy domain.QuotaPolicy, cost int64, now time.Time) time.Duration {
+	bucket := l.bucket(key, policy, now)
+	bucket.tokens -= float64(cost)
+	if bucket.tokens < 0 && bucket.credits > 0 {
+		spent := min(bucket.credits, -bucket.tokens)
+		bucket.credits -= spent
+		bucket.tokens += spent
+	}
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+// bucket returns the bucket of key under policy, refilled as of now; l.mu must
+// be held
+func (l *RateLimiter) bucket(key rateKey, policy domain.QuotaPolicy, now time.Time) *tokenBucket {
+	burst, credits := float64(policy.RateBurst()), float64(policy.Credits)
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, credits: credits, updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.refill(now)
+	// Policies may have been replaced since the bucket was created
+	bucket.burst, bucket.rate = burst, policy.Rate
+	bucket.creditCap, bucket.accrual = credits, policy.CreditAccrual()
+	bucket.tokens = min(bucket.tokens, burst)
+	bucket.credits = min(bucket.credits, credits)
+	return bucket
+}
+
+// Credits returns the credit balance of the principal under a policy with
+// credits, and when it will be full again at the current rate of accrual if
+// the principal stays idle
+func (l *RateLimiter) Credits(policy domain.QuotaPolicy, user, database string) (float64, time.Time) {
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket := l.bucket(rateKey{policy: policy.Name, user: user, database: database}, policy, now)
+	refill := max(0, bucket.burst-bucket.tokens)/bucket.rate + (bucket.creditCap-bucket.credits)/bucket.accrual
+	return bucket.credits, now.Add(time.Duration(refill * float64(time.Second)))
+}
+
+// Refund gives back the tokens Wait took from the buckets of a query that was
+// denied after it, so that it does not slow the principal's next queries
+func (l *RateLimiter) Refund(policies []domain.QuotaPolicy, query *domain.Query, cost int64) {
+	if cost <= 0 {
+		return
+	}
+	var keys []rateKey
+	for _, policy := range policies {
+		if policy.RateLimited() {
+			keys = append(keys, rateKeyOf(policy, query))
+		}
+	}
+	l.release(keys, cost)
+}
+
+// release gives back the tokens a cancelled query reserved
+func (l *RateLimiter) release(keys []rateKey, cost int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		if bucket, ok := l.buckets[key]; ok {
+			bucket.put(float64(cost))
+		}
+	}
+}
+
+// sweep drops buckets that refilled completely, credits included, at most once per sweep interval,
+// so closed connections and idle principals do not leak; l.mu must be held
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, bucket := range l.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.burst && bucket.credits >= bucket.creditCap {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateKeyOf returns the bucket of the query under a rate-limited policy
+func rateKeyOf(policy domain.QuotaPolicy, query *domain.Query) rateKey {
+	key := rateKey{policy: policy.Name, user: query.UserID, database: query.Database}
+	if policy.RatePer == domain.RateScopeConnection {
+		key.connectionID = query.ConnectionID
+	}
+	return key
+}
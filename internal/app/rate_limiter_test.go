@@ -0,0 +1,154 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newConnectionQuery(user, connectionID string) *domain.Query {
+	query := domain.NewQuery("SELECT 1", connectionID)
+	query.UserID = user
+	query.Database = "app"
+	return query
+}
+
+func TestRateLimiter_DelaysBeyondBurst(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	limiter := NewRateLimiter(clock)
+	policies := []domain.QuotaPolicy{{Name: "batch", Rate: 2, Burst: 2}}
+
+	for i := 0; i < 2; i++ {
+		delay, err := limiter.Wait(ctx, policies, newConnectionQuery("alice", "conn_1"), 1)
+		require.NoError(t, err)
+		assert.Zero(t, delay, "Query %d fits in the burst", i+1)
+	}
+
+	// The next two queries queue behind each other at the rate
+	delays := make(chan time.Duration, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			delay, err := limiter.Wait(ctx, policies, newConnectionQuery("alice", "conn_2"), 1)
+			assert.NoError(t, err)
+			delays <- delay
+		}()
+	}
+	require.True(t, clock.WaitForTimers(2, time.Second))
+	clock.Advance(500 * time.Millisecond)
+	assert.Equal(t, 500*time.Millisecond, <-delays)
+	clock.Advance(500 * time.Millisecond)
+	assert.Equal(t, time.Second, <-delays)
+
+	// Tokens refill at the rate up to the burst
+	clock.Advance(time.Minute)
+	delay, err := limiter.Wait(ctx, policies, newConnectionQuery("alice", "conn_1"), 2)
+	require.NoError(t, err)
+	assert.Zero(t, delay)
+}
+
+func TestRateLimiter_Scopes(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	limiter := NewRateLimiter(clock)
+	perConnection := []domain.QuotaPolicy{{Name: "batch", Rate: 1, RatePer: domain.RateScopeConnection}}
+	perUser := []domain.QuotaPolicy{{Name: "shared", Rate: 1}}
+
+	for _, connectionID := range []string{"conn_1", "conn_2"} {
+		delay, err := limiter.Wait(ctx, perConnection, newConnectionQuery("alice", connectionID), 1)
+		require.NoError(t, err)
+		assert.Zero(t, delay, "Each connection has its own bucket")
+	}
+
+	delay, err := limiter.Wait(ctx, perUser, newConnectionQuery("alice", "conn_1"), 1)
+	require.NoError(t, err)
+	assert.Zero(t, delay)
+	delay, err = limiter.Wait(ctx, perUser, newConnectionQuery("bob", "conn_3"), 1)
+	require.NoError(t, err)
+	assert.Zero(t, delay, "Each user has their own bucket")
+
+	// The user's connections share its bucket
+	done := make(chan time.Duration)
+	go func() {
+		delay, err := limiter.Wait(ctx, perUser, newConnectionQuery("alice", "conn_2"), 1)
+		assert.NoError(t, err)
+		done <- delay
+	}()
+	require.True(t, clock.WaitForTimers(1, time.Second))
+	clock.Advance(time.Second)
+	assert.Equal(t, time.Second, <-done)
+}
+
+func TestRateLimiter_CancelReleasesTokens(t *testing.T) {
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	limiter := NewRateLimiter(clock)
+	policies := []domain.QuotaPolicy{{Name: "batch", Rate: 1, Burst: 2}}
+
+	_, err := limiter.Wait(context.Background(), policies, newConnectionQuery("alice", "conn_1"), 2)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := limiter.Wait(ctx, policies, newConnectionQuery("alice", "conn_1"), 1)
+		errs <- err
+	}()
+	require.True(t, clock.WaitForTimers(1, time.Second))
+	cancel()
+	assert.ErrorIs(t, <-errs, context.Canceled)
+
+	// The abandoned query gave its token back, so one second refills a token
+	clock.Advance(time.Second)
+	delay, err := limiter.Wait(context.Background(), policies, newConnectionQuery("alice", "conn_1"), 1)
+	require.NoError(t, err)
+	assert.Zero(t, delay)
+}
+
+func TestRateLimiter_Credits(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	limiter := NewRateLimiter(clock)
+	policy := domain.QuotaPolicy{Name: "tenant", Rate: 2, Burst: 2, Credits: 10, CreditRate: 1}
+	policies := []domain.QuotaPolicy{policy}
+
+	// A full balance covers a spike of burst plus credits without delay
+	delay, err := limiter.Wait(ctx, policies, newConnectionQuery("alice", "conn_1"), 12)
+	require.NoError(t, err)
+	assert.Zero(t, delay)
+	balance, fullAt := limiter.Credits(policy, "alice", "app")
+	assert.Zero(t, balance)
+	assert.Equal(t, clock.Now().Add(11*time.Second), fullAt, "The burst refills first, then credits accrue")
+
+	// Credits accrue only once the bucket is full
+	clock.Advance(6 * time.Second)
+	balance, _ = limiter.Credits(policy, "alice", "app")
+	assert.InDelta(t, 5, balance, 1e-9)
+
+	delay, err = limiter.Wait(ctx, policies, newConnectionQuery("alice", "conn_2"), 7)
+	require.NoError(t, err)
+	assert.Zero(t, delay, "Credits are shared across the principal's connections")
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = limiter.Wait(cancelled, policies, newConnectionQuery("alice", "conn_1"), 1)
+	assert.ErrorIs(t, err, context.Canceled, "The query should have waited once credits ran out")
+
+	// Balances are capped at Credits
+	clock.Advance(time.Minute)
+	balance, _ = limiter.Credits(policy, "alice", "app")
+	assert.InDelta(t, 10, balance, 1e-9)
+
+	for _, invalid := range []domain.QuotaPolicy{
+		{Name: "no rate", Limit: 10, Window: time.Hour, Credits: 10},
+		{Name: "per connection", Rate: 2, RatePer: domain.RateScopeConnection, Credits: 10},
+		{Name: "no credits", Rate: 2, CreditRate: 1},
+	} {
+		assert.Error(t, invalid.Validate(), invalid.Name)
+	}
+}
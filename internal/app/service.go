@@ -2,58 +2,2315 @@ package app
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
 	"pgbouncer-quota-enforcer/internal/app/domain"
 	"pgbouncer-quota-enforcer/internal/infra/adapters"
 	"pgbouncer-quota-enforcer/pkg/logger"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrPoliciesUnmanaged is returned when quota policies are managed by a custom policy engine
+	ErrPoliciesUnmanaged = errors.New("quota policies are managed by a custom policy engine")
+
+	// ErrInvalidPolicies is returned when quota policies fail validation
+	ErrInvalidPolicies = errors.New("invalid quota policies")
+
+	// ErrPolicyNotFound is returned when no quota policy has the given name
+	ErrPolicyNotFound = errors.New("quota policy not found")
+
+	// ErrConnectionNotFound is returned when no open connection has the given ID
+	ErrConnectionNotFound = errors.New("connection not found")
+
+	// ErrPoolerUnmonitored is returned when no pooler admin console is configured
+	ErrPoolerUnmonitored = errors.New("the upstream pooler is not monitored")
+
+	// ErrFailoverDisabled is returned when no secondary upstream is configured
+	ErrFailoverDisabled = errors.New("upstream failover is not configured")
+
+	// ErrFirewallDisabled is returned when the SQL firewall is not configured
+	ErrFirewallDisabled = errors.New("the SQL firewall is not configured")
+
+	// ErrFaultInjectionDisabled is returned by binaries built without the chaos tag
+	ErrFaultInjectionDisabled = errors.New("fault injection requires a binary built with the chaos tag")
+
+	// ErrFirewallProfileNotFound is returned when the SQL firewall learned no
+	// queries for the given user
+	ErrFirewallProfileNotFound = errors.New("firewall profile not found")
 )
 
 // ServerService provides the high-level application service for the TCP server
 type ServerService struct {
-	tcpServer domain.TCPServer
-	logger    logger.Logger
+	instanceID  string
+	tcpServer   domain.TCPServer
+	logger      logger.Logger
+	maintenance *MaintenanceService
+	quotas      *QuotaService // nil when a custom policy engine is used
+	connections *ConnectionRegistry
+	activity    *ActivityMonitor
+	queryStats  *QueryStatsCollector
+	rateAlerts  *RateAnomalyDetector // nil unless rate alerts are configured
+	firewall    *SQLFirewall         // nil unless the SQL firewall is configured
+	faults      domain.FaultInjector
+	reloadMu    sync.Mutex
+	upstreams   *UpstreamBalancer
+	discoveries []*UpstreamDiscovery
+	pooler      *PoolerMonitor              // nil unless the upstream pooler is monitored
+	failover    *UpstreamFailover           // nil unless a secondary upstream is configured
+	housekeeper *Housekeeper                // nil unless a leader elector is set
+	housekept   chan struct{}               // closed once the housekeeper resigned
+	secondary   *UpstreamBalancer           // targets of the secondary upstream, nil without one
+	usageStore  domain.Pinger               // nil unless the usage store depends on an external service
+	queryCache  *adapters.CachingNormalizer // nil when normalized queries are not cached
+	stopRefresh context.CancelFunc
+	closers     []io.Closer
+	access      *AccessControl // nil when clients may connect from anywhere
+
+	listeners         []ListenerConfig
+	listenerUpstreams map[string]*UpstreamBalancer // upstreams of the listeners having their own
+	databaseUpstreams map[string]*UpstreamBalancer // upstreams of the databases having their own
+	socketActivation  bool
+	listener          net.Listener // accepts the connections of the default listener, nil to listen on its address
+
+	closeConnections context.CancelFunc // ends the handling of every connection
+
+	drainMu       sync.Mutex
+	drainStarted  time.Time
+	drainDeadline time.Time
+	drained       chan struct{} // closed once a drain completes
+}
+
+// ServerConfig holds configuration for the server service
+type ServerConfig struct {
+	Address string
+
+	// InstanceID identifies this replica in logs, events and captures; generated when empty
+	InstanceID string
+
+	// Upstream locates the PostgreSQL or PgBouncer backends: a host:port whose name
+	// is re-resolved as its DNS records expire, srv://<record> or consul://<service>
+	Upstream string
+
+	// Listeners accept connections on other addresses than Address, each under
+	// a name that policies can be scoped to, and may proxy them to upstreams of
+	// their own
+	Listeners []ListenerConfig
+
+	// Databases route the connections to some databases to upstreams of their
+	// own, or to another database upstream, like PgBouncer's [databases] section
+	Databases []DatabaseConfig
+
+	// SocketActivation serves the sockets passed by systemd: those named after a
+	// listener serve it and the others serve the default listener. Listeners
+	// without a socket listen on their address, the default one on Address.
+	SocketActivation bool
+
+	// Access restricts the addresses clients may connect from, per listener and per user
+	Access AccessConfig
+
+	// UpstreamDiscovery bounds how often the upstream is re-resolved
+	UpstreamDiscovery UpstreamDiscoveryConfig
+
+	// UpstreamTimeout bounds connecting to the upstream; zero uses the handler default
+	UpstreamTimeout time.Duration
+
+	// UpstreamTLS encrypts the connections to the upstream
+	UpstreamTLS UpstreamTLSConfig
+
+	// GSSEncryptionTunnel relays the connections of clients requesting GSSAPI
+	// encryption to their upstream byte for byte, unenforced, when it accepts
+	// it; otherwise GSSENCRequests are declined and GSSAPI authentication is
+	// relayed like any other
+	GSSEncryptionTunnel bool
+
+	// UpstreamReconnect replaces the upstream connection of a client lost
+	// outside a transaction, such as when the upstream restarts, instead of
+	// closing the client connection; pooled connections are not reconnected
+	UpstreamReconnect bool
+
+	// Failover checks the health of the upstream and fails new connections over
+	// to a secondary while it is unhealthy; listener and database upstreams do
+	// not fail over
+	Failover UpstreamFailoverConfig
+
+	// Pool shares upstream connections between clients instead of opening one
+	// per client; it needs Auth.File
+	Pool PoolConfig
+
+	// ReadTimeout is how long a client read blocks before shutdown and eviction are
+	// checked again; zero uses the handler default
+	ReadTimeout time.Duration
+
+	// IdleTimeout and IdleTxTimeout close the connections of clients idle for
+	// longer outside a transaction, or inside one; zero disables either
+	IdleTimeout   time.Duration
+	IdleTxTimeout time.Duration
+
+	// LogLevel is the minimum severity logged; the zero value logs everything
+	LogLevel logger.Level
+
+	// LogParameters are the query fingerprints whose literals and bound
+	// parameters the query logger may write; "*" allows every query. Others are
+	// logged as their normalized text.
+	LogParameters []string
+
+	// Normalizer names the normalizer fingerprinting queries: pg_query, the
+	// default, fast-regex, which needs no CGO call, or none, which leaves queries
+	// as they are, literals included
+	Normalizer string
+
+	// QueryCacheSize caps the normalized queries cached by text, so repeated
+	// queries are parsed once; zero disables the cache
+	QueryCacheSize int
+
+	// StatementCacheSize caps the prepared statements cached by name in addition;
+	// zero caches them by text only
+	StatementCacheSize int
+
+	// CaptureFile, when set, records every query event to a capture file
+	CaptureFile string
+
+	// CaptureParameters records the values bound to prepared statements in protocol
+	// events and on the queries of their executions
+	CaptureParameters bool
+
+	// QuotaFunctions answers SELECT quota_remaining() and SELECT * FROM
+	// pgqe.usage from the quotas of the default policy engine
+	QuotaFunctions bool
+
+	// Faults are the rules of the faults injected for resilience testing, in
+	// binaries built with the chaos tag (see adapters.ParseFaultRules)
+	Faults string
+
+	// ParameterLabels label the executions of prepared statements with values
+	// bound to them, so that label policies apply per value
+	ParameterLabels ParameterLabelConfig
+
+	// Policies are the quota policies enforced by the default policy engine
+	Policies []domain.QuotaPolicy
+
+	// Roles are the members of the roles policies may apply to, as user names by
+	// role name
+	Roles map[string][]string
+
+	// Identity looks the directory groups of users up, making them members of
+	// the roles of the same name
+	Identity IdentityConfig
+
+	// UsageWeights sets how much quota Query, Parse and Execute messages consume;
+	// the zero value uses domain.DefaultUsageWeights
+	UsageWeights domain.UsageWeights
+
+	// BurstDetection reports and optionally limits N+1 query patterns
+	BurstDetection BurstDetectorConfig
+
+	// DenialAlerts raises an event when a principal is denied unusually often
+	DenialAlerts DenialAnomalyConfig
+
+	// RateAlerts raises an event when the query rate of a principal strays from
+	// its learned baseline
+	RateAlerts RateAnomalyConfig
+
+	// Firewall learns the queries each user runs, then blocks or alerts on
+	// those it never saw
+	Firewall FirewallConfig
+
+	// MaxIdleConnections caps the idle connections each user and database pair may
+	// hold; the longest idle ones beyond it are closed. Zero disables eviction.
+	MaxIdleConnections int
+
+	// MaxMessageSize closes the connections of clients sending a larger message,
+	// in bytes; zero for no limit
+	MaxMessageSize int
+
+	// MaxConnectionBuffer closes the connections whose prepared statements and
+	// portals hold more bytes; zero for no limit
+	MaxConnectionBuffer int64
+
+	// TLS terminates TLS for clients that send an SSLRequest
+	TLS TLSConfig
+
+	// Auth authenticates clients at the enforcer instead of the upstream
+	Auth AuthConfig
+
+	// Audit appends a record of every evaluated query to a rotated file
+	Audit AuditConfig
+
+	// SlowQueries writes a record of every query slower than a threshold to a
+	// dedicated log
+	SlowQueries SlowQueryConfig
+
+	// QueryLogs are the destinations of the query log, each with its own filter;
+	// empty logs every query to standard output
+	QueryLogs []QueryLogConfig
+
+	// Scripts run operator Lua scripts on every query, which may deny or rewrite it
+	Scripts ScriptConfig
+
+	// Rewrite rewrites queries before the upstream runs them: bounding reads,
+	// filtering tenants and tagging them with trace comments
+	Rewrite RewriteConfig
+
+	// Kafka publishes the outcome of every evaluated query to a Kafka topic
+	Kafka KafkaConfig
+
+	// QuotaAlerts raises events as principals use up the quotas of the default policy engine
+	QuotaAlerts QuotaAlertConfig
+
+	// AsyncUsage records usage in the background, so a slow usage store does not
+	// delay queries
+	AsyncUsage AsyncUsageConfig
+
+	// Webhooks are notified of events in addition to the event sink
+	Webhooks []WebhookConfig
+
+	// PgBouncer polls the admin console of the PgBouncer the upstream runs, so
+	// that policies can be tightened while its pools are saturated
+	PgBouncer PgBouncerConfig
+
+	// Housekeeping configures the jobs run by the replica elected leader of a
+	// cluster, when a leader elector is set with WithLeaderElector
+	Housekeeping HousekeepingConfig
+
+	// QueryStats configures the statistics kept per query fingerprint, added
+	// to the usage store when it keeps them
+	QueryStats QueryStatsConfig
+}
+
+// PgBouncerConfig configures the polling of PgBouncer's admin console
+type PgBouncerConfig struct {
+	// AdminURL connects to the admin console, e.g.
+	// postgres://stats@pgbouncer.internal:6432/pgbouncer; empty disables polling
+	AdminURL string
+
+	// PollInterval is how often the console is polled; zero uses DefaultPoolerPollInterval
+	PollInterval time.Duration
+}
+
+// Enabled reports whether an admin console is configured
+func (c PgBouncerConfig) Enabled() bool {
+	return c.AdminURL != ""
+}
+
+// Validate checks that the poll interval is not negative
+func (c PgBouncerConfig) Validate() error {
+	if c.PollInterval < 0 {
+		return fmt.Errorf("PgBouncer poll interval must not be negative")
+	}
+	return nil
+}
+
+// AsyncUsageConfig configures recording usage in the background
+type AsyncUsageConfig struct {
+	Enabled bool
+
+	// Staleness is how long usage read from the store is trusted by enforcement;
+	// zero reads the store on every check
+	Staleness time.Duration
+
+	// Workers and QueueSize are how many goroutines write increments to the store
+	// and how many each buffers; zero uses the defaults
+	Workers   int
+	QueueSize int
+}
+
+// Validate checks that no setting is negative
+func (c AsyncUsageConfig) Validate() error {
+	if c.Staleness < 0 || c.Workers < 0 || c.QueueSize < 0 {
+		return fmt.Errorf("async usage settings must not be negative")
+	}
+	return nil
+}
+
+// ListenerConfig configures an additional listener
+type ListenerConfig struct {
+	// Name identifies the listener in policies and logs; with socket activation,
+	// it is matched against the FileDescriptorName= of the sockets passed by systemd
+	Name string
+
+	// Address is where the listener accepts connections; it may be left empty
+	// with socket activation
+	Address string
+
+	// Upstream locates the backends of the listener's connections, like
+	// ServerConfig.Upstream, which they are proxied to when it is empty
+	Upstream string
+
+	// Allow and Deny are the CIDR ranges the listener's clients may and may not
+	// connect from, see AccessConfig
+	Allow []string
+	Deny  []string
+}
+
+// DatabaseConfig routes the connections to a database, as named by clients in
+// their startup packet
+type DatabaseConfig struct {
+	// Name is the database clients connect to
+	Name string
+
+	// Upstream locates the backends of its connections, like ServerConfig.Upstream;
+	// empty keeps the upstream of their listener
+	Upstream string
+
+	// Database is the database the connections are logged into upstream; empty
+	// keeps Name
+	Database string
+}
+
+// PoolConfig configures the pooling of upstream connections
+type PoolConfig struct {
+	// Mode is session, which assigns a connection to a client until it
+	// disconnects, or transaction, which assigns one per transaction. Empty
+	// opens an upstream connection per client.
+	Mode string
+
+	// Size caps the upstream connections of each listener, user and database;
+	// zero uses adapters.DefaultPoolSize
+	Size int
+
+	// Sizes overrides Size for some users and databases; the first match applies
+	Sizes []PoolSizeConfig
+
+	// WaitTimeout bounds how long a client waits for a connection of a full
+	// pool before it is disconnected; zero uses adapters.DefaultPoolWaitTimeout
+	WaitTimeout time.Duration
+}
+
+// PoolSizeConfig is the pool size of a user and database; empty fields match any
+type PoolSizeConfig struct {
+	User     string
+	Database string
+	Size     int
+}
+
+// Enabled reports whether a pool mode is set
+func (c PoolConfig) Enabled() bool {
+	return c.Mode != ""
+}
+
+// Validate checks the mode and that sizes and the wait timeout are not negative
+func (c PoolConfig) Validate() error {
+	if _, err := adapters.ParsePoolMode(c.Mode); err != nil {
+		return err
+	}
+	if c.Size < 0 || c.WaitTimeout < 0 {
+		return fmt.Errorf("pool size and wait timeout must not be negative")
+	}
+	for _, size := range c.Sizes {
+		if size.Size < 1 {
+			return fmt.Errorf("pool size of user %q and database %q must be positive", size.User, size.Database)
+		}
+	}
+	return nil
+}
+
+// QuotaAlertConfig configures the events raised as principals use up their quotas
+type QuotaAlertConfig struct {
+	// Thresholds are percentages of a policy's limit; a quota_threshold event is
+	// raised when a principal's usage crosses one within the policy's window. Once
+	// set, a quota_blocked event is raised when a policy starts denying a principal.
+	Thresholds []int
+}
+
+// Enabled reports whether thresholds are configured
+func (c QuotaAlertConfig) Enabled() bool {
+	return len(c.Thresholds) > 0
+}
+
+// Validate checks that the thresholds are positive
+func (c QuotaAlertConfig) Validate() error {
+	for _, threshold := range c.Thresholds {
+		if threshold <= 0 {
+			return fmt.Errorf("quota alert thresholds must be positive")
+		}
+	}
+	return nil
+}
+
+// WebhookConfig is an HTTP endpoint notified of events
+type WebhookConfig struct {
+	URL string
+
+	// Secret, when set, signs every delivery with HMAC-SHA256
+	Secret string
+
+	// Events lists the event types delivered; empty delivers every event
+	Events []string
+}
+
+// Validate checks the URL is set and the event types are known
+func (c WebhookConfig) Validate() error {
+	if c.URL == "" {
+		return fmt.Errorf("webhook URL is required")
+	}
+	for _, name := range c.Events {
+		if !slices.Contains(domain.EventTypes, domain.EventType(name)) {
+			return fmt.Errorf("unknown event type %q for webhook %s", name, c.URL)
+		}
+	}
+	return nil
+}
+
+// KafkaConfig configures the publishing of query events to Kafka
+type KafkaConfig struct {
+	// Brokers bootstrap the discovery of the cluster, as host:port; empty disables publishing
+	Brokers []string
+
+	// Topic receives the events
+	Topic string
+
+	// Key selects the event field that keys messages: user or query_hash; empty keys by user
+	Key string
+
+	// BatchSize caps the events of a produce request and Linger bounds how long
+	// events wait for their batch to fill; zero uses the adapter defaults
+	BatchSize int
+	Linger    time.Duration
+
+	// TLS encrypts the connections to the brokers
+	TLS KafkaTLSConfig
+
+	// SASL authenticates to the brokers
+	SASL KafkaSASLConfig
+}
+
+// KafkaTLSConfig configures TLS on the connections to the brokers
+type KafkaTLSConfig struct {
+	// Enabled connects to the brokers over TLS
+	Enabled bool
+
+	// ServerName is verified against broker certificates; empty uses the host of each broker
+	ServerName string
+
+	// CAFile holds the CAs trusted to sign broker certificates; empty uses the system roots
+	CAFile string
+
+	// CertFile and KeyFile hold the client certificate presented to brokers that ask for one
+	CertFile string
+	KeyFile  string
+}
+
+// KafkaSASLConfig configures the SASL authentication to the brokers
+type KafkaSASLConfig struct {
+	// Mechanism is PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512; empty disables SASL
+	Mechanism string
+	Username  string
+	Password  string
+}
+
+// Enabled reports whether brokers are configured
+func (c KafkaConfig) Enabled() bool {
+	return len(c.Brokers) > 0
+}
+
+// Validate checks that brokers come with a topic and that the key is known
+func (c KafkaConfig) Validate() error {
+	if c.Enabled() != (c.Topic != "") {
+		return fmt.Errorf("kafka needs both brokers and a topic")
+	}
+	if c.BatchSize < 0 || c.Linger < 0 {
+		return fmt.Errorf("kafka batch size and linger must not be negative")
+	}
+	if _, err := adapters.ParseKafkaKey(c.Key); err != nil {
+		return err
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("kafka TLS needs both a client certificate and a key")
+	}
+	if !c.TLS.Enabled && (c.TLS.ServerName != "" || c.TLS.CAFile != "" || c.TLS.CertFile != "") {
+		return fmt.Errorf("kafka TLS settings need TLS enabled")
+	}
+	mechanism, err := adapters.ParseKafkaSASLMechanism(c.SASL.Mechanism)
+	if err != nil {
+		return err
+	}
+	if (mechanism == "") != (c.SASL.Username == "") {
+		return fmt.Errorf("kafka SASL needs both a mechanism and a username")
+	}
+	return nil
+}
+
+// AuditConfig configures the audit log
+type AuditConfig struct {
+	// File is the JSON Lines file records are appended to; empty disables the audit log
+	File string
+
+	// MaxSize rotates the file before it grows beyond this many bytes, and MaxAge
+	// once it has been written to for this long. Zero disables either rotation.
+	MaxSize int64
+	MaxAge  time.Duration
+
+	// MaxBackups is how many rotated files are kept; zero keeps them all
+	MaxBackups int
+
+	// Compress compresses rotated files with gzip
+	Compress bool
+}
+
+// Types of query log destinations
+const (
+	QueryLogStdout = "stdout" // lines of the standard logger
+	QueryLogFile   = "file"   // JSON Lines records, like the audit log
+	QueryLogKafka  = "kafka"  // query events published to the Kafka topic
+	QueryLogEvents = "events" // query_decision events, delivered to webhooks
+)
+
+// QueryLogConfig is a destination of the query log
+type QueryLogConfig struct {
+	// Type is QueryLogStdout, QueryLogFile, QueryLogKafka or QueryLogEvents
+	Type string
+
+	// File is the file records are appended to, rotated like the audit log with
+	// MaxSize, MaxAge, MaxBackups and Compress
+	File       string
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+	Compress   bool
+
+	// Decisions restricts the destination to the decisions with these actions,
+	// allow or deny, so that it receives neither queries nor protocol messages;
+	// empty logs every event
+	Decisions []string
+}
+
+// Validate checks the type of the destination and its decisions are known
+func (c QueryLogConfig) Validate() error {
+	switch c.Type {
+	case QueryLogStdout, QueryLogKafka, QueryLogEvents:
+	case QueryLogFile:
+		if c.File == "" {
+			return fmt.Errorf("file query log needs a file")
+		}
+	default:
+		return fmt.Errorf("unknown query log type %q: use stdout, file, kafka or events", c.Type)
+	}
+	for _, action := range c.Decisions {
+		if action != string(domain.DecisionAllow) && action != string(domain.DecisionDeny) {
+			return fmt.Errorf("unknown decision %q for the %s query log: use allow or deny", action, c.Type)
+		}
+	}
+	return nil
+}
+
+// DefaultSlowQueryThreshold is the duration beyond which queries are logged as slow
+const DefaultSlowQueryThreshold = time.Second
+
+// SlowQueryConfig configures the slow query log
+type SlowQueryConfig struct {
+	// File is the JSON Lines file records are appended to, or "-" for standard
+	// error; empty disables the slow query log
+	File string
+
+	// Threshold is the duration, from when a query is received until the upstream
+	// completes it, beyond which it is logged; zero uses DefaultSlowQueryThreshold
+	Threshold time.Duration
+
+	// SampleRate is the share of slow queries logged, greater than 0 and at most
+	// 1; zero logs them all
+	SampleRate float64
+
+	// MaxPerSecond caps the records written per second; zero disables the cap
+	MaxPerSecond int
+
+	// RedactParameters records the format and size of bound parameters instead of
+	// their values
+	RedactParameters bool
+}
+
+// Validate checks that the limits are not negative and the sample rate is
+// between 0 and 1
+func (c SlowQueryConfig) Validate() error {
+	if c.Threshold < 0 || c.MaxPerSecond < 0 {
+		return fmt.Errorf("slow query log limits must not be negative")
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("slow query sample rate must be between 0 and 1")
+	}
+	return nil
+}
+
+// ScriptConfig configures the Lua scripts run on every query
+type ScriptConfig struct {
+	// Files are the scripts, run in order ahead of the policy engine; each
+	// defines an evaluate(query) function, see adapters.LuaScript
+	Files []string
+
+	// Timeout bounds the run of a script on a query; zero uses
+	// adapters.DefaultScriptTimeout
+	Timeout time.Duration
+}
+
+// Validate checks that the timeout is not negative
+func (c ScriptConfig) Validate() error {
+	if c.Timeout < 0 {
+		return fmt.Errorf("script timeout must not be negative")
+	}
+	return nil
+}
+
+// ParameterLabelConfig configures the labels taken from the values bound to
+// prepared statements
+type ParameterLabelConfig struct {
+	// MaxSize is the largest value, in bytes, taken as a label; zero uses
+	// adapters.DefaultParameterLabelSize
+	MaxSize int
+
+	// Labels name the parameters labels are taken from
+	Labels []ParameterLabelRule
+}
+
+// ParameterLabelRule names the parameter a label is taken from, see adapters.ParameterLabel
+type ParameterLabelRule struct {
+	Label        string
+	Position     int      // 1 for $1
+	Fingerprints []string // empty takes the label from every statement with that many parameters
+}
+
+// labels returns the rules as adapters.ParameterLabel
+func (c ParameterLabelConfig) labels() []adapters.ParameterLabel {
+	labels := make([]adapters.ParameterLabel, 0, len(c.Labels))
+	for _, rule := range c.Labels {
+		labels = append(labels, adapters.ParameterLabel{Label: rule.Label, Position: rule.Position, Fingerprints: rule.Fingerprints})
+	}
+	return labels
+}
+
+// Validate checks that the max size is not negative and every label rule
+func (c ParameterLabelConfig) Validate() error {
+	if c.MaxSize < 0 {
+		return fmt.Errorf("parameter label max size must not be negative")
+	}
+	for _, label := range c.labels() {
+		if err := label.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RewriteConfig configures the rewriting of queries, see adapters.QueryRewriter
+type RewriteConfig struct {
+	// RowLimit is appended as a LIMIT to the SELECTs reading relations without
+	// one; zero appends none
+	RowLimit int64
+
+	// TraceComments prepends a traceparent comment to every query
+	TraceComments bool
+
+	// TenantFilter restricts tables to the rows of the tenant of each connection
+	TenantFilter TenantFilterConfig
+}
+
+// TenantFilterConfig configures the filtering of tables by tenant
+type TenantFilterConfig struct {
+	// Column holds the tenant of each row; empty filters no table
+	Column string
+
+	// Value is where the tenant of a connection comes from: user, database,
+	// application_name, or label.<name> for a connection label
+	Value string
+
+	// Tables are the patterns of the filtered tables: name, schema.name or schema.*
+	Tables []string
+}
+
+// Enabled reports whether queries are rewritten
+func (c RewriteConfig) Enabled() bool {
+	return c.RowLimit != 0 || c.TraceComments || c.TenantFilter.Column != ""
+}
+
+// Options returns the options of the query rewriter making the configured rewrites
+func (c RewriteConfig) Options() []adapters.QueryRewriterOption {
+	var opts []adapters.QueryRewriterOption
+	if c.RowLimit != 0 {
+		opts = append(opts, adapters.WithRowLimit(c.RowLimit))
+	}
+	if c.TraceComments {
+		opts = append(opts, adapters.WithTraceComments())
+	}
+	if c.TenantFilter.Column != "" {
+		opts = append(opts, adapters.WithTenantFilter(adapters.TenantFilter{
+			Column: c.TenantFilter.Column,
+			Value:  c.TenantFilter.Value,
+			Tables: c.TenantFilter.Tables,
+		}))
+	}
+	return opts
+}
+
+// Validate checks that the rewriter accepts the options and that filtered
+// tables come with a tenant column
+func (c RewriteConfig) Validate() error {
+	if !c.Enabled() {
+		if len(c.TenantFilter.Tables) > 0 {
+			return fmt.Errorf("tenant filter needs a column")
+		}
+		return nil
+	}
+	if _, err := adapters.NewQueryRewriter(c.Options()...); err != nil {
+		return fmt.Errorf("invalid query rewriting: %w", err)
+	}
+	return nil
+}
+
+// AuthConfig configures local authentication of clients
+type AuthConfig struct {
+	// File is a PgBouncer auth_file listing the users and their password verifiers;
+	// without it clients authenticate with the upstream
+	File string
+
+	// UpstreamUser and UpstreamPassword are the credentials locally authenticated
+	// clients are logged into the upstream with. An empty user keeps the client's,
+	// and an empty password uses the client's when the auth file holds it in plaintext.
+	UpstreamUser     string
+	UpstreamPassword string
+
+	// JWT attributes connections to the claims of a token clients present
+	JWT JWTConfig
+}
+
+// JWTConfig configures the verification of the JSON Web Tokens clients present
+// and the claims their connections are attributed to
+type JWTConfig struct {
+	// Parameter is the startup parameter carrying the token; empty takes the
+	// password as the token and logs clients into the upstream with
+	// UpstreamUser and UpstreamPassword
+	Parameter string
+
+	// Secret verifies HMAC-signed tokens and PublicKeyFile, a PEM file of public
+	// keys or certificates, RSA- and ECDSA-signed ones; one of them enables tokens
+	Secret        string
+	PublicKeyFile string
+
+	// Issuer and Audience, when set, must match the iss and aud claims
+	Issuer   string
+	Audience string
+
+	// Leeway tolerates clock skew when checking expiry
+	Leeway time.Duration
+
+	// UserClaim names the claim quotas are attributed to instead of the user
+	// name, and LabelClaims maps claims to the connection labels they set
+	UserClaim   string
+	LabelClaims map[string]string
+}
+
+// Enabled reports whether clients present tokens
+func (c JWTConfig) Enabled() bool {
+	return c.Secret != "" || c.PublicKeyFile != ""
+}
+
+// Options returns the verifier options of the configuration
+func (c JWTConfig) Options() []adapters.JWTVerifierOption {
+	var opts []adapters.JWTVerifierOption
+	if c.Secret != "" {
+		opts = append(opts, adapters.WithJWTSecret([]byte(c.Secret)))
+	}
+	if c.PublicKeyFile != "" {
+		opts = append(opts, adapters.WithJWTPublicKeys(c.PublicKeyFile))
+	}
+	if c.Issuer != "" {
+		opts = append(opts, adapters.WithJWTIssuer(c.Issuer))
+	}
+	if c.Audience != "" {
+		opts = append(opts, adapters.WithJWTAudience(c.Audience))
+	}
+	if c.Leeway != 0 {
+		opts = append(opts, adapters.WithJWTLeeway(c.Leeway))
+	}
+	return opts
+}
+
+// TLSConfig configures TLS termination of client connections
+type TLSConfig struct {
+	// CertFile and KeyFile hold the PEM server certificate and key; without them
+	// SSLRequests are declined
+	CertFile string
+	KeyFile  string
+
+	// CAFile, when set, holds the CAs that must have signed client certificates
+	CAFile string
+
+	// RequireUsers lists the users whose plaintext connections are rejected; "*" matches every user
+	RequireUsers []string
+}
+
+// Enabled reports whether a server certificate is configured
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// UpstreamTLSConfig configures TLS on the upstream leg of proxied connections
+type UpstreamTLSConfig struct {
+	// Mode is a libpq sslmode: disable, require, verify-ca or verify-full. Empty disables TLS.
+	Mode string
+
+	// ServerName is sent as SNI and checked by verify-full. It defaults to the host
+	// of a host:port upstream, or to the host of each target for discovered upstreams.
+	ServerName string
+
+	// CAFile holds the CAs trusted to sign upstream certificates; empty uses the system roots
+	CAFile string
+
+	// CertFile and KeyFile hold the PEM client certificate and key presented to the upstream
+	CertFile string
+	KeyFile  string
+}
+
+// Validate checks the mode and that a client certificate comes with its key
+func (c UpstreamTLSConfig) Validate() error {
+	if _, err := adapters.ParseUpstreamTLSMode(c.Mode); err != nil {
+		return err
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("upstream TLS needs both a client certificate and a key")
+	}
+	return nil
+}
+
+// serviceComponents holds the pluggable components used by NewServerService
+type serviceComponents struct {
+	queryLogger  domain.QueryLogger
+	policyEngine domain.PolicyEngine
+	usageStore   domain.UsageStore
+	clock        domain.Clock
+	eventSink    domain.EventSink
+	queryEvents  domain.QueryEventPublisher
+	upstreams    domain.UpstreamResolver
+	elector      domain.LeaderElector
+	logger       logger.Logger
+	normalizer   domain.QueryNormalizer
+	handler      domain.ConnectionHandler
+	listener     net.Listener
+	middlewares  []domain.QueryMiddleware
+}
+
+// ServiceOption replaces a default component wired by NewServerService
+type ServiceOption func(*serviceComponents)
+
+// WithQueryLogger replaces the default stdout query logger
+func WithQueryLogger(queryLogger domain.QueryLogger) ServiceOption {
+	return func(c *serviceComponents) {
+		c.queryLogger = queryLogger
+	}
+}
+
+// WithPolicyEngine replaces the default quota policy engine
+func WithPolicyEngine(engine domain.PolicyEngine) ServiceOption {
+	return func(c *serviceComponents) {
+		c.policyEngine = engine
+	}
+}
+
+// WithUsageStore replaces the default in-memory usage store used by the default policy engine
+func WithUsageStore(store domain.UsageStore) ServiceOption {
+	return func(c *serviceComponents) {
+		c.usageStore = store
+	}
+}
+
+// WithQuotaStore is WithUsageStore, for the store backing the quotas of the
+// default policy engine
+func WithQuotaStore(store domain.UsageStore) ServiceOption {
+	return WithUsageStore(store)
+}
+
+// WithLogger replaces the default logger writing to standard output. Lines still
+// carry the instance ID; ServerConfig.LogLevel only applies to the default logger.
+func WithLogger(log logger.Logger) ServiceOption {
+	return func(c *serviceComponents) {
+		c.logger = log
+	}
+}
+
+// WithNormalizer replaces the normalizer named by ServerConfig.Normalizer. It is
+// still put behind the cache when ServerConfig.QueryCacheSize is set.
+func WithNormalizer(normalizer domain.QueryNormalizer) ServiceOption {
+	return func(c *serviceComponents) {
+		c.normalizer = normalizer
+	}
+}
+
+// WithConnectionHandler serves accepted connections with handler instead of the
+// PostgreSQL handler built from the configuration, which the handler settings
+// then no longer apply to. A handler that is a domain.ConnectionDrainer is drained.
+func WithConnectionHandler(handler domain.ConnectionHandler) ServiceOption {
+	return func(c *serviceComponents) {
+		c.handler = handler
+	}
+}
+
+// WithListener serves the default listener on listener, opened by the caller,
+// instead of listening on the address given to Start. The service closes it when
+// it stops.
+func WithListener(listener net.Listener) ServiceOption {
+	return func(c *serviceComponents) {
+		c.listener = listener
+	}
+}
+
+// WithMiddleware runs queries through middlewares around the policy engine, in
+// the order given, after those of earlier WithMiddleware options
+func WithMiddleware(middlewares ...domain.QueryMiddleware) ServiceOption {
+	return func(c *serviceComponents) {
+		c.middlewares = append(c.middlewares, middlewares...)
+	}
+}
+
+// WithEventSink replaces the default logging event sink
+func WithEventSink(sink domain.EventSink) ServiceOption {
+	return func(c *serviceComponents) {
+		c.eventSink = sink
+	}
+}
+
+// WithQueryEventPublisher publishes the outcome of every evaluated query to
+// publisher, in place of the Kafka publisher built from ServerConfig.Kafka
+func WithQueryEventPublisher(publisher domain.QueryEventPublisher) ServiceOption {
+	return func(c *serviceComponents) {
+		c.queryEvents = publisher
+	}
+}
+
+// WithUpstreamResolver discovers upstream targets with resolver instead of the one
+// built from ServerConfig.Upstream
+func WithUpstreamResolver(resolver domain.UpstreamResolver) ServiceOption {
+	return func(c *serviceComponents) {
+		c.upstreams = resolver
+	}
 }
 
-// ServerConfig holds configuration for the server service
-type ServerConfig struct {
-	Address string
+// WithLeaderElector runs the housekeeping jobs, such as usage reports and
+// compaction, on the replica elector elects
+func WithLeaderElector(elector domain.LeaderElector) ServiceOption {
+	return func(c *serviceComponents) {
+		c.elector = elector
+	}
+}
+
+// WithClock replaces the wall clock used for quota windows and maintenance queueing
+func WithClock(clock domain.Clock) ServiceOption {
+	return func(c *serviceComponents) {
+		c.clock = clock
+	}
 }
 
 // NewServerService creates a new ServerService with all dependencies wired up
-func NewServerService(config ServerConfig) *ServerService {
-	// Create logger
-	log := logger.NewSimpleLogger()
+func NewServerService(config ServerConfig, opts ...ServiceOption) (_ *ServerService, err error) {
+	components := serviceComponents{clock: adapters.SystemClock{}}
+	for _, opt := range opts {
+		opt(&components)
+	}
+
+	// Release what was opened so far when a later component fails
+	var closers []io.Closer
+	defer func() {
+		if err != nil {
+			for _, closer := range closers {
+				_ = closer.Close()
+			}
+		}
+	}()
+
+	instanceID := config.InstanceID
+	if instanceID == "" {
+		instanceID = GenerateInstanceID()
+	}
+
+	// Create logger unless one was provided; every line carries the instance ID
+	baseLogger := components.logger
+	if baseLogger == nil {
+		simpleLogger := logger.NewSimpleLogger()
+		simpleLogger.SetLevel(config.LogLevel)
+		baseLogger = simpleLogger
+	}
+	log := baseLogger.WithField("instance_id", instanceID)
+
+	// Create fault injector (no-op unless built with the chaos tag)
+	faults, err := adapters.NewFaultInjector(config.Faults)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fault rules: %w", err)
+	}
+	if config.Faults != "" && !adapters.FaultInjectionEnabled {
+		log.Info("Ignoring fault rules: this binary was not built with the chaos tag")
+	}
+
+	// Events go to the log unless a sink was provided
+	var eventSink domain.EventSink = adapters.NewLoggingEventSink(log)
+	if components.eventSink != nil {
+		eventSink = components.eventSink
+	}
+
+	// Webhooks are notified in addition to the sink
+	if len(config.Webhooks) > 0 {
+		sinks := adapters.MultiEventSink{eventSink}
+		for _, webhook := range config.Webhooks {
+			if err := webhook.Validate(); err != nil {
+				return nil, err
+			}
+			types := make([]domain.EventType, 0, len(webhook.Events))
+			for _, eventType := range webhook.Events {
+				types = append(types, domain.EventType(eventType))
+			}
+			notifier, err := adapters.NewWebhookNotifier(webhook.URL, log,
+				adapters.WithWebhookSecret(webhook.Secret), adapters.WithWebhookEvents(types...))
+			if err != nil {
+				return nil, err
+			}
+			closers = append(closers, notifier)
+			sinks = append(sinks, notifier)
+		}
+		eventSink = sinks
+	}
+	eventSink = instanceEventSink{instanceID: instanceID, next: eventSink}
+
+	// Create the configured query normalizer unless one was provided, behind a
+	// cache as parsing is a CGO call
+	queryNormalizer := components.normalizer
+	if queryNormalizer == nil {
+		normalizer, err := adapters.ParseNormalizer(config.Normalizer)
+		if err != nil {
+			return nil, err
+		}
+		queryNormalizer = adapters.NewQueryNormalizer(normalizer)
+	}
+	var queryCache *adapters.CachingNormalizer
+	if config.QueryCacheSize > 0 {
+		queryCache = adapters.NewCachingNormalizer(queryNormalizer, config.QueryCacheSize, config.StatementCacheSize)
+		queryNormalizer = queryCache
+	}
+
+	// Poll the pools of the upstream's PgBouncer once started
+	var pooler *PoolerMonitor
+	if config.PgBouncer.Enabled() {
+		if err := config.PgBouncer.Validate(); err != nil {
+			return nil, err
+		}
+		console, err := adapters.NewPgBouncerConsole(config.PgBouncer.AdminURL)
+		if err != nil {
+			return nil, err
+		}
+		closers = append(closers, console)
+		pooler = NewPoolerMonitor(console, config.PgBouncer.PollInterval, components.clock, log.WithField("pooler", "pgbouncer"))
+	}
+
+	// Create the policy engine unless one was provided. It is built even without
+	// policies so that policies can be added by a reload.
+	var quotas *QuotaService
+	policyEngine := components.policyEngine
+	if policyEngine == nil {
+		store := components.usageStore
+		if store == nil {
+			slidingStore := adapters.NewSlidingWindowUsageStore(adapters.WithSlidingWindowClock(components.clock))
+			closers = append(closers, slidingStore)
+			store = slidingStore
+		}
+		if adapters.FaultInjectionEnabled {
+			store = adapters.NewFaultUsageStore(store, faults)
+		}
+		if config.AsyncUsage.Enabled {
+			if err := config.AsyncUsage.Validate(); err != nil {
+				return nil, err
+			}
+			asyncOpts := []adapters.AsyncUsageStoreOption{
+				adapters.WithUsageStaleness(config.AsyncUsage.Staleness),
+				adapters.WithAsyncUsageClock(components.clock),
+			}
+			if config.AsyncUsage.Workers > 0 {
+				asyncOpts = append(asyncOpts, adapters.WithAsyncUsageWorkers(config.AsyncUsage.Workers))
+			}
+			if config.AsyncUsage.QueueSize > 0 {
+				asyncOpts = append(asyncOpts, adapters.WithAsyncUsageQueueSize(config.AsyncUsage.QueueSize))
+			}
+			asyncStore := adapters.NewAsyncUsageStore(store, log, asyncOpts...)
+			closers = append(closers, asyncStore)
+			store = asyncStore
+		}
+
+		weights := config.UsageWeights
+		if weights == (domain.UsageWeights{}) {
+			weights = domain.DefaultUsageWeights()
+		}
+
+		quotaOpts := []QuotaServiceOption{WithUsageWeights(weights), WithQuotaClock(components.clock), WithQueryNormalizer(queryNormalizer)}
+		if config.QuotaAlerts.Enabled() {
+			quotaOpts = append(quotaOpts, WithQuotaAlerts(config.QuotaAlerts.Thresholds, eventSink))
+		}
+		if pooler != nil {
+			quotaOpts = append(quotaOpts, WithPoolSaturation(pooler))
+		}
+		if config.Identity.Enabled() {
+			identities, err := newIdentityResolver(config.Identity)
+			if err != nil {
+				return nil, err
+			}
+			cache := NewIdentityCache(identities, config.Identity.CacheTTL, components.clock, log)
+			quotaOpts = append(quotaOpts, WithIdentityResolver(cache))
+		}
+		quotaService, err := NewQuotaService(store, config.Policies, quotaOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota policies: %w", err)
+		}
+		quotaService.SetRoles(config.Roles)
+		quotas = quotaService
+		policyEngine = quotaService
+	}
+
+	// Run the middlewares, then the scripts, then the rewriter, right around the
+	// policy engine, so that the engines decorating it see the queries and
+	// decisions they changed
+	middlewares := slices.Clone(components.middlewares)
+	if len(config.Scripts.Files) > 0 {
+		if err := config.Scripts.Validate(); err != nil {
+			return nil, err
+		}
+		var scriptOpts []adapters.LuaScriptOption
+		if config.Scripts.Timeout > 0 {
+			scriptOpts = append(scriptOpts, adapters.WithScriptTimeout(config.Scripts.Timeout))
+		}
+		for _, file := range config.Scripts.Files {
+			script, err := adapters.LoadLuaScript(file, log, scriptOpts...)
+			if err != nil {
+				return nil, err
+			}
+			closers = append(closers, script)
+			middlewares = append(middlewares, script.Middleware)
+			log.Info("Running script %s on every query", file)
+		}
+	}
+	if config.Rewrite.Enabled() {
+		rewriter, err := adapters.NewQueryRewriter(config.Rewrite.Options()...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query rewriting: %w", err)
+		}
+		middlewares = append(middlewares, rewriter.Middleware)
+	}
+
+	// Freeze users to the queries they were learned to run in front of every
+	// other middleware and the quota engine, so that blocked queries consume no
+	// quota
+	var firewall *SQLFirewall
+	if config.Firewall.Enabled() && policyEngine != nil {
+		var store domain.FirewallProfileStore
+		if config.Firewall.ProfileFile != "" {
+			store = adapters.NewFileFirewallStore(config.Firewall.ProfileFile)
+		}
+		firewall, err = NewSQLFirewall(config.Firewall, store, eventSink, components.clock, log.WithField("firewall", string(config.Firewall.Mode)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SQL firewall: %w", err)
+		}
+		middlewares = append([]domain.QueryMiddleware{firewall.Middleware}, middlewares...)
+	}
+	if len(middlewares) > 0 {
+		policyEngine = NewMiddlewareChain(policyEngine, middlewares...)
+	}
+
+	// Detect N+1 bursts in front of the quota engine so limited queries consume no quota
+	if config.BurstDetection.Enabled() {
+		detector, err := NewBurstDetector(config.BurstDetection, policyEngine, eventSink, components.clock)
+		if err != nil {
+			return nil, fmt.Errorf("invalid burst detection: %w", err)
+		}
+		policyEngine = detector
+	}
+
+	// Watch denial rates around every other engine so burst denials count too
+	if config.DenialAlerts.Enabled() && policyEngine != nil {
+		detector, err := NewDenialAnomalyDetector(config.DenialAlerts, policyEngine, eventSink, components.clock)
+		if err != nil {
+			return nil, fmt.Errorf("invalid denial alerts: %w", err)
+		}
+		policyEngine = detector
+	}
+
+	// Learn the usual query rates of the principals, denied queries included
+	var rateAlerts *RateAnomalyDetector
+	if config.RateAlerts.Enabled() && policyEngine != nil {
+		detector, err := NewRateAnomalyDetector(config.RateAlerts, policyEngine, eventSink, components.clock)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate alerts: %w", err)
+		}
+		rateAlerts = detector
+		policyEngine = detector
+	}
+
+	// Measure query rates and keep recent denials outside every other engine
+	var activity *ActivityMonitor
+	if policyEngine != nil {
+		activity = NewActivityMonitor(policyEngine, components.clock)
+		policyEngine = activity
+	}
+
+	// Aggregate what each query fingerprint consumed, persisted by the usage stores keeping it
+	var queryStats *QueryStatsCollector
+	if policyEngine != nil {
+		if err := config.QueryStats.Validate(); err != nil {
+			return nil, err
+		}
+		store, _ := components.usageStore.(domain.QueryStatsStore)
+		queryStats = NewQueryStatsCollector(policyEngine, store, config.QueryStats, components.clock, log)
+		policyEngine = queryStats
+	}
+
+	// Report, export and compact the usage of elapsed windows on the elected replica
+	var housekeeper *Housekeeper
+	if components.elector != nil {
+		if err := config.Housekeeping.Validate(); err != nil {
+			return nil, err
+		}
+		var jobs []HousekeepingJob
+		if history, ok := components.usageStore.(domain.UsageHistory); ok {
+			retention := config.Housekeeping.Retention
+			if retention == 0 {
+				retention = DefaultUsageRetention
+			}
+			jobs = append(jobs,
+				UsageReportJob(history, eventSink, config.Housekeeping.reportInterval()),
+				UsageCompactionJob(history, retention, log))
+			if config.Housekeeping.ExportDir != "" {
+				exporter, err := adapters.NewFileUsageExporter(config.Housekeeping.ExportDir, config.Housekeeping.exportFormat())
+				if err != nil {
+					return nil, err
+				}
+				policies := func() []domain.QuotaPolicy { return config.Policies }
+				if quotas != nil {
+					policies = quotas.Policies
+				}
+				jobs = append(jobs, UsageExportJob(history, policies, exporter, config.Housekeeping.reportInterval()))
+			}
+		} else {
+			log.Info("The usage store keeps no elapsed windows: the elected replica has no usage to report or compact")
+		}
+		housekeeper = NewHousekeeper(components.elector, config.Housekeeping.RenewInterval, components.clock,
+			log.WithField("housekeeping", "leader"), jobs...)
+	}
+
+	// Publish the outcome of every query for analytics when requested
+	queryEvents := components.queryEvents
+	if queryEvents == nil && config.Kafka.Enabled() {
+		if err := config.Kafka.Validate(); err != nil {
+			return nil, err
+		}
+		key, _ := adapters.ParseKafkaKey(config.Kafka.Key)
+		kafkaOpts := []adapters.KafkaPublisherOption{adapters.WithKafkaKey(key)}
+		if config.Kafka.BatchSize > 0 {
+			kafkaOpts = append(kafkaOpts, adapters.WithKafkaBatchSize(config.Kafka.BatchSize))
+		}
+		if config.Kafka.Linger > 0 {
+			kafkaOpts = append(kafkaOpts, adapters.WithKafkaLinger(config.Kafka.Linger))
+		}
+		if config.Kafka.TLS.Enabled {
+			tlsConfig, err := adapters.LoadKafkaTLSConfig(config.Kafka.TLS.CAFile, config.Kafka.TLS.CertFile, config.Kafka.TLS.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.ServerName = config.Kafka.TLS.ServerName
+			kafkaOpts = append(kafkaOpts, adapters.WithKafkaTLS(tlsConfig))
+		}
+		if mechanism, _ := adapters.ParseKafkaSASLMechanism(config.Kafka.SASL.Mechanism); mechanism != "" {
+			kafkaOpts = append(kafkaOpts, adapters.WithKafkaSASL(mechanism, config.Kafka.SASL.Username, config.Kafka.SASL.Password))
+		}
+
+		publisher, err := adapters.NewKafkaPublisher(config.Kafka.Brokers, config.Kafka.Topic, log, kafkaOpts...)
+		if err != nil {
+			return nil, err
+		}
+		queryEvents = publisher
+		closers = append(closers, publisher)
+	}
+
+	// Create query logger with normalizer unless one was provided: the configured
+	// destinations, or standard output
+	queryLogger := components.queryLogger
+	kafkaDestination := false
+	if queryLogger == nil && len(config.QueryLogs) > 0 {
+		destinations := make([]adapters.QueryLogDestination, 0, len(config.QueryLogs))
+		for _, destination := range config.QueryLogs {
+			if err := destination.Validate(); err != nil {
+				return nil, err
+			}
+			var next domain.QueryLogger
+			switch destination.Type {
+			case QueryLogStdout:
+				next = adapters.NewStandardQueryLogger(log, queryNormalizer, adapters.WithLoggedParameters(config.LogParameters...))
+			case QueryLogFile:
+				auditOpts := []adapters.AuditLogOption{
+					adapters.WithAuditInstance(instanceID),
+					adapters.WithAuditMaxSize(destination.MaxSize),
+					adapters.WithAuditMaxAge(destination.MaxAge),
+					adapters.WithAuditMaxBackups(destination.MaxBackups),
+					adapters.WithAuditClock(components.clock),
+				}
+				if destination.Compress {
+					auditOpts = append(auditOpts, adapters.WithAuditCompression())
+				}
+				fileLog, err := adapters.NewAuditLog(destination.File, nil, auditOpts...)
+				if err != nil {
+					return nil, err
+				}
+				closers = append(closers, fileLog)
+				next = fileLog
+			case QueryLogKafka:
+				if queryEvents == nil {
+					return nil, fmt.Errorf("the kafka query log needs kafka brokers and a topic")
+				}
+				next = adapters.NewQueryEventLogger(queryEvents, nil, instanceID)
+				kafkaDestination = true
+			case QueryLogEvents:
+				next = adapters.NewEventQueryLogger(eventSink)
+			}
+			decisions := make([]domain.DecisionAction, 0, len(destination.Decisions))
+			for _, action := range destination.Decisions {
+				decisions = append(decisions, domain.DecisionAction(action))
+			}
+			destinations = append(destinations, adapters.QueryLogDestination{Logger: next, Decisions: decisions})
+		}
+		queryLogger = adapters.NewFanOutQueryLogger(destinations...)
+	}
+	if queryLogger == nil {
+		queryLogger = adapters.NewStandardQueryLogger(log, queryNormalizer, adapters.WithLoggedParameters(config.LogParameters...))
+	}
+
+	// Record query events to a capture file when requested
+	if config.CaptureFile != "" {
+		file, err := os.OpenFile(config.CaptureFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open capture file: %w", err)
+		}
+
+		recorder, err := adapters.NewCaptureRecorder(file, queryLogger, adapters.WithCaptureInstance(instanceID))
+		if err != nil {
+			_ = file.Close()
+			return nil, fmt.Errorf("failed to create capture recorder: %w", err)
+		}
+
+		queryLogger = recorder
+		closers = append(closers, recorder)
+	}
+
+	// Publish to Kafka every query, unless a query log destination filters them
+	if queryEvents != nil && !kafkaDestination {
+		queryLogger = adapters.NewQueryEventLogger(queryEvents, queryLogger, instanceID)
+	}
+
+	// Append the outcome of every query to the audit log when requested
+	if config.Audit.File != "" {
+		auditOpts := []adapters.AuditLogOption{
+			adapters.WithAuditInstance(instanceID),
+			adapters.WithAuditMaxSize(config.Audit.MaxSize),
+			adapters.WithAuditMaxAge(config.Audit.MaxAge),
+			adapters.WithAuditMaxBackups(config.Audit.MaxBackups),
+			adapters.WithAuditClock(components.clock),
+		}
+		if config.Audit.Compress {
+			auditOpts = append(auditOpts, adapters.WithAuditCompression())
+		}
+
+		auditLog, err := adapters.NewAuditLog(config.Audit.File, queryLogger, auditOpts...)
+		if err != nil {
+			return nil, err
+		}
+		queryLogger = auditLog
+		closers = append(closers, auditLog)
+	}
 
-	// Create query normalizer using pg_query (replaces custom regex-based normalizer)
-	queryNormalizer := adapters.NewPgQueryNormalizer()
+	// Log the queries slower than the threshold when requested
+	if config.SlowQueries.File != "" {
+		if err := config.SlowQueries.Validate(); err != nil {
+			return nil, err
+		}
+		threshold := config.SlowQueries.Threshold
+		if threshold == 0 {
+			threshold = DefaultSlowQueryThreshold
+		}
+		slowOpts := []adapters.SlowQueryLogOption{
+			adapters.WithSlowQueryInstance(instanceID),
+			adapters.WithSlowQueryMaxPerSecond(config.SlowQueries.MaxPerSecond),
+			adapters.WithSlowQueryClock(components.clock),
+		}
+		if config.SlowQueries.SampleRate > 0 {
+			slowOpts = append(slowOpts, adapters.WithSlowQuerySampleRate(config.SlowQueries.SampleRate))
+		}
+		if config.SlowQueries.RedactParameters {
+			slowOpts = append(slowOpts, adapters.WithSlowQueryParameterRedaction())
+		}
 
-	// Create query logger with normalizer
-	queryLogger := adapters.NewStandardQueryLogger(log, queryNormalizer)
+		slowLog, err := adapters.NewSlowQueryLog(config.SlowQueries.File, threshold, queryLogger, slowOpts...)
+		if err != nil {
+			return nil, err
+		}
+		queryLogger = slowLog
+		closers = append(closers, slowLog)
+	}
+
+	// Resolve upstream targets in the background once started
+	var upstreams *UpstreamBalancer
+	var discoveries []*UpstreamDiscovery
+	resolver := components.upstreams
+	if resolver == nil && config.Upstream != "" {
+		resolver, err = adapters.NewUpstreamResolver(config.Upstream)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resolver != nil {
+		upstreams = NewUpstreamBalancer()
+		discoveries = append(discoveries, NewUpstreamDiscovery(resolver, upstreams, config.UpstreamDiscovery, components.clock, log.WithField("upstream", config.Upstream)))
+	}
+
+	// New connections fail over to a secondary upstream while the primary fails its checks
+	var failover *UpstreamFailover
+	var secondary *UpstreamBalancer
+	if config.Failover.Enabled() {
+		if err := config.Failover.Validate(); err != nil {
+			return nil, err
+		}
+		if upstreams == nil {
+			return nil, fmt.Errorf("upstream failover needs a primary upstream")
+		}
+		resolver, err := adapters.NewUpstreamResolver(config.Failover.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("secondary upstream: %w", err)
+		}
+		secondaryTLS, err := loadUpstreamTLSConfig(config.UpstreamTLS, config.Failover.Upstream)
+		if err != nil {
+			return nil, err
+		}
+		var serverName string
+		if secondaryTLS != nil {
+			serverName = secondaryTLS.ServerName
+		}
+
+		var checker domain.UpstreamChecker = adapters.TCPUpstreamChecker{Timeout: config.Failover.Timeout}
+		if config.Failover.CheckURL != "" {
+			primaryTLS, err := loadUpstreamTLSConfig(config.UpstreamTLS, config.Upstream)
+			if err != nil {
+				return nil, err
+			}
+			if checker, err = adapters.NewQueryUpstreamChecker(config.Failover.CheckURL, config.Failover.Timeout, primaryTLS); err != nil {
+				return nil, err
+			}
+		}
+
+		secondary = NewUpstreamBalancer()
+		discoveries = append(discoveries, NewUpstreamDiscovery(resolver, secondary, config.UpstreamDiscovery, components.clock, log.WithField("upstream", config.Failover.Upstream)))
+		failover = NewUpstreamFailover(upstreams, secondary, serverName, checker, config.Failover, eventSink, components.clock, log.WithField("upstream", config.Upstream))
+	}
+
+	// Listeners with an upstream of their own get their own balancer
+	listenerUpstreams := make(map[string]*UpstreamBalancer)
+	var upstreamRoutes []adapters.ConnectionHandlerOption
+	for _, listener := range config.Listeners {
+		if listener.Upstream == "" {
+			continue
+		}
+		resolver, err := adapters.NewUpstreamResolver(listener.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %w", listener.Name, err)
+		}
+		tlsConfig, err := loadUpstreamTLSConfig(config.UpstreamTLS, listener.Upstream)
+		if err != nil {
+			return nil, err
+		}
+
+		balancer := NewUpstreamBalancer()
+		listenerUpstreams[listener.Name] = balancer
+		discoveries = append(discoveries, NewUpstreamDiscovery(resolver, balancer, config.UpstreamDiscovery, components.clock,
+			log.WithField("listener", listener.Name).WithField("upstream", listener.Upstream)))
+		upstreamRoutes = append(upstreamRoutes, adapters.WithListenerUpstreams(listener.Name, balancer, tlsConfig))
+	}
+
+	// So do databases, which may also be renamed upstream
+	databaseUpstreams := make(map[string]*UpstreamBalancer)
+	for _, database := range config.Databases {
+		if database.Upstream == "" {
+			upstreamRoutes = append(upstreamRoutes, adapters.WithDatabaseUpstreams(database.Name, database.Database, nil, nil))
+			continue
+		}
+		resolver, err := adapters.NewUpstreamResolver(database.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("database %s: %w", database.Name, err)
+		}
+		tlsConfig, err := loadUpstreamTLSConfig(config.UpstreamTLS, database.Upstream)
+		if err != nil {
+			return nil, err
+		}
+
+		balancer := NewUpstreamBalancer()
+		databaseUpstreams[database.Name] = balancer
+		discoveries = append(discoveries, NewUpstreamDiscovery(resolver, balancer, config.UpstreamDiscovery, components.clock,
+			log.WithField("database", database.Name).WithField("upstream", database.Upstream)))
+		upstreamRoutes = append(upstreamRoutes, adapters.WithDatabaseUpstreams(database.Name, database.Database, balancer, tlsConfig))
+	}
+
+	// Maintenance windows are toggled at runtime through Maintenance()
+	maintenance := NewMaintenanceService(components.clock)
 
 	// Create PostgreSQL connection handler with normalizer
-	connHandler := adapters.NewPostgreSQLConnectionHandler(queryLogger, queryNormalizer, log)
+	handlerOpts := []adapters.ConnectionHandlerOption{
+		adapters.WithFaultInjector(faults),
+		adapters.WithMaintenanceGate(maintenance),
+	}
+	if policyEngine != nil {
+		handlerOpts = append(handlerOpts, adapters.WithPolicyEngine(policyEngine))
+	}
+	if config.GSSEncryptionTunnel {
+		handlerOpts = append(handlerOpts, adapters.WithGSSEncryptionTunnel())
+	}
+	var access *AccessControl
+	if config.Access.Enabled(config.Listeners) {
+		if access, err = NewAccessControl(config.Access, config.Listeners, eventSink, components.clock); err != nil {
+			return nil, err
+		}
+		handlerOpts = append(handlerOpts, adapters.WithAccessController(access))
+	}
+	if quotas != nil {
+		handlerOpts = append(handlerOpts, adapters.WithConnectionLimiter(quotas))
+		if config.QuotaFunctions {
+			handlerOpts = append(handlerOpts, adapters.WithQuotaReporter(quotas))
+		}
+	}
+	if failover != nil {
+		handlerOpts = append(handlerOpts, adapters.WithUpstreams(failover))
+	} else if upstreams != nil {
+		handlerOpts = append(handlerOpts, adapters.WithUpstreams(upstreams))
+	}
+	if config.ReadTimeout > 0 {
+		handlerOpts = append(handlerOpts, adapters.WithReadTimeout(config.ReadTimeout))
+	}
+	if config.UpstreamTimeout > 0 {
+		handlerOpts = append(handlerOpts, adapters.WithUpstreamTimeout(config.UpstreamTimeout))
+	}
+	if config.IdleTimeout > 0 || config.IdleTxTimeout > 0 {
+		handlerOpts = append(handlerOpts, adapters.WithIdleTimeouts(config.IdleTimeout, config.IdleTxTimeout))
+	}
+	if config.UpstreamReconnect {
+		handlerOpts = append(handlerOpts, adapters.WithUpstreamReconnect())
+	}
+	if config.MaxMessageSize > 0 {
+		handlerOpts = append(handlerOpts, adapters.WithMaxMessageSize(config.MaxMessageSize))
+	}
+	if config.MaxConnectionBuffer > 0 {
+		handlerOpts = append(handlerOpts, adapters.WithMaxConnectionBuffer(config.MaxConnectionBuffer))
+	}
+	if upstreams != nil {
+		tlsConfig, err := loadUpstreamTLSConfig(config.UpstreamTLS, config.Upstream)
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig != nil {
+			handlerOpts = append(handlerOpts, adapters.WithUpstreamTLS(tlsConfig))
+		}
+	}
+	handlerOpts = append(handlerOpts, upstreamRoutes...)
+	if config.CaptureParameters {
+		handlerOpts = append(handlerOpts, adapters.WithParameterCapture())
+	}
+	if len(config.ParameterLabels.Labels) > 0 {
+		if err := config.ParameterLabels.Validate(); err != nil {
+			return nil, err
+		}
+		handlerOpts = append(handlerOpts, adapters.WithParameterLabels(config.ParameterLabels.MaxSize, config.ParameterLabels.labels()...))
+	}
+	var tracker domain.ConnectionTracker
+	if config.MaxIdleConnections > 0 {
+		tracker = NewIdleConnectionTracker(config.MaxIdleConnections)
+	}
+	connections := NewConnectionRegistry(tracker, components.clock)
+	handlerOpts = append(handlerOpts, adapters.WithConnectionTracker(connections))
+	if config.TLS.Enabled() {
+		tlsConfig, err := adapters.LoadServerTLSConfig(config.TLS.CertFile, config.TLS.KeyFile, config.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		handlerOpts = append(handlerOpts, adapters.WithTLS(tlsConfig))
+	}
+	if len(config.TLS.RequireUsers) > 0 {
+		handlerOpts = append(handlerOpts, adapters.WithRequiredTLS(config.TLS.RequireUsers...))
+	}
+	if config.Pool.Enabled() {
+		if err := config.Pool.Validate(); err != nil {
+			return nil, err
+		}
+		if config.Auth.File == "" {
+			return nil, fmt.Errorf("upstream pooling needs an auth file")
+		}
+		mode, _ := adapters.ParsePoolMode(config.Pool.Mode)
+		var sizes []adapters.PoolSize
+		for _, size := range config.Pool.Sizes {
+			sizes = append(sizes, adapters.PoolSize{User: size.User, Database: size.Database, Size: size.Size})
+		}
+		poolOpts := []adapters.UpstreamPoolOption{adapters.WithPoolSizes(sizes...)}
+		if config.Pool.WaitTimeout > 0 {
+			poolOpts = append(poolOpts, adapters.WithPoolWaitTimeout(config.Pool.WaitTimeout))
+		}
+		pool := adapters.NewUpstreamPool(mode, config.Pool.Size, poolOpts...)
+		closers = append(closers, pool)
+		handlerOpts = append(handlerOpts, adapters.WithUpstreamPool(pool))
+	}
+	if config.Auth.File != "" {
+		userlist, err := adapters.LoadUserlist(config.Auth.File)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("Authenticating %d users from %s", userlist.Len(), config.Auth.File)
+		handlerOpts = append(handlerOpts,
+			adapters.WithLocalAuth(userlist),
+			adapters.WithUpstreamCredentials(config.Auth.UpstreamUser, config.Auth.UpstreamPassword))
+	}
+	if jwt := config.Auth.JWT; jwt.Enabled() {
+		if jwt.Parameter == "" && config.Auth.UpstreamUser == "" {
+			return nil, fmt.Errorf("JWT authentication through the password needs upstream credentials")
+		}
+		verifier, err := adapters.NewJWTVerifier(jwt.Options()...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT authentication: %w", err)
+		}
+		handlerOpts = append(handlerOpts, adapters.WithJWTIdentity(adapters.JWTIdentity{
+			Verifier:    verifier,
+			Parameter:   jwt.Parameter,
+			UserClaim:   jwt.UserClaim,
+			LabelClaims: jwt.LabelClaims,
+		}))
+		if jwt.Parameter == "" {
+			handlerOpts = append(handlerOpts, adapters.WithUpstreamCredentials(config.Auth.UpstreamUser, config.Auth.UpstreamPassword))
+		}
+	}
+	connHandler := components.handler
+	if connHandler == nil {
+		connHandler = adapters.NewPostgreSQLConnectionHandler(queryLogger, queryNormalizer, log, handlerOpts...)
+	}
 
 	// Create TCP server
 	tcpServer := adapters.NewStandardTCPServer(connHandler, log)
 
+	usageStore, _ := components.usageStore.(domain.Pinger)
+
 	return &ServerService{
-		tcpServer: tcpServer,
-		logger:    log,
-	}
+		instanceID:  instanceID,
+		tcpServer:   tcpServer,
+		logger:      log,
+		maintenance: maintenance,
+		quotas:      quotas,
+		connections: connections,
+		activity:    activity,
+		queryStats:  queryStats,
+		rateAlerts:  rateAlerts,
+		firewall:    firewall,
+		faults:      faults,
+		upstreams:   upstreams,
+		discoveries: discoveries,
+		pooler:      pooler,
+		failover:    failover,
+		housekeeper: housekeeper,
+		secondary:   secondary,
+		usageStore:  usageStore,
+		queryCache:  queryCache,
+		closers:     closers,
+		access:      access,
+
+		listeners:         config.Listeners,
+		listenerUpstreams: listenerUpstreams,
+		databaseUpstreams: databaseUpstreams,
+		socketActivation:  config.SocketActivation,
+		listener:          components.listener,
+
+		drained: make(chan struct{}),
+	}, nil
 }
 
-// Start starts the TCP server
+// Start starts the TCP server on address and on the addresses of the additional
+// listeners, or on the sockets passed by systemd with socket activation
 func (s *ServerService) Start(ctx context.Context, address string) error {
 	s.logger.Info("Starting server service", "address", address)
-	return s.tcpServer.Start(ctx, address)
+
+	// Resolve upstreams before accepting the first client
+	delays := make([]time.Duration, len(s.discoveries))
+	for i, discovery := range s.discoveries {
+		var err error
+		if delays[i], err = discovery.Refresh(ctx); err != nil {
+			s.logger.Error("Failed to resolve upstream targets: %v", err)
+		}
+	}
+
+	// Enforce the learned queries from the first client on
+	if s.firewall != nil {
+		if err := s.firewall.Load(ctx); err != nil {
+			return err
+		}
+	}
+
+	listeners, err := s.listen(address)
+	if err != nil {
+		return err
+	}
+
+	// Connections outlive a drain's deadline only until this context is cancelled
+	connectionCtx, closeConnections := context.WithCancel(ctx)
+	if err := s.tcpServer.Serve(connectionCtx, listeners); err != nil {
+		closeConnections()
+		for _, listener := range listeners {
+			_ = listener.Listener.Close()
+		}
+		return err
+	}
+	s.closeConnections = closeConnections
+
+	if s.pooler != nil {
+		if err := s.pooler.Refresh(ctx); err != nil {
+			s.logger.Error("Failed to poll the pooler's pools: %v", err)
+		}
+	}
+
+	flushStats := s.queryStats != nil && s.queryStats.store != nil
+	if len(s.discoveries) > 0 || s.pooler != nil || s.failover != nil || s.housekeeper != nil || flushStats || s.rateAlerts != nil || s.firewall != nil {
+		refreshCtx, cancel := context.WithCancel(ctx)
+		s.stopRefresh = cancel
+		for i, discovery := range s.discoveries {
+			go discovery.Run(refreshCtx, delays[i])
+		}
+		if s.pooler != nil {
+			go s.pooler.Run(refreshCtx)
+		}
+		if s.failover != nil {
+			go s.failover.Run(refreshCtx)
+		}
+		if flushStats {
+			go s.queryStats.Run(refreshCtx)
+		}
+		if s.rateAlerts != nil {
+			go s.rateAlerts.Run(refreshCtx)
+		}
+		if s.firewall != nil {
+			go s.firewall.Run(refreshCtx)
+		}
+		if s.housekeeper != nil {
+			s.housekept = make(chan struct{})
+			go func() {
+				defer close(s.housekept)
+				s.housekeeper.Run(refreshCtx)
+			}()
+		}
+	}
+	return nil
+}
+
+// listen opens the default listener and the additional ones. With socket
+// activation, the sockets passed by systemd are used instead: those named after
+// a listener serve it and the others serve the default listener, so that a
+// single unnamed socket replaces Address. Listeners left without a socket
+// listen on their address, and the default one on the listener it was given, if
+// any. The default listener comes first. With access lists, the listeners close
+// the connections of the clients they do not admit as they accept them.
+func (s *ServerService) listen(address string) ([]domain.Listener, error) {
+	var sockets map[string][]net.Listener
+	if s.socketActivation {
+		var err error
+		if sockets, err = adapters.SystemdListeners(); err != nil {
+			return nil, err
+		}
+		if len(sockets) == 0 {
+			return nil, fmt.Errorf("socket activation is enabled but systemd passed no socket")
+		}
+	}
+
+	var listeners, named []domain.Listener
+	fail := func(err error) ([]domain.Listener, error) {
+		for _, listener := range append(listeners, named...) {
+			_ = listener.Listener.Close()
+		}
+		for _, unused := range sockets {
+			for _, socket := range unused {
+				_ = socket.Close()
+			}
+		}
+		return nil, err
+	}
+
+	for _, config := range s.listeners {
+		if inherited, ok := sockets[config.Name]; ok {
+			for _, socket := range inherited {
+				named = append(named, domain.Listener{Name: config.Name, Listener: socket})
+			}
+			delete(sockets, config.Name)
+			continue
+		}
+		if config.Address == "" {
+			return fail(fmt.Errorf("listener %s has no address and systemd passed no socket named after it", config.Name))
+		}
+		listener, err := net.Listen("tcp", config.Address)
+		if err != nil {
+			return fail(fmt.Errorf("failed to listen on %s for listener %s: %w", config.Address, config.Name, err))
+		}
+		named = append(named, domain.Listener{Name: config.Name, Listener: listener})
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(sockets)) {
+		for _, socket := range sockets[name] {
+			listeners = append(listeners, domain.Listener{Listener: socket})
+		}
+		delete(sockets, name)
+	}
+	if len(listeners) == 0 && s.listener != nil {
+		listeners = append(listeners, domain.Listener{Listener: s.listener})
+	}
+	if len(listeners) == 0 {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return fail(fmt.Errorf("failed to listen on %s: %w", address, err))
+		}
+		listeners = append(listeners, domain.Listener{Listener: listener})
+	}
+	listeners = append(listeners, named...)
+	if s.access != nil {
+		for i, listener := range listeners {
+			listeners[i].Listener = adapters.NewAccessListener(listener.Listener, listener.Name, s.access)
+		}
+	}
+	return listeners, nil
 }
 
-// Stop stops the TCP server
+// Stop stops the TCP server and releases resources such as capture files
 func (s *ServerService) Stop(ctx context.Context) error {
 	s.logger.Info("Stopping server service")
-	return s.tcpServer.Stop(ctx)
+	err := s.tcpServer.Stop(ctx)
+	if s.closeConnections != nil {
+		s.closeConnections()
+	}
+	if s.stopRefresh != nil {
+		s.stopRefresh()
+	}
+	if s.housekept != nil {
+		// Let another replica take over the housekeeping jobs at once
+		select {
+		case <-s.housekept:
+		case <-ctx.Done():
+		}
+	}
+	if s.queryStats != nil {
+		// Save what the last flush interval consumed before the usage store closes
+		if flushErr := s.queryStats.Flush(ctx); flushErr != nil {
+			s.logger.Error("%v", flushErr)
+		}
+	}
+	if s.firewall != nil {
+		if flushErr := s.firewall.Flush(ctx); flushErr != nil {
+			s.logger.Error("%v", flushErr)
+		}
+	}
+
+	for _, closer := range s.closers {
+		if closeErr := closer.Close(); closeErr != nil {
+			s.logger.Error("Error closing resource: %v", closeErr)
+		}
+	}
+
+	return err
+}
+
+// DrainStatus is the progress of a drain
+type DrainStatus struct {
+	Draining        bool
+	StartedAt       time.Time
+	Deadline        time.Time // connections still open then are closed
+	OpenConnections int
+	Done            bool // every connection is closed
+}
+
+// Drain stops accepting connections and, in the background, closes each open one
+// as soon as its client is outside a transaction, so rolling restarts do not cut
+// transactions short. Connections still open after timeout are closed anyway. It
+// returns the progress of the drain and whether this call started it. The server
+// still has to be stopped once drained.
+func (s *ServerService) Drain(timeout time.Duration) (DrainStatus, bool) {
+	s.drainMu.Lock()
+	started := s.drainStarted.IsZero()
+	if started {
+		s.drainStarted = time.Now()
+		s.drainDeadline = s.drainStarted.Add(timeout)
+		go s.drain(timeout)
+	}
+	s.drainMu.Unlock()
+	return s.DrainStatus(), started
+}
+
+// drain waits for the connections to be drained and closes those still open at the deadline
+func (s *ServerService) drain(timeout time.Duration) {
+	defer close(s.drained)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.tcpServer.Drain(ctx); err != nil {
+		s.logger.Error("Closing %d connections still open after %s", s.tcpServer.OpenConnections(), timeout)
+		if s.closeConnections != nil {
+			s.closeConnections()
+		}
+	}
+}
+
+// DrainStatus returns the progress of the drain, if one was started
+func (s *ServerService) DrainStatus() DrainStatus {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+
+	status := DrainStatus{
+		Draining:        !s.drainStarted.IsZero(),
+		StartedAt:       s.drainStarted,
+		Deadline:        s.drainDeadline,
+		OpenConnections: s.tcpServer.OpenConnections(),
+	}
+	status.Done = status.Draining && status.OpenConnections == 0
+	return status
+}
+
+// Drained returns a channel that is closed once a drain completed or reached its deadline
+func (s *ServerService) Drained() <-chan struct{} {
+	return s.drained
 }
 
-// Address returns the address the server is listening on
+// Started returns a channel that is closed once the server accepts connections
+func (s *ServerService) Started() <-chan struct{} {
+	return s.tcpServer.Started()
+}
+
+// Address returns the address the server is listening on, that of the default
+// listener when there are several
 func (s *ServerService) Address() string {
 	return s.tcpServer.Address()
 }
+
+// Addresses returns the address of every listener by name, the default listener
+// having none
+func (s *ServerService) Addresses() map[string]string {
+	return s.tcpServer.Addresses()
+}
+
+// InstanceID returns the identifier of this enforcer replica
+func (s *ServerService) InstanceID() string {
+	return s.instanceID
+}
+
+// Upstreams returns the balancer holding the resolved upstream targets, or nil
+// when no upstream is configured
+func (s *ServerService) Upstreams() *UpstreamBalancer {
+	return s.upstreams
+}
+
+// ListenerUpstreams returns the balancers of the listeners with an upstream of
+// their own, by listener name
+func (s *ServerService) ListenerUpstreams() map[string]*UpstreamBalancer {
+	return s.listenerUpstreams
+}
+
+// DatabaseUpstreams returns the balancers of the databases with an upstream of
+// their own, by database name
+func (s *ServerService) DatabaseUpstreams() map[string]*UpstreamBalancer {
+	return s.databaseUpstreams
+}
+
+// ReloadPolicies atomically replaces the quota policies enforced by the built-in
+// policy engine and logs how they changed. Active connections are unaffected and
+// usage recorded under a policy name carries over to its new definition.
+func (s *ServerService) ReloadPolicies(policies []domain.QuotaPolicy) error {
+	if s.quotas == nil {
+		return ErrPoliciesUnmanaged
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	return s.setPolicies(s.quotas.Policies(), policies)
+}
+
+// SetRoles replaces the members of the roles the built-in policy engine's
+// policies may apply to
+func (s *ServerService) SetRoles(roles map[string][]string) error {
+	if s.quotas == nil {
+		return ErrPoliciesUnmanaged
+	}
+	s.quotas.SetRoles(roles)
+	return nil
+}
+
+// ExplainQuery tells which of the built-in policy engine's policies apply to
+// the query and why
+func (s *ServerService) ExplainQuery(query *domain.Query) ([]PolicyExplanation, error) {
+	if s.quotas == nil {
+		return nil, ErrPoliciesUnmanaged
+	}
+	return s.quotas.Explain(query), nil
+}
+
+// Policies returns the quota policies enforced by the built-in policy engine
+func (s *ServerService) Policies() ([]domain.QuotaPolicy, error) {
+	if s.quotas == nil {
+		return nil, ErrPoliciesUnmanaged
+	}
+	return s.quotas.Policies(), nil
+}
+
+// PutPolicy adds a quota policy, or replaces the policy of the same name, and
+// reports whether it was added. The change lasts until policies are reloaded.
+func (s *ServerService) PutPolicy(policy domain.QuotaPolicy) (bool, error) {
+	if s.quotas == nil {
+		return false, ErrPoliciesUnmanaged
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	previous := s.quotas.Policies()
+	policies := append([]domain.QuotaPolicy(nil), previous...)
+	for i := range policies {
+		if policies[i].Name == policy.Name {
+			policies[i] = policy
+			return false, s.setPolicies(previous, policies)
+		}
+	}
+	return true, s.setPolicies(previous, append(policies, policy))
+}
+
+// DeletePolicy removes the named quota policy until policies are reloaded
+func (s *ServerService) DeletePolicy(name string) error {
+	if s.quotas == nil {
+		return ErrPoliciesUnmanaged
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	previous := s.quotas.Policies()
+	var policies []domain.QuotaPolicy
+	for _, policy := range previous {
+		if policy.Name != name {
+			policies = append(policies, policy)
+		}
+	}
+	if len(policies) == len(previous) {
+		return fmt.Errorf("%w: %q", ErrPolicyNotFound, name)
+	}
+	return s.setPolicies(previous, policies)
+}
+
+// Usage returns what the principal consumed under the built-in policy engine's
+// policies, with label under those counting label values apart
+func (s *ServerService) Usage(ctx context.Context, user, database, label string) ([]PolicyUsage, error) {
+	if s.quotas == nil {
+		return nil, ErrPoliciesUnmanaged
+	}
+	return s.quotas.Usage(ctx, user, database, label)
+}
+
+// Credits returns the credit balances of the principal under the built-in policy
+// engine's policies
+func (s *ServerService) Credits(ctx context.Context, user, database string) ([]PolicyCredits, error) {
+	if s.quotas == nil {
+		return nil, ErrPoliciesUnmanaged
+	}
+	return s.quotas.Credits(ctx, user, database), nil
+}
+
+// ResetUsage clears the principal's usage under the named policy, or under all of
+// them when name is empty, with label under those counting label values apart
+func (s *ServerService) ResetUsage(ctx context.Context, user, database, label, name string) error {
+	if s.quotas == nil {
+		return ErrPoliciesUnmanaged
+	}
+	found, err := s.quotas.ResetUsage(ctx, user, database, label, name)
+	if err != nil {
+		return err
+	}
+	if !found && name != "" {
+		return fmt.Errorf("%w: %q", ErrPolicyNotFound, name)
+	}
+	s.logger.Info("Quota usage of %s on %s reset", user, database)
+	return nil
+}
+
+// Connections returns the open client connections whose user or database is known
+func (s *ServerService) Connections() []ConnectionInfo {
+	return s.connections.Connections()
+}
+
+// TerminateConnection closes an open client connection on an administrator's
+// request: its client is sent a FATAL error, the query it runs is cancelled and
+// its upstream connection is closed
+func (s *ServerService) TerminateConnection(connectionID string) error {
+	if !s.connections.Terminate(connectionID) {
+		return fmt.Errorf("%w: %q", ErrConnectionNotFound, connectionID)
+	}
+	s.logger.Info("Terminating connection %s", connectionID)
+	return nil
+}
+
+// Activity returns the recent query rates of the principals and the latest denials
+func (s *ServerService) Activity() Activity {
+	if s.activity == nil {
+		return Activity{}
+	}
+	return s.activity.Activity()
+}
+
+// QueryStats returns the statistics of the query fingerprints seen since the
+// server started, the most time-consuming first
+func (s *ServerService) QueryStats() []domain.QueryStats {
+	if s.queryStats == nil {
+		return nil
+	}
+	return s.queryStats.QueryStats()
+}
+
+// FirewallProfiles returns the queries the SQL firewall learned for each user
+func (s *ServerService) FirewallProfiles() ([]domain.FirewallProfile, error) {
+	if s.firewall == nil {
+		return nil, ErrFirewallDisabled
+	}
+	return s.firewall.Profiles(), nil
+}
+
+// RelearnFirewall forgets the queries the SQL firewall learned for user, which
+// are learned again from its next query in learn mode
+func (s *ServerService) RelearnFirewall(user string) error {
+	if s.firewall == nil {
+		return ErrFirewallDisabled
+	}
+	if !s.firewall.Relearn(user) {
+		return fmt.Errorf("%w: %q", ErrFirewallProfileNotFound, user)
+	}
+	s.logger.Info("SQL firewall profile of %s reset", user)
+	return nil
+}
+
+// FaultRules returns the rules of the faults injected
+func (s *ServerService) FaultRules() ([]adapters.FaultRule, error) {
+	injector, ok := s.faults.(*adapters.RuleFaultInjector)
+	if !ok {
+		return nil, ErrFaultInjectionDisabled
+	}
+	return injector.Rules(), nil
+}
+
+// SetFaultRules replaces the rules of the faults injected; they last until the
+// server restarts
+func (s *ServerService) SetFaultRules(rules []adapters.FaultRule) error {
+	injector, ok := s.faults.(*adapters.RuleFaultInjector)
+	if !ok {
+		return ErrFaultInjectionDisabled
+	}
+	injector.SetRules(rules)
+	s.logger.Info("Fault rules set to %q", adapters.FormatFaultRules(rules))
+	return nil
+}
+
+// UpstreamFailover returns the state of the failover to the secondary upstream
+// and what it counted
+func (s *ServerService) UpstreamFailover() (FailoverStatus, error) {
+	if s.failover == nil {
+		return FailoverStatus{}, ErrFailoverDisabled
+	}
+	return s.failover.Status(), nil
+}
+
+// PoolerPool is a pool of the upstream's pooler, along with what this enforcer
+// sees of the principal of the same user and database
+type PoolerPool struct {
+	domain.PoolStats
+	Saturation int
+
+	EnforcerConnections      int     // open connections of the principal
+	EnforcerQueriesPerSecond float64 // queries of the principal evaluated recently
+}
+
+// PoolerPools returns the pools of the upstream's pooler as last polled, and
+// when they were
+func (s *ServerService) PoolerPools() ([]PoolerPool, time.Time, error) {
+	if s.pooler == nil {
+		return nil, time.Time{}, ErrPoolerUnmonitored
+	}
+	stats, polledAt := s.pooler.Pools()
+
+	type principal struct{ user, database string }
+	connections := make(map[principal]int)
+	for _, connection := range s.connections.Connections() {
+		connections[principal{connection.User, connection.Database}]++
+	}
+	rates := make(map[principal]float64)
+	for _, activity := range s.Activity().Principals {
+		rates[principal{activity.User, activity.Database}] = activity.QueriesPerSecond
+	}
+
+	pools := make([]PoolerPool, 0, len(stats))
+	for _, pool := range stats {
+		key := principal{pool.User, pool.Database}
+		pools = append(pools, PoolerPool{
+			PoolStats:                pool,
+			Saturation:               pool.Saturation(),
+			EnforcerConnections:      connections[key],
+			EnforcerQueriesPerSecond: rates[key],
+		})
+	}
+	return pools, polledAt, nil
+}
+
+// QueryCacheStats returns the lookup counters of the normalized query cache, and
+// false when the cache is disabled
+func (s *ServerService) QueryCacheStats() (adapters.QueryCacheStats, bool) {
+	if s.queryCache == nil {
+		return adapters.QueryCacheStats{}, false
+	}
+	return s.queryCache.Stats(), true
+}
+
+// setPolicies replaces the policies and logs how they changed from previous;
+// the caller holds reloadMu
+func (s *ServerService) setPolicies(previous, policies []domain.QuotaPolicy) error {
+	if err := s.quotas.SetPolicies(policies); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPolicies, err)
+	}
+
+	changes := diffPolicies(previous, policies)
+	if len(changes) == 0 {
+		s.logger.Info("Quota policies reloaded without changes")
+		return nil
+	}
+	for _, change := range changes {
+		s.logger.Info("Quota policy %s", change)
+	}
+	return nil
+}
+
+// Maintenance returns the service controlling maintenance windows
+func (s *ServerService) Maintenance() *MaintenanceService {
+	return s.maintenance
+}
+
+// loadUpstreamTLSConfig builds the TLS configuration of upstream connections, or
+// nil when TLS is disabled. The server name defaults to the host of a host:port
+// upstream, since its targets are dialed by IP address once resolved.
+func loadUpstreamTLSConfig(config UpstreamTLSConfig, upstream string) (*tls.Config, error) {
+	mode, err := adapters.ParseUpstreamTLSMode(config.Mode)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := adapters.LoadUpstreamTLSConfig(mode, config.CAFile, config.CertFile, config.KeyFile)
+	if err != nil || tlsConfig == nil {
+		return nil, err
+	}
+
+	tlsConfig.ServerName = config.ServerName
+	if tlsConfig.ServerName == "" && !strings.Contains(upstream, "://") {
+		if host, _, err := net.SplitHostPort(upstream); err == nil {
+			tlsConfig.ServerName = host
+		}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,76 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fieldRecorder is a logger.Logger keeping the messages it is given along with
+// the fields attached to it
+type fieldRecorder struct {
+	mu       *sync.Mutex
+	messages *[]string
+	fields   map[string]interface{}
+}
+
+func newFieldRecorder() fieldRecorder {
+	return fieldRecorder{mu: &sync.Mutex{}, messages: &[]string{}, fields: map[string]interface{}{}}
+}
+
+// record keeps the message prefixed with the instance ID it is logged for
+func (r fieldRecorder) record(msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*r.messages = append(*r.messages, fmt.Sprintf("%v: %s", r.fields["instance_id"], msg))
+}
+
+func (r fieldRecorder) Info(msg string, args ...interface{})  { r.record(msg) }
+func (r fieldRecorder) Error(msg string, args ...interface{}) { r.record(msg) }
+func (r fieldRecorder) Debug(msg string, args ...interface{}) { r.record(msg) }
+
+func (r fieldRecorder) WithField(key string, value interface{}) logger.Logger {
+	fields := map[string]interface{}{}
+	for k, v := range r.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	return fieldRecorder{mu: r.mu, messages: r.messages, fields: fields}
+}
+
+func TestNewServerService_InjectedComponents(t *testing.T) {
+	log := newFieldRecorder()
+	accepted := make(chan struct{}, 1)
+	handler := mocks.ConnectionHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+		accepted <- struct{}{}
+		return conn.Close()
+	})
+
+	service, err := NewServerService(ServerConfig{Address: "127.0.0.1:0", InstanceID: "enforcer-1"},
+		WithLogger(log), WithConnectionHandler(handler), WithNormalizer(&mocks.QueryNormalizer{}))
+	require.NoError(t, err)
+	require.NoError(t, service.Start(context.Background(), "127.0.0.1:0"))
+	defer service.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", service.Address())
+	require.NoError(t, err)
+	defer conn.Close()
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The injected connection handler should serve accepted connections")
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	assert.Contains(t, *log.messages, "enforcer-1: Starting server service", "The injected logger should be used")
+}
@@ -0,0 +1,249 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"slices"
+	"sync"
+	"time"
+)
+
+// poolerPrincipal is a user of a database of the pooler
+type poolerPrincipal struct {
+	user     string
+	database string
+}
+
+// poolerTotals are the counters of a database of the pooler since it started
+type poolerTotals struct {
+	queries   int64
+	bytes     int64
+	queryTime time.Duration
+}
+
+// since returns what was counted after previous. Counters that went back mean
+// the pooler restarted, so everything counted since is new.
+func (t poolerTotals) since(previous poolerTotals) poolerTotals {
+	if t.queries < previous.queries || t.bytes < previous.bytes || t.queryTime < previous.queryTime {
+		return t
+	}
+	return poolerTotals{
+		queries:   t.queries - previous.queries,
+		bytes:     t.bytes - previous.bytes,
+		queryTime: t.queryTime - previous.queryTime,
+	}
+}
+
+// SidecarService enforces quotas without proxying any connection. Clients keep
+// connecting to PgBouncer directly; every poll of its admin console, what each
+// database ran since the previous poll is charged to the users with a pool in
+// it, in proportion to their client connections, since PgBouncer only counts
+// queries per database. The clients of a principal beyond a quota are killed
+// as long as it stays blocked, and a database is disabled while every one of
+// its users is blocked, so that they cannot reconnect in between.
+type SidecarService struct {
+	monitor  *PoolerMonitor
+	admin    domain.PoolerAdmin
+	quotas   *QuotaService
+	interval time.Duration
+	clock    domain.Clock
+	logger   logger.Logger
+
+	mu       sync.Mutex
+	totals   map[string]poolerTotals // by database, as last polled
+	blocked  map[poolerPrincipal]bool
+	disabled map[string]bool
+}
+
+// NewSidecarService creates a SidecarService polling the pools through monitor,
+// at its interval, and enforcing the policies of quotas through admin. The same
+// monitor may tighten the policies of quotas.
+func NewSidecarService(monitor *PoolerMonitor, admin domain.PoolerAdmin, quotas *QuotaService, clock domain.Clock, log logger.Logger) *SidecarService {
+	return &SidecarService{
+		monitor:  monitor,
+		admin:    admin,
+		quotas:   quotas,
+		interval: monitor.interval,
+		clock:    clock,
+		logger:   log,
+		totals:   make(map[string]poolerTotals),
+		blocked:  make(map[poolerPrincipal]bool),
+		disabled: make(map[string]bool),
+	}
+}
+
+// ReloadPolicies replaces the quota policies enforced and logs how they changed.
+// Usage recorded under a policy name carries over to its new definition.
+func (s *SidecarService) ReloadPolicies(policies []domain.QuotaPolicy) error {
+	previous := s.quotas.Policies()
+	if err := s.quotas.SetPolicies(policies); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPolicies, err)
+	}
+
+	changes := diffPolicies(previous, policies)
+	if len(changes) == 0 {
+		s.logger.Info("Quota policies reloaded without changes")
+	}
+	for _, change := range changes {
+		s.logger.Info("Quota policy %s", change)
+	}
+	return nil
+}
+
+// SetRoles replaces the members of the roles policies may apply to
+func (s *SidecarService) SetRoles(roles map[string][]string) error {
+	s.quotas.SetRoles(roles)
+	return nil
+}
+
+// Run polls every interval until ctx is cancelled
+func (s *SidecarService) Run(ctx context.Context) {
+	for {
+		if err := s.Poll(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.logger.Error("Failed to enforce quotas through the pooler: %v", err)
+		}
+
+		timer := s.clock.NewTimer(s.interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// Poll reads the pools once, charges what their databases ran since the
+// previous poll and enforces the quotas. The first poll of a database only
+// records its totals.
+func (s *SidecarService) Poll(ctx context.Context) error {
+	if err := s.monitor.Refresh(ctx); err != nil {
+		return err
+	}
+	pools, _ := s.monitor.Pools()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	databases := make(map[string][]domain.PoolStats)
+	for _, pool := range pools {
+		databases[pool.Database] = append(databases[pool.Database], pool)
+	}
+	for _, database := range slices.Sorted(maps.Keys(databases)) {
+		if err := s.enforceDatabase(ctx, database, databases[database]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enforceDatabase charges what the database ran to the users of its pools and
+// enforces their quotas; s.mu must be held
+func (s *SidecarService) enforceDatabase(ctx context.Context, database string, pools []domain.PoolStats) error {
+	current := poolerTotals{queries: pools[0].TotalQueries, bytes: pools[0].TotalBytes, queryTime: pools[0].TotalQueryTime}
+	previous, seen := s.totals[database]
+	s.totals[database] = current
+	var ran poolerTotals
+	if seen {
+		ran = current.since(previous)
+	}
+
+	weights := make([]int64, len(pools))
+	for i, pool := range pools {
+		weights[i] = pool.Clients
+	}
+	queries := shareOut(ran.queries, weights)
+	bytes := shareOut(ran.bytes, weights)
+	queryTime := shareOut(int64(ran.queryTime), weights)
+
+	blocked := 0
+	for i, pool := range pools {
+		usage := domain.StatementUsage{Bytes: bytes[i], Duration: time.Duration(queryTime[i])}
+		decision, err := s.quotas.ChargeUsage(ctx, pool.User, database, queries[i], usage)
+		if err != nil {
+			return err
+		}
+		if s.enforce(ctx, pool, decision) {
+			blocked++
+		}
+	}
+
+	switch disable := blocked == len(pools); {
+	case disable && !s.disabled[database]:
+		if err := s.admin.Disable(ctx, database); err != nil {
+			return err
+		}
+		s.disabled[database] = true
+		s.logger.Info("Disabled database %s: every user is over quota", database)
+	case !disable && s.disabled[database]:
+		if err := s.admin.Enable(ctx, database); err != nil {
+			return err
+		}
+		delete(s.disabled, database)
+		s.logger.Info("Enabled database %s again", database)
+	}
+	return nil
+}
+
+// enforce kills the clients of the pool's principal when decision denies it,
+// and reports whether it does; s.mu must be held
+func (s *SidecarService) enforce(ctx context.Context, pool domain.PoolStats, decision domain.Decision) bool {
+	principal := poolerPrincipal{user: pool.User, database: pool.Database}
+	if decision.Action != domain.DecisionDeny {
+		if s.blocked[principal] {
+			delete(s.blocked, principal)
+			s.logger.Info("Principal back under quota: user %s, database %s", pool.User, pool.Database)
+		}
+		return false
+	}
+
+	if !s.blocked[principal] {
+		s.logger.Info("Principal over quota: user %s, database %s: %s", pool.User, pool.Database, decision.Reason)
+	}
+	s.blocked[principal] = true
+	if pool.Clients > 0 {
+		killed, err := s.admin.KillClients(ctx, pool.User, pool.Database)
+		if err != nil {
+			// The next poll tries again
+			s.logger.Error("Failed to kill the clients of %s on %s: %v", pool.User, pool.Database, err)
+		} else if killed > 0 {
+			s.logger.Info("Killed %d clients of %s on %s over quota", killed, pool.User, pool.Database)
+		}
+	}
+	return true
+}
+
+// shareOut splits total in proportion to weights, evenly when they are all
+// zero. What rounding leaves goes to the heaviest share.
+func shareOut(total int64, weights []int64) []int64 {
+	shares := make([]int64, len(weights))
+	if total == 0 || len(weights) == 0 {
+		return shares
+	}
+
+	var sum int64
+	heaviest := 0
+	for i, weight := range weights {
+		sum += weight
+		if weight > weights[heaviest] {
+			heaviest = i
+		}
+	}
+	var given int64
+	for i, weight := range weights {
+		if sum == 0 {
+			shares[i] = total / int64(len(weights))
+		} else {
+			shares[i] = total * weight / sum
+		}
+		given += shares[i]
+	}
+	shares[heaviest] += total - given
+	return shares
+}
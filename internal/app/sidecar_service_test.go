@@ -0,0 +1,79 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSidecarService(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	quotas, err := NewQuotaService(adapters.NewMemoryUsageStore(adapters.WithUsageStoreClock(clock)), []domain.QuotaPolicy{
+		{Name: "app", Database: "app", Limit: 100, Window: time.Hour},
+	}, WithQuotaClock(clock))
+	require.NoError(t, err)
+
+	console := &mocks.PoolerConsole{}
+	admin := &mocks.PoolerAdmin{}
+	sidecar := NewSidecarService(NewPoolerMonitor(console, time.Minute, clock, logger.NewSimpleLogger()), admin, quotas, clock, logger.NewSimpleLogger())
+
+	poll := func(total int64, aliceClients, bobClients int64) {
+		t.Helper()
+		console.On("Pools", ctx).Return([]domain.PoolStats{
+			{Database: "app", User: "alice", Clients: aliceClients, TotalQueries: total},
+			{Database: "app", User: "bob", Clients: bobClients, TotalQueries: total},
+		}, nil).Once()
+		require.NoError(t, sidecar.Poll(ctx))
+	}
+	used := func(user string) int64 {
+		t.Helper()
+		usages, err := quotas.Usage(ctx, user, "app", "")
+		require.NoError(t, err)
+		require.Len(t, usages, 1)
+		return usages[0].Used
+	}
+
+	poll(5000, 3, 1)
+	assert.Zero(t, used("alice"), "The first poll should only record the totals")
+
+	poll(5080, 3, 1)
+	assert.Equal(t, int64(60), used("alice"), "Queries should be shared out by client connections")
+	assert.Equal(t, int64(20), used("bob"))
+
+	admin.On("KillClients", ctx, "alice", "app").Return(3, nil).Once()
+	poll(5140, 3, 1)
+	assert.Equal(t, int64(105), used("alice"))
+	admin.AssertExpectations(t)
+
+	admin.On("KillClients", ctx, "bob", "app").Return(1, nil).Once()
+	admin.On("Disable", ctx, "app").Return(nil).Once()
+	poll(5440, 0, 1)
+	assert.Equal(t, int64(335), used("bob"), "Users without clients should get no share")
+	admin.AssertExpectations(t)
+
+	// Disabled databases stay so until a window resets, and pooler restarts count from zero
+	poll(10, 0, 0)
+	clock.Advance(time.Hour)
+	admin.On("Enable", ctx, "app").Return(nil).Once()
+	poll(10, 0, 0)
+	assert.Zero(t, used("alice"))
+	admin.AssertExpectations(t)
+	console.AssertExpectations(t)
+}
+
+func TestShareOut(t *testing.T) {
+	assert.Equal(t, []int64{7, 3}, shareOut(10, []int64{2, 1}), "The remainder should go to the heaviest share")
+	assert.Equal(t, []int64{4, 3, 3}, shareOut(10, []int64{0, 0, 0}))
+	assert.Equal(t, []int64{0, 0}, shareOut(0, []int64{1, 1}))
+	assert.Empty(t, shareOut(10, nil))
+}
@@ -0,0 +1,186 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"sort"
+	"time"
+)
+
+// SimulationReport summarizes what a set of policies would have done to recorded traffic
+type SimulationReport struct {
+	Queries int                `json:"queries"`
+	Denied  int                `json:"denied"`
+	Tenants []TenantSimulation `json:"tenants"`
+}
+
+// TenantSimulation holds the simulated outcome for one user and database pair
+type TenantSimulation struct {
+	User           string         `json:"user"`
+	Database       string         `json:"database"`
+	Queries        int            `json:"queries"`
+	Denied         int            `json:"denied"`
+	DeniedByPolicy map[string]int `json:"denied_by_policy,omitempty"`
+	FirstDeniedAt  *time.Time     `json:"first_denied_at,omitempty"`
+}
+
+// tenantKey identifies a tenant in a simulation
+type tenantKey struct {
+	user     string
+	database string
+}
+
+// SimulationService evaluates quota policies against recorded traffic without enforcing them
+type SimulationService struct {
+	policies []domain.QuotaPolicy
+}
+
+// NewSimulationService creates a SimulationService for the proposed policies
+func NewSimulationService(policies []domain.QuotaPolicy) (*SimulationService, error) {
+	// Validate up front so a bad policy file fails before any capture is read
+	if _, err := NewQuotaService(adapters.NewMemoryUsageStore(), policies); err != nil {
+		return nil, err
+	}
+	return &SimulationService{policies: policies}, nil
+}
+
+// Run replays the capture through a fresh quota engine. Windows follow the recorded
+// timestamps, so the report reflects the original traffic rate rather than replay speed.
+// Tenants and connection labels are taken from each connection's StartupMessage;
+// connections recorded without a startup phase are reported under an empty user and database.
+func (s *SimulationService) Run(ctx context.Context, source domain.CaptureSource) (*SimulationReport, error) {
+	clock := &captureClock{}
+	// Same sliding windows as the server; eviction is pointless for a single replay
+	store := adapters.NewSlidingWindowUsageStore(adapters.WithSlidingWindowClock(clock), adapters.WithUsageEvictionInterval(0))
+
+	// Rate limits delay queries on the capture's timeline without waiting
+	engine, err := NewQuotaService(store, s.policies, WithQuotaClock(clock))
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make(map[string]tenantKey)
+	labels := make(map[string]map[string]string)
+	tenants := make(map[tenantKey]*TenantSimulation)
+	report := &SimulationReport{}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		record, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read capture: %w", err)
+		}
+
+		switch {
+		case record.Kind == domain.CaptureRecordProtocol && record.MessageType == "StartupMessage":
+			params := make(map[string]string, len(record.Details))
+			for name := range record.Details {
+				params[name] = detailString(record.Details, name)
+			}
+			sessions[record.ConnectionID] = tenantKey{
+				user:     params["user"],
+				database: params["database"],
+			}
+			labels[record.ConnectionID] = adapters.ParseConnectionLabels(params)
+
+		case record.Kind == domain.CaptureRecordQuery:
+			clock.now = record.Timestamp
+			key := sessions[record.ConnectionID]
+
+			query := domain.NewQuery(record.Query, record.ConnectionID)
+			query.UserID = key.user
+			query.Database = key.database
+			query.Labels = labels[record.ConnectionID]
+			query.Timestamp = record.Timestamp
+
+			decision, err := engine.Evaluate(ctx, query)
+			if err != nil {
+				return nil, fmt.Errorf("failed to evaluate query on %s: %w", record.ConnectionID, err)
+			}
+			// Captures do not tell when statements end, so concurrency caps never deny
+			decision.Finish()
+
+			tenant, ok := tenants[key]
+			if !ok {
+				tenant = &TenantSimulation{User: key.user, Database: key.database}
+				tenants[key] = tenant
+			}
+			tenant.Queries++
+			report.Queries++
+
+			if !decision.Allowed() {
+				if tenant.DeniedByPolicy == nil {
+					tenant.DeniedByPolicy = make(map[string]int)
+				}
+				if tenant.FirstDeniedAt == nil {
+					deniedAt := record.Timestamp
+					tenant.FirstDeniedAt = &deniedAt
+				}
+				tenant.DeniedByPolicy[decision.Policy]++
+				tenant.Denied++
+				report.Denied++
+			}
+		}
+	}
+
+	report.Tenants = make([]TenantSimulation, 0, len(tenants))
+	for _, tenant := range tenants {
+		report.Tenants = append(report.Tenants, *tenant)
+	}
+	sort.Slice(report.Tenants, func(i, j int) bool {
+		a, b := report.Tenants[i], report.Tenants[j]
+		if a.Denied != b.Denied {
+			return a.Denied > b.Denied
+		}
+		if a.User != b.User {
+			return a.User < b.User
+		}
+		return a.Database < b.Database
+	})
+
+	return report, nil
+}
+
+// captureClock is a domain.Clock standing at the timestamp of the record being simulated
+type captureClock struct {
+	now time.Time
+}
+
+func (c *captureClock) Now() time.Time {
+	return c.now
+}
+
+// NewTimer returns an already fired timer; simulations never wait
+func (c *captureClock) NewTimer(d time.Duration) domain.Timer {
+	timer := firedTimer{ch: make(chan time.Time, 1)}
+	timer.ch <- c.now.Add(d)
+	return timer
+}
+
+// firedTimer is a domain.Timer that has already fired
+type firedTimer struct {
+	ch chan time.Time
+}
+
+func (t firedTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t firedTimer) Stop() bool {
+	return false
+}
+
+// detailString returns a string value from protocol message details
+func detailString(details map[string]interface{}, name string) string {
+	value, _ := details[name].(string)
+	return value
+}
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sliceCaptureSource serves capture records from memory
+type sliceCaptureSource struct {
+	records []domain.CaptureRecord
+}
+
+func (s *sliceCaptureSource) Header() domain.CaptureHeader {
+	return domain.CaptureHeader{Version: domain.CaptureFormatVersion}
+}
+
+func (s *sliceCaptureSource) Next() (*domain.CaptureRecord, error) {
+	if len(s.records) == 0 {
+		return nil, io.EOF
+	}
+	record := s.records[0]
+	s.records = s.records[1:]
+	return &record, nil
+}
+
+func TestSimulationService_Run(t *testing.T) {
+	start := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	startup := func(conn, user, database string) domain.CaptureRecord {
+		return domain.CaptureRecord{
+			Timestamp:    start,
+			ConnectionID: conn,
+			Kind:         domain.CaptureRecordProtocol,
+			MessageType:  "StartupMessage",
+			Details:      map[string]interface{}{"user": user, "database": database},
+		}
+	}
+	query := func(conn string, offset time.Duration) domain.CaptureRecord {
+		return domain.CaptureRecord{
+			Timestamp:    start.Add(offset),
+			ConnectionID: conn,
+			Kind:         domain.CaptureRecordQuery,
+			Query:        "SELECT 1",
+		}
+	}
+
+	source := &sliceCaptureSource{records: []domain.CaptureRecord{
+		startup("conn_1", "alice", "app"),
+		startup("conn_2", "bob", "app"),
+		query("conn_1", time.Second),
+		query("conn_1", 2*time.Second),
+		query("conn_2", 3*time.Second),
+		query("conn_1", 4*time.Second),
+		query("conn_1", 5*time.Second),
+		// A minute later alice's earlier queries have almost slid out of the window
+		query("conn_1", time.Minute+time.Second),
+	}}
+
+	simulation, err := NewSimulationService([]domain.QuotaPolicy{
+		{Name: "per-minute", User: "alice", Limit: 2, Window: time.Minute},
+	})
+	require.NoError(t, err)
+
+	report, err := simulation.Run(context.Background(), source)
+	require.NoError(t, err)
+
+	assert.Equal(t, 6, report.Queries)
+	assert.Equal(t, 2, report.Denied)
+	require.Len(t, report.Tenants, 2)
+
+	alice := report.Tenants[0]
+	assert.Equal(t, "alice", alice.User)
+	assert.Equal(t, 5, alice.Queries)
+	assert.Equal(t, 2, alice.Denied)
+	assert.Equal(t, map[string]int{"per-minute": 2}, alice.DeniedByPolicy)
+	require.NotNil(t, alice.FirstDeniedAt)
+	assert.Equal(t, start.Add(4*time.Second), *alice.FirstDeniedAt)
+
+	bob := report.Tenants[1]
+	assert.Equal(t, "bob", bob.User)
+	assert.Equal(t, 1, bob.Queries)
+	assert.Zero(t, bob.Denied)
+	assert.Nil(t, bob.FirstDeniedAt)
+}
+
+func TestNewSimulationService_InvalidPolicies(t *testing.T) {
+	_, err := NewSimulationService([]domain.QuotaPolicy{{Name: "broken", Limit: 0, Window: time.Minute}})
+	assert.Error(t, err)
+}
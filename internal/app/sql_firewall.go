@@ -0,0 +1,373 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// FirewallPolicyName is the decision policy reported when the SQL firewall
+	// blocks a query
+	FirewallPolicyName = "sql_firewall"
+
+	// DefaultFirewallSaveInterval is how often the profiles learned since the
+	// last save are saved
+	DefaultFirewallSaveInterval = time.Minute
+
+	// firewallErrorCode is the SQLSTATE of blocked queries, insufficient_privilege
+	firewallErrorCode = "42501"
+
+	// maxFirewallReports bounds the violations remembered as reported; once
+	// reached they are forgotten, and reported again as they recur
+	maxFirewallReports = 10000
+)
+
+// FirewallMode tells whether the SQL firewall learns the queries of the users
+// or only enforces what it learned
+type FirewallMode string
+
+const (
+	FirewallLearn   FirewallMode = "learn"   // learn each user's queries, then enforce them once its learning period is over
+	FirewallEnforce FirewallMode = "enforce" // enforce the saved profiles, learning nothing
+)
+
+// FirewallAction is what the SQL firewall does with the queries it enforces
+// that are not among those learned
+type FirewallAction string
+
+const (
+	FirewallBlock FirewallAction = "block" // deny them
+	FirewallAlert FirewallAction = "alert" // allow them, emitting a firewall_violation event
+)
+
+// FirewallConfig configures the SQL firewall, which freezes users, typically
+// service accounts, to the set of queries they ran while it learned them
+type FirewallConfig struct {
+	// Mode is learn or enforce; empty disables the firewall
+	Mode FirewallMode
+
+	// LearningPeriod is how long the queries of a user are learned, from its
+	// first query, before the firewall enforces them in learn mode. Zero
+	// learns until the firewall is switched to enforce mode.
+	LearningPeriod time.Duration
+
+	// Action is block or alert; empty blocks
+	Action FirewallAction
+
+	// Users restricts the firewall to these users; empty applies it to all
+	Users []string
+
+	// ProfileFile is where the learned profiles are saved, and loaded from on
+	// start; empty keeps them in memory
+	ProfileFile string
+}
+
+// Enabled reports whether the SQL firewall is configured
+func (c FirewallConfig) Enabled() bool {
+	return c.Mode != ""
+}
+
+// Validate checks the mode and action are known, the learning period is not
+// negative and that the enforce mode has a profile file
+func (c FirewallConfig) Validate() error {
+	switch c.Mode {
+	case "", FirewallLearn, FirewallEnforce:
+	default:
+		return fmt.Errorf("unknown firewall mode %q: use learn or enforce", c.Mode)
+	}
+	switch c.Action {
+	case "", FirewallBlock, FirewallAlert:
+	default:
+		return fmt.Errorf("unknown firewall action %q: use block or alert", c.Action)
+	}
+	if c.LearningPeriod < 0 {
+		return fmt.Errorf("firewall learning period must not be negative")
+	}
+	if c.Mode == FirewallEnforce && c.ProfileFile == "" {
+		return fmt.Errorf("the firewall enforce mode needs the profile file of a learn mode")
+	}
+	return nil
+}
+
+// firewallKey identifies a fingerprint of a user
+type firewallKey struct {
+	user string
+	hash string
+}
+
+// SQLFirewall learns the query fingerprints each user runs, then blocks, or
+// alerts on, those it never saw, so that a compromised or misbehaving service
+// account cannot run anything new. In learn mode a user's queries are learned
+// for the learning period following its first query, after which its profile
+// is enforced; in enforce mode the saved profiles are enforced as they are,
+// users without one having none allowed. Queries that could not be normalized
+// have no fingerprint: they are never learned, and are violations once
+// enforced. Simple queries and Parse messages are checked, the Executes of a
+// prepared statement following its Parse. A firewall_violation event is
+// emitted once per user and fingerprint. Its Middleware runs in front of the
+// policy engine, so blocked queries consume no quota.
+type SQLFirewall struct {
+	config FirewallConfig
+	store  domain.FirewallProfileStore // nil keeps profiles in memory
+	events domain.EventSink
+	clock  domain.Clock
+	logger logger.Logger
+	users  map[string]bool // empty for every user
+
+	mu       sync.Mutex
+	profiles map[string]*domain.FirewallProfile
+	reported map[firewallKey]bool
+	dirty    bool // profiles changed since the last save
+
+	flushMu sync.Mutex // orders saves so an older snapshot never replaces a newer one
+}
+
+// NewSQLFirewall creates a SQLFirewall saving the profiles it learns to store,
+// which may be nil
+func NewSQLFirewall(config FirewallConfig, store domain.FirewallProfileStore, events domain.EventSink, clock domain.Clock, log logger.Logger) (*SQLFirewall, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Action == "" {
+		config.Action = FirewallBlock
+	}
+	users := make(map[string]bool, len(config.Users))
+	for _, user := range config.Users {
+		users[user] = true
+	}
+	return &SQLFirewall{
+		config:   config,
+		store:    store,
+		events:   events,
+		clock:    clock,
+		logger:   log,
+		users:    users,
+		profiles: make(map[string]*domain.FirewallProfile),
+		reported: make(map[firewallKey]bool),
+	}, nil
+}
+
+// Load replaces the profiles with those saved in the store
+func (f *SQLFirewall) Load(ctx context.Context) error {
+	if f.store == nil {
+		return nil
+	}
+	profiles, err := f.store.LoadFirewallProfiles(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load firewall profiles: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.profiles = make(map[string]*domain.FirewallProfile, len(profiles))
+	for _, profile := range profiles {
+		if profile.Fingerprints == nil {
+			profile.Fingerprints = make(map[string]string)
+		}
+		delete(profile.Fingerprints, "")
+		f.profiles[profile.User] = &profile
+	}
+	f.reported = make(map[firewallKey]bool)
+	return nil
+}
+
+// Middleware is a domain.QueryMiddleware learning the query's fingerprint, or
+// checking it against those learned for its user, and handing the query on to
+// next unless it is blocked
+func (f *SQLFirewall) Middleware(ctx context.Context, query *domain.Query, next domain.QueryHandler) (domain.Decision, error) {
+	if query.Kind == domain.QueryKindExecute || (len(f.users) > 0 && !f.users[query.UserID]) {
+		return next(ctx, query)
+	}
+
+	hash := query.Hash.String()
+	now := f.clock.Now()
+	f.mu.Lock()
+	profile, ok := f.profiles[query.UserID]
+	if !ok && f.config.Mode == FirewallLearn {
+		profile = &domain.FirewallProfile{User: query.UserID, LearnedSince: now, Fingerprints: make(map[string]string)}
+		f.profiles[query.UserID] = profile
+		f.dirty = true
+	}
+	if f.learning(profile, now) {
+		if _, ok := profile.Fingerprints[hash]; !ok && hash != "" {
+			profile.Fingerprints[hash] = query.Normalized
+			f.dirty = true
+		}
+		f.mu.Unlock()
+		return next(ctx, query)
+	}
+
+	known := false
+	if profile != nil && hash != "" {
+		_, known = profile.Fingerprints[hash]
+	}
+	key := firewallKey{user: query.UserID, hash: hash}
+	report := !known && !f.reported[key]
+	if report {
+		if len(f.reported) >= maxFirewallReports {
+			clear(f.reported)
+		}
+		f.reported[key] = true
+	}
+	f.mu.Unlock()
+
+	if known {
+		return next(ctx, query)
+	}
+	if report {
+		f.violation(query, now)
+	}
+	if f.config.Action == FirewallAlert {
+		return next(ctx, query)
+	}
+	return domain.Decision{
+		Action: domain.DecisionDeny,
+		Policy: FirewallPolicyName,
+		Code:   firewallErrorCode,
+		Reason: fmt.Sprintf("%s is not among the queries learned for user %q", describeFingerprint(hash), query.UserID),
+		Hint:   "The SQL firewall only lets the user run the queries it ran while learning.",
+	}, nil
+}
+
+// learning reports whether the queries of profile are still learned, and ends
+// its learning once the learning period is over; f.mu must be held
+func (f *SQLFirewall) learning(profile *domain.FirewallProfile, now time.Time) bool {
+	if f.config.Mode != FirewallLearn || profile.Enforced {
+		return false
+	}
+	if f.config.LearningPeriod <= 0 || now.Sub(profile.LearnedSince) < f.config.LearningPeriod {
+		return true
+	}
+	profile.Enforced = true
+	f.dirty = true
+	f.logger.Info("Learned %d queries of user %s since %s; the SQL firewall now enforces them",
+		len(profile.Fingerprints), profile.User, profile.LearnedSince.UTC().Format(time.RFC3339))
+	return false
+}
+
+// violation reports a query of an unseen fingerprint
+func (f *SQLFirewall) violation(query *domain.Query, now time.Time) {
+	hash := query.Hash.String()
+	outcome := "Blocked"
+	if f.config.Action == FirewallAlert {
+		outcome = "Let through"
+	}
+	f.logger.Info("%s %s of user %s on database %s, unknown to the SQL firewall: %s",
+		outcome, describeFingerprint(hash), query.UserID, query.Database, query.Normalized)
+	if f.events == nil {
+		return
+	}
+	f.events.Emit(domain.Event{
+		Type:         domain.EventFirewallViolation,
+		Timestamp:    now,
+		ConnectionID: query.ConnectionID,
+		Fields: map[string]interface{}{
+			"user":       query.UserID,
+			"database":   query.Database,
+			"query_hash": hash,
+			"query":      query.Normalized,
+			"action":     string(f.config.Action),
+		},
+	})
+}
+
+// describeFingerprint names the queries of a fingerprint in messages
+func describeFingerprint(hash string) string {
+	if hash == "" {
+		return "a query that could not be normalized"
+	}
+	return "query " + hash
+}
+
+// Profiles returns the learned profiles, by user name
+func (f *SQLFirewall) Profiles() []domain.FirewallProfile {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.snapshot()
+}
+
+// snapshot copies the profiles, by user name; f.mu must be held
+func (f *SQLFirewall) snapshot() []domain.FirewallProfile {
+	profiles := make([]domain.FirewallProfile, 0, len(f.profiles))
+	for _, profile := range f.profiles {
+		copied := *profile
+		copied.Fingerprints = maps.Clone(profile.Fingerprints)
+		profiles = append(profiles, copied)
+	}
+	slices.SortFunc(profiles, func(a, b domain.FirewallProfile) int {
+		return strings.Compare(a.User, b.User)
+	})
+	return profiles
+}
+
+// Relearn forgets the profile of user, whose queries are learned again from
+// its next one in learn mode. It reports whether the user had a profile.
+func (f *SQLFirewall) Relearn(user string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.profiles[user]; !ok {
+		return false
+	}
+	delete(f.profiles, user)
+	for key := range f.reported {
+		if key.user == user {
+			delete(f.reported, key)
+		}
+	}
+	f.dirty = true
+	return true
+}
+
+// Flush saves the profiles to the store when they changed since the last save
+func (f *SQLFirewall) Flush(ctx context.Context) error {
+	if f.store == nil {
+		return nil
+	}
+	f.flushMu.Lock()
+	defer f.flushMu.Unlock()
+
+	f.mu.Lock()
+	if !f.dirty {
+		f.mu.Unlock()
+		return nil
+	}
+	profiles := f.snapshot()
+	f.dirty = false
+	f.mu.Unlock()
+
+	if err := f.store.SaveFirewallProfiles(ctx, profiles); err != nil {
+		f.mu.Lock()
+		f.dirty = true
+		f.mu.Unlock()
+		return fmt.Errorf("failed to save firewall profiles: %w", err)
+	}
+	return nil
+}
+
+// Run saves the changed profiles every DefaultFirewallSaveInterval until ctx is
+// cancelled
+func (f *SQLFirewall) Run(ctx context.Context) {
+	for {
+		timer := f.clock.NewTimer(DefaultFirewallSaveInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+
+		if err := f.Flush(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			f.logger.Error("%v", err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newUserQuery is a query of user with the fingerprint hash
+func newUserQuery(user, hash string) *domain.Query {
+	query := newFingerprintedQuery("conn_1", hash)
+	query.UserID = user
+	query.Database = "app"
+	query.Kind = domain.QueryKindSimple
+	return query
+}
+
+func TestSQLFirewall_LearnsThenEnforces(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC))
+	events := &mocks.RecordingEventSink{}
+	next := &mocks.StaticPolicyEngine{}
+	firewall, err := NewSQLFirewall(FirewallConfig{Mode: FirewallLearn, LearningPeriod: time.Hour, Users: []string{"billing"}},
+		nil, events, clock, logger.NewSimpleLogger())
+	require.NoError(t, err)
+	engine := NewMiddlewareChain(next, firewall.Middleware)
+
+	for _, hash := range []string{"a1", "b2", "a1"} {
+		decision, err := engine.Evaluate(ctx, newUserQuery("billing", hash))
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed(), "Queries should be let through while learning")
+	}
+	clock.Advance(time.Hour)
+
+	decision, err := engine.Evaluate(ctx, newUserQuery("billing", "a1"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed(), "Learned queries should be let through")
+	for i := 0; i < 2; i++ {
+		decision, err = engine.Evaluate(ctx, newUserQuery("billing", "c3"))
+		require.NoError(t, err)
+		require.False(t, decision.Allowed(), "Unseen queries should be blocked")
+	}
+	assert.Equal(t, FirewallPolicyName, decision.Policy)
+	assert.Equal(t, "42501", decision.Code)
+	assert.Equal(t, `query c3 is not among the queries learned for user "billing"`, decision.Reason)
+	assert.Len(t, next.Queries(), 4, "Blocked queries should not reach the quota engine")
+
+	violations := events.EventsOfType(domain.EventFirewallViolation)
+	require.Len(t, violations, 1, "A fingerprint should be reported once")
+	assert.Equal(t, "billing", violations[0].Fields["user"])
+	assert.Equal(t, "c3", violations[0].Fields["query_hash"])
+	assert.Equal(t, "block", violations[0].Fields["action"])
+
+	execute := newUserQuery("billing", "c3")
+	execute.Kind = domain.QueryKindExecute
+	decision, err = engine.Evaluate(ctx, execute)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed(), "Executes should be left to the check of their Parse")
+	decision, err = engine.Evaluate(ctx, newUserQuery("alice", "c3"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed(), "Users outside the list should not be firewalled")
+
+	profiles := firewall.Profiles()
+	require.Len(t, profiles, 1)
+	assert.True(t, profiles[0].Enforced)
+	assert.Equal(t, map[string]string{"a1": "SELECT * FROM users WHERE id = $1", "b2": "SELECT * FROM users WHERE id = $1"}, profiles[0].Fingerprints)
+
+	assert.True(t, firewall.Relearn("billing"))
+	assert.False(t, firewall.Relearn("billing"))
+	decision, err = engine.Evaluate(ctx, newUserQuery("billing", "c3"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed(), "A relearned user should be learned again")
+}
+
+func TestSQLFirewall_EnforcesSavedProfiles(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC))
+	store := adapters.NewFileFirewallStore(filepath.Join(t.TempDir(), "firewall.json"))
+	learner, err := NewSQLFirewall(FirewallConfig{Mode: FirewallLearn, ProfileFile: "firewall.json"},
+		store, nil, clock, logger.NewSimpleLogger())
+	require.NoError(t, err)
+	learning := NewMiddlewareChain(&mocks.StaticPolicyEngine{}, learner.Middleware)
+	_, err = learning.Evaluate(ctx, newUserQuery("etl", "a1"))
+	require.NoError(t, err)
+	decision, err := learning.Evaluate(ctx, newUserQuery("etl", ""))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed(), "Queries should be let through while learning")
+	require.NoError(t, learner.Flush(ctx))
+	assert.Equal(t, map[string]string{"a1": "SELECT * FROM users WHERE id = $1"}, learner.Profiles()[0].Fingerprints,
+		"Queries that could not be normalized should not be learned")
+
+	events := &mocks.RecordingEventSink{}
+	enforcer, err := NewSQLFirewall(FirewallConfig{Mode: FirewallEnforce, Action: FirewallAlert, ProfileFile: "firewall.json"},
+		store, events, clock, logger.NewSimpleLogger())
+	require.NoError(t, err)
+	require.NoError(t, enforcer.Load(ctx))
+	enforcing := NewMiddlewareChain(&mocks.StaticPolicyEngine{}, enforcer.Middleware)
+
+	for _, query := range []*domain.Query{newUserQuery("etl", "a1"), newUserQuery("etl", ""), newUserQuery("etl", "b2"), newUserQuery("web", "a1")} {
+		decision, err := enforcing.Evaluate(ctx, query)
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed(), "Alerts should let queries through")
+	}
+	violations := events.EventsOfType(domain.EventFirewallViolation)
+	require.Len(t, violations, 3, "Unseen and unnormalized queries, and users without a profile, should be reported")
+	assert.Equal(t, "", violations[0].Fields["query_hash"])
+	assert.Equal(t, "b2", violations[1].Fields["query_hash"])
+	assert.Equal(t, "web", violations[2].Fields["user"])
+	assert.Len(t, enforcer.Profiles(), 1, "Enforcing should learn nothing")
+
+	// Violations are remembered as reported up to a bound
+	for i := 0; i < maxFirewallReports+1; i++ {
+		_, err := enforcing.Evaluate(ctx, newUserQuery("web", fmt.Sprintf("h%d", i)))
+		require.NoError(t, err)
+	}
+	assert.LessOrEqual(t, len(enforcer.reported), maxFirewallReports)
+
+	for _, config := range []FirewallConfig{
+		{Mode: "audit"},
+		{Mode: FirewallLearn, Action: "drop"},
+		{Mode: FirewallLearn, LearningPeriod: -time.Hour},
+		{Mode: FirewallEnforce},
+	} {
+		assert.Error(t, config.Validate(), "%+v", config)
+	}
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sort"
+	"sync"
+)
+
+// UpstreamBalancer holds the current upstream membership and spreads new
+// connections across it in round-robin order
+type UpstreamBalancer struct {
+	mu      sync.Mutex
+	targets []domain.UpstreamTarget
+	next    int
+}
+
+// NewUpstreamBalancer creates a balancer with no targets
+func NewUpstreamBalancer() *UpstreamBalancer {
+	return &UpstreamBalancer{}
+}
+
+// Update replaces the membership and returns the targets that were added and removed
+func (b *UpstreamBalancer) Update(targets []domain.UpstreamTarget) (added, removed []domain.UpstreamTarget) {
+	updated := make([]domain.UpstreamTarget, 0, len(targets))
+	seen := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		if seen[target.Address] {
+			continue
+		}
+		seen[target.Address] = true
+		updated = append(updated, target)
+	}
+	sort.Slice(updated, func(i, j int) bool {
+		return updated[i].Address < updated[j].Address
+	})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current := make(map[string]bool, len(b.targets))
+	for _, target := range b.targets {
+		current[target.Address] = true
+		if !seen[target.Address] {
+			removed = append(removed, target)
+		}
+	}
+	for _, target := range updated {
+		if !current[target.Address] {
+			added = append(added, target)
+		}
+	}
+
+	b.targets = updated
+	return added, removed
+}
+
+// Next returns the next target in round-robin order, or false when there are none
+func (b *UpstreamBalancer) Next() (domain.UpstreamTarget, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.targets) == 0 {
+		return domain.UpstreamTarget{}, false
+	}
+	target := b.targets[b.next%len(b.targets)]
+	b.next = (b.next + 1) % len(b.targets)
+	return target, true
+}
+
+// Targets returns a copy of the current membership
+func (b *UpstreamBalancer) Targets() []domain.UpstreamTarget {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]domain.UpstreamTarget(nil), b.targets...)
+}
@@ -0,0 +1,33 @@
+package app
+
+import (
+	"testing"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamBalancer(t *testing.T) {
+	balancer := NewUpstreamBalancer()
+
+	_, ok := balancer.Next()
+	assert.False(t, ok, "An empty balancer has no target")
+
+	added, removed := balancer.Update([]domain.UpstreamTarget{{Address: "10.0.0.2:5432"}, {Address: "10.0.0.1:5432"}, {Address: "10.0.0.1:5432"}})
+	assert.Equal(t, []domain.UpstreamTarget{{Address: "10.0.0.1:5432"}, {Address: "10.0.0.2:5432"}}, added)
+	assert.Empty(t, removed)
+
+	var picked []string
+	for i := 0; i < 4; i++ {
+		target, ok := balancer.Next()
+		assert.True(t, ok)
+		picked = append(picked, target.Address)
+	}
+	assert.Equal(t, []string{"10.0.0.1:5432", "10.0.0.2:5432", "10.0.0.1:5432", "10.0.0.2:5432"}, picked)
+
+	added, removed = balancer.Update([]domain.UpstreamTarget{{Address: "10.0.0.2:5432"}, {Address: "10.0.0.3:5432"}})
+	assert.Equal(t, []domain.UpstreamTarget{{Address: "10.0.0.3:5432"}}, added)
+	assert.Equal(t, []domain.UpstreamTarget{{Address: "10.0.0.1:5432"}}, removed)
+	assert.Len(t, balancer.Targets(), 2)
+}
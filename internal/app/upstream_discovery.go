@@ -0,0 +1,111 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"time"
+)
+
+const (
+	// DefaultUpstreamMinRefresh is the shortest delay between two resolutions
+	DefaultUpstreamMinRefresh = time.Second
+
+	// DefaultUpstreamMaxRefresh is the longest delay between two resolutions
+	DefaultUpstreamMaxRefresh = 30 * time.Second
+)
+
+// UpstreamDiscoveryConfig bounds how often upstream targets are re-resolved
+type UpstreamDiscoveryConfig struct {
+	// MinRefresh is the lower bound on the refresh interval and the retry delay
+	// after a failed resolution
+	MinRefresh time.Duration
+
+	// MaxRefresh is the upper bound on the refresh interval, also used when the
+	// resolver does not report a TTL
+	MaxRefresh time.Duration
+}
+
+// UpstreamDiscovery periodically resolves upstream targets, honoring the TTL reported
+// by the resolver, and feeds membership changes into an UpstreamBalancer
+type UpstreamDiscovery struct {
+	resolver domain.UpstreamResolver
+	balancer *UpstreamBalancer
+	config   UpstreamDiscoveryConfig
+	clock    domain.Clock
+	logger   logger.Logger
+}
+
+// NewUpstreamDiscovery creates an UpstreamDiscovery; zero intervals take their defaults
+func NewUpstreamDiscovery(resolver domain.UpstreamResolver, balancer *UpstreamBalancer, config UpstreamDiscoveryConfig, clock domain.Clock, log logger.Logger) *UpstreamDiscovery {
+	if config.MinRefresh <= 0 {
+		config.MinRefresh = DefaultUpstreamMinRefresh
+	}
+	if config.MaxRefresh <= 0 {
+		config.MaxRefresh = DefaultUpstreamMaxRefresh
+	}
+	if config.MaxRefresh < config.MinRefresh {
+		config.MaxRefresh = config.MinRefresh
+	}
+
+	return &UpstreamDiscovery{
+		resolver: resolver,
+		balancer: balancer,
+		config:   config,
+		clock:    clock,
+		logger:   log,
+	}
+}
+
+// Refresh resolves the targets once and updates the balancer. It returns the delay
+// before the next refresh. On failure the last known targets are kept, so a
+// resolver outage does not take every upstream away.
+func (d *UpstreamDiscovery) Refresh(ctx context.Context) (time.Duration, error) {
+	targets, ttl, err := d.resolver.Resolve(ctx)
+	if err == nil && len(targets) == 0 {
+		err = fmt.Errorf("resolver returned no upstream targets")
+	}
+	if err != nil {
+		return d.config.MinRefresh, err
+	}
+
+	added, removed := d.balancer.Update(targets)
+	for _, target := range added {
+		d.logger.Info("Upstream target added: %s", target.Address)
+	}
+	for _, target := range removed {
+		d.logger.Info("Upstream target removed: %s", target.Address)
+	}
+
+	switch {
+	case ttl <= 0 || ttl > d.config.MaxRefresh:
+		return d.config.MaxRefresh, nil
+	case ttl < d.config.MinRefresh:
+		return d.config.MinRefresh, nil
+	default:
+		return ttl, nil
+	}
+}
+
+// Run waits for delay, then refreshes the targets until ctx is cancelled
+func (d *UpstreamDiscovery) Run(ctx context.Context, delay time.Duration) {
+	for {
+		timer := d.clock.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+
+		var err error
+		delay, err = d.Refresh(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			d.logger.Error("Failed to resolve upstream targets: %v", err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamDiscovery_Refresh(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	resolver := &mocks.UpstreamResolver{}
+	balancer := NewUpstreamBalancer()
+	discovery := NewUpstreamDiscovery(resolver, balancer, UpstreamDiscoveryConfig{MinRefresh: time.Second, MaxRefresh: time.Minute}, clock, logger.NewSimpleLogger())
+
+	first := []domain.UpstreamTarget{{Address: "10.0.0.1:5432"}}
+	resolver.On("Resolve", ctx).Return(first, 20*time.Second, nil).Once()
+	delay, err := discovery.Refresh(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 20*time.Second, delay, "The record TTL should drive the refresh")
+	assert.Equal(t, first, balancer.Targets())
+
+	resolver.On("Resolve", ctx).Return(nil, time.Duration(0), errors.New("SERVFAIL")).Once()
+	delay, err = discovery.Refresh(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, time.Second, delay, "Failures should be retried after the minimum interval")
+	assert.Equal(t, first, balancer.Targets(), "Failures should keep the last known targets")
+
+	resolver.On("Resolve", ctx).Return([]domain.UpstreamTarget{}, time.Duration(0), nil).Once()
+	_, err = discovery.Refresh(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, first, balancer.Targets(), "An empty answer should not drop every upstream")
+
+	resolver.On("Resolve", ctx).Return(first, 10*time.Millisecond, nil).Once()
+	delay, err = discovery.Refresh(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, delay, "Short TTLs should be clamped to the minimum")
+
+	resolver.On("Resolve", ctx).Return(first, time.Duration(0), nil).Once()
+	delay, err = discovery.Refresh(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, delay, "A missing TTL should use the maximum")
+
+	resolver.AssertExpectations(t)
+}
+
+func TestUpstreamDiscovery_Run(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	resolver := &mocks.UpstreamResolver{}
+	balancer := NewUpstreamBalancer()
+	discovery := NewUpstreamDiscovery(resolver, balancer, UpstreamDiscoveryConfig{}, clock, logger.NewSimpleLogger())
+
+	resolver.On("Resolve", mock.Anything).Return([]domain.UpstreamTarget{{Address: "10.0.0.1:5432"}}, 5*time.Second, nil).Once()
+	resolver.On("Resolve", mock.Anything).Return([]domain.UpstreamTarget{{Address: "10.0.0.2:5432"}}, 5*time.Second, nil)
+
+	done := make(chan struct{})
+	go func() {
+		discovery.Run(ctx, 0)
+		close(done)
+	}()
+
+	require.True(t, clock.WaitForTimers(1, time.Second))
+	assert.Equal(t, []domain.UpstreamTarget{{Address: "10.0.0.1:5432"}}, balancer.Targets())
+
+	clock.Advance(5 * time.Second)
+	assert.Eventually(t, func() bool {
+		targets := balancer.Targets()
+		return len(targets) == 1 && targets[0].Address == "10.0.0.2:5432"
+	}, time.Second, 10*time.Millisecond, "Records should be re-resolved once the TTL expires")
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,260 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultFailoverInterval is how often the primary upstream is checked
+	DefaultFailoverInterval = 5 * time.Second
+
+	// DefaultFailoverTimeout bounds each check of a primary upstream target
+	DefaultFailoverTimeout = 2 * time.Second
+
+	// DefaultFailoverThreshold is how many checks in a row the primary upstream
+	// fails before new connections fail over
+	DefaultFailoverThreshold = 3
+
+	// DefaultFailoverCooldown is how long the primary upstream stays healthy
+	// before new connections fail back to it
+	DefaultFailoverCooldown = time.Minute
+)
+
+// UpstreamFailoverConfig configures the failover of the upstream to a secondary
+type UpstreamFailoverConfig struct {
+	// Upstream is the secondary new connections fail over to, in any form the
+	// primary upstream accepts; empty disables failover
+	Upstream string
+
+	// CheckURL logs the checks in to the primary with its user, password and
+	// database, such as postgres://health@/postgres, and runs SELECT 1; empty
+	// only checks that a TCP connection opens
+	CheckURL string
+
+	// Interval, Timeout, Threshold and Cooldown take their defaults when zero
+	Interval  time.Duration
+	Timeout   time.Duration
+	Threshold int
+	Cooldown  time.Duration
+}
+
+// Enabled reports whether a secondary upstream is configured
+func (c UpstreamFailoverConfig) Enabled() bool {
+	return c.Upstream != ""
+}
+
+// Validate checks that durations and the threshold are not negative
+func (c UpstreamFailoverConfig) Validate() error {
+	if c.Interval < 0 || c.Timeout < 0 || c.Cooldown < 0 {
+		return fmt.Errorf("upstream failover durations must not be negative")
+	}
+	if c.Threshold < 0 {
+		return fmt.Errorf("upstream failover threshold must not be negative")
+	}
+	return nil
+}
+
+// FailoverStatus is the state of an UpstreamFailover and what it counted
+type FailoverStatus struct {
+	FailedOver          bool
+	Since               time.Time // of the last failover or failback, zero if none
+	ConsecutiveFailures int
+	HealthySince        time.Time // zero while the primary is failing
+	Checks              int64
+	FailedChecks        int64
+	Failovers           int64
+	Failbacks           int64
+	LastError           string // of the last failed check
+}
+
+// UpstreamFailover implements domain.UpstreamSelector over a primary and a
+// secondary upstream. The targets of the primary are checked every interval,
+// and the primary is healthy while any of them passes. New connections go to
+// the primary until it fails threshold checks in a row, then to the secondary
+// until the primary has stayed healthy for the cooldown, so that a flapping
+// primary does not get connections back and forth. Open connections stay where
+// they are.
+type UpstreamFailover struct {
+	primary    *UpstreamBalancer
+	secondary  domain.UpstreamSelector
+	serverName string // verified by upstream TLS on secondary targets; empty for their host
+	checker    domain.UpstreamChecker
+	config     UpstreamFailoverConfig
+	events     domain.EventSink
+	clock      domain.Clock
+	logger     logger.Logger
+
+	mu     sync.Mutex
+	status FailoverStatus
+}
+
+// NewUpstreamFailover creates an UpstreamFailover checking the targets of
+// primary with checker. Upstream TLS verifies secondary targets against
+// serverName, or against their own host when empty, rather than against the
+// primary's host name. Failovers and failbacks are emitted to events, which may
+// be nil.
+func NewUpstreamFailover(primary *UpstreamBalancer, secondary domain.UpstreamSelector, serverName string, checker domain.UpstreamChecker,
+	config UpstreamFailoverConfig, events domain.EventSink, clock domain.Clock, log logger.Logger) *UpstreamFailover {
+	if config.Interval <= 0 {
+		config.Interval = DefaultFailoverInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultFailoverTimeout
+	}
+	if config.Threshold <= 0 {
+		config.Threshold = DefaultFailoverThreshold
+	}
+	if config.Cooldown <= 0 {
+		config.Cooldown = DefaultFailoverCooldown
+	}
+	return &UpstreamFailover{
+		primary:    primary,
+		secondary:  secondary,
+		serverName: serverName,
+		checker:    checker,
+		config:     config,
+		events:     events,
+		clock:      clock,
+		logger:     log,
+	}
+}
+
+// Next implements domain.UpstreamSelector. While failed over, the primary is
+// still tried when the secondary has no target.
+func (f *UpstreamFailover) Next() (domain.UpstreamTarget, bool) {
+	if f.Status().FailedOver {
+		if target, ok := f.secondary.Next(); ok {
+			target.ServerName = f.serverName
+			if target.ServerName == "" {
+				target.ServerName, _, _ = net.SplitHostPort(target.Address)
+			}
+			return target, true
+		}
+	}
+	return f.primary.Next()
+}
+
+// Status returns the current state and counters
+func (f *UpstreamFailover) Status() FailoverStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+// Check checks the primary once and fails over or back as needed
+func (f *UpstreamFailover) Check(ctx context.Context) {
+	err := f.checkPrimary(ctx)
+	if ctx.Err() != nil {
+		// Shutting down is not the primary's failure
+		return
+	}
+	now := f.clock.Now()
+
+	f.mu.Lock()
+	f.status.Checks++
+	var transition domain.EventType
+	if err != nil {
+		f.status.FailedChecks++
+		f.status.ConsecutiveFailures++
+		f.status.HealthySince = time.Time{}
+		f.status.LastError = err.Error()
+		if !f.status.FailedOver && f.status.ConsecutiveFailures >= f.config.Threshold {
+			f.status.FailedOver = true
+			f.status.Since = now
+			f.status.Failovers++
+			transition = domain.EventUpstreamFailover
+		}
+	} else {
+		f.status.ConsecutiveFailures = 0
+		if f.status.HealthySince.IsZero() {
+			f.status.HealthySince = now
+		}
+		if f.status.FailedOver && now.Sub(f.status.HealthySince) >= f.config.Cooldown {
+			f.status.FailedOver = false
+			f.status.Since = now
+			f.status.Failbacks++
+			transition = domain.EventUpstreamFailback
+		}
+	}
+	failures := f.status.ConsecutiveFailures
+	f.mu.Unlock()
+
+	switch transition {
+	case domain.EventUpstreamFailover:
+		f.logger.Error("Primary upstream failed %d checks in a row, failing over to %s: %v", failures, f.config.Upstream, err)
+		f.emit(transition, now, map[string]interface{}{
+			"secondary": f.config.Upstream,
+			"failures":  failures,
+			"error":     err.Error(),
+		})
+	case domain.EventUpstreamFailback:
+		f.logger.Info("Primary upstream healthy for %s, failing back from %s", f.config.Cooldown, f.config.Upstream)
+		f.emit(transition, now, map[string]interface{}{
+			"secondary": f.config.Upstream,
+			"cooldown":  f.config.Cooldown.String(),
+		})
+	default:
+		if err != nil {
+			f.logger.Debug("Primary upstream failed its check: %v", err)
+		}
+	}
+}
+
+// Run checks the primary every interval until ctx is cancelled
+func (f *UpstreamFailover) Run(ctx context.Context) {
+	for {
+		timer := f.clock.NewTimer(f.config.Interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+		f.Check(ctx)
+	}
+}
+
+// checkPrimary checks every target of the primary concurrently and returns nil
+// as soon as one passes, or the first failure once they all failed
+func (f *UpstreamFailover) checkPrimary(ctx context.Context) error {
+	targets := f.primary.Targets()
+	if len(targets) == 0 {
+		return fmt.Errorf("no upstream target resolved")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.config.Timeout)
+	defer cancel()
+
+	errs := make(chan error, len(targets))
+	for _, target := range targets {
+		go func(address string) {
+			errs <- f.checker.Check(ctx, address)
+		}(target.Address)
+	}
+
+	var failure error
+	for range targets {
+		err := <-errs
+		if err == nil {
+			return nil
+		}
+		if failure == nil {
+			failure = err
+		}
+	}
+	return failure
+}
+
+// emit publishes an event of the given type, if an event sink is set
+func (f *UpstreamFailover) emit(eventType domain.EventType, now time.Time, fields map[string]interface{}) {
+	if f.events == nil {
+		return
+	}
+	f.events.Emit(domain.Event{Type: eventType, Timestamp: now, Fields: fields})
+}
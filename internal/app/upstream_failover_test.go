@@ -0,0 +1,106 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamFailover(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	primary := NewUpstreamBalancer()
+	primary.Update([]domain.UpstreamTarget{{Address: "10.0.0.1:6432"}, {Address: "10.0.0.2:6432"}})
+	secondary := NewUpstreamBalancer()
+	secondary.Update([]domain.UpstreamTarget{{Address: "10.0.1.1:6432"}})
+	checker := &mocks.UpstreamChecker{}
+	events := &mocks.RecordingEventSink{}
+	failover := NewUpstreamFailover(primary, secondary, "standby.internal", checker,
+		UpstreamFailoverConfig{Upstream: "standby.internal:6432", Threshold: 2, Cooldown: time.Minute},
+		events, clock, logger.NewSimpleLogger())
+
+	refused := errors.New("connection refused")
+	checker.On("Check", mock.Anything, "10.0.0.1:6432").Return(refused)
+	checker.On("Check", mock.Anything, "10.0.0.2:6432").Return(nil).Once()
+	failover.Check(ctx)
+	assert.False(t, failover.Status().FailedOver, "One healthy target should keep the primary healthy")
+
+	checker.On("Check", mock.Anything, "10.0.0.2:6432").Return(refused).Times(3)
+	failover.Check(ctx)
+	status := failover.Status()
+	assert.False(t, status.FailedOver, "Failing fewer checks than the threshold should not fail over")
+	assert.Equal(t, 1, status.ConsecutiveFailures)
+	assert.Equal(t, "connection refused", status.LastError)
+
+	failover.Check(ctx)
+	status = failover.Status()
+	require.True(t, status.FailedOver)
+	assert.Equal(t, int64(1), status.Failovers)
+	assert.Equal(t, clock.Now(), status.Since)
+	target, ok := failover.Next()
+	require.True(t, ok)
+	assert.Equal(t, domain.UpstreamTarget{Address: "10.0.1.1:6432", ServerName: "standby.internal"}, target)
+
+	failover.Check(ctx)
+	assert.Equal(t, int64(1), failover.Status().Failovers, "Failing over again should wait for a failback")
+
+	checker.On("Check", mock.Anything, "10.0.0.2:6432").Return(nil)
+	failover.Check(ctx)
+	clock.Advance(30 * time.Second)
+	failover.Check(ctx)
+	assert.True(t, failover.Status().FailedOver, "The primary should stay healthy for the cooldown before failing back")
+
+	clock.Advance(30 * time.Second)
+	failover.Check(ctx)
+	status = failover.Status()
+	assert.False(t, status.FailedOver)
+	assert.Equal(t, int64(1), status.Failbacks)
+	assert.Equal(t, int64(7), status.Checks)
+	assert.Equal(t, int64(3), status.FailedChecks)
+	target, _ = failover.Next()
+	assert.Contains(t, []string{"10.0.0.1:6432", "10.0.0.2:6432"}, target.Address)
+	assert.Empty(t, target.ServerName)
+
+	require.Len(t, events.EventsOfType(domain.EventUpstreamFailover), 1)
+	assert.Equal(t, "standby.internal:6432", events.EventsOfType(domain.EventUpstreamFailover)[0].Fields["secondary"])
+	assert.Len(t, events.EventsOfType(domain.EventUpstreamFailback), 1)
+}
+
+func TestUpstreamFailover_SecondaryWithoutTargets(t *testing.T) {
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	primary := NewUpstreamBalancer()
+	primary.Update([]domain.UpstreamTarget{{Address: "10.0.0.1:6432"}})
+	checker := &mocks.UpstreamChecker{}
+	checker.On("Check", mock.Anything, "10.0.0.1:6432").Return(errors.New("connection refused"))
+	failover := NewUpstreamFailover(primary, NewUpstreamBalancer(), "", checker,
+		UpstreamFailoverConfig{Upstream: "standby.internal:6432", Threshold: 1}, nil, clock, logger.NewSimpleLogger())
+
+	failover.Check(context.Background())
+	require.True(t, failover.Status().FailedOver)
+	target, ok := failover.Next()
+	require.True(t, ok, "The primary should still be tried when the secondary has no target")
+	assert.Equal(t, "10.0.0.1:6432", target.Address)
+}
+
+func TestUpstreamFailover_NoPrimaryTarget(t *testing.T) {
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	secondary := NewUpstreamBalancer()
+	secondary.Update([]domain.UpstreamTarget{{Address: "10.0.1.1:6432"}})
+	failover := NewUpstreamFailover(NewUpstreamBalancer(), secondary, "", &mocks.UpstreamChecker{},
+		UpstreamFailoverConfig{Upstream: "standby.internal:6432", Threshold: 1}, nil, clock, logger.NewSimpleLogger())
+
+	failover.Check(context.Background())
+	assert.True(t, failover.Status().FailedOver, "A primary without targets should fail its checks")
+	target, _ := failover.Next()
+	assert.Equal(t, domain.UpstreamTarget{Address: "10.0.1.1:6432", ServerName: "10.0.1.1"}, target)
+}
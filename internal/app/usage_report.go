@@ -0,0 +1,104 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sort"
+	"time"
+)
+
+// BuildUsageReport sums by tenant the usage of the windows of history that ended
+// after from and no later than to. What a window counted is told by the
+// dimension of its policy among policies; the windows of other policies are left
+// out. Policies counting the same dimension overlap, such as an hourly and a
+// daily limit on queries, so a tenant is charged the largest of their sums
+// rather than their total.
+func BuildUsageReport(ctx context.Context, history domain.UsageHistory, policies []domain.QuotaPolicy, from, to time.Time) (domain.UsageReport, error) {
+	if !to.After(from) {
+		return domain.UsageReport{}, fmt.Errorf("the report period must end after it starts")
+	}
+	windows, err := history.Ended(ctx, from, to)
+	if err != nil {
+		return domain.UsageReport{}, err
+	}
+	return domain.UsageReport{From: from, To: to, Tenants: tenantUsage(windows, policies)}, nil
+}
+
+// tenantUsage sums windows by tenant, in user then database order
+func tenantUsage(windows []domain.WindowUsage, policies []domain.QuotaPolicy) []domain.TenantUsage {
+	dimensions := make(map[string]domain.QuotaDimension, len(policies))
+	for _, policy := range policies {
+		dimension := policy.Dimension
+		if dimension == "" {
+			dimension = domain.QuotaDimensionQueries
+		}
+		dimensions[policy.Name] = dimension
+	}
+
+	type tenant struct{ user, database string }
+	sums := make(map[tenant]map[string]int64) // by policy
+	for _, window := range windows {
+		if _, ok := dimensions[window.Key.Policy]; !ok {
+			continue
+		}
+		t := tenant{window.Key.User, window.Key.Database}
+		if sums[t] == nil {
+			sums[t] = make(map[string]int64)
+		}
+		sums[t][window.Key.Policy] += window.Used
+	}
+
+	tenants := make([]domain.TenantUsage, 0, len(sums))
+	for t, byPolicy := range sums {
+		usage := domain.TenantUsage{User: t.user, Database: t.database}
+		for policy, used := range byPolicy {
+			switch dimensions[policy] {
+			case domain.QuotaDimensionQueries:
+				usage.Queries = max(usage.Queries, used)
+			case domain.QuotaDimensionRows:
+				usage.Rows = max(usage.Rows, used)
+			case domain.QuotaDimensionBytes:
+				usage.Bytes = max(usage.Bytes, used)
+			case domain.QuotaDimensionSeconds:
+				usage.Seconds = max(usage.Seconds, float64(used)/float64(domain.QuotaDimensionSeconds.Scale()))
+			case domain.QuotaDimensionCost:
+				usage.Cost = max(usage.Cost, used)
+			}
+		}
+		tenants = append(tenants, usage)
+	}
+	sort.Slice(tenants, func(i, j int) bool {
+		if tenants[i].User != tenants[j].User {
+			return tenants[i].User < tenants[j].User
+		}
+		return tenants[i].Database < tenants[j].Database
+	})
+	return tenants
+}
+
+// UsageExportJob exports, every interval, the usage of the windows that rolled
+// over since the previous export; a failed export is covered by the next one.
+// A new leader exports the windows that ended within the last interval.
+// policies returns the policies in force.
+func UsageExportJob(history domain.UsageHistory, policies func() []domain.QuotaPolicy, exporter domain.UsageExporter, interval time.Duration) HousekeepingJob {
+	var from time.Time // end of the last export
+	return HousekeepingJob{
+		Name:     "usage export",
+		Interval: interval,
+		Run: func(ctx context.Context, now time.Time) error {
+			if from.IsZero() {
+				from = now.Add(-interval)
+			}
+			report, err := BuildUsageReport(ctx, history, policies(), from, now)
+			if err != nil {
+				return err
+			}
+			if err := exporter.ExportUsage(ctx, report); err != nil {
+				return err
+			}
+			from = now
+			return nil
+		},
+	}
+}
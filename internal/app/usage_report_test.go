@@ -0,0 +1,86 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reportExporter records the reports exported, failing while err is set
+type reportExporter struct {
+	reports []domain.UsageReport
+	err     error
+}
+
+func (e *reportExporter) ExportUsage(ctx context.Context, report domain.UsageReport) error {
+	if e.err != nil {
+		return e.err
+	}
+	e.reports = append(e.reports, report)
+	return nil
+}
+
+func TestBuildUsageReport(t *testing.T) {
+	ctx := context.Background()
+	day := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	window := func(policy, user string, end time.Duration, used int64) domain.WindowUsage {
+		return domain.WindowUsage{Key: domain.UsageKey{Policy: policy, User: user, Database: "app"}, End: day.Add(end), Used: used}
+	}
+	history := &usageHistory{windows: []domain.WindowUsage{
+		window("hourly", "alice", time.Hour, 40),
+		window("hourly", "alice", 2*time.Hour, 60),
+		window("daily", "alice", 24*time.Hour, 90), // counted as of its end: a window is reported whole
+		window("rows", "alice", time.Hour, 5000),
+		window("time", "alice", time.Hour, 2500),
+		window("cost", "bob", time.Hour, 300),
+		window("removed", "bob", time.Hour, 7),
+		window("hourly", "bob", 25*time.Hour, 1),
+	}}
+	policies := []domain.QuotaPolicy{
+		{Name: "hourly", Limit: 100, Window: time.Hour},
+		{Name: "daily", Dimension: domain.QuotaDimensionQueries, Limit: 1000, Window: 24 * time.Hour},
+		{Name: "rows", Dimension: domain.QuotaDimensionRows, Limit: 100000, Window: time.Hour},
+		{Name: "time", Dimension: domain.QuotaDimensionSeconds, Limit: 60, Window: time.Hour},
+		{Name: "cost", Dimension: domain.QuotaDimensionCost, Limit: 1000, Window: time.Hour},
+	}
+
+	report, err := BuildUsageReport(ctx, history, policies, day, day.Add(24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []domain.TenantUsage{
+		{User: "alice", Database: "app", Queries: 100, Rows: 5000, Seconds: 2.5},
+		{User: "bob", Database: "app", Cost: 300},
+	}, report.Tenants, "Overlapping policies should charge the largest of their sums")
+
+	_, err = BuildUsageReport(ctx, history, policies, day, day)
+	assert.Error(t, err)
+}
+
+func TestUsageExportJob(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2025, 6, 2, 0, 0, 0, 0, time.UTC)
+	history := &usageHistory{windows: []domain.WindowUsage{
+		{Key: domain.UsageKey{Policy: "hourly", User: "alice", Database: "app"}, End: now.Add(-time.Hour), Used: 10},
+	}}
+	policies := func() []domain.QuotaPolicy {
+		return []domain.QuotaPolicy{{Name: "hourly", Limit: 100, Window: time.Hour}}
+	}
+	exporter := &reportExporter{err: errors.New("disk full")}
+	job := UsageExportJob(history, policies, exporter, 24*time.Hour)
+
+	assert.Error(t, job.Run(ctx, now))
+	exporter.err = nil
+	require.NoError(t, job.Run(ctx, now.Add(24*time.Hour)))
+	require.Len(t, exporter.reports, 1)
+	assert.Equal(t, now.Add(-24*time.Hour), exporter.reports[0].From, "A failed export should be covered by the next one")
+	assert.Len(t, exporter.reports[0].Tenants, 1)
+
+	require.NoError(t, job.Run(ctx, now.Add(48*time.Hour)))
+	assert.Equal(t, now.Add(24*time.Hour), exporter.reports[1].From)
+	assert.Empty(t, exporter.reports[1].Tenants)
+}
@@ -0,0 +1,612 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2/unstable"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// Issue is a problem found in a configuration file
+type Issue struct {
+	Line    int    // 1-based; 0 when the problem has no single location
+	Column  int    // 1-based; 0 when unknown
+	Key     string // e.g. policies[1].window; empty for problems of the whole file
+	Message string
+}
+
+// String formats the issue as line:column: key: message
+func (i Issue) String() string {
+	var b strings.Builder
+	if i.Line > 0 {
+		fmt.Fprintf(&b, "%d:%d: ", i.Line, i.Column)
+	}
+	if i.Key != "" {
+		b.WriteString(i.Key + ": ")
+	}
+	b.WriteString(i.Message)
+	return b.String()
+}
+
+// nodeKind is the shape of a document node
+type nodeKind int
+
+const (
+	scalarNode nodeKind = iota
+	mappingNode
+	sequenceNode
+)
+
+// documentNode is a YAML or TOML value along with where it appears in the file
+type documentNode struct {
+	kind         nodeKind
+	line, column int
+	value        string // text of a scalar
+	quoted       bool   // whether a scalar is a string rather than a number or boolean
+	entries      []documentEntry
+	items        []*documentNode
+}
+
+// documentEntry is a key of a mapping node
+type documentEntry struct {
+	name         string
+	line, column int
+	value        *documentNode
+}
+
+// entry returns the value of the named key, if present
+func (n *documentNode) entry(name string) *documentEntry {
+	for i := range n.entries {
+		if n.entries[i].name == name {
+			return &n.entries[i]
+		}
+	}
+	return nil
+}
+
+// Check reads the configuration file at path and reports every problem it can
+// locate: syntax errors, unknown and duplicate keys, values of the wrong type and
+// invalid quota policies. When none is found, the file is loaded with the defaults
+// of flags so that the checks of Validate apply too; their issues have no line.
+// An error is returned when the file cannot be read at all.
+func Check(path string, flags *pflag.FlagSet) ([]Issue, error) {
+	format, err := fileFormat(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var root *documentNode
+	var issue *Issue
+	if format == "yaml" {
+		root, issue = parseYAML(data)
+	} else {
+		root, issue = parseTOML(data)
+	}
+	if issue != nil {
+		return []Issue{*issue}, nil
+	}
+
+	checker := &checker{}
+	checker.check(root, reflect.TypeOf(Config{}), "")
+	checker.checkPolicies(root)
+	if len(checker.issues) > 0 {
+		return checker.issues, nil
+	}
+
+	if _, err := Load(path, flags); err != nil {
+		message := strings.TrimPrefix(err.Error(), "invalid configuration: ")
+		return []Issue{{Message: message}}, nil
+	}
+	return nil, nil
+}
+
+// checker collects the issues of a document
+type checker struct {
+	issues []Issue
+}
+
+// report records an issue at the position of a node
+func (c *checker) report(line, column int, key, format string, args ...interface{}) {
+	c.issues = append(c.issues, Issue{Line: line, Column: column, Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+// check verifies that node can be decoded into a value of type t
+func (c *checker) check(node *documentNode, t reflect.Type, key string) {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		if node.kind != scalarNode {
+			c.report(node.line, node.column, key, "expected a duration such as 30s or 1h")
+		} else if !node.quoted {
+			c.report(node.line, node.column, key, "duration %s needs a unit, e.g. %ss", node.value, node.value)
+		} else if _, err := time.ParseDuration(node.value); err != nil {
+			c.report(node.line, node.column, key, "invalid duration %q: use a number and a unit such as 30s, 5m or 1h", node.value)
+		}
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.kind != mappingNode {
+			c.report(node.line, node.column, key, "expected a section of settings")
+			return
+		}
+		fields := make(map[string]reflect.Type, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			fields[t.Field(i).Tag.Get("mapstructure")] = t.Field(i).Type
+		}
+		seen := make(map[string]int)
+		for _, entry := range node.entries {
+			entryKey := joinKey(key, entry.name)
+			if first, ok := seen[entry.name]; ok {
+				c.report(entry.line, entry.column, entryKey, "duplicate key, first defined on line %d", first)
+				continue
+			}
+			seen[entry.name] = entry.line
+
+			// Settings are case insensitive, as when they are loaded
+			field, ok := fields[strings.ToLower(entry.name)]
+			if !ok {
+				c.report(entry.line, entry.column, entryKey, "unknown key%s", suggestKey(entry.name, fields))
+				continue
+			}
+			c.check(entry.value, field, entryKey)
+		}
+	case reflect.Map:
+		if node.kind != mappingNode {
+			c.report(node.line, node.column, key, "expected key: value pairs")
+			return
+		}
+		seen := make(map[string]int)
+		for _, entry := range node.entries {
+			entryKey := joinKey(key, entry.name)
+			if first, ok := seen[entry.name]; ok {
+				c.report(entry.line, entry.column, entryKey, "duplicate key, first defined on line %d", first)
+				continue
+			}
+			seen[entry.name] = entry.line
+			c.check(entry.value, t.Elem(), entryKey)
+		}
+	case reflect.Slice:
+		if node.kind == scalarNode && t.Elem().Kind() == reflect.String {
+			return // a comma separated list
+		}
+		if node.kind != sequenceNode {
+			c.report(node.line, node.column, key, "expected a list")
+			return
+		}
+		for i, item := range node.items {
+			c.check(item, t.Elem(), fmt.Sprintf("%s[%d]", key, i))
+		}
+	case reflect.String:
+		if node.kind != scalarNode {
+			c.report(node.line, node.column, key, "expected a string")
+		}
+	case reflect.Bool:
+		if _, err := strconv.ParseBool(node.value); node.kind != scalarNode || err != nil {
+			c.report(node.line, node.column, key, "expected true or false")
+		}
+	case reflect.Int, reflect.Int64:
+		if _, err := strconv.ParseInt(strings.ReplaceAll(node.value, "_", ""), 10, 64); node.kind != scalarNode || err != nil {
+			c.report(node.line, node.column, key, "expected an integer, got %q", node.value)
+		}
+	case reflect.Float64:
+		if _, err := strconv.ParseFloat(strings.ReplaceAll(node.value, "_", ""), 64); node.kind != scalarNode || err != nil {
+			c.report(node.line, node.column, key, "expected a number, got %q", node.value)
+		}
+	}
+}
+
+// checkPolicies validates each quota policy and the uniqueness of their names,
+// once their values have the right types
+func (c *checker) checkPolicies(root *documentNode) {
+	if len(c.issues) > 0 || root.entry("policies") == nil {
+		return
+	}
+
+	names := make(map[string]int)
+	for i, item := range root.entry("policies").value.items {
+		key := fmt.Sprintf("policies[%d]", i)
+		policy := domain.QuotaPolicy{}
+		if entry := item.entry("name"); entry != nil {
+			policy.Name = entry.value.value
+			if first, ok := names[policy.Name]; ok {
+				c.report(entry.line, entry.column, key+".name", "quota policy %q is already defined on line %d", policy.Name, first)
+				continue
+			}
+			names[policy.Name] = entry.line
+		}
+		if entry := item.entry("dimension"); entry != nil {
+			policy.Dimension = domain.QuotaDimension(entry.value.value)
+		}
+		if entry := item.entry("limit"); entry != nil {
+			policy.Limit, _ = strconv.ParseInt(strings.ReplaceAll(entry.value.value, "_", ""), 10, 64)
+		}
+		if entry := item.entry("window"); entry != nil {
+			policy.Window, _ = time.ParseDuration(entry.value.value)
+		}
+		if entry := item.entry("rate"); entry != nil {
+			policy.Rate, _ = strconv.ParseFloat(strings.ReplaceAll(entry.value.value, "_", ""), 64)
+		}
+		if entry := item.entry("burst"); entry != nil {
+			policy.Burst, _ = strconv.ParseInt(strings.ReplaceAll(entry.value.value, "_", ""), 10, 64)
+		}
+		if entry := item.entry("credits"); entry != nil {
+			policy.Credits, _ = strconv.ParseInt(strings.ReplaceAll(entry.value.value, "_", ""), 10, 64)
+		}
+		if entry := item.entry("credit_rate"); entry != nil {
+			policy.CreditRate, _ = strconv.ParseFloat(strings.ReplaceAll(entry.value.value, "_", ""), 64)
+		}
+		if entry := item.entry("max_connections"); entry != nil {
+			policy.MaxConnections, _ = strconv.ParseInt(strings.ReplaceAll(entry.value.value, "_", ""), 10, 64)
+		}
+		if entry := item.entry("max_concurrent_queries"); entry != nil {
+			policy.MaxConcurrentQueries, _ = strconv.ParseInt(strings.ReplaceAll(entry.value.value, "_", ""), 10, 64)
+		}
+		if entry := item.entry("queue_timeout"); entry != nil {
+			policy.QueueTimeout, _ = time.ParseDuration(entry.value.value)
+		}
+		if entry := item.entry("statement_timeout"); entry != nil {
+			policy.StatementTimeout, _ = time.ParseDuration(entry.value.value)
+		}
+		if entry := item.entry("max_result_rows"); entry != nil {
+			policy.MaxResultRows, _ = strconv.ParseInt(strings.ReplaceAll(entry.value.value, "_", ""), 10, 64)
+		}
+		if entry := item.entry("max_result_bytes"); entry != nil {
+			policy.MaxResultBytes, _ = strconv.ParseInt(strings.ReplaceAll(entry.value.value, "_", ""), 10, 64)
+		}
+		if entry := item.entry("max_transaction_duration"); entry != nil {
+			policy.MaxTransactionDuration, _ = time.ParseDuration(entry.value.value)
+		}
+		if entry := item.entry("max_transaction_statements"); entry != nil {
+			policy.MaxTransactionStatements, _ = strconv.ParseInt(strings.ReplaceAll(entry.value.value, "_", ""), 10, 64)
+		}
+		if entry := item.entry("startup_parameters"); entry != nil {
+			policy.StartupParameters = make(map[string]string)
+			for _, parameter := range entry.value.entries {
+				policy.StartupParameters[parameter.name] = parameter.value.value
+			}
+		}
+		if entry := item.entry("rate_per"); entry != nil {
+			policy.RatePer = domain.RateScope(entry.value.value)
+		}
+		if entry := item.entry("per_label"); entry != nil {
+			policy.PerLabel = entry.value.value
+		}
+		if entry := item.entry("tables"); entry != nil {
+			policy.Tables = stringList(entry.value)
+		}
+		if entry := item.entry("statements"); entry != nil {
+			for _, class := range stringList(entry.value) {
+				policy.Statements = append(policy.Statements, domain.StatementClass(class))
+			}
+		}
+		if entry := item.entry("deny"); entry != nil {
+			policy.Deny, _ = strconv.ParseBool(entry.value.value)
+		}
+		if entry := item.entry("allow_during"); entry != nil {
+			policy.AllowDuring = stringList(entry.value)
+		}
+		if entry := item.entry("active_during"); entry != nil {
+			policy.ActiveDuring = stringList(entry.value)
+		}
+		if entry := item.entry("fingerprints"); entry != nil {
+			policy.Fingerprints = stringList(entry.value)
+		}
+		if entry := item.entry("patterns"); entry != nil {
+			policy.Patterns = stringList(entry.value)
+		}
+		if entry := item.entry("allow"); entry != nil {
+			policy.Allow, _ = strconv.ParseBool(entry.value.value)
+		}
+
+		if err := policy.Validate(); err != nil {
+			line, column := item.line, item.column
+			if entry := item.entry(invalidPolicyField(policy)); entry != nil {
+				line, column = entry.line, entry.column
+			}
+			c.report(line, column, key, "%s", err)
+		}
+	}
+}
+
+// invalidPolicyField returns the key of the field QuotaPolicy.Validate rejects
+func invalidPolicyField(policy domain.QuotaPolicy) string {
+	switch {
+	case policy.Name == "":
+		return "name"
+	case slices.ContainsFunc(policy.Tables, func(pattern string) bool { return !domain.ValidTablePattern(pattern) }):
+		return "tables"
+	case slices.ContainsFunc(policy.Statements, func(class domain.StatementClass) bool { return !class.Valid() }):
+		return "statements"
+	case slices.ContainsFunc(policy.Fingerprints, func(hash string) bool { return !domain.ValidFingerprint(hash) }):
+		return "fingerprints"
+	case slices.ContainsFunc(policy.Patterns, func(pattern string) bool {
+		_, err := regexp.Compile(pattern)
+		return err != nil
+	}):
+		return "patterns"
+	case slices.ContainsFunc(policy.AllowDuring, func(window string) bool {
+		_, err := domain.ParseRecurringWindow(window)
+		return err != nil
+	}):
+		return "allow_during"
+	case slices.ContainsFunc(policy.ActiveDuring, func(window string) bool {
+		_, err := domain.ParseRecurringWindow(window)
+		return err != nil
+	}):
+		return "active_during"
+	case len(policy.AllowDuring) > 0 && !policy.Deny:
+		return "allow_during"
+	case policy.PerLabel != "" && !policy.Windowed():
+		return "per_label"
+	case len(policy.StartupParameters) > 0 && (policy.Deny || policy.Allow || policy.Scoped() || policy.Fingerprinted() ||
+		domain.QuotaPolicy{Name: policy.Name, StartupParameters: policy.StartupParameters}.Validate() != nil):
+		return "startup_parameters"
+	case policy.Allow:
+		return "allow"
+	case policy.Deny:
+		return "deny"
+	case policy.MaxConnections > 0 && (policy.Scoped() || policy.Fingerprinted()):
+		return "max_connections"
+	case policy.Rate < 0:
+		return "rate"
+	case policy.Burst < 0 || (policy.Burst > 0 && policy.Rate == 0):
+		return "burst"
+	case policy.Credits < 0 || (policy.Credits > 0 && (policy.Rate == 0 || policy.RatePer == domain.RateScopeConnection)):
+		return "credits"
+	case policy.CreditRate < 0 || (policy.CreditRate > 0 && policy.Credits == 0):
+		return "credit_rate"
+	case policy.MaxConnections < 0:
+		return "max_connections"
+	case policy.MaxConcurrentQueries < 0:
+		return "max_concurrent_queries"
+	case policy.QueueTimeout < 0 || (policy.QueueTimeout > 0 && policy.MaxConcurrentQueries == 0):
+		return "queue_timeout"
+	case policy.StatementTimeout < 0:
+		return "statement_timeout"
+	case policy.MaxResultRows < 0:
+		return "max_result_rows"
+	case policy.MaxResultBytes < 0:
+		return "max_result_bytes"
+	case policy.MaxTransactionDuration < 0:
+		return "max_transaction_duration"
+	case policy.MaxTransactionStatements < 0:
+		return "max_transaction_statements"
+	case policy.RatePer != "" && policy.RatePer != domain.RateScopeUser && policy.RatePer != domain.RateScopeConnection:
+		return "rate_per"
+	case policy.Limit <= 0 && (policy.Windowed() || (!policy.RateLimited() && policy.MaxConnections == 0 && policy.MaxConcurrentQueries == 0 && policy.StatementTimeout == 0 && !policy.ResultCapped() && !policy.TransactionLimited() && len(policy.StartupParameters) == 0)):
+		return "limit"
+	case policy.Window <= 0 && (policy.Windowed() || (!policy.RateLimited() && policy.MaxConnections == 0 && policy.MaxConcurrentQueries == 0 && policy.StatementTimeout == 0 && !policy.ResultCapped() && !policy.TransactionLimited() && len(policy.StartupParameters) == 0)):
+		return "window"
+	default:
+		return "dimension"
+	}
+}
+
+// stringList returns the items of a list of strings, or of a comma separated list
+func stringList(node *documentNode) []string {
+	if node.kind == scalarNode {
+		return strings.Split(node.value, ",")
+	}
+	var values []string
+	for _, item := range node.items {
+		values = append(values, item.value)
+	}
+	return values
+}
+
+// joinKey appends name to the dotted key of its parent
+func joinKey(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+// suggestKey returns a hint naming the known key closest to name, if any is close
+func suggestKey(name string, known map[string]reflect.Type) string {
+	best, bestDistance := "", 3
+	for candidate := range known {
+		if distance := editDistance(name, candidate); distance < bestDistance || (distance == bestDistance && candidate < best) {
+			best, bestDistance = candidate, distance
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %q?", best)
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+// yamlErrorLine extracts the line from the errors of the YAML parser
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// parseYAML converts a YAML document into document nodes
+func parseYAML(data []byte) (*documentNode, *Issue) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		if match := yamlErrorLine.FindStringSubmatch(err.Error()); match != nil {
+			line, _ := strconv.Atoi(match[1])
+			return nil, &Issue{Line: line, Column: 1, Message: match[2]}
+		}
+		return nil, &Issue{Message: strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+	if len(document.Content) == 0 {
+		return &documentNode{kind: mappingNode, line: 1, column: 1}, nil
+	}
+	return fromYAML(document.Content[0]), nil
+}
+
+// fromYAML converts a YAML node
+func fromYAML(node *yaml.Node) *documentNode {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	converted := &documentNode{line: node.Line, column: node.Column}
+	switch node.Kind {
+	case yaml.MappingNode:
+		converted.kind = mappingNode
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			converted.entries = append(converted.entries, documentEntry{
+				name:   key.Value,
+				line:   key.Line,
+				column: key.Column,
+				value:  fromYAML(node.Content[i+1]),
+			})
+		}
+	case yaml.SequenceNode:
+		converted.kind = sequenceNode
+		for _, item := range node.Content {
+			converted.items = append(converted.items, fromYAML(item))
+		}
+	default:
+		converted.kind = scalarNode
+		converted.value = node.Value
+		converted.quoted = node.ShortTag() == "!!str"
+	}
+	return converted
+}
+
+// parseTOML converts a TOML document into document nodes
+func parseTOML(data []byte) (*documentNode, *Issue) {
+	parser := &unstable.Parser{}
+	parser.Reset(data)
+
+	root := &documentNode{kind: mappingNode, line: 1, column: 1}
+	current := root
+	for parser.NextExpression() {
+		expression := parser.Expression()
+		switch expression.Kind {
+		case unstable.Table, unstable.ArrayTable:
+			parent, name, shape := root, "", unstable.Shape{}
+			keys := expression.Key()
+			for keys.Next() {
+				if name != "" {
+					parent = tomlTable(parent, name, shape)
+				}
+				name, shape = string(keys.Node().Data), parser.Shape(keys.Node().Raw)
+			}
+			if expression.Kind == unstable.Table {
+				current = tomlTable(parent, name, shape)
+				break
+			}
+			entry := parent.entry(name)
+			if entry == nil {
+				parent.entries = append(parent.entries, documentEntry{
+					name: name, line: shape.Start.Line, column: shape.Start.Column,
+					value: &documentNode{kind: sequenceNode, line: shape.Start.Line, column: shape.Start.Column},
+				})
+				entry = &parent.entries[len(parent.entries)-1]
+			}
+			current = &documentNode{kind: mappingNode, line: shape.Start.Line, column: shape.Start.Column}
+			entry.value.items = append(entry.value.items, current)
+		case unstable.KeyValue:
+			tomlKeyValue(parser, current, expression)
+		}
+	}
+
+	if err := parser.Error(); err != nil {
+		var parserErr *unstable.ParserError
+		if errors.As(err, &parserErr) && len(parserErr.Highlight) > 0 {
+			shape := parser.Shape(parser.Range(parserErr.Highlight))
+			return nil, &Issue{Line: shape.Start.Line, Column: shape.Start.Column, Message: parserErr.Message}
+		}
+		return nil, &Issue{Message: err.Error()}
+	}
+	return root, nil
+}
+
+// tomlTable returns the table named name in parent, creating it at shape if needed.
+// A name bound to an array of tables refers to its last table.
+func tomlTable(parent *documentNode, name string, shape unstable.Shape) *documentNode {
+	if entry := parent.entry(name); entry != nil {
+		if entry.value.kind == sequenceNode && len(entry.value.items) > 0 {
+			return entry.value.items[len(entry.value.items)-1]
+		}
+		return entry.value
+	}
+	table := &documentNode{kind: mappingNode, line: shape.Start.Line, column: shape.Start.Column}
+	parent.entries = append(parent.entries, documentEntry{name: name, line: shape.Start.Line, column: shape.Start.Column, value: table})
+	return table
+}
+
+// tomlKeyValue adds a possibly dotted key and its value to table. Duplicate keys
+// are kept so that they can be reported.
+func tomlKeyValue(parser *unstable.Parser, table *documentNode, expression *unstable.Node) {
+	var names []string
+	var shape unstable.Shape
+	keys := expression.Key()
+	for keys.Next() {
+		names = append(names, string(keys.Node().Data))
+		shape = parser.Shape(keys.Node().Raw)
+	}
+	for _, name := range names[:len(names)-1] {
+		table = tomlTable(table, name, shape)
+	}
+
+	table.entries = append(table.entries, documentEntry{
+		name:   names[len(names)-1],
+		line:   shape.Start.Line,
+		column: shape.Start.Column,
+		value:  fromTOML(parser, expression.Value(), shape),
+	})
+}
+
+// fromTOML converts a TOML value, located at the key it is bound to
+func fromTOML(parser *unstable.Parser, value *unstable.Node, shape unstable.Shape) *documentNode {
+	converted := &documentNode{line: shape.Start.Line, column: shape.Start.Column}
+	switch value.Kind {
+	case unstable.Array:
+		converted.kind = sequenceNode
+		items := value.Children()
+		for items.Next() {
+			converted.items = append(converted.items, fromTOML(parser, items.Node(), shape))
+		}
+	case unstable.InlineTable:
+		converted.kind = mappingNode
+		entries := value.Children()
+		for entries.Next() {
+			tomlKeyValue(parser, converted, entries.Node())
+		}
+	default:
+		converted.kind = scalarNode
+		converted.value = string(value.Data)
+		converted.quoted = value.Kind == unstable.String
+	}
+	return converted
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck_Valid(t *testing.T) {
+	for name, content := range map[string]string{
+		"enforcer.yaml": "server:\n  address: \":6432\"\npolicies:\n  - name: default\n    limit: 10\n    window: 1h\n",
+		"enforcer.toml": "[server]\naddress = \":6432\"\n\n[[policies]]\nname = \"default\"\nlimit = 10\nwindow = \"1h\"\nlabels = { team = \"billing\" }\n",
+	} {
+		issues, err := Check(writeConfig(t, name, content), testFlags())
+		require.NoError(t, err)
+		assert.Empty(t, issues, name)
+	}
+}
+
+func TestCheck_YAML(t *testing.T) {
+	path := writeConfig(t, "enforcer.yaml", `server:
+  adress: ":6432"
+  max_idle_connections: many
+timeouts:
+  read: 30
+  read: 1m
+policies:
+  - name: default
+    limit: 10
+    window: 1hr
+`)
+
+	issues, err := Check(path, testFlags())
+	require.NoError(t, err)
+	assert.Equal(t, []Issue{
+		{Line: 2, Column: 3, Key: "server.adress", Message: `unknown key, did you mean "address"?`},
+		{Line: 3, Column: 25, Key: "server.max_idle_connections", Message: `expected an integer, got "many"`},
+		{Line: 5, Column: 9, Key: "timeouts.read", Message: "duration 30 needs a unit, e.g. 30s"},
+		{Line: 6, Column: 3, Key: "timeouts.read", Message: "duplicate key, first defined on line 5"},
+		{Line: 10, Column: 13, Key: "policies[0].window", Message: `invalid duration "1hr": use a number and a unit such as 30s, 5m or 1h`},
+	}, issues)
+}
+
+func TestCheck_Policies(t *testing.T) {
+	path := writeConfig(t, "enforcer.toml", `[[policies]]
+name = "default"
+limit = 10
+window = "1h"
+
+[[policies]]
+name = "metered"
+dimension = "rows"
+limit = 0
+window = "1h"
+
+[[policies]]
+name = "default"
+limit = 1
+window = "1m"
+
+[[policies]]
+name = "smoothing"
+rate = 2.5
+
+[[policies]]
+name = "batch"
+rate = 10
+rate_per = "database"
+
+[[policies]]
+name = "audit"
+tables = ["audit.*"]
+statements = ["truncate"]
+deny = true
+
+[[policies]]
+name = "ddl"
+statements = ["ddl"]
+allow_during = ["Sat 02:00-04:00", "Sun 25:00-26:00"]
+deny = true
+
+[[policies]]
+name = "reads"
+tables = "analytics.events"
+deny = true
+limit = 5
+window = "1h"
+
+[[policies]]
+name = "full-scans"
+patterns = ["(?i)^select \\* from huge_table$", "(unclosed"]
+deny = true
+
+[[policies]]
+name = "reports"
+fingerprints = ["a0b1c2d3e4f5a6b7"]
+allow = true
+rate = 5
+
+[[policies]]
+name = "runaway"
+statement_timeout = "-5s"
+
+[[policies]]
+name = "tagged"
+startup_parameters = { user = "admin" }
+`)
+
+	issues, err := Check(path, testFlags())
+	require.NoError(t, err)
+	assert.Equal(t, []Issue{
+		{Line: 9, Column: 1, Key: "policies[1]", Message: `quota policy "metered": limit must be positive`},
+		{Line: 13, Column: 1, Key: "policies[2].name", Message: `quota policy "default" is already defined on line 2`},
+		{Line: 24, Column: 1, Key: "policies[4]", Message: `quota policy "batch": unknown rate scope "database": use user or connection`},
+		{Line: 29, Column: 1, Key: "policies[5]", Message: `quota policy "audit": unknown statement class "truncate": use read, write, select, insert, update, delete or ddl`},
+		{Line: 35, Column: 1, Key: "policies[6]", Message: `quota policy "ddl": invalid window "Sun 25:00-26:00": invalid time "25:00": use HH:MM`},
+		{Line: 41, Column: 1, Key: "policies[7]", Message: `quota policy "reads": a deny policy cannot have a limit, a rate, a connection or concurrency cap, a statement timeout, a result cap or a transaction limit`},
+		{Line: 47, Column: 1, Key: "policies[8]", Message: "quota policy \"full-scans\": invalid pattern \"(unclosed\": error parsing regexp: missing closing ): `(unclosed`"},
+		{Line: 53, Column: 1, Key: "policies[9]", Message: `quota policy "reports": an allow policy cannot deny queries or have a limit, a rate, a connection or concurrency cap, a statement timeout, a result cap or a transaction limit`},
+		{Line: 58, Column: 1, Key: "policies[10]", Message: `quota policy "runaway": statement timeout must not be negative`},
+		{Line: 62, Column: 1, Key: "policies[11]", Message: `quota policy "tagged": startup parameter "user" cannot be set`},
+	}, issues)
+}
+
+func TestCheck_Syntax(t *testing.T) {
+	issues, err := Check(writeConfig(t, "enforcer.yaml", "server:\n  address: [\n"), testFlags())
+	require.NoError(t, err)
+	require.Len(t, issues, 1)
+	assert.NotZero(t, issues[0].Line)
+
+	issues, err = Check(writeConfig(t, "enforcer.toml", "[server]\naddress = \n"), testFlags())
+	require.NoError(t, err)
+	require.Len(t, issues, 1)
+	assert.Equal(t, 2, issues[0].Line)
+}
+
+func TestCheck_CrossFieldSettings(t *testing.T) {
+	issues, err := Check(writeConfig(t, "enforcer.yaml", "tls:\n  key_file: server.key\n"), testFlags())
+	require.NoError(t, err)
+	assert.Equal(t, []Issue{{Message: "TLS needs both a certificate and a key"}}, issues)
+}
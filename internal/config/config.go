@@ -0,0 +1,1372 @@
+// Package config loads the server settings from a YAML or TOML file, command-line
+// flags and environment variables. Environment variables take precedence over
+// the flags bound to the loader, which take precedence over the file, which
+// takes precedence over the flag defaults.
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Config is the typed server configuration:
+//
+//	server:
+//	  address: ":5432"
+//	  max_idle_connections: 10
+//	  query_cache_size: 10000
+//	upstream:
+//	  address: pgbouncer.internal:6432
+//	  reconnect: true
+//	  tls:
+//	    mode: verify-full
+//	    ca_file: /etc/enforcer/upstream-ca.crt
+//	  failover:
+//	    address: standby-pgbouncer.internal:6432
+//	    check_url: postgres://health@/postgres
+//	    threshold: 3
+//	    cooldown: 1m
+//	listeners:
+//	  - name: analytics
+//	    address: ":5433"
+//	    upstream: analytics-pgbouncer.internal:6432
+//	    allow: [10.20.0.0/16]
+//	access:
+//	  deny: [203.0.113.0/24]
+//	  users:
+//	    - user: etl
+//	      allow: [10.30.0.0/16]
+//	databases:
+//	  - name: reporting
+//	    upstream: replica-pgbouncer.internal:6432
+//	    database: analytics_ro
+//	pool:
+//	  mode: transaction
+//	  size: 20
+//	  sizes:
+//	    - user: etl
+//	      size: 5
+//	timeouts:
+//	  read: 30s
+//	  upstream: 10s
+//	logging:
+//	  level: info
+//	admin:
+//	  address: 127.0.0.1:8080
+//	  token: change-me
+//	health:
+//	  address: :8081
+//	audit:
+//	  file: /var/log/enforcer/audit.jsonl
+//	  max_size_mb: 100
+//	  max_age: 24h
+//	kafka:
+//	  brokers: [kafka-1.internal:9092, kafka-2.internal:9092]
+//	  topic: query-events
+//	  key: user
+//	  tls:
+//	    enabled: true
+//	  sasl:
+//	    mechanism: SCRAM-SHA-512
+//	    username: enforcer
+//	    password: change-me
+//	quota_alerts:
+//	  thresholds: [80, 100]
+//	pgbouncer:
+//	  admin_url: postgres://stats@pgbouncer.internal:6432/pgbouncer
+//	  poll_interval: 10s
+//	query_stats:
+//	  max: 5000
+//	  flush_interval: 1m
+//	webhooks:
+//	  - url: https://alerts.internal/enforcer
+//	    secret: change-me
+//	    events: [quota_threshold, quota_blocked]
+//	parameter_labels:
+//	  max_size: 64
+//	  labels:
+//	    - label: tenant_id
+//	      position: 1
+//	      fingerprints: [50fde20626009aba]
+//	query_logs:
+//	  - type: stdout
+//	  - type: events
+//	    decisions: [deny]
+//	usage_store:
+//	  dsn: postgres://enforcer@quota-db.internal/enforcer # or file: /var/lib/enforcer/quota.db
+//	  async: true
+//	  staleness: 1s
+//	etcd:
+//	  endpoints: [etcd-0.internal:2379, etcd-1.internal:2379]
+//	  prefix: /quota-enforcer/
+//	housekeeping:
+//	  election: kubernetes # or redis, with redis: redis://quota-redis.internal:6379/0
+//	  report_interval: 1h
+//	  retention: 168h
+//	  export_dir: /var/lib/enforcer/usage
+//	  export_format: parquet
+//	policies:
+//	  - name: default
+//	    user: alice
+//	    limit: 1000
+//	    window: 1h
+//	  - name: analytics
+//	    listener: analytics
+//	    limit: 100
+//	    window: 1h
+type Config struct {
+	Server       ServerSettings       `mapstructure:"server"`
+	Upstream     UpstreamSettings     `mapstructure:"upstream"`
+	Listeners    []ListenerSettings   `mapstructure:"listeners"`
+	Access       AccessSettings       `mapstructure:"access"`
+	Databases    []DatabaseSettings   `mapstructure:"databases"`
+	Pool         PoolSettings         `mapstructure:"pool"`
+	Timeouts     TimeoutSettings      `mapstructure:"timeouts"`
+	Logging      LoggingSettings      `mapstructure:"logging"`
+	Maintenance  MaintenanceSettings  `mapstructure:"maintenance"`
+	Burst        BurstSettings        `mapstructure:"burst"`
+	DenialAlerts DenialAlertSettings  `mapstructure:"denial_alerts"`
+	RateAlerts   RateAlertSettings    `mapstructure:"rate_alerts"`
+	Firewall     FirewallSettings     `mapstructure:"firewall"`
+	UsageWeights UsageWeightSettings  `mapstructure:"usage_weights"`
+	UsageStore   UsageStoreSettings   `mapstructure:"usage_store"`
+	Etcd         EtcdSettings         `mapstructure:"etcd"`
+	Housekeeping HousekeepingSettings `mapstructure:"housekeeping"`
+	TLS          TLSSettings          `mapstructure:"tls"`
+	Auth         AuthSettings         `mapstructure:"auth"`
+	Admin        AdminSettings        `mapstructure:"admin"`
+	Health       HealthSettings       `mapstructure:"health"`
+	Audit        AuditSettings        `mapstructure:"audit"`
+	SlowQueries  SlowQuerySettings    `mapstructure:"slow_queries"`
+	Scripts      ScriptSettings       `mapstructure:"scripts"`
+	Rewrite      RewriteSettings      `mapstructure:"rewrite"`
+	Kafka        KafkaSettings        `mapstructure:"kafka"`
+	QuotaAlerts  QuotaAlertSettings   `mapstructure:"quota_alerts"`
+	PgBouncer    PgBouncerSettings    `mapstructure:"pgbouncer"`
+	QueryStats   QueryStatsSettings   `mapstructure:"query_stats"`
+	Webhooks     []WebhookSettings    `mapstructure:"webhooks"`
+	QueryLogs    []QueryLogSettings   `mapstructure:"query_logs"`
+	ParamLabels  ParamLabelSettings   `mapstructure:"parameter_labels"`
+	Roles        []RoleSettings       `mapstructure:"roles"`
+	Identity     IdentitySettings     `mapstructure:"identity"`
+	Policies     []PolicySettings     `mapstructure:"policies"`
+	Faults       string               `mapstructure:"faults"` // injected in binaries built with the chaos tag
+}
+
+// ServerSettings configures the listener
+type ServerSettings struct {
+	Address               string `mapstructure:"address"`
+	InstanceID            string `mapstructure:"instance_id"`
+	CaptureFile           string `mapstructure:"capture_file"`
+	CaptureParameters     bool   `mapstructure:"capture_parameters"`
+	QuotaFunctions        bool   `mapstructure:"quota_functions"`
+	GSSEncryptionTunnel   bool   `mapstructure:"gss_encryption_tunnel"`
+	MaxIdleConnections    int    `mapstructure:"max_idle_connections"`
+	SocketActivation      bool   `mapstructure:"socket_activation"`
+	Normalizer            string `mapstructure:"normalizer"`
+	QueryCacheSize        int    `mapstructure:"query_cache_size"`
+	StatementCacheSize    int    `mapstructure:"statement_cache_size"`
+	MaxMessageSizeMB      int    `mapstructure:"max_message_size_mb"`
+	MaxConnectionBufferMB int    `mapstructure:"max_connection_buffer_mb"`
+}
+
+// ListenerSettings configures an additional listener and the upstream of its connections
+type ListenerSettings struct {
+	Name     string `mapstructure:"name"`
+	Address  string `mapstructure:"address"`
+	Upstream string `mapstructure:"upstream"`
+
+	Allow []string `mapstructure:"allow"` // CIDR ranges clients may connect from; empty allows any
+	Deny  []string `mapstructure:"deny"`  // CIDR ranges clients may not connect from
+}
+
+// AccessSettings restricts the addresses the clients of the default listener,
+// and those of some users, may connect from
+type AccessSettings struct {
+	Allow []string             `mapstructure:"allow"`
+	Deny  []string             `mapstructure:"deny"`
+	Users []UserAccessSettings `mapstructure:"users"`
+}
+
+// UserAccessSettings restricts the addresses a user may log in from
+type UserAccessSettings struct {
+	User  string   `mapstructure:"user"`
+	Allow []string `mapstructure:"allow"`
+	Deny  []string `mapstructure:"deny"`
+}
+
+// DatabaseSettings routes the connections to a database to an upstream of its
+// own, or to another database upstream
+type DatabaseSettings struct {
+	Name     string `mapstructure:"name"`
+	Upstream string `mapstructure:"upstream"`
+	Database string `mapstructure:"database"`
+}
+
+// PoolSettings configures the pooling of upstream connections
+type PoolSettings struct {
+	Mode        string             `mapstructure:"mode"` // session or transaction; empty opens an upstream connection per client
+	Size        int                `mapstructure:"size"`
+	Sizes       []PoolSizeSettings `mapstructure:"sizes"`
+	WaitTimeout time.Duration      `mapstructure:"wait_timeout"`
+}
+
+// PoolSizeSettings overrides the pool size of a user and database
+type PoolSizeSettings struct {
+	User     string `mapstructure:"user"`
+	Database string `mapstructure:"database"`
+	Size     int    `mapstructure:"size"`
+}
+
+// UpstreamSettings locates the upstream servers
+type UpstreamSettings struct {
+	Address    string              `mapstructure:"address"`
+	MinRefresh time.Duration       `mapstructure:"min_refresh"`
+	MaxRefresh time.Duration       `mapstructure:"max_refresh"`
+	TLS        UpstreamTLSSettings `mapstructure:"tls"`
+	Failover   FailoverSettings    `mapstructure:"failover"`
+	Reconnect  bool                `mapstructure:"reconnect"` // replace lost upstream connections outside transactions
+}
+
+// UpstreamTLSSettings configures TLS on the connections to the upstream
+type UpstreamTLSSettings struct {
+	Mode       string `mapstructure:"mode"` // disable, require, verify-ca or verify-full
+	ServerName string `mapstructure:"server_name"`
+	CAFile     string `mapstructure:"ca_file"`
+	CertFile   string `mapstructure:"cert_file"`
+	KeyFile    string `mapstructure:"key_file"`
+}
+
+// FailoverSettings configures the health checks of the upstream and the
+// secondary upstream new connections fail over to
+type FailoverSettings struct {
+	Address   string        `mapstructure:"address"`   // empty disables failover
+	CheckURL  string        `mapstructure:"check_url"` // empty checks TCP connections only
+	Interval  time.Duration `mapstructure:"interval"`
+	Timeout   time.Duration `mapstructure:"timeout"`
+	Threshold int           `mapstructure:"threshold"`
+	Cooldown  time.Duration `mapstructure:"cooldown"`
+}
+
+// TimeoutSettings bounds client reads, idle clients, upstream connections and shutdown
+type TimeoutSettings struct {
+	Read            time.Duration `mapstructure:"read"`
+	Idle            time.Duration `mapstructure:"idle"`
+	IdleTransaction time.Duration `mapstructure:"idle_transaction"`
+	Upstream        time.Duration `mapstructure:"upstream"`
+	Shutdown        time.Duration `mapstructure:"shutdown"`
+}
+
+// LoggingSettings configures the server log
+type LoggingSettings struct {
+	Level string `mapstructure:"level"` // debug, info or error
+
+	// ParameterFingerprints are the query hashes whose literals and bound
+	// parameters may be logged; "*" allows every query
+	ParameterFingerprints []string `mapstructure:"parameter_fingerprints"`
+}
+
+// MaintenanceSettings is the window applied when maintenance is toggled at runtime
+type MaintenanceSettings struct {
+	Message string        `mapstructure:"message"`
+	Queue   time.Duration `mapstructure:"queue"`
+}
+
+// BurstSettings configures N+1 detection
+type BurstSettings struct {
+	Threshold int           `mapstructure:"threshold"`
+	Interval  time.Duration `mapstructure:"interval"`
+	Limit     int           `mapstructure:"limit"`
+}
+
+// DenialAlertSettings configures denial rate alerts
+type DenialAlertSettings struct {
+	Percent    float64       `mapstructure:"percent"`
+	Window     time.Duration `mapstructure:"window"`
+	MinQueries int           `mapstructure:"min_queries"`
+}
+
+// RateAlertSettings configures alerts on query rates straying from their baseline
+type RateAlertSettings struct {
+	Factor       float64       `mapstructure:"factor"`
+	Interval     time.Duration `mapstructure:"interval"`
+	Warmup       int           `mapstructure:"warmup"`
+	MinRate      float64       `mapstructure:"min_rate"`
+	Fingerprints bool          `mapstructure:"fingerprints"`
+	Notices      bool          `mapstructure:"notices"`
+}
+
+// FirewallSettings configures the SQL firewall
+type FirewallSettings struct {
+	Mode           string        `mapstructure:"mode"`
+	LearningPeriod time.Duration `mapstructure:"learning_period"`
+	Action         string        `mapstructure:"action"`
+	Users          []string      `mapstructure:"users"`
+	ProfileFile    string        `mapstructure:"profile_file"`
+}
+
+// UsageWeightSettings sets the quota consumed per kind of query
+type UsageWeightSettings struct {
+	Simple  int64 `mapstructure:"simple"`
+	Parse   int64 `mapstructure:"parse"`
+	Execute int64 `mapstructure:"execute"`
+}
+
+// UsageStoreSettings selects where usage counters are kept
+type UsageStoreSettings struct {
+	DSN                string        `mapstructure:"dsn"`           // PostgreSQL connection string; empty keeps usage in memory
+	File               string        `mapstructure:"file"`          // SQLite database file, instead of a DSN
+	Redis              string        `mapstructure:"redis"`         // Redis URL, instead of a DSN
+	Consistency        string        `mapstructure:"consistency"`   // strict or eventual, the default
+	MaxOvershoot       int64         `mapstructure:"max_overshoot"` // usage of a counter an enforcer holds back at most
+	FlushInterval      time.Duration `mapstructure:"flush_interval"`
+	CheckpointInterval time.Duration `mapstructure:"checkpoint_interval"` // of the SQLite write-ahead log
+	Async              bool          `mapstructure:"async"`               // records usage in the background
+	Staleness          time.Duration `mapstructure:"staleness"`
+	Workers            int           `mapstructure:"workers"`
+	QueueSize          int           `mapstructure:"queue_size"`
+}
+
+// EtcdSettings selects the etcd cluster quota policies and roles are read and
+// watched from, alongside those of the configuration
+type EtcdSettings struct {
+	Endpoints []string      `mapstructure:"endpoints"` // empty disables etcd
+	Prefix    string        `mapstructure:"prefix"`
+	LeaseTTL  time.Duration `mapstructure:"lease_ttl"` // of the registration of the instance
+}
+
+// HousekeepingSettings elects the replica of a cluster that reports, exports and
+// compacts the usage of elapsed windows
+type HousekeepingSettings struct {
+	Election       string        `mapstructure:"election"`  // redis or kubernetes; empty disables housekeeping
+	Redis          string        `mapstructure:"redis"`     // URL of the lock; defaults to that of the usage store
+	Namespace      string        `mapstructure:"namespace"` // of the Lease; defaults to that of the pod
+	Lock           string        `mapstructure:"lock"`      // name of the Redis key or Lease
+	TTL            time.Duration `mapstructure:"ttl"`       // of the leadership, renewed every third of it
+	ReportInterval time.Duration `mapstructure:"report_interval"`
+	Retention      time.Duration `mapstructure:"retention"`     // of the counters of elapsed windows
+	ExportDir      string        `mapstructure:"export_dir"`    // receives a usage report file every report interval
+	ExportFormat   string        `mapstructure:"export_format"` // csv, json or parquet
+}
+
+// TLSSettings configures TLS termination of client connections
+type TLSSettings struct {
+	CertFile     string   `mapstructure:"cert_file"`
+	KeyFile      string   `mapstructure:"key_file"`
+	CAFile       string   `mapstructure:"ca_file"`
+	RequireUsers []string `mapstructure:"require_users"` // "*" requires TLS from every user
+}
+
+// AuthSettings configures local authentication of clients
+type AuthSettings struct {
+	File             string      `mapstructure:"file"` // PgBouncer auth_file; empty relays authentication upstream
+	UpstreamUser     string      `mapstructure:"upstream_user"`
+	UpstreamPassword string      `mapstructure:"upstream_password"`
+	JWT              JWTSettings `mapstructure:"jwt"`
+}
+
+// JWTSettings configures the JSON Web Tokens clients present to be attributed to a tenant
+type JWTSettings struct {
+	Parameter     string            `mapstructure:"parameter"` // startup parameter carrying the token; empty takes the password
+	Secret        string            `mapstructure:"secret"`    // verifies HS256, HS384 and HS512 tokens
+	PublicKeyFile string            `mapstructure:"public_key_file"`
+	Issuer        string            `mapstructure:"issuer"`
+	Audience      string            `mapstructure:"audience"`
+	Leeway        time.Duration     `mapstructure:"leeway"`
+	UserClaim     string            `mapstructure:"user_claim"`   // claim quotas are attributed to instead of the user name
+	LabelClaims   map[string]string `mapstructure:"label_claims"` // connection labels set from claims, by claim name
+}
+
+// AdminSettings configures the admin HTTP API
+type AdminSettings struct {
+	Address string `mapstructure:"address"` // empty disables the API
+	Token   string `mapstructure:"token"`   // bearer token required on every request
+}
+
+// HealthSettings configures the liveness and readiness probes
+type HealthSettings struct {
+	Address string `mapstructure:"address"` // empty disables the probes
+}
+
+// AuditSettings configures the audit log of evaluated queries
+type AuditSettings struct {
+	File       string        `mapstructure:"file"` // empty disables the audit log
+	MaxSizeMB  int64         `mapstructure:"max_size_mb"`
+	MaxAge     time.Duration `mapstructure:"max_age"`
+	MaxBackups int           `mapstructure:"max_backups"`
+	Compress   bool          `mapstructure:"compress"`
+}
+
+// SlowQuerySettings configures the slow query log
+type SlowQuerySettings struct {
+	File             string        `mapstructure:"file"` // empty disables the slow query log
+	Threshold        time.Duration `mapstructure:"threshold"`
+	SampleRate       float64       `mapstructure:"sample_rate"`
+	MaxPerSecond     int           `mapstructure:"max_per_second"`
+	RedactParameters bool          `mapstructure:"redact_parameters"`
+}
+
+// ScriptSettings configures the Lua scripts run on every query
+type ScriptSettings struct {
+	Files   []string      `mapstructure:"files"` // empty runs no script
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// ParamLabelSettings configures the labels taken from the values bound to
+// prepared statements
+type ParamLabelSettings struct {
+	MaxSize int                   `mapstructure:"max_size"` // 0 uses the default
+	Labels  []ParameterLabelEntry `mapstructure:"labels"`
+}
+
+// ParameterLabelEntry names the parameter a label is taken from
+type ParameterLabelEntry struct {
+	Label        string   `mapstructure:"label"`
+	Position     int      `mapstructure:"position"`     // 1 for $1
+	Fingerprints []string `mapstructure:"fingerprints"` // empty takes it from every statement
+}
+
+// RewriteSettings configures the rewriting of queries
+type RewriteSettings struct {
+	RowLimit      int64                `mapstructure:"row_limit"` // 0 appends no LIMIT
+	TraceComments bool                 `mapstructure:"trace_comments"`
+	TenantFilter  TenantFilterSettings `mapstructure:"tenant_filter"`
+}
+
+// TenantFilterSettings configures the filtering of tables by tenant
+type TenantFilterSettings struct {
+	Column string   `mapstructure:"column"` // empty filters no table
+	Value  string   `mapstructure:"value"`
+	Tables []string `mapstructure:"tables"`
+}
+
+// KafkaSettings configures the publishing of query events to Kafka
+type KafkaSettings struct {
+	Brokers   []string          `mapstructure:"brokers"` // empty disables publishing
+	Topic     string            `mapstructure:"topic"`
+	Key       string            `mapstructure:"key"` // user or query_hash
+	BatchSize int               `mapstructure:"batch_size"`
+	Linger    time.Duration     `mapstructure:"linger"`
+	TLS       KafkaTLSSettings  `mapstructure:"tls"`
+	SASL      KafkaSASLSettings `mapstructure:"sasl"`
+}
+
+// KafkaTLSSettings configures TLS on the connections to the brokers
+type KafkaTLSSettings struct {
+	Enabled    bool   `mapstructure:"enabled"`
+	ServerName string `mapstructure:"server_name"`
+	CAFile     string `mapstructure:"ca_file"`
+	CertFile   string `mapstructure:"cert_file"`
+	KeyFile    string `mapstructure:"key_file"`
+}
+
+// KafkaSASLSettings configures the SASL authentication to the brokers
+type KafkaSASLSettings struct {
+	Mechanism string `mapstructure:"mechanism"` // PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512; empty disables SASL
+	Username  string `mapstructure:"username"`
+	Password  string `mapstructure:"password"`
+}
+
+// QuotaAlertSettings configures the events raised as principals use up their quotas
+type QuotaAlertSettings struct {
+	Thresholds []int `mapstructure:"thresholds"` // percentages of a policy's limit
+}
+
+// PgBouncerSettings configures the polling of the upstream PgBouncer's admin console
+type PgBouncerSettings struct {
+	AdminURL     string        `mapstructure:"admin_url"` // empty disables polling
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+}
+
+// QueryStatsSettings configures the statistics kept per query fingerprint
+type QueryStatsSettings struct {
+	Max           int           `mapstructure:"max"`            // fingerprints tracked
+	FlushInterval time.Duration `mapstructure:"flush_interval"` // to the usage store, when it keeps them
+}
+
+// WebhookSettings is an HTTP endpoint notified of events
+type WebhookSettings struct {
+	URL    string   `mapstructure:"url"`
+	Secret string   `mapstructure:"secret"`
+	Events []string `mapstructure:"events"` // empty delivers every event
+}
+
+// QueryLogSettings is a destination of the query log
+type QueryLogSettings struct {
+	Type       string        `mapstructure:"type"` // stdout, file, kafka or events
+	File       string        `mapstructure:"file"`
+	MaxSizeMB  int64         `mapstructure:"max_size_mb"`
+	MaxAge     time.Duration `mapstructure:"max_age"`
+	MaxBackups int           `mapstructure:"max_backups"`
+	Compress   bool          `mapstructure:"compress"`
+	Decisions  []string      `mapstructure:"decisions"` // empty logs every event
+}
+
+// RoleSettings names the users a role groups, for policies to apply to them all
+type RoleSettings struct {
+	Name  string   `mapstructure:"name"`
+	Users []string `mapstructure:"users"`
+}
+
+// IdentitySettings configures the lookup of the directory groups users belong
+// to, each making its members members of the role of the same name
+type IdentitySettings struct {
+	LDAP     LDAPSettings  `mapstructure:"ldap"`
+	CacheTTL time.Duration `mapstructure:"cache_ttl"`
+}
+
+// LDAPSettings selects the LDAP directory groups are searched in
+type LDAPSettings struct {
+	URL             string        `mapstructure:"url"` // ldap://host[:port] or ldaps://host[:port]
+	BindDN          string        `mapstructure:"bind_dn"`
+	BindPassword    string        `mapstructure:"bind_password"`
+	BaseDN          string        `mapstructure:"base_dn"`
+	GroupFilter     string        `mapstructure:"group_filter"` // {user} stands for the user name
+	GroupAttribute  string        `mapstructure:"group_attribute"`
+	CAFile          string        `mapstructure:"ca_file"`
+	StartTLS        bool          `mapstructure:"start_tls"` // upgrade ldap:// connections to TLS
+	FollowReferrals bool          `mapstructure:"follow_referrals"`
+	Timeout         time.Duration `mapstructure:"timeout"`
+}
+
+// PolicySettings is a quota policy as written in the configuration file
+type PolicySettings struct {
+	Name      string            `mapstructure:"name"`
+	User      string            `mapstructure:"user"`
+	Role      string            `mapstructure:"role"`
+	Database  string            `mapstructure:"database"`
+	Labels    map[string]string `mapstructure:"labels"`
+	Listener  string            `mapstructure:"listener"`
+	Dimension string            `mapstructure:"dimension"`
+	Limit     int64             `mapstructure:"limit"`
+	Window    time.Duration     `mapstructure:"window"`
+	PerLabel  string            `mapstructure:"per_label"`
+	Rate      float64           `mapstructure:"rate"`
+	Burst     int64             `mapstructure:"burst"`
+	RatePer   string            `mapstructure:"rate_per"`
+
+	Credits    int64   `mapstructure:"credits"`
+	CreditRate float64 `mapstructure:"credit_rate"`
+
+	WarnAt int           `mapstructure:"warn_at"`
+	Soft   bool          `mapstructure:"soft"`
+	Grace  time.Duration `mapstructure:"grace"`
+
+	TightenAt int `mapstructure:"tighten_at"`
+	TightenTo int `mapstructure:"tighten_to"`
+
+	MaxConnections       int64         `mapstructure:"max_connections"`
+	MaxConcurrentQueries int64         `mapstructure:"max_concurrent_queries"`
+	QueueTimeout         time.Duration `mapstructure:"queue_timeout"`
+	StatementTimeout     time.Duration `mapstructure:"statement_timeout"`
+	MaxResultRows        int64         `mapstructure:"max_result_rows"`
+	MaxResultBytes       int64         `mapstructure:"max_result_bytes"`
+
+	MaxTransactionDuration   time.Duration `mapstructure:"max_transaction_duration"`
+	MaxTransactionStatements int64         `mapstructure:"max_transaction_statements"`
+
+	StartupParameters map[string]string `mapstructure:"startup_parameters"`
+
+	Tables      []string `mapstructure:"tables"`
+	Statements  []string `mapstructure:"statements"`
+	Deny        bool     `mapstructure:"deny"`
+	AllowDuring []string `mapstructure:"allow_during"`
+
+	ActiveDuring []string `mapstructure:"active_during"`
+
+	Fingerprints []string `mapstructure:"fingerprints"`
+	Patterns     []string `mapstructure:"patterns"`
+	Allow        bool     `mapstructure:"allow"`
+	Hint         string   `mapstructure:"hint"`
+
+	Override bool `mapstructure:"override"`
+}
+
+// DefaultAddress is the address the server listens on unless configured otherwise
+const DefaultAddress = ":5432"
+
+// flagKeys maps the server command flags to their configuration keys
+var flagKeys = map[string]string{
+	"address":                    "server.address",
+	"instance-id":                "server.instance_id",
+	"capture-file":               "server.capture_file",
+	"capture-parameters":         "server.capture_parameters",
+	"quota-functions":            "server.quota_functions",
+	"gss-encryption-tunnel":      "server.gss_encryption_tunnel",
+	"max-idle-connections":       "server.max_idle_connections",
+	"max-message-size-mb":        "server.max_message_size_mb",
+	"max-connection-buffer-mb":   "server.max_connection_buffer_mb",
+	"socket-activation":          "server.socket_activation",
+	"normalizer":                 "server.normalizer",
+	"query-cache-size":           "server.query_cache_size",
+	"statement-cache-size":       "server.statement_cache_size",
+	"upstream":                   "upstream.address",
+	"upstream-min-refresh":       "upstream.min_refresh",
+	"upstream-max-refresh":       "upstream.max_refresh",
+	"failover-upstream":          "upstream.failover.address",
+	"failover-cooldown":          "upstream.failover.cooldown",
+	"upstream-reconnect":         "upstream.reconnect",
+	"pool-mode":                  "pool.mode",
+	"pool-size":                  "pool.size",
+	"pool-wait-timeout":          "pool.wait_timeout",
+	"read-timeout":               "timeouts.read",
+	"idle-timeout":               "timeouts.idle",
+	"idle-transaction-timeout":   "timeouts.idle_transaction",
+	"upstream-timeout":           "timeouts.upstream",
+	"shutdown-timeout":           "timeouts.shutdown",
+	"log-level":                  "logging.level",
+	"log-parameters":             "logging.parameter_fingerprints",
+	"maintenance-message":        "maintenance.message",
+	"maintenance-queue":          "maintenance.queue",
+	"burst-threshold":            "burst.threshold",
+	"burst-interval":             "burst.interval",
+	"burst-limit":                "burst.limit",
+	"denial-alert-percent":       "denial_alerts.percent",
+	"denial-alert-window":        "denial_alerts.window",
+	"denial-alert-min-queries":   "denial_alerts.min_queries",
+	"rate-alert-factor":          "rate_alerts.factor",
+	"rate-alert-interval":        "rate_alerts.interval",
+	"rate-alert-warmup":          "rate_alerts.warmup",
+	"rate-alert-min-rate":        "rate_alerts.min_rate",
+	"rate-alert-fingerprints":    "rate_alerts.fingerprints",
+	"rate-alert-notices":         "rate_alerts.notices",
+	"firewall-mode":              "firewall.mode",
+	"firewall-learning-period":   "firewall.learning_period",
+	"firewall-action":            "firewall.action",
+	"firewall-users":             "firewall.users",
+	"firewall-profile-file":      "firewall.profile_file",
+	"usage-store-dsn":            "usage_store.dsn",
+	"usage-store-file":           "usage_store.file",
+	"usage-store-redis":          "usage_store.redis",
+	"usage-consistency":          "usage_store.consistency",
+	"usage-max-overshoot":        "usage_store.max_overshoot",
+	"usage-store-flush-interval": "usage_store.flush_interval",
+	"async-usage":                "usage_store.async",
+	"usage-staleness":            "usage_store.staleness",
+	"usage-workers":              "usage_store.workers",
+	"usage-queue-size":           "usage_store.queue_size",
+	"etcd-endpoints":             "etcd.endpoints",
+	"etcd-prefix":                "etcd.prefix",
+	"leader-election":            "housekeeping.election",
+	"leader-election-redis":      "housekeeping.redis",
+	"leader-election-namespace":  "housekeeping.namespace",
+	"usage-report-interval":      "housekeeping.report_interval",
+	"usage-retention":            "housekeeping.retention",
+	"usage-export-dir":           "housekeeping.export_dir",
+	"usage-export-format":        "housekeeping.export_format",
+	"tls-cert":                   "tls.cert_file",
+	"tls-key":                    "tls.key_file",
+	"tls-ca":                     "tls.ca_file",
+	"tls-require-users":          "tls.require_users",
+	"auth-file":                  "auth.file",
+	"auth-upstream-user":         "auth.upstream_user",
+	"admin-address":              "admin.address",
+	"admin-token":                "admin.token",
+	"health-address":             "health.address",
+	"audit-file":                 "audit.file",
+	"audit-max-size-mb":          "audit.max_size_mb",
+	"audit-max-age":              "audit.max_age",
+	"audit-max-backups":          "audit.max_backups",
+	"audit-compress":             "audit.compress",
+	"slow-query-log":             "slow_queries.file",
+	"slow-query-threshold":       "slow_queries.threshold",
+	"slow-query-sample-rate":     "slow_queries.sample_rate",
+	"slow-query-max-per-second":  "slow_queries.max_per_second",
+	"slow-query-redact":          "slow_queries.redact_parameters",
+	"script":                     "scripts.files",
+	"script-timeout":             "scripts.timeout",
+	"rewrite-row-limit":          "rewrite.row_limit",
+	"rewrite-trace-comments":     "rewrite.trace_comments",
+	"rewrite-tenant-column":      "rewrite.tenant_filter.column",
+	"rewrite-tenant-value":       "rewrite.tenant_filter.value",
+	"rewrite-tenant-tables":      "rewrite.tenant_filter.tables",
+	"access-allow":               "access.allow",
+	"access-deny":                "access.deny",
+	"kafka-brokers":              "kafka.brokers",
+	"kafka-topic":                "kafka.topic",
+	"kafka-key":                  "kafka.key",
+	"kafka-batch-size":           "kafka.batch_size",
+	"kafka-linger":               "kafka.linger",
+	"kafka-tls":                  "kafka.tls.enabled",
+	"kafka-tls-ca":               "kafka.tls.ca_file",
+	"kafka-sasl-mechanism":       "kafka.sasl.mechanism",
+	"kafka-sasl-username":        "kafka.sasl.username",
+	"quota-alert-thresholds":     "quota_alerts.thresholds",
+	"pgbouncer-admin-url":        "pgbouncer.admin_url",
+	"pgbouncer-poll-interval":    "pgbouncer.poll_interval",
+	"query-stats-max":            "query_stats.max",
+	"query-stats-flush-interval": "query_stats.flush_interval",
+	"faults":                     "faults",
+}
+
+// Load reads the configuration file at path, if any, overlays the flags set on
+// the command line, then the environment variables starting with EnvPrefix.
+// Flags that are not set supply the defaults of missing keys. Unknown keys and
+// variables are rejected so typos do not go unnoticed.
+func Load(path string, flags *pflag.FlagSet) (*Config, error) {
+	v := viper.New()
+	if err := applyEnv(v, os.Environ()); err != nil {
+		return nil, err
+	}
+
+	for name, key := range flagKeys {
+		flag := flags.Lookup(name)
+		if flag == nil {
+			continue
+		}
+		if err := v.BindPFlag(key, flag); err != nil {
+			return nil, fmt.Errorf("failed to bind flag %s: %w", name, err)
+		}
+	}
+
+	// Commands without an address flag, such as the sidecar, still validate
+	v.SetDefault("server.address", DefaultAddress)
+	weights := domain.DefaultUsageWeights()
+	v.SetDefault("usage_weights.simple", weights.Simple)
+	v.SetDefault("usage_weights.parse", weights.Parse)
+	v.SetDefault("usage_weights.execute", weights.Execute)
+
+	if path != "" {
+		format, err := fileFormat(path)
+		if err != nil {
+			return nil, err
+		}
+		v.SetConfigFile(path)
+		v.SetConfigType(format)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+	}
+
+	var config Config
+	if err := v.UnmarshalExact(&config); err != nil {
+		return nil, fmt.Errorf("failed to decode configuration: %w", err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return &config, nil
+}
+
+// fileFormat returns the viper config type for the file extension
+func fileFormat(path string) (string, error) {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		return "yaml", nil
+	case ".toml":
+		return "toml", nil
+	default:
+		return "", fmt.Errorf("unsupported config format %q: use .yaml, .yml or .toml", ext)
+	}
+}
+
+// Validate checks the settings that NewServerService would otherwise reject later
+func (c *Config) Validate() error {
+	if c.Server.Address == "" {
+		return fmt.Errorf("server address is required")
+	}
+	if c.Server.MaxIdleConnections < 0 {
+		return fmt.Errorf("max idle connections must not be negative")
+	}
+	if _, err := adapters.ParseNormalizer(c.Server.Normalizer); err != nil {
+		return err
+	}
+	if _, err := adapters.ParseFaultRules(c.Faults); err != nil {
+		return fmt.Errorf("invalid fault rules: %w", err)
+	}
+	if c.Server.QueryCacheSize < 0 || c.Server.StatementCacheSize < 0 {
+		return fmt.Errorf("query cache sizes must not be negative")
+	}
+	if c.Server.MaxMessageSizeMB < 0 || c.Server.MaxConnectionBufferMB < 0 {
+		return fmt.Errorf("connection memory limits must not be negative")
+	}
+	if c.Server.MaxMessageSizeMB >= 1<<11 {
+		return fmt.Errorf("max message size must be below 2048 MB, the largest message the protocol allows")
+	}
+	listeners := make(map[string]bool, len(c.Listeners))
+	for _, listener := range c.Listeners {
+		if listener.Name == "" {
+			return fmt.Errorf("listener name is required")
+		}
+		if listeners[listener.Name] {
+			return fmt.Errorf("listener %q is defined twice", listener.Name)
+		}
+		listeners[listener.Name] = true
+		if listener.Address == "" && !c.Server.SocketActivation {
+			return fmt.Errorf("listener %q needs an address without socket activation", listener.Name)
+		}
+	}
+	databases := make(map[string]bool, len(c.Databases))
+	for _, database := range c.Databases {
+		if database.Name == "" {
+			return fmt.Errorf("database name is required")
+		}
+		if databases[database.Name] {
+			return fmt.Errorf("database %q is defined twice", database.Name)
+		}
+		databases[database.Name] = true
+		if database.Upstream == "" && database.Database == "" {
+			return fmt.Errorf("database %q needs an upstream or an upstream database name", database.Name)
+		}
+	}
+	if c.Timeouts.Read < 0 || c.Timeouts.Idle < 0 || c.Timeouts.IdleTransaction < 0 || c.Timeouts.Upstream < 0 || c.Timeouts.Shutdown < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("TLS needs both a certificate and a key")
+	}
+	if c.TLS.CertFile == "" && (c.TLS.CAFile != "" || len(c.TLS.RequireUsers) > 0) {
+		return fmt.Errorf("TLS client CAs and required users need a server certificate")
+	}
+	if c.Upstream.TLS.Mode != "" && c.Upstream.TLS.Mode != "disable" && c.Upstream.Address == "" &&
+		!slices.ContainsFunc(c.Listeners, func(listener ListenerSettings) bool { return listener.Upstream != "" }) &&
+		!slices.ContainsFunc(c.Databases, func(database DatabaseSettings) bool { return database.Upstream != "" }) {
+		return fmt.Errorf("upstream TLS needs an upstream address")
+	}
+	if c.Upstream.Failover.Address != "" && c.Upstream.Address == "" {
+		return fmt.Errorf("upstream failover needs an upstream address")
+	}
+	jwt := c.Auth.JWT.Secret != "" || c.Auth.JWT.PublicKeyFile != ""
+	jwtPassword := jwt && c.Auth.JWT.Parameter == ""
+	if c.Auth.File == "" && !jwtPassword && (c.Auth.UpstreamUser != "" || c.Auth.UpstreamPassword != "") {
+		return fmt.Errorf("upstream credentials need an auth file")
+	}
+	if jwt && c.Auth.File != "" {
+		return fmt.Errorf("JWT authentication cannot be combined with an auth file")
+	}
+	if jwtPassword && c.Auth.UpstreamUser == "" {
+		return fmt.Errorf("JWT authentication through the password needs upstream credentials")
+	}
+	if jwt && c.Server.GSSEncryptionTunnel {
+		return fmt.Errorf("GSSAPI encryption cannot be tunnelled with JWT authentication: tunnelled clients would present no token")
+	}
+	if c.Auth.JWT.Leeway < 0 {
+		return fmt.Errorf("JWT leeway must not be negative")
+	}
+	if c.Pool.Mode != "" && c.Auth.File == "" {
+		return fmt.Errorf("upstream pooling needs an auth file")
+	}
+	if c.Server.GSSEncryptionTunnel && c.Auth.File != "" {
+		return fmt.Errorf("GSSAPI encryption cannot be tunnelled with an auth file: tunnelled clients would skip local authentication")
+	}
+	if c.Admin.Address != "" && c.Admin.Token == "" {
+		return fmt.Errorf("the admin API needs a token")
+	}
+	if c.Audit.MaxSizeMB < 0 || c.Audit.MaxAge < 0 || c.Audit.MaxBackups < 0 {
+		return fmt.Errorf("audit log rotation limits must not be negative")
+	}
+	if c.UsageStore.FlushInterval < 0 || c.UsageStore.CheckpointInterval < 0 {
+		return fmt.Errorf("usage store flush and checkpoint intervals must not be negative")
+	}
+	stores := 0
+	for _, location := range []string{c.UsageStore.DSN, c.UsageStore.File, c.UsageStore.Redis} {
+		if location != "" {
+			stores++
+		}
+	}
+	if stores > 1 {
+		return fmt.Errorf("the usage store takes one of a DSN, a file or a Redis URL")
+	}
+	switch c.UsageStore.Consistency {
+	case "", "eventual":
+	case "strict":
+		if c.UsageStore.Async {
+			return fmt.Errorf("strict usage consistency cannot record usage in the background")
+		}
+	default:
+		return fmt.Errorf("unknown usage consistency %q: use strict or eventual", c.UsageStore.Consistency)
+	}
+	if c.UsageStore.MaxOvershoot < 0 {
+		return fmt.Errorf("usage store max overshoot must not be negative")
+	}
+	if c.Etcd.LeaseTTL < 0 {
+		return fmt.Errorf("etcd lease TTL must not be negative")
+	}
+	switch c.Housekeeping.Election {
+	case "", "kubernetes":
+	case "redis":
+		if c.Housekeeping.Redis == "" && c.UsageStore.Redis == "" {
+			return fmt.Errorf("leader election with Redis needs a Redis URL")
+		}
+	default:
+		return fmt.Errorf("unknown leader election %q: use redis or kubernetes", c.Housekeeping.Election)
+	}
+	if c.Housekeeping.TTL < 0 {
+		return fmt.Errorf("leader election TTL must not be negative")
+	}
+	if c.Logging.Level != "" {
+		if _, err := logger.ParseLevel(c.Logging.Level); err != nil {
+			return err
+		}
+	}
+
+	roles := make(map[string]bool, len(c.Roles))
+	for _, role := range c.Roles {
+		if role.Name == "" {
+			return fmt.Errorf("roles must have a name")
+		}
+		if roles[role.Name] {
+			return fmt.Errorf("role %q is defined twice", role.Name)
+		}
+		roles[role.Name] = true
+	}
+
+	names := make(map[string]bool, len(c.Policies))
+	for _, policy := range c.QuotaPolicies() {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+		if names[policy.Name] {
+			return fmt.Errorf("quota policy %q is defined twice", policy.Name)
+		}
+		names[policy.Name] = true
+		if policy.Listener != "" && !listeners[policy.Listener] {
+			return fmt.Errorf("quota policy %q: unknown listener %q", policy.Name, policy.Listener)
+		}
+	}
+
+	serverConfig := c.ServerConfig()
+	if err := serverConfig.UpstreamTLS.Validate(); err != nil {
+		return err
+	}
+	if err := serverConfig.Pool.Validate(); err != nil {
+		return err
+	}
+	if err := serverConfig.Identity.Validate(); err != nil {
+		return err
+	}
+	if err := serverConfig.UsageWeights.Validate(); err != nil {
+		return err
+	}
+	if err := serverConfig.Kafka.Validate(); err != nil {
+		return err
+	}
+	if err := serverConfig.QuotaAlerts.Validate(); err != nil {
+		return err
+	}
+	if err := serverConfig.PgBouncer.Validate(); err != nil {
+		return err
+	}
+	if err := serverConfig.QueryStats.Validate(); err != nil {
+		return err
+	}
+	if err := serverConfig.SlowQueries.Validate(); err != nil {
+		return err
+	}
+	if err := serverConfig.Scripts.Validate(); err != nil {
+		return err
+	}
+	if err := serverConfig.Access.Validate(); err != nil {
+		return err
+	}
+	for _, listener := range serverConfig.Listeners {
+		if _, err := domain.ParseAccessList(listener.Allow, listener.Deny); err != nil {
+			return fmt.Errorf("access of listener %s: %w", listener.Name, err)
+		}
+	}
+	if err := serverConfig.Rewrite.Validate(); err != nil {
+		return err
+	}
+	if err := serverConfig.ParameterLabels.Validate(); err != nil {
+		return err
+	}
+	if err := serverConfig.Failover.Validate(); err != nil {
+		return err
+	}
+	if err := serverConfig.Housekeeping.Validate(); err != nil {
+		return err
+	}
+	if err := serverConfig.AsyncUsage.Validate(); err != nil {
+		return err
+	}
+	for _, webhook := range serverConfig.Webhooks {
+		if err := webhook.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, destination := range serverConfig.QueryLogs {
+		if err := destination.Validate(); err != nil {
+			return err
+		}
+		if destination.Type == app.QueryLogKafka && !serverConfig.Kafka.Enabled() {
+			return fmt.Errorf("the kafka query log needs kafka brokers and a topic")
+		}
+	}
+	if err := serverConfig.BurstDetection.Validate(); err != nil {
+		return err
+	}
+	if err := serverConfig.DenialAlerts.Validate(); err != nil {
+		return err
+	}
+	if err := serverConfig.RateAlerts.Validate(); err != nil {
+		return err
+	}
+	return serverConfig.Firewall.Validate()
+}
+
+// QuotaPolicies returns the configured quota policies
+func (c *Config) QuotaPolicies() []domain.QuotaPolicy {
+	policies := make([]domain.QuotaPolicy, 0, len(c.Policies))
+	for _, entry := range c.Policies {
+		var statements []domain.StatementClass
+		for _, class := range entry.Statements {
+			statements = append(statements, domain.StatementClass(class))
+		}
+		policies = append(policies, domain.QuotaPolicy{
+			Name:      entry.Name,
+			User:      entry.User,
+			Role:      entry.Role,
+			Database:  entry.Database,
+			Labels:    entry.Labels,
+			Listener:  entry.Listener,
+			Dimension: domain.QuotaDimension(entry.Dimension),
+			Limit:     entry.Limit,
+			Window:    entry.Window,
+			PerLabel:  entry.PerLabel,
+			Rate:      entry.Rate,
+			Burst:     entry.Burst,
+			RatePer:   domain.RateScope(entry.RatePer),
+
+			Credits:    entry.Credits,
+			CreditRate: entry.CreditRate,
+
+			WarnAt: entry.WarnAt,
+			Soft:   entry.Soft,
+			Grace:  entry.Grace,
+
+			TightenAt: entry.TightenAt,
+			TightenTo: entry.TightenTo,
+
+			MaxConnections:       entry.MaxConnections,
+			MaxConcurrentQueries: entry.MaxConcurrentQueries,
+			QueueTimeout:         entry.QueueTimeout,
+			StatementTimeout:     entry.StatementTimeout,
+			MaxResultRows:        entry.MaxResultRows,
+			MaxResultBytes:       entry.MaxResultBytes,
+
+			MaxTransactionDuration:   entry.MaxTransactionDuration,
+			MaxTransactionStatements: entry.MaxTransactionStatements,
+
+			StartupParameters: entry.StartupParameters,
+
+			Tables:      entry.Tables,
+			Statements:  statements,
+			Deny:        entry.Deny,
+			AllowDuring: entry.AllowDuring,
+
+			ActiveDuring: entry.ActiveDuring,
+
+			Fingerprints: entry.Fingerprints,
+			Patterns:     entry.Patterns,
+			Allow:        entry.Allow,
+			Hint:         entry.Hint,
+
+			Override: entry.Override,
+		})
+	}
+	return policies
+}
+
+// QuotaRoles returns the users of the configured roles by role name
+func (c *Config) QuotaRoles() map[string][]string {
+	roles := make(map[string][]string, len(c.Roles))
+	for _, role := range c.Roles {
+		roles[role.Name] = role.Users
+	}
+	return roles
+}
+
+// ServerConfig returns the settings of the server service
+func (c *Config) ServerConfig() app.ServerConfig {
+	// Validate has rejected unknown levels; an empty level logs everything
+	level, _ := logger.ParseLevel(c.Logging.Level)
+
+	return app.ServerConfig{
+		Address:          c.Server.Address,
+		InstanceID:       c.Server.InstanceID,
+		Upstream:         c.Upstream.Address,
+		Listeners:        c.listeners(),
+		Databases:        c.databases(),
+		SocketActivation: c.Server.SocketActivation,
+		Access:           c.access(),
+		UpstreamDiscovery: app.UpstreamDiscoveryConfig{
+			MinRefresh: c.Upstream.MinRefresh,
+			MaxRefresh: c.Upstream.MaxRefresh,
+		},
+		UpstreamTimeout:   c.Timeouts.Upstream,
+		UpstreamReconnect: c.Upstream.Reconnect,
+		Failover: app.UpstreamFailoverConfig{
+			Upstream:  c.Upstream.Failover.Address,
+			CheckURL:  c.Upstream.Failover.CheckURL,
+			Interval:  c.Upstream.Failover.Interval,
+			Timeout:   c.Upstream.Failover.Timeout,
+			Threshold: c.Upstream.Failover.Threshold,
+			Cooldown:  c.Upstream.Failover.Cooldown,
+		},
+		Pool: app.PoolConfig{
+			Mode:        c.Pool.Mode,
+			Size:        c.Pool.Size,
+			Sizes:       c.poolSizes(),
+			WaitTimeout: c.Pool.WaitTimeout,
+		},
+		UpstreamTLS: app.UpstreamTLSConfig{
+			Mode:       c.Upstream.TLS.Mode,
+			ServerName: c.Upstream.TLS.ServerName,
+			CAFile:     c.Upstream.TLS.CAFile,
+			CertFile:   c.Upstream.TLS.CertFile,
+			KeyFile:    c.Upstream.TLS.KeyFile,
+		},
+		ReadTimeout:        c.Timeouts.Read,
+		IdleTimeout:        c.Timeouts.Idle,
+		IdleTxTimeout:      c.Timeouts.IdleTransaction,
+		LogLevel:           level,
+		LogParameters:      c.Logging.ParameterFingerprints,
+		CaptureFile:        c.Server.CaptureFile,
+		Normalizer:         c.Server.Normalizer,
+		QueryCacheSize:     c.Server.QueryCacheSize,
+		StatementCacheSize: c.Server.StatementCacheSize,
+		CaptureParameters:  c.Server.CaptureParameters,
+		QuotaFunctions:     c.Server.QuotaFunctions,
+		Faults:             c.Faults,
+		ParameterLabels:    c.parameterLabels(),
+		Policies:           c.QuotaPolicies(),
+		Roles:              c.QuotaRoles(),
+		Identity:           c.identity(),
+		UsageWeights: domain.UsageWeights{
+			Simple:  c.UsageWeights.Simple,
+			Parse:   c.UsageWeights.Parse,
+			Execute: c.UsageWeights.Execute,
+		},
+		BurstDetection: app.BurstDetectorConfig{
+			Threshold: c.Burst.Threshold,
+			Interval:  c.Burst.Interval,
+			Limit:     c.Burst.Limit,
+		},
+		DenialAlerts: app.DenialAnomalyConfig{
+			Percent:    c.DenialAlerts.Percent,
+			Window:     c.DenialAlerts.Window,
+			MinQueries: c.DenialAlerts.MinQueries,
+		},
+		RateAlerts: app.RateAnomalyConfig{
+			Factor:       c.RateAlerts.Factor,
+			Interval:     c.RateAlerts.Interval,
+			Warmup:       c.RateAlerts.Warmup,
+			MinRate:      c.RateAlerts.MinRate,
+			Fingerprints: c.RateAlerts.Fingerprints,
+			Notices:      c.RateAlerts.Notices,
+		},
+		Firewall: app.FirewallConfig{
+			Mode:           app.FirewallMode(c.Firewall.Mode),
+			LearningPeriod: c.Firewall.LearningPeriod,
+			Action:         app.FirewallAction(c.Firewall.Action),
+			Users:          c.Firewall.Users,
+			ProfileFile:    c.Firewall.ProfileFile,
+		},
+		MaxIdleConnections:  c.Server.MaxIdleConnections,
+		MaxMessageSize:      c.Server.MaxMessageSizeMB << 20,
+		MaxConnectionBuffer: int64(c.Server.MaxConnectionBufferMB) << 20,
+		TLS: app.TLSConfig{
+			CertFile:     c.TLS.CertFile,
+			KeyFile:      c.TLS.KeyFile,
+			CAFile:       c.TLS.CAFile,
+			RequireUsers: c.TLS.RequireUsers,
+		},
+		Auth: app.AuthConfig{
+			File:             c.Auth.File,
+			UpstreamUser:     c.Auth.UpstreamUser,
+			UpstreamPassword: c.Auth.UpstreamPassword,
+			JWT: app.JWTConfig{
+				Parameter:     c.Auth.JWT.Parameter,
+				Secret:        c.Auth.JWT.Secret,
+				PublicKeyFile: c.Auth.JWT.PublicKeyFile,
+				Issuer:        c.Auth.JWT.Issuer,
+				Audience:      c.Auth.JWT.Audience,
+				Leeway:        c.Auth.JWT.Leeway,
+				UserClaim:     c.Auth.JWT.UserClaim,
+				LabelClaims:   c.Auth.JWT.LabelClaims,
+			},
+		},
+		Audit: app.AuditConfig{
+			File:       c.Audit.File,
+			MaxSize:    c.Audit.MaxSizeMB << 20,
+			MaxAge:     c.Audit.MaxAge,
+			MaxBackups: c.Audit.MaxBackups,
+			Compress:   c.Audit.Compress,
+		},
+		SlowQueries: app.SlowQueryConfig{
+			File:             c.SlowQueries.File,
+			Threshold:        c.SlowQueries.Threshold,
+			SampleRate:       c.SlowQueries.SampleRate,
+			MaxPerSecond:     c.SlowQueries.MaxPerSecond,
+			RedactParameters: c.SlowQueries.RedactParameters,
+		},
+		Scripts:             app.ScriptConfig{Files: c.Scripts.Files, Timeout: c.Scripts.Timeout},
+		GSSEncryptionTunnel: c.Server.GSSEncryptionTunnel,
+		Rewrite: app.RewriteConfig{
+			RowLimit:      c.Rewrite.RowLimit,
+			TraceComments: c.Rewrite.TraceComments,
+			TenantFilter: app.TenantFilterConfig{
+				Column: c.Rewrite.TenantFilter.Column,
+				Value:  c.Rewrite.TenantFilter.Value,
+				Tables: c.Rewrite.TenantFilter.Tables,
+			},
+		},
+		Kafka: app.KafkaConfig{
+			Brokers:   c.Kafka.Brokers,
+			Topic:     c.Kafka.Topic,
+			Key:       c.Kafka.Key,
+			BatchSize: c.Kafka.BatchSize,
+			Linger:    c.Kafka.Linger,
+			TLS: app.KafkaTLSConfig{
+				Enabled:    c.Kafka.TLS.Enabled,
+				ServerName: c.Kafka.TLS.ServerName,
+				CAFile:     c.Kafka.TLS.CAFile,
+				CertFile:   c.Kafka.TLS.CertFile,
+				KeyFile:    c.Kafka.TLS.KeyFile,
+			},
+			SASL: app.KafkaSASLConfig{
+				Mechanism: c.Kafka.SASL.Mechanism,
+				Username:  c.Kafka.SASL.Username,
+				Password:  c.Kafka.SASL.Password,
+			},
+		},
+		QuotaAlerts: app.QuotaAlertConfig{Thresholds: c.QuotaAlerts.Thresholds},
+		PgBouncer: app.PgBouncerConfig{
+			AdminURL:     c.PgBouncer.AdminURL,
+			PollInterval: c.PgBouncer.PollInterval,
+		},
+		AsyncUsage: app.AsyncUsageConfig{
+			Enabled:   c.UsageStore.Async,
+			Staleness: c.UsageStore.Staleness,
+			Workers:   c.UsageStore.Workers,
+			QueueSize: c.UsageStore.QueueSize,
+		},
+		Webhooks:  c.webhooks(),
+		QueryLogs: c.queryLogs(),
+		Housekeeping: app.HousekeepingConfig{
+			RenewInterval:  c.Housekeeping.TTL / 3,
+			ReportInterval: c.Housekeeping.ReportInterval,
+			Retention:      c.Housekeeping.Retention,
+			ExportDir:      c.Housekeeping.ExportDir,
+			ExportFormat:   c.Housekeeping.ExportFormat,
+		},
+		QueryStats: app.QueryStatsConfig{
+			Max:           c.QueryStats.Max,
+			FlushInterval: c.QueryStats.FlushInterval,
+		},
+	}
+}
+
+// listeners returns the configured additional listeners
+func (c *Config) listeners() []app.ListenerConfig {
+	var listeners []app.ListenerConfig
+	for _, entry := range c.Listeners {
+		listeners = append(listeners, app.ListenerConfig{Name: entry.Name, Address: entry.Address, Upstream: entry.Upstream, Allow: entry.Allow, Deny: entry.Deny})
+	}
+	return listeners
+}
+
+// access returns the configured access lists
+func (c *Config) access() app.AccessConfig {
+	access := app.AccessConfig{Allow: c.Access.Allow, Deny: c.Access.Deny}
+	for _, entry := range c.Access.Users {
+		access.Users = append(access.Users, app.UserAccessConfig{User: entry.User, Allow: entry.Allow, Deny: entry.Deny})
+	}
+	return access
+}
+
+// identity returns the configured directory group lookup
+func (c *Config) identity() app.IdentityConfig {
+	ldap := c.Identity.LDAP
+	return app.IdentityConfig{
+		LDAP: app.LDAPConfig{
+			URL:             ldap.URL,
+			BindDN:          ldap.BindDN,
+			BindPassword:    ldap.BindPassword,
+			BaseDN:          ldap.BaseDN,
+			GroupFilter:     ldap.GroupFilter,
+			GroupAttribute:  ldap.GroupAttribute,
+			CAFile:          ldap.CAFile,
+			StartTLS:        ldap.StartTLS,
+			FollowReferrals: ldap.FollowReferrals,
+			Timeout:         ldap.Timeout,
+		},
+		CacheTTL: c.Identity.CacheTTL,
+	}
+}
+
+// databases returns the configured database routes
+func (c *Config) databases() []app.DatabaseConfig {
+	var databases []app.DatabaseConfig
+	for _, entry := range c.Databases {
+		databases = append(databases, app.DatabaseConfig{Name: entry.Name, Upstream: entry.Upstream, Database: entry.Database})
+	}
+	return databases
+}
+
+// poolSizes returns the configured pool size overrides
+func (c *Config) poolSizes() []app.PoolSizeConfig {
+	var sizes []app.PoolSizeConfig
+	for _, entry := range c.Pool.Sizes {
+		sizes = append(sizes, app.PoolSizeConfig{User: entry.User, Database: entry.Database, Size: entry.Size})
+	}
+	return sizes
+}
+
+// queryLogs returns the configured query log destinations
+func (c *Config) queryLogs() []app.QueryLogConfig {
+	var destinations []app.QueryLogConfig
+	for _, entry := range c.QueryLogs {
+		destinations = append(destinations, app.QueryLogConfig{
+			Type:       entry.Type,
+			File:       entry.File,
+			MaxSize:    entry.MaxSizeMB << 20,
+			MaxAge:     entry.MaxAge,
+			MaxBackups: entry.MaxBackups,
+			Compress:   entry.Compress,
+			Decisions:  entry.Decisions,
+		})
+	}
+	return destinations
+}
+
+// parameterLabels returns the configured labels taken from bound values
+func (c *Config) parameterLabels() app.ParameterLabelConfig {
+	labels := app.ParameterLabelConfig{MaxSize: c.ParamLabels.MaxSize}
+	for _, entry := range c.ParamLabels.Labels {
+		labels.Labels = append(labels.Labels, app.ParameterLabelRule{
+			Label:        entry.Label,
+			Position:     entry.Position,
+			Fingerprints: entry.Fingerprints,
+		})
+	}
+	return labels
+}
+
+// webhooks returns the configured webhooks
+func (c *Config) webhooks() []app.WebhookConfig {
+	var webhooks []app.WebhookConfig
+	for _, entry := range c.Webhooks {
+		webhooks = append(webhooks, app.WebhookConfig{URL: entry.URL, Secret: entry.Secret, Events: entry.Events})
+	}
+	return webhooks
+}
+
+// MaintenanceWindow returns the window applied when maintenance is enabled at runtime
+func (c *Config) MaintenanceWindow() domain.MaintenanceWindow {
+	return domain.MaintenanceWindow{
+		Message:      c.Maintenance.Message,
+		QueueTimeout: c.Maintenance.Queue,
+	}
+}
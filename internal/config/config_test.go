@@ -0,0 +1,530 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testFlags defines a subset of the server command flags with their defaults
+func testFlags() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("server", pflag.ContinueOnError)
+	flags.String("address", ":5432", "")
+	flags.String("upstream", "", "")
+	flags.Duration("read-timeout", 30*time.Second, "")
+	flags.Duration("shutdown-timeout", 10*time.Second, "")
+	flags.String("log-level", "debug", "")
+	flags.Int("max-idle-connections", 0, "")
+	return flags
+}
+
+// writeConfig writes content to a file named name in a temporary directory
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoad_YAML(t *testing.T) {
+	path := writeConfig(t, "enforcer.yaml", `
+server:
+  address: ":6432"
+  max_idle_connections: 5
+  capture_parameters: true
+  quota_functions: true
+  socket_activation: true
+  query_cache_size: 500
+  normalizer: fast-regex
+  max_message_size_mb: 16
+  max_connection_buffer_mb: 64
+  statement_cache_size: 0
+upstream:
+  address: pgbouncer.internal:6432
+  reconnect: true
+  tls:
+    mode: verify-full
+    ca_file: /etc/enforcer/upstream-ca.crt
+  failover:
+    address: standby-pgbouncer.internal:6432
+    check_url: postgres://health@/postgres
+    threshold: 5
+    cooldown: 2m
+listeners:
+  - name: analytics
+    address: ":6433"
+    upstream: analytics-pgbouncer.internal:6432
+    allow: [10.20.0.0/16]
+  - name: reporting
+access:
+  deny: [203.0.113.0/24]
+  users:
+    - user: etl
+      allow: [10.30.0.0/16]
+databases:
+  - name: reporting
+    upstream: replica-pgbouncer.internal:6432
+    database: analytics_ro
+  - name: legacy
+    database: app
+pool:
+  mode: transaction
+  size: 10
+  sizes:
+    - user: etl
+      size: 2
+  wait_timeout: 5s
+timeouts:
+  read: 1m
+  idle_transaction: 30s
+logging:
+  level: info
+  parameter_fingerprints: [50fde20626009aba]
+tls:
+  cert_file: /etc/enforcer/server.crt
+  key_file: /etc/enforcer/server.key
+  require_users: [alice, bob]
+auth:
+  file: /etc/enforcer/userlist.txt
+  upstream_user: app
+  upstream_password: secret
+admin:
+  address: 127.0.0.1:8080
+  token: secret
+audit:
+  file: /var/log/enforcer/audit.jsonl
+  max_size_mb: 10
+  max_age: 1h
+  compress: true
+slow_queries:
+  file: /var/log/enforcer/slow.jsonl
+  threshold: 500ms
+  sample_rate: 0.1
+  redact_parameters: true
+scripts:
+  files: [/etc/enforcer/rules.lua]
+  timeout: 5ms
+rewrite:
+  row_limit: 1000
+  trace_comments: true
+  tenant_filter:
+    column: tenant_id
+    value: label.tenant
+    tables: [orders, billing.*]
+kafka:
+  brokers: [kafka-1:9092, kafka-2:9092]
+  topic: query-events
+  key: query_hash
+  tls:
+    enabled: true
+    ca_file: /etc/enforcer/kafka-ca.pem
+  sasl:
+    mechanism: SCRAM-SHA-512
+    username: enforcer
+    password: secret
+quota_alerts:
+  thresholds: [80, 100]
+pgbouncer:
+  admin_url: postgres://stats@pgbouncer:6432/pgbouncer
+query_stats:
+  max: 1000
+  flush_interval: 30s
+rate_alerts:
+  factor: 4
+  warmup: 30
+  fingerprints: true
+firewall:
+  mode: learn
+  learning_period: 168h
+  users: [billing, etl]
+  profile_file: /var/lib/enforcer/firewall.json
+webhooks:
+  - url: https://alerts.internal/enforcer
+    secret: s3cret
+    events: [quota_threshold, quota_blocked]
+parameter_labels:
+  max_size: 32
+  labels:
+    - label: tenant_id
+      position: 1
+      fingerprints: [50fde20626009aba]
+query_logs:
+  - type: file
+    file: /var/log/enforcer/queries.jsonl
+    max_size_mb: 50
+  - type: events
+    decisions: [deny]
+usage_weights:
+  parse: 0
+usage_store:
+  file: /var/lib/enforcer/quota.db
+  checkpoint_interval: 10m
+  consistency: eventual
+  max_overshoot: 50
+  async: true
+  staleness: 500ms
+  workers: 2
+etcd:
+  endpoints: [etcd-0:2379, etcd-1:2379]
+  prefix: /enforcers/eu/
+housekeeping:
+  election: kubernetes
+  ttl: 30s
+  report_interval: 24h
+  export_dir: /var/lib/enforcer/usage
+  export_format: parquet
+roles:
+  - name: analysts
+    users: [alice, bob]
+policies:
+  - name: billing
+    database: app
+    labels:
+      team: billing
+    listener: analytics
+    limit: 100
+    window: 1h
+  - name: etl
+    user: etl
+    rate: 20
+    burst: 50
+    rate_per: connection
+    max_connections: 4
+    statement_timeout: 15m
+    startup_parameters:
+      application_name: "etl ({connection_id})"
+  - name: audit-readonly
+    tables: [audit.*, secrets]
+    statements: [write]
+    deny: true
+  - name: analysts
+    role: analysts
+    limit: 1000
+    window: 1h
+    override: true
+  - name: tenant-daily
+    user: tenant
+    limit: 10000
+    window: 24h
+    warn_at: 90
+    grace: 15m
+`)
+
+	cfg, err := Load(path, testFlags())
+	require.NoError(t, err)
+
+	serverConfig := cfg.ServerConfig()
+	assert.Equal(t, ":6432", serverConfig.Address)
+	assert.Equal(t, "pgbouncer.internal:6432", serverConfig.Upstream)
+	assert.Equal(t, 5, serverConfig.MaxIdleConnections)
+	assert.True(t, serverConfig.QuotaFunctions)
+	assert.True(t, serverConfig.CaptureParameters)
+	assert.True(t, serverConfig.SocketActivation)
+	assert.Equal(t, 500, serverConfig.QueryCacheSize)
+	assert.Equal(t, "fast-regex", serverConfig.Normalizer)
+	assert.Equal(t, 16<<20, serverConfig.MaxMessageSize)
+	assert.Equal(t, int64(64<<20), serverConfig.MaxConnectionBuffer)
+	assert.Equal(t, app.AsyncUsageConfig{Enabled: true, Staleness: 500 * time.Millisecond, Workers: 2}, serverConfig.AsyncUsage)
+	assert.Equal(t, "/var/lib/enforcer/quota.db", cfg.UsageStore.File)
+	assert.Equal(t, 10*time.Minute, cfg.UsageStore.CheckpointInterval)
+	assert.Equal(t, int64(50), cfg.UsageStore.MaxOvershoot)
+	assert.Equal(t, EtcdSettings{Endpoints: []string{"etcd-0:2379", "etcd-1:2379"}, Prefix: "/enforcers/eu/"}, cfg.Etcd)
+	assert.Equal(t, "kubernetes", cfg.Housekeeping.Election)
+	assert.Equal(t, app.HousekeepingConfig{
+		RenewInterval: 10 * time.Second, ReportInterval: 24 * time.Hour, ExportDir: "/var/lib/enforcer/usage", ExportFormat: "parquet",
+	}, serverConfig.Housekeeping)
+	assert.Equal(t, app.QueryStatsConfig{Max: 1000, FlushInterval: 30 * time.Second}, serverConfig.QueryStats)
+	assert.Equal(t, app.RateAnomalyConfig{Factor: 4, Warmup: 30, Fingerprints: true}, serverConfig.RateAlerts)
+	assert.Equal(t, app.FirewallConfig{
+		Mode: app.FirewallLearn, LearningPeriod: 168 * time.Hour, Users: []string{"billing", "etl"}, ProfileFile: "/var/lib/enforcer/firewall.json",
+	}, serverConfig.Firewall)
+	assert.Zero(t, serverConfig.StatementCacheSize, "Zero should disable the statement cache")
+	assert.Equal(t, []app.ListenerConfig{
+		{Name: "analytics", Address: ":6433", Upstream: "analytics-pgbouncer.internal:6432", Allow: []string{"10.20.0.0/16"}},
+		{Name: "reporting"},
+	}, serverConfig.Listeners, "Listeners may go without an address with socket activation")
+	assert.Equal(t, app.AccessConfig{
+		Deny:  []string{"203.0.113.0/24"},
+		Users: []app.UserAccessConfig{{User: "etl", Allow: []string{"10.30.0.0/16"}}},
+	}, serverConfig.Access)
+	assert.Equal(t, []app.DatabaseConfig{
+		{Name: "reporting", Upstream: "replica-pgbouncer.internal:6432", Database: "analytics_ro"},
+		{Name: "legacy", Database: "app"},
+	}, serverConfig.Databases)
+	assert.Equal(t, app.PoolConfig{
+		Mode:        "transaction",
+		Size:        10,
+		Sizes:       []app.PoolSizeConfig{{User: "etl", Size: 2}},
+		WaitTimeout: 5 * time.Second,
+	}, serverConfig.Pool)
+	assert.Equal(t, time.Minute, serverConfig.ReadTimeout)
+	assert.Equal(t, 30*time.Second, serverConfig.IdleTxTimeout)
+	assert.Zero(t, serverConfig.IdleTimeout)
+	assert.Equal(t, logger.LevelInfo, serverConfig.LogLevel)
+	assert.Equal(t, []string{"50fde20626009aba"}, serverConfig.LogParameters)
+	assert.Equal(t, 10*time.Second, cfg.Timeouts.Shutdown, "Missing keys take the flag default")
+	assert.Equal(t, domain.UsageWeights{Simple: 1, Parse: 0, Execute: 1}, serverConfig.UsageWeights)
+	assert.Equal(t, app.UpstreamTLSConfig{Mode: "verify-full", CAFile: "/etc/enforcer/upstream-ca.crt"}, serverConfig.UpstreamTLS)
+	assert.Equal(t, app.UpstreamFailoverConfig{
+		Upstream:  "standby-pgbouncer.internal:6432",
+		CheckURL:  "postgres://health@/postgres",
+		Threshold: 5,
+		Cooldown:  2 * time.Minute,
+	}, serverConfig.Failover)
+	assert.True(t, serverConfig.UpstreamReconnect)
+	assert.Equal(t, app.AuthConfig{File: "/etc/enforcer/userlist.txt", UpstreamUser: "app", UpstreamPassword: "secret"}, serverConfig.Auth)
+	assert.Equal(t, AdminSettings{Address: "127.0.0.1:8080", Token: "secret"}, cfg.Admin)
+	assert.Equal(t, app.KafkaConfig{
+		Brokers: []string{"kafka-1:9092", "kafka-2:9092"}, Topic: "query-events", Key: "query_hash",
+		TLS:  app.KafkaTLSConfig{Enabled: true, CAFile: "/etc/enforcer/kafka-ca.pem"},
+		SASL: app.KafkaSASLConfig{Mechanism: "SCRAM-SHA-512", Username: "enforcer", Password: "secret"},
+	}, serverConfig.Kafka)
+	assert.Equal(t, app.QuotaAlertConfig{Thresholds: []int{80, 100}}, serverConfig.QuotaAlerts)
+	assert.Equal(t, app.PgBouncerConfig{AdminURL: "postgres://stats@pgbouncer:6432/pgbouncer"}, serverConfig.PgBouncer)
+	assert.Equal(t, []app.WebhookConfig{{
+		URL:    "https://alerts.internal/enforcer",
+		Secret: "s3cret",
+		Events: []string{"quota_threshold", "quota_blocked"},
+	}}, serverConfig.Webhooks)
+	assert.Equal(t, []app.QueryLogConfig{
+		{Type: "file", File: "/var/log/enforcer/queries.jsonl", MaxSize: 50 << 20},
+		{Type: "events", Decisions: []string{"deny"}},
+	}, serverConfig.QueryLogs)
+	assert.Equal(t, app.ParameterLabelConfig{MaxSize: 32, Labels: []app.ParameterLabelRule{
+		{Label: "tenant_id", Position: 1, Fingerprints: []string{"50fde20626009aba"}},
+	}}, serverConfig.ParameterLabels)
+	assert.Equal(t, app.AuditConfig{File: "/var/log/enforcer/audit.jsonl", MaxSize: 10 << 20, MaxAge: time.Hour, Compress: true}, serverConfig.Audit)
+	assert.Equal(t, app.SlowQueryConfig{File: "/var/log/enforcer/slow.jsonl", Threshold: 500 * time.Millisecond, SampleRate: 0.1, RedactParameters: true}, serverConfig.SlowQueries)
+	assert.Equal(t, app.ScriptConfig{Files: []string{"/etc/enforcer/rules.lua"}, Timeout: 5 * time.Millisecond}, serverConfig.Scripts)
+	assert.Equal(t, app.RewriteConfig{RowLimit: 1000, TraceComments: true, TenantFilter: app.TenantFilterConfig{
+		Column: "tenant_id", Value: "label.tenant", Tables: []string{"orders", "billing.*"},
+	}}, serverConfig.Rewrite)
+	assert.Equal(t, app.TLSConfig{
+		CertFile:     "/etc/enforcer/server.crt",
+		KeyFile:      "/etc/enforcer/server.key",
+		RequireUsers: []string{"alice", "bob"},
+	}, serverConfig.TLS)
+	assert.Equal(t, []domain.QuotaPolicy{{
+		Name:     "billing",
+		Database: "app",
+		Labels:   map[string]string{"team": "billing"},
+		Listener: "analytics",
+		Limit:    100,
+		Window:   time.Hour,
+	}, {
+		Name:    "etl",
+		User:    "etl",
+		Rate:    20,
+		Burst:   50,
+		RatePer: domain.RateScopeConnection,
+
+		MaxConnections:   4,
+		StatementTimeout: 15 * time.Minute,
+
+		StartupParameters: map[string]string{"application_name": "etl ({connection_id})"},
+	}, {
+		Name:       "audit-readonly",
+		Tables:     []string{"audit.*", "secrets"},
+		Statements: []domain.StatementClass{domain.StatementClassWrite},
+		Deny:       true,
+	}, {
+		Name:     "analysts",
+		Role:     "analysts",
+		Limit:    1000,
+		Window:   time.Hour,
+		Override: true,
+	}, {
+		Name:   "tenant-daily",
+		User:   "tenant",
+		Limit:  10000,
+		Window: 24 * time.Hour,
+
+		WarnAt: 90,
+		Grace:  15 * time.Minute,
+	}}, serverConfig.Policies)
+	assert.Equal(t, map[string][]string{"analysts": {"alice", "bob"}}, serverConfig.Roles)
+}
+
+func TestLoad_TOML(t *testing.T) {
+	path := writeConfig(t, "enforcer.toml", `
+[server]
+address = ":7432"
+
+[[policies]]
+name = "default"
+limit = 10
+window = "1m"
+`)
+
+	cfg, err := Load(path, testFlags())
+	require.NoError(t, err)
+	assert.Equal(t, ":7432", cfg.Server.Address)
+	assert.Equal(t, []domain.QuotaPolicy{{Name: "default", Limit: 10, Window: time.Minute}}, cfg.QuotaPolicies())
+}
+
+func TestLoad_FlagsOverrideFile(t *testing.T) {
+	path := writeConfig(t, "enforcer.yml", `
+server:
+  address: ":6432"
+upstream:
+  address: file.internal:6432
+`)
+
+	flags := testFlags()
+	require.NoError(t, flags.Parse([]string{"--upstream", "flag.internal:6432"}))
+
+	cfg, err := Load(path, flags)
+	require.NoError(t, err)
+	assert.Equal(t, "flag.internal:6432", cfg.Upstream.Address)
+	assert.Equal(t, ":6432", cfg.Server.Address)
+}
+
+func TestLoad_EnvOverridesFlags(t *testing.T) {
+	path := writeConfig(t, "enforcer.yml", `
+server:
+  address: ":6432"
+upstream:
+  address: file.internal:6432
+timeouts:
+  idle: 1m
+`)
+	t.Setenv("PQE_UPSTREAM_ADDRESS", "env.internal:6432")
+	t.Setenv("PQE_TIMEOUTS_READ", "45s")
+	t.Setenv("PQE_ETCD_ENDPOINTS", "etcd-0.internal:2379,etcd-1.internal:2379")
+	t.Setenv("PQE_QUOTA_ALERTS_THRESHOLDS", "80,100")
+	t.Setenv("PQE_POLICIES", `[{name: default, user: alice, limit: 1000, window: 1h}]`)
+	t.Setenv("PQE_AUTH_JWT_LABEL_CLAIMS", `{org_id: org}`)
+
+	flags := testFlags()
+	require.NoError(t, flags.Parse([]string{"--upstream", "flag.internal:6432", "--read-timeout", "5s"}))
+
+	cfg, err := Load(path, flags)
+	require.NoError(t, err)
+	assert.Equal(t, "env.internal:6432", cfg.Upstream.Address)
+	assert.Equal(t, 45*time.Second, cfg.Timeouts.Read)
+	assert.Equal(t, time.Minute, cfg.Timeouts.Idle)
+	assert.Equal(t, ":6432", cfg.Server.Address)
+	assert.Equal(t, []string{"etcd-0.internal:2379", "etcd-1.internal:2379"}, cfg.Etcd.Endpoints)
+	assert.Equal(t, []int{80, 100}, cfg.QuotaAlerts.Thresholds)
+	assert.Equal(t, []domain.QuotaPolicy{{Name: "default", User: "alice", Limit: 1000, Window: time.Hour}}, cfg.QuotaPolicies())
+	assert.Equal(t, map[string]string{"org_id": "org"}, cfg.Auth.JWT.LabelClaims)
+
+	t.Setenv("PQE_UPSTREAM_ADDR", "typo.internal:6432")
+	_, err = Load(path, flags)
+	assert.ErrorContains(t, err, "unknown environment variables: PQE_UPSTREAM_ADDR")
+}
+
+func TestEnvVar(t *testing.T) {
+	assert.Equal(t, "PQE_USAGE_STORE_DSN", EnvVar("usage_store.dsn"))
+	assert.Equal(t, "PQE_UPSTREAM_TLS_MODE", EnvVar("upstream.tls.mode"))
+	for name, setting := range envSettings() {
+		assert.Equal(t, name, EnvVar(setting.key))
+	}
+	assert.True(t, envSettings()["PQE_LISTENERS"].list)
+	assert.False(t, envSettings()["PQE_ETCD_ENDPOINTS"].list)
+	assert.True(t, envSettings()["PQE_AUTH_JWT_LABEL_CLAIMS"].mapping)
+}
+
+func TestLoad_WithoutFile(t *testing.T) {
+	cfg, err := Load("", testFlags())
+	require.NoError(t, err)
+	assert.Equal(t, ":5432", cfg.Server.Address)
+	assert.Equal(t, domain.DefaultUsageWeights(), cfg.ServerConfig().UsageWeights)
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{name: "unknown key", file: "enforcer.yaml", content: "server:\n  adress: \":6432\"\n"},
+		{name: "invalid policy", file: "enforcer.yaml", content: "policies:\n  - name: broken\n    window: 1m\n"},
+		{name: "duplicate policy", file: "enforcer.yaml", content: "policies:\n  - {name: a, limit: 1, window: 1m}\n  - {name: a, limit: 2, window: 1m}\n"},
+		{name: "unknown log level", file: "enforcer.yaml", content: "logging:\n  level: verbose\n"},
+		{name: "negative timeout", file: "enforcer.yaml", content: "timeouts:\n  read: -1s\n"},
+		{name: "TLS key without certificate", file: "enforcer.yaml", content: "tls:\n  key_file: server.key\n"},
+		{name: "TLS required without certificate", file: "enforcer.yaml", content: "tls:\n  require_users: [alice]\n"},
+		{name: "unknown upstream TLS mode", file: "enforcer.yaml", content: "upstream:\n  address: db:5432\n  tls:\n    mode: prefer\n"},
+		{name: "upstream TLS without upstream", file: "enforcer.yaml", content: "upstream:\n  tls:\n    mode: require\n"},
+		{name: "upstream client certificate without key", file: "enforcer.yaml", content: "upstream:\n  address: db:5432\n  tls:\n    mode: require\n    cert_file: client.crt\n"},
+		{name: "upstream credentials without auth file", file: "enforcer.yaml", content: "auth:\n  upstream_user: app\n"},
+		{name: "admin API without token", file: "enforcer.yaml", content: "admin:\n  address: 127.0.0.1:8080\n"},
+		{name: "negative audit rotation", file: "enforcer.yaml", content: "audit:\n  max_age: -1h\n"},
+		{name: "slow query sample rate over 1", file: "enforcer.yaml", content: "slow_queries:\n  sample_rate: 2\n"},
+		{name: "negative script timeout", file: "enforcer.yaml", content: "scripts:\n  files: [rules.lua]\n  timeout: -1s\n"},
+		{name: "unknown tenant value", file: "enforcer.yaml", content: "rewrite:\n  tenant_filter:\n    column: tenant_id\n    value: session\n    tables: [orders]\n"},
+		{name: "Kafka brokers without topic", file: "enforcer.yaml", content: "kafka:\n  brokers: [kafka:9092]\n"},
+		{name: "unknown Kafka key", file: "enforcer.yaml", content: "kafka:\n  brokers: [kafka:9092]\n  topic: events\n  key: database\n"},
+		{name: "Kafka TLS files without TLS", file: "enforcer.yaml", content: "kafka:\n  brokers: [kafka:9092]\n  topic: events\n  tls:\n    ca_file: ca.pem\n"},
+		{name: "unknown Kafka SASL mechanism", file: "enforcer.yaml", content: "kafka:\n  brokers: [kafka:9092]\n  topic: events\n  sasl:\n    mechanism: GSSAPI\n    username: enforcer\n"},
+		{name: "Kafka SASL without username", file: "enforcer.yaml", content: "kafka:\n  brokers: [kafka:9092]\n  topic: events\n  sasl:\n    mechanism: PLAIN\n"},
+		{name: "non-positive alert threshold", file: "enforcer.yaml", content: "quota_alerts:\n  thresholds: [0]\n"},
+		{name: "negative PgBouncer poll interval", file: "enforcer.yaml", content: "pgbouncer:\n  admin_url: postgres://pgbouncer/pgbouncer\n  poll_interval: -1s\n"},
+		{name: "tightening without target", file: "enforcer.yaml", content: "policies:\n  - {name: a, rate: 10, tighten_at: 80}\n"},
+		{name: "invalid access range", file: "enforcer.yaml", content: "access:\n  allow: [10.0.0.0/33]\n"},
+		{name: "invalid listener access range", file: "enforcer.yaml", content: "listeners:\n  - name: analytics\n    address: \":6433\"\n    deny: [analytics.internal]\n"},
+		{name: "webhook without URL", file: "enforcer.yaml", content: "webhooks:\n  - secret: s3cret\n"},
+		{name: "parameter label without position", file: "enforcer.yaml", content: "parameter_labels:\n  labels:\n    - label: tenant_id\n"},
+		{name: "unknown query log type", file: "enforcer.yaml", content: "query_logs:\n  - type: syslog\n"},
+		{name: "file query log without file", file: "enforcer.yaml", content: "query_logs:\n  - type: file\n"},
+		{name: "unknown query log decision", file: "enforcer.yaml", content: "query_logs:\n  - {type: stdout, decisions: [denied]}\n"},
+		{name: "kafka query log without kafka", file: "enforcer.yaml", content: "query_logs:\n  - type: kafka\n"},
+		{name: "unknown webhook event", file: "enforcer.yaml", content: "webhooks:\n  - url: https://alerts.internal\n    events: [quota_exceeded]\n"},
+		{name: "failover without upstream", file: "enforcer.yaml", content: "upstream:\n  failover:\n    address: standby:6432\n"},
+		{name: "negative failover cooldown", file: "enforcer.yaml", content: "upstream:\n  address: db:5432\n  failover:\n    address: standby:6432\n    cooldown: -1m\n"},
+		{name: "listener without name", file: "enforcer.yaml", content: "listeners:\n  - address: :6433\n"},
+		{name: "duplicate listener", file: "enforcer.yaml", content: "listeners:\n  - {name: a, address: \":6433\"}\n  - {name: a, address: \":6434\"}\n"},
+		{name: "negative query cache size", file: "enforcer.yaml", content: "server:\n  query_cache_size: -1\n"},
+		{name: "unknown normalizer", file: "enforcer.yaml", content: "server:\n  normalizer: regex\n"},
+		{name: "usage store with DSN and file", file: "enforcer.yaml", content: "usage_store:\n  dsn: postgres://quota-db/enforcer\n  file: quota.db\n"},
+		{name: "usage store with file and Redis", file: "enforcer.yaml", content: "usage_store:\n  file: quota.db\n  redis: redis://quota-redis\n"},
+		{name: "unknown usage consistency", file: "enforcer.yaml", content: "usage_store:\n  redis: redis://quota-redis\n  consistency: linearizable\n"},
+		{name: "strict usage in the background", file: "enforcer.yaml", content: "usage_store:\n  redis: redis://quota-redis\n  consistency: strict\n  async: true\n"},
+		{name: "negative etcd lease TTL", file: "enforcer.yaml", content: "etcd:\n  endpoints: [etcd:2379]\n  lease_ttl: -1s\n"},
+		{name: "unknown leader election", file: "enforcer.yaml", content: "housekeeping:\n  election: etcd\n"},
+		{name: "Redis leader election without Redis", file: "enforcer.yaml", content: "housekeeping:\n  election: redis\n"},
+		{name: "retention shorter than reports", file: "enforcer.yaml", content: "housekeeping:\n  report_interval: 24h\n  retention: 1h\n"},
+		{name: "unknown usage export format", file: "enforcer.yaml", content: "housekeeping:\n  export_format: xlsx\n"},
+		{name: "rate alert factor of one", file: "enforcer.yaml", content: "rate_alerts:\n  factor: 1\n"},
+		{name: "firewall enforcing without profiles", file: "enforcer.yaml", content: "firewall:\n  mode: enforce\n"},
+		{name: "negative query stats flush interval", file: "enforcer.yaml", content: "query_stats:\n  flush_interval: -1m\n"},
+		{name: "negative usage staleness", file: "enforcer.yaml", content: "usage_store:\n  async: true\n  staleness: -1s\n"},
+		{name: "message size over the protocol limit", file: "enforcer.yaml", content: "server:\n  max_message_size_mb: 4096\n"},
+		{name: "LDAP without base DN", file: "enforcer.yaml", content: "identity:\n  ldap:\n    url: ldap://ldap.internal\n"},
+		{name: "LDAP StartTLS on ldaps", file: "enforcer.yaml", content: "identity:\n  ldap:\n    url: ldaps://ldap.internal\n    base_dn: dc=example,dc=com\n    start_tls: true\n"},
+		{name: "GSS tunnel with auth file", file: "enforcer.yaml", content: "auth:\n  file: userlist.txt\nserver:\n  gss_encryption_tunnel: true\n"},
+		{name: "JWT password without upstream user", file: "enforcer.yaml", content: "auth:\n  jwt:\n    secret: s3cret\n"},
+		{name: "JWT with auth file", file: "enforcer.yaml", content: "auth:\n  file: userlist.txt\n  jwt:\n    secret: s3cret\n    parameter: jwt\n"},
+		{name: "pooling without auth file", file: "enforcer.yaml", content: "pool:\n  mode: transaction\n"},
+		{name: "unknown pool mode", file: "enforcer.yaml", content: "auth:\n  file: userlist.txt\npool:\n  mode: statement\n"},
+		{name: "listener without address", file: "enforcer.yaml", content: "listeners:\n  - name: analytics\n"},
+		{name: "database without name", file: "enforcer.yaml", content: "databases:\n  - database: app\n"},
+		{name: "duplicate database", file: "enforcer.yaml", content: "databases:\n  - {name: a, database: b}\n  - {name: a, database: c}\n"},
+		{name: "database without route", file: "enforcer.yaml", content: "databases:\n  - name: reporting\n"},
+		{name: "duplicate role", file: "enforcer.yaml", content: "roles:\n  - {name: a, users: [alice]}\n  - {name: a, users: [bob]}\n"},
+		{name: "scoped override", file: "enforcer.yaml", content: "policies:\n  - {name: a, tables: [audit.*], limit: 1, window: 1m, override: true}\n"},
+		{name: "soft limit with grace", file: "enforcer.yaml", content: "policies:\n  - {name: a, limit: 1, window: 1m, soft: true, grace: 1m}\n"},
+		{name: "policy of unknown listener", file: "enforcer.yaml", content: "policies:\n  - {name: a, listener: analytics, limit: 1, window: 1m}\n"},
+		{name: "unsupported format", file: "enforcer.json", content: "{}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tt.file, tt.content), testFlags())
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := Load(filepath.Join(t.TempDir(), "missing.yaml"), testFlags())
+	assert.Error(t, err)
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the name of the environment variables setting configuration
+// keys: PQE_ followed by the key in upper case, with dots as underscores, such as
+// PQE_UPSTREAM_ADDRESS for upstream.address
+const EnvPrefix = "PQE_"
+
+// EnvVar returns the environment variable setting key
+func EnvVar(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// envSetting is the key an environment variable sets
+type envSetting struct {
+	key     string
+	list    bool // a list of settings, such as policies, rather than of values
+	mapping bool // a map, such as the label claims, rather than a value
+}
+
+// envSettings maps the environment variables to the keys they set: every
+// setting, and the lists of settings as a whole
+func envSettings() map[string]envSetting {
+	settings := make(map[string]envSetting)
+	var walk func(t reflect.Type, prefix string)
+	walk = func(t reflect.Type, prefix string) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			key := prefix + field.Tag.Get("mapstructure")
+			if field.Type.Kind() == reflect.Struct {
+				walk(field.Type, key+".")
+				continue
+			}
+			list := field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Struct
+			settings[EnvVar(key)] = envSetting{key: key, list: list, mapping: field.Type.Kind() == reflect.Map}
+		}
+	}
+	walk(reflect.TypeOf(Config{}), "")
+	return settings
+}
+
+// applyEnv sets the keys of v from the environment variables of environ, as
+// NAME=value pairs. Lists take comma separated values, and lists of settings,
+// such as listeners or policies, and maps, such as the label claims, a YAML or
+// JSON document. Variables starting
+// with EnvPrefix that set no key are rejected, as unknown keys are.
+func applyEnv(v *viper.Viper, environ []string) error {
+	settings := envSettings()
+	var unknown []string
+	for _, pair := range environ {
+		name, value, _ := strings.Cut(pair, "=")
+		if !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+		setting, ok := settings[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+
+		if setting.list {
+			var list []interface{}
+			if err := yaml.Unmarshal([]byte(value), &list); err != nil {
+				return fmt.Errorf("failed to decode %s: %w", name, err)
+			}
+			v.Set(setting.key, list)
+			continue
+		}
+		if setting.mapping {
+			var mapping map[string]interface{}
+			if err := yaml.Unmarshal([]byte(value), &mapping); err != nil {
+				return fmt.Errorf("failed to decode %s: %w", name, err)
+			}
+			v.Set(setting.key, mapping)
+			continue
+		}
+		v.Set(setting.key, value)
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown environment variables: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
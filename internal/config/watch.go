@@ -0,0 +1,63 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce coalesces the bursts of events editors produce when saving a file
+const watchDebounce = 100 * time.Millisecond
+
+// Watch calls onChange after the file at path is written, created or replaced,
+// until ctx is cancelled. The parent directory is watched rather than the file, so
+// editors that save through a rename and Kubernetes ConfigMap updates, which swap
+// a ..data symlink, are noticed too. onChange runs on the watcher's goroutine.
+func Watch(ctx context.Context, path string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create config watcher: %w", err)
+	}
+
+	path = filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return fmt.Errorf("failed to watch %s: %w", path, err)
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Clean(event.Name)
+				if name != path && filepath.Base(name) != "..data" {
+					continue
+				}
+				if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Rename) {
+					debounce = time.After(watchDebounce)
+				}
+			case _, ok := <-watcher.Errors:
+				// Errors such as event queue overflows may drop a change; SIGHUP still reloads
+				if !ok {
+					return
+				}
+			case <-debounce:
+				debounce = nil
+				onChange()
+			}
+		}
+	}()
+
+	return nil
+}
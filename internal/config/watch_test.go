@@ -0,0 +1,48 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatch(t *testing.T) {
+	path := writeConfig(t, "enforcer.yaml", "server:\n  address: \":6432\"\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := make(chan struct{}, 10)
+	require.NoError(t, Watch(ctx, path, func() { changes <- struct{}{} }))
+
+	waitForChange := func(message string) {
+		t.Helper()
+		select {
+		case <-changes:
+		case <-time.After(2 * time.Second):
+			t.Fatal(message)
+		}
+	}
+
+	// Other files in the directory are ignored
+	require.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(path), "other.yaml"), []byte("x"), 0o600))
+
+	require.NoError(t, os.WriteFile(path, []byte("server:\n  address: \":7432\"\n"), 0o600))
+	waitForChange("An in-place write was not noticed")
+
+	// Editors often save by renaming a new file over the old one
+	replacement := filepath.Join(filepath.Dir(path), "enforcer.yaml.tmp")
+	require.NoError(t, os.WriteFile(replacement, []byte("server:\n  address: \":8432\"\n"), 0o600))
+	require.NoError(t, os.Rename(replacement, path))
+	waitForChange("A replaced file was not noticed")
+
+	select {
+	case <-changes:
+		t.Fatal("Each save should be reported once")
+	case <-time.After(3 * watchDebounce):
+	}
+}
@@ -0,0 +1,35 @@
+package adapters
+
+import (
+	"net"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+)
+
+// AccessListener is a net.Listener that only returns the connections the
+// access controller admits for the named listener. The others are closed as
+// soon as they are accepted, before anything is read from them, so rejecting
+// abusive clients costs neither a goroutine nor a protocol exchange.
+type AccessListener struct {
+	net.Listener
+	name   string
+	access domain.AccessController
+}
+
+// NewAccessListener wraps listener, serving the listener of the given name, with access
+func NewAccessListener(listener net.Listener, name string, access domain.AccessController) *AccessListener {
+	return &AccessListener{Listener: listener, name: name, access: access}
+}
+
+// Accept waits for the next connection the access controller admits
+func (l *AccessListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.access.AdmitAddress(l.name, conn.RemoteAddr()) {
+			return conn, nil
+		}
+		_ = conn.Close()
+	}
+}
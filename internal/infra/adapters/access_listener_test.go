@@ -0,0 +1,54 @@
+package adapters
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessListener(t *testing.T) {
+	access := &mocks.AccessController{}
+	access.On("AdmitAddress", "analytics", mock.Anything).Return(false).Once()
+	access.On("AdmitAddress", "analytics", mock.Anything).Return(true)
+
+	handled := make(chan struct{}, 2)
+	handler := mocks.ConnectionHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+		handled <- struct{}{}
+		return conn.Close()
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := NewStandardTCPServer(handler, logger.NewSimpleLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, server.Serve(ctx, []domain.Listener{{Name: "analytics", Listener: NewAccessListener(listener, "analytics", access)}}))
+	defer func() { _ = server.Stop(context.Background()) }()
+
+	rejected, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer rejected.Close()
+	require.NoError(t, rejected.SetReadDeadline(time.Now().Add(2*time.Second)))
+	_, err = rejected.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "A rejected connection should be closed at once")
+
+	admitted, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer admitted.Close()
+	select {
+	case <-handled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The admitted connection was not handled")
+	}
+	assert.Empty(t, handled, "The rejected connection should not reach the handler")
+	access.AssertNumberOfCalls(t, "AdmitAddress", 2)
+}
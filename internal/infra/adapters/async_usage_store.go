@@ -0,0 +1,313 @@
+package adapters
+
+import (
+	"context"
+	"hash/fnv"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAsyncUsageWorkers is how many goroutines apply increments to the wrapped store
+	DefaultAsyncUsageWorkers = 4
+
+	// DefaultAsyncUsageQueueSize is how many increments each worker buffers
+	DefaultAsyncUsageQueueSize = 1024
+
+	// DefaultUsageStaleness is how long counters read from the wrapped store are
+	// trusted before enforcement reads them again
+	DefaultUsageStaleness = time.Second
+
+	// asyncUsageBatchSize caps the increments a worker coalesces into one batch
+	asyncUsageBatchSize = 256
+
+	// asyncUsageTimeout bounds each call a worker makes to the wrapped store
+	asyncUsageTimeout = 5 * time.Second
+)
+
+// usageIncrement is an increment queued for the wrapped store
+type usageIncrement struct {
+	key    domain.UsageKey
+	window time.Duration
+	amount int64
+}
+
+// localUsage is the last usage of a key read from the wrapped store, and what
+// was recorded since and not applied to it yet
+type localUsage struct {
+	window  time.Duration
+	usage   domain.Usage
+	readAt  time.Time // zero when usage is an estimate that was never read
+	pending int64
+}
+
+// AsyncUsageStore implements domain.UsageStore in front of a slower store, so
+// that connections never wait for it to record usage. Increments are counted
+// locally and queued to a pool of workers, each owning a share of the keys so
+// that the increments of a key are applied in order; a worker coalesces what
+// is queued into one increment per key. Reads are answered from the local
+// counters until they are older than the staleness, then read from the store
+// again, plus what is still queued. Enforcement may therefore miss the usage
+// other enforcers recorded within the staleness. Increments only wait for the
+// store when a worker's queue is full, and the store's failures are logged and
+// the increments dropped.
+type AsyncUsageStore struct {
+	next      domain.UsageStore
+	clock     domain.Clock
+	logger    logger.Logger
+	staleness time.Duration
+	workers   int
+	queueSize int
+
+	mu     sync.Mutex
+	counts map[domain.UsageKey]*localUsage
+
+	// sendMu keeps the queues open while increments are sent to them
+	sendMu sync.RWMutex
+	closed bool
+	queues []chan usageIncrement
+	wg     sync.WaitGroup
+}
+
+// AsyncUsageStoreOption configures optional behavior of an AsyncUsageStore
+type AsyncUsageStoreOption func(*AsyncUsageStore)
+
+// WithUsageStaleness sets how long counters read from the store are trusted;
+// zero reads the store on every enforcement check
+func WithUsageStaleness(staleness time.Duration) AsyncUsageStoreOption {
+	return func(s *AsyncUsageStore) {
+		s.staleness = staleness
+	}
+}
+
+// WithAsyncUsageWorkers sets how many goroutines apply increments to the store
+func WithAsyncUsageWorkers(workers int) AsyncUsageStoreOption {
+	return func(s *AsyncUsageStore) {
+		s.workers = workers
+	}
+}
+
+// WithAsyncUsageQueueSize sets how many increments each worker buffers
+func WithAsyncUsageQueueSize(size int) AsyncUsageStoreOption {
+	return func(s *AsyncUsageStore) {
+		s.queueSize = size
+	}
+}
+
+// WithAsyncUsageClock sets the clock timing the staleness of counters
+func WithAsyncUsageClock(clock domain.Clock) AsyncUsageStoreOption {
+	return func(s *AsyncUsageStore) {
+		s.clock = clock
+	}
+}
+
+// NewAsyncUsageStore wraps next and starts the workers applying increments to
+// it. Close applies the queued increments and stops them; next is left open.
+func NewAsyncUsageStore(next domain.UsageStore, log logger.Logger, opts ...AsyncUsageStoreOption) *AsyncUsageStore {
+	store := &AsyncUsageStore{
+		next:      next,
+		clock:     SystemClock{},
+		logger:    log,
+		staleness: DefaultUsageStaleness,
+		workers:   DefaultAsyncUsageWorkers,
+		queueSize: DefaultAsyncUsageQueueSize,
+		counts:    make(map[domain.UsageKey]*localUsage),
+	}
+	for _, opt := range opts {
+		opt(store)
+	}
+	store.workers = max(store.workers, 1)
+
+	store.queues = make([]chan usageIncrement, store.workers)
+	for i := range store.queues {
+		store.queues[i] = make(chan usageIncrement, max(store.queueSize, 1))
+		store.wg.Add(1)
+		go store.run(store.queues[i])
+	}
+	return store
+}
+
+// Increment counts amount locally and queues it for the store. The usage
+// returned is the last usage read plus what was recorded since.
+func (s *AsyncUsageStore) Increment(ctx context.Context, key domain.UsageKey, window time.Duration, amount int64) (domain.Usage, error) {
+	s.sendMu.RLock()
+	defer s.sendMu.RUnlock()
+	if s.closed {
+		return s.next.Increment(ctx, key, window, amount)
+	}
+
+	now := s.clock.Now()
+	s.mu.Lock()
+	count := s.counts[key]
+	if count == nil || count.window != window || !now.Before(count.usage.ResetAt) {
+		// Until the store is read, the window is assumed to start now
+		count = &localUsage{window: window, usage: domain.Usage{ResetAt: now.Add(window)}, pending: s.pending(key)}
+		s.counts[key] = count
+	}
+	count.pending += amount
+	usage := domain.Usage{Used: count.usage.Used + count.pending, ResetAt: count.usage.ResetAt}
+	s.mu.Unlock()
+
+	if amount != 0 {
+		select {
+		case s.queues[s.worker(key)] <- usageIncrement{key: key, window: window, amount: amount}:
+		case <-ctx.Done():
+			s.settle(key, amount, nil)
+			return domain.Usage{}, ctx.Err()
+		}
+	}
+	return usage, nil
+}
+
+// Get returns the local usage of key while it is fresh, and reads it from the
+// store otherwise
+func (s *AsyncUsageStore) Get(ctx context.Context, key domain.UsageKey, window time.Duration) (domain.Usage, error) {
+	now := s.clock.Now()
+	s.mu.Lock()
+	if count := s.counts[key]; count != nil && count.window == window && !count.readAt.IsZero() &&
+		now.Sub(count.readAt) <= s.staleness && now.Before(count.usage.ResetAt) {
+		usage := domain.Usage{Used: count.usage.Used + count.pending, ResetAt: count.usage.ResetAt}
+		s.mu.Unlock()
+		return usage, nil
+	}
+	s.mu.Unlock()
+
+	usage, err := s.next.Get(ctx, key, window)
+	if err != nil {
+		return domain.Usage{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := s.counts[key]
+	if count == nil || count.window != window {
+		count = &localUsage{window: window, pending: s.pending(key)}
+		s.counts[key] = count
+	}
+	count.usage = usage
+	count.readAt = now
+	return domain.Usage{Used: usage.Used + count.pending, ResetAt: usage.ResetAt}, nil
+}
+
+// Reset forgets the local usage of key and resets it in the store. Increments
+// still queued are applied after the reset.
+func (s *AsyncUsageStore) Reset(ctx context.Context, key domain.UsageKey) error {
+	s.mu.Lock()
+	if count := s.counts[key]; count != nil {
+		s.counts[key] = &localUsage{window: count.window, pending: count.pending}
+	}
+	s.mu.Unlock()
+	return s.next.Reset(ctx, key)
+}
+
+// Ping checks the wrapped store when it depends on an external service
+func (s *AsyncUsageStore) Ping(ctx context.Context) error {
+	if pinger, ok := s.next.(domain.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// Close applies the queued increments and stops the workers; later increments
+// are applied synchronously
+func (s *AsyncUsageStore) Close() error {
+	s.sendMu.Lock()
+	if s.closed {
+		s.sendMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	for _, queue := range s.queues {
+		close(queue)
+	}
+	s.sendMu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// pending returns what is queued for key under a window it no longer counts in,
+// so it is not forgotten when the local counter is replaced; s.mu must be held
+func (s *AsyncUsageStore) pending(key domain.UsageKey) int64 {
+	if count := s.counts[key]; count != nil {
+		return count.pending
+	}
+	return 0
+}
+
+// worker returns the index of the worker applying the increments of key
+func (s *AsyncUsageStore) worker(key domain.UsageKey) int {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key.String()))
+	return int(hash.Sum32() % uint32(len(s.queues)))
+}
+
+// run applies the increments of queue, coalescing those already queued
+func (s *AsyncUsageStore) run(queue chan usageIncrement) {
+	defer s.wg.Done()
+
+	for first := range queue {
+		batch := []usageIncrement{first}
+	collect:
+		for len(batch) < asyncUsageBatchSize {
+			select {
+			case increment, ok := <-queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, increment)
+			default:
+				break collect
+			}
+		}
+		s.apply(batch)
+	}
+}
+
+// apply adds the increments of batch to the store, one call per key and window
+func (s *AsyncUsageStore) apply(batch []usageIncrement) {
+	type counter struct {
+		key    domain.UsageKey
+		window time.Duration
+	}
+	var order []counter
+	amounts := make(map[counter]int64)
+	for _, increment := range batch {
+		c := counter{key: increment.key, window: increment.window}
+		if _, ok := amounts[c]; !ok {
+			order = append(order, c)
+		}
+		amounts[c] += increment.amount
+	}
+
+	for _, c := range order {
+		ctx, cancel := context.WithTimeout(context.Background(), asyncUsageTimeout)
+		usage, err := s.next.Increment(ctx, c.key, c.window, amounts[c])
+		cancel()
+		if err != nil {
+			s.logger.Error("Failed to record usage of %s: %v", c.key, err)
+			s.settle(c.key, amounts[c], nil)
+			continue
+		}
+		s.settle(c.key, amounts[c], &usage)
+	}
+}
+
+// settle removes amount from the pending usage of key once applied or dropped,
+// and keeps the usage the store returned after applying it
+func (s *AsyncUsageStore) settle(key domain.UsageKey, amount int64, usage *domain.Usage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := s.counts[key]
+	if count == nil {
+		return
+	}
+	count.pending -= amount
+	if usage != nil {
+		// The store's usage includes amount, and what was applied before it
+		count.usage = *usage
+		count.readAt = s.clock.Now()
+	}
+}
@@ -0,0 +1,80 @@
+package adapters
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowUsageStore is a MemoryUsageStore whose increments wait for the gate to open
+type slowUsageStore struct {
+	*MemoryUsageStore
+	gate       chan struct{}
+	increments atomic.Int64
+	gets       atomic.Int64
+}
+
+func (s *slowUsageStore) Increment(ctx context.Context, key domain.UsageKey, window time.Duration, amount int64) (domain.Usage, error) {
+	<-s.gate
+	s.increments.Add(1)
+	return s.MemoryUsageStore.Increment(ctx, key, window, amount)
+}
+
+func (s *slowUsageStore) Get(ctx context.Context, key domain.UsageKey, window time.Duration) (domain.Usage, error) {
+	s.gets.Add(1)
+	return s.MemoryUsageStore.Get(ctx, key, window)
+}
+
+func TestAsyncUsageStore(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	next := &slowUsageStore{MemoryUsageStore: NewMemoryUsageStore(WithUsageStoreClock(clock)), gate: make(chan struct{})}
+	store := NewAsyncUsageStore(next, logger.NewSimpleLogger(), WithUsageStaleness(time.Second), WithAsyncUsageClock(clock))
+	key := domain.UsageKey{Policy: "p", User: "alice", Database: "app"}
+
+	usage, err := store.Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Zero(t, usage.Used)
+
+	// Increments return while the store is blocked, and are read back locally
+	for i := 0; i < 3; i++ {
+		usage, err = store.Increment(ctx, key, time.Hour, 2)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int64(6), usage.Used)
+	usage, err = store.Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), usage.Used)
+	assert.Equal(t, int64(1), next.gets.Load(), "Fresh counters should be read locally")
+
+	close(next.gate)
+	require.NoError(t, store.Close())
+	assert.LessOrEqual(t, next.increments.Load(), int64(2), "Queued increments should be coalesced")
+	stored, err := next.MemoryUsageStore.Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), stored.Used)
+
+	// Stale counters are read from the store again
+	_, err = next.MemoryUsageStore.Increment(ctx, key, time.Hour, 10)
+	require.NoError(t, err)
+	usage, err = store.Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), usage.Used)
+	clock.Advance(2 * time.Second)
+	usage, err = store.Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(16), usage.Used)
+
+	require.NoError(t, store.Reset(ctx, key))
+	usage, err = store.Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Zero(t, usage.Used)
+}
@@ -0,0 +1,407 @@
+package adapters
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditBackupTimeFormat stamps rotated audit files; it sorts chronologically
+const auditBackupTimeFormat = "2006-01-02T15-04-05.000"
+
+// AuditRecord is a line of the audit log: the outcome of an evaluated query. It is
+// also the JSON encoding of published query events.
+type AuditRecord struct {
+	Time            time.Time             `json:"time"` // when the query was received
+	Instance        string                `json:"instance,omitempty"`
+	ConnectionID    string                `json:"connection_id"`
+	User            string                `json:"user,omitempty"`
+	Database        string                `json:"database,omitempty"`
+	ApplicationName string                `json:"application_name,omitempty"`
+	Kind            domain.QueryKind      `json:"kind,omitempty"`
+	QueryHash       string                `json:"query_hash,omitempty"`
+	Normalized      string                `json:"normalized_query,omitempty"` // empty when normalization failed
+	Decision        domain.DecisionAction `json:"decision"`
+	Policy          string                `json:"policy,omitempty"`
+	Reason          string                `json:"reason,omitempty"`
+	DurationMs      float64               `json:"duration_ms"`
+	Rows            int64                 `json:"rows"`
+	Bytes           int64                 `json:"bytes"`
+}
+
+// newAuditRecord returns the record of a query event
+func newAuditRecord(event domain.QueryEvent) AuditRecord {
+	return AuditRecord{
+		Time:            event.Timestamp.UTC(),
+		Instance:        event.InstanceID,
+		ConnectionID:    event.ConnectionID,
+		User:            event.User,
+		Database:        event.Database,
+		ApplicationName: event.ApplicationName,
+		Kind:            event.Kind,
+		QueryHash:       event.QueryHash,
+		Normalized:      event.Normalized,
+		Decision:        event.Decision,
+		Policy:          event.Policy,
+		Reason:          event.Reason,
+		DurationMs:      float64(event.Duration.Microseconds()) / 1000,
+		Rows:            event.Rows,
+		Bytes:           event.Bytes,
+	}
+}
+
+// AuditLog implements domain.QueryLogger by appending a record of every evaluated
+// query to a JSON Lines file before delegating to the next QueryLogger. Records
+// are written through domain.DecisionLogger; the other events are only forwarded,
+// so literals never reach the audit log. It implements domain.SessionLogger on
+// behalf of the next logger.
+//
+// The file is rotated at the first record once it reaches its maximum size or
+// age: it is renamed with the time of the rotation, optionally compressed with
+// gzip in the background, and the oldest rotated files beyond the retention are
+// removed.
+type AuditLog struct {
+	next       domain.QueryLogger
+	path       string
+	clock      domain.Clock
+	instance   string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	rotated      sync.WaitGroup
+	archiveMu    sync.Mutex // serializes compressing and pruning rotated files
+	archiveQueue []string   // rotated files awaiting archiving, oldest first
+	archiveErr   error
+}
+
+// AuditLogOption configures optional behavior of an AuditLog
+type AuditLogOption func(*AuditLog)
+
+// WithAuditMaxSize rotates the audit log before it grows beyond size bytes
+func WithAuditMaxSize(size int64) AuditLogOption {
+	return func(l *AuditLog) {
+		l.maxSize = size
+	}
+}
+
+// WithAuditMaxAge rotates the audit log once it has been written to for age
+func WithAuditMaxAge(age time.Duration) AuditLogOption {
+	return func(l *AuditLog) {
+		l.maxAge = age
+	}
+}
+
+// WithAuditMaxBackups keeps at most count rotated files; zero keeps them all
+func WithAuditMaxBackups(count int) AuditLogOption {
+	return func(l *AuditLog) {
+		l.maxBackups = count
+	}
+}
+
+// WithAuditCompression compresses rotated files with gzip
+func WithAuditCompression() AuditLogOption {
+	return func(l *AuditLog) {
+		l.compress = true
+	}
+}
+
+// WithAuditInstance records the enforcer instance ID in every record
+func WithAuditInstance(instanceID string) AuditLogOption {
+	return func(l *AuditLog) {
+		l.instance = instanceID
+	}
+}
+
+// WithAuditClock sets the clock that times rotations
+func WithAuditClock(clock domain.Clock) AuditLogOption {
+	return func(l *AuditLog) {
+		l.clock = clock
+	}
+}
+
+// NewAuditLog opens the audit log at path for appending, creating it if needed.
+// The next logger may be nil.
+func NewAuditLog(path string, next domain.QueryLogger, opts ...AuditLogOption) (*AuditLog, error) {
+	l := &AuditLog{
+		next:  next,
+		path:  path,
+		clock: SystemClock{},
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.maxSize < 0 || l.maxAge < 0 || l.maxBackups < 0 {
+		return nil, fmt.Errorf("audit log rotation limits must not be negative")
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the file at path for appending
+func (l *AuditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	l.file = file
+	l.size = info.Size()
+	l.opened = l.clock.Now()
+	return nil
+}
+
+// LogQuery forwards the query to the next logger
+func (l *AuditLog) LogQuery(connectionID string, query string) error {
+	if l.next != nil {
+		return l.next.LogQuery(connectionID, query)
+	}
+	return nil
+}
+
+// LogNormalizedQuery forwards the normalized query to the next logger
+func (l *AuditLog) LogNormalizedQuery(connectionID string, normalizedQuery domain.NormalizedQuery) error {
+	if l.next != nil {
+		return l.next.LogNormalizedQuery(connectionID, normalizedQuery)
+	}
+	return nil
+}
+
+// LogProtocolMessage forwards the protocol message to the next logger
+func (l *AuditLog) LogProtocolMessage(connectionID string, messageType string, details map[string]interface{}) error {
+	if l.next != nil {
+		return l.next.LogProtocolMessage(connectionID, messageType, details)
+	}
+	return nil
+}
+
+// StartSession forwards the session to the next logger when it attributes sessions.
+// Records carry the user and database of their query.
+func (l *AuditLog) StartSession(session domain.Session) error {
+	if sessionLogger, ok := l.next.(domain.SessionLogger); ok {
+		return sessionLogger.StartSession(session)
+	}
+	return nil
+}
+
+// EndSession forwards the end of the session to the next logger
+func (l *AuditLog) EndSession(connectionID string) {
+	if sessionLogger, ok := l.next.(domain.SessionLogger); ok {
+		sessionLogger.EndSession(connectionID)
+	}
+}
+
+// LogDecision appends the record of the query and forwards the decision to the
+// next logger when it records decisions
+func (l *AuditLog) LogDecision(query *domain.Query, decision domain.Decision, usage domain.StatementUsage) error {
+	if err := l.write(newAuditRecord(newQueryEvent(l.instance, query, decision, usage))); err != nil {
+		return err
+	}
+
+	if decisionLogger, ok := l.next.(domain.DecisionLogger); ok {
+		return decisionLogger.LogDecision(query, decision, usage)
+	}
+	return nil
+}
+
+// write appends a record, rotating the file first when it is due
+func (l *AuditLog) write(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit record: %w", err)
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return fmt.Errorf("audit log is closed")
+	}
+
+	now := l.clock.Now()
+	full := l.maxSize > 0 && l.size+int64(len(line)) > l.maxSize
+	expired := l.maxAge > 0 && now.Sub(l.opened) >= l.maxAge
+	if l.size > 0 && (full || expired) {
+		if err := l.rotate(now); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	return nil
+}
+
+// rotate renames the current file after now and starts a new one. Archiving the
+// rotated file happens in the background.
+func (l *AuditLog) rotate(now time.Time) error {
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %w", err)
+	}
+	l.file = nil
+
+	ext := filepath.Ext(l.path)
+	backup := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(l.path, ext), now.UTC().Format(auditBackupTimeFormat), ext)
+	if err := os.Rename(l.path, backup); err != nil {
+		// Keep appending to the current file rather than losing records
+		if openErr := l.open(); openErr != nil {
+			return openErr
+		}
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+
+	l.archiveMu.Lock()
+	l.archiveQueue = append(l.archiveQueue, backup)
+	l.archiveMu.Unlock()
+
+	l.rotated.Add(1)
+	go func() {
+		defer l.rotated.Done()
+		l.archive()
+	}()
+	return nil
+}
+
+// archive compresses the oldest rotated file awaiting it when configured and
+// removes the oldest rotated files beyond the retention
+func (l *AuditLog) archive() {
+	l.archiveMu.Lock()
+	defer l.archiveMu.Unlock()
+
+	backup := l.archiveQueue[0]
+	l.archiveQueue = l.archiveQueue[1:]
+
+	// Pruning may have removed it already when rotations outpace archiving
+	if l.compress {
+		if err := compressFile(backup); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			l.archiveErr = errors.Join(l.archiveErr, err)
+		}
+	}
+	if l.maxBackups > 0 {
+		if err := l.prune(); err != nil {
+			l.archiveErr = errors.Join(l.archiveErr, err)
+		}
+	}
+}
+
+// prune removes the oldest rotated files beyond maxBackups
+func (l *AuditLog) prune() error {
+	backups, err := l.backups()
+	if err != nil {
+		return err
+	}
+
+	var errs error
+	for len(backups) > l.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("failed to remove rotated audit log: %w", err))
+		}
+		backups = backups[1:]
+	}
+	return errs
+}
+
+// backups returns the rotated files of the audit log, oldest first
+func (l *AuditLog) backups() ([]string, error) {
+	ext := filepath.Ext(l.path)
+	prefix := filepath.Base(strings.TrimSuffix(l.path, ext)) + "-"
+	entries, err := os.ReadDir(filepath.Dir(l.path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rotated audit logs: %w", err)
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		stamp, ok := strings.CutPrefix(name, prefix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		stamp = strings.TrimSuffix(strings.TrimSuffix(stamp, ".gz"), ext)
+		if _, err := time.Parse(auditBackupTimeFormat, stamp); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(filepath.Dir(l.path), name))
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// compressFile replaces a file with its gzip-compressed copy
+func compressFile(path string) (err error) {
+	source, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to compress rotated audit log: %w", err)
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to compress rotated audit log: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = target.Close()
+			_ = os.Remove(path + ".gz")
+		}
+	}()
+
+	compressed := gzip.NewWriter(target)
+	if _, err := io.Copy(compressed, source); err != nil {
+		return fmt.Errorf("failed to compress rotated audit log: %w", err)
+	}
+	if err := compressed.Close(); err != nil {
+		return fmt.Errorf("failed to compress rotated audit log: %w", err)
+	}
+	if err := target.Close(); err != nil {
+		return fmt.Errorf("failed to compress rotated audit log: %w", err)
+	}
+	return os.Remove(path)
+}
+
+// Close closes the audit log once the rotated files are archived, and reports
+// any archiving failure
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	var err error
+	if l.file != nil {
+		err = l.file.Close()
+		l.file = nil
+	}
+	l.mu.Unlock()
+
+	l.rotated.Wait()
+	l.archiveMu.Lock()
+	defer l.archiveMu.Unlock()
+	return errors.Join(err, l.archiveErr)
+}
@@ -0,0 +1,153 @@
+package adapters
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readAuditRecords decodes the records of an audit log file, gzip-compressed or not
+func readAuditRecords(t *testing.T, path string) []AuditRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var reader io.Reader = file
+	if filepath.Ext(path) == ".gz" {
+		gz, err := gzip.NewReader(file)
+		require.NoError(t, err)
+		defer gz.Close()
+		reader = gz
+	}
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		var record AuditRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func auditQuery(raw string) *domain.Query {
+	query := domain.NewQuery(raw, "conn_1")
+	query.Kind = domain.QueryKindSimple
+	query.UserID = "alice"
+	query.Database = "app"
+	query.Normalized = raw
+	query.Hash = domain.NewQueryHash("hash-" + raw)
+	return query
+}
+
+func TestAuditLog_Records(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	next := mocks.NewRecordingQueryLogger()
+
+	audit, err := NewAuditLog(path, next, WithAuditInstance("enforcer-1"))
+	require.NoError(t, err)
+
+	require.NoError(t, audit.LogQuery("conn_1", "SELECT 1"))
+	require.NoError(t, audit.LogDecision(auditQuery("SELECT $1"), domain.AllowDecision(),
+		domain.StatementUsage{Rows: 3, Bytes: 42, Duration: 1500 * time.Microsecond}))
+	require.NoError(t, audit.LogDecision(auditQuery("DELETE FROM t"), domain.Decision{
+		Action: domain.DecisionDeny, Policy: "writes", Reason: "quota exceeded",
+	}, domain.StatementUsage{}))
+	require.NoError(t, audit.Close())
+
+	assert.Equal(t, []string{"SELECT 1"}, next.Queries(), "Events should be forwarded")
+
+	records := readAuditRecords(t, path)
+	require.Len(t, records, 2)
+	assert.Equal(t, "enforcer-1", records[0].Instance)
+	assert.Equal(t, "conn_1", records[0].ConnectionID)
+	assert.Equal(t, "alice", records[0].User)
+	assert.Equal(t, "app", records[0].Database)
+	assert.Equal(t, "hash-SELECT $1", records[0].QueryHash)
+	assert.Equal(t, domain.DecisionAllow, records[0].Decision)
+	assert.Equal(t, 1.5, records[0].DurationMs)
+	assert.Equal(t, int64(3), records[0].Rows)
+	assert.Equal(t, domain.DecisionDeny, records[1].Decision)
+	assert.Equal(t, "writes", records[1].Policy)
+	assert.Equal(t, "quota exceeded", records[1].Reason)
+
+	// Reopening appends to the existing file
+	audit, err = NewAuditLog(path, nil)
+	require.NoError(t, err)
+	require.NoError(t, audit.LogDecision(auditQuery("SELECT 2"), domain.AllowDecision(), domain.StatementUsage{}))
+	require.NoError(t, audit.Close())
+	assert.Len(t, readAuditRecords(t, path), 3)
+}
+
+func TestAuditLog_RotatesBySize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	clock := testkit.NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	audit, err := NewAuditLog(path, nil, WithAuditMaxSize(300), WithAuditMaxBackups(2),
+		WithAuditCompression(), WithAuditClock(clock))
+	require.NoError(t, err)
+
+	for i := 0; i < 8; i++ {
+		clock.Advance(time.Second)
+		require.NoError(t, audit.LogDecision(auditQuery("SELECT 1"), domain.AllowDecision(), domain.StatementUsage{}))
+	}
+	require.NoError(t, audit.Close())
+
+	backups, err := filepath.Glob(filepath.Join(dir, "audit-*.jsonl.gz"))
+	require.NoError(t, err)
+	sort.Strings(backups)
+	require.Len(t, backups, 2, "Only the newest rotated files are kept")
+	uncompressed, err := filepath.Glob(filepath.Join(dir, "audit-*.jsonl"))
+	require.NoError(t, err)
+	assert.Empty(t, uncompressed, "Rotated files are compressed")
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, info.Size(), int64(300))
+
+	// The newest records are in the current file, preceded by the newest backup
+	current := readAuditRecords(t, path)
+	require.NotEmpty(t, current)
+	previous := readAuditRecords(t, backups[1])
+	require.NotEmpty(t, previous)
+	assert.True(t, previous[len(previous)-1].Time.Before(current[0].Time) ||
+		previous[len(previous)-1].Time.Equal(current[0].Time))
+}
+
+func TestAuditLog_RotatesByAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	clock := testkit.NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	audit, err := NewAuditLog(path, nil, WithAuditMaxAge(time.Hour), WithAuditClock(clock))
+	require.NoError(t, err)
+
+	require.NoError(t, audit.LogDecision(auditQuery("SELECT 1"), domain.AllowDecision(), domain.StatementUsage{}))
+	clock.Advance(30 * time.Minute)
+	require.NoError(t, audit.LogDecision(auditQuery("SELECT 2"), domain.AllowDecision(), domain.StatementUsage{}))
+	clock.Advance(30 * time.Minute)
+	require.NoError(t, audit.LogDecision(auditQuery("SELECT 3"), domain.AllowDecision(), domain.StatementUsage{}))
+	require.NoError(t, audit.Close())
+
+	backup := filepath.Join(dir, "audit-2024-01-01T13-00-00.000.jsonl")
+	assert.Len(t, readAuditRecords(t, backup), 2)
+	records := readAuditRecords(t, path)
+	require.Len(t, records, 1)
+	assert.Equal(t, "SELECT 3", records[0].Normalized)
+}
@@ -0,0 +1,161 @@
+package adapters
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// DefaultParameterLabelSize is the largest bound value, in bytes, taken as a label
+const DefaultParameterLabelSize = 64
+
+// labelNamePattern is the syntax of label names
+var labelNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// ParameterLabel labels the executions of prepared statements with a value
+// bound to them, so that policies on that label apply per value: with
+// {Label: "tenant_id", Position: 1}, executing WHERE tenant_id = $1 with 42
+// matches the policies with the label tenant_id: "42".
+type ParameterLabel struct {
+	// Label is the name of the label set on the execution
+	Label string
+
+	// Position is the parameter holding the value, from 1 for $1
+	Position int
+
+	// Fingerprints scope the label to the statements with one of these query
+	// hashes; empty takes the value from every statement with that many parameters
+	Fingerprints []string
+}
+
+// Validate checks that the label is usable
+func (l ParameterLabel) Validate() error {
+	if !labelNamePattern.MatchString(l.Label) {
+		return fmt.Errorf("invalid parameter label name %q", l.Label)
+	}
+	if l.Position < 1 || l.Position > math.MaxUint16 {
+		return fmt.Errorf("parameter label %s must name a parameter position from 1 to %d", l.Label, math.MaxUint16)
+	}
+	return nil
+}
+
+// applies reports whether the label is taken from the statement with the fingerprint
+func (l ParameterLabel) applies(fingerprint string) bool {
+	if len(l.Fingerprints) == 0 {
+		return true
+	}
+	for _, candidate := range l.Fingerprints {
+		if candidate == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// parameterLabels returns the labels of the Bind of a statement with the given
+// fingerprint and parameter types. NULLs, values that cannot be decoded and
+// values over maxSize bytes set no label.
+func parameterLabels(labels []ParameterLabel, maxSize int, fingerprint string, oids []uint32, bind *pgproto3.Bind) map[string]string {
+	var values map[string]string
+	for _, label := range labels {
+		if !label.applies(fingerprint) || label.Position > len(bind.Parameters) {
+			continue
+		}
+		i := label.Position - 1
+		parameter := bind.Parameters[i]
+		if parameter == nil {
+			continue
+		}
+		var oid uint32
+		if i < len(oids) {
+			oid = oids[i]
+		}
+		value, ok := decodeParameter(parameter, parameterFormat(bind, i), oid)
+		if !ok || len(value) > maxSize {
+			continue
+		}
+		if values == nil {
+			values = make(map[string]string)
+		}
+		values[label.Label] = value
+	}
+	return values
+}
+
+// parameterFormat returns the format code of the i-th parameter of a Bind
+func parameterFormat(bind *pgproto3.Bind, i int) int16 {
+	// No format codes means text for all; a single one applies to all
+	switch len(bind.ParameterFormatCodes) {
+	case 0:
+		return pgproto3.TextFormat
+	case 1:
+		return bind.ParameterFormatCodes[0]
+	default:
+		if i < len(bind.ParameterFormatCodes) {
+			return bind.ParameterFormatCodes[i]
+		}
+		return pgproto3.TextFormat
+	}
+}
+
+// decodeParameter returns the text form of a bound value. Binary values are
+// decoded according to the type the statement declared for them; those of
+// undeclared or other types cannot be decoded.
+func decodeParameter(value []byte, format int16, oid uint32) (string, bool) {
+	if format == pgproto3.TextFormat {
+		return string(value), true
+	}
+
+	switch oid {
+	case pgtype.TextOID, pgtype.VarcharOID, pgtype.BPCharOID, pgtype.NameOID:
+		return string(value), true
+	case pgtype.BoolOID:
+		if len(value) == 1 {
+			return strconv.FormatBool(value[0] != 0), true
+		}
+	case pgtype.Int2OID:
+		if len(value) == 2 {
+			return strconv.FormatInt(int64(int16(binary.BigEndian.Uint16(value))), 10), true
+		}
+	case pgtype.Int4OID:
+		if len(value) == 4 {
+			return strconv.FormatInt(int64(int32(binary.BigEndian.Uint32(value))), 10), true
+		}
+	case pgtype.OIDOID:
+		if len(value) == 4 {
+			return strconv.FormatUint(uint64(binary.BigEndian.Uint32(value)), 10), true
+		}
+	case pgtype.Int8OID:
+		if len(value) == 8 {
+			return strconv.FormatInt(int64(binary.BigEndian.Uint64(value)), 10), true
+		}
+	case pgtype.Float4OID:
+		if len(value) == 4 {
+			return strconv.FormatFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(value))), 'g', -1, 32), true
+		}
+	case pgtype.Float8OID:
+		if len(value) == 8 {
+			return strconv.FormatFloat(math.Float64frombits(binary.BigEndian.Uint64(value)), 'g', -1, 64), true
+		}
+	case pgtype.UUIDOID:
+		if len(value) == 16 {
+			return fmt.Sprintf("%x-%x-%x-%x-%x", value[0:4], value[4:6], value[6:8], value[8:10], value[10:16]), true
+		}
+	}
+	return "", false
+}
+
+// redactLabels replaces the values of labels taken from parameters with their
+// size, for the protocol log
+func redactLabels(labels map[string]string) map[string]string {
+	redacted := make(map[string]string, len(labels))
+	for name, value := range labels {
+		redacted[name] = fmt.Sprintf("<%d bytes>", len(value))
+	}
+	return redacted
+}
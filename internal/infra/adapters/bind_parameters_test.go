@@ -0,0 +1,47 @@
+package adapters
+
+import (
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeParameter(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    []byte
+		format   int16
+		oid      uint32
+		expected string
+		ok       bool
+	}{
+		{name: "text", value: []byte("42"), format: pgproto3.TextFormat, expected: "42", ok: true},
+		{name: "int2", value: []byte{0xff, 0xfe}, format: pgproto3.BinaryFormat, oid: pgtype.Int2OID, expected: "-2", ok: true},
+		{name: "int4", value: []byte{0, 0, 1, 0}, format: pgproto3.BinaryFormat, oid: pgtype.Int4OID, expected: "256", ok: true},
+		{name: "int8", value: []byte{0, 0, 0, 0, 0, 0, 0, 7}, format: pgproto3.BinaryFormat, oid: pgtype.Int8OID, expected: "7", ok: true},
+		{name: "bool", value: []byte{1}, format: pgproto3.BinaryFormat, oid: pgtype.BoolOID, expected: "true", ok: true},
+		{name: "float8", value: []byte{0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, format: pgproto3.BinaryFormat, oid: pgtype.Float8OID, expected: "1.5", ok: true},
+		{name: "varchar", value: []byte("acme"), format: pgproto3.BinaryFormat, oid: pgtype.VarcharOID, expected: "acme", ok: true},
+		{
+			name:     "uuid",
+			value:    []byte{0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00},
+			format:   pgproto3.BinaryFormat,
+			oid:      pgtype.UUIDOID,
+			expected: "123e4567-e89b-12d3-a456-426614174000",
+			ok:       true,
+		},
+		{name: "truncated int4", value: []byte{0, 1}, format: pgproto3.BinaryFormat, oid: pgtype.Int4OID},
+		{name: "undeclared type", value: []byte{0, 0, 0, 1}, format: pgproto3.BinaryFormat},
+		{name: "other type", value: []byte{0, 0, 0, 1}, format: pgproto3.BinaryFormat, oid: pgtype.NumericOID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, ok := decodeParameter(tt.value, tt.format, tt.oid)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.expected, value)
+		})
+	}
+}
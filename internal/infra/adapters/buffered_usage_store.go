@@ -0,0 +1,416 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultUsageFlushInterval is how often buffered usage is written
+	DefaultUsageFlushInterval = time.Second
+
+	// DefaultUsageFlushThreshold is the number of buffered counters that triggers
+	// a flush before the interval elapses
+	DefaultUsageFlushThreshold = 1000
+
+	// usageFlushTimeout bounds a single background flush
+	usageFlushTimeout = 10 * time.Second
+)
+
+// usageRow identifies the counter of a key within the window starting at start
+type usageRow struct {
+	key   domain.UsageKey
+	start int64 // unix microseconds, the precision of timestamptz
+}
+
+// pendingUsage is usage recorded in memory and not yet written to the table
+type pendingUsage struct {
+	end   time.Time
+	delta int64
+}
+
+// persistedUsage is the last total read from or written to the table for a key
+type persistedUsage struct {
+	start int64
+	used  int64
+}
+
+// usageDelta is an increment written by a flush
+type usageDelta struct {
+	key   domain.UsageKey
+	start time.Time
+	end   time.Time
+	delta int64
+}
+
+// usageTable reads and writes the usage counters of a bufferedUsageStore
+type usageTable interface {
+	// load returns the persisted usage of key in the window starting at start, zero when absent
+	load(ctx context.Context, key domain.UsageKey, start time.Time) (int64, error)
+
+	// upsert adds every delta to its counter in one statement and returns the
+	// resulting totals in the order of deltas
+	upsert(ctx context.Context, deltas []usageDelta) ([]int64, error)
+
+	// delete removes the counters of key in every window
+	delete(ctx context.Context, key domain.UsageKey) error
+}
+
+// usageHistoryTable is implemented by usage tables keeping the counters of
+// elapsed windows until they are compacted
+type usageHistoryTable interface {
+	// ended returns the counters of the windows ending in (from, to]
+	ended(ctx context.Context, from, to time.Time) ([]domain.WindowUsage, error)
+
+	// compact removes the counters of the windows ending before before
+	compact(ctx context.Context, before time.Time) (int64, error)
+}
+
+// bufferedUsageStore implements domain.UsageStore with the counters of a
+// usageTable, whichever database keeps them. Increments are buffered in memory
+// and written in batches, every flush interval or once the flush threshold is
+// reached, instead of one write per query. Usage recorded by other enforcers is
+// picked up when a batch is written, so a quota may be exceeded by what the
+// enforcers record within one flush interval. A maximum pending amount bounds
+// what each enforcer holds back per counter, and strict usage writes every
+// increment through instead, so that quotas are enforced exactly across
+// enforcers at the cost of a write per query.
+type bufferedUsageStore struct {
+	table          usageTable
+	clock          domain.Clock
+	logger         logger.Logger
+	flushInterval  time.Duration
+	flushThreshold int
+	maxPending     int64 // zero leaves pending usage unbounded
+	strict         bool
+
+	mu        sync.Mutex
+	persisted map[domain.UsageKey]persistedUsage
+	pending   map[usageRow]pendingUsage
+
+	// flushMu orders flushes, resets and strict writes so a reset is not undone
+	// by a batch in flight
+	flushMu   sync.RWMutex
+	flushNow  chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// BufferedUsageStoreOption configures how the PostgreSQL, SQLite and Redis usage
+// stores buffer increments
+type BufferedUsageStoreOption func(*bufferedUsageStore)
+
+// WithUsageFlushInterval sets how often buffered usage is written
+func WithUsageFlushInterval(interval time.Duration) BufferedUsageStoreOption {
+	return func(s *bufferedUsageStore) {
+		s.flushInterval = interval
+	}
+}
+
+// WithUsageFlushThreshold sets the number of buffered counters that triggers an early flush
+func WithUsageFlushThreshold(threshold int) BufferedUsageStoreOption {
+	return func(s *bufferedUsageStore) {
+		s.flushThreshold = threshold
+	}
+}
+
+// WithUsageMaxPending bounds the usage of a counter held back in memory: an
+// increment reaching it writes the buffered usage before returning
+func WithUsageMaxPending(amount int64) BufferedUsageStoreOption {
+	return func(s *bufferedUsageStore) {
+		s.maxPending = amount
+	}
+}
+
+// WithStrictUsage writes every increment through and reads usage back from the
+// table on every check, instead of buffering
+func WithStrictUsage() BufferedUsageStoreOption {
+	return func(s *bufferedUsageStore) {
+		s.strict = true
+	}
+}
+
+// WithBufferedUsageClock sets the clock used to select windows and schedule flushes
+func WithBufferedUsageClock(clock domain.Clock) BufferedUsageStoreOption {
+	return func(s *bufferedUsageStore) {
+		s.clock = clock
+	}
+}
+
+// newBufferedUsageStore creates a store writing to table and starts its flush loop
+func newBufferedUsageStore(table usageTable, log logger.Logger, opts ...BufferedUsageStoreOption) *bufferedUsageStore {
+	store := &bufferedUsageStore{
+		table:          table,
+		clock:          SystemClock{},
+		logger:         log,
+		flushInterval:  DefaultUsageFlushInterval,
+		flushThreshold: DefaultUsageFlushThreshold,
+		persisted:      make(map[domain.UsageKey]persistedUsage),
+		pending:        make(map[usageRow]pendingUsage),
+		flushNow:       make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(store)
+	}
+
+	go store.run()
+	return store
+}
+
+// Increment adds amount to the buffered counter of the current window. The usage
+// returned includes increments that have not been written yet.
+func (s *bufferedUsageStore) Increment(ctx context.Context, key domain.UsageKey, window time.Duration, amount int64) (domain.Usage, error) {
+	if s.strict {
+		return s.writeThrough(ctx, key, window, amount)
+	}
+	start, end, err := s.window(ctx, key, window)
+	if err != nil {
+		return domain.Usage{}, err
+	}
+
+	row := usageRow{key: key, start: start.UnixMicro()}
+
+	s.mu.Lock()
+	if amount != 0 {
+		pending := s.pending[row]
+		s.pending[row] = pendingUsage{end: end, delta: pending.delta + amount}
+	}
+	used := s.used(row)
+	held := s.pending[row].delta
+	buffered := len(s.pending)
+	s.mu.Unlock()
+
+	if s.maxPending > 0 && held >= s.maxPending {
+		if err := s.Flush(ctx); err != nil {
+			return domain.Usage{}, err
+		}
+		s.mu.Lock()
+		used = s.used(row)
+		s.mu.Unlock()
+	} else if buffered >= s.flushThreshold {
+		select {
+		case s.flushNow <- struct{}{}:
+		default:
+		}
+	}
+
+	return domain.Usage{Used: used, ResetAt: end}, nil
+}
+
+// Get returns the usage of the current window, including buffered increments
+func (s *bufferedUsageStore) Get(ctx context.Context, key domain.UsageKey, window time.Duration) (domain.Usage, error) {
+	if s.strict {
+		return s.writeThrough(ctx, key, window, 0)
+	}
+	start, end, err := s.window(ctx, key, window)
+	if err != nil {
+		return domain.Usage{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return domain.Usage{Used: s.used(usageRow{key: key, start: start.UnixMicro()}), ResetAt: end}, nil
+}
+
+// Reset clears the counters of key, buffered and persisted
+func (s *bufferedUsageStore) Reset(ctx context.Context, key domain.UsageKey) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	delete(s.persisted, key)
+	for row := range s.pending {
+		if row.key == key {
+			delete(s.pending, row)
+		}
+	}
+	s.mu.Unlock()
+
+	if err := s.table.delete(ctx, key); err != nil {
+		return fmt.Errorf("failed to reset usage of %s: %w", key, err)
+	}
+	return nil
+}
+
+// Flush writes the buffered usage in a single batch and refreshes the totals of
+// the flushed counters. Usage stays buffered when the write fails.
+func (s *bufferedUsageStore) Flush(ctx context.Context) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	rows := make([]usageRow, 0, len(s.pending))
+	deltas := make([]usageDelta, 0, len(s.pending))
+	for row, pending := range s.pending {
+		rows = append(rows, row)
+		deltas = append(deltas, usageDelta{
+			key:   row.key,
+			start: time.UnixMicro(row.start).UTC(),
+			end:   pending.end,
+			delta: pending.delta,
+		})
+	}
+	s.mu.Unlock()
+
+	if len(deltas) == 0 {
+		return nil
+	}
+
+	totals, err := s.table.upsert(ctx, deltas)
+	if err != nil {
+		return fmt.Errorf("failed to flush usage: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, row := range rows {
+		// Increments recorded while the batch was written stay buffered
+		pending := s.pending[row]
+		if pending.delta -= deltas[i].delta; pending.delta != 0 {
+			s.pending[row] = pending
+		} else {
+			delete(s.pending, row)
+		}
+
+		if persisted, ok := s.persisted[row.key]; ok && persisted.start == row.start {
+			s.persisted[row.key] = persistedUsage{start: row.start, used: totals[i]}
+		}
+	}
+	return nil
+}
+
+// Close stops the flush loop and writes the buffered usage
+func (s *bufferedUsageStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+
+		ctx, cancel := context.WithTimeout(context.Background(), usageFlushTimeout)
+		defer cancel()
+		err = s.Flush(ctx)
+	})
+	return err
+}
+
+// Ended implements domain.UsageHistory with the counters written so far, when
+// the table keeps elapsed windows; usage still buffered by enforcers is not
+// included
+func (s *bufferedUsageStore) Ended(ctx context.Context, from, to time.Time) ([]domain.WindowUsage, error) {
+	history, ok := s.table.(usageHistoryTable)
+	if !ok {
+		return nil, errors.New("the usage store keeps no elapsed windows")
+	}
+	windows, err := history.ended(ctx, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read elapsed usage: %w", err)
+	}
+	return windows, nil
+}
+
+// Compact implements domain.UsageHistory
+func (s *bufferedUsageStore) Compact(ctx context.Context, before time.Time) (int64, error) {
+	history, ok := s.table.(usageHistoryTable)
+	if !ok {
+		return 0, errors.New("the usage store keeps no elapsed windows")
+	}
+	deleted, err := history.compact(ctx, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to compact usage: %w", err)
+	}
+	return deleted, nil
+}
+
+// window returns the bounds of the current window of key, loading its persisted
+// usage when the window was not seen yet
+func (s *bufferedUsageStore) window(ctx context.Context, key domain.UsageKey, window time.Duration) (time.Time, time.Time, error) {
+	start := s.clock.Now().Truncate(window)
+	end := start.Add(window)
+
+	s.mu.Lock()
+	persisted, ok := s.persisted[key]
+	s.mu.Unlock()
+	if ok && persisted.start == start.UnixMicro() {
+		return start, end, nil
+	}
+
+	used, err := s.table.load(ctx, key, start)
+	if err != nil {
+		return start, end, fmt.Errorf("failed to load usage of %s: %w", key, err)
+	}
+
+	s.mu.Lock()
+	if persisted, ok := s.persisted[key]; !ok || persisted.start != start.UnixMicro() {
+		s.persisted[key] = persistedUsage{start: start.UnixMicro(), used: used}
+	}
+	s.mu.Unlock()
+
+	return start, end, nil
+}
+
+// writeThrough adds amount, if any, to the counter of the current window in the
+// table and returns its total as read back, usage of other enforcers included
+func (s *bufferedUsageStore) writeThrough(ctx context.Context, key domain.UsageKey, window time.Duration, amount int64) (domain.Usage, error) {
+	start := s.clock.Now().Truncate(window)
+	end := start.Add(window)
+
+	s.flushMu.RLock()
+	defer s.flushMu.RUnlock()
+
+	if amount == 0 {
+		used, err := s.table.load(ctx, key, start)
+		if err != nil {
+			return domain.Usage{}, fmt.Errorf("failed to load usage of %s: %w", key, err)
+		}
+		return domain.Usage{Used: used, ResetAt: end}, nil
+	}
+
+	totals, err := s.table.upsert(ctx, []usageDelta{{key: key, start: start, end: end, delta: amount}})
+	if err != nil {
+		return domain.Usage{}, fmt.Errorf("failed to record usage of %s: %w", key, err)
+	}
+	return domain.Usage{Used: totals[0], ResetAt: end}, nil
+}
+
+// used returns the persisted and buffered usage of row; s.mu must be held
+func (s *bufferedUsageStore) used(row usageRow) int64 {
+	used := s.pending[row].delta
+	if persisted, ok := s.persisted[row.key]; ok && persisted.start == row.start {
+		used += persisted.used
+	}
+	return used
+}
+
+// run flushes buffered usage every flush interval, or earlier when the threshold is reached
+func (s *bufferedUsageStore) run() {
+	defer close(s.done)
+
+	for {
+		timer := s.clock.NewTimer(s.flushInterval)
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-s.flushNow:
+			timer.Stop()
+		case <-timer.C():
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), usageFlushTimeout)
+		if err := s.Flush(ctx); err != nil {
+			s.logger.Error("Failed to write quota usage: %v", err)
+		}
+		cancel()
+	}
+}
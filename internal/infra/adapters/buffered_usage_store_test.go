@@ -0,0 +1,202 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeUsageTable keeps usage counters in memory and records every batch written
+type fakeUsageTable struct {
+	mu      sync.Mutex
+	used    map[usageRow]int64
+	loads   int
+	batches [][]usageDelta
+	err     error
+}
+
+func newFakeUsageTable() *fakeUsageTable {
+	return &fakeUsageTable{used: make(map[usageRow]int64)}
+}
+
+func (t *fakeUsageTable) load(ctx context.Context, key domain.UsageKey, start time.Time) (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.loads++
+	return t.used[usageRow{key: key, start: start.UnixMicro()}], nil
+}
+
+func (t *fakeUsageTable) upsert(ctx context.Context, deltas []usageDelta) ([]int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return nil, t.err
+	}
+	t.batches = append(t.batches, deltas)
+
+	totals := make([]int64, len(deltas))
+	for i, delta := range deltas {
+		row := usageRow{key: delta.key, start: delta.start.UnixMicro()}
+		t.used[row] += delta.delta
+		totals[i] = t.used[row]
+	}
+	return totals, nil
+}
+
+func (t *fakeUsageTable) delete(ctx context.Context, key domain.UsageKey) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for row := range t.used {
+		if row.key == key {
+			delete(t.used, row)
+		}
+	}
+	return nil
+}
+
+// add records usage written by another enforcer
+func (t *fakeUsageTable) add(key domain.UsageKey, start time.Time, used int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.used[usageRow{key: key, start: start.UnixMicro()}] += used
+}
+
+func TestBufferedUsageStore_BatchesIncrements(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2025, 6, 1, 12, 0, 30, 0, time.UTC)
+	clock := testkit.NewFakeClock(now)
+	table := newFakeUsageTable()
+	store := newBufferedUsageStore(table, logger.NewSimpleLogger(), WithBufferedUsageClock(clock))
+	defer store.Close()
+
+	alice := domain.UsageKey{Policy: "p", User: "alice", Database: "app"}
+	bob := domain.UsageKey{Policy: "p", User: "bob", Database: "app"}
+	windowStart := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	table.add(alice, windowStart, 10)
+
+	for i := 0; i < 3; i++ {
+		_, err := store.Increment(ctx, alice, time.Minute, 1)
+		require.NoError(t, err)
+	}
+	usage, err := store.Increment(ctx, bob, time.Minute, 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), usage.Used)
+
+	usage, err = store.Get(ctx, alice, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(13), usage.Used, "Buffered usage should add to the persisted total")
+	assert.Equal(t, windowStart.Add(time.Minute), usage.ResetAt)
+	assert.Equal(t, 2, table.loads, "Persisted usage should be read once per key and window")
+	assert.Empty(t, table.batches, "Nothing should be written before a flush")
+
+	// Another enforcer records usage in the meantime
+	table.add(alice, windowStart, 5)
+
+	require.NoError(t, store.Flush(ctx))
+	require.Len(t, table.batches, 1)
+	assert.Len(t, table.batches[0], 2, "One delta per counter should be written")
+
+	usage, err = store.Get(ctx, alice, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(18), usage.Used, "A flush should pick up usage recorded elsewhere")
+
+	require.NoError(t, store.Flush(ctx))
+	assert.Len(t, table.batches, 1, "An empty buffer should not be written")
+}
+
+func TestBufferedUsageStore_FlushFailureKeepsUsage(t *testing.T) {
+	ctx := context.Background()
+	table := newFakeUsageTable()
+	store := newBufferedUsageStore(table, logger.NewSimpleLogger(), WithUsageFlushInterval(time.Hour))
+	defer store.Close()
+
+	key := domain.UsageKey{Policy: "p", User: "alice", Database: "app"}
+	_, err := store.Increment(ctx, key, time.Hour, 4)
+	require.NoError(t, err)
+
+	table.err = errors.New("connection refused")
+	assert.Error(t, store.Flush(ctx))
+
+	usage, err := store.Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), usage.Used)
+
+	table.err = nil
+	require.NoError(t, store.Flush(ctx))
+	require.Len(t, table.batches, 1)
+	assert.Equal(t, int64(4), table.batches[0][0].delta)
+}
+
+func TestBufferedUsageStore_WindowRollover(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 30, 0, time.UTC))
+	table := newFakeUsageTable()
+	store := newBufferedUsageStore(table, logger.NewSimpleLogger(), WithBufferedUsageClock(clock))
+	defer store.Close()
+
+	key := domain.UsageKey{Policy: "p", User: "alice", Database: "app"}
+	_, err := store.Increment(ctx, key, time.Minute, 5)
+	require.NoError(t, err)
+
+	clock.Advance(30 * time.Second)
+	usage, err := store.Increment(ctx, key, time.Minute, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), usage.Used, "Usage should reset when the window rolls over")
+
+	require.NoError(t, store.Flush(ctx))
+	require.Len(t, table.batches, 1)
+	assert.Len(t, table.batches[0], 2, "Usage of the elapsed window should still be written")
+}
+
+func TestBufferedUsageStore_Reset(t *testing.T) {
+	ctx := context.Background()
+	table := newFakeUsageTable()
+	store := newBufferedUsageStore(table, logger.NewSimpleLogger(), WithUsageFlushInterval(time.Hour))
+	defer store.Close()
+
+	key := domain.UsageKey{Policy: "p", User: "alice", Database: "app"}
+	_, err := store.Increment(ctx, key, time.Hour, 3)
+	require.NoError(t, err)
+	require.NoError(t, store.Flush(ctx))
+	_, err = store.Increment(ctx, key, time.Hour, 2)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Reset(ctx, key))
+
+	usage, err := store.Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), usage.Used)
+	assert.Empty(t, table.used)
+}
+
+func TestBufferedUsageStore_FlushThreshold(t *testing.T) {
+	ctx := context.Background()
+	table := newFakeUsageTable()
+	store := newBufferedUsageStore(table, logger.NewSimpleLogger(),
+		WithUsageFlushInterval(time.Hour), WithUsageFlushThreshold(2))
+
+	for _, user := range []string{"alice", "bob"} {
+		_, err := store.Increment(ctx, domain.UsageKey{Policy: "p", User: user}, time.Hour, 1)
+		require.NoError(t, err)
+	}
+
+	assert.Eventually(t, func() bool {
+		table.mu.Lock()
+		defer table.mu.Unlock()
+		return len(table.batches) == 1
+	}, time.Second, 10*time.Millisecond, "Reaching the threshold should flush before the interval")
+
+	_, err := store.Increment(ctx, domain.UsageKey{Policy: "p", User: "carol"}, time.Hour, 1)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+	assert.Len(t, table.batches, 2, "Close should write the remaining usage")
+}
@@ -0,0 +1,152 @@
+package adapters
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// cancelKeys maps the BackendKeyData handed to proxied clients to the upstream
+// backend running their queries. Clients get keys generated by the enforcer since
+// backends of different upstreams may share process IDs, and a CancelRequest
+// must reach the upstream the connection was balanced to.
+type cancelKeys struct {
+	mu      sync.Mutex
+	targets map[uint32]cancelTarget // by client-facing process ID
+}
+
+// cancelTarget is the upstream backend behind a client-facing key
+type cancelTarget struct {
+	secretKey uint32 // client-facing secret key
+	address   string
+	tlsConfig *tls.Config // how the upstream was dialed
+	backend   pgproto3.BackendKeyData
+}
+
+// newCancelKeys creates an empty key table
+func newCancelKeys() *cancelKeys {
+	return &cancelKeys{targets: make(map[uint32]cancelTarget)}
+}
+
+// register assigns a random client-facing key to the backend of the upstream at
+// address, dialed with tlsConfig
+func (k *cancelKeys) register(address string, tlsConfig *tls.Config, backend pgproto3.BackendKeyData) (*pgproto3.BackendKeyData, error) {
+	var random [8]byte
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for {
+		if _, err := rand.Read(random[:]); err != nil {
+			return nil, fmt.Errorf("failed to generate cancel key: %w", err)
+		}
+		key := &pgproto3.BackendKeyData{
+			ProcessID: binary.BigEndian.Uint32(random[:4]),
+			SecretKey: binary.BigEndian.Uint32(random[4:]),
+		}
+		if _, taken := k.targets[key.ProcessID]; key.ProcessID == 0 || taken {
+			continue
+		}
+
+		k.targets[key.ProcessID] = cancelTarget{secretKey: key.SecretKey, address: address, tlsConfig: tlsConfig, backend: backend}
+		return key, nil
+	}
+}
+
+// assign points a client-facing key at the backend of upstream, or at no backend
+// when upstream is nil, as pooled connections are assigned to the client in turn
+func (k *cancelKeys) assign(processID uint32, upstream *upstreamConnection) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	target, ok := k.targets[processID]
+	if !ok {
+		return
+	}
+	target.address, target.tlsConfig, target.backend = "", nil, pgproto3.BackendKeyData{}
+	if upstream != nil {
+		target.address, target.tlsConfig, target.backend = upstream.address, upstream.tlsConfig, upstream.backend
+	}
+	k.targets[processID] = target
+}
+
+// unregister forgets a client-facing key once its connection is closed
+func (k *cancelKeys) unregister(processID uint32) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.targets, processID)
+}
+
+// lookup returns the upstream backend of a client-facing key
+func (k *cancelKeys) lookup(processID, secretKey uint32) (cancelTarget, bool) {
+	k.mu.Lock()
+	target, ok := k.targets[processID]
+	k.mu.Unlock()
+
+	var expected, actual [4]byte
+	binary.BigEndian.PutUint32(expected[:], target.secretKey)
+	binary.BigEndian.PutUint32(actual[:], secretKey)
+	if !ok || subtle.ConstantTimeCompare(expected[:], actual[:]) != 1 {
+		return cancelTarget{}, false
+	}
+	return target, true
+}
+
+// target returns the upstream backend of a client-facing process ID, without
+// checking the secret key, for cancellations the enforcer makes itself
+func (k *cancelKeys) target(processID uint32) (cancelTarget, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	target, ok := k.targets[processID]
+	return target, ok
+}
+
+// cancel relays a client's CancelRequest to the upstream backend its key was
+// assigned to. Like PostgreSQL, nothing is answered: unknown keys are only logged.
+func (h *PostgreSQLConnectionHandler) cancel(ctx context.Context, request *pgproto3.CancelRequest, connLogger logger.Logger) {
+	target, ok := h.cancelKeys.lookup(request.ProcessID, request.SecretKey)
+	if !ok {
+		connLogger.Info("Ignoring CancelRequest with unknown key for process %d", request.ProcessID)
+		return
+	}
+	if target.address == "" {
+		// Pooled clients hold no upstream connection between transactions
+		connLogger.Info("Ignoring CancelRequest for process %d: no upstream connection is assigned", request.ProcessID)
+		return
+	}
+	h.cancelBackend(ctx, target, connLogger)
+}
+
+// cancelStatement cancels the statement the upstream backend assigned to a
+// client-facing process ID runs, for cancellations the enforcer makes itself
+func (h *PostgreSQLConnectionHandler) cancelStatement(ctx context.Context, processID uint32, connLogger logger.Logger) {
+	if target, ok := h.cancelKeys.target(processID); ok && target.address != "" {
+		h.cancelBackend(ctx, target, connLogger)
+	}
+}
+
+// cancelBackend sends a CancelRequest for the query the backend of target runs
+func (h *PostgreSQLConnectionHandler) cancelBackend(ctx context.Context, target cancelTarget, connLogger logger.Logger) {
+
+	upstream, err := dialUpstream(ctx, target.address, h.upstreamTimeout, target.tlsConfig)
+	if err != nil {
+		connLogger.Error("Failed to relay CancelRequest: %v", err)
+		return
+	}
+	defer upstream.Close()
+
+	if err := upstream.Send(&pgproto3.CancelRequest{
+		ProcessID: target.backend.ProcessID,
+		SecretKey: target.backend.SecretKey,
+	}); err != nil {
+		connLogger.Error("Failed to relay CancelRequest: %v", err)
+		return
+	}
+	connLogger.Info("Relayed CancelRequest to backend %d on upstream %s", target.backend.ProcessID, target.address)
+}
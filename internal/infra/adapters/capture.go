@@ -0,0 +1,209 @@
+package adapters
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sync"
+	"time"
+)
+
+// CaptureRecorder implements domain.QueryLogger by writing every event to a
+// versioned JSON Lines capture before delegating to the next QueryLogger.
+// It implements domain.SessionLogger on behalf of the next logger.
+type CaptureRecorder struct {
+	next    domain.QueryLogger
+	mu      sync.Mutex
+	writer  *bufio.Writer
+	closer  io.Closer
+	encoder *json.Encoder
+}
+
+// CaptureRecorderOption configures optional behavior of a CaptureRecorder
+type CaptureRecorderOption func(*domain.CaptureHeader)
+
+// WithCaptureInstance records the enforcer instance ID in the capture header
+func WithCaptureInstance(instanceID string) CaptureRecorderOption {
+	return func(header *domain.CaptureHeader) {
+		header.Instance = instanceID
+	}
+}
+
+// NewCaptureRecorder creates a CaptureRecorder writing to w. The next logger may be nil.
+func NewCaptureRecorder(w io.Writer, next domain.QueryLogger, opts ...CaptureRecorderOption) (*CaptureRecorder, error) {
+	buffered := bufio.NewWriter(w)
+	recorder := &CaptureRecorder{
+		next:    next,
+		writer:  buffered,
+		encoder: json.NewEncoder(buffered),
+	}
+	if closer, ok := w.(io.Closer); ok {
+		recorder.closer = closer
+	}
+
+	header := domain.CaptureHeader{
+		Version:   domain.CaptureFormatVersion,
+		CreatedAt: time.Now().UTC(),
+		Source:    "pgbouncer-quota-enforcer",
+	}
+	for _, opt := range opts {
+		opt(&header)
+	}
+	if err := recorder.encoder.Encode(header); err != nil {
+		return nil, fmt.Errorf("failed to write capture header: %w", err)
+	}
+
+	return recorder, nil
+}
+
+// LogQuery records a SQL query and forwards it to the next logger
+func (r *CaptureRecorder) LogQuery(connectionID string, query string) error {
+	if err := r.record(&domain.CaptureRecord{
+		ConnectionID: connectionID,
+		Kind:         domain.CaptureRecordQuery,
+		MessageType:  "Query",
+		Query:        query,
+	}); err != nil {
+		return err
+	}
+
+	if r.next != nil {
+		return r.next.LogQuery(connectionID, query)
+	}
+	return nil
+}
+
+// LogNormalizedQuery records a normalized query and forwards it to the next logger
+func (r *CaptureRecorder) LogNormalizedQuery(connectionID string, normalizedQuery domain.NormalizedQuery) error {
+	if err := r.record(&domain.CaptureRecord{
+		ConnectionID: connectionID,
+		Kind:         domain.CaptureRecordNormalized,
+		Query:        normalizedQuery.Original,
+		Normalized:   normalizedQuery.Normalized,
+		QueryHash:    normalizedQuery.Hash.Value(),
+	}); err != nil {
+		return err
+	}
+
+	if r.next != nil {
+		return r.next.LogNormalizedQuery(connectionID, normalizedQuery)
+	}
+	return nil
+}
+
+// LogProtocolMessage records a protocol message and forwards it to the next logger
+func (r *CaptureRecorder) LogProtocolMessage(connectionID string, messageType string, details map[string]interface{}) error {
+	if err := r.record(&domain.CaptureRecord{
+		ConnectionID: connectionID,
+		Kind:         domain.CaptureRecordProtocol,
+		MessageType:  messageType,
+		Details:      details,
+	}); err != nil {
+		return err
+	}
+
+	if r.next != nil {
+		return r.next.LogProtocolMessage(connectionID, messageType, details)
+	}
+	return nil
+}
+
+// StartSession forwards the session to the next logger when it attributes sessions.
+// The capture already holds the StartupMessage the session was built from.
+func (r *CaptureRecorder) StartSession(session domain.Session) error {
+	if sessionLogger, ok := r.next.(domain.SessionLogger); ok {
+		return sessionLogger.StartSession(session)
+	}
+	return nil
+}
+
+// LogDecision forwards the decision to the next logger when it records decisions.
+// The capture already holds the messages the decision was taken on.
+func (r *CaptureRecorder) LogDecision(query *domain.Query, decision domain.Decision, usage domain.StatementUsage) error {
+	if decisionLogger, ok := r.next.(domain.DecisionLogger); ok {
+		return decisionLogger.LogDecision(query, decision, usage)
+	}
+	return nil
+}
+
+// EndSession forwards the end of the session to the next logger
+func (r *CaptureRecorder) EndSession(connectionID string) {
+	if sessionLogger, ok := r.next.(domain.SessionLogger); ok {
+		sessionLogger.EndSession(connectionID)
+	}
+}
+
+// Flush writes buffered records to the underlying writer
+func (r *CaptureRecorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writer.Flush()
+}
+
+// Close flushes buffered records and closes the underlying writer if it is closable
+func (r *CaptureRecorder) Close() error {
+	if err := r.Flush(); err != nil {
+		return fmt.Errorf("failed to flush capture: %w", err)
+	}
+	if r.closer != nil {
+		return r.closer.Close()
+	}
+	return nil
+}
+
+// record timestamps and writes a single record
+func (r *CaptureRecorder) record(record *domain.CaptureRecord) error {
+	record.Timestamp = time.Now().UTC()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.encoder.Encode(record); err != nil {
+		return fmt.Errorf("failed to write capture record: %w", err)
+	}
+	return nil
+}
+
+// CaptureReader implements domain.CaptureSource over a JSON Lines capture
+type CaptureReader struct {
+	decoder *json.Decoder
+	header  domain.CaptureHeader
+}
+
+// NewCaptureReader reads and validates the capture header from r
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+
+	var header domain.CaptureHeader
+	if err := decoder.Decode(&header); err != nil {
+		return nil, fmt.Errorf("failed to read capture header: %w", err)
+	}
+
+	if header.Version < 1 || header.Version > domain.CaptureFormatVersion {
+		return nil, fmt.Errorf("unsupported capture format version %d (supported: 1-%d)", header.Version, domain.CaptureFormatVersion)
+	}
+
+	return &CaptureReader{
+		decoder: decoder,
+		header:  header,
+	}, nil
+}
+
+// Header returns the capture header
+func (r *CaptureReader) Header() domain.CaptureHeader {
+	return r.header
+}
+
+// Next returns the next record, or io.EOF when the capture is exhausted
+func (r *CaptureReader) Next() (*domain.CaptureRecord, error) {
+	var record domain.CaptureRecord
+	if err := r.decoder.Decode(&record); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("failed to read capture record: %w", err)
+	}
+	return &record, nil
+}
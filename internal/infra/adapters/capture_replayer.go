@@ -0,0 +1,178 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// ReplayStats summarizes a capture replay
+type ReplayStats struct {
+	Connections int
+	Queries     int
+	Skipped     int
+}
+
+// CaptureReplayer re-sends a recorded capture to a target server, one TCP
+// connection per recorded connection, preserving the recorded pacing
+type CaptureReplayer struct {
+	target string
+	speed  float64
+	logger logger.Logger
+}
+
+// replayConnection is an open connection to the replay target
+type replayConnection struct {
+	conn     net.Conn
+	frontend *pgproto3.Frontend
+}
+
+// NewCaptureReplayer creates a replayer. A speed of 1 keeps the original pacing,
+// 2 replays twice as fast and 0 sends everything as fast as possible.
+func NewCaptureReplayer(target string, speed float64, log logger.Logger) *CaptureReplayer {
+	return &CaptureReplayer{
+		target: target,
+		speed:  speed,
+		logger: log,
+	}
+}
+
+// Replay sends every replayable record of the source to the target
+func (r *CaptureReplayer) Replay(ctx context.Context, source domain.CaptureSource) (ReplayStats, error) {
+	var stats ReplayStats
+	conns := make(map[string]*replayConnection)
+	defer func() {
+		for _, c := range conns {
+			_ = c.conn.Close()
+		}
+	}()
+
+	var first time.Time
+	started := time.Now()
+
+	for {
+		record, err := source.Next()
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+
+		if first.IsZero() {
+			first = record.Timestamp
+		}
+		if err := r.wait(ctx, started, record.Timestamp.Sub(first)); err != nil {
+			return stats, err
+		}
+
+		switch {
+		case record.Kind == domain.CaptureRecordProtocol && record.MessageType == "StartupMessage":
+			if _, ok := conns[record.ConnectionID]; ok {
+				continue
+			}
+			c, err := r.open(record.Details)
+			if err != nil {
+				return stats, err
+			}
+			conns[record.ConnectionID] = c
+			stats.Connections++
+
+		case record.Kind == domain.CaptureRecordProtocol && record.MessageType == "Terminate":
+			if c, ok := conns[record.ConnectionID]; ok {
+				c.frontend.Send(&pgproto3.Terminate{})
+				_ = c.frontend.Flush()
+				_ = c.conn.Close()
+				delete(conns, record.ConnectionID)
+			}
+
+		case record.Kind == domain.CaptureRecordQuery:
+			c, ok := conns[record.ConnectionID]
+			if !ok {
+				// Captures taken without a startup phase replay the raw message stream
+				c, err = r.open(nil)
+				if err != nil {
+					return stats, err
+				}
+				conns[record.ConnectionID] = c
+				stats.Connections++
+			}
+
+			c.frontend.Send(&pgproto3.Query{String: record.Query})
+			if err := c.frontend.Flush(); err != nil {
+				return stats, fmt.Errorf("failed to replay query on %s: %w", record.ConnectionID, err)
+			}
+			stats.Queries++
+
+		default:
+			stats.Skipped++
+		}
+	}
+}
+
+// wait sleeps until the record's offset, scaled by the replay speed, has elapsed
+func (r *CaptureReplayer) wait(ctx context.Context, started time.Time, offset time.Duration) error {
+	if r.speed <= 0 {
+		return ctx.Err()
+	}
+
+	due := started.Add(time.Duration(float64(offset) / r.speed))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// open dials the target and sends a StartupMessage when startup details were recorded
+func (r *CaptureReplayer) open(startup map[string]interface{}) (*replayConnection, error) {
+	conn, err := net.Dial("tcp", r.target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to replay target %s: %w", r.target, err)
+	}
+
+	c := &replayConnection{
+		conn:     conn,
+		frontend: pgproto3.NewFrontend(conn, conn),
+	}
+
+	// Server responses are not inspected; drain them so the target never blocks on writes
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	if startup != nil {
+		params := make(map[string]string)
+		for k, v := range startup {
+			if s, ok := v.(string); ok {
+				params[k] = s
+			}
+		}
+		c.frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      params,
+		})
+		if err := c.frontend.Flush(); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to send startup message: %w", err)
+		}
+	}
+
+	r.logger.Debug("Opened replay connection to %s", r.target)
+	return c, nil
+}
@@ -0,0 +1,121 @@
+package adapters
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureRecorder_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	next := mocks.NewRecordingQueryLogger()
+
+	recorder, err := NewCaptureRecorder(&buf, next, WithCaptureInstance("enforcer-1"))
+	require.NoError(t, err)
+
+	normalized, err := NewPgQueryNormalizer().Normalize("SELECT * FROM users WHERE id = 1")
+	require.NoError(t, err)
+
+	require.NoError(t, recorder.LogProtocolMessage("conn_1", "StartupMessage", map[string]interface{}{"user": "alice"}))
+	require.NoError(t, recorder.LogQuery("conn_1", "SELECT * FROM users WHERE id = 1"))
+	require.NoError(t, recorder.LogNormalizedQuery("conn_1", normalized))
+	require.NoError(t, recorder.Close())
+
+	assert.Equal(t, []string{"SELECT * FROM users WHERE id = 1"}, next.Queries(), "Events should be forwarded")
+
+	reader, err := NewCaptureReader(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, domain.CaptureFormatVersion, reader.Header().Version)
+	assert.Equal(t, "enforcer-1", reader.Header().Instance)
+
+	var records []*domain.CaptureRecord
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		records = append(records, record)
+	}
+
+	require.Len(t, records, 3)
+	assert.Equal(t, domain.CaptureRecordProtocol, records[0].Kind)
+	assert.Equal(t, "alice", records[0].Details["user"])
+	assert.Equal(t, domain.CaptureRecordQuery, records[1].Kind)
+	assert.Equal(t, "SELECT * FROM users WHERE id = 1", records[1].Query)
+	assert.Equal(t, domain.CaptureRecordNormalized, records[2].Kind)
+	assert.Equal(t, "SELECT * FROM users WHERE id = $1", records[2].Normalized)
+	assert.Equal(t, normalized.Hash.Value(), records[2].QueryHash)
+	assert.False(t, records[1].Timestamp.IsZero())
+}
+
+func TestNewCaptureReader_Version(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expectError bool
+	}{
+		{name: "Current version", input: `{"version":1}`},
+		{name: "Future version", input: `{"version":99}`, expectError: true},
+		{name: "Missing header", input: ``, expectError: true},
+		{name: "Malformed header", input: `not json`, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewCaptureReader(strings.NewReader(tt.input))
+			if tt.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestCaptureReplayer_Replay(t *testing.T) {
+	log := logger.NewSimpleLogger()
+	target := mocks.NewRecordingQueryLogger()
+	server := NewStandardTCPServer(NewPostgreSQLConnectionHandler(target, NewPgQueryNormalizer(), log), log)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, server.Start(ctx, "127.0.0.1:0"))
+	<-server.Started()
+	defer func() {
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), time.Second)
+		defer stopCancel()
+		_ = server.Stop(stopCtx)
+	}()
+
+	var buf bytes.Buffer
+	recorder, err := NewCaptureRecorder(&buf, nil)
+	require.NoError(t, err)
+	require.NoError(t, recorder.LogQuery("conn_1", "SELECT 1"))
+	require.NoError(t, recorder.LogQuery("conn_2", "SELECT 2"))
+	require.NoError(t, recorder.LogQuery("conn_1", "SELECT 3"))
+	require.NoError(t, recorder.LogProtocolMessage("conn_1", "Sync", nil))
+	require.NoError(t, recorder.Close())
+
+	reader, err := NewCaptureReader(&buf)
+	require.NoError(t, err)
+
+	stats, err := NewCaptureReplayer(server.Address(), 0, log).Replay(ctx, reader)
+	require.NoError(t, err)
+	assert.Equal(t, ReplayStats{Connections: 2, Queries: 3, Skipped: 1}, stats)
+
+	assert.Eventually(t, func() bool {
+		return len(target.Queries()) == 3
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{"SELECT 1", "SELECT 2", "SELECT 3"}, target.Queries())
+}
@@ -0,0 +1,32 @@
+package adapters
+
+import (
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"time"
+)
+
+// SystemClock implements domain.Clock with the wall clock
+type SystemClock struct{}
+
+// Now returns time.Now()
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer wraps time.NewTimer
+func (SystemClock) NewTimer(d time.Duration) domain.Timer {
+	return systemTimer{timer: time.NewTimer(d)}
+}
+
+// systemTimer adapts *time.Timer to domain.Timer
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
@@ -0,0 +1,91 @@
+package adapters
+
+import (
+	"strings"
+)
+
+// labelPrefix is the custom option namespace carrying connection labels.
+// PostgreSQL accepts dotted option names as placeholders, so labels can be
+// forwarded upstream without being rejected.
+const labelPrefix = "label."
+
+// ParseConnectionLabels extracts connection labels from startup parameters.
+// Labels are read from parameters named "label.<name>" and from "-c label.<name>=<value>"
+// or "--label.<name>=<value>" switches in the libpq options parameter, which take
+// precedence. It returns nil when the client supplied no labels.
+func ParseConnectionLabels(params map[string]string) map[string]string {
+	var labels map[string]string
+	set := func(name, value string) {
+		name = strings.TrimPrefix(name, labelPrefix)
+		if name == "" {
+			return
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[name] = value
+	}
+
+	for name, value := range params {
+		if strings.HasPrefix(name, labelPrefix) {
+			set(name, value)
+		}
+	}
+
+	args := splitOptions(params["options"])
+	for i := 0; i < len(args); i++ {
+		var setting string
+		switch {
+		case args[i] == "-c" && i+1 < len(args):
+			i++
+			setting = args[i]
+		case strings.HasPrefix(args[i], "-c"):
+			setting = args[i][len("-c"):]
+		case strings.HasPrefix(args[i], "--"):
+			setting = args[i][len("--"):]
+		default:
+			continue
+		}
+
+		name, value, ok := strings.Cut(setting, "=")
+		if ok && strings.HasPrefix(name, labelPrefix) {
+			set(name, value)
+		}
+	}
+
+	return labels
+}
+
+// splitOptions splits the options parameter on whitespace the way the server does:
+// a backslash escapes the next character, allowing spaces inside values
+func splitOptions(options string) []string {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	escaped := false
+
+	for _, r := range options {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args
+}
@@ -0,0 +1,57 @@
+package adapters
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConnectionLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   map[string]string
+		expected map[string]string
+	}{
+		{
+			name:     "No labels",
+			params:   map[string]string{"user": "alice", "application_name": "psql"},
+			expected: nil,
+		},
+		{
+			name:     "Custom startup parameters",
+			params:   map[string]string{"user": "alice", "label.team": "billing", "label.workload": "etl"},
+			expected: map[string]string{"team": "billing", "workload": "etl"},
+		},
+		{
+			name:     "Options switches",
+			params:   map[string]string{"options": "-c label.team=billing --label.workload=etl -c statement_timeout=5s"},
+			expected: map[string]string{"team": "billing", "workload": "etl"},
+		},
+		{
+			name:     "Attached -c switch",
+			params:   map[string]string{"options": "-clabel.team=billing"},
+			expected: map[string]string{"team": "billing"},
+		},
+		{
+			name:     "Escaped spaces",
+			params:   map[string]string{"options": `-c label.job=nightly\ rollup`},
+			expected: map[string]string{"job": "nightly rollup"},
+		},
+		{
+			name:     "Options override parameters",
+			params:   map[string]string{"label.team": "billing", "options": "-c label.team=search"},
+			expected: map[string]string{"team": "search"},
+		},
+		{
+			name:     "Empty label name is ignored",
+			params:   map[string]string{"options": "-c label.=x"},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ParseConnectionLabels(tt.params))
+		})
+	}
+}
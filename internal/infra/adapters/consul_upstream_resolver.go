@@ -0,0 +1,119 @@
+package adapters
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultConsulAddress is the local Consul agent queried when CONSUL_HTTP_ADDR is unset
+const DefaultConsulAddress = "http://127.0.0.1:8500"
+
+// ConsulServiceQuery selects the service instances to use as upstreams
+type ConsulServiceQuery struct {
+	Service    string
+	Tag        string // optional; only instances carrying this tag
+	Datacenter string // optional; defaults to the agent's datacenter
+}
+
+// ConsulUpstreamResolver discovers upstream targets from the Consul service catalog.
+// Only instances whose health checks are all passing are returned, so failing
+// backends leave the membership on the next refresh.
+type ConsulUpstreamResolver struct {
+	query   ConsulServiceQuery
+	address string
+	token   string
+	client  *http.Client
+}
+
+// NewConsulUpstreamResolver creates a resolver querying the Consul agent at address.
+// An empty address falls back to CONSUL_HTTP_ADDR, then to DefaultConsulAddress;
+// the ACL token is read from CONSUL_HTTP_TOKEN.
+func NewConsulUpstreamResolver(query ConsulServiceQuery, address string) (*ConsulUpstreamResolver, error) {
+	if query.Service == "" {
+		return nil, fmt.Errorf("consul service name is required")
+	}
+
+	if address == "" {
+		address = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if address == "" {
+		address = DefaultConsulAddress
+	}
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+
+	return &ConsulUpstreamResolver{
+		query:   query,
+		address: strings.TrimSuffix(address, "/"),
+		token:   os.Getenv("CONSUL_HTTP_TOKEN"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// consulServiceEntry is the subset of a /v1/health/service entry the resolver needs
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+// Resolve lists the passing instances of the service. Consul does not report a TTL,
+// so the refresh interval is left to the caller.
+func (r *ConsulUpstreamResolver) Resolve(ctx context.Context) ([]domain.UpstreamTarget, time.Duration, error) {
+	params := url.Values{"passing": {"true"}}
+	if r.query.Tag != "" {
+		params.Set("tag", r.query.Tag)
+	}
+	if r.query.Datacenter != "" {
+		params.Set("dc", r.query.Datacenter)
+	}
+	endpoint := fmt.Sprintf("%s/v1/health/service/%s?%s", r.address, url.PathEscape(r.query.Service), params.Encode())
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to build consul request: %w", err)
+	}
+	if r.token != "" {
+		request.Header.Set("X-Consul-Token", r.token)
+	}
+
+	response, err := r.client.Do(request)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query consul: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul returned %s for service %s", response.Status, r.query.Service)
+	}
+
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(response.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode consul response: %w", err)
+	}
+
+	targets := make([]domain.UpstreamTarget, 0, len(entries))
+	for _, entry := range entries {
+		// Instances registered without an address listen on their node's address
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		targets = append(targets, domain.UpstreamTarget{Address: net.JoinHostPort(host, strconv.Itoa(entry.Service.Port))})
+	}
+	return targets, 0, nil
+}
@@ -0,0 +1,76 @@
+package adapters
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulUpstreamResolver_Resolve(t *testing.T) {
+	t.Setenv("CONSUL_HTTP_TOKEN", "secret")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/health/service/pgbouncer", r.URL.Path)
+		assert.Equal(t, "true", r.URL.Query().Get("passing"))
+		assert.Equal(t, "primary", r.URL.Query().Get("tag"))
+		assert.Equal(t, "eu1", r.URL.Query().Get("dc"))
+		assert.Equal(t, "secret", r.Header.Get("X-Consul-Token"))
+
+		_, _ = w.Write([]byte(`[
+			{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "10.0.1.1", "Port": 6432}},
+			{"Node": {"Address": "10.0.0.2"}, "Service": {"Address": "", "Port": 6433}}
+		]`))
+	}))
+	defer server.Close()
+
+	resolver, err := NewConsulUpstreamResolver(ConsulServiceQuery{Service: "pgbouncer", Tag: "primary", Datacenter: "eu1"}, server.URL)
+	require.NoError(t, err)
+
+	targets, ttl, err := resolver.Resolve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []domain.UpstreamTarget{
+		{Address: "10.0.1.1:6432"},
+		{Address: "10.0.0.2:6433"},
+	}, targets, "Instances without an address should use their node's")
+	assert.Zero(t, ttl)
+}
+
+func TestConsulUpstreamResolver_Errors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "ACL not found", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	resolver, err := NewConsulUpstreamResolver(ConsulServiceQuery{Service: "pgbouncer"}, server.URL)
+	require.NoError(t, err)
+
+	_, _, err = resolver.Resolve(context.Background())
+	assert.ErrorContains(t, err, "403")
+
+	_, err = NewConsulUpstreamResolver(ConsulServiceQuery{}, server.URL)
+	assert.Error(t, err)
+}
+
+func TestNewUpstreamResolver(t *testing.T) {
+	t.Setenv("CONSUL_HTTP_ADDR", "consul.internal:8500")
+
+	resolver, err := NewUpstreamResolver("127.0.0.1:5432")
+	require.NoError(t, err)
+	assert.IsType(t, &DNSUpstreamResolver{}, resolver)
+
+	resolver, err = NewUpstreamResolver("consul://pgbouncer?tag=primary")
+	require.NoError(t, err)
+	require.IsType(t, &ConsulUpstreamResolver{}, resolver)
+	consul := resolver.(*ConsulUpstreamResolver)
+	assert.Equal(t, ConsulServiceQuery{Service: "pgbouncer", Tag: "primary"}, consul.query)
+	assert.Equal(t, "http://consul.internal:8500", consul.address)
+
+	_, err = NewUpstreamResolver("etcd://pgbouncer")
+	assert.ErrorContains(t, err, "unsupported upstream scheme")
+}
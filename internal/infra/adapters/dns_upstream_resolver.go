@@ -0,0 +1,150 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// resolvConfPath is where the system resolvers are read from when none are configured
+const resolvConfPath = "/etc/resolv.conf"
+
+// DNSUpstreamResolver resolves an upstream host name to one target per A and AAAA
+// record. It reports the smallest record TTL so callers re-resolve when the
+// records expire, which the standard library resolver does not expose.
+type DNSUpstreamResolver struct {
+	host    string
+	port    string
+	servers []string
+	client  *dns.Client
+}
+
+// DNSResolverOption configures optional behavior of a DNSUpstreamResolver
+type DNSResolverOption func(*DNSUpstreamResolver)
+
+// WithDNSServers queries the given name servers (host:port) instead of the ones in /etc/resolv.conf
+func WithDNSServers(servers ...string) DNSResolverOption {
+	return func(r *DNSUpstreamResolver) {
+		r.servers = servers
+	}
+}
+
+// NewDNSUpstreamResolver creates a resolver for address, given as host:port.
+// The host is resolved as a fully qualified name; resolv.conf search domains are not applied.
+func NewDNSUpstreamResolver(address string, opts ...DNSResolverOption) (*DNSUpstreamResolver, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream address %q: %w", address, err)
+	}
+
+	resolver := &DNSUpstreamResolver{
+		host:   host,
+		port:   port,
+		client: &dns.Client{Timeout: 5 * time.Second},
+	}
+	for _, opt := range opts {
+		opt(resolver)
+	}
+
+	if len(resolver.servers) == 0 && net.ParseIP(host) == nil {
+		resolver.servers, err = systemNameServers()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return resolver, nil
+}
+
+// Resolve looks up the host's addresses. IP literals resolve to themselves with no TTL.
+func (r *DNSUpstreamResolver) Resolve(ctx context.Context) ([]domain.UpstreamTarget, time.Duration, error) {
+	if net.ParseIP(r.host) != nil {
+		return []domain.UpstreamTarget{{Address: net.JoinHostPort(r.host, r.port)}}, 0, nil
+	}
+
+	var targets []domain.UpstreamTarget
+	var ttl uint32
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		answers, err := exchangeDNS(ctx, r.client, r.servers, r.host, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, answer := range answers {
+			var ip net.IP
+			switch record := answer.(type) {
+			case *dns.A:
+				ip = record.A
+			case *dns.AAAA:
+				ip = record.AAAA
+			default:
+				continue
+			}
+
+			if len(targets) == 0 || answer.Header().Ttl < ttl {
+				ttl = answer.Header().Ttl
+			}
+			targets = append(targets, domain.UpstreamTarget{Address: net.JoinHostPort(ip.String(), r.port)})
+		}
+	}
+
+	if len(targets) == 0 {
+		return nil, 0, fmt.Errorf("no addresses found for %s", r.host)
+	}
+	return targets, time.Duration(ttl) * time.Second, nil
+}
+
+// systemNameServers returns the name servers listed in /etc/resolv.conf as host:port
+func systemNameServers() ([]string, error) {
+	config, err := dns.ClientConfigFromFile(resolvConfPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read name servers: %w", err)
+	}
+
+	servers := make([]string, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		servers = append(servers, net.JoinHostPort(server, config.Port))
+	}
+	return servers, nil
+}
+
+// exchangeDNS sends a recursive query for name to each server in turn and returns the
+// answer section of the first usable response. A name that does not exist yields no
+// records rather than an error. Truncated UDP responses are retried over TCP.
+func exchangeDNS(ctx context.Context, client *dns.Client, servers []string, name string, qtype uint16) ([]dns.RR, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no name servers configured")
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+
+	var lastErr error
+	for _, server := range servers {
+		response, _, err := client.ExchangeContext(ctx, msg, server)
+		if err == nil && response.Truncated {
+			tcpClient := *client
+			tcpClient.Net = "tcp"
+			response, _, err = tcpClient.ExchangeContext(ctx, msg, server)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		switch response.Rcode {
+		case dns.RcodeSuccess:
+			return response.Answer, nil
+		case dns.RcodeNameError:
+			return nil, nil
+		default:
+			lastErr = fmt.Errorf("%s from %s", dns.RcodeToString[response.Rcode], server)
+		}
+	}
+
+	return nil, fmt.Errorf("failed to resolve %s: %w", name, lastErr)
+}
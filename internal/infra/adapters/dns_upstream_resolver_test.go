@@ -0,0 +1,114 @@
+package adapters
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startDNSServer serves the given records from a local UDP name server and returns its address
+func startDNSServer(t *testing.T, records func() []string) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, request *dns.Msg) {
+		response := new(dns.Msg)
+		response.SetReply(request)
+
+		question := request.Question[0]
+		found := false
+		for _, record := range records() {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				t.Errorf("invalid record %q: %v", record, err)
+				continue
+			}
+			if rr.Header().Name != question.Name {
+				continue
+			}
+			found = true
+			if rr.Header().Rrtype == question.Qtype {
+				response.Answer = append(response.Answer, rr)
+			}
+		}
+		if !found {
+			response.Rcode = dns.RcodeNameError
+		}
+		_ = w.WriteMsg(response)
+	})
+
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	return conn.LocalAddr().String()
+}
+
+func TestDNSUpstreamResolver_Resolve(t *testing.T) {
+	var mu sync.Mutex
+	records := []string{
+		"db.internal. 30 IN A 10.0.0.1",
+		"db.internal. 10 IN A 10.0.0.2",
+		"db.internal. 60 IN AAAA fd00::1",
+	}
+	server := startDNSServer(t, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return records
+	})
+
+	resolver, err := NewDNSUpstreamResolver("db.internal:6432", WithDNSServers(server))
+	require.NoError(t, err)
+
+	targets, ttl, err := resolver.Resolve(context.Background())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []domain.UpstreamTarget{
+		{Address: "10.0.0.1:6432"},
+		{Address: "10.0.0.2:6432"},
+		{Address: "[fd00::1]:6432"},
+	}, targets)
+	assert.Equal(t, 10*time.Second, ttl, "The smallest record TTL should be reported")
+
+	mu.Lock()
+	records = []string{"db.internal. 30 IN A 10.0.0.3"}
+	mu.Unlock()
+
+	targets, ttl, err = resolver.Resolve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []domain.UpstreamTarget{{Address: "10.0.0.3:6432"}}, targets, "Record changes should be picked up")
+	assert.Equal(t, 30*time.Second, ttl)
+}
+
+func TestDNSUpstreamResolver_Errors(t *testing.T) {
+	server := startDNSServer(t, func() []string { return nil })
+
+	resolver, err := NewDNSUpstreamResolver("missing.internal:5432", WithDNSServers(server))
+	require.NoError(t, err)
+	_, _, err = resolver.Resolve(context.Background())
+	assert.ErrorContains(t, err, "no addresses found")
+
+	_, err = NewDNSUpstreamResolver("db.internal")
+	assert.Error(t, err, "A port is required")
+}
+
+func TestDNSUpstreamResolver_IPLiteral(t *testing.T) {
+	resolver, err := NewDNSUpstreamResolver("127.0.0.1:5432")
+	require.NoError(t, err)
+
+	targets, ttl, err := resolver.Resolve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []domain.UpstreamTarget{{Address: "127.0.0.1:5432"}}, targets)
+	assert.Zero(t, ttl)
+}
@@ -0,0 +1,418 @@
+package adapters
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultEtcdPrefix is the key prefix under which the enforcer keeps its
+	// policies, roles and instances
+	DefaultEtcdPrefix = "/quota-enforcer/"
+
+	// DefaultEtcdLeaseTTL is how long the registration of an instance outlives
+	// its last keepalive
+	DefaultEtcdLeaseTTL = 10 * time.Second
+
+	// etcdDialTimeout bounds the connection to the etcd cluster
+	etcdDialTimeout = 5 * time.Second
+
+	// etcdRetryInterval is how long a broken watch or registration waits before
+	// trying again
+	etcdRetryInterval = time.Second
+
+	// etcdManagedHeader starts the policies written by SyncPolicies, telling them
+	// apart from those written by other means; decoders skip it as a comment
+	etcdManagedHeader = "# Managed by the quota enforcer operator: edit the QuotaPolicy resource instead\n"
+)
+
+// EtcdInstance is what an enforcer instance registers under the instances/ key
+// of the prefix, so that the convergence of a fleet on new policies can be
+// followed with etcdctl get --prefix
+type EtcdInstance struct {
+	Revision  int64     `json:"revision"` // of the policies and roles in force
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+// EtcdPolicyStore reads quota policies and roles from etcd and watches them, so
+// that a fleet of enforcers picks up new limits within seconds of their write.
+// Under its prefix, policies/<name> holds a policy in the policy file format and
+// roles/<name> the list of the role's users, both in YAML. Every instance
+// registers under instances/<id> with a lease, along with the revision of the
+// policies it enforces; its key vanishes once it stops renewing the lease.
+type EtcdPolicyStore struct {
+	client   *clientv3.Client // nil when the store was not dialed
+	kv       clientv3.KV
+	watcher  clientv3.Watcher
+	lease    clientv3.Lease
+	prefix   string
+	leaseTTL time.Duration
+	clock    domain.Clock
+	logger   logger.Logger
+
+	mu         sync.Mutex
+	loaded     int64 // revision of the last policies loaded
+	instance   string
+	applied    EtcdInstance
+	leaseID    clientv3.LeaseID   // zero while unregistered
+	unregister context.CancelFunc // stops keeping the registration alive
+}
+
+// EtcdPolicyStoreOption configures optional behavior of an EtcdPolicyStore
+type EtcdPolicyStoreOption func(*EtcdPolicyStore)
+
+// WithEtcdPrefix sets the key prefix of policies, roles and instances
+func WithEtcdPrefix(prefix string) EtcdPolicyStoreOption {
+	return func(s *EtcdPolicyStore) {
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		s.prefix = prefix
+	}
+}
+
+// WithEtcdLeaseTTL sets how long the registration of the instance outlives its
+// last keepalive
+func WithEtcdLeaseTTL(ttl time.Duration) EtcdPolicyStoreOption {
+	return func(s *EtcdPolicyStore) {
+		s.leaseTTL = ttl
+	}
+}
+
+// WithEtcdPolicyStoreClock sets the clock used to time retries and registrations
+func WithEtcdPolicyStoreClock(clock domain.Clock) EtcdPolicyStoreOption {
+	return func(s *EtcdPolicyStore) {
+		s.clock = clock
+	}
+}
+
+// NewEtcdPolicyStore connects to the etcd cluster at endpoints. Close revokes
+// the registration of the instance and closes the connection.
+func NewEtcdPolicyStore(endpoints []string, log logger.Logger, opts ...EtcdPolicyStoreOption) (*EtcdPolicyStore, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("etcd endpoints are required")
+	}
+	client, err := clientv3.New(clientv3.Config{Endpoints: endpoints, DialTimeout: etcdDialTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to etcd: %w", err)
+	}
+
+	store := newEtcdPolicyStore(client, client, client, log, opts...)
+	store.client = client
+	return store, nil
+}
+
+// newEtcdPolicyStore creates a store reading kv, watching with watcher and
+// registering with lease
+func newEtcdPolicyStore(kv clientv3.KV, watcher clientv3.Watcher, lease clientv3.Lease, log logger.Logger, opts ...EtcdPolicyStoreOption) *EtcdPolicyStore {
+	store := &EtcdPolicyStore{
+		kv:       kv,
+		watcher:  watcher,
+		lease:    lease,
+		prefix:   DefaultEtcdPrefix,
+		leaseTTL: DefaultEtcdLeaseTTL,
+		clock:    SystemClock{},
+		logger:   log,
+	}
+	for _, opt := range opts {
+		opt(store)
+	}
+	return store
+}
+
+// LoadPolicies reads the quota policies under the policies/ key of the prefix.
+// The name of a policy defaults to its key, and must match it when set.
+func (s *EtcdPolicyStore) LoadPolicies(ctx context.Context) ([]domain.QuotaPolicy, error) {
+	response, err := s.kv.Get(ctx, s.prefix+"policies/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quota policies from etcd: %w", err)
+	}
+
+	policies := make([]domain.QuotaPolicy, 0, len(response.Kvs))
+	for _, kv := range response.Kvs {
+		name := strings.TrimPrefix(string(kv.Key), s.prefix+"policies/")
+		decoder := yaml.NewDecoder(bytes.NewReader(kv.Value))
+		decoder.KnownFields(true)
+
+		var entry policyFileEntry
+		if err := decoder.Decode(&entry); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to decode quota policy %s: %w", kv.Key, err)
+		}
+		if entry.Name == "" {
+			entry.Name = name
+		}
+		if entry.Name != name {
+			return nil, fmt.Errorf("quota policy %q is stored under %s", entry.Name, kv.Key)
+		}
+
+		policy := entry.policy()
+		if err := policy.Validate(); err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+
+	s.mu.Lock()
+	s.loaded = response.Header.Revision
+	s.mu.Unlock()
+	return policies, nil
+}
+
+// SyncPolicies implements domain.PolicySink. Policies are written under the
+// policies/ key of the prefix, in the policy file format, after a comment
+// marking them as written by the operator. Keys written by other means are
+// never overwritten nor deleted.
+func (s *EtcdPolicyStore) SyncPolicies(ctx context.Context, policies []domain.QuotaPolicy) (map[string]error, error) {
+	response, err := s.kv.Get(ctx, s.prefix+"policies/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quota policies from etcd: %w", err)
+	}
+	stored := make(map[string]string, len(response.Kvs))
+	for _, kv := range response.Kvs {
+		stored[string(kv.Key)] = string(kv.Value)
+	}
+
+	failures := make(map[string]error)
+	declared := make(map[string]bool, len(policies))
+	for _, policy := range policies {
+		key := s.prefix + "policies/" + policy.Name
+		declared[key] = true
+		encoded, err := yaml.Marshal(policyEntry(policy))
+		if err != nil {
+			failures[policy.Name] = err
+			continue
+		}
+		value := etcdManagedHeader + string(encoded)
+
+		current, ok := stored[key]
+		switch {
+		case ok && !strings.HasPrefix(current, etcdManagedHeader):
+			failures[policy.Name] = fmt.Errorf("quota policy %q was written to %s by other means", policy.Name, key)
+			continue
+		case current == value:
+			continue
+		}
+		if _, err := s.kv.Put(ctx, key, value); err != nil {
+			return nil, fmt.Errorf("failed to write quota policy %q to etcd: %w", policy.Name, err)
+		}
+		s.logger.Info("Wrote quota policy %s to etcd", policy.Name)
+	}
+
+	for key, value := range stored {
+		if declared[key] || !strings.HasPrefix(value, etcdManagedHeader) {
+			continue
+		}
+		if _, err := s.kv.Delete(ctx, key); err != nil {
+			return nil, fmt.Errorf("failed to delete quota policy %s from etcd: %w", key, err)
+		}
+		s.logger.Info("Deleted quota policy %s from etcd", strings.TrimPrefix(key, s.prefix+"policies/"))
+	}
+	return failures, nil
+}
+
+// LoadRoles reads the users of the roles under the roles/ key of the prefix, by
+// role name
+func (s *EtcdPolicyStore) LoadRoles(ctx context.Context) (map[string][]string, error) {
+	response, err := s.kv.Get(ctx, s.prefix+"roles/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read roles from etcd: %w", err)
+	}
+
+	roles := make(map[string][]string, len(response.Kvs))
+	for _, kv := range response.Kvs {
+		var users []string
+		if err := yaml.Unmarshal(kv.Value, &users); err != nil {
+			return nil, fmt.Errorf("failed to decode role %s: %w", kv.Key, err)
+		}
+		sort.Strings(users)
+		roles[strings.TrimPrefix(string(kv.Key), s.prefix+"roles/")] = users
+	}
+	return roles, nil
+}
+
+// Revision returns the etcd revision of the policies last loaded
+func (s *EtcdPolicyStore) Revision() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loaded
+}
+
+// Watch calls changed whenever a policy or a role is written or deleted after
+// the revision last loaded, until ctx is cancelled. A broken watch resumes where
+// it stopped; when etcd has compacted the revisions it missed, changed is called
+// so that everything is loaded again.
+func (s *EtcdPolicyStore) Watch(ctx context.Context, changed func()) {
+	go func() {
+		next := s.Revision() + 1
+		for {
+			next = s.watch(ctx, next, changed)
+			timer := s.clock.NewTimer(etcdRetryInterval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C():
+			}
+		}
+	}()
+}
+
+// watch watches the prefix from revision next until the watch breaks, and
+// returns the revision to resume from
+func (s *EtcdPolicyStore) watch(ctx context.Context, next int64, changed func()) int64 {
+	opts := []clientv3.OpOption{clientv3.WithPrefix()}
+	if next > 1 {
+		opts = append(opts, clientv3.WithRev(next))
+	}
+	for response := range s.watcher.Watch(clientv3.WithRequireLeader(ctx), s.prefix, opts...) {
+		if response.CompactRevision != 0 {
+			s.logger.Info("etcd compacted the policy changes since revision %d, loading them again", next)
+			changed()
+			return response.CompactRevision
+		}
+		if err := response.Err(); err != nil {
+			if ctx.Err() == nil {
+				s.logger.Error("Lost the watch of etcd policies: %v", err)
+			}
+			return next
+		}
+
+		relevant := false
+		for _, event := range response.Events {
+			key := strings.TrimPrefix(string(event.Kv.Key), s.prefix)
+			relevant = relevant || strings.HasPrefix(key, "policies/") || strings.HasPrefix(key, "roles/")
+		}
+		if relevant {
+			changed()
+		}
+		if response.Header.Revision >= next {
+			next = response.Header.Revision + 1
+		}
+	}
+	return next
+}
+
+// Register registers the instance under instances/<instance> with a lease kept
+// alive until ctx is cancelled or the store is closed, granting a new lease
+// should etcd expire it
+func (s *EtcdPolicyStore) Register(ctx context.Context, instance string) {
+	ctx, cancel := context.WithCancel(ctx)
+	s.mu.Lock()
+	s.instance = instance
+	s.unregister = cancel
+	s.mu.Unlock()
+
+	go func() {
+		for {
+			if err := s.register(ctx); err != nil && ctx.Err() == nil {
+				s.logger.Error("Failed to register instance %s in etcd: %v", instance, err)
+			}
+			timer := s.clock.NewTimer(etcdRetryInterval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C():
+			}
+		}
+	}()
+}
+
+// register grants a lease, writes the registration under it and keeps it alive
+// until the lease is lost
+func (s *EtcdPolicyStore) register(ctx context.Context) error {
+	grant, err := s.lease.Grant(ctx, int64((s.leaseTTL+time.Second-1)/time.Second))
+	if err != nil {
+		return err
+	}
+	keepAlive, err := s.lease.KeepAlive(ctx, grant.ID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.leaseID = grant.ID
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		if s.leaseID == grant.ID {
+			s.leaseID = 0
+		}
+		s.mu.Unlock()
+	}()
+
+	if err := s.publish(ctx); err != nil {
+		return err
+	}
+	for range keepAlive {
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return errors.New("lease lost")
+}
+
+// Applied records that the policies and roles last loaded are in force, and
+// publishes their revision in the registration of the instance
+func (s *EtcdPolicyStore) Applied(ctx context.Context) {
+	s.mu.Lock()
+	s.applied = EtcdInstance{Revision: s.loaded, AppliedAt: s.clock.Now().UTC()}
+	s.mu.Unlock()
+
+	if err := s.publish(ctx); err != nil {
+		s.logger.Error("Failed to publish the policy revision to etcd: %v", err)
+	}
+}
+
+// publish writes the registration of the instance under its lease, if registered
+func (s *EtcdPolicyStore) publish(ctx context.Context) error {
+	s.mu.Lock()
+	instance, applied, leaseID := s.instance, s.applied, s.leaseID
+	s.mu.Unlock()
+	if leaseID == 0 {
+		return nil
+	}
+
+	value, err := json.Marshal(applied)
+	if err != nil {
+		return err
+	}
+	_, err = s.kv.Put(ctx, s.prefix+"instances/"+instance, string(value), clientv3.WithLease(leaseID))
+	return err
+}
+
+// Close revokes the registration of the instance and closes the connection
+func (s *EtcdPolicyStore) Close() error {
+	s.mu.Lock()
+	leaseID, unregister := s.leaseID, s.unregister
+	s.mu.Unlock()
+	if unregister != nil {
+		unregister()
+	}
+
+	var err error
+	if leaseID != 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), etcdDialTimeout)
+		_, err = s.lease.Revoke(ctx, leaseID)
+		cancel()
+	}
+	if s.client != nil {
+		if closeErr := s.client.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,296 @@
+package adapters
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// fakeEtcd keeps keys in memory, streams their changes to watchers and grants
+// leases that live until revoked
+type fakeEtcd struct {
+	clientv3.KV
+	clientv3.Watcher
+	clientv3.Lease
+
+	mu         sync.Mutex
+	revision   int64
+	keys       map[string]string
+	leases     map[string]clientv3.LeaseID
+	watches    []chan clientv3.WatchResponse
+	keepAlives map[clientv3.LeaseID]chan *clientv3.LeaseKeepAliveResponse
+	nextLease  clientv3.LeaseID
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{
+		revision:   1,
+		keys:       make(map[string]string),
+		leases:     make(map[string]clientv3.LeaseID),
+		keepAlives: make(map[clientv3.LeaseID]chan *clientv3.LeaseKeepAliveResponse),
+	}
+}
+
+func (e *fakeEtcd) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	response := &clientv3.GetResponse{Header: &pb.ResponseHeader{Revision: e.revision}}
+	for k, v := range e.keys {
+		if strings.HasPrefix(k, key) {
+			response.Kvs = append(response.Kvs, &mvccpb.KeyValue{Key: []byte(k), Value: []byte(v)})
+		}
+	}
+	return response, nil
+}
+
+func (e *fakeEtcd) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	// The only option used is the lease of the last grant
+	if len(opts) > 0 {
+		e.mu.Lock()
+		e.leases[key] = e.nextLease
+		e.mu.Unlock()
+	}
+	e.put(key, val)
+	return &clientv3.PutResponse{}, nil
+}
+
+func (e *fakeEtcd) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.keys[key]; !ok {
+		return &clientv3.DeleteResponse{}, nil
+	}
+	e.revision++
+	delete(e.keys, key)
+	e.notify(clientv3.WatchResponse{
+		Header: pb.ResponseHeader{Revision: e.revision},
+		Events: []*clientv3.Event{{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: []byte(key)}}},
+	})
+	return &clientv3.DeleteResponse{Deleted: 1}, nil
+}
+
+func (e *fakeEtcd) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	watch := make(chan clientv3.WatchResponse, 16)
+	e.mu.Lock()
+	e.watches = append(e.watches, watch)
+	e.mu.Unlock()
+	return watch
+}
+
+func (e *fakeEtcd) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.nextLease++
+	return &clientv3.LeaseGrantResponse{ID: e.nextLease, TTL: ttl}, nil
+}
+
+func (e *fakeEtcd) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	keepAlive := make(chan *clientv3.LeaseKeepAliveResponse)
+	e.mu.Lock()
+	e.keepAlives[id] = keepAlive
+	e.mu.Unlock()
+	return keepAlive, nil
+}
+
+func (e *fakeEtcd) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	e.expire(id)
+	return &clientv3.LeaseRevokeResponse{}, nil
+}
+
+func (e *fakeEtcd) Close() error {
+	return nil
+}
+
+// put writes key and notifies the watchers
+func (e *fakeEtcd) put(key, value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.revision++
+	e.keys[key] = value
+	e.notify(clientv3.WatchResponse{
+		Header: pb.ResponseHeader{Revision: e.revision},
+		Events: []*clientv3.Event{{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte(key), Value: []byte(value)}}},
+	})
+}
+
+// expire drops the keys of lease id and ends its keepalives
+func (e *fakeEtcd) expire(id clientv3.LeaseID) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key, lease := range e.leases {
+		if lease == id {
+			delete(e.keys, key)
+			delete(e.leases, key)
+		}
+	}
+	if keepAlive, ok := e.keepAlives[id]; ok {
+		close(keepAlive)
+		delete(e.keepAlives, id)
+	}
+}
+
+// notify sends response to every watcher; e.mu must be held
+func (e *fakeEtcd) notify(response clientv3.WatchResponse) {
+	for _, watch := range e.watches {
+		watch <- response
+	}
+}
+
+// get returns the value of key
+func (e *fakeEtcd) get(key string) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	value, ok := e.keys[key]
+	return value, ok
+}
+
+func TestEtcdPolicyStore_LoadPolicies(t *testing.T) {
+	ctx := context.Background()
+	etcd := newFakeEtcd()
+	etcd.put("/enforcer/policies/alice-daily", "user: alice\nlimit: 1000\nwindow: 24h\nstatement_timeout: 30s\n")
+	etcd.put("/enforcer/policies/analysts-deny", "name: analysts-deny\nrole: analysts\nstatements: [ddl]\ndeny: true\n")
+	etcd.put("/enforcer/roles/analysts", "[bob, alice]")
+	store := newEtcdPolicyStore(etcd, etcd, etcd, logger.NewSimpleLogger(), WithEtcdPrefix("/enforcer"))
+
+	policies, err := store.LoadPolicies(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []domain.QuotaPolicy{
+		{Name: "alice-daily", User: "alice", Limit: 1000, Window: 24 * time.Hour, StatementTimeout: 30 * time.Second},
+		{Name: "analysts-deny", Role: "analysts", Statements: []domain.StatementClass{domain.StatementClassDDL}, Deny: true},
+	}, policies)
+	assert.Equal(t, int64(4), store.Revision())
+
+	roles, err := store.LoadRoles(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"analysts": {"alice", "bob"}}, roles)
+
+	etcd.put("/enforcer/policies/bob", "name: robert\nlimit: 1\nwindow: 1h\n")
+	_, err = store.LoadPolicies(ctx)
+	assert.ErrorContains(t, err, `quota policy "robert" is stored under /enforcer/policies/bob`)
+
+	etcd.put("/enforcer/policies/bob", "limit: 1\nwindow: 1h\nlimits: 2\n")
+	_, err = store.LoadPolicies(ctx)
+	assert.ErrorContains(t, err, "field limits not found", "Unknown fields should be rejected")
+}
+
+func TestEtcdPolicyStore_SyncPolicies(t *testing.T) {
+	ctx := context.Background()
+	etcd := newFakeEtcd()
+	etcd.put("/enforcer/policies/manual", "user: carol\nlimit: 10\nwindow: 1h\n")
+	etcd.put("/enforcer/policies/dropped", etcdManagedHeader+"user: dave\nlimit: 10\nwindow: 1h\n")
+	store := newEtcdPolicyStore(etcd, etcd, etcd, logger.NewSimpleLogger(), WithEtcdPrefix("/enforcer"))
+
+	declared := []domain.QuotaPolicy{
+		{Name: "alice-daily", User: "alice", Limit: 1000, Window: 24 * time.Hour, StatementTimeout: 30 * time.Second},
+		{Name: "analysts-deny", Role: "analysts", Statements: []domain.StatementClass{domain.StatementClassDDL}, Deny: true},
+		{Name: "manual", User: "carol", Limit: 20, Window: time.Hour},
+	}
+	failures, err := store.SyncPolicies(ctx, declared)
+	require.NoError(t, err)
+	require.Len(t, failures, 1)
+	assert.ErrorContains(t, failures["manual"], "by other means")
+
+	_, ok := etcd.get("/enforcer/policies/dropped")
+	assert.False(t, ok, "Policies written by the operator should be deleted once no longer declared")
+	value, _ := etcd.get("/enforcer/policies/manual")
+	assert.Equal(t, "user: carol\nlimit: 10\nwindow: 1h\n", value, "Policies written by other means should be left alone")
+	value, _ = etcd.get("/enforcer/policies/alice-daily")
+	assert.True(t, strings.HasPrefix(value, etcdManagedHeader))
+
+	policies, err := store.LoadPolicies(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []domain.QuotaPolicy{
+		declared[0], declared[1],
+		{Name: "manual", User: "carol", Limit: 10, Window: time.Hour},
+	}, policies, "Synced policies should load as declared")
+
+	revision := store.Revision()
+	_, err = store.SyncPolicies(ctx, declared)
+	require.NoError(t, err)
+	_, err = store.LoadPolicies(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, revision, store.Revision(), "Unchanged policies should not be written again")
+}
+
+func TestEtcdPolicyStore_Watch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	etcd := newFakeEtcd()
+	store := newEtcdPolicyStore(etcd, etcd, etcd, logger.NewSimpleLogger())
+	_, err := store.LoadPolicies(ctx)
+	require.NoError(t, err)
+
+	changes := make(chan struct{}, 16)
+	store.Watch(ctx, func() { changes <- struct{}{} })
+	require.Eventually(t, func() bool {
+		etcd.mu.Lock()
+		defer etcd.mu.Unlock()
+		return len(etcd.watches) == 1
+	}, time.Second, time.Millisecond)
+
+	etcd.put(DefaultEtcdPrefix+"instances/other", "{}")
+	etcd.put(DefaultEtcdPrefix+"policies/default", "limit: 1\nwindow: 1h\n")
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("A policy write should be reported")
+	}
+	assert.Empty(t, changes, "Registrations of instances should not be reported")
+
+	etcd.mu.Lock()
+	etcd.notify(clientv3.WatchResponse{CompactRevision: 10})
+	etcd.mu.Unlock()
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("A compaction should have everything loaded again")
+	}
+}
+
+func TestEtcdPolicyStore_Register(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	etcd := newFakeEtcd()
+	etcd.put(DefaultEtcdPrefix+"policies/default", "limit: 1\nwindow: 1h\n")
+	store := newEtcdPolicyStore(etcd, etcd, etcd, logger.NewSimpleLogger(), WithEtcdPolicyStoreClock(clock))
+	_, err := store.LoadPolicies(ctx)
+	require.NoError(t, err)
+
+	key := DefaultEtcdPrefix + "instances/enforcer-1"
+	store.Register(ctx, "enforcer-1")
+	store.Applied(ctx)
+	require.Eventually(t, func() bool {
+		value, _ := etcd.get(key)
+		return strings.Contains(value, `"revision":2`)
+	}, time.Second, time.Millisecond)
+
+	var instance EtcdInstance
+	value, _ := etcd.get(key)
+	require.NoError(t, json.Unmarshal([]byte(value), &instance))
+	assert.Equal(t, EtcdInstance{Revision: 2, AppliedAt: clock.Now()}, instance)
+
+	etcd.expire(1)
+	require.Eventually(t, func() bool {
+		clock.Advance(etcdRetryInterval)
+		_, ok := etcd.get(key)
+		return ok
+	}, time.Second, time.Millisecond, "A lost lease should be granted again")
+
+	require.NoError(t, store.Close())
+	_, ok := etcd.get(key)
+	assert.False(t, ok, "Closing should revoke the registration")
+}
@@ -0,0 +1,49 @@
+package adapters
+
+import (
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"sort"
+)
+
+// LoggingEventSink implements domain.EventSink by writing events to the logger
+type LoggingEventSink struct {
+	logger logger.Logger
+}
+
+// NewLoggingEventSink creates a LoggingEventSink
+func NewLoggingEventSink(log logger.Logger) *LoggingEventSink {
+	return &LoggingEventSink{logger: log}
+}
+
+// Emit logs the event with its fields
+func (s *LoggingEventSink) Emit(event domain.Event) {
+	log := s.logger.WithField("event", string(event.Type))
+	if event.InstanceID != "" {
+		log = log.WithField("instance_id", event.InstanceID)
+	}
+	if event.ConnectionID != "" {
+		log = log.WithField("connection_id", event.ConnectionID)
+	}
+
+	names := make([]string, 0, len(event.Fields))
+	for name := range event.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log = log.WithField(name, event.Fields[name])
+	}
+
+	log.Info("Event %s", event.Type)
+}
+
+// MultiEventSink implements domain.EventSink by forwarding every event to each of its sinks
+type MultiEventSink []domain.EventSink
+
+// Emit forwards the event to every sink
+func (s MultiEventSink) Emit(event domain.Event) {
+	for _, sink := range s {
+		sink.Emit(event)
+	}
+}
@@ -0,0 +1,243 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FaultKind describes the effect of a fault rule
+type FaultKind string
+
+const (
+	FaultLatency FaultKind = "latency"
+	FaultError   FaultKind = "error"
+	FaultReset   FaultKind = "reset"
+	FaultTimeout FaultKind = "timeout"
+)
+
+// FaultRule configures a fault at an injection point
+type FaultRule struct {
+	Point       domain.FaultPoint
+	Kind        FaultKind
+	Duration    time.Duration
+	Probability float64
+}
+
+// String formats the rule as ParseFaultRules parses it
+func (r FaultRule) String() string {
+	rule := string(r.Point) + ":" + string(r.Kind)
+	if r.Kind == FaultLatency || r.Kind == FaultTimeout {
+		rule += ":" + r.Duration.String()
+	}
+	if r.Probability < 1 {
+		rule += "@" + strconv.FormatFloat(r.Probability, 'g', -1, 64)
+	}
+	return rule
+}
+
+// FormatFaultRules formats rules as a specification ParseFaultRules parses
+func FormatFaultRules(rules []FaultRule) string {
+	specs := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		specs = append(specs, rule.String())
+	}
+	return strings.Join(specs, ";")
+}
+
+// NoopFaultInjector implements domain.FaultInjector without injecting anything
+type NoopFaultInjector struct{}
+
+// Inject never fails
+func (NoopFaultInjector) Inject(ctx context.Context, point domain.FaultPoint) error {
+	return nil
+}
+
+// RuleFaultInjector implements domain.FaultInjector from a mutable set of rules
+type RuleFaultInjector struct {
+	mu      sync.RWMutex
+	rules   []FaultRule // in the order they were set
+	byPoint map[domain.FaultPoint][]FaultRule
+	random  func() float64
+}
+
+// NewRuleFaultInjector creates a RuleFaultInjector with the given rules
+func NewRuleFaultInjector(rules ...FaultRule) *RuleFaultInjector {
+	injector := &RuleFaultInjector{
+		random: rand.Float64,
+	}
+	injector.SetRules(rules)
+	return injector
+}
+
+// SetRules replaces all configured rules
+func (f *RuleFaultInjector) SetRules(rules []FaultRule) {
+	byPoint := make(map[domain.FaultPoint][]FaultRule)
+	for _, rule := range rules {
+		byPoint[rule.Point] = append(byPoint[rule.Point], rule)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = slices.Clone(rules)
+	f.byPoint = byPoint
+}
+
+// Rules returns a copy of the configured rules
+func (f *RuleFaultInjector) Rules() []FaultRule {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return slices.Clone(f.rules)
+}
+
+// Inject applies every rule configured for the point in order
+func (f *RuleFaultInjector) Inject(ctx context.Context, point domain.FaultPoint) error {
+	f.mu.RLock()
+	rules := f.byPoint[point]
+	f.mu.RUnlock()
+
+	for _, rule := range rules {
+		if rule.Probability < 1 && f.random() >= rule.Probability {
+			continue
+		}
+
+		switch rule.Kind {
+		case FaultLatency:
+			if err := sleepContext(ctx, rule.Duration); err != nil {
+				return err
+			}
+		case FaultError:
+			return fmt.Errorf("%s: %w", point, domain.ErrInjectedFault)
+		case FaultReset:
+			return fmt.Errorf("%s: %w", point, domain.ErrInjectedReset)
+		case FaultTimeout:
+			if err := sleepContext(ctx, rule.Duration); err != nil {
+				return err
+			}
+			return fmt.Errorf("%s: %w", point, context.DeadlineExceeded)
+		}
+	}
+
+	return nil
+}
+
+// ParseFaultRules parses a semicolon separated fault specification. Each rule
+// has the form point:kind[:duration][@probability], for example
+// "client_read:latency:50ms;upstream_read:reset@0.05;store:timeout:2s@0.2".
+func ParseFaultRules(spec string) ([]FaultRule, error) {
+	var rules []FaultRule
+
+	for _, raw := range strings.Split(spec, ";") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		rule := FaultRule{Probability: 1}
+
+		if at := strings.LastIndex(raw, "@"); at >= 0 {
+			probability, err := strconv.ParseFloat(raw[at+1:], 64)
+			if err != nil || probability < 0 || probability > 1 {
+				return nil, fmt.Errorf("invalid fault probability in %q", raw)
+			}
+			rule.Probability = probability
+			raw = raw[:at]
+		}
+
+		parts := strings.Split(raw, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid fault rule %q: expected point:kind[:duration][@probability]", raw)
+		}
+
+		rule.Point = domain.FaultPoint(parts[0])
+		switch rule.Point {
+		case domain.FaultPointClientRead, domain.FaultPointUpstreamRead, domain.FaultPointUpstreamWrite, domain.FaultPointStore:
+		default:
+			return nil, fmt.Errorf("unknown fault point %q", parts[0])
+		}
+
+		rule.Kind = FaultKind(parts[1])
+		switch rule.Kind {
+		case FaultLatency, FaultTimeout:
+			if len(parts) != 3 {
+				return nil, fmt.Errorf("fault kind %q requires a duration in %q", rule.Kind, raw)
+			}
+			duration, err := time.ParseDuration(parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid fault duration in %q: %w", raw, err)
+			}
+			rule.Duration = duration
+		case FaultError, FaultReset:
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("fault kind %q does not take a duration in %q", rule.Kind, raw)
+			}
+		default:
+			return nil, fmt.Errorf("unknown fault kind %q", parts[1])
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// faultUsageStore applies the faults injected on the store before each call to
+// the wrapped store
+type faultUsageStore struct {
+	next   domain.UsageStore
+	faults domain.FaultInjector
+}
+
+// NewFaultUsageStore wraps store so that the faults configured for
+// domain.FaultPointStore fail or delay its calls
+func NewFaultUsageStore(store domain.UsageStore, faults domain.FaultInjector) domain.UsageStore {
+	return &faultUsageStore{next: store, faults: faults}
+}
+
+// Increment adds amount to the counter unless a fault is injected
+func (s *faultUsageStore) Increment(ctx context.Context, key domain.UsageKey, window time.Duration, amount int64) (domain.Usage, error) {
+	if err := s.faults.Inject(ctx, domain.FaultPointStore); err != nil {
+		return domain.Usage{}, err
+	}
+	return s.next.Increment(ctx, key, window, amount)
+}
+
+// Get returns the current usage unless a fault is injected
+func (s *faultUsageStore) Get(ctx context.Context, key domain.UsageKey, window time.Duration) (domain.Usage, error) {
+	if err := s.faults.Inject(ctx, domain.FaultPointStore); err != nil {
+		return domain.Usage{}, err
+	}
+	return s.next.Get(ctx, key, window)
+}
+
+// Reset clears the counter unless a fault is injected
+func (s *faultUsageStore) Reset(ctx context.Context, key domain.UsageKey) error {
+	if err := s.faults.Inject(ctx, domain.FaultPointStore); err != nil {
+		return err
+	}
+	return s.next.Reset(ctx, key)
+}
+
+// sleepContext sleeps for d or until the context is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
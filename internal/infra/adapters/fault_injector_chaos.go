@@ -0,0 +1,20 @@
+//go:build chaos
+
+package adapters
+
+import (
+	"pgbouncer-quota-enforcer/internal/app/domain"
+)
+
+// FaultInjectionEnabled reports whether this binary was built with the chaos tag
+const FaultInjectionEnabled = true
+
+// NewFaultInjector creates the process fault injector from the rules of spec,
+// which the admin API may replace later (see ParseFaultRules for the syntax)
+func NewFaultInjector(spec string) (domain.FaultInjector, error) {
+	rules, err := ParseFaultRules(spec)
+	if err != nil {
+		return nil, err
+	}
+	return NewRuleFaultInjector(rules...), nil
+}
@@ -0,0 +1,16 @@
+//go:build !chaos
+
+package adapters
+
+import (
+	"pgbouncer-quota-enforcer/internal/app/domain"
+)
+
+// FaultInjectionEnabled reports whether this binary was built with the chaos tag
+const FaultInjectionEnabled = false
+
+// NewFaultInjector returns a no-op injector whatever the rules of spec; fault
+// injection is only available in binaries built with the chaos tag
+func NewFaultInjector(spec string) (domain.FaultInjector, error) {
+	return NoopFaultInjector{}, nil
+}
@@ -0,0 +1,121 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFaultRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		spec        string
+		expected    []FaultRule
+		expectError bool
+	}{
+		{
+			name:     "Empty spec",
+			spec:     "",
+			expected: nil,
+		},
+		{
+			name: "Multiple rules",
+			spec: "client_read:latency:50ms; upstream_read:reset@0.05;store:timeout:2s@0.2",
+			expected: []FaultRule{
+				{Point: domain.FaultPointClientRead, Kind: FaultLatency, Duration: 50 * time.Millisecond, Probability: 1},
+				{Point: domain.FaultPointUpstreamRead, Kind: FaultReset, Probability: 0.05},
+				{Point: domain.FaultPointStore, Kind: FaultTimeout, Duration: 2 * time.Second, Probability: 0.2},
+			},
+		},
+		{name: "Unknown point", spec: "disk:error", expectError: true},
+		{name: "Unknown kind", spec: "store:explode", expectError: true},
+		{name: "Missing duration", spec: "store:latency", expectError: true},
+		{name: "Unexpected duration", spec: "store:error:1s", expectError: true},
+		{name: "Invalid probability", spec: "store:error@2", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseFaultRules(tt.spec)
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, rules)
+		})
+	}
+}
+
+func TestRuleFaultInjector_Inject(t *testing.T) {
+	ctx := context.Background()
+
+	injector := NewRuleFaultInjector(
+		FaultRule{Point: domain.FaultPointClientRead, Kind: FaultError, Probability: 0.5},
+		FaultRule{Point: domain.FaultPointUpstreamRead, Kind: FaultReset, Probability: 1},
+		FaultRule{Point: domain.FaultPointStore, Kind: FaultTimeout, Duration: time.Millisecond, Probability: 1},
+	)
+
+	roll := 0.9
+	injector.random = func() float64 { return roll }
+
+	assert.NoError(t, injector.Inject(ctx, domain.FaultPointClientRead), "Roll above probability should not fail")
+	roll = 0.1
+	assert.ErrorIs(t, injector.Inject(ctx, domain.FaultPointClientRead), domain.ErrInjectedFault)
+
+	assert.ErrorIs(t, injector.Inject(ctx, domain.FaultPointUpstreamRead), domain.ErrInjectedReset)
+	assert.ErrorIs(t, injector.Inject(ctx, domain.FaultPointStore), context.DeadlineExceeded)
+	assert.NoError(t, injector.Inject(ctx, domain.FaultPointUpstreamWrite), "Points without rules should not fail")
+
+	injector.SetRules(nil)
+	assert.NoError(t, injector.Inject(ctx, domain.FaultPointUpstreamRead))
+	assert.Empty(t, injector.Rules())
+}
+
+func TestRuleFaultInjector_LatencyHonorsContext(t *testing.T) {
+	injector := NewRuleFaultInjector(FaultRule{Point: domain.FaultPointClientRead, Kind: FaultLatency, Duration: time.Hour, Probability: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := injector.Inject(ctx, domain.FaultPointClientRead)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestFormatFaultRules(t *testing.T) {
+	spec := "client_read:latency:50ms;upstream_read:reset@0.05;store:timeout:2s@0.2;upstream_write:error"
+	rules, err := ParseFaultRules(spec)
+	require.NoError(t, err)
+	assert.Equal(t, spec, FormatFaultRules(rules))
+
+	injector := NewRuleFaultInjector(rules...)
+	assert.Equal(t, rules, injector.Rules(), "Rules should keep the order they were set in")
+}
+
+func TestFaultUsageStore(t *testing.T) {
+	ctx := context.Background()
+	key := domain.UsageKey{Policy: "default", User: "alice", Database: "app"}
+	injector := NewRuleFaultInjector()
+	store := NewFaultUsageStore(NewMemoryUsageStore(), injector)
+
+	_, err := store.Increment(ctx, key, time.Hour, 1)
+	require.NoError(t, err)
+
+	injector.SetRules([]FaultRule{{Point: domain.FaultPointStore, Kind: FaultError, Probability: 1}})
+	_, err = store.Increment(ctx, key, time.Hour, 1)
+	assert.ErrorIs(t, err, domain.ErrInjectedFault)
+	_, err = store.Get(ctx, key, time.Hour)
+	assert.ErrorIs(t, err, domain.ErrInjectedFault)
+	assert.ErrorIs(t, store.Reset(ctx, key), domain.ErrInjectedFault)
+
+	injector.SetRules(nil)
+	usage, err := store.Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), usage.Used, "Failed increments should not reach the store")
+}
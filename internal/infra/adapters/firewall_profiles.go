@@ -0,0 +1,84 @@
+package adapters
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"time"
+)
+
+// firewallProfileJSON is a profile of the firewall profile file
+type firewallProfileJSON struct {
+	User         string            `json:"user"`
+	LearnedSince time.Time         `json:"learned_since"`
+	Enforced     bool              `json:"enforced"`
+	Fingerprints map[string]string `json:"fingerprints"` // normalized query by fingerprint
+}
+
+// FileFirewallStore is a domain.FirewallProfileStore keeping the profiles of
+// the SQL firewall in a JSON file, which operators may review, edit or copy to
+// the other replicas
+type FileFirewallStore struct {
+	path string
+}
+
+// NewFileFirewallStore creates a FileFirewallStore saving profiles to path
+func NewFileFirewallStore(path string) *FileFirewallStore {
+	return &FileFirewallStore{path: path}
+}
+
+// LoadFirewallProfiles implements domain.FirewallProfileStore. A missing file
+// holds no profiles.
+func (s *FileFirewallStore) LoadFirewallProfiles(ctx context.Context) ([]domain.FirewallProfile, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []firewallProfileJSON
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid firewall profile file %s: %w", s.path, err)
+	}
+	profiles := make([]domain.FirewallProfile, 0, len(entries))
+	for _, entry := range entries {
+		if entry.User == "" {
+			return nil, fmt.Errorf("invalid firewall profile file %s: a profile has no user", s.path)
+		}
+		profiles = append(profiles, domain.FirewallProfile(entry))
+	}
+	return profiles, nil
+}
+
+// SaveFirewallProfiles implements domain.FirewallProfileStore. The file is
+// replaced whole, so that a crash never leaves a partial one.
+func (s *FileFirewallStore) SaveFirewallProfiles(ctx context.Context, profiles []domain.FirewallProfile) error {
+	entries := make([]firewallProfileJSON, 0, len(profiles))
+	for _, profile := range profiles {
+		entries = append(entries, firewallProfileJSON(profile))
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), s.path)
+}
@@ -0,0 +1,49 @@
+package adapters
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileFirewallStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "firewall.json")
+	store := NewFileFirewallStore(path)
+
+	profiles, err := store.LoadFirewallProfiles(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, profiles, "A missing file should hold no profiles")
+
+	saved := []domain.FirewallProfile{
+		{
+			User:         "billing",
+			LearnedSince: time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC),
+			Enforced:     true,
+			Fingerprints: map[string]string{"8f3a": "SELECT * FROM invoices WHERE id = $1", "": ""},
+		},
+		{User: "etl", LearnedSince: time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC), Fingerprints: map[string]string{}},
+	}
+	require.NoError(t, store.SaveFirewallProfiles(ctx, saved))
+	profiles, err = store.LoadFirewallProfiles(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, saved, profiles)
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "No temporary file should be left behind")
+
+	require.NoError(t, os.WriteFile(path, []byte(`[{"enforced": true}]`), 0o600))
+	_, err = store.LoadFirewallProfiles(ctx)
+	assert.ErrorContains(t, err, "a profile has no user")
+	require.NoError(t, os.WriteFile(path, []byte(`{`), 0o600))
+	_, err = store.LoadFirewallProfiles(ctx)
+	assert.Error(t, err)
+}
@@ -0,0 +1,131 @@
+package adapters
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// fuzzMaxBodyLen bounds message bodies so length fields cannot trigger huge allocations
+const fuzzMaxBodyLen = 1 << 20
+
+// encodeMessages concatenates the wire encoding of the given messages
+func encodeMessages(tb testing.TB, msgs ...pgproto3.Message) []byte {
+	tb.Helper()
+
+	var buf []byte
+	for _, msg := range msgs {
+		var err error
+		buf, err = msg.Encode(buf)
+		if err != nil {
+			tb.Fatalf("failed to encode %T: %v", msg, err)
+		}
+	}
+	return buf
+}
+
+func FuzzPostgreSQLParser_ReadMessage(f *testing.F) {
+	f.Add(encodeMessages(f, &pgproto3.Query{String: "SELECT 1"}))
+	f.Add(encodeMessages(f,
+		&pgproto3.Parse{Name: "s1", Query: "SELECT * FROM users WHERE id = $1", ParameterOIDs: []uint32{23}},
+		&pgproto3.Bind{PreparedStatement: "s1", Parameters: [][]byte{[]byte("42")}},
+		&pgproto3.Describe{ObjectType: 'P'},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	))
+	f.Add(encodeMessages(f, &pgproto3.Close{ObjectType: 'S', Name: "s1"}, &pgproto3.Flush{}, &pgproto3.Terminate{}))
+	f.Add([]byte{'Q', 0, 0, 0, 3})
+	f.Add([]byte{'X', 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parser := NewPostgreSQLParser(bytes.NewReader(data), io.Discard)
+		parser.backend.SetMaxBodyLen(fuzzMaxBodyLen)
+
+		// Every message must either parse or fail with an error; panics are bugs
+		for i := 0; i < len(data); i++ {
+			message, err := parser.ReadMessage()
+			if err != nil {
+				return
+			}
+			if message == nil {
+				t.Fatal("ReadMessage returned nil message without error")
+			}
+			if message.Type == "" {
+				t.Fatal("ReadMessage returned message without type")
+			}
+		}
+	})
+}
+
+func FuzzPgQueryNormalizer_Normalize(f *testing.F) {
+	f.Add("SELECT * FROM users WHERE id = 1")
+	f.Add("SELECT * FROM items WHERE category IN ('a', 'b', 'c')")
+	f.Add("INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y') RETURNING id")
+	f.Add("SELECT 1; SELECT 2")
+	f.Add("SELECT $1::text")
+	f.Add("SELECT '")
+	f.Add("")
+
+	normalizer := NewPgQueryNormalizer()
+
+	f.Fuzz(func(t *testing.T, query string) {
+		if !utf8.ValidString(query) {
+			t.Skip()
+		}
+
+		result, err := normalizer.Normalize(query)
+		if err != nil {
+			return
+		}
+
+		if result.Original != query {
+			t.Fatalf("Original = %q, want %q", result.Original, query)
+		}
+		if result.Hash.Value() == "" {
+			t.Fatal("successful normalization returned an empty hash")
+		}
+
+		// Normalization must be stable: normalizing the output again yields the same fingerprint
+		again, err := normalizer.Normalize(result.Normalized)
+		if err == nil && again.Normalized != result.Normalized {
+			t.Fatalf("Normalize is not idempotent: %q -> %q", result.Normalized, again.Normalized)
+		}
+	})
+}
+
+func FuzzRegexNormalizer_Normalize(f *testing.F) {
+	f.Add("SELECT * FROM users WHERE id = 1")
+	f.Add("SELECT * FROM items WHERE category IN ('a', 'b', 'c')")
+	f.Add("SELECT E'\\'', $tag$ 'x' $tag$, \"a\"\"b\" /* /* */ */ -- c")
+	f.Add("SELECT $2, 3.5e-1, 0x1F")
+	f.Add("SELECT '")
+	f.Add("")
+
+	normalizer := NewRegexNormalizer()
+
+	f.Fuzz(func(t *testing.T, query string) {
+		result, err := normalizer.Normalize(query)
+		if err != nil {
+			return
+		}
+
+		if result.Original != query {
+			t.Fatalf("Original = %q, want %q", result.Original, query)
+		}
+		if result.Hash.Value() == "" {
+			t.Fatal("successful normalization returned an empty hash")
+		}
+
+		// Literals are replaced by parameters, which fingerprint alike
+		again, err := normalizer.Normalize(result.Normalized)
+		if err != nil {
+			t.Fatalf("normalized query %q failed to normalize: %v", result.Normalized, err)
+		}
+		if again.Normalized != result.Normalized || again.Hash != result.Hash {
+			t.Fatalf("Normalize is not idempotent: %q -> %q", result.Normalized, again.Normalized)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package adapters
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// updateGolden regenerates the golden files instead of comparing against them:
+//
+//	go test ./internal/infra/adapters/ -run TestGoldenCorpus -update
+var updateGolden = flag.Bool("update", false, "regenerate golden files")
+
+const (
+	goldenQueriesFile  = "testdata/golden/queries.json"
+	goldenExpectedFile = "testdata/golden/expected.json"
+)
+
+// goldenEntry is the recorded normalization and analysis output for one query
+type goldenEntry struct {
+	Query       string   `json:"query"`
+	Normalized  string   `json:"normalized,omitempty"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	QueryType   string   `json:"query_type,omitempty"`
+	Tables      []string `json:"tables,omitempty"`
+	Joins       int      `json:"joins,omitempty"`
+	Cost        int64    `json:"cost,omitempty"`
+	Error       bool     `json:"error,omitempty"`
+}
+
+// buildGoldenEntry runs the normalizer and analyzer on a query
+func buildGoldenEntry(normalizer domain.QueryNormalizer, analyzer domain.QueryAnalyzer, query string) goldenEntry {
+	entry := goldenEntry{Query: query}
+
+	normalized, err := normalizer.Normalize(query)
+	if err != nil {
+		entry.Error = true
+		return entry
+	}
+	entry.Normalized = normalized.Normalized
+	entry.Fingerprint = normalized.Hash.Value()
+
+	analysis, err := analyzer.AnalyzeQuery(domain.NewQuery(query, "golden"))
+	if err != nil {
+		entry.Error = true
+		return entry
+	}
+	entry.QueryType = string(analysis.QueryType)
+	entry.Tables = analysis.Tables
+	entry.Joins = analysis.Joins
+	entry.Cost = analysis.EstimatedCost
+
+	return entry
+}
+
+func TestGoldenCorpus(t *testing.T) {
+	raw, err := os.ReadFile(goldenQueriesFile)
+	require.NoError(t, err)
+
+	var queries []string
+	require.NoError(t, json.Unmarshal(raw, &queries))
+
+	normalizer := NewPgQueryNormalizer()
+	analyzer := NewPgQueryAnalyzer()
+
+	actual := make([]goldenEntry, 0, len(queries))
+	for _, query := range queries {
+		actual = append(actual, buildGoldenEntry(normalizer, analyzer, query))
+	}
+
+	if *updateGolden {
+		out, err := json.MarshalIndent(actual, "", "  ")
+		require.NoError(t, err)
+		require.NoError(t, os.MkdirAll(filepath.Dir(goldenExpectedFile), 0o755))
+		require.NoError(t, os.WriteFile(goldenExpectedFile, append(out, '\n'), 0o644))
+		t.Logf("Updated %s with %d entries", goldenExpectedFile, len(actual))
+		return
+	}
+
+	raw, err = os.ReadFile(goldenExpectedFile)
+	require.NoError(t, err, "Run with -update to create the golden file")
+
+	var expected []goldenEntry
+	require.NoError(t, json.Unmarshal(raw, &expected))
+
+	expectedByQuery := make(map[string]goldenEntry, len(expected))
+	for _, entry := range expected {
+		expectedByQuery[entry.Query] = entry
+	}
+
+	for _, entry := range actual {
+		want, ok := expectedByQuery[entry.Query]
+		if !assert.True(t, ok, "Query missing from golden file (run with -update): %q", entry.Query) {
+			continue
+		}
+		assert.Equal(t, want, entry, "Golden mismatch for %q (run with -update if the change is intended)", entry.Query)
+	}
+	assert.Len(t, actual, len(expected), "Golden file and corpus differ in size (run with -update)")
+}
@@ -0,0 +1,128 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// answerGSSEncRequest answers a client's GSSENCRequest. Without a tunnel, or
+// when the upstream declines GSSAPI encryption, the request is declined and
+// the client goes on with its startup, unencrypted or over TLS; GSSAPI
+// authentication is still relayed then. It reports whether the connection was
+// tunnelled, in which case it has been relayed until it closed.
+func (h *PostgreSQLConnectionHandler) answerGSSEncRequest(ctx context.Context, conn net.Conn, listener string, connLogger logger.Logger) (bool, error) {
+	if !h.gssTunnel {
+		return false, declineGSSEncryption(conn)
+	}
+	route := h.route(listener, "")
+	if route.selector == nil {
+		return false, declineGSSEncryption(conn)
+	}
+	target, ok := route.selector.Next()
+	if !ok {
+		connLogger.Error("No upstream available to tunnel GSSAPI encryption to")
+		return false, declineGSSEncryption(conn)
+	}
+
+	upstream, accepted, err := requestGSSEncryption(ctx, target.Address, h.upstreamTimeout)
+	if err != nil {
+		connLogger.Error("Failed to request GSSAPI encryption from upstream: %v", err)
+		return false, declineGSSEncryption(conn)
+	}
+	if !accepted {
+		_ = upstream.Close()
+		return false, declineGSSEncryption(conn)
+	}
+	defer upstream.Close()
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return false, fmt.Errorf("failed to clear client deadline: %w", err)
+	}
+	if _, err := conn.Write([]byte{'G'}); err != nil {
+		return false, fmt.Errorf("failed to accept encryption: %w", err)
+	}
+	connLogger.Info("Tunnelling GSSAPI-encrypted connection to upstream %s; its queries are not enforced", target.Address)
+	tunnel(ctx, conn, upstream)
+	return true, nil
+}
+
+// declineGSSEncryption tells the client GSSAPI encryption is unavailable
+func declineGSSEncryption(conn net.Conn) error {
+	if _, err := conn.Write([]byte{'N'}); err != nil {
+		return fmt.Errorf("failed to decline encryption: %w", err)
+	}
+	return nil
+}
+
+// requestGSSEncryption dials address and sends it a GSSENCRequest, reporting
+// whether it accepted GSSAPI encryption. The connection is returned either way
+// and without deadline when accepted.
+func requestGSSEncryption(ctx context.Context, address string, timeout time.Duration) (net.Conn, bool, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to connect to upstream %s: %w", address, err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		_ = conn.Close()
+		return nil, false, err
+	}
+
+	request, err := (&pgproto3.GSSEncRequest{}).Encode(nil)
+	if err != nil {
+		_ = conn.Close()
+		return nil, false, err
+	}
+	if _, err := conn.Write(request); err != nil {
+		_ = conn.Close()
+		return nil, false, fmt.Errorf("failed to send GSSENCRequest: %w", err)
+	}
+	// The upstream answers with a single byte: G to go on with a GSSAPI
+	// handshake, N to decline; servers predating it send an ErrorResponse
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		_ = conn.Close()
+		return nil, false, fmt.Errorf("failed to read GSSENCRequest reply: %w", err)
+	}
+	if reply[0] != 'G' {
+		return conn, false, nil
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, false, err
+	}
+	return conn, true, nil
+}
+
+// tunnel copies bytes between client and upstream in both directions until
+// either side closes its connection or ctx is done. The upstream connection is
+// closed on return; the client connection is left to its handler.
+func tunnel(ctx context.Context, client, upstream net.Conn) {
+	done := make(chan struct{}, 2)
+	relay := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go relay(upstream, client)
+	go relay(client, upstream)
+
+	finished := 0
+	select {
+	case <-done:
+		finished++
+	case <-ctx.Done():
+	}
+	// Unblock the remaining copies: the upstream is closed, the client's pending
+	// read times out
+	_ = upstream.Close()
+	_ = client.SetDeadline(time.Now())
+	for ; finished < 2; finished++ {
+		<-done
+	}
+}
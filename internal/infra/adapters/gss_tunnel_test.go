@@ -0,0 +1,140 @@
+package adapters
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var gssEncRequest = []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x30}
+
+// startGSSUpstream starts a server accepting GSSAPI encryption and echoing
+// what it receives afterwards. The request it received is sent on the channel.
+func startGSSUpstream(t *testing.T) (string, <-chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	requests := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request := make([]byte, 8)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		requests <- request
+		if _, err := conn.Write([]byte{'G'}); err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+	}()
+	return listener.Addr().String(), requests
+}
+
+func TestPostgreSQLConnectionHandler_GSSAuthentication(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.RequireGSS("client-token")
+
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithUpstreams(upstreamSelector(backend.Addr())))
+	addr := startHandler(t, handler)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(2*time.Second)))
+
+	frontend := pgproto3.NewFrontend(conn, conn)
+	frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice@EXAMPLE.COM", "database": "app"},
+	})
+	require.NoError(t, frontend.Flush())
+
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.AuthenticationGSS{}, msg)
+	frontend.Send(&pgproto3.GSSResponse{Data: []byte("initial-token")})
+	require.NoError(t, frontend.Flush())
+
+	msg, err = frontend.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.AuthenticationGSSContinue{}, msg)
+	assert.Equal(t, []byte("server-token"), msg.(*pgproto3.AuthenticationGSSContinue).Data)
+	frontend.Send(&pgproto3.GSSResponse{Data: []byte("client-token")})
+	require.NoError(t, frontend.Flush())
+
+	for {
+		msg, err = frontend.Receive()
+		require.NoError(t, err)
+		if errorResponse, ok := msg.(*pgproto3.ErrorResponse); ok {
+			t.Fatalf("Authentication failed: %s", errorResponse.Message)
+		}
+		if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			break
+		}
+	}
+}
+
+func TestPostgreSQLConnectionHandler_GSSEncryptionTunnel(t *testing.T) {
+	upstream, requests := startGSSUpstream(t)
+	queryLogger := mocks.NewRecordingQueryLogger()
+	handler := NewPostgreSQLConnectionHandler(queryLogger, NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithUpstreams(upstreamSelector(upstream)), WithGSSEncryptionTunnel())
+	addr := startHandler(t, handler)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(2*time.Second)))
+
+	_, err = conn.Write(gssEncRequest)
+	require.NoError(t, err)
+	reply := make([]byte, 1)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, byte('G'), reply[0])
+	assert.Equal(t, gssEncRequest, <-requests, "The request should be forwarded upstream")
+
+	// Whatever follows is relayed as is
+	_, err = conn.Write([]byte("opaque GSSAPI token"))
+	require.NoError(t, err)
+	echoed := make([]byte, len("opaque GSSAPI token"))
+	_, err = io.ReadFull(conn, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "opaque GSSAPI token", string(echoed))
+	assert.Empty(t, queryLogger.Sessions())
+}
+
+func TestPostgreSQLConnectionHandler_GSSEncryptionDeclined(t *testing.T) {
+	upstream, requests := startGSSUpstream(t)
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithUpstreams(upstreamSelector(upstream)))
+	addr := startHandler(t, handler)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(2*time.Second)))
+
+	_, err = conn.Write(gssEncRequest)
+	require.NoError(t, err)
+	reply := make([]byte, 1)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, byte('N'), reply[0], "GSSAPI encryption should be declined without a tunnel")
+	assert.Empty(t, requests, "The upstream should not be asked")
+}
@@ -0,0 +1,344 @@
+package adapters
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"os"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"slices"
+	"strings"
+	"time"
+)
+
+// errInvalidToken reports a JSON Web Token that failed verification
+var errInvalidToken = errors.New("invalid token")
+
+// jwtAlgorithm describes a JWS signature algorithm by its hash
+type jwtAlgorithm struct {
+	hash crypto.Hash
+}
+
+// jwtAlgorithms are the signature algorithms tokens may be signed with, from
+// RFC 7518; none is never accepted
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"HS256": {crypto.SHA256}, "HS384": {crypto.SHA384}, "HS512": {crypto.SHA512},
+	"RS256": {crypto.SHA256}, "RS384": {crypto.SHA384}, "RS512": {crypto.SHA512},
+	"ES256": {crypto.SHA256}, "ES384": {crypto.SHA384}, "ES512": {crypto.SHA512},
+}
+
+// JWTVerifier verifies the signature and registered claims of JSON Web Tokens
+// in the compact serialization. Tokens are signed with HMAC (HS256, HS384,
+// HS512) under a shared secret, or with RSA (RS256, RS384, RS512) or ECDSA
+// (ES256, ES384, ES512) under one of a set of public keys.
+type JWTVerifier struct {
+	secret   []byte
+	keyFile  string
+	keys     []crypto.PublicKey
+	issuer   string
+	audience string
+	leeway   time.Duration
+	clock    domain.Clock
+}
+
+// JWTVerifierOption configures optional behavior of a JWTVerifier
+type JWTVerifierOption func(*JWTVerifier)
+
+// WithJWTSecret accepts tokens signed with HMAC under secret
+func WithJWTSecret(secret []byte) JWTVerifierOption {
+	return func(v *JWTVerifier) {
+		v.secret = secret
+	}
+}
+
+// WithJWTPublicKeys accepts tokens signed with RSA or ECDSA under one of the
+// keys of a PEM file, given as public keys or certificates
+func WithJWTPublicKeys(file string) JWTVerifierOption {
+	return func(v *JWTVerifier) {
+		v.keyFile = file
+	}
+}
+
+// WithJWTIssuer requires the iss claim to be issuer
+func WithJWTIssuer(issuer string) JWTVerifierOption {
+	return func(v *JWTVerifier) {
+		v.issuer = issuer
+	}
+}
+
+// WithJWTAudience requires the aud claim to name audience
+func WithJWTAudience(audience string) JWTVerifierOption {
+	return func(v *JWTVerifier) {
+		v.audience = audience
+	}
+}
+
+// WithJWTLeeway tolerates clock skew of up to leeway when checking exp and nbf
+func WithJWTLeeway(leeway time.Duration) JWTVerifierOption {
+	return func(v *JWTVerifier) {
+		v.leeway = leeway
+	}
+}
+
+// WithJWTClock sets the clock tokens are checked for expiry against
+func WithJWTClock(clock domain.Clock) JWTVerifierOption {
+	return func(v *JWTVerifier) {
+		v.clock = clock
+	}
+}
+
+// NewJWTVerifier creates a JWTVerifier, which needs a secret or public keys
+func NewJWTVerifier(opts ...JWTVerifierOption) (*JWTVerifier, error) {
+	v := &JWTVerifier{clock: SystemClock{}}
+	for _, opt := range opts {
+		opt(v)
+	}
+	if v.keyFile != "" {
+		keys, err := loadJWTPublicKeys(v.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = keys
+	}
+	if len(v.secret) == 0 && len(v.keys) == 0 {
+		return nil, fmt.Errorf("JWT verification needs a secret or public keys")
+	}
+	if v.leeway < 0 {
+		return nil, fmt.Errorf("JWT leeway must not be negative")
+	}
+	return v, nil
+}
+
+// loadJWTPublicKeys reads the RSA and ECDSA public keys of a PEM file
+func loadJWTPublicKeys(file string) ([]crypto.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT public keys: %w", err)
+	}
+
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var key crypto.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var certificate *x509.Certificate
+			if certificate, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = certificate.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT public key in %s: %w", file, err)
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			keys = append(keys, key)
+		default:
+			return nil, fmt.Errorf("unsupported JWT public key in %s: %T", file, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public key found in %s", file)
+	}
+	return keys, nil
+}
+
+// Verify checks the signature of token, its expiry and not-before times and
+// its issuer and audience when required, and returns its claims. Numbers are
+// returned as json.Number.
+func (v *JWTVerifier) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a compact JWS", errInvalidToken)
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", errInvalidToken, err)
+	}
+	algorithm, ok := jwtAlgorithms[header.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", errInvalidToken, header.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", errInvalidToken, err)
+	}
+	if !v.verifySignature(header.Algorithm, algorithm.hash, parts[0]+"."+parts[1], signature) {
+		return nil, fmt.Errorf("%w: bad signature", errInvalidToken)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", errInvalidToken, err)
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// decodeJWTPart decodes a base64url-encoded JSON object into target
+func decodeJWTPart(part string, target interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(target)
+}
+
+// verifySignature checks the signature of signed, the encoded header and
+// claims, with the keys matching the family of the algorithm
+func (v *JWTVerifier) verifySignature(name string, hash crypto.Hash, signed string, signature []byte) bool {
+	digest := hash.New()
+	digest.Write([]byte(signed))
+	sum := digest.Sum(nil)
+
+	switch name[:2] {
+	case "HS":
+		if len(v.secret) == 0 {
+			return false
+		}
+		mac := hmac.New(jwtHashFunc(hash), v.secret)
+		mac.Write([]byte(signed))
+		return hmac.Equal(mac.Sum(nil), signature)
+	case "RS":
+		for _, key := range v.keys {
+			if rsaKey, ok := key.(*rsa.PublicKey); ok && rsa.VerifyPKCS1v15(rsaKey, hash, sum, signature) == nil {
+				return true
+			}
+		}
+	case "ES":
+		for _, key := range v.keys {
+			ecKey, ok := key.(*ecdsa.PublicKey)
+			if !ok {
+				continue
+			}
+			// ES signatures are r and s as big-endian integers of the curve's size
+			size := (ecKey.Curve.Params().BitSize + 7) / 8
+			if len(signature) != 2*size {
+				continue
+			}
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(ecKey, sum, r, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jwtHashFunc returns the constructor of hash for HMAC
+func jwtHashFunc(algorithm crypto.Hash) func() hash.Hash {
+	switch algorithm {
+	case crypto.SHA384:
+		return sha512.New384
+	case crypto.SHA512:
+		return sha512.New
+	default:
+		return sha256.New
+	}
+}
+
+// checkClaims checks the registered claims of a verified token
+func (v *JWTVerifier) checkClaims(claims map[string]interface{}) error {
+	now := v.clock.Now()
+	if exp, ok, err := numericDate(claims, "exp"); err != nil {
+		return err
+	} else if ok && !now.Before(exp.Add(v.leeway)) {
+		return fmt.Errorf("%w: expired at %s", errInvalidToken, exp.UTC().Format(time.RFC3339))
+	}
+	if nbf, ok, err := numericDate(claims, "nbf"); err != nil {
+		return err
+	} else if ok && now.Add(v.leeway).Before(nbf) {
+		return fmt.Errorf("%w: not valid before %s", errInvalidToken, nbf.UTC().Format(time.RFC3339))
+	}
+
+	if v.issuer != "" {
+		if issuer, _ := claims["iss"].(string); issuer != v.issuer {
+			return fmt.Errorf("%w: unexpected issuer %q", errInvalidToken, issuer)
+		}
+	}
+	if v.audience != "" && !slices.Contains(audiences(claims["aud"]), v.audience) {
+		return fmt.Errorf("%w: audience %q not granted", errInvalidToken, v.audience)
+	}
+	return nil
+}
+
+// numericDate reads a claim holding seconds since the epoch
+func numericDate(claims map[string]interface{}, name string) (time.Time, bool, error) {
+	value, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("%w: %s is not a number", errInvalidToken, name)
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%w: %s is not a number", errInvalidToken, name)
+	}
+	return time.Unix(0, 0).Add(time.Duration(seconds * float64(time.Second))), true, nil
+}
+
+// audiences returns the audiences of an aud claim, a string or an array of strings
+func audiences(value interface{}) []string {
+	switch aud := value.(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		var names []string
+		for _, name := range aud {
+			if s, ok := name.(string); ok {
+				names = append(names, s)
+			}
+		}
+		return names
+	default:
+		return nil
+	}
+}
+
+// ClaimString returns a claim as a string: strings as they are, numbers and
+// booleans as written in the token. Other claims, and missing ones, are not
+// reported.
+func ClaimString(claims map[string]interface{}, name string) (string, bool) {
+	switch value := claims[name].(type) {
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return fmt.Sprint(value), true
+	default:
+		return "", false
+	}
+}
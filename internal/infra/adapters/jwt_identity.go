@@ -0,0 +1,116 @@
+package adapters
+
+import (
+	"errors"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// redactedToken replaces tokens in the protocol log
+const redactedToken = "[redacted]"
+
+// JWTIdentity attributes connections to the tenant named by a JSON Web Token
+// the client presents, as cloud PostgreSQL proxies do, instead of to the role
+// it logs in as
+type JWTIdentity struct {
+	Verifier *JWTVerifier
+
+	// Parameter is the startup parameter carrying the token, which is neither
+	// logged nor forwarded upstream; clients keep authenticating with the
+	// upstream. Empty takes the token as the password: the enforcer asks for it
+	// in cleartext and logs into the upstream with its own credentials.
+	Parameter string
+
+	// UserClaim names the claim quotas are attributed to in place of the user
+	// name, e.g. org_id; empty keeps the user name. Tokens without it are rejected.
+	UserClaim string
+
+	// LabelClaims sets connection labels from claims, by claim name, e.g.
+	// plan=plan. They replace the labels of the same name the client supplies,
+	// which are dropped when the token lacks the claim.
+	LabelClaims map[string]string
+}
+
+// WithJWTIdentity verifies the token clients present according to identity and
+// attributes their connections to its claims. Clients without a valid token are
+// rejected.
+func WithJWTIdentity(identity JWTIdentity) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.jwtIdentity = &identity
+	}
+}
+
+// redactToken hides the token among the startup parameters logged for a
+// StartupMessage, leaving params untouched
+func (h *PostgreSQLConnectionHandler) redactToken(details map[string]interface{}) {
+	if h.jwtIdentity == nil || h.jwtIdentity.Parameter == "" {
+		return
+	}
+	if _, ok := details[h.jwtIdentity.Parameter]; ok {
+		details[h.jwtIdentity.Parameter] = redactedToken
+	}
+}
+
+// authenticateJWT verifies the client's token and attributes session to its
+// claims, reporting whether the client may continue. Invalid tokens are
+// answered with a FATAL error.
+func (h *PostgreSQLConnectionHandler) authenticateJWT(parser *PostgreSQLParser, writer *PostgreSQLResponseWriter, session *domain.Session, connLogger logger.Logger) (bool, error) {
+	identity := h.jwtIdentity
+	code := pgerrInvalidAuthorization
+	var token string
+	if identity.Parameter != "" {
+		token = session.Parameters[identity.Parameter]
+		delete(session.Parameters, identity.Parameter)
+	} else {
+		code = pgerrInvalidPassword
+		if err := parser.Send(&pgproto3.AuthenticationCleartextPassword{}); err != nil {
+			return false, fmt.Errorf("failed to request password: %w", err)
+		}
+		response, err := readAuthResponse[*pgproto3.PasswordMessage](parser, pgproto3.AuthTypeCleartextPassword)
+		if err != nil && !errors.Is(err, errAuthenticationFailed) {
+			return false, err
+		}
+		if response != nil {
+			token = response.Password
+		}
+	}
+
+	claims, err := identity.Verifier.Verify(token)
+	user := session.User
+	if err == nil && identity.UserClaim != "" {
+		var ok bool
+		if user, ok = ClaimString(claims, identity.UserClaim); !ok || user == "" {
+			err = fmt.Errorf("%w: no %s claim", errInvalidToken, identity.UserClaim)
+		}
+	}
+	if err != nil {
+		connLogger.Info("Token authentication of %s failed: %v", session.User, err)
+		return false, writer.Reject(code, fmt.Sprintf("token authentication failed for user %q", session.User))
+	}
+
+	if user != session.User {
+		connLogger.Debug("Attributing connection of %s to %s", session.User, user)
+		session.User = user
+	}
+	for claim, label := range identity.LabelClaims {
+		value, ok := ClaimString(claims, claim)
+		if !ok {
+			delete(session.Labels, label)
+			continue
+		}
+		if session.Labels == nil {
+			session.Labels = make(map[string]string)
+		}
+		session.Labels[label] = value
+	}
+
+	if identity.Parameter == "" {
+		if err := parser.Send(&pgproto3.AuthenticationOk{}); err != nil {
+			return false, fmt.Errorf("failed to confirm authentication: %w", err)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,253 @@
+package adapters
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signJWT signs claims with algorithm under key, a secret for HS algorithms
+// and a private key otherwise
+func signJWT(t *testing.T, algorithm string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": algorithm, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := jwtAlgorithms[algorithm].hash
+	digest := hash.New()
+	digest.Write([]byte(signed))
+	sum := digest.Sum(nil)
+
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(jwtHashFunc(hash), key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, sum)
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum)
+		require.NoError(t, err)
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// writePublicKeys writes the public keys of keys to a PEM file and returns its path
+func writePublicKeys(t *testing.T, keys ...crypto.Signer) string {
+	t.Helper()
+	var data []byte
+	for _, key := range keys {
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		require.NoError(t, err)
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...)
+	}
+	path := filepath.Join(t.TempDir(), "keys.pem")
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	return path
+}
+
+func TestJWTVerifier(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clock := testkit.NewFakeClock(now)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	secret := []byte("shared-secret")
+
+	verifier, err := NewJWTVerifier(WithJWTSecret(secret), WithJWTPublicKeys(writePublicKeys(t, rsaKey, ecKey)),
+		WithJWTIssuer("https://auth.example.com"), WithJWTAudience("postgres"), WithJWTLeeway(time.Minute), WithJWTClock(clock))
+	require.NoError(t, err)
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss": "https://auth.example.com", "aud": []string{"api", "postgres"},
+			"exp": now.Add(time.Hour).Unix(), "org_id": "acme", "seats": 25,
+		}
+	}
+	for algorithm, key := range map[string]interface{}{"HS256": secret, "HS512": secret, "RS256": rsaKey, "ES256": ecKey} {
+		t.Run(algorithm, func(t *testing.T) {
+			claims, err := verifier.Verify(signJWT(t, algorithm, key, valid()))
+			require.NoError(t, err)
+			org, _ := ClaimString(claims, "org_id")
+			seats, _ := ClaimString(claims, "seats")
+			assert.Equal(t, "acme", org)
+			assert.Equal(t, "25", seats, "Numbers should be kept as written")
+		})
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tests := map[string]string{
+		"wrong secret":    signJWT(t, "HS256", []byte("guess"), valid()),
+		"unknown key":     signJWT(t, "ES256", otherKey, valid()),
+		"key of RS as HS": signJWT(t, "HS256", x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey), valid()),
+		"not a JWT":       "acme",
+	}
+	for name, change := range map[string]func(map[string]interface{}){
+		"expired":        func(c map[string]interface{}) { c["exp"] = now.Add(-2 * time.Minute).Unix() },
+		"not yet valid":  func(c map[string]interface{}) { c["nbf"] = now.Add(2 * time.Minute).Unix() },
+		"wrong issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"wrong audience": func(c map[string]interface{}) { c["aud"] = "api" },
+		"text exp":       func(c map[string]interface{}) { c["exp"] = "tomorrow" },
+	} {
+		claims := valid()
+		change(claims)
+		tests[name] = signJWT(t, "HS256", secret, claims)
+	}
+	unsigned := valid()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload, _ := json.Marshal(unsigned)
+	tests["alg none"] = header + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := verifier.Verify(token)
+			assert.ErrorIs(t, err, errInvalidToken)
+		})
+	}
+
+	claims := valid()
+	claims["exp"] = now.Add(-30 * time.Second).Unix()
+	_, err = verifier.Verify(signJWT(t, "HS256", secret, claims))
+	assert.NoError(t, err, "Tokens expired within the leeway should be accepted")
+
+	_, err = NewJWTVerifier()
+	assert.Error(t, err)
+	_, err = NewJWTVerifier(WithJWTPublicKeys(filepath.Join(t.TempDir(), "missing.pem")))
+	assert.Error(t, err)
+}
+
+// startJWTHandler starts a handler attributing connections to the org_id claim
+// of tokens signed with secret, labelled with their plan
+func startJWTHandler(t *testing.T, backend *testkit.FakeBackend, engine *mocks.StaticPolicyEngine, queryLogger *mocks.RecordingQueryLogger, parameter string, secret []byte, opts ...ConnectionHandlerOption) string {
+	t.Helper()
+	verifier, err := NewJWTVerifier(WithJWTSecret(secret))
+	require.NoError(t, err)
+	opts = append(opts, WithPolicyEngine(engine), WithUpstreams(upstreamSelector(backend.Addr())),
+		WithJWTIdentity(JWTIdentity{Verifier: verifier, Parameter: parameter, UserClaim: "org_id", LabelClaims: map[string]string{"plan": "plan"}}))
+	handler := NewPostgreSQLConnectionHandler(queryLogger, NewPgQueryNormalizer(), logger.NewSimpleLogger(), opts...)
+	return startHandler(t, handler)
+}
+
+func TestPostgreSQLConnectionHandler_JWTPassword(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.RequirePassword("upstream-secret")
+	secret := []byte("shared-secret")
+	engine := &mocks.StaticPolicyEngine{}
+	addr := startJWTHandler(t, backend, engine, mocks.NewRecordingQueryLogger(), "", secret,
+		WithUpstreamCredentials("shared", "upstream-secret"))
+
+	token := signJWT(t, "HS256", secret, map[string]interface{}{"org_id": "acme", "plan": "pro"})
+	conn, err := connectLibpq(t, addr, "app", token)
+	require.NoError(t, err)
+	defer conn.Close(context.Background())
+	_, err = conn.Exec(context.Background(), "SELECT 1").ReadAll()
+	require.NoError(t, err)
+
+	queries := engine.Queries()
+	require.Len(t, queries, 1)
+	assert.Equal(t, "acme", queries[0].UserID, "Quotas should apply to the tenant of the token")
+	assert.Equal(t, map[string]string{"plan": "pro"}, queries[0].Labels)
+	assert.Equal(t, "shared", backend.StartupParameters()[0]["user"], "The upstream should see the shared credentials")
+
+	for name, password := range map[string]string{
+		"forged token":     signJWT(t, "HS256", []byte("guess"), map[string]interface{}{"org_id": "acme"}),
+		"no org_id claim":  signJWT(t, "HS256", secret, map[string]interface{}{"plan": "pro"}),
+		"regular password": "upstream-secret",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := connectLibpq(t, addr, "app", password)
+			var pgErr *pgconn.PgError
+			require.ErrorAs(t, err, &pgErr)
+			assert.Equal(t, pgerrInvalidPassword, pgErr.Code)
+		})
+	}
+	assert.Len(t, backend.StartupParameters(), 1, "Rejected tokens should not reach the upstream")
+}
+
+func TestPostgreSQLConnectionHandler_JWTParameter(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	secret := []byte("shared-secret")
+	engine := &mocks.StaticPolicyEngine{}
+	queryLogger := mocks.NewRecordingQueryLogger()
+	addr := startJWTHandler(t, backend, engine, queryLogger, "jwt", secret)
+
+	connect := func(token string) (*pgproto3.Frontend, net.Conn) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		frontend := pgproto3.NewFrontend(conn, conn)
+		frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "app", "database": "app", "jwt": token, "label.plan": "enterprise"},
+		})
+		require.NoError(t, frontend.Flush())
+		return frontend, conn
+	}
+
+	token := signJWT(t, "HS256", secret, map[string]interface{}{"org_id": 42})
+	frontend, _ := connect(token)
+	for {
+		message, err := frontend.Receive()
+		require.NoError(t, err)
+		if _, ok := message.(*pgproto3.ReadyForQuery); ok {
+			break
+		}
+	}
+	frontend.Send(&pgproto3.Query{String: "SELECT 1"})
+	require.NoError(t, frontend.Flush())
+
+	require.Eventually(t, func() bool { return len(engine.Queries()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "42", engine.Queries()[0].UserID)
+	assert.Empty(t, engine.Queries()[0].Labels, "Labels of claims the token lacks should not be spoofed")
+	startup := backend.StartupParameters()[0]
+	assert.Equal(t, "app", startup["user"], "Clients should keep their own upstream login")
+	assert.NotContains(t, startup, "jwt", "The token should not be forwarded")
+	require.Len(t, queryLogger.Sessions(), 1)
+	assert.NotContains(t, queryLogger.Sessions()[0].Parameters, "jwt")
+
+	frontend, _ = connect(token[:len(token)-2])
+	message, err := frontend.Receive()
+	require.NoError(t, err)
+	rejection, ok := message.(*pgproto3.ErrorResponse)
+	require.True(t, ok, fmt.Sprintf("expected an error, got %T", message))
+	assert.Equal(t, pgerrInvalidAuthorization, rejection.Code)
+
+	details := map[string]interface{}{"user": "app", "jwt": token}
+	handler := &PostgreSQLConnectionHandler{jwtIdentity: &JWTIdentity{Parameter: "jwt"}}
+	handler.redactToken(details)
+	assert.Equal(t, redactedToken, details["jwt"], "The token should not be logged")
+}
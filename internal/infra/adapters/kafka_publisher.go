@@ -0,0 +1,352 @@
+package adapters
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+const (
+	// DefaultKafkaBatchSize is how many events are produced together at most
+	DefaultKafkaBatchSize = 500
+
+	// DefaultKafkaLinger is how long events wait for their batch to fill
+	DefaultKafkaLinger = 100 * time.Millisecond
+
+	// DefaultKafkaTimeout bounds connecting to a broker and the delivery of a batch
+	DefaultKafkaTimeout = 10 * time.Second
+
+	// DefaultKafkaBuffer is how many events may wait to be published before new
+	// ones are dropped
+	DefaultKafkaBuffer = 10000
+
+	// kafkaClientID identifies the publisher in broker logs and quotas
+	kafkaClientID = "pgbouncer-quota-enforcer"
+)
+
+// KafkaKey selects the event field that keys Kafka messages. Messages with the
+// same key land in the same partition, so consumers see them in order.
+type KafkaKey string
+
+const (
+	KafkaKeyUser      KafkaKey = "user"       // events of a user are ordered
+	KafkaKeyQueryHash KafkaKey = "query_hash" // events of a normalized query are ordered
+)
+
+// ParseKafkaKey validates a message key setting; empty selects KafkaKeyUser
+func ParseKafkaKey(key string) (KafkaKey, error) {
+	switch KafkaKey(key) {
+	case "":
+		return KafkaKeyUser, nil
+	case KafkaKeyUser, KafkaKeyQueryHash:
+		return KafkaKey(key), nil
+	default:
+		return "", fmt.Errorf("unknown Kafka message key %q: use user or query_hash", key)
+	}
+}
+
+// KafkaSASLMechanism authenticates the publisher to the brokers
+type KafkaSASLMechanism string
+
+const (
+	KafkaSASLPlain       KafkaSASLMechanism = "PLAIN"
+	KafkaSASLScramSHA256 KafkaSASLMechanism = "SCRAM-SHA-256"
+	KafkaSASLScramSHA512 KafkaSASLMechanism = "SCRAM-SHA-512"
+)
+
+// ParseKafkaSASLMechanism validates a SASL mechanism setting; empty disables SASL
+func ParseKafkaSASLMechanism(mechanism string) (KafkaSASLMechanism, error) {
+	switch parsed := KafkaSASLMechanism(strings.ToUpper(mechanism)); parsed {
+	case "", KafkaSASLPlain, KafkaSASLScramSHA256, KafkaSASLScramSHA512:
+		return parsed, nil
+	default:
+		return "", fmt.Errorf("unknown Kafka SASL mechanism %q: use PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512", mechanism)
+	}
+}
+
+// KafkaPublisher implements domain.QueryEventPublisher by producing events to a
+// Kafka topic as JSON messages shaped like audit log records. Events are queued
+// and produced in batches by a background goroutine, so publishing never waits
+// for the brokers; events beyond the queue's capacity are dropped. Produce
+// requests wait for every in-sync replica; the client follows partition leaders
+// as they move and retries failed records until the timeout runs out.
+//
+// Brokers are reached over plaintext or TLS listeners, optionally
+// authenticating with SASL PLAIN or SCRAM.
+type KafkaPublisher struct {
+	key       KafkaKey
+	batchSize int
+	linger    time.Duration
+	timeout   time.Duration
+	tlsConfig *tls.Config
+	sasl      sasl.Mechanism
+	logger    logger.Logger
+
+	client  *kgo.Client
+	mu      sync.RWMutex
+	closed  bool
+	events  chan domain.QueryEvent
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+// KafkaPublisherOption configures optional behavior of a KafkaPublisher
+type KafkaPublisherOption func(*KafkaPublisher)
+
+// WithKafkaKey selects the event field that keys messages
+func WithKafkaKey(key KafkaKey) KafkaPublisherOption {
+	return func(p *KafkaPublisher) {
+		p.key = key
+	}
+}
+
+// WithKafkaBatchSize caps the events of a produce request
+func WithKafkaBatchSize(size int) KafkaPublisherOption {
+	return func(p *KafkaPublisher) {
+		p.batchSize = size
+	}
+}
+
+// WithKafkaLinger sets how long events wait for their batch to fill
+func WithKafkaLinger(linger time.Duration) KafkaPublisherOption {
+	return func(p *KafkaPublisher) {
+		p.linger = linger
+	}
+}
+
+// WithKafkaTimeout bounds connecting to a broker and the delivery of a batch
+func WithKafkaTimeout(timeout time.Duration) KafkaPublisherOption {
+	return func(p *KafkaPublisher) {
+		p.timeout = timeout
+	}
+}
+
+// WithKafkaTLS connects to the brokers over TLS. The server name defaults to
+// the host of each broker.
+func WithKafkaTLS(config *tls.Config) KafkaPublisherOption {
+	return func(p *KafkaPublisher) {
+		p.tlsConfig = config
+	}
+}
+
+// WithKafkaSASL authenticates to the brokers with mechanism and the credentials
+// of user
+func WithKafkaSASL(mechanism KafkaSASLMechanism, user, password string) KafkaPublisherOption {
+	return func(p *KafkaPublisher) {
+		switch mechanism {
+		case KafkaSASLPlain:
+			p.sasl = plain.Auth{User: user, Pass: password}.AsMechanism()
+		case KafkaSASLScramSHA256:
+			p.sasl = scram.Auth{User: user, Pass: password}.AsSha256Mechanism()
+		case KafkaSASLScramSHA512:
+			p.sasl = scram.Auth{User: user, Pass: password}.AsSha512Mechanism()
+		default:
+			p.sasl = nil
+		}
+	}
+}
+
+// LoadKafkaTLSConfig builds the TLS configuration used to connect to brokers.
+// Certificates are verified against the CAs of caFile, or the system roots when
+// it is empty. certFile and keyFile, when set, hold the client certificate
+// presented to brokers that ask for one.
+func LoadKafkaTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Kafka client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// NewKafkaPublisher creates a KafkaPublisher producing to topic and starts
+// publishing. The brokers, given as host:port, only bootstrap the discovery of
+// the cluster; the topic must exist or be created automatically by the brokers.
+func NewKafkaPublisher(brokers []string, topic string, log logger.Logger, opts ...KafkaPublisherOption) (*KafkaPublisher, error) {
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("kafka publisher needs at least one broker")
+	}
+	if topic == "" {
+		return nil, fmt.Errorf("kafka publisher needs a topic")
+	}
+
+	p := &KafkaPublisher{
+		key:       KafkaKeyUser,
+		batchSize: DefaultKafkaBatchSize,
+		linger:    DefaultKafkaLinger,
+		timeout:   DefaultKafkaTimeout,
+		logger:    log,
+		events:    make(chan domain.QueryEvent, DefaultKafkaBuffer),
+		done:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if _, err := ParseKafkaKey(string(p.key)); err != nil {
+		return nil, err
+	}
+	if p.batchSize <= 0 || p.linger <= 0 || p.timeout <= 0 {
+		return nil, fmt.Errorf("kafka batch size, linger and timeout must be positive")
+	}
+
+	// Batches are formed by run, so the client sends records as soon as they are produced
+	clientOpts := []kgo.Opt{
+		kgo.SeedBrokers(brokers...),
+		kgo.ClientID(kafkaClientID),
+		kgo.DefaultProduceTopic(topic),
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+		kgo.ProducerLinger(0),
+		kgo.DialTimeout(p.timeout),
+		kgo.ProduceRequestTimeout(p.timeout),
+	}
+	if p.tlsConfig != nil {
+		clientOpts = append(clientOpts, kgo.DialTLSConfig(p.tlsConfig))
+	}
+	if p.sasl != nil {
+		clientOpts = append(clientOpts, kgo.SASL(p.sasl))
+	}
+	client, err := kgo.NewClient(clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kafka client: %w", err)
+	}
+	p.client = client
+
+	go p.run()
+	return p, nil
+}
+
+// Publish queues the event, or drops it when the queue is full or the publisher closed
+func (p *KafkaPublisher) Publish(event domain.QueryEvent) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return
+	}
+
+	select {
+	case p.events <- event:
+	default:
+		// Warn on the first drop and then every thousand, not on every event
+		if dropped := p.dropped.Add(1); dropped%1000 == 1 {
+			p.logger.Error("Kafka publisher is falling behind: %d query events dropped", dropped)
+		}
+	}
+}
+
+// Dropped returns how many events were dropped because the queue was full
+func (p *KafkaPublisher) Dropped() int64 {
+	return p.dropped.Load()
+}
+
+// Close publishes the queued events and closes the broker connections
+func (p *KafkaPublisher) Close() error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.events)
+	}
+	p.mu.Unlock()
+
+	<-p.done
+	return nil
+}
+
+// run batches queued events until the publisher is closed
+func (p *KafkaPublisher) run() {
+	defer close(p.done)
+	defer p.client.Close()
+
+	ticker := time.NewTicker(p.linger)
+	defer ticker.Stop()
+
+	batch := make([]domain.QueryEvent, 0, p.batchSize)
+	for {
+		select {
+		case event, ok := <-p.events:
+			if !ok {
+				p.flush(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) < p.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		p.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush produces a batch of events and waits for the brokers to acknowledge it
+func (p *KafkaPublisher) flush(events []domain.QueryEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	records := make([]*kgo.Record, 0, len(events))
+	for _, event := range events {
+		value, err := json.Marshal(newAuditRecord(event))
+		if err != nil {
+			p.logger.Error("Failed to encode query event: %v", err)
+			continue
+		}
+		records = append(records, &kgo.Record{Key: p.messageKey(event), Value: value, Timestamp: event.Timestamp})
+	}
+
+	// Records carry the time of their event, so the delivery is bounded by a
+	// context rather than by the client's record timeout
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	var failed int
+	var err error
+	for _, result := range p.client.ProduceSync(ctx, records...) {
+		if result.Err != nil {
+			failed++
+			err = result.Err
+		}
+	}
+	if failed > 0 {
+		p.logger.Error("Failed to publish %d query events to Kafka: %v", failed, err)
+	}
+}
+
+// messageKey returns the key of the event's message; events without one are
+// spread over the partitions
+func (p *KafkaPublisher) messageKey(event domain.QueryEvent) []byte {
+	key := event.User
+	if p.key == KafkaKeyQueryHash {
+		key = event.QueryHash
+	}
+	if key == "" {
+		return nil
+	}
+	return []byte(key)
+}
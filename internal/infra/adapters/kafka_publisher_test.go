@@ -0,0 +1,197 @@
+package adapters
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// newKafkaCluster starts an in-process Kafka cluster of three brokers with a
+// query-events topic of partitions partitions
+func newKafkaCluster(t *testing.T, partitions int32, opts ...kfake.Opt) *kfake.Cluster {
+	t.Helper()
+	cluster, err := kfake.NewCluster(append([]kfake.Opt{kfake.NumBrokers(3), kfake.SeedTopics(partitions, "query-events")}, opts...)...)
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	return cluster
+}
+
+// consumeKafka reads count records of the query-events topic from the start
+func consumeKafka(t *testing.T, cluster *kfake.Cluster, count int, opts ...kgo.Opt) []*kgo.Record {
+	t.Helper()
+	client, err := kgo.NewClient(append([]kgo.Opt{
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.ConsumeTopics("query-events"),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	}, opts...)...)
+	require.NoError(t, err)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var records []*kgo.Record
+	for len(records) < count {
+		fetches := client.PollFetches(ctx)
+		require.NoError(t, ctx.Err(), "Only %d of %d records were published", len(records), count)
+		records = append(records, fetches.Records()...)
+	}
+	return records
+}
+
+func TestKafkaPublisher_Publish(t *testing.T) {
+	cluster := newKafkaCluster(t, 3)
+	publisher, err := NewKafkaPublisher(cluster.ListenAddrs(), "query-events", logger.NewSimpleLogger(),
+		WithKafkaLinger(10*time.Millisecond), WithKafkaBatchSize(4))
+	require.NoError(t, err)
+
+	received := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		user := []string{"alice", "bob"}[i%2]
+		publisher.Publish(domain.QueryEvent{
+			Timestamp: received.Add(time.Duration(i) * time.Millisecond),
+			User:      user,
+			QueryHash: "hash",
+			Decision:  domain.DecisionAllow,
+			Rows:      int64(i),
+		})
+	}
+	publisher.Publish(domain.QueryEvent{Timestamp: received, Decision: domain.DecisionDeny, Policy: "reads"})
+	require.NoError(t, publisher.Close())
+
+	records := consumeKafka(t, cluster, 11)
+	assert.Len(t, records, 11)
+	partitions := make(map[string]int32)
+	rows := int64(-1)
+	for _, record := range records {
+		var event AuditRecord
+		require.NoError(t, json.Unmarshal(record.Value, &event))
+		assert.Equal(t, event.Time.UnixMilli(), record.Timestamp.UnixMilli())
+		if record.Key == nil {
+			assert.Equal(t, "reads", event.Policy)
+			continue
+		}
+
+		assert.Equal(t, event.User, string(record.Key))
+		if partition, seen := partitions[event.User]; seen {
+			assert.Equal(t, partition, record.Partition, "Keyed records go to the partition of their key")
+		}
+		partitions[event.User] = record.Partition
+		if event.User == "alice" {
+			assert.Greater(t, event.Rows, rows, "Events of a key keep their order")
+			rows = event.Rows
+		}
+	}
+	assert.Zero(t, publisher.Dropped())
+}
+
+func TestKafkaPublisher_QueryHashKey(t *testing.T) {
+	cluster := newKafkaCluster(t, 4)
+	publisher, err := NewKafkaPublisher(cluster.ListenAddrs(), "query-events", logger.NewSimpleLogger(),
+		WithKafkaKey(KafkaKeyQueryHash))
+	require.NoError(t, err)
+
+	publisher.Publish(domain.QueryEvent{User: "alice", QueryHash: "abc", Timestamp: time.Now()})
+	require.NoError(t, publisher.Close())
+
+	records := consumeKafka(t, cluster, 1)
+	assert.Equal(t, []byte("abc"), records[0].Key)
+}
+
+func TestKafkaPublisher_FollowsMovedLeaders(t *testing.T) {
+	cluster := newKafkaCluster(t, 1)
+	publisher, err := NewKafkaPublisher(cluster.ListenAddrs(), "query-events", logger.NewSimpleLogger(),
+		WithKafkaLinger(10*time.Millisecond))
+	require.NoError(t, err)
+
+	publisher.Publish(domain.QueryEvent{User: "alice", Timestamp: time.Now()})
+	consumeKafka(t, cluster, 1)
+
+	leader := cluster.LeaderFor("query-events", 0)
+	require.NoError(t, cluster.MoveTopicPartition("query-events", 0, (leader+1)%3))
+	publisher.Publish(domain.QueryEvent{User: "bob", Timestamp: time.Now()})
+	require.NoError(t, publisher.Close())
+
+	assert.Len(t, consumeKafka(t, cluster, 2), 2)
+}
+
+func TestKafkaPublisher_TLSAndSASL(t *testing.T) {
+	cert := writeTestCertificate(t)
+	serverTLS, err := LoadServerTLSConfig(cert.certFile, cert.keyFile, "")
+	require.NoError(t, err)
+	cluster := newKafkaCluster(t, 1, kfake.TLS(serverTLS), kfake.EnableSASL(),
+		kfake.Superuser(string(KafkaSASLScramSHA512), "enforcer", "secret"))
+
+	clientTLS, err := LoadKafkaTLSConfig(cert.certFile, "", "")
+	require.NoError(t, err)
+	publisher, err := NewKafkaPublisher(cluster.ListenAddrs(), "query-events", logger.NewSimpleLogger(),
+		WithKafkaTLS(clientTLS), WithKafkaSASL(KafkaSASLScramSHA512, "enforcer", "secret"))
+	require.NoError(t, err)
+
+	publisher.Publish(domain.QueryEvent{User: "alice", Timestamp: time.Now()})
+	require.NoError(t, publisher.Close())
+
+	records := consumeKafka(t, cluster, 1, kgo.DialTLSConfig(clientTLS),
+		kgo.SASL(scram.Auth{User: "enforcer", Pass: "secret"}.AsSha512Mechanism()))
+	assert.Equal(t, []byte("alice"), records[0].Key)
+}
+
+func TestParseKafkaSASLMechanism(t *testing.T) {
+	mechanism, err := ParseKafkaSASLMechanism("scram-sha-256")
+	require.NoError(t, err)
+	assert.Equal(t, KafkaSASLScramSHA256, mechanism)
+
+	mechanism, err = ParseKafkaSASLMechanism("")
+	require.NoError(t, err)
+	assert.Empty(t, mechanism)
+
+	_, err = ParseKafkaSASLMechanism("GSSAPI")
+	assert.Error(t, err)
+}
+
+func TestKafkaPublisher_Invalid(t *testing.T) {
+	log := logger.NewSimpleLogger()
+	_, err := NewKafkaPublisher(nil, "query-events", log)
+	assert.Error(t, err)
+	_, err = NewKafkaPublisher([]string{"localhost:9092"}, "", log)
+	assert.Error(t, err)
+	_, err = NewKafkaPublisher([]string{"localhost:9092"}, "query-events", log, WithKafkaKey("database"))
+	assert.Error(t, err)
+}
+
+func TestQueryEventLogger(t *testing.T) {
+	publisher := &recordingQueryEventPublisher{}
+	queryLogger := NewQueryEventLogger(publisher, nil, "enforcer-1")
+
+	query := auditQuery("SELECT $1")
+	require.NoError(t, queryLogger.LogDecision(query, domain.Decision{Action: domain.DecisionDeny, Policy: "reads"}, domain.StatementUsage{}))
+	require.NoError(t, queryLogger.LogDecision(query, domain.AllowDecision(), domain.StatementUsage{Rows: 2, Duration: time.Millisecond}))
+
+	require.Len(t, publisher.events, 2)
+	assert.Equal(t, "enforcer-1", publisher.events[0].InstanceID)
+	assert.Equal(t, "alice", publisher.events[0].User)
+	assert.Equal(t, "hash-SELECT $1", publisher.events[0].QueryHash)
+	assert.Equal(t, domain.DecisionDeny, publisher.events[0].Decision)
+	assert.Equal(t, "reads", publisher.events[0].Policy)
+	assert.Equal(t, domain.DecisionAllow, publisher.events[1].Decision)
+	assert.Equal(t, int64(2), publisher.events[1].Rows)
+	assert.Equal(t, time.Millisecond, publisher.events[1].Duration)
+}
+
+// recordingQueryEventPublisher keeps the events it is given
+type recordingQueryEventPublisher struct {
+	events []domain.QueryEvent
+}
+
+func (p *recordingQueryEventPublisher) Publish(event domain.QueryEvent) {
+	p.events = append(p.events, event)
+}
@@ -0,0 +1,145 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	leasesv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+// kubernetesNamespaceFile holds the namespace of the pod, mounted with its service account token
+const kubernetesNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// KubernetesLeaderElector implements domain.LeaderElector with a coordination
+// Lease, as Kubernetes controllers do. The leader renews the Lease; other
+// replicas take it over once it has not been renewed for its duration, so the
+// clocks of the replicas are assumed to agree within a fraction of the TTL.
+// Concurrent takeovers are settled by the resource version of the Lease.
+type KubernetesLeaderElector struct {
+	leaderElection
+	leases leasesv1.LeaseInterface
+}
+
+// NewKubernetesLeaderElector elects identity, usually the ID of the instance,
+// with a Lease of namespace, the namespace of the pod when empty. It connects to
+// the API server with the service account of the pod, which must be allowed to
+// get, create and update Leases.
+func NewKubernetesLeaderElector(namespace, identity string, opts ...LeaderElectorOption) (*KubernetesLeaderElector, error) {
+	config, err := kubernetesConfig("")
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure leader election: %w", err)
+	}
+	if namespace == "" {
+		content, err := os.ReadFile(kubernetesNamespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the namespace of the pod: %w", err)
+		}
+		namespace = strings.TrimSpace(string(content))
+	}
+	return newKubernetesLeaderElector(clientset.CoordinationV1().Leases(namespace), identity, opts...), nil
+}
+
+// newKubernetesLeaderElector creates an elector competing for a Lease of leases
+func newKubernetesLeaderElector(leases leasesv1.LeaseInterface, identity string, opts ...LeaderElectorOption) *KubernetesLeaderElector {
+	return &KubernetesLeaderElector{leaderElection: newLeaderElection(identity, opts), leases: leases}
+}
+
+// Lead implements domain.LeaderElector
+func (e *KubernetesLeaderElector) Lead(ctx context.Context) (time.Time, error) {
+	now := e.clock.Now()
+	lease, err := e.leases.Get(ctx, e.lock, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Name: e.lock}}
+		e.hold(lease, now)
+		if _, err := e.leases.Create(ctx, lease, metav1.CreateOptions{}); err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				return time.Time{}, nil
+			}
+			return time.Time{}, err
+		}
+		return now.Add(e.ttl), nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if holder := leaseHolder(lease); holder != e.identity && holder != "" && !leaseExpired(lease, now) {
+		return time.Time{}, nil
+	}
+	e.hold(lease, now)
+	if _, err := e.leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		if apierrors.IsConflict(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return now.Add(e.ttl), nil
+}
+
+// Resign implements domain.LeaderElector by clearing the holder of the Lease
+func (e *KubernetesLeaderElector) Resign(ctx context.Context) error {
+	lease, err := e.leases.Get(ctx, e.lock, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if leaseHolder(lease) != e.identity {
+		return nil
+	}
+
+	lease.Spec.HolderIdentity = nil
+	_, err = e.leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+// hold makes the identity the holder of lease, renewed at now
+func (e *KubernetesLeaderElector) hold(lease *coordinationv1.Lease, now time.Time) {
+	renewed := metav1.NewMicroTime(now)
+	if leaseHolder(lease) != e.identity {
+		if lease.Spec.HolderIdentity != nil {
+			transitions := ptrValue(lease.Spec.LeaseTransitions) + 1
+			lease.Spec.LeaseTransitions = &transitions
+		}
+		lease.Spec.HolderIdentity = &e.identity
+		lease.Spec.AcquireTime = &renewed
+	}
+	duration := int32((e.ttl + time.Second - 1) / time.Second)
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &renewed
+}
+
+// leaseHolder returns the identity holding lease, empty when released
+func leaseHolder(lease *coordinationv1.Lease) string {
+	return ptrValue(lease.Spec.HolderIdentity)
+}
+
+// leaseExpired reports whether lease was not renewed for its duration at now
+func leaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	duration := time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	return !now.Before(lease.Spec.RenewTime.Add(duration))
+}
+
+// ptrValue returns what p points to, the zero value when nil
+func ptrValue[T any](p *T) T {
+	var zero T
+	if p == nil {
+		return zero
+	}
+	return *p
+}
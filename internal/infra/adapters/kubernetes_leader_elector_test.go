@@ -0,0 +1,54 @@
+package adapters
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestKubernetesLeaderElector(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	leases := fake.NewClientset().CoordinationV1().Leases("enforcer")
+	first := newKubernetesLeaderElector(leases, "enforcer-1", WithLeaderTTL(10*time.Second), WithLeaderElectorClock(clock))
+	second := newKubernetesLeaderElector(leases, "enforcer-2", WithLeaderTTL(10*time.Second), WithLeaderElectorClock(clock))
+
+	until, err := first.Lead(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, clock.Now().Add(10*time.Second), until)
+	until, err = second.Lead(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, until, "Only one replica should lead")
+
+	clock.Advance(8 * time.Second)
+	_, err = first.Lead(ctx)
+	require.NoError(t, err)
+	clock.Advance(8 * time.Second)
+	until, err = second.Lead(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, until, "Renewals should keep the leadership")
+
+	clock.Advance(2 * time.Second)
+	until, err = second.Lead(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, clock.Now().Add(10*time.Second), until, "An expired Lease should be taken over")
+
+	lease, err := leases.Get(ctx, DefaultLeaderLock, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "enforcer-2", *lease.Spec.HolderIdentity)
+	assert.Equal(t, int32(1), *lease.Spec.LeaseTransitions)
+	assert.Equal(t, int32(10), *lease.Spec.LeaseDurationSeconds)
+
+	require.NoError(t, first.Resign(ctx))
+	require.NoError(t, second.Resign(ctx))
+	until, err = first.Lead(ctx)
+	require.NoError(t, err)
+	assert.NotZero(t, until, "A resignation should let another replica lead")
+}
@@ -0,0 +1,273 @@
+package adapters
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// kubernetesRetryInterval is how long a broken watch of resources waits before
+// starting again
+const kubernetesRetryInterval = time.Second
+
+// QuotaPolicyResource identifies the QuotaPolicy custom resources, defined by
+// deploy/kubernetes/quotapolicies.yaml
+var QuotaPolicyResource = schema.GroupVersionResource{Group: "quota-enforcer.io", Version: "v1alpha1", Resource: "quotapolicies"}
+
+// quotaPolicySpec is the spec of a QuotaPolicy resource: the policy file format
+// in camel case, the policy being named after the resource
+type quotaPolicySpec struct {
+	User      string            `json:"user,omitempty"`
+	Role      string            `json:"role,omitempty"`
+	Database  string            `json:"database,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Listener  string            `json:"listener,omitempty"`
+	Dimension string            `json:"dimension,omitempty"`
+	Limit     int64             `json:"limit,omitempty"`
+	Window    metav1.Duration   `json:"window,omitempty"`
+	PerLabel  string            `json:"perLabel,omitempty"`
+	Rate      float64           `json:"rate,omitempty"`
+	Burst     int64             `json:"burst,omitempty"`
+	RatePer   string            `json:"ratePer,omitempty"`
+
+	Credits    int64   `json:"credits,omitempty"`
+	CreditRate float64 `json:"creditRate,omitempty"`
+
+	WarnAt int             `json:"warnAt,omitempty"`
+	Soft   bool            `json:"soft,omitempty"`
+	Grace  metav1.Duration `json:"grace,omitempty"`
+
+	TightenAt int `json:"tightenAt,omitempty"`
+	TightenTo int `json:"tightenTo,omitempty"`
+
+	MaxConnections       int64           `json:"maxConnections,omitempty"`
+	MaxConcurrentQueries int64           `json:"maxConcurrentQueries,omitempty"`
+	QueueTimeout         metav1.Duration `json:"queueTimeout,omitempty"`
+	StatementTimeout     metav1.Duration `json:"statementTimeout,omitempty"`
+	MaxResultRows        int64           `json:"maxResultRows,omitempty"`
+	MaxResultBytes       int64           `json:"maxResultBytes,omitempty"`
+
+	MaxTransactionDuration   metav1.Duration `json:"maxTransactionDuration,omitempty"`
+	MaxTransactionStatements int64           `json:"maxTransactionStatements,omitempty"`
+
+	StartupParameters map[string]string `json:"startupParameters,omitempty"`
+
+	Tables      []string                `json:"tables,omitempty"`
+	Statements  []domain.StatementClass `json:"statements,omitempty"`
+	Deny        bool                    `json:"deny,omitempty"`
+	AllowDuring []string                `json:"allowDuring,omitempty"`
+
+	ActiveDuring []string `json:"activeDuring,omitempty"`
+
+	Fingerprints []string `json:"fingerprints,omitempty"`
+	Patterns     []string `json:"patterns,omitempty"`
+	Allow        bool     `json:"allow,omitempty"`
+	Hint         string   `json:"hint,omitempty"`
+
+	Override bool `json:"override,omitempty"`
+}
+
+// policy converts the spec to the quota policy named name, which is not validated
+func (s quotaPolicySpec) policy(name string) domain.QuotaPolicy {
+	return policyFileEntry{
+		Name:      name,
+		User:      s.User,
+		Role:      s.Role,
+		Database:  s.Database,
+		Labels:    s.Labels,
+		Listener:  s.Listener,
+		Dimension: s.Dimension,
+		Limit:     s.Limit,
+		Window:    s.Window.Duration,
+		PerLabel:  s.PerLabel,
+		Rate:      s.Rate,
+		Burst:     s.Burst,
+		RatePer:   s.RatePer,
+
+		Credits:    s.Credits,
+		CreditRate: s.CreditRate,
+
+		WarnAt: s.WarnAt,
+		Soft:   s.Soft,
+		Grace:  s.Grace.Duration,
+
+		TightenAt: s.TightenAt,
+		TightenTo: s.TightenTo,
+
+		MaxConnections:       s.MaxConnections,
+		MaxConcurrentQueries: s.MaxConcurrentQueries,
+		QueueTimeout:         s.QueueTimeout.Duration,
+		StatementTimeout:     s.StatementTimeout.Duration,
+		MaxResultRows:        s.MaxResultRows,
+		MaxResultBytes:       s.MaxResultBytes,
+
+		MaxTransactionDuration:   s.MaxTransactionDuration.Duration,
+		MaxTransactionStatements: s.MaxTransactionStatements,
+
+		StartupParameters: s.StartupParameters,
+
+		Tables:      s.Tables,
+		Statements:  s.Statements,
+		Deny:        s.Deny,
+		AllowDuring: s.AllowDuring,
+
+		ActiveDuring: s.ActiveDuring,
+
+		Fingerprints: s.Fingerprints,
+		Patterns:     s.Patterns,
+		Allow:        s.Allow,
+		Hint:         s.Hint,
+
+		Override: s.Override,
+	}.policy()
+}
+
+// KubernetesQuotaPolicies implements domain.PolicyResources with the cluster
+// scoped QuotaPolicy custom resources
+type KubernetesQuotaPolicies struct {
+	client dynamic.ResourceInterface
+	clock  domain.Clock
+	logger logger.Logger
+}
+
+// NewKubernetesQuotaPolicies connects to the API server with the kubeconfig
+// file at kubeconfig, or with the service account of the pod when empty
+func NewKubernetesQuotaPolicies(kubeconfig string, log logger.Logger) (*KubernetesQuotaPolicies, error) {
+	config, err := kubernetesConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Kubernetes: %w", err)
+	}
+	return newKubernetesQuotaPolicies(client.Resource(QuotaPolicyResource), log), nil
+}
+
+// newKubernetesQuotaPolicies reads the resources of client
+func newKubernetesQuotaPolicies(client dynamic.ResourceInterface, log logger.Logger) *KubernetesQuotaPolicies {
+	return &KubernetesQuotaPolicies{client: client, clock: SystemClock{}, logger: log}
+}
+
+// kubernetesConfig loads the kubeconfig file at kubeconfig, or the in-cluster
+// configuration of the pod when empty
+func kubernetesConfig(kubeconfig string) (*rest.Config, error) {
+	var config *rest.Config
+	var err error
+	if kubeconfig == "" {
+		config, err = rest.InClusterConfig()
+	} else {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure the Kubernetes client: %w", err)
+	}
+	return config, nil
+}
+
+// List implements domain.PolicyResources, in name order. Unknown spec fields
+// make a resource invalid, as they do a policy file.
+func (p *KubernetesQuotaPolicies) List(ctx context.Context) ([]domain.PolicyResource, error) {
+	list, err := p.client.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list quota policy resources: %w", err)
+	}
+
+	resources := make([]domain.PolicyResource, 0, len(list.Items))
+	for _, item := range list.Items {
+		resource := domain.PolicyResource{Name: item.GetName(), Generation: item.GetGeneration()}
+		resource.Policy, resource.Err = decodeQuotaPolicy(item)
+		resources = append(resources, resource)
+	}
+	sort.Slice(resources, func(i, j int) bool { return resources[i].Name < resources[j].Name })
+	return resources, nil
+}
+
+// decodeQuotaPolicy decodes and validates the policy of item
+func decodeQuotaPolicy(item unstructured.Unstructured) (domain.QuotaPolicy, error) {
+	raw, err := json.Marshal(item.Object["spec"])
+	if err != nil {
+		return domain.QuotaPolicy{}, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+
+	var spec quotaPolicySpec
+	if err := decoder.Decode(&spec); err != nil {
+		return domain.QuotaPolicy{}, fmt.Errorf("failed to decode the spec: %w", err)
+	}
+	policy := spec.policy(item.GetName())
+	if err := policy.Validate(); err != nil {
+		return domain.QuotaPolicy{}, err
+	}
+	return policy, nil
+}
+
+// Watch implements domain.PolicyResources. A broken watch starts again, which
+// lists every resource as added.
+func (p *KubernetesQuotaPolicies) Watch(ctx context.Context, changed func()) {
+	go func() {
+		for {
+			if err := p.watch(ctx, changed); err != nil && ctx.Err() == nil {
+				p.logger.Error("Lost the watch of quota policy resources: %v", err)
+			}
+			timer := p.clock.NewTimer(kubernetesRetryInterval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C():
+			}
+		}
+	}()
+}
+
+// watch calls changed on every event until the watch breaks
+func (p *KubernetesQuotaPolicies) watch(ctx context.Context, changed func()) error {
+	watcher, err := p.client.Watch(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+
+	for event := range watcher.ResultChan() {
+		if event.Type == watch.Error {
+			return fmt.Errorf("watch failed: %v", event.Object)
+		}
+		changed()
+	}
+	return nil
+}
+
+// SetStatus implements domain.PolicyResources with the synced, message and
+// observedGeneration fields of the status subresource
+func (p *KubernetesQuotaPolicies) SetStatus(ctx context.Context, resource domain.PolicyResource, err error) error {
+	item, getErr := p.client.Get(ctx, resource.Name, metav1.GetOptions{})
+	if getErr != nil {
+		return getErr
+	}
+
+	status := map[string]interface{}{
+		"observedGeneration": resource.Generation,
+		"synced":             err == nil,
+	}
+	if err != nil {
+		status["message"] = err.Error()
+	}
+	item.Object["status"] = status
+	_, updateErr := p.client.UpdateStatus(ctx, item, metav1.UpdateOptions{})
+	return updateErr
+}
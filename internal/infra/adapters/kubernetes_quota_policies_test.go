@@ -0,0 +1,115 @@
+package adapters
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+// quotaPolicyObject returns a QuotaPolicy resource named name with spec
+func quotaPolicyObject(name string, generation int64, spec map[string]interface{}) *unstructured.Unstructured {
+	item := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "quota-enforcer.io/v1alpha1",
+		"kind":       "QuotaPolicy",
+		"spec":       spec,
+	}}
+	item.SetName(name)
+	item.SetGeneration(generation)
+	return item
+}
+
+func TestKubernetesQuotaPolicies(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{QuotaPolicyResource: "QuotaPolicyList"},
+		quotaPolicyObject("alice-daily", 2, map[string]interface{}{
+			"user": "alice", "limit": int64(1000), "window": "24h", "statementTimeout": "30s",
+		}),
+		quotaPolicyObject("analysts-deny", 1, map[string]interface{}{
+			"role": "analysts", "statements": []interface{}{"ddl"}, "deny": true,
+		}),
+		quotaPolicyObject("misspelled", 1, map[string]interface{}{"user": "bob", "limt": int64(10)}),
+		quotaPolicyObject("windowless", 1, map[string]interface{}{"user": "bob", "limit": int64(10)}),
+	)
+	policies := newKubernetesQuotaPolicies(client.Resource(QuotaPolicyResource), logger.NewSimpleLogger())
+
+	resources, err := policies.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, resources, 4)
+	assert.Equal(t, domain.PolicyResource{
+		Name:       "alice-daily",
+		Generation: 2,
+		Policy:     domain.QuotaPolicy{Name: "alice-daily", User: "alice", Limit: 1000, Window: 24 * time.Hour, StatementTimeout: 30 * time.Second},
+	}, resources[0])
+	assert.Equal(t, domain.QuotaPolicy{
+		Name: "analysts-deny", Role: "analysts", Statements: []domain.StatementClass{domain.StatementClassDDL}, Deny: true,
+	}, resources[1].Policy)
+	assert.ErrorContains(t, resources[2].Err, "limt", "Unknown fields should make a resource invalid")
+	assert.ErrorContains(t, resources[3].Err, "window must be positive")
+
+	require.NoError(t, policies.SetStatus(ctx, resources[0], nil))
+	require.NoError(t, policies.SetStatus(ctx, resources[3], resources[3].Err))
+
+	item, err := client.Resource(QuotaPolicyResource).Get(ctx, "alice-daily", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"observedGeneration": int64(2), "synced": true}, item.Object["status"])
+	item, err = client.Resource(QuotaPolicyResource).Get(ctx, "windowless", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"observedGeneration": int64(1), "synced": false, "message": resources[3].Err.Error(),
+	}, item.Object["status"])
+}
+
+func TestQuotaPolicyDefinition_MatchesSpec(t *testing.T) {
+	content, err := os.ReadFile("../../../deploy/kubernetes/quotapolicies.yaml")
+	require.NoError(t, err)
+
+	var definition struct {
+		Spec struct {
+			Versions []struct {
+				Name   string `yaml:"name"`
+				Schema struct {
+					OpenAPIV3Schema struct {
+						Properties struct {
+							Spec struct {
+								Properties map[string]interface{} `yaml:"properties"`
+							} `yaml:"spec"`
+						} `yaml:"properties"`
+					} `yaml:"openAPIV3Schema"`
+				} `yaml:"schema"`
+			} `yaml:"versions"`
+		} `yaml:"spec"`
+	}
+	require.NoError(t, yaml.Unmarshal(content, &definition))
+	require.Len(t, definition.Spec.Versions, 1)
+	assert.Equal(t, QuotaPolicyResource.Version, definition.Spec.Versions[0].Name)
+
+	var declared []string
+	for name := range definition.Spec.Versions[0].Schema.OpenAPIV3Schema.Properties.Spec.Properties {
+		declared = append(declared, name)
+	}
+	var fields []string
+	specType := reflect.TypeOf(quotaPolicySpec{})
+	for i := 0; i < specType.NumField(); i++ {
+		fields = append(fields, strings.Split(specType.Field(i).Tag.Get("json"), ",")[0])
+	}
+	sort.Strings(declared)
+	sort.Strings(fields)
+	assert.Equal(t, fields, declared, "The definition should declare every field of the spec")
+}
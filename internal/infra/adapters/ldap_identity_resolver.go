@@ -0,0 +1,255 @@
+package adapters
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	// DefaultLDAPGroupFilter finds the POSIX groups listing the user as a memberUid
+	DefaultLDAPGroupFilter = "(&(objectClass=posixGroup)(memberUid={user}))"
+
+	// DefaultLDAPGroupAttribute is the attribute naming groups
+	DefaultLDAPGroupAttribute = "cn"
+
+	// DefaultLDAPTimeout bounds a group lookup, from connecting to the last result
+	DefaultLDAPTimeout = 5 * time.Second
+)
+
+// LDAPIdentityResolver implements domain.IdentityResolver by searching an LDAP
+// directory for the groups of a user. Each lookup opens a connection, binds,
+// searches and unbinds; callers are expected to cache the groups.
+type LDAPIdentityResolver struct {
+	url       *url.URL
+	startTLS  bool
+	referrals bool
+	tlsConfig *tls.Config
+	caFile    string
+	baseDN    string
+	filter    string
+	attribute string
+	bindDN    string
+	password  string
+	timeout   time.Duration
+}
+
+// LDAPIdentityResolverOption configures optional behavior of an LDAPIdentityResolver
+type LDAPIdentityResolverOption func(*LDAPIdentityResolver)
+
+// WithLDAPBind binds as dn with password before searching, instead of searching anonymously
+func WithLDAPBind(dn, password string) LDAPIdentityResolverOption {
+	return func(r *LDAPIdentityResolver) {
+		r.bindDN = dn
+		r.password = password
+	}
+}
+
+// WithLDAPGroupFilter sets the filter finding the groups of a user, in which
+// {user} stands for the user name, e.g. (member=uid={user},ou=people,dc=example,dc=com)
+func WithLDAPGroupFilter(filter string) LDAPIdentityResolverOption {
+	return func(r *LDAPIdentityResolver) {
+		r.filter = filter
+	}
+}
+
+// WithLDAPGroupAttribute sets the attribute of group entries holding their name
+func WithLDAPGroupAttribute(attribute string) LDAPIdentityResolverOption {
+	return func(r *LDAPIdentityResolver) {
+		r.attribute = attribute
+	}
+}
+
+// WithLDAPTimeout bounds each lookup
+func WithLDAPTimeout(timeout time.Duration) LDAPIdentityResolverOption {
+	return func(r *LDAPIdentityResolver) {
+		r.timeout = timeout
+	}
+}
+
+// WithLDAPRootCAs verifies the certificate of the server against the CAs of
+// caFile instead of the system roots
+func WithLDAPRootCAs(caFile string) LDAPIdentityResolverOption {
+	return func(r *LDAPIdentityResolver) {
+		r.caFile = caFile
+	}
+}
+
+// WithLDAPStartTLS upgrades ldap:// connections to TLS with the StartTLS
+// extended operation before binding
+func WithLDAPStartTLS() LDAPIdentityResolverOption {
+	return func(r *LDAPIdentityResolver) {
+		r.startTLS = true
+	}
+}
+
+// WithLDAPReferrals follows the search references of the server: the subtrees
+// they point to are searched with the same credentials, one hop deep
+func WithLDAPReferrals() LDAPIdentityResolverOption {
+	return func(r *LDAPIdentityResolver) {
+		r.referrals = true
+	}
+}
+
+// NewLDAPIdentityResolver creates an LDAPIdentityResolver searching the subtree
+// of baseDN on the server at rawURL, ldap://host[:port] or ldaps://host[:port]
+func NewLDAPIdentityResolver(rawURL, baseDN string, opts ...LDAPIdentityResolverOption) (*LDAPIdentityResolver, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URL %q: %w", rawURL, err)
+	}
+	if parsed.Scheme != "ldap" && parsed.Scheme != "ldaps" {
+		return nil, fmt.Errorf("invalid LDAP URL %q: scheme must be ldap or ldaps", rawURL)
+	}
+	if parsed.Hostname() == "" {
+		return nil, fmt.Errorf("invalid LDAP URL %q: host is required", rawURL)
+	}
+
+	r := &LDAPIdentityResolver{
+		url:       parsed,
+		baseDN:    baseDN,
+		filter:    DefaultLDAPGroupFilter,
+		attribute: DefaultLDAPGroupAttribute,
+		timeout:   DefaultLDAPTimeout,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.startTLS && parsed.Scheme == "ldaps" {
+		return nil, fmt.Errorf("LDAP StartTLS requires an ldap URL")
+	}
+	if parsed.Scheme == "ldaps" || r.startTLS {
+		r.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if r.caFile != "" {
+		if r.tlsConfig == nil {
+			return nil, fmt.Errorf("LDAP CA file requires an ldaps URL or StartTLS")
+		}
+		pool, err := loadCertPool(r.caFile)
+		if err != nil {
+			return nil, err
+		}
+		r.tlsConfig.RootCAs = pool
+	}
+	if !strings.Contains(r.filter, "{user}") {
+		return nil, fmt.Errorf("LDAP group filter %q must contain {user}", r.filter)
+	}
+	if _, err := ldap.CompileFilter(r.groupFilter("user")); err != nil {
+		return nil, fmt.Errorf("invalid LDAP group filter %q: %w", r.filter, err)
+	}
+	if r.attribute == "" || r.timeout <= 0 {
+		return nil, fmt.Errorf("LDAP group attribute and timeout are required")
+	}
+	return r, nil
+}
+
+// groupFilter returns the group filter of user
+func (r *LDAPIdentityResolver) groupFilter(user string) string {
+	return strings.ReplaceAll(r.filter, "{user}", ldap.EscapeFilter(user))
+}
+
+// Groups returns the names of the groups the filter finds for user, sorted
+func (r *LDAPIdentityResolver) Groups(ctx context.Context, user string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.search(ctx, r.url, r.baseDN, user)
+	if err != nil {
+		return nil, err
+	}
+	entries := result.Entries
+	if r.referrals {
+		for _, referral := range result.Referrals {
+			referred, baseDN, err := parseLDAPReferral(referral, r.baseDN)
+			if err != nil {
+				return nil, err
+			}
+			// References returned by the referred servers are not followed
+			result, err := r.search(ctx, referred, baseDN, user)
+			if err != nil {
+				return nil, fmt.Errorf("referral %s: %w", referral, err)
+			}
+			entries = append(entries, result.Entries...)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var groups []string
+	for _, entry := range entries {
+		for _, attribute := range entry.Attributes {
+			if !strings.EqualFold(attribute.Name, r.attribute) {
+				continue
+			}
+			for _, name := range attribute.Values {
+				if !seen[name] {
+					seen[name] = true
+					groups = append(groups, name)
+				}
+			}
+		}
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+// search binds to the server at target and searches the subtree of baseDN for
+// the groups of user. Results truncated by the server's size limit are kept.
+func (r *LDAPIdentityResolver) search(ctx context.Context, target *url.URL, baseDN, user string) (*ldap.SearchResult, error) {
+	deadline, _ := ctx.Deadline()
+	dialer := &net.Dialer{Deadline: deadline}
+	var tlsConfig *tls.Config
+	if r.tlsConfig != nil {
+		tlsConfig = r.tlsConfig.Clone()
+		tlsConfig.ServerName = target.Hostname()
+	}
+
+	address := target.Host
+	conn, err := ldap.DialURL(target.String(), ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server %s: %w", address, err)
+	}
+	defer conn.Close()
+	conn.SetTimeout(time.Until(deadline))
+
+	if r.startTLS && target.Scheme == "ldap" {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			return nil, fmt.Errorf("failed to start TLS with LDAP server %s: %w", address, err)
+		}
+	}
+	if r.bindDN != "" {
+		if err := conn.Bind(r.bindDN, r.password); err != nil {
+			return nil, fmt.Errorf("failed to bind to LDAP server as %s: %w", r.bindDN, err)
+		}
+	}
+
+	timeLimit := int(r.timeout / time.Second)
+	request := ldap.NewSearchRequest(baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, timeLimit, false,
+		r.groupFilter(user), []string{r.attribute}, nil)
+	result, err := conn.Search(request)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("failed to search groups of %s: %w", user, err)
+	}
+	_ = conn.Unbind()
+	return result, nil
+}
+
+// parseLDAPReferral returns the server and base DN of a search reference, an
+// LDAP URL such as ldap://host/ou=groups,dc=example,dc=com; references without
+// a DN keep baseDN
+func parseLDAPReferral(referral, baseDN string) (*url.URL, string, error) {
+	parsed, err := url.Parse(referral)
+	if err != nil || (parsed.Scheme != "ldap" && parsed.Scheme != "ldaps") || parsed.Hostname() == "" {
+		return nil, "", fmt.Errorf("invalid LDAP referral %q", referral)
+	}
+	if dn := strings.TrimPrefix(parsed.Path, "/"); dn != "" {
+		baseDN = dn
+	}
+	return &url.URL{Scheme: parsed.Scheme, Host: parsed.Host}, baseDN, nil
+}
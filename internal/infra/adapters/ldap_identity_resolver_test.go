@@ -0,0 +1,216 @@
+package adapters
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ldapStartTLSOID names the StartTLS extended operation
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// fakeLDAPServer answers binds as cn=enforcer with password secret and
+// searches with the groups of the user named in the filter
+type fakeLDAPServer struct {
+	groups     map[string][]string
+	references []string    // search references returned after the entries
+	tlsConfig  *tls.Config // answers StartTLS when set
+	searches   chan fakeLDAPSearch
+}
+
+// fakeLDAPSearch is a search received by a fakeLDAPServer
+type fakeLDAPSearch struct {
+	baseDN string
+	filter string
+}
+
+// startFakeLDAPServer starts a fakeLDAPServer and returns its ldap:// URL
+func startFakeLDAPServer(t *testing.T, server *fakeLDAPServer) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	server.searches = make(chan fakeLDAPSearch, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return "ldap://" + listener.Addr().String()
+}
+
+func (s *fakeLDAPServer) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, _ := op.Children[1].Value.(string)
+			code := int64(ldap.LDAPResultSuccess)
+			if dn != "cn=enforcer" || op.Children[2].Data.String() != "secret" {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			_, _ = conn.Write(ldapResponse(id, ldapResult(ldap.ApplicationBindResponse, code)))
+		case ldap.ApplicationExtendedRequest:
+			if s.tlsConfig == nil || string(op.Children[0].Data.Bytes()) != ldapStartTLSOID {
+				_, _ = conn.Write(ldapResponse(id, ldapResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError)))
+				continue
+			}
+			_, _ = conn.Write(ldapResponse(id, ldapResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess)))
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn = tlsConn
+		case ldap.ApplicationSearchRequest:
+			baseDN, _ := op.Children[0].Value.(string)
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			s.searches <- fakeLDAPSearch{baseDN: baseDN, filter: filter}
+			for user, groups := range s.groups {
+				if !strings.Contains(filter, "="+user+")") {
+					continue
+				}
+				for _, group := range groups {
+					values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, group, ""))
+					attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "CN", ""))
+					attribute.AppendChild(values)
+					attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					attributes.AppendChild(attribute)
+					entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+					entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "cn="+group+","+baseDN, ""))
+					entry.AppendChild(attributes)
+					_, _ = conn.Write(ldapResponse(id, entry))
+				}
+			}
+			for _, reference := range s.references {
+				op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultReference, nil, "")
+				op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, reference, ""))
+				_, _ = conn.Write(ldapResponse(id, op))
+			}
+			_, _ = conn.Write(ldapResponse(id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)))
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+// ldapResponse encodes the LDAPMessage of message id carrying op
+func ldapResponse(id int64, op *ber.Packet) []byte {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	message.AppendChild(op)
+	return message.Bytes()
+}
+
+// ldapResult encodes an LDAPResult with the given result code as the response tag
+func ldapResult(tag ber.Tag, code int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return op
+}
+
+func TestLDAPIdentityResolver(t *testing.T) {
+	ctx := context.Background()
+	server := &fakeLDAPServer{groups: map[string][]string{"alice": {"staff", "analysts", "staff"}}}
+	url := startFakeLDAPServer(t, server)
+
+	resolver, err := NewLDAPIdentityResolver(url, "ou=groups,dc=example,dc=com",
+		WithLDAPBind("cn=enforcer", "secret"), WithLDAPGroupFilter("(&(objectClass=posixGroup)(memberUid={user}))"))
+	require.NoError(t, err)
+
+	groups, err := resolver.Groups(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"analysts", "staff"}, groups, "Groups should be deduplicated and sorted")
+	assert.Equal(t, fakeLDAPSearch{baseDN: "ou=groups,dc=example,dc=com", filter: "(&(objectClass=posixGroup)(memberUid=alice))"}, <-server.searches)
+
+	groups, err = resolver.Groups(ctx, "bob")
+	require.NoError(t, err)
+	assert.Empty(t, groups)
+	<-server.searches
+
+	_, err = resolver.Groups(ctx, "a*(b)")
+	require.NoError(t, err)
+	assert.Equal(t, `(&(objectClass=posixGroup)(memberUid=a\2a\28b\29))`, (<-server.searches).filter, "User names should be escaped")
+
+	resolver, err = NewLDAPIdentityResolver(url, "dc=example,dc=com", WithLDAPBind("cn=enforcer", "wrong"))
+	require.NoError(t, err)
+	_, err = resolver.Groups(ctx, "alice")
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials), "Bind should fail: %v", err)
+
+	for _, opts := range [][]LDAPIdentityResolverOption{
+		{WithLDAPGroupFilter("(memberUid=alice)")},
+		{WithLDAPGroupFilter("(&(memberUid={user})")},
+		{WithLDAPRootCAs("testdata/ca.crt")},
+	} {
+		_, err := NewLDAPIdentityResolver(url, "dc=example,dc=com", opts...)
+		assert.Error(t, err)
+	}
+	_, err = NewLDAPIdentityResolver("ldaps://ldap.internal", "dc=example,dc=com", WithLDAPStartTLS())
+	assert.Error(t, err, "StartTLS should be rejected on ldaps URLs")
+	_, err = NewLDAPIdentityResolver("http://ldap.internal", "dc=example,dc=com")
+	assert.Error(t, err)
+}
+
+func TestLDAPIdentityResolver_StartTLS(t *testing.T) {
+	cert := writeTestCertificate(t)
+	tlsConfig, err := LoadServerTLSConfig(cert.certFile, cert.keyFile, "")
+	require.NoError(t, err)
+	server := &fakeLDAPServer{groups: map[string][]string{"alice": {"analysts"}}, tlsConfig: tlsConfig}
+	url := startFakeLDAPServer(t, server)
+
+	resolver, err := NewLDAPIdentityResolver(url, "dc=example,dc=com",
+		WithLDAPStartTLS(), WithLDAPRootCAs(cert.certFile), WithLDAPBind("cn=enforcer", "secret"))
+	require.NoError(t, err)
+	groups, err := resolver.Groups(context.Background(), "alice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"analysts"}, groups)
+
+	// The server certificate is not signed by the system roots
+	resolver, err = NewLDAPIdentityResolver(url, "dc=example,dc=com", WithLDAPStartTLS())
+	require.NoError(t, err)
+	_, err = resolver.Groups(context.Background(), "alice")
+	assert.ErrorContains(t, err, "failed to start TLS")
+}
+
+func TestLDAPIdentityResolver_Referrals(t *testing.T) {
+	partners := &fakeLDAPServer{groups: map[string][]string{"alice": {"partners"}}}
+	partnersURL := startFakeLDAPServer(t, partners)
+	server := &fakeLDAPServer{
+		groups:     map[string][]string{"alice": {"analysts"}},
+		references: []string{partnersURL + "/ou=partners,dc=example,dc=com??sub"},
+	}
+	url := startFakeLDAPServer(t, server)
+
+	resolver, err := NewLDAPIdentityResolver(url, "dc=example,dc=com")
+	require.NoError(t, err)
+	groups, err := resolver.Groups(context.Background(), "alice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"analysts"}, groups, "Referrals should only be followed when enabled")
+
+	resolver, err = NewLDAPIdentityResolver(url, "dc=example,dc=com", WithLDAPReferrals())
+	require.NoError(t, err)
+	groups, err = resolver.Groups(context.Background(), "alice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"analysts", "partners"}, groups)
+	assert.Equal(t, "ou=partners,dc=example,dc=com", (<-partners.searches).baseDN)
+}
@@ -0,0 +1,310 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// loadReconnectDelay is how long a load connection waits before connecting
+// again after failing to, so that a refusing target is not hammered
+const loadReconnectDelay = 100 * time.Millisecond
+
+// LoadQuery is a query of a load mix, sent in proportion to its weight
+type LoadQuery struct {
+	SQL    string
+	Weight int
+}
+
+// LoadConfig configures a LoadGenerator
+type LoadConfig struct {
+	Target      string // connection string of the server under load
+	Connections int
+	Rate        float64 // queries per second over all connections, 0 for as fast as possible
+	Duration    time.Duration
+	Mix         []LoadQuery
+}
+
+// LatencyPercentiles summarizes the latencies of queries
+type LatencyPercentiles struct {
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+// LoadQueryReport is what a load run measured for one query of the mix
+type LoadQueryReport struct {
+	Query      string             `json:"query"`
+	Sent       int64              `json:"sent"`
+	Denied     int64              `json:"denied"`
+	Errors     int64              `json:"errors"`
+	DenialRate float64            `json:"denial_rate"`
+	Latency    LatencyPercentiles `json:"latency"`
+}
+
+// LoadReport is what a load run measured. Queries denied by a quota are
+// counted apart from other errors, and latencies cover every answered query.
+type LoadReport struct {
+	Elapsed          time.Duration      `json:"elapsed"`
+	Connections      int                `json:"connections"`
+	ConnectionErrors int64              `json:"connection_errors"`
+	Sent             int64              `json:"sent"`
+	Denied           int64              `json:"denied"`
+	Errors           int64              `json:"errors"`
+	DenialRate       float64            `json:"denial_rate"`
+	Throughput       float64            `json:"throughput"`
+	Latency          LatencyPercentiles `json:"latency"`
+	Queries          []LoadQueryReport  `json:"queries"`
+}
+
+// loadStats is what a load connection measured for each query of the mix
+type loadStats struct {
+	latencies        [][]time.Duration // of the queries the server answered
+	sent             []int64
+	denied           []int64
+	errors           []int64
+	connectionErrors int64
+}
+
+// LoadGenerator sends a weighted mix of simple protocol queries to a server
+// over concurrent connections, at a target rate, and measures their latency
+// and how many were denied by a quota
+type LoadGenerator struct {
+	config     LoadConfig
+	connConfig *pgconn.Config
+	weight     int // sum of the weights of the mix
+	logger     logger.Logger
+}
+
+// NewLoadGenerator creates a LoadGenerator, validating config
+func NewLoadGenerator(config LoadConfig, log logger.Logger) (*LoadGenerator, error) {
+	if config.Connections <= 0 {
+		return nil, fmt.Errorf("at least one connection is needed")
+	}
+	if config.Rate < 0 {
+		return nil, fmt.Errorf("rate must not be negative")
+	}
+	if config.Duration <= 0 {
+		return nil, fmt.Errorf("duration must be positive")
+	}
+	if len(config.Mix) == 0 {
+		return nil, fmt.Errorf("at least one query is needed")
+	}
+
+	weight := 0
+	for _, query := range config.Mix {
+		if query.SQL == "" {
+			return nil, fmt.Errorf("queries must not be empty")
+		}
+		if query.Weight <= 0 {
+			return nil, fmt.Errorf("query %q: weight must be positive", query.SQL)
+		}
+		weight += query.Weight
+	}
+
+	connConfig, err := pgconn.ParseConfig(config.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %w", err)
+	}
+
+	return &LoadGenerator{
+		config:     config,
+		connConfig: connConfig,
+		weight:     weight,
+		logger:     log,
+	}, nil
+}
+
+// Run sends queries for the configured duration, or until ctx is cancelled,
+// and reports what was measured
+func (g *LoadGenerator) Run(ctx context.Context) (LoadReport, error) {
+	started := time.Now()
+	end := started.Add(g.config.Duration)
+	var scheduled atomic.Int64
+
+	stats := make([]*loadStats, g.config.Connections)
+	var wg sync.WaitGroup
+	for i := range stats {
+		stats[i] = &loadStats{
+			latencies: make([][]time.Duration, len(g.config.Mix)),
+			sent:      make([]int64, len(g.config.Mix)),
+			denied:    make([]int64, len(g.config.Mix)),
+			errors:    make([]int64, len(g.config.Mix)),
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.work(ctx, started, end, &scheduled, stats[i])
+		}()
+	}
+	wg.Wait()
+
+	return g.report(time.Since(started), stats), ctx.Err()
+}
+
+// work sends queries over one connection until end, connecting again whenever
+// the connection is lost
+func (g *LoadGenerator) work(ctx context.Context, started, end time.Time, scheduled *atomic.Int64, stats *loadStats) {
+	var conn *pgconn.PgConn
+	defer func() {
+		if conn != nil {
+			_ = conn.Close(context.Background())
+		}
+	}()
+
+	for {
+		due, ok := g.nextDue(started, end, scheduled)
+		if !ok || !sleepUntil(ctx, due) {
+			return
+		}
+
+		if conn == nil || conn.IsClosed() {
+			var err error
+			conn, err = pgconn.ConnectConfig(ctx, g.connConfig)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				stats.connectionErrors++
+				g.logger.Debug("Failed to connect to the load target: %v", err)
+				if !sleepUntil(ctx, time.Now().Add(loadReconnectDelay)) {
+					return
+				}
+				continue
+			}
+		}
+
+		i := g.pick()
+		sent := time.Now()
+		_, err := conn.Exec(ctx, g.config.Mix[i].SQL).ReadAll()
+		latency := time.Since(sent)
+		if ctx.Err() != nil {
+			return
+		}
+		stats.sent[i]++
+
+		var pgErr *pgconn.PgError
+		switch {
+		case err == nil:
+		case errors.As(err, &pgErr) && pgErr.Code == pgerrQuotaExceeded:
+			stats.denied[i]++
+		default:
+			stats.errors[i]++
+			g.logger.Debug("Load query failed: %v", err)
+			if !errors.As(err, &pgErr) {
+				// The connection is gone or broken; the latency is not the server's
+				continue
+			}
+		}
+		stats.latencies[i] = append(stats.latencies[i], latency)
+	}
+}
+
+// nextDue returns when the next query should be sent, spreading queries
+// evenly over time at the configured rate. It reports false once queries
+// would be due after end.
+func (g *LoadGenerator) nextDue(started, end time.Time, scheduled *atomic.Int64) (time.Time, bool) {
+	if g.config.Rate == 0 {
+		now := time.Now()
+		return now, now.Before(end)
+	}
+	n := scheduled.Add(1) - 1
+	due := started.Add(time.Duration(float64(n) / g.config.Rate * float64(time.Second)))
+	return due, due.Before(end)
+}
+
+// pick returns the index of a query of the mix, chosen in proportion to weights
+func (g *LoadGenerator) pick() int {
+	n := rand.IntN(g.weight)
+	for i, query := range g.config.Mix {
+		if n < query.Weight {
+			return i
+		}
+		n -= query.Weight
+	}
+	return len(g.config.Mix) - 1
+}
+
+// report merges what every connection measured
+func (g *LoadGenerator) report(elapsed time.Duration, stats []*loadStats) LoadReport {
+	report := LoadReport{
+		Elapsed:     elapsed,
+		Connections: g.config.Connections,
+		Queries:     make([]LoadQueryReport, len(g.config.Mix)),
+	}
+
+	var all []time.Duration
+	for i, query := range g.config.Mix {
+		var latencies []time.Duration
+		queryReport := LoadQueryReport{Query: query.SQL}
+		for _, s := range stats {
+			latencies = append(latencies, s.latencies[i]...)
+			queryReport.Sent += s.sent[i]
+			queryReport.Denied += s.denied[i]
+			queryReport.Errors += s.errors[i]
+		}
+		queryReport.DenialRate = ratio(queryReport.Denied, queryReport.Sent)
+		queryReport.Latency = latencyPercentiles(latencies)
+		report.Queries[i] = queryReport
+
+		report.Sent += queryReport.Sent
+		report.Denied += queryReport.Denied
+		report.Errors += queryReport.Errors
+		all = append(all, latencies...)
+	}
+	for _, s := range stats {
+		report.ConnectionErrors += s.connectionErrors
+	}
+
+	report.DenialRate = ratio(report.Denied, report.Sent)
+	if elapsed > 0 {
+		report.Throughput = float64(report.Sent) / elapsed.Seconds()
+	}
+	report.Latency = latencyPercentiles(all)
+	return report
+}
+
+// latencyPercentiles sorts latencies and summarizes them
+func latencyPercentiles(latencies []time.Duration) LatencyPercentiles {
+	if len(latencies) == 0 {
+		return LatencyPercentiles{}
+	}
+	slices.Sort(latencies)
+	at := func(percentile int) time.Duration {
+		return latencies[(len(latencies)-1)*percentile/100]
+	}
+	return LatencyPercentiles{P50: at(50), P90: at(90), P99: at(99), Max: latencies[len(latencies)-1]}
+}
+
+// ratio returns part/total, zero when total is
+func ratio(part, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total)
+}
+
+// sleepUntil waits until t, reporting false if ctx is cancelled first
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	delay := time.Until(t)
+	if delay <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
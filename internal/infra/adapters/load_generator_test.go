@@ -0,0 +1,75 @@
+package adapters
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadGenerator(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.Handle("SELECT 1", testkit.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}, CommandTag: "SELECT 1"})
+	backend.Handle("SELECT 2", testkit.Result{Err: &testkit.ServerError{Code: pgerrQuotaExceeded, Message: `quota "app" exceeded`}})
+	backend.Handle("SELECT 3", testkit.Result{Err: &testkit.ServerError{Code: "42P01", Message: `relation "missing" does not exist`}})
+
+	generator, err := NewLoadGenerator(LoadConfig{
+		Target:      "postgres://alice@" + backend.Addr() + "/app?sslmode=disable",
+		Connections: 4,
+		Rate:        200,
+		Duration:    250 * time.Millisecond,
+		Mix:         []LoadQuery{{SQL: "SELECT 1", Weight: 2}, {SQL: "SELECT 2", Weight: 1}, {SQL: "SELECT 3", Weight: 1}},
+	}, logger.NewSimpleLogger())
+	require.NoError(t, err)
+
+	report, err := generator.Run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(50), report.Sent, "Queries should be paced at the target rate")
+	assert.Zero(t, report.ConnectionErrors)
+	require.Len(t, report.Queries, 3)
+	assert.Equal(t, report.Sent, report.Queries[0].Sent+report.Queries[1].Sent+report.Queries[2].Sent)
+	assert.Equal(t, report.Queries[1].Sent, report.Denied, "Quota denials should be counted apart")
+	assert.Equal(t, report.Queries[2].Sent, report.Errors)
+	assert.InDelta(t, float64(report.Denied)/float64(report.Sent), report.DenialRate, 1e-9)
+	assert.Positive(t, report.Latency.Max)
+	assert.LessOrEqual(t, report.Latency.P50, report.Latency.P99)
+	assert.Len(t, backend.StartupParameters(), 4, "Every connection should be opened once")
+}
+
+func TestNewLoadGenerator_Invalid(t *testing.T) {
+	valid := LoadConfig{Target: "postgres://alice@127.0.0.1/app", Connections: 1, Duration: time.Second, Mix: []LoadQuery{{SQL: "SELECT 1", Weight: 1}}}
+
+	for name, mutate := range map[string]func(*LoadConfig){
+		"no connections":  func(c *LoadConfig) { c.Connections = 0 },
+		"negative rate":   func(c *LoadConfig) { c.Rate = -1 },
+		"no duration":     func(c *LoadConfig) { c.Duration = 0 },
+		"empty mix":       func(c *LoadConfig) { c.Mix = nil },
+		"zero weight":     func(c *LoadConfig) { c.Mix[0].Weight = 0 },
+		"invalid target":  func(c *LoadConfig) { c.Target = "postgres://%zz" },
+		"empty query SQL": func(c *LoadConfig) { c.Mix[0].SQL = "" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			config := valid
+			config.Mix = append([]LoadQuery(nil), valid.Mix...)
+			mutate(&config)
+			_, err := NewLoadGenerator(config, logger.NewSimpleLogger())
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	latencies := make([]time.Duration, 0, 100)
+	for i := 100; i > 0; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, LatencyPercentiles{
+		P50: 50 * time.Millisecond, P90: 90 * time.Millisecond, P99: 99 * time.Millisecond, Max: 100 * time.Millisecond,
+	}, latencyPercentiles(latencies))
+	assert.Zero(t, latencyPercentiles(nil))
+}
@@ -0,0 +1,208 @@
+package adapters
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"slices"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// pgerrInvalidPassword is the SQLSTATE reported when local authentication fails
+const pgerrInvalidPassword = "28P01"
+
+// errUpstreamLogin reports that the enforcer could not log into the upstream with its own credentials
+var errUpstreamLogin = errors.New("upstream login failed")
+
+// authenticate checks the client's password against the userlist and reports
+// whether the client may continue. Failures are answered with a FATAL error
+// that does not tell unknown users from wrong passwords.
+func (h *PostgreSQLConnectionHandler) authenticate(parser *PostgreSQLParser, writer *PostgreSQLResponseWriter, user string, connLogger logger.Logger) (bool, error) {
+	credentials, ok := h.userlist.lookup(user)
+
+	var err error
+	switch {
+	case !ok:
+		err = fmt.Errorf("%w: unknown user", errAuthenticationFailed)
+	case credentials.md5 != "":
+		err = authenticateMD5(parser, credentials.md5)
+	default:
+		err = authenticateSCRAM(parser, credentials.scram)
+	}
+
+	if errors.Is(err, errAuthenticationFailed) {
+		connLogger.Info("Authentication of %s failed: %v", user, err)
+		return false, writer.Reject(pgerrInvalidPassword, fmt.Sprintf("password authentication failed for user %q", user))
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := parser.Send(&pgproto3.AuthenticationOk{}); err != nil {
+		return false, fmt.Errorf("failed to confirm authentication: %w", err)
+	}
+	return true, nil
+}
+
+// authenticateMD5 runs an MD5 password exchange against the stored hash
+func authenticateMD5(parser *PostgreSQLParser, hash string) error {
+	var salt [4]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	if err := parser.Send(&pgproto3.AuthenticationMD5Password{Salt: salt}); err != nil {
+		return fmt.Errorf("failed to request password: %w", err)
+	}
+	response, err := readAuthResponse[*pgproto3.PasswordMessage](parser, pgproto3.AuthTypeMD5Password)
+	if err != nil {
+		return err
+	}
+
+	expected := md5Response(hash, salt)
+	if subtle.ConstantTimeCompare([]byte(response.Password), []byte(expected)) != 1 {
+		return errAuthenticationFailed
+	}
+	return nil
+}
+
+// authenticateSCRAM runs a SCRAM-SHA-256 exchange against the stored verifier
+func authenticateSCRAM(parser *PostgreSQLParser, verifier *scramVerifier) error {
+	if err := parser.Send(&pgproto3.AuthenticationSASL{AuthMechanisms: []string{scramMechanism}}); err != nil {
+		return fmt.Errorf("failed to request password: %w", err)
+	}
+	initial, err := readAuthResponse[*pgproto3.SASLInitialResponse](parser, pgproto3.AuthTypeSASL)
+	if err != nil {
+		return err
+	}
+	if initial.AuthMechanism != scramMechanism {
+		return fmt.Errorf("%w: unsupported SASL mechanism %q", errAuthenticationFailed, initial.AuthMechanism)
+	}
+
+	server := newSCRAMServer(verifier)
+	serverFirst, err := server.First(initial.Data)
+	if err != nil {
+		return err
+	}
+	if err := parser.Send(&pgproto3.AuthenticationSASLContinue{Data: []byte(serverFirst)}); err != nil {
+		return fmt.Errorf("failed to continue SCRAM exchange: %w", err)
+	}
+
+	response, err := readAuthResponse[*pgproto3.SASLResponse](parser, pgproto3.AuthTypeSASLContinue)
+	if err != nil {
+		return err
+	}
+	serverFinal, err := server.Final(response.Data)
+	if err != nil {
+		return err
+	}
+	if err := parser.Send(&pgproto3.AuthenticationSASLFinal{Data: []byte(serverFinal)}); err != nil {
+		return fmt.Errorf("failed to complete SCRAM exchange: %w", err)
+	}
+	return nil
+}
+
+// readAuthResponse reads the client's answer to an authentication request of authType
+func readAuthResponse[T pgproto3.FrontendMessage](parser *PostgreSQLParser, authType uint32) (T, error) {
+	var zero T
+	if err := parser.SetAuthType(authType); err != nil {
+		return zero, fmt.Errorf("failed to follow authentication: %w", err)
+	}
+	message, err := parser.ReadMessage()
+	if err != nil {
+		return zero, err
+	}
+	response, ok := message.Message.(T)
+	if !ok {
+		return zero, fmt.Errorf("%w: unexpected %s during authentication", errAuthenticationFailed, message.Type)
+	}
+	return response, nil
+}
+
+// upstreamLogin answers the upstream's authentication requests with the enforcer's
+// own credentials, for clients the enforcer authenticated itself
+type upstreamLogin struct {
+	user     string
+	password string
+	scram    *scramClient
+}
+
+// upstreamLogin returns the credentials the connection of user logs into the
+// upstream with, or nil when clients authenticate with the upstream directly.
+// Without configured upstream credentials the client's own user name is used,
+// with its password when the userlist holds it in plaintext. Clients presenting
+// their token as the password always use the configured credentials.
+func (h *PostgreSQLConnectionHandler) upstreamLogin(user string) *upstreamLogin {
+	if h.jwtIdentity != nil && h.jwtIdentity.Parameter == "" {
+		return &upstreamLogin{user: h.upstreamUser, password: h.upstreamPassword}
+	}
+	if h.userlist == nil {
+		return nil
+	}
+	if h.upstreamUser != "" {
+		return &upstreamLogin{user: h.upstreamUser, password: h.upstreamPassword}
+	}
+
+	login := &upstreamLogin{user: user, password: h.upstreamPassword}
+	if credentials, ok := h.userlist.lookup(user); ok && login.password == "" {
+		login.password = credentials.plaintext
+	}
+	return login
+}
+
+// answer responds to an authentication message from the upstream and reports
+// whether it was consumed. AuthenticationOk is consumed too, since the client
+// was already told it is authenticated.
+func (l *upstreamLogin) answer(upstream *upstreamConnection, msg pgproto3.BackendMessage) (bool, error) {
+	var response pgproto3.FrontendMessage
+	switch m := msg.(type) {
+	case *pgproto3.AuthenticationOk:
+		return true, nil
+	case *pgproto3.AuthenticationCleartextPassword:
+		response = &pgproto3.PasswordMessage{Password: l.password}
+	case *pgproto3.AuthenticationMD5Password:
+		response = &pgproto3.PasswordMessage{Password: md5Response(md5Password(l.user, l.password), m.Salt)}
+	case *pgproto3.AuthenticationSASL:
+		if !slices.Contains(m.AuthMechanisms, scramMechanism) {
+			return false, fmt.Errorf("%w: no supported SASL mechanism in %v", errUpstreamLogin, m.AuthMechanisms)
+		}
+		client, err := newSCRAMClient(l.password)
+		if err != nil {
+			return false, err
+		}
+		l.scram = client
+		response = &pgproto3.SASLInitialResponse{AuthMechanism: scramMechanism, Data: client.First()}
+	case *pgproto3.AuthenticationSASLContinue:
+		if l.scram == nil {
+			return false, fmt.Errorf("%w: unexpected SASL continuation", errUpstreamLogin)
+		}
+		final, err := l.scram.Final(m.Data)
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", errUpstreamLogin, err)
+		}
+		response = &pgproto3.SASLResponse{Data: final}
+	case *pgproto3.AuthenticationSASLFinal:
+		if l.scram == nil {
+			return false, fmt.Errorf("%w: unexpected SASL completion", errUpstreamLogin)
+		}
+		if err := l.scram.Verify(m.Data); err != nil {
+			return false, fmt.Errorf("%w: %v", errUpstreamLogin, err)
+		}
+		return true, nil
+	case *pgproto3.AuthenticationGSS, *pgproto3.AuthenticationGSSContinue:
+		return false, fmt.Errorf("%w: GSSAPI authentication is not supported", errUpstreamLogin)
+	default:
+		return false, nil
+	}
+
+	if l.password == "" {
+		return false, fmt.Errorf("%w: no password for upstream user %q", errUpstreamLogin, l.user)
+	}
+	if err := upstream.Send(response); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,108 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectLibpq connects like a libpq client, which answers MD5 and SCRAM challenges
+func connectLibpq(t *testing.T, addr, user, password string) (*pgconn.PgConn, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return pgconn.Connect(ctx, fmt.Sprintf("postgres://%s:%s@%s/app?sslmode=disable", user, password, addr))
+}
+
+func TestPostgreSQLConnectionHandler_LocalAuth(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.RequirePassword("upstream-secret")
+
+	userlist, err := ParseUserlist(strings.NewReader(`"alice" "` + md5Password("alice", "alice-secret") + `"
+"bob" "bob-secret"
+`))
+	require.NoError(t, err)
+
+	engine := &mocks.StaticPolicyEngine{}
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithUpstreams(upstreamSelector(backend.Addr())),
+		WithLocalAuth(userlist), WithUpstreamCredentials("shared", "upstream-secret"))
+	addr := startHandler(t, handler)
+
+	for _, user := range []string{"alice", "bob"} {
+		t.Run(user, func(t *testing.T) {
+			conn, err := connectLibpq(t, addr, user, user+"-secret")
+			require.NoError(t, err)
+			defer conn.Close(context.Background())
+
+			_, err = conn.Exec(context.Background(), "SELECT 1").ReadAll()
+			require.NoError(t, err)
+
+			queries := engine.Queries()
+			assert.Equal(t, user, queries[len(queries)-1].UserID, "Quotas should apply to the client's own user")
+			startups := backend.StartupParameters()
+			assert.Equal(t, "shared", startups[len(startups)-1]["user"], "The upstream should see the shared credentials")
+		})
+	}
+
+	for name, credentials := range map[string][2]string{
+		"wrong MD5 password":   {"alice", "guess"},
+		"wrong SCRAM password": {"bob", "guess"},
+		"unknown user":         {"mallory", "guess"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := connectLibpq(t, addr, credentials[0], credentials[1])
+			var pgErr *pgconn.PgError
+			require.ErrorAs(t, err, &pgErr)
+			assert.Equal(t, pgerrInvalidPassword, pgErr.Code)
+		})
+	}
+	assert.Len(t, backend.StartupParameters(), 2, "Failed logins should not reach the upstream")
+}
+
+func TestPostgreSQLConnectionHandler_LocalAuthPlaintextPassthrough(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.RequirePassword("bob-secret")
+
+	userlist, err := ParseUserlist(strings.NewReader(`"bob" "bob-secret"` + "\n"))
+	require.NoError(t, err)
+
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithUpstreams(upstreamSelector(backend.Addr())), WithLocalAuth(userlist))
+	addr := startHandler(t, handler)
+
+	conn, err := connectLibpq(t, addr, "bob", "bob-secret")
+	require.NoError(t, err)
+	defer conn.Close(context.Background())
+
+	require.Len(t, backend.StartupParameters(), 1)
+	assert.Equal(t, "bob", backend.StartupParameters()[0]["user"], "Without upstream credentials the client's user should be used")
+}
+
+func TestPostgreSQLConnectionHandler_LocalAuthUpstreamLoginFails(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.RequirePassword("upstream-secret")
+
+	userlist, err := ParseUserlist(strings.NewReader(`"alice" "` + md5Password("alice", "alice-secret") + `"` + "\n"))
+	require.NoError(t, err)
+
+	// alice's password is only known as a hash, so nothing can answer the upstream
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithUpstreams(upstreamSelector(backend.Addr())), WithLocalAuth(userlist))
+	addr := startHandler(t, handler)
+
+	_, err = connectLibpq(t, addr, "alice", "alice-secret")
+	var pgErr *pgconn.PgError
+	require.ErrorAs(t, err, &pgErr)
+	assert.Equal(t, pgerrConnectionFailure, pgErr.Code)
+}
@@ -0,0 +1,371 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	// DefaultScriptTimeout bounds the run of a script on a query
+	DefaultScriptTimeout = 10 * time.Millisecond
+
+	// scriptLoadTimeout bounds the run of the top level of a script, which
+	// defines its functions
+	scriptLoadTimeout = time.Second
+
+	// scriptMaxRep bounds the bytes a script may build with string.rep
+	scriptMaxRep = 1 << 20
+
+	// scriptCallStackSize and scriptRegistryMaxSize bound the call depth and
+	// the value stack of a script
+	scriptCallStackSize   = 200
+	scriptRegistryMaxSize = 64 * 1024
+)
+
+// Actions a script's evaluate function may return
+const (
+	ScriptActionAllow   = "allow"
+	ScriptActionDeny    = "deny"
+	ScriptActionRewrite = "rewrite"
+)
+
+// LuaScript runs an operator's Lua script on every query, ahead of the policy
+// engine. The script defines a global function evaluate(query) returning an
+// action: "allow" (or nothing) hands the query on to the policy engine, "deny"
+// denies it with the reason returned second, and "rewrite" has the upstream run
+// the text returned second instead, once the policy engine allowed it.
+//
+// The query table has the fields user, database, application_name, listener,
+// kind, query, normalized, fingerprint and labels, and type and tables, which
+// are only analyzed when the script reads them. Scripts run without access to
+// files, the OS or code loading, each run bounded by a timeout, with a bounded
+// stack, string.rep capped to scriptMaxRep bytes and string.format widths to two
+// digits, so that memory is only allocated as fast as the timeout allows. A
+// script failing or timing out is logged and has no say on the query.
+//
+// Runs reuse idle states, whose globals are reset after each run: those the top
+// level defined are restored, and those a run added are dropped. Tables and
+// upvalues of the top level are shared by the runs of a state.
+type LuaScript struct {
+	name     string
+	proto    *lua.FunctionProto
+	analyzer domain.QueryAnalyzer
+	timeout  time.Duration
+	logger   logger.Logger
+	states   sync.Pool // idle *lua.LState with the script loaded, as states are not safe for concurrent use
+}
+
+// LuaScriptOption configures optional behavior of a LuaScript
+type LuaScriptOption func(*LuaScript)
+
+// WithScriptTimeout bounds each run of the script on a query instead of DefaultScriptTimeout
+func WithScriptTimeout(timeout time.Duration) LuaScriptOption {
+	return func(s *LuaScript) {
+		s.timeout = timeout
+	}
+}
+
+// WithScriptAnalyzer analyzes the type and tables of queries with analyzer instead of pg_query
+func WithScriptAnalyzer(analyzer domain.QueryAnalyzer) LuaScriptOption {
+	return func(s *LuaScript) {
+		s.analyzer = analyzer
+	}
+}
+
+// LoadLuaScript compiles the Lua script at path
+func LoadLuaScript(path string, log logger.Logger, opts ...LuaScriptOption) (*LuaScript, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read script: %w", err)
+	}
+	return NewLuaScript(filepath.Base(path), string(source), log, opts...)
+}
+
+// NewLuaScript compiles source, a Lua script named name in decisions and logs,
+// and checks that it defines an evaluate function
+func NewLuaScript(name, source string, log logger.Logger, opts ...LuaScriptOption) (*LuaScript, error) {
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse script %s: %w", name, err)
+	}
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile script %s: %w", name, err)
+	}
+
+	s := &LuaScript{
+		name:     name,
+		proto:    proto,
+		analyzer: NewPgQueryAnalyzer(),
+		timeout:  DefaultScriptTimeout,
+		logger:   log.WithField("script", name),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.timeout <= 0 {
+		return nil, fmt.Errorf("script timeout must be positive")
+	}
+
+	state, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.states.Put(state)
+	return s, nil
+}
+
+// Name returns the name of the script
+func (s *LuaScript) Name() string {
+	return s.name
+}
+
+// load creates a sandboxed Lua state and runs the top level of the script in it.
+// The globals it defines are then moved to a table the globals table falls back
+// to, so that resetGlobals can drop what a run sets.
+func (s *LuaScript) load() (*lua.LState, error) {
+	state := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   scriptCallStackSize,
+		RegistrySize:    lua.RegistrySize,
+		RegistryMaxSize: scriptRegistryMaxSize,
+	})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		if err := state.CallByParam(lua.P{Fn: state.NewFunction(lib.open), Protect: true}, lua.LString(lib.name)); err != nil {
+			state.Close()
+			return nil, fmt.Errorf("failed to open the %q library of script %s: %w", lib.name, s.name, err)
+		}
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		state.SetGlobal(name, lua.LNil)
+	}
+	limitStringLib(state)
+
+	ctx, cancel := context.WithTimeout(context.Background(), scriptLoadTimeout)
+	defer cancel()
+	state.SetContext(ctx)
+	err := state.CallByParam(lua.P{Fn: state.NewFunctionFromProto(s.proto), Protect: true})
+	state.RemoveContext()
+	if err != nil {
+		state.Close()
+		return nil, fmt.Errorf("failed to load script %s: %w", s.name, err)
+	}
+	if state.GetGlobal("evaluate").Type() != lua.LTFunction {
+		state.Close()
+		return nil, fmt.Errorf("script %s does not define an evaluate function", s.name)
+	}
+
+	defined := state.NewTable()
+	state.G.Global.ForEach(func(key, value lua.LValue) {
+		defined.RawSet(key, value)
+	})
+	resetGlobals(state)
+	metatable := state.NewTable()
+	metatable.RawSetString("__index", defined)
+	metatable.RawSetString("__metatable", lua.LFalse) // kept from getmetatable and setmetatable
+	state.SetMetatable(state.G.Global, metatable)
+	return state, nil
+}
+
+// resetGlobals drops the globals set in the globals table of state, leaving
+// those of the table it falls back to
+func resetGlobals(state *lua.LState) {
+	var keys []lua.LValue
+	state.G.Global.ForEach(func(key, _ lua.LValue) {
+		keys = append(keys, key)
+	})
+	for _, key := range keys {
+		state.G.Global.RawSet(key, lua.LNil)
+	}
+}
+
+// limitStringLib replaces string.rep and string.format, whose results may be
+// far larger than their arguments, with versions bounding them
+func limitStringLib(state *lua.LState) {
+	lib, ok := state.GetGlobal(lua.StringLibName).(*lua.LTable)
+	if !ok {
+		return
+	}
+	lib.RawSetString("rep", state.NewFunction(func(state *lua.LState) int {
+		str, n := state.CheckString(1), state.CheckInt(2)
+		if n <= 0 {
+			state.Push(lua.LString(""))
+			return 1
+		}
+		if len(str) > 0 && n > scriptMaxRep/len(str) {
+			state.RaiseError("string.rep result larger than %d bytes", scriptMaxRep)
+		}
+		state.Push(lua.LString(strings.Repeat(str, n)))
+		return 1
+	}))
+	if format, ok := lib.RawGetString("format").(*lua.LFunction); ok && format.GFunction != nil {
+		lib.RawSetString("format", state.NewFunction(func(state *lua.LState) int {
+			if err := checkScriptFormat(state.CheckString(1)); err != nil {
+				state.RaiseError("%v", err)
+			}
+			return format.GFunction(state)
+		}))
+	}
+}
+
+// checkScriptFormat rejects the widths and precisions of string.format
+// conversions longer than two digits, as Lua does
+func checkScriptFormat(format string) error {
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		for _, part := range []string{"width", "precision"} {
+			if part == "precision" {
+				if i >= len(format) || format[i] != '.' {
+					break
+				}
+				i++
+			}
+			digits := 0
+			for i < len(format) && isQueryDigit(format[i]) {
+				i++
+				digits++
+			}
+			if digits > 2 {
+				return fmt.Errorf("invalid format %q: %s longer than 2 digits", format, part)
+			}
+		}
+	}
+	return nil
+}
+
+// Middleware is a domain.QueryMiddleware running the script on query before next
+func (s *LuaScript) Middleware(ctx context.Context, query *domain.Query, next domain.QueryHandler) (domain.Decision, error) {
+	action, text, err := s.run(ctx, query)
+	if err != nil {
+		s.logger.Error("Ignoring script on query of connection %s: %v", query.ConnectionID, err)
+		return next(ctx, query)
+	}
+
+	switch action {
+	case ScriptActionDeny:
+		if text == "" {
+			text = "denied by script " + s.name
+		}
+		return domain.Decision{Action: domain.DecisionDeny, Policy: s.name, Reason: text, Code: pgerrInsufficientPrivilege}, nil
+	case ScriptActionRewrite:
+		if text == "" {
+			s.logger.Error("Ignoring rewrite to an empty query of connection %s", query.ConnectionID)
+			return next(ctx, query)
+		}
+		query.Raw = text
+		decision, err := next(ctx, query)
+		if err == nil && decision.Allowed() && decision.Rewrite == "" {
+			decision.Rewrite = text
+		}
+		return decision, err
+	case ScriptActionAllow, "":
+		return next(ctx, query)
+	default:
+		s.logger.Error("Ignoring unknown script action %q on query of connection %s", action, query.ConnectionID)
+		return next(ctx, query)
+	}
+}
+
+// run calls the evaluate function of the script on query and returns the action
+// and text it returned
+func (s *LuaScript) run(ctx context.Context, query *domain.Query) (string, string, error) {
+	state, _ := s.states.Get().(*lua.LState)
+	if state == nil {
+		var err error
+		if state, err = s.load(); err != nil {
+			return "", "", err
+		}
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	state.SetContext(runCtx)
+	err := state.CallByParam(lua.P{Fn: state.GetGlobal("evaluate"), NRet: 2, Protect: true}, s.queryTable(state, query))
+	state.RemoveContext()
+	if err != nil {
+		// The state may be left mid-call, so it is not reused
+		state.Close()
+		return "", "", err
+	}
+
+	action, text := lua.LVAsString(state.Get(-2)), lua.LVAsString(state.Get(-1))
+	state.Pop(2)
+	resetGlobals(state)
+	s.states.Put(state)
+	return strings.ToLower(action), text, nil
+}
+
+// queryTable returns the Lua table describing query to the script. Its type
+// and tables are analyzed the first time the script reads either.
+func (s *LuaScript) queryTable(state *lua.LState, query *domain.Query) *lua.LTable {
+	table := state.NewTable()
+	table.RawSetString("user", lua.LString(query.UserID))
+	table.RawSetString("database", lua.LString(query.Database))
+	table.RawSetString("application_name", lua.LString(query.ApplicationName))
+	table.RawSetString("listener", lua.LString(query.Listener))
+	table.RawSetString("kind", lua.LString(query.Kind))
+	table.RawSetString("query", lua.LString(query.Raw))
+	table.RawSetString("normalized", lua.LString(query.Normalized))
+	table.RawSetString("fingerprint", lua.LString(query.Hash.Value()))
+	labels := state.NewTable()
+	for key, value := range query.Labels {
+		labels.RawSetString(key, lua.LString(value))
+	}
+	table.RawSetString("labels", labels)
+
+	analyzed := false
+	metatable := state.NewTable()
+	metatable.RawSetString("__index", state.NewFunction(func(state *lua.LState) int {
+		key := state.CheckString(2)
+		if !analyzed && (key == "type" || key == "tables") {
+			analyzed = true
+			tables := state.NewTable()
+			if analysis, err := s.analyzer.AnalyzeQuery(query); err == nil {
+				table.RawSetString("type", lua.LString(analysis.QueryType))
+				for _, name := range analysis.Tables {
+					tables.Append(lua.LString(name))
+				}
+			}
+			table.RawSetString("tables", tables)
+		}
+		state.Push(table.RawGetString(key))
+		return 1
+	}))
+	state.SetMetatable(table, metatable)
+	return table
+}
+
+// Close releases the idle Lua states of the script
+func (s *LuaScript) Close() error {
+	for {
+		state, _ := s.states.Get().(*lua.LState)
+		if state == nil {
+			return nil
+		}
+		state.Close()
+	}
+}
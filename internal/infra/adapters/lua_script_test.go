@@ -0,0 +1,161 @@
+package adapters
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testScript = `
+function evaluate(query)
+  if query.type == "DELETE" and query.labels.team ~= "dba" then
+    return "deny", "only DBAs may delete from " .. table.concat(query.tables, ", ")
+  end
+  if query.user == "reporting" and not string.find(query.query, "LIMIT") then
+    return "rewrite", query.query .. " LIMIT 1000"
+  end
+  return "allow"
+end
+`
+
+// scriptQuery returns a normalized query of alice on app
+func scriptQuery(raw string) *domain.Query {
+	query := domain.NewQuery(raw, "conn_1")
+	query.UserID = "alice"
+	query.Database = "app"
+	query.Kind = domain.QueryKindSimple
+	return query
+}
+
+func TestLuaScript_Decisions(t *testing.T) {
+	script, err := NewLuaScript("rules.lua", testScript, logger.NewSimpleLogger())
+	require.NoError(t, err)
+	defer script.Close()
+	engine := &mocks.StaticPolicyEngine{}
+	ctx := context.Background()
+
+	decision, err := script.Middleware(ctx, scriptQuery("DELETE FROM orders WHERE id = 1"), engine.Evaluate)
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed())
+	assert.Equal(t, "rules.lua", decision.Policy)
+	assert.Equal(t, "only DBAs may delete from orders", decision.Reason)
+	assert.Equal(t, pgerrInsufficientPrivilege, decision.Code)
+	assert.Empty(t, engine.Queries(), "Denied queries should not reach the policy engine")
+
+	dba := scriptQuery("DELETE FROM orders WHERE id = 1")
+	dba.Labels = map[string]string{"team": "dba"}
+	decision, err = script.Middleware(ctx, dba, engine.Evaluate)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed())
+	assert.Empty(t, decision.Rewrite)
+
+	reporting := scriptQuery("SELECT * FROM orders")
+	reporting.UserID = "reporting"
+	decision, err = script.Middleware(ctx, reporting, engine.Evaluate)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed())
+	assert.Equal(t, "SELECT * FROM orders LIMIT 1000", decision.Rewrite)
+	assert.Equal(t, "SELECT * FROM orders LIMIT 1000", engine.Queries()[1].Raw, "The policy engine should see the rewritten query")
+}
+
+func TestLuaScript_FailuresAreIgnored(t *testing.T) {
+	engine := &mocks.StaticPolicyEngine{Decision: domain.Decision{Action: domain.DecisionDeny, Reason: "quota exceeded"}}
+	script, err := NewLuaScript("loop.lua", `
+function evaluate(query)
+  if query.user == "alice" then
+    while true do end
+  end
+  error("broken")
+end`, logger.NewSimpleLogger(), WithScriptTimeout(20*time.Millisecond))
+	require.NoError(t, err)
+
+	query := scriptQuery("SELECT 1")
+	decision, err := script.Middleware(context.Background(), query, engine.Evaluate)
+	require.NoError(t, err)
+	assert.Equal(t, "quota exceeded", decision.Reason, "A script timing out should leave the decision to the policy engine")
+
+	query.UserID = "bob"
+	decision, err = script.Middleware(context.Background(), query, engine.Evaluate)
+	require.NoError(t, err)
+	assert.Equal(t, "quota exceeded", decision.Reason, "A failing script should leave the decision to the policy engine")
+}
+
+func TestLuaScript_GlobalsAreReset(t *testing.T) {
+	engine := &mocks.StaticPolicyEngine{}
+	script, err := NewLuaScript("globals.lua", `
+limit = 1
+function evaluate(query)
+  if seen or limit ~= 1 then
+    return "deny", "state leaked from an earlier query"
+  end
+  seen = true
+  limit = 2
+  evaluate = nil
+end`, logger.NewSimpleLogger())
+	require.NoError(t, err)
+	defer script.Close()
+
+	for i := 0; i < 3; i++ {
+		decision, err := script.Middleware(context.Background(), scriptQuery("SELECT 1"), engine.Evaluate)
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed(), "Run %d: %s", i, decision.Reason)
+	}
+}
+
+func TestLuaScript_StringLimits(t *testing.T) {
+	engine := &mocks.StaticPolicyEngine{}
+	script, err := NewLuaScript("strings.lua", `
+function evaluate(query)
+  if query.user == "rep" then
+    return "deny", string.rep("x", 1e9)
+  elseif query.user == "method" then
+    return "deny", ("x"):rep(1e9)
+  elseif query.user == "format" then
+    return "deny", string.format("%999999999d", 1)
+  end
+  return "deny", string.rep("ab", 2) .. string.format("%5.2f|%%|%-3s", 1.5, "x")
+end`, logger.NewSimpleLogger())
+	require.NoError(t, err)
+	defer script.Close()
+
+	for _, user := range []string{"rep", "method", "format"} {
+		query := scriptQuery("SELECT 1")
+		query.UserID = user
+		decision, err := script.Middleware(context.Background(), query, engine.Evaluate)
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed(), "%s should fail the script and leave the decision to the policy engine", user)
+	}
+
+	decision, err := script.Middleware(context.Background(), scriptQuery("SELECT 1"), engine.Evaluate)
+	require.NoError(t, err)
+	assert.Equal(t, "abab 1.50|%|x  ", decision.Reason, "Bounded strings should still be built")
+}
+
+func TestLoadLuaScript_Rejects(t *testing.T) {
+	dir := t.TempDir()
+	for name, source := range map[string]string{
+		"syntax.lua":    "function evaluate(query",
+		"missing.lua":   "function decide(query) end",
+		"sandbox.lua":   "local f = io.open('/etc/passwd')\nfunction evaluate(query) end",
+		"loadfile.lua":  "loadfile('/etc/passwd')\nfunction evaluate(query) end",
+		"toplevel.lua":  "error('fails to load')",
+		"osexecute.lua": "os.execute('true')\nfunction evaluate(query) end",
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(source), 0o600))
+		_, err := LoadLuaScript(path, logger.NewSimpleLogger())
+		assert.Error(t, err, name)
+	}
+
+	_, err := LoadLuaScript(filepath.Join(dir, "absent.lua"), logger.NewSimpleLogger())
+	assert.Error(t, err)
+}
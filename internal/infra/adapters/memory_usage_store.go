@@ -0,0 +1,85 @@
+package adapters
+
+import (
+	"context"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sync"
+	"time"
+)
+
+// MemoryUsageStore implements domain.UsageStore with fixed windows kept in process memory
+type MemoryUsageStore struct {
+	mu       sync.Mutex
+	counters map[domain.UsageKey]*fixedWindowCounter
+	clock    domain.Clock
+}
+
+// MemoryUsageStoreOption configures optional behavior of a MemoryUsageStore
+type MemoryUsageStoreOption func(*MemoryUsageStore)
+
+// WithUsageStoreClock sets the clock used to select windows
+func WithUsageStoreClock(clock domain.Clock) MemoryUsageStoreOption {
+	return func(s *MemoryUsageStore) {
+		s.clock = clock
+	}
+}
+
+// fixedWindowCounter counts usage within a single aligned window
+type fixedWindowCounter struct {
+	windowStart time.Time
+	used        int64
+}
+
+// NewMemoryUsageStore creates an empty MemoryUsageStore
+func NewMemoryUsageStore(opts ...MemoryUsageStoreOption) *MemoryUsageStore {
+	store := &MemoryUsageStore{
+		counters: make(map[domain.UsageKey]*fixedWindowCounter),
+		clock:    SystemClock{},
+	}
+
+	for _, opt := range opts {
+		opt(store)
+	}
+
+	return store
+}
+
+// Increment adds amount to the counter for the current window
+func (s *MemoryUsageStore) Increment(ctx context.Context, key domain.UsageKey, window time.Duration, amount int64) (domain.Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.current(key, window, s.clock.Now())
+	counter.used += amount
+	return domain.Usage{Used: counter.used, ResetAt: counter.windowStart.Add(window)}, nil
+}
+
+// Get returns the usage of the current window
+func (s *MemoryUsageStore) Get(ctx context.Context, key domain.UsageKey, window time.Duration) (domain.Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.current(key, window, s.clock.Now())
+	return domain.Usage{Used: counter.used, ResetAt: counter.windowStart.Add(window)}, nil
+}
+
+// Reset clears the counter
+func (s *MemoryUsageStore) Reset(ctx context.Context, key domain.UsageKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.counters, key)
+	return nil
+}
+
+// current returns the counter for the window containing now, starting a new one when it rolled over
+func (s *MemoryUsageStore) current(key domain.UsageKey, window time.Duration, now time.Time) *fixedWindowCounter {
+	start := now.Truncate(window)
+
+	counter, ok := s.counters[key]
+	if !ok || !counter.windowStart.Equal(start) {
+		counter = &fixedWindowCounter{windowStart: start}
+		s.counters[key] = counter
+	}
+	return counter
+}
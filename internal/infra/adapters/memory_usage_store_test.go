@@ -0,0 +1,61 @@
+package adapters
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryUsageStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryUsageStore()
+	key := domain.UsageKey{Policy: "p", User: "alice", Database: "app"}
+
+	usage, err := store.Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), usage.Used)
+
+	usage, err = store.Increment(ctx, key, time.Hour, 3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), usage.Used)
+	assert.True(t, usage.ResetAt.After(time.Now()))
+
+	other := domain.UsageKey{Policy: "p", User: "bob", Database: "app"}
+	usage, err = store.Increment(ctx, other, time.Hour, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), usage.Used)
+
+	require.NoError(t, store.Reset(ctx, key))
+	usage, err = store.Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), usage.Used)
+}
+
+func TestMemoryUsageStore_WindowRollover(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 30, 0, time.UTC))
+	store := NewMemoryUsageStore(WithUsageStoreClock(clock))
+	key := domain.UsageKey{Policy: "p", User: "alice", Database: "app"}
+
+	usage, err := store.Increment(ctx, key, time.Minute, 5)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), usage.Used)
+	assert.Equal(t, time.Date(2025, 6, 1, 12, 1, 0, 0, time.UTC), usage.ResetAt)
+
+	clock.Advance(29 * time.Second)
+	usage, err = store.Get(ctx, key, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), usage.Used, "Usage should persist within the window")
+
+	clock.Advance(time.Second)
+	usage, err = store.Get(ctx, key, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), usage.Used, "Usage should reset when the window rolls over")
+	assert.Equal(t, time.Date(2025, 6, 1, 12, 2, 0, 0, time.UTC), usage.ResetAt)
+}
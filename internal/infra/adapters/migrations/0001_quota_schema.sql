@@ -0,0 +1,28 @@
+-- Quota definitions and usage counters of the PostgreSQL usage store.
+-- Policies may be managed with plain SQL; the enforcer reads them at startup
+-- and on every reload.
+
+CREATE TABLE quota_enforcer.quota_policies (
+    name          text PRIMARY KEY,
+    user_name     text NOT NULL DEFAULT '',
+    database_name text NOT NULL DEFAULT '',
+    labels        jsonb NOT NULL DEFAULT '{}',
+    query_limit   bigint NOT NULL CHECK (query_limit > 0),
+    time_window   interval NOT NULL CHECK (time_window > interval '0'),
+    updated_at    timestamptz NOT NULL DEFAULT now()
+);
+
+-- One row per policy, principal and window. Rows of elapsed windows are kept
+-- for reporting and may be deleted once window_end has passed.
+CREATE TABLE quota_enforcer.quota_usage (
+    policy        text NOT NULL,
+    user_name     text NOT NULL,
+    database_name text NOT NULL,
+    window_start  timestamptz NOT NULL,
+    window_end    timestamptz NOT NULL,
+    used          bigint NOT NULL DEFAULT 0,
+    updated_at    timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (policy, user_name, database_name, window_start)
+);
+
+CREATE INDEX quota_usage_window_end_idx ON quota_enforcer.quota_usage (window_end);
@@ -0,0 +1,6 @@
+-- Policies may limit the data COPY commands transfer instead of queries. The
+-- limit of a bytes or rows policy is counted in that unit.
+
+ALTER TABLE quota_enforcer.quota_policies
+    ADD COLUMN dimension text NOT NULL DEFAULT 'queries'
+        CHECK (dimension IN ('queries', 'bytes', 'rows'));
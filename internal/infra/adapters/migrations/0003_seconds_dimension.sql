@@ -0,0 +1,6 @@
+-- Policies may limit the execution time of statements, in seconds.
+
+ALTER TABLE quota_enforcer.quota_policies
+    DROP CONSTRAINT quota_policies_dimension_check,
+    ADD CONSTRAINT quota_policies_dimension_check
+        CHECK (dimension IN ('queries', 'bytes', 'rows', 'seconds'));
@@ -0,0 +1,15 @@
+-- Policies may delay queries beyond a rate instead of, or besides, limiting
+-- them within a window. Policies with a rate may leave the limit and window at
+-- zero.
+
+ALTER TABLE quota_enforcer.quota_policies
+    ADD COLUMN rate double precision NOT NULL DEFAULT 0 CHECK (rate >= 0),
+    ADD COLUMN burst bigint NOT NULL DEFAULT 0 CHECK (burst >= 0),
+    ADD COLUMN rate_per text NOT NULL DEFAULT 'user' CHECK (rate_per IN ('user', 'connection')),
+    ALTER COLUMN query_limit SET DEFAULT 0,
+    ALTER COLUMN time_window SET DEFAULT interval '0',
+    DROP CONSTRAINT quota_policies_query_limit_check,
+    DROP CONSTRAINT quota_policies_time_window_check,
+    ADD CONSTRAINT quota_policies_limit_check CHECK (
+        (query_limit > 0 AND time_window > interval '0')
+        OR (query_limit = 0 AND time_window = interval '0' AND rate > 0));
@@ -0,0 +1,9 @@
+-- Policies may cap the concurrent connections of each principal they match,
+-- with or without a windowed limit.
+
+ALTER TABLE quota_enforcer.quota_policies
+    ADD COLUMN max_connections bigint NOT NULL DEFAULT 0 CHECK (max_connections >= 0),
+    DROP CONSTRAINT quota_policies_limit_check,
+    ADD CONSTRAINT quota_policies_limit_check CHECK (
+        (query_limit > 0 AND time_window > interval '0')
+        OR (query_limit = 0 AND time_window = interval '0' AND (rate > 0 OR max_connections > 0)));
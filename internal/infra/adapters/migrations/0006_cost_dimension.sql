@@ -0,0 +1,6 @@
+-- Policies may limit the estimated cost of queries.
+
+ALTER TABLE quota_enforcer.quota_policies
+    DROP CONSTRAINT quota_policies_dimension_check,
+    ADD CONSTRAINT quota_policies_dimension_check
+        CHECK (dimension IN ('queries', 'cost', 'bytes', 'rows', 'seconds'));
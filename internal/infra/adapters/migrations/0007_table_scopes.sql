@@ -0,0 +1,11 @@
+-- Policies may be scoped to the statements reading or writing some tables, and
+-- may deny the queries they apply to instead of limiting them.
+
+ALTER TABLE quota_enforcer.quota_policies
+    ADD COLUMN tables text[] NOT NULL DEFAULT '{}',
+    ADD COLUMN statements text[] NOT NULL DEFAULT '{}' CHECK (statements <@ ARRAY['read', 'write']),
+    ADD COLUMN deny boolean NOT NULL DEFAULT false,
+    DROP CONSTRAINT quota_policies_limit_check,
+    ADD CONSTRAINT quota_policies_limit_check CHECK (
+        (query_limit > 0 AND time_window > interval '0')
+        OR (query_limit = 0 AND time_window = interval '0' AND (rate > 0 OR max_connections > 0 OR deny)));
@@ -0,0 +1,8 @@
+-- Policies may be scoped to single statement types, and deny policies may be
+-- lifted during recurring windows such as "Sat 02:00-04:00".
+
+ALTER TABLE quota_enforcer.quota_policies
+    ADD COLUMN allow_during text[] NOT NULL DEFAULT '{}',
+    DROP CONSTRAINT quota_policies_statements_check,
+    ADD CONSTRAINT quota_policies_statements_check
+        CHECK (statements <@ ARRAY['read', 'write', 'select', 'insert', 'update', 'delete', 'ddl']);
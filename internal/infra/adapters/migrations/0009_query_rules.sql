@@ -0,0 +1,12 @@
+-- Policies may be scoped to queries by fingerprint or pattern, and allow
+-- policies exempt the queries they apply to from every other policy.
+
+ALTER TABLE quota_enforcer.quota_policies
+    ADD COLUMN fingerprints text[] NOT NULL DEFAULT '{}',
+    ADD COLUMN patterns text[] NOT NULL DEFAULT '{}',
+    ADD COLUMN allow boolean NOT NULL DEFAULT false,
+    ADD COLUMN hint text NOT NULL DEFAULT '',
+    DROP CONSTRAINT quota_policies_limit_check,
+    ADD CONSTRAINT quota_policies_limit_check CHECK (
+        (query_limit > 0 AND time_window > interval '0')
+        OR (query_limit = 0 AND time_window = interval '0' AND (rate > 0 OR max_connections > 0 OR deny OR allow)));
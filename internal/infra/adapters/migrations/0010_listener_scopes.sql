@@ -0,0 +1,4 @@
+-- Policies may be scoped to the connections accepted by a named listener.
+
+ALTER TABLE quota_enforcer.quota_policies
+    ADD COLUMN listener text NOT NULL DEFAULT '';
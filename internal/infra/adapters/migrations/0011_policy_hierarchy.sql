@@ -0,0 +1,12 @@
+-- Policies may apply to the members of a role, and overrides replace the limits
+-- of the less specific policies matching along with them.
+
+ALTER TABLE quota_enforcer.quota_policies
+    ADD COLUMN role text NOT NULL DEFAULT '',
+    ADD COLUMN override boolean NOT NULL DEFAULT false;
+
+CREATE TABLE quota_enforcer.role_members (
+    role text NOT NULL,
+    user_name text NOT NULL,
+    PRIMARY KEY (role, user_name)
+);
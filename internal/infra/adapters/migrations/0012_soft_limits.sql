@@ -0,0 +1,7 @@
+-- Policies may warn clients as they near their limit, never deny queries beyond
+-- it, or allow them for a grace period first.
+
+ALTER TABLE quota_enforcer.quota_policies
+    ADD COLUMN warn_at integer NOT NULL DEFAULT 0 CHECK (warn_at BETWEEN 0 AND 100),
+    ADD COLUMN soft boolean NOT NULL DEFAULT false,
+    ADD COLUMN grace interval NOT NULL DEFAULT interval '0';
@@ -0,0 +1,7 @@
+-- Policies may tighten their limits and rate while the upstream pool of their
+-- principals is saturated.
+
+ALTER TABLE quota_enforcer.quota_policies
+    ADD COLUMN tighten_at integer NOT NULL DEFAULT 0 CHECK (tighten_at BETWEEN 0 AND 100),
+    ADD COLUMN tighten_to integer NOT NULL DEFAULT 0 CHECK (tighten_to BETWEEN 0 AND 99),
+    ADD CHECK ((tighten_at = 0) = (tighten_to = 0));
@@ -0,0 +1,5 @@
+-- Policies may cancel the statements they apply to that run longer than a
+-- timeout of their own.
+
+ALTER TABLE quota_enforcer.quota_policies
+    ADD COLUMN statement_timeout interval NOT NULL DEFAULT interval '0' CHECK (statement_timeout >= interval '0');
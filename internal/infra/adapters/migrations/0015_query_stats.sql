@@ -0,0 +1,16 @@
+-- Statistics of the statements proxied, per query fingerprint, that every
+-- enforcer sharing the database adds to: the proxy's own pg_stat_statements.
+-- Durations are in milliseconds; the 95th percentile is that of the latest
+-- calls an enforcer flushed, and the query is the first one saved.
+
+CREATE TABLE quota_enforcer.query_stats (
+    query_hash    text PRIMARY KEY,
+    query         text NOT NULL,
+    calls         bigint NOT NULL DEFAULT 0,
+    total_time_ms double precision NOT NULL DEFAULT 0,
+    p95_time_ms   double precision NOT NULL DEFAULT 0,
+    rows          bigint NOT NULL DEFAULT 0,
+    bytes         bigint NOT NULL DEFAULT 0,
+    last_seen     timestamptz NOT NULL,
+    updated_at    timestamptz NOT NULL DEFAULT now()
+);
@@ -0,0 +1,4 @@
+-- Policies may only apply during recurring windows, such as business hours.
+
+ALTER TABLE quota_enforcer.quota_policies
+    ADD COLUMN active_during text[] NOT NULL DEFAULT '{}';
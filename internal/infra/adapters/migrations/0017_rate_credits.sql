@@ -0,0 +1,6 @@
+-- Rate-limited policies may let principals accrue credits while below their
+-- rate, spent on bursts beyond it.
+
+ALTER TABLE quota_enforcer.quota_policies
+    ADD COLUMN credits bigint NOT NULL DEFAULT 0 CHECK (credits >= 0),
+    ADD COLUMN credit_rate double precision NOT NULL DEFAULT 0 CHECK (credit_rate >= 0);
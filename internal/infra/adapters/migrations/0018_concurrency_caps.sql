@@ -0,0 +1,10 @@
+-- Policies may cap the statements their principals run at once, queueing the
+-- statements beyond the cap for up to a timeout.
+
+ALTER TABLE quota_enforcer.quota_policies
+    ADD COLUMN max_concurrent_queries bigint NOT NULL DEFAULT 0 CHECK (max_concurrent_queries >= 0),
+    ADD COLUMN queue_timeout interval NOT NULL DEFAULT interval '0' CHECK (queue_timeout >= interval '0'),
+    DROP CONSTRAINT quota_policies_limit_check,
+    ADD CONSTRAINT quota_policies_limit_check CHECK (
+        (query_limit > 0 AND time_window > interval '0')
+        OR (query_limit = 0 AND time_window = interval '0' AND (rate > 0 OR max_connections > 0 OR max_concurrent_queries > 0 OR deny OR allow)));
@@ -0,0 +1,11 @@
+-- Policies may cut off the statements they apply to once their results reach
+-- a number of rows or bytes.
+
+ALTER TABLE quota_enforcer.quota_policies
+    ADD COLUMN max_result_rows bigint NOT NULL DEFAULT 0 CHECK (max_result_rows >= 0),
+    ADD COLUMN max_result_bytes bigint NOT NULL DEFAULT 0 CHECK (max_result_bytes >= 0),
+    DROP CONSTRAINT quota_policies_limit_check,
+    ADD CONSTRAINT quota_policies_limit_check CHECK (
+        (query_limit > 0 AND time_window > interval '0')
+        OR (query_limit = 0 AND time_window = interval '0' AND (rate > 0 OR max_connections > 0 OR max_concurrent_queries > 0
+            OR max_result_rows > 0 OR max_result_bytes > 0 OR deny OR allow)));
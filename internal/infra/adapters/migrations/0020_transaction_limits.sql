@@ -0,0 +1,12 @@
+-- Policies may bound how long the transactions of their principals stay open
+-- and how many statements they run.
+
+ALTER TABLE quota_enforcer.quota_policies
+    ADD COLUMN max_transaction_duration interval NOT NULL DEFAULT interval '0' CHECK (max_transaction_duration >= interval '0'),
+    ADD COLUMN max_transaction_statements bigint NOT NULL DEFAULT 0 CHECK (max_transaction_statements >= 0),
+    DROP CONSTRAINT quota_policies_limit_check,
+    ADD CONSTRAINT quota_policies_limit_check CHECK (
+        (query_limit > 0 AND time_window > interval '0')
+        OR (query_limit = 0 AND time_window = interval '0' AND (rate > 0 OR max_connections > 0 OR max_concurrent_queries > 0
+            OR max_result_rows > 0 OR max_result_bytes > 0 OR max_transaction_duration > interval '0' OR max_transaction_statements > 0
+            OR deny OR allow)));
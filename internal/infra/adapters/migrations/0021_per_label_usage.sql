@@ -0,0 +1,10 @@
+-- Policies may count the usage of each value of a connection label apart, so
+-- the counters are keyed by that value too; it is empty for the other policies.
+
+ALTER TABLE quota_enforcer.quota_policies
+    ADD COLUMN per_label text NOT NULL DEFAULT '';
+
+ALTER TABLE quota_enforcer.quota_usage
+    ADD COLUMN label text NOT NULL DEFAULT '',
+    DROP CONSTRAINT quota_usage_pkey,
+    ADD PRIMARY KEY (policy, user_name, database_name, label, window_start);
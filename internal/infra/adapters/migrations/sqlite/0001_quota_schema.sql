@@ -0,0 +1,62 @@
+-- Quota definitions and usage counters of the SQLite usage store, in the shape
+-- of the PostgreSQL usage store's. Policies may be managed with plain SQL; the
+-- enforcer reads them at startup and on every reload. Durations are written as
+-- Go durations such as '1h' or '30s', lists as JSON arrays and labels as a JSON
+-- object.
+
+CREATE TABLE quota_policies (
+    name              text PRIMARY KEY,
+    user_name         text NOT NULL DEFAULT '',
+    role              text NOT NULL DEFAULT '',
+    database_name     text NOT NULL DEFAULT '',
+    labels            text NOT NULL DEFAULT '{}' CHECK (json_type(labels) = 'object'),
+    listener          text NOT NULL DEFAULT '',
+    dimension         text NOT NULL DEFAULT ''
+        CHECK (dimension IN ('', 'queries', 'cost', 'bytes', 'rows', 'seconds')),
+    query_limit       integer NOT NULL DEFAULT 0 CHECK (query_limit >= 0),
+    time_window       text NOT NULL DEFAULT '0s',
+    rate              real NOT NULL DEFAULT 0 CHECK (rate >= 0),
+    burst             integer NOT NULL DEFAULT 0 CHECK (burst >= 0),
+    rate_per          text NOT NULL DEFAULT '' CHECK (rate_per IN ('', 'user', 'connection')),
+    max_connections   integer NOT NULL DEFAULT 0 CHECK (max_connections >= 0),
+    statement_timeout text NOT NULL DEFAULT '0s',
+    tables            text NOT NULL DEFAULT '[]' CHECK (json_type(tables) = 'array'),
+    statements        text NOT NULL DEFAULT '[]' CHECK (json_type(statements) = 'array'),
+    deny              integer NOT NULL DEFAULT 0 CHECK (deny IN (0, 1)),
+    allow_during      text NOT NULL DEFAULT '[]' CHECK (json_type(allow_during) = 'array'),
+    fingerprints      text NOT NULL DEFAULT '[]' CHECK (json_type(fingerprints) = 'array'),
+    patterns          text NOT NULL DEFAULT '[]' CHECK (json_type(patterns) = 'array'),
+    allow             integer NOT NULL DEFAULT 0 CHECK (allow IN (0, 1)),
+    hint              text NOT NULL DEFAULT '',
+    override          integer NOT NULL DEFAULT 0 CHECK (override IN (0, 1)),
+    warn_at           integer NOT NULL DEFAULT 0 CHECK (warn_at BETWEEN 0 AND 100),
+    soft              integer NOT NULL DEFAULT 0 CHECK (soft IN (0, 1)),
+    grace             text NOT NULL DEFAULT '0s',
+    tighten_at        integer NOT NULL DEFAULT 0 CHECK (tighten_at BETWEEN 0 AND 100),
+    tighten_to        integer NOT NULL DEFAULT 0 CHECK (tighten_to BETWEEN 0 AND 99),
+    updated_at        text NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK ((tighten_at = 0) = (tighten_to = 0))
+);
+
+CREATE TABLE role_members (
+    role      text NOT NULL,
+    user_name text NOT NULL,
+    PRIMARY KEY (role, user_name)
+);
+
+-- One row per policy, principal and window, with the bounds of the window in
+-- UTC as 'YYYY-MM-DD HH:MM:SS.SSSSSS', which SQLite's date functions accept.
+-- Rows of elapsed windows are kept for reporting and may be deleted once
+-- window_end has passed.
+CREATE TABLE quota_usage (
+    policy        text NOT NULL,
+    user_name     text NOT NULL,
+    database_name text NOT NULL,
+    window_start  text NOT NULL,
+    window_end    text NOT NULL,
+    used          integer NOT NULL DEFAULT 0,
+    updated_at    text NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (policy, user_name, database_name, window_start)
+);
+
+CREATE INDEX quota_usage_window_end_idx ON quota_usage (window_end);
@@ -0,0 +1,16 @@
+-- Statistics of the statements proxied, per query fingerprint, in the shape of
+-- the PostgreSQL usage store's. Durations are in milliseconds; the 95th
+-- percentile is that of the latest calls flushed, and the query is the first
+-- one saved. last_seen is in UTC as 'YYYY-MM-DD HH:MM:SS.SSSSSS'.
+
+CREATE TABLE query_stats (
+    query_hash    text PRIMARY KEY,
+    query         text NOT NULL,
+    calls         integer NOT NULL DEFAULT 0,
+    total_time_ms real NOT NULL DEFAULT 0,
+    p95_time_ms   real NOT NULL DEFAULT 0,
+    rows          integer NOT NULL DEFAULT 0,
+    bytes         integer NOT NULL DEFAULT 0,
+    last_seen     text NOT NULL,
+    updated_at    text NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
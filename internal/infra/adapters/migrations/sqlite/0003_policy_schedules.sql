@@ -0,0 +1,4 @@
+-- Policies may only apply during recurring windows, such as business hours.
+
+ALTER TABLE quota_policies
+    ADD COLUMN active_during text NOT NULL DEFAULT '[]' CHECK (json_type(active_during) = 'array');
@@ -0,0 +1,5 @@
+-- Rate-limited policies may let principals accrue credits while below their
+-- rate, spent on bursts beyond it.
+
+ALTER TABLE quota_policies ADD COLUMN credits integer NOT NULL DEFAULT 0 CHECK (credits >= 0);
+ALTER TABLE quota_policies ADD COLUMN credit_rate real NOT NULL DEFAULT 0 CHECK (credit_rate >= 0);
@@ -0,0 +1,5 @@
+-- Policies may cap the statements their principals run at once, queueing the
+-- statements beyond the cap for up to a timeout.
+
+ALTER TABLE quota_policies ADD COLUMN max_concurrent_queries integer NOT NULL DEFAULT 0 CHECK (max_concurrent_queries >= 0);
+ALTER TABLE quota_policies ADD COLUMN queue_timeout text NOT NULL DEFAULT '0s';
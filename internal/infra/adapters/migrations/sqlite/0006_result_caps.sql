@@ -0,0 +1,5 @@
+-- Policies may cut off the statements they apply to once their results reach
+-- a number of rows or bytes.
+
+ALTER TABLE quota_policies ADD COLUMN max_result_rows integer NOT NULL DEFAULT 0 CHECK (max_result_rows >= 0);
+ALTER TABLE quota_policies ADD COLUMN max_result_bytes integer NOT NULL DEFAULT 0 CHECK (max_result_bytes >= 0);
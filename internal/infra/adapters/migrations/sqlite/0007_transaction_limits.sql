@@ -0,0 +1,5 @@
+-- Policies may bound how long the transactions of their principals stay open
+-- and how many statements they run.
+
+ALTER TABLE quota_policies ADD COLUMN max_transaction_duration text NOT NULL DEFAULT '0s';
+ALTER TABLE quota_policies ADD COLUMN max_transaction_statements integer NOT NULL DEFAULT 0 CHECK (max_transaction_statements >= 0);
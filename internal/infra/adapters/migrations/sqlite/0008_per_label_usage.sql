@@ -0,0 +1,25 @@
+-- Policies may count the usage of each value of a connection label apart, so
+-- the counters are keyed by that value too; it is empty for the other policies.
+-- SQLite cannot change a primary key, so quota_usage is copied to a new table.
+
+ALTER TABLE quota_policies ADD COLUMN per_label text NOT NULL DEFAULT '';
+
+CREATE TABLE quota_usage_by_label (
+    policy        text NOT NULL,
+    user_name     text NOT NULL,
+    database_name text NOT NULL,
+    label         text NOT NULL DEFAULT '',
+    window_start  text NOT NULL,
+    window_end    text NOT NULL,
+    used          integer NOT NULL DEFAULT 0,
+    updated_at    text NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (policy, user_name, database_name, label, window_start)
+);
+
+INSERT INTO quota_usage_by_label (policy, user_name, database_name, window_start, window_end, used, updated_at)
+SELECT policy, user_name, database_name, window_start, window_end, used, updated_at FROM quota_usage;
+
+DROP TABLE quota_usage;
+ALTER TABLE quota_usage_by_label RENAME TO quota_usage;
+
+CREATE INDEX quota_usage_window_end_idx ON quota_usage (window_end);
@@ -0,0 +1,226 @@
+package adapters
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Parquet physical and converted types of the columns written by writeParquet
+const (
+	parquetInt64     int32 = 2
+	parquetDouble    int32 = 5
+	parquetByteArray int32 = 6
+
+	parquetNoConversion    int32 = -1
+	parquetUTF8            int32 = 0
+	parquetTimestampMillis int32 = 9
+)
+
+// Parquet encodings and page type of the pages written by writeParquet
+const (
+	parquetPlain    int32 = 0
+	parquetRLE      int32 = 3
+	parquetDataPage int32 = 0
+)
+
+// parquetMagic starts and ends every Parquet file
+const parquetMagic = "PAR1"
+
+// parquetColumn is a required, flat column of a Parquet file and its values,
+// PLAIN encoded. Required flat columns need no definition nor repetition levels.
+type parquetColumn struct {
+	name      string
+	kind      int32
+	converted int32
+	count     int
+	values    []byte
+}
+
+func (c *parquetColumn) int64(v int64) {
+	c.values = binary.LittleEndian.AppendUint64(c.values, uint64(v))
+	c.count++
+}
+
+func (c *parquetColumn) double(v float64) {
+	c.values = binary.LittleEndian.AppendUint64(c.values, math.Float64bits(v))
+	c.count++
+}
+
+func (c *parquetColumn) byteArray(s string) {
+	c.values = binary.LittleEndian.AppendUint32(c.values, uint32(len(s)))
+	c.values = append(c.values, s...)
+	c.count++
+}
+
+// writeParquet writes rows, the values of columns, as a Parquet file of a single
+// uncompressed row group with a data page per column
+func writeParquet(w io.Writer, rows int, columns []*parquetColumn) error {
+	file := []byte(parquetMagic)
+	offsets := make([]int64, len(columns))
+	sizes := make([]int64, len(columns))
+	for i, column := range columns {
+		var header thriftEncoder
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(len(column.values)))
+		header.i32(3, int32(len(column.values)))
+		header.structBegin(5)
+		header.i32(1, int32(column.count))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.structEnd()
+		header.stop()
+
+		offsets[i] = int64(len(file))
+		file = append(file, header.buf...)
+		file = append(file, column.values...)
+		sizes[i] = int64(len(file)) - offsets[i]
+	}
+
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+
+	var footer thriftEncoder
+	footer.i32(1, 1)
+	footer.listBegin(2, thriftStruct, len(columns)+1)
+	footer.elementBegin()
+	footer.binary(4, "schema")
+	footer.i32(5, int32(len(columns)))
+	footer.structEnd()
+	for _, column := range columns {
+		footer.elementBegin()
+		footer.i32(1, column.kind)
+		footer.i32(3, 0) // REQUIRED
+		footer.binary(4, column.name)
+		if column.converted != parquetNoConversion {
+			footer.i32(6, column.converted)
+		}
+		footer.structEnd()
+	}
+	footer.i64(3, int64(rows))
+	footer.listBegin(4, thriftStruct, 1)
+	footer.elementBegin()
+	footer.listBegin(1, thriftStruct, len(columns))
+	for i, column := range columns {
+		footer.elementBegin()
+		footer.i64(2, offsets[i])
+		footer.structBegin(3)
+		footer.i32(1, column.kind)
+		footer.listBegin(2, thriftI32, 2)
+		footer.varint(int64(parquetPlain))
+		footer.varint(int64(parquetRLE))
+		footer.listBegin(3, thriftBinary, 1)
+		footer.raw(column.name)
+		footer.i32(4, 0) // UNCOMPRESSED
+		footer.i64(5, int64(column.count))
+		footer.i64(6, sizes[i])
+		footer.i64(7, sizes[i])
+		footer.i64(9, offsets[i])
+		footer.structEnd()
+		footer.structEnd()
+	}
+	footer.i64(2, total)
+	footer.i64(3, int64(rows))
+	footer.structEnd()
+	footer.binary(6, "pgbouncer-quota-enforcer")
+	footer.stop()
+
+	file = append(file, footer.buf...)
+	file = binary.LittleEndian.AppendUint32(file, uint32(len(footer.buf)))
+	file = append(file, parquetMagic...)
+	_, err := w.Write(file)
+	return err
+}
+
+// Thrift compact protocol types used by Parquet metadata
+const (
+	thriftI32    byte = 5
+	thriftI64    byte = 6
+	thriftBinary byte = 8
+	thriftList   byte = 9
+	thriftStruct byte = 12
+)
+
+// thriftEncoder appends Thrift compact protocol structs to a buffer, as Parquet
+// encodes its page headers and file metadata. The encoder starts within the
+// top-level struct; lists must be filled right after listBegin.
+type thriftEncoder struct {
+	buf    []byte
+	fields []int16 // last field id of each enclosing struct
+	last   int16   // last field id of the current struct
+}
+
+// field writes the header of field id of type kind
+func (e *thriftEncoder) field(id int16, kind byte) {
+	if delta := id - e.last; delta > 0 && delta <= 15 {
+		e.buf = append(e.buf, byte(delta)<<4|kind)
+	} else {
+		e.buf = append(e.buf, kind)
+		e.varint(int64(id))
+	}
+	e.last = id
+}
+
+// varint writes v zigzag encoded, as i16, i32 and i64 values are
+func (e *thriftEncoder) varint(v int64) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(v<<1)^uint64(v>>63))
+}
+
+// raw writes a binary value without a field header, as list elements are
+func (e *thriftEncoder) raw(s string) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *thriftEncoder) i32(id int16, v int32) {
+	e.field(id, thriftI32)
+	e.varint(int64(v))
+}
+
+func (e *thriftEncoder) i64(id int16, v int64) {
+	e.field(id, thriftI64)
+	e.varint(v)
+}
+
+func (e *thriftEncoder) binary(id int16, s string) {
+	e.field(id, thriftBinary)
+	e.raw(s)
+}
+
+// listBegin writes the header of list field id of size elements of type kind
+func (e *thriftEncoder) listBegin(id int16, kind byte, size int) {
+	e.field(id, thriftList)
+	if size < 15 {
+		e.buf = append(e.buf, byte(size)<<4|kind)
+		return
+	}
+	e.buf = append(e.buf, 0xF0|kind)
+	e.buf = binary.AppendUvarint(e.buf, uint64(size))
+}
+
+// structBegin starts struct field id, ended by structEnd
+func (e *thriftEncoder) structBegin(id int16) {
+	e.field(id, thriftStruct)
+	e.elementBegin()
+}
+
+// elementBegin starts a struct element of a list, ended by structEnd
+func (e *thriftEncoder) elementBegin() {
+	e.fields = append(e.fields, e.last)
+	e.last = 0
+}
+
+// structEnd ends the current struct
+func (e *thriftEncoder) structEnd() {
+	e.stop()
+	e.last = e.fields[len(e.fields)-1]
+	e.fields = e.fields[:len(e.fields)-1]
+}
+
+// stop ends the fields of the current struct
+func (e *thriftEncoder) stop() {
+	e.buf = append(e.buf, 0)
+}
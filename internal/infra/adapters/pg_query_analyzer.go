@@ -0,0 +1,339 @@
+package adapters
+
+import (
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sort"
+	"strings"
+
+	pg_query "github.com/pganalyze/pg_query_go/v6"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Weights of the cost heuristic. A statement costs 1, plus the weight of every
+// construct below it that tends to make PostgreSQL do more work.
+const (
+	costJoin       = 2 // per explicit join or additional FROM item
+	costSubquery   = 2 // per subquery or subselect in FROM
+	costAggregate  = 1 // per GROUP BY or DISTINCT
+	costSort       = 1 // per ORDER BY
+	costUnfiltered = 5 // per SELECT, UPDATE or DELETE reading relations without WHERE or LIMIT
+	costDDL        = 3 // per schema change, which takes heavy locks
+)
+
+// PgQueryAnalyzer implements domain.QueryAnalyzer using the pg_query parse tree
+type PgQueryAnalyzer struct{}
+
+// NewPgQueryAnalyzer creates a new PgQueryAnalyzer
+func NewPgQueryAnalyzer() domain.QueryAnalyzer {
+	return &PgQueryAnalyzer{}
+}
+
+// AnalyzeQuery parses the raw query and extracts its type, referenced tables,
+// join count and a heuristic cost; see the cost weights above. Each operation is
+// a table with the type of access to it: the statement's type for the tables it
+// writes or changes, and SELECT for the tables it reads.
+func (a *PgQueryAnalyzer) AnalyzeQuery(query *domain.Query) (*domain.QueryAnalysis, error) {
+	if query == nil || strings.TrimSpace(query.Raw) == "" {
+		return nil, fmt.Errorf("empty query cannot be analyzed")
+	}
+
+	tree, err := pgQueryParse(query.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query: %w", err)
+	}
+
+	analysis := &domain.QueryAnalysis{
+		Query:         query,
+		QueryType:     domain.QueryTypeOther,
+		EstimatedCost: 1,
+	}
+
+	if len(tree.Stmts) == 0 {
+		return analysis, nil
+	}
+
+	analysis.QueryType = statementType(tree.Stmts[0].Stmt)
+
+	collector := &tableCollector{
+		accesses: make(map[tableAccess]struct{}),
+		ctes:     make(map[string]struct{}),
+		targets:  make(map[*pg_query.RangeVar]domain.QueryType),
+	}
+	var ddl int
+	for _, stmt := range tree.Stmts {
+		collector.reads = sourceType(stmt.Stmt)
+		collector.walk(stmt.ProtoReflect())
+		switch statementType(stmt.Stmt) {
+		case domain.QueryTypeCreate, domain.QueryTypeDrop, domain.QueryTypeAlter:
+			ddl++
+		}
+	}
+
+	analysis.Tables = collector.result()
+	analysis.Joins = collector.joins
+	analysis.EstimatedCost = int64(len(tree.Stmts) +
+		costJoin*collector.joins +
+		costSubquery*collector.subqueries +
+		costAggregate*collector.aggregates +
+		costSort*collector.sorts +
+		costUnfiltered*collector.unfiltered +
+		costDDL*ddl)
+	for _, access := range collector.operations() {
+		analysis.Operations = append(analysis.Operations, domain.QueryOperation{
+			Type:       string(access.queryType),
+			Table:      access.table,
+			Complexity: int(analysis.EstimatedCost),
+		})
+	}
+
+	return analysis, nil
+}
+
+// statementType maps a top-level parse node to a domain.QueryType
+func statementType(node *pg_query.Node) domain.QueryType {
+	if node == nil {
+		return domain.QueryTypeOther
+	}
+
+	switch n := node.Node.(type) {
+	case *pg_query.Node_SelectStmt:
+		if n.SelectStmt.IntoClause != nil {
+			return domain.QueryTypeCreate
+		}
+		return domain.QueryTypeSelect
+	case *pg_query.Node_InsertStmt:
+		return domain.QueryTypeInsert
+	case *pg_query.Node_UpdateStmt:
+		return domain.QueryTypeUpdate
+	case *pg_query.Node_DeleteStmt, *pg_query.Node_TruncateStmt:
+		return domain.QueryTypeDelete
+	case *pg_query.Node_MergeStmt:
+		return domain.QueryTypeUpdate
+	case *pg_query.Node_CopyStmt:
+		if n.CopyStmt.IsFrom {
+			return domain.QueryTypeInsert
+		}
+		return domain.QueryTypeSelect
+	case *pg_query.Node_ExplainStmt:
+		return statementType(n.ExplainStmt.Query)
+	case *pg_query.Node_CreateStmt, *pg_query.Node_CreateTableAsStmt, *pg_query.Node_IndexStmt,
+		*pg_query.Node_ViewStmt, *pg_query.Node_CreateSchemaStmt, *pg_query.Node_CreateSeqStmt,
+		*pg_query.Node_CreateFunctionStmt, *pg_query.Node_CreateExtensionStmt, *pg_query.Node_CreateTrigStmt,
+		*pg_query.Node_CreateRoleStmt, *pg_query.Node_CompositeTypeStmt, *pg_query.Node_CreateEnumStmt,
+		*pg_query.Node_CreatedbStmt:
+		return domain.QueryTypeCreate
+	case *pg_query.Node_DropStmt, *pg_query.Node_DropdbStmt, *pg_query.Node_DropRoleStmt:
+		return domain.QueryTypeDrop
+	case *pg_query.Node_AlterTableStmt, *pg_query.Node_RenameStmt, *pg_query.Node_AlterSeqStmt,
+		*pg_query.Node_AlterRoleStmt, *pg_query.Node_AlterDatabaseStmt, *pg_query.Node_AlterEnumStmt,
+		*pg_query.Node_AlterObjectSchemaStmt, *pg_query.Node_AlterOwnerStmt:
+		return domain.QueryTypeAlter
+	default:
+		return domain.QueryTypeOther
+	}
+}
+
+// sourceType returns the access type of the tables a top-level statement names
+// without writing them: SELECT for queries and DML, whose targets are recorded
+// as they are reached, and the statement's own type for other statements, which
+// act on the tables they name
+func sourceType(node *pg_query.Node) domain.QueryType {
+	if node != nil {
+		switch node.Node.(type) {
+		case *pg_query.Node_CreateTableAsStmt, *pg_query.Node_ViewStmt:
+			return domain.QueryTypeSelect
+		}
+	}
+
+	switch queryType := statementType(node); queryType {
+	case domain.QueryTypeInsert, domain.QueryTypeUpdate, domain.QueryTypeDelete:
+		return domain.QueryTypeSelect
+	case domain.QueryTypeCreate:
+		if _, ok := node.Node.(*pg_query.Node_SelectStmt); ok {
+			return domain.QueryTypeSelect // SELECT INTO
+		}
+		return queryType
+	default:
+		return queryType
+	}
+}
+
+// tableAccess is a relation and the type of access a statement makes to it
+type tableAccess struct {
+	table     string
+	queryType domain.QueryType
+}
+
+// tableCollector walks a parse tree and records referenced relations, along
+// with the constructs the cost heuristic counts
+type tableCollector struct {
+	accesses map[tableAccess]struct{}
+	ctes     map[string]struct{}
+	targets  map[*pg_query.RangeVar]domain.QueryType // relations written by a statement
+	reads    domain.QueryType                        // access type of the other relations of the current statement
+
+	joins      int
+	subqueries int
+	aggregates int
+	sorts      int
+	unfiltered int
+}
+
+// walk visits every message reachable from msg
+func (c *tableCollector) walk(msg protoreflect.Message) {
+	switch node := msg.Interface().(type) {
+	case *pg_query.RangeVar:
+		c.addRangeVar(node)
+	case *pg_query.CommonTableExpr:
+		c.ctes[node.Ctename] = struct{}{}
+	case *pg_query.JoinExpr:
+		c.joins++
+	case *pg_query.SubLink, *pg_query.RangeSubselect:
+		c.subqueries++
+	case *pg_query.SelectStmt:
+		c.countSelect(node)
+	case *pg_query.InsertStmt:
+		c.target(node.Relation, domain.QueryTypeInsert)
+	case *pg_query.UpdateStmt:
+		c.target(node.Relation, domain.QueryTypeUpdate)
+		c.joins += len(node.FromClause)
+		if node.WhereClause == nil {
+			c.unfiltered++
+		}
+	case *pg_query.DeleteStmt:
+		c.target(node.Relation, domain.QueryTypeDelete)
+		c.joins += len(node.UsingClause)
+		if node.WhereClause == nil {
+			c.unfiltered++
+		}
+	case *pg_query.MergeStmt:
+		c.target(node.Relation, domain.QueryTypeUpdate)
+	case *pg_query.TruncateStmt:
+		for _, relation := range node.Relations {
+			c.target(relation.GetRangeVar(), domain.QueryTypeDelete)
+		}
+	case *pg_query.CopyStmt:
+		if node.IsFrom {
+			c.target(node.Relation, domain.QueryTypeInsert)
+		}
+	case *pg_query.IntoClause:
+		c.target(node.Rel, domain.QueryTypeCreate)
+	case *pg_query.ViewStmt:
+		c.target(node.View, domain.QueryTypeCreate)
+	case *pg_query.DropStmt:
+		c.addDropped(node)
+	}
+
+	msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				c.walk(list.Get(i).Message())
+			}
+		case fd.Message() != nil && !fd.IsMap():
+			c.walk(v.Message())
+		}
+		return true
+	})
+}
+
+// countSelect counts the implicit joins, grouping, sorting and unbounded reads of
+// a SELECT; explicit joins and subqueries are counted as the walk reaches them
+func (c *tableCollector) countSelect(stmt *pg_query.SelectStmt) {
+	if len(stmt.FromClause) > 1 {
+		c.joins += len(stmt.FromClause) - 1
+	}
+	if len(stmt.GroupClause) > 0 {
+		c.aggregates++
+	}
+	if len(stmt.DistinctClause) > 0 {
+		c.aggregates++
+	}
+	if len(stmt.SortClause) > 0 {
+		c.sorts++
+	}
+	if len(stmt.FromClause) > 0 && stmt.WhereClause == nil && stmt.LimitCount == nil {
+		c.unfiltered++
+	}
+}
+
+// target records that the current statement writes the relation, before the
+// walk reaches it
+func (c *tableCollector) target(rv *pg_query.RangeVar, queryType domain.QueryType) {
+	if rv != nil {
+		c.targets[rv] = queryType
+	}
+}
+
+// addRangeVar records a relation using its schema-qualified name when present
+func (c *tableCollector) addRangeVar(rv *pg_query.RangeVar) {
+	if rv.Relname == "" {
+		return
+	}
+
+	name := rv.Relname
+	if rv.Schemaname != "" {
+		name = rv.Schemaname + "." + rv.Relname
+	}
+	queryType, written := c.targets[rv]
+	if !written {
+		queryType = c.reads
+	}
+	c.accesses[tableAccess{table: name, queryType: queryType}] = struct{}{}
+}
+
+// addDropped records the relations a DROP names, which are lists of names
+// rather than RangeVars
+func (c *tableCollector) addDropped(stmt *pg_query.DropStmt) {
+	switch stmt.RemoveType {
+	case pg_query.ObjectType_OBJECT_TABLE, pg_query.ObjectType_OBJECT_VIEW,
+		pg_query.ObjectType_OBJECT_MATVIEW, pg_query.ObjectType_OBJECT_FOREIGN_TABLE:
+	default:
+		return
+	}
+
+	for _, object := range stmt.Objects {
+		var names []string
+		for _, item := range object.GetList().GetItems() {
+			names = append(names, item.GetString_().GetSval())
+		}
+		if len(names) > 2 {
+			names = names[len(names)-2:] // without the database
+		}
+		if len(names) > 0 {
+			c.accesses[tableAccess{table: strings.Join(names, "."), queryType: domain.QueryTypeDrop}] = struct{}{}
+		}
+	}
+}
+
+// operations returns the accesses sorted by relation name and type, excluding
+// references to CTEs
+func (c *tableCollector) operations() []tableAccess {
+	var accesses []tableAccess
+	for access := range c.accesses {
+		if _, isCTE := c.ctes[access.table]; isCTE {
+			continue
+		}
+		accesses = append(accesses, access)
+	}
+	sort.Slice(accesses, func(i, j int) bool {
+		if accesses[i].table != accesses[j].table {
+			return accesses[i].table < accesses[j].table
+		}
+		return accesses[i].queryType < accesses[j].queryType
+	})
+	return accesses
+}
+
+// result returns the sorted relation names, excluding references to CTEs
+func (c *tableCollector) result() []string {
+	var tables []string
+	for _, access := range c.operations() {
+		if len(tables) == 0 || tables[len(tables)-1] != access.table {
+			tables = append(tables, access.table)
+		}
+	}
+	return tables
+}
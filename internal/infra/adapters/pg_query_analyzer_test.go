@@ -0,0 +1,171 @@
+package adapters
+
+import (
+	"testing"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPgQueryAnalyzer_AnalyzeQuery(t *testing.T) {
+	analyzer := NewPgQueryAnalyzer()
+
+	tests := []struct {
+		name           string
+		input          string
+		expectedType   domain.QueryType
+		expectedTables []string
+		expectedJoins  int
+		expectedCost   int64
+		expectError    bool
+	}{
+		{
+			name:           "Select with join",
+			input:          "SELECT * FROM users u JOIN orders o ON o.user_id = u.id",
+			expectedType:   domain.QueryTypeSelect,
+			expectedTables: []string{"orders", "users"},
+			expectedJoins:  1,
+			expectedCost:   8,
+		},
+		{
+			name:           "Schema qualified insert",
+			input:          "INSERT INTO analytics.events (name) VALUES ('x')",
+			expectedType:   domain.QueryTypeInsert,
+			expectedTables: []string{"analytics.events"},
+			expectedCost:   1,
+		},
+		{
+			name:           "CTE names are not tables",
+			input:          "WITH recent AS (SELECT * FROM orders) SELECT * FROM recent",
+			expectedType:   domain.QueryTypeSelect,
+			expectedTables: []string{"orders"},
+			expectedCost:   11,
+		},
+		{
+			name:           "Explain reports the explained statement",
+			input:          "EXPLAIN DELETE FROM sessions",
+			expectedType:   domain.QueryTypeDelete,
+			expectedTables: []string{"sessions"},
+			expectedCost:   6,
+		},
+		{
+			name:           "DDL",
+			input:          "ALTER TABLE users ADD COLUMN age int",
+			expectedType:   domain.QueryTypeAlter,
+			expectedTables: []string{"users"},
+			expectedCost:   4,
+		},
+		{
+			name:           "Implicit join with grouping",
+			input:          "SELECT u.id, count(*) FROM users u, orders o WHERE o.user_id = u.id GROUP BY u.id",
+			expectedType:   domain.QueryTypeSelect,
+			expectedTables: []string{"orders", "users"},
+			expectedJoins:  1,
+			expectedCost:   4,
+		},
+		{
+			name:           "Sorted select with subquery",
+			input:          "SELECT id FROM users WHERE id IN (SELECT user_id FROM orders WHERE total > 10) ORDER BY id",
+			expectedType:   domain.QueryTypeSelect,
+			expectedTables: []string{"orders", "users"},
+			expectedCost:   4,
+		},
+		{
+			name:         "Utility statement",
+			input:        "SET search_path TO public",
+			expectedType: domain.QueryTypeOther,
+			expectedCost: 1,
+		},
+		{
+			name:        "Invalid SQL",
+			input:       "SELECT * FROM WHERE",
+			expectError: true,
+		},
+		{
+			name:        "Empty query",
+			input:       "  ",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analysis, err := analyzer.AnalyzeQuery(domain.NewQuery(tt.input, "conn_1"))
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedType, analysis.QueryType)
+			assert.Equal(t, tt.expectedTables, analysis.Tables)
+			assert.Equal(t, tt.expectedJoins, analysis.Joins)
+			assert.Equal(t, tt.expectedCost, analysis.EstimatedCost)
+			assert.Len(t, analysis.Operations, len(tt.expectedTables))
+		})
+	}
+}
+
+func TestPgQueryAnalyzer_Operations(t *testing.T) {
+	analyzer := NewPgQueryAnalyzer()
+
+	tests := []struct {
+		input    string
+		expected []domain.QueryOperation
+	}{
+		{
+			input: "INSERT INTO audit.log SELECT * FROM events WHERE id = 1",
+			expected: []domain.QueryOperation{
+				{Type: "INSERT", Table: "audit.log"},
+				{Type: "SELECT", Table: "events"},
+			},
+		},
+		{
+			input: "WITH gone AS (DELETE FROM audit.log WHERE id = 1 RETURNING *) SELECT * FROM gone LIMIT 1",
+			expected: []domain.QueryOperation{
+				{Type: "DELETE", Table: "audit.log"},
+			},
+		},
+		{
+			input: "CREATE TABLE archive AS SELECT * FROM orders WHERE total > 10",
+			expected: []domain.QueryOperation{
+				{Type: "CREATE", Table: "archive"},
+				{Type: "SELECT", Table: "orders"},
+			},
+		},
+		{
+			input: "TRUNCATE audit.log, sessions",
+			expected: []domain.QueryOperation{
+				{Type: "DELETE", Table: "audit.log"},
+				{Type: "DELETE", Table: "sessions"},
+			},
+		},
+		{
+			input: "COPY analytics.events FROM STDIN",
+			expected: []domain.QueryOperation{
+				{Type: "INSERT", Table: "analytics.events"},
+			},
+		},
+		{
+			input: "SELECT 1; DROP TABLE audit.log",
+			expected: []domain.QueryOperation{
+				{Type: "DROP", Table: "audit.log"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			analysis, err := analyzer.AnalyzeQuery(domain.NewQuery(tt.input, "conn_1"))
+			require.NoError(t, err)
+
+			var operations []domain.QueryOperation
+			for _, operation := range analysis.Operations {
+				operations = append(operations, domain.QueryOperation{Type: operation.Type, Table: operation.Table})
+			}
+			assert.Equal(t, tt.expected, operations)
+		})
+	}
+}
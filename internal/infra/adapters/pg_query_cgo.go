@@ -0,0 +1,39 @@
+//go:build cgo
+
+package adapters
+
+import (
+	pg_query "github.com/pganalyze/pg_query_go/v6"
+)
+
+// PgQueryAvailable reports whether queries can be parsed with pg_query, which
+// is linked into binaries built with cgo
+const PgQueryAvailable = true
+
+// DefaultNormalizer is the normalizer of servers configured with none
+const DefaultNormalizer = NormalizerPgQuery
+
+// pgQueryParse returns the parse tree of query
+func pgQueryParse(query string) (*pg_query.ParseResult, error) {
+	return pg_query.Parse(query)
+}
+
+// pgQueryDeparse returns the text of a parse tree
+func pgQueryDeparse(tree *pg_query.ParseResult) (string, error) {
+	return pg_query.Deparse(tree)
+}
+
+// pgQueryNormalize replaces the constants of query with parameters
+func pgQueryNormalize(query string) (string, error) {
+	return pg_query.Normalize(query)
+}
+
+// pgQueryFingerprint returns the fingerprint of query
+func pgQueryFingerprint(query string) (string, error) {
+	return pg_query.Fingerprint(query)
+}
+
+// pgQuerySplit splits query into the texts of its statements
+func pgQuerySplit(query string) ([]string, error) {
+	return pg_query.SplitWithParser(query, true)
+}
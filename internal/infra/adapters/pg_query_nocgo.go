@@ -0,0 +1,40 @@
+//go:build !cgo
+
+package adapters
+
+import (
+	"errors"
+
+	pg_query "github.com/pganalyze/pg_query_go/v6"
+)
+
+// PgQueryAvailable reports whether queries can be parsed with pg_query, which
+// is linked into binaries built with cgo
+const PgQueryAvailable = false
+
+// DefaultNormalizer is the normalizer of servers configured with none; without
+// pg_query, queries are normalized in pure Go
+const DefaultNormalizer = NormalizerFastRegex
+
+// errPgQueryUnavailable is returned for every query to parse without pg_query
+var errPgQueryUnavailable = errors.New("pg_query is not available in binaries built without cgo")
+
+func pgQueryParse(query string) (*pg_query.ParseResult, error) {
+	return nil, errPgQueryUnavailable
+}
+
+func pgQueryDeparse(tree *pg_query.ParseResult) (string, error) {
+	return "", errPgQueryUnavailable
+}
+
+func pgQueryNormalize(query string) (string, error) {
+	return "", errPgQueryUnavailable
+}
+
+func pgQueryFingerprint(query string) (string, error) {
+	return "", errPgQueryUnavailable
+}
+
+func pgQuerySplit(query string) ([]string, error) {
+	return nil, errPgQueryUnavailable
+}
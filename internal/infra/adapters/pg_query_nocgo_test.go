@@ -0,0 +1,30 @@
+//go:build !cgo
+
+package adapters
+
+import (
+	"testing"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPgQueryUnavailable(t *testing.T) {
+	normalizer, err := ParseNormalizer("")
+	require.NoError(t, err)
+	assert.Equal(t, NormalizerFastRegex, normalizer, "Queries should be normalized in pure Go by default")
+	_, err = ParseNormalizer(string(NormalizerPgQuery))
+	assert.ErrorContains(t, err, "cgo")
+
+	_, err = NewQueryRewriter(WithRowLimit(100))
+	assert.ErrorContains(t, err, "cgo")
+	_, err = NewQueryRewriter(WithTraceComments())
+	assert.NoError(t, err, "Trace comments need no parsing")
+
+	_, err = NewPgQueryAnalyzer().AnalyzeQuery(domain.NewQuery("SELECT 1", ""))
+	assert.ErrorIs(t, err, errPgQueryUnavailable)
+	assert.Nil(t, splitStatements("SELECT 1; SELECT 2"), "Queries should be evaluated whole")
+	assert.False(t, retryableQuery("SELECT 1"), "Queries that cannot be parsed should never be sent again")
+}
@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"pgbouncer-quota-enforcer/internal/app/domain"
 	"strings"
-
-	pg_query "github.com/pganalyze/pg_query_go/v6"
 )
 
 // PgQueryNormalizer implements domain.QueryNormalizer using pg_query library
@@ -28,13 +26,13 @@ func (n *PgQueryNormalizer) Normalize(rawQuery string) (domain.NormalizedQuery,
 	}
 
 	// Use pg_query to normalize the query
-	normalized, err := pg_query.Normalize(rawQuery)
+	normalized, err := pgQueryNormalize(rawQuery)
 	if err != nil {
 		return domain.NormalizedQuery{}, fmt.Errorf("failed to normalize query: %w", err)
 	}
 
 	// Use pg_query to generate a fingerprint (hash)
-	fingerprint, err := pg_query.Fingerprint(rawQuery)
+	fingerprint, err := pgQueryFingerprint(rawQuery)
 	if err != nil {
 		return domain.NormalizedQuery{}, fmt.Errorf("failed to generate fingerprint: %w", err)
 	}
@@ -0,0 +1,245 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// pgbouncerConsoleDatabase is the name of PgBouncer's admin console, which has
+// a pool of its own
+const pgbouncerConsoleDatabase = "pgbouncer"
+
+// consoleRow is a row of a SHOW command, in text by column name. Columns
+// differ between PgBouncer versions, so missing ones read as zero.
+type consoleRow map[string]string
+
+// int returns the integer of column, zero when missing or not an integer
+func (r consoleRow) int(column string) int64 {
+	value, _ := strconv.ParseInt(r[column], 10, 64)
+	return value
+}
+
+// float returns the number of column, zero when missing or not a number
+func (r consoleRow) float(column string) float64 {
+	value, _ := strconv.ParseFloat(r[column], 64)
+	return value
+}
+
+// micros returns the microseconds of column as a duration
+func (r consoleRow) micros(column string) time.Duration {
+	return time.Duration(r.int(column)) * time.Microsecond
+}
+
+// poolName identifies a pool of PgBouncer
+type poolName struct {
+	database string
+	user     string
+}
+
+// PgBouncerConsole implements domain.PoolerConsole with the admin console of a
+// PgBouncer: the pools are read with SHOW POOLS, their sizes with SHOW
+// DATABASES, the averages and totals of their databases with SHOW STATS, and
+// their client connections with SHOW CLIENTS. It also implements
+// domain.PoolerAdmin with KILL_CLIENT, DISABLE and ENABLE, which need a user of
+// PgBouncer's admin_users. The console only speaks the simple query protocol,
+// which the commands are sent with. A single connection is kept open between
+// commands, and opened again after a failure.
+type PgBouncerConsole struct {
+	config *pgconn.Config
+
+	mu   sync.Mutex
+	conn *pgconn.PgConn // nil until the next poll connects
+}
+
+// NewPgBouncerConsole creates a console connecting with connString, such as
+// postgres://stats@pgbouncer.internal:6432/pgbouncer; nothing is dialed until the
+// first poll
+func NewPgBouncerConsole(connString string) (*PgBouncerConsole, error) {
+	config, err := pgconn.ParseConfig(connString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PgBouncer admin console URL: %w", err)
+	}
+	return &PgBouncerConsole{config: config}, nil
+}
+
+// Pools reads the pools of PgBouncer, less the console's own
+func (c *PgBouncerConsole) Pools(ctx context.Context) ([]domain.PoolStats, error) {
+	var pools []domain.PoolStats
+	err := c.session(ctx, func() error {
+		var err error
+		pools, err = c.poll(ctx)
+		return err
+	})
+	return pools, err
+}
+
+// KillClients closes the client connections of the user to the database with
+// KILL_CLIENT, which PgBouncer 1.23 introduced along with the id column of SHOW
+// CLIENTS
+func (c *PgBouncerConsole) KillClients(ctx context.Context, user, database string) (int, error) {
+	killed := 0
+	err := c.session(ctx, func() error {
+		rows, err := c.show(ctx, "SHOW CLIENTS")
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if row["user"] != user || row["database"] != database {
+				continue
+			}
+			id, ok := row["id"]
+			if !ok {
+				return fmt.Errorf("killing clients needs PgBouncer 1.23 or later")
+			}
+			if _, err := c.show(ctx, "KILL_CLIENT "+id); err != nil {
+				return err
+			}
+			killed++
+		}
+		return nil
+	})
+	return killed, err
+}
+
+// Disable rejects new client connections to the database with DISABLE
+func (c *PgBouncerConsole) Disable(ctx context.Context, database string) error {
+	return c.session(ctx, func() error {
+		_, err := c.show(ctx, "DISABLE "+pgx.Identifier{database}.Sanitize())
+		return err
+	})
+}
+
+// Enable accepts client connections to the database again with ENABLE
+func (c *PgBouncerConsole) Enable(ctx context.Context, database string) error {
+	return c.session(ctx, func() error {
+		_, err := c.show(ctx, "ENABLE "+pgx.Identifier{database}.Sanitize())
+		return err
+	})
+}
+
+// session runs commands on the connection to the console, connecting first
+// when needed and closing the connection when they fail
+func (c *PgBouncerConsole) session(ctx context.Context, commands func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		conn, err := pgconn.ConnectConfig(ctx, c.config)
+		if err != nil {
+			return fmt.Errorf("failed to connect to the PgBouncer admin console: %w", err)
+		}
+		c.conn = conn
+	}
+
+	if err := commands(); err != nil {
+		_ = c.conn.Close(context.Background())
+		c.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection to the console
+func (c *PgBouncerConsole) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close(context.Background())
+	c.conn = nil
+	return err
+}
+
+// poll runs the SHOW commands and merges their rows by pool; c.mu must be held
+func (c *PgBouncerConsole) poll(ctx context.Context) ([]domain.PoolStats, error) {
+	poolRows, err := c.show(ctx, "SHOW POOLS")
+	if err != nil {
+		return nil, err
+	}
+	databaseRows, err := c.show(ctx, "SHOW DATABASES")
+	if err != nil {
+		return nil, err
+	}
+	statsRows, err := c.show(ctx, "SHOW STATS")
+	if err != nil {
+		return nil, err
+	}
+	clientRows, err := c.show(ctx, "SHOW CLIENTS")
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[string]int64, len(databaseRows))
+	for _, row := range databaseRows {
+		sizes[row["name"]] = row.int("pool_size")
+	}
+	stats := make(map[string]consoleRow, len(statsRows))
+	for _, row := range statsRows {
+		stats[row["database"]] = row
+	}
+	clients := make(map[poolName]int64)
+	for _, row := range clientRows {
+		clients[poolName{database: row["database"], user: row["user"]}]++
+	}
+
+	var pools []domain.PoolStats
+	for _, row := range poolRows {
+		name := poolName{database: row["database"], user: row["user"]}
+		if name.database == pgbouncerConsoleDatabase {
+			continue
+		}
+		database := stats[name.database]
+		pools = append(pools, domain.PoolStats{
+			Database: name.database,
+			User:     name.user,
+			Mode:     row["pool_mode"],
+			Size:     sizes[name.database],
+
+			ClientsActive:  row.int("cl_active"),
+			ClientsWaiting: row.int("cl_waiting"),
+			ServersActive:  row.int("sv_active"),
+			ServersIdle:    row.int("sv_idle"),
+			ServersUsed:    row.int("sv_used"),
+			MaxWait:        time.Duration(row.int("maxwait"))*time.Second + row.micros("maxwait_us"),
+			Clients:        clients[name],
+
+			QueriesPerSecond:      database.float("avg_query_count"),
+			TransactionsPerSecond: database.float("avg_xact_count"),
+			AverageQueryTime:      database.micros("avg_query_time"),
+			AverageWait:           database.micros("avg_wait_time"),
+
+			TotalQueries:   database.int("total_query_count"),
+			TotalBytes:     database.int("total_received") + database.int("total_sent"),
+			TotalQueryTime: database.micros("total_query_time"),
+		})
+	}
+	return pools, nil
+}
+
+// show runs a command of the console and returns its rows; c.mu must be held
+func (c *PgBouncerConsole) show(ctx context.Context, command string) ([]consoleRow, error) {
+	results, err := c.conn.Exec(ctx, command).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run %s: %w", command, err)
+	}
+
+	var rows []consoleRow
+	for _, result := range results {
+		for _, values := range result.Rows {
+			row := make(consoleRow, len(result.FieldDescriptions))
+			for i, field := range result.FieldDescriptions {
+				row[field.Name] = string(values[i])
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
@@ -0,0 +1,97 @@
+package adapters
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPgBouncerConsole(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.Handle("SHOW POOLS", testkit.Result{
+		Columns: []string{"database", "user", "cl_active", "cl_waiting", "sv_active", "sv_idle", "sv_used", "maxwait", "maxwait_us", "pool_mode"},
+		Rows: [][]string{
+			{"pgbouncer", "pgbouncer", "1", "0", "0", "0", "0", "0", "0", "statement"},
+			{"app", "alice", "12", "3", "10", "0", "0", "1", "500000", "transaction"},
+			{"app", "bob", "2", "0", "1", "4", "0", "0", "0", "transaction"},
+		},
+		CommandTag: "SHOW",
+	})
+	backend.Handle("SHOW DATABASES", testkit.Result{
+		Columns:    []string{"name", "host", "port", "database", "pool_size"},
+		Rows:       [][]string{{"app", "db.internal", "5432", "app", "10"}, {"pgbouncer", "", "6432", "pgbouncer", "2"}},
+		CommandTag: "SHOW",
+	})
+	backend.Handle("SHOW STATS", testkit.Result{
+		Columns:    []string{"database", "avg_xact_count", "avg_query_count", "avg_query_time", "avg_wait_time"},
+		Rows:       [][]string{{"app", "40", "120", "2500", "15000"}},
+		CommandTag: "SHOW",
+	})
+	backend.Handle("SHOW CLIENTS", testkit.Result{
+		Columns:    []string{"type", "user", "database", "state", "addr", "port"},
+		Rows:       [][]string{{"C", "alice", "app", "active", "10.0.0.1", "50001"}, {"C", "alice", "app", "waiting", "10.0.0.2", "50002"}},
+		CommandTag: "SHOW",
+	})
+
+	console, err := NewPgBouncerConsole("postgres://stats@" + backend.Addr() + "/pgbouncer?sslmode=disable")
+	require.NoError(t, err)
+	defer console.Close()
+
+	pools, err := console.Pools(context.Background())
+	require.NoError(t, err)
+	require.Len(t, pools, 2, "The console's own pool should be left out")
+	assert.Equal(t, domain.PoolStats{
+		Database: "app", User: "alice", Mode: "transaction", Size: 10,
+		ClientsActive: 12, ClientsWaiting: 3, ServersActive: 10,
+		MaxWait: 1500 * time.Millisecond, Clients: 2,
+		QueriesPerSecond: 120, TransactionsPerSecond: 40,
+		AverageQueryTime: 2500 * time.Microsecond, AverageWait: 15 * time.Millisecond,
+	}, pools[0])
+	assert.Equal(t, 100, pools[0].Saturation(), "Pools with waiting clients should be saturated")
+	assert.Equal(t, 10, pools[1].Saturation())
+	assert.Zero(t, pools[1].Clients)
+
+	// The connection is kept between polls
+	_, err = console.Pools(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, backend.StartupParameters(), 1)
+
+	_, err = NewPgBouncerConsole("postgres://%zz")
+	assert.Error(t, err)
+}
+
+func TestPgBouncerConsole_Admin(t *testing.T) {
+	ctx := context.Background()
+	backend := testkit.StartFakeBackend(t)
+	backend.Handle("SHOW CLIENTS", testkit.Result{
+		Columns: []string{"type", "user", "database", "state", "id"},
+		Rows: [][]string{
+			{"C", "alice", "app", "active", "7"},
+			{"C", "bob", "app", "active", "8"},
+			{"C", "alice", "app", "idle", "9"},
+		},
+		CommandTag: "SHOW",
+	})
+	for _, command := range []string{"KILL_CLIENT 7", "KILL_CLIENT 9", `DISABLE "app"`, `ENABLE "app"`} {
+		backend.Handle(command, testkit.Result{CommandTag: strings.Fields(command)[0]})
+	}
+
+	console, err := NewPgBouncerConsole("postgres://admin@" + backend.Addr() + "/pgbouncer?sslmode=disable")
+	require.NoError(t, err)
+	defer console.Close()
+
+	killed, err := console.KillClients(ctx, "alice", "app")
+	require.NoError(t, err)
+	assert.Equal(t, 2, killed)
+	require.NoError(t, console.Disable(ctx, "app"))
+	require.NoError(t, console.Enable(ctx, "app"))
+	assert.Subset(t, backend.Queries(), []string{"KILL_CLIENT 7", "KILL_CLIENT 9", `DISABLE "app"`, `ENABLE "app"`})
+	assert.NotContains(t, backend.Queries(), "KILL_CLIENT 8")
+}
@@ -0,0 +1,313 @@
+package adapters
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// policyFile is the on-disk layout of a quota policy file
+type policyFile struct {
+	Policies []policyFileEntry `yaml:"policies"`
+}
+
+// policyFileEntry is a single policy as written in a policy file
+type policyFileEntry struct {
+	Name      string            `yaml:"name,omitempty"`
+	User      string            `yaml:"user,omitempty"`
+	Role      string            `yaml:"role,omitempty"`
+	Database  string            `yaml:"database,omitempty"`
+	Labels    map[string]string `yaml:"labels,omitempty"`
+	Listener  string            `yaml:"listener,omitempty"`
+	Dimension string            `yaml:"dimension,omitempty"`
+	Limit     int64             `yaml:"limit,omitempty"`
+	Window    time.Duration     `yaml:"window,omitempty"`
+	PerLabel  string            `yaml:"per_label,omitempty"`
+	Rate      float64           `yaml:"rate,omitempty"`
+	Burst     int64             `yaml:"burst,omitempty"`
+	RatePer   string            `yaml:"rate_per,omitempty"`
+
+	Credits    int64   `yaml:"credits,omitempty"`
+	CreditRate float64 `yaml:"credit_rate,omitempty"`
+
+	WarnAt int           `yaml:"warn_at,omitempty"`
+	Soft   bool          `yaml:"soft,omitempty"`
+	Grace  time.Duration `yaml:"grace,omitempty"`
+
+	TightenAt int `yaml:"tighten_at,omitempty"`
+	TightenTo int `yaml:"tighten_to,omitempty"`
+
+	MaxConnections       int64         `yaml:"max_connections,omitempty"`
+	MaxConcurrentQueries int64         `yaml:"max_concurrent_queries,omitempty"`
+	QueueTimeout         time.Duration `yaml:"queue_timeout,omitempty"`
+	StatementTimeout     time.Duration `yaml:"statement_timeout,omitempty"`
+	MaxResultRows        int64         `yaml:"max_result_rows,omitempty"`
+	MaxResultBytes       int64         `yaml:"max_result_bytes,omitempty"`
+
+	MaxTransactionDuration   time.Duration `yaml:"max_transaction_duration,omitempty"`
+	MaxTransactionStatements int64         `yaml:"max_transaction_statements,omitempty"`
+
+	StartupParameters map[string]string `yaml:"startup_parameters,omitempty"`
+
+	Tables      []string                `yaml:"tables,omitempty"`
+	Statements  []domain.StatementClass `yaml:"statements,omitempty"`
+	Deny        bool                    `yaml:"deny,omitempty"`
+	AllowDuring []string                `yaml:"allow_during,omitempty"`
+
+	ActiveDuring []string `yaml:"active_during,omitempty"`
+
+	Fingerprints []string `yaml:"fingerprints,omitempty"`
+	Patterns     []string `yaml:"patterns,omitempty"`
+	Allow        bool     `yaml:"allow,omitempty"`
+	Hint         string   `yaml:"hint,omitempty"`
+
+	Override bool `yaml:"override,omitempty"`
+}
+
+// LoadPolicyFile reads quota policies from a YAML file
+func LoadPolicyFile(path string) ([]domain.QuotaPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open policy file: %w", err)
+	}
+	defer f.Close()
+
+	policies, err := ParsePolicies(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return policies, nil
+}
+
+// ParsePolicies decodes and validates quota policies in the policy file format:
+//
+//	policies:
+//	  - name: default
+//	    user: alice
+//	    database: app
+//	    labels:
+//	      team: billing
+//	    limit: 1000
+//	    window: 1h
+//	    warn_at: 90
+//	  - name: exports
+//	    dimension: bytes
+//	    limit: 1073741824
+//	    window: 24h
+//	    grace: 15m
+//	  - name: batch
+//	    user: etl
+//	    rate: 20
+//	    burst: 50
+//	    rate_per: connection
+//	    tighten_at: 80
+//	    tighten_to: 50
+//	  - name: tenant-credits
+//	    user: tenant
+//	    rate: 10
+//	    credits: 3000
+//	    credit_rate: 2
+//	  - name: reporting
+//	    database: reporting
+//	    max_connections: 20
+//	    max_concurrent_queries: 4
+//	    queue_timeout: 5s
+//	    statement_timeout: 30s
+//	    max_result_rows: 100000
+//	    max_transaction_duration: 5m
+//	    max_transaction_statements: 1000
+//	    startup_parameters:
+//	      application_name: "{application_name} (pgqe {connection_id})"
+//	  - name: events-reads
+//	    tables: [analytics.events]
+//	    statements: [read]
+//	    limit: 100
+//	    window: 1h
+//	  - name: audit-readonly
+//	    tables: [audit.*]
+//	    statements: [write]
+//	    deny: true
+//	  - name: ddl-maintenance
+//	    statements: [ddl]
+//	    deny: true
+//	    allow_during: ["Sat 02:00-04:00"]
+//	  - name: peak-writes
+//	    statements: [write]
+//	    limit: 1000
+//	    window: 1h
+//	    active_during: ["Mon-Fri 09:00-18:00 Europe/Paris"]
+//	  - name: no-full-scans
+//	    patterns: ['(?i)^select \* from huge_table$']
+//	    deny: true
+//	    hint: filter huge_table by created_at
+//	  - name: health-checks
+//	    fingerprints: [50fde20626009aba]
+//	    allow: true
+//	  - name: analytics
+//	    listener: analytics
+//	    limit: 100
+//	    window: 1h
+//	  - name: analysts
+//	    role: analysts
+//	    limit: 5000
+//	    window: 1h
+//	    override: true
+//
+// The dimension is queries, cost, bytes, rows or seconds; it defaults to
+// queries. Queries past warn_at percent of a limit carry a warning; those
+// beyond a soft limit, or beyond a limit within its grace period, are allowed
+// with a warning. The rate, in queries per second, is shared by the user's connections
+// unless rate_per is connection. While the upstream PgBouncer pool of a principal
+// is saturated beyond tighten_at percent, its limit and rate are tightened to
+// tighten_to percent. max_connections caps the concurrent connections
+// of each user and database pair the policy matches, max_concurrent_queries
+// the statements they run at once, queueing those beyond it for up to
+// queue_timeout. statement_timeout cancels the queries it applies to that run
+// longer, and max_result_rows and max_result_bytes those returning more, cut
+// off once they reach the cap. Connections whose transaction stays open longer
+// than max_transaction_duration, or runs more than max_transaction_statements,
+// are closed and the transaction rolled back. startup_parameters are
+// sent upstream in the startup message of the connections the policy matches,
+// in place of those of the client. tables and statements
+// restrict a policy to the queries reading or writing those tables; a deny
+// policy rejects them, except during the recurring windows of allow_during. A
+// policy with active_during windows only applies during them.
+// fingerprints and patterns restrict a policy to the queries with one of those
+// hashes or whose normalized text matches one of those regular expressions; an
+// allow policy exempts them from every other policy. A policy with a listener
+// only applies to the connections accepted by the listener of that name. A
+// policy with a role only applies to the members of that role, and an override
+// replaces the same kind of limit of the less specific policies.
+func ParsePolicies(r io.Reader) ([]domain.QuotaPolicy, error) {
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+
+	var file policyFile
+	if err := decoder.Decode(&file); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to decode policies: %w", err)
+	}
+
+	policies := make([]domain.QuotaPolicy, 0, len(file.Policies))
+	for _, entry := range file.Policies {
+		policy := entry.policy()
+		if err := policy.Validate(); err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// policy converts the entry to a quota policy, which is not validated
+func (e policyFileEntry) policy() domain.QuotaPolicy {
+	return domain.QuotaPolicy{
+		Name:      e.Name,
+		User:      e.User,
+		Role:      e.Role,
+		Database:  e.Database,
+		Labels:    e.Labels,
+		Listener:  e.Listener,
+		Dimension: domain.QuotaDimension(e.Dimension),
+		Limit:     e.Limit,
+		Window:    e.Window,
+		PerLabel:  e.PerLabel,
+		Rate:      e.Rate,
+		Burst:     e.Burst,
+		RatePer:   domain.RateScope(e.RatePer),
+
+		Credits:    e.Credits,
+		CreditRate: e.CreditRate,
+
+		WarnAt: e.WarnAt,
+		Soft:   e.Soft,
+		Grace:  e.Grace,
+
+		TightenAt: e.TightenAt,
+		TightenTo: e.TightenTo,
+
+		MaxConnections:       e.MaxConnections,
+		MaxConcurrentQueries: e.MaxConcurrentQueries,
+		QueueTimeout:         e.QueueTimeout,
+		StatementTimeout:     e.StatementTimeout,
+		MaxResultRows:        e.MaxResultRows,
+		MaxResultBytes:       e.MaxResultBytes,
+
+		MaxTransactionDuration:   e.MaxTransactionDuration,
+		MaxTransactionStatements: e.MaxTransactionStatements,
+
+		StartupParameters: e.StartupParameters,
+
+		Tables:      e.Tables,
+		Statements:  e.Statements,
+		Deny:        e.Deny,
+		AllowDuring: e.AllowDuring,
+
+		ActiveDuring: e.ActiveDuring,
+
+		Fingerprints: e.Fingerprints,
+		Patterns:     e.Patterns,
+		Allow:        e.Allow,
+		Hint:         e.Hint,
+
+		Override: e.Override,
+	}
+}
+
+// policyEntry converts policy to an entry of a policy file, the inverse of policy
+func policyEntry(policy domain.QuotaPolicy) policyFileEntry {
+	return policyFileEntry{
+		Name:      policy.Name,
+		User:      policy.User,
+		Role:      policy.Role,
+		Database:  policy.Database,
+		Labels:    policy.Labels,
+		Listener:  policy.Listener,
+		Dimension: string(policy.Dimension),
+		Limit:     policy.Limit,
+		Window:    policy.Window,
+		PerLabel:  policy.PerLabel,
+		Rate:      policy.Rate,
+		Burst:     policy.Burst,
+		RatePer:   string(policy.RatePer),
+
+		Credits:    policy.Credits,
+		CreditRate: policy.CreditRate,
+
+		WarnAt: policy.WarnAt,
+		Soft:   policy.Soft,
+		Grace:  policy.Grace,
+
+		TightenAt: policy.TightenAt,
+		TightenTo: policy.TightenTo,
+
+		MaxConnections:       policy.MaxConnections,
+		MaxConcurrentQueries: policy.MaxConcurrentQueries,
+		QueueTimeout:         policy.QueueTimeout,
+		StatementTimeout:     policy.StatementTimeout,
+		MaxResultRows:        policy.MaxResultRows,
+		MaxResultBytes:       policy.MaxResultBytes,
+
+		MaxTransactionDuration:   policy.MaxTransactionDuration,
+		MaxTransactionStatements: policy.MaxTransactionStatements,
+
+		StartupParameters: policy.StartupParameters,
+
+		Tables:      policy.Tables,
+		Statements:  policy.Statements,
+		Deny:        policy.Deny,
+		AllowDuring: policy.AllowDuring,
+
+		ActiveDuring: policy.ActiveDuring,
+
+		Fingerprints: policy.Fingerprints,
+		Patterns:     policy.Patterns,
+		Allow:        policy.Allow,
+		Hint:         policy.Hint,
+
+		Override: policy.Override,
+	}
+}
@@ -0,0 +1,131 @@
+package adapters
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePolicies(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expected    []domain.QuotaPolicy
+		expectedErr string
+	}{
+		{
+			name: "Valid policies",
+			input: `
+policies:
+  - name: default
+    limit: 1000
+    window: 1h
+  - name: alice-reporting
+    user: alice
+    database: reporting
+    labels:
+      workload: dashboard
+    limit: 10
+    window: 30s
+`,
+			expected: []domain.QuotaPolicy{
+				{Name: "default", Limit: 1000, Window: time.Hour},
+				{Name: "alice-reporting", User: "alice", Database: "reporting", Labels: map[string]string{"workload": "dashboard"}, Limit: 10, Window: 30 * time.Second},
+			},
+		},
+		{
+			name:     "Data volume policy",
+			input:    "policies:\n  - name: exports\n    dimension: bytes\n    limit: 1048576\n    window: 24h\n",
+			expected: []domain.QuotaPolicy{{Name: "exports", Dimension: domain.QuotaDimensionBytes, Limit: 1048576, Window: 24 * time.Hour}},
+		},
+		{
+			name:  "Table scoped policies",
+			input: "policies:\n  - name: audit\n    tables: [audit.*]\n    statements: [write]\n    deny: true\n",
+			expected: []domain.QuotaPolicy{{
+				Name:       "audit",
+				Tables:     []string{"audit.*"},
+				Statements: []domain.StatementClass{domain.StatementClassWrite},
+				Deny:       true,
+			}},
+		},
+		{
+			name: "Query rules",
+			input: `
+policies:
+  - name: no-full-scans
+    patterns: ['(?i)^select \* from huge_table$']
+    deny: true
+    hint: filter huge_table by created_at
+  - name: health-checks
+    fingerprints: [50fde20626009aba]
+    allow: true
+`,
+			expected: []domain.QuotaPolicy{
+				{Name: "no-full-scans", Patterns: []string{`(?i)^select \* from huge_table$`}, Deny: true, Hint: "filter huge_table by created_at"},
+				{Name: "health-checks", Fingerprints: []string{"50fde20626009aba"}, Allow: true},
+			},
+		},
+		{
+			name:     "Statement timeout",
+			input:    "policies:\n  - name: reporting\n    database: reporting\n    statement_timeout: 30s\n",
+			expected: []domain.QuotaPolicy{{Name: "reporting", Database: "reporting", StatementTimeout: 30 * time.Second}},
+		},
+		{
+			name:  "Startup parameters",
+			input: "policies:\n  - name: tagged\n    startup_parameters:\n      application_name: \"{application_name} (pgqe {connection_id})\"\n",
+			expected: []domain.QuotaPolicy{
+				{Name: "tagged", StartupParameters: map[string]string{"application_name": "{application_name} (pgqe {connection_id})"}},
+			},
+		},
+		{
+			name:        "Invalid fingerprint",
+			input:       "policies:\n  - name: health-checks\n    fingerprints: [\"SELECT 1\"]\n    allow: true\n",
+			expectedErr: "invalid fingerprint",
+		},
+		{
+			name:        "Invalid table pattern",
+			input:       "policies:\n  - name: audit\n    tables: [\"audit.*.log\"]\n    deny: true\n",
+			expectedErr: "invalid table pattern",
+		},
+		{
+			name:        "Unknown dimension",
+			input:       "policies:\n  - name: exports\n    dimension: megabytes\n    limit: 10\n    window: 1h\n",
+			expectedErr: "unknown dimension",
+		},
+		{
+			name:     "Empty file",
+			input:    "",
+			expected: []domain.QuotaPolicy{},
+		},
+		{
+			name:        "Unknown field",
+			input:       "policies:\n  - name: default\n    limt: 10\n    window: 1h\n",
+			expectedErr: "limt",
+		},
+		{
+			name:        "Invalid policy",
+			input:       "policies:\n  - name: default\n    limit: 10\n",
+			expectedErr: "window must be positive",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policies, err := ParsePolicies(strings.NewReader(tt.input))
+
+			if tt.expectedErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expectedErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, policies)
+		})
+	}
+}
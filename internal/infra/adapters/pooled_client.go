@@ -0,0 +1,424 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// upstreamStartupError is an error reported by the upstream while the enforcer
+// logs a pooled connection in, such as an unknown database
+type upstreamStartupError struct {
+	response *pgproto3.ErrorResponse
+}
+
+func (e *upstreamStartupError) Error() string {
+	return fmt.Sprintf("upstream rejected the connection: %s", e.response.Message)
+}
+
+// pooledClient relays the messages of a client to upstream connections taken
+// from the pool: one for the whole session in session mode, one per transaction
+// in transaction mode. Messages are sent from the handler goroutine, and the
+// replies of each assigned connection are relayed by a goroutine of its own
+// that, in transaction mode, returns the connection once the client is idle.
+type pooledClient struct {
+	h            *PostgreSQLConnectionHandler
+	key          poolKey
+	route        upstreamRoute
+	parser       *PostgreSQLParser
+	writer       *PostgreSQLResponseWriter
+	conn         net.Conn
+	meter        *resultMeter
+	state        *sessionTracker
+	timeouts     *statementTimeouts
+	caps         *resultCaps
+	transactions *transactionLimits
+	connLogger   logger.Logger
+	cancelKey    uint32 // client-facing process ID
+
+	mu       sync.Mutex
+	upstream *upstreamConnection // nil while none is assigned
+	relayed  chan struct{}       // closed when the relay of upstream returns
+	synced   bool                // the client ended its last extended protocol exchange with a Sync
+	sending  int                 // messages being written to upstream
+
+	failed   chan struct{} // closed when an assigned connection fails
+	failOnce sync.Once
+}
+
+// connectPooled answers the startup of a locally authenticated client with the
+// parameters of a pooled connection and a cancel key of the enforcer's own. In
+// session mode the connection stays assigned to the client; in transaction
+// mode it goes back to the pool until the client sends a query. A nil client
+// without error means the client was already sent a FATAL error and must be
+// disconnected.
+func (h *PostgreSQLConnectionHandler) connectPooled(ctx context.Context, route upstreamRoute, parser *PostgreSQLParser, writer *PostgreSQLResponseWriter, conn net.Conn, session domain.Session, meter *resultMeter, state *sessionTracker, timeouts *statementTimeouts, caps *resultCaps, transactions *transactionLimits, connLogger logger.Logger) (*pooledClient, error) {
+	client := &pooledClient{
+		h:            h,
+		key:          poolKey{listener: session.Listener, user: session.User, database: session.Database},
+		route:        route,
+		parser:       parser,
+		writer:       writer,
+		conn:         conn,
+		meter:        meter,
+		state:        state,
+		timeouts:     timeouts,
+		caps:         caps,
+		transactions: transactions,
+		connLogger:   connLogger,
+		synced:       true,
+		failed:       make(chan struct{}),
+	}
+
+	upstream, err := h.acquirePooled(ctx, client.key, route, writer, connLogger)
+	if err != nil || upstream == nil {
+		return nil, err
+	}
+
+	clientKey, err := h.cancelKeys.register("", nil, pgproto3.BackendKeyData{})
+	if err != nil {
+		h.pool.release(client.key, upstream)
+		return nil, err
+	}
+	client.cancelKey = clientKey.ProcessID
+
+	for _, name := range slices.Sorted(maps.Keys(upstream.parameters)) {
+		parser.Queue(&pgproto3.ParameterStatus{Name: name, Value: upstream.parameters[name]})
+	}
+	parser.Queue(clientKey)
+	parser.Queue(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	if err := parser.Flush(); err != nil {
+		h.pool.release(client.key, upstream)
+		h.cancelKeys.unregister(client.cancelKey)
+		return nil, fmt.Errorf("failed to complete startup: %w", err)
+	}
+
+	if h.pool.Mode() == PoolModeTransaction {
+		h.pool.release(client.key, upstream)
+	} else {
+		client.mu.Lock()
+		client.assign(ctx, upstream)
+		client.mu.Unlock()
+	}
+	connLogger.Info("Using pooled upstream connections to %s in %s mode", upstream.address, h.pool.Mode())
+	return client, nil
+}
+
+// acquirePooled takes a connection from the pool of key, logging a new one into
+// an upstream of route when the pool has room. A nil connection without error
+// means the client was sent a FATAL error and must be disconnected.
+func (h *PostgreSQLConnectionHandler) acquirePooled(ctx context.Context, key poolKey, route upstreamRoute, writer *PostgreSQLResponseWriter, connLogger logger.Logger) (*upstreamConnection, error) {
+	upstream, err := h.pool.acquire(ctx, key, func(ctx context.Context) (*upstreamConnection, error) {
+		return h.dialPooled(ctx, key, route)
+	})
+	var rejected *upstreamStartupError
+	switch {
+	case err == nil:
+		return upstream, nil
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case errors.As(err, &rejected):
+		connLogger.Error("Failed to open pooled upstream connection: %v", err)
+		return nil, writer.parser.Send(rejected.response)
+	case errors.Is(err, errNoUpstream):
+		connLogger.Error("No upstream available")
+		return nil, writer.Reject(pgerrConnectionFailure, "no upstream server is available")
+	case errors.Is(err, errUpstreamLogin):
+		connLogger.Error("Failed to log into upstream: %v", err)
+		return nil, writer.Reject(pgerrConnectionFailure, "could not authenticate with the upstream server")
+	case errors.Is(err, errPoolTimeout):
+		connLogger.Error("No pooled upstream connection was released in time")
+		return nil, writer.Reject(pgerrConnectionFailure, "no upstream connection became available in time")
+	default:
+		connLogger.Error("Failed to connect to upstream: %v", err)
+		return nil, writer.Reject(pgerrConnectionFailure, "could not connect to the upstream server")
+	}
+}
+
+// dialPooled opens a connection to an upstream of route and logs it into the
+// database of key, or the one route renames it to, with the enforcer's credentials. Only the user and database
+// are sent, since the connection is shared by every client of the pool.
+func (h *PostgreSQLConnectionHandler) dialPooled(ctx context.Context, key poolKey, route upstreamRoute) (*upstreamConnection, error) {
+	target, ok := route.selector.Next()
+	if !ok {
+		return nil, errNoUpstream
+	}
+	upstream, err := dialUpstream(ctx, target.Address, h.upstreamTimeout, targetTLSConfig(route.tlsConfig, target))
+	if err != nil {
+		return nil, err
+	}
+	if err := upstream.conn.SetDeadline(time.Now().Add(h.upstreamTimeout)); err != nil {
+		_ = upstream.Close()
+		return nil, fmt.Errorf("failed to set upstream deadline: %w", err)
+	}
+
+	database := key.database
+	if route.database != "" {
+		database = route.database
+	}
+	login := h.upstreamLogin(key.user)
+	if err := upstream.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": login.user, "database": database},
+	}); err != nil {
+		_ = upstream.Close()
+		return nil, err
+	}
+
+	upstream.parameters = make(map[string]string)
+	for {
+		msg, err := upstream.Receive()
+		if err == nil {
+			var answered bool
+			if answered, err = login.answer(upstream, msg); answered {
+				continue
+			}
+		}
+		if err != nil {
+			_ = upstream.Close()
+			return nil, err
+		}
+
+		switch m := msg.(type) {
+		case *pgproto3.ParameterStatus:
+			upstream.parameters[m.Name] = m.Value
+		case *pgproto3.BackendKeyData:
+			upstream.backend = *m
+		case *pgproto3.ErrorResponse:
+			_ = upstream.Close()
+			response := *m
+			return nil, &upstreamStartupError{response: &response}
+		case *pgproto3.ReadyForQuery:
+			if err := upstream.conn.SetDeadline(time.Time{}); err != nil {
+				_ = upstream.Close()
+				return nil, fmt.Errorf("failed to clear upstream deadline: %w", err)
+			}
+			return upstream, nil
+		}
+	}
+}
+
+// send forwards a client message, assigning a pooled connection to the client
+// first when it holds none; in transaction mode the parameters the client set
+// are restored on it. It reports false without error when no connection could
+// be assigned and the client was sent a FATAL error.
+func (c *pooledClient) send(ctx context.Context, message *ParsedMessage, synced bool) (bool, error) {
+	c.mu.Lock()
+	c.synced = synced
+	if c.upstream == nil {
+		upstream, err := c.h.acquirePooled(ctx, c.key, c.route, c.writer, c.connLogger)
+		if err != nil || upstream == nil {
+			c.mu.Unlock()
+			return false, err
+		}
+		if parameters := c.state.current().Parameters; c.h.pool.Mode() == PoolModeTransaction && len(parameters) > 0 {
+			if err := c.h.runPooled(upstream, restoreSessionQuery(parameters)); err != nil {
+				c.mu.Unlock()
+				c.connLogger.Error("Failed to restore session parameters: %v", err)
+				c.h.pool.discard(c.key, upstream)
+				return false, c.writer.Reject(pgerrConnectionFailure, "could not restore the session parameters on an upstream connection")
+			}
+		}
+		c.assign(ctx, upstream)
+	}
+	if message.Type == "Query" || message.Type == "Sync" {
+		c.writer.Await()
+	}
+	// The connection stays assigned while the message is written, which happens
+	// outside the lock so the relay keeps reading meanwhile
+	upstream := c.upstream
+	c.sending++
+	c.mu.Unlock()
+
+	err := c.h.sendUpstream(ctx, upstream, message.Message)
+
+	c.mu.Lock()
+	c.sending--
+	c.mu.Unlock()
+	return err == nil, err
+}
+
+// assign makes upstream the client's connection and starts relaying its replies.
+// The caller holds the lock.
+func (c *pooledClient) assign(ctx context.Context, upstream *upstreamConnection) {
+	c.upstream = upstream
+	c.relayed = make(chan struct{})
+	c.h.cancelKeys.assign(c.cancelKey, upstream)
+	go c.relay(ctx, upstream, c.relayed)
+}
+
+// detach takes the connection away from the client. The caller holds the lock.
+func (c *pooledClient) detach() {
+	c.upstream = nil
+	c.h.cancelKeys.assign(c.cancelKey, nil)
+}
+
+// relay forwards the replies of upstream to the client until the connection is
+// returned to the pool, detached by close or fails. Messages are batched while
+// more are buffered.
+func (c *pooledClient) relay(ctx context.Context, upstream *upstreamConnection, done chan struct{}) {
+	defer close(done)
+
+	for {
+		msg, err := c.h.receiveUpstream(ctx, upstream)
+		if err != nil {
+			c.mu.Lock()
+			assigned := c.upstream == upstream
+			if assigned {
+				c.detach()
+			}
+			c.mu.Unlock()
+
+			// A connection detached by close was interrupted on purpose
+			if assigned {
+				c.connLogger.Debug("Upstream relay stopped: %v", err)
+				c.h.pool.discard(c.key, upstream)
+				c.fail()
+			}
+			return
+		}
+
+		msg = c.timeouts.observeUpstream(msg)
+		c.meter.observeUpstream(ctx, msg)
+		c.state.observeUpstream(msg)
+		c.transactions.observeUpstream(msg)
+		cutoff, msg := c.caps.observeUpstream(msg)
+		if cutoff != nil {
+			c.writer.Relay(cutoff)
+		}
+		if msg != nil {
+			c.writer.Relay(msg)
+		}
+		if upstream.Buffered() {
+			continue
+		}
+		if err := c.parser.Flush(); err != nil {
+			c.connLogger.Debug("Client relay stopped: %v", err)
+			c.fail()
+			return
+		}
+
+		answered, status := c.writer.Answered()
+		idle := answered && status == domain.TransactionIdle
+		c.mu.Lock()
+		release := c.h.pool.Mode() == PoolModeTransaction && idle && c.synced && c.sending == 0 && c.upstream == upstream
+		if release {
+			c.detach()
+		}
+		c.mu.Unlock()
+
+		// A draining connection is closed as soon as its transaction ends, and the
+		// handler waiting for the upstream to answer the client is woken
+		if answered && (idle && c.h.draining() || c.state.wake()) {
+			_ = c.conn.SetReadDeadline(time.Now())
+		}
+		if release {
+			if err := c.reset(upstream); err != nil {
+				c.connLogger.Debug("Failed to reset pooled upstream connection: %v", err)
+				c.h.pool.discard(c.key, upstream)
+				return
+			}
+			c.h.pool.release(c.key, upstream)
+			return
+		}
+	}
+}
+
+// fail ends the client connection after its upstream connection failed
+func (c *pooledClient) fail() {
+	c.failOnce.Do(func() {
+		close(c.failed)
+		_ = c.conn.SetReadDeadline(time.Now())
+	})
+}
+
+// close gives the connection assigned to the client back to the pool once the
+// client disconnects, once reset. Connections left inside a transaction or in
+// the middle of an exchange are closed instead.
+func (c *pooledClient) close() {
+	c.mu.Lock()
+	upstream, relayed := c.upstream, c.relayed
+	if upstream != nil {
+		c.detach()
+	}
+	synced := c.synced
+	c.mu.Unlock()
+	c.h.cancelKeys.unregister(c.cancelKey)
+	if upstream == nil {
+		return
+	}
+
+	// Interrupt the relay, which reads nothing more from an idle connection
+	_ = upstream.conn.SetReadDeadline(time.Now())
+	<-relayed
+
+	reusable := synced && c.writer.Idle()
+	if reusable {
+		if err := c.reset(upstream); err != nil {
+			c.connLogger.Debug("Failed to reset pooled upstream connection: %v", err)
+			reusable = false
+		}
+	}
+	if !reusable {
+		c.h.pool.discard(c.key, upstream)
+		return
+	}
+	if err := upstream.conn.SetDeadline(time.Time{}); err != nil {
+		c.h.pool.discard(c.key, upstream)
+		return
+	}
+	c.h.pool.release(c.key, upstream)
+}
+
+// reset cleans the state the client left on its connection before it goes back
+// to the pool: everything with DISCARD ALL in session mode, and the parameters
+// the client set with RESET ALL in transaction mode
+func (c *pooledClient) reset(upstream *upstreamConnection) error {
+	switch {
+	case c.h.pool.Mode() == PoolModeSession:
+		return c.h.runPooled(upstream, "DISCARD ALL")
+	case len(c.state.current().Parameters) > 0:
+		return c.h.runPooled(upstream, "RESET ALL")
+	}
+	return nil
+}
+
+// runPooled runs query on a pooled connection no client relays, outside a
+// transaction, and clears its deadline once done
+func (h *PostgreSQLConnectionHandler) runPooled(upstream *upstreamConnection, query string) error {
+	if err := upstream.conn.SetDeadline(time.Now().Add(h.upstreamTimeout)); err != nil {
+		return fmt.Errorf("failed to set upstream deadline: %w", err)
+	}
+	if err := upstream.Send(&pgproto3.Query{String: query}); err != nil {
+		return err
+	}
+
+	var failure error
+	for {
+		msg, err := upstream.Receive()
+		if err != nil {
+			return err
+		}
+		switch m := msg.(type) {
+		case *pgproto3.ErrorResponse:
+			failure = fmt.Errorf("upstream failed to run %s: %s", query, m.Message)
+		case *pgproto3.ReadyForQuery:
+			if failure == nil && m.TxStatus != 'I' {
+				failure = fmt.Errorf("upstream connection is still in a transaction")
+			}
+			if failure == nil {
+				failure = upstream.conn.SetDeadline(time.Time{})
+			}
+			return failure
+		}
+	}
+}
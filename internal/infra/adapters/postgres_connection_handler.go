@@ -1,32 +1,484 @@
 package adapters
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"pgbouncer-quota-enforcer/internal/app/domain"
 	"pgbouncer-quota-enforcer/pkg/logger"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+const (
+	// pgerrCannotConnectNow is the SQLSTATE PostgreSQL uses while it cannot accept connections
+	pgerrCannotConnectNow = "57P03"
+
+	// pgerrTooManyConnections is the SQLSTATE for connection limits
+	pgerrTooManyConnections = "53300"
+
+	// pgerrInvalidAuthorization is the SQLSTATE PostgreSQL reports when no pg_hba.conf
+	// entry matches, such as a plaintext connection where TLS is required
+	pgerrInvalidAuthorization = "28000"
+
+	// pgerrAdminShutdown is the SQLSTATE PostgreSQL reports when it terminates a
+	// connection on shutdown
+	pgerrAdminShutdown = "57P01"
+
+	// pgerrProgramLimitExceeded is the SQLSTATE of messages over the size limit
+	pgerrProgramLimitExceeded = "54000"
+
+	// pgerrOutOfMemory is the SQLSTATE of connections over their buffer limit
+	pgerrOutOfMemory = "53200"
+
+	// pgerrInsufficientPrivilege is the SQLSTATE of queries a script denies
+	pgerrInsufficientPrivilege = "42501"
+
+	// pgerrIdleSessionTimeout is the SQLSTATE PostgreSQL reports when it closes
+	// a connection idle for longer than its idle_session_timeout
+	pgerrIdleSessionTimeout = "57P05"
+
+	// pgerrIdleInTransactionTimeout is the SQLSTATE PostgreSQL reports when it
+	// closes a connection idle in a transaction for longer than its
+	// idle_in_transaction_session_timeout
+	pgerrIdleInTransactionTimeout = "25P03"
 )
 
+// preparedStatement is a statement created by a Parse message, kept so its
+// executions can be attributed to the original query
+type preparedStatement struct {
+	raw        string
+	normalized *domain.NormalizedQuery // nil when the query could not be normalized
+	oids       []uint32                // parameter types declared by the Parse
+}
+
+// size returns the bytes the statement named name holds
+func (s preparedStatement) size(name string) int64 {
+	return int64(len(name)+len(s.raw)) + 4*int64(len(s.oids))
+}
+
+// boundPortal is a portal created by a Bind message
+type boundPortal struct {
+	statement  string            // name of the prepared statement it executes
+	parameters []interface{}     // bound values, only kept when parameter capture is enabled
+	labels     map[string]string // labels taken from the bound values, see ParameterLabel
+}
+
+// size returns the bytes the portal named name holds
+func (p boundPortal) size(name string) int64 {
+	size := int64(len(name) + len(p.statement))
+	for _, parameter := range p.parameters {
+		switch value := parameter.(type) {
+		case string:
+			size += int64(len(value))
+		case []byte:
+			size += int64(len(value))
+		}
+	}
+	for label, value := range p.labels {
+		size += int64(len(label) + len(value))
+	}
+	return size
+}
+
+// extendedProtocolState tracks the prepared statements and portals of a connection
+type extendedProtocolState struct {
+	statements map[string]preparedStatement // by statement name; "" is the unnamed statement
+	portals    map[string]boundPortal       // by portal name; "" is the unnamed portal
+
+	// denied is set once a message is denied; like PostgreSQL after an error,
+	// the following messages are discarded until the client's Sync
+	denied *domain.Decision
+
+	// buffered is what the statements and portals hold, in bytes
+	buffered int64
+}
+
+func newExtendedProtocolState() *extendedProtocolState {
+	return &extendedProtocolState{
+		statements: make(map[string]preparedStatement),
+		portals:    make(map[string]boundPortal),
+	}
+}
+
+// named reports whether the client prepared a named statement it did not close
+func (e *extendedProtocolState) named() bool {
+	for name := range e.statements {
+		if name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// prepare remembers the statement named name, replacing any of the same name
+func (e *extendedProtocolState) prepare(name string, statement preparedStatement) {
+	e.closeStatement(name)
+	e.statements[name] = statement
+	e.buffered += statement.size(name)
+}
+
+// bind remembers the portal named name, replacing any of the same name
+func (e *extendedProtocolState) bind(name string, portal boundPortal) {
+	e.closePortal(name)
+	e.portals[name] = portal
+	e.buffered += portal.size(name)
+}
+
+// closeStatement forgets the statement named name
+func (e *extendedProtocolState) closeStatement(name string) {
+	if statement, ok := e.statements[name]; ok {
+		e.buffered -= statement.size(name)
+		delete(e.statements, name)
+	}
+}
+
+// closePortal forgets the portal named name
+func (e *extendedProtocolState) closePortal(name string) {
+	if portal, ok := e.portals[name]; ok {
+		e.buffered -= portal.size(name)
+		delete(e.portals, name)
+	}
+}
+
 // PostgreSQLConnectionHandler implements domain.ConnectionHandler for PostgreSQL protocol
 type PostgreSQLConnectionHandler struct {
-	queryLogger  domain.QueryLogger
-	normalizer   domain.QueryNormalizer
-	logger       logger.Logger
-	readTimeout  time.Duration
-	connectionID int64 // Atomic counter for connection IDs
+	queryLogger      domain.QueryLogger
+	normalizer       domain.QueryNormalizer
+	logger           logger.Logger
+	readTimeout      time.Duration
+	upstreamTimeout  time.Duration
+	idleTimeout      time.Duration // closes clients idle outside a transaction for longer; zero for no limit
+	idleInTxTimeout  time.Duration // closes clients idle inside a transaction for longer; zero for no limit
+	faults           domain.FaultInjector
+	clock            domain.Clock
+	policyEngine     domain.PolicyEngine
+	maintenance      domain.MaintenanceGate
+	limiter          domain.ConnectionLimiter
+	access           domain.AccessController
+	gssTunnel        bool // relays GSSAPI-encrypted connections upstream without enforcing them
+	connections      domain.ConnectionTracker
+	upstreams        domain.UpstreamSelector
+	upstreamTLS      *tls.Config
+	listenerRoutes   map[string]upstreamRoute // upstreams of named listeners, by listener name
+	databaseRoutes   map[string]upstreamRoute // upstreams of databases, by the name clients connect to
+	pool             *UpstreamPool            // nil when every client gets an upstream connection of its own
+	tlsConfig        *tls.Config
+	tlsRequired      map[string]bool // users that must connect over TLS; "*" for all
+	userlist         *Userlist
+	jwtIdentity      *JWTIdentity // attributes connections to the claims of client tokens
+	upstreamUser     string
+	upstreamPassword string
+	cancelKeys       *cancelKeys
+	paramLabels      []ParameterLabel
+	paramLabelSize   int // largest bound value taken as a label
+	quotaReporter    domain.QuotaReporter
+	captureParams    bool          // record the values bound to prepared statements
+	reconnect        bool          // replace lost upstream connections outside transactions
+	maxMessageSize   int           // largest client message accepted; zero for no limit
+	maxBuffered      int64         // bytes of statements and portals a connection may hold; zero for no limit
+	connectionID     int64         // Atomic counter for connection IDs
+	drain            chan struct{} // closed by Drain
+	drainOnce        sync.Once
+}
+
+// ConnectionHandlerOption configures optional behavior of a PostgreSQLConnectionHandler
+type ConnectionHandlerOption func(*PostgreSQLConnectionHandler)
+
+// WithFaultInjector sets the fault injector consulted before every client read
+func WithFaultInjector(faults domain.FaultInjector) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.faults = faults
+	}
+}
+
+// WithPolicyEngine sets the policy engine evaluated for every SQL query
+func WithPolicyEngine(engine domain.PolicyEngine) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.policyEngine = engine
+	}
+}
+
+// WithMaintenanceGate sets the gate consulted before admitting a new client connection
+func WithMaintenanceGate(gate domain.MaintenanceGate) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.maintenance = gate
+	}
+}
+
+// WithConnectionLimiter sets the limiter capping the concurrent connections of principals
+func WithConnectionLimiter(limiter domain.ConnectionLimiter) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.limiter = limiter
+	}
+}
+
+// WithAccessController rejects the connections of users logging in from
+// addresses their access list does not admit
+func WithAccessController(access domain.AccessController) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.access = access
+	}
+}
+
+// WithGSSEncryptionTunnel relays the connections of clients requesting GSSAPI
+// encryption to the upstream of their listener byte for byte, when the upstream
+// accepts it. The enforcer cannot read such connections: none of their queries
+// are enforced, logged or counted.
+func WithGSSEncryptionTunnel() ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.gssTunnel = true
+	}
+}
+
+// WithQuotaReporter answers the simple queries SELECT quota_remaining() and
+// SELECT * FROM pgqe.usage with the quotas reporter reports, without reaching
+// the upstream or being charged
+func WithQuotaReporter(reporter domain.QuotaReporter) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.quotaReporter = reporter
+	}
+}
+
+// WithConnectionTracker sets the tracker told when connections go idle and become busy,
+// which may evict idle connections
+func WithConnectionTracker(tracker domain.ConnectionTracker) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.connections = tracker
+	}
+}
+
+// WithUpstreams enables proxy mode: each client connection that sends a startup
+// packet is paired with a connection to an upstream picked by selector, and
+// messages are relayed in both directions after being evaluated
+func WithUpstreams(selector domain.UpstreamSelector) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.upstreams = selector
+	}
+}
+
+// WithListenerUpstreams proxies the connections accepted by the named listener
+// to upstreams picked by selector, encrypted with tlsConfig when it is not nil,
+// instead of the upstreams set with WithUpstreams. The connections of other
+// listeners go to those.
+func WithListenerUpstreams(listener string, selector domain.UpstreamSelector, tlsConfig *tls.Config) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		if h.listenerRoutes == nil {
+			h.listenerRoutes = make(map[string]upstreamRoute)
+		}
+		h.listenerRoutes[listener] = upstreamRoute{selector: selector, tlsConfig: tlsConfig}
+	}
+}
+
+// WithDatabaseUpstreams proxies the connections to database, as named in the
+// client's startup packet, to upstreams picked by selector, encrypted with
+// tlsConfig when it is not nil, instead of those of their listener; a nil
+// selector keeps them. A non-empty upstreamDatabase is the database logged into
+// upstream instead. Quota policies still see the name clients connect to.
+func WithDatabaseUpstreams(database, upstreamDatabase string, selector domain.UpstreamSelector, tlsConfig *tls.Config) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		if h.databaseRoutes == nil {
+			h.databaseRoutes = make(map[string]upstreamRoute)
+		}
+		h.databaseRoutes[database] = upstreamRoute{selector: selector, tlsConfig: tlsConfig, database: upstreamDatabase}
+	}
+}
+
+// WithUpstreamPool shares upstream connections between clients through pool
+// instead of opening one per client. Pooling needs local authentication, since
+// pooled connections are logged in with the enforcer's credentials and clients
+// are answered by the enforcer itself; without it the pool is not used.
+func WithUpstreamPool(pool *UpstreamPool) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.pool = pool
+	}
+}
+
+// WithUpstreamTLS encrypts upstream connections with config, negotiated through an
+// SSLRequest as libpq does. Upstreams that decline are treated as unreachable.
+// Without a ServerName in config, the host of each target is sent as SNI and
+// checked against its certificate.
+func WithUpstreamTLS(config *tls.Config) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.upstreamTLS = config
+	}
+}
+
+// WithTLS answers SSLRequests by terminating TLS with config and parsing the rest
+// of the connection over the encrypted stream. Without it SSLRequests are declined
+// and clients fall back to plaintext or give up, depending on their sslmode.
+func WithTLS(config *tls.Config) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.tlsConfig = config
+	}
+}
+
+// WithRequiredTLS rejects plaintext connections of the given users; "*" requires
+// TLS from every user
+func WithRequiredTLS(users ...string) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.tlsRequired = make(map[string]bool, len(users))
+		for _, user := range users {
+			h.tlsRequired[user] = true
+		}
+	}
+}
+
+// WithLocalAuth authenticates clients against userlist instead of relaying their
+// authentication to the upstream. Clients with an MD5 verifier authenticate with
+// MD5 and the others with SCRAM-SHA-256.
+func WithLocalAuth(userlist *Userlist) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.userlist = userlist
+	}
+}
+
+// WithUpstreamCredentials sets the role locally authenticated clients, and clients
+// presenting a token as their password, are logged into the upstream as. An
+// empty user keeps the client's; an empty password uses the client's when the
+// userlist holds it in plaintext.
+func WithUpstreamCredentials(user, password string) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.upstreamUser = user
+		h.upstreamPassword = password
+	}
+}
+
+// WithParameterCapture records the values bound to prepared statements in the
+// protocol log and on the queries of their executions. Values may hold personal
+// data, so they are left out by default.
+func WithParameterCapture() ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.captureParams = true
+	}
+}
+
+// WithParameterLabels labels the executions of prepared statements with the
+// values bound to them, up to maxSize bytes; zero uses DefaultParameterLabelSize.
+// The protocol log only records the size of the values, unless parameter capture
+// is enabled.
+func WithParameterLabels(maxSize int, labels ...ParameterLabel) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		if maxSize <= 0 {
+			maxSize = DefaultParameterLabelSize
+		}
+		h.paramLabels = labels
+		h.paramLabelSize = maxSize
+	}
+}
+
+// WithClock sets the clock timing statements until the upstream completes them
+func WithClock(clock domain.Clock) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.clock = clock
+	}
+}
+
+// WithReadTimeout sets how long a client read may block before the handler checks
+// for shutdown and eviction again
+func WithReadTimeout(timeout time.Duration) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.readTimeout = timeout
+	}
+}
+
+// WithIdleTimeouts closes the connections of clients the upstream waits on for
+// longer than idle outside a transaction, or than idleInTransaction inside one,
+// with the FATAL errors of PostgreSQL's idle_session_timeout and
+// idle_in_transaction_session_timeout. A client idle in a transaction holds its
+// upstream connection, and the locks of its transaction, until it is closed.
+// Zero leaves either unlimited.
+func WithIdleTimeouts(idle, idleInTransaction time.Duration) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.idleTimeout = idle
+		h.idleInTxTimeout = idleInTransaction
+	}
+}
+
+// WithMaxMessageSize closes the connections of clients sending a message larger
+// than size bytes, before it is read into memory
+func WithMaxMessageSize(size int) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.maxMessageSize = size
+	}
+}
+
+// WithMaxConnectionBuffer closes the connections whose prepared statements and
+// portals hold more than size bytes, the text and bound values the handler
+// keeps to charge their executions
+func WithMaxConnectionBuffer(size int64) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.maxBuffered = size
+	}
+}
+
+// WithUpstreamReconnect replaces the upstream connection of a client when it is
+// lost outside a transaction, such as when the upstream restarts, instead of
+// closing the client connection. A simple query in flight is sent again when it
+// only reads and nothing of its result reached the client. Clients holding named
+// prepared statements are not reconnected, since the statements would be gone,
+// and neither are those the upstream asks for a password the enforcer does not
+// hold. Other session state than the parameters set with SET, such as temporary
+// tables, is lost. Pooled connections are not reconnected.
+func WithUpstreamReconnect() ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.reconnect = true
+	}
+}
+
+// WithUpstreamTimeout bounds dialing an upstream and completing its startup handshake
+func WithUpstreamTimeout(timeout time.Duration) ConnectionHandlerOption {
+	return func(h *PostgreSQLConnectionHandler) {
+		h.upstreamTimeout = timeout
+	}
 }
 
 // NewPostgreSQLConnectionHandler creates a new PostgreSQL connection handler
-func NewPostgreSQLConnectionHandler(queryLogger domain.QueryLogger, normalizer domain.QueryNormalizer, log logger.Logger) domain.ConnectionHandler {
-	return &PostgreSQLConnectionHandler{
-		queryLogger: queryLogger,
-		normalizer:  normalizer,
-		logger:      log,
-		readTimeout: 30 * time.Second,
+func NewPostgreSQLConnectionHandler(queryLogger domain.QueryLogger, normalizer domain.QueryNormalizer, log logger.Logger, opts ...ConnectionHandlerOption) domain.ConnectionHandler {
+	handler := &PostgreSQLConnectionHandler{
+		queryLogger:     queryLogger,
+		normalizer:      normalizer,
+		logger:          log,
+		readTimeout:     30 * time.Second,
+		upstreamTimeout: defaultUpstreamTimeout,
+		faults:          NoopFaultInjector{},
+		clock:           SystemClock{},
+		cancelKeys:      newCancelKeys(),
+		drain:           make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(handler)
+	}
+
+	return handler
+}
+
+// Drain rejects new connections and closes each open one once its client is
+// outside a transaction with no query in flight, so no transaction is cut short
+func (h *PostgreSQLConnectionHandler) Drain() {
+	h.drainOnce.Do(func() {
+		h.logger.Info("Draining client connections")
+		close(h.drain)
+	})
+}
+
+// draining reports whether Drain was called
+func (h *PostgreSQLConnectionHandler) draining() bool {
+	select {
+	case <-h.drain:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -51,8 +503,187 @@ func (h *PostgreSQLConnectionHandler) HandleConnection(ctx context.Context, conn
 	connLogger.Info("New PostgreSQL connection established")
 
 	// Create PostgreSQL protocol parser
-	// Note: We're creating a dummy writer since we're only parsing, not responding
-	parser := NewPostgreSQLParser(conn, io.Discard)
+	// Note: without an upstream only startup-phase replies and quota errors are written back to clients
+	parser := NewPostgreSQLParser(conn, conn)
+	parser.SetMaxMessageSize(h.maxMessageSize)
+	writer := NewPostgreSQLResponseWriter(parser)
+
+	// Clients speaking the full protocol begin with a startup packet; raw
+	// message streams (e.g. replayed captures) skip straight to the loop
+	if err := conn.SetReadDeadline(time.Now().Add(h.readTimeout)); err != nil {
+		connLogger.Error("Failed to set read deadline: %v", err)
+		return fmt.Errorf("failed to set read deadline: %w", err)
+	}
+	hasStartup, err := parser.HasStartup()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			connLogger.Info("Connection closed by client")
+			return nil
+		}
+		return fmt.Errorf("failed to read from client: %w", err)
+	}
+	listener := domain.ListenerName(ctx)
+	session := domain.Session{ConnectionID: connectionID, Listener: listener, ClientAddr: conn.RemoteAddr().String()}
+	if hasStartup {
+		var admitted bool
+		session, admitted, err = h.startup(ctx, connectionID, parser, writer, conn, connLogger)
+		if err != nil {
+			connLogger.Error("Error during startup: %v", err)
+			return fmt.Errorf("error during startup: %w", err)
+		}
+		if !admitted {
+			return nil
+		}
+		connLogger = connLogger.WithField("user", session.User).WithField("database", session.Database)
+
+		// Connections beyond a cap are refused like PostgreSQL refuses them
+		if h.limiter != nil {
+			release, decision := h.limiter.AcquireConnection(session)
+			if !decision.Allowed() {
+				connLogger.Info("Rejecting connection: %s (policy %s allows %d)", decision.Reason, decision.Policy, decision.Limit)
+				return writer.Reject(pgerrTooManyConnections, decision.Reason)
+			}
+			defer release()
+			session.UpstreamParameters = decision.StartupParameters
+		}
+		for name, value := range session.Labels {
+			connLogger = connLogger.WithField("label."+name, value)
+		}
+
+		// Let the query logger attribute the connection's queries to its tenant
+		if sessionLogger, ok := h.queryLogger.(domain.SessionLogger); ok {
+			if err := sessionLogger.StartSession(session); err != nil {
+				connLogger.Error("Failed to log session: %v", err)
+			}
+			defer sessionLogger.EndSession(connectionID)
+		}
+	}
+
+	route := h.route(listener, session.Database)
+
+	// Idle connections may be evicted from another goroutine; the eviction interrupts
+	// the pending read so the loop below notices it
+	var evicted chan struct{}
+	var terminated chan struct{}
+	sessions, _ := h.connections.(domain.SessionRegistry)
+	if h.connections != nil && (session.User != "" || session.Database != "") {
+		evicted = make(chan struct{})
+		h.connections.Track(connectionID, session.User, session.Database, func() {
+			close(evicted)
+			_ = conn.SetReadDeadline(time.Now())
+		})
+		defer h.connections.Untrack(connectionID)
+
+		// Administrators may terminate the connection the same way
+		if sessions != nil {
+			terminated = make(chan struct{})
+			sessions.Register(session, func() {
+				close(terminated)
+				_ = conn.SetReadDeadline(time.Now())
+			})
+		}
+	}
+
+	// A drain or a shutdown interrupts the pending read so the loop below notices it
+	stopWaking := make(chan struct{})
+	defer close(stopWaking)
+	go func() {
+		for _, wake := range []<-chan struct{}{h.drain, ctx.Done()} {
+			select {
+			case <-wake:
+				_ = conn.SetReadDeadline(time.Now())
+			case <-stopWaking:
+				return
+			}
+		}
+	}()
+
+	// Statement results are logged and charged to metered quotas as they complete
+	meter := newResultMeter(h.policyEngine, h.queryLogger, &session, h.clock, route.selector == nil || !hasStartup, connLogger)
+
+	// The session state of proxied connections is followed so that they are
+	// never marked idle, and evicted, inside a transaction
+	var report func(domain.SessionState)
+	if sessions, ok := h.connections.(domain.SessionStateTracker); ok {
+		report = func(state domain.SessionState) {
+			sessions.UpdateSession(connectionID, state)
+		}
+	}
+	state := newSessionTracker(route.selector == nil || !hasStartup, report)
+
+	// Statements running longer than the timeout of their policies are cancelled
+	// upstream through the client's cancel key, known once connected
+	var cancelKey uint32
+	timeouts := newStatementTimeouts(h.clock, func(policy string, timeout time.Duration) {
+		connLogger.Info("Cancelling statement running longer than the %s timeout of quota %q", timeout, policy)
+		h.cancelStatement(ctx, cancelKey, connLogger)
+	})
+	defer timeouts.close()
+
+	// Statements returning larger results than the caps of their policies are
+	// cancelled the same way
+	caps := newResultCaps(func(policy string) {
+		connLogger.Info("Cancelling statement returning more than the result cap of quota %q", policy)
+		h.cancelStatement(ctx, cancelKey, connLogger)
+	})
+
+	// Transactions open longer, or running more statements, than the limits of
+	// their policies get the connection closed, which rolls them back
+	transactions := newTransactionLimits(h.clock, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer transactions.close()
+
+	// In proxy mode, pair the client with an upstream connection, or with the
+	// pooled ones assigned to it in turn
+	var upstream *upstreamConnection
+	var pooled *pooledClient
+	var upstreamDone chan struct{}
+	if route.selector != nil && hasStartup && h.pool != nil && h.userlist != nil {
+		pooled, err = h.connectPooled(ctx, route, parser, writer, conn, session, meter, state, timeouts, caps, transactions, connLogger)
+		if err != nil {
+			connLogger.Error("Error connecting to upstream: %v", err)
+			return fmt.Errorf("error connecting to upstream: %w", err)
+		}
+		if pooled == nil {
+			return nil
+		}
+		upstreamDone = pooled.failed
+		cancelKey = pooled.cancelKey
+		defer pooled.close()
+	} else if route.selector != nil && hasStartup {
+		upstream, err = h.connectUpstream(ctx, route, parser, writer, session, connLogger)
+		if err != nil {
+			connLogger.Error("Error connecting to upstream: %v", err)
+			return fmt.Errorf("error connecting to upstream: %w", err)
+		}
+		if upstream == nil {
+			return nil
+		}
+
+		upstreamDone = h.startRelay(ctx, upstream, parser, writer, conn, meter, state, timeouts, caps, transactions, connLogger)
+		cancelKey = upstream.cancelKey
+		defer func() {
+			h.closeUpstream(upstream)
+			<-upstreamDone
+		}()
+	}
+
+	extended := newExtendedProtocolState()
+
+	// synced is false while the client is in the middle of an extended protocol
+	// exchange it has not ended with a Sync yet
+	synced := true
+
+	// With upstream reconnects, retry is the simple query sent again on the new
+	// upstream connection when the connection is lost before answering it, and
+	// retryRelayed the messages relayed to the client before it was sent
+	var retry *pgproto3.Query
+	var retryRelayed int64
+
+	// idleSince is when the upstream last answered everything the client sent,
+	// zero while it has not or the client has sent something since
+	var idleSince time.Time
 
 	// Process messages in a loop until connection is closed or context is cancelled
 	for {
@@ -60,42 +691,464 @@ func (h *PostgreSQLConnectionHandler) HandleConnection(ctx context.Context, conn
 		case <-ctx.Done():
 			connLogger.Info("Connection handler stopped due to context cancellation")
 			return ctx.Err()
+		case <-evicted:
+			connLogger.Info("Evicting idle connection")
+			return h.evict(writer, session)
+		case <-terminated:
+			connLogger.Info("Terminating connection on administrator request")
+			return h.terminate(ctx, writer, upstream, pooled, pgerrAdminShutdown, "terminating connection due to administrator command", connLogger)
+		case <-transactions.exceeded:
+			violation := transactions.violated()
+			connLogger.Info("Closing connection whose transaction exceeded its limits: %s; statements run: %s",
+				violation.reason, strings.Join(violation.fingerprints, ", "))
+			if err := h.queryLogger.LogProtocolMessage(connectionID, "TransactionKilled", map[string]interface{}{
+				"reason":       violation.reason,
+				"fingerprints": violation.fingerprints,
+			}); err != nil {
+				connLogger.Error("Failed to log killed transaction: %v", err)
+			}
+			return h.terminate(ctx, writer, upstream, pooled, violation.code, violation.reason, connLogger)
+		case <-upstreamDone:
+			if upstream != nil && !upstream.lost {
+				// The client is gone
+				return nil
+			}
+			if upstream != nil && h.reconnect && synced && !extended.named() {
+				resend := retry
+				retry = nil
+				idle := writer.Idle()
+				if !idle && (resend == nil || writer.Relayed() != retryRelayed) {
+					resend = nil
+				}
+				if idle || resend != nil {
+					replaced, err := h.reconnectUpstream(ctx, route, session, upstream, state.current().Parameters)
+					if err == nil && resend != nil {
+						err = h.sendUpstream(ctx, replaced, resend)
+						if err != nil {
+							h.closeUpstream(replaced)
+						}
+					}
+					if err == nil {
+						upstream = replaced
+						upstreamDone = h.startRelay(ctx, upstream, parser, writer, conn, meter, state, timeouts, caps, transactions, connLogger)
+						if resend != nil {
+							connLogger.Info("Upstream connection lost, reconnected to %s and sent the query again", upstream.address)
+						} else {
+							connLogger.Info("Upstream connection lost, reconnected to %s", upstream.address)
+						}
+						continue
+					}
+					connLogger.Error("Failed to reconnect to upstream: %v", err)
+				}
+			}
+			connLogger.Info("Upstream connection lost")
+			return h.upstreamLost(parser, writer, upstream, connLogger)
 		default:
+			// Apply injected faults (no-op unless built with the chaos tag)
+			if err := h.faults.Inject(ctx, domain.FaultPointClientRead); err != nil {
+				connLogger.Error("Injected fault on client read: %v", err)
+				return fmt.Errorf("client read failed: %w", err)
+			}
+
+			if h.connections != nil && state.idle(writer) {
+				h.connections.Idle(connectionID)
+			}
+
+			// Clients idle for longer than their idle timeout are closed; the read
+			// returns in time to close them
+			readTimeout := h.readTimeout
+			if hasStartup && (h.idleTimeout > 0 || h.idleInTxTimeout > 0) {
+				answered, status := state.answered(writer)
+				timeout, code, reason := h.idleLimit(status)
+				if !synced || !answered || timeout == 0 {
+					idleSince = time.Time{}
+				} else {
+					now := h.clock.Now()
+					if idleSince.IsZero() {
+						idleSince = now
+					}
+					idle := now.Sub(idleSince)
+					if idle >= timeout {
+						connLogger.Info("Closing connection idle for %s, over the timeout of %s", idle, timeout)
+						return writer.Reject(code, reason)
+					}
+					readTimeout = min(readTimeout, timeout-idle)
+				}
+			}
+
 			// Set read timeout
-			if err := conn.SetReadDeadline(time.Now().Add(h.readTimeout)); err != nil {
+			if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
 				connLogger.Error("Failed to set read deadline: %v", err)
 				return fmt.Errorf("failed to set read deadline: %w", err)
 			}
 
+			// While draining, connections are closed between transactions; the
+			// upstream relay interrupts the read once a transaction ends
+			if synced && writer.Idle() && h.draining() {
+				connLogger.Info("Closing drained connection")
+				return writer.Reject(pgerrAdminShutdown, "terminating connection due to administrator command")
+			}
+
 			// Read and parse PostgreSQL message
 			message, err := parser.ReadMessage()
 			if err != nil {
-				if err == io.EOF {
+				if errors.Is(err, io.EOF) {
 					connLogger.Info("Connection closed by client")
 					return nil
 				}
 
 				// Check if it's a timeout error (expected during graceful shutdown)
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
 					// Continue loop to check context cancellation
 					continue
 				}
 
+				// The oversized message is left unread, so the stream cannot go on
+				var tooLarge *pgproto3.ExceededMaxBodyLenErr
+				if errors.As(err, &tooLarge) {
+					connLogger.Error("Closing connection sending a message of %d bytes, over the limit of %d", tooLarge.ActualBodyLen, tooLarge.MaxExpectedBodyLen)
+					return writer.Reject(pgerrProgramLimitExceeded, fmt.Sprintf("message of %d bytes exceeds the limit of %d bytes", tooLarge.ActualBodyLen, tooLarge.MaxExpectedBodyLen))
+				}
+
 				connLogger.Error("Error parsing PostgreSQL message: %v", err)
 				return fmt.Errorf("error parsing PostgreSQL message: %w", err)
 			}
+			idleSince = time.Time{}
+
+			// Messages racing an eviction are dropped
+			if h.connections != nil && !h.connections.Busy(connectionID) {
+				continue
+			}
+
+			switch message.Type {
+			case "Query", "Sync":
+				synced = true
+			case "Parse", "Bind", "Describe", "Execute", "Close", "Flush":
+				synced = false
+			}
+
+			// After a denied extended protocol message, skip to the client's Sync
+			if extended.denied != nil {
+				if message.Type != "Sync" {
+					continue
+				}
+				decision := *extended.denied
+				extended.denied = nil
+				if upstream == nil && pooled == nil {
+					if err := writer.Deny(decision); err != nil {
+						return err
+					}
+					continue
+				}
+				writer.DenyBeforeReady(decision)
+			}
+
+			// Queries on quotas are answered here, after the answers to the
+			// queries the upstream still runs
+			if h.quotaReporter != nil && message.Type == "Query" && virtualQuery(message.Query) {
+				if err := h.queryLogger.LogQuery(connectionID, message.Query); err != nil {
+					connLogger.Error("Failed to log query: %v", err)
+				}
+				if err := h.answerVirtualQuery(ctx, &session, writer, message.Query); err != nil {
+					return err
+				}
+				continue
+			}
 
 			// Process the parsed message
-			if err := h.processMessage(connectionID, message); err != nil {
+			queries, decision, err := h.processMessage(ctx, &session, extended, message)
+			if err != nil {
 				connLogger.Error("Error processing message: %v", err)
 				// Continue processing even if logging fails
 			}
+			if h.maxBuffered > 0 && extended.buffered > h.maxBuffered {
+				decision.Finish()
+				connLogger.Error("Closing connection holding %d bytes of prepared statements and portals, over the limit of %d", extended.buffered, h.maxBuffered)
+				return writer.Reject(pgerrOutOfMemory, fmt.Sprintf("prepared statements and portals exceed the limit of %d bytes of the connection", h.maxBuffered))
+			}
+
+			// Statements hold their concurrency slots until the upstream
+			// answers them, and free them at once when they do not run
+			if !decision.Allowed() || (upstream == nil && pooled == nil) {
+				decision.Finish()
+			}
+
+			// Denied messages are answered here and never reach the upstream
+			if !decision.Allowed() {
+				if message.Type != "Query" {
+					extended.denied = &decision
+					continue
+				}
+				if err := writer.Deny(decision); err != nil {
+					return err
+				}
+				continue
+			}
+			if len(decision.Warnings) > 0 {
+				if upstream == nil && pooled == nil {
+					if err := writer.Warn(decision); err != nil {
+						return err
+					}
+				} else {
+					writer.WarnBeforeNext(decision)
+				}
+			}
+
+			if decision.Rewrite != "" {
+				rewriteMessage(message, decision.Rewrite)
+			}
+
+			var query *domain.Query
+			if len(queries) > 0 {
+				query = queries[0]
+			}
+			meter.observeClient(ctx, message, queries...)
+			state.observeClient(message, query)
+			if upstream != nil || pooled != nil {
+				timeouts.observeClient(message, decision)
+				caps.observeClient(message, decision)
+				transactions.observeClient(message, queries, decision)
+			}
+			if sessions != nil && query != nil && message.Type != "Parse" {
+				raw := query.Raw
+				if message.Type == "Query" {
+					raw = message.Query
+				}
+				sessions.QueryStarted(connectionID, raw)
+			}
+
+			// Forward the message once it has been evaluated. Pooled connections
+			// outlive the client, so its Terminate stays here.
+			if pooled != nil {
+				if message.Type == "Terminate" {
+					return nil
+				}
+				sent, err := pooled.send(ctx, message, synced)
+				if err != nil {
+					connLogger.Error("Error forwarding message: %v", err)
+					return fmt.Errorf("error forwarding message: %w", err)
+				}
+				if !sent {
+					return nil
+				}
+			} else if upstream != nil {
+				if h.reconnect {
+					retry = nil
+					if query, ok := message.Message.(*pgproto3.Query); ok && writer.Idle() && retryableQuery(query.String) {
+						retry = &pgproto3.Query{String: query.String}
+						retryRelayed = writer.Relayed()
+					}
+				}
+				if message.Type == "Query" || message.Type == "Sync" {
+					writer.Await()
+				}
+				if err := h.sendUpstream(ctx, upstream, message.Message); err != nil {
+					// Closing the connection stops the relay, which the loop waits for
+					connLogger.Debug("Error forwarding message: %v", err)
+					_ = upstream.Close()
+					continue
+				}
+				if message.Type == "Terminate" {
+					return nil
+				}
+			}
 		}
 	}
 }
 
-// processMessage handles different types of PostgreSQL messages
-func (h *PostgreSQLConnectionHandler) processMessage(connectionID string, message *ParsedMessage) error {
+// startup processes the startup phase and reports whether the connection may continue,
+// along with the session the client declared in its StartupMessage.
+// SSLRequests are accepted when TLS is configured and the parser continues over the
+// encrypted stream; other encryption requests are declined so clients fall back to plaintext.
+func (h *PostgreSQLConnectionHandler) startup(ctx context.Context, connectionID string, parser *PostgreSQLParser, writer *PostgreSQLResponseWriter, conn net.Conn, connLogger logger.Logger) (domain.Session, bool, error) {
+	encrypted := false
+	for {
+		message, err := parser.ReadStartupMessage()
+		if err != nil {
+			return domain.Session{}, false, err
+		}
+
+		var labels map[string]string
+		var params map[string]string
+		if message.Type == "StartupMessage" {
+			params = make(map[string]string, len(message.Details))
+			for name, value := range message.Details {
+				if s, ok := value.(string); ok {
+					params[name] = s
+				}
+			}
+			labels = ParseConnectionLabels(params)
+			if labels != nil {
+				message.Details["labels"] = labels
+			}
+			h.redactToken(message.Details)
+		}
+
+		if err := h.queryLogger.LogProtocolMessage(connectionID, message.Type, message.Details); err != nil {
+			connLogger.Error("Failed to log protocol message: %v", err)
+		}
+
+		switch message.Type {
+		case "SSLRequest":
+			if encrypted {
+				return domain.Session{}, false, fmt.Errorf("received SSLRequest over TLS")
+			}
+			if h.tlsConfig == nil {
+				if _, err := conn.Write([]byte{'N'}); err != nil {
+					return domain.Session{}, false, fmt.Errorf("failed to decline encryption: %w", err)
+				}
+				continue
+			}
+			if err := h.startTLS(ctx, parser, conn); err != nil {
+				return domain.Session{}, false, err
+			}
+			encrypted = true
+		case "GSSEncRequest":
+			if encrypted {
+				return domain.Session{}, false, fmt.Errorf("received GSSEncRequest over TLS")
+			}
+			tunnelled, err := h.answerGSSEncRequest(ctx, conn, domain.ListenerName(ctx), connLogger)
+			if err != nil || tunnelled {
+				return domain.Session{}, false, err
+			}
+		case "StartupMessage":
+			session := domain.Session{
+				ConnectionID:    connectionID,
+				User:            params["user"],
+				Database:        params["database"],
+				ApplicationName: params["application_name"],
+				Labels:          labels,
+				Parameters:      params,
+				TLS:             encrypted,
+				Listener:        domain.ListenerName(ctx),
+				ClientAddr:      conn.RemoteAddr().String(),
+			}
+			if session.Database == "" {
+				session.Database = session.User
+			}
+			if h.access != nil && !h.access.AdmitUser(session.Listener, session.User, conn.RemoteAddr()) {
+				connLogger.Info("Rejecting connection of %s from %s", session.User, session.ClientAddr)
+				host, _, err := net.SplitHostPort(session.ClientAddr)
+				if err != nil {
+					host = session.ClientAddr
+				}
+				return session, false, writer.Reject(pgerrInvalidAuthorization,
+					fmt.Sprintf("connection from host %q rejected for user %q", host, session.User))
+			}
+			if !encrypted && (h.tlsRequired["*"] || h.tlsRequired[session.User]) {
+				connLogger.Info("Rejecting plaintext connection of %s", session.User)
+				return session, false, writer.Reject(pgerrInvalidAuthorization,
+					fmt.Sprintf("SSL connection is required for user %q", session.User))
+			}
+			if h.userlist != nil {
+				authenticated, err := h.authenticate(parser, writer, session.User, connLogger)
+				if err != nil || !authenticated {
+					return session, false, err
+				}
+			}
+			if h.jwtIdentity != nil {
+				authenticated, err := h.authenticateJWT(parser, writer, &session, connLogger)
+				if err != nil || !authenticated {
+					return session, false, err
+				}
+			}
+			admitted, err := h.admit(ctx, writer, session.Database, connLogger)
+			return session, admitted, err
+		case "CancelRequest":
+			// CancelRequest connections carry nothing else
+			if request, ok := message.Message.(*pgproto3.CancelRequest); ok {
+				h.cancel(ctx, request, connLogger)
+			}
+			return domain.Session{}, false, nil
+		default:
+			return domain.Session{}, false, nil
+		}
+	}
+}
+
+// startTLS accepts an SSLRequest, completes the TLS handshake within the pending
+// read deadline and switches the parser to the encrypted stream
+func (h *PostgreSQLConnectionHandler) startTLS(ctx context.Context, parser *PostgreSQLParser, conn net.Conn) error {
+	if _, err := conn.Write([]byte{'S'}); err != nil {
+		return fmt.Errorf("failed to accept encryption: %w", err)
+	}
+
+	tlsConn := tls.Server(conn, h.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	parser.Upgrade(tlsConn, tlsConn)
+	return nil
+}
+
+// admit consults the maintenance gate and rejects the connection during
+// maintenance or while the handler drains
+func (h *PostgreSQLConnectionHandler) admit(ctx context.Context, writer *PostgreSQLResponseWriter, database string, connLogger logger.Logger) (bool, error) {
+	if h.draining() {
+		connLogger.Info("Rejecting connection to %s while draining", database)
+		return false, writer.Reject(pgerrCannotConnectNow, "the server is shutting down")
+	}
+	if h.maintenance == nil {
+		return true, nil
+	}
+
+	window, err := h.maintenance.Admit(ctx, database)
+	if err != nil {
+		return false, err
+	}
+	if window == nil {
+		return true, nil
+	}
+
+	connLogger.Info("Rejecting connection to %s during maintenance", database)
+	return false, writer.Reject(pgerrCannotConnectNow, window.Message)
+}
+
+// evict tells the client its idle connection is being closed
+func (h *PostgreSQLConnectionHandler) evict(writer *PostgreSQLResponseWriter, session domain.Session) error {
+	return writer.Reject(pgerrTooManyConnections,
+		fmt.Sprintf("idle connection evicted: too many idle connections for role %q on database %q", session.User, session.Database))
+}
+
+// idleLimit returns how long a client in the given transaction status may stay
+// idle, and the FATAL error closing its connection once it has
+func (h *PostgreSQLConnectionHandler) idleLimit(status domain.TransactionStatus) (time.Duration, string, string) {
+	if status == domain.TransactionIdle {
+		return h.idleTimeout, pgerrIdleSessionTimeout, "terminating connection due to idle-session timeout"
+	}
+	return h.idleInTxTimeout, pgerrIdleInTransactionTimeout, "terminating connection due to idle-in-transaction timeout"
+}
+
+// terminate closes a connection an administrator terminated, or whose
+// transaction exceeded its limits, as pg_terminate_backend does: the query the
+// client runs is cancelled, a proxied upstream connection is told to terminate
+// too, and the client is sent a FATAL error with code and message. Pooled
+// connections are reused when the client was idle.
+func (h *PostgreSQLConnectionHandler) terminate(ctx context.Context, writer *PostgreSQLResponseWriter, upstream *upstreamConnection, pooled *pooledClient, code, message string, connLogger logger.Logger) error {
+	var processID uint32
+	switch {
+	case upstream != nil:
+		processID = upstream.cancelKey
+	case pooled != nil:
+		processID = pooled.cancelKey
+	}
+	if !writer.Idle() {
+		h.cancelStatement(ctx, processID, connLogger)
+	}
+	if upstream != nil {
+		if err := upstream.Send(&pgproto3.Terminate{}); err != nil {
+			connLogger.Debug("Failed to terminate upstream connection: %v", err)
+		}
+	}
+	return writer.Reject(code, message)
+}
+
+// processMessage handles different types of PostgreSQL messages and returns the
+// queries and quota decision of those that run some: the statements of a simple
+// query holding several, or the one query of others
+func (h *PostgreSQLConnectionHandler) processMessage(ctx context.Context, session *domain.Session, extended *extendedProtocolState, message *ParsedMessage) ([]*domain.Query, domain.Decision, error) {
+	connectionID := session.ConnectionID
 	switch message.Type {
 	case "Query", "Parse":
 		// Log and normalize SQL queries
@@ -104,22 +1157,255 @@ func (h *PostgreSQLConnectionHandler) processMessage(connectionID string, messag
 			if err := h.queryLogger.LogQuery(connectionID, message.Query); err != nil {
 				h.logger.Error("Failed to log query: %v", err)
 			}
+			if message.Type == "Query" {
+				if statements := splitStatements(message.Query); statements != nil {
+					queries, decision := h.evaluateStatements(ctx, session, statements)
+					return queries, decision, nil
+				}
+			}
+
+			query := sessionQuery(message.Query, session)
+			query.Kind = domain.QueryKindSimple
 
 			// Normalize the query and log normalized version
-			normalizedQuery, err := h.normalizer.Normalize(message.Query)
-			if err != nil {
-				h.logger.Error("Failed to normalize query: %v", err)
-				// Continue processing even if normalization fails
-			} else {
-				if err := h.queryLogger.LogNormalizedQuery(connectionID, normalizedQuery); err != nil {
-					h.logger.Error("Failed to log normalized query: %v", err)
+			normalizedQuery, err := h.normalize(message)
+			h.fingerprint(query, normalizedQuery, err)
+
+			if message.Type == "Parse" {
+				query.Kind = domain.QueryKindParse
+			}
+
+			decision := h.evaluateQuota(ctx, query)
+
+			// Remember prepared statements so their executions can be charged
+			if message.Type == "Parse" && decision.Allowed() {
+				statement := preparedStatement{raw: message.Query}
+				if err == nil {
+					statement.normalized = &normalizedQuery
+				}
+				if parse, ok := message.Message.(*pgproto3.Parse); ok {
+					statement.oids = parse.ParameterOIDs
 				}
+				name, _ := message.Details["name"].(string)
+				extended.prepare(name, statement)
+			}
+			return []*domain.Query{query}, decision, nil
+		}
+	case "Bind":
+		name, _ := message.Details["destination_portal"].(string)
+		portal := boundPortal{}
+		portal.statement, _ = message.Details["prepared_statement"].(string)
+		statement, prepared := extended.statements[portal.statement]
+		var fingerprint string
+		if prepared && statement.normalized != nil {
+			fingerprint = statement.normalized.Hash.String()
+			message.Details["query_hash"] = fingerprint
+		}
+		if bind, ok := message.Message.(*pgproto3.Bind); ok {
+			if h.captureParams {
+				portal.parameters = bindParameterValues(bind, statement.oids)
+				message.Details["parameters"] = portal.parameters
+			}
+			if len(h.paramLabels) > 0 && prepared {
+				portal.labels = parameterLabels(h.paramLabels, h.paramLabelSize, fingerprint, statement.oids, bind)
+				switch {
+				case len(portal.labels) == 0:
+				case h.captureParams:
+					message.Details["labels"] = portal.labels
+				default:
+					message.Details["labels"] = redactLabels(portal.labels)
+				}
+			}
+		}
+		extended.bind(name, portal)
+		return nil, domain.AllowDecision(), h.queryLogger.LogProtocolMessage(connectionID, message.Type, message.Details)
+	case "Execute":
+		name, _ := message.Details["portal"].(string)
+		portal, bound := extended.portals[name]
+		statement, prepared := extended.statements[portal.statement]
+		attributed := bound && prepared
+		if attributed {
+			// Correlate the execution with its statement in the protocol log
+			message.Details["statement"] = portal.statement
+			if statement.normalized != nil {
+				message.Details["query_hash"] = statement.normalized.Hash.String()
+			}
+		}
+
+		if err := h.queryLogger.LogProtocolMessage(connectionID, message.Type, message.Details); err != nil {
+			return nil, domain.AllowDecision(), err
+		}
+		if !attributed {
+			// Portals opened before the enforcer saw the connection cannot be attributed
+			return nil, domain.AllowDecision(), nil
+		}
+
+		query := sessionQuery(statement.raw, session)
+		query.Kind = domain.QueryKindExecute
+		query.Parameters = portal.parameters
+		if len(portal.labels) > 0 {
+			labels := maps.Clone(session.Labels)
+			if labels == nil {
+				labels = make(map[string]string, len(portal.labels))
 			}
+			maps.Copy(labels, portal.labels)
+			query.Labels = labels
+		}
+		if statement.normalized != nil {
+			query.Normalized = statement.normalized.Normalized
+			query.Hash = statement.normalized.Hash
 		}
+		return []*domain.Query{query}, h.evaluateQuota(ctx, query), nil
+	case "Close":
+		name, _ := message.Details["name"].(string)
+		if objectType, _ := message.Details["object_type"].(string); objectType == "S" {
+			extended.closeStatement(name)
+		} else {
+			extended.closePortal(name)
+		}
+		return nil, domain.AllowDecision(), h.queryLogger.LogProtocolMessage(connectionID, message.Type, message.Details)
+	case "CopyData":
+		// COPY payload is metered, not logged message by message
+		return nil, domain.AllowDecision(), nil
 	default:
 		// Log other protocol messages
-		return h.queryLogger.LogProtocolMessage(connectionID, message.Type, message.Details)
+		return nil, domain.AllowDecision(), h.queryLogger.LogProtocolMessage(connectionID, message.Type, message.Details)
 	}
 
-	return nil
+	return nil, domain.AllowDecision(), nil
+}
+
+// evaluateStatements evaluates each statement of a simple query holding several
+// as if it was sent alone: it is normalized and checked against the policies on
+// its own. The query is denied as a whole by the first statement denied, none
+// of its statements being charged, and otherwise allowed with the decisions of
+// its statements combined once they are all charged.
+func (h *PostgreSQLConnectionHandler) evaluateStatements(ctx context.Context, session *domain.Session, statements []string) ([]*domain.Query, domain.Decision) {
+	ctx, charges := domain.WithChargeBatch(ctx)
+	queries := make([]*domain.Query, 0, len(statements))
+	decisions := make([]domain.Decision, 0, len(statements))
+	for _, statement := range statements {
+		query := sessionQuery(statement, session)
+		query.Kind = domain.QueryKindSimple
+		normalizedQuery, err := h.normalizer.Normalize(statement)
+		h.fingerprint(query, normalizedQuery, err)
+
+		decision := h.evaluateQuota(ctx, query)
+		if !decision.Allowed() {
+			for _, allowed := range decisions {
+				allowed.Finish()
+			}
+			return []*domain.Query{query}, decision
+		}
+		queries = append(queries, query)
+		decisions = append(decisions, decision)
+	}
+	if err := charges.Commit(ctx); err != nil {
+		h.logger.Error("Failed to charge statements: %v", err)
+	}
+	return queries, batchDecision(statements, decisions)
+}
+
+// fingerprint sets the normalized text and hash of query and logs them, unless
+// the query could not be normalized
+func (h *PostgreSQLConnectionHandler) fingerprint(query *domain.Query, normalizedQuery domain.NormalizedQuery, err error) {
+	if err != nil {
+		h.logger.Error("Failed to normalize query: %v", err)
+		// Continue processing even if normalization fails
+		return
+	}
+	query.Normalized = normalizedQuery.Normalized
+	query.Hash = normalizedQuery.Hash
+	if err := h.queryLogger.LogNormalizedQuery(query.ConnectionID, normalizedQuery); err != nil {
+		h.logger.Error("Failed to log normalized query: %v", err)
+	}
+}
+
+// normalize normalizes the query of a Query or Parse message, looking prepared
+// statements up by name when the normalizer can
+func (h *PostgreSQLConnectionHandler) normalize(message *ParsedMessage) (domain.NormalizedQuery, error) {
+	if statements, ok := h.normalizer.(domain.StatementNormalizer); ok && message.Type == "Parse" {
+		name, _ := message.Details["name"].(string)
+		return statements.NormalizeStatement(name, message.Query)
+	}
+	return h.normalizer.Normalize(message.Query)
+}
+
+// rewriteMessage replaces the text of a Query or Parse message, so that the
+// upstream runs rewritten instead. Other messages are left as they are.
+func rewriteMessage(message *ParsedMessage, rewritten string) {
+	switch msg := message.Message.(type) {
+	case *pgproto3.Query:
+		message.Message = &pgproto3.Query{String: rewritten}
+	case *pgproto3.Parse:
+		message.Message = &pgproto3.Parse{Name: msg.Name, Query: rewritten, ParameterOIDs: msg.ParameterOIDs}
+	default:
+		return
+	}
+	message.Query = rewritten
+}
+
+// bindParameterValues copies the values bound by a Bind message: strings for
+// text parameters and binary ones of the declared types oids can decode, bytes
+// for other binary ones and nil for NULL
+func bindParameterValues(bind *pgproto3.Bind, oids []uint32) []interface{} {
+	values := make([]interface{}, len(bind.Parameters))
+	for i, parameter := range bind.Parameters {
+		if parameter == nil {
+			continue
+		}
+		var oid uint32
+		if i < len(oids) {
+			oid = oids[i]
+		}
+		if value, ok := decodeParameter(parameter, parameterFormat(bind, i), oid); ok {
+			values[i] = value
+		} else {
+			values[i] = bytes.Clone(parameter)
+		}
+	}
+	return values
+}
+
+// sessionQuery creates a query attributed to the user, database and labels of the session
+func sessionQuery(raw string, session *domain.Session) *domain.Query {
+	query := domain.NewQuery(raw, session.ConnectionID)
+	query.UserID = session.User
+	query.Database = session.Database
+	query.ApplicationName = session.ApplicationName
+	query.Labels = session.Labels
+	query.Listener = session.Listener
+	return query
+}
+
+// evaluateQuota consults the policy engine and logs denied queries; allowed ones
+// are reported by the result meter. Queries are allowed when the engine fails, so
+// an unavailable store does not block traffic.
+func (h *PostgreSQLConnectionHandler) evaluateQuota(ctx context.Context, query *domain.Query) domain.Decision {
+	if h.policyEngine == nil {
+		return domain.AllowDecision()
+	}
+
+	started := h.clock.Now()
+	decision, err := h.policyEngine.Evaluate(ctx, query)
+	query.Evaluation = h.clock.Now().Sub(started)
+	if err != nil {
+		h.logger.Error("Failed to evaluate quota: %v", err)
+		return domain.AllowDecision()
+	}
+
+	for _, warning := range decision.Warnings {
+		h.logger.WithField("connection_id", query.ConnectionID).
+			Debug("Quota warning: %s", warning)
+	}
+	if !decision.Allowed() {
+		h.logger.WithField("connection_id", query.ConnectionID).
+			Info("Quota exceeded: %s", decision.Reason)
+		if decisionLogger, ok := h.queryLogger.(domain.DecisionLogger); ok {
+			if err := decisionLogger.LogDecision(query, decision, domain.StatementUsage{}); err != nil {
+				h.logger.Error("Failed to log query decision: %v", err)
+			}
+		}
+	}
+	return decision
 }
@@ -0,0 +1,519 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// startHandler serves handler on an ephemeral port for the duration of the test
+func startHandler(t *testing.T, handler domain.ConnectionHandler) string {
+	t.Helper()
+
+	server := NewStandardTCPServer(handler, logger.NewSimpleLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, server.Start(ctx, "127.0.0.1:0"))
+	<-server.Started()
+
+	t.Cleanup(func() {
+		cancel()
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownCancel()
+		_ = server.Stop(shutdownCtx)
+	})
+	return server.Address()
+}
+
+func TestPostgreSQLConnectionHandler_Maintenance(t *testing.T) {
+	gate := &mocks.MaintenanceGate{}
+	gate.On("Admit", mock.Anything, "reporting").
+		Return(&domain.MaintenanceWindow{Database: "reporting", Message: "reporting is being upgraded"}, nil)
+
+	queryLogger := mocks.NewRecordingQueryLogger()
+	handler := NewPostgreSQLConnectionHandler(queryLogger, NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithMaintenanceGate(gate))
+	addr := startHandler(t, handler)
+
+	_, err := testkit.Dial(addr, testkit.ClientConfig{User: "alice", Database: "reporting"})
+
+	var serverErr *testkit.ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, "FATAL", serverErr.Severity)
+	assert.Equal(t, "57P03", serverErr.Code)
+	assert.Equal(t, "reporting is being upgraded", serverErr.Message)
+
+	gate.AssertExpectations(t)
+	require.NotEmpty(t, queryLogger.ProtocolMessages())
+	assert.Contains(t, queryLogger.ProtocolMessages()[0], "StartupMessage")
+}
+
+func TestPostgreSQLConnectionHandler_UserAccess(t *testing.T) {
+	access := &mocks.AccessController{}
+	access.On("AdmitUser", "", "etl", mock.Anything).Return(false)
+	access.On("AdmitUser", "", "alice", mock.Anything).Return(true)
+
+	engine := &mocks.StaticPolicyEngine{}
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithAccessController(access))
+	addr := startHandler(t, handler)
+
+	_, err := testkit.Dial(addr, testkit.ClientConfig{User: "etl", Database: "app"})
+	var serverErr *testkit.ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, "FATAL", serverErr.Severity)
+	assert.Equal(t, "28000", serverErr.Code)
+	assert.Equal(t, `connection from host "127.0.0.1" rejected for user "etl"`, serverErr.Message)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	frontend := pgproto3.NewFrontend(conn, conn)
+	frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice", "database": "app"},
+	})
+	frontend.Send(&pgproto3.Query{String: "SELECT 1"})
+	require.NoError(t, frontend.Flush())
+
+	require.Eventually(t, func() bool { return len(engine.Queries()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	access.AssertExpectations(t)
+}
+
+func TestPostgreSQLConnectionHandler_Labels(t *testing.T) {
+	engine := &mocks.StaticPolicyEngine{}
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine))
+	addr := startHandler(t, handler)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	frontend := pgproto3.NewFrontend(conn, conn)
+	frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters: map[string]string{
+			"user":       "alice",
+			"database":   "app",
+			"label.team": "billing",
+			"options":    "-c label.workload=etl",
+		},
+	})
+	frontend.Send(&pgproto3.Query{String: "SELECT 1"})
+	require.NoError(t, frontend.Flush())
+
+	require.Eventually(t, func() bool { return len(engine.Queries()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, map[string]string{"team": "billing", "workload": "etl"}, engine.Queries()[0].Labels)
+}
+
+func TestPostgreSQLConnectionHandler_Session(t *testing.T) {
+	engine := &mocks.StaticPolicyEngine{}
+	queryLogger := mocks.NewRecordingQueryLogger()
+	handler := NewPostgreSQLConnectionHandler(queryLogger, NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine))
+	addr := startHandler(t, handler)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// SSLRequest is declined before the StartupMessage
+	_, err = conn.Write(sslRequest)
+	require.NoError(t, err)
+	reply := make([]byte, 1)
+	_, err = conn.Read(reply)
+	require.NoError(t, err)
+	assert.Equal(t, byte('N'), reply[0])
+
+	frontend := pgproto3.NewFrontend(conn, conn)
+	frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters: map[string]string{
+			"user":             "alice",
+			"application_name": "billing-worker",
+			"label.team":       "billing",
+		},
+	})
+	frontend.Send(&pgproto3.Query{String: "SELECT 1"})
+	require.NoError(t, frontend.Flush())
+
+	require.Eventually(t, func() bool { return len(engine.Queries()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	query := engine.Queries()[0]
+	assert.Equal(t, "alice", query.UserID)
+	assert.Equal(t, "alice", query.Database, "The database should default to the user name")
+	assert.Equal(t, "billing-worker", query.ApplicationName)
+
+	sessions := queryLogger.Sessions()
+	require.Len(t, sessions, 1)
+	assert.Equal(t, query.ConnectionID, sessions[0].ConnectionID)
+	assert.Equal(t, "alice", sessions[0].User)
+	assert.Equal(t, "billing-worker", sessions[0].ApplicationName)
+	assert.Equal(t, map[string]string{"team": "billing"}, sessions[0].Labels)
+}
+
+func TestPostgreSQLConnectionHandler_IdleEviction(t *testing.T) {
+	evictions := make(chan func(), 1)
+	tracker := &mocks.ConnectionTracker{}
+	tracker.On("Track", "conn_1", "alice", "app", mock.Anything).
+		Run(func(args mock.Arguments) { evictions <- args.Get(3).(func()) })
+	tracker.On("Register", mock.Anything, mock.Anything)
+	tracker.On("QueryStarted", "conn_1", mock.Anything)
+	tracker.On("Idle", "conn_1")
+	tracker.On("Busy", "conn_1").Return(true)
+	tracker.On("Untrack", "conn_1")
+
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithConnectionTracker(tracker))
+	addr := startHandler(t, handler)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	frontend := pgproto3.NewFrontend(conn, conn)
+	frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice", "database": "app"},
+	})
+	require.NoError(t, frontend.Flush())
+
+	var evict func()
+	select {
+	case evict = <-evictions:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connection was not tracked")
+	}
+	evict()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	message, err := frontend.Receive()
+	require.NoError(t, err)
+	errorResponse, ok := message.(*pgproto3.ErrorResponse)
+	require.True(t, ok, "Expected an ErrorResponse, got %T", message)
+	assert.Equal(t, "FATAL", errorResponse.Severity)
+	assert.Equal(t, "53300", errorResponse.Code)
+
+	_, err = frontend.Receive()
+	assert.Error(t, err, "The connection should be closed after eviction")
+
+	require.Eventually(t, func() bool {
+		return len(tracker.Calls) > 0 && tracker.Calls[len(tracker.Calls)-1].Method == "Untrack"
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestPostgreSQLConnectionHandler_ConnectionLimit(t *testing.T) {
+	acquired := make(chan struct{}, 1)
+	released := make(chan struct{}, 1)
+	limiter := &mocks.ConnectionLimiter{}
+	limiter.On("AcquireConnection", mock.MatchedBy(func(session domain.Session) bool { return session.User == "alice" })).
+		Return(domain.AllowDecision()).Run(func(mock.Arguments) { acquired <- struct{}{} })
+	limiter.On("AcquireConnection", mock.MatchedBy(func(session domain.Session) bool { return session.User == "bob" })).
+		Return(domain.Decision{Action: domain.DecisionDeny, Policy: "bob", Reason: `too many connections for role "bob"`, Limit: 1, Used: 1})
+	limiter.On("Release").Run(func(mock.Arguments) { released <- struct{}{} })
+
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithConnectionLimiter(limiter))
+	addr := startHandler(t, handler)
+
+	connect := func(user string) (*pgproto3.Frontend, net.Conn) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		frontend := pgproto3.NewFrontend(conn, conn)
+		frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": user, "database": "app"},
+		})
+		require.NoError(t, frontend.Flush())
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+		return frontend, conn
+	}
+
+	frontend, conn := connect("bob")
+	message, err := frontend.Receive()
+	require.NoError(t, err)
+	errorResponse, ok := message.(*pgproto3.ErrorResponse)
+	require.True(t, ok, "Expected an ErrorResponse, got %T", message)
+	assert.Equal(t, "FATAL", errorResponse.Severity)
+	assert.Equal(t, "53300", errorResponse.Code)
+	assert.Equal(t, `too many connections for role "bob"`, errorResponse.Message)
+	_, err = frontend.Receive()
+	assert.Error(t, err, "The rejected connection should be closed")
+	conn.Close()
+
+	_, conn = connect("alice")
+	select {
+	case <-acquired:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connection was not counted")
+	}
+	assert.Empty(t, released, "Rejected connections are not released")
+	conn.Close()
+	select {
+	case <-released:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The connection should be released once closed")
+	}
+}
+
+func TestPostgreSQLConnectionHandler_PreparedStatementExecutions(t *testing.T) {
+	engine := &mocks.StaticPolicyEngine{}
+	queryLogger := mocks.NewRecordingQueryLogger()
+	handler := NewPostgreSQLConnectionHandler(queryLogger, NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine))
+	addr := startHandler(t, handler)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	frontend := pgproto3.NewFrontend(conn, conn)
+	frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice", "database": "app"},
+	})
+	frontend.Send(&pgproto3.Parse{Name: "user_by_id", Query: "SELECT * FROM users WHERE id = $1"})
+	for i := 0; i < 3; i++ {
+		frontend.Send(&pgproto3.Bind{PreparedStatement: "user_by_id", Parameters: [][]byte{[]byte("1")}})
+		frontend.Send(&pgproto3.Execute{})
+	}
+	frontend.Send(&pgproto3.Close{ObjectType: 'S', Name: "user_by_id"})
+	frontend.Send(&pgproto3.Bind{PreparedStatement: "user_by_id"})
+	frontend.Send(&pgproto3.Execute{})
+	frontend.Send(&pgproto3.Sync{})
+	require.NoError(t, frontend.Flush())
+
+	require.Eventually(t, func() bool {
+		messages := queryLogger.ProtocolMessages()
+		return len(messages) > 0 && strings.Contains(messages[len(messages)-1], "Sync")
+	}, 2*time.Second, 10*time.Millisecond)
+
+	queries := engine.Queries()
+	require.Len(t, queries, 4, "Executions of a closed statement cannot be attributed")
+	assert.Equal(t, domain.QueryKindParse, queries[0].Kind)
+	for _, query := range queries[1:] {
+		assert.Equal(t, domain.QueryKindExecute, query.Kind)
+		assert.Equal(t, "SELECT * FROM users WHERE id = $1", query.Raw)
+		assert.Equal(t, queries[0].Hash, query.Hash, "Executions share the fingerprint of their statement")
+	}
+}
+
+func TestPostgreSQLConnectionHandler_BindParameterCapture(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []ConnectionHandlerOption
+		parameters []interface{}
+	}{
+		{name: "disabled"},
+		{name: "enabled", opts: []ConnectionHandlerOption{WithParameterCapture()}, parameters: []interface{}{"42", []byte{0, 0, 0, 1}, nil}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := &mocks.StaticPolicyEngine{}
+			queryLogger := mocks.NewRecordingQueryLogger()
+			handler := NewPostgreSQLConnectionHandler(queryLogger, NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+				append(tt.opts, WithPolicyEngine(engine))...)
+			addr := startHandler(t, handler)
+
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			frontend := pgproto3.NewFrontend(conn, conn)
+			frontend.Send(&pgproto3.StartupMessage{
+				ProtocolVersion: pgproto3.ProtocolVersionNumber,
+				Parameters:      map[string]string{"user": "alice", "database": "app"},
+			})
+			frontend.Send(&pgproto3.Parse{Name: "find", Query: "SELECT * FROM users WHERE id = $1 AND flags = $2 AND note = $3"})
+			frontend.Send(&pgproto3.Bind{
+				DestinationPortal:    "cursor",
+				PreparedStatement:    "find",
+				ParameterFormatCodes: []int16{pgproto3.TextFormat, pgproto3.BinaryFormat, pgproto3.TextFormat},
+				Parameters:           [][]byte{[]byte("42"), {0, 0, 0, 1}, nil},
+			})
+			frontend.Send(&pgproto3.Execute{Portal: "cursor"})
+			frontend.Send(&pgproto3.Sync{})
+			require.NoError(t, frontend.Flush())
+
+			require.Eventually(t, func() bool {
+				messages := queryLogger.ProtocolMessages()
+				return len(messages) > 0 && strings.Contains(messages[len(messages)-1], "Sync")
+			}, 2*time.Second, 10*time.Millisecond)
+
+			queries := engine.Queries()
+			require.Len(t, queries, 2)
+			assert.Equal(t, tt.parameters, queries[1].Parameters)
+
+			var execute string
+			for _, message := range queryLogger.ProtocolMessages() {
+				if strings.HasPrefix(message, "Execute") {
+					execute = message
+				}
+			}
+			assert.Contains(t, execute, "statement:find", "Executions should be correlated with their statement")
+			assert.Contains(t, execute, "query_hash:"+queries[0].Hash.String())
+		})
+	}
+}
+
+func TestPostgreSQLConnectionHandler_ParameterLabels(t *testing.T) {
+	engine := &mocks.StaticPolicyEngine{}
+	queryLogger := mocks.NewRecordingQueryLogger()
+	handler := NewPostgreSQLConnectionHandler(queryLogger, NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithParameterLabels(8,
+			ParameterLabel{Label: "tenant_id", Position: 1},
+			ParameterLabel{Label: "note", Position: 2},
+			ParameterLabel{Label: "region", Position: 1, Fingerprints: []string{"0000000000000000"}},
+		))
+	addr := startHandler(t, handler)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	frontend := pgproto3.NewFrontend(conn, conn)
+	frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice", "database": "app", "label.team": "billing"},
+	})
+	frontend.Send(&pgproto3.Parse{Name: "find", Query: "SELECT * FROM orders WHERE tenant_id = $1 AND note = $2",
+		ParameterOIDs: []uint32{pgtype.Int4OID, pgtype.TextOID}})
+	frontend.Send(&pgproto3.Bind{
+		PreparedStatement:    "find",
+		ParameterFormatCodes: []int16{pgproto3.BinaryFormat},
+		Parameters:           [][]byte{{0, 0, 0, 42}, []byte("longer than eight bytes")},
+	})
+	frontend.Send(&pgproto3.Execute{})
+	frontend.Send(&pgproto3.Sync{})
+	require.NoError(t, frontend.Flush())
+
+	require.Eventually(t, func() bool {
+		messages := queryLogger.ProtocolMessages()
+		return len(messages) > 0 && strings.Contains(messages[len(messages)-1], "Sync")
+	}, 2*time.Second, 10*time.Millisecond)
+
+	queries := engine.Queries()
+	require.Len(t, queries, 2)
+	assert.Equal(t, map[string]string{"team": "billing", "tenant_id": "42"}, queries[1].Labels,
+		"Executions should carry the decoded labels of their parameters, values over the size limit left out")
+	assert.Equal(t, map[string]string{"team": "billing"}, queries[0].Labels, "The connection labels should be left as they are")
+
+	for _, message := range queryLogger.ProtocolMessages() {
+		if strings.HasPrefix(message, "Bind") {
+			assert.Contains(t, message, "labels:map[tenant_id:<2 bytes>]", "Label values should be redacted from the protocol log")
+		}
+	}
+}
+
+func TestPostgreSQLConnectionHandler_CopyVolume(t *testing.T) {
+	engine := &mocks.StaticPolicyEngine{}
+	queryLogger := mocks.NewRecordingQueryLogger()
+	handler := NewPostgreSQLConnectionHandler(queryLogger, NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine))
+	addr := startHandler(t, handler)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	frontend := pgproto3.NewFrontend(conn, conn)
+	frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice", "database": "app"},
+	})
+	frontend.Send(&pgproto3.Query{String: "COPY events FROM STDIN"})
+	frontend.Send(&pgproto3.CopyData{Data: []byte("1\tsignup\n")})
+	frontend.Send(&pgproto3.CopyData{Data: []byte("2\tlogin\n")})
+	frontend.Send(&pgproto3.CopyDone{})
+	frontend.Send(&pgproto3.Query{String: "SELECT 1"})
+	require.NoError(t, frontend.Flush())
+
+	require.Eventually(t, func() bool { return len(engine.Queries()) == 2 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []domain.StatementUsage{{Bytes: 17}}, engine.Usage(), "Without an upstream the COPY ends with CopyDone")
+
+	for _, message := range queryLogger.ProtocolMessages() {
+		assert.False(t, strings.HasPrefix(message, "CopyData"), "CopyData should not be logged")
+	}
+}
+
+// dialFrontend opens a connection to addr and sends the startup message of alice,
+// which the handler answers with nothing when it has no upstream
+func dialFrontend(t *testing.T, addr string) *pgproto3.Frontend {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+
+	frontend := pgproto3.NewFrontend(conn, conn)
+	frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice", "database": "app"},
+	})
+	return frontend
+}
+
+// receiveError returns the first ErrorResponse the handler sends
+func receiveError(t *testing.T, frontend *pgproto3.Frontend) *pgproto3.ErrorResponse {
+	t.Helper()
+	for {
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		if errorResponse, ok := msg.(*pgproto3.ErrorResponse); ok {
+			return errorResponse
+		}
+	}
+}
+
+func TestPostgreSQLConnectionHandler_MaxMessageSize(t *testing.T) {
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithMaxMessageSize(1024))
+	frontend := dialFrontend(t, startHandler(t, handler))
+
+	frontend.Send(&pgproto3.Query{String: "SELECT '" + strings.Repeat("x", 2048) + "'"})
+	require.NoError(t, frontend.Flush())
+
+	errorResponse := receiveError(t, frontend)
+	assert.Equal(t, "FATAL", errorResponse.Severity)
+	assert.Equal(t, "54000", errorResponse.Code)
+	_, err := frontend.Receive()
+	assert.Error(t, err, "The connection should be closed")
+}
+
+func TestPostgreSQLConnectionHandler_MaxConnectionBuffer(t *testing.T) {
+	engine := &mocks.StaticPolicyEngine{}
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithMaxConnectionBuffer(4096))
+	frontend := dialFrontend(t, startHandler(t, handler))
+
+	// Replacing and closing statements frees what they held
+	query := "SELECT '" + strings.Repeat("x", 1000) + "'"
+	for i := 0; i < 10; i++ {
+		frontend.Send(&pgproto3.Parse{Name: "replaced", Query: query})
+		frontend.Send(&pgproto3.Parse{Name: "closed", Query: query})
+		frontend.Send(&pgproto3.Close{ObjectType: 'S', Name: "closed"})
+	}
+	for i := 0; i < 5; i++ {
+		frontend.Send(&pgproto3.Parse{Name: fmt.Sprintf("leaked_%d", i), Query: query})
+	}
+	require.NoError(t, frontend.Flush())
+
+	errorResponse := receiveError(t, frontend)
+	assert.Equal(t, "FATAL", errorResponse.Severity)
+	assert.Equal(t, "53200", errorResponse.Code)
+	assert.Len(t, engine.Queries(), 24, "The fourth leaked statement should exceed the limit")
+}
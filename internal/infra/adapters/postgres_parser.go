@@ -1,21 +1,28 @@
 package adapters
 
 import (
+	"bufio"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/jackc/pgx/v5/pgproto3"
 )
 
 // PostgreSQLParser handles parsing of PostgreSQL wire protocol messages
 type PostgreSQLParser struct {
-	backend *pgproto3.Backend
+	reader         *bufio.Reader
+	backend        *pgproto3.Backend
+	maxMessageSize int        // largest message body accepted; zero for no limit
+	sendMu         sync.Mutex // Serializes writes to the client, which may come from several goroutines
 }
 
 // NewPostgreSQLParser creates a new PostgreSQL protocol parser
 func NewPostgreSQLParser(reader io.Reader, writer io.Writer) *PostgreSQLParser {
-	backend := pgproto3.NewBackend(reader, writer)
+	buffered := bufio.NewReader(reader)
+	backend := pgproto3.NewBackend(buffered, writer)
 	return &PostgreSQLParser{
+		reader:  buffered,
 		backend: backend,
 	}
 }
@@ -25,10 +32,20 @@ type ParsedMessage struct {
 	Type    string
 	Query   string
 	Details map[string]interface{}
+	Message pgproto3.FrontendMessage // Decoded message, valid until the next read
 }
 
 // ReadMessage reads and parses the next PostgreSQL protocol message
-func (p *PostgreSQLParser) ReadMessage() (*ParsedMessage, error) {
+func (p *PostgreSQLParser) ReadMessage() (message *ParsedMessage, err error) {
+	// pgproto3 decoders can panic on malformed length fields (found by fuzzing);
+	// treat those as protocol errors instead of crashing the connection goroutine
+	defer func() {
+		if r := recover(); r != nil {
+			message = nil
+			err = fmt.Errorf("failed to decode message: %v", r)
+		}
+	}()
+
 	msg, err := p.backend.Receive()
 	if err != nil {
 		return nil, fmt.Errorf("failed to receive message: %w", err)
@@ -37,8 +54,94 @@ func (p *PostgreSQLParser) ReadMessage() (*ParsedMessage, error) {
 	return p.parseMessage(msg)
 }
 
+// HasStartup reports whether the stream begins with an untyped startup packet.
+// Startup packets begin with a length whose high byte is always zero, while
+// regular messages begin with an ASCII type byte.
+func (p *PostgreSQLParser) HasStartup() (bool, error) {
+	b, err := p.reader.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	return b[0] == 0, nil
+}
+
+// Upgrade continues parsing over a new stream, such as the TLS session negotiated
+// after an SSLRequest. Anything the client sent before the upgrade is discarded
+// rather than interpreted, so plaintext cannot be injected into the encrypted session.
+func (p *PostgreSQLParser) Upgrade(reader io.Reader, writer io.Writer) {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	p.reader = bufio.NewReader(reader)
+	p.backend = pgproto3.NewBackend(p.reader, writer)
+	p.backend.SetMaxBodyLen(p.maxMessageSize)
+}
+
+// SetMaxMessageSize makes ReadMessage fail with a *pgproto3.ExceededMaxBodyLenErr
+// on messages whose body exceeds size bytes, before reading them; zero removes
+// the limit
+func (p *PostgreSQLParser) SetMaxMessageSize(size int) {
+	p.maxMessageSize = size
+	p.backend.SetMaxBodyLen(size)
+}
+
+// ReadStartupMessage reads and parses the next startup-phase message
+// (SSLRequest, GSSEncRequest, StartupMessage or CancelRequest)
+func (p *PostgreSQLParser) ReadStartupMessage() (message *ParsedMessage, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			message = nil
+			err = fmt.Errorf("failed to decode startup message: %v", r)
+		}
+	}()
+
+	msg, err := p.backend.ReceiveStartupMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive startup message: %w", err)
+	}
+
+	return p.parseMessage(msg)
+}
+
+// Send writes a message to the client and flushes it
+func (p *PostgreSQLParser) Send(msg pgproto3.BackendMessage) error {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	p.backend.Send(msg)
+	return p.backend.Flush()
+}
+
+// Queue buffers a message for the client until the next Flush or Send
+func (p *PostgreSQLParser) Queue(msg pgproto3.BackendMessage) {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	p.backend.Send(msg)
+}
+
+// Flush writes buffered messages to the client
+func (p *PostgreSQLParser) Flush() error {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	return p.backend.Flush()
+}
+
+// SetAuthType tells the parser which authentication exchange is in progress,
+// so the client's next 'p' message is decoded as the matching response
+func (p *PostgreSQLParser) SetAuthType(authType uint32) error {
+	return p.backend.SetAuthType(authType)
+}
+
 // parseMessage converts a pgproto3 message to our ParsedMessage format
-func (p *PostgreSQLParser) parseMessage(msg pgproto3.Message) (*ParsedMessage, error) {
+func (p *PostgreSQLParser) parseMessage(msg pgproto3.FrontendMessage) (*ParsedMessage, error) {
+	parsed, err := p.describeMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	parsed.Message = msg
+	return parsed, nil
+}
+
+// describeMessage extracts the type and loggable details of a message
+func (p *PostgreSQLParser) describeMessage(msg pgproto3.FrontendMessage) (*ParsedMessage, error) {
 	switch m := msg.(type) {
 	case *pgproto3.Query:
 		return &ParsedMessage{
@@ -72,6 +175,26 @@ func (p *PostgreSQLParser) parseMessage(msg pgproto3.Message) (*ParsedMessage, e
 			Details: details,
 		}, nil
 
+	case *pgproto3.SSLRequest:
+		return &ParsedMessage{
+			Type:    "SSLRequest",
+			Details: map[string]interface{}{},
+		}, nil
+
+	case *pgproto3.GSSEncRequest:
+		return &ParsedMessage{
+			Type:    "GSSEncRequest",
+			Details: map[string]interface{}{},
+		}, nil
+
+	case *pgproto3.CancelRequest:
+		return &ParsedMessage{
+			Type: "CancelRequest",
+			Details: map[string]interface{}{
+				"process_id": m.ProcessID,
+			},
+		}, nil
+
 	case *pgproto3.PasswordMessage:
 		return &ParsedMessage{
 			Type: "PasswordMessage",
@@ -80,6 +203,14 @@ func (p *PostgreSQLParser) parseMessage(msg pgproto3.Message) (*ParsedMessage, e
 			},
 		}, nil
 
+	case *pgproto3.GSSResponse:
+		return &ParsedMessage{
+			Type: "GSSResponse",
+			Details: map[string]interface{}{
+				"token_length": len(m.Data),
+			},
+		}, nil
+
 	case *pgproto3.Bind:
 		return &ParsedMessage{
 			Type: "Bind",
@@ -135,6 +266,28 @@ func (p *PostgreSQLParser) parseMessage(msg pgproto3.Message) (*ParsedMessage, e
 			},
 		}, nil
 
+	case *pgproto3.CopyData:
+		return &ParsedMessage{
+			Type: "CopyData",
+			Details: map[string]interface{}{
+				"length": len(m.Data),
+			},
+		}, nil
+
+	case *pgproto3.CopyDone:
+		return &ParsedMessage{
+			Type:    "CopyDone",
+			Details: map[string]interface{}{},
+		}, nil
+
+	case *pgproto3.CopyFail:
+		return &ParsedMessage{
+			Type: "CopyFail",
+			Details: map[string]interface{}{
+				"message": m.Message,
+			},
+		}, nil
+
 	default:
 		return &ParsedMessage{
 			Type: fmt.Sprintf("Unknown_%T", msg),
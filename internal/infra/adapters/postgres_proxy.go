@@ -0,0 +1,267 @@
+package adapters
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// pgerrConnectionFailure is the SQLSTATE reported when no upstream can be reached
+const pgerrConnectionFailure = "08006"
+
+// defaultUpstreamTimeout bounds dialing the upstream and completing its startup handshake
+const defaultUpstreamTimeout = 10 * time.Second
+
+// upstreamRoute is where the connections of a listener or to a database are
+// proxied to
+type upstreamRoute struct {
+	selector  domain.UpstreamSelector // nil when the connections are not proxied
+	tlsConfig *tls.Config
+	database  string // database logged into upstream; empty keeps the client's
+}
+
+// route returns the upstreams of the connections to database accepted by the
+// named listener: those of the database when it has some, else the listener's
+// own when it has some, else those of every listener. The database may be
+// renamed upstream whichever upstreams are used.
+func (h *PostgreSQLConnectionHandler) route(listener, database string) upstreamRoute {
+	route, ok := h.listenerRoutes[listener]
+	if !ok {
+		route = upstreamRoute{selector: h.upstreams, tlsConfig: h.upstreamTLS}
+	}
+	if databaseRoute, ok := h.databaseRoutes[database]; ok {
+		if databaseRoute.selector != nil {
+			route.selector, route.tlsConfig = databaseRoute.selector, databaseRoute.tlsConfig
+		}
+		route.database = databaseRoute.database
+	}
+	return route
+}
+
+// connectUpstream opens the upstream leg of a proxied connection, forwards the
+// client's startup parameters and relays the authentication exchange until the
+// upstream is ready for queries. A nil connection without error means the client
+// was already sent a FATAL error and must be disconnected.
+func (h *PostgreSQLConnectionHandler) connectUpstream(ctx context.Context, route upstreamRoute, parser *PostgreSQLParser, writer *PostgreSQLResponseWriter, session domain.Session, connLogger logger.Logger) (*upstreamConnection, error) {
+	target, ok := route.selector.Next()
+	if !ok {
+		connLogger.Error("No upstream available")
+		return nil, writer.Reject(pgerrConnectionFailure, "no upstream server is available")
+	}
+
+	upstream, err := dialUpstream(ctx, target.Address, h.upstreamTimeout, targetTLSConfig(route.tlsConfig, target))
+	if err != nil {
+		connLogger.Error("Failed to connect to upstream: %v", err)
+		return nil, writer.Reject(pgerrConnectionFailure, "could not connect to the upstream server")
+	}
+
+	if err := upstream.conn.SetDeadline(time.Now().Add(h.upstreamTimeout)); err != nil {
+		_ = upstream.Close()
+		return nil, fmt.Errorf("failed to set upstream deadline: %w", err)
+	}
+
+	ready, err := h.relayStartup(parser, upstream, session, route.database)
+	if errors.Is(err, errUpstreamLogin) {
+		h.closeUpstream(upstream)
+		connLogger.Error("Failed to log into upstream: %v", err)
+		return nil, writer.Reject(pgerrConnectionFailure, "could not authenticate with the upstream server")
+	}
+	if err != nil || !ready {
+		h.closeUpstream(upstream)
+		return nil, err
+	}
+
+	if err := upstream.conn.SetDeadline(time.Time{}); err != nil {
+		h.closeUpstream(upstream)
+		return nil, fmt.Errorf("failed to clear upstream deadline: %w", err)
+	}
+
+	connLogger.Info("Connected to upstream %s", target.Address)
+	return upstream, nil
+}
+
+// relayStartup sends the startup message upstream and relays messages in both
+// directions until the upstream reports ReadyForQuery or rejects the client.
+// Clients authenticated by the enforcer are logged in with its own credentials
+// and never see the upstream's authentication requests. A non-empty database
+// replaces the one the client asked for.
+func (h *PostgreSQLConnectionHandler) relayStartup(parser *PostgreSQLParser, upstream *upstreamConnection, session domain.Session, database string) (bool, error) {
+	login := h.upstreamLogin(session.User)
+	if err := upstream.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      startupParameters(session, database, login),
+	}); err != nil {
+		return false, err
+	}
+
+	for {
+		msg, err := upstream.Receive()
+		if err != nil {
+			return false, err
+		}
+		if login != nil {
+			answered, err := login.answer(upstream, msg)
+			if err != nil {
+				return false, err
+			}
+			if answered {
+				continue
+			}
+		}
+		// Clients get a key of the enforcer's own so cancel requests can be routed
+		if key, ok := msg.(*pgproto3.BackendKeyData); ok {
+			clientKey, err := h.cancelKeys.register(upstream.address, upstream.tlsConfig, *key)
+			if err != nil {
+				return false, err
+			}
+			upstream.cancelKey = clientKey.ProcessID
+			msg = clientKey
+		}
+		if err := parser.Send(msg); err != nil {
+			return false, fmt.Errorf("failed to relay startup to client: %w", err)
+		}
+
+		switch msg.(type) {
+		case *pgproto3.ReadyForQuery:
+			return true, nil
+		case *pgproto3.ErrorResponse:
+			return false, nil
+		case *pgproto3.AuthenticationCleartextPassword, *pgproto3.AuthenticationMD5Password,
+			*pgproto3.AuthenticationSASL, *pgproto3.AuthenticationSASLContinue,
+			*pgproto3.AuthenticationGSS, *pgproto3.AuthenticationGSSContinue:
+			// The client answers each challenge; relay its response
+			if err := parser.SetAuthType(upstream.AuthType()); err != nil {
+				return false, fmt.Errorf("failed to follow authentication: %w", err)
+			}
+			response, err := parser.ReadMessage()
+			if err != nil {
+				return false, err
+			}
+			if err := upstream.Send(response.Message); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+// startupParameters returns the startup parameters a client's upstream
+// connection is opened with: the client's own, replaced with those policies set,
+// logged in with login when not nil and into database when not empty
+func startupParameters(session domain.Session, database string, login *upstreamLogin) map[string]string {
+	// Connection labels are consumed here; upstreams such as PgBouncer reject
+	// startup parameters they do not know
+	params := make(map[string]string, len(session.Parameters)+len(session.UpstreamParameters))
+	for name, value := range session.Parameters {
+		if !strings.HasPrefix(name, labelPrefix) {
+			params[name] = value
+		}
+	}
+	for name, value := range session.UpstreamParameters {
+		params[name] = value
+	}
+	if database != "" {
+		params["database"] = database
+	}
+	if login != nil {
+		params["user"] = login.user
+	}
+	return params
+}
+
+// closeUpstream closes the upstream leg and forgets its cancel key
+func (h *PostgreSQLConnectionHandler) closeUpstream(upstream *upstreamConnection) {
+	if upstream.cancelKey != 0 {
+		h.cancelKeys.unregister(upstream.cancelKey)
+	}
+	_ = upstream.Close()
+}
+
+// sendUpstream forwards a client message to upstream once the faults injected
+// on upstream writes are applied. A failed fault closes the connection, as a
+// failed write would leave it unusable.
+func (h *PostgreSQLConnectionHandler) sendUpstream(ctx context.Context, upstream *upstreamConnection, msg pgproto3.FrontendMessage) error {
+	if err := h.faults.Inject(ctx, domain.FaultPointUpstreamWrite); err != nil {
+		_ = upstream.Close()
+		return err
+	}
+	return upstream.Send(msg)
+}
+
+// receiveUpstream reads the next upstream message once the faults injected on
+// upstream reads are applied; a failed fault closes the connection
+func (h *PostgreSQLConnectionHandler) receiveUpstream(ctx context.Context, upstream *upstreamConnection) (pgproto3.BackendMessage, error) {
+	if err := h.faults.Inject(ctx, domain.FaultPointUpstreamRead); err != nil {
+		_ = upstream.Close()
+		return nil, err
+	}
+	return upstream.Receive()
+}
+
+// startRelay runs relayFromUpstream in a goroutine and returns a channel closed
+// once it returns
+func (h *PostgreSQLConnectionHandler) startRelay(ctx context.Context, upstream *upstreamConnection, parser *PostgreSQLParser, writer *PostgreSQLResponseWriter, conn net.Conn, meter *resultMeter, state *sessionTracker, timeouts *statementTimeouts, caps *resultCaps, transactions *transactionLimits, connLogger logger.Logger) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.relayFromUpstream(ctx, upstream, parser, writer, conn, meter, state, timeouts, caps, transactions, connLogger)
+	}()
+	return done
+}
+
+// relayFromUpstream forwards upstream messages to the client until either side
+// fails. Messages are batched while more are buffered. On return the client's
+// pending read is interrupted so the handler loop notices the upstream is gone.
+// With upstream reconnects, a FATAL error is held back from the client, since
+// the handler may replace the connection the error ends.
+func (h *PostgreSQLConnectionHandler) relayFromUpstream(ctx context.Context, upstream *upstreamConnection, parser *PostgreSQLParser, writer *PostgreSQLResponseWriter, conn net.Conn, meter *resultMeter, state *sessionTracker, timeouts *statementTimeouts, caps *resultCaps, transactions *transactionLimits, connLogger logger.Logger) {
+	defer func() {
+		_ = conn.SetReadDeadline(time.Now())
+	}()
+
+	for {
+		msg, err := h.receiveUpstream(ctx, upstream)
+		if err != nil {
+			connLogger.Debug("Upstream relay stopped: %v", err)
+			upstream.lost = true
+			return
+		}
+		if response, ok := msg.(*pgproto3.ErrorResponse); ok && h.reconnect && response.Severity == "FATAL" {
+			connLogger.Debug("Upstream relay stopped: %s", response.Message)
+			upstream.lost, upstream.fatal = true, response
+			return
+		}
+
+		msg = timeouts.observeUpstream(msg)
+		meter.observeUpstream(ctx, msg)
+		state.observeUpstream(msg)
+		transactions.observeUpstream(msg)
+		cutoff, msg := caps.observeUpstream(msg)
+		if cutoff != nil {
+			writer.Relay(cutoff)
+		}
+		if msg != nil {
+			writer.Relay(msg)
+		}
+		if upstream.Buffered() {
+			continue
+		}
+		if err := parser.Flush(); err != nil {
+			connLogger.Debug("Client relay stopped: %v", err)
+			return
+		}
+
+		// A draining connection is closed as soon as its transaction ends, and the
+		// handler waiting for the upstream to answer the client is woken
+		if answered, status := writer.Answered(); answered && (status == domain.TransactionIdle && h.draining() || state.wake()) {
+			_ = conn.SetReadDeadline(time.Now())
+		}
+	}
+}
@@ -0,0 +1,1014 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// upstreamSelector returns a selector that always picks address
+func upstreamSelector(address string) *mocks.UpstreamSelector {
+	selector := &mocks.UpstreamSelector{}
+	selector.On("Next").Return(domain.UpstreamTarget{Address: address}, true)
+	return selector
+}
+
+func TestPostgreSQLConnectionHandler_Proxy(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.RequirePassword("secret")
+	backend.Handle("SELECT 1", testkit.Result{
+		Columns:    []string{"?column?"},
+		Rows:       [][]string{{"1"}},
+		CommandTag: "SELECT 1",
+	})
+
+	engine := &mocks.StaticPolicyEngine{}
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithUpstreams(upstreamSelector(backend.Addr())))
+	addr := startHandler(t, handler)
+
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{
+		User:       "alice",
+		Database:   "app",
+		Password:   "secret",
+		Parameters: map[string]string{"label.team": "billing"},
+	})
+
+	result, err := client.Query("SELECT 1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"?column?"}, result.Columns)
+	assert.Equal(t, [][]string{{"1"}}, result.Rows)
+	assert.Equal(t, "SELECT 1", result.CommandTag)
+
+	assert.Equal(t, []string{"SELECT 1"}, backend.Queries())
+	require.Len(t, engine.Queries(), 1)
+	assert.Equal(t, map[string]string{"team": "billing"}, engine.Queries()[0].Labels)
+
+	require.Len(t, backend.StartupParameters(), 1)
+	params := backend.StartupParameters()[0]
+	assert.Equal(t, "alice", params["user"])
+	assert.NotContains(t, params, "label.team", "Labels must not be forwarded upstream")
+}
+
+func TestPostgreSQLConnectionHandler_ProxyStartupParameters(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.Handle("SELECT 1", testkit.Result{CommandTag: "SELECT 1"})
+
+	limiter := &mocks.ConnectionLimiter{}
+	limiter.On("AcquireConnection", mock.Anything).Return(domain.Decision{
+		Action:            domain.DecisionAllow,
+		StartupParameters: map[string]string{"application_name": "worker (pgqe)", "options": "-c statement_timeout=5s"},
+	})
+	limiter.On("Release")
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithConnectionLimiter(limiter), WithUpstreams(upstreamSelector(backend.Addr())))
+	addr := startHandler(t, handler)
+
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{
+		User:       "alice",
+		Database:   "app",
+		Parameters: map[string]string{"application_name": "worker", "DateStyle": "ISO"},
+	})
+	_, err := client.Query("SELECT 1")
+	require.NoError(t, err)
+
+	require.Len(t, backend.StartupParameters(), 1)
+	params := backend.StartupParameters()[0]
+	assert.Equal(t, "worker (pgqe)", params["application_name"], "Policies should replace the client's parameters")
+	assert.Equal(t, "-c statement_timeout=5s", params["options"])
+	assert.Equal(t, "ISO", params["DateStyle"], "The client's other parameters should be kept")
+	assert.Equal(t, "alice", params["user"])
+}
+
+func TestPostgreSQLConnectionHandler_ProxyUpstreamError(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.RequirePassword("secret")
+
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithUpstreams(upstreamSelector(backend.Addr())))
+	addr := startHandler(t, handler)
+
+	_, err := testkit.Dial(addr, testkit.ClientConfig{User: "alice", Database: "app", Password: "wrong"})
+
+	var serverErr *testkit.ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, "28P01", serverErr.Code, "Upstream authentication errors are relayed as is")
+}
+
+func TestPostgreSQLConnectionHandler_ProxyUpstreamFaults(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.Handle("SELECT 1", testkit.Result{CommandTag: "SELECT 1"})
+
+	faults := NewRuleFaultInjector()
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithUpstreams(upstreamSelector(backend.Addr())), WithFaultInjector(faults))
+	addr := startHandler(t, handler)
+
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+	faults.SetRules([]FaultRule{{Point: domain.FaultPointUpstreamWrite, Kind: FaultReset, Probability: 1}})
+	_, err := client.Query("SELECT 1")
+	assert.Error(t, err, "A failed upstream write should fail the query")
+	assert.Empty(t, backend.Queries())
+
+	faults.SetRules([]FaultRule{{Point: domain.FaultPointUpstreamRead, Kind: FaultError, Probability: 1}})
+	client = testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+	_, err = client.Query("SELECT 1")
+	assert.Error(t, err, "A failed upstream read should fail the query")
+}
+
+func TestPostgreSQLConnectionHandler_ProxyNoUpstream(t *testing.T) {
+	selector := &mocks.UpstreamSelector{}
+	selector.On("Next").Return(domain.UpstreamTarget{}, false)
+
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithUpstreams(selector))
+	addr := startHandler(t, handler)
+
+	_, err := testkit.Dial(addr, testkit.ClientConfig{User: "alice", Database: "app"})
+
+	var serverErr *testkit.ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, "FATAL", serverErr.Severity)
+	assert.Equal(t, pgerrConnectionFailure, serverErr.Code)
+}
+
+func TestPostgreSQLConnectionHandler_ProxyQuotaDenied(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.Handle("SELECT 1", testkit.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}, CommandTag: "SELECT 1"})
+
+	deny := domain.Decision{
+		Action:  domain.DecisionDeny,
+		Policy:  "per-user",
+		Reason:  `quota "per-user" exceeded: 10 of 10 queries per 1m0s`,
+		Limit:   10,
+		Used:    10,
+		ResetAt: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC),
+	}
+	engine := &mocks.PolicyEngine{}
+	engine.On("Evaluate", mock.Anything, mock.MatchedBy(func(q *domain.Query) bool {
+		return q.Raw == "SELECT 2" || (q.Raw == "SELECT 3" && q.Kind == domain.QueryKindExecute)
+	})).Return(deny, nil)
+	engine.On("Evaluate", mock.Anything, mock.Anything).Return(domain.AllowDecision(), nil)
+
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithUpstreams(upstreamSelector(backend.Addr())))
+	addr := startHandler(t, handler)
+
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+
+	for name, run := range map[string]func(string) (*testkit.QueryResult, error){
+		"simple":   func(sql string) (*testkit.QueryResult, error) { return client.Query(sql) },
+		"extended": func(sql string) (*testkit.QueryResult, error) { return client.Exec(sql) },
+	} {
+		_, err := run("SELECT 2")
+		var serverErr *testkit.ServerError
+		require.ErrorAs(t, err, &serverErr, name)
+		assert.Equal(t, "ERROR", serverErr.Severity, name)
+		assert.Equal(t, pgerrQuotaExceeded, serverErr.Code, name)
+		assert.Contains(t, serverErr.Message, `quota "per-user" exceeded`, name)
+		assert.Contains(t, serverErr.Message, "resets at 2026-01-01T12:00:00Z", name)
+		assert.Equal(t, byte('I'), client.TxStatus(), name)
+
+		// The connection stays usable after a denial
+		result, err := run("SELECT 1")
+		require.NoError(t, err, name)
+		assert.Equal(t, [][]string{{"1"}}, result.Rows, name)
+	}
+
+	// A denied Execute is reported once the upstream has answered the messages before it
+	_, err := client.Exec("SELECT 3")
+	var serverErr *testkit.ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, pgerrQuotaExceeded, serverErr.Code)
+	_, err = client.Query("SELECT 1")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"SELECT 1", "SELECT 1", "SELECT 1"}, backend.Queries(), "Denied queries never reach the upstream")
+}
+
+// receiveTypes returns the types of the messages received until readies
+// ReadyForQuery, runs of DataRow counting as one
+func receiveTypes(t *testing.T, frontend *pgproto3.Frontend, readies int) []string {
+	t.Helper()
+	var types []string
+	for readies > 0 {
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		name := fmt.Sprintf("%T", msg)[len("*pgproto3."):]
+		if _, ready := msg.(*pgproto3.ReadyForQuery); ready {
+			readies--
+		}
+		if name == "DataRow" && len(types) > 0 && types[len(types)-1] == name {
+			continue
+		}
+		types = append(types, name)
+	}
+	return types
+}
+
+func TestPostgreSQLConnectionHandler_ProxyPipelinedDenials(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	rows := make([][]string, 5000)
+	for i := range rows {
+		rows[i] = []string{strconv.Itoa(i)}
+	}
+	backend.Handle("SELECT big", testkit.Result{Columns: []string{"n"}, Rows: rows, CommandTag: "SELECT 5000"})
+
+	engine := &mocks.PolicyEngine{}
+	engine.On("Evaluate", mock.Anything, mock.MatchedBy(func(q *domain.Query) bool { return q.Raw == "SELECT denied" })).
+		Return(domain.Decision{Action: domain.DecisionDeny, Policy: "per-user"}, nil)
+	engine.On("Evaluate", mock.Anything, mock.Anything).Return(domain.AllowDecision(), nil)
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithUpstreams(upstreamSelector(backend.Addr())))
+	frontend := dialFrontend(t, startHandler(t, handler))
+	require.NoError(t, frontend.Flush())
+	receiveTypes(t, frontend, 1) // the startup
+
+	// A denied query is answered after the query forwarded before it
+	frontend.Send(&pgproto3.Query{String: "SELECT big"})
+	frontend.Send(&pgproto3.Query{String: "SELECT denied"})
+	require.NoError(t, frontend.Flush())
+	assert.Equal(t, []string{
+		"RowDescription", "DataRow", "CommandComplete", "ReadyForQuery",
+		"ErrorResponse", "ReadyForQuery",
+	}, receiveTypes(t, frontend, 2))
+
+	// The error of a denied batch ends that batch, not the one before it
+	for _, sql := range []string{"SELECT big", "SELECT denied"} {
+		frontend.Send(&pgproto3.Parse{Query: sql})
+		frontend.Send(&pgproto3.Bind{})
+		frontend.Send(&pgproto3.Execute{})
+		frontend.Send(&pgproto3.Sync{})
+	}
+	require.NoError(t, frontend.Flush())
+	assert.Equal(t, []string{
+		"ParseComplete", "BindComplete", "DataRow", "CommandComplete", "ReadyForQuery",
+		"ErrorResponse", "ReadyForQuery",
+	}, receiveTypes(t, frontend, 2))
+}
+
+func TestPostgreSQLConnectionHandler_ProxyQuotaWarning(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.Handle("SELECT 1", testkit.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}, CommandTag: "SELECT 1"})
+
+	engine := &mocks.StaticPolicyEngine{Decision: domain.Decision{
+		Action:   domain.DecisionAllow,
+		Warnings: []string{`you have used 90% of quota "daily": 900 of 1000 queries per 24h0m0s`},
+	}}
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithUpstreams(upstreamSelector(backend.Addr())))
+	addr := startHandler(t, handler)
+
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+	for name, run := range map[string]func(string) (*testkit.QueryResult, error){
+		"simple":   func(sql string) (*testkit.QueryResult, error) { return client.Query(sql) },
+		"extended": func(sql string) (*testkit.QueryResult, error) { return client.Exec(sql) },
+	} {
+		result, err := run("SELECT 1")
+		require.NoError(t, err, name)
+		assert.Equal(t, [][]string{{"1"}}, result.Rows, "Warned queries should still run")
+		assert.Contains(t, result.Notices, `you have used 90% of quota "daily": 900 of 1000 queries per 24h0m0s`, name)
+	}
+}
+
+func TestPostgreSQLConnectionHandler_ProxyRewrite(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.Handle("SELECT 2", testkit.Result{Columns: []string{"?column?"}, Rows: [][]string{{"2"}}, CommandTag: "SELECT 1"})
+
+	engine := &mocks.StaticPolicyEngine{Decision: domain.Decision{Action: domain.DecisionAllow, Rewrite: "SELECT 2"}}
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithUpstreams(upstreamSelector(backend.Addr())))
+	addr := startHandler(t, handler)
+
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+	for name, run := range map[string]func(string) (*testkit.QueryResult, error){
+		"simple":   func(sql string) (*testkit.QueryResult, error) { return client.Query(sql) },
+		"extended": func(sql string) (*testkit.QueryResult, error) { return client.Exec(sql) },
+	} {
+		result, err := run("SELECT 1")
+		require.NoError(t, err, name)
+		assert.Equal(t, [][]string{{"2"}}, result.Rows, "The rewritten query should run instead, %s", name)
+	}
+	assert.Equal(t, []string{"SELECT 2", "SELECT 2"}, backend.Queries())
+	assert.Equal(t, "SELECT 1", engine.Queries()[0].Raw, "Policies should see the query as sent")
+}
+
+func TestPostgreSQLConnectionHandler_ProxyMultiStatement(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.Handle("SELECT 1; SELECT 2", testkit.Result{Columns: []string{"?column?"}, Rows: [][]string{{"2"}}, CommandTag: "SELECT 1"})
+
+	// Allowed statements are charged through the batch of their query
+	var charged atomic.Int64
+	engine := &mocks.PolicyEngine{}
+	engine.On("Evaluate", mock.Anything, mock.MatchedBy(func(q *domain.Query) bool {
+		return q.Raw == "DELETE FROM audit"
+	})).Return(domain.Decision{Action: domain.DecisionDeny, Policy: "no-deletes", Reason: "deleting from audit is not allowed"}, nil)
+	engine.On("Evaluate", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		domain.ChargeBatchOf(args.Get(0).(context.Context)).Defer(domain.UsageKey{}, 1, func(context.Context) error {
+			charged.Add(1)
+			return nil
+		})
+	}).Return(domain.AllowDecision(), nil)
+
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithUpstreams(upstreamSelector(backend.Addr())))
+	addr := startHandler(t, handler)
+
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+	_, err := client.Query("SELECT 1; DELETE FROM audit")
+	var serverErr *testkit.ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Contains(t, serverErr.Message, "deleting from audit is not allowed")
+	assert.Empty(t, backend.Queries(), "A query should be denied as a whole when one of its statements is")
+	assert.Zero(t, charged.Load(), "The statements of a denied query should not be charged")
+
+	result, err := client.Query("SELECT 1; SELECT 2")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"2"}}, result.Rows)
+	assert.Equal(t, []string{"SELECT 1; SELECT 2"}, backend.Queries(), "Allowed queries should be sent as they are")
+	assert.Equal(t, int64(2), charged.Load())
+
+	var evaluated []string
+	hashes := make(map[string]bool)
+	for _, call := range engine.Calls {
+		query := call.Arguments.Get(1).(*domain.Query)
+		evaluated = append(evaluated, query.Raw)
+		hashes[query.Hash.Value()] = true
+	}
+	assert.Equal(t, []string{"SELECT 1", "DELETE FROM audit", "SELECT 1", "SELECT 2"}, evaluated, "Each statement should be evaluated on its own")
+	assert.Len(t, hashes, 2)
+}
+
+func TestPostgreSQLConnectionHandler_ProxyCancelRequest(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithUpstreams(upstreamSelector(backend.Addr())))
+	addr := startHandler(t, handler)
+
+	client, err := testkit.Dial(addr, testkit.ClientConfig{User: "alice", Database: "app"})
+	require.NoError(t, err)
+
+	// The FakeBackend numbers its backends from 1001, with a secret key of seven times the pid
+	pid, key := client.BackendKey()
+	assert.NotEqual(t, uint32(1001), pid, "Clients should get a key of the enforcer's own")
+
+	forged := &pgproto3.CancelRequest{ProcessID: pid, SecretKey: key + 1}
+	request, err := forged.Encode(nil)
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = conn.Write(request)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	require.NoError(t, client.Cancel())
+	require.Eventually(t, func() bool { return len(backend.CancelRequests()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, pgproto3.CancelRequest{ProcessID: 1001, SecretKey: 7007}, backend.CancelRequests()[0],
+		"The cancellation should reach the upstream backend with its own key")
+
+	// Keys are forgotten with their connection
+	require.NoError(t, client.Close())
+	keys := handler.(*PostgreSQLConnectionHandler).cancelKeys
+	require.Eventually(t, func() bool {
+		_, ok := keys.lookup(pid, key)
+		return !ok
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestPostgreSQLConnectionHandler_ProxyResultVolume(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.Handle("SELECT id, name FROM users", testkit.Result{
+		Columns: []string{"id", "name"},
+		Rows:    [][]string{{"1", "alice"}, {"2", "bob"}},
+	})
+
+	engine := &mocks.StaticPolicyEngine{}
+	queryLogger := mocks.NewRecordingQueryLogger()
+	handler := NewPostgreSQLConnectionHandler(queryLogger, NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithUpstreams(upstreamSelector(backend.Addr())))
+	addr := startHandler(t, handler)
+
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+	_, err := client.Query("SELECT id, name FROM users")
+	require.NoError(t, err)
+	_, err = client.Exec("SELECT id, name FROM users")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return len(engine.Usage()) == 2 }, 2*time.Second, 10*time.Millisecond)
+	for _, usage := range engine.Usage() {
+		assert.Equal(t, int64(2), usage.Rows)
+		assert.Equal(t, int64(10), usage.Bytes)
+		assert.Positive(t, usage.Duration, "Statements should be timed until the upstream completes them")
+	}
+
+	var results []string
+	for _, message := range queryLogger.ProtocolMessages() {
+		if strings.HasPrefix(message, "CommandComplete") {
+			results = append(results, message)
+		}
+	}
+	require.Len(t, results, 2)
+	assert.Contains(t, results[0], "rows:2")
+	assert.Contains(t, results[0], "bytes:10")
+	assert.Contains(t, results[0], "command_tag:SELECT 2")
+}
+
+func TestPostgreSQLConnectionHandler_ProxyDrain(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithUpstreams(upstreamSelector(backend.Addr())))
+	addr := startHandler(t, handler)
+
+	idle := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+	busy := testkit.MustDial(t, addr, testkit.ClientConfig{User: "bob", Database: "app"})
+	_, err := busy.Query("BEGIN")
+	require.NoError(t, err)
+	require.Equal(t, byte('T'), busy.TxStatus())
+
+	handler.(domain.ConnectionDrainer).Drain()
+
+	// Idle connections are closed right away, new ones are refused
+	var serverErr *testkit.ServerError
+	require.ErrorAs(t, idle.WaitClosed(time.Second), &serverErr)
+	assert.Equal(t, pgerrAdminShutdown, serverErr.Code)
+	_, err = testkit.Dial(addr, testkit.ClientConfig{User: "carol", Database: "app"})
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, pgerrCannotConnectNow, serverErr.Code)
+
+	// Open transactions run to completion
+	_, err = busy.Query("SELECT 1")
+	require.NoError(t, err)
+	_, err = busy.Exec("COMMIT")
+	require.NoError(t, err)
+	require.ErrorAs(t, busy.WaitClosed(time.Second), &serverErr)
+	assert.Equal(t, pgerrAdminShutdown, serverErr.Code)
+
+	assert.Equal(t, []string{"BEGIN", "SELECT 1", "COMMIT"}, backend.Queries())
+}
+
+func TestPostgreSQLConnectionHandler_ProxyTerminate(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	release := make(chan struct{})
+	defer close(release)
+	backend.HandleFunc(func(query string) testkit.Result {
+		<-release
+		return testkit.Result{}
+	})
+
+	terminations := make(chan func(), 1)
+	queries := make(chan string, 1)
+	tracker := &mocks.ConnectionTracker{}
+	tracker.On("Track", "conn_1", "alice", "app", mock.Anything)
+	tracker.On("Register", mock.MatchedBy(func(session domain.Session) bool { return session.ClientAddr != "" }), mock.Anything).
+		Run(func(args mock.Arguments) { terminations <- args.Get(1).(func()) })
+	tracker.On("QueryStarted", "conn_1", mock.Anything).Run(func(args mock.Arguments) { queries <- args.String(1) })
+	tracker.On("Idle", "conn_1")
+	tracker.On("Busy", "conn_1").Return(true)
+	tracker.On("UpdateSession", "conn_1", mock.Anything)
+	untracked := make(chan struct{})
+	tracker.On("Untrack", "conn_1").Run(func(mock.Arguments) { close(untracked) })
+
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithUpstreams(upstreamSelector(backend.Addr())), WithConnectionTracker(tracker))
+	addr := startHandler(t, handler)
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+	terminate := <-terminations
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := client.Query("SELECT pg_sleep(60)")
+		result <- err
+	}()
+	select {
+	case query := <-queries:
+		assert.Equal(t, "SELECT pg_sleep(60)", query)
+	case <-time.After(2 * time.Second):
+		t.Fatal("The running query was not reported")
+	}
+	require.Eventually(t, func() bool { return len(backend.Queries()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	terminate()
+
+	var serverErr *testkit.ServerError
+	select {
+	case err := <-result:
+		require.ErrorAs(t, err, &serverErr)
+	case <-time.After(2 * time.Second):
+		t.Fatal("The terminated client was not closed")
+	}
+	assert.Equal(t, pgerrAdminShutdown, serverErr.Code)
+	assert.Equal(t, "terminating connection due to administrator command", serverErr.Message)
+	require.Eventually(t, func() bool { return len(backend.CancelRequests()) == 1 }, 2*time.Second, 10*time.Millisecond,
+		"The running query should be cancelled upstream")
+	select {
+	case <-untracked:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The handler should return once both legs are closed")
+	}
+}
+
+func TestPostgreSQLConnectionHandler_ProxyStatementTimeout(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.HandleFunc(func(query string) testkit.Result {
+		if query != "SELECT pg_sleep(60)" {
+			return testkit.Result{CommandTag: "SELECT 1"}
+		}
+		for len(backend.CancelRequests()) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return testkit.Result{Err: &testkit.ServerError{Code: pgerrQueryCanceled, Message: "canceling statement due to user request"}}
+	})
+
+	clock := testkit.NewFakeClock(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	engine := &mocks.StaticPolicyEngine{Decision: domain.Decision{
+		Action:           domain.DecisionAllow,
+		StatementTimeout: 30 * time.Second,
+		TimeoutPolicy:    "reporting",
+	}}
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithUpstreams(upstreamSelector(backend.Addr())), WithClock(clock))
+	addr := startHandler(t, handler)
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+
+	_, err := client.Query("SELECT 1")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return clock.PendingTimers() == 0 }, 2*time.Second, 10*time.Millisecond,
+		"The timeout of a finished statement should be stopped")
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := client.Query("SELECT pg_sleep(60)")
+		result <- err
+	}()
+	require.True(t, clock.WaitForTimers(1, 2*time.Second))
+	clock.Advance(30 * time.Second)
+
+	var serverErr *testkit.ServerError
+	select {
+	case err := <-result:
+		require.ErrorAs(t, err, &serverErr)
+	case <-time.After(2 * time.Second):
+		t.Fatal("The statement was not cancelled")
+	}
+	assert.Equal(t, pgerrQueryCanceled, serverErr.Code)
+	assert.Equal(t, "canceling statement due to statement timeout", serverErr.Message)
+	assert.Equal(t, `quota "reporting" limits statements to 30s`, serverErr.Detail)
+	assert.Len(t, backend.CancelRequests(), 1)
+
+	// The connection stays usable after a cancellation
+	_, err = client.Query("SELECT 1")
+	require.NoError(t, err)
+}
+
+func TestPostgreSQLConnectionHandler_ProxyStatementTimeoutPerStatement(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.HandleFunc(func(query string) testkit.Result {
+		// Each sleep runs until the proxy has cancelled one more statement
+		cancels := map[string]int{"SELECT pg_sleep(60)": 1, "SELECT pg_sleep(61)": 2}[query]
+		if cancels == 0 {
+			return testkit.Result{CommandTag: "SELECT 1"}
+		}
+		for len(backend.CancelRequests()) < cancels {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return testkit.Result{Err: &testkit.ServerError{Code: pgerrQueryCanceled, Message: "canceling statement due to user request"}}
+	})
+
+	clock := testkit.NewFakeClock(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	engine := &mocks.PolicyEngine{}
+	engine.On("Evaluate", mock.Anything, mock.MatchedBy(func(q *domain.Query) bool {
+		return q.Raw == "SELECT 1"
+	})).Return(domain.Decision{Action: domain.DecisionAllow, StatementTimeout: time.Second, TimeoutPolicy: "lookups"}, nil)
+	engine.On("Evaluate", mock.Anything, mock.MatchedBy(func(q *domain.Query) bool {
+		return q.Raw == "SELECT 2"
+	})).Return(domain.AllowDecision(), nil)
+	engine.On("Evaluate", mock.Anything, mock.Anything).
+		Return(domain.Decision{Action: domain.DecisionAllow, StatementTimeout: 10 * time.Minute, TimeoutPolicy: "reporting"}, nil)
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithUpstreams(upstreamSelector(backend.Addr())), WithClock(clock))
+	addr := startHandler(t, handler)
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+
+	run := func(sql string) <-chan error {
+		result := make(chan error, 1)
+		go func() {
+			_, err := client.Query(sql)
+			result <- err
+		}()
+		return result
+	}
+	cancelled := func(result <-chan error) *testkit.ServerError {
+		var serverErr *testkit.ServerError
+		select {
+		case err := <-result:
+			require.ErrorAs(t, err, &serverErr)
+		case <-time.After(2 * time.Second):
+			t.Fatal("The statement was not cancelled")
+		}
+		return serverErr
+	}
+
+	// A statement is held to its own timeout, not to the shorter one of the
+	// statement after it
+	result := run("SELECT pg_sleep(60); SELECT 1")
+	require.True(t, clock.WaitForTimers(1, 2*time.Second))
+	clock.Advance(time.Second)
+	assert.Never(t, func() bool { return len(backend.CancelRequests()) > 0 }, 200*time.Millisecond, 10*time.Millisecond)
+	clock.Advance(10 * time.Minute)
+	serverErr := cancelled(result)
+	assert.Equal(t, `quota "reporting" limits statements to 10m0s`, serverErr.Detail)
+
+	// The timeout of a statement starts once the statement before it completed
+	result = run("SELECT 2; SELECT pg_sleep(61)")
+	require.True(t, clock.WaitForTimers(1, 2*time.Second))
+	clock.Advance(10 * time.Minute)
+	serverErr = cancelled(result)
+	assert.Equal(t, `quota "reporting" limits statements to 10m0s`, serverErr.Detail)
+}
+
+func TestPostgreSQLConnectionHandler_ProxyResultCaps(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.Handle("SELECT id, name FROM users", testkit.Result{
+		Columns: []string{"id", "name"},
+		Rows:    [][]string{{"1", "alice"}, {"2", "bob"}, {"3", "carol"}},
+	})
+	backend.Handle("SELECT description FROM reports", testkit.Result{
+		Columns: []string{"description"},
+		Rows:    [][]string{{"quarterly revenue"}},
+	})
+	backend.Handle("SELECT id FROM teams", testkit.Result{
+		Columns: []string{"id"},
+		Rows:    [][]string{{"1"}, {"2"}},
+	})
+
+	engine := &mocks.StaticPolicyEngine{Decision: domain.Decision{
+		Action:            domain.DecisionAllow,
+		MaxResultRows:     2,
+		ResultRowsPolicy:  "reporting-rows",
+		MaxResultBytes:    12,
+		ResultBytesPolicy: "reporting-bytes",
+	}}
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithUpstreams(upstreamSelector(backend.Addr())))
+	addr := startHandler(t, handler)
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+
+	_, err := client.Query("SELECT id, name FROM users")
+	var serverErr *testkit.ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, pgerrQuotaExceeded, serverErr.Code)
+	assert.Equal(t, `quota "reporting-rows" exceeded: results are limited to 2 rows`, serverErr.Message)
+	require.Eventually(t, func() bool { return len(backend.CancelRequests()) == 1 }, 2*time.Second, 10*time.Millisecond,
+		"The statement should be cancelled upstream")
+
+	_, err = client.Exec("SELECT description FROM reports")
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, `quota "reporting-bytes" exceeded: results are limited to 12 bytes`, serverErr.Message)
+
+	// The connection stays usable, and results within the caps are relayed whole
+	result, err := client.Query("SELECT id FROM teams")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"1"}, {"2"}}, result.Rows)
+	result, err = client.Exec("SELECT id FROM teams")
+	require.NoError(t, err)
+	assert.Len(t, result.Rows, 2)
+}
+
+func TestPostgreSQLConnectionHandler_ProxyResultCapsPerStatement(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.Handle("SELECT id FROM teams", testkit.Result{Columns: []string{"id"}, Rows: [][]string{{"1"}}})
+	backend.Handle("SELECT id FROM projects", testkit.Result{Columns: []string{"id"}, Rows: [][]string{{"1"}, {"2"}, {"3"}}})
+
+	engine := &mocks.PolicyEngine{}
+	engine.On("Evaluate", mock.Anything, mock.MatchedBy(func(q *domain.Query) bool {
+		return q.Raw == "SELECT id FROM teams"
+	})).Return(domain.Decision{Action: domain.DecisionAllow, MaxResultRows: 1, ResultRowsPolicy: "teams-rows"}, nil)
+	engine.On("Evaluate", mock.Anything, mock.Anything).
+		Return(domain.Decision{Action: domain.DecisionAllow, MaxResultRows: 2, ResultRowsPolicy: "projects-rows"}, nil)
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithUpstreams(upstreamSelector(backend.Addr())))
+	addr := startHandler(t, handler)
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+
+	// Each statement is held to the caps of its own policies
+	_, err := client.Query("SELECT id FROM teams; SELECT id FROM projects")
+	var serverErr *testkit.ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, `quota "projects-rows" exceeded: results are limited to 2 rows`, serverErr.Message)
+
+	backend.Handle("SELECT id FROM projects", testkit.Result{Columns: []string{"id"}, Rows: [][]string{{"1"}, {"2"}}})
+	result, err := client.Query("SELECT id FROM projects; SELECT id FROM teams")
+	require.NoError(t, err, "The cap of a statement should not apply to the statements after it")
+	assert.Equal(t, [][]string{{"1"}}, result.Rows)
+}
+
+func TestPostgreSQLConnectionHandler_ProxyTransactionLimits(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	clock := testkit.NewFakeClock(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	engine := &mocks.StaticPolicyEngine{Decision: domain.Decision{
+		Action:                      domain.DecisionAllow,
+		MaxTransactionDuration:      time.Minute,
+		TransactionDurationPolicy:   "short-transactions",
+		MaxTransactionStatements:    3,
+		TransactionStatementsPolicy: "small-transactions",
+	}}
+	queryLogger := mocks.NewRecordingQueryLogger()
+	handler := NewPostgreSQLConnectionHandler(queryLogger, NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithUpstreams(upstreamSelector(backend.Addr())), WithClock(clock))
+	addr := startHandler(t, handler)
+
+	// Statements outside transactions, and transactions within the limits, run
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+	for _, query := range []string{"SELECT 1", "SELECT 1", "SELECT 1", "SELECT 1", "BEGIN", "SELECT 1", "SELECT 1", "COMMIT", "SELECT 1"} {
+		_, err := client.Query(query)
+		require.NoError(t, err, query)
+	}
+	require.Eventually(t, func() bool { return clock.PendingTimers() == 0 }, 2*time.Second, 10*time.Millisecond,
+		"The duration limit of a finished transaction should be stopped")
+
+	client = testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+	for _, query := range []string{"BEGIN", "SELECT 1", "SELECT 1", "SELECT 1"} {
+		_, err := client.Query(query)
+		require.NoError(t, err, query)
+	}
+	var serverErr *testkit.ServerError
+	require.ErrorAs(t, client.WaitClosed(2*time.Second), &serverErr)
+	assert.Equal(t, pgerrQuotaExceeded, serverErr.Code)
+	assert.Equal(t, `terminating connection due to transaction statement limit: quota "small-transactions" limits transactions to 3 statements`, serverErr.Message)
+	logged := queryLogger.ProtocolMessages()
+	require.NotEmpty(t, logged)
+	assert.Regexp(t, `^TransactionKilled: map\[fingerprints:\[\w+ \w+\] `, logged[len(logged)-1],
+		"The fingerprints of the statements of the transaction should be logged")
+
+	client = testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+	_, err := client.Query("BEGIN")
+	require.NoError(t, err)
+	require.True(t, clock.WaitForTimers(1, 2*time.Second))
+	clock.Advance(time.Minute)
+	require.ErrorAs(t, client.WaitClosed(2*time.Second), &serverErr)
+	assert.Equal(t, pgerrTransactionTimeout, serverErr.Code)
+	assert.Equal(t, `terminating connection due to transaction timeout: quota "short-transactions" limits transactions to 1m0s`, serverErr.Message)
+}
+
+func TestPostgreSQLConnectionHandler_ProxyReleasesConcurrencySlots(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	unblock := make(chan struct{})
+	t.Cleanup(func() { close(unblock) })
+	backend.HandleFunc(func(query string) testkit.Result {
+		if query == "SELECT pg_sleep(60)" {
+			<-unblock
+		}
+		return testkit.Result{CommandTag: "SELECT 1"}
+	})
+
+	var released atomic.Int64
+	engine := &mocks.StaticPolicyEngine{Decision: domain.Decision{
+		Action:  domain.DecisionAllow,
+		Release: func() { released.Add(1) },
+	}}
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithUpstreams(upstreamSelector(backend.Addr())))
+	addr := startHandler(t, handler)
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+
+	_, err := client.Query("SELECT 1")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return released.Load() == 1 }, 2*time.Second, 10*time.Millisecond,
+		"The slot should be released once the statement ended")
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	frontend := pgproto3.NewFrontend(conn, conn)
+	frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice", "database": "app"},
+	})
+	require.NoError(t, frontend.Flush())
+	for {
+		message, err := frontend.Receive()
+		require.NoError(t, err)
+		if _, ok := message.(*pgproto3.ReadyForQuery); ok {
+			break
+		}
+	}
+	frontend.Send(&pgproto3.Query{String: "SELECT pg_sleep(60)"})
+	require.NoError(t, frontend.Flush())
+	require.Eventually(t, func() bool { return len(backend.Queries()) == 2 }, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int64(1), released.Load(), "The slot should be held while the statement runs")
+
+	// The slots of statements still running are released when the client leaves
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool { return released.Load() == 2 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestPostgreSQLConnectionHandler_ProxyIdleTimeouts(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+
+	clock := testkit.NewFakeClock(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithUpstreams(upstreamSelector(backend.Addr())), WithClock(clock), WithReadTimeout(10*time.Millisecond),
+		WithIdleTimeouts(time.Hour, 10*time.Second))
+	addr := startHandler(t, handler)
+
+	idle := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+	_, err := idle.Query("SELECT 1")
+	require.NoError(t, err)
+	inTransaction := testkit.MustDial(t, addr, testkit.ClientConfig{User: "bob", Database: "app"})
+	_, err = inTransaction.Query("BEGIN")
+	require.NoError(t, err)
+
+	closedWithin := func(client *testkit.Client, step time.Duration) *testkit.ServerError {
+		t.Helper()
+		closed := make(chan error, 1)
+		go func() { closed <- client.WaitClosed(5 * time.Second) }()
+		require.Eventually(t, func() bool {
+			clock.Advance(step)
+			return len(closed) == 1
+		}, 3*time.Second, 10*time.Millisecond)
+		var serverErr *testkit.ServerError
+		require.ErrorAs(t, <-closed, &serverErr)
+		return serverErr
+	}
+
+	serverErr := closedWithin(inTransaction, time.Second)
+	assert.Equal(t, pgerrIdleInTransactionTimeout, serverErr.Code)
+	assert.Equal(t, "terminating connection due to idle-in-transaction timeout", serverErr.Message)
+
+	_, err = idle.Query("SELECT 1")
+	require.NoError(t, err, "A client idle outside a transaction should have its own timeout")
+
+	serverErr = closedWithin(idle, 10*time.Minute)
+	assert.Equal(t, pgerrIdleSessionTimeout, serverErr.Code)
+	assert.Equal(t, "terminating connection due to idle-session timeout", serverErr.Message)
+}
+
+func TestPostgreSQLConnectionHandler_ProxySessionState(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	idle := make(chan struct{}, 16)
+	states := make(chan domain.SessionState, 16)
+	tracker := &mocks.ConnectionTracker{}
+	tracker.On("Track", "conn_1", "alice", "app", mock.Anything)
+	tracker.On("Idle", "conn_1").Run(func(mock.Arguments) { idle <- struct{}{} })
+	tracker.On("Register", mock.Anything, mock.Anything)
+	tracker.On("QueryStarted", "conn_1", mock.Anything)
+	tracker.On("Busy", "conn_1").Return(true)
+	tracker.On("UpdateSession", "conn_1", mock.Anything).
+		Run(func(args mock.Arguments) { states <- args.Get(1).(domain.SessionState) })
+	tracker.On("Untrack", "conn_1")
+
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithUpstreams(upstreamSelector(backend.Addr())), WithConnectionTracker(tracker))
+	addr := startHandler(t, handler)
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+
+	receive := func(what string) domain.SessionState {
+		t.Helper()
+		select {
+		case state := <-states:
+			return state
+		case <-time.After(2 * time.Second):
+			t.Fatalf("No session state reported after %s", what)
+			return domain.SessionState{}
+		}
+	}
+	drainIdle := func() int {
+		count := 0
+		for {
+			select {
+			case <-idle:
+				count++
+			default:
+				return count
+			}
+		}
+	}
+
+	_, err := client.Exec("BEGIN")
+	require.NoError(t, err)
+	assert.Equal(t, domain.TransactionActive, receive("BEGIN").Transaction)
+	_, err = client.Exec("SET search_path TO billing")
+	require.NoError(t, err)
+	drainIdle()
+	time.Sleep(100 * time.Millisecond)
+	assert.Zero(t, drainIdle(), "Connections inside a transaction should never be marked idle")
+
+	_, err = client.Exec("COMMIT")
+	require.NoError(t, err)
+	assert.Equal(t, domain.SessionState{Transaction: domain.TransactionIdle, Parameters: map[string]string{"search_path": "billing"}}, receive("COMMIT"))
+	select {
+	case <-idle:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The connection should be marked idle once its transaction ends")
+	}
+
+	_, err = client.Exec("BEGIN")
+	require.NoError(t, err)
+	receive("BEGIN")
+	_, err = client.Exec("RESET search_path")
+	require.NoError(t, err)
+	_, err = client.Exec("ROLLBACK")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"search_path": "billing"}, receive("ROLLBACK").Parameters, "Rolled back changes should not last")
+}
+
+func TestPostgreSQLConnectionHandler_ProxyDatabaseRoutes(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	replica := testkit.StartFakeBackend(t)
+
+	engine := &mocks.StaticPolicyEngine{}
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithUpstreams(upstreamSelector(backend.Addr())),
+		WithDatabaseUpstreams("reporting", "analytics_ro", upstreamSelector(replica.Addr()), nil),
+		WithDatabaseUpstreams("legacy", "app", nil, nil))
+	addr := startHandler(t, handler)
+
+	for _, database := range []string{"reporting", "legacy", "app"} {
+		client := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: database})
+		_, err := client.Query("SELECT '" + database + "'")
+		require.NoError(t, err)
+	}
+
+	require.Len(t, replica.StartupParameters(), 1)
+	assert.Equal(t, "analytics_ro", replica.StartupParameters()[0]["database"], "Databases should be renamed upstream")
+	assert.Equal(t, []string{"SELECT 'reporting'"}, replica.Queries())
+
+	require.Len(t, backend.StartupParameters(), 2)
+	assert.Equal(t, "app", backend.StartupParameters()[0]["database"], "Aliases should keep the default upstream")
+	assert.Equal(t, "app", backend.StartupParameters()[1]["database"])
+	assert.Equal(t, []string{"SELECT 'legacy'", "SELECT 'app'"}, backend.Queries())
+
+	require.Len(t, engine.Queries(), 3)
+	assert.Equal(t, "reporting", engine.Queries()[0].Database, "Policies should see the database clients connect to")
+	assert.Equal(t, "legacy", engine.Queries()[1].Database)
+}
+
+func TestPostgreSQLConnectionHandler_ProxyUpstreamLost(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithUpstreams(upstreamSelector(backend.Addr())))
+	addr := startHandler(t, handler)
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+
+	backend.DropNextQuery()
+	_, err := client.Query("SELECT 1")
+
+	var serverErr *testkit.ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, "FATAL", serverErr.Severity)
+	assert.Equal(t, pgerrAdminShutdown, serverErr.Code, "Clients should be told to reconnect rather than see a reset connection")
+
+	idle := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app"})
+	backend.DropConnections()
+	require.ErrorAs(t, idle.WaitClosed(2*time.Second), &serverErr)
+	assert.Equal(t, pgerrAdminShutdown, serverErr.Code)
+}
+
+func TestPostgreSQLConnectionHandler_ProxyUpstreamReconnect(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithUpstreams(upstreamSelector(backend.Addr())), WithUpstreamReconnect())
+	addr := startHandler(t, handler)
+	client := testkit.MustDial(t, addr, testkit.ClientConfig{User: "alice", Database: "app", Parameters: map[string]string{"application_name": "billing"}})
+	_, err := client.Exec("SET search_path TO billing")
+	require.NoError(t, err)
+
+	// Idle clients are reconnected with their startup and session parameters
+	backend.DropConnections()
+	require.Eventually(t, func() bool { return len(backend.StartupParameters()) == 2 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "billing", backend.StartupParameters()[1]["application_name"])
+	_, err = client.Query("SELECT 1")
+	require.NoError(t, err)
+
+	// A query only reading is sent again when nothing of its result was relayed
+	backend.DropNextQuery()
+	_, err = client.Query("SELECT 2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"SET search_path TO billing", `SET "search_path" TO billing`, "SELECT 1", "SELECT 2", `SET "search_path" TO billing`, "SELECT 2"}, backend.Queries())
+
+	// Others end the client connection, since they may have run
+	backend.DropNextQuery()
+	_, err = client.Exec("UPDATE accounts SET balance = 0")
+	var serverErr *testkit.ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, pgerrAdminShutdown, serverErr.Code)
+}
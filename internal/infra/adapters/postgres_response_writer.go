@@ -0,0 +1,290 @@
+package adapters
+
+import (
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// pgerrQuotaExceeded is the SQLSTATE reported for queries denied by a quota (configuration_limit_exceeded)
+const pgerrQuotaExceeded = "53400"
+
+// pgerrWarning is the SQLSTATE of the notices warning about a quota (warning)
+const pgerrWarning = "01000"
+
+// PostgreSQLResponseWriter writes the responses the enforcer itself sends to a client.
+// In proxy mode upstream messages are relayed through it too, so it knows the
+// client's transaction status and can deliver an error in its place in the
+// upstream's reply stream.
+type PostgreSQLResponseWriter struct {
+	parser *PostgreSQLParser
+
+	mu       sync.Mutex
+	txStatus byte                       // from the last ReadyForQuery sent to the client
+	pending  []pendingError             // errors sent just before the ReadyForQuery they belong to, in order
+	notices  []*pgproto3.NoticeResponse // sent just before the next relayed message
+	awaiting int                        // ReadyForQuery messages the upstream still owes
+	readies  int64                      // ReadyForQuery messages relayed so far
+	held     []heldAnswer               // answers of the enforcer waiting for their turn, in order
+	relayed  int64                      // upstream messages relayed so far
+	fatal    bool                       // the upstream sent a FATAL error, before closing its connection
+}
+
+// heldAnswer answers a query the enforcer answers itself, once the upstream
+// answered the messages forwarded before it
+type heldAnswer struct {
+	ready    int64 // value of readies once the messages before it are answered
+	messages []pgproto3.BackendMessage
+}
+
+// pendingError is the error of a denied extended protocol message, sent just
+// before the ReadyForQuery answering the client's Sync
+type pendingError struct {
+	ready    int64 // value of readies once that ReadyForQuery is relayed
+	response *pgproto3.ErrorResponse
+}
+
+// NewPostgreSQLResponseWriter creates a response writer sending through parser
+func NewPostgreSQLResponseWriter(parser *PostgreSQLParser) *PostgreSQLResponseWriter {
+	return &PostgreSQLResponseWriter{
+		parser:   parser,
+		txStatus: 'I',
+	}
+}
+
+// Reject sends a FATAL error; the connection is expected to be closed afterwards
+func (w *PostgreSQLResponseWriter) Reject(code, message string) error {
+	if err := w.parser.Send(&pgproto3.ErrorResponse{
+		Severity:            "FATAL",
+		SeverityUnlocalized: "FATAL",
+		Code:                code,
+		Message:             message,
+	}); err != nil {
+		return fmt.Errorf("failed to send error to client: %w", err)
+	}
+	return nil
+}
+
+// Deny answers a denied query with an ErrorResponse followed by ReadyForQuery, leaving
+// the client free to send its next query. The transaction status is unchanged since
+// the query never reached the upstream. Like Fail's, the answer waits for the
+// upstream to answer the queries forwarded before it.
+func (w *PostgreSQLResponseWriter) Deny(decision domain.Decision) error {
+	if err := w.respond([]pgproto3.BackendMessage{quotaExceededError(decision)}); err != nil {
+		return fmt.Errorf("failed to send quota error to client: %w", err)
+	}
+	return nil
+}
+
+// Answer answers a query the enforcer ran itself with its rows, in the text
+// format, followed by ReadyForQuery. A nil value is a NULL. The answer waits
+// for its turn like Fail's.
+func (w *PostgreSQLResponseWriter) Answer(columns []pgproto3.FieldDescription, rows [][][]byte) error {
+	messages := make([]pgproto3.BackendMessage, 0, len(rows)+2)
+	messages = append(messages, &pgproto3.RowDescription{Fields: columns})
+	for _, row := range rows {
+		messages = append(messages, &pgproto3.DataRow{Values: row})
+	}
+	messages = append(messages, &pgproto3.CommandComplete{CommandTag: selectTag(len(rows))})
+	if err := w.respond(messages); err != nil {
+		return fmt.Errorf("failed to send rows to client: %w", err)
+	}
+	return nil
+}
+
+// Fail answers a query the enforcer failed to run itself with the error of
+// decision, followed by ReadyForQuery. While the upstream has not answered
+// every Query and Sync forwarded before the query, the answer is held until it
+// has, so that the client gets its answers in the order it sent its queries.
+func (w *PostgreSQLResponseWriter) Fail(decision domain.Decision) error {
+	if err := w.respond([]pgproto3.BackendMessage{quotaExceededError(decision)}); err != nil {
+		return fmt.Errorf("failed to send error to client: %w", err)
+	}
+	return nil
+}
+
+// respond sends messages followed by ReadyForQuery, or holds them until the
+// upstream answered the messages forwarded so far. The lock is held while they
+// are queued, so that no relayed message comes between them.
+func (w *PostgreSQLResponseWriter) respond(messages []pgproto3.BackendMessage) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.awaiting > 0 {
+		w.held = append(w.held, heldAnswer{ready: w.readies + int64(w.awaiting), messages: messages})
+		return nil
+	}
+
+	for _, msg := range messages {
+		w.parser.Queue(msg)
+	}
+	w.parser.Queue(&pgproto3.ReadyForQuery{TxStatus: w.txStatus})
+	return w.parser.Flush()
+}
+
+// DenyBeforeReady holds the error for a denied extended protocol message until the
+// upstream answers the client's Sync, which is forwarded next, so it reaches the
+// client after the replies to the messages that were forwarded before it and
+// just before the ReadyForQuery ending its own batch
+func (w *PostgreSQLResponseWriter) DenyBeforeReady(decision domain.Decision) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(w.pending, pendingError{ready: w.readies + int64(w.awaiting) + 1, response: quotaExceededError(decision)})
+}
+
+// Warn sends the warnings of an allowed query as notices
+func (w *PostgreSQLResponseWriter) Warn(decision domain.Decision) error {
+	for _, warning := range decision.Warnings {
+		w.parser.Queue(quotaWarningNotice(warning))
+	}
+	if err := w.parser.Flush(); err != nil {
+		return fmt.Errorf("failed to send quota warning to client: %w", err)
+	}
+	return nil
+}
+
+// WarnBeforeNext holds the warnings of an allowed query forwarded upstream until
+// the upstream's next message, so that the notices are relayed between two of
+// its messages rather than written over one
+func (w *PostgreSQLResponseWriter) WarnBeforeNext(decision domain.Decision) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, warning := range decision.Warnings {
+		w.notices = append(w.notices, quotaWarningNotice(warning))
+	}
+}
+
+// Await records that a Query or Sync was forwarded upstream, which the upstream
+// answers with a ReadyForQuery
+func (w *PostgreSQLResponseWriter) Await() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.awaiting++
+}
+
+// Idle reports whether the client is outside a transaction and every forwarded
+// Query and Sync was answered
+func (w *PostgreSQLResponseWriter) Idle() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.txStatus == 'I' && w.awaiting == 0
+}
+
+// Answered reports whether every forwarded Query and Sync was answered, inside a
+// transaction or not, along with the client's transaction status
+func (w *PostgreSQLResponseWriter) Answered() (bool, domain.TransactionStatus) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.awaiting == 0, domain.TransactionStatus(w.txStatus)
+}
+
+// UpstreamLost tells the client its upstream connection was lost, the way
+// PostgreSQL tells its clients it shuts down, so that they reconnect rather
+// than see a reset connection. Nothing is sent when the upstream said why with
+// a FATAL error of its own before closing the connection.
+func (w *PostgreSQLResponseWriter) UpstreamLost() error {
+	w.mu.Lock()
+	fatal := w.fatal
+	w.mu.Unlock()
+	if fatal {
+		return nil
+	}
+
+	if err := w.parser.Send(&pgproto3.ErrorResponse{
+		Severity:            "FATAL",
+		SeverityUnlocalized: "FATAL",
+		Code:                pgerrAdminShutdown,
+		Message:             "terminating connection because the connection to the upstream server was lost",
+		Hint:                "The upstream server may be restarting. Reconnect and retry; a statement in progress may or may not have completed.",
+	}); err != nil {
+		return fmt.Errorf("failed to send error to client: %w", err)
+	}
+	return nil
+}
+
+// Relayed returns how many upstream messages were relayed to the client
+func (w *PostgreSQLResponseWriter) Relayed() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.relayed
+}
+
+// Relay queues an upstream message for the client; the caller flushes. The
+// lock is held while messages are queued, so that the enforcer's own answers
+// are never queued between them.
+func (w *PostgreSQLResponseWriter) Relay(msg pgproto3.BackendMessage) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.relayed++
+	if response, ok := msg.(*pgproto3.ErrorResponse); ok && (response.Severity == "FATAL" || response.Severity == "PANIC") {
+		w.fatal = true
+	}
+	for _, notice := range w.notices {
+		w.parser.Queue(notice)
+	}
+	w.notices = nil
+
+	ready, ok := msg.(*pgproto3.ReadyForQuery)
+	if !ok {
+		w.parser.Queue(msg)
+		return
+	}
+
+	w.txStatus = ready.TxStatus
+	if w.awaiting > 0 {
+		w.awaiting--
+	}
+	w.readies++
+	for len(w.pending) > 0 && w.pending[0].ready <= w.readies {
+		w.parser.Queue(w.pending[0].response)
+		w.pending = w.pending[1:]
+	}
+	w.parser.Queue(msg)
+	for len(w.held) > 0 && w.held[0].ready <= w.readies {
+		for _, message := range w.held[0].messages {
+			w.parser.Queue(message)
+		}
+		w.parser.Queue(&pgproto3.ReadyForQuery{TxStatus: ready.TxStatus})
+		w.held = w.held[1:]
+	}
+}
+
+// quotaExceededError describes a denial: which quota was exceeded and when it
+// resets, or why a policy rejected the query
+func quotaExceededError(decision domain.Decision) *pgproto3.ErrorResponse {
+	message := decision.Reason
+	if message == "" {
+		message = fmt.Sprintf("quota %q exceeded", decision.Policy)
+	}
+	if !decision.ResetAt.IsZero() {
+		message = fmt.Sprintf("%s; resets at %s", message, decision.ResetAt.UTC().Format(time.RFC3339))
+	}
+
+	response := &pgproto3.ErrorResponse{
+		Severity:            "ERROR",
+		SeverityUnlocalized: "ERROR",
+		Code:                pgerrQuotaExceeded,
+		Message:             message,
+		Hint:                decision.Hint,
+	}
+	if decision.Code != "" {
+		response.Code = decision.Code
+	}
+	if decision.Limit > 0 {
+		response.Detail = fmt.Sprintf("Policy %q allows %d, %d already used.", decision.Policy, decision.Limit, decision.Used)
+	}
+	return response
+}
+
+// quotaWarningNotice is a WARNING notice carrying one of the warnings of an
+// allowed query
+func quotaWarningNotice(warning string) *pgproto3.NoticeResponse {
+	return &pgproto3.NoticeResponse{
+		Severity:            "WARNING",
+		SeverityUnlocalized: "WARNING",
+		Code:                pgerrWarning,
+		Message:             warning,
+	}
+}
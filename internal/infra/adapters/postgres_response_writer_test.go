@@ -0,0 +1,167 @@
+package adapters
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receiveMessages decodes count backend messages written to out
+func receiveMessages(t *testing.T, out *bytes.Buffer, count int) []pgproto3.BackendMessage {
+	t.Helper()
+
+	frontend := pgproto3.NewFrontend(out, nil)
+	var messages []pgproto3.BackendMessage
+	for len(messages) < count {
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		// Received messages are only valid until the next Receive
+		switch m := msg.(type) {
+		case *pgproto3.ErrorResponse:
+			copied := *m
+			messages = append(messages, &copied)
+		case *pgproto3.ReadyForQuery:
+			copied := *m
+			messages = append(messages, &copied)
+		case *pgproto3.NoticeResponse:
+			copied := *m
+			messages = append(messages, &copied)
+		default:
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+func TestPostgreSQLResponseWriter_Deny(t *testing.T) {
+	var out bytes.Buffer
+	writer := NewPostgreSQLResponseWriter(NewPostgreSQLParser(&bytes.Buffer{}, &out))
+
+	require.NoError(t, writer.Deny(domain.Decision{
+		Action:  domain.DecisionDeny,
+		Policy:  "per-user",
+		Reason:  `quota "per-user" exceeded: 5 of 5 queries per 1m0s`,
+		Limit:   5,
+		Used:    5,
+		ResetAt: time.Date(2026, 3, 1, 8, 30, 0, 0, time.UTC),
+	}))
+
+	messages := receiveMessages(t, &out, 2)
+	errorResponse, ok := messages[0].(*pgproto3.ErrorResponse)
+	require.True(t, ok, "Expected an ErrorResponse, got %T", messages[0])
+	assert.Equal(t, "ERROR", errorResponse.Severity)
+	assert.Equal(t, pgerrQuotaExceeded, errorResponse.Code)
+	assert.Equal(t, `quota "per-user" exceeded: 5 of 5 queries per 1m0s; resets at 2026-03-01T08:30:00Z`, errorResponse.Message)
+	assert.Equal(t, `Policy "per-user" allows 5, 5 already used.`, errorResponse.Detail)
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'I'}, messages[1])
+}
+
+func TestPostgreSQLResponseWriter_DenyWithCode(t *testing.T) {
+	var out bytes.Buffer
+	writer := NewPostgreSQLResponseWriter(NewPostgreSQLParser(&bytes.Buffer{}, &out))
+
+	require.NoError(t, writer.Deny(domain.Decision{
+		Action: domain.DecisionDeny,
+		Policy: "audit-readonly",
+		Reason: `DELETE on audit.log denied by policy "audit-readonly"`,
+		Code:   "42501",
+		Hint:   "Writes to audit tables go through the audit service.",
+	}))
+
+	messages := receiveMessages(t, &out, 2)
+	errorResponse, ok := messages[0].(*pgproto3.ErrorResponse)
+	require.True(t, ok, "Expected an ErrorResponse, got %T", messages[0])
+	assert.Equal(t, "42501", errorResponse.Code)
+	assert.Equal(t, `DELETE on audit.log denied by policy "audit-readonly"`, errorResponse.Message)
+	assert.Empty(t, errorResponse.Detail)
+	assert.Equal(t, "Writes to audit tables go through the audit service.", errorResponse.Hint)
+}
+
+func TestPostgreSQLResponseWriter_DenyBeforeReady(t *testing.T) {
+	var out bytes.Buffer
+	parser := NewPostgreSQLParser(&bytes.Buffer{}, &out)
+	writer := NewPostgreSQLResponseWriter(parser)
+
+	// The transaction status follows the relayed ReadyForQuery messages
+	writer.Relay(&pgproto3.ReadyForQuery{TxStatus: 'T'})
+	writer.DenyBeforeReady(domain.Decision{Action: domain.DecisionDeny, Policy: "per-user"})
+	writer.Relay(&pgproto3.ParseComplete{})
+	writer.Relay(&pgproto3.ReadyForQuery{TxStatus: 'T'})
+	require.NoError(t, parser.Flush())
+	require.NoError(t, writer.Deny(domain.Decision{Action: domain.DecisionDeny, Policy: "per-user"}))
+
+	messages := receiveMessages(t, &out, 6)
+	assert.IsType(t, &pgproto3.ReadyForQuery{}, messages[0])
+	assert.IsType(t, &pgproto3.ParseComplete{}, messages[1])
+	require.IsType(t, &pgproto3.ErrorResponse{}, messages[2])
+	assert.Equal(t, `quota "per-user" exceeded`, messages[2].(*pgproto3.ErrorResponse).Message)
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'T'}, messages[3])
+	assert.IsType(t, &pgproto3.ErrorResponse{}, messages[4])
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'T'}, messages[5], "A denial leaves the transaction as it was")
+}
+
+func TestPostgreSQLResponseWriter_AnswerInTurn(t *testing.T) {
+	var out bytes.Buffer
+	parser := NewPostgreSQLParser(&bytes.Buffer{}, &out)
+	writer := NewPostgreSQLResponseWriter(parser)
+
+	// Two queries are forwarded, the second after an answered one
+	writer.Await()
+	require.NoError(t, writer.Answer([]pgproto3.FieldDescription{int8Column("quota_remaining")}, [][][]byte{{[]byte("7")}}))
+	writer.Await()
+	require.NoError(t, parser.Flush())
+	assert.Zero(t, out.Len(), "The answer should wait for the upstream to answer the query before it")
+
+	writer.Relay(&pgproto3.CommandComplete{CommandTag: []byte("BEGIN")})
+	writer.Relay(&pgproto3.ReadyForQuery{TxStatus: 'T'})
+	writer.Relay(&pgproto3.CommandComplete{CommandTag: []byte("COMMIT")})
+	writer.Relay(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	require.NoError(t, parser.Flush())
+
+	messages := receiveMessages(t, &out, 8)
+	assert.IsType(t, &pgproto3.CommandComplete{}, messages[0])
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'T'}, messages[1])
+	assert.IsType(t, &pgproto3.RowDescription{}, messages[2])
+	assert.IsType(t, &pgproto3.DataRow{}, messages[3])
+	assert.IsType(t, &pgproto3.CommandComplete{}, messages[4])
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'T'}, messages[5], "The answer should carry the status of the transaction it ran in")
+	assert.IsType(t, &pgproto3.CommandComplete{}, messages[6])
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'I'}, messages[7])
+
+	// With nothing forwarded, answers go out at once
+	require.NoError(t, writer.Fail(domain.Decision{Action: domain.DecisionDeny, Reason: "quota usage is unavailable"}))
+	messages = receiveMessages(t, &out, 2)
+	assert.IsType(t, &pgproto3.ErrorResponse{}, messages[0])
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'I'}, messages[1])
+}
+
+func TestPostgreSQLResponseWriter_WarnBeforeNext(t *testing.T) {
+	var out bytes.Buffer
+	parser := NewPostgreSQLParser(&bytes.Buffer{}, &out)
+	writer := NewPostgreSQLResponseWriter(parser)
+
+	writer.Relay(&pgproto3.ParseComplete{})
+	writer.WarnBeforeNext(domain.Decision{Action: domain.DecisionAllow, Warnings: []string{`you have used 90% of quota "daily"`}})
+	writer.Relay(&pgproto3.BindComplete{})
+	writer.Relay(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	require.NoError(t, parser.Flush())
+	require.NoError(t, writer.Warn(domain.Decision{Action: domain.DecisionAllow, Warnings: []string{"first", "second"}}))
+
+	messages := receiveMessages(t, &out, 6)
+	assert.IsType(t, &pgproto3.ParseComplete{}, messages[0])
+	require.IsType(t, &pgproto3.NoticeResponse{}, messages[1], "Held warnings should be relayed before the next message")
+	notice := messages[1].(*pgproto3.NoticeResponse)
+	assert.Equal(t, "WARNING", notice.Severity)
+	assert.Equal(t, pgerrWarning, notice.Code)
+	assert.Equal(t, `you have used 90% of quota "daily"`, notice.Message)
+	assert.IsType(t, &pgproto3.BindComplete{}, messages[2])
+	assert.IsType(t, &pgproto3.ReadyForQuery{}, messages[3])
+	assert.IsType(t, &pgproto3.NoticeResponse{}, messages[4])
+	assert.IsType(t, &pgproto3.NoticeResponse{}, messages[5])
+}
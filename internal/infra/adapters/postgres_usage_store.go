@@ -0,0 +1,439 @@
+package adapters
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// migrations holds the schema of the PostgreSQL usage store, applied in file name order
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// usageMigrationLock serializes migrations of enforcers sharing a database
+const usageMigrationLock = "quota_enforcer.migrations"
+
+// PostgresUsageStore implements domain.UsageStore with counters kept in PostgreSQL,
+// so enforcers sharing a database share quotas and usage survives restarts.
+// Increments are buffered and flushed in batches, or written through with strict
+// usage (see BufferedUsageStoreOption). Quota policies and roles may be kept in
+// the database too.
+type PostgresUsageStore struct {
+	counters *bufferedUsageStore
+	pool     *pgxpool.Pool
+}
+
+// NewPostgresUsageStore connects to the database at dsn, migrates the quota_enforcer
+// schema and starts flushing buffered usage in the background. Close flushes the
+// remaining usage and closes the connections.
+func NewPostgresUsageStore(ctx context.Context, dsn string, log logger.Logger, opts ...BufferedUsageStoreOption) (*PostgresUsageStore, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure usage store: %w", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to connect to usage store: %w", err)
+	}
+	if err := migrateUsageSchema(ctx, pool); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return &PostgresUsageStore{
+		counters: newBufferedUsageStore(pgUsageTable{pool: pool}, log, opts...),
+		pool:     pool,
+	}, nil
+}
+
+// Increment adds amount to the buffered counter of the current window. The usage
+// returned includes increments that have not been written yet.
+func (s *PostgresUsageStore) Increment(ctx context.Context, key domain.UsageKey, window time.Duration, amount int64) (domain.Usage, error) {
+	return s.counters.Increment(ctx, key, window, amount)
+}
+
+// Get returns the usage of the current window, including buffered increments
+func (s *PostgresUsageStore) Get(ctx context.Context, key domain.UsageKey, window time.Duration) (domain.Usage, error) {
+	return s.counters.Get(ctx, key, window)
+}
+
+// Reset clears the counters of key, buffered and persisted
+func (s *PostgresUsageStore) Reset(ctx context.Context, key domain.UsageKey) error {
+	return s.counters.Reset(ctx, key)
+}
+
+// Flush writes the buffered usage in a single statement
+func (s *PostgresUsageStore) Flush(ctx context.Context) error {
+	return s.counters.Flush(ctx)
+}
+
+// Close stops the flush loop, writes the buffered usage and closes the connections
+func (s *PostgresUsageStore) Close() error {
+	err := s.counters.Close()
+	s.pool.Close()
+	return err
+}
+
+// Ping checks that the database holding the counters is reachable
+func (s *PostgresUsageStore) Ping(ctx context.Context) error {
+	return s.pool.Ping(ctx)
+}
+
+// Ended implements domain.UsageHistory with the counters written so far; usage
+// still buffered by enforcers is not included
+func (s *PostgresUsageStore) Ended(ctx context.Context, from, to time.Time) ([]domain.WindowUsage, error) {
+	return s.counters.Ended(ctx, from, to)
+}
+
+// Compact implements domain.UsageHistory
+func (s *PostgresUsageStore) Compact(ctx context.Context, before time.Time) (int64, error) {
+	return s.counters.Compact(ctx, before)
+}
+
+// LoadPolicies reads the quota policies defined in the quota_enforcer.quota_policies table
+func (s *PostgresUsageStore) LoadPolicies(ctx context.Context) ([]domain.QuotaPolicy, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT name, user_name, role, database_name, labels, listener, dimension, query_limit,
+		       (extract(epoch FROM time_window) * 1000000)::bigint, rate, burst, rate_per, max_connections,
+		       tables, statements, deny, allow_during, fingerprints, patterns, allow, hint, override,
+		       warn_at, soft, (extract(epoch FROM grace) * 1000000)::bigint, tighten_at, tighten_to,
+		       (extract(epoch FROM statement_timeout) * 1000000)::bigint, active_during,
+		       credits, credit_rate, max_concurrent_queries, (extract(epoch FROM queue_timeout) * 1000000)::bigint,
+		       max_result_rows, max_result_bytes, (extract(epoch FROM max_transaction_duration) * 1000000)::bigint, max_transaction_statements,
+		       per_label
+		FROM quota_enforcer.quota_policies
+		ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query quota policies: %w", err)
+	}
+	defer rows.Close()
+
+	var policies []domain.QuotaPolicy
+	for rows.Next() {
+		var policy domain.QuotaPolicy
+		var windowMicros, graceMicros, timeoutMicros, queueMicros, transactionMicros int64
+		var statements []string
+		if err := rows.Scan(&policy.Name, &policy.User, &policy.Role, &policy.Database, &policy.Labels, &policy.Listener, &policy.Dimension, &policy.Limit, &windowMicros,
+			&policy.Rate, &policy.Burst, &policy.RatePer, &policy.MaxConnections, &policy.Tables, &statements, &policy.Deny, &policy.AllowDuring,
+			&policy.Fingerprints, &policy.Patterns, &policy.Allow, &policy.Hint, &policy.Override,
+			&policy.WarnAt, &policy.Soft, &graceMicros, &policy.TightenAt, &policy.TightenTo, &timeoutMicros, &policy.ActiveDuring,
+			&policy.Credits, &policy.CreditRate, &policy.MaxConcurrentQueries, &queueMicros,
+			&policy.MaxResultRows, &policy.MaxResultBytes, &transactionMicros, &policy.MaxTransactionStatements,
+			&policy.PerLabel); err != nil {
+			return nil, fmt.Errorf("failed to read quota policy: %w", err)
+		}
+		if len(policy.Labels) == 0 {
+			policy.Labels = nil
+		}
+		if len(policy.Tables) == 0 {
+			policy.Tables = nil
+		}
+		if len(policy.AllowDuring) == 0 {
+			policy.AllowDuring = nil
+		}
+		if len(policy.ActiveDuring) == 0 {
+			policy.ActiveDuring = nil
+		}
+		if len(policy.Fingerprints) == 0 {
+			policy.Fingerprints = nil
+		}
+		if len(policy.Patterns) == 0 {
+			policy.Patterns = nil
+		}
+		for _, class := range statements {
+			policy.Statements = append(policy.Statements, domain.StatementClass(class))
+		}
+		policy.Window = time.Duration(windowMicros) * time.Microsecond
+		policy.Grace = time.Duration(graceMicros) * time.Microsecond
+		policy.StatementTimeout = time.Duration(timeoutMicros) * time.Microsecond
+		policy.QueueTimeout = time.Duration(queueMicros) * time.Microsecond
+		policy.MaxTransactionDuration = time.Duration(transactionMicros) * time.Microsecond
+		if err := policy.Validate(); err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query quota policies: %w", err)
+	}
+	return policies, nil
+}
+
+// LoadRoles reads the users of the roles defined in the quota_enforcer.role_members
+// table, by role name
+func (s *PostgresUsageStore) LoadRoles(ctx context.Context) (map[string][]string, error) {
+	rows, err := s.pool.Query(ctx, `SELECT role, user_name FROM quota_enforcer.role_members ORDER BY role, user_name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query role members: %w", err)
+	}
+	defer rows.Close()
+
+	roles := make(map[string][]string)
+	for rows.Next() {
+		var role, user string
+		if err := rows.Scan(&role, &user); err != nil {
+			return nil, fmt.Errorf("failed to read role member: %w", err)
+		}
+		roles[role] = append(roles[role], user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query role members: %w", err)
+	}
+	return roles, nil
+}
+
+// SaveQueryStats implements domain.QueryStatsStore with the
+// quota_enforcer.query_stats table
+func (s *PostgresUsageStore) SaveQueryStats(ctx context.Context, stats []domain.QueryStats) error {
+	if len(stats) == 0 {
+		return nil
+	}
+
+	hashes := make([]string, len(stats))
+	queries := make([]string, len(stats))
+	calls := make([]int64, len(stats))
+	totals := make([]float64, len(stats))
+	p95s := make([]float64, len(stats))
+	rows := make([]int64, len(stats))
+	bytes := make([]int64, len(stats))
+	lastSeen := make([]time.Time, len(stats))
+	for i, entry := range stats {
+		hashes[i] = entry.Hash.String()
+		queries[i] = entry.Query
+		calls[i] = entry.Calls
+		totals[i] = milliseconds(entry.TotalDuration)
+		p95s[i] = milliseconds(entry.P95Duration)
+		rows[i] = entry.Rows
+		bytes[i] = entry.Bytes
+		lastSeen[i] = entry.LastSeen
+	}
+
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO quota_enforcer.query_stats AS stats
+			(query_hash, query, calls, total_time_ms, p95_time_ms, rows, bytes, last_seen)
+		SELECT * FROM unnest($1::text[], $2::text[], $3::bigint[], $4::float8[], $5::float8[],
+		                     $6::bigint[], $7::bigint[], $8::timestamptz[])
+		ON CONFLICT (query_hash) DO UPDATE
+			SET calls = stats.calls + excluded.calls,
+			    total_time_ms = stats.total_time_ms + excluded.total_time_ms,
+			    p95_time_ms = excluded.p95_time_ms,
+			    rows = stats.rows + excluded.rows,
+			    bytes = stats.bytes + excluded.bytes,
+			    last_seen = greatest(stats.last_seen, excluded.last_seen),
+			    updated_at = now()`,
+		hashes, queries, calls, totals, p95s, rows, bytes, lastSeen)
+	if err != nil {
+		return fmt.Errorf("failed to save query statistics: %w", err)
+	}
+	return nil
+}
+
+// milliseconds converts d to fractional milliseconds, as pg_stat_statements reports durations
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// pgUsageTable implements usageTable with the quota_enforcer.quota_usage table
+type pgUsageTable struct {
+	pool *pgxpool.Pool
+}
+
+func (t pgUsageTable) load(ctx context.Context, key domain.UsageKey, start time.Time) (int64, error) {
+	var used int64
+	err := t.pool.QueryRow(ctx, `
+		SELECT used FROM quota_enforcer.quota_usage
+		WHERE policy = $1 AND user_name = $2 AND database_name = $3 AND label = $4 AND window_start = $5`,
+		key.Policy, key.User, key.Database, key.Label, start).Scan(&used)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	return used, err
+}
+
+func (t pgUsageTable) upsert(ctx context.Context, deltas []usageDelta) ([]int64, error) {
+	policies := make([]string, len(deltas))
+	users := make([]string, len(deltas))
+	databases := make([]string, len(deltas))
+	labels := make([]string, len(deltas))
+	starts := make([]time.Time, len(deltas))
+	ends := make([]time.Time, len(deltas))
+	amounts := make([]int64, len(deltas))
+	for i, delta := range deltas {
+		policies[i] = delta.key.Policy
+		users[i] = delta.key.User
+		databases[i] = delta.key.Database
+		labels[i] = delta.key.Label
+		starts[i] = delta.start
+		ends[i] = delta.end
+		amounts[i] = delta.delta
+	}
+
+	rows, err := t.pool.Query(ctx, `
+		INSERT INTO quota_enforcer.quota_usage AS counter
+			(policy, user_name, database_name, label, window_start, window_end, used)
+		SELECT * FROM unnest($1::text[], $2::text[], $3::text[], $4::text[], $5::timestamptz[], $6::timestamptz[], $7::bigint[])
+		ON CONFLICT (policy, user_name, database_name, label, window_start) DO UPDATE
+			SET used = counter.used + excluded.used,
+			    window_end = excluded.window_end,
+			    updated_at = now()
+		RETURNING policy, user_name, database_name, label, window_start, used`,
+		policies, users, databases, labels, starts, ends, amounts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// RETURNING does not preserve the input order
+	totals := make(map[usageRow]int64, len(deltas))
+	for rows.Next() {
+		var key domain.UsageKey
+		var start time.Time
+		var used int64
+		if err := rows.Scan(&key.Policy, &key.User, &key.Database, &key.Label, &start, &used); err != nil {
+			return nil, err
+		}
+		totals[usageRow{key: key, start: start.UnixMicro()}] = used
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]int64, len(deltas))
+	for i, delta := range deltas {
+		result[i] = totals[usageRow{key: delta.key, start: delta.start.UnixMicro()}]
+	}
+	return result, nil
+}
+
+func (t pgUsageTable) delete(ctx context.Context, key domain.UsageKey) error {
+	_, err := t.pool.Exec(ctx, `
+		DELETE FROM quota_enforcer.quota_usage
+		WHERE policy = $1 AND user_name = $2 AND database_name = $3 AND label = $4`,
+		key.Policy, key.User, key.Database, key.Label)
+	return err
+}
+
+func (t pgUsageTable) ended(ctx context.Context, from, to time.Time) ([]domain.WindowUsage, error) {
+	rows, err := t.pool.Query(ctx, `
+		SELECT policy, user_name, database_name, label, window_start, window_end, used
+		FROM quota_enforcer.quota_usage
+		WHERE window_end > $1 AND window_end <= $2
+		ORDER BY policy, user_name, database_name, label, window_start`,
+		from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var windows []domain.WindowUsage
+	for rows.Next() {
+		var window domain.WindowUsage
+		if err := rows.Scan(&window.Key.Policy, &window.Key.User, &window.Key.Database, &window.Key.Label,
+			&window.Start, &window.End, &window.Used); err != nil {
+			return nil, err
+		}
+		window.Start, window.End = window.Start.UTC(), window.End.UTC()
+		windows = append(windows, window)
+	}
+	return windows, rows.Err()
+}
+
+func (t pgUsageTable) compact(ctx context.Context, before time.Time) (int64, error) {
+	tag, err := t.pool.Exec(ctx, `DELETE FROM quota_enforcer.quota_usage WHERE window_end < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// migrateUsageSchema creates the quota_enforcer schema and applies the migrations
+// not recorded in quota_enforcer.schema_migrations, in a single transaction
+func migrateUsageSchema(ctx context.Context, pool *pgxpool.Pool) error {
+	names, err := fs.Glob(migrations, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to migrate usage store: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	setup := []string{
+		`SELECT pg_advisory_xact_lock(hashtext('` + usageMigrationLock + `'))`,
+		`CREATE SCHEMA IF NOT EXISTS quota_enforcer`,
+		`CREATE TABLE IF NOT EXISTS quota_enforcer.schema_migrations (
+			version    integer PRIMARY KEY,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`,
+	}
+	for _, statement := range setup {
+		if _, err := tx.Exec(ctx, statement); err != nil {
+			return fmt.Errorf("failed to migrate usage store: %w", err)
+		}
+	}
+
+	applied := make(map[int]bool)
+	rows, err := tx.Query(ctx, `SELECT version FROM quota_enforcer.schema_migrations`)
+	if err != nil {
+		return fmt.Errorf("failed to migrate usage store: %w", err)
+	}
+	versions, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return fmt.Errorf("failed to migrate usage store: %w", err)
+	}
+	for _, version := range versions {
+		applied[version] = true
+	}
+
+	for _, name := range names {
+		version, err := migrationVersion(name)
+		if err != nil {
+			return err
+		}
+		if applied[version] {
+			continue
+		}
+
+		script, err := migrations.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, string(script)); err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", path.Base(name), err)
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO quota_enforcer.schema_migrations (version) VALUES ($1)`, version); err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", path.Base(name), err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to migrate usage store: %w", err)
+	}
+	return nil
+}
+
+// migrationVersion parses the numeric prefix of a migration file name such as 0001_quota_schema.sql
+func migrationVersion(name string) (int, error) {
+	prefix, _, _ := strings.Cut(path.Base(name), "_")
+	version, err := strconv.Atoi(prefix)
+	if err != nil {
+		return 0, fmt.Errorf("invalid migration file name %s", path.Base(name))
+	}
+	return version, nil
+}
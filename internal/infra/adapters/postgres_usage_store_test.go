@@ -0,0 +1,21 @@
+package adapters
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationVersion(t *testing.T) {
+	version, err := migrationVersion("migrations/0001_quota_schema.sql")
+	require.NoError(t, err)
+	assert.Equal(t, 1, version)
+
+	_, err = migrationVersion("migrations/quota_schema.sql")
+	assert.Error(t, err)
+
+	names, err := migrations.ReadDir("migrations")
+	require.NoError(t, err)
+	assert.NotEmpty(t, names, "Migrations should be embedded")
+}
@@ -0,0 +1,182 @@
+package adapters
+
+import (
+	"container/list"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sync"
+)
+
+const (
+	// DefaultQueryCacheSize is how many normalized queries are cached by text
+	DefaultQueryCacheSize = 10000
+
+	// DefaultStatementCacheSize is how many normalized prepared statements are cached by name
+	DefaultStatementCacheSize = 1000
+
+	// maxCachedQueryLength keeps long queries, which are mostly one-off batches
+	// with inlined values, from filling the cache
+	maxCachedQueryLength = 16 << 10
+)
+
+// CacheStats counts the lookups of a cache
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Entries   int
+	Capacity  int
+}
+
+// QueryCacheStats counts the lookups of the caches of a CachingNormalizer
+type QueryCacheStats struct {
+	Queries    CacheStats // by query text
+	Statements CacheStats // by prepared statement name
+}
+
+// normalizeResult is the cached outcome of normalizing a query
+type normalizeResult struct {
+	query domain.NormalizedQuery
+	err   error
+}
+
+// statementEntry is a prepared statement's text and normalization
+type statementEntry struct {
+	raw    string
+	result normalizeResult
+}
+
+// lruCache is a fixed-capacity map evicting its least recently used entry
+type lruCache[K comparable, V any] struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // of *lruEntry, most recently used first
+	entries  map[K]*list.Element
+	stats    CacheStats
+}
+
+// lruEntry is an element of an lruCache
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func newLRUCache[K comparable, V any](capacity int) *lruCache[K, V] {
+	return &lruCache[K, V]{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[K]*list.Element, capacity),
+	}
+}
+
+// get returns the value of key and marks it as recently used, counting a hit
+// when accept reports the value usable and a miss otherwise
+func (c *lruCache[K, V]) get(key K, accept func(V) bool) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*lruEntry[K, V])
+		if accept == nil || accept(entry.value) {
+			c.order.MoveToFront(element)
+			c.stats.Hits++
+			return entry.value, true
+		}
+	}
+	c.stats.Misses++
+	var zero V
+	return zero, false
+}
+
+// put stores the value of key, evicting the least recently used entry when full
+func (c *lruCache[K, V]) put(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*lruEntry[K, V]).value = value
+		c.order.MoveToFront(element)
+		return
+	}
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[K, V]).key)
+		c.stats.Evictions++
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value})
+}
+
+// snapshot returns the lookup counters and the size of the cache
+func (c *lruCache[K, V]) snapshot() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.order.Len()
+	stats.Capacity = c.capacity
+	return stats
+}
+
+// CachingNormalizer caches the results of another normalizer, since parsing a
+// query with pg_query is a CGO call costing far more than a map lookup.
+// Queries are cached by text; prepared statements are also cached by name in
+// a cache of their own, so that a stream of one-off queries does not evict
+// the statements applications execute over and over. Failures are cached too.
+type CachingNormalizer struct {
+	next       domain.QueryNormalizer
+	queries    *lruCache[string, normalizeResult]
+	statements *lruCache[string, statementEntry] // nil when statements are not cached by name
+}
+
+// NewCachingNormalizer caches up to querySize queries normalized by next and up
+// to statementSize prepared statements; a statement size of zero caches
+// statements by text only
+func NewCachingNormalizer(next domain.QueryNormalizer, querySize, statementSize int) *CachingNormalizer {
+	normalizer := &CachingNormalizer{
+		next:    next,
+		queries: newLRUCache[string, normalizeResult](max(querySize, 1)),
+	}
+	if statementSize > 0 {
+		normalizer.statements = newLRUCache[string, statementEntry](statementSize)
+	}
+	return normalizer
+}
+
+// Normalize returns the cached normalization of rawQuery, normalizing it on a miss
+func (n *CachingNormalizer) Normalize(rawQuery string) (domain.NormalizedQuery, error) {
+	if len(rawQuery) > maxCachedQueryLength {
+		return n.next.Normalize(rawQuery)
+	}
+	if result, ok := n.queries.get(rawQuery, nil); ok {
+		return result.query, result.err
+	}
+
+	normalized, err := n.next.Normalize(rawQuery)
+	n.queries.put(rawQuery, normalizeResult{query: normalized, err: err})
+	return normalized, err
+}
+
+// NormalizeStatement returns the cached normalization of the prepared statement
+// name. Clients may reuse a name for another query, so the cached entry is only
+// used when its text matches rawQuery. The unnamed statement is cached by text.
+func (n *CachingNormalizer) NormalizeStatement(name, rawQuery string) (domain.NormalizedQuery, error) {
+	if name == "" || n.statements == nil || len(rawQuery) > maxCachedQueryLength {
+		return n.Normalize(rawQuery)
+	}
+	entry, ok := n.statements.get(name, func(entry statementEntry) bool { return entry.raw == rawQuery })
+	if ok {
+		return entry.result.query, entry.result.err
+	}
+
+	normalized, err := n.Normalize(rawQuery)
+	n.statements.put(name, statementEntry{raw: rawQuery, result: normalizeResult{query: normalized, err: err}})
+	return normalized, err
+}
+
+// Stats returns the lookup counters of both caches
+func (n *CachingNormalizer) Stats() QueryCacheStats {
+	stats := QueryCacheStats{Queries: n.queries.snapshot()}
+	if n.statements != nil {
+		stats.Statements = n.statements.snapshot()
+	}
+	return stats
+}
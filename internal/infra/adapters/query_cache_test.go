@@ -0,0 +1,74 @@
+package adapters
+
+import (
+	"errors"
+	"testing"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachingNormalizer_Normalize(t *testing.T) {
+	next := &mocks.QueryNormalizer{}
+	selectOne := domain.NormalizedQuery{Original: "SELECT 1", Normalized: "SELECT $1", Hash: domain.NewQueryHash("a")}
+	selectTwo := domain.NormalizedQuery{Original: "SELECT 2", Normalized: "SELECT $1", Hash: domain.NewQueryHash("a")}
+	next.On("Normalize", "SELECT 1").Return(selectOne, nil).Once()
+	next.On("Normalize", "SELECT 2").Return(selectTwo, nil).Once()
+	next.On("Normalize", "SELEC").Return(domain.NormalizedQuery{}, errors.New("syntax error")).Once()
+	cache := NewCachingNormalizer(next, 2, 0)
+
+	for i := 0; i < 3; i++ {
+		normalized, err := cache.Normalize("SELECT 1")
+		require.NoError(t, err)
+		assert.Equal(t, selectOne, normalized)
+	}
+	for i := 0; i < 2; i++ {
+		_, err := cache.Normalize("SELEC")
+		assert.EqualError(t, err, "syntax error", "Failures should be cached too")
+	}
+
+	// SELECT 1 was used more recently than SELEC, which is evicted
+	_, err := cache.Normalize("SELECT 1")
+	require.NoError(t, err)
+	_, err = cache.Normalize("SELECT 2")
+	require.NoError(t, err)
+	next.AssertExpectations(t)
+
+	assert.Equal(t, QueryCacheStats{
+		Queries: CacheStats{Hits: 4, Misses: 3, Evictions: 1, Entries: 2, Capacity: 2},
+	}, cache.Stats())
+}
+
+func TestCachingNormalizer_NormalizeStatement(t *testing.T) {
+	next := &mocks.QueryNormalizer{}
+	byID := domain.NormalizedQuery{Original: "SELECT * FROM users WHERE id = $1", Hash: domain.NewQueryHash("a")}
+	byName := domain.NormalizedQuery{Original: "SELECT * FROM users WHERE name = $1", Hash: domain.NewQueryHash("b")}
+	next.On("Normalize", byID.Original).Return(byID, nil).Once()
+	next.On("Normalize", byName.Original).Return(byName, nil).Once()
+	cache := NewCachingNormalizer(next, 10, 10)
+
+	normalized, err := cache.NormalizeStatement("stmt_1", byID.Original)
+	require.NoError(t, err)
+	assert.Equal(t, byID, normalized)
+	normalized, err = cache.NormalizeStatement("stmt_1", byID.Original)
+	require.NoError(t, err)
+	assert.Equal(t, byID, normalized)
+
+	// A name reused for another query is normalized again
+	normalized, err = cache.NormalizeStatement("stmt_1", byName.Original)
+	require.NoError(t, err)
+	assert.Equal(t, byName, normalized)
+
+	// Another statement of a cached query is normalized from the query cache
+	normalized, err = cache.NormalizeStatement("stmt_2", byID.Original)
+	require.NoError(t, err)
+	assert.Equal(t, byID, normalized)
+	next.AssertExpectations(t)
+
+	stats := cache.Stats()
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 3, Entries: 2, Capacity: 10}, stats.Statements)
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 2, Entries: 2, Capacity: 10}, stats.Queries)
+}
@@ -0,0 +1,100 @@
+package adapters
+
+import (
+	"pgbouncer-quota-enforcer/internal/app/domain"
+)
+
+// QueryEventLogger implements domain.QueryLogger by publishing the decision taken
+// on every evaluated query as a domain.QueryEvent before delegating to the next
+// QueryLogger. Events come through domain.DecisionLogger; the other events are only
+// forwarded. It implements domain.SessionLogger on behalf of the next logger.
+type QueryEventLogger struct {
+	next       domain.QueryLogger
+	publisher  domain.QueryEventPublisher
+	instanceID string
+}
+
+// NewQueryEventLogger creates a QueryEventLogger publishing to publisher the events
+// of the enforcer instance instanceID. The next logger may be nil.
+func NewQueryEventLogger(publisher domain.QueryEventPublisher, next domain.QueryLogger, instanceID string) *QueryEventLogger {
+	return &QueryEventLogger{
+		next:       next,
+		publisher:  publisher,
+		instanceID: instanceID,
+	}
+}
+
+// LogQuery forwards the query to the next logger
+func (l *QueryEventLogger) LogQuery(connectionID string, query string) error {
+	if l.next != nil {
+		return l.next.LogQuery(connectionID, query)
+	}
+	return nil
+}
+
+// LogNormalizedQuery forwards the normalized query to the next logger
+func (l *QueryEventLogger) LogNormalizedQuery(connectionID string, normalizedQuery domain.NormalizedQuery) error {
+	if l.next != nil {
+		return l.next.LogNormalizedQuery(connectionID, normalizedQuery)
+	}
+	return nil
+}
+
+// LogProtocolMessage forwards the protocol message to the next logger
+func (l *QueryEventLogger) LogProtocolMessage(connectionID string, messageType string, details map[string]interface{}) error {
+	if l.next != nil {
+		return l.next.LogProtocolMessage(connectionID, messageType, details)
+	}
+	return nil
+}
+
+// StartSession forwards the session to the next logger when it attributes sessions
+func (l *QueryEventLogger) StartSession(session domain.Session) error {
+	if sessionLogger, ok := l.next.(domain.SessionLogger); ok {
+		return sessionLogger.StartSession(session)
+	}
+	return nil
+}
+
+// EndSession forwards the end of the session to the next logger
+func (l *QueryEventLogger) EndSession(connectionID string) {
+	if sessionLogger, ok := l.next.(domain.SessionLogger); ok {
+		sessionLogger.EndSession(connectionID)
+	}
+}
+
+// LogDecision publishes the event of the query and forwards the decision to the
+// next logger when it records decisions
+func (l *QueryEventLogger) LogDecision(query *domain.Query, decision domain.Decision, usage domain.StatementUsage) error {
+	l.publisher.Publish(newQueryEvent(l.instanceID, query, decision, usage))
+
+	if decisionLogger, ok := l.next.(domain.DecisionLogger); ok {
+		return decisionLogger.LogDecision(query, decision, usage)
+	}
+	return nil
+}
+
+// newQueryEvent describes the decision taken on query and what the query consumed
+func newQueryEvent(instanceID string, query *domain.Query, decision domain.Decision, usage domain.StatementUsage) domain.QueryEvent {
+	action := decision.Action
+	if action == "" {
+		action = domain.DecisionAllow
+	}
+	return domain.QueryEvent{
+		Timestamp:       query.Timestamp,
+		InstanceID:      instanceID,
+		ConnectionID:    query.ConnectionID,
+		User:            query.UserID,
+		Database:        query.Database,
+		ApplicationName: query.ApplicationName,
+		Kind:            query.Kind,
+		QueryHash:       query.Hash.Value(),
+		Normalized:      query.Normalized,
+		Decision:        action,
+		Policy:          decision.Policy,
+		Reason:          decision.Reason,
+		Duration:        usage.Duration,
+		Rows:            usage.Rows,
+		Bytes:           usage.Bytes,
+	}
+}
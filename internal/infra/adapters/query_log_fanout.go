@@ -0,0 +1,177 @@
+package adapters
+
+import (
+	"errors"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"slices"
+)
+
+// QueryLogDestination is a query logger of a FanOutQueryLogger, along with the
+// decisions it receives
+type QueryLogDestination struct {
+	Logger domain.QueryLogger
+
+	// Decisions restricts the destination to the decisions with these actions,
+	// so that it receives neither queries nor protocol messages; empty forwards
+	// every event
+	Decisions []domain.DecisionAction
+}
+
+// accepts reports whether the destination receives the events that are not
+// decisions
+func (d QueryLogDestination) accepts() bool {
+	return len(d.Decisions) == 0
+}
+
+// acceptsDecision reports whether the destination receives decision
+func (d QueryLogDestination) acceptsDecision(decision domain.Decision) bool {
+	action := decision.Action
+	if action == "" {
+		action = domain.DecisionAllow
+	}
+	return len(d.Decisions) == 0 || slices.Contains(d.Decisions, action)
+}
+
+// FanOutQueryLogger implements domain.QueryLogger, domain.SessionLogger and
+// domain.DecisionLogger by forwarding every event to each of its destinations
+// that accepts it, so queries can be logged to several places, each with its own
+// filter. A failing destination does not keep the others from receiving the
+// event; the errors of all of them are returned.
+type FanOutQueryLogger struct {
+	destinations []QueryLogDestination
+}
+
+// NewFanOutQueryLogger creates a FanOutQueryLogger forwarding to destinations
+func NewFanOutQueryLogger(destinations ...QueryLogDestination) *FanOutQueryLogger {
+	return &FanOutQueryLogger{destinations: destinations}
+}
+
+// LogQuery forwards the query to the destinations that receive every event
+func (l *FanOutQueryLogger) LogQuery(connectionID string, query string) error {
+	var errs error
+	for _, destination := range l.destinations {
+		if destination.accepts() {
+			errs = errors.Join(errs, destination.Logger.LogQuery(connectionID, query))
+		}
+	}
+	return errs
+}
+
+// LogNormalizedQuery forwards the normalized query to the destinations that
+// receive every event
+func (l *FanOutQueryLogger) LogNormalizedQuery(connectionID string, normalizedQuery domain.NormalizedQuery) error {
+	var errs error
+	for _, destination := range l.destinations {
+		if destination.accepts() {
+			errs = errors.Join(errs, destination.Logger.LogNormalizedQuery(connectionID, normalizedQuery))
+		}
+	}
+	return errs
+}
+
+// LogProtocolMessage forwards the protocol message to the destinations that
+// receive every event
+func (l *FanOutQueryLogger) LogProtocolMessage(connectionID string, messageType string, details map[string]interface{}) error {
+	var errs error
+	for _, destination := range l.destinations {
+		if destination.accepts() {
+			errs = errors.Join(errs, destination.Logger.LogProtocolMessage(connectionID, messageType, details))
+		}
+	}
+	return errs
+}
+
+// StartSession forwards the session to every destination that attributes
+// sessions, so the decisions they receive are attributed as well
+func (l *FanOutQueryLogger) StartSession(session domain.Session) error {
+	var errs error
+	for _, destination := range l.destinations {
+		if sessionLogger, ok := destination.Logger.(domain.SessionLogger); ok {
+			errs = errors.Join(errs, sessionLogger.StartSession(session))
+		}
+	}
+	return errs
+}
+
+// EndSession forwards the end of the session to every destination that
+// attributes sessions
+func (l *FanOutQueryLogger) EndSession(connectionID string) {
+	for _, destination := range l.destinations {
+		if sessionLogger, ok := destination.Logger.(domain.SessionLogger); ok {
+			sessionLogger.EndSession(connectionID)
+		}
+	}
+}
+
+// LogDecision forwards the decision to the destinations that record decisions
+// and accept its action
+func (l *FanOutQueryLogger) LogDecision(query *domain.Query, decision domain.Decision, usage domain.StatementUsage) error {
+	var errs error
+	for _, destination := range l.destinations {
+		decisionLogger, ok := destination.Logger.(domain.DecisionLogger)
+		if ok && destination.acceptsDecision(decision) {
+			errs = errors.Join(errs, decisionLogger.LogDecision(query, decision, usage))
+		}
+	}
+	return errs
+}
+
+// EventQueryLogger implements domain.QueryLogger and domain.DecisionLogger by
+// emitting every decision as a query_decision event, so that the decisions of a
+// query log destination reach webhooks and the other event sinks. The other
+// events are dropped.
+type EventQueryLogger struct {
+	sink domain.EventSink
+}
+
+// NewEventQueryLogger creates an EventQueryLogger emitting to sink
+func NewEventQueryLogger(sink domain.EventSink) *EventQueryLogger {
+	return &EventQueryLogger{sink: sink}
+}
+
+// LogQuery drops the query
+func (l *EventQueryLogger) LogQuery(connectionID string, query string) error {
+	return nil
+}
+
+// LogNormalizedQuery drops the normalized query
+func (l *EventQueryLogger) LogNormalizedQuery(connectionID string, normalizedQuery domain.NormalizedQuery) error {
+	return nil
+}
+
+// LogProtocolMessage drops the protocol message
+func (l *EventQueryLogger) LogProtocolMessage(connectionID string, messageType string, details map[string]interface{}) error {
+	return nil
+}
+
+// LogDecision emits the event of the decision taken on query
+func (l *EventQueryLogger) LogDecision(query *domain.Query, decision domain.Decision, usage domain.StatementUsage) error {
+	event := newQueryEvent("", query, decision, usage)
+	fields := map[string]interface{}{
+		"user":        event.User,
+		"database":    event.Database,
+		"decision":    string(event.Decision),
+		"duration_ms": milliseconds(event.Duration),
+		"rows":        event.Rows,
+		"bytes":       event.Bytes,
+	}
+	for name, value := range map[string]string{
+		"application_name": event.ApplicationName,
+		"kind":             string(event.Kind),
+		"query_hash":       event.QueryHash,
+		"normalized_query": event.Normalized,
+		"policy":           event.Policy,
+		"reason":           event.Reason,
+	} {
+		if value != "" {
+			fields[name] = value
+		}
+	}
+	l.sink.Emit(domain.Event{
+		Type:         domain.EventQueryDecision,
+		Timestamp:    event.Timestamp,
+		ConnectionID: event.ConnectionID,
+		Fields:       fields,
+	})
+	return nil
+}
@@ -0,0 +1,56 @@
+package adapters
+
+import (
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFanOutQueryLogger_FiltersDestinations(t *testing.T) {
+	everything := &decisionRecordingLogger{RecordingQueryLogger: mocks.NewRecordingQueryLogger()}
+	denials := &decisionRecordingLogger{RecordingQueryLogger: mocks.NewRecordingQueryLogger()}
+	fanOut := NewFanOutQueryLogger(
+		QueryLogDestination{Logger: everything},
+		QueryLogDestination{Logger: denials, Decisions: []domain.DecisionAction{domain.DecisionDeny}},
+	)
+
+	require.NoError(t, fanOut.StartSession(domain.Session{ConnectionID: "conn_1", User: "alice"}))
+	require.NoError(t, fanOut.LogQuery("conn_1", "SELECT 1"))
+	require.NoError(t, fanOut.LogProtocolMessage("conn_1", "Sync", nil))
+	require.NoError(t, fanOut.LogDecision(auditQuery("SELECT 1"), domain.AllowDecision(), domain.StatementUsage{}))
+	require.NoError(t, fanOut.LogDecision(auditQuery("DELETE FROM t"), domain.Decision{Action: domain.DecisionDeny}, domain.StatementUsage{}))
+
+	assert.Equal(t, []string{"SELECT 1"}, everything.Queries())
+	assert.Equal(t, []string{"Sync: map[]"}, everything.ProtocolMessages())
+	assert.Equal(t, []string{"SELECT 1", "DELETE FROM t"}, everything.queries)
+
+	assert.Empty(t, denials.Queries(), "A destination filtering decisions should only receive decisions")
+	assert.Empty(t, denials.ProtocolMessages())
+	assert.Equal(t, []string{"DELETE FROM t"}, denials.queries)
+	assert.Len(t, denials.Sessions(), 1, "Sessions should reach every destination")
+}
+
+func TestEventQueryLogger_EmitsDecisions(t *testing.T) {
+	sink := &mocks.RecordingEventSink{}
+	eventLogger := NewEventQueryLogger(sink)
+
+	require.NoError(t, eventLogger.LogQuery("conn_1", "DELETE FROM t"))
+	require.NoError(t, eventLogger.LogDecision(auditQuery("DELETE FROM t"), domain.Decision{
+		Action: domain.DecisionDeny, Policy: "writes", Reason: "quota exceeded",
+	}, domain.StatementUsage{Duration: 2 * time.Millisecond}))
+
+	events := sink.Events()
+	require.Len(t, events, 1, "Only decisions should be emitted")
+	assert.Equal(t, domain.EventQueryDecision, events[0].Type)
+	assert.Equal(t, "conn_1", events[0].ConnectionID)
+	assert.Equal(t, "alice", events[0].Fields["user"])
+	assert.Equal(t, "deny", events[0].Fields["decision"])
+	assert.Equal(t, "writes", events[0].Fields["policy"])
+	assert.Equal(t, 2.0, events[0].Fields["duration_ms"])
+	assert.NotContains(t, events[0].Fields, "application_name")
+}
@@ -4,30 +4,72 @@ import (
 	"pgbouncer-quota-enforcer/internal/app/domain"
 	"pgbouncer-quota-enforcer/pkg/logger"
 	"strings"
+	"sync"
 )
 
-// StandardQueryLogger implements domain.QueryLogger
+// StandardQueryLogger implements domain.QueryLogger and domain.SessionLogger.
+// Lines logged for a connection with a session carry its user, database and
+// application name.
+//
+// Literal values and bound parameters are redacted by default: queries are
+// logged as their normalized text, and parameters as their format and size.
+// Only the queries of allowlisted fingerprints are logged as sent, along with
+// their parameters.
 type StandardQueryLogger struct {
 	logger     logger.Logger
 	normalizer domain.QueryNormalizer
+	literals   map[string]bool // fingerprints whose literals and parameters are logged
+	sessions   sync.Map        // connection ID to the logger.Logger of its session
+}
+
+// StandardQueryLoggerOption configures optional behavior of a StandardQueryLogger
+type StandardQueryLoggerOption func(*StandardQueryLogger)
+
+// WithLoggedParameters logs the queries with the given fingerprints as sent, and
+// the values bound to their executions; "*" logs those of every query
+func WithLoggedParameters(fingerprints ...string) StandardQueryLoggerOption {
+	return func(l *StandardQueryLogger) {
+		for _, fingerprint := range fingerprints {
+			l.literals[fingerprint] = true
+		}
+	}
 }
 
 // NewStandardQueryLogger creates a new StandardQueryLogger
-func NewStandardQueryLogger(log logger.Logger, normalizer domain.QueryNormalizer) domain.QueryLogger {
-	return &StandardQueryLogger{
+func NewStandardQueryLogger(log logger.Logger, normalizer domain.QueryNormalizer, opts ...StandardQueryLoggerOption) domain.QueryLogger {
+	l := &StandardQueryLogger{
 		logger:     log,
 		normalizer: normalizer,
+		literals:   make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(l)
 	}
+	return l
 }
 
-// LogQuery logs a SQL query with connection information
+// literalsLogged reports whether the literals and parameters of the queries with
+// fingerprint hash may be logged
+func (l *StandardQueryLogger) literalsLogged(hash string) bool {
+	return l.literals["*"] || (hash != "" && l.literals[hash])
+}
+
+// LogQuery logs a SQL query with connection information. Its fingerprint is not
+// known yet, so its text is only logged when every fingerprint is allowlisted;
+// LogNormalizedQuery logs it otherwise.
 func (l *StandardQueryLogger) LogQuery(connectionID string, query string) error {
 	if query == "" {
 		return nil
 	}
 
 	// Create a logger with connection context
-	connLogger := l.logger.WithField("connection_id", connectionID)
+	connLogger := l.connLogger(connectionID)
+	if !l.literalsLogged("") {
+		connLogger.Info("SQL Query received",
+			"query_length", len(query),
+		)
+		return nil
+	}
 
 	// Clean up the query for logging (remove extra whitespace, newlines)
 	cleanQuery := strings.TrimSpace(strings.ReplaceAll(query, "\n", " "))
@@ -49,9 +91,16 @@ func (l *StandardQueryLogger) LogQuery(connectionID string, query string) error
 // LogNormalizedQuery logs a normalized SQL query with hash
 func (l *StandardQueryLogger) LogNormalizedQuery(connectionID string, normalizedQuery domain.NormalizedQuery) error {
 	// Create a logger with connection context
-	connLogger := l.logger.WithField("connection_id", connectionID)
-
-	// Log the normalized query with hash
+	connLogger := l.connLogger(connectionID)
+
+	// Log the normalized query with hash, and as sent when allowlisted
+	if !l.literalsLogged(normalizedQuery.Hash.Value()) {
+		connLogger.Info("Normalized SQL Query",
+			"normalized_query", normalizedQuery.Normalized,
+			"query_hash", normalizedQuery.Hash.Value(),
+		)
+		return nil
+	}
 	connLogger.Info("Normalized SQL Query",
 		"original_query", normalizedQuery.Original,
 		"normalized_query", normalizedQuery.Normalized,
@@ -64,13 +113,17 @@ func (l *StandardQueryLogger) LogNormalizedQuery(connectionID string, normalized
 // LogProtocolMessage logs other protocol messages (startup, auth, etc.)
 func (l *StandardQueryLogger) LogProtocolMessage(connectionID string, messageType string, details map[string]interface{}) error {
 	// Create a logger with connection context
-	connLogger := l.logger.WithField("connection_id", connectionID)
+	connLogger := l.connLogger(connectionID)
 
 	// Convert details to a more readable format
 	logFields := make([]interface{}, 0, len(details)*2+2)
 	logFields = append(logFields, "message_type", messageType)
 
+	hash, _ := details["query_hash"].(string)
 	for key, value := range details {
+		if parameters, ok := value.([]interface{}); ok && key == "parameters" && !l.literalsLogged(hash) {
+			value = redactParameters(parameters)
+		}
 		logFields = append(logFields, key, value)
 	}
 
@@ -78,3 +131,31 @@ func (l *StandardQueryLogger) LogProtocolMessage(connectionID string, messageTyp
 
 	return nil
 }
+
+// StartSession logs the session and attributes the connection's next lines to it
+func (l *StandardQueryLogger) StartSession(session domain.Session) error {
+	connLogger := l.logger.WithField("connection_id", session.ConnectionID).
+		WithField("user", session.User).
+		WithField("database", session.Database)
+	if session.ApplicationName != "" {
+		connLogger = connLogger.WithField("application_name", session.ApplicationName)
+	}
+	l.sessions.Store(session.ConnectionID, connLogger)
+
+	connLogger.Info("PostgreSQL session started")
+	return nil
+}
+
+// EndSession forgets the session of a closed connection
+func (l *StandardQueryLogger) EndSession(connectionID string) {
+	l.sessions.Delete(connectionID)
+}
+
+// connLogger returns the logger of the connection's session, or one carrying only
+// the connection ID before the session starts
+func (l *StandardQueryLogger) connLogger(connectionID string) logger.Logger {
+	if connLogger, ok := l.sessions.Load(connectionID); ok {
+		return connLogger.(logger.Logger)
+	}
+	return l.logger.WithField("connection_id", connectionID)
+}
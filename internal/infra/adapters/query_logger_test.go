@@ -0,0 +1,91 @@
+package adapters
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lineRecorder is a logger.Logger keeping the messages and arguments it is given
+type lineRecorder struct {
+	mu    *sync.Mutex
+	lines *[]string
+}
+
+func newLineRecorder() lineRecorder {
+	return lineRecorder{mu: &sync.Mutex{}, lines: &[]string{}}
+}
+
+func (r lineRecorder) record(msg string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*r.lines = append(*r.lines, fmt.Sprint(append([]interface{}{msg}, args...)...))
+}
+
+func (r lineRecorder) Info(msg string, args ...interface{})  { r.record(msg, args...) }
+func (r lineRecorder) Error(msg string, args ...interface{}) { r.record(msg, args...) }
+func (r lineRecorder) Debug(msg string, args ...interface{}) { r.record(msg, args...) }
+
+func (r lineRecorder) WithField(key string, value interface{}) logger.Logger {
+	return r
+}
+
+func (r lineRecorder) text() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return strings.Join(*r.lines, "\n")
+}
+
+func TestStandardQueryLogger_RedactsLiteralsByDefault(t *testing.T) {
+	lines := newLineRecorder()
+	queryLogger := NewStandardQueryLogger(lines, nil)
+
+	require.NoError(t, queryLogger.LogQuery("conn_1", "SELECT * FROM users WHERE email = 'alice@example.com'"))
+	require.NoError(t, queryLogger.LogNormalizedQuery("conn_1", domain.NormalizedQuery{
+		Original:   "SELECT * FROM users WHERE email = 'alice@example.com'",
+		Normalized: "SELECT * FROM users WHERE email = $1",
+		Hash:       domain.NewQueryHash("users-by-email"),
+	}))
+	require.NoError(t, queryLogger.LogProtocolMessage("conn_1", "Bind", map[string]interface{}{
+		"query_hash": "users-by-email",
+		"parameters": []interface{}{"alice@example.com", nil},
+	}))
+
+	text := lines.text()
+	assert.NotContains(t, text, "alice@example.com", "Literals and parameters should never be logged")
+	assert.Contains(t, text, "SELECT * FROM users WHERE email = $1")
+	assert.Contains(t, text, "<text, 17 bytes>")
+}
+
+func TestStandardQueryLogger_LogsAllowlistedParameters(t *testing.T) {
+	lines := newLineRecorder()
+	queryLogger := NewStandardQueryLogger(lines, nil, WithLoggedParameters("orders-by-id"))
+
+	require.NoError(t, queryLogger.LogNormalizedQuery("conn_1", domain.NormalizedQuery{
+		Original: "SELECT * FROM orders WHERE id = 42", Normalized: "SELECT * FROM orders WHERE id = $1", Hash: domain.NewQueryHash("orders-by-id"),
+	}))
+	require.NoError(t, queryLogger.LogProtocolMessage("conn_1", "Bind", map[string]interface{}{
+		"query_hash": "orders-by-id", "parameters": []interface{}{"1337"},
+	}))
+	require.NoError(t, queryLogger.LogProtocolMessage("conn_1", "Bind", map[string]interface{}{
+		"query_hash": "users-by-email", "parameters": []interface{}{"bob@example.com"},
+	}))
+
+	text := lines.text()
+	assert.Contains(t, text, "SELECT * FROM orders WHERE id = 42")
+	assert.Contains(t, text, "1337")
+	assert.NotContains(t, text, "bob@example.com", "Parameters of other fingerprints should be redacted")
+
+	// A wildcard logs every query as sent
+	lines = newLineRecorder()
+	queryLogger = NewStandardQueryLogger(lines, nil, WithLoggedParameters("*"))
+	require.NoError(t, queryLogger.LogQuery("conn_1", "SELECT 'literal'"))
+	assert.Contains(t, lines.text(), "SELECT 'literal'")
+}
@@ -0,0 +1,355 @@
+package adapters
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"strings"
+
+	pg_query "github.com/pganalyze/pg_query_go/v6"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// TenantFilter restricts the rows of some tables to those of the tenant of the
+// connection
+type TenantFilter struct {
+	// Column holds the tenant of each row
+	Column string
+
+	// Value is where the tenant of a connection comes from: user, database,
+	// application_name, or label.<name> for a connection label
+	Value string
+
+	// Tables are the patterns of the filtered tables: name, schema.name or schema.*
+	Tables []string
+}
+
+// Validate checks that the filter is usable
+func (f TenantFilter) Validate() error {
+	if f.Column == "" {
+		return fmt.Errorf("tenant filter needs a column")
+	}
+	switch f.Value {
+	case "user", "database", "application_name":
+	default:
+		if name, ok := strings.CutPrefix(f.Value, "label."); !ok || name == "" {
+			return fmt.Errorf("tenant filter value %q is not user, database, application_name or label.<name>", f.Value)
+		}
+	}
+	if len(f.Tables) == 0 {
+		return fmt.Errorf("tenant filter needs tables")
+	}
+	for _, pattern := range f.Tables {
+		if !domain.ValidTablePattern(pattern) {
+			return fmt.Errorf("invalid tenant filter table pattern %q: use name, schema.name or schema.*", pattern)
+		}
+	}
+	return nil
+}
+
+// tenant returns the tenant of the connection of query, empty when it has none
+func (f TenantFilter) tenant(query *domain.Query) string {
+	switch f.Value {
+	case "user":
+		return query.UserID
+	case "database":
+		return query.Database
+	case "application_name":
+		return query.ApplicationName
+	default:
+		return query.Labels[strings.TrimPrefix(f.Value, "label.")]
+	}
+}
+
+// filters reports whether the relation is one of the filtered tables
+func (f TenantFilter) filters(rv *pg_query.RangeVar) bool {
+	name := rv.Relname
+	if rv.Schemaname != "" {
+		name = rv.Schemaname + "." + rv.Relname
+	}
+	for _, pattern := range f.Tables {
+		if domain.MatchesTable(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryRewriter rewrites the text of queries before the upstream runs them: it
+// bounds the SELECTs reading relations without a LIMIT, restricts filtered
+// tables to the rows of the connection's tenant, and tags queries with a trace
+// comment. Queries are rewritten from their parse tree, so their comments and
+// layout are not kept. Executions of prepared statements are left alone, their
+// statement having been rewritten when it was prepared.
+type QueryRewriter struct {
+	limit  int64
+	trace  bool
+	tenant *TenantFilter
+}
+
+// QueryRewriterOption configures the rewrites of a QueryRewriter
+type QueryRewriterOption func(*QueryRewriter)
+
+// WithRowLimit appends LIMIT limit to the SELECTs reading relations that have no LIMIT
+func WithRowLimit(limit int64) QueryRewriterOption {
+	return func(r *QueryRewriter) {
+		r.limit = limit
+	}
+}
+
+// WithTraceComments prepends a W3C traceparent comment to every query, such as
+// /*traceparent='00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01'*/. The
+// trace of the traceparent label of the connection is continued when it has one.
+func WithTraceComments() QueryRewriterOption {
+	return func(r *QueryRewriter) {
+		r.trace = true
+	}
+}
+
+// WithTenantFilter restricts the tables of filter to the rows of the tenant of
+// each connection. A filtered table read by a query is replaced with a subquery
+// selecting the rows of the tenant, and the rows UPDATE and DELETE statements
+// write are restricted with a predicate. INSERT, MERGE, COPY and TRUNCATE are
+// not filtered. Queries on filtered tables are denied when the connection has
+// no tenant, and queries that cannot be parsed are denied.
+func WithTenantFilter(filter TenantFilter) QueryRewriterOption {
+	return func(r *QueryRewriter) {
+		r.tenant = &filter
+	}
+}
+
+// NewQueryRewriter creates a QueryRewriter making the configured rewrites
+func NewQueryRewriter(opts ...QueryRewriterOption) (*QueryRewriter, error) {
+	r := &QueryRewriter{}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.limit < 0 || r.limit > math.MaxInt32 {
+		return nil, fmt.Errorf("row limit must be between 0 and %d", math.MaxInt32)
+	}
+	if (r.limit > 0 || r.tenant != nil) && !PgQueryAvailable {
+		return nil, fmt.Errorf("row limits and tenant filters rewrite queries with pg_query, which needs a binary built with cgo")
+	}
+	if r.tenant != nil {
+		if err := r.tenant.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Middleware is a domain.QueryMiddleware handing the rewritten query on to
+// next, and having the upstream run it once allowed. Queries the tenant filter
+// cannot apply to are denied.
+func (r *QueryRewriter) Middleware(ctx context.Context, query *domain.Query, next domain.QueryHandler) (domain.Decision, error) {
+	rewritten, err := r.Rewrite(query)
+	if err != nil {
+		return domain.Decision{Action: domain.DecisionDeny, Policy: "tenant_filter", Reason: err.Error(), Code: pgerrInsufficientPrivilege}, nil
+	}
+	if rewritten == "" {
+		return next(ctx, query)
+	}
+
+	query.Raw = rewritten
+	decision, err := next(ctx, query)
+	if err == nil && decision.Allowed() && decision.Rewrite == "" {
+		decision.Rewrite = rewritten
+	}
+	return decision, err
+}
+
+// Rewrite returns the rewritten text of query, or an empty string when it is
+// left as it is. It fails when the tenant filter cannot apply to the query.
+func (r *QueryRewriter) Rewrite(query *domain.Query) (string, error) {
+	if query.Kind == domain.QueryKindExecute || strings.TrimSpace(query.Raw) == "" {
+		return "", nil
+	}
+
+	text, changed := query.Raw, false
+	if r.limit > 0 || r.tenant != nil {
+		tree, err := pgQueryParse(query.Raw)
+		if err != nil {
+			if r.tenant != nil {
+				return "", fmt.Errorf("query cannot be parsed to filter tenants: %v", err)
+			}
+		} else {
+			rewriter := treeRewriter{limit: r.limit, tenant: r.tenant, created: make(map[*pg_query.SelectStmt]bool)}
+			if r.tenant != nil {
+				rewriter.value = r.tenant.tenant(query)
+			}
+			for _, stmt := range tree.Stmts {
+				if selectStmt := stmt.Stmt.GetSelectStmt(); selectStmt != nil {
+					rewriter.bound(selectStmt)
+				}
+				rewriter.walk(stmt.ProtoReflect())
+			}
+			if rewriter.err != nil {
+				return "", rewriter.err
+			}
+			if rewriter.changed {
+				if text, err = pgQueryDeparse(tree); err != nil {
+					return "", fmt.Errorf("failed to deparse rewritten query: %w", err)
+				}
+				changed = true
+			}
+		}
+	}
+
+	if r.trace {
+		text = fmt.Sprintf("/*traceparent='%s'*/ %s", traceparent(query.Labels["traceparent"]), text)
+		changed = true
+	}
+	if !changed {
+		return "", nil
+	}
+	return text, nil
+}
+
+// treeRewriter rewrites a parse tree in place
+type treeRewriter struct {
+	limit   int64
+	tenant  *TenantFilter
+	value   string                        // tenant of the connection
+	created map[*pg_query.SelectStmt]bool // subqueries of the tenant filter, already filtered
+	changed bool
+	err     error
+}
+
+// bound appends the row limit to a top-level SELECT reading relations without
+// a LIMIT. SELECT INTO, which creates a table, is left alone.
+func (t *treeRewriter) bound(stmt *pg_query.SelectStmt) {
+	if t.limit == 0 || stmt.LimitCount != nil || stmt.IntoClause != nil {
+		return
+	}
+	if stmt.Op == pg_query.SetOperation_SETOP_NONE && len(stmt.FromClause) == 0 {
+		return
+	}
+	stmt.LimitCount = pg_query.MakeAConstIntNode(t.limit, -1)
+	stmt.LimitOption = pg_query.LimitOption_LIMIT_OPTION_COUNT
+	t.changed = true
+}
+
+// walk visits every message reachable from msg, filtering the relations of the
+// statements it reaches
+func (t *treeRewriter) walk(msg protoreflect.Message) {
+	if t.tenant != nil && t.err == nil {
+		switch node := msg.Interface().(type) {
+		case *pg_query.SelectStmt:
+			if !t.created[node] {
+				t.filterFrom(node.FromClause)
+			}
+		case *pg_query.UpdateStmt:
+			node.WhereClause = t.restrict(node.Relation, node.WhereClause)
+			t.filterFrom(node.FromClause)
+		case *pg_query.DeleteStmt:
+			node.WhereClause = t.restrict(node.Relation, node.WhereClause)
+			t.filterFrom(node.UsingClause)
+		}
+	}
+
+	msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				t.walk(list.Get(i).Message())
+			}
+		case fd.Message() != nil && !fd.IsMap():
+			t.walk(v.Message())
+		}
+		return true
+	})
+}
+
+// filterFrom replaces the filtered tables of a FROM list, joined ones included,
+// with subqueries selecting the rows of the tenant
+func (t *treeRewriter) filterFrom(items []*pg_query.Node) {
+	for _, item := range items {
+		t.filterItem(item)
+	}
+}
+
+// filterItem filters a FROM item in place
+func (t *treeRewriter) filterItem(item *pg_query.Node) {
+	switch node := item.Node.(type) {
+	case *pg_query.Node_JoinExpr:
+		t.filterItem(node.JoinExpr.Larg)
+		t.filterItem(node.JoinExpr.Rarg)
+	case *pg_query.Node_RangeVar:
+		rv := node.RangeVar
+		if !t.tenant.filters(rv) || !t.check() {
+			return
+		}
+		alias := rv.Alias
+		if alias == nil {
+			alias = &pg_query.Alias{Aliasname: rv.Relname}
+		}
+		rv.Alias = nil
+		subquery := &pg_query.SelectStmt{
+			TargetList:  []*pg_query.Node{pg_query.MakeResTargetNodeWithVal(pg_query.MakeColumnRefNode([]*pg_query.Node{pg_query.MakeAStarNode()}, -1), -1)},
+			FromClause:  []*pg_query.Node{{Node: &pg_query.Node_RangeVar{RangeVar: rv}}},
+			WhereClause: t.predicate(rv, nil),
+			LimitOption: pg_query.LimitOption_LIMIT_OPTION_DEFAULT,
+			Op:          pg_query.SetOperation_SETOP_NONE,
+		}
+		t.created[subquery] = true
+		item.Node = &pg_query.Node_RangeSubselect{RangeSubselect: &pg_query.RangeSubselect{
+			Subquery: &pg_query.Node{Node: &pg_query.Node_SelectStmt{SelectStmt: subquery}},
+			Alias:    alias,
+		}}
+		t.changed = true
+	}
+}
+
+// restrict adds the tenant predicate of the relation an UPDATE or DELETE writes
+// to its WHERE clause
+func (t *treeRewriter) restrict(rv *pg_query.RangeVar, where *pg_query.Node) *pg_query.Node {
+	if rv == nil || !t.tenant.filters(rv) || !t.check() {
+		return where
+	}
+	t.changed = true
+	return t.predicate(rv, where)
+}
+
+// check reports whether the connection has a tenant, recording the error
+// denying the query otherwise
+func (t *treeRewriter) check() bool {
+	if t.value == "" && t.err == nil {
+		t.err = fmt.Errorf("the connection has no tenant to filter its queries with: set %s", t.tenant.Value)
+	}
+	return t.err == nil
+}
+
+// predicate returns the tenant predicate of the relation, and with where when not nil
+func (t *treeRewriter) predicate(rv *pg_query.RangeVar, where *pg_query.Node) *pg_query.Node {
+	qualifier := rv.Relname
+	if rv.Alias != nil {
+		qualifier = rv.Alias.Aliasname
+	}
+	column := pg_query.MakeColumnRefNode([]*pg_query.Node{pg_query.MakeStrNode(qualifier), pg_query.MakeStrNode(t.tenant.Column)}, -1)
+	predicate := pg_query.MakeAExprNode(pg_query.A_Expr_Kind_AEXPR_OP, []*pg_query.Node{pg_query.MakeStrNode("=")},
+		column, pg_query.MakeAConstStrNode(t.value, -1), -1)
+	if where == nil {
+		return predicate
+	}
+	return pg_query.MakeBoolExprNode(pg_query.BoolExprType_AND_EXPR, []*pg_query.Node{where, predicate}, -1)
+}
+
+// traceparent returns a W3C traceparent for a query: in the trace of parent when
+// it is a valid traceparent, in a new trace otherwise
+func traceparent(parent string) string {
+	var ids [24]byte
+	_, _ = rand.Read(ids[:])
+	traceID, spanID := hex.EncodeToString(ids[:16]), hex.EncodeToString(ids[16:])
+
+	parts := strings.Split(parent, "-")
+	if len(parts) == 4 && len(parts[1]) == 32 && strings.Trim(parts[1], "0") != "" {
+		if _, err := hex.DecodeString(parts[1]); err == nil {
+			traceID = strings.ToLower(parts[1])
+		}
+	}
+	return fmt.Sprintf("00-%s-%s-01", traceID, spanID)
+}
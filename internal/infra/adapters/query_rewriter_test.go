@@ -0,0 +1,95 @@
+package adapters
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryRewriter_Rewrite(t *testing.T) {
+	rewriter, err := NewQueryRewriter(WithRowLimit(100), WithTenantFilter(TenantFilter{
+		Column: "tenant_id", Value: "label.tenant", Tables: []string{"orders", "billing.*"},
+	}))
+	require.NoError(t, err)
+
+	for raw, expected := range map[string]string{
+		"SELECT 1":                               "",
+		"SELECT * FROM products":                 "SELECT * FROM products LIMIT 100",
+		"SELECT * FROM products LIMIT 5":         "",
+		"SELECT * INTO archive FROM products":    "",
+		"SELECT id FROM orders WHERE total > 10": "SELECT id FROM (SELECT * FROM orders WHERE orders.tenant_id = 'acme') orders WHERE total > 10 LIMIT 100",
+		"SELECT o.id FROM orders o JOIN products p ON p.id = o.product_id": "SELECT o.id FROM (SELECT * FROM orders WHERE orders.tenant_id = 'acme') o JOIN products p ON p.id = o.product_id LIMIT 100",
+		"SELECT * FROM billing.invoices LIMIT 1":                           "SELECT * FROM (SELECT * FROM billing.invoices WHERE invoices.tenant_id = 'acme') invoices LIMIT 1",
+		"UPDATE orders SET total = 0 WHERE id = 1":                         "UPDATE orders SET total = 0 WHERE id = 1 AND orders.tenant_id = 'acme'",
+		"DELETE FROM orders":                                               "DELETE FROM orders WHERE orders.tenant_id = 'acme'",
+		"INSERT INTO products SELECT * FROM orders":                        "INSERT INTO products SELECT * FROM (SELECT * FROM orders WHERE orders.tenant_id = 'acme') orders",
+	} {
+		query := scriptQuery(raw)
+		query.Labels = map[string]string{"tenant": "acme"}
+		rewritten, err := rewriter.Rewrite(query)
+		require.NoError(t, err, raw)
+		assert.Equal(t, expected, rewritten, raw)
+	}
+
+	_, err = rewriter.Rewrite(scriptQuery("SELECT * FROM orders"))
+	assert.Error(t, err, "Queries on filtered tables should fail without a tenant")
+	_, err = rewriter.Rewrite(scriptQuery("SELECT * FROM"))
+	assert.Error(t, err, "Queries that cannot be parsed should fail with a tenant filter")
+
+	execute := scriptQuery("SELECT * FROM products")
+	execute.Kind = domain.QueryKindExecute
+	rewritten, err := rewriter.Rewrite(execute)
+	require.NoError(t, err)
+	assert.Empty(t, rewritten, "Executions of prepared statements should be left alone")
+}
+
+func TestQueryRewriter_TraceComments(t *testing.T) {
+	rewriter, err := NewQueryRewriter(WithTraceComments())
+	require.NoError(t, err)
+
+	rewritten, err := rewriter.Rewrite(scriptQuery("SELECT 1"))
+	require.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^/\*traceparent='00-[0-9a-f]{32}-[0-9a-f]{16}-01'\*/ SELECT 1$`), rewritten)
+
+	query := scriptQuery("SELECT 1")
+	query.Labels = map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	rewritten, err = rewriter.Rewrite(query)
+	require.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^/\*traceparent='00-4bf92f3577b34da6a3ce929d0e0e4736-[0-9a-f]{16}-01'\*/ SELECT 1$`), rewritten,
+		"The trace of the traceparent label should be continued")
+}
+
+func TestQueryRewriter_Middleware(t *testing.T) {
+	rewriter, err := NewQueryRewriter(WithRowLimit(10), WithTenantFilter(TenantFilter{Column: "tenant_id", Value: "user", Tables: []string{"orders"}}))
+	require.NoError(t, err)
+	engine := &mocks.StaticPolicyEngine{}
+	ctx := context.Background()
+
+	decision, err := rewriter.Middleware(ctx, scriptQuery("SELECT * FROM products"), engine.Evaluate)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed())
+	assert.Equal(t, "SELECT * FROM products LIMIT 10", decision.Rewrite)
+	assert.Equal(t, "SELECT * FROM products LIMIT 10", engine.Queries()[0].Raw, "The policy engine should see the rewritten query")
+
+	decision, err = rewriter.Middleware(ctx, scriptQuery("SELECT 1"), engine.Evaluate)
+	require.NoError(t, err)
+	assert.Empty(t, decision.Rewrite)
+
+	anonymous := scriptQuery("SELECT * FROM orders")
+	anonymous.UserID = ""
+	decision, err = rewriter.Middleware(ctx, anonymous, engine.Evaluate)
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed(), "Queries the tenant filter cannot apply to should be denied")
+	assert.Len(t, engine.Queries(), 2)
+
+	_, err = NewQueryRewriter(WithTenantFilter(TenantFilter{Column: "tenant_id", Value: "session", Tables: []string{"orders"}}))
+	assert.Error(t, err)
+	_, err = NewQueryRewriter(WithRowLimit(-1))
+	assert.Error(t, err)
+}
@@ -0,0 +1,135 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// DefaultLeaderLock names the Redis key or Kubernetes Lease the replicas of a
+	// cluster compete for
+	DefaultLeaderLock = "quota-enforcer-housekeeping"
+
+	// DefaultLeaderTTL is how long the leadership outlives its last renewal
+	DefaultLeaderTTL = 15 * time.Second
+)
+
+// leaderElection holds the settings shared by the leader electors
+type leaderElection struct {
+	lock     string
+	identity string
+	ttl      time.Duration
+	clock    domain.Clock
+}
+
+// LeaderElectorOption configures optional behavior of a leader elector
+type LeaderElectorOption func(*leaderElection)
+
+// WithLeaderLock sets the name of the Redis key or Kubernetes Lease
+func WithLeaderLock(lock string) LeaderElectorOption {
+	return func(e *leaderElection) {
+		e.lock = lock
+	}
+}
+
+// WithLeaderTTL sets how long the leadership outlives its last renewal
+func WithLeaderTTL(ttl time.Duration) LeaderElectorOption {
+	return func(e *leaderElection) {
+		e.ttl = ttl
+	}
+}
+
+// WithLeaderElectorClock sets the clock the leadership is timed with
+func WithLeaderElectorClock(clock domain.Clock) LeaderElectorOption {
+	return func(e *leaderElection) {
+		e.clock = clock
+	}
+}
+
+// newLeaderElection applies opts to the defaults
+func newLeaderElection(identity string, opts []LeaderElectorOption) leaderElection {
+	election := leaderElection{
+		lock:     DefaultLeaderLock,
+		identity: identity,
+		ttl:      DefaultLeaderTTL,
+		clock:    SystemClock{},
+	}
+	for _, opt := range opts {
+		opt(&election)
+	}
+	return election
+}
+
+var (
+	// redisLeadScript sets the lock to the identity unless another one holds
+	// it, and extends it when the identity does
+	redisLeadScript = redis.NewScript(`
+		local holder = redis.call('GET', KEYS[1])
+		if holder == false then
+			redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+			return 1
+		end
+		if holder == ARGV[1] then
+			redis.call('PEXPIRE', KEYS[1], ARGV[2])
+			return 1
+		end
+		return 0`)
+
+	// redisResignScript deletes the lock if the identity holds it
+	redisResignScript = redis.NewScript(`
+		if redis.call('GET', KEYS[1]) == ARGV[1] then
+			return redis.call('DEL', KEYS[1])
+		end
+		return 0`)
+)
+
+// RedisLeaderElector implements domain.LeaderElector with a lock kept in Redis:
+// a key holding the identity of the leader and expiring with its leadership.
+// Redis times the leadership, so the clocks of the replicas need not agree.
+type RedisLeaderElector struct {
+	leaderElection
+	client *redis.Client
+}
+
+// NewRedisLeaderElector connects to the Redis server at url to elect identity,
+// usually the ID of the instance. Close closes the connections.
+func NewRedisLeaderElector(ctx context.Context, url, identity string, opts ...LeaderElectorOption) (*RedisLeaderElector, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure leader election: %w", err)
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("failed to connect to the leader election lock: %w", err)
+	}
+
+	return &RedisLeaderElector{leaderElection: newLeaderElection(identity, opts), client: client}, nil
+}
+
+// Lead implements domain.LeaderElector
+func (e *RedisLeaderElector) Lead(ctx context.Context) (time.Time, error) {
+	start := e.clock.Now()
+	led, err := redisLeadScript.Run(ctx, e.client, []string{e.lock}, e.identity, e.ttl.Milliseconds()).Int()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if led == 0 {
+		return time.Time{}, nil
+	}
+	return start.Add(e.ttl), nil
+}
+
+// Resign implements domain.LeaderElector
+func (e *RedisLeaderElector) Resign(ctx context.Context) error {
+	return redisResignScript.Run(ctx, e.client, []string{e.lock}, e.identity).Err()
+}
+
+// Close closes the connections
+func (e *RedisLeaderElector) Close() error {
+	return e.client.Close()
+}
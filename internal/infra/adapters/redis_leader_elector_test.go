@@ -0,0 +1,63 @@
+package adapters
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisLeaderElector(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	newElector := func(identity string) *RedisLeaderElector {
+		elector, err := NewRedisLeaderElector(ctx, "redis://"+server.Addr(), identity,
+			WithLeaderTTL(10*time.Second), WithLeaderElectorClock(clock))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = elector.Close() })
+		return elector
+	}
+	first, second := newElector("enforcer-1"), newElector("enforcer-2")
+
+	until, err := first.Lead(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, clock.Now().Add(10*time.Second), until)
+	until, err = second.Lead(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, until, "Only one replica should lead")
+
+	server.FastForward(8 * time.Second)
+	_, err = first.Lead(ctx)
+	require.NoError(t, err)
+	server.FastForward(8 * time.Second)
+	until, err = second.Lead(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, until, "Renewals should keep the leadership")
+
+	require.NoError(t, second.Resign(ctx))
+	assert.Equal(t, "enforcer-1", mustGet(t, server, DefaultLeaderLock), "Followers should not release the lock")
+	require.NoError(t, first.Resign(ctx))
+	until, err = second.Lead(ctx)
+	require.NoError(t, err)
+	assert.NotZero(t, until, "A resignation should let another replica lead")
+
+	server.FastForward(10 * time.Second)
+	until, err = first.Lead(ctx)
+	require.NoError(t, err)
+	assert.NotZero(t, until, "An expired leadership should be taken over")
+}
+
+// mustGet returns the value of key
+func mustGet(t *testing.T, server *miniredis.Miniredis, key string) string {
+	t.Helper()
+	value, err := server.Get(key)
+	require.NoError(t, err)
+	return value
+}
@@ -0,0 +1,164 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRedisUsagePrefix prefixes the keys of the usage counters kept in Redis
+const DefaultRedisUsagePrefix = "quota-enforcer:usage:"
+
+// RedisUsageStore implements domain.UsageStore with counters kept in Redis, so
+// that replicas behind a load balancer enforce quotas on the sum of their usage.
+// Each counter is a key expiring with its window. Increments are buffered,
+// bounded and flushed, or written through with strict usage (see
+// BufferedUsageStoreOption). Redis keeps no quota policies.
+type RedisUsageStore struct {
+	counters *bufferedUsageStore
+	client   *redis.Client
+}
+
+// NewRedisUsageStore connects to the Redis server at url, such as
+// redis://quota-redis.internal:6379/0, and starts flushing buffered usage in the
+// background. opts configure the buffering of increments. Close flushes the
+// remaining usage and closes the connections.
+func NewRedisUsageStore(ctx context.Context, url string, log logger.Logger, opts ...BufferedUsageStoreOption) (*RedisUsageStore, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure usage store: %w", err)
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("failed to connect to usage store: %w", err)
+	}
+
+	return &RedisUsageStore{
+		counters: newBufferedUsageStore(redisUsageTable{client: client, prefix: DefaultRedisUsagePrefix}, log, opts...),
+		client:   client,
+	}, nil
+}
+
+// Increment adds amount to the counter of the current window
+func (s *RedisUsageStore) Increment(ctx context.Context, key domain.UsageKey, window time.Duration, amount int64) (domain.Usage, error) {
+	return s.counters.Increment(ctx, key, window, amount)
+}
+
+// Get returns the usage of the current window, including buffered increments
+func (s *RedisUsageStore) Get(ctx context.Context, key domain.UsageKey, window time.Duration) (domain.Usage, error) {
+	return s.counters.Get(ctx, key, window)
+}
+
+// Reset clears the counters of key, buffered and persisted
+func (s *RedisUsageStore) Reset(ctx context.Context, key domain.UsageKey) error {
+	return s.counters.Reset(ctx, key)
+}
+
+// Flush writes the buffered usage in a single transaction
+func (s *RedisUsageStore) Flush(ctx context.Context) error {
+	return s.counters.Flush(ctx)
+}
+
+// Ping checks that the Redis server is reachable
+func (s *RedisUsageStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+// LoadPolicies returns no policy: they are kept in the configuration or etcd
+func (s *RedisUsageStore) LoadPolicies(ctx context.Context) ([]domain.QuotaPolicy, error) {
+	return nil, nil
+}
+
+// LoadRoles returns no role: they are kept in the configuration or etcd
+func (s *RedisUsageStore) LoadRoles(ctx context.Context) (map[string][]string, error) {
+	return nil, nil
+}
+
+// Close writes the buffered usage and closes the connections
+func (s *RedisUsageStore) Close() error {
+	err := s.counters.Close()
+	if closeErr := s.client.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// redisUsageTable implements usageTable with a Redis key per counter and window
+type redisUsageTable struct {
+	client *redis.Client
+	prefix string
+}
+
+// counterPrefix returns the prefix of the keys of the counters of key, whose
+// fields are quoted so that no name can run into the next one. The label value
+// of policies counted per label follows the database, so that the keys of the
+// other policies keep their format.
+func (t redisUsageTable) counterPrefix(key domain.UsageKey) string {
+	prefix := t.prefix + strconv.Quote(key.Policy) + ":" + strconv.Quote(key.User) + ":" + strconv.Quote(key.Database) + ":"
+	if key.Label != "" {
+		prefix += strconv.Quote(key.Label) + ":"
+	}
+	return prefix
+}
+
+// counterKey returns the key of the counter of key in the window starting at start
+func (t redisUsageTable) counterKey(key domain.UsageKey, start time.Time) string {
+	return t.counterPrefix(key) + strconv.FormatInt(start.UnixMicro(), 10)
+}
+
+func (t redisUsageTable) load(ctx context.Context, key domain.UsageKey, start time.Time) (int64, error) {
+	used, err := t.client.Get(ctx, t.counterKey(key, start)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return used, err
+}
+
+func (t redisUsageTable) upsert(ctx context.Context, deltas []usageDelta) ([]int64, error) {
+	increments := make([]*redis.IntCmd, len(deltas))
+	_, err := t.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, delta := range deltas {
+			counter := t.counterKey(delta.key, delta.start)
+			increments[i] = pipe.IncrBy(ctx, counter, delta.delta)
+			pipe.ExpireAt(ctx, counter, delta.end)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	totals := make([]int64, len(deltas))
+	for i, increment := range increments {
+		totals[i] = increment.Val()
+	}
+	return totals, nil
+}
+
+func (t redisUsageTable) delete(ctx context.Context, key domain.UsageKey) error {
+	// Window starts follow the prefix: a quoted label value is another counter's
+	pattern := redisGlobEscaper.Replace(t.counterPrefix(key)) + "[0-9]*"
+	iter := t.client.Scan(ctx, 0, pattern, 100).Iterator()
+	var counters []string
+	for iter.Next(ctx) {
+		counters = append(counters, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(counters) == 0 {
+		return nil
+	}
+	return t.client.Del(ctx, counters...).Err()
+}
+
+// redisGlobEscaper escapes the characters SCAN patterns give a meaning to
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
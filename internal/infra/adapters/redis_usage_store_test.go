@@ -0,0 +1,96 @@
+package adapters
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisUsageStore_SharesUsageAcrossReplicas(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 30, 0, time.UTC))
+	server.SetTime(clock.Now())
+	key := domain.UsageKey{Policy: "daily", User: "alice", Database: "app"}
+
+	newReplica := func(opts ...BufferedUsageStoreOption) *RedisUsageStore {
+		store, err := NewRedisUsageStore(ctx, "redis://"+server.Addr(), logger.NewSimpleLogger(),
+			append(opts, WithBufferedUsageClock(clock))...)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = store.Close() })
+		return store
+	}
+
+	strict := []*RedisUsageStore{newReplica(WithStrictUsage()), newReplica(WithStrictUsage())}
+	for i := 0; i < 3; i++ {
+		_, err := strict[i%2].Increment(ctx, key, time.Hour, 1)
+		require.NoError(t, err)
+	}
+	usage, err := strict[1].Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), usage.Used, "Strict replicas should see the usage of each other at once")
+	assert.Equal(t, time.Date(2025, 6, 1, 13, 0, 0, 0, time.UTC), usage.ResetAt)
+
+	eventual := []*RedisUsageStore{newReplica(WithUsageMaxPending(5)), newReplica(WithUsageMaxPending(5))}
+	for i := 0; i < 4; i++ {
+		_, err := eventual[0].Increment(ctx, key, time.Hour, 1)
+		require.NoError(t, err)
+	}
+	usage, err = eventual[1].Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), usage.Used, "Usage below the bound should stay on its replica")
+
+	usage, err = eventual[0].Increment(ctx, key, time.Hour, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), usage.Used)
+	usage, err = strict[0].Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), usage.Used, "Reaching the bound should write the usage held back")
+
+	server.FastForward(time.Hour)
+	assert.Empty(t, server.Keys(), "Counters should expire with their window")
+}
+
+func TestRedisUsageStore_Reset(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	// Off the hour, so that the minute and hour windows start apart
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 30, 0, 0, time.UTC))
+	server.SetTime(clock.Now())
+	store, err := NewRedisUsageStore(ctx, "redis://"+server.Addr(), logger.NewSimpleLogger(), WithStrictUsage(), WithBufferedUsageClock(clock))
+	require.NoError(t, err)
+	defer store.Close()
+
+	globbed := domain.UsageKey{Policy: "p*", User: "alice", Database: "app"}
+	other := domain.UsageKey{Policy: "pa", User: "alice", Database: "app"}
+	tenant := domain.UsageKey{Policy: "p*", User: "alice", Database: "app", Label: "42"}
+	for _, key := range []domain.UsageKey{globbed, other, tenant} {
+		_, err := store.Increment(ctx, key, time.Hour, 2)
+		require.NoError(t, err)
+		_, err = store.Increment(ctx, key, time.Minute, 1)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, store.Reset(ctx, globbed))
+	usage, err := store.Get(ctx, globbed, time.Hour)
+	require.NoError(t, err)
+	assert.Zero(t, usage.Used)
+	usage, err = store.Get(ctx, other, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), usage.Used, "Names should not be matched as patterns")
+	usage, err = store.Get(ctx, tenant, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), usage.Used, "Label values should be counted apart")
+	assert.Len(t, server.Keys(), 4)
+
+	require.NoError(t, store.Reset(ctx, tenant))
+	assert.Len(t, server.Keys(), 2)
+}
@@ -0,0 +1,352 @@
+package adapters
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Normalizer names a query normalizer a server may be configured with
+type Normalizer string
+
+const (
+	// NormalizerPgQuery normalizes queries with PostgreSQL's own parser, through
+	// pg_query; it is the default of binaries built with cgo
+	NormalizerPgQuery Normalizer = "pg_query"
+	// NormalizerFastRegex normalizes queries with RegexNormalizer, which needs no
+	// CGO call
+	NormalizerFastRegex Normalizer = "fast-regex"
+	// NormalizerNone leaves queries as they are, fingerprinting them by their text
+	NormalizerNone Normalizer = "none"
+)
+
+// ParseNormalizer parses a normalizer name; an empty name is DefaultNormalizer.
+// pg_query is rejected by binaries built without cgo.
+func ParseNormalizer(name string) (Normalizer, error) {
+	switch normalizer := Normalizer(name); normalizer {
+	case "":
+		return DefaultNormalizer, nil
+	case NormalizerPgQuery:
+		if !PgQueryAvailable {
+			return "", fmt.Errorf("the pg_query normalizer needs a binary built with cgo: use fast-regex or none")
+		}
+		return normalizer, nil
+	case NormalizerFastRegex, NormalizerNone:
+		return normalizer, nil
+	default:
+		return "", fmt.Errorf("unknown normalizer %q: use pg_query, fast-regex or none", name)
+	}
+}
+
+// NewQueryNormalizer creates the query normalizer named normalizer
+func NewQueryNormalizer(normalizer Normalizer) domain.QueryNormalizer {
+	switch normalizer {
+	case NormalizerFastRegex:
+		return NewRegexNormalizer()
+	case NormalizerNone:
+		return NewVerbatimNormalizer()
+	default:
+		return NewPgQueryNormalizer()
+	}
+}
+
+// regexTokenKind tells apart the tokens of a query the RegexNormalizer cares about
+type regexTokenKind int
+
+const (
+	regexTokenSpace regexTokenKind = iota
+	regexTokenComment
+	regexTokenLiteral
+	regexTokenParam
+	regexTokenIdentifier
+	regexTokenOther
+)
+
+var (
+	// regexStringLiteral matches a string constant, or a bit string one
+	regexStringLiteral = regexp.MustCompile(`^(?:[bBxXnN]|[uU]&)?'(?:[^']|'')*'`)
+	// regexEscapeString matches a string constant with C-style escapes
+	regexEscapeString = regexp.MustCompile(`^[eE]'(?:[^'\\]|\\(?s:.)|'')*'`)
+	// regexNumber matches a numeric constant
+	regexNumber = regexp.MustCompile(`^(?:0[xXoObB][0-9a-fA-F_]+|(?:\d[\d_]*(?:\.[\d_]*)?|\.\d[\d_]*)(?:[eE][+-]?\d+)?)`)
+	// regexQuotedIdentifier matches a quoted identifier
+	regexQuotedIdentifier = regexp.MustCompile(`^(?:[uU]&)?"(?:[^"]|"")*"`)
+	// regexParam matches a parameter
+	regexParam = regexp.MustCompile(`^\$\d+`)
+	// regexDollarTag matches the tag opening a dollar-quoted string constant
+	regexDollarTag = regexp.MustCompile(`^\$(?:[A-Za-z_\x{80}-\x{10FFFF}][A-Za-z0-9_\x{80}-\x{10FFFF}]*)?\$`)
+)
+
+// regexToken is a token of a query
+type regexToken struct {
+	kind regexTokenKind
+	text string
+}
+
+// RegexNormalizer implements domain.QueryNormalizer without parsing queries, so
+// that it needs no CGO call: a lexer replaces their literals (strings, numbers,
+// negative ones included, and booleans) with parameters, like pg_query does, and
+// fingerprints them by
+// their tokens, ignoring comments, spacing, the case of keywords and the number
+// of constants in IN lists. It does not check the syntax of queries, and may
+// fingerprint apart queries pg_query deems alike, or replace constants pg_query
+// keeps, such as type modifiers.
+type RegexNormalizer struct{}
+
+// NewRegexNormalizer creates a new RegexNormalizer
+func NewRegexNormalizer() domain.QueryNormalizer {
+	return &RegexNormalizer{}
+}
+
+// Normalize normalizes a SQL query by replacing its literals
+func (n *RegexNormalizer) Normalize(rawQuery string) (domain.NormalizedQuery, error) {
+	if strings.TrimSpace(rawQuery) == "" {
+		return domain.NormalizedQuery{}, fmt.Errorf("empty query cannot be normalized")
+	}
+	tokens, err := lexQuery(rawQuery)
+	if err != nil {
+		return domain.NormalizedQuery{}, fmt.Errorf("failed to normalize query: %w", err)
+	}
+
+	// Number the replaced literals after the parameters of the query
+	param := 0
+	for _, token := range tokens {
+		if token.kind == regexTokenParam {
+			if n, err := strconv.Atoi(token.text[1:]); err == nil && n > param {
+				param = n
+			}
+		}
+	}
+
+	var normalized strings.Builder
+	normalized.Grow(len(rawQuery))
+	fingerprint := make([]string, 0, len(tokens))
+	for i, token := range tokens {
+		switch token.kind {
+		case regexTokenLiteral:
+			// Identifiers may contain $, and $ start dollar quotes, so that a
+			// parameter right after either would become part of it
+			if i > 0 && (tokens[i-1].kind == regexTokenIdentifier || strings.HasSuffix(tokens[i-1].text, "$")) {
+				normalized.WriteByte(' ')
+			}
+			param++
+			normalized.WriteString("$" + strconv.Itoa(param))
+			fingerprint = append(fingerprint, "?")
+		case regexTokenParam:
+			normalized.WriteString(token.text)
+			fingerprint = append(fingerprint, "?")
+		case regexTokenSpace, regexTokenComment:
+			normalized.WriteString(token.text)
+		case regexTokenIdentifier:
+			normalized.WriteString(token.text)
+			if strings.HasSuffix(token.text, `"`) {
+				fingerprint = append(fingerprint, token.text)
+			} else {
+				fingerprint = append(fingerprint, strings.ToLower(token.text))
+			}
+		default:
+			normalized.WriteString(token.text)
+			fingerprint = append(fingerprint, token.text)
+		}
+	}
+
+	return domain.NormalizedQuery{
+		Original:   rawQuery,
+		Normalized: normalized.String(),
+		Hash:       domain.NewQueryHash(fingerprintHash(strings.Join(collapseConstantLists(fingerprint), " "))),
+	}, nil
+}
+
+// lexQuery splits query into tokens, literals being those the RegexNormalizer
+// replaces. Tokens are told apart by their first bytes, and constants and quoted
+// identifiers matched by regular expressions.
+func lexQuery(query string) ([]regexToken, error) {
+	tokens := make([]regexToken, 0, len(query)/4)
+	for pos := 0; pos < len(query); {
+		rest := query[pos:]
+		kind, length := regexTokenOther, 1
+		switch c := rest[0]; {
+		case isQuerySpace(c):
+			kind = regexTokenSpace
+			for length < len(rest) && isQuerySpace(rest[length]) {
+				length++
+			}
+		case strings.HasPrefix(rest, "--"):
+			kind, length = regexTokenComment, len(rest)
+			if newline := strings.IndexByte(rest, '\n'); newline >= 0 {
+				length = newline
+			}
+		case strings.HasPrefix(rest, "/*"):
+			end, err := blockCommentEnd(query, pos)
+			if err != nil {
+				return nil, err
+			}
+			kind, length = regexTokenComment, end-pos
+		case c == '\'' || (len(rest) > 1 && rest[1] == '\'' && strings.IndexByte("bBxXnN", c) >= 0) || strings.HasPrefix(rest, "u&'") || strings.HasPrefix(rest, "U&'"):
+			if length = len(regexStringLiteral.FindString(rest)); length == 0 {
+				return nil, fmt.Errorf("unterminated quoted string at position %d", pos)
+			}
+			kind = regexTokenLiteral
+		case len(rest) > 1 && rest[1] == '\'' && (c == 'e' || c == 'E'):
+			if length = len(regexEscapeString.FindString(rest)); length == 0 {
+				return nil, fmt.Errorf("unterminated quoted string at position %d", pos)
+			}
+			kind = regexTokenLiteral
+		case c == '"' || strings.HasPrefix(rest, "u&\"") || strings.HasPrefix(rest, "U&\""):
+			if length = len(regexQuotedIdentifier.FindString(rest)); length == 0 {
+				return nil, fmt.Errorf("unterminated quoted identifier at position %d", pos)
+			}
+			kind = regexTokenIdentifier
+		case isQueryDigit(c) || (c == '.' && len(rest) > 1 && isQueryDigit(rest[1])):
+			kind, length = regexTokenLiteral, len(regexNumber.FindString(rest))
+		case c == '-' && len(rest) > 1 && startsNumber(rest[1:]) && startsOperand(tokens):
+			// A minus starting an operand negates the number, which PostgreSQL
+			// folds into the constant
+			kind, length = regexTokenLiteral, 1+len(regexNumber.FindString(rest[1:]))
+		case c == '$':
+			if param := regexParam.FindString(rest); param != "" {
+				kind, length = regexTokenParam, len(param)
+			} else if tag := regexDollarTag.FindString(rest); tag != "" {
+				closing := strings.Index(rest[len(tag):], tag)
+				if closing < 0 {
+					return nil, fmt.Errorf("unterminated dollar-quoted string at position %d", pos)
+				}
+				kind, length = regexTokenLiteral, len(tag)+closing+len(tag)
+			}
+		case isIdentifierStart(c):
+			kind = regexTokenIdentifier
+			for length < len(rest) && (isIdentifierStart(rest[length]) || isQueryDigit(rest[length]) || rest[length] == '$') {
+				length++
+			}
+			if word := rest[:length]; strings.EqualFold(word, "true") || strings.EqualFold(word, "false") {
+				kind = regexTokenLiteral
+			}
+		}
+		tokens = append(tokens, regexToken{kind: kind, text: rest[:length]})
+		pos += length
+	}
+	return tokens, nil
+}
+
+// startsNumber reports whether s starts with a numeric constant
+func startsNumber(s string) bool {
+	return isQueryDigit(s[0]) || (s[0] == '.' && len(s) > 1 && isQueryDigit(s[1]))
+}
+
+// operandKeywords are the keywords an operand may directly follow
+var operandKeywords = map[string]bool{
+	"select": true, "where": true, "and": true, "or": true, "not": true, "between": true, "when": true,
+	"then": true, "else": true, "limit": true, "offset": true, "having": true, "on": true, "by": true, "returning": true,
+}
+
+// startsOperand reports whether the token following tokens starts an operand:
+// the query starts there, or it follows an operator, a comma, an opening
+// parenthesis or bracket, or a keyword an operand follows, rather than another
+// operand
+func startsOperand(tokens []regexToken) bool {
+	for i := len(tokens) - 1; i >= 0; i-- {
+		switch token := tokens[i]; token.kind {
+		case regexTokenSpace, regexTokenComment:
+			continue
+		case regexTokenOther:
+			return token.text != ")" && token.text != "]"
+		case regexTokenIdentifier:
+			return operandKeywords[strings.ToLower(token.text)]
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isQuerySpace reports whether c is a whitespace byte
+func isQuerySpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+// isQueryDigit reports whether c is a decimal digit
+func isQueryDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// isIdentifierStart reports whether an identifier may start with c, bytes of
+// multibyte characters included as PostgreSQL does
+func isIdentifierStart(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || c == '_' || c >= 0x80
+}
+
+// blockCommentEnd returns the end of the block comment starting at start, which
+// may nest others
+func blockCommentEnd(query string, start int) (int, error) {
+	depth := 0
+	for pos := start; pos+1 < len(query); pos++ {
+		switch query[pos : pos+2] {
+		case "/*":
+			depth++
+			pos++
+		case "*/":
+			depth--
+			pos++
+			if depth == 0 {
+				return pos + 1, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unterminated comment at position %d", start)
+}
+
+// collapseConstantLists replaces the parenthesized or bracketed lists of
+// constants of a fingerprint, such as IN lists and ARRAY constructors, with a
+// single constant, so that their length does not matter
+func collapseConstantLists(fingerprint []string) []string {
+	collapsed := fingerprint[:0]
+	for i := 0; i < len(fingerprint); i++ {
+		collapsed = append(collapsed, fingerprint[i])
+		if fingerprint[i] != "(" && fingerprint[i] != "[" {
+			continue
+		}
+		end := i + 1
+		for end+1 < len(fingerprint) && fingerprint[end] == "?" && fingerprint[end+1] == "," {
+			end += 2
+		}
+		if end > i+1 && end+1 < len(fingerprint) && fingerprint[end] == "?" && (fingerprint[end+1] == ")" || fingerprint[end+1] == "]") {
+			collapsed = append(collapsed, "?")
+			i = end
+		}
+	}
+	return collapsed
+}
+
+// fingerprintHash hashes a fingerprint into 16 hexadecimal digits, the length of
+// pg_query fingerprints
+func fingerprintHash(fingerprint string) string {
+	sum := sha256.Sum256([]byte(fingerprint))
+	return hex.EncodeToString(sum[:8])
+}
+
+// VerbatimNormalizer implements domain.QueryNormalizer without normalizing
+// queries: their normalized text is their text, literals included, and queries
+// differing by a literal have different fingerprints
+type VerbatimNormalizer struct{}
+
+// NewVerbatimNormalizer creates a new VerbatimNormalizer
+func NewVerbatimNormalizer() domain.QueryNormalizer {
+	return &VerbatimNormalizer{}
+}
+
+// Normalize returns the query as it is, fingerprinted by its trimmed text
+func (n *VerbatimNormalizer) Normalize(rawQuery string) (domain.NormalizedQuery, error) {
+	trimmed := strings.TrimSpace(rawQuery)
+	if trimmed == "" {
+		return domain.NormalizedQuery{}, fmt.Errorf("empty query cannot be normalized")
+	}
+	return domain.NormalizedQuery{
+		Original:   rawQuery,
+		Normalized: rawQuery,
+		Hash:       domain.NewQueryHash(fingerprintHash(trimmed)),
+	}, nil
+}
@@ -0,0 +1,178 @@
+package adapters
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegexNormalizer_Normalize(t *testing.T) {
+	normalizer := NewRegexNormalizer()
+
+	tests := []struct {
+		name               string
+		input              string
+		expectedNormalized string
+		expectError        bool
+	}{
+		{
+			name:               "String and numeric literals",
+			input:              "SELECT * FROM orders WHERE user_id = 123 AND status = 'pending' AND total > 9.5e2",
+			expectedNormalized: "SELECT * FROM orders WHERE user_id = $1 AND status = $2 AND total > $3",
+		},
+		{
+			name:               "IN list",
+			input:              "SELECT * FROM items WHERE category IN ('electronics', 'books', 'clothing')",
+			expectedNormalized: "SELECT * FROM items WHERE category IN ($1, $2, $3)",
+		},
+		{
+			name:               "Quotes, escapes and dollar quoting",
+			input:              `SELECT 'it''s', E'a\'b', $fn$ x 'y' $fn$, "col""1" FROM t2`,
+			expectedNormalized: `SELECT $1, $2, $3, "col""1" FROM t2`,
+		},
+		{
+			name:               "Booleans, typed literals and casts",
+			input:              "SELECT * FROM users WHERE active = TRUE AND created_at > DATE '2023-01-01' AND id = '7'::int",
+			expectedNormalized: "SELECT * FROM users WHERE active = $1 AND created_at > DATE $2 AND id = $3::int",
+		},
+		{
+			name:               "Parameters are kept and numbered after",
+			input:              "SELECT * FROM users WHERE id = $2 AND name = $1 LIMIT 10",
+			expectedNormalized: "SELECT * FROM users WHERE id = $2 AND name = $1 LIMIT $3",
+		},
+		{
+			name:               "Negative numbers",
+			input:              "SELECT -1, x - 2, f(-3.5e10) FROM t WHERE x = -3.5e10 AND y BETWEEN -.5 AND -7 LIMIT 5 -1",
+			expectedNormalized: "SELECT $1, x - $2, f($3) FROM t WHERE x = $4 AND y BETWEEN $5 AND $6 LIMIT $7 -$8",
+		},
+		{
+			name:               "Minus after operands",
+			input:              "SELECT a-1, $1 -2, (b)-3, c[1]-4, \"d\"-5 FROM t WHERE z=-6",
+			expectedNormalized: "SELECT a-$2, $1 -$3, (b)-$4, c[$5]-$6, \"d\"-$7 FROM t WHERE z=$8",
+		},
+		{
+			name:               "Comments are kept",
+			input:              "/* app /* nested */ */ SELECT 1 -- trailing 'x'",
+			expectedNormalized: "/* app /* nested */ */ SELECT $1 -- trailing 'x'",
+		},
+		{
+			name:        "Empty query",
+			input:       "   \n\t  ",
+			expectError: true,
+		},
+		{
+			name:        "Unterminated string",
+			input:       "SELECT 'abc",
+			expectError: true,
+		},
+		{
+			name:        "Unterminated dollar quote",
+			input:       "SELECT $$abc",
+			expectError: true,
+		},
+		{
+			name:        "Unterminated comment",
+			input:       "SELECT 1 /* /* */",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := normalizer.Normalize(tt.input)
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.input, result.Original, "Original query should be preserved")
+			assert.Equal(t, tt.expectedNormalized, result.Normalized)
+			assert.Len(t, result.Hash.Value(), 16)
+
+			again, err := normalizer.Normalize(result.Normalized)
+			require.NoError(t, err)
+			assert.Equal(t, result.Normalized, again.Normalized, "Normalization should be idempotent")
+			assert.Equal(t, result.Hash, again.Hash, "Literals and parameters should fingerprint alike")
+		})
+	}
+}
+
+func TestRegexNormalizer_Fingerprints(t *testing.T) {
+	normalizer := NewRegexNormalizer()
+
+	alike := [][]string{
+		{
+			"SELECT * FROM users WHERE id = 1",
+			"select *  from USERS where id=42 -- by id",
+			"SELECT * FROM users /* pk */ WHERE id = $1",
+		},
+		{
+			"SELECT * FROM items WHERE category IN ('a')",
+			"SELECT * FROM items WHERE category IN ('a', 'b', 'c')",
+			"SELECT * FROM items WHERE category IN ($1, $2)",
+		},
+		{
+			"SELECT * FROM t WHERE tags && ARRAY[1, 2]",
+			"SELECT * FROM t WHERE tags && ARRAY[3]",
+		},
+		{
+			"SELECT * FROM t WHERE x = 3.5e10",
+			"SELECT * FROM t WHERE x = -3.5e10",
+			"SELECT * FROM t WHERE x=-1",
+		},
+		{
+			"SELECT * FROM t WHERE x IN (1, 2)",
+			"SELECT * FROM t WHERE x IN (-1, -2, 3)",
+		},
+	}
+	for _, queries := range alike {
+		first, err := normalizer.Normalize(queries[0])
+		require.NoError(t, err)
+		for _, query := range queries[1:] {
+			result, err := normalizer.Normalize(query)
+			require.NoError(t, err)
+			assert.Equal(t, first.Hash, result.Hash, "%q and %q should fingerprint alike", queries[0], query)
+		}
+	}
+
+	apart := []string{
+		"SELECT * FROM users WHERE id = 1",
+		"SELECT * FROM users WHERE uid = 1",
+		`SELECT * FROM "Users" WHERE id = 1`,
+		"SELECT * FROM users WHERE id = 1 AND org = 2",
+		"SELECT * FROM users2 WHERE id = 1",
+	}
+	hashes := make(map[string]string)
+	for _, query := range apart {
+		result, err := normalizer.Normalize(query)
+		require.NoError(t, err)
+		assert.NotContains(t, hashes, result.Hash.Value(), "%q should not fingerprint like %q", query, hashes[result.Hash.Value()])
+		hashes[result.Hash.Value()] = query
+	}
+}
+
+func TestVerbatimNormalizer_Normalize(t *testing.T) {
+	normalizer := NewQueryNormalizer(NormalizerNone)
+
+	result, err := normalizer.Normalize(" SELECT * FROM users WHERE id = 1\n")
+	require.NoError(t, err)
+	assert.Equal(t, " SELECT * FROM users WHERE id = 1\n", result.Normalized, "Queries should be left as they are")
+	trimmed, err := normalizer.Normalize("SELECT * FROM users WHERE id = 1")
+	require.NoError(t, err)
+	assert.Equal(t, result.Hash, trimmed.Hash)
+	other, err := normalizer.Normalize("SELECT * FROM users WHERE id = 2")
+	require.NoError(t, err)
+	assert.NotEqual(t, result.Hash, other.Hash, "Literals should tell queries apart")
+
+	_, err = normalizer.Normalize("")
+	assert.Error(t, err)
+
+	for _, name := range []string{"", "pg_query", "fast-regex", "none"} {
+		_, err := ParseNormalizer(name)
+		assert.NoError(t, err, name)
+	}
+	_, err = ParseNormalizer("regex")
+	assert.Error(t, err)
+}
@@ -0,0 +1,152 @@
+package adapters
+
+import (
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// resultCaps cuts off the statements of a proxied connection whose results
+// exceed the row or byte caps of the policies applying to them. Once a
+// statement, or an execution of a portal, returns more rows or more bytes of
+// rows than its cap allows, the proxy sends the upstream a cancel request and
+// discards what the upstream sends until the ReadyForQuery answering the Query
+// or Sync of the statement, which the client gets after an error telling the
+// cap, as if the statement had failed. Notices and other asynchronous messages
+// are still relayed. Client messages are observed by the handler goroutine and
+// upstream messages by the relay goroutine.
+type resultCaps struct {
+	cancel func(policy string) // sends a CancelRequest for the statement the upstream runs
+
+	mu      sync.Mutex
+	pending []cappedResult // messages forwarded upstream whose results are awaited, in order
+	rows    int64          // rows of the current statement
+	bytes   int64          // bytes of rows of the current statement
+	cutoff  *pgproto3.ErrorResponse
+}
+
+// cappedResult is a message forwarded upstream that produces results, with the
+// caps of its decision
+type cappedResult struct {
+	sync     bool // answered up to a ReadyForQuery, like Query and Sync messages
+	decision domain.Decision
+	next     int // index of the statement of a Query holding several completing next
+}
+
+// caps returns the decision holding the caps of the statement completing next:
+// the decision of that statement for a Query holding several
+func (r cappedResult) caps() domain.Decision {
+	if len(r.decision.Statements) == 0 {
+		return r.decision
+	}
+	return r.decision.Statements[min(r.next, len(r.decision.Statements)-1)]
+}
+
+// newResultCaps creates the result caps of a connection, which cancel its
+// statements with cancel
+func newResultCaps(cancel func(policy string)) *resultCaps {
+	return &resultCaps{cancel: cancel}
+}
+
+// observeClient queues a message forwarded upstream, which the decision taken
+// on it may give result caps
+func (c *resultCaps) observeClient(message *ParsedMessage, decision domain.Decision) {
+	switch message.Message.(type) {
+	case *pgproto3.Query:
+		c.expect(cappedResult{sync: true, decision: decision})
+	case *pgproto3.Execute:
+		c.expect(cappedResult{decision: decision})
+	case *pgproto3.Sync:
+		c.expect(cappedResult{sync: true})
+	}
+}
+
+// expect queues a message whose results the upstream will send
+func (c *resultCaps) expect(result cappedResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, result)
+}
+
+// observeUpstream counts the rows of the current statement and returns the
+// messages to relay in place of msg: the error of a statement cut off, ahead
+// of the ReadyForQuery ending it, and msg unless it is discarded. A statement
+// ends with its CommandComplete, or with a suspended portal, an empty query or
+// an error; each statement of a Query holding several has the caps of its own
+// decision.
+func (c *resultCaps) observeUpstream(msg pgproto3.BackendMessage) (pgproto3.BackendMessage, pgproto3.BackendMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch m := msg.(type) {
+	case *pgproto3.DataRow:
+		if c.cutoff != nil || len(c.pending) == 0 {
+			break
+		}
+		c.rows++
+		for _, value := range m.Values {
+			c.bytes += int64(len(value))
+		}
+		decision := c.pending[0].caps()
+		switch {
+		case decision.MaxResultRows > 0 && c.rows > decision.MaxResultRows:
+			c.cut(decision.ResultRowsPolicy, fmt.Sprintf("%d rows", decision.MaxResultRows))
+		case decision.MaxResultBytes > 0 && c.bytes > decision.MaxResultBytes:
+			c.cut(decision.ResultBytesPolicy, fmt.Sprintf("%d bytes", decision.MaxResultBytes))
+		}
+	case *pgproto3.CommandComplete, *pgproto3.PortalSuspended, *pgproto3.EmptyQueryResponse, *pgproto3.ErrorResponse:
+		c.rows, c.bytes = 0, 0
+		if c.cutoff == nil && len(c.pending) > 0 {
+			if c.pending[0].sync {
+				c.pending[0].next++
+			} else {
+				c.pending = c.pending[1:]
+			}
+		}
+	case *pgproto3.ReadyForQuery:
+		for len(c.pending) > 0 {
+			sync := c.pending[0].sync
+			c.pending = c.pending[1:]
+			if sync {
+				break
+			}
+		}
+		cutoff := c.cutoff
+		c.cutoff, c.rows, c.bytes = nil, 0, 0
+		if cutoff != nil {
+			return cutoff, msg
+		}
+		return nil, msg
+	}
+	if c.cutoff != nil && !asynchronous(msg) {
+		return nil, nil
+	}
+	return nil, msg
+}
+
+// asynchronous reports whether the upstream may send msg whatever the client
+// asked for: notices, notifications, parameter changes and FATAL errors
+func asynchronous(msg pgproto3.BackendMessage) bool {
+	switch m := msg.(type) {
+	case *pgproto3.NoticeResponse, *pgproto3.NotificationResponse, *pgproto3.ParameterStatus:
+		return true
+	case *pgproto3.ErrorResponse:
+		return m.Severity == "FATAL" || m.Severity == "PANIC"
+	}
+	return false
+}
+
+// cut cuts off the current statement for exceeding limit, the cap of policy;
+// c.mu must be held
+func (c *resultCaps) cut(policy, limit string) {
+	c.cutoff = &pgproto3.ErrorResponse{
+		Severity:            "ERROR",
+		SeverityUnlocalized: "ERROR",
+		Code:                pgerrQuotaExceeded,
+		Message:             fmt.Sprintf("quota %q exceeded: results are limited to %s", policy, limit),
+		Detail:              "The statement was cancelled and the rest of its result discarded.",
+	}
+	go c.cancel(policy)
+}
@@ -0,0 +1,254 @@
+package adapters
+
+import (
+	"context"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// resultMeter measures what each statement of a connection consumes: the rows it
+// returns, the bytes of its result rows and COPY data in either direction, and
+// the time the upstream took to complete it. Completed statements are logged and
+// charged to the metered quotas of the policy engine, and allowed queries are
+// reported to query loggers that record decisions. Client messages are
+// observed by the handler goroutine and upstream messages by the relay goroutine.
+type resultMeter struct {
+	recorder    domain.UsageRecorder // nil when the policy engine has no metered quotas
+	queryLogger domain.QueryLogger
+	decisions   domain.DecisionLogger // nil when the query logger does not record decisions
+	session     *domain.Session
+	clock       domain.Clock
+	logger      logger.Logger
+	standalone  bool // without an upstream only COPY data sent by the client is measured
+
+	mu       sync.Mutex
+	pending  []pendingResult       // messages forwarded upstream whose results are awaited, in order
+	last     *domain.Query         // most recent query, charged for COPY data without an upstream
+	usage    domain.StatementUsage // measured since the last statement completed
+	lastDone time.Time             // when the last statement completed
+}
+
+// pendingResult is a message forwarded upstream that produces results
+type pendingResult struct {
+	queries []*domain.Query // the statements of a Query, in order; empty for Sync and nil for executions that could not be attributed
+	next    int             // index of the statement completing next
+	sync    bool            // answered up to a ReadyForQuery, like Query and Sync messages
+	sent    time.Time
+}
+
+// newResultMeter creates the meter of a connection
+func newResultMeter(engine domain.PolicyEngine, queryLogger domain.QueryLogger, session *domain.Session, clock domain.Clock, standalone bool, log logger.Logger) *resultMeter {
+	recorder, _ := engine.(domain.UsageRecorder)
+	decisions, _ := queryLogger.(domain.DecisionLogger)
+	return &resultMeter{
+		recorder:    recorder,
+		queryLogger: queryLogger,
+		decisions:   decisions,
+		session:     session,
+		clock:       clock,
+		logger:      log,
+		standalone:  standalone,
+	}
+}
+
+// observeClient meters a message the client sent once it was allowed, along with
+// the queries it was evaluated as, if any: the statements of a Query holding
+// several are charged one by one as they complete. Without an upstream a COPY
+// ends with the client's CopyDone or CopyFail, and queries are reported as soon
+// as they are allowed.
+func (m *resultMeter) observeClient(ctx context.Context, message *ParsedMessage, queries ...*domain.Query) {
+	switch msg := message.Message.(type) {
+	case *pgproto3.Query:
+		m.expect(pendingResult{queries: queries, sync: true})
+		if m.standalone {
+			for _, query := range queries {
+				m.logDecision(query, domain.StatementUsage{})
+			}
+		}
+	case *pgproto3.Parse:
+		// Preparing a statement produces no result to wait for
+		for _, query := range queries {
+			m.logDecision(query, domain.StatementUsage{})
+		}
+	case *pgproto3.Execute:
+		m.expect(pendingResult{queries: queries})
+		if m.standalone {
+			for _, query := range queries {
+				m.logDecision(query, domain.StatementUsage{})
+			}
+		}
+	case *pgproto3.Sync:
+		m.expect(pendingResult{sync: true})
+	case *pgproto3.CopyData:
+		m.add(0, len(msg.Data))
+	case *pgproto3.CopyDone, *pgproto3.CopyFail:
+		if m.standalone {
+			m.complete(ctx, "", false)
+		}
+	}
+}
+
+// observeUpstream meters a message relayed from the upstream. A statement completes
+// with its CommandComplete, or with a suspended portal, an empty query or an error.
+func (m *resultMeter) observeUpstream(ctx context.Context, msg pgproto3.BackendMessage) {
+	switch msg := msg.(type) {
+	case *pgproto3.DataRow:
+		size := 0
+		for _, value := range msg.Values {
+			size += len(value)
+		}
+		m.add(1, size)
+	case *pgproto3.CopyData:
+		m.add(0, len(msg.Data))
+	case *pgproto3.CommandComplete:
+		m.complete(ctx, string(msg.CommandTag), true)
+	case *pgproto3.PortalSuspended:
+		m.complete(ctx, "", true)
+	case *pgproto3.EmptyQueryResponse, *pgproto3.ErrorResponse:
+		m.complete(ctx, "", false)
+	case *pgproto3.ReadyForQuery:
+		m.ready()
+	}
+}
+
+// expect queues a message whose results the upstream will send
+func (m *resultMeter) expect(result pendingResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, query := range result.queries {
+		if query != nil {
+			m.last = query
+		}
+	}
+	if !m.standalone {
+		result.sent = m.clock.Now()
+		m.pending = append(m.pending, result)
+	}
+}
+
+// add counts result rows and bytes
+func (m *resultMeter) add(rows, bytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.usage.Rows += int64(rows)
+	m.usage.Bytes += int64(bytes)
+}
+
+// complete ends the statement at the head of the queue. Executions leave the
+// queue; a Query stays at its head until ReadyForQuery, each completion moving
+// on to its next statement, and its last statement is charged for any extra
+// completion. A statement is timed from when it was sent, or from when the
+// statement before it completed if the upstream was still busy with that one,
+// and queued until then; later statements of a Query are not queued.
+func (m *resultMeter) complete(ctx context.Context, tag string, logged bool) {
+	m.mu.Lock()
+	usage := m.usage
+	m.usage = domain.StatementUsage{}
+	query := m.last
+	attributed := false
+	if !m.standalone {
+		query = nil
+		if len(m.pending) > 0 {
+			head := m.pending[0]
+			now := m.clock.Now()
+			started := head.sent
+			if m.lastDone.After(started) {
+				started = m.lastDone
+			}
+			usage.Duration = now.Sub(started)
+			if head.next == 0 {
+				usage.Queued = started.Sub(head.sent)
+			}
+			m.lastDone = now
+
+			if len(head.queries) > 0 {
+				query = head.queries[min(head.next, len(head.queries)-1)]
+			}
+			attributed = query != nil
+			if !head.sync {
+				m.pending = m.pending[1:]
+			} else {
+				m.pending[0].next++
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	// COPY returns no rows; its tag tells how many it transferred
+	if rows, ok := copyRows(tag); ok {
+		usage.Rows = rows
+	}
+	if query == nil {
+		query = sessionQuery("", m.session)
+	}
+	query.Duration = usage.Duration
+
+	if logged {
+		details := map[string]interface{}{
+			"command_tag": tag,
+			"rows":        usage.Rows,
+			"bytes":       usage.Bytes,
+			"duration_ms": float64(usage.Duration.Microseconds()) / 1000,
+		}
+		if hash := query.Hash.String(); hash != "" {
+			details["query_hash"] = hash
+		}
+		if err := m.queryLogger.LogProtocolMessage(m.session.ConnectionID, "CommandComplete", details); err != nil {
+			m.logger.Error("Failed to log statement result: %v", err)
+		}
+	}
+
+	if attributed {
+		m.logDecision(query, usage)
+	}
+
+	if m.recorder == nil || usage == (domain.StatementUsage{}) {
+		return
+	}
+	if err := m.recorder.RecordUsage(ctx, query, usage); err != nil {
+		m.logger.Error("Failed to record statement usage: %v", err)
+	}
+}
+
+// logDecision reports an allowed query and what it consumed to the query logger
+// when it records decisions
+func (m *resultMeter) logDecision(query *domain.Query, usage domain.StatementUsage) {
+	if m.decisions == nil || query == nil {
+		return
+	}
+	if err := m.decisions.LogDecision(query, domain.AllowDecision(), usage); err != nil {
+		m.logger.Error("Failed to log query decision: %v", err)
+	}
+}
+
+// ready drops the messages answered by a ReadyForQuery: everything up to the
+// Query or Sync it ends, including executions skipped after an error
+func (m *resultMeter) ready() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.pending) > 0 {
+		sync := m.pending[0].sync
+		m.pending = m.pending[1:]
+		if sync {
+			break
+		}
+	}
+	m.usage = domain.StatementUsage{}
+	m.lastDone = m.clock.Now()
+}
+
+// copyRows returns the row count of a "COPY n" command tag
+func copyRows(tag string) (int64, bool) {
+	count, ok := strings.CutPrefix(tag, "COPY ")
+	if !ok {
+		return 0, false
+	}
+	rows, err := strconv.ParseInt(count, 10, 64)
+	return rows, err == nil
+}
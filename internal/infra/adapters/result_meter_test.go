@@ -0,0 +1,281 @@
+package adapters
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResultMeter(t *testing.T) {
+	ctx := context.Background()
+	session := &domain.Session{ConnectionID: "conn_1", User: "alice", Database: "app"}
+	query := func(raw string) *domain.Query {
+		q := sessionQuery(raw, session)
+		q.Hash = domain.NewQueryHash(raw)
+		return q
+	}
+	client := func(meter *resultMeter, msg pgproto3.FrontendMessage, q *domain.Query) {
+		meter.observeClient(ctx, &ParsedMessage{Message: msg}, q)
+	}
+	row := &pgproto3.DataRow{Values: [][]byte{[]byte("42"), []byte("alice"), nil}}
+
+	tests := []struct {
+		name     string
+		run      func(meter *resultMeter)
+		volumes  []domain.StatementUsage
+		queries  []string
+		resultsN int
+	}{
+		{
+			name: "Simple query rows",
+			run: func(meter *resultMeter) {
+				client(meter, &pgproto3.Query{}, query("select"))
+				meter.observeUpstream(ctx, &pgproto3.RowDescription{})
+				meter.observeUpstream(ctx, row)
+				meter.observeUpstream(ctx, row)
+				meter.observeUpstream(ctx, &pgproto3.CommandComplete{CommandTag: []byte("SELECT 2")})
+				meter.observeUpstream(ctx, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+			},
+			volumes:  []domain.StatementUsage{{Rows: 2, Bytes: 14}},
+			queries:  []string{"select"},
+			resultsN: 1,
+		},
+		{
+			name: "Pipelined executions are charged in order",
+			run: func(meter *resultMeter) {
+				client(meter, &pgproto3.Execute{}, query("first"))
+				client(meter, &pgproto3.Execute{}, query("second"))
+				client(meter, &pgproto3.Sync{}, nil)
+				meter.observeUpstream(ctx, row)
+				meter.observeUpstream(ctx, &pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+				meter.observeUpstream(ctx, row)
+				meter.observeUpstream(ctx, row)
+				meter.observeUpstream(ctx, &pgproto3.PortalSuspended{})
+				meter.observeUpstream(ctx, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+			},
+			volumes:  []domain.StatementUsage{{Rows: 1, Bytes: 7}, {Rows: 2, Bytes: 14}},
+			queries:  []string{"first", "second"},
+			resultsN: 2,
+		},
+		{
+			name: "Executions skipped after an error are dropped",
+			run: func(meter *resultMeter) {
+				client(meter, &pgproto3.Execute{}, query("failing"))
+				client(meter, &pgproto3.Execute{}, query("skipped"))
+				client(meter, &pgproto3.Sync{}, nil)
+				client(meter, &pgproto3.Execute{}, query("next"))
+				client(meter, &pgproto3.Sync{}, nil)
+				meter.observeUpstream(ctx, &pgproto3.ErrorResponse{Code: "22012"})
+				meter.observeUpstream(ctx, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+				meter.observeUpstream(ctx, row)
+				meter.observeUpstream(ctx, &pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+				meter.observeUpstream(ctx, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+			},
+			volumes:  []domain.StatementUsage{{Rows: 1, Bytes: 7}},
+			queries:  []string{"next"},
+			resultsN: 1,
+		},
+		{
+			name: "COPY rows come from the command tag",
+			run: func(meter *resultMeter) {
+				client(meter, &pgproto3.Query{}, query("copy out"))
+				meter.observeUpstream(ctx, &pgproto3.CopyOutResponse{})
+				meter.observeUpstream(ctx, &pgproto3.CopyData{Data: []byte("1\tsignup\n")})
+				meter.observeUpstream(ctx, &pgproto3.CopyData{Data: []byte("2\tlogin\n")})
+				meter.observeUpstream(ctx, &pgproto3.CopyDone{})
+				meter.observeUpstream(ctx, &pgproto3.CommandComplete{CommandTag: []byte("COPY 2")})
+				meter.observeUpstream(ctx, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+			},
+			volumes:  []domain.StatementUsage{{Rows: 2, Bytes: 17}},
+			queries:  []string{"copy out"},
+			resultsN: 1,
+		},
+		{
+			name: "A failed COPY is charged the data sent before it failed",
+			run: func(meter *resultMeter) {
+				client(meter, &pgproto3.Query{}, query("copy in"))
+				client(meter, &pgproto3.CopyData{Data: []byte("garbage")}, nil)
+				client(meter, &pgproto3.CopyFail{Message: "aborted"}, nil)
+				meter.observeUpstream(ctx, &pgproto3.ErrorResponse{Code: "57014"})
+				meter.observeUpstream(ctx, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+			},
+			volumes: []domain.StatementUsage{{Bytes: 7}},
+			queries: []string{"copy in"},
+		},
+		{
+			name: "Statements without results are logged but not charged",
+			run: func(meter *resultMeter) {
+				client(meter, &pgproto3.Query{}, query("insert"))
+				meter.observeUpstream(ctx, &pgproto3.CommandComplete{CommandTag: []byte("INSERT 0 1")})
+				meter.observeUpstream(ctx, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+			},
+			resultsN: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := &recordingUsageEngine{}
+			queryLogger := mocks.NewRecordingQueryLogger()
+			meter := newResultMeter(engine, queryLogger, session, testkit.NewFakeClock(time.Now()), false, logger.NewSimpleLogger())
+
+			tt.run(meter)
+
+			assert.Equal(t, tt.volumes, engine.usage)
+			assert.Equal(t, tt.queries, engine.queries)
+			assert.Len(t, queryLogger.ProtocolMessages(), tt.resultsN)
+			meter.mu.Lock()
+			assert.Empty(t, meter.pending, "Every pending result should be answered")
+			meter.mu.Unlock()
+		})
+	}
+}
+
+func TestResultMeter_Standalone(t *testing.T) {
+	ctx := context.Background()
+	engine := &recordingUsageEngine{}
+	session := &domain.Session{ConnectionID: "conn_1", User: "alice"}
+	meter := newResultMeter(engine, mocks.NewRecordingQueryLogger(), session, SystemClock{}, true, logger.NewSimpleLogger())
+
+	meter.observeClient(ctx, &ParsedMessage{Message: &pgproto3.Query{}}, sessionQuery("copy in", session))
+	meter.observeClient(ctx, &ParsedMessage{Message: &pgproto3.CopyData{Data: []byte("1\n2\n")}}, nil)
+	meter.observeClient(ctx, &ParsedMessage{Message: &pgproto3.CopyDone{}}, nil)
+
+	assert.Equal(t, []domain.StatementUsage{{Bytes: 4}}, engine.usage)
+	assert.Equal(t, []string{"copy in"}, engine.queries)
+	require.Empty(t, meter.pending, "Nothing is awaited without an upstream")
+}
+
+func TestResultMeter_Duration(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	engine := &recordingUsageEngine{}
+	session := &domain.Session{ConnectionID: "conn_1", User: "alice"}
+	meter := newResultMeter(engine, mocks.NewRecordingQueryLogger(), session, clock, false, logger.NewSimpleLogger())
+
+	first := sessionQuery("first", session)
+	second := sessionQuery("second", session)
+	meter.observeClient(ctx, &ParsedMessage{Message: &pgproto3.Execute{}}, first)
+	meter.observeClient(ctx, &ParsedMessage{Message: &pgproto3.Execute{}}, second)
+	meter.observeClient(ctx, &ParsedMessage{Message: &pgproto3.Sync{}}, nil)
+
+	clock.Advance(300 * time.Millisecond)
+	meter.observeUpstream(ctx, &pgproto3.CommandComplete{CommandTag: []byte("UPDATE 1")})
+	clock.Advance(200 * time.Millisecond)
+	meter.observeUpstream(ctx, &pgproto3.CommandComplete{CommandTag: []byte("UPDATE 1")})
+	meter.observeUpstream(ctx, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+
+	assert.Equal(t, 300*time.Millisecond, first.Duration)
+	assert.Equal(t, 200*time.Millisecond, second.Duration, "Pipelined statements are timed from the completion of the previous one")
+	assert.Equal(t, []domain.StatementUsage{{Duration: 300 * time.Millisecond}, {Duration: 200 * time.Millisecond, Queued: 300 * time.Millisecond}}, engine.usage)
+
+	// Statements of a simple query are timed one after the other
+	clock.Advance(time.Second)
+	script := sessionQuery("UPDATE a; UPDATE b", session)
+	meter.observeClient(ctx, &ParsedMessage{Message: &pgproto3.Query{}}, script)
+	clock.Advance(50 * time.Millisecond)
+	meter.observeUpstream(ctx, &pgproto3.CommandComplete{CommandTag: []byte("UPDATE 1")})
+	clock.Advance(70 * time.Millisecond)
+	meter.observeUpstream(ctx, &pgproto3.CommandComplete{CommandTag: []byte("UPDATE 1")})
+	meter.observeUpstream(ctx, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+
+	assert.Equal(t, 70*time.Millisecond, script.Duration)
+	assert.Equal(t, 50*time.Millisecond, engine.usage[2].Duration)
+}
+
+func TestResultMeter_Statements(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	engine := &recordingUsageEngine{}
+	session := &domain.Session{ConnectionID: "conn_1", User: "alice"}
+	queryLogger := &decisionRecordingLogger{RecordingQueryLogger: mocks.NewRecordingQueryLogger()}
+	meter := newResultMeter(engine, queryLogger, session, clock, false, logger.NewSimpleLogger())
+
+	update := sessionQuery("UPDATE a SET x = 1", session)
+	selected := sessionQuery("SELECT * FROM a", session)
+	meter.observeClient(ctx, &ParsedMessage{Message: &pgproto3.Query{}}, update, selected)
+	clock.Advance(50 * time.Millisecond)
+	meter.observeUpstream(ctx, &pgproto3.CommandComplete{CommandTag: []byte("UPDATE 3")})
+	clock.Advance(70 * time.Millisecond)
+	meter.observeUpstream(ctx, &pgproto3.DataRow{Values: [][]byte{[]byte("1")}})
+	meter.observeUpstream(ctx, &pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+	meter.observeUpstream(ctx, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+
+	assert.Equal(t, []string{"UPDATE a SET x = 1", "SELECT * FROM a"}, engine.queries, "Each statement should be charged on its own")
+	assert.Equal(t, []domain.StatementUsage{{Duration: 50 * time.Millisecond}, {Rows: 1, Bytes: 1, Duration: 70 * time.Millisecond}}, engine.usage)
+	assert.Equal(t, 50*time.Millisecond, update.Duration)
+	assert.Equal(t, 70*time.Millisecond, selected.Duration)
+	assert.Equal(t, []string{"UPDATE a SET x = 1", "SELECT * FROM a"}, queryLogger.queries)
+
+	// After an error the statements left are skipped and never charged
+	first := sessionQuery("SELECT 1/0", session)
+	meter.observeClient(ctx, &ParsedMessage{Message: &pgproto3.Query{}}, first, sessionQuery("SELECT 2", session))
+	clock.Advance(10 * time.Millisecond)
+	meter.observeUpstream(ctx, &pgproto3.ErrorResponse{Code: "22012"})
+	meter.observeUpstream(ctx, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+	assert.Equal(t, []string{"UPDATE a SET x = 1", "SELECT * FROM a", "SELECT 1/0"}, engine.queries)
+	assert.Empty(t, meter.pending)
+}
+
+func TestResultMeter_LogsDecisions(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	session := &domain.Session{ConnectionID: "conn_1", User: "alice"}
+	queryLogger := &decisionRecordingLogger{RecordingQueryLogger: mocks.NewRecordingQueryLogger()}
+	meter := newResultMeter(&recordingUsageEngine{}, queryLogger, session, clock, false, logger.NewSimpleLogger())
+
+	meter.observeClient(ctx, &ParsedMessage{Message: &pgproto3.Parse{}}, sessionQuery("prepare", session))
+	meter.observeClient(ctx, &ParsedMessage{Message: &pgproto3.Execute{}}, sessionQuery("execute", session))
+	meter.observeClient(ctx, &ParsedMessage{Message: &pgproto3.Execute{}}, nil)
+	meter.observeClient(ctx, &ParsedMessage{Message: &pgproto3.Sync{}}, nil)
+	require.Equal(t, []string{"prepare"}, queryLogger.queries, "A Parse is logged as soon as it is allowed")
+
+	clock.Advance(10 * time.Millisecond)
+	meter.observeUpstream(ctx, &pgproto3.DataRow{Values: [][]byte{[]byte("1")}})
+	meter.observeUpstream(ctx, &pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+	meter.observeUpstream(ctx, &pgproto3.CommandComplete{CommandTag: []byte("SELECT 0")})
+	meter.observeUpstream(ctx, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+
+	assert.Equal(t, []string{"prepare", "execute"}, queryLogger.queries, "Unattributed executions are not logged")
+	assert.Equal(t, domain.StatementUsage{Rows: 1, Bytes: 1, Duration: 10 * time.Millisecond}, queryLogger.usage[1])
+
+	// Without an upstream queries are logged once allowed
+	standalone := newResultMeter(&recordingUsageEngine{}, queryLogger, session, clock, true, logger.NewSimpleLogger())
+	standalone.observeClient(ctx, &ParsedMessage{Message: &pgproto3.Query{}}, sessionQuery("select", session))
+	assert.Equal(t, []string{"prepare", "execute", "select"}, queryLogger.queries)
+}
+
+// decisionRecordingLogger records the queries and usage of the decisions it is told
+type decisionRecordingLogger struct {
+	*mocks.RecordingQueryLogger
+	queries []string
+	usage   []domain.StatementUsage
+}
+
+func (l *decisionRecordingLogger) LogDecision(query *domain.Query, decision domain.Decision, usage domain.StatementUsage) error {
+	l.queries = append(l.queries, query.Raw)
+	l.usage = append(l.usage, usage)
+	return nil
+}
+
+// recordingUsageEngine allows every query and keeps the volumes recorded with their query
+type recordingUsageEngine struct {
+	mocks.StaticPolicyEngine
+	usage   []domain.StatementUsage
+	queries []string
+}
+
+func (e *recordingUsageEngine) RecordUsage(ctx context.Context, query *domain.Query, usage domain.StatementUsage) error {
+	e.usage = append(e.usage, usage)
+	e.queries = append(e.queries, query.Raw)
+	return nil
+}
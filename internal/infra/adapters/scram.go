@@ -0,0 +1,286 @@
+package adapters
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// scramMechanism is the only SASL mechanism offered and used; channel binding is not supported
+	scramMechanism = "SCRAM-SHA-256"
+
+	// scramIterations is the PBKDF2 iteration count of verifiers derived from plaintext passwords
+	scramIterations = 4096
+
+	// scramNonceLength is the number of random bytes in a nonce before encoding
+	scramNonceLength = 18
+)
+
+// errAuthenticationFailed reports a wrong password or a malformed authentication exchange
+var errAuthenticationFailed = errors.New("authentication failed")
+
+// scramVerifier is what a server stores to check SCRAM-SHA-256 proofs without
+// knowing the password, as in PostgreSQL's pg_authid:
+//
+//	SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+type scramVerifier struct {
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+// parseSCRAMVerifier decodes a verifier in PostgreSQL's text format
+func parseSCRAMVerifier(text string) (*scramVerifier, error) {
+	rest, ok := strings.CutPrefix(text, scramMechanism+"$")
+	if !ok {
+		return nil, fmt.Errorf("SCRAM verifier must start with %s$", scramMechanism)
+	}
+	params, keys, ok := strings.Cut(rest, "$")
+	if !ok {
+		return nil, fmt.Errorf("malformed SCRAM verifier")
+	}
+	iterations, salt, ok := strings.Cut(params, ":")
+	if !ok {
+		return nil, fmt.Errorf("malformed SCRAM verifier parameters")
+	}
+	storedKey, serverKey, ok := strings.Cut(keys, ":")
+	if !ok {
+		return nil, fmt.Errorf("malformed SCRAM verifier keys")
+	}
+
+	verifier := &scramVerifier{}
+	var err error
+	if verifier.iterations, err = strconv.Atoi(iterations); err != nil || verifier.iterations <= 0 {
+		return nil, fmt.Errorf("invalid SCRAM iteration count %q", iterations)
+	}
+	for _, field := range []struct {
+		dst   *[]byte
+		value string
+	}{{&verifier.salt, salt}, {&verifier.storedKey, storedKey}, {&verifier.serverKey, serverKey}} {
+		if *field.dst, err = base64.StdEncoding.DecodeString(field.value); err != nil {
+			return nil, fmt.Errorf("invalid SCRAM verifier encoding: %w", err)
+		}
+	}
+	if len(verifier.storedKey) != sha256.Size || len(verifier.serverKey) != sha256.Size {
+		return nil, fmt.Errorf("SCRAM verifier keys must be %d bytes", sha256.Size)
+	}
+	return verifier, nil
+}
+
+// newSCRAMVerifier derives a verifier from a plaintext password with a random salt
+func newSCRAMVerifier(password string) (*scramVerifier, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	clientKey, serverKey := scramKeys(password, salt, scramIterations)
+	storedKey := sha256.Sum256(clientKey)
+	return &scramVerifier{
+		iterations: scramIterations,
+		salt:       salt,
+		storedKey:  storedKey[:],
+		serverKey:  serverKey,
+	}, nil
+}
+
+// scramKeys derives the ClientKey and ServerKey of a password. Passwords are used
+// as is: SASLprep normalization only changes passwords with unusual Unicode.
+func scramKeys(password string, salt []byte, iterations int) ([]byte, []byte) {
+	salted := scramHi([]byte(password), salt, iterations)
+	return scramHMAC(salted, []byte("Client Key")), scramHMAC(salted, []byte("Server Key"))
+}
+
+// scramHi is PBKDF2 with HMAC-SHA-256 producing a single block (RFC 5802 Hi)
+func scramHi(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := bytes.Clone(u)
+
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+// scramHMAC computes HMAC-SHA-256 of data
+func scramHMAC(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// scramNonce returns a random printable nonce
+func scramNonce() (string, error) {
+	nonce := make([]byte, scramNonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return base64.RawStdEncoding.EncodeToString(nonce), nil
+}
+
+// scramAttributes splits a SCRAM message into its attributes, keyed by their letter
+func scramAttributes(message string) map[byte]string {
+	attributes := make(map[byte]string)
+	for _, field := range strings.Split(message, ",") {
+		if len(field) >= 2 && field[1] == '=' {
+			attributes[field[0]] = field[2:]
+		}
+	}
+	return attributes
+}
+
+// scramServer checks a client's SCRAM-SHA-256 proof against a verifier
+type scramServer struct {
+	verifier        *scramVerifier
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+}
+
+// newSCRAMServer starts a server exchange for verifier
+func newSCRAMServer(verifier *scramVerifier) *scramServer {
+	return &scramServer{verifier: verifier}
+}
+
+// First answers the client-first-message with the salt, iteration count and the
+// combined nonce. The user name in the message is ignored, as PostgreSQL does,
+// since the StartupMessage already named the role.
+func (s *scramServer) First(clientFirst []byte) (string, error) {
+	message := string(clientFirst)
+	// The GS2 header: no channel binding ("n") or none supported by the server ("y")
+	switch {
+	case strings.HasPrefix(message, "n,,"), strings.HasPrefix(message, "y,,"):
+		s.clientFirstBare = message[3:]
+	default:
+		return "", fmt.Errorf("%w: unsupported SCRAM channel binding", errAuthenticationFailed)
+	}
+
+	clientNonce := scramAttributes(s.clientFirstBare)['r']
+	if clientNonce == "" {
+		return "", fmt.Errorf("%w: missing SCRAM client nonce", errAuthenticationFailed)
+	}
+	serverNonce, err := scramNonce()
+	if err != nil {
+		return "", err
+	}
+
+	s.nonce = clientNonce + serverNonce
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", s.nonce,
+		base64.StdEncoding.EncodeToString(s.verifier.salt), s.verifier.iterations)
+	return s.serverFirst, nil
+}
+
+// Final checks the proof of the client-final-message and returns the server
+// signature proving the server knew the verifier too
+func (s *scramServer) Final(clientFinal []byte) (string, error) {
+	message := string(clientFinal)
+	withoutProof, proofAttribute, ok := strings.Cut(message, ",p=")
+	if !ok {
+		return "", fmt.Errorf("%w: missing SCRAM proof", errAuthenticationFailed)
+	}
+	attributes := scramAttributes(withoutProof)
+	if attributes['r'] != s.nonce {
+		return "", fmt.Errorf("%w: SCRAM nonce mismatch", errAuthenticationFailed)
+	}
+	if binding := attributes['c']; binding != "biws" && binding != "eSws" {
+		return "", fmt.Errorf("%w: unexpected SCRAM channel binding", errAuthenticationFailed)
+	}
+	proof, err := base64.StdEncoding.DecodeString(proofAttribute)
+	if err != nil || len(proof) != sha256.Size {
+		return "", fmt.Errorf("%w: malformed SCRAM proof", errAuthenticationFailed)
+	}
+
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+	clientSignature := scramHMAC(s.verifier.storedKey, authMessage)
+	clientKey := make([]byte, sha256.Size)
+	for i := range clientKey {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], s.verifier.storedKey) != 1 {
+		return "", errAuthenticationFailed
+	}
+
+	serverSignature := scramHMAC(s.verifier.serverKey, authMessage)
+	return "v=" + base64.StdEncoding.EncodeToString(serverSignature), nil
+}
+
+// scramClient proves knowledge of a password to a SCRAM-SHA-256 server
+type scramClient struct {
+	password        string
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// newSCRAMClient starts a client exchange with a random nonce
+func newSCRAMClient(password string) (*scramClient, error) {
+	nonce, err := scramNonce()
+	if err != nil {
+		return nil, err
+	}
+	return &scramClient{password: password, clientNonce: nonce}, nil
+}
+
+// First returns the client-first-message. The user name is left empty as libpq
+// does; the server takes it from the StartupMessage.
+func (c *scramClient) First() []byte {
+	c.clientFirstBare = "n=,r=" + c.clientNonce
+	return []byte("n,," + c.clientFirstBare)
+}
+
+// Final answers the server-first-message with the client proof
+func (c *scramClient) Final(serverFirst []byte) ([]byte, error) {
+	attributes := scramAttributes(string(serverFirst))
+	nonce := attributes['r']
+	if !strings.HasPrefix(nonce, c.clientNonce) || len(nonce) == len(c.clientNonce) {
+		return nil, fmt.Errorf("invalid SCRAM server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attributes['s'])
+	if err != nil {
+		return nil, fmt.Errorf("invalid SCRAM salt: %w", err)
+	}
+	iterations, err := strconv.Atoi(attributes['i'])
+	if err != nil || iterations <= 0 {
+		return nil, fmt.Errorf("invalid SCRAM iteration count %q", attributes['i'])
+	}
+
+	clientKey, serverKey := scramKeys(c.password, salt, iterations)
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := []byte(c.clientFirstBare + "," + string(serverFirst) + "," + withoutProof)
+
+	clientSignature := scramHMAC(storedKey[:], authMessage)
+	proof := make([]byte, sha256.Size)
+	for i := range proof {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	c.serverSignature = scramHMAC(serverKey, authMessage)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// Verify checks the server signature of the server-final-message
+func (c *scramClient) Verify(serverFinal []byte) error {
+	signature, err := base64.StdEncoding.DecodeString(scramAttributes(string(serverFinal))['v'])
+	if err != nil || !hmac.Equal(signature, c.serverSignature) {
+		return fmt.Errorf("invalid SCRAM server signature")
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package adapters
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSCRAMClient_RFC7677(t *testing.T) {
+	// Test vector of RFC 7677 section 3
+	client := &scramClient{password: "pencil", clientNonce: "rOprNGfwEbeRWgbNEkqO"}
+	client.First()
+	client.clientFirstBare = "n=user,r=rOprNGfwEbeRWgbNEkqO"
+
+	final, err := client.Final([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	require.NoError(t, err)
+	assert.Equal(t, "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", string(final))
+
+	assert.NoError(t, client.Verify([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")))
+	assert.Error(t, client.Verify([]byte("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")))
+}
+
+func TestSCRAMExchange(t *testing.T) {
+	verifier, err := newSCRAMVerifier("secret")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{name: "right password", password: "secret"},
+		{name: "wrong password", password: "guess", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := newSCRAMClient(tt.password)
+			require.NoError(t, err)
+			server := newSCRAMServer(verifier)
+
+			serverFirst, err := server.First(client.First())
+			require.NoError(t, err)
+			clientFinal, err := client.Final([]byte(serverFirst))
+			require.NoError(t, err)
+
+			serverFinal, err := server.Final(clientFinal)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, errAuthenticationFailed)
+				return
+			}
+			require.NoError(t, err)
+			assert.NoError(t, client.Verify([]byte(serverFinal)))
+		})
+	}
+}
+
+func TestSCRAMServer_RejectsChannelBinding(t *testing.T) {
+	verifier, err := newSCRAMVerifier("secret")
+	require.NoError(t, err)
+
+	_, err = newSCRAMServer(verifier).First([]byte("p=tls-server-end-point,,n=,r=abc"))
+	assert.ErrorIs(t, err, errAuthenticationFailed)
+}
+
+func TestParseSCRAMVerifier(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	clientKey, serverKey := scramKeys("secret", salt, 4096)
+	storedKey := sha256.Sum256(clientKey)
+	text := "SCRAM-SHA-256$4096:" + base64.StdEncoding.EncodeToString(salt) + "$" +
+		base64.StdEncoding.EncodeToString(storedKey[:]) + ":" + base64.StdEncoding.EncodeToString(serverKey)
+
+	verifier, err := parseSCRAMVerifier(text)
+	require.NoError(t, err)
+	assert.Equal(t, 4096, verifier.iterations)
+	assert.Equal(t, salt, verifier.salt)
+	assert.Equal(t, storedKey[:], verifier.storedKey)
+
+	for _, invalid := range []string{
+		"SCRAM-SHA-1$4096:c2FsdA==$a:b",
+		"SCRAM-SHA-256$4096:c2FsdA==",
+		"SCRAM-SHA-256$zero:c2FsdA==$a:b",
+		"SCRAM-SHA-256$4096:c2FsdA==$c2hvcnQ=:c2hvcnQ=",
+	} {
+		_, err := parseSCRAMVerifier(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
@@ -0,0 +1,306 @@
+package adapters
+
+import (
+	"fmt"
+	"maps"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgproto3"
+	pg_query "github.com/pganalyze/pg_query_go/v6"
+)
+
+// sessionStatementPattern finds the queries that may change session
+// parameters, so that other queries are not parsed again
+var sessionStatementPattern = regexp.MustCompile(`(?i)(^|;)\s*(set|reset|discard)\s`)
+
+// sessionChange is what a SET, RESET or DISCARD ALL statement does to the
+// run-time parameters of a session
+type sessionChange struct {
+	name   string // lower-case parameter name; empty for RESET ALL and DISCARD ALL
+	value  string // as written in the statement; empty to reset the parameter
+	ignore bool   // SET LOCAL and SET TRANSACTION, which last until the transaction ends
+}
+
+// sessionTracker follows the state of a proxied session: the transaction
+// status of the ReadyForQuery messages relayed to the client, and the
+// parameters its SET, RESET and DISCARD ALL statements changed. A change
+// counts once the upstream completes the statement, and only lasts if its
+// transaction commits; changes made with set_config are not seen. Client
+// messages are observed by the handler goroutine and upstream messages by
+// the relay goroutine.
+type sessionTracker struct {
+	report     func(domain.SessionState) // nil when no one follows the state
+	standalone bool                      // without an upstream nothing is tracked
+
+	mu         sync.Mutex
+	state      domain.SessionState
+	queue      []*sessionChange // changes forwarded upstream, in order; nil ends a Query or Sync
+	staged     []sessionChange  // completed in the current transaction
+	failed     bool             // a statement of the current exchange failed
+	rolledBack bool             // the current exchange rolled a transaction back
+	waking     bool             // the handler waits to be woken once the client is idle
+}
+
+// newSessionTracker creates the tracker of a session; report, when set, is
+// called with the new state whenever it changes
+func newSessionTracker(standalone bool, report func(domain.SessionState)) *sessionTracker {
+	return &sessionTracker{
+		report:     report,
+		standalone: standalone,
+		state:      domain.SessionState{Transaction: domain.TransactionIdle},
+	}
+}
+
+// observeClient queues the changes of a message the client sent once it was
+// allowed, along with the query it was evaluated as, if any
+func (t *sessionTracker) observeClient(message *ParsedMessage, query *domain.Query) {
+	if t.standalone {
+		return
+	}
+	var changes []*sessionChange
+	switch message.Message.(type) {
+	case *pgproto3.Query:
+		changes = append(parseSessionChanges(message.Query), nil)
+	case *pgproto3.Execute:
+		if query == nil {
+			return
+		}
+		changes = parseSessionChanges(query.Raw)
+	case *pgproto3.Sync:
+		changes = []*sessionChange{nil}
+	default:
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.queue = append(t.queue, changes...)
+}
+
+// observeUpstream follows a message relayed from the upstream. Statements
+// complete in the order they were sent; after an error the upstream skips
+// the rest of the Query, or the messages up to the client's Sync.
+func (t *sessionTracker) observeUpstream(msg pgproto3.BackendMessage) {
+	var changed *domain.SessionState
+	t.mu.Lock()
+	switch msg := msg.(type) {
+	case *pgproto3.CommandComplete:
+		switch string(msg.CommandTag) {
+		case "SET", "RESET", "DISCARD ALL":
+			if len(t.queue) > 0 && t.queue[0] != nil {
+				if change := t.queue[0]; !change.ignore {
+					t.staged = append(t.staged, *change)
+				}
+				t.queue = t.queue[1:]
+			}
+		case "ROLLBACK":
+			t.rolledBack = true
+		}
+	case *pgproto3.ErrorResponse:
+		t.failed = true
+		for len(t.queue) > 0 && t.queue[0] != nil {
+			t.queue = t.queue[1:]
+		}
+	case *pgproto3.ReadyForQuery:
+		changed = t.ready(domain.TransactionStatus(msg.TxStatus))
+	}
+	t.mu.Unlock()
+
+	if changed != nil && t.report != nil {
+		t.report(*changed)
+	}
+}
+
+// ready ends an exchange: what the client sent up to the Query or Sync the
+// ReadyForQuery answers is done. Outside a transaction the staged changes are
+// applied, unless they were rolled back. The new state is returned when it
+// changed. The caller holds the lock.
+func (t *sessionTracker) ready(status domain.TransactionStatus) *domain.SessionState {
+	for len(t.queue) > 0 {
+		end := t.queue[0] == nil
+		t.queue = t.queue[1:]
+		if end {
+			break
+		}
+	}
+
+	changed := status != t.state.Transaction
+	t.state.Transaction = status
+	if status == domain.TransactionIdle {
+		if !t.failed && !t.rolledBack && len(t.staged) > 0 {
+			t.state.Parameters = applySessionChanges(t.state.Parameters, t.staged)
+			changed = true
+		}
+		t.staged = nil
+	}
+	t.failed = false
+	t.rolledBack = false
+
+	if !changed {
+		return nil
+	}
+	state := t.snapshot()
+	return &state
+}
+
+// snapshot copies the state. The caller holds the lock.
+func (t *sessionTracker) snapshot() domain.SessionState {
+	return domain.SessionState{Transaction: t.state.Transaction, Parameters: maps.Clone(t.state.Parameters)}
+}
+
+// current returns the state of the session
+func (t *sessionTracker) current() domain.SessionState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.snapshot()
+}
+
+// idle reports whether the handler may mark the connection idle: the client
+// is outside a transaction and awaits nothing from the upstream. When it may
+// not, the relay wakes the handler once the client is idle; the request is
+// made before checking, so that the relay cannot miss it.
+func (t *sessionTracker) idle(writer *PostgreSQLResponseWriter) bool {
+	t.mu.Lock()
+	t.waking = true
+	t.mu.Unlock()
+	if !writer.Idle() {
+		return false
+	}
+
+	t.mu.Lock()
+	t.waking = false
+	t.mu.Unlock()
+	return true
+}
+
+// answered reports whether the upstream answered everything the client sent,
+// inside a transaction or not, along with the client's transaction status.
+// When it did not, the relay wakes the handler once it has, as with idle.
+func (t *sessionTracker) answered(writer *PostgreSQLResponseWriter) (bool, domain.TransactionStatus) {
+	t.mu.Lock()
+	t.waking = true
+	t.mu.Unlock()
+	answered, status := writer.Answered()
+	if !answered {
+		return false, status
+	}
+
+	t.mu.Lock()
+	t.waking = false
+	t.mu.Unlock()
+	return true, status
+}
+
+// wake reports, once, whether the handler waits to be woken since the upstream
+// answered the client
+func (t *sessionTracker) wake() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	waking := t.waking
+	t.waking = false
+	return waking
+}
+
+// applySessionChanges returns the parameters once changes are applied, nil
+// when none remain
+func applySessionChanges(parameters map[string]string, changes []sessionChange) map[string]string {
+	parameters = maps.Clone(parameters)
+	for _, change := range changes {
+		switch {
+		case change.name == "":
+			parameters = nil
+		case change.value == "":
+			delete(parameters, change.name)
+		default:
+			if parameters == nil {
+				parameters = make(map[string]string)
+			}
+			parameters[change.name] = change.value
+		}
+	}
+	if len(parameters) == 0 {
+		return nil
+	}
+	return parameters
+}
+
+// parseSessionChanges returns the changes of the SET, RESET and DISCARD ALL
+// statements of a query, in order. Queries the parser rejects change nothing,
+// since PostgreSQL rejects them as well.
+func parseSessionChanges(query string) []*sessionChange {
+	if !sessionStatementPattern.MatchString(query) {
+		return nil
+	}
+	tree, err := pgQueryParse(query)
+	if err != nil {
+		return nil
+	}
+
+	var changes []*sessionChange
+	for _, raw := range tree.Stmts {
+		switch {
+		case raw.Stmt.GetVariableSetStmt() != nil:
+			changes = append(changes, variableSetChange(query, raw, raw.Stmt.GetVariableSetStmt()))
+		case raw.Stmt.GetDiscardStmt().GetTarget() == pg_query.DiscardMode_DISCARD_ALL:
+			changes = append(changes, &sessionChange{})
+		}
+	}
+	return changes
+}
+
+// variableSetChange returns the change of a SET or RESET statement. Values are
+// kept as written, from the first argument to the end of the statement.
+func variableSetChange(query string, raw *pg_query.RawStmt, stmt *pg_query.VariableSetStmt) *sessionChange {
+	switch stmt.Kind {
+	case pg_query.VariableSetKind_VAR_SET_VALUE:
+		if stmt.IsLocal || len(stmt.Args) == 0 {
+			break
+		}
+		start := int(nodeLocation(stmt.Args[0]))
+		end := len(query)
+		if raw.StmtLen > 0 {
+			end = int(raw.StmtLocation + raw.StmtLen)
+		}
+		if start < 0 || start >= end || end > len(query) {
+			break
+		}
+		value := strings.TrimRight(query[start:end], " \t\r\n;")
+		return &sessionChange{name: stmt.Name, value: value}
+	case pg_query.VariableSetKind_VAR_SET_DEFAULT, pg_query.VariableSetKind_VAR_RESET:
+		if stmt.IsLocal {
+			break
+		}
+		return &sessionChange{name: stmt.Name}
+	case pg_query.VariableSetKind_VAR_RESET_ALL:
+		return &sessionChange{}
+	}
+	return &sessionChange{ignore: true}
+}
+
+// nodeLocation returns where a SET argument starts in the query, or -1
+func nodeLocation(node *pg_query.Node) int32 {
+	switch {
+	case node.GetAConst() != nil:
+		return node.GetAConst().Location
+	case node.GetTypeCast() != nil:
+		return node.GetTypeCast().Location
+	default:
+		return -1
+	}
+}
+
+// restoreSessionQuery returns the query setting parameters again on another
+// upstream connection
+func restoreSessionQuery(parameters map[string]string) string {
+	statements := make([]string, 0, len(parameters))
+	for _, name := range slices.Sorted(maps.Keys(parameters)) {
+		identifier := pgx.Identifier(strings.Split(name, ".")).Sanitize()
+		statements = append(statements, fmt.Sprintf("SET %s TO %s", identifier, parameters[name]))
+	}
+	return strings.Join(statements, "; ")
+}
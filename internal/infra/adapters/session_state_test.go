@@ -0,0 +1,107 @@
+package adapters
+
+import (
+	"testing"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSessionChanges(t *testing.T) {
+	tests := []struct {
+		query   string
+		changes []*sessionChange
+	}{
+		{query: "SELECT 1"},
+		{query: "UPDATE accounts SET balance = 0"},
+		{query: "SET search_path TO billing, public", changes: []*sessionChange{{name: "search_path", value: "billing, public"}}},
+		{query: "set statement_timeout = '5s';", changes: []*sessionChange{{name: "statement_timeout", value: "'5s'"}}},
+		{query: "SET TIME ZONE 'UTC'; SELECT 1; RESET work_mem", changes: []*sessionChange{{name: "timezone", value: "'UTC'"}, {name: "work_mem"}}},
+		{query: "SET application_name TO DEFAULT", changes: []*sessionChange{{name: "application_name"}}},
+		{query: "SET LOCAL lock_timeout = 100", changes: []*sessionChange{{ignore: true}}},
+		{query: "SET TRANSACTION ISOLATION LEVEL SERIALIZABLE", changes: []*sessionChange{{ignore: true}}},
+		{query: "RESET ALL", changes: []*sessionChange{{}}},
+		{query: "DISCARD ALL", changes: []*sessionChange{{}}},
+		{query: "DISCARD PLANS"},
+		{query: "SET search_path TO", changes: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			assert.Equal(t, tt.changes, parseSessionChanges(tt.query))
+		})
+	}
+}
+
+func TestSessionTracker(t *testing.T) {
+	var reports []domain.SessionState
+	tracker := newSessionTracker(false, func(state domain.SessionState) { reports = append(reports, state) })
+	query := func(sql string, tags ...string) {
+		tracker.observeClient(&ParsedMessage{Message: &pgproto3.Query{String: sql}, Query: sql}, nil)
+		for _, tag := range tags {
+			if tag == "ERROR" {
+				tracker.observeUpstream(&pgproto3.ErrorResponse{})
+				continue
+			}
+			tracker.observeUpstream(&pgproto3.CommandComplete{CommandTag: []byte(tag)})
+		}
+	}
+	ready := func(status byte) {
+		tracker.observeUpstream(&pgproto3.ReadyForQuery{TxStatus: status})
+	}
+
+	query("SET search_path TO billing", "SET")
+	ready('I')
+	assert.Equal(t, domain.SessionState{Transaction: domain.TransactionIdle, Parameters: map[string]string{"search_path": "billing"}}, tracker.current())
+	require.Len(t, reports, 1)
+
+	// Changes last once their transaction commits
+	query("BEGIN", "BEGIN")
+	ready('T')
+	query("SET work_mem TO '64MB'", "SET")
+	ready('T')
+	assert.True(t, tracker.current().InTransaction())
+	assert.NotContains(t, tracker.current().Parameters, "work_mem")
+	query("COMMIT", "COMMIT")
+	ready('I')
+	assert.Equal(t, "'64MB'", tracker.current().Parameters["work_mem"])
+
+	// and are forgotten when it is rolled back, even by a failed COMMIT
+	query("BEGIN", "BEGIN")
+	ready('T')
+	query("RESET ALL", "RESET")
+	ready('T')
+	query("SELECT 1/0", "ERROR")
+	ready('E')
+	assert.Equal(t, domain.TransactionFailed, tracker.current().Transaction)
+	query("COMMIT", "ROLLBACK")
+	ready('I')
+	assert.Len(t, tracker.current().Parameters, 2)
+
+	// A failed statement rolls back the implicit transaction of its exchange
+	tracker.observeClient(&ParsedMessage{Message: &pgproto3.Execute{}}, &domain.Query{Raw: "RESET search_path"})
+	tracker.observeClient(&ParsedMessage{Message: &pgproto3.Execute{}}, &domain.Query{Raw: "SET work_mem TO 'lots'"})
+	tracker.observeClient(&ParsedMessage{Message: &pgproto3.Sync{}}, nil)
+	tracker.observeUpstream(&pgproto3.CommandComplete{CommandTag: []byte("RESET")})
+	tracker.observeUpstream(&pgproto3.ErrorResponse{})
+	ready('I')
+	assert.Equal(t, map[string]string{"search_path": "billing", "work_mem": "'64MB'"}, tracker.current().Parameters)
+
+	query("SET LOCAL work_mem TO '1MB'; RESET search_path", "SET", "RESET")
+	ready('I')
+	assert.Equal(t, map[string]string{"work_mem": "'64MB'"}, tracker.current().Parameters, "SET LOCAL should not last")
+	assert.Equal(t, "", tracker.current().SearchPath())
+
+	query("DISCARD ALL", "DISCARD ALL")
+	ready('I')
+	assert.Nil(t, tracker.current().Parameters)
+	assert.Equal(t, map[string]string{"search_path": "billing"}, reports[0].Parameters, "Reports should not share the parameters")
+}
+
+func TestRestoreSessionQuery(t *testing.T) {
+	assert.Equal(t, `SET "myapp"."tenant" TO 'acme'; SET "search_path" TO billing, public`,
+		restoreSessionQuery(map[string]string{"search_path": "billing, public", "myapp.tenant": "'acme'"}))
+}
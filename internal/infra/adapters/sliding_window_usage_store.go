@@ -0,0 +1,233 @@
+package adapters
+
+import (
+	"context"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sync"
+	"time"
+)
+
+const (
+	// usageStoreShards is the number of independently locked partitions of a
+	// SlidingWindowUsageStore, so connections of different principals rarely contend
+	usageStoreShards = 32
+
+	// DefaultUsageEvictionInterval is how often idle counters are dropped
+	DefaultUsageEvictionInterval = time.Minute
+)
+
+// SlidingWindowUsageStore implements domain.UsageStore with sliding window counters
+// kept in process memory. Each counter keeps the usage of the current and previous
+// fixed buckets of the window length and weighs the previous bucket by the share
+// of it still inside the window, so usage slides out gradually instead of resetting
+// all at once at a window boundary. Counters are spread over lock-sharded maps and
+// those with no usage left in their window are evicted periodically.
+type SlidingWindowUsageStore struct {
+	shards           [usageStoreShards]usageShard
+	clock            domain.Clock
+	evictionInterval time.Duration
+	stop             chan struct{}
+	done             chan struct{}
+	closeOnce        sync.Once
+}
+
+// usageShard is a partition of the counters of a SlidingWindowUsageStore
+type usageShard struct {
+	mu       sync.Mutex
+	counters map[domain.UsageKey]*slidingWindowCounter
+}
+
+// slidingWindowCounter counts usage in the current bucket and the one before it
+type slidingWindowCounter struct {
+	window      time.Duration
+	bucketStart time.Time
+	current     int64
+	previous    int64
+}
+
+// SlidingWindowUsageStoreOption configures optional behavior of a SlidingWindowUsageStore
+type SlidingWindowUsageStoreOption func(*SlidingWindowUsageStore)
+
+// WithSlidingWindowClock sets the clock used to select buckets and schedule evictions
+func WithSlidingWindowClock(clock domain.Clock) SlidingWindowUsageStoreOption {
+	return func(s *SlidingWindowUsageStore) {
+		s.clock = clock
+	}
+}
+
+// WithUsageEvictionInterval sets how often idle counters are dropped; zero disables eviction
+func WithUsageEvictionInterval(interval time.Duration) SlidingWindowUsageStoreOption {
+	return func(s *SlidingWindowUsageStore) {
+		s.evictionInterval = interval
+	}
+}
+
+// NewSlidingWindowUsageStore creates an empty SlidingWindowUsageStore and starts
+// evicting idle counters. Close stops the eviction.
+func NewSlidingWindowUsageStore(opts ...SlidingWindowUsageStoreOption) *SlidingWindowUsageStore {
+	store := &SlidingWindowUsageStore{
+		clock:            SystemClock{},
+		evictionInterval: DefaultUsageEvictionInterval,
+		stop:             make(chan struct{}),
+		done:             make(chan struct{}),
+	}
+	for i := range store.shards {
+		store.shards[i].counters = make(map[domain.UsageKey]*slidingWindowCounter)
+	}
+
+	for _, opt := range opts {
+		opt(store)
+	}
+
+	if store.evictionInterval > 0 {
+		go store.run()
+	} else {
+		close(store.done)
+	}
+	return store
+}
+
+// Increment adds amount to the current bucket and returns the usage of the sliding window
+func (s *SlidingWindowUsageStore) Increment(ctx context.Context, key domain.UsageKey, window time.Duration, amount int64) (domain.Usage, error) {
+	shard := s.shard(key)
+	now := s.clock.Now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	counter, ok := shard.counters[key]
+	if !ok {
+		counter = &slidingWindowCounter{}
+		shard.counters[key] = counter
+	}
+	counter.advance(now, window)
+	counter.current += amount
+	return counter.usage(now), nil
+}
+
+// Get returns the usage of the sliding window ending now
+func (s *SlidingWindowUsageStore) Get(ctx context.Context, key domain.UsageKey, window time.Duration) (domain.Usage, error) {
+	shard := s.shard(key)
+	now := s.clock.Now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	counter, ok := shard.counters[key]
+	if !ok {
+		return domain.Usage{ResetAt: now.Truncate(window).Add(window)}, nil
+	}
+	counter.advance(now, window)
+	return counter.usage(now), nil
+}
+
+// Reset clears the counter
+func (s *SlidingWindowUsageStore) Reset(ctx context.Context, key domain.UsageKey) error {
+	shard := s.shard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	delete(shard.counters, key)
+	return nil
+}
+
+// Evict drops the counters whose window holds no usage anymore
+func (s *SlidingWindowUsageStore) Evict() {
+	now := s.clock.Now()
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.Lock()
+		for key, counter := range shard.counters {
+			if counter.idle(now) {
+				delete(shard.counters, key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// Len returns the number of counters held
+func (s *SlidingWindowUsageStore) Len() int {
+	count := 0
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.Lock()
+		count += len(shard.counters)
+		shard.mu.Unlock()
+	}
+	return count
+}
+
+// Close stops the eviction of idle counters
+func (s *SlidingWindowUsageStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+	})
+	return nil
+}
+
+// run evicts idle counters every eviction interval until the store is closed
+func (s *SlidingWindowUsageStore) run() {
+	defer close(s.done)
+
+	for {
+		timer := s.clock.NewTimer(s.evictionInterval)
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C():
+			s.Evict()
+		}
+	}
+}
+
+// shard returns the partition holding key, chosen by an FNV-1a hash of its fields
+func (s *SlidingWindowUsageStore) shard(key domain.UsageKey) *usageShard {
+	const (
+		offset = 2166136261
+		prime  = 16777619
+	)
+
+	hash := uint32(offset)
+	for _, field := range [...]string{key.Policy, key.User, key.Database, key.Label} {
+		for i := 0; i < len(field); i++ {
+			hash ^= uint32(field[i])
+			hash *= prime
+		}
+		// Separate the fields so ("ab", "c") and ("a", "bc") differ
+		hash ^= '/'
+		hash *= prime
+	}
+	return &s.shards[hash%usageStoreShards]
+}
+
+// advance moves the counter to the bucket containing now. A changed window, as
+// after a policy reload, starts the counter over.
+func (c *slidingWindowCounter) advance(now time.Time, window time.Duration) {
+	start := now.Truncate(window)
+	switch {
+	case c.window != window:
+		c.window, c.bucketStart, c.current, c.previous = window, start, 0, 0
+	case start.Equal(c.bucketStart):
+	case start.Equal(c.bucketStart.Add(window)):
+		c.bucketStart, c.current, c.previous = start, 0, c.current
+	default:
+		c.bucketStart, c.current, c.previous = start, 0, 0
+	}
+}
+
+// usage estimates the usage of the window ending now. ResetAt is the end of the
+// current bucket, when the usage of the previous bucket has fully slid out.
+func (c *slidingWindowCounter) usage(now time.Time) domain.Usage {
+	remaining := c.window - now.Sub(c.bucketStart)
+	used := c.current + int64(float64(c.previous)*float64(remaining)/float64(c.window))
+	return domain.Usage{Used: used, ResetAt: c.bucketStart.Add(c.window)}
+}
+
+// idle reports whether no usage is left in the window ending now
+func (c *slidingWindowCounter) idle(now time.Time) bool {
+	return !now.Before(c.bucketStart.Add(2 * c.window))
+}
@@ -0,0 +1,133 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlidingWindowUsageStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewSlidingWindowUsageStore()
+	defer store.Close()
+	key := domain.UsageKey{Policy: "p", User: "alice", Database: "app"}
+
+	usage, err := store.Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), usage.Used)
+	assert.Zero(t, store.Len(), "Get should not create counters")
+
+	usage, err = store.Increment(ctx, key, time.Hour, 3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), usage.Used)
+	assert.True(t, usage.ResetAt.After(time.Now()))
+
+	other := domain.UsageKey{Policy: "p", User: "bob", Database: "app"}
+	usage, err = store.Increment(ctx, other, time.Hour, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), usage.Used)
+
+	require.NoError(t, store.Reset(ctx, key))
+	usage, err = store.Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), usage.Used)
+}
+
+func TestSlidingWindowUsageStore_Slides(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 30, 0, time.UTC))
+	store := NewSlidingWindowUsageStore(WithSlidingWindowClock(clock), WithUsageEvictionInterval(0))
+	key := domain.UsageKey{Policy: "p", User: "alice", Database: "app"}
+
+	_, err := store.Increment(ctx, key, time.Minute, 60)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		used    int64
+		resetAt time.Time
+	}{
+		{name: "same bucket", advance: 29 * time.Second, used: 60, resetAt: time.Date(2025, 6, 1, 12, 1, 0, 0, time.UTC)},
+		{name: "quarter of the previous bucket elapsed", advance: 16 * time.Second, used: 45, resetAt: time.Date(2025, 6, 1, 12, 2, 0, 0, time.UTC)},
+		{name: "previous bucket almost gone", advance: 44 * time.Second, used: 1, resetAt: time.Date(2025, 6, 1, 12, 2, 0, 0, time.UTC)},
+		{name: "window fully elapsed", advance: time.Second, used: 0, resetAt: time.Date(2025, 6, 1, 12, 3, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock.Advance(tt.advance)
+			usage, err := store.Get(ctx, key, time.Minute)
+			require.NoError(t, err)
+			assert.Equal(t, tt.used, usage.Used)
+			assert.Equal(t, tt.resetAt, usage.ResetAt)
+		})
+	}
+}
+
+func TestSlidingWindowUsageStore_WindowChange(t *testing.T) {
+	ctx := context.Background()
+	store := NewSlidingWindowUsageStore(WithUsageEvictionInterval(0))
+	key := domain.UsageKey{Policy: "p", User: "alice", Database: "app"}
+
+	_, err := store.Increment(ctx, key, time.Minute, 5)
+	require.NoError(t, err)
+
+	usage, err := store.Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), usage.Used, "A new window should start the counter over")
+}
+
+func TestSlidingWindowUsageStore_EvictsIdleCounters(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+	store := NewSlidingWindowUsageStore(WithSlidingWindowClock(clock), WithUsageEvictionInterval(time.Minute))
+	defer store.Close()
+
+	_, err := store.Increment(ctx, domain.UsageKey{Policy: "short", User: "alice"}, time.Minute, 1)
+	require.NoError(t, err)
+	_, err = store.Increment(ctx, domain.UsageKey{Policy: "long", User: "alice"}, time.Hour, 1)
+	require.NoError(t, err)
+
+	require.True(t, clock.WaitForTimers(1, time.Second))
+	clock.Advance(time.Minute)
+	require.True(t, clock.WaitForTimers(1, time.Second))
+	assert.Equal(t, 2, store.Len(), "Counters with usage left in their window should be kept")
+
+	clock.Advance(time.Minute)
+	require.True(t, clock.WaitForTimers(1, time.Second))
+	assert.Equal(t, 1, store.Len(), "The idle per-minute counter should be evicted")
+}
+
+func TestSlidingWindowUsageStore_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	store := NewSlidingWindowUsageStore(WithUsageEvictionInterval(0))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := domain.UsageKey{Policy: "p", User: fmt.Sprintf("user_%d", i%4)}
+			for j := 0; j < 100; j++ {
+				_, err := store.Increment(ctx, key, time.Hour, 1)
+				assert.NoError(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 4; i++ {
+		usage, err := store.Get(ctx, domain.UsageKey{Policy: "p", User: fmt.Sprintf("user_%d", i)}, time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, int64(200), usage.Used)
+	}
+}
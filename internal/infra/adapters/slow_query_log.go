@@ -0,0 +1,282 @@
+package adapters
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sync"
+	"time"
+)
+
+// SlowQueryRecord is a line of the slow query log: an allowed statement that took
+// longer than the threshold, from when it was received until the upstream
+// completed it
+type SlowQueryRecord struct {
+	Time            time.Time        `json:"time"` // when the query was received
+	Instance        string           `json:"instance,omitempty"`
+	ConnectionID    string           `json:"connection_id"`
+	User            string           `json:"user,omitempty"`
+	Database        string           `json:"database,omitempty"`
+	ApplicationName string           `json:"application_name,omitempty"`
+	Kind            domain.QueryKind `json:"kind,omitempty"`
+	QueryHash       string           `json:"query_hash,omitempty"`
+	Normalized      string           `json:"normalized_query,omitempty"` // empty when normalization failed
+	Parameters      []interface{}    `json:"parameters,omitempty"`       // bound to an Execute, when captured
+	DurationMs      float64          `json:"duration_ms"`
+	Wait            SlowQueryWait    `json:"wait"`
+	Rows            int64            `json:"rows"`
+	Bytes           int64            `json:"bytes"`
+	Skipped         int64            `json:"skipped,omitempty"` // slow queries left out since the previous record
+}
+
+// SlowQueryWait breaks the duration of a slow query down
+type SlowQueryWait struct {
+	EvaluationMs float64 `json:"evaluation_ms"` // deciding on it, including rate limit delays
+	QueuedMs     float64 `json:"queued_ms"`     // waiting for the upstream to complete earlier statements
+	ExecutionMs  float64 `json:"execution_ms"`  // until the upstream completed it
+}
+
+// SlowQueryLog implements domain.QueryLogger by writing a record of every allowed
+// query slower than a threshold to a JSON Lines stream before delegating to the
+// next QueryLogger. Records are written through domain.DecisionLogger; the other
+// events are only forwarded, so only normalized text reaches the log. Slow queries
+// can be sampled, and capped per second, to bound the volume of the log. It
+// implements domain.SessionLogger on behalf of the next logger.
+type SlowQueryLog struct {
+	next         domain.QueryLogger
+	threshold    time.Duration
+	clock        domain.Clock
+	instance     string
+	sampleRate   float64
+	maxPerSecond int
+	redact       bool
+	random       func() float64
+
+	mu      sync.Mutex
+	out     io.Writer
+	file    *os.File // nil when writing to standard error
+	second  time.Time
+	written int   // records written within second
+	skipped int64 // slow queries left out since the last record
+}
+
+// SlowQueryLogOption configures optional behavior of a SlowQueryLog
+type SlowQueryLogOption func(*SlowQueryLog)
+
+// WithSlowQuerySampleRate logs each slow query with probability rate, between 0
+// and 1. Queries are logged by default.
+func WithSlowQuerySampleRate(rate float64) SlowQueryLogOption {
+	return func(l *SlowQueryLog) {
+		l.sampleRate = rate
+	}
+}
+
+// WithSlowQueryMaxPerSecond logs at most count slow queries per second; zero
+// logs them all
+func WithSlowQueryMaxPerSecond(count int) SlowQueryLogOption {
+	return func(l *SlowQueryLog) {
+		l.maxPerSecond = count
+	}
+}
+
+// WithSlowQueryParameterRedaction records the type and size of bound parameters
+// instead of their values
+func WithSlowQueryParameterRedaction() SlowQueryLogOption {
+	return func(l *SlowQueryLog) {
+		l.redact = true
+	}
+}
+
+// WithSlowQueryInstance records the enforcer instance ID in every record
+func WithSlowQueryInstance(instanceID string) SlowQueryLogOption {
+	return func(l *SlowQueryLog) {
+		l.instance = instanceID
+	}
+}
+
+// WithSlowQueryClock sets the clock that caps records per second
+func WithSlowQueryClock(clock domain.Clock) SlowQueryLogOption {
+	return func(l *SlowQueryLog) {
+		l.clock = clock
+	}
+}
+
+// NewSlowQueryLog opens the slow query log at path for appending, creating it if
+// needed, or writes to standard error when path is "-". Queries taking longer
+// than threshold are logged. The next logger may be nil.
+func NewSlowQueryLog(path string, threshold time.Duration, next domain.QueryLogger, opts ...SlowQueryLogOption) (*SlowQueryLog, error) {
+	l := &SlowQueryLog{
+		next:       next,
+		threshold:  threshold,
+		clock:      SystemClock{},
+		sampleRate: 1,
+		random:     rand.Float64,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.threshold < 0 || l.maxPerSecond < 0 {
+		return nil, fmt.Errorf("slow query log limits must not be negative")
+	}
+	if l.sampleRate <= 0 || l.sampleRate > 1 {
+		return nil, fmt.Errorf("slow query sample rate must be greater than 0 and at most 1")
+	}
+
+	if path == "-" {
+		l.out = os.Stderr
+		return l, nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open slow query log: %w", err)
+	}
+	l.out = file
+	l.file = file
+	return l, nil
+}
+
+// LogQuery forwards the query to the next logger
+func (l *SlowQueryLog) LogQuery(connectionID string, query string) error {
+	if l.next != nil {
+		return l.next.LogQuery(connectionID, query)
+	}
+	return nil
+}
+
+// LogNormalizedQuery forwards the normalized query to the next logger
+func (l *SlowQueryLog) LogNormalizedQuery(connectionID string, normalizedQuery domain.NormalizedQuery) error {
+	if l.next != nil {
+		return l.next.LogNormalizedQuery(connectionID, normalizedQuery)
+	}
+	return nil
+}
+
+// LogProtocolMessage forwards the protocol message to the next logger
+func (l *SlowQueryLog) LogProtocolMessage(connectionID string, messageType string, details map[string]interface{}) error {
+	if l.next != nil {
+		return l.next.LogProtocolMessage(connectionID, messageType, details)
+	}
+	return nil
+}
+
+// StartSession forwards the session to the next logger when it attributes sessions.
+// Records carry the user and database of their query.
+func (l *SlowQueryLog) StartSession(session domain.Session) error {
+	if sessionLogger, ok := l.next.(domain.SessionLogger); ok {
+		return sessionLogger.StartSession(session)
+	}
+	return nil
+}
+
+// EndSession forwards the end of the session to the next logger
+func (l *SlowQueryLog) EndSession(connectionID string) {
+	if sessionLogger, ok := l.next.(domain.SessionLogger); ok {
+		sessionLogger.EndSession(connectionID)
+	}
+}
+
+// LogDecision writes the record of an allowed query slower than the threshold,
+// unless it is sampled out, and forwards the decision to the next logger when it
+// records decisions
+func (l *SlowQueryLog) LogDecision(query *domain.Query, decision domain.Decision, usage domain.StatementUsage) error {
+	total := query.Evaluation + usage.Queued + usage.Duration
+	if decision.Allowed() && total > l.threshold {
+		if err := l.write(query, usage, total); err != nil {
+			return err
+		}
+	}
+
+	if decisionLogger, ok := l.next.(domain.DecisionLogger); ok {
+		return decisionLogger.LogDecision(query, decision, usage)
+	}
+	return nil
+}
+
+// write appends the record of a slow query when sampling and the cap per second
+// let it through, and counts it as skipped otherwise
+func (l *SlowQueryLog) write(query *domain.Query, usage domain.StatementUsage, total time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.out == nil {
+		return fmt.Errorf("slow query log is closed")
+	}
+
+	now := l.clock.Now()
+	if second := now.Truncate(time.Second); !second.Equal(l.second) {
+		l.second = second
+		l.written = 0
+	}
+	if l.random() >= l.sampleRate || (l.maxPerSecond > 0 && l.written >= l.maxPerSecond) {
+		l.skipped++
+		return nil
+	}
+
+	record := SlowQueryRecord{
+		Time:            query.Timestamp.UTC(),
+		Instance:        l.instance,
+		ConnectionID:    query.ConnectionID,
+		User:            query.UserID,
+		Database:        query.Database,
+		ApplicationName: query.ApplicationName,
+		Kind:            query.Kind,
+		QueryHash:       query.Hash.Value(),
+		Normalized:      query.Normalized,
+		Parameters:      query.Parameters,
+		DurationMs:      milliseconds(total),
+		Wait: SlowQueryWait{
+			EvaluationMs: milliseconds(query.Evaluation),
+			QueuedMs:     milliseconds(usage.Queued),
+			ExecutionMs:  milliseconds(usage.Duration),
+		},
+		Rows:    usage.Rows,
+		Bytes:   usage.Bytes,
+		Skipped: l.skipped,
+	}
+	if l.redact {
+		record.Parameters = redactParameters(query.Parameters)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode slow query record: %w", err)
+	}
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write slow query record: %w", err)
+	}
+	l.written++
+	l.skipped = 0
+	return nil
+}
+
+// redactParameters replaces the bound values with their format and size. NULLs
+// are kept.
+func redactParameters(parameters []interface{}) []interface{} {
+	if len(parameters) == 0 {
+		return nil
+	}
+	redacted := make([]interface{}, len(parameters))
+	for i, parameter := range parameters {
+		switch value := parameter.(type) {
+		case string:
+			redacted[i] = fmt.Sprintf("<text, %d bytes>", len(value))
+		case []byte:
+			redacted[i] = fmt.Sprintf("<binary, %d bytes>", len(value))
+		}
+	}
+	return redacted
+}
+
+// Close closes the log file
+func (l *SlowQueryLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file := l.file
+	l.out = nil
+	l.file = nil
+	if file == nil {
+		return nil
+	}
+	return file.Close()
+}
@@ -0,0 +1,110 @@
+package adapters
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readSlowQueryRecords decodes the records of a slow query log file
+func readSlowQueryRecords(t *testing.T, path string) []SlowQueryRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var records []SlowQueryRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record SlowQueryRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func TestSlowQueryLog_RecordsSlowQueries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slow.jsonl")
+	next := mocks.NewRecordingQueryLogger()
+	slow, err := NewSlowQueryLog(path, 100*time.Millisecond, next, WithSlowQueryInstance("enforcer-1"))
+	require.NoError(t, err)
+
+	query := auditQuery("SELECT * FROM orders WHERE id = $1")
+	query.Kind = domain.QueryKindExecute
+	query.Parameters = []interface{}{"42", nil}
+	query.Evaluation = 20 * time.Millisecond
+	require.NoError(t, slow.LogQuery("conn_1", "SELECT 1"))
+	require.NoError(t, slow.LogDecision(query, domain.AllowDecision(),
+		domain.StatementUsage{Rows: 1, Bytes: 8, Duration: 150 * time.Millisecond, Queued: 30 * time.Millisecond}))
+	require.NoError(t, slow.LogDecision(auditQuery("SELECT 1"), domain.AllowDecision(),
+		domain.StatementUsage{Duration: 99 * time.Millisecond}))
+	require.NoError(t, slow.LogDecision(auditQuery("DELETE FROM t"), domain.Decision{Action: domain.DecisionDeny, Reason: "quota exceeded"}, domain.StatementUsage{}))
+	require.NoError(t, slow.Close())
+
+	assert.Equal(t, []string{"SELECT 1"}, next.Queries(), "Events should be forwarded")
+
+	records := readSlowQueryRecords(t, path)
+	require.Len(t, records, 1, "Fast and denied queries should not be logged")
+	record := records[0]
+	assert.Equal(t, "enforcer-1", record.Instance)
+	assert.Equal(t, "alice", record.User)
+	assert.Equal(t, "app", record.Database)
+	assert.Equal(t, domain.QueryKindExecute, record.Kind)
+	assert.Equal(t, "SELECT * FROM orders WHERE id = $1", record.Normalized)
+	assert.Equal(t, []interface{}{"42", nil}, record.Parameters)
+	assert.Equal(t, 200.0, record.DurationMs)
+	assert.Equal(t, SlowQueryWait{EvaluationMs: 20, QueuedMs: 30, ExecutionMs: 150}, record.Wait)
+	assert.Equal(t, int64(1), record.Rows)
+}
+
+func TestSlowQueryLog_SamplesAndRedacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slow.jsonl")
+	clock := testkit.NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	slow, err := NewSlowQueryLog(path, 0, nil, WithSlowQuerySampleRate(0.5), WithSlowQueryMaxPerSecond(2),
+		WithSlowQueryParameterRedaction(), WithSlowQueryClock(clock))
+	require.NoError(t, err)
+	draws := []float64{0.1, 0.7, 0.2, 0.3, 0.4}
+	slow.random = func() float64 {
+		draw := draws[0]
+		draws = draws[1:]
+		return draw
+	}
+
+	query := auditQuery("SELECT $1, $2")
+	query.Parameters = []interface{}{"alice@example.com", []byte{0, 1}}
+	usage := domain.StatementUsage{Duration: time.Second}
+	for i := 0; i < 4; i++ {
+		require.NoError(t, slow.LogDecision(query, domain.AllowDecision(), usage))
+	}
+	clock.Advance(time.Second)
+	require.NoError(t, slow.LogDecision(query, domain.AllowDecision(), usage))
+	require.NoError(t, slow.Close())
+
+	records := readSlowQueryRecords(t, path)
+	require.Len(t, records, 3, "A sampled out query and one over the cap per second should be skipped")
+	assert.Zero(t, records[0].Skipped)
+	assert.Equal(t, int64(1), records[1].Skipped)
+	assert.Equal(t, int64(1), records[2].Skipped)
+	assert.Equal(t, []interface{}{"<text, 17 bytes>", "<binary, 2 bytes>"}, records[0].Parameters)
+}
+
+func TestNewSlowQueryLog_RejectsInvalidSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slow.jsonl")
+	_, err := NewSlowQueryLog(path, -time.Second, nil)
+	assert.Error(t, err)
+	_, err = NewSlowQueryLog(path, time.Second, nil, WithSlowQuerySampleRate(0))
+	assert.Error(t, err)
+	_, err = NewSlowQueryLog(path, time.Second, nil, WithSlowQueryMaxPerSecond(-1))
+	assert.Error(t, err)
+}
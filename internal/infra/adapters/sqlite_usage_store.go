@@ -0,0 +1,509 @@
+package adapters
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"sort"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // registers the sqlite3 driver
+)
+
+// sqliteMigrations holds the schema of the SQLite usage store, applied in file name order
+//
+//go:embed migrations/sqlite/*.sql
+var sqliteMigrations embed.FS
+
+const (
+	// DefaultSQLiteCheckpointInterval is how often the write-ahead log of the
+	// SQLite usage store is checkpointed into the database file
+	DefaultSQLiteCheckpointInterval = 5 * time.Minute
+
+	// sqliteTimeFormat is how window bounds are stored: UTC, in a form SQLite's
+	// date functions accept and that sorts chronologically
+	sqliteTimeFormat = "2006-01-02 15:04:05.000000"
+)
+
+// SQLiteUsageStore implements domain.UsageStore with quota policies and usage
+// counters kept in a SQLite database file, for single-node deployments without
+// a PostgreSQL database to share. The database is opened in WAL mode so that
+// reads do not wait for flushes, and the log is checkpointed into the database
+// file every checkpoint interval. Increments are buffered and flushed as in the
+// other database usage stores (see BufferedUsageStoreOption).
+type SQLiteUsageStore struct {
+	counters           *bufferedUsageStore
+	db                 *sql.DB
+	clock              domain.Clock
+	logger             logger.Logger
+	flushInterval      time.Duration
+	checkpointInterval time.Duration
+	usageOpts          []BufferedUsageStoreOption
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// SQLiteUsageStoreOption configures optional behavior of a SQLiteUsageStore
+type SQLiteUsageStoreOption func(*SQLiteUsageStore)
+
+// WithSQLiteFlushInterval sets how often buffered usage is written
+func WithSQLiteFlushInterval(interval time.Duration) SQLiteUsageStoreOption {
+	return func(s *SQLiteUsageStore) {
+		s.flushInterval = interval
+	}
+}
+
+// WithSQLiteUsageOptions configures the buffering of increments
+func WithSQLiteUsageOptions(opts ...BufferedUsageStoreOption) SQLiteUsageStoreOption {
+	return func(s *SQLiteUsageStore) {
+		s.usageOpts = append(s.usageOpts, opts...)
+	}
+}
+
+// WithSQLiteCheckpointInterval sets how often the write-ahead log is checkpointed
+func WithSQLiteCheckpointInterval(interval time.Duration) SQLiteUsageStoreOption {
+	return func(s *SQLiteUsageStore) {
+		s.checkpointInterval = interval
+	}
+}
+
+// WithSQLiteUsageStoreClock sets the clock used to select windows and schedule
+// flushes and checkpoints
+func WithSQLiteUsageStoreClock(clock domain.Clock) SQLiteUsageStoreOption {
+	return func(s *SQLiteUsageStore) {
+		s.clock = clock
+	}
+}
+
+// NewSQLiteUsageStore opens the SQLite database at file, creating it if needed,
+// migrates its schema and starts flushing buffered usage and checkpointing in
+// the background. Close flushes the remaining usage, checkpoints and closes the
+// database.
+func NewSQLiteUsageStore(ctx context.Context, file string, log logger.Logger, opts ...SQLiteUsageStoreOption) (*SQLiteUsageStore, error) {
+	store := &SQLiteUsageStore{
+		clock:              SystemClock{},
+		logger:             log,
+		flushInterval:      DefaultUsageFlushInterval,
+		checkpointInterval: DefaultSQLiteCheckpointInterval,
+		stop:               make(chan struct{}),
+		done:               make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(store)
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+file+"?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure usage store: %w", err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to open usage store %s: %w", file, err)
+	}
+	if err := migrateSQLiteSchema(ctx, db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	store.db = db
+	usageOpts := append([]BufferedUsageStoreOption{WithUsageFlushInterval(store.flushInterval), WithBufferedUsageClock(store.clock)}, store.usageOpts...)
+	store.counters = newBufferedUsageStore(sqliteUsageTable{db: db}, log, usageOpts...)
+	go store.run()
+	return store, nil
+}
+
+// Increment adds amount to the buffered counter of the current window
+func (s *SQLiteUsageStore) Increment(ctx context.Context, key domain.UsageKey, window time.Duration, amount int64) (domain.Usage, error) {
+	return s.counters.Increment(ctx, key, window, amount)
+}
+
+// Get returns the usage of the current window, including buffered increments
+func (s *SQLiteUsageStore) Get(ctx context.Context, key domain.UsageKey, window time.Duration) (domain.Usage, error) {
+	return s.counters.Get(ctx, key, window)
+}
+
+// Reset clears the counters of key, buffered and persisted
+func (s *SQLiteUsageStore) Reset(ctx context.Context, key domain.UsageKey) error {
+	return s.counters.Reset(ctx, key)
+}
+
+// Flush writes the buffered usage in a single transaction
+func (s *SQLiteUsageStore) Flush(ctx context.Context) error {
+	return s.counters.Flush(ctx)
+}
+
+// Ping checks that the database file can still be read
+func (s *SQLiteUsageStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Checkpoint writes the content of the write-ahead log into the database file
+// and truncates the log
+func (s *SQLiteUsageStore) Checkpoint(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return fmt.Errorf("failed to checkpoint usage store: %w", err)
+	}
+	return nil
+}
+
+// Close stops checkpointing, writes the buffered usage, checkpoints a last time
+// and closes the database
+func (s *SQLiteUsageStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+
+		err = s.counters.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), usageFlushTimeout)
+		defer cancel()
+		if checkpointErr := s.Checkpoint(ctx); err == nil {
+			err = checkpointErr
+		}
+		if closeErr := s.db.Close(); err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
+
+// Ended implements domain.UsageHistory with the counters written so far
+func (s *SQLiteUsageStore) Ended(ctx context.Context, from, to time.Time) ([]domain.WindowUsage, error) {
+	return s.counters.Ended(ctx, from, to)
+}
+
+// Compact implements domain.UsageHistory
+func (s *SQLiteUsageStore) Compact(ctx context.Context, before time.Time) (int64, error) {
+	return s.counters.Compact(ctx, before)
+}
+
+// LoadPolicies reads the quota policies defined in the quota_policies table
+func (s *SQLiteUsageStore) LoadPolicies(ctx context.Context) ([]domain.QuotaPolicy, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT name, user_name, role, database_name, labels, listener, dimension, query_limit,
+		       time_window, rate, burst, rate_per, max_connections,
+		       tables, statements, deny, allow_during, fingerprints, patterns, allow, hint, override,
+		       warn_at, soft, grace, tighten_at, tighten_to, statement_timeout, active_during,
+		       credits, credit_rate, max_concurrent_queries, queue_timeout, max_result_rows, max_result_bytes,
+		       max_transaction_duration, max_transaction_statements, per_label
+		FROM quota_policies
+		ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query quota policies: %w", err)
+	}
+	defer rows.Close()
+
+	var policies []domain.QuotaPolicy
+	for rows.Next() {
+		var policy domain.QuotaPolicy
+		var labels, window, tables, statements, allowDuring, activeDuring, fingerprints, patterns, grace, timeout, queueTimeout, transactionDuration string
+		if err := rows.Scan(&policy.Name, &policy.User, &policy.Role, &policy.Database, &labels, &policy.Listener, &policy.Dimension, &policy.Limit, &window,
+			&policy.Rate, &policy.Burst, &policy.RatePer, &policy.MaxConnections, &tables, &statements, &policy.Deny, &allowDuring,
+			&fingerprints, &patterns, &policy.Allow, &policy.Hint, &policy.Override,
+			&policy.WarnAt, &policy.Soft, &grace, &policy.TightenAt, &policy.TightenTo, &timeout, &activeDuring,
+			&policy.Credits, &policy.CreditRate, &policy.MaxConcurrentQueries, &queueTimeout, &policy.MaxResultRows, &policy.MaxResultBytes,
+			&transactionDuration, &policy.MaxTransactionStatements, &policy.PerLabel); err != nil {
+			return nil, fmt.Errorf("failed to read quota policy: %w", err)
+		}
+
+		var classes []string
+		for _, column := range []struct {
+			text   string
+			target interface{}
+		}{{labels, &policy.Labels}, {tables, &policy.Tables}, {statements, &classes},
+			{allowDuring, &policy.AllowDuring}, {activeDuring, &policy.ActiveDuring}, {fingerprints, &policy.Fingerprints}, {patterns, &policy.Patterns}} {
+			if err := json.Unmarshal([]byte(column.text), column.target); err != nil {
+				return nil, fmt.Errorf("quota policy %q: invalid JSON %s: %w", policy.Name, column.text, err)
+			}
+		}
+		if len(policy.Labels) == 0 {
+			policy.Labels = nil
+		}
+		if len(policy.Tables) == 0 {
+			policy.Tables = nil
+		}
+		if len(policy.AllowDuring) == 0 {
+			policy.AllowDuring = nil
+		}
+		if len(policy.ActiveDuring) == 0 {
+			policy.ActiveDuring = nil
+		}
+		if len(policy.Fingerprints) == 0 {
+			policy.Fingerprints = nil
+		}
+		if len(policy.Patterns) == 0 {
+			policy.Patterns = nil
+		}
+		for _, class := range classes {
+			policy.Statements = append(policy.Statements, domain.StatementClass(class))
+		}
+
+		for _, column := range []struct {
+			text   string
+			target *time.Duration
+		}{{window, &policy.Window}, {grace, &policy.Grace}, {timeout, &policy.StatementTimeout}, {queueTimeout, &policy.QueueTimeout},
+			{transactionDuration, &policy.MaxTransactionDuration}} {
+			if *column.target, err = time.ParseDuration(column.text); err != nil {
+				return nil, fmt.Errorf("quota policy %q: %w", policy.Name, err)
+			}
+		}
+		if err := policy.Validate(); err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query quota policies: %w", err)
+	}
+	return policies, nil
+}
+
+// LoadRoles reads the users of the roles defined in the role_members table, by
+// role name
+func (s *SQLiteUsageStore) LoadRoles(ctx context.Context) (map[string][]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT role, user_name FROM role_members ORDER BY role, user_name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query role members: %w", err)
+	}
+	defer rows.Close()
+
+	roles := make(map[string][]string)
+	for rows.Next() {
+		var role, user string
+		if err := rows.Scan(&role, &user); err != nil {
+			return nil, fmt.Errorf("failed to read role member: %w", err)
+		}
+		roles[role] = append(roles[role], user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query role members: %w", err)
+	}
+	return roles, nil
+}
+
+// SaveQueryStats implements domain.QueryStatsStore with the query_stats table
+func (s *SQLiteUsageStore) SaveQueryStats(ctx context.Context, stats []domain.QueryStats) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to save query statistics: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, entry := range stats {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO query_stats (query_hash, query, calls, total_time_ms, p95_time_ms, rows, bytes, last_seen)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (query_hash) DO UPDATE
+				SET calls = calls + excluded.calls,
+				    total_time_ms = total_time_ms + excluded.total_time_ms,
+				    p95_time_ms = excluded.p95_time_ms,
+				    rows = rows + excluded.rows,
+				    bytes = bytes + excluded.bytes,
+				    last_seen = max(last_seen, excluded.last_seen),
+				    updated_at = CURRENT_TIMESTAMP`,
+			entry.Hash.String(), entry.Query, entry.Calls, milliseconds(entry.TotalDuration),
+			milliseconds(entry.P95Duration), entry.Rows, entry.Bytes,
+			entry.LastSeen.UTC().Format(sqliteTimeFormat)); err != nil {
+			return fmt.Errorf("failed to save query statistics: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to save query statistics: %w", err)
+	}
+	return nil
+}
+
+// run checkpoints the write-ahead log every checkpoint interval
+func (s *SQLiteUsageStore) run() {
+	defer close(s.done)
+
+	for {
+		timer := s.clock.NewTimer(s.checkpointInterval)
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), usageFlushTimeout)
+		if err := s.Checkpoint(ctx); err != nil {
+			s.logger.Error("%v", err)
+		}
+		cancel()
+	}
+}
+
+// sqliteUsageTable implements usageTable with the quota_usage table of a SQLite database
+type sqliteUsageTable struct {
+	db *sql.DB
+}
+
+func (t sqliteUsageTable) load(ctx context.Context, key domain.UsageKey, start time.Time) (int64, error) {
+	var used int64
+	err := t.db.QueryRowContext(ctx, `
+		SELECT used FROM quota_usage
+		WHERE policy = ? AND user_name = ? AND database_name = ? AND label = ? AND window_start = ?`,
+		key.Policy, key.User, key.Database, key.Label, start.UTC().Format(sqliteTimeFormat)).Scan(&used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return used, err
+}
+
+func (t sqliteUsageTable) upsert(ctx context.Context, deltas []usageDelta) ([]int64, error) {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	statement, err := tx.PrepareContext(ctx, `
+		INSERT INTO quota_usage (policy, user_name, database_name, label, window_start, window_end, used)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (policy, user_name, database_name, label, window_start) DO UPDATE
+			SET used = used + excluded.used,
+			    window_end = excluded.window_end,
+			    updated_at = CURRENT_TIMESTAMP
+		RETURNING used`)
+	if err != nil {
+		return nil, err
+	}
+	defer statement.Close()
+
+	totals := make([]int64, len(deltas))
+	for i, delta := range deltas {
+		if err := statement.QueryRowContext(ctx, delta.key.Policy, delta.key.User, delta.key.Database, delta.key.Label,
+			delta.start.UTC().Format(sqliteTimeFormat), delta.end.UTC().Format(sqliteTimeFormat), delta.delta).Scan(&totals[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return totals, nil
+}
+
+func (t sqliteUsageTable) delete(ctx context.Context, key domain.UsageKey) error {
+	_, err := t.db.ExecContext(ctx, `
+		DELETE FROM quota_usage
+		WHERE policy = ? AND user_name = ? AND database_name = ? AND label = ?`,
+		key.Policy, key.User, key.Database, key.Label)
+	return err
+}
+
+func (t sqliteUsageTable) ended(ctx context.Context, from, to time.Time) ([]domain.WindowUsage, error) {
+	rows, err := t.db.QueryContext(ctx, `
+		SELECT policy, user_name, database_name, label, window_start, window_end, used
+		FROM quota_usage
+		WHERE window_end > ? AND window_end <= ?
+		ORDER BY policy, user_name, database_name, label, window_start`,
+		from.UTC().Format(sqliteTimeFormat), to.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var windows []domain.WindowUsage
+	for rows.Next() {
+		var window domain.WindowUsage
+		var start, end string
+		if err := rows.Scan(&window.Key.Policy, &window.Key.User, &window.Key.Database, &window.Key.Label, &start, &end, &window.Used); err != nil {
+			return nil, err
+		}
+		if window.Start, err = time.Parse(sqliteTimeFormat, start); err != nil {
+			return nil, err
+		}
+		if window.End, err = time.Parse(sqliteTimeFormat, end); err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	return windows, rows.Err()
+}
+
+func (t sqliteUsageTable) compact(ctx context.Context, before time.Time) (int64, error) {
+	result, err := t.db.ExecContext(ctx, `DELETE FROM quota_usage WHERE window_end < ?`, before.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// migrateSQLiteSchema applies the migrations not recorded in schema_migrations,
+// in a single transaction
+func migrateSQLiteSchema(ctx context.Context, db *sql.DB) error {
+	names, err := fs.Glob(sqliteMigrations, "migrations/sqlite/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to migrate usage store: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    integer PRIMARY KEY,
+		applied_at text NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`); err != nil {
+		return fmt.Errorf("failed to migrate usage store: %w", err)
+	}
+
+	applied := make(map[int]bool)
+	rows, err := tx.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return fmt.Errorf("failed to migrate usage store: %w", err)
+	}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to migrate usage store: %w", err)
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to migrate usage store: %w", err)
+	}
+
+	for _, name := range names {
+		version, err := migrationVersion(name)
+		if err != nil {
+			return err
+		}
+		if applied[version] {
+			continue
+		}
+
+		script, err := sqliteMigrations.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, string(script)); err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", path.Base(name), err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES (?)`, version); err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", path.Base(name), err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to migrate usage store: %w", err)
+	}
+	return nil
+}
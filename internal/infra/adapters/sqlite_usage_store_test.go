@@ -0,0 +1,185 @@
+package adapters
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteUsageStore_PersistsUsage(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "quota.db")
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 30, 0, time.UTC))
+	key := domain.UsageKey{Policy: "daily", User: "alice", Database: "app"}
+	tenant := domain.UsageKey{Policy: "daily", User: "alice", Database: "app", Label: "42"}
+
+	store, err := NewSQLiteUsageStore(ctx, file, logger.NewSimpleLogger(), WithSQLiteUsageStoreClock(clock))
+	require.NoError(t, err)
+	_, err = store.Increment(ctx, key, time.Hour, 3)
+	require.NoError(t, err)
+	_, err = store.Increment(ctx, tenant, time.Hour, 7)
+	require.NoError(t, err)
+	require.NoError(t, store.Flush(ctx))
+	usage, err := store.Increment(ctx, key, time.Hour, 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), usage.Used)
+	assert.Equal(t, time.Date(2025, 6, 1, 13, 0, 0, 0, time.UTC), usage.ResetAt)
+	require.NoError(t, store.Close(), "Closing should flush the buffered usage")
+
+	reopened, err := NewSQLiteUsageStore(ctx, file, logger.NewSimpleLogger(), WithSQLiteUsageStoreClock(clock))
+	require.NoError(t, err)
+	defer reopened.Close()
+	usage, err = reopened.Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), usage.Used, "Usage should survive a restart")
+
+	var mode string
+	require.NoError(t, reopened.db.QueryRowContext(ctx, `PRAGMA journal_mode`).Scan(&mode))
+	assert.Equal(t, "wal", mode)
+	require.NoError(t, reopened.Checkpoint(ctx))
+
+	require.NoError(t, reopened.Reset(ctx, key))
+	usage, err = reopened.Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Zero(t, usage.Used)
+	usage, err = reopened.Get(ctx, tenant, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), usage.Used, "Label values should be counted apart")
+
+	clock.Advance(time.Hour)
+	usage, err = reopened.Increment(ctx, key, time.Hour, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), usage.Used, "A new window should start from zero")
+}
+
+func TestSQLiteUsageStore_History(t *testing.T) {
+	ctx := context.Background()
+	clock := testkit.NewFakeClock(time.Date(2025, 6, 1, 12, 0, 30, 0, time.UTC))
+	store, err := NewSQLiteUsageStore(ctx, filepath.Join(t.TempDir(), "quota.db"), logger.NewSimpleLogger(), WithSQLiteUsageStoreClock(clock))
+	require.NoError(t, err)
+	defer store.Close()
+
+	key := domain.UsageKey{Policy: "hourly", User: "alice", Database: "app"}
+	for i := 0; i < 3; i++ {
+		_, err := store.Increment(ctx, key, time.Hour, int64(i+1))
+		require.NoError(t, err)
+		require.NoError(t, store.Flush(ctx))
+		clock.Advance(time.Hour)
+	}
+
+	windows, err := store.Ended(ctx, time.Date(2025, 6, 1, 13, 0, 0, 0, time.UTC), clock.Now())
+	require.NoError(t, err)
+	assert.Equal(t, []domain.WindowUsage{
+		{Key: key, Start: time.Date(2025, 6, 1, 13, 0, 0, 0, time.UTC), End: time.Date(2025, 6, 1, 14, 0, 0, 0, time.UTC), Used: 2},
+		{Key: key, Start: time.Date(2025, 6, 1, 14, 0, 0, 0, time.UTC), End: time.Date(2025, 6, 1, 15, 0, 0, 0, time.UTC), Used: 3},
+	}, windows, "Windows should be reported once they ended")
+
+	deleted, err := store.Compact(ctx, time.Date(2025, 6, 1, 14, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	windows, err = store.Ended(ctx, time.Time{}, clock.Now())
+	require.NoError(t, err)
+	assert.Len(t, windows, 2)
+}
+
+func TestSQLiteUsageStore_SaveQueryStats(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewSQLiteUsageStore(ctx, filepath.Join(t.TempDir(), "quota.db"), logger.NewSimpleLogger())
+	require.NoError(t, err)
+	defer store.Close()
+
+	seen := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	stats := domain.QueryStats{
+		Hash:          domain.NewQueryHash("abc123"),
+		Query:         "SELECT * FROM orders WHERE id = $1",
+		Calls:         4,
+		TotalDuration: 10 * time.Millisecond,
+		P95Duration:   4 * time.Millisecond,
+		Rows:          4,
+		Bytes:         400,
+		LastSeen:      seen,
+	}
+	require.NoError(t, store.SaveQueryStats(ctx, []domain.QueryStats{stats}))
+	stats.Query = "SELECT * FROM orders WHERE id = $2"
+	stats.Calls, stats.P95Duration, stats.LastSeen = 1, 2500*time.Microsecond, seen.Add(-time.Minute)
+	require.NoError(t, store.SaveQueryStats(ctx, []domain.QueryStats{stats}), "Another enforcer should add to the same fingerprint")
+
+	var query, lastSeen string
+	var calls, rows, bytes int64
+	var total, p95 float64
+	require.NoError(t, store.db.QueryRowContext(ctx, `
+		SELECT query, calls, total_time_ms, p95_time_ms, rows, bytes, last_seen
+		FROM query_stats WHERE query_hash = 'abc123'`).Scan(&query, &calls, &total, &p95, &rows, &bytes, &lastSeen))
+	assert.Equal(t, "SELECT * FROM orders WHERE id = $1", query, "The first query saved should be kept")
+	assert.Equal(t, int64(5), calls)
+	assert.Equal(t, 20.0, total)
+	assert.Equal(t, 2.5, p95, "The latest 95th percentile should replace the previous one")
+	assert.Equal(t, int64(8), rows)
+	assert.Equal(t, int64(800), bytes)
+	assert.Equal(t, "2025-06-01 12:00:00.000000", lastSeen)
+}
+
+func TestSQLiteUsageStore_LoadPolicies(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "quota.db")
+	store, err := NewSQLiteUsageStore(ctx, file, logger.NewSimpleLogger())
+	require.NoError(t, err)
+	defer store.Close()
+
+	db, err := sql.Open("sqlite3", "file:"+file)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO quota_policies (name, user_name, query_limit, time_window, labels, tables, statements, warn_at, grace, statement_timeout)
+		VALUES ('alice-daily', 'alice', 1000, '24h', '{"team":"data"}', '["public.*"]', '["read"]', 80, '10m', '30s');
+		INSERT INTO quota_policies (name, role, deny, allow_during) VALUES ('analysts-deny', 'analysts', 1, '["Mon-Fri 09:00-18:00"]');
+		INSERT INTO quota_policies (name, user_name, query_limit, time_window, active_during) VALUES ('bob-peak', 'bob', 10, '1h', '["Mon-Fri 09:00-18:00 Europe/Paris"]');
+		INSERT INTO quota_policies (name, user_name, rate, credits, credit_rate) VALUES ('carol-credits', 'carol', 10, 3000, 2.5);
+		INSERT INTO quota_policies (name, user_name, max_concurrent_queries, queue_timeout) VALUES ('dave-concurrency', 'dave', 4, '5s');
+		INSERT INTO quota_policies (name, database_name, max_result_rows, max_result_bytes) VALUES ('reporting-results', 'reporting', 10000, 1048576);
+		INSERT INTO quota_policies (name, user_name, max_transaction_duration, max_transaction_statements) VALUES ('erin-transactions', 'erin', '5m', 1000);
+		INSERT INTO role_members (role, user_name) VALUES ('analysts', 'bob'), ('analysts', 'alice');`)
+	require.NoError(t, err)
+
+	policies, err := store.LoadPolicies(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []domain.QuotaPolicy{
+		{Name: "alice-daily", User: "alice", Labels: map[string]string{"team": "data"}, Limit: 1000, Window: 24 * time.Hour,
+			WarnAt: 80, Grace: 10 * time.Minute, StatementTimeout: 30 * time.Second,
+			Tables: []string{"public.*"}, Statements: []domain.StatementClass{domain.StatementClassRead}},
+		{Name: "analysts-deny", Role: "analysts", Deny: true, AllowDuring: []string{"Mon-Fri 09:00-18:00"}},
+		{Name: "bob-peak", User: "bob", Limit: 10, Window: time.Hour, ActiveDuring: []string{"Mon-Fri 09:00-18:00 Europe/Paris"}},
+		{Name: "carol-credits", User: "carol", Rate: 10, Credits: 3000, CreditRate: 2.5},
+		{Name: "dave-concurrency", User: "dave", MaxConcurrentQueries: 4, QueueTimeout: 5 * time.Second},
+		{Name: "erin-transactions", User: "erin", MaxTransactionDuration: 5 * time.Minute, MaxTransactionStatements: 1000},
+		{Name: "reporting-results", Database: "reporting", MaxResultRows: 10000, MaxResultBytes: 1048576},
+	}, policies)
+
+	roles, err := store.LoadRoles(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"analysts": {"alice", "bob"}}, roles)
+
+	_, err = db.ExecContext(ctx, `UPDATE quota_policies SET time_window = 'a day' WHERE name = 'alice-daily'`)
+	require.NoError(t, err)
+	_, err = store.LoadPolicies(ctx)
+	assert.ErrorContains(t, err, `quota policy "alice-daily"`)
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	names, err := sqliteMigrations.ReadDir("migrations/sqlite")
+	require.NoError(t, err)
+	require.NotEmpty(t, names, "Migrations should be embedded")
+	for _, name := range names {
+		_, err := migrationVersion(name.Name())
+		assert.NoError(t, err)
+	}
+}
@@ -0,0 +1,88 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SRVUpstreamResolver discovers upstream targets from a DNS SRV record such as
+// _postgresql._tcp.db.internal. Only the records with the lowest priority are used;
+// higher priorities are backups that take over once the primaries are withdrawn.
+type SRVUpstreamResolver struct {
+	name    string
+	servers []string
+	client  *dns.Client
+}
+
+// NewSRVUpstreamResolver creates a resolver for the SRV record name
+func NewSRVUpstreamResolver(name string, opts ...DNSResolverOption) (*SRVUpstreamResolver, error) {
+	if name == "" {
+		return nil, fmt.Errorf("SRV record name is required")
+	}
+
+	// Share the name server options of the A/AAAA resolver
+	options := &DNSUpstreamResolver{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	servers := options.servers
+	if len(servers) == 0 {
+		var err error
+		if servers, err = systemNameServers(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &SRVUpstreamResolver{
+		name:    name,
+		servers: servers,
+		client:  &dns.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+// Resolve returns one target per SRV record of the lowest priority, addressed by
+// the record's target host name and port
+func (r *SRVUpstreamResolver) Resolve(ctx context.Context) ([]domain.UpstreamTarget, time.Duration, error) {
+	answers, err := exchangeDNS(ctx, r.client, r.servers, r.name, dns.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var records []*dns.SRV
+	var ttl uint32
+	for _, answer := range answers {
+		record, ok := answer.(*dns.SRV)
+		if !ok || record.Target == "." {
+			continue
+		}
+		if len(records) == 0 || record.Hdr.Ttl < ttl {
+			ttl = record.Hdr.Ttl
+		}
+		if len(records) > 0 && record.Priority > records[0].Priority {
+			continue
+		}
+		if len(records) > 0 && record.Priority < records[0].Priority {
+			records = records[:0]
+		}
+		records = append(records, record)
+	}
+
+	if len(records) == 0 {
+		return nil, 0, fmt.Errorf("no SRV records found for %s", r.name)
+	}
+
+	targets := make([]domain.UpstreamTarget, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		targets = append(targets, domain.UpstreamTarget{Address: net.JoinHostPort(host, strconv.Itoa(int(record.Port)))})
+	}
+	return targets, time.Duration(ttl) * time.Second, nil
+}
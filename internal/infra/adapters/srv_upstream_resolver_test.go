@@ -0,0 +1,43 @@
+package adapters
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSRVUpstreamResolver_Resolve(t *testing.T) {
+	server := startDNSServer(t, func() []string {
+		return []string{
+			"_postgresql._tcp.db.internal. 60 IN SRV 10 50 6432 pgb-1.db.internal.",
+			"_postgresql._tcp.db.internal. 20 IN SRV 10 50 6433 pgb-2.db.internal.",
+			"_postgresql._tcp.db.internal. 60 IN SRV 20 50 6432 pgb-backup.db.internal.",
+		}
+	})
+
+	resolver, err := NewSRVUpstreamResolver("_postgresql._tcp.db.internal", WithDNSServers(server))
+	require.NoError(t, err)
+
+	targets, ttl, err := resolver.Resolve(context.Background())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []domain.UpstreamTarget{
+		{Address: "pgb-1.db.internal:6432"},
+		{Address: "pgb-2.db.internal:6433"},
+	}, targets, "Only the lowest priority records should be used")
+	assert.Equal(t, 20*time.Second, ttl)
+}
+
+func TestSRVUpstreamResolver_NoRecords(t *testing.T) {
+	server := startDNSServer(t, func() []string { return nil })
+
+	resolver, err := NewSRVUpstreamResolver("_postgresql._tcp.missing.internal", WithDNSServers(server))
+	require.NoError(t, err)
+
+	_, _, err = resolver.Resolve(context.Background())
+	assert.ErrorContains(t, err, "no SRV records")
+}
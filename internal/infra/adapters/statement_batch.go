@@ -0,0 +1,73 @@
+package adapters
+
+import (
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"strings"
+	"time"
+)
+
+// splitStatements splits a simple query holding several statements into their
+// texts, following the parse tree of pg_query so that semicolons in literals,
+// comments and function bodies are left alone. Queries holding one statement,
+// and those the parser rejects, which the upstream rejects as a whole too, are
+// not split: nil is returned.
+func splitStatements(query string) []string {
+	if !strings.Contains(query, ";") {
+		return nil
+	}
+	statements, err := pgQuerySplit(query)
+	if err != nil || len(statements) < 2 {
+		return nil
+	}
+	return statements
+}
+
+// batchDecision combines the decisions allowing each statement of a simple query
+// into the decision of the query: it is warned about each statement, keeps
+// their decisions for the statement timeouts and result caps of each, holds
+// its transaction to the strictest limits of its statements, and releases the
+// concurrency slots they hold once it ends. Statements rewritten are replaced
+// in the query.
+func batchDecision(statements []string, decisions []domain.Decision) domain.Decision {
+	batch := domain.AllowDecision()
+	batch.Statements = decisions
+	var releases []func()
+	rewritten := false
+	for _, decision := range decisions {
+		batch.Warnings = append(batch.Warnings, decision.Warnings...)
+		if stricter(decision.MaxTransactionDuration, batch.MaxTransactionDuration) {
+			batch.MaxTransactionDuration, batch.TransactionDurationPolicy = decision.MaxTransactionDuration, decision.TransactionDurationPolicy
+		}
+		if stricter(decision.MaxTransactionStatements, batch.MaxTransactionStatements) {
+			batch.MaxTransactionStatements, batch.TransactionStatementsPolicy = decision.MaxTransactionStatements, decision.TransactionStatementsPolicy
+		}
+		if decision.Release != nil {
+			releases = append(releases, decision.Release)
+		}
+		rewritten = rewritten || decision.Rewrite != ""
+	}
+
+	if len(releases) > 0 {
+		batch.Release = func() {
+			for _, release := range releases {
+				release()
+			}
+		}
+	}
+	if rewritten {
+		texts := make([]string, len(statements))
+		for i, statement := range statements {
+			texts[i] = statement
+			if decisions[i].Rewrite != "" {
+				texts[i] = decisions[i].Rewrite
+			}
+		}
+		batch.Rewrite = strings.Join(texts, "; ")
+	}
+	return batch
+}
+
+// stricter reports whether limit, zero when unlimited, is stricter than current
+func stricter[T int64 | time.Duration](limit, current T) bool {
+	return limit > 0 && (current == 0 || limit < current)
+}
@@ -0,0 +1,76 @@
+package adapters
+
+import (
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{name: "Single statement", query: "SELECT * FROM users WHERE id = 1", expected: nil},
+		{name: "Trailing semicolon", query: "SELECT 1;", expected: nil},
+		{name: "Two statements", query: "BEGIN; UPDATE accounts SET balance = 0;\nCOMMIT", expected: []string{"BEGIN", "UPDATE accounts SET balance = 0", "COMMIT"}},
+		{name: "Semicolons in literals and comments", query: "SELECT 'a;b' /* ; */; SELECT \";\" FROM t", expected: []string{"SELECT 'a;b' /* ; */", `SELECT ";" FROM t`}},
+		{name: "Function body", query: "CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql", expected: nil},
+		{name: "Syntax error", query: "SELECT 1; SELEC 2", expected: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, splitStatements(tt.query))
+		})
+	}
+}
+
+func TestBatchDecision(t *testing.T) {
+	var released []string
+	decisions := []domain.Decision{
+		{
+			Action:           domain.DecisionAllow,
+			Warnings:         []string{"first warning"},
+			StatementTimeout: time.Minute,
+			TimeoutPolicy:    "slow",
+			MaxResultRows:    100,
+			ResultRowsPolicy: "rows",
+			Release:          func() { released = append(released, "first") },
+		},
+		{Action: domain.DecisionAllow, Rewrite: "SELECT * FROM orders LIMIT 10"},
+		{
+			Action:                   domain.DecisionAllow,
+			Warnings:                 []string{"second warning"},
+			StatementTimeout:         time.Second,
+			TimeoutPolicy:            "fast",
+			MaxResultRows:            1000,
+			ResultRowsPolicy:         "more-rows",
+			MaxTransactionStatements: 5,
+			Release:                  func() { released = append(released, "third") },
+		},
+	}
+
+	batch := batchDecision([]string{"SELECT 1", "SELECT * FROM orders", "SELECT 3"}, decisions)
+	assert.True(t, batch.Allowed())
+	assert.Equal(t, []string{"first warning", "second warning"}, batch.Warnings)
+	assert.Zero(t, batch.StatementTimeout, "Statement timeouts should apply to each statement")
+	assert.Zero(t, batch.MaxResultRows, "Result caps should apply to each statement")
+	require.Len(t, batch.Statements, 3)
+	assert.Equal(t, "slow", batch.Statements[0].TimeoutPolicy)
+	assert.Equal(t, "more-rows", batch.Statements[2].ResultRowsPolicy)
+	assert.Equal(t, int64(5), batch.MaxTransactionStatements, "The strictest transaction limits should apply")
+	assert.Equal(t, "SELECT 1; SELECT * FROM orders LIMIT 10; SELECT 3", batch.Rewrite)
+
+	batch.Finish()
+	assert.Equal(t, []string{"first", "third"}, released, "The slots of every statement should be released")
+
+	batch = batchDecision([]string{"SELECT 1", "SELECT 2"}, []domain.Decision{domain.AllowDecision(), domain.AllowDecision()})
+	assert.Empty(t, batch.Rewrite, "Queries without rewritten statements should be sent as they are")
+	assert.Nil(t, batch.Release)
+}
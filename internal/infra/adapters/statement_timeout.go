@@ -0,0 +1,204 @@
+package adapters
+
+import (
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// pgerrQueryCanceled is the SQLSTATE PostgreSQL reports for a cancelled
+// statement, whether on request or after its statement_timeout
+const pgerrQueryCanceled = "57014"
+
+// statementTimeouts cancels the statements of a proxied connection that run
+// longer than the statement timeout of the policies applying to them, and
+// reports their cancellation to the client as PostgreSQL reports its own
+// statement_timeout. A statement is timed from when it is forwarded upstream
+// until the ReadyForQuery answering its Query, or the Sync following its
+// Execute. The statements of a Query holding several are timed one by one, each
+// from when the one before it completed, with the timeout of its own decision.
+// Client messages are observed by the handler goroutine and upstream
+// messages by the relay goroutine. The decisions of statements are finished
+// once they end, freeing their concurrency slots, and those of the statements
+// still running once the connection closes.
+type statementTimeouts struct {
+	clock  domain.Clock
+	cancel func(policy string, timeout time.Duration) // sends a CancelRequest for the statement the upstream runs
+
+	mu       sync.Mutex
+	sent     int64           // Query and Sync messages forwarded upstream
+	answered int64           // ReadyForQuery messages relayed to the client
+	armed    []*armedTimeout // by the ReadyForQuery ending their statement
+	expired  *armedTimeout   // cancelled statement whose error is awaited
+	running  []runningStatement
+	batches  []*timedBatch // Queries holding several statements, in order
+}
+
+// timedBatch is a Query holding several statements, whose statements are timed
+// as they run
+type timedBatch struct {
+	ready   int64             // value of answered once the Query ends
+	current *armedTimeout     // timeout of the statement running, nil when it has none
+	rest    []domain.Decision // decisions of the statements after it
+}
+
+// runningStatement is a statement whose decision is finished once it ends
+type runningStatement struct {
+	ready    int64 // value of answered once the statement ends
+	decision domain.Decision
+}
+
+// armedTimeout is the timeout of a statement still running
+type armedTimeout struct {
+	ready   int64 // value of answered once the statement ends
+	timeout time.Duration
+	policy  string
+	stop    chan struct{}
+	stopped bool // the statement ended before its Query, t.mu guarding it
+}
+
+// newStatementTimeouts creates the statement timeouts of a connection, which
+// cancel its statements with cancel
+func newStatementTimeouts(clock domain.Clock, cancel func(policy string, timeout time.Duration)) *statementTimeouts {
+	return &statementTimeouts{clock: clock, cancel: cancel}
+}
+
+// observeClient times a message forwarded upstream, which the decision taken on
+// it may give a statement timeout
+func (t *statementTimeouts) observeClient(message *ParsedMessage, decision domain.Decision) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ready := t.sent + 1
+	switch message.Message.(type) {
+	case *pgproto3.Query, *pgproto3.Sync:
+		t.sent++
+	case *pgproto3.Execute:
+	default:
+		decision.Finish()
+		return
+	}
+	if decision.Release != nil {
+		t.running = append(t.running, runningStatement{ready: ready, decision: decision})
+	}
+	if message.Type == "Sync" {
+		return
+	}
+	if len(decision.Statements) > 0 {
+		first := decision.Statements[0]
+		t.batches = append(t.batches, &timedBatch{ready: ready, current: t.arm(ready, first), rest: decision.Statements[1:]})
+		return
+	}
+	t.arm(ready, decision)
+}
+
+// arm starts the timeout of a statement ending with the ReadyForQuery ready,
+// and returns it, or nil when the decision gives it none; t.mu must be held
+func (t *statementTimeouts) arm(ready int64, decision domain.Decision) *armedTimeout {
+	if decision.StatementTimeout <= 0 {
+		return nil
+	}
+	armed := &armedTimeout{ready: ready, timeout: decision.StatementTimeout, policy: decision.TimeoutPolicy, stop: make(chan struct{})}
+	t.armed = append(t.armed, armed)
+	timer := t.clock.NewTimer(armed.timeout)
+	go func() {
+		select {
+		case <-timer.C():
+			t.expire(armed)
+		case <-armed.stop:
+			timer.Stop()
+		}
+	}()
+	return armed
+}
+
+// disarm stops the timeout of a statement that ended; t.mu must be held
+func (t *statementTimeouts) disarm(armed *armedTimeout) {
+	if armed == nil || armed.stopped {
+		return
+	}
+	armed.stopped = true
+	close(armed.stop)
+	t.armed = slices.DeleteFunc(t.armed, func(other *armedTimeout) bool { return other == armed })
+}
+
+// expire cancels the statement of armed if it is still running
+func (t *statementTimeouts) expire(armed *armedTimeout) {
+	t.mu.Lock()
+	running := t.answered < armed.ready && t.expired == nil && !armed.stopped
+	if running {
+		t.expired = armed
+	}
+	t.mu.Unlock()
+
+	if running {
+		t.cancel(armed.policy, armed.timeout)
+	}
+}
+
+// observeUpstream ends the statements a ReadyForQuery answers, and returns the
+// message to relay: the error of a statement cancelled on timeout tells so
+func (t *statementTimeouts) observeUpstream(msg pgproto3.BackendMessage) pgproto3.BackendMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch m := msg.(type) {
+	case *pgproto3.ErrorResponse:
+		if t.expired == nil || m.Code != pgerrQueryCanceled {
+			return msg
+		}
+		response := *m
+		response.Message = "canceling statement due to statement timeout"
+		response.Detail = fmt.Sprintf("quota %q limits statements to %s", t.expired.policy, t.expired.timeout)
+		return &response
+	case *pgproto3.CommandComplete, *pgproto3.EmptyQueryResponse:
+		// The next statement of a Query holding several starts
+		if len(t.batches) > 0 && t.batches[0].ready == t.answered+1 && len(t.batches[0].rest) > 0 {
+			batch := t.batches[0]
+			t.disarm(batch.current)
+			batch.current = t.arm(batch.ready, batch.rest[0])
+			batch.rest = batch.rest[1:]
+		}
+	case *pgproto3.ReadyForQuery:
+		t.answered++
+		for len(t.batches) > 0 && t.batches[0].ready <= t.answered {
+			t.batches = t.batches[1:]
+		}
+		for _, armed := range t.armed {
+			if armed.ready <= t.answered {
+				armed.stopped = true
+				close(armed.stop)
+			}
+		}
+		t.armed = slices.DeleteFunc(t.armed, func(armed *armedTimeout) bool { return armed.ready <= t.answered })
+		for len(t.running) > 0 && t.running[0].ready <= t.answered {
+			t.running[0].decision.Finish()
+			t.running = t.running[1:]
+		}
+		if t.expired != nil && t.expired.ready <= t.answered {
+			t.expired = nil
+		}
+	}
+	return msg
+}
+
+// close stops the timers of the statements still running and finishes their
+// decisions
+func (t *statementTimeouts) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, armed := range t.armed {
+		armed.stopped = true
+		close(armed.stop)
+	}
+	t.armed = nil
+	t.batches = nil
+	for _, statement := range t.running {
+		statement.decision.Finish()
+	}
+	t.running = nil
+}
@@ -0,0 +1,74 @@
+package adapters
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemdFirstFD is the first file descriptor passed by systemd socket activation
+const systemdFirstFD = 3
+
+// SystemdListeners returns the sockets passed by systemd socket activation, as
+// described in sd_listen_fds(3), keyed by the name set with FileDescriptorName=
+// in their socket unit, which defaults to the name of the unit. It returns no
+// socket when the process was not socket activated. The LISTEN_* variables are
+// unset so that child processes do not take the sockets for theirs.
+func SystemdListeners() (map[string][]net.Listener, error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	return systemdListeners(pid, fds, names, os.Getpid(), systemdFirstFD)
+}
+
+// systemdListeners opens the sockets described by the LISTEN_* variables, when
+// they are addressed to the process pid, numbered from firstFD
+func systemdListeners(listenPID, listenFDs, listenFDNames string, pid, firstFD int) (map[string][]net.Listener, error) {
+	if listenPID == "" || listenFDs == "" {
+		return nil, nil
+	}
+	if target, err := strconv.Atoi(listenPID); err != nil || target != pid {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(listenFDs)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", listenFDs)
+	}
+	var names []string
+	if listenFDNames != "" {
+		names = strings.Split(listenFDNames, ":")
+	}
+
+	listeners := make(map[string][]net.Listener, count)
+	for i := 0; i < count; i++ {
+		name := "unknown" // what systemd reports for sockets without a name
+		if i < len(names) {
+			name = names[i]
+		}
+
+		fd := firstFD + i
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close() // FileListener works on a duplicate of the descriptor
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("failed to use socket %s passed by systemd as fd %d: %w", name, fd, err)
+		}
+		listeners[name] = append(listeners[name], listener)
+	}
+	return listeners, nil
+}
+
+// closeListeners closes every listener of the map
+func closeListeners(listeners map[string][]net.Listener) {
+	for _, named := range listeners {
+		for _, listener := range named {
+			_ = listener.Close()
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package adapters
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystemdListeners(t *testing.T) {
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer socket.Close()
+	// A duplicate descriptor of the socket stands for one passed by systemd,
+	// which is closed once used
+	file, err := socket.(*net.TCPListener).File()
+	require.NoError(t, err)
+	defer file.Close()
+	fd, err := syscall.Dup(int(file.Fd()))
+	require.NoError(t, err)
+
+	listeners, err := systemdListeners("42", "", "", 42, fd)
+	require.NoError(t, err)
+	assert.Empty(t, listeners, "No socket should be used without socket activation")
+
+	listeners, err = systemdListeners("41", "1", "analytics", 42, fd)
+	require.NoError(t, err)
+	assert.Empty(t, listeners, "Sockets passed to another process should be ignored")
+
+	_, err = systemdListeners("42", "two", "", 42, fd)
+	assert.Error(t, err)
+
+	listeners, err = systemdListeners("42", "1", "analytics", 42, fd)
+	require.NoError(t, err)
+	require.Len(t, listeners["analytics"], 1, "Sockets should be keyed by their name")
+	defer listeners["analytics"][0].Close()
+	assert.Equal(t, socket.Addr().String(), listeners["analytics"][0].Addr().String())
+
+	conn, err := net.Dial("tcp", socket.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	accepted, err := listeners["analytics"][0].Accept()
+	require.NoError(t, err, "The socket passed by systemd should accept connections")
+	accepted.Close()
+}
@@ -7,17 +7,20 @@ import (
 	"pgbouncer-quota-enforcer/internal/app/domain"
 	"pgbouncer-quota-enforcer/pkg/logger"
 	"sync"
+	"sync/atomic"
 )
 
 // StandardTCPServer implements domain.TCPServer
 type StandardTCPServer struct {
 	handler   domain.ConnectionHandler
 	logger    logger.Logger
-	listener  net.Listener
+	listeners []domain.Listener
 	wg        sync.WaitGroup
 	mu        sync.RWMutex
-	address   string
 	isRunning bool
+	draining  bool // the listener is closed but the server is not stopped yet
+	started   chan struct{}
+	open      atomic.Int64 // connections being handled
 }
 
 // NewStandardTCPServer creates a new StandardTCPServer
@@ -25,33 +28,55 @@ func NewStandardTCPServer(handler domain.ConnectionHandler, log logger.Logger) d
 	return &StandardTCPServer{
 		handler: handler,
 		logger:  log,
+		started: make(chan struct{}),
 	}
 }
 
 // Start begins listening for TCP connections on the specified address
 func (s *StandardTCPServer) Start(ctx context.Context, address string) error {
+	// Create TCP listener
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+	if err := s.Serve(ctx, []domain.Listener{{Listener: listener}}); err != nil {
+		_ = listener.Close()
+		return err
+	}
+	return nil
+}
+
+// Serve begins accepting TCP connections on listeners, one accept loop each
+func (s *StandardTCPServer) Serve(ctx context.Context, listeners []domain.Listener) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.isRunning {
 		return fmt.Errorf("server is already running")
 	}
-
-	// Create TCP listener
-	listener, err := net.Listen("tcp", address)
-	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", address, err)
+	if len(listeners) == 0 {
+		return fmt.Errorf("no listener to serve")
 	}
 
-	s.listener = listener
-	s.address = listener.Addr().String()
+	s.listeners = listeners
 	s.isRunning = true
+	s.draining = false
 
-	s.logger.Info("TCP server started", "address", s.address)
+	for _, listener := range listeners {
+		if listener.Name == "" {
+			s.logger.Info("TCP server started on %s", listener.Listener.Addr())
+		} else {
+			s.logger.Info("TCP server started listener %s on %s", listener.Name, listener.Listener.Addr())
+		}
+	}
 
-	// Start accepting connections in a goroutine
-	s.wg.Add(1)
-	go s.acceptConnections(ctx)
+	// Start accepting connections in goroutines; the listeners are already bound
+	// so connections queue in their backlog until the loops run
+	for _, listener := range listeners {
+		s.wg.Add(1)
+		go s.acceptConnections(domain.WithListenerName(ctx, listener.Name), listener.Listener)
+	}
+	close(s.started)
 
 	return nil
 }
@@ -59,24 +84,77 @@ func (s *StandardTCPServer) Start(ctx context.Context, address string) error {
 // Stop gracefully shuts down the server
 func (s *StandardTCPServer) Stop(ctx context.Context) error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
 	if !s.isRunning {
+		s.mu.Unlock()
 		return nil
 	}
 
 	s.logger.Info("Stopping TCP server")
 
-	// Close listener to stop accepting new connections
-	if s.listener != nil {
-		if err := s.listener.Close(); err != nil {
-			s.logger.Error("Error closing listener: %v", err)
-		}
+	// Close listeners to stop accepting new connections, unless a drain already did
+	if !s.draining {
+		s.closeListeners()
 	}
 
 	s.isRunning = false
+	s.draining = false
+	s.started = make(chan struct{})
+
+	// Release the lock before waiting so the accept loop can observe the stopped state
+	s.mu.Unlock()
 
 	// Wait for all connection handlers to finish with timeout
+	if err := s.wait(ctx); err != nil {
+		s.logger.Error("Timeout waiting for connections to close")
+		return err
+	}
+	s.logger.Info("TCP server stopped gracefully")
+	return nil
+}
+
+// Drain closes the listener and, when the handler is a domain.ConnectionDrainer,
+// asks it to close its connections, then waits for them until ctx is done
+func (s *StandardTCPServer) Drain(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.isRunning {
+		s.mu.Unlock()
+		return nil
+	}
+	if !s.draining {
+		s.logger.Info("Draining TCP server with %d connections", s.open.Load())
+		s.draining = true
+		s.closeListeners()
+	}
+	s.mu.Unlock()
+
+	if drainer, ok := s.handler.(domain.ConnectionDrainer); ok {
+		drainer.Drain()
+	}
+	if err := s.wait(ctx); err != nil {
+		s.logger.Error("Timeout waiting for %d connections to drain", s.open.Load())
+		return err
+	}
+	s.logger.Info("TCP server drained")
+	return nil
+}
+
+// closeListeners closes every listener; the caller holds the lock
+func (s *StandardTCPServer) closeListeners() {
+	for _, listener := range s.listeners {
+		if err := listener.Listener.Close(); err != nil {
+			s.logger.Error("Error closing listener: %v", err)
+		}
+	}
+}
+
+// OpenConnections returns how many connections are being handled
+func (s *StandardTCPServer) OpenConnections() int {
+	return int(s.open.Load())
+}
+
+// wait blocks until the accept loop and every connection handler have returned, or ctx is done
+func (s *StandardTCPServer) wait(ctx context.Context) error {
 	done := make(chan struct{})
 	go func() {
 		s.wg.Wait()
@@ -85,28 +163,48 @@ func (s *StandardTCPServer) Stop(ctx context.Context) error {
 
 	select {
 	case <-done:
-		s.logger.Info("TCP server stopped gracefully")
 		return nil
 	case <-ctx.Done():
-		s.logger.Error("Timeout waiting for connections to close")
 		return ctx.Err()
 	}
 }
 
-// Address returns the address the server is listening on
+// Address returns the address the server is listening on, that of its first
+// listener when it has several
 func (s *StandardTCPServer) Address() string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.address
+	if len(s.listeners) == 0 {
+		return ""
+	}
+	return s.listeners[0].Listener.Addr().String()
+}
+
+// Addresses returns the address of every listener by name
+func (s *StandardTCPServer) Addresses() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	addresses := make(map[string]string, len(s.listeners))
+	for _, listener := range s.listeners {
+		addresses[listener.Name] = listener.Listener.Addr().String()
+	}
+	return addresses
+}
+
+// Started returns a channel that is closed once the server accepts connections
+func (s *StandardTCPServer) Started() <-chan struct{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.started
 }
 
-// acceptConnections accepts incoming connections and spawns handlers
-func (s *StandardTCPServer) acceptConnections(ctx context.Context) {
+// acceptConnections accepts incoming connections on listener and spawns handlers
+func (s *StandardTCPServer) acceptConnections(ctx context.Context, listener net.Listener) {
 	defer s.wg.Done()
 
 	for {
 		// Accept connection with context awareness
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			select {
 			case <-ctx.Done():
@@ -115,7 +213,7 @@ func (s *StandardTCPServer) acceptConnections(ctx context.Context) {
 			default:
 				// Check if server is still running
 				s.mu.RLock()
-				isRunning := s.isRunning
+				isRunning := s.isRunning && !s.draining
 				s.mu.RUnlock()
 
 				if !isRunning {
@@ -130,8 +228,10 @@ func (s *StandardTCPServer) acceptConnections(ctx context.Context) {
 
 		// Handle connection in a separate goroutine
 		s.wg.Add(1)
+		s.open.Add(1)
 		go func(c net.Conn) {
 			defer s.wg.Done()
+			defer s.open.Add(-1)
 
 			if err := s.handler.HandleConnection(ctx, c); err != nil {
 				s.logger.Error("Error handling connection: %v", err)
@@ -0,0 +1,144 @@
+package adapters
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStandardTCPServer_EphemeralPort(t *testing.T) {
+	accepted := make(chan struct{}, 1)
+	handler := mocks.ConnectionHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+		accepted <- struct{}{}
+		return conn.Close()
+	})
+
+	server := NewStandardTCPServer(handler, logger.NewSimpleLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, server.Start(ctx, "127.0.0.1:0"))
+
+	_, port, err := net.SplitHostPort(server.Address())
+	require.NoError(t, err)
+	assert.NotEqual(t, "0", port, "Address should be resolved before Start returns")
+
+	select {
+	case <-server.Started():
+	case <-time.After(time.Second):
+		t.Fatal("Started channel was not closed")
+	}
+
+	conn, err := net.Dial("tcp", server.Address())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("Connection was not handled")
+	}
+
+	assert.Error(t, server.Start(ctx, "127.0.0.1:0"), "Starting twice should fail")
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), time.Second)
+	defer stopCancel()
+	require.NoError(t, server.Stop(stopCtx))
+
+	select {
+	case <-server.Started():
+		t.Fatal("Started channel should be reset after Stop")
+	default:
+	}
+}
+
+func TestStandardTCPServer_Drain(t *testing.T) {
+	release := make(chan struct{})
+	handler := mocks.ConnectionHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+		<-release
+		return conn.Close()
+	})
+
+	server := NewStandardTCPServer(handler, logger.NewSimpleLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, server.Start(ctx, "127.0.0.1:0"))
+
+	conn, err := net.Dial("tcp", server.Address())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool { return server.OpenConnections() == 1 }, time.Second, time.Millisecond)
+
+	// The drain waits for the open connection and gives up at its deadline
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer drainCancel()
+	assert.ErrorIs(t, server.Drain(drainCtx), context.DeadlineExceeded)
+
+	_, err = net.DialTimeout("tcp", server.Address(), time.Second)
+	assert.Error(t, err, "New connections are refused while draining")
+
+	close(release)
+	drainCtx, drainCancel = context.WithTimeout(context.Background(), time.Second)
+	defer drainCancel()
+	require.NoError(t, server.Drain(drainCtx))
+	assert.Zero(t, server.OpenConnections())
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), time.Second)
+	defer stopCancel()
+	require.NoError(t, server.Stop(stopCtx))
+}
+
+func TestStandardTCPServer_Listeners(t *testing.T) {
+	accepted := make(chan string, 2)
+	handler := mocks.ConnectionHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+		accepted <- domain.ListenerName(ctx)
+		return conn.Close()
+	})
+
+	var listeners []domain.Listener
+	for _, name := range []string{"", "analytics"} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners = append(listeners, domain.Listener{Name: name, Listener: listener})
+	}
+
+	server := NewStandardTCPServer(handler, logger.NewSimpleLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, server.Serve(ctx, listeners))
+	<-server.Started()
+
+	addresses := server.Addresses()
+	assert.Len(t, addresses, 2)
+	assert.Equal(t, addresses[""], server.Address(), "The first listener should be the address of the server")
+
+	for _, name := range []string{"analytics", ""} {
+		conn, err := net.Dial("tcp", addresses[name])
+		require.NoError(t, err)
+		defer conn.Close()
+
+		select {
+		case listener := <-accepted:
+			assert.Equal(t, name, listener, "Connections should be handled with the name of their listener")
+		case <-time.After(time.Second):
+			t.Fatal("Connection was not handled")
+		}
+	}
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), time.Second)
+	defer stopCancel()
+	require.NoError(t, server.Stop(stopCtx))
+	for _, address := range addresses {
+		_, err := net.Dial("tcp", address)
+		assert.Error(t, err, "Every listener should be closed on Stop")
+	}
+}
@@ -0,0 +1,140 @@
+package adapters
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// LoadServerTLSConfig builds the TLS configuration used to terminate client
+// connections from a PEM certificate and key. When caFile is set, clients that
+// present a certificate must present one signed by those CAs.
+func LoadServerTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// loadCertPool reads the PEM certificates of a CA bundle
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in CA file %s", caFile)
+	}
+	return pool, nil
+}
+
+// UpstreamTLSMode selects how the upstream leg of proxied connections is
+// encrypted, following libpq's sslmode
+type UpstreamTLSMode string
+
+const (
+	// UpstreamTLSDisable connects to upstreams in plaintext
+	UpstreamTLSDisable UpstreamTLSMode = "disable"
+	// UpstreamTLSRequire encrypts the connection without verifying the upstream's certificate
+	UpstreamTLSRequire UpstreamTLSMode = "require"
+	// UpstreamTLSVerifyCA also checks that the certificate was signed by a trusted CA
+	UpstreamTLSVerifyCA UpstreamTLSMode = "verify-ca"
+	// UpstreamTLSVerifyFull also checks that the certificate matches the upstream's host name
+	UpstreamTLSVerifyFull UpstreamTLSMode = "verify-full"
+)
+
+// ParseUpstreamTLSMode parses an sslmode name; an empty name disables TLS
+func ParseUpstreamTLSMode(name string) (UpstreamTLSMode, error) {
+	switch mode := UpstreamTLSMode(name); mode {
+	case "":
+		return UpstreamTLSDisable, nil
+	case UpstreamTLSDisable, UpstreamTLSRequire, UpstreamTLSVerifyCA, UpstreamTLSVerifyFull:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown upstream TLS mode %q: use disable, require, verify-ca or verify-full", name)
+	}
+}
+
+// LoadUpstreamTLSConfig builds the TLS configuration used to connect to upstreams,
+// or nil when mode disables TLS. Certificates are verified against the CAs of
+// caFile, or the system roots when it is empty. certFile and keyFile, when set,
+// hold the client certificate presented to upstreams that ask for one. The server
+// name checked by verify-full and sent as SNI defaults to the host dialed.
+func LoadUpstreamTLSConfig(mode UpstreamTLSMode, caFile, certFile, keyFile string) (*tls.Config, error) {
+	if mode == UpstreamTLSDisable || mode == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	switch mode {
+	case UpstreamTLSRequire:
+		config.InsecureSkipVerify = true
+	case UpstreamTLSVerifyCA:
+		// The standard verification always checks the host name, so the chain is
+		// verified by hand instead
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = verifyChain(config.RootCAs)
+	case UpstreamTLSVerifyFull:
+	default:
+		return nil, fmt.Errorf("unknown upstream TLS mode %q", mode)
+	}
+	return config, nil
+}
+
+// verifyChain checks that the peer certificate chains up to roots, or the system
+// roots when nil, regardless of the names it was issued for
+func verifyChain(roots *x509.CertPool) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("upstream presented no certificate")
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to verify upstream certificate: %w", err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,260 @@
+package adapters
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificate is a self-signed certificate for localhost written to PEM files
+type testCertificate struct {
+	certFile string
+	keyFile  string
+	pool     *x509.CertPool
+}
+
+// writeTestCertificate generates a self-signed certificate valid for localhost and 127.0.0.1
+func writeTestCertificate(t *testing.T) testCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	cert := testCertificate{
+		certFile: filepath.Join(dir, "server.crt"),
+		keyFile:  filepath.Join(dir, "server.key"),
+		pool:     x509.NewCertPool(),
+	}
+	require.NoError(t, os.WriteFile(cert.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(cert.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	parsed, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	cert.pool.AddCert(parsed)
+	return cert
+}
+
+// sslRequest is the startup packet asking the server to negotiate TLS
+var sslRequest = []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+
+func TestLoadServerTLSConfig(t *testing.T) {
+	cert := writeTestCertificate(t)
+
+	config, err := LoadServerTLSConfig(cert.certFile, cert.keyFile, "")
+	require.NoError(t, err)
+	assert.Len(t, config.Certificates, 1)
+	assert.Equal(t, tls.NoClientCert, config.ClientAuth)
+
+	config, err = LoadServerTLSConfig(cert.certFile, cert.keyFile, cert.certFile)
+	require.NoError(t, err)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, config.ClientAuth)
+	assert.NotNil(t, config.ClientCAs)
+
+	_, err = LoadServerTLSConfig(cert.certFile, cert.keyFile, cert.keyFile)
+	assert.Error(t, err, "A CA file without certificates should be rejected")
+
+	_, err = LoadServerTLSConfig(filepath.Join(t.TempDir(), "missing.crt"), cert.keyFile, "")
+	assert.Error(t, err)
+}
+
+func TestPostgreSQLConnectionHandler_TLS(t *testing.T) {
+	cert := writeTestCertificate(t)
+	tlsConfig, err := LoadServerTLSConfig(cert.certFile, cert.keyFile, "")
+	require.NoError(t, err)
+
+	engine := &mocks.StaticPolicyEngine{}
+	queryLogger := mocks.NewRecordingQueryLogger()
+	handler := NewPostgreSQLConnectionHandler(queryLogger, NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithTLS(tlsConfig), WithRequiredTLS("alice"))
+	addr := startHandler(t, handler)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write(sslRequest)
+	require.NoError(t, err)
+	reply := make([]byte, 1)
+	_, err = conn.Read(reply)
+	require.NoError(t, err)
+	require.Equal(t, byte('S'), reply[0])
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "localhost", RootCAs: cert.pool})
+	require.NoError(t, tlsConn.Handshake())
+
+	frontend := pgproto3.NewFrontend(tlsConn, tlsConn)
+	frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice", "database": "app"},
+	})
+	frontend.Send(&pgproto3.Query{String: "SELECT 1"})
+	require.NoError(t, frontend.Flush())
+
+	require.Eventually(t, func() bool { return len(engine.Queries()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "alice", engine.Queries()[0].UserID)
+
+	sessions := queryLogger.Sessions()
+	require.Len(t, sessions, 1)
+	assert.True(t, sessions[0].TLS)
+}
+
+func TestPostgreSQLConnectionHandler_RequiredTLS(t *testing.T) {
+	cert := writeTestCertificate(t)
+	tlsConfig, err := LoadServerTLSConfig(cert.certFile, cert.keyFile, "")
+	require.NoError(t, err)
+
+	engine := &mocks.StaticPolicyEngine{}
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithTLS(tlsConfig), WithRequiredTLS("alice"))
+	addr := startHandler(t, handler)
+
+	_, err = testkit.Dial(addr, testkit.ClientConfig{User: "alice", Database: "app"})
+
+	var serverErr *testkit.ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, "FATAL", serverErr.Severity)
+	assert.Equal(t, "28000", serverErr.Code)
+	assert.Equal(t, `SSL connection is required for user "alice"`, serverErr.Message)
+
+	// Other users may still connect in plaintext
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	frontend := pgproto3.NewFrontend(conn, conn)
+	frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "bob"},
+	})
+	frontend.Send(&pgproto3.Query{String: "SELECT 1"})
+	require.NoError(t, frontend.Flush())
+
+	require.Eventually(t, func() bool { return len(engine.Queries()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "bob", engine.Queries()[0].UserID)
+}
+
+func TestLoadUpstreamTLSConfig(t *testing.T) {
+	cert := writeTestCertificate(t)
+
+	config, err := LoadUpstreamTLSConfig(UpstreamTLSDisable, cert.certFile, "", "")
+	require.NoError(t, err)
+	assert.Nil(t, config, "Disabled TLS should need no configuration")
+
+	config, err = LoadUpstreamTLSConfig(UpstreamTLSRequire, "", "", "")
+	require.NoError(t, err)
+	assert.True(t, config.InsecureSkipVerify)
+
+	config, err = LoadUpstreamTLSConfig(UpstreamTLSVerifyCA, cert.certFile, "", "")
+	require.NoError(t, err)
+	assert.True(t, config.InsecureSkipVerify, "verify-ca should not check the host name")
+	assert.NotNil(t, config.VerifyConnection)
+
+	config, err = LoadUpstreamTLSConfig(UpstreamTLSVerifyFull, cert.certFile, cert.certFile, cert.keyFile)
+	require.NoError(t, err)
+	assert.False(t, config.InsecureSkipVerify)
+	assert.NotNil(t, config.RootCAs)
+	assert.Len(t, config.Certificates, 1)
+
+	_, err = LoadUpstreamTLSConfig(UpstreamTLSVerifyFull, cert.keyFile, "", "")
+	assert.Error(t, err)
+
+	_, err = ParseUpstreamTLSMode("prefer")
+	assert.Error(t, err)
+}
+
+func TestPostgreSQLConnectionHandler_UpstreamTLS(t *testing.T) {
+	serverCert := writeTestCertificate(t)
+	clientCert := writeTestCertificate(t)
+	otherCA := writeTestCertificate(t)
+
+	tests := []struct {
+		name       string
+		mode       UpstreamTLSMode
+		caFile     string
+		serverName string
+		plaintext  bool
+		wantErr    bool
+	}{
+		{name: "verify-full against the dialed address", mode: UpstreamTLSVerifyFull, caFile: serverCert.certFile},
+		{name: "verify-full with SNI", mode: UpstreamTLSVerifyFull, caFile: serverCert.certFile, serverName: "localhost"},
+		{name: "verify-full with a mismatched name", mode: UpstreamTLSVerifyFull, caFile: serverCert.certFile, serverName: "db.example.com", wantErr: true},
+		{name: "verify-ca ignores the name", mode: UpstreamTLSVerifyCA, caFile: serverCert.certFile, serverName: "db.example.com"},
+		{name: "verify-ca with an untrusted CA", mode: UpstreamTLSVerifyCA, caFile: otherCA.certFile, wantErr: true},
+		{name: "require skips verification", mode: UpstreamTLSRequire, caFile: otherCA.certFile},
+		{name: "upstream without TLS", mode: UpstreamTLSRequire, plaintext: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := testkit.StartFakeBackend(t)
+			if !tt.plaintext {
+				serverConfig, err := LoadServerTLSConfig(serverCert.certFile, serverCert.keyFile, clientCert.certFile)
+				require.NoError(t, err)
+				serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+				backend.EnableTLS(serverConfig)
+			}
+
+			upstreamTLS, err := LoadUpstreamTLSConfig(tt.mode, tt.caFile, clientCert.certFile, clientCert.keyFile)
+			require.NoError(t, err)
+			upstreamTLS.ServerName = tt.serverName
+
+			handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+				WithUpstreams(upstreamSelector(backend.Addr())), WithUpstreamTLS(upstreamTLS))
+			addr := startHandler(t, handler)
+
+			client, err := testkit.Dial(addr, testkit.ClientConfig{User: "alice", Database: "app"})
+			if tt.wantErr {
+				var serverErr *testkit.ServerError
+				require.ErrorAs(t, err, &serverErr)
+				assert.Equal(t, pgerrConnectionFailure, serverErr.Code)
+				return
+			}
+			require.NoError(t, err)
+			defer client.Close()
+
+			_, err = client.Query("SELECT 1")
+			require.NoError(t, err)
+
+			states := backend.TLSStates()
+			require.Len(t, states, 1)
+			assert.Equal(t, tt.serverName, states[0].ServerName, "SNI should carry the server name")
+			assert.Len(t, states[0].PeerCertificates, 1, "The client certificate should be presented")
+		})
+	}
+}
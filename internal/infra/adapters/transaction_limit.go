@@ -0,0 +1,248 @@
+package adapters
+
+import (
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// pgerrTransactionTimeout is the SQLSTATE PostgreSQL reports when it closes a
+// connection whose transaction ran longer than its transaction_timeout
+const pgerrTransactionTimeout = "25P04"
+
+// transactionCaps are the smallest transaction limits of a set of
+// statements, with the policies setting them
+type transactionCaps struct {
+	duration         time.Duration
+	durationPolicy   string
+	statements       int64
+	statementsPolicy string
+}
+
+// merge lowers the caps to those of other that are smaller
+func (c *transactionCaps) merge(other transactionCaps) {
+	if other.duration > 0 && (c.duration <= 0 || other.duration < c.duration) {
+		c.duration, c.durationPolicy = other.duration, other.durationPolicy
+	}
+	if other.statements > 0 && (c.statements <= 0 || other.statements < c.statements) {
+		c.statements, c.statementsPolicy = other.statements, other.statementsPolicy
+	}
+}
+
+// transactionExchange is what a Query, or the messages up to a Sync, ran: the
+// statements that count against the transaction they end up in
+type transactionExchange struct {
+	sent         time.Time
+	statements   int64
+	fingerprints []string
+	caps         transactionCaps
+}
+
+// transactionViolation is a transaction that exceeded a limit of its policies
+type transactionViolation struct {
+	code         string
+	reason       string
+	fingerprints []string // hashes of the statements the transaction ran
+}
+
+// transactionLimits closes the proxied connections whose transaction stays
+// open longer, or runs more statements, than the transaction limits of the
+// policies applying to its statements. Transactions are told apart by the
+// status of the ReadyForQuery messages the upstream sends: one starts when the
+// exchange a ReadyForQuery answers leaves the connection in a transaction,
+// from when that exchange was sent, and ends with the next ReadyForQuery
+// outside one. Each statement of a Query and each Execute count as one
+// statement, but a Query both opening and ending a transaction is not seen as
+// one, since it is answered by a single ReadyForQuery. Once a limit is exceeded,
+// kill wakes the handler, which closes the connection: the upstream connection
+// is closed as well, rolling the transaction back. Client messages are observed
+// by the handler goroutine and upstream messages by the relay goroutine.
+type transactionLimits struct {
+	clock domain.Clock
+	kill  func() // wakes the handler to close the connection
+
+	mu           sync.Mutex
+	batch        transactionExchange   // executions sent since the last Sync
+	pending      []transactionExchange // exchanges forwarded upstream, awaiting their ReadyForQuery
+	open         bool                  // the upstream is in a transaction
+	started      time.Time
+	statements   int64
+	fingerprints []string
+	caps         transactionCaps // of the statements of the transaction
+	stop         chan struct{}   // stops the timer of the transaction's duration limit
+	violation    *transactionViolation
+	exceeded     chan struct{} // closed along with violation being set
+}
+
+// newTransactionLimits creates the transaction limits of a connection, which
+// call kill once a transaction exceeds one of them
+func newTransactionLimits(clock domain.Clock, kill func()) *transactionLimits {
+	return &transactionLimits{clock: clock, kill: kill, exceeded: make(chan struct{})}
+}
+
+// observeClient counts the statements forwarded upstream, along with the
+// queries they were evaluated as, if any, and the decision taken on them
+func (t *transactionLimits) observeClient(message *ParsedMessage, queries []*domain.Query, decision domain.Decision) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch message.Message.(type) {
+	case *pgproto3.Query:
+		t.batch.add(queries, decision)
+		t.send()
+	case *pgproto3.Execute:
+		t.batch.add(queries, decision)
+	case *pgproto3.Sync:
+		t.send()
+	}
+}
+
+// send queues the exchange ended by a Query or Sync; t.mu must be held
+func (t *transactionLimits) send() {
+	t.batch.sent = t.clock.Now()
+	t.pending = append(t.pending, t.batch)
+	t.batch = transactionExchange{}
+}
+
+// add counts the statements of a message of the exchange: its queries, or one
+// when it was evaluated as none
+func (e *transactionExchange) add(queries []*domain.Query, decision domain.Decision) {
+	e.statements += max(int64(len(queries)), 1)
+	for _, query := range queries {
+		if query == nil {
+			continue
+		}
+		if hash := query.Hash.String(); hash != "" && !slices.Contains(e.fingerprints, hash) {
+			e.fingerprints = append(e.fingerprints, hash)
+		}
+	}
+	e.caps.merge(transactionCaps{
+		duration:         decision.MaxTransactionDuration,
+		durationPolicy:   decision.TransactionDurationPolicy,
+		statements:       decision.MaxTransactionStatements,
+		statementsPolicy: decision.TransactionStatementsPolicy,
+	})
+}
+
+// observeUpstream follows the transaction status of a ReadyForQuery relayed
+// from the upstream
+func (t *transactionLimits) observeUpstream(msg pgproto3.BackendMessage) {
+	ready, ok := msg.(*pgproto3.ReadyForQuery)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var exchange transactionExchange
+	if len(t.pending) > 0 {
+		exchange = t.pending[0]
+		t.pending = t.pending[1:]
+	}
+	if domain.TransactionStatus(ready.TxStatus) == domain.TransactionIdle {
+		t.end()
+		return
+	}
+
+	if !t.open {
+		t.open = true
+		t.started = exchange.sent
+		if t.started.IsZero() {
+			t.started = t.clock.Now()
+		}
+	}
+	t.statements += exchange.statements
+	for _, hash := range exchange.fingerprints {
+		if !slices.Contains(t.fingerprints, hash) {
+			t.fingerprints = append(t.fingerprints, hash)
+		}
+	}
+	duration := t.caps.duration
+	t.caps.merge(exchange.caps)
+
+	if limit := t.caps.statements; limit > 0 && t.statements > limit {
+		t.violate(pgerrQuotaExceeded, fmt.Sprintf("terminating connection due to transaction statement limit: quota %q limits transactions to %d statements",
+			t.caps.statementsPolicy, limit))
+		return
+	}
+	if t.caps.duration != duration {
+		t.arm()
+	}
+}
+
+// arm times the transaction against its duration limit, in place of a longer
+// limit it was timed against; t.mu must be held
+func (t *transactionLimits) arm() {
+	if t.stop != nil {
+		close(t.stop)
+	}
+	limit, policy := t.caps.duration, t.caps.durationPolicy
+	reason := fmt.Sprintf("terminating connection due to transaction timeout: quota %q limits transactions to %s", policy, limit)
+	remaining := limit - t.clock.Now().Sub(t.started)
+	if remaining <= 0 {
+		t.stop = nil
+		t.violate(pgerrTransactionTimeout, reason)
+		return
+	}
+
+	stop := make(chan struct{})
+	t.stop = stop
+	timer := t.clock.NewTimer(remaining)
+	go func() {
+		select {
+		case <-timer.C():
+			t.mu.Lock()
+			if t.stop == stop {
+				t.violate(pgerrTransactionTimeout, reason)
+			}
+			t.mu.Unlock()
+		case <-stop:
+			timer.Stop()
+		}
+	}()
+}
+
+// violate records the first limit the transaction exceeded and wakes the
+// handler; t.mu must be held
+func (t *transactionLimits) violate(code, reason string) {
+	if t.violation != nil {
+		return
+	}
+	t.violation = &transactionViolation{code: code, reason: reason, fingerprints: slices.Clone(t.fingerprints)}
+	close(t.exceeded)
+	go t.kill()
+}
+
+// end forgets the transaction that ended; t.mu must be held
+func (t *transactionLimits) end() {
+	if t.stop != nil {
+		close(t.stop)
+		t.stop = nil
+	}
+	t.open = false
+	t.started = time.Time{}
+	t.statements = 0
+	t.fingerprints = nil
+	t.caps = transactionCaps{}
+}
+
+// violated returns the limit a transaction exceeded, once exceeded is closed
+func (t *transactionLimits) violated() *transactionViolation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.violation
+}
+
+// close stops the timer of the transaction still open
+func (t *transactionLimits) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stop != nil {
+		close(t.stop)
+		t.stop = nil
+	}
+}
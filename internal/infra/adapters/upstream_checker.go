@@ -0,0 +1,82 @@
+package adapters
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// TCPUpstreamChecker implements domain.UpstreamChecker by opening a TCP
+// connection to the target, which tells a host that is down from one that is up
+// but says nothing of the server behind the port
+type TCPUpstreamChecker struct {
+	Timeout time.Duration
+}
+
+// Check connects to the target at address and closes the connection
+func (c TCPUpstreamChecker) Check(ctx context.Context, address string) error {
+	return ProbeUpstream(ctx, address, c.Timeout)
+}
+
+// QueryUpstreamChecker implements domain.UpstreamChecker by logging in to the
+// target and running SELECT 1 over the simple query protocol, so that a server
+// refusing logins or too busy to answer fails the check
+type QueryUpstreamChecker struct {
+	config  *pgconn.Config
+	timeout time.Duration
+}
+
+// NewQueryUpstreamChecker creates a checker logging in with the user, password
+// and database of connString, such as postgres://health@/postgres; its host is
+// replaced by the address of each target. Connections are encrypted with
+// tlsConfig, as the upstream's are, and plaintext when it is nil.
+func NewQueryUpstreamChecker(connString string, timeout time.Duration, tlsConfig *tls.Config) (*QueryUpstreamChecker, error) {
+	config, err := pgconn.ParseConfig(connString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream health check URL: %w", err)
+	}
+	config.ConnectTimeout = timeout
+	config.TLSConfig = tlsConfig
+	config.Fallbacks = nil
+	return &QueryUpstreamChecker{config: config, timeout: timeout}, nil
+}
+
+// Check logs in to the target at address and runs SELECT 1
+func (c *QueryUpstreamChecker) Check(ctx context.Context, address string) error {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid upstream address %s: %w", address, err)
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid upstream address %s: %w", address, err)
+	}
+
+	config := c.config.Copy()
+	config.Host = host
+	config.Port = uint16(port)
+	if config.TLSConfig != nil && config.TLSConfig.ServerName == "" {
+		config.TLSConfig.ServerName = host
+	}
+
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	conn, err := pgconn.ConnectConfig(ctx, config)
+	if err != nil {
+		return fmt.Errorf("failed to log in to upstream %s: %w", address, err)
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "SELECT 1").ReadAll(); err != nil {
+		return fmt.Errorf("upstream %s failed to answer: %w", address, err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package adapters
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryUpstreamChecker(t *testing.T) {
+	ctx := context.Background()
+	backend := testkit.StartFakeBackend(t)
+	backend.RequirePassword("secret")
+
+	checker, err := NewQueryUpstreamChecker("postgres://health:secret@/postgres", time.Second, nil)
+	require.NoError(t, err)
+	require.NoError(t, checker.Check(ctx, backend.Addr()))
+	require.Eventually(t, func() bool {
+		return len(backend.Queries()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "SELECT 1", backend.Queries()[0])
+	assert.Equal(t, "health", backend.StartupParameters()[0]["user"])
+
+	wrong, err := NewQueryUpstreamChecker("postgres://health:wrong@/postgres", time.Second, nil)
+	require.NoError(t, err)
+	assert.Error(t, wrong.Check(ctx, backend.Addr()), "A refused login should fail the check")
+
+	backend.Handle("SELECT 1", testkit.Result{Err: &testkit.ServerError{Code: "57P03", Message: "the database system is starting up"}})
+	assert.ErrorContains(t, checker.Check(ctx, backend.Addr()), "failed to answer")
+}
+
+func TestTCPUpstreamChecker(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+
+	checker := TCPUpstreamChecker{Timeout: time.Second}
+	assert.NoError(t, checker.Check(context.Background(), address))
+
+	require.NoError(t, listener.Close())
+	assert.Error(t, checker.Check(context.Background(), address))
+}
@@ -0,0 +1,162 @@
+package adapters
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// upstreamConnection is the server leg of a proxied client connection, or of
+// the clients it is assigned to in turn when pooled. Messages are sent from the
+// handler goroutine and received by the relay goroutine.
+type upstreamConnection struct {
+	address   string
+	tlsConfig *tls.Config // nil for plaintext connections
+	conn      net.Conn
+	frontend  *pgproto3.Frontend
+	cancelKey uint32 // client-facing process ID of the backend, once its key is registered
+
+	// Set by the relay goroutine before it stops because the upstream closed the
+	// connection, rather than the client
+	lost  bool
+	fatal *pgproto3.ErrorResponse // FATAL error held back from the client for a reconnect
+
+	// Pooled connections are logged in by the enforcer and shared by clients
+	backend    pgproto3.BackendKeyData // key of the upstream backend, for cancel requests
+	parameters map[string]string       // reported by the upstream at login
+	idleSince  time.Time               // when it was last released to its pool
+}
+
+// dialUpstream opens a TCP connection to the upstream at address. With a TLS
+// config the connection is encrypted before anything else is sent, and upstreams
+// declining the SSLRequest are rejected.
+func dialUpstream(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (*upstreamConnection, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to upstream %s: %w", address, err)
+	}
+
+	if tlsConfig != nil {
+		conn, err = startUpstreamTLS(ctx, conn, address, timeout, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &upstreamConnection{
+		address:   address,
+		tlsConfig: tlsConfig,
+		conn:      conn,
+		frontend:  pgproto3.NewFrontend(conn, conn),
+	}, nil
+}
+
+// targetTLSConfig returns the TLS config to dial target with: tlsConfig, with
+// the server name of the target when it has one
+func targetTLSConfig(tlsConfig *tls.Config, target domain.UpstreamTarget) *tls.Config {
+	if tlsConfig == nil || target.ServerName == "" || target.ServerName == tlsConfig.ServerName {
+		return tlsConfig
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.ServerName = target.ServerName
+	return tlsConfig
+}
+
+// ProbeUpstream opens a TCP connection to the upstream at address and closes it,
+// reporting whether the upstream is reachable within timeout
+func ProbeUpstream(ctx context.Context, address string, timeout time.Duration) error {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to upstream %s: %w", address, err)
+	}
+	return conn.Close()
+}
+
+// startUpstreamTLS sends an SSLRequest and performs the TLS handshake once the
+// upstream accepts it. The connection is closed on failure.
+func startUpstreamTLS(ctx context.Context, conn net.Conn, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	fail := func(err error) (net.Conn, error) {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return fail(fmt.Errorf("failed to set upstream deadline: %w", err))
+	}
+
+	request, err := (&pgproto3.SSLRequest{}).Encode(nil)
+	if err != nil {
+		return fail(fmt.Errorf("failed to encode SSLRequest: %w", err))
+	}
+	if _, err := conn.Write(request); err != nil {
+		return fail(fmt.Errorf("failed to send SSLRequest to upstream %s: %w", address, err))
+	}
+
+	reply := make([]byte, 1)
+	if _, err := conn.Read(reply); err != nil {
+		return fail(fmt.Errorf("failed to read SSLRequest reply from upstream %s: %w", address, err))
+	}
+	if reply[0] != 'S' {
+		return fail(fmt.Errorf("upstream %s does not accept TLS connections", address))
+	}
+
+	// Send SNI and check the certificate against the dialed host unless a server
+	// name is configured
+	config := tlsConfig
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return fail(fmt.Errorf("invalid upstream address %s: %w", address, err))
+		}
+		config = tlsConfig.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return fail(fmt.Errorf("TLS handshake with upstream %s failed: %w", address, err))
+	}
+	return tlsConn, nil
+}
+
+// Send writes a message to the upstream and flushes it
+func (u *upstreamConnection) Send(msg pgproto3.FrontendMessage) error {
+	u.frontend.Send(msg)
+	if err := u.frontend.Flush(); err != nil {
+		return fmt.Errorf("failed to send to upstream %s: %w", u.address, err)
+	}
+	return nil
+}
+
+// Receive reads the next message from the upstream. The message is only valid
+// until the next call to Receive.
+func (u *upstreamConnection) Receive() (pgproto3.BackendMessage, error) {
+	msg, err := u.frontend.Receive()
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive from upstream %s: %w", u.address, err)
+	}
+	return msg, nil
+}
+
+// Buffered reports whether more upstream messages are already buffered, so
+// writes to the client can be batched until the buffer drains
+func (u *upstreamConnection) Buffered() bool {
+	return u.frontend.ReadBufferLen() > 0
+}
+
+// AuthType returns the authentication exchange requested by the upstream
+func (u *upstreamConnection) AuthType() uint32 {
+	return u.frontend.GetAuthType()
+}
+
+// Close closes the upstream connection
+func (u *upstreamConnection) Close() error {
+	return u.conn.Close()
+}
@@ -0,0 +1,297 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// PoolMode selects when a pooled upstream connection goes back to its pool
+type PoolMode string
+
+const (
+	// PoolModeSession assigns an upstream connection to a client until it disconnects
+	PoolModeSession PoolMode = "session"
+	// PoolModeTransaction assigns an upstream connection to a client until its
+	// transaction ends, so that idle clients hold none
+	PoolModeTransaction PoolMode = "transaction"
+)
+
+// ParsePoolMode parses a pooling mode name; an empty name disables pooling
+func ParsePoolMode(name string) (PoolMode, error) {
+	switch mode := PoolMode(name); mode {
+	case "", PoolModeSession, PoolModeTransaction:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown pool mode %q: use session or transaction", name)
+	}
+}
+
+const (
+	// DefaultPoolSize is how many upstream connections each pool may open, like
+	// PgBouncer's default_pool_size
+	DefaultPoolSize = 20
+
+	// DefaultPoolWaitTimeout bounds how long a client waits for a connection of a full pool
+	DefaultPoolWaitTimeout = 30 * time.Second
+
+	// poolIdleLifetime is how long a connection may stay idle in its pool before it
+	// is closed, so that upstreams do not time it out first
+	poolIdleLifetime = 10 * time.Minute
+)
+
+var (
+	// errPoolTimeout reports that no connection of a full pool was released in time
+	errPoolTimeout = errors.New("timed out waiting for a pooled upstream connection")
+
+	// errPoolClosed reports that the pool was closed
+	errPoolClosed = errors.New("upstream pool is closed")
+
+	// errNoUpstream reports that no upstream target was available to dial
+	errNoUpstream = errors.New("no upstream available")
+)
+
+// PoolSize overrides the size of the pools of a user and database; empty fields
+// match any
+type PoolSize struct {
+	User     string
+	Database string
+	Size     int
+}
+
+// poolKey identifies the pool of a listener, user and database
+type poolKey struct {
+	listener string
+	user     string
+	database string
+}
+
+// serverPool holds the upstream connections of one pool key
+type serverPool struct {
+	size    int
+	open    int                        // dialed and not closed, idle or assigned
+	idle    []*upstreamConnection      // least recently released first
+	waiters []chan *upstreamConnection // clients waiting for a connection, in arrival order
+}
+
+// UpstreamPool keeps upstream connections open between the clients using them,
+// in one pool per listener, user and database, as PgBouncer does
+type UpstreamPool struct {
+	mode        PoolMode
+	size        int
+	sizes       []PoolSize
+	waitTimeout time.Duration
+
+	mu     sync.Mutex
+	pools  map[poolKey]*serverPool
+	closed bool
+}
+
+// UpstreamPoolOption configures optional behavior of an UpstreamPool
+type UpstreamPoolOption func(*UpstreamPool)
+
+// WithPoolSizes overrides the pool size of some users and databases; the first
+// matching override applies
+func WithPoolSizes(sizes ...PoolSize) UpstreamPoolOption {
+	return func(p *UpstreamPool) {
+		p.sizes = sizes
+	}
+}
+
+// WithPoolWaitTimeout bounds how long a client waits for a connection when its
+// pool is full
+func WithPoolWaitTimeout(timeout time.Duration) UpstreamPoolOption {
+	return func(p *UpstreamPool) {
+		p.waitTimeout = timeout
+	}
+}
+
+// NewUpstreamPool creates a pool in mode whose pools open at most size
+// connections each; a size below one uses DefaultPoolSize
+func NewUpstreamPool(mode PoolMode, size int, opts ...UpstreamPoolOption) *UpstreamPool {
+	if size < 1 {
+		size = DefaultPoolSize
+	}
+	pool := &UpstreamPool{
+		mode:        mode,
+		size:        size,
+		waitTimeout: DefaultPoolWaitTimeout,
+		pools:       make(map[poolKey]*serverPool),
+	}
+	for _, opt := range opts {
+		opt(pool)
+	}
+	return pool
+}
+
+// Mode returns when connections go back to the pool
+func (p *UpstreamPool) Mode() PoolMode {
+	return p.mode
+}
+
+// Close closes the idle connections; those still assigned are closed when released
+func (p *UpstreamPool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	var idle []*upstreamConnection
+	for _, pool := range p.pools {
+		idle = append(idle, pool.idle...)
+		pool.open -= len(pool.idle)
+		pool.idle = nil
+	}
+	p.mu.Unlock()
+
+	for _, conn := range idle {
+		_ = conn.Close()
+	}
+	return nil
+}
+
+// sizeOf returns how many connections the pool of user and database may open
+func (p *UpstreamPool) sizeOf(user, database string) int {
+	for _, override := range p.sizes {
+		if (override.User == "" || override.User == user) && (override.Database == "" || override.Database == database) {
+			return override.Size
+		}
+	}
+	return p.size
+}
+
+// acquire returns an idle connection of the pool of key, or one opened with dial
+// while the pool has room. When it is full, the client waits for a connection
+// to be released, up to the wait timeout.
+func (p *UpstreamPool) acquire(ctx context.Context, key poolKey, dial func(context.Context) (*upstreamConnection, error)) (*upstreamConnection, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errPoolClosed
+	}
+	pool, ok := p.pools[key]
+	if !ok {
+		pool = &serverPool{size: p.sizeOf(key.user, key.database)}
+		p.pools[key] = pool
+	}
+
+	// Connections idle for too long are dropped; they are released in order
+	now := time.Now()
+	expired := 0
+	for expired < len(pool.idle) && now.Sub(pool.idle[expired].idleSince) > poolIdleLifetime {
+		_ = pool.idle[expired].Close()
+		expired++
+	}
+	pool.idle = pool.idle[expired:]
+	pool.open -= expired
+
+	// The most recently released connection is reused first
+	if n := len(pool.idle); n > 0 {
+		conn := pool.idle[n-1]
+		pool.idle = pool.idle[:n-1]
+		p.mu.Unlock()
+		return conn, nil
+	}
+	if pool.open < pool.size {
+		pool.open++
+		p.mu.Unlock()
+		return p.open(ctx, key, dial)
+	}
+
+	wait := make(chan *upstreamConnection, 1)
+	pool.waiters = append(pool.waiters, wait)
+	p.mu.Unlock()
+
+	timer := time.NewTimer(p.waitTimeout)
+	defer timer.Stop()
+	select {
+	case conn := <-wait:
+		if conn == nil {
+			// A closed connection left its slot to this client
+			return p.open(ctx, key, dial)
+		}
+		return conn, nil
+	case <-ctx.Done():
+		p.abandon(key, wait)
+		return nil, ctx.Err()
+	case <-timer.C:
+		p.abandon(key, wait)
+		return nil, errPoolTimeout
+	}
+}
+
+// open dials a connection in a slot already counted as open, and frees the slot
+// when dialing fails
+func (p *UpstreamPool) open(ctx context.Context, key poolKey, dial func(context.Context) (*upstreamConnection, error)) (*upstreamConnection, error) {
+	conn, err := dial(ctx)
+	if err != nil {
+		p.discard(key, nil)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// abandon removes a waiter that gave up, passing on what it was handed meanwhile
+func (p *UpstreamPool) abandon(key poolKey, wait chan *upstreamConnection) {
+	p.mu.Lock()
+	pool := p.pools[key]
+	i := slices.Index(pool.waiters, wait)
+	if i >= 0 {
+		pool.waiters = slices.Delete(pool.waiters, i, i+1)
+	}
+	p.mu.Unlock()
+	if i >= 0 {
+		return
+	}
+
+	// The waiter was handed a connection or a slot just before giving up
+	if conn := <-wait; conn != nil {
+		p.release(key, conn)
+	} else {
+		p.discard(key, nil)
+	}
+}
+
+// release returns a connection that is idle and outside a transaction to its
+// pool, handing it to the longest waiting client if any
+func (p *UpstreamPool) release(key poolKey, conn *upstreamConnection) {
+	p.mu.Lock()
+	pool := p.pools[key]
+	if p.closed {
+		pool.open--
+		p.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	if len(pool.waiters) > 0 {
+		wait := pool.waiters[0]
+		pool.waiters = pool.waiters[1:]
+		p.mu.Unlock()
+		wait <- conn
+		return
+	}
+	conn.idleSince = time.Now()
+	pool.idle = append(pool.idle, conn)
+	p.mu.Unlock()
+}
+
+// discard closes a connection that cannot be reused, or frees the slot of one
+// that could not be opened when conn is nil. The slot goes to the longest
+// waiting client if any.
+func (p *UpstreamPool) discard(key poolKey, conn *upstreamConnection) {
+	if conn != nil {
+		_ = conn.Close()
+	}
+
+	p.mu.Lock()
+	pool := p.pools[key]
+	if len(pool.waiters) > 0 && !p.closed {
+		wait := pool.waiters[0]
+		pool.waiters = pool.waiters[1:]
+		p.mu.Unlock()
+		wait <- nil
+		return
+	}
+	pool.open--
+	p.mu.Unlock()
+}
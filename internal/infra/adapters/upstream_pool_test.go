@@ -0,0 +1,193 @@
+package adapters
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startPooledHandler proxies locally authenticated clients to backend through pool
+func startPooledHandler(t *testing.T, backend *testkit.FakeBackend, pool *UpstreamPool) string {
+	t.Helper()
+	backend.RequirePassword("upstream-secret")
+	userlist, err := ParseUserlist(strings.NewReader(`"alice" "alice-secret"` + "\n"))
+	require.NoError(t, err)
+
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithUpstreams(upstreamSelector(backend.Addr())), WithLocalAuth(userlist),
+		WithUpstreamCredentials("shared", "upstream-secret"), WithUpstreamPool(pool))
+	return startHandler(t, handler)
+}
+
+func TestUpstreamPool(t *testing.T) {
+	pool := NewUpstreamPool(PoolModeTransaction, 1,
+		WithPoolSizes(PoolSize{User: "etl", Size: 2}), WithPoolWaitTimeout(50*time.Millisecond))
+	defer pool.Close()
+
+	dials := 0
+	dial := func(ctx context.Context) (*upstreamConnection, error) {
+		dials++
+		client, server := net.Pipe()
+		t.Cleanup(func() { _ = server.Close() })
+		return &upstreamConnection{conn: client}, nil
+	}
+	ctx := context.Background()
+	alice := poolKey{user: "alice", database: "app"}
+
+	conn, err := pool.acquire(ctx, alice, dial)
+	require.NoError(t, err)
+	_, err = pool.acquire(ctx, alice, dial)
+	assert.ErrorIs(t, err, errPoolTimeout, "A full pool should make clients wait until the timeout")
+
+	pool.release(alice, conn)
+	reused, err := pool.acquire(ctx, alice, dial)
+	require.NoError(t, err)
+	assert.Same(t, conn, reused, "Released connections should be reused")
+	assert.Equal(t, 1, dials)
+
+	etl := poolKey{user: "etl", database: "app"}
+	for i := 0; i < 2; i++ {
+		_, err := pool.acquire(ctx, etl, dial)
+		require.NoError(t, err, "Overridden pools should open more connections")
+	}
+	assert.Equal(t, 3, dials)
+
+	// A discarded connection leaves its slot to the waiting client
+	acquired := make(chan error, 1)
+	go func() {
+		_, err := pool.acquire(ctx, alice, dial)
+		acquired <- err
+	}()
+	require.Eventually(t, func() bool {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return len(pool.pools[alice].waiters) == 1
+	}, time.Second, time.Millisecond)
+	pool.discard(alice, reused)
+	require.NoError(t, <-acquired)
+	assert.Equal(t, 4, dials)
+}
+
+func TestPostgreSQLConnectionHandler_TransactionPooling(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.SetParameter("TimeZone", "UTC")
+	addr := startPooledHandler(t, backend, NewUpstreamPool(PoolModeTransaction, 1))
+	ctx := context.Background()
+
+	first, err := connectLibpq(t, addr, "alice", "alice-secret")
+	require.NoError(t, err)
+	defer first.Close(ctx)
+	second, err := connectLibpq(t, addr, "alice", "alice-secret")
+	require.NoError(t, err)
+	defer second.Close(ctx)
+	assert.Equal(t, "UTC", second.ParameterStatus("TimeZone"), "Clients should get the parameters of the pooled connection")
+
+	for _, conn := range []*pgconn.PgConn{first, second} {
+		_, err := conn.Exec(ctx, "SELECT 1").ReadAll()
+		require.NoError(t, err)
+	}
+	require.Len(t, backend.StartupParameters(), 1, "Clients should share the connection between transactions")
+	assert.Equal(t, map[string]string{"user": "shared", "database": "app"}, backend.StartupParameters()[0])
+
+	// A client keeps the connection until its transaction ends
+	_, err = first.Exec(ctx, "BEGIN").ReadAll()
+	require.NoError(t, err)
+	done := make(chan error, 1)
+	go func() {
+		_, err := second.Exec(ctx, "SELECT 2").ReadAll()
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("The query should wait for the transaction of the other client")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, err = first.Exec(ctx, "COMMIT").ReadAll()
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+	assert.Equal(t, []string{"SELECT 1", "SELECT 1", "BEGIN", "COMMIT", "SELECT 2"}, backend.Queries())
+	assert.Len(t, backend.StartupParameters(), 1)
+}
+
+func TestPostgreSQLConnectionHandler_PoolingDatabaseRoutes(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.RequirePassword("upstream-secret")
+	userlist, err := ParseUserlist(strings.NewReader(`"alice" "alice-secret"` + "\n"))
+	require.NoError(t, err)
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithDatabaseUpstreams("reporting", "analytics_ro", upstreamSelector(backend.Addr()), nil), WithLocalAuth(userlist),
+		WithUpstreamCredentials("shared", "upstream-secret"), WithUpstreamPool(NewUpstreamPool(PoolModeTransaction, 1)))
+	addr := startHandler(t, handler)
+	ctx := context.Background()
+
+	conn, err := pgconn.Connect(ctx, "postgres://alice:alice-secret@"+addr+"/reporting?sslmode=disable")
+	require.NoError(t, err)
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, "SELECT 1").ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{{"user": "shared", "database": "analytics_ro"}}, backend.StartupParameters(),
+		"Pooled connections should be logged into the renamed database")
+}
+
+func TestPostgreSQLConnectionHandler_SessionPooling(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	addr := startPooledHandler(t, backend, NewUpstreamPool(PoolModeSession, 1))
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		conn, err := connectLibpq(t, addr, "alice", "alice-secret")
+		require.NoError(t, err)
+		_, err = conn.Exec(ctx, "SET search_path TO billing").ReadAll()
+		require.NoError(t, err)
+		require.NoError(t, conn.Close(ctx))
+	}
+
+	require.Eventually(t, func() bool { return len(backend.Queries()) == 4 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"SET search_path TO billing", "DISCARD ALL", "SET search_path TO billing", "DISCARD ALL"}, backend.Queries(),
+		"The session state should be discarded before the connection is reused")
+	assert.Len(t, backend.StartupParameters(), 1)
+}
+
+func TestPostgreSQLConnectionHandler_TransactionPoolingParameters(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	addr := startPooledHandler(t, backend, NewUpstreamPool(PoolModeTransaction, 1))
+	ctx := context.Background()
+
+	first, err := connectLibpq(t, addr, "alice", "alice-secret")
+	require.NoError(t, err)
+	defer first.Close(ctx)
+	second, err := connectLibpq(t, addr, "alice", "alice-secret")
+	require.NoError(t, err)
+	defer second.Close(ctx)
+
+	for _, step := range []struct {
+		conn  *pgconn.PgConn
+		query string
+	}{
+		{first, "SET search_path TO billing"},
+		{second, "SELECT 1"},
+		{first, "SELECT 2"},
+	} {
+		_, err := step.conn.Exec(ctx, step.query).ReadAll()
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool { return len(backend.Queries()) == 6 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{
+		"SET search_path TO billing", "RESET ALL",
+		"SELECT 1",
+		`SET "search_path" TO billing`, "SELECT 2", "RESET ALL",
+	}, backend.Queries(), "Parameters should follow the client from one pooled connection to the next")
+	assert.Len(t, backend.StartupParameters(), 1)
+}
@@ -0,0 +1,197 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	pg_query "github.com/pganalyze/pg_query_go/v6"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// sideEffectFunctions are built-in functions a SELECT may call that change
+// something, so that a query calling them is not sent again
+var sideEffectFunctions = map[string]struct{}{
+	"nextval":                             {},
+	"setval":                              {},
+	"set_config":                          {},
+	"pg_notify":                           {},
+	"pg_advisory_lock":                    {},
+	"pg_advisory_lock_shared":             {},
+	"pg_advisory_xact_lock":               {},
+	"pg_try_advisory_lock":                {},
+	"pg_try_advisory_lock_shared":         {},
+	"pg_advisory_unlock":                  {},
+	"pg_advisory_unlock_all":              {},
+	"pg_cancel_backend":                   {},
+	"pg_terminate_backend":                {},
+	"pg_reload_conf":                      {},
+	"pg_switch_wal":                       {},
+	"pg_create_restore_point":             {},
+	"pg_create_logical_replication_slot":  {},
+	"pg_create_physical_replication_slot": {},
+	"pg_drop_replication_slot":            {},
+	"lo_create":                           {},
+	"lo_import":                           {},
+	"lo_unlink":                           {},
+}
+
+// retryableQuery reports whether sending query again cannot change anything
+// its first run may have changed: every statement is a SELECT that neither
+// creates a table, locks rows, modifies data in a WITH clause nor calls a
+// built-in function with side effects, or a SHOW. Functions of the database's
+// own are assumed to only read.
+func retryableQuery(query string) bool {
+	tree, err := pgQueryParse(query)
+	if err != nil || len(tree.Stmts) == 0 {
+		return false
+	}
+	for _, raw := range tree.Stmts {
+		switch {
+		case raw.Stmt.GetVariableShowStmt() != nil:
+		case raw.Stmt.GetSelectStmt() != nil:
+			if !readOnly(raw.Stmt.ProtoReflect()) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// readOnly reports whether nothing reachable from msg writes, locks or calls a
+// function with side effects
+func readOnly(msg protoreflect.Message) bool {
+	switch node := msg.Interface().(type) {
+	case *pg_query.SelectStmt:
+		if node.IntoClause != nil || len(node.LockingClause) > 0 {
+			return false
+		}
+	case *pg_query.InsertStmt, *pg_query.UpdateStmt, *pg_query.DeleteStmt, *pg_query.MergeStmt:
+		return false
+	case *pg_query.FuncCall:
+		if len(node.Funcname) > 0 {
+			name := node.Funcname[len(node.Funcname)-1].GetString_().GetSval()
+			if _, ok := sideEffectFunctions[strings.ToLower(name)]; ok {
+				return false
+			}
+		}
+	}
+
+	ok := true
+	msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			list := v.List()
+			for i := 0; i < list.Len() && ok; i++ {
+				ok = readOnly(list.Get(i).Message())
+			}
+		case fd.Message() != nil && !fd.IsMap():
+			ok = readOnly(v.Message())
+		}
+		return ok
+	})
+	return ok
+}
+
+// reconnectUpstream replaces the lost upstream connection of a client by a new
+// one to an upstream of route, logged in as the client was, without a word to
+// the client, and sets the parameters the client set on it. The client keeps
+// its cancel key, which now cancels the queries of the new connection. The lost
+// connection is closed once replaced.
+func (h *PostgreSQLConnectionHandler) reconnectUpstream(ctx context.Context, route upstreamRoute, session domain.Session, lost *upstreamConnection, parameters map[string]string) (*upstreamConnection, error) {
+	target, ok := route.selector.Next()
+	if !ok {
+		return nil, errNoUpstream
+	}
+	upstream, err := dialUpstream(ctx, target.Address, h.upstreamTimeout, targetTLSConfig(route.tlsConfig, target))
+	if err != nil {
+		return nil, err
+	}
+	if err := upstream.conn.SetDeadline(time.Now().Add(h.upstreamTimeout)); err != nil {
+		_ = upstream.Close()
+		return nil, fmt.Errorf("failed to set upstream deadline: %w", err)
+	}
+	if err := h.loginUpstream(upstream, session, route.database); err != nil {
+		_ = upstream.Close()
+		return nil, err
+	}
+
+	if len(parameters) > 0 {
+		err = h.runPooled(upstream, restoreSessionQuery(parameters))
+	} else {
+		err = upstream.conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		_ = upstream.Close()
+		return nil, fmt.Errorf("failed to restore session parameters: %w", err)
+	}
+
+	upstream.cancelKey, lost.cancelKey = lost.cancelKey, 0
+	h.cancelKeys.assign(upstream.cancelKey, upstream)
+	_ = lost.Close()
+	return upstream, nil
+}
+
+// loginUpstream sends the startup message of a client upstream and completes
+// the login on its behalf, which only succeeds when the enforcer holds the
+// credentials or the upstream asks for none
+func (h *PostgreSQLConnectionHandler) loginUpstream(upstream *upstreamConnection, session domain.Session, database string) error {
+	login := h.upstreamLogin(session.User)
+	if err := upstream.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      startupParameters(session, database, login),
+	}); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := upstream.Receive()
+		if err != nil {
+			return err
+		}
+		if login != nil {
+			answered, err := login.answer(upstream, msg)
+			if err != nil {
+				return err
+			}
+			if answered {
+				continue
+			}
+		}
+
+		switch m := msg.(type) {
+		case *pgproto3.BackendKeyData:
+			upstream.backend = *m
+		case *pgproto3.ErrorResponse:
+			response := *m
+			return &upstreamStartupError{response: &response}
+		case *pgproto3.ReadyForQuery:
+			return nil
+		case *pgproto3.AuthenticationOk, *pgproto3.ParameterStatus, *pgproto3.NoticeResponse:
+		default:
+			return fmt.Errorf("%w: the upstream asked for credentials the client gave it directly", errUpstreamLogin)
+		}
+	}
+}
+
+// upstreamLost ends a client connection whose upstream connection was lost,
+// with the FATAL error held back for a reconnect when there is one
+func (h *PostgreSQLConnectionHandler) upstreamLost(parser *PostgreSQLParser, writer *PostgreSQLResponseWriter, upstream *upstreamConnection, connLogger logger.Logger) error {
+	var err error
+	if upstream != nil && upstream.fatal != nil {
+		err = parser.Send(upstream.fatal)
+	} else {
+		err = writer.UpstreamLost()
+	}
+	if err != nil {
+		// The client may be gone as well
+		connLogger.Debug("Failed to tell the client its upstream connection was lost: %v", err)
+	}
+	return nil
+}
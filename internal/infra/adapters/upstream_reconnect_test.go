@@ -0,0 +1,31 @@
+package adapters
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryableQuery(t *testing.T) {
+	tests := []struct {
+		query     string
+		retryable bool
+	}{
+		{"SELECT 1", true},
+		{"SELECT * FROM orders WHERE id = 1; SHOW search_path", true},
+		{"WITH recent AS (SELECT * FROM orders) SELECT count(*) FROM recent", true},
+		{"SELECT * FROM orders FOR UPDATE", false},
+		{"SELECT * INTO archive FROM orders", false},
+		{"WITH moved AS (DELETE FROM orders RETURNING *) SELECT count(*) FROM moved", false},
+		{"SELECT nextval('orders_id_seq')", false},
+		{"SELECT pg_catalog.pg_advisory_lock(1)", false},
+		{"UPDATE orders SET total = 0", false},
+		{"SELECT 1; UPDATE orders SET total = 0", false},
+		{"BEGIN", false},
+		{"SELEC 1", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.retryable, retryableQuery(tt.query), tt.query)
+	}
+}
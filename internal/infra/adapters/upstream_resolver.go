@@ -0,0 +1,37 @@
+package adapters
+
+import (
+	"fmt"
+	"net/url"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"strings"
+)
+
+// NewUpstreamResolver creates the resolver matching an upstream specification:
+//
+//	host:port                     A/AAAA records of host, re-resolved as they expire
+//	srv://_postgresql._tcp.name   DNS SRV records
+//	consul://service?tag=x&dc=y   passing instances from the Consul catalog
+func NewUpstreamResolver(upstream string) (domain.UpstreamResolver, error) {
+	if !strings.Contains(upstream, "://") {
+		return NewDNSUpstreamResolver(upstream)
+	}
+
+	parsed, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %q: %w", upstream, err)
+	}
+
+	switch parsed.Scheme {
+	case "srv":
+		return NewSRVUpstreamResolver(parsed.Host)
+	case "consul":
+		return NewConsulUpstreamResolver(ConsulServiceQuery{
+			Service:    parsed.Host,
+			Tag:        parsed.Query().Get("tag"),
+			Datacenter: parsed.Query().Get("dc"),
+		}, "")
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme %q", parsed.Scheme)
+	}
+}
@@ -0,0 +1,148 @@
+package adapters
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"strconv"
+	"time"
+)
+
+// UsageExportFormat is the file format of exported usage reports
+type UsageExportFormat string
+
+const (
+	UsageExportCSV     UsageExportFormat = "csv"     // A header, then a row per tenant
+	UsageExportJSON    UsageExportFormat = "json"    // The period and the list of tenants
+	UsageExportParquet UsageExportFormat = "parquet" // A row per tenant, for data warehouses
+)
+
+// Validate checks that the format is known
+func (f UsageExportFormat) Validate() error {
+	switch f {
+	case UsageExportCSV, UsageExportJSON, UsageExportParquet:
+		return nil
+	}
+	return fmt.Errorf("unknown usage export format %q: use csv, json or parquet", string(f))
+}
+
+// usageExportColumns are the columns of the CSV and Parquet formats
+var usageExportColumns = []string{"from", "to", "user", "database", "queries", "rows", "bytes", "seconds", "cost"}
+
+// tenantUsageJSON is a tenant of the JSON format
+type tenantUsageJSON struct {
+	User     string  `json:"user"`
+	Database string  `json:"database"`
+	Queries  int64   `json:"queries"`
+	Rows     int64   `json:"rows"`
+	Bytes    int64   `json:"bytes"`
+	Seconds  float64 `json:"seconds"`
+	Cost     int64   `json:"cost"`
+}
+
+// WriteUsageReport writes report to w in format. Times are in UTC.
+func WriteUsageReport(w io.Writer, report domain.UsageReport, format UsageExportFormat) error {
+	from, to := report.From.UTC(), report.To.UTC()
+	switch format {
+	case UsageExportCSV:
+		out := csv.NewWriter(w)
+		if err := out.Write(usageExportColumns); err != nil {
+			return err
+		}
+		for _, tenant := range report.Tenants {
+			if err := out.Write([]string{
+				from.Format(time.RFC3339), to.Format(time.RFC3339), tenant.User, tenant.Database,
+				strconv.FormatInt(tenant.Queries, 10), strconv.FormatInt(tenant.Rows, 10), strconv.FormatInt(tenant.Bytes, 10),
+				strconv.FormatFloat(tenant.Seconds, 'f', -1, 64), strconv.FormatInt(tenant.Cost, 10),
+			}); err != nil {
+				return err
+			}
+		}
+		out.Flush()
+		return out.Error()
+
+	case UsageExportJSON:
+		tenants := make([]tenantUsageJSON, 0, len(report.Tenants))
+		for _, tenant := range report.Tenants {
+			tenants = append(tenants, tenantUsageJSON(tenant))
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			From    time.Time         `json:"from"`
+			To      time.Time         `json:"to"`
+			Tenants []tenantUsageJSON `json:"tenants"`
+		}{from, to, tenants})
+
+	case UsageExportParquet:
+		columns := make([]*parquetColumn, len(usageExportColumns))
+		for i, name := range usageExportColumns {
+			columns[i] = &parquetColumn{name: name, kind: parquetInt64, converted: parquetNoConversion}
+		}
+		columns[0].converted, columns[1].converted = parquetTimestampMillis, parquetTimestampMillis
+		columns[2].kind, columns[2].converted = parquetByteArray, parquetUTF8
+		columns[3].kind, columns[3].converted = parquetByteArray, parquetUTF8
+		columns[7].kind = parquetDouble
+		for _, tenant := range report.Tenants {
+			columns[0].int64(from.UnixMilli())
+			columns[1].int64(to.UnixMilli())
+			columns[2].byteArray(tenant.User)
+			columns[3].byteArray(tenant.Database)
+			columns[4].int64(tenant.Queries)
+			columns[5].int64(tenant.Rows)
+			columns[6].int64(tenant.Bytes)
+			columns[7].double(tenant.Seconds)
+			columns[8].int64(tenant.Cost)
+		}
+		return writeParquet(w, len(report.Tenants), columns)
+	}
+	return format.Validate()
+}
+
+// FileUsageExporter implements domain.UsageExporter by writing each report to a
+// file of a directory, named after its period, such as
+// usage-20250601T000000Z-20250602T000000Z.csv
+type FileUsageExporter struct {
+	dir    string
+	format UsageExportFormat
+}
+
+// NewFileUsageExporter writes reports to dir in format
+func NewFileUsageExporter(dir string, format UsageExportFormat) (*FileUsageExporter, error) {
+	if err := format.Validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create the usage export directory: %w", err)
+	}
+	return &FileUsageExporter{dir: dir, format: format}, nil
+}
+
+// ExportUsage implements domain.UsageExporter. The file appears complete or not
+// at all, so collectors polling the directory never read a partial report.
+func (e *FileUsageExporter) ExportUsage(ctx context.Context, report domain.UsageReport) error {
+	const layout = "20060102T150405Z"
+	name := fmt.Sprintf("usage-%s-%s.%s", report.From.UTC().Format(layout), report.To.UTC().Format(layout), e.format)
+
+	file, err := os.CreateTemp(e.dir, "."+name+".*")
+	if err != nil {
+		return fmt.Errorf("failed to export usage: %w", err)
+	}
+	defer os.Remove(file.Name())
+	if err := WriteUsageReport(file, report, e.format); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to export usage: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to export usage: %w", err)
+	}
+	if err := os.Rename(file.Name(), filepath.Join(e.dir, name)); err != nil {
+		return fmt.Errorf("failed to export usage: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package adapters
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testUsageReport is a report of two tenants over a day
+func testUsageReport() domain.UsageReport {
+	return domain.UsageReport{
+		From: time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2025, 6, 2, 0, 0, 0, 0, time.UTC),
+		Tenants: []domain.TenantUsage{
+			{User: "alice", Database: "app", Queries: 1200, Rows: 50000, Bytes: 1 << 20, Seconds: 12.5, Cost: 900},
+			{User: "bob", Database: "reports", Queries: 30},
+		},
+	}
+}
+
+func TestWriteUsageReport_CSV(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, WriteUsageReport(&out, testUsageReport(), UsageExportCSV))
+	assert.Equal(t, "from,to,user,database,queries,rows,bytes,seconds,cost\n"+
+		"2025-06-01T00:00:00Z,2025-06-02T00:00:00Z,alice,app,1200,50000,1048576,12.5,900\n"+
+		"2025-06-01T00:00:00Z,2025-06-02T00:00:00Z,bob,reports,30,0,0,0,0\n", out.String())
+}
+
+func TestWriteUsageReport_JSON(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, WriteUsageReport(&out, testUsageReport(), UsageExportJSON))
+
+	var decoded struct {
+		From    time.Time                `json:"from"`
+		Tenants []map[string]interface{} `json:"tenants"`
+	}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.Equal(t, testUsageReport().From, decoded.From)
+	require.Len(t, decoded.Tenants, 2)
+	assert.Equal(t, map[string]interface{}{
+		"user": "alice", "database": "app", "queries": 1200.0, "rows": 50000.0, "bytes": 1048576.0, "seconds": 12.5, "cost": 900.0,
+	}, decoded.Tenants[0])
+
+	assert.Error(t, WriteUsageReport(&out, testUsageReport(), "xml"))
+}
+
+// decodeThrift decodes a Thrift compact value of type kind at data[*pos], structs
+// as maps by field id and lists as slices
+func decodeThrift(t *testing.T, data []byte, pos *int, kind byte) interface{} {
+	t.Helper()
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(data[*pos:])
+		require.Positive(t, n)
+		*pos += n
+		return v
+	}
+	switch kind {
+	case thriftI32, thriftI64:
+		v := uvarint()
+		return int64(v>>1) ^ -int64(v&1)
+	case thriftBinary:
+		n := int(uvarint())
+		*pos += n
+		return string(data[*pos-n : *pos])
+	case thriftList:
+		header := data[*pos]
+		*pos++
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(uvarint())
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = decodeThrift(t, data, pos, header&0x0F)
+		}
+		return list
+	case thriftStruct:
+		fields := make(map[int16]interface{})
+		var id int16
+		for {
+			header := data[*pos]
+			*pos++
+			if header == 0 {
+				return fields
+			}
+			id += int16(header >> 4)
+			fields[id] = decodeThrift(t, data, pos, header&0x0F)
+		}
+	}
+	t.Fatalf("unexpected Thrift type %d", kind)
+	return nil
+}
+
+func TestWriteUsageReport_Parquet(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, WriteUsageReport(&out, testUsageReport(), UsageExportParquet))
+	data := out.Bytes()
+	require.Equal(t, parquetMagic, string(data[:4]))
+	require.Equal(t, parquetMagic, string(data[len(data)-4:]))
+
+	size := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	pos := len(data) - 8 - size
+	footer := decodeThrift(t, data, &pos, thriftStruct).(map[int16]interface{})
+	assert.Equal(t, len(data)-8, pos, "The footer length should cover the metadata")
+	assert.Equal(t, int64(2), footer[3], "The file should hold a row per tenant")
+
+	schema := footer[2].([]interface{})
+	require.Len(t, schema, len(usageExportColumns)+1)
+	for i, name := range usageExportColumns {
+		assert.Equal(t, name, schema[i+1].(map[int16]interface{})[4])
+	}
+
+	// The values of the user column follow the header of its data page
+	chunks := footer[4].([]interface{})[0].(map[int16]interface{})[1].([]interface{})
+	metadata := chunks[2].(map[int16]interface{})[3].(map[int16]interface{})
+	pos = int(metadata[9].(int64))
+	page := decodeThrift(t, data, &pos, thriftStruct).(map[int16]interface{})
+	assert.Equal(t, int64(2), page[5].(map[int16]interface{})[1])
+	values := data[pos : pos+int(page[2].(int64))]
+	assert.Equal(t, "\x05\x00\x00\x00alice\x03\x00\x00\x00bob", string(values))
+}
+
+func TestFileUsageExporter(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "exports")
+	exporter, err := NewFileUsageExporter(dir, UsageExportCSV)
+	require.NoError(t, err)
+	require.NoError(t, exporter.ExportUsage(context.Background(), testUsageReport()))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "Only the complete report should be left")
+	assert.Equal(t, "usage-20250601T000000Z-20250602T000000Z.csv", entries[0].Name())
+
+	_, err = NewFileUsageExporter(dir, "xlsx")
+	assert.ErrorContains(t, err, "unknown usage export format")
+}
@@ -0,0 +1,158 @@
+package adapters
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Userlist holds the password verifiers of the users the enforcer authenticates
+// itself, read from a PgBouncer auth_file:
+//
+//	"alice" "md5<md5 of password and user name>"
+//	"bob" "SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>"
+//	"carol" "plaintext password"
+//
+// Users with an MD5 verifier authenticate with MD5; the others with SCRAM-SHA-256.
+type Userlist struct {
+	users map[string]userCredentials
+}
+
+// userCredentials is what the enforcer knows about a user's password
+type userCredentials struct {
+	md5       string         // "md5" followed by the hex digest, for MD5 users
+	scram     *scramVerifier // for SCRAM users, including plaintext ones
+	plaintext string         // set when the file holds the password itself
+}
+
+// LoadUserlist reads a PgBouncer auth_file
+func LoadUserlist(path string) (*Userlist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open auth file: %w", err)
+	}
+	defer file.Close()
+
+	userlist, err := ParseUserlist(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse auth file %s: %w", path, err)
+	}
+	return userlist, nil
+}
+
+// ParseUserlist reads users in the PgBouncer auth_file format. Blank lines and
+// lines starting with ';' or '#' are skipped; fields after the password are ignored.
+func ParseUserlist(r io.Reader) (*Userlist, error) {
+	userlist := &Userlist{users: make(map[string]userCredentials)}
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+
+		user, rest, err := readQuoted(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		password, _, err := readQuoted(strings.TrimLeft(rest, " \t"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if user == "" || password == "" {
+			return nil, fmt.Errorf("line %d: user name and password must not be empty", lineNumber)
+		}
+
+		credentials, err := parseCredentials(password)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		userlist.users[user] = credentials
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return userlist, nil
+}
+
+// readQuoted reads a double-quoted field at the start of s, where a doubled quote
+// stands for a literal one, and returns it with the rest of s
+func readQuoted(s string) (string, string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", "", fmt.Errorf("expected a double-quoted field")
+	}
+
+	var field strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != '"' {
+			field.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '"' {
+			field.WriteByte('"')
+			i++
+			continue
+		}
+		return field.String(), s[i+1:], nil
+	}
+	return "", "", fmt.Errorf("unterminated double-quoted field")
+}
+
+// parseCredentials recognizes MD5 and SCRAM verifiers; anything else is a plaintext password
+func parseCredentials(password string) (userCredentials, error) {
+	switch {
+	case isMD5Verifier(password):
+		return userCredentials{md5: password}, nil
+	case strings.HasPrefix(password, scramMechanism+"$"):
+		verifier, err := parseSCRAMVerifier(password)
+		if err != nil {
+			return userCredentials{}, err
+		}
+		return userCredentials{scram: verifier}, nil
+	default:
+		verifier, err := newSCRAMVerifier(password)
+		if err != nil {
+			return userCredentials{}, err
+		}
+		return userCredentials{scram: verifier, plaintext: password}, nil
+	}
+}
+
+// isMD5Verifier reports whether password is "md5" followed by 32 hex digits
+func isMD5Verifier(password string) bool {
+	if len(password) != 35 || !strings.HasPrefix(password, "md5") {
+		return false
+	}
+	_, err := hex.DecodeString(password[3:])
+	return err == nil
+}
+
+// md5Password hashes a password the way PostgreSQL stores it: "md5" followed by
+// the hex digest of the password and user name
+func md5Password(user, password string) string {
+	sum := md5.Sum([]byte(password + user))
+	return "md5" + hex.EncodeToString(sum[:])
+}
+
+// md5Response answers an AuthenticationMD5Password challenge given the stored
+// password hash and the server's salt
+func md5Response(hash string, salt [4]byte) string {
+	sum := md5.Sum(append([]byte(strings.TrimPrefix(hash, "md5")), salt[:]...))
+	return "md5" + hex.EncodeToString(sum[:])
+}
+
+// lookup returns the credentials of user
+func (u *Userlist) lookup(user string) (userCredentials, bool) {
+	credentials, ok := u.users[user]
+	return credentials, ok
+}
+
+// Len returns the number of users
+func (u *Userlist) Len() int {
+	return len(u.users)
+}
@@ -0,0 +1,66 @@
+package adapters
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUserlist(t *testing.T) {
+	userlist, err := ParseUserlist(strings.NewReader(`
+; PgBouncer auth_file
+"alice" "md5` + strings.Repeat("ab", 16) + `"
+"bob"   "s3cret" ""
+# quotes are doubled
+"o""brien" "pa""ss"
+`))
+	require.NoError(t, err)
+	assert.Equal(t, 3, userlist.Len())
+
+	alice, ok := userlist.lookup("alice")
+	require.True(t, ok)
+	assert.Equal(t, "md5"+strings.Repeat("ab", 16), alice.md5)
+	assert.Nil(t, alice.scram)
+
+	bob, ok := userlist.lookup("bob")
+	require.True(t, ok)
+	assert.Equal(t, "s3cret", bob.plaintext)
+	assert.NotNil(t, bob.scram, "Plaintext users should authenticate with SCRAM")
+
+	obrien, ok := userlist.lookup(`o"brien`)
+	require.True(t, ok)
+	assert.Equal(t, `pa"ss`, obrien.plaintext)
+}
+
+func TestParseUserlist_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "unquoted", content: "alice secret\n"},
+		{name: "unterminated", content: `"alice" "secret` + "\n"},
+		{name: "missing password", content: `"alice"` + "\n"},
+		{name: "empty password", content: `"alice" ""` + "\n"},
+		{name: "malformed SCRAM verifier", content: `"alice" "SCRAM-SHA-256$4096:salt"` + "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseUserlist(strings.NewReader(tt.content))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLoadUserlist_Missing(t *testing.T) {
+	_, err := LoadUserlist(filepath.Join(t.TempDir(), "userlist.txt"))
+	assert.Error(t, err)
+}
+
+func TestMD5Password(t *testing.T) {
+	// As computed by PostgreSQL: SELECT 'md5' || md5('secret' || 'alice')
+	assert.Equal(t, "md54a0a68b43b6cd5cf266fa02f196e2371", md5Password("alice", "secret"))
+}
@@ -0,0 +1,107 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// pgerrSystemError is the SQLSTATE of virtual queries the enforcer failed to answer
+const pgerrSystemError = "58000"
+
+var (
+	// quotaRemainingQuery matches SELECT quota_remaining() and SELECT
+	// quota_remaining('policy'), optionally qualified with the pgqe schema
+	quotaRemainingQuery = regexp.MustCompile(`(?is)^\s*select\s+(?:pgqe\.)?quota_remaining\s*\(\s*(?:'([^']*)')?\s*\)\s*;?\s*$`)
+
+	// quotaUsageQuery matches SELECT * FROM pgqe.usage
+	quotaUsageQuery = regexp.MustCompile(`(?is)^\s*select\s+\*\s+from\s+pgqe\.usage\s*;?\s*$`)
+)
+
+// usageColumns describe the rows of pgqe.usage
+var usageColumns = []pgproto3.FieldDescription{
+	textColumn("policy"),
+	textColumn("dimension"),
+	int8Column("limit"),
+	int8Column("used"),
+	int8Column("remaining"),
+	textColumn("window"),
+	textColumn("resets_at"),
+}
+
+// virtualQuery reports whether text is one of the queries on quotas the
+// enforcer answers itself
+func virtualQuery(text string) bool {
+	return quotaRemainingQuery.MatchString(text) || quotaUsageQuery.MatchString(text)
+}
+
+// answerVirtualQuery answers a query on the quotas of the session's connection
+// with the rows the enforcer computed. quota_remaining() is what is left of the
+// quota of queries closest to its limit, NULL when no such quota applies;
+// quota_remaining('policy') is what is left of the named quota.
+// Quotas are read as the query arrives; its answer is sent once the upstream
+// answered the queries sent before it.
+func (h *PostgreSQLConnectionHandler) answerVirtualQuery(ctx context.Context, session *domain.Session, writer *PostgreSQLResponseWriter, text string) error {
+	statuses, err := h.quotaReporter.QuotaStatus(ctx, *session)
+	if err != nil {
+		h.logger.Error("Failed to report the quotas of connection %s: %v", session.ConnectionID, err)
+		return writer.Fail(domain.Decision{Action: domain.DecisionDeny, Reason: "quota usage is unavailable", Code: pgerrSystemError})
+	}
+
+	if match := quotaRemainingQuery.FindStringSubmatch(text); match != nil {
+		var remaining []byte
+		closest := int64(-1)
+		for _, status := range statuses {
+			if match[1] != "" && status.Policy != match[1] {
+				continue
+			}
+			if match[1] == "" && status.Dimension.Unit() != domain.QuotaDimensionQueries.Unit() {
+				continue
+			}
+			if closest < 0 || status.Remaining() < closest {
+				closest = status.Remaining()
+				remaining = []byte(strconv.FormatInt(closest, 10))
+			}
+		}
+		return writer.Answer([]pgproto3.FieldDescription{int8Column("quota_remaining")}, [][][]byte{{remaining}})
+	}
+
+	rows := make([][][]byte, 0, len(statuses))
+	for _, status := range statuses {
+		resetsAt := []byte(nil)
+		if !status.ResetAt.IsZero() {
+			resetsAt = []byte(status.ResetAt.UTC().Format(time.RFC3339))
+		}
+		rows = append(rows, [][]byte{
+			[]byte(status.Policy),
+			[]byte(status.Dimension.Unit()),
+			[]byte(strconv.FormatInt(status.Limit, 10)),
+			[]byte(strconv.FormatInt(status.Used, 10)),
+			[]byte(strconv.FormatInt(status.Remaining(), 10)),
+			[]byte(status.Window.String()),
+			resetsAt,
+		})
+	}
+	return writer.Answer(usageColumns, rows)
+}
+
+// textColumn describes a text column of a virtual query
+func textColumn(name string) pgproto3.FieldDescription {
+	return pgproto3.FieldDescription{Name: []byte(name), DataTypeOID: pgtype.TextOID, DataTypeSize: -1, TypeModifier: -1}
+}
+
+// int8Column describes a bigint column of a virtual query
+func int8Column(name string) pgproto3.FieldDescription {
+	return pgproto3.FieldDescription{Name: []byte(name), DataTypeOID: pgtype.Int8OID, DataTypeSize: 8, TypeModifier: -1}
+}
+
+// selectTag is the command tag of a SELECT returning rows rows
+func selectTag(rows int) []byte {
+	return []byte(fmt.Sprintf("SELECT %d", rows))
+}
@@ -0,0 +1,115 @@
+package adapters
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staticQuotaReporter reports the same quotas for every connection
+type staticQuotaReporter []domain.QuotaStatus
+
+func (r staticQuotaReporter) QuotaStatus(ctx context.Context, session domain.Session) ([]domain.QuotaStatus, error) {
+	return r, nil
+}
+
+// receiveRows returns the values of the rows answering a query, until ReadyForQuery
+func receiveRows(t *testing.T, frontend *pgproto3.Frontend) (columns []string, rows [][]string) {
+	t.Helper()
+	for {
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		switch m := msg.(type) {
+		case *pgproto3.RowDescription:
+			for _, field := range m.Fields {
+				columns = append(columns, string(field.Name))
+			}
+		case *pgproto3.DataRow:
+			var row []string
+			for _, value := range m.Values {
+				if value == nil {
+					row = append(row, "NULL")
+				} else {
+					row = append(row, string(value))
+				}
+			}
+			rows = append(rows, row)
+		case *pgproto3.ErrorResponse:
+			t.Fatalf("Unexpected error: %s", m.Message)
+		case *pgproto3.ReadyForQuery:
+			return columns, rows
+		}
+	}
+}
+
+func TestPostgreSQLConnectionHandler_QuotaFunctions(t *testing.T) {
+	resetAt := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	reporter := staticQuotaReporter{
+		{Policy: "hourly", Limit: 100, Used: 40, Window: time.Hour, ResetAt: resetAt},
+		{Policy: "daily", Limit: 1000, Used: 980, Window: 24 * time.Hour},
+		{Policy: "egress", Dimension: domain.QuotaDimensionBytes, Limit: 1 << 20, Used: 1 << 21, Window: time.Hour},
+	}
+	engine := &mocks.StaticPolicyEngine{}
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(engine), WithQuotaReporter(reporter))
+	frontend := dialFrontend(t, startHandler(t, handler))
+
+	frontend.Send(&pgproto3.Query{String: "select quota_remaining();"})
+	require.NoError(t, frontend.Flush())
+	columns, rows := receiveRows(t, frontend)
+	assert.Equal(t, []string{"quota_remaining"}, columns)
+	assert.Equal(t, [][]string{{"20"}}, rows, "The quota of queries closest to its limit should be reported")
+
+	frontend.Send(&pgproto3.Query{String: "SELECT pgqe.quota_remaining('egress')"})
+	require.NoError(t, frontend.Flush())
+	_, rows = receiveRows(t, frontend)
+	assert.Equal(t, [][]string{{"0"}}, rows)
+
+	frontend.Send(&pgproto3.Query{String: "SELECT quota_remaining('absent')"})
+	require.NoError(t, frontend.Flush())
+	_, rows = receiveRows(t, frontend)
+	assert.Equal(t, [][]string{{"NULL"}}, rows)
+
+	frontend.Send(&pgproto3.Query{String: "SELECT * FROM pgqe.usage"})
+	require.NoError(t, frontend.Flush())
+	columns, rows = receiveRows(t, frontend)
+	assert.Equal(t, []string{"policy", "dimension", "limit", "used", "remaining", "window", "resets_at"}, columns)
+	assert.Equal(t, [][]string{
+		{"hourly", "queries", "100", "40", "60", "1h0m0s", "2026-03-01T09:00:00Z"},
+		{"daily", "queries", "1000", "980", "20", "24h0m0s", "NULL"},
+		{"egress", "bytes", "1048576", "2097152", "0", "1h0m0s", "NULL"},
+	}, rows)
+
+	assert.Empty(t, engine.Queries(), "Queries on quotas should not be evaluated or charged")
+}
+
+func TestPostgreSQLConnectionHandler_QuotaFunctionsPipelined(t *testing.T) {
+	backend := testkit.StartFakeBackend(t)
+	backend.Handle("SELECT 1", testkit.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}, CommandTag: "SELECT 1"})
+	reporter := staticQuotaReporter{{Policy: "hourly", Limit: 100, Used: 40, Window: time.Hour}}
+	handler := NewPostgreSQLConnectionHandler(mocks.NewRecordingQueryLogger(), NewPgQueryNormalizer(), logger.NewSimpleLogger(),
+		WithPolicyEngine(&mocks.StaticPolicyEngine{}), WithQuotaReporter(reporter), WithUpstreams(upstreamSelector(backend.Addr())))
+	frontend := dialFrontend(t, startHandler(t, handler))
+	require.NoError(t, frontend.Flush())
+	receiveRows(t, frontend) // the startup, up to its ReadyForQuery
+
+	// A query on quotas sent behind queries the upstream runs is answered in turn
+	frontend.Send(&pgproto3.Query{String: "SELECT 1"})
+	frontend.Send(&pgproto3.Query{String: "SELECT quota_remaining()"})
+	frontend.Send(&pgproto3.Query{String: "SELECT 1"})
+	require.NoError(t, frontend.Flush())
+	for _, expected := range [][]string{{"1"}, {"60"}, {"1"}} {
+		_, rows := receiveRows(t, frontend)
+		assert.Equal(t, [][]string{expected}, rows)
+	}
+	assert.Equal(t, []string{"SELECT 1", "SELECT 1"}, backend.Queries(), "Queries on quotas should never reach the upstream")
+}
@@ -0,0 +1,260 @@
+package adapters
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWebhookAttempts is how many times a delivery is tried before it is given up
+	DefaultWebhookAttempts = 5
+
+	// DefaultWebhookBackoff is the delay before the first retry; it doubles with every retry
+	DefaultWebhookBackoff = time.Second
+
+	// DefaultWebhookTimeout bounds each delivery attempt
+	DefaultWebhookTimeout = 10 * time.Second
+
+	// webhookQueueSize is how many events may wait for delivery before new ones are dropped
+	webhookQueueSize = 1000
+)
+
+// Headers of webhook deliveries
+const (
+	WebhookEventHeader     = "X-Enforcer-Event"
+	WebhookDeliveryHeader  = "X-Enforcer-Delivery"
+	WebhookTimestampHeader = "X-Enforcer-Timestamp"
+	WebhookSignatureHeader = "X-Enforcer-Signature"
+)
+
+// webhookPayload is the JSON body of a webhook delivery
+type webhookPayload struct {
+	Type         domain.EventType       `json:"type"`
+	Timestamp    time.Time              `json:"timestamp"`
+	InstanceID   string                 `json:"instance_id,omitempty"`
+	ConnectionID string                 `json:"connection_id,omitempty"`
+	Fields       map[string]interface{} `json:"fields,omitempty"`
+}
+
+// WebhookNotifier implements domain.EventSink by POSTing events as JSON to an
+// HTTP endpoint, so teams can route alerts to their own receivers. Deliveries
+// happen in the background and are retried with exponential backoff on network
+// errors, 429 and 5xx responses; events are dropped while the queue is full.
+//
+// When a secret is set, every delivery is signed: the X-Enforcer-Signature header
+// holds "sha256=" followed by the hex HMAC-SHA256 of the X-Enforcer-Timestamp
+// header, a dot and the body, so receivers can reject forged and replayed requests.
+type WebhookNotifier struct {
+	url      string
+	secret   []byte
+	types    map[domain.EventType]bool // nil delivers every event
+	attempts int
+	backoff  time.Duration
+	client   *http.Client
+	logger   logger.Logger
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan domain.Event
+	stop   chan struct{} // closed by Close to give up on retries
+	done   chan struct{}
+}
+
+// WebhookNotifierOption configures optional behavior of a WebhookNotifier
+type WebhookNotifierOption func(*WebhookNotifier)
+
+// WithWebhookSecret signs deliveries with secret
+func WithWebhookSecret(secret string) WebhookNotifierOption {
+	return func(n *WebhookNotifier) {
+		n.secret = []byte(secret)
+	}
+}
+
+// WithWebhookEvents only delivers events of the given types
+func WithWebhookEvents(types ...domain.EventType) WebhookNotifierOption {
+	return func(n *WebhookNotifier) {
+		if len(types) == 0 {
+			return
+		}
+		n.types = make(map[domain.EventType]bool, len(types))
+		for _, eventType := range types {
+			n.types[eventType] = true
+		}
+	}
+}
+
+// WithWebhookRetries sets how many times a delivery is tried and the delay before the first retry
+func WithWebhookRetries(attempts int, backoff time.Duration) WebhookNotifierOption {
+	return func(n *WebhookNotifier) {
+		n.attempts = attempts
+		n.backoff = backoff
+	}
+}
+
+// WithWebhookClient sends deliveries with client instead of one bounded by DefaultWebhookTimeout
+func WithWebhookClient(client *http.Client) WebhookNotifierOption {
+	return func(n *WebhookNotifier) {
+		n.client = client
+	}
+}
+
+// NewWebhookNotifier creates a WebhookNotifier delivering to url and starts delivering
+func NewWebhookNotifier(url string, log logger.Logger, opts ...WebhookNotifierOption) (*WebhookNotifier, error) {
+	n := &WebhookNotifier{
+		url:      url,
+		attempts: DefaultWebhookAttempts,
+		backoff:  DefaultWebhookBackoff,
+		client:   &http.Client{Timeout: DefaultWebhookTimeout},
+		logger:   log.WithField("webhook", url),
+		queue:    make(chan domain.Event, webhookQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil || (request.URL.Scheme != "http" && request.URL.Scheme != "https") {
+		return nil, fmt.Errorf("invalid webhook URL %q: use an http or https URL", url)
+	}
+	if n.attempts <= 0 || n.backoff < 0 {
+		return nil, fmt.Errorf("webhook attempts must be positive and backoff must not be negative")
+	}
+
+	go n.run()
+	return n, nil
+}
+
+// Emit queues the event for delivery when its type is selected
+func (n *WebhookNotifier) Emit(event domain.Event) {
+	if n.types != nil && !n.types[event.Type] {
+		return
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.closed {
+		return
+	}
+
+	select {
+	case n.queue <- event:
+	default:
+		n.logger.Error("Dropping %s event: webhook deliveries are falling behind", event.Type)
+	}
+}
+
+// Close delivers the queued events, without retrying failed deliveries, and stops
+func (n *WebhookNotifier) Close() error {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.stop)
+		close(n.queue)
+	}
+	n.mu.Unlock()
+
+	<-n.done
+	return nil
+}
+
+// run delivers queued events in order until the notifier is closed
+func (n *WebhookNotifier) run() {
+	defer close(n.done)
+	for event := range n.queue {
+		if err := n.deliver(event); err != nil {
+			n.logger.Error("Failed to deliver %s event: %v", event.Type, err)
+		}
+	}
+}
+
+// deliver sends the event, retrying transient failures
+func (n *WebhookNotifier) deliver(event domain.Event) error {
+	body, err := json.Marshal(webhookPayload{
+		Type:         event.Type,
+		Timestamp:    event.Timestamp.UTC(),
+		InstanceID:   event.InstanceID,
+		ConnectionID: event.ConnectionID,
+		Fields:       event.Fields,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	// Retries carry the same delivery ID so receivers can discard duplicates
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return fmt.Errorf("failed to generate delivery ID: %w", err)
+	}
+	delivery := hex.EncodeToString(id[:])
+
+	backoff := n.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(event.Type, delivery, body)
+		if err == nil || !retry || attempt == n.attempts {
+			return err
+		}
+
+		select {
+		case <-n.stop:
+			return fmt.Errorf("%w (gave up on retries at shutdown)", err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// post sends one delivery attempt and reports whether a failure is worth retrying
+func (n *WebhookNotifier) post(eventType domain.EventType, delivery string, body []byte) (bool, error) {
+	request, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "pgbouncer-quota-enforcer")
+	request.Header.Set(WebhookEventHeader, string(eventType))
+	request.Header.Set(WebhookDeliveryHeader, delivery)
+	request.Header.Set(WebhookTimestampHeader, timestamp)
+	if len(n.secret) > 0 {
+		request.Header.Set(WebhookSignatureHeader, SignWebhook(n.secret, timestamp, body))
+	}
+
+	response, err := n.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+	response.Body.Close()
+
+	switch {
+	case response.StatusCode < 300:
+		return false, nil
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return true, fmt.Errorf("webhook returned %s", response.Status)
+	default:
+		return false, fmt.Errorf("webhook returned %s", response.Status)
+	}
+}
+
+// SignWebhook returns the X-Enforcer-Signature of a delivery body sent at timestamp
+func SignWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
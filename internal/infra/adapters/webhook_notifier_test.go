@@ -0,0 +1,122 @@
+package adapters
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookReceiver records deliveries and answers them with the queued statuses
+type webhookReceiver struct {
+	mu         sync.Mutex
+	statuses   []int // answered in order, then 204
+	deliveries []*http.Request
+	bodies     [][]byte
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	body, _ := io.ReadAll(request.Body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deliveries = append(r.deliveries, request)
+	r.bodies = append(r.bodies, body)
+	status := http.StatusNoContent
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func thresholdEvent(user string) domain.Event {
+	return domain.Event{
+		Type:       domain.EventQuotaThreshold,
+		Timestamp:  time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		InstanceID: "enforcer-1",
+		Fields:     map[string]interface{}{"user": user, "threshold": 80},
+	}
+}
+
+func TestWebhookNotifier_SignsDeliveries(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	notifier, err := NewWebhookNotifier(server.URL, logger.NewSimpleLogger(),
+		WithWebhookSecret("s3cret"), WithWebhookEvents(domain.EventQuotaThreshold))
+	require.NoError(t, err)
+
+	notifier.Emit(domain.Event{Type: domain.EventQueryBurst, Timestamp: time.Now()})
+	notifier.Emit(thresholdEvent("alice"))
+	require.NoError(t, notifier.Close())
+
+	require.Len(t, receiver.deliveries, 1, "Only selected event types are delivered")
+	request, body := receiver.deliveries[0], receiver.bodies[0]
+	assert.Equal(t, http.MethodPost, request.Method)
+	assert.Equal(t, "application/json", request.Header.Get("Content-Type"))
+	assert.Equal(t, string(domain.EventQuotaThreshold), request.Header.Get(WebhookEventHeader))
+	assert.NotEmpty(t, request.Header.Get(WebhookDeliveryHeader))
+	assert.Equal(t, SignWebhook([]byte("s3cret"), request.Header.Get(WebhookTimestampHeader), body),
+		request.Header.Get(WebhookSignatureHeader))
+
+	var payload webhookPayload
+	require.NoError(t, json.Unmarshal(body, &payload))
+	assert.Equal(t, domain.EventQuotaThreshold, payload.Type)
+	assert.Equal(t, "enforcer-1", payload.InstanceID)
+	assert.Equal(t, "alice", payload.Fields["user"])
+}
+
+func TestWebhookNotifier_Retries(t *testing.T) {
+	receiver := &webhookReceiver{statuses: []int{http.StatusInternalServerError, http.StatusTooManyRequests}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	notifier, err := NewWebhookNotifier(server.URL, logger.NewSimpleLogger(), WithWebhookRetries(3, time.Millisecond))
+	require.NoError(t, err)
+	notifier.Emit(thresholdEvent("alice"))
+	require.Eventually(t, func() bool {
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		return len(receiver.deliveries) == 3
+	}, time.Second, time.Millisecond)
+	require.NoError(t, notifier.Close())
+
+	delivery := receiver.deliveries[0].Header.Get(WebhookDeliveryHeader)
+	for _, request := range receiver.deliveries {
+		assert.Equal(t, delivery, request.Header.Get(WebhookDeliveryHeader), "Retries keep the delivery ID")
+		assert.Empty(t, request.Header.Get(WebhookSignatureHeader), "Deliveries are unsigned without a secret")
+	}
+}
+
+func TestWebhookNotifier_DoesNotRetryRejectedDeliveries(t *testing.T) {
+	receiver := &webhookReceiver{statuses: []int{http.StatusBadRequest}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	notifier, err := NewWebhookNotifier(server.URL, logger.NewSimpleLogger(), WithWebhookRetries(3, time.Millisecond))
+	require.NoError(t, err)
+	notifier.Emit(thresholdEvent("alice"))
+	notifier.Emit(thresholdEvent("bob"))
+	require.NoError(t, notifier.Close())
+
+	require.Len(t, receiver.deliveries, 2, "A rejected delivery is not retried")
+	assert.Contains(t, string(receiver.bodies[1]), "bob")
+}
+
+func TestWebhookNotifier_Invalid(t *testing.T) {
+	log := logger.NewSimpleLogger()
+	_, err := NewWebhookNotifier("ftp://example.com/hook", log)
+	assert.Error(t, err)
+	_, err = NewWebhookNotifier("http://example.com/hook", log, WithWebhookRetries(0, time.Second))
+	assert.Error(t, err)
+}
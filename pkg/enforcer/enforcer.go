@@ -0,0 +1,290 @@
+// Package enforcer lets Go programs run the quota enforcer in-process instead
+// of shelling out to the pgbouncer-quota-enforcer binary, for instance inside an
+// existing proxy that hands it a listener of its own.
+//
+// Behavior is customized through hook interfaces set in Config: a PolicyEngine
+// decides on each query, and may implement UsageRecorder to be charged what
+// statements consumed; a QueryLogger receives every query and protocol message,
+// along with the sessions when it implements SessionLogger and the decisions
+// when it implements DecisionLogger; a QueryNormalizer fingerprints queries; a
+// UsageStore keeps the counters of the built-in policy engine. Middleware wraps
+// the policy engine to change queries or decisions, in order.
+//
+// The identifiers of this package are its stable API: they are only added to,
+// and keep their meaning across releases. The packages under internal may change
+// at any time.
+package enforcer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"pgbouncer-quota-enforcer/internal/app"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/pkg/logger"
+	"time"
+)
+
+// Aliases of the domain types embedders need to plug in their own components
+type (
+	Query           = domain.Query
+	NormalizedQuery = domain.NormalizedQuery
+	QueryHash       = domain.QueryHash
+	QueryNormalizer = domain.QueryNormalizer
+	QueryLogger     = domain.QueryLogger
+	Session         = domain.Session
+	SessionLogger   = domain.SessionLogger
+	DecisionLogger  = domain.DecisionLogger
+	PolicyEngine    = domain.PolicyEngine
+	QueryHandler    = domain.QueryHandler
+	QueryMiddleware = domain.QueryMiddleware
+	UsageRecorder   = domain.UsageRecorder
+	StatementUsage  = domain.StatementUsage
+	UsageStore      = domain.UsageStore
+	UsageKey        = domain.UsageKey
+	Usage           = domain.Usage
+	QuotaPolicy     = domain.QuotaPolicy
+	Decision        = domain.Decision
+	DecisionAction  = domain.DecisionAction
+	Logger          = logger.Logger
+
+	MaintenanceWindow   = domain.MaintenanceWindow
+	Clock               = domain.Clock
+	Timer               = domain.Timer
+	Event               = domain.Event
+	EventType           = domain.EventType
+	EventSink           = domain.EventSink
+	QueryEvent          = domain.QueryEvent
+	QueryEventPublisher = domain.QueryEventPublisher
+	UpstreamTarget      = domain.UpstreamTarget
+	UpstreamResolver    = domain.UpstreamResolver
+	UsageWeights        = domain.UsageWeights
+	QueryKind           = domain.QueryKind
+
+	BurstDetectorConfig = app.BurstDetectorConfig
+	DenialAnomalyConfig = app.DenialAnomalyConfig
+	ListenerConfig      = app.ListenerConfig
+)
+
+const (
+	DecisionAllow = domain.DecisionAllow
+	DecisionDeny  = domain.DecisionDeny
+
+	QueryKindSimple  = domain.QueryKindSimple
+	QueryKindParse   = domain.QueryKindParse
+	QueryKindExecute = domain.QueryKindExecute
+
+	EventQueryBurst    = domain.EventQueryBurst
+	EventDenialAnomaly = domain.EventDenialAnomaly
+)
+
+// NewQueryHash returns the fingerprint hash, for QueryNormalizer implementations
+func NewQueryHash(hash string) QueryHash {
+	return domain.NewQueryHash(hash)
+}
+
+// Config configures an embedded enforcer. Nil components fall back to the
+// built-in implementations.
+type Config struct {
+	// Address to listen on; use "127.0.0.1:0" for an ephemeral port
+	Address string
+
+	// Listener accepts the connections instead of listening on Address, for
+	// embedders that open the socket themselves. The server closes it when it stops.
+	Listener net.Listener
+
+	// Upstream locates the backends: host:port (re-resolved as DNS records expire),
+	// srv://<record> or consul://<service>
+	Upstream string
+
+	// UpstreamResolver discovers backends instead of the resolver built from Upstream
+	UpstreamResolver UpstreamResolver
+
+	// Listeners accept connections on more addresses, each under a name that
+	// policies can be scoped to and with an optional upstream of its own
+	Listeners []ListenerConfig
+
+	// InstanceID identifies this replica in logs, events and captures; generated when empty
+	InstanceID string
+
+	// Policies enforced by the built-in policy engine (ignored when PolicyEngine is set)
+	Policies []QuotaPolicy
+
+	// Roles lists the users of each role policies may apply to, by role name
+	Roles map[string][]string
+
+	// UsageWeights sets how much quota Query, Parse and Execute messages consume;
+	// the zero value charges one unit each
+	UsageWeights UsageWeights
+
+	// QueryLogger receives every query and protocol event
+	QueryLogger QueryLogger
+
+	// Normalizer fingerprints queries for policies and logs; defaults to pg_query
+	Normalizer QueryNormalizer
+
+	// Logger receives the server's own log lines; defaults to standard output
+	Logger Logger
+
+	// PolicyEngine decides whether queries may proceed
+	PolicyEngine PolicyEngine
+
+	// Middleware intercepts queries around the policy engine, in order: the first
+	// sees the query first and the decision last
+	Middleware []QueryMiddleware
+
+	// UsageStore persists usage counters for the built-in policy engine
+	UsageStore UsageStore
+
+	// Clock drives quota windows and timeouts; defaults to the wall clock
+	Clock Clock
+
+	// EventSink receives events such as detected query bursts; defaults to the log
+	EventSink EventSink
+
+	// QueryEventPublisher receives the outcome of every evaluated query
+	QueryEventPublisher QueryEventPublisher
+
+	// BurstDetection reports and optionally limits N+1 query patterns
+	BurstDetection BurstDetectorConfig
+
+	// DenialAlerts raises an event when a principal is denied unusually often
+	DenialAlerts DenialAnomalyConfig
+
+	// MaxIdleConnections caps the idle connections per user and database; zero disables eviction
+	MaxIdleConnections int
+}
+
+// Server is an embedded enforcer instance
+type Server struct {
+	config  Config
+	service *app.ServerService
+}
+
+// New creates an embedded enforcer from the configuration
+func New(config Config) (*Server, error) {
+	var opts []app.ServiceOption
+	if config.QueryLogger != nil {
+		opts = append(opts, app.WithQueryLogger(config.QueryLogger))
+	}
+	if config.PolicyEngine != nil {
+		opts = append(opts, app.WithPolicyEngine(config.PolicyEngine))
+	}
+	if config.UsageStore != nil {
+		opts = append(opts, app.WithUsageStore(config.UsageStore))
+	}
+	if config.Clock != nil {
+		opts = append(opts, app.WithClock(config.Clock))
+	}
+	if config.EventSink != nil {
+		opts = append(opts, app.WithEventSink(config.EventSink))
+	}
+	if config.QueryEventPublisher != nil {
+		opts = append(opts, app.WithQueryEventPublisher(config.QueryEventPublisher))
+	}
+	if config.UpstreamResolver != nil {
+		opts = append(opts, app.WithUpstreamResolver(config.UpstreamResolver))
+	}
+	if len(config.Middleware) > 0 {
+		opts = append(opts, app.WithMiddleware(config.Middleware...))
+	}
+	if config.Normalizer != nil {
+		opts = append(opts, app.WithNormalizer(config.Normalizer))
+	}
+	if config.Logger != nil {
+		opts = append(opts, app.WithLogger(config.Logger))
+	}
+	if config.Listener != nil {
+		opts = append(opts, app.WithListener(config.Listener))
+	}
+
+	service, err := app.NewServerService(app.ServerConfig{
+		Address:            config.Address,
+		InstanceID:         config.InstanceID,
+		Upstream:           config.Upstream,
+		Listeners:          config.Listeners,
+		Policies:           config.Policies,
+		Roles:              config.Roles,
+		UsageWeights:       config.UsageWeights,
+		BurstDetection:     config.BurstDetection,
+		DenialAlerts:       config.DenialAlerts,
+		MaxIdleConnections: config.MaxIdleConnections,
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create enforcer: %w", err)
+	}
+
+	return &Server{
+		config:  config,
+		service: service,
+	}, nil
+}
+
+// Start begins accepting connections on the configured address, or listener
+func (s *Server) Start(ctx context.Context) error {
+	return s.service.Start(ctx, s.config.Address)
+}
+
+// Stop gracefully shuts the server down
+func (s *Server) Stop(ctx context.Context) error {
+	return s.service.Stop(ctx)
+}
+
+// Drain stops accepting connections and closes each open one as soon as its
+// client is outside a transaction. It returns once none is left, or after timeout
+// when the remaining connections are closed anyway. Stop the server afterwards.
+func (s *Server) Drain(timeout time.Duration) {
+	s.service.Drain(timeout)
+	<-s.service.Drained()
+}
+
+// Started returns a channel that is closed once the server accepts connections
+func (s *Server) Started() <-chan struct{} {
+	return s.service.Started()
+}
+
+// Address returns the resolved listen address
+func (s *Server) Address() string {
+	return s.service.Address()
+}
+
+// Addresses returns the resolved address of every listener by name, the
+// default listener having none
+func (s *Server) Addresses() map[string]string {
+	return s.service.Addresses()
+}
+
+// EnableMaintenance rejects new connections covered by the window until it is disabled
+func (s *Server) EnableMaintenance(window MaintenanceWindow) {
+	s.service.Maintenance().Enable(window)
+}
+
+// DisableMaintenance ends the maintenance window for database ("" for the whole listener)
+func (s *Server) DisableMaintenance(database string) {
+	s.service.Maintenance().Disable(database)
+}
+
+// ReloadPolicies replaces the policies of the built-in policy engine without
+// dropping connections; it fails when a custom PolicyEngine is configured
+func (s *Server) ReloadPolicies(policies []QuotaPolicy) error {
+	return s.service.ReloadPolicies(policies)
+}
+
+// SetRoles replaces the members of the roles policies apply to; it fails when a
+// custom PolicyEngine is configured
+func (s *Server) SetRoles(roles map[string][]string) error {
+	return s.service.SetRoles(roles)
+}
+
+// InstanceID returns the identifier of this replica
+func (s *Server) InstanceID() string {
+	return s.service.InstanceID()
+}
+
+// Upstreams returns the currently resolved upstream targets
+func (s *Server) Upstreams() []UpstreamTarget {
+	if s.service.Upstreams() == nil {
+		return nil
+	}
+	return s.service.Upstreams().Targets()
+}
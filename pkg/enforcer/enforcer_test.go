@@ -0,0 +1,318 @@
+package enforcer
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/pkg/testkit"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingPolicyEngine allows every query and records what it evaluated
+type countingPolicyEngine struct {
+	mu      sync.Mutex
+	queries []string
+}
+
+func (e *countingPolicyEngine) Evaluate(ctx context.Context, query *Query) (Decision, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.queries = append(e.queries, query.Normalized)
+	return Decision{Action: DecisionAllow}, nil
+}
+
+func (e *countingPolicyEngine) Queries() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.queries...)
+}
+
+func TestServer_PluggablePolicyEngine(t *testing.T) {
+	engine := &countingPolicyEngine{}
+
+	server, err := New(Config{
+		Address:      "127.0.0.1:0",
+		PolicyEngine: engine,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, server.Start(ctx))
+	<-server.Started()
+	defer func() {
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), time.Second)
+		defer stopCancel()
+		assert.NoError(t, server.Stop(stopCtx))
+	}()
+
+	conn, err := net.Dial("tcp", server.Address())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	frontend := pgproto3.NewFrontend(conn, conn)
+	frontend.Send(&pgproto3.Query{String: "SELECT * FROM users WHERE id = 1"})
+	require.NoError(t, frontend.Flush())
+
+	assert.Eventually(t, func() bool {
+		return len(engine.Queries()) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"SELECT * FROM users WHERE id = $1"}, engine.Queries())
+}
+
+func TestNew_InvalidPolicies(t *testing.T) {
+	_, err := New(Config{
+		Address:  "127.0.0.1:0",
+		Policies: []QuotaPolicy{{Name: "broken"}},
+	})
+	assert.Error(t, err)
+}
+
+func TestServer_ReloadPolicies(t *testing.T) {
+	server, err := New(Config{Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, server.Start(ctx))
+	<-server.Started()
+	defer func() {
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), time.Second)
+		defer stopCancel()
+		assert.NoError(t, server.Stop(stopCtx))
+	}()
+
+	conn, err := net.Dial("tcp", server.Address())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Policies added at runtime apply to connections that are already open
+	require.NoError(t, server.ReloadPolicies([]QuotaPolicy{{Name: "global", Limit: 1, Window: time.Hour}}))
+
+	frontend := pgproto3.NewFrontend(conn, conn)
+	frontend.Send(&pgproto3.Query{String: "SELECT 1"})
+	frontend.Send(&pgproto3.Query{String: "SELECT 1"})
+	require.NoError(t, frontend.Flush())
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	message, err := frontend.Receive()
+	require.NoError(t, err)
+	errorResponse, ok := message.(*pgproto3.ErrorResponse)
+	require.True(t, ok, "Expected an ErrorResponse, got %T", message)
+	assert.Contains(t, errorResponse.Message, `quota "global" exceeded`)
+
+	assert.Error(t, server.ReloadPolicies([]QuotaPolicy{{Name: "broken"}}))
+}
+
+func TestServer_ReloadPoliciesWithCustomEngine(t *testing.T) {
+	server, err := New(Config{
+		Address:      "127.0.0.1:0",
+		PolicyEngine: &countingPolicyEngine{},
+	})
+	require.NoError(t, err)
+
+	assert.Error(t, server.ReloadPolicies([]QuotaPolicy{{Name: "global", Limit: 1, Window: time.Hour}}))
+}
+
+// recordingPublisher keeps the query events it is given
+type recordingPublisher struct {
+	mu     sync.Mutex
+	events []QueryEvent
+}
+
+func (p *recordingPublisher) Publish(event QueryEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, event)
+}
+
+func (p *recordingPublisher) Events() []QueryEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]QueryEvent(nil), p.events...)
+}
+
+func TestServer_QueryEventPublisher(t *testing.T) {
+	publisher := &recordingPublisher{}
+	server, err := New(Config{
+		Address:             "127.0.0.1:0",
+		InstanceID:          "enforcer-1",
+		Policies:            []QuotaPolicy{{Name: "global", Limit: 1, Window: time.Hour}},
+		QueryEventPublisher: publisher,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, server.Start(ctx))
+	<-server.Started()
+	defer func() {
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), time.Second)
+		defer stopCancel()
+		assert.NoError(t, server.Stop(stopCtx))
+	}()
+
+	conn, err := net.Dial("tcp", server.Address())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	frontend := pgproto3.NewFrontend(conn, conn)
+	frontend.Send(&pgproto3.Query{String: "SELECT 1"})
+	frontend.Send(&pgproto3.Query{String: "SELECT 2"})
+	require.NoError(t, frontend.Flush())
+
+	require.Eventually(t, func() bool {
+		return len(publisher.Events()) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	events := publisher.Events()
+	assert.Equal(t, "enforcer-1", events[0].InstanceID)
+	assert.Equal(t, "SELECT $1", events[0].Normalized)
+	assert.Equal(t, DecisionAllow, events[0].Decision)
+	assert.Equal(t, DecisionDeny, events[1].Decision)
+	assert.Equal(t, "global", events[1].Policy)
+}
+
+func TestServer_Listeners(t *testing.T) {
+	result := testkit.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}, CommandTag: "SELECT 1"}
+	primary := testkit.StartFakeBackend(t)
+	primary.Handle("SELECT 1", result)
+	analytics := testkit.StartFakeBackend(t)
+	analytics.Handle("SELECT 1", result)
+
+	server, err := New(Config{
+		Address:   "127.0.0.1:0",
+		Upstream:  primary.Addr(),
+		Listeners: []ListenerConfig{{Name: "analytics", Address: "127.0.0.1:0", Upstream: analytics.Addr()}},
+		Policies:  []QuotaPolicy{{Name: "analytics-hourly", Listener: "analytics", Limit: 1, Window: time.Hour}},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, server.Start(ctx))
+	<-server.Started()
+	defer func() {
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), time.Second)
+		defer stopCancel()
+		assert.NoError(t, server.Stop(stopCtx))
+	}()
+
+	addresses := server.Addresses()
+	require.Len(t, addresses, 2)
+	assert.Equal(t, server.Address(), addresses[""])
+
+	// The policy of the analytics listener does not apply to the default one
+	client := testkit.MustDial(t, server.Address(), testkit.ClientConfig{User: "alice", Database: "app"})
+	defer client.Close()
+	for i := 0; i < 2; i++ {
+		_, err := client.Query("SELECT 1")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"SELECT 1", "SELECT 1"}, primary.Queries())
+
+	client = testkit.MustDial(t, addresses["analytics"], testkit.ClientConfig{User: "alice", Database: "app"})
+	defer client.Close()
+	_, err = client.Query("SELECT 1")
+	require.NoError(t, err)
+	_, err = client.Query("SELECT 1")
+	var serverErr *testkit.ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Contains(t, serverErr.Message, `quota "analytics-hourly" exceeded`)
+	assert.Equal(t, []string{"SELECT 1"}, analytics.Queries(), "The listener should proxy to its own upstream")
+}
+
+// constantNormalizer fingerprints every query alike
+type constantNormalizer struct{}
+
+func (constantNormalizer) Normalize(rawQuery string) (NormalizedQuery, error) {
+	return NormalizedQuery{Original: rawQuery, Normalized: "QUERY", Hash: NewQueryHash("query")}, nil
+}
+
+func TestServer_EmbeddedListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	engine := &countingPolicyEngine{}
+
+	server, err := New(Config{
+		Listener:     listener,
+		PolicyEngine: engine,
+		Normalizer:   constantNormalizer{},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, server.Start(ctx))
+	<-server.Started()
+	defer func() {
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), time.Second)
+		defer stopCancel()
+		assert.NoError(t, server.Stop(stopCtx))
+	}()
+	assert.Equal(t, listener.Addr().String(), server.Address(), "The server should accept on the given listener")
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	frontend := pgproto3.NewFrontend(conn, conn)
+	frontend.Send(&pgproto3.Query{String: "SELECT * FROM users WHERE id = 1"})
+	require.NoError(t, frontend.Flush())
+
+	assert.Eventually(t, func() bool {
+		return len(engine.Queries()) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"QUERY"}, engine.Queries(), "Queries should be fingerprinted by the given normalizer")
+}
+
+func TestServer_Middleware(t *testing.T) {
+	denyDeletes := func(ctx context.Context, query *Query, next QueryHandler) (Decision, error) {
+		if strings.HasPrefix(query.Raw, "DELETE") {
+			return Decision{Action: DecisionDeny, Reason: "deletes are disabled"}, nil
+		}
+		return next(ctx, query)
+	}
+	engine := &countingPolicyEngine{}
+	server, err := New(Config{
+		Address:      "127.0.0.1:0",
+		PolicyEngine: engine,
+		Middleware:   []QueryMiddleware{denyDeletes},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, server.Start(ctx))
+	<-server.Started()
+	defer func() {
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), time.Second)
+		defer stopCancel()
+		assert.NoError(t, server.Stop(stopCtx))
+	}()
+
+	conn, err := net.Dial("tcp", server.Address())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	frontend := pgproto3.NewFrontend(conn, conn)
+	frontend.Send(&pgproto3.Query{String: "DELETE FROM users"})
+	require.NoError(t, frontend.Flush())
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	message, err := frontend.Receive()
+	require.NoError(t, err)
+	errorResponse, ok := message.(*pgproto3.ErrorResponse)
+	require.True(t, ok, "Expected an ErrorResponse, got %T", message)
+	assert.Contains(t, errorResponse.Message, "deletes are disabled")
+	assert.Empty(t, engine.Queries(), "The middleware should decide before the policy engine")
+}
@@ -4,9 +4,34 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 )
 
+// Level is the minimum severity written by a SimpleLogger
+type Level int
+
+const (
+	// LevelDebug writes every message; it is the zero value
+	LevelDebug Level = iota
+	LevelInfo
+	LevelError
+)
+
+// ParseLevel parses a level name: debug, info or error
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelDebug, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
 // Logger defines the interface for application logging
 type Logger interface {
 	Info(msg string, args ...interface{})
@@ -19,6 +44,7 @@ type Logger interface {
 type SimpleLogger struct {
 	logger *log.Logger
 	fields map[string]interface{}
+	level  Level
 }
 
 // NewSimpleLogger creates a new SimpleLogger instance
@@ -29,9 +55,16 @@ func NewSimpleLogger() *SimpleLogger {
 	}
 }
 
+// SetLevel drops messages below level, including from loggers later derived with WithField
+func (l *SimpleLogger) SetLevel(level Level) {
+	l.level = level
+}
+
 // Info logs an info message
 func (l *SimpleLogger) Info(msg string, args ...interface{}) {
-	l.logWithLevel("INFO", msg, args...)
+	if l.level <= LevelInfo {
+		l.logWithLevel("INFO", msg, args...)
+	}
 }
 
 // Error logs an error message
@@ -41,7 +74,9 @@ func (l *SimpleLogger) Error(msg string, args ...interface{}) {
 
 // Debug logs a debug message
 func (l *SimpleLogger) Debug(msg string, args ...interface{}) {
-	l.logWithLevel("DEBUG", msg, args...)
+	if l.level <= LevelDebug {
+		l.logWithLevel("DEBUG", msg, args...)
+	}
 }
 
 // WithField returns a new logger with an additional field
@@ -55,6 +90,7 @@ func (l *SimpleLogger) WithField(key string, value interface{}) Logger {
 	return &SimpleLogger{
 		logger: l.logger,
 		fields: newFields,
+		level:  l.level,
 	}
 }
 
@@ -1,6 +1,8 @@
 package logger
 
 import (
+	"bytes"
+	"log"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -173,3 +175,28 @@ func TestLogger_FieldIsolation(t *testing.T) {
 	_, exists := baseMock.getFieldValue("logger_id")
 	assert.False(t, exists)
 }
+
+func TestSimpleLogger_Level(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewSimpleLogger()
+	logger.logger = log.New(&out, "", 0)
+	logger.SetLevel(LevelInfo)
+
+	derived := logger.WithField("connection_id", "conn_1")
+	derived.Debug("hidden")
+	derived.Info("shown")
+	derived.Error("also shown")
+
+	assert.NotContains(t, out.String(), "hidden")
+	assert.Contains(t, out.String(), "INFO: shown")
+	assert.Contains(t, out.String(), "ERROR: also shown")
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("ERROR")
+	assert.NoError(t, err)
+	assert.Equal(t, LevelError, level)
+
+	_, err = ParseLevel("verbose")
+	assert.Error(t, err)
+}
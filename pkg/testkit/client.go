@@ -0,0 +1,264 @@
+package testkit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// QueryResult holds the messages returned by the server for a query
+type QueryResult struct {
+	Columns    []string
+	Rows       [][]string
+	CommandTag string
+	Notices    []string
+}
+
+// Client is a minimal PostgreSQL frontend used to drive servers in tests
+type Client struct {
+	conn      net.Conn
+	frontend  *pgproto3.Frontend
+	params    map[string]string
+	processID uint32
+	secretKey uint32
+	txStatus  byte
+}
+
+// ClientConfig configures how a Client connects
+type ClientConfig struct {
+	User        string
+	Database    string
+	Password    string
+	Parameters  map[string]string
+	DialTimeout time.Duration
+}
+
+// Dial connects to addr and completes the startup handshake
+func Dial(addr string, config ClientConfig) (*Client, error) {
+	timeout := config.DialTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %w", addr, err)
+	}
+
+	client := &Client{
+		conn:     conn,
+		frontend: pgproto3.NewFrontend(conn, conn),
+		params:   make(map[string]string),
+	}
+
+	if err := client.startup(config); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// startup sends the StartupMessage and processes authentication
+func (c *Client) startup(config ClientConfig) error {
+	params := map[string]string{
+		"user":     config.User,
+		"database": config.Database,
+	}
+	if params["user"] == "" {
+		params["user"] = "testkit"
+	}
+	if params["database"] == "" {
+		params["database"] = params["user"]
+	}
+	for k, v := range config.Parameters {
+		params[k] = v
+	}
+
+	c.frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      params,
+	})
+	if err := c.frontend.Flush(); err != nil {
+		return fmt.Errorf("failed to send startup message: %w", err)
+	}
+
+	for {
+		msg, err := c.frontend.Receive()
+		if err != nil {
+			return fmt.Errorf("failed to receive startup response: %w", err)
+		}
+
+		switch m := msg.(type) {
+		case *pgproto3.AuthenticationOk:
+		case *pgproto3.AuthenticationCleartextPassword:
+			c.frontend.Send(&pgproto3.PasswordMessage{Password: config.Password})
+			if err := c.frontend.Flush(); err != nil {
+				return fmt.Errorf("failed to send password: %w", err)
+			}
+		case *pgproto3.ParameterStatus:
+			c.params[m.Name] = m.Value
+		case *pgproto3.BackendKeyData:
+			c.processID = m.ProcessID
+			c.secretKey = m.SecretKey
+		case *pgproto3.ErrorResponse:
+			return serverError(m)
+		case *pgproto3.ReadyForQuery:
+			c.txStatus = m.TxStatus
+			return nil
+		default:
+			return fmt.Errorf("unexpected startup message %T", msg)
+		}
+	}
+}
+
+// Query runs a simple protocol query and collects its result.
+// When the query text contains several statements, the result of the last one is returned.
+func (c *Client) Query(sql string) (*QueryResult, error) {
+	c.frontend.Send(&pgproto3.Query{String: sql})
+	if err := c.frontend.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to send query: %w", err)
+	}
+	return c.readResult()
+}
+
+// Exec runs a query through the extended protocol (Parse/Bind/Execute/Sync)
+func (c *Client) Exec(sql string, args ...string) (*QueryResult, error) {
+	params := make([][]byte, len(args))
+	for i, arg := range args {
+		params[i] = []byte(arg)
+	}
+
+	c.frontend.SendParse(&pgproto3.Parse{Query: sql})
+	c.frontend.SendBind(&pgproto3.Bind{Parameters: params})
+	c.frontend.SendDescribe(&pgproto3.Describe{ObjectType: 'P'})
+	c.frontend.SendExecute(&pgproto3.Execute{})
+	c.frontend.SendSync(&pgproto3.Sync{})
+	if err := c.frontend.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to send extended query: %w", err)
+	}
+	return c.readResult()
+}
+
+// readResult reads messages until ReadyForQuery and returns the collected result
+func (c *Client) readResult() (*QueryResult, error) {
+	result := &QueryResult{}
+	var queryErr error
+
+	for {
+		msg, err := c.frontend.Receive()
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive query response: %w", err)
+		}
+
+		switch m := msg.(type) {
+		case *pgproto3.RowDescription:
+			result.Columns = result.Columns[:0]
+			result.Rows = nil
+			for _, f := range m.Fields {
+				result.Columns = append(result.Columns, string(f.Name))
+			}
+		case *pgproto3.DataRow:
+			row := make([]string, len(m.Values))
+			for i, v := range m.Values {
+				row[i] = string(v)
+			}
+			result.Rows = append(result.Rows, row)
+		case *pgproto3.CommandComplete:
+			result.CommandTag = string(m.CommandTag)
+		case *pgproto3.NoticeResponse:
+			result.Notices = append(result.Notices, m.Message)
+		case *pgproto3.ErrorResponse:
+			queryErr = serverError(m)
+			if m.Severity == "FATAL" || m.Severity == "PANIC" {
+				return nil, queryErr
+			}
+		case *pgproto3.ReadyForQuery:
+			c.txStatus = m.TxStatus
+			if queryErr != nil {
+				return nil, queryErr
+			}
+			return result, nil
+		}
+	}
+}
+
+// Parameter returns a ParameterStatus value reported by the server
+func (c *Client) Parameter(name string) string {
+	return c.params[name]
+}
+
+// BackendKey returns the process ID and secret key reported by the server
+func (c *Client) BackendKey() (uint32, uint32) {
+	return c.processID, c.secretKey
+}
+
+// Cancel asks the server to cancel the query running on this connection, sending
+// a CancelRequest with the backend key over a new connection
+func (c *Client) Cancel() error {
+	conn, err := net.DialTimeout("tcp", c.conn.RemoteAddr().String(), 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to dial for cancellation: %w", err)
+	}
+	defer conn.Close()
+
+	request, err := (&pgproto3.CancelRequest{ProcessID: c.processID, SecretKey: c.secretKey}).Encode(nil)
+	if err != nil {
+		return fmt.Errorf("failed to encode CancelRequest: %w", err)
+	}
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("failed to send CancelRequest: %w", err)
+	}
+	return nil
+}
+
+// TxStatus returns the transaction status from the last ReadyForQuery
+func (c *Client) TxStatus() byte {
+	return c.txStatus
+}
+
+// WaitClosed reads until the server closes the connection and returns the FATAL
+// error it sent before closing, if any. Other messages are discarded.
+func (c *Client) WaitClosed(timeout time.Duration) error {
+	if err := c.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	defer func() {
+		_ = c.conn.SetReadDeadline(time.Time{})
+	}()
+
+	for {
+		msg, err := c.frontend.Receive()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("connection was not closed: %w", err)
+		}
+		if m, ok := msg.(*pgproto3.ErrorResponse); ok && m.Severity == "FATAL" {
+			return serverError(m)
+		}
+	}
+}
+
+// Close sends Terminate and closes the connection
+func (c *Client) Close() error {
+	c.frontend.Send(&pgproto3.Terminate{})
+	_ = c.frontend.Flush()
+	return c.conn.Close()
+}
+
+// serverError converts an ErrorResponse into a ServerError
+func serverError(m *pgproto3.ErrorResponse) *ServerError {
+	return &ServerError{
+		Severity: m.Severity,
+		Code:     m.Code,
+		Message:  m.Message,
+		Detail:   m.Detail,
+		Hint:     m.Hint,
+	}
+}
@@ -0,0 +1,141 @@
+package testkit
+
+import (
+	"sync"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+)
+
+// FakeClock is a domain.Clock that only moves when told to.
+// Timers fire synchronously from Advance and Set once their deadline is reached.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	added  chan struct{} // closed and replaced whenever a timer is created
+}
+
+// NewFakeClock creates a FakeClock starting at start
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{
+		now:   start,
+		added: make(chan struct{}),
+	}
+}
+
+// Now returns the fake current time
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer creates a timer firing once the clock has advanced by d
+func (c *FakeClock) NewTimer(d time.Duration) domain.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	timer := &fakeTimer{
+		clock:    c,
+		deadline: c.now.Add(d),
+		ch:       make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		timer.ch <- c.now
+		return timer
+	}
+
+	c.timers = append(c.timers, timer)
+	close(c.added)
+	c.added = make(chan struct{})
+	return timer
+}
+
+// Advance moves the clock forward by d and fires due timers
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setLocked(c.now.Add(d))
+}
+
+// Set moves the clock to t and fires due timers. Moving backwards fires nothing.
+func (c *FakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setLocked(t)
+}
+
+// PendingTimers returns the number of timers that have not fired or been stopped
+func (c *FakeClock) PendingTimers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// WaitForTimers blocks until at least n timers are pending or the timeout expires,
+// and reports whether they were. Use it to make sure the code under test is
+// waiting on the clock before advancing it.
+func (c *FakeClock) WaitForTimers(n int, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		c.mu.Lock()
+		pending := len(c.timers)
+		added := c.added
+		c.mu.Unlock()
+
+		if pending >= n {
+			return true
+		}
+
+		select {
+		case <-added:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// setLocked updates the time and fires every timer whose deadline has passed
+func (c *FakeClock) setLocked(t time.Time) {
+	c.now = t
+
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.deadline.After(t) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.ch <- t
+	}
+	c.timers = pending
+}
+
+// remove drops a timer from the pending list and reports whether it was pending
+func (c *FakeClock) remove(timer *fakeTimer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, pending := range c.timers {
+		if pending == timer {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fakeTimer is a timer driven by a FakeClock
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	return t.clock.remove(t)
+}
@@ -0,0 +1,55 @@
+package testkit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	assert.Equal(t, start, clock.Now())
+
+	short := clock.NewTimer(time.Second)
+	long := clock.NewTimer(time.Minute)
+	stopped := clock.NewTimer(time.Second)
+	assert.Equal(t, 3, clock.PendingTimers())
+
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop(), "Stopping twice should report the timer was no longer pending")
+
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), clock.Now())
+
+	select {
+	case fired := <-short.C():
+		assert.Equal(t, start.Add(time.Second), fired)
+	default:
+		t.Fatal("Due timer should have fired")
+	}
+	select {
+	case <-long.C():
+		t.Fatal("Timer should not fire before its deadline")
+	default:
+	}
+	assert.Equal(t, 1, clock.PendingTimers())
+
+	clock.Set(start.Add(time.Hour))
+	<-long.C()
+	assert.Zero(t, clock.PendingTimers())
+
+	immediate := clock.NewTimer(0)
+	<-immediate.C()
+}
+
+func TestFakeClock_WaitForTimers(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+
+	assert.False(t, clock.WaitForTimers(1, 10*time.Millisecond))
+
+	go clock.NewTimer(time.Minute)
+	require.True(t, clock.WaitForTimers(1, time.Second))
+}
@@ -0,0 +1,656 @@
+package testkit
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// Result is a canned response returned by the FakeBackend for a query
+type Result struct {
+	Columns    []string
+	Rows       [][]string
+	CommandTag string
+	Err        *ServerError
+}
+
+// ServerError represents a PostgreSQL ErrorResponse
+type ServerError struct {
+	Severity string
+	Code     string
+	Message  string
+	Detail   string
+	Hint     string
+}
+
+// Error implements the error interface
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("%s: %s (SQLSTATE %s)", e.Severity, e.Message, e.Code)
+}
+
+// toErrorResponse converts the ServerError to its wire representation
+func (e *ServerError) toErrorResponse() *pgproto3.ErrorResponse {
+	severity := e.Severity
+	if severity == "" {
+		severity = "ERROR"
+	}
+	return &pgproto3.ErrorResponse{
+		Severity:            severity,
+		SeverityUnlocalized: severity,
+		Code:                e.Code,
+		Message:             e.Message,
+		Detail:              e.Detail,
+		Hint:                e.Hint,
+	}
+}
+
+// QueryHandler produces a Result for a query received by the FakeBackend
+type QueryHandler func(query string) Result
+
+// FakeBackend is a scriptable in-process PostgreSQL server for tests.
+// It performs the startup handshake, answers simple and extended protocol
+// queries with canned results and can inject errors on demand.
+type FakeBackend struct {
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu             sync.Mutex
+	results        map[string]Result
+	fallback       QueryHandler
+	password       string
+	gssToken       string
+	parameters     map[string]string
+	queries        []string
+	startups       []map[string]string
+	cancels        []pgproto3.CancelRequest
+	conns          map[net.Conn]struct{}
+	tlsConfig      *tls.Config
+	tlsStates      []tls.ConnectionState
+	failStartup    *ServerError
+	dropNextQuery  bool
+	nextBackendPID uint32
+}
+
+// NewFakeBackend creates a new FakeBackend that is not yet listening
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		results: make(map[string]Result),
+		parameters: map[string]string{
+			"server_version":  "16.0",
+			"server_encoding": "UTF8",
+			"client_encoding": "UTF8",
+		},
+		conns:          make(map[net.Conn]struct{}),
+		nextBackendPID: 1000,
+	}
+}
+
+// Start begins listening on an ephemeral loopback port
+func (b *FakeBackend) Start() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	b.listener = listener
+
+	b.wg.Add(1)
+	go b.acceptConnections()
+
+	return nil
+}
+
+// Addr returns the address the FakeBackend is listening on
+func (b *FakeBackend) Addr() string {
+	if b.listener == nil {
+		return ""
+	}
+	return b.listener.Addr().String()
+}
+
+// Close stops the listener and closes all open client connections
+func (b *FakeBackend) Close() error {
+	var err error
+	if b.listener != nil {
+		err = b.listener.Close()
+	}
+
+	b.mu.Lock()
+	for conn := range b.conns {
+		_ = conn.Close()
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// Handle registers a canned result for an exact query text
+func (b *FakeBackend) Handle(query string, result Result) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.results[query] = result
+}
+
+// HandleFunc registers a handler used for queries without a canned result
+func (b *FakeBackend) HandleFunc(handler QueryHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fallback = handler
+}
+
+// RequirePassword makes the FakeBackend request a cleartext password during startup
+func (b *FakeBackend) RequirePassword(password string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.password = password
+}
+
+// RequireGSS makes the FakeBackend request GSSAPI authentication during startup:
+// it sends AuthenticationGSS, answers the client's first token with an
+// AuthenticationGSSContinue and accepts the client once its second token is token
+func (b *FakeBackend) RequireGSS(token string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.gssToken = token
+}
+
+// SetParameter sets a ParameterStatus value reported to clients during startup
+func (b *FakeBackend) SetParameter(name, value string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.parameters[name] = value
+}
+
+// EnableTLS makes the FakeBackend accept SSLRequests and encrypt the connection with config
+func (b *FakeBackend) EnableTLS(config *tls.Config) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tlsConfig = config
+}
+
+// TLSStates returns the TLS state of every encrypted connection received so far
+func (b *FakeBackend) TLSStates() []tls.ConnectionState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]tls.ConnectionState(nil), b.tlsStates...)
+}
+
+// FailStartup makes every subsequent startup fail with the given error
+func (b *FakeBackend) FailStartup(err *ServerError) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failStartup = err
+}
+
+// DropNextQuery makes the FakeBackend abruptly close the connection on the next query
+func (b *FakeBackend) DropNextQuery() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dropNextQuery = true
+}
+
+// DropConnections abruptly closes every open connection, as a restarting
+// server does, and keeps accepting new ones
+func (b *FakeBackend) DropConnections() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn := range b.conns {
+		_ = conn.Close()
+	}
+}
+
+// Queries returns every query text received so far, in order
+func (b *FakeBackend) Queries() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.queries...)
+}
+
+// StartupParameters returns the startup parameters of every connection received so far
+func (b *FakeBackend) StartupParameters() []map[string]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]map[string]string(nil), b.startups...)
+}
+
+// CancelRequests returns every CancelRequest received so far, in order
+func (b *FakeBackend) CancelRequests() []pgproto3.CancelRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]pgproto3.CancelRequest(nil), b.cancels...)
+}
+
+// acceptConnections accepts incoming connections and spawns handlers
+func (b *FakeBackend) acceptConnections() {
+	defer b.wg.Done()
+
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		b.mu.Lock()
+		b.conns[conn] = struct{}{}
+		b.mu.Unlock()
+
+		b.wg.Add(1)
+		go func(c net.Conn) {
+			defer b.wg.Done()
+			defer func() {
+				b.mu.Lock()
+				delete(b.conns, c)
+				b.mu.Unlock()
+				_ = c.Close()
+			}()
+
+			_ = b.serve(c)
+		}(conn)
+	}
+}
+
+// serve runs the protocol for a single client connection
+func (b *FakeBackend) serve(conn net.Conn) error {
+	backend, err := b.handshake(conn)
+	if err != nil {
+		return err
+	}
+
+	statements := make(map[string]string)
+	portals := make(map[string]string)
+	txStatus := byte('I')
+
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return err
+		}
+
+		switch m := msg.(type) {
+		case *pgproto3.Query:
+			if b.recordQuery(m.String) {
+				return io.EOF
+			}
+			// The result of each statement is sent as it completes
+			for _, statement := range b.statementsOf(m.String) {
+				result := b.resultFor(statement)
+				b.writeResult(backend, result, true)
+				txStatus = nextTxStatus(txStatus, statement, result)
+				if result.Err != nil {
+					break
+				}
+				if err := backend.Flush(); err != nil {
+					return err
+				}
+			}
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: txStatus})
+
+		case *pgproto3.Parse:
+			statements[m.Name] = m.Query
+			backend.Send(&pgproto3.ParseComplete{})
+
+		case *pgproto3.Bind:
+			portals[m.DestinationPortal] = statements[m.PreparedStatement]
+			backend.Send(&pgproto3.BindComplete{})
+
+		case *pgproto3.Describe:
+			query := statements[m.Name]
+			if m.ObjectType == 'P' {
+				query = portals[m.Name]
+			} else {
+				backend.Send(&pgproto3.ParameterDescription{})
+			}
+			result := b.resultFor(query)
+			if len(result.Columns) > 0 && result.Err == nil {
+				backend.Send(rowDescription(result.Columns))
+			} else {
+				backend.Send(&pgproto3.NoData{})
+			}
+
+		case *pgproto3.Execute:
+			query := portals[m.Portal]
+			if b.recordQuery(query) {
+				return io.EOF
+			}
+			result := b.resultFor(query)
+			b.writeResult(backend, result, false)
+			txStatus = nextTxStatus(txStatus, query, result)
+
+		case *pgproto3.Close:
+			if m.ObjectType == 'S' {
+				delete(statements, m.Name)
+			} else {
+				delete(portals, m.Name)
+			}
+			backend.Send(&pgproto3.CloseComplete{})
+
+		case *pgproto3.Sync:
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: txStatus})
+
+		case *pgproto3.Terminate:
+			return nil
+		}
+
+		if err := backend.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// handshake performs the startup phase, negotiating TLS when enabled and optionally
+// asking for a password. It returns the backend reading from the possibly encrypted connection.
+func (b *FakeBackend) handshake(conn net.Conn) (*pgproto3.Backend, error) {
+	backend := pgproto3.NewBackend(conn, conn)
+	for {
+		msg, err := backend.ReceiveStartupMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		switch m := msg.(type) {
+		case *pgproto3.SSLRequest:
+			b.mu.Lock()
+			tlsConfig := b.tlsConfig
+			b.mu.Unlock()
+
+			if tlsConfig == nil {
+				if _, err := conn.Write([]byte{'N'}); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			if _, err := conn.Write([]byte{'S'}); err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Server(conn, tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return nil, err
+			}
+
+			b.mu.Lock()
+			b.tlsStates = append(b.tlsStates, tlsConn.ConnectionState())
+			b.mu.Unlock()
+
+			conn = tlsConn
+			backend = pgproto3.NewBackend(conn, conn)
+
+		case *pgproto3.GSSEncRequest:
+			if _, err := conn.Write([]byte{'N'}); err != nil {
+				return nil, err
+			}
+
+		case *pgproto3.CancelRequest:
+			b.mu.Lock()
+			b.cancels = append(b.cancels, *m)
+			b.mu.Unlock()
+			return nil, io.EOF
+
+		case *pgproto3.StartupMessage:
+			params := make(map[string]string, len(m.Parameters))
+			for k, v := range m.Parameters {
+				params[k] = v
+			}
+
+			b.mu.Lock()
+			b.startups = append(b.startups, params)
+			failure := b.failStartup
+			password := b.password
+			gssToken := b.gssToken
+			b.nextBackendPID++
+			pid := b.nextBackendPID
+			statusParams := make(map[string]string, len(b.parameters))
+			for k, v := range b.parameters {
+				statusParams[k] = v
+			}
+			b.mu.Unlock()
+
+			if failure != nil {
+				backend.Send(failure.toErrorResponse())
+				_ = backend.Flush()
+				return nil, io.EOF
+			}
+
+			if password != "" {
+				if err := b.authenticate(backend, password); err != nil {
+					return nil, err
+				}
+			}
+			if gssToken != "" {
+				if err := b.authenticateGSS(backend, gssToken); err != nil {
+					return nil, err
+				}
+			}
+
+			backend.Send(&pgproto3.AuthenticationOk{})
+			for name, value := range statusParams {
+				backend.Send(&pgproto3.ParameterStatus{Name: name, Value: value})
+			}
+			backend.Send(&pgproto3.BackendKeyData{ProcessID: pid, SecretKey: pid * 7})
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+			return backend, backend.Flush()
+
+		default:
+			return nil, fmt.Errorf("unexpected startup message %T", msg)
+		}
+	}
+}
+
+// authenticate requests and checks a cleartext password
+func (b *FakeBackend) authenticate(backend *pgproto3.Backend, password string) error {
+	backend.Send(&pgproto3.AuthenticationCleartextPassword{})
+	if err := backend.Flush(); err != nil {
+		return err
+	}
+
+	if err := backend.SetAuthType(pgproto3.AuthTypeCleartextPassword); err != nil {
+		return err
+	}
+
+	msg, err := backend.Receive()
+	if err != nil {
+		return err
+	}
+
+	pw, ok := msg.(*pgproto3.PasswordMessage)
+	if !ok || pw.Password != password {
+		backend.Send((&ServerError{
+			Severity: "FATAL",
+			Code:     "28P01",
+			Message:  "password authentication failed",
+		}).toErrorResponse())
+		_ = backend.Flush()
+		return io.EOF
+	}
+
+	return nil
+}
+
+// authenticateGSS runs a two-step GSSAPI exchange, accepting the client once its
+// second token is token
+func (b *FakeBackend) authenticateGSS(backend *pgproto3.Backend, token string) error {
+	backend.Send(&pgproto3.AuthenticationGSS{})
+	if err := backend.Flush(); err != nil {
+		return err
+	}
+
+	var last []byte
+	for step := 0; step < 2; step++ {
+		if err := backend.SetAuthType(pgproto3.AuthTypeGSS); err != nil {
+			return err
+		}
+		msg, err := backend.Receive()
+		if err != nil {
+			return err
+		}
+		response, ok := msg.(*pgproto3.GSSResponse)
+		if !ok {
+			return fmt.Errorf("unexpected GSSAPI response %T", msg)
+		}
+		last = response.Data
+		if step == 0 {
+			backend.Send(&pgproto3.AuthenticationGSSContinue{Data: []byte("server-token")})
+			if err := backend.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if string(last) != token {
+		backend.Send((&ServerError{
+			Severity: "FATAL",
+			Code:     "28000",
+			Message:  "GSSAPI authentication failed",
+		}).toErrorResponse())
+		_ = backend.Flush()
+		return io.EOF
+	}
+	return nil
+}
+
+// recordQuery stores a received query and reports whether the connection must be dropped
+func (b *FakeBackend) recordQuery(query string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queries = append(b.queries, query)
+	if b.dropNextQuery {
+		b.dropNextQuery = false
+		return true
+	}
+	return false
+}
+
+// statementsOf returns the statements a simple query is answered as: the query
+// itself when it has a canned result, and otherwise each statement separated by
+// a semicolon, like PostgreSQL runs them. Semicolons are not told apart from
+// those in literals.
+func (b *FakeBackend) statementsOf(query string) []string {
+	b.mu.Lock()
+	_, canned := b.results[query]
+	b.mu.Unlock()
+	if canned || !strings.Contains(query, ";") {
+		return []string{query}
+	}
+
+	var statements []string
+	for _, statement := range strings.Split(query, ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	if len(statements) == 0 {
+		return []string{query}
+	}
+	return statements
+}
+
+// resultFor looks up the canned result for a query
+func (b *FakeBackend) resultFor(query string) Result {
+	b.mu.Lock()
+	result, ok := b.results[query]
+	fallback := b.fallback
+	b.mu.Unlock()
+
+	if ok {
+		return result
+	}
+	if fallback != nil {
+		return fallback(query)
+	}
+	return Result{CommandTag: defaultCommandTag(query)}
+}
+
+// writeResult writes a result, including the row description when describe is true
+func (b *FakeBackend) writeResult(backend *pgproto3.Backend, result Result, describe bool) {
+	if result.Err != nil {
+		backend.Send(result.Err.toErrorResponse())
+		return
+	}
+
+	if describe && len(result.Columns) > 0 {
+		backend.Send(rowDescription(result.Columns))
+	}
+
+	for _, row := range result.Rows {
+		values := make([][]byte, len(row))
+		for i, v := range row {
+			values[i] = []byte(v)
+		}
+		backend.Send(&pgproto3.DataRow{Values: values})
+	}
+
+	tag := result.CommandTag
+	if tag == "" {
+		tag = fmt.Sprintf("SELECT %d", len(result.Rows))
+	}
+	backend.Send(&pgproto3.CommandComplete{CommandTag: []byte(tag)})
+}
+
+// rowDescription builds a text-format RowDescription for the given columns
+func rowDescription(columns []string) *pgproto3.RowDescription {
+	fields := make([]pgproto3.FieldDescription, len(columns))
+	for i, name := range columns {
+		fields[i] = pgproto3.FieldDescription{
+			Name:         []byte(name),
+			DataTypeOID:  25, // text
+			DataTypeSize: -1,
+			TypeModifier: -1,
+		}
+	}
+	return &pgproto3.RowDescription{Fields: fields}
+}
+
+// defaultCommandTag derives a plausible command tag from the query's leading keyword
+func defaultCommandTag(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "EMPTY"
+	}
+
+	keyword := strings.ToUpper(strings.TrimSuffix(fields[0], ";"))
+	switch keyword {
+	case "SELECT":
+		return "SELECT 0"
+	case "INSERT":
+		return "INSERT 0 0"
+	case "UPDATE", "DELETE":
+		return keyword + " 0"
+	default:
+		return keyword
+	}
+}
+
+// nextTxStatus follows transaction control statements to the transaction status
+// after query; a failing query aborts the transaction it runs in
+func nextTxStatus(status byte, query string, result Result) byte {
+	if result.Err != nil {
+		if status == 'T' {
+			return 'E'
+		}
+		return status
+	}
+
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return status
+	}
+	switch strings.ToUpper(strings.TrimSuffix(fields[0], ";")) {
+	case "BEGIN", "START":
+		return 'T'
+	case "COMMIT", "END", "ROLLBACK", "ABORT":
+		return 'I'
+	default:
+		return status
+	}
+}
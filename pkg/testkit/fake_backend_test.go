@@ -0,0 +1,162 @@
+package testkit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeBackend_Handshake(t *testing.T) {
+	backend := StartFakeBackend(t)
+	backend.SetParameter("application_name", "fake")
+
+	client := MustDial(t, backend.Addr(), ClientConfig{
+		User:       "alice",
+		Database:   "app",
+		Parameters: map[string]string{"application_name": "tests"},
+	})
+
+	assert.Equal(t, "16.0", client.Parameter("server_version"))
+	assert.Equal(t, "fake", client.Parameter("application_name"))
+	assert.Equal(t, byte('I'), client.TxStatus())
+
+	pid, key := client.BackendKey()
+	assert.NotZero(t, pid)
+	assert.NotZero(t, key)
+
+	require.NoError(t, client.Cancel())
+	require.Eventually(t, func() bool { return len(backend.CancelRequests()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, pid, backend.CancelRequests()[0].ProcessID)
+	assert.Equal(t, key, backend.CancelRequests()[0].SecretKey)
+
+	startups := backend.StartupParameters()
+	require.Len(t, startups, 1)
+	assert.Equal(t, "alice", startups[0]["user"])
+	assert.Equal(t, "app", startups[0]["database"])
+	assert.Equal(t, "tests", startups[0]["application_name"])
+}
+
+func TestFakeBackend_CannedResults(t *testing.T) {
+	backend := StartFakeBackend(t)
+	backend.Handle("SELECT id, name FROM users", Result{
+		Columns: []string{"id", "name"},
+		Rows:    [][]string{{"1", "alice"}, {"2", "bob"}},
+	})
+	backend.Handle("SELECT broken", Result{
+		Err: &ServerError{Code: "42703", Message: "column does not exist"},
+	})
+
+	client := MustDial(t, backend.Addr(), ClientConfig{})
+
+	tests := []struct {
+		name        string
+		run         func() (*QueryResult, error)
+		expected    *QueryResult
+		expectedErr string
+	}{
+		{
+			name: "Simple protocol rows",
+			run:  func() (*QueryResult, error) { return client.Query("SELECT id, name FROM users") },
+			expected: &QueryResult{
+				Columns:    []string{"id", "name"},
+				Rows:       [][]string{{"1", "alice"}, {"2", "bob"}},
+				CommandTag: "SELECT 2",
+			},
+		},
+		{
+			name: "Extended protocol rows",
+			run:  func() (*QueryResult, error) { return client.Exec("SELECT id, name FROM users") },
+			expected: &QueryResult{
+				Columns:    []string{"id", "name"},
+				Rows:       [][]string{{"1", "alice"}, {"2", "bob"}},
+				CommandTag: "SELECT 2",
+			},
+		},
+		{
+			name:     "Default command tag",
+			run:      func() (*QueryResult, error) { return client.Query("UPDATE users SET name = 'x'") },
+			expected: &QueryResult{CommandTag: "UPDATE 0"},
+		},
+		{
+			name:        "Injected error",
+			run:         func() (*QueryResult, error) { return client.Query("SELECT broken") },
+			expectedErr: "42703",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := tt.run()
+
+			if tt.expectedErr != "" {
+				var serverErr *ServerError
+				require.ErrorAs(t, err, &serverErr)
+				assert.Equal(t, tt.expectedErr, serverErr.Code)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+
+	assert.Equal(t, []string{
+		"SELECT id, name FROM users",
+		"SELECT id, name FROM users",
+		"UPDATE users SET name = 'x'",
+		"SELECT broken",
+	}, backend.Queries())
+}
+
+func TestFakeBackend_HandleFunc(t *testing.T) {
+	backend := StartFakeBackend(t)
+	backend.HandleFunc(func(query string) Result {
+		return Result{Columns: []string{"echo"}, Rows: [][]string{{query}}}
+	})
+
+	client := MustDial(t, backend.Addr(), ClientConfig{})
+
+	result, err := client.Query("SELECT 42")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"SELECT 42"}}, result.Rows)
+}
+
+func TestFakeBackend_Password(t *testing.T) {
+	backend := StartFakeBackend(t)
+	backend.RequirePassword("secret")
+
+	_, err := Dial(backend.Addr(), ClientConfig{Password: "wrong"})
+	var serverErr *ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, "28P01", serverErr.Code)
+
+	client, err := Dial(backend.Addr(), ClientConfig{Password: "secret"})
+	require.NoError(t, err)
+	assert.NoError(t, client.Close())
+}
+
+func TestFakeBackend_ErrorInjection(t *testing.T) {
+	backend := StartFakeBackend(t)
+
+	client := MustDial(t, backend.Addr(), ClientConfig{})
+	backend.DropNextQuery()
+
+	_, err := client.Query("SELECT 1")
+	assert.Error(t, err)
+
+	client = MustDial(t, backend.Addr(), ClientConfig{})
+	backend.DropConnections()
+	assert.NoError(t, client.WaitClosed(time.Second), "The dropped connection should be closed")
+	client = MustDial(t, backend.Addr(), ClientConfig{})
+	_, err = client.Query("SELECT 1")
+	assert.NoError(t, err, "New connections should be accepted after dropping the open ones")
+
+	backend.FailStartup(&ServerError{Severity: "FATAL", Code: "53300", Message: "too many connections"})
+
+	_, err = Dial(backend.Addr(), ClientConfig{})
+	var serverErr *ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, "53300", serverErr.Code)
+}
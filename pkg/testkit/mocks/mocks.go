@@ -0,0 +1,333 @@
+// Package mocks provides test doubles for the enforcer's domain interfaces:
+// testify/mock based mocks for expectation-driven tests and recording stubs
+// for tests that only need to observe what happened.
+package mocks
+
+import (
+	"context"
+	"net"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+// QueryLogger is a mock domain.QueryLogger
+type QueryLogger struct {
+	mock.Mock
+}
+
+// LogQuery records the call and returns the configured error
+func (m *QueryLogger) LogQuery(connectionID string, query string) error {
+	args := m.Called(connectionID, query)
+	return args.Error(0)
+}
+
+// LogProtocolMessage records the call and returns the configured error
+func (m *QueryLogger) LogProtocolMessage(connectionID string, messageType string, details map[string]interface{}) error {
+	args := m.Called(connectionID, messageType, details)
+	return args.Error(0)
+}
+
+// LogNormalizedQuery records the call and returns the configured error
+func (m *QueryLogger) LogNormalizedQuery(connectionID string, normalizedQuery domain.NormalizedQuery) error {
+	args := m.Called(connectionID, normalizedQuery)
+	return args.Error(0)
+}
+
+// QueryNormalizer is a mock domain.QueryNormalizer
+type QueryNormalizer struct {
+	mock.Mock
+}
+
+// Normalize records the call and returns the configured result
+func (m *QueryNormalizer) Normalize(rawQuery string) (domain.NormalizedQuery, error) {
+	args := m.Called(rawQuery)
+	return args.Get(0).(domain.NormalizedQuery), args.Error(1)
+}
+
+// QueryAnalyzer is a mock domain.QueryAnalyzer
+type QueryAnalyzer struct {
+	mock.Mock
+}
+
+// AnalyzeQuery records the call and returns the configured result
+func (m *QueryAnalyzer) AnalyzeQuery(query *domain.Query) (*domain.QueryAnalysis, error) {
+	args := m.Called(query)
+	analysis, _ := args.Get(0).(*domain.QueryAnalysis)
+	return analysis, args.Error(1)
+}
+
+// UsageStore is a mock domain.UsageStore
+type UsageStore struct {
+	mock.Mock
+}
+
+// Increment records the call and returns the configured result
+func (m *UsageStore) Increment(ctx context.Context, key domain.UsageKey, window time.Duration, amount int64) (domain.Usage, error) {
+	args := m.Called(ctx, key, window, amount)
+	return args.Get(0).(domain.Usage), args.Error(1)
+}
+
+// Get records the call and returns the configured result
+func (m *UsageStore) Get(ctx context.Context, key domain.UsageKey, window time.Duration) (domain.Usage, error) {
+	args := m.Called(ctx, key, window)
+	return args.Get(0).(domain.Usage), args.Error(1)
+}
+
+// Reset records the call and returns the configured error
+func (m *UsageStore) Reset(ctx context.Context, key domain.UsageKey) error {
+	args := m.Called(ctx, key)
+	return args.Error(0)
+}
+
+// PolicyEngine is a mock domain.PolicyEngine
+type PolicyEngine struct {
+	mock.Mock
+}
+
+// Evaluate records the call and returns the configured result
+func (m *PolicyEngine) Evaluate(ctx context.Context, query *domain.Query) (domain.Decision, error) {
+	args := m.Called(ctx, query)
+	return args.Get(0).(domain.Decision), args.Error(1)
+}
+
+// ConnectionHandler is a mock domain.ConnectionHandler
+type ConnectionHandler struct {
+	mock.Mock
+}
+
+// HandleConnection records the call and returns the configured error
+func (m *ConnectionHandler) HandleConnection(ctx context.Context, conn net.Conn) error {
+	args := m.Called(ctx, conn)
+	return args.Error(0)
+}
+
+// FaultInjector is a mock domain.FaultInjector
+type FaultInjector struct {
+	mock.Mock
+}
+
+// Inject records the call and returns the configured error
+func (m *FaultInjector) Inject(ctx context.Context, point domain.FaultPoint) error {
+	args := m.Called(ctx, point)
+	return args.Error(0)
+}
+
+// MaintenanceGate is a mock domain.MaintenanceGate
+type MaintenanceGate struct {
+	mock.Mock
+}
+
+// Admit records the call and returns the configured result
+func (m *MaintenanceGate) Admit(ctx context.Context, database string) (*domain.MaintenanceWindow, error) {
+	args := m.Called(ctx, database)
+	window, _ := args.Get(0).(*domain.MaintenanceWindow)
+	return window, args.Error(1)
+}
+
+// EventSink is a mock domain.EventSink
+type EventSink struct {
+	mock.Mock
+}
+
+// Emit records the call
+func (m *EventSink) Emit(event domain.Event) {
+	m.Called(event)
+}
+
+// UpstreamResolver is a mock domain.UpstreamResolver
+type UpstreamResolver struct {
+	mock.Mock
+}
+
+// Resolve records the call and returns the configured result
+func (m *UpstreamResolver) Resolve(ctx context.Context) ([]domain.UpstreamTarget, time.Duration, error) {
+	args := m.Called(ctx)
+	targets, _ := args.Get(0).([]domain.UpstreamTarget)
+	return targets, args.Get(1).(time.Duration), args.Error(2)
+}
+
+// PoolerConsole is a mock domain.PoolerConsole
+type PoolerConsole struct {
+	mock.Mock
+}
+
+// Pools records the call and returns the configured result
+func (m *PoolerConsole) Pools(ctx context.Context) ([]domain.PoolStats, error) {
+	args := m.Called(ctx)
+	pools, _ := args.Get(0).([]domain.PoolStats)
+	return pools, args.Error(1)
+}
+
+// PoolerAdmin is a mock domain.PoolerAdmin
+type PoolerAdmin struct {
+	mock.Mock
+}
+
+// KillClients records the call and returns the configured result
+func (m *PoolerAdmin) KillClients(ctx context.Context, user, database string) (int, error) {
+	args := m.Called(ctx, user, database)
+	return args.Int(0), args.Error(1)
+}
+
+// Disable records the call and returns the configured error
+func (m *PoolerAdmin) Disable(ctx context.Context, database string) error {
+	return m.Called(ctx, database).Error(0)
+}
+
+// Enable records the call and returns the configured error
+func (m *PoolerAdmin) Enable(ctx context.Context, database string) error {
+	return m.Called(ctx, database).Error(0)
+}
+
+// ConnectionTracker is a mock domain.ConnectionTracker
+type ConnectionTracker struct {
+	mock.Mock
+}
+
+// Track records the call
+func (m *ConnectionTracker) Track(connectionID, user, database string, evict func()) {
+	m.Called(connectionID, user, database, evict)
+}
+
+// Busy records the call and returns the configured result
+func (m *ConnectionTracker) Busy(connectionID string) bool {
+	args := m.Called(connectionID)
+	return args.Bool(0)
+}
+
+// Idle records the call
+func (m *ConnectionTracker) Idle(connectionID string) {
+	m.Called(connectionID)
+}
+
+// Untrack records the call
+func (m *ConnectionTracker) Untrack(connectionID string) {
+	m.Called(connectionID)
+}
+
+// UpdateSession records the call
+func (m *ConnectionTracker) UpdateSession(connectionID string, state domain.SessionState) {
+	m.Called(connectionID, state)
+}
+
+// Register records the call
+func (m *ConnectionTracker) Register(session domain.Session, terminate func()) {
+	m.Called(session, terminate)
+}
+
+// QueryStarted records the call
+func (m *ConnectionTracker) QueryStarted(connectionID, query string) {
+	m.Called(connectionID, query)
+}
+
+// ConnectionLimiter is a mock domain.ConnectionLimiter
+type ConnectionLimiter struct {
+	mock.Mock
+}
+
+// AcquireConnection records the call and returns the configured decision with
+// a release function recording a Release call
+func (m *ConnectionLimiter) AcquireConnection(session domain.Session) (func(), domain.Decision) {
+	args := m.Called(session)
+	return func() { m.MethodCalled("Release") }, args.Get(0).(domain.Decision)
+}
+
+// AccessController is a mock domain.AccessController
+type AccessController struct {
+	mock.Mock
+}
+
+// AdmitAddress records the call and returns the configured result
+func (m *AccessController) AdmitAddress(listener string, addr net.Addr) bool {
+	return m.Called(listener, addr).Bool(0)
+}
+
+// AdmitUser records the call and returns the configured result
+func (m *AccessController) AdmitUser(listener, user string, addr net.Addr) bool {
+	return m.Called(listener, user, addr).Bool(0)
+}
+
+// IdentityResolver is a mock domain.IdentityResolver
+type IdentityResolver struct {
+	mock.Mock
+}
+
+// Groups records the call and returns the configured result
+func (m *IdentityResolver) Groups(ctx context.Context, user string) ([]string, error) {
+	args := m.Called(ctx, user)
+	groups, _ := args.Get(0).([]string)
+	return groups, args.Error(1)
+}
+
+// UpstreamSelector is a mock domain.UpstreamSelector
+type UpstreamSelector struct {
+	mock.Mock
+}
+
+// Next records the call and returns the configured result
+func (m *UpstreamSelector) Next() (domain.UpstreamTarget, bool) {
+	args := m.Called()
+	return args.Get(0).(domain.UpstreamTarget), args.Bool(1)
+}
+
+// UpstreamChecker is a mock domain.UpstreamChecker
+type UpstreamChecker struct {
+	mock.Mock
+}
+
+// Check records the call and returns the configured error
+func (m *UpstreamChecker) Check(ctx context.Context, address string) error {
+	return m.Called(ctx, address).Error(0)
+}
+
+// LeaderElector is a mock domain.LeaderElector
+type LeaderElector struct {
+	mock.Mock
+}
+
+// Lead records the call and returns the configured result
+func (m *LeaderElector) Lead(ctx context.Context) (time.Time, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(time.Time), args.Error(1)
+}
+
+// Resign records the call and returns the configured error
+func (m *LeaderElector) Resign(ctx context.Context) error {
+	return m.Called(ctx).Error(0)
+}
+
+// PolicyResources is a mock domain.PolicyResources
+type PolicyResources struct {
+	mock.Mock
+}
+
+// List records the call and returns the configured resources
+func (m *PolicyResources) List(ctx context.Context) ([]domain.PolicyResource, error) {
+	args := m.Called(ctx)
+	resources, _ := args.Get(0).([]domain.PolicyResource)
+	return resources, args.Error(1)
+}
+
+// Watch records the call
+func (m *PolicyResources) Watch(ctx context.Context, changed func()) {
+	m.Called(ctx, changed)
+}
+
+// SetStatus records the call and returns the configured error
+func (m *PolicyResources) SetStatus(ctx context.Context, resource domain.PolicyResource, err error) error {
+	return m.Called(ctx, resource, err).Error(0)
+}
+
+// PolicySink is a mock domain.PolicySink
+type PolicySink struct {
+	mock.Mock
+}
+
+// SyncPolicies records the call and returns the configured failures
+func (m *PolicySink) SyncPolicies(ctx context.Context, policies []domain.QuotaPolicy) (map[string]error, error) {
+	args := m.Called(ctx, policies)
+	failures, _ := args.Get(0).(map[string]error)
+	return failures, args.Error(1)
+}
@@ -0,0 +1,65 @@
+package mocks
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageStore_Expectations(t *testing.T) {
+	store := &UsageStore{}
+	key := domain.UsageKey{Policy: "default", User: "alice", Database: "app"}
+	resetAt := time.Now().Add(time.Hour)
+
+	store.On("Increment", mock.Anything, key, time.Hour, int64(1)).
+		Return(domain.Usage{Used: 3, ResetAt: resetAt}, nil).Once()
+
+	usage, err := store.Increment(context.Background(), key, time.Hour, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), usage.Used)
+	assert.Equal(t, resetAt, usage.ResetAt)
+
+	store.AssertExpectations(t)
+}
+
+func TestRecordingQueryLogger(t *testing.T) {
+	queryLogger := NewRecordingQueryLogger()
+
+	go func() {
+		_ = queryLogger.LogQuery("conn_1", "SELECT 1")
+		_ = queryLogger.LogQuery("conn_1", "SELECT 2")
+	}()
+
+	received := queryLogger.WaitForQueries(2, time.Second)
+	assert.Equal(t, []string{"SELECT 1", "SELECT 2"}, received)
+
+	require.NoError(t, queryLogger.LogNormalizedQuery("conn_1", domain.NormalizedQuery{Normalized: "SELECT $1"}))
+	require.NoError(t, queryLogger.LogProtocolMessage("conn_1", "Query", map[string]interface{}{"query": "SELECT 1"}))
+
+	assert.Equal(t, []string{"SELECT 1", "SELECT 2"}, queryLogger.Queries())
+	require.Len(t, queryLogger.NormalizedQueries(), 1)
+	assert.Equal(t, "SELECT $1", queryLogger.NormalizedQueries()[0].Normalized)
+	assert.Equal(t, []string{"Query: map[query:SELECT 1]"}, queryLogger.ProtocolMessages())
+
+	assert.Empty(t, queryLogger.WaitForQueries(1, 10*time.Millisecond))
+}
+
+func TestStaticPolicyEngine(t *testing.T) {
+	engine := &StaticPolicyEngine{}
+
+	decision, err := engine.Evaluate(context.Background(), domain.NewQuery("SELECT 1", "conn_1"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed())
+
+	engine.Decision = domain.Decision{Action: domain.DecisionDeny, Policy: "default"}
+	decision, err = engine.Evaluate(context.Background(), domain.NewQuery("SELECT 2", "conn_1"))
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed())
+	assert.Len(t, engine.Queries(), 2)
+}
@@ -0,0 +1,224 @@
+package mocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"sync"
+	"time"
+)
+
+// RecordingQueryLogger implements domain.QueryLogger and domain.SessionLogger by
+// keeping every event in memory
+type RecordingQueryLogger struct {
+	mu                sync.Mutex
+	queries           []string
+	normalizedQueries []domain.NormalizedQuery
+	protocolMessages  []string
+	sessions          []domain.Session
+	queryCh           chan string
+}
+
+// NewRecordingQueryLogger creates a RecordingQueryLogger
+func NewRecordingQueryLogger() *RecordingQueryLogger {
+	return &RecordingQueryLogger{
+		queryCh: make(chan string, 1024),
+	}
+}
+
+// LogQuery records a query
+func (l *RecordingQueryLogger) LogQuery(connectionID string, query string) error {
+	l.mu.Lock()
+	l.queries = append(l.queries, query)
+	l.mu.Unlock()
+
+	select {
+	case l.queryCh <- query:
+	default:
+	}
+	return nil
+}
+
+// LogNormalizedQuery records a normalized query
+func (l *RecordingQueryLogger) LogNormalizedQuery(connectionID string, normalizedQuery domain.NormalizedQuery) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.normalizedQueries = append(l.normalizedQueries, normalizedQuery)
+	return nil
+}
+
+// LogProtocolMessage records a protocol message as "Type: details"
+func (l *RecordingQueryLogger) LogProtocolMessage(connectionID string, messageType string, details map[string]interface{}) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.protocolMessages = append(l.protocolMessages, fmt.Sprintf("%s: %v", messageType, details))
+	return nil
+}
+
+// StartSession records a session
+func (l *RecordingQueryLogger) StartSession(session domain.Session) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sessions = append(l.sessions, session)
+	return nil
+}
+
+// EndSession is a no-op; sessions stay recorded after their connection closes
+func (l *RecordingQueryLogger) EndSession(connectionID string) {}
+
+// Sessions returns the recorded sessions
+func (l *RecordingQueryLogger) Sessions() []domain.Session {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]domain.Session(nil), l.sessions...)
+}
+
+// Queries returns the recorded queries
+func (l *RecordingQueryLogger) Queries() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.queries...)
+}
+
+// NormalizedQueries returns the recorded normalized queries
+func (l *RecordingQueryLogger) NormalizedQueries() []domain.NormalizedQuery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]domain.NormalizedQuery(nil), l.normalizedQueries...)
+}
+
+// ProtocolMessages returns the recorded protocol messages
+func (l *RecordingQueryLogger) ProtocolMessages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.protocolMessages...)
+}
+
+// WaitForQueries blocks until count queries were logged since the last wait
+// or the timeout expires, and returns the queries received while waiting
+func (l *RecordingQueryLogger) WaitForQueries(count int, timeout time.Duration) []string {
+	timeoutCh := time.After(timeout)
+	received := make([]string, 0, count)
+
+	for len(received) < count {
+		select {
+		case query := <-l.queryCh:
+			received = append(received, query)
+		case <-timeoutCh:
+			return received
+		}
+	}
+	return received
+}
+
+// StaticPolicyEngine implements domain.PolicyEngine by returning a fixed decision,
+// and domain.UsageRecorder by keeping the recorded statement usage
+type StaticPolicyEngine struct {
+	Decision domain.Decision
+
+	mu      sync.Mutex
+	queries []*domain.Query
+	usage   []domain.StatementUsage
+}
+
+// Evaluate records the query and returns the configured decision
+func (e *StaticPolicyEngine) Evaluate(ctx context.Context, query *domain.Query) (domain.Decision, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.queries = append(e.queries, query)
+
+	if e.Decision.Action == "" {
+		return domain.AllowDecision(), nil
+	}
+	return e.Decision, nil
+}
+
+// Queries returns the evaluated queries
+func (e *StaticPolicyEngine) Queries() []*domain.Query {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*domain.Query(nil), e.queries...)
+}
+
+// RecordUsage records what a statement consumed
+func (e *StaticPolicyEngine) RecordUsage(ctx context.Context, query *domain.Query, usage domain.StatementUsage) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.usage = append(e.usage, usage)
+	return nil
+}
+
+// Usage returns the recorded statement usage
+func (e *StaticPolicyEngine) Usage() []domain.StatementUsage {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]domain.StatementUsage(nil), e.usage...)
+}
+
+// RecordingEventSink implements domain.EventSink by keeping every event in memory
+type RecordingEventSink struct {
+	mu     sync.Mutex
+	events []domain.Event
+}
+
+// Emit records the event
+func (s *RecordingEventSink) Emit(event domain.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+}
+
+// Events returns the recorded events
+func (s *RecordingEventSink) Events() []domain.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]domain.Event(nil), s.events...)
+}
+
+// EventsOfType returns the recorded events of the given type
+func (s *RecordingEventSink) EventsOfType(eventType domain.EventType) []domain.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []domain.Event
+	for _, event := range s.events {
+		if event.Type == eventType {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// ConnectionHandlerFunc adapts a function to domain.ConnectionHandler
+type ConnectionHandlerFunc func(ctx context.Context, conn net.Conn) error
+
+// HandleConnection calls f
+func (f ConnectionHandlerFunc) HandleConnection(ctx context.Context, conn net.Conn) error {
+	return f(ctx, conn)
+}
+
+// Compile-time checks that the doubles satisfy the domain interfaces
+var (
+	_ domain.QueryLogger       = (*QueryLogger)(nil)
+	_ domain.QueryNormalizer   = (*QueryNormalizer)(nil)
+	_ domain.QueryAnalyzer     = (*QueryAnalyzer)(nil)
+	_ domain.UsageStore        = (*UsageStore)(nil)
+	_ domain.PolicyEngine      = (*PolicyEngine)(nil)
+	_ domain.ConnectionHandler = (*ConnectionHandler)(nil)
+	_ domain.FaultInjector     = (*FaultInjector)(nil)
+	_ domain.MaintenanceGate   = (*MaintenanceGate)(nil)
+	_ domain.EventSink         = (*EventSink)(nil)
+	_ domain.UpstreamResolver  = (*UpstreamResolver)(nil)
+	_ domain.PoolerConsole     = (*PoolerConsole)(nil)
+	_ domain.PoolerAdmin       = (*PoolerAdmin)(nil)
+	_ domain.ConnectionTracker = (*ConnectionTracker)(nil)
+	_ domain.SessionRegistry   = (*ConnectionTracker)(nil)
+	_ domain.UpstreamSelector  = (*UpstreamSelector)(nil)
+	_ domain.UpstreamChecker   = (*UpstreamChecker)(nil)
+	_ domain.QueryLogger       = (*RecordingQueryLogger)(nil)
+	_ domain.SessionLogger     = (*RecordingQueryLogger)(nil)
+	_ domain.PolicyEngine      = (*StaticPolicyEngine)(nil)
+	_ domain.EventSink         = (*RecordingEventSink)(nil)
+	_ domain.ConnectionHandler = ConnectionHandlerFunc(nil)
+)
@@ -0,0 +1,42 @@
+// Package testkit provides a scriptable fake PostgreSQL backend, client
+// helpers and a controllable clock for testing code that embeds or extends
+// the quota enforcer without Docker, fixed ports or sleeps.
+package testkit
+
+import (
+	"testing"
+)
+
+// StartFakeBackend starts a FakeBackend on an ephemeral port and closes it when the test ends
+func StartFakeBackend(tb testing.TB) *FakeBackend {
+	tb.Helper()
+
+	backend := NewFakeBackend()
+	if err := backend.Start(); err != nil {
+		tb.Fatalf("failed to start fake backend: %v", err)
+	}
+
+	tb.Cleanup(func() {
+		if err := backend.Close(); err != nil {
+			tb.Errorf("failed to close fake backend: %v", err)
+		}
+	})
+
+	return backend
+}
+
+// MustDial connects a Client to addr and closes it when the test ends
+func MustDial(tb testing.TB, addr string, config ClientConfig) *Client {
+	tb.Helper()
+
+	client, err := Dial(addr, config)
+	if err != nil {
+		tb.Fatalf("failed to dial %s: %v", addr, err)
+	}
+
+	tb.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	return client
+}
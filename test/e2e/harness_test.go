@@ -0,0 +1,131 @@
+//go:build e2e
+
+// Package e2e runs pgx workloads against real PostgreSQL and PgBouncer
+// containers started with testcontainers. Tests skip when no Docker
+// daemon is reachable.
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/network"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+const (
+	postgresImage  = "postgres:16-alpine"
+	pgbouncerImage = "edoburu/pgbouncer:latest"
+
+	databaseName     = "enforcer"
+	databaseUser     = "enforcer"
+	databasePassword = "enforcer"
+
+	postgresAlias = "postgres"
+)
+
+// Stack describes the containers started for a test
+type Stack struct {
+	Network *testcontainers.DockerNetwork
+
+	// PostgresAddr is the host-reachable address of the PostgreSQL container
+	PostgresAddr string
+
+	// PgBouncerAddr is the host-reachable address of the PgBouncer container,
+	// empty when the stack was started without PgBouncer
+	PgBouncerAddr string
+}
+
+// StackOptions selects which containers to start
+type StackOptions struct {
+	WithPgBouncer bool
+}
+
+// StartStack starts PostgreSQL (and optionally PgBouncer) on a dedicated network.
+// Containers are removed when the test finishes.
+func StartStack(t *testing.T, opts StackOptions) *Stack {
+	t.Helper()
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	nw, err := network.New(ctx)
+	require.NoError(t, err, "Failed to create docker network")
+	testcontainers.CleanupNetwork(t, nw)
+
+	pg, err := postgres.Run(ctx, postgresImage,
+		postgres.WithDatabase(databaseName),
+		postgres.WithUsername(databaseUser),
+		postgres.WithPassword(databasePassword),
+		postgres.BasicWaitStrategies(),
+		network.WithNetwork([]string{postgresAlias}, nw),
+	)
+	testcontainers.CleanupContainer(t, pg)
+	require.NoError(t, err, "Failed to start PostgreSQL container")
+
+	stack := &Stack{Network: nw}
+	stack.PostgresAddr, err = pg.PortEndpoint(ctx, "5432/tcp", "")
+	require.NoError(t, err, "Failed to resolve PostgreSQL address")
+
+	if opts.WithPgBouncer {
+		bouncer, err := testcontainers.Run(ctx, pgbouncerImage,
+			testcontainers.WithEnv(map[string]string{
+				"DATABASE_URL": fmt.Sprintf("postgres://%s:%s@%s:5432/%s", databaseUser, databasePassword, postgresAlias, databaseName),
+				"AUTH_TYPE":    "scram-sha-256",
+				"POOL_MODE":    "transaction",
+				"LISTEN_PORT":  "5432",
+			}),
+			testcontainers.WithExposedPorts("5432/tcp"),
+			testcontainers.WithWaitStrategy(wait.ForListeningPort("5432/tcp")),
+			network.WithNetwork([]string{"pgbouncer"}, nw),
+		)
+		testcontainers.CleanupContainer(t, bouncer)
+		require.NoError(t, err, "Failed to start PgBouncer container")
+
+		stack.PgBouncerAddr, err = bouncer.PortEndpoint(ctx, "5432/tcp", "")
+		require.NoError(t, err, "Failed to resolve PgBouncer address")
+	}
+
+	return stack
+}
+
+// DSN builds a connection string for addr using the stack credentials.
+// The simple protocol is forced so every statement is a single Query message,
+// which keeps the workload compatible with PgBouncer transaction pooling.
+func DSN(addr string) string {
+	return fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable&default_query_exec_mode=simple_protocol",
+		databaseUser, databasePassword, addr, databaseName)
+}
+
+// WorkloadResult holds the outcome of every statement of a workload
+type WorkloadResult struct {
+	Succeeded int
+	Errors    []error
+}
+
+// RunWorkload opens a single connection to dsn and executes statements in order,
+// collecting per-statement errors instead of stopping at the first one
+func RunWorkload(ctx context.Context, t *testing.T, dsn string, statements []string) WorkloadResult {
+	t.Helper()
+
+	conn, err := pgx.Connect(ctx, dsn)
+	require.NoError(t, err, "Failed to connect to %s", dsn)
+	defer conn.Close(context.Background())
+
+	var result WorkloadResult
+	for _, statement := range statements {
+		if _, err := conn.Exec(ctx, statement); err != nil {
+			result.Errors = append(result.Errors, fmt.Errorf("%s: %w", statement, err))
+			continue
+		}
+		result.Succeeded++
+	}
+	return result
+}
@@ -0,0 +1,66 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgbouncer-quota-enforcer/internal/app/domain"
+	"pgbouncer-quota-enforcer/internal/infra/adapters"
+	"pgbouncer-quota-enforcer/pkg/logger"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestE2E_PostgresUsageStore(t *testing.T) {
+	stack := StartStack(t, StackOptions{})
+	dsn := DSN(stack.PostgresAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	store, err := adapters.NewPostgresUsageStore(ctx, dsn, logger.NewSimpleLogger())
+	require.NoError(t, err)
+
+	key := domain.UsageKey{Policy: "default", User: "alice", Database: "app"}
+	for i := 0; i < 3; i++ {
+		_, err := store.Increment(ctx, key, time.Hour, 2)
+		require.NoError(t, err)
+	}
+	require.NoError(t, store.Close())
+
+	// Policies are managed with SQL
+	conn, err := pgx.Connect(ctx, dsn)
+	require.NoError(t, err)
+	defer conn.Close(context.Background())
+	_, err = conn.Exec(ctx, `INSERT INTO quota_enforcer.quota_policies (name, user_name, labels, query_limit, time_window)
+		VALUES ('default', 'alice', '{"team": "billing"}', 100, '1 hour')`)
+	require.NoError(t, err)
+
+	var used int64
+	require.NoError(t, conn.QueryRow(ctx, `SELECT used FROM quota_enforcer.quota_usage WHERE user_name = 'alice'`).Scan(&used))
+	assert.Equal(t, int64(6), used, "Increments should be written in a batch on close")
+
+	// Migrations are applied once and usage survives a restart
+	store, err = adapters.NewPostgresUsageStore(ctx, dsn, logger.NewSimpleLogger())
+	require.NoError(t, err)
+	defer store.Close()
+
+	usage, err := store.Get(ctx, key, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), usage.Used)
+
+	policies, err := store.LoadPolicies(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []domain.QuotaPolicy{{
+		Name:   "default",
+		User:   "alice",
+		Labels: map[string]string{"team": "billing"},
+		Limit:  100,
+		Window: time.Hour,
+	}}, policies)
+}
@@ -0,0 +1,44 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var basicWorkload = []string{
+	"CREATE TABLE IF NOT EXISTS quota_usage (id INTEGER PRIMARY KEY, usage BIGINT)",
+	"INSERT INTO quota_usage VALUES (1, 1000) ON CONFLICT (id) DO NOTHING",
+	"SELECT * FROM quota_usage WHERE id = 1",
+	"UPDATE quota_usage SET usage = usage + 1 WHERE id = 1",
+	"DELETE FROM quota_usage WHERE id = 1",
+	"DROP TABLE quota_usage",
+}
+
+func TestE2E_PostgresWorkload(t *testing.T) {
+	stack := StartStack(t, StackOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result := RunWorkload(ctx, t, DSN(stack.PostgresAddr), basicWorkload)
+
+	assert.Empty(t, result.Errors)
+	assert.Equal(t, len(basicWorkload), result.Succeeded)
+}
+
+func TestE2E_PgBouncerWorkload(t *testing.T) {
+	stack := StartStack(t, StackOptions{WithPgBouncer: true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result := RunWorkload(ctx, t, DSN(stack.PgBouncerAddr), basicWorkload)
+
+	assert.Empty(t, result.Errors)
+	assert.Equal(t, len(basicWorkload), result.Succeeded)
+}
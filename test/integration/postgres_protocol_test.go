@@ -5,13 +5,11 @@ package integration
 
 import (
 	"context"
-	"fmt"
 	"net"
-	"pgbouncer-quota-enforcer/internal/app/domain"
 	"pgbouncer-quota-enforcer/internal/infra/adapters"
 	"pgbouncer-quota-enforcer/pkg/logger"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
 	"strings"
-	"sync"
 	"testing"
 	"time"
 
@@ -20,94 +18,11 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-// TestQueryLogger captures queries for testing
-type TestQueryLogger struct {
-	queries           []string
-	normalizedQueries []string
-	protocolMsgs      []string
-	mu                sync.Mutex
-	expectedQueries   int
-	queryChannel      chan string
-}
-
-func NewTestQueryLogger(expectedQueries int) *TestQueryLogger {
-	return &TestQueryLogger{
-		queries:           make([]string, 0),
-		normalizedQueries: make([]string, 0),
-		protocolMsgs:      make([]string, 0),
-		expectedQueries:   expectedQueries,
-		queryChannel:      make(chan string, expectedQueries),
-	}
-}
-
-func (t *TestQueryLogger) LogQuery(connectionID string, query string) error {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	t.queries = append(t.queries, query)
-
-	// Send to channel for synchronization
-	select {
-	case t.queryChannel <- query:
-	default:
-	}
-
-	return nil
-}
-
-func (t *TestQueryLogger) LogNormalizedQuery(connectionID string, normalizedQuery domain.NormalizedQuery) error {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	t.normalizedQueries = append(t.normalizedQueries, normalizedQuery.Normalized)
-	return nil
-}
-
-func (t *TestQueryLogger) LogProtocolMessage(connectionID string, messageType string, details map[string]interface{}) error {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	msg := fmt.Sprintf("%s: %v", messageType, details)
-	t.protocolMsgs = append(t.protocolMsgs, msg)
-	return nil
-}
-
-func (t *TestQueryLogger) GetQueries() []string {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	return append([]string(nil), t.queries...)
-}
-
-func (t *TestQueryLogger) GetNormalizedQueries() []string {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	return append([]string(nil), t.normalizedQueries...)
-}
-
-func (t *TestQueryLogger) GetProtocolMessages() []string {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	return append([]string(nil), t.protocolMsgs...)
-}
-
-func (t *TestQueryLogger) WaitForQueries(timeout time.Duration) []string {
-	timeoutCh := time.After(timeout)
-	receivedQueries := make([]string, 0, t.expectedQueries)
-
-	for len(receivedQueries) < t.expectedQueries {
-		select {
-		case query := <-t.queryChannel:
-			receivedQueries = append(receivedQueries, query)
-		case <-timeoutCh:
-			return receivedQueries
-		}
-	}
-
-	return receivedQueries
-}
-
 func TestPostgreSQLProtocolParsing(t *testing.T) {
 	t.Log("=== Starting PostgreSQL Protocol Parsing Test ===")
 
 	// Create test logger to capture queries
-	testQueryLogger := NewTestQueryLogger(2)
+	testQueryLogger := mocks.NewRecordingQueryLogger()
 
 	// Create service with our test logger
 	log := logger.NewSimpleLogger()
@@ -119,11 +34,11 @@ func TestPostgreSQLProtocolParsing(t *testing.T) {
 	serverCtx, serverCancel := context.WithCancel(context.Background())
 	defer serverCancel()
 
-	err := tcpServer.Start(serverCtx, ":15433")
+	err := tcpServer.Start(serverCtx, "127.0.0.1:0")
 	require.NoError(t, err, "Failed to start test server")
 
-	// Give server time to start
-	time.Sleep(200 * time.Millisecond)
+	// Wait until the server accepts connections
+	<-tcpServer.Started()
 
 	// Ensure server is stopped when test completes
 	defer func() {
@@ -133,10 +48,10 @@ func TestPostgreSQLProtocolParsing(t *testing.T) {
 		tcpServer.Stop(shutdownCtx)
 	}()
 
-	t.Log("Server started on port 15433")
+	t.Logf("Server started on %s", tcpServer.Address())
 
 	// Connect to server and send PostgreSQL protocol messages
-	conn, err := net.Dial("tcp", "localhost:15433")
+	conn, err := net.Dial("tcp", tcpServer.Address())
 	require.NoError(t, err, "Failed to connect to test server")
 	defer conn.Close()
 
@@ -166,7 +81,7 @@ func TestPostgreSQLProtocolParsing(t *testing.T) {
 
 	// Wait for queries to be processed and logged
 	t.Log("Waiting for queries to be processed...")
-	receivedQueries := testQueryLogger.WaitForQueries(3 * time.Second)
+	receivedQueries := testQueryLogger.WaitForQueries(len(testQueries), 3*time.Second)
 
 	// Verify queries were captured
 	t.Logf("Expected %d queries, got %d", len(testQueries), len(receivedQueries))
@@ -180,18 +95,18 @@ func TestPostgreSQLProtocolParsing(t *testing.T) {
 	}
 
 	// Verify normalized queries were also captured
-	normalizedQueries := testQueryLogger.GetNormalizedQueries()
+	normalizedQueries := testQueryLogger.NormalizedQueries()
 	t.Logf("Total normalized queries captured: %d", len(normalizedQueries))
 	for i, normalizedQuery := range normalizedQueries {
-		t.Logf("Normalized query %d: %s", i+1, normalizedQuery)
+		t.Logf("Normalized query %d: %s", i+1, normalizedQuery.Normalized)
 	}
 
 	// Verify we have normalized queries for each original query
 	assert.Equal(t, len(testQueries), len(normalizedQueries), "Should have normalized version of each query")
 
 	// Get all queries and protocol messages for logging
-	allQueries := testQueryLogger.GetQueries()
-	allProtocolMsgs := testQueryLogger.GetProtocolMessages()
+	allQueries := testQueryLogger.Queries()
+	allProtocolMsgs := testQueryLogger.ProtocolMessages()
 
 	t.Logf("Total queries captured: %d", len(allQueries))
 	for i, query := range allQueries {
@@ -210,7 +125,7 @@ func TestPostgreSQLProtocolMessagesHandling(t *testing.T) {
 	t.Log("=== Starting PostgreSQL Protocol Messages Test ===")
 
 	// Create test logger to capture messages
-	testQueryLogger := NewTestQueryLogger(1)
+	testQueryLogger := mocks.NewRecordingQueryLogger()
 
 	// Create service with our test logger
 	log := logger.NewSimpleLogger()
@@ -222,11 +137,11 @@ func TestPostgreSQLProtocolMessagesHandling(t *testing.T) {
 	serverCtx, serverCancel := context.WithCancel(context.Background())
 	defer serverCancel()
 
-	err := tcpServer.Start(serverCtx, ":15434")
+	err := tcpServer.Start(serverCtx, "127.0.0.1:0")
 	require.NoError(t, err, "Failed to start test server")
 
-	// Give server time to start
-	time.Sleep(200 * time.Millisecond)
+	// Wait until the server accepts connections
+	<-tcpServer.Started()
 
 	// Ensure server is stopped when test completes
 	defer func() {
@@ -236,10 +151,10 @@ func TestPostgreSQLProtocolMessagesHandling(t *testing.T) {
 		tcpServer.Stop(shutdownCtx)
 	}()
 
-	t.Log("Server started on port 15434")
+	t.Logf("Server started on %s", tcpServer.Address())
 
 	// Connect to server
-	conn, err := net.Dial("tcp", "localhost:15434")
+	conn, err := net.Dial("tcp", tcpServer.Address())
 	require.NoError(t, err, "Failed to connect to test server")
 	defer conn.Close()
 
@@ -268,15 +183,15 @@ func TestPostgreSQLProtocolMessagesHandling(t *testing.T) {
 	require.NoError(t, err, "Failed to send query message")
 
 	// Wait for processing
-	receivedQueries := testQueryLogger.WaitForQueries(3 * time.Second)
+	receivedQueries := testQueryLogger.WaitForQueries(1, 3*time.Second)
 
 	// Give extra time for normalization processing
 	time.Sleep(1 * time.Second)
 
 	// Check results
-	allQueries := testQueryLogger.GetQueries()
-	allNormalizedQueries := testQueryLogger.GetNormalizedQueries()
-	allProtocolMsgs := testQueryLogger.GetProtocolMessages()
+	allQueries := testQueryLogger.Queries()
+	allNormalizedQueries := testQueryLogger.NormalizedQueries()
+	allProtocolMsgs := testQueryLogger.ProtocolMessages()
 
 	t.Logf("Total queries captured: %d", len(allQueries))
 	for i, query := range allQueries {
@@ -285,7 +200,7 @@ func TestPostgreSQLProtocolMessagesHandling(t *testing.T) {
 
 	t.Logf("Total normalized queries captured: %d", len(allNormalizedQueries))
 	for i, query := range allNormalizedQueries {
-		t.Logf("Normalized query %d: %s", i+1, query)
+		t.Logf("Normalized query %d: %s", i+1, query.Normalized)
 	}
 
 	t.Logf("Total protocol messages captured: %d", len(allProtocolMsgs))
@@ -301,7 +216,7 @@ func TestPostgreSQLProtocolMessagesHandling(t *testing.T) {
 
 	// Verify we got normalized queries too (with less strict assertion)
 	if len(allNormalizedQueries) > 0 {
-		assert.Equal(t, "SELECT NOW();", allNormalizedQueries[0], "Normalized query should be the same for this simple query")
+		assert.Equal(t, "SELECT NOW();", allNormalizedQueries[0].Normalized, "Normalized query should be the same for this simple query")
 		t.Log("✓ Normalized query captured correctly")
 	} else {
 		t.Log("⚠ No normalized queries captured - this might be a timing issue")
@@ -6,10 +6,9 @@ package integration
 import (
 	"context"
 	"net"
-	"pgbouncer-quota-enforcer/internal/app/domain"
 	"pgbouncer-quota-enforcer/internal/infra/adapters"
 	"pgbouncer-quota-enforcer/pkg/logger"
-	"sync"
+	"pgbouncer-quota-enforcer/pkg/testkit/mocks"
 	"testing"
 	"time"
 
@@ -18,83 +17,11 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-// NormalizationTestLogger captures both original and normalized queries
-type NormalizationTestLogger struct {
-	queries         []string
-	normalizedData  []domain.NormalizedQuery
-	mu              sync.Mutex
-	expectedQueries int
-	queryChannel    chan string
-}
-
-func NewNormalizationTestLogger(expectedQueries int) *NormalizationTestLogger {
-	return &NormalizationTestLogger{
-		queries:         make([]string, 0),
-		normalizedData:  make([]domain.NormalizedQuery, 0),
-		expectedQueries: expectedQueries,
-		queryChannel:    make(chan string, expectedQueries),
-	}
-}
-
-func (t *NormalizationTestLogger) LogQuery(connectionID string, query string) error {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	t.queries = append(t.queries, query)
-
-	// Send to channel for synchronization
-	select {
-	case t.queryChannel <- query:
-	default:
-	}
-
-	return nil
-}
-
-func (t *NormalizationTestLogger) LogNormalizedQuery(connectionID string, normalizedQuery domain.NormalizedQuery) error {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	t.normalizedData = append(t.normalizedData, normalizedQuery)
-	return nil
-}
-
-func (t *NormalizationTestLogger) LogProtocolMessage(connectionID string, messageType string, details map[string]interface{}) error {
-	// No-op for this test
-	return nil
-}
-
-func (t *NormalizationTestLogger) GetQueries() []string {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	return append([]string(nil), t.queries...)
-}
-
-func (t *NormalizationTestLogger) GetNormalizedData() []domain.NormalizedQuery {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	return append([]domain.NormalizedQuery(nil), t.normalizedData...)
-}
-
-func (t *NormalizationTestLogger) WaitForQueries(timeout time.Duration) []string {
-	timeoutCh := time.After(timeout)
-	receivedQueries := make([]string, 0, t.expectedQueries)
-
-	for len(receivedQueries) < t.expectedQueries {
-		select {
-		case query := <-t.queryChannel:
-			receivedQueries = append(receivedQueries, query)
-		case <-timeoutCh:
-			return receivedQueries
-		}
-	}
-
-	return receivedQueries
-}
-
 func TestQueryNormalizationIntegration(t *testing.T) {
 	t.Log("=== Starting Query Normalization Integration Test ===")
 
 	// Create test logger to capture normalization data
-	testLogger := NewNormalizationTestLogger(4)
+	testLogger := mocks.NewRecordingQueryLogger()
 
 	// Create service with our test logger
 	log := logger.NewSimpleLogger()
@@ -106,11 +33,11 @@ func TestQueryNormalizationIntegration(t *testing.T) {
 	serverCtx, serverCancel := context.WithCancel(context.Background())
 	defer serverCancel()
 
-	err := tcpServer.Start(serverCtx, ":15435")
+	err := tcpServer.Start(serverCtx, "127.0.0.1:0")
 	require.NoError(t, err, "Failed to start test server")
 
-	// Give server time to start
-	time.Sleep(200 * time.Millisecond)
+	// Wait until the server accepts connections
+	<-tcpServer.Started()
 
 	// Ensure server is stopped when test completes
 	defer func() {
@@ -120,10 +47,10 @@ func TestQueryNormalizationIntegration(t *testing.T) {
 		tcpServer.Stop(shutdownCtx)
 	}()
 
-	t.Log("Server started on port 15435")
+	t.Logf("Server started on %s", tcpServer.Address())
 
 	// Connect to server
-	conn, err := net.Dial("tcp", "localhost:15435")
+	conn, err := net.Dial("tcp", tcpServer.Address())
 	require.NoError(t, err, "Failed to connect to test server")
 	defer conn.Close()
 
@@ -175,13 +102,13 @@ func TestQueryNormalizationIntegration(t *testing.T) {
 
 	// Wait for queries to be processed
 	t.Log("Waiting for queries to be processed...")
-	receivedQueries := testLogger.WaitForQueries(5 * time.Second)
+	receivedQueries := testLogger.WaitForQueries(len(testQueries), 5*time.Second)
 
 	// Verify all queries were received
 	require.Equal(t, len(testQueries), len(receivedQueries), "All queries should be received")
 
 	// Get normalization data
-	normalizedData := testLogger.GetNormalizedData()
+	normalizedData := testLogger.NormalizedQueries()
 	require.Equal(t, len(testQueries), len(normalizedData), "All queries should have normalization data")
 
 	// Verify each query was normalized correctly
@@ -229,7 +156,7 @@ func TestQueryNormalizationIntegration(t *testing.T) {
 	time.Sleep(1 * time.Second)
 
 	// Get updated normalization data
-	finalNormalizedData := testLogger.GetNormalizedData()
+	finalNormalizedData := testLogger.NormalizedQueries()
 
 	// The first query and the two equivalent queries should have the same hash
 	if len(finalNormalizedData) >= 3 {
@@ -5,6 +5,7 @@ package integration
 
 import (
 	"context"
+	"net"
 	"os/exec"
 	"pgbouncer-quota-enforcer/internal/app"
 	"strings"
@@ -29,17 +30,18 @@ func TestSimplePsqlConnection(t *testing.T) {
 	t.Log("=== Starting PostgreSQL Integration Test ===")
 
 	// Start the server
-	serverService := app.NewServerService(app.ServerConfig{})
+	serverService, err := app.NewServerService(app.ServerConfig{})
+	require.NoError(t, err, "Failed to create test server")
 
 	// Start server in background
 	serverCtx, serverCancel := context.WithCancel(context.Background())
 	defer serverCancel()
 
-	err := serverService.Start(serverCtx, ":15432")
+	err = serverService.Start(serverCtx, "127.0.0.1:0")
 	require.NoError(t, err, "Failed to start test server")
 
-	// Give server time to start
-	time.Sleep(200 * time.Millisecond)
+	// Wait until the server accepts connections
+	<-serverService.Started()
 
 	// Ensure server is stopped when test completes
 	defer func() {
@@ -49,7 +51,10 @@ func TestSimplePsqlConnection(t *testing.T) {
 		serverService.Stop(shutdownCtx)
 	}()
 
-	t.Log("Server started on port 15432")
+	t.Logf("Server started on %s", serverService.Address())
+
+	_, port, err := net.SplitHostPort(serverService.Address())
+	require.NoError(t, err, "Failed to resolve server port")
 	t.Log("Sending PostgreSQL connection attempts...")
 
 	// Define a set of queries to test different PostgreSQL message types
@@ -78,7 +83,7 @@ func TestSimplePsqlConnection(t *testing.T) {
 
 		cmd := exec.CommandContext(ctx, "psql",
 			"-h", "localhost",
-			"-p", "15432",
+			"-p", port,
 			"-U", "testuser",
 			"-d", "testdb",
 			"-c", query,